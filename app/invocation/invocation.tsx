@@ -47,6 +47,7 @@ import TargetV2Component from "../target/target_v2";
 import { ExecuteOperation, ExecutionStage, executionStatusLabel, waitExecution } from "./execution_status";
 import { PlayCircle, PlayCircleIcon } from "lucide-react";
 import InvocationCoverageCardComponent from "./invocation_coverage_card";
+import WorkflowArtifactsCardComponent from "./workflow_artifacts_card";
 
 interface State {
   loading: boolean;
@@ -622,6 +623,13 @@ export default class InvocationComponent extends React.Component<Props, State> {
               <CacheRequestsCardComponent model={this.state.model} search={this.props.search} />
             )}
 
+          {this.state.model.isWorkflowInvocation() && (activeTab === "all" || activeTab === "artifacts") && (
+            <WorkflowArtifactsCardComponent
+              model={this.state.model}
+              filter={this.props.search.get("artifactFilter") ?? ""}
+            />
+          )}
+
           {(activeTab === "all" || activeTab === "artifacts") && (
             <ArtifactsCardComponent
               model={this.state.model}
@@ -31,11 +31,12 @@ interface State {
   isOpen: boolean;
   isLoading: boolean;
   acl?: acl.ACL;
+  downloadPermission: invocation.InvocationPermission;
   error?: string;
   keyboardShortcutHandle: string;
 }
 
-type VisibilitySelection = "group" | "public";
+type VisibilitySelection = "owner" | "group" | "public";
 
 export default class InvocationShareButtonComponent extends React.Component<
   InvocationShareButtonComponentProps,
@@ -71,6 +72,7 @@ export default class InvocationShareButtonComponent extends React.Component<
     return {
       isOpen: false,
       acl: this.props.model.invocation.acl ?? undefined,
+      downloadPermission: this.props.model.invocation.downloadPermission || invocation.InvocationPermission.PUBLIC,
       isLoading: false,
       keyboardShortcutHandle: "",
     };
@@ -90,20 +92,35 @@ export default class InvocationShareButtonComponent extends React.Component<
 
   private async onVisibilitySelectionChange(e: React.ChangeEvent<HTMLSelectElement>) {
     const visibility = e.target.value as VisibilitySelection;
-    const newAcl = new acl.ACL(this.props.model.invocation.acl ?? {});
-    if (!newAcl.othersPermissions) {
+    const newAcl = new acl.ACL(this.state.acl ?? this.props.model.invocation.acl ?? {});
+    if (!newAcl.ownerPermissions || !newAcl.groupPermissions || !newAcl.othersPermissions) {
       this.setState({ error: "Something went wrong. Refresh the page and try again." });
       return;
     }
 
+    // Owner-only invocations can only be changed by their owner (and org
+    // admins), so the owner keeps write access.
+    newAcl.ownerPermissions.read = newAcl.ownerPermissions.read || visibility === "owner";
+    newAcl.ownerPermissions.write = newAcl.ownerPermissions.write || visibility === "owner";
+    newAcl.groupPermissions.read = visibility !== "owner";
+    newAcl.groupPermissions.write = visibility !== "owner";
     newAcl.othersPermissions.read = visibility === "public";
 
-    this.setState({ acl: newAcl, isLoading: true });
+    this.setState({ acl: newAcl });
+    await this.updateInvocation(new invocation.UpdateInvocationRequest({ acl: newAcl }));
+  }
+
+  private async onDownloadPermissionChange(e: React.ChangeEvent<HTMLSelectElement>) {
+    const downloadPermission = Number(e.target.value) as invocation.InvocationPermission;
+    this.setState({ downloadPermission });
+    await this.updateInvocation(new invocation.UpdateInvocationRequest({ downloadPermission }));
+  }
 
+  private async updateInvocation(request: invocation.UpdateInvocationRequest) {
+    request.invocationId = this.props.invocationId;
+    this.setState({ isLoading: true });
     try {
-      await rpcService.service.updateInvocation(
-        new invocation.UpdateInvocationRequest({ invocationId: this.props.invocationId, acl: newAcl })
-      );
+      await rpcService.service.updateInvocation(request);
     } catch (e) {
       console.error(e);
       this.setState({ error: "Something went wrong. Refresh the page and try again." });
@@ -112,6 +129,16 @@ export default class InvocationShareButtonComponent extends React.Component<
     }
   }
 
+  private getVisibility(): VisibilitySelection {
+    if (this.state.acl?.othersPermissions?.read) {
+      return "public";
+    }
+    if (this.state.acl?.groupPermissions && !this.state.acl.groupPermissions.read) {
+      return "owner";
+    }
+    return "group";
+  }
+
   private onCopyLinkButtonClick() {
     this.inputRef.current!.select();
     document.execCommand("copy");
@@ -127,8 +154,12 @@ export default class InvocationShareButtonComponent extends React.Component<
       !this.props.model.invocation.acl?.userId?.id && !this.props.model.invocation.acl?.groupId
     );
     const canChangePermissions = isEnabledByOrg && !isUnauthenticatedBuild;
+    const hasOwner = Boolean(this.props.model.invocation.acl?.userId?.id);
+    const isOrgAdmin = Boolean(
+      owningGroup && owningGroup.id === this.props.user.selectedGroup.id && this.props.user.isGroupAdmin()
+    );
 
-    const visibility: VisibilitySelection = this.state.acl?.othersPermissions?.read ? "public" : "group";
+    const visibility = this.getVisibility();
 
     return (
       <>
@@ -159,14 +190,32 @@ export default class InvocationShareButtonComponent extends React.Component<
                   onChange={this.onVisibilitySelectionChange.bind(this)}
                   value={visibility}
                   disabled={!canChangePermissions || this.state.isLoading || Boolean(this.state.error)}>
+                  {hasOwner && <Option value="owner">Only the owner</Option>}
                   <Option value="group">{owningGroup?.name}</Option>
                   <Option value="public">Anyone with the link</Option>
                 </Select>
                 <div className="visibility-explanation">
+                  {visibility === "owner" && <>Only the user who ran this build can view</>}
                   {visibility === "group" && <>Anyone in this organization with the link can view</>}
                   {visibility === "public" && <>Anyone on the Internet with this link can view</>}
                 </div>
               </div>
+              {isOrgAdmin && !isUnauthenticatedBuild && (
+                <div>
+                  <div className="visibility-header">Artifact and log downloads</div>
+                  <Select
+                    onChange={this.onDownloadPermissionChange.bind(this)}
+                    value={this.state.downloadPermission}
+                    disabled={this.state.isLoading || Boolean(this.state.error)}>
+                    {hasOwner && <Option value={invocation.InvocationPermission.OWNER}>Only the owner</Option>}
+                    <Option value={invocation.InvocationPermission.GROUP}>{owningGroup?.name}</Option>
+                    <Option value={invocation.InvocationPermission.PUBLIC}>Anyone who can view</Option>
+                  </Select>
+                  <div className="visibility-explanation">
+                    Who can download artifacts and logs. Others who can view this build only see its metadata.
+                  </div>
+                </div>
+              )}
               {!canChangePermissions && (
                 <div className="changing-permissions-disabled-explanation">
                   {isUnauthenticatedBuild ? (
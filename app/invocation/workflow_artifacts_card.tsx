@@ -0,0 +1,98 @@
+import React from "react";
+import { Package } from "lucide-react";
+import InvocationModel from "./invocation_model";
+import rpcService, { CancelablePromise } from "../service/rpc_service";
+import { workflow } from "../../proto/workflow_ts_proto";
+import DigestComponent from "../components/digest/digest";
+import errorService from "../errors/error_service";
+import format from "../format/format";
+
+interface Props {
+  model: InvocationModel;
+  filter: string;
+}
+
+interface State {
+  response?: workflow.GetWorkflowArtifactsResponse;
+}
+
+/**
+ * Lists the artifacts that a workflow action declared in buildbuddy.yaml,
+ * which are kept until they expire, regardless of cache eviction.
+ */
+export default class WorkflowArtifactsCardComponent extends React.Component<Props, State> {
+  state: State = {};
+
+  private rpc?: CancelablePromise;
+
+  componentDidMount() {
+    this.maybeFetch();
+  }
+
+  componentDidUpdate() {
+    this.maybeFetch();
+  }
+
+  componentWillUnmount() {
+    this.rpc?.cancel();
+  }
+
+  private maybeFetch() {
+    // Artifacts are persisted once the invocation is complete.
+    if (this.rpc || !this.props.model.isComplete()) return;
+    this.rpc = rpcService.service
+      .getWorkflowArtifacts({ invocationId: this.props.model.getInvocationId() })
+      .then((response) => this.setState({ response }))
+      .catch((e) => errorService.handleError(e));
+  }
+
+  private getDownloadUrl(artifact: workflow.WorkflowArtifact, file: workflow.WorkflowArtifact.File) {
+    return rpcService.getDownloadUrl({
+      invocation_id: this.props.model.getInvocationId(),
+      artifact: "workflow_artifact",
+      artifact_name: artifact.name,
+      filename: file.name,
+    });
+  }
+
+  render() {
+    const filter = this.props.filter.toLowerCase();
+    const artifacts = (this.state.response?.artifact ?? [])
+      .map((artifact) => ({
+        artifact,
+        files: artifact.file.filter(
+          (file) => !filter || artifact.name.toLowerCase().includes(filter) || file.name.toLowerCase().includes(filter)
+        ),
+      }))
+      .filter(({ files }) => files.length);
+    if (!artifacts.length) return null;
+
+    return (
+      <div className="card artifacts">
+        <Package className="icon brown" />
+        <div className="content">
+          <div className="title">Workflow artifacts</div>
+          <div className="details">
+            {artifacts.map(({ artifact, files }) => (
+              <div>
+                <div className="artifact-section-title">
+                  {artifact.name} (expires {format.formatTimestampUsec(artifact.expiresAtUsec)})
+                </div>
+                <div className="artifact-list">
+                  {files.map((file) => (
+                    <div className="artifact-line">
+                      <a href={this.getDownloadUrl(artifact, file)} className="artifact-name">
+                        {file.name}
+                      </a>
+                      <DigestComponent digest={{ hash: file.digest, sizeBytes: file.sizeBytes }} />
+                    </div>
+                  ))}
+                </div>
+              </div>
+            ))}
+          </div>
+        </div>
+      </div>
+    );
+  }
+}
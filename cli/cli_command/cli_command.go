@@ -8,6 +8,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/cli/execute"
 	"github.com/buildbuddy-io/buildbuddy/cli/explain"
 	"github.com/buildbuddy-io/buildbuddy/cli/fix"
+	"github.com/buildbuddy-io/buildbuddy/cli/invalidate"
 	"github.com/buildbuddy-io/buildbuddy/cli/login"
 	"github.com/buildbuddy-io/buildbuddy/cli/plugin"
 	"github.com/buildbuddy-io/buildbuddy/cli/printlog"
@@ -63,6 +64,11 @@ var Commands = []Command{
 		Help:    "Installs a bb plugin (https://buildbuddy.io/plugins).",
 		Handler: plugin.HandleInstall,
 	},
+	{
+		Name:    "invalidate",
+		Help:    "Invalidates action cache entries by instance name prefix or platform property.",
+		Handler: invalidate.HandleInvalidate,
+	},
 	{
 		Name:    "login",
 		Help:    "Configures bb commands to use your BuildBuddy API key.",
@@ -26,6 +26,12 @@ func (c *nullEventChannel) GetInitialSequenceNumber() int64 {
 	return 1
 }
 func (c *nullEventChannel) Close() {}
+func (c *nullEventChannel) Resumable() bool {
+	return false
+}
+func (c *nullEventChannel) Suspend() bool {
+	return false
+}
 
 func (c *nullEventChannel) Context() context.Context {
 	return c.ctx
@@ -0,0 +1,131 @@
+package invalidate
+
+import (
+	"context"
+	"flag"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/cli/arg"
+	"github.com/buildbuddy-io/buildbuddy/cli/log"
+	"github.com/buildbuddy-io/buildbuddy/cli/storage"
+	"github.com/buildbuddy-io/buildbuddy/server/util/grpc_client"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"google.golang.org/grpc/metadata"
+
+	bbspb "github.com/buildbuddy-io/buildbuddy/proto/buildbuddy_service"
+	capb "github.com/buildbuddy-io/buildbuddy/proto/cache"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+var (
+	flags = flag.NewFlagSet("invalidate", flag.ContinueOnError)
+
+	target             = flags.String("target", "grpcs://remote.buildbuddy.io", "BuildBuddy gRPC target")
+	instanceNamePrefix = flags.String("instance_name_prefix", "", "Invalidate action cache entries whose remote instance name starts with this prefix.")
+	platformProperty   = flags.String("platform_property", "", "Invalidate action cache entries for actions with this platform property, in the form NAME=VALUE.")
+	deleteID           = flags.String("delete", "", "Delete the invalidation with this ID, so that the entries it invalidated are served again.")
+
+	usage = `
+usage: bb ` + flags.Name() + ` [--instance_name_prefix=PREFIX] [--platform_property=NAME=VALUE]
+       bb ` + flags.Name() + ` --delete=INVALIDATION_ID
+
+Invalidates action cache entries, so that the actions that wrote them are
+re-run the next time they're requested. The CAS is left untouched.
+
+If both flags are set, only entries matching both are invalidated. Requires
+an API key with the Org admin capability. Invalidations expire after 30 days
+by default, or can be deleted earlier with --delete.
+
+Example of invalidating every entry written by Linux actions under the
+"ci/" instance name:
+  $ bb invalidate --instance_name_prefix=ci/ --platform_property=OSFamily=linux
+`
+)
+
+func newClient() (bbspb.BuildBuddyServiceClient, func(), error) {
+	conn, err := grpc_client.DialSimple(*target)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bbspb.NewBuildBuddyServiceClient(conn), func() { conn.Close() }, nil
+}
+
+func newContext() context.Context {
+	ctx := context.Background()
+	if apiKey, err := storage.ReadRepoConfig("api-key"); err == nil && apiKey != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-buildbuddy-api-key", apiKey)
+	}
+	return ctx
+}
+
+func deleteInvalidation(id string) error {
+	client, cleanup, err := newClient()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	_, err = client.DeleteActionCacheInvalidation(newContext(), &capb.DeleteActionCacheInvalidationRequest{InvalidationId: id})
+	return err
+}
+
+func invalidate() (string, error) {
+	req := &capb.InvalidateActionCacheRequest{
+		InstanceNamePrefix: *instanceNamePrefix,
+	}
+	if *platformProperty != "" {
+		name, value, ok := strings.Cut(*platformProperty, "=")
+		if !ok || name == "" {
+			return "", status.InvalidArgumentErrorf("Invalid --platform_property %q: expected NAME=VALUE", *platformProperty)
+		}
+		req.PlatformProperty = &repb.Platform_Property{Name: name, Value: value}
+	}
+
+	client, cleanup, err := newClient()
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+	rsp, err := client.InvalidateActionCache(newContext(), req)
+	if err != nil {
+		return "", err
+	}
+	return rsp.GetInvalidationId(), nil
+}
+
+func HandleInvalidate(args []string) (int, error) {
+	if err := arg.ParseFlagSet(flags, args); err != nil {
+		if err == flag.ErrHelp {
+			log.Print(usage)
+			return 1, nil
+		}
+		return -1, err
+	}
+
+	invalidating := *instanceNamePrefix != "" || *platformProperty != ""
+	if len(flags.Args()) != 0 || invalidating == (*deleteID != "") {
+		log.Print(usage)
+		return 1, nil
+	}
+
+	if *target == "" {
+		log.Printf("A non-empty --target must be specified")
+		return 1, nil
+	}
+
+	if *deleteID != "" {
+		if err := deleteInvalidation(*deleteID); err != nil {
+			log.Print(err)
+			return 1, nil
+		}
+		log.Printf("Deleted action cache invalidation %s", *deleteID)
+		return 0, nil
+	}
+
+	id, err := invalidate()
+	if err != nil {
+		log.Print(err)
+		return 1, nil
+	}
+	log.Printf("Invalidated action cache entries (invalidation ID: %s)", id)
+	return 0, nil
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
 
 	"github.com/buildbuddy-io/buildbuddy/codesearch/server"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/configsecrets"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/log_index"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remoteauth"
 	"github.com/buildbuddy-io/buildbuddy/server/config"
 	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
@@ -21,6 +23,7 @@ import (
 	"google.golang.org/grpc"
 
 	csspb "github.com/buildbuddy-io/buildbuddy/proto/codesearch_service"
+	lipb "github.com/buildbuddy-io/buildbuddy/proto/log_index_service"
 	bspb "google.golang.org/genproto/googleapis/bytestream"
 )
 
@@ -31,6 +34,7 @@ var (
 	csIndexDir   = flag.String("codesearch.index_dir", "", "Directory to store index in")
 	csScratchDir = flag.String("codesearch.scratch_dir", "", "Directory to store temp files in")
 	remoteCache  = flag.String("codesearch.remote_cache", "", "gRPC Address of buildbuddy cache")
+	logIndexDir  = flag.String("codesearch.log_index_dir", "", "If set, the log index service is served from an index in this directory. Apps use it when app.log_index.backend points at this server.")
 
 	monitoringAddr = flag.String("monitoring.listen", ":9090", "Address to listen for monitoring traffic on")
 )
@@ -73,6 +77,18 @@ func main() {
 		log.Fatal(err.Error())
 	}
 
+	var logIndexServer *log_index.Server
+	if *logIndexDir != "" {
+		li, err := log_index.New(*logIndexDir)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		env.GetHealthChecker().RegisterShutdownFunction(func(ctx context.Context) error {
+			return li.Close()
+		})
+		logIndexServer = log_index.NewServer(env, li)
+	}
+
 	conn, err := grpc_client.DialInternal(env, *remoteCache)
 	if err != nil {
 		log.Fatal(err.Error())
@@ -98,6 +114,9 @@ func main() {
 
 	server := s.GetServer()
 	csspb.RegisterCodesearchServiceServer(server, css)
+	if logIndexServer != nil {
+		lipb.RegisterLogIndexServiceServer(server, logIndexServer)
+	}
 
 	env.GetHealthChecker().RegisterShutdownFunction(grpc_server.GRPCShutdownFunc(server))
 	go func() {
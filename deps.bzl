@@ -4227,6 +4227,12 @@ def install_go_mod_dependencies(workspace_name = "buildbuddy"):
         sum = "h1:9BQrFxC+YOHJlTlHGkTrFWf59nbL3XnCoFLTwDCI7ys=",
         version = "v1.2.0",
     )
+    go_repository(
+        name = "com_github_segmentio_kafka_go",
+        importpath = "github.com/segmentio/kafka-go",
+        sum = "h1:IqziR4pA3vrZq7YdRxaT3w1/5fvIH5qpCwstUanQQB0=",
+        version = "v0.4.47",
+    )
     go_repository(
         name = "com_github_sereal_sereal_go_sereal",
         importpath = "github.com/Sereal/Sereal/Go/sereal",
@@ -187,6 +187,7 @@ export default class ApiKeysComponent extends React.Component<ApiKeysComponentPr
           label: apiKey.label,
           capability: [...apiKey.capability],
           visibleToDevelopers: apiKey.visibleToDevelopers,
+          scopes: new api_key.ApiKeyScopes({ scope: [...apiKey.scope] }),
         }),
       },
     });
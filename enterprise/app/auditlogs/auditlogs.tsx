@@ -125,6 +125,15 @@ export default class AuditLogsComponent extends React.Component<AuditLogsCompone
       case auditlog.ResourceType.IP_RULE:
         res = "IP Rule";
         break;
+      case auditlog.ResourceType.WORKFLOW:
+        res = "Workflow";
+        break;
+      case auditlog.ResourceType.OIDC_TRUST_POLICY:
+        res = "OIDC Trust Policy";
+        break;
+      case auditlog.ResourceType.OIDC_PROVIDER:
+        res = "OIDC Provider";
+        break;
     }
     return (
       <>
@@ -163,6 +172,30 @@ export default class AuditLogsComponent extends React.Component<AuditLogsCompone
         return "Update IP Rules Config";
       case Action.INVALIDATE_VM_SNAPSHOT:
         return "Invalidate VM Snapshot";
+      case Action.DISPATCH_WORKFLOW_ACTION:
+        return "Dispatch Workflow Action";
+      case Action.INVALIDATE_ACTION_CACHE:
+        return "Invalidate Action Cache";
+      case Action.CANCEL_EXECUTIONS:
+        return "Cancel Executions";
+      case Action.EXECUTE_WORKFLOW:
+        return "Execute Workflow";
+      case Action.LINK_GITHUB_APP_INSTALLATION:
+        return "Link GitHub App Installation";
+      case Action.UNLINK_GITHUB_APP_INSTALLATION:
+        return "Unlink GitHub App Installation";
+      case Action.EXPORT_AUDIT_LOGS:
+        return "Export Audit Logs";
+      case Action.CREATE_IP_RULES_OVERRIDE:
+        return "Override IP Rules";
+      case Action.IP_RULES_ACCESS_DENIED:
+        return "Denied by IP Rules";
+      case Action.DELETE_ACTION_CACHE_INVALIDATION:
+        return "Delete Action Cache Invalidation";
+      case Action.DELETE_IP_RULES_OVERRIDE:
+        return "Revoke IP Rules Override";
+      case Action.QUEUE_TIME_SLO_DECISION:
+        return "Queue-Time SLO Decision";
     }
     return "";
   }
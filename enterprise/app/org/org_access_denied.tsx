@@ -1,21 +1,47 @@
 import { User } from "../../../app/auth/user";
 import React from "react";
 import FilledButton from "../../../app/components/button/button";
+import TextInput from "../../../app/components/input/input";
 import authService from "../../../app/auth/auth_service";
+import errorService from "../../../app/errors/error_service";
 import router from "../../../app/router/router";
+import rpcService from "../../../app/service/rpc_service";
+import { iprules } from "../../../proto/iprules_ts_proto";
 import { user } from "../../../proto/user_ts_proto";
 
 export type Props = {
   user: User;
 };
 
-export default class OrgAccessDeniedComponent extends React.Component<Props> {
+type State = {
+  overrideReason: string;
+  creatingOverride: boolean;
+};
+
+export default class OrgAccessDeniedComponent extends React.Component<Props, State> {
+  state: State = {
+    overrideReason: "",
+    creatingOverride: false,
+  };
+
   handleImpersonateClicked() {
     const params = new URLSearchParams(window.location.search);
     const sourceUrl = params.get("source_url");
     authService.enterImpersonationMode(this.props.user.subdomainGroupID, { redirectUrl: sourceUrl ?? undefined });
   }
 
+  handleOverrideClicked() {
+    this.setState({ creatingOverride: true });
+    rpcService.service
+      .createIPRulesOverride(new iprules.CreateOverrideRequest({ reason: this.state.overrideReason }))
+      .then(() => {
+        const params = new URLSearchParams(window.location.search);
+        window.location.href = params.get("source_url") || "/";
+      })
+      .catch((e) => errorService.handleError(e))
+      .finally(() => this.setState({ creatingOverride: false }));
+  }
+
   render() {
     const params = new URLSearchParams(window.location.search);
     const deniedByIpRules = params.get("denied_reason") == user.SelectedGroup.Access.DENIED_BY_IP_RULES.toString();
@@ -29,6 +55,26 @@ export default class OrgAccessDeniedComponent extends React.Component<Props> {
             </div>
             {!deniedByIpRules && <div className="details">You are not authorized to access this site.</div>}
             {deniedByIpRules && <div className="details">Access blocked by Organization IP Rules.</div>}
+            {deniedByIpRules && this.props.user?.isGroupAdmin() && (
+              <div className="ip-rules-override">
+                <div className="details">
+                  As an organization admin, you can bypass the IP rules for a limited time. This is recorded in the
+                  audit log.
+                </div>
+                <TextInput
+                  name="override-reason"
+                  value={this.state.overrideReason}
+                  onChange={(e) => this.setState({ overrideReason: e.target.value })}
+                  placeholder="Reason, e.g. office IP changed"
+                />
+                <FilledButton
+                  onClick={this.handleOverrideClicked.bind(this)}
+                  disabled={!this.state.overrideReason.trim() || this.state.creatingOverride}
+                  className="impersonate-button">
+                  Override IP rules
+                </FilledButton>
+              </div>
+            )}
             {this.props.user?.subdomainGroupID && (
               <div>
                 <FilledButton onClick={this.handleImpersonateClicked.bind(this)} className="impersonate-button">
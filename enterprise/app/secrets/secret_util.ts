@@ -2,7 +2,7 @@ import rpc_service from "../../../app/service/rpc_service";
 import { secrets } from "../../../proto/secrets_ts_proto";
 import sodium from "libsodium-wrappers";
 
-export function encryptAndUpdate(name: string, value: string) {
+export function encryptAndUpdate(name: string, value: string, repoUrl = "") {
   return sodium.ready.then(() => {
     return rpc_service.service.getPublicKey(secrets.GetPublicKeyRequest.create({})).then((response) => {
       const typedResponse = response as secrets.GetPublicKeyResponse;
@@ -10,7 +10,7 @@ export function encryptAndUpdate(name: string, value: string) {
         throw new Error("Server did not return public key.");
       }
       const secret = encrypt(typedResponse.publicKey, name, value.trim());
-      return updateSecret(secret);
+      return updateSecret({ ...secret, repoUrl });
     });
   });
 }
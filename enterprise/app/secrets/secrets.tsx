@@ -13,7 +13,12 @@ export default class SecretsComponent extends React.Component<SecretsComponentPr
       return <UpdateSecretComponent />;
     }
     if (this.props.path === "/settings/org/secrets/edit") {
-      return <UpdateSecretComponent name={this.props.search.get("name") || ""} />;
+      return (
+        <UpdateSecretComponent
+          name={this.props.search.get("name") || ""}
+          repoUrl={this.props.search.get("repo_url") || ""}
+        />
+      );
     }
     return <SecretsListComponent />;
   }
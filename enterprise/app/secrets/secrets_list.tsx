@@ -13,7 +13,7 @@ interface State {
   loading?: boolean;
   response?: secrets.ListSecretsResponse;
 
-  secretToDelete?: string;
+  secretToDelete?: secrets.ISecret;
   deleteLoading?: boolean;
 }
 
@@ -33,8 +33,8 @@ export default class SecretsListComponent extends React.Component<{}, State> {
       .finally(() => this.setState({ loading: false }));
   }
 
-  private onClickDelete(name: string) {
-    this.setState({ secretToDelete: name });
+  private onClickDelete(secret: secrets.ISecret) {
+    this.setState({ secretToDelete: secret });
   }
   private onCloseDeleteModal() {
     this.setState({ secretToDelete: undefined });
@@ -43,7 +43,12 @@ export default class SecretsListComponent extends React.Component<{}, State> {
     this.setState({ deleteLoading: true });
     rpc_service.service
       .deleteSecret(
-        secrets.DeleteSecretRequest.create({ secret: secrets.Secret.create({ name: this.state.secretToDelete }) })
+        secrets.DeleteSecretRequest.create({
+          secret: secrets.Secret.create({
+            name: this.state.secretToDelete?.name,
+            repoUrl: this.state.secretToDelete?.repoUrl,
+          }),
+        })
       )
       .then(() => {
         alert_service.success("Secret deleted successfully.");
@@ -75,14 +80,17 @@ export default class SecretsListComponent extends React.Component<{}, State> {
               <div className="secrets-row">
                 <Lock className="icon lock-icon" />
                 <span className="secret-name code-font">{secret.name}</span>
+                {secret.repoUrl && <span className="secret-repo-url">{secret.repoUrl}</span>}
                 <OutlinedLinkButton
                   className="edit-button"
-                  href={`/settings/org/secrets/edit?name=${encodeURIComponent(secret.name)}`}>
+                  href={`/settings/org/secrets/edit?name=${encodeURIComponent(secret.name)}${
+                    secret.repoUrl ? `&repo_url=${encodeURIComponent(secret.repoUrl)}` : ""
+                  }`}>
                   Edit
                 </OutlinedLinkButton>
                 <OutlinedButton
                   className="delete-button destructive"
-                  onClick={this.onClickDelete.bind(this, secret.name)}>
+                  onClick={this.onClickDelete.bind(this, secret)}>
                   Delete
                 </OutlinedButton>
               </div>
@@ -98,7 +106,8 @@ export default class SecretsListComponent extends React.Component<{}, State> {
           loading={this.state.deleteLoading}
           className="delete-secret-dialog"
           destructive>
-          Delete <span className="secret-name code-font">{this.state.secretToDelete}</span>? This cannot be undone.
+          Delete <span className="secret-name code-font">{this.state.secretToDelete?.name}</span>
+          {this.state.secretToDelete?.repoUrl && <> for {this.state.secretToDelete.repoUrl}</>}? This cannot be undone.
         </SimpleModalDialog>
       </div>
     );
@@ -10,11 +10,13 @@ import { encryptAndUpdate } from "./secret_util";
 
 export interface UpdateSecretProps {
   name?: string;
+  repoUrl?: string;
 }
 
 interface State {
   name?: string;
   value?: string;
+  repoUrl?: string;
 
   loading?: boolean;
 }
@@ -28,8 +30,9 @@ export default class UpdateSecretComponent extends React.Component<UpdateSecretP
 
     const name = this.props.name || this.state.name || "";
     const value = this.state.value || "";
+    const repoUrl = this.props.name ? this.props.repoUrl || "" : this.state.repoUrl || "";
 
-    encryptAndUpdate(name, value)
+    encryptAndUpdate(name, value, repoUrl)
       .then(() => {
         alert_service.success("Successfully encrypted and saved secret.");
         router.navigateTo("/settings/org/secrets");
@@ -45,6 +48,11 @@ export default class UpdateSecretComponent extends React.Component<UpdateSecretP
     this.setState({ name });
   }
 
+  private onChangeRepoUrl(e: React.ChangeEvent<HTMLInputElement>) {
+    const repoUrl = e.target.value;
+    this.setState({ repoUrl });
+  }
+
   private onChangeSecretValue(e: React.ChangeEvent<HTMLTextAreaElement>) {
     const value = e.target.value;
     this.setState({ value });
@@ -61,21 +69,40 @@ export default class UpdateSecretComponent extends React.Component<UpdateSecretP
         </div>
         <form className="secrets-form" autoComplete="off" noValidate onSubmit={this.onSubmit.bind(this)}>
           {this.props.name ? (
-            <div className="secret-name code-font">{this.props.name}</div>
+            <div>
+              <div className="secret-name code-font">{this.props.name}</div>
+              {this.props.repoUrl && <div className="caption">{this.props.repoUrl}</div>}
+            </div>
           ) : (
-            <div className="form-field-group">
-              <label htmlFor="secretName">Name</label>
-              <div className="caption">
-                Actions with secrets enabled will use this environment variable to get the secret's value.
-                UPPERCASE_WITH_UNDERSCORES is recommended.
+            <>
+              <div className="form-field-group">
+                <label htmlFor="secretName">Name</label>
+                <div className="caption">
+                  Actions with secrets enabled will use this environment variable to get the secret's value.
+                  UPPERCASE_WITH_UNDERSCORES is recommended.
+                </div>
+                <div>
+                  <TextInput
+                    name="secretName"
+                    onChange={this.onChangeSecretName.bind(this)}
+                    value={this.props.name || this.state.name}></TextInput>
+                </div>
               </div>
-              <div>
-                <TextInput
-                  name="secretName"
-                  onChange={this.onChangeSecretName.bind(this)}
-                  value={this.props.name || this.state.name}></TextInput>
+              <div className="form-field-group">
+                <label htmlFor="repoUrl">Repository URL (optional)</label>
+                <div className="caption">
+                  If set, the secret is only available to workflows for this repository, and only for runs triggered
+                  by trusted collaborators. It takes precedence over an org secret with the same name.
+                </div>
+                <div>
+                  <TextInput
+                    name="repoUrl"
+                    placeholder="https://github.com/acme-inc/acme"
+                    onChange={this.onChangeRepoUrl.bind(this)}
+                    value={this.state.repoUrl}></TextInput>
+                </div>
               </div>
-            </div>
+            </>
           )}
           <div className="form-field-group">
             <label htmlFor="secretValue">Value</label>
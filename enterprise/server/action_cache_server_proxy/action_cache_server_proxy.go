@@ -2,17 +2,27 @@ package action_cache_server_proxy
 
 import (
 	"context"
+	"flag"
 	"fmt"
 
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
 )
 
+var cacheActionResults = flag.Bool("cache_proxy.cache_action_results", false, "If true, the Cache Proxy stores action results in the local cache and serves subsequent GetActionResult requests from it without contacting the remote cache. Locally cached results may be stale if the remote entry is overwritten.")
+
 type ActionCacheServerProxy struct {
 	env         environment.Env
+	localCache  interfaces.Cache
 	remoteCache repb.ActionCacheClient
 }
 
@@ -30,22 +40,106 @@ func NewActionCacheServerProxy(env environment.Env) (*ActionCacheServerProxy, er
 	if remoteCache == nil {
 		return nil, fmt.Errorf("An ActionCacheClient is required to enable the ActionCacheServerProxy")
 	}
+	var localCache interfaces.Cache
+	if *cacheActionResults {
+		localCache = env.GetCache()
+		if localCache == nil {
+			return nil, fmt.Errorf("A local cache is required to cache action results in the ActionCacheServerProxy")
+		}
+	}
 	return &ActionCacheServerProxy{
 		env:         env,
+		localCache:  localCache,
 		remoteCache: remoteCache,
 	}, nil
 }
 
+func actionResultResourceName(instanceName string, d *repb.Digest, digestFunction repb.DigestFunction_Value) *rspb.ResourceName {
+	return digest.NewResourceName(d, instanceName, rspb.CacheType_AC, digestFunction).ToProto()
+}
+
+func (s *ActionCacheServerProxy) getLocalActionResult(ctx context.Context, req *repb.GetActionResultRequest) (*repb.ActionResult, error) {
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, s.env)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := s.localCache.Get(ctx, actionResultResourceName(req.GetInstanceName(), req.GetActionDigest(), req.GetDigestFunction()))
+	if err != nil {
+		return nil, err
+	}
+	rsp := &repb.ActionResult{}
+	if err := proto.Unmarshal(buf, rsp); err != nil {
+		return nil, err
+	}
+	return rsp, nil
+}
+
+func (s *ActionCacheServerProxy) setLocalActionResult(ctx context.Context, instanceName string, d *repb.Digest, digestFunction repb.DigestFunction_Value, ar *repb.ActionResult) {
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, s.env)
+	if err != nil {
+		log.CtxWarningf(ctx, "Could not cache action result locally: %s", err)
+		return
+	}
+	buf, err := proto.Marshal(ar)
+	if err != nil {
+		log.CtxWarningf(ctx, "Could not cache action result locally: %s", err)
+		return
+	}
+	if err := s.localCache.Set(ctx, actionResultResourceName(instanceName, d, digestFunction), buf); err != nil {
+		log.CtxWarningf(ctx, "Could not cache action result locally: %s", err)
+	}
+}
+
 // Action Cache entries are not content-addressable, so the value pointed to
-// by a given key may change in the backing cache. Thus, always fetch them from
-// the authoritative cache.
+// by a given key may change in the backing cache. Thus, unless local caching
+// of action results is explicitly enabled, always fetch them from the
+// authoritative cache.
 func (s *ActionCacheServerProxy) GetActionResult(ctx context.Context, req *repb.GetActionResultRequest) (*repb.ActionResult, error) {
-	return s.remoteCache.GetActionResult(ctx, req)
+	if s.localCache == nil {
+		return s.remoteCache.GetActionResult(ctx, req)
+	}
+	if rsp, err := s.getLocalActionResult(ctx, req); err == nil {
+		return rsp, nil
+	} else if !status.IsNotFoundError(err) {
+		log.CtxInfof(ctx, "Error reading action result from local cache: %s", err)
+	}
+	rsp, err := s.remoteCache.GetActionResult(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	s.setLocalActionResult(ctx, req.GetInstanceName(), req.GetActionDigest(), req.GetDigestFunction(), rsp)
+	return rsp, nil
+}
+
+// remoteWriteFlusher is implemented by CAS servers that write blobs to the
+// remote cache in the background.
+type remoteWriteFlusher interface {
+	// FlushRemoteWrites makes sure that the blobs written by the
+	// authenticated group are in the remote cache.
+	FlushRemoteWrites(ctx context.Context) error
 }
 
 // Action Cache entries are not content-addressable, so the value pointed to
-// by a given key may change in the backing cache. Thus, don't cache them
-// locally when writing to the authoritative cache.
+// by a given key may change in the backing cache. Thus, the authoritative
+// cache is always updated, and the local copy (if any) is only updated once
+// that succeeds.
+//
+// The blobs referenced by the action result may still be on their way to the
+// remote cache, so the group's background CAS writes are flushed first.
+// Otherwise, the remote action cache could point at blobs that are missing
+// from the remote CAS.
 func (s *ActionCacheServerProxy) UpdateActionResult(ctx context.Context, req *repb.UpdateActionResultRequest) (*repb.ActionResult, error) {
-	return s.remoteCache.UpdateActionResult(ctx, req)
+	if f, ok := s.env.GetCASServer().(remoteWriteFlusher); ok {
+		if err := f.FlushRemoteWrites(ctx); err != nil {
+			return nil, err
+		}
+	}
+	rsp, err := s.remoteCache.UpdateActionResult(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if s.localCache != nil {
+		s.setLocalActionResult(ctx, req.GetInstanceName(), req.GetActionDigest(), req.GetDigestFunction(), req.GetActionResult())
+	}
+	return rsp, nil
 }
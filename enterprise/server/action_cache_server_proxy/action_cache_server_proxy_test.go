@@ -8,6 +8,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/action_cache_server"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 	"github.com/stretchr/testify/require"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
@@ -114,3 +115,39 @@ func TestActionCacheProxy(t *testing.T) {
 	require.Equal(t, int32(998), get(ctx, ac, digestB, t).GetExitCode())
 	require.Equal(t, int32(998), get(ctx, proxy, digestB, t).GetExitCode())
 }
+
+func TestActionCacheProxy_CacheActionResults(t *testing.T) {
+	flags.Set(t, "cache_proxy.cache_action_results", true)
+	ctx := context.Background()
+	ac := runACServer(ctx, t)
+	proxy := runACProxy(ctx, t, ac)
+
+	digestA := &repb.Digest{
+		Hash:      strings.Repeat("a", 64),
+		SizeBytes: 1024,
+	}
+	digestB := &repb.Digest{
+		Hash:      strings.Repeat("b", 64),
+		SizeBytes: 1024,
+	}
+
+	// Results written through the proxy are readable from the proxy and
+	// backing cache.
+	update(ctx, proxy, digestA, 1, t)
+	require.Equal(t, int32(1), get(ctx, ac, digestA, t).GetExitCode())
+	require.Equal(t, int32(1), get(ctx, proxy, digestA, t).GetExitCode())
+
+	// Results written to the backing cache are fetched on the first read, and
+	// served from the local cache afterwards, even if the remote entry
+	// changes.
+	update(ctx, ac, digestB, 999, t)
+	require.Equal(t, int32(999), get(ctx, proxy, digestB, t).GetExitCode())
+	update(ctx, ac, digestB, 998, t)
+	require.Equal(t, int32(998), get(ctx, ac, digestB, t).GetExitCode())
+	require.Equal(t, int32(999), get(ctx, proxy, digestB, t).GetExitCode())
+
+	// Writing through the proxy updates the local copy too.
+	update(ctx, proxy, digestB, 997, t)
+	require.Equal(t, int32(997), get(ctx, ac, digestB, t).GetExitCode())
+	require.Equal(t, int32(997), get(ctx, proxy, digestB, t).GetExitCode())
+}
@@ -3,14 +3,19 @@ package api
 import (
 	"context"
 	"flag"
+	"fmt"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/prom"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/flake_detector"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/hostedrunner"
 	"github.com/buildbuddy-io/buildbuddy/proto/workflow"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/target_tracker"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/timing_profile"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/eventlog"
 	"github.com/buildbuddy-io/buildbuddy/server/http/protolet"
@@ -25,8 +30,10 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
 	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
+	"github.com/buildbuddy-io/buildbuddy/server/util/scopes"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	api_common "github.com/buildbuddy-io/buildbuddy/server/api/common"
 	requestcontext "github.com/buildbuddy-io/buildbuddy/server/util/request_context"
@@ -36,6 +43,7 @@ import (
 	bespb "github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
 	elpb "github.com/buildbuddy-io/buildbuddy/proto/eventlog"
 	gitpb "github.com/buildbuddy-io/buildbuddy/proto/git"
+	inspb "github.com/buildbuddy-io/buildbuddy/proto/invocation_status"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
 	rnpb "github.com/buildbuddy-io/buildbuddy/proto/runner"
@@ -48,6 +56,8 @@ var (
 	enableMetricsAPI     = flag.Bool("api.enable_metrics_api", false, "If true, enable access to metrics API.")
 )
 
+const byteStreamReadMethod = "/google.bytestream.ByteStream/Read"
+
 type APIServer struct {
 	env environment.Env
 }
@@ -103,27 +113,7 @@ func (s *APIServer) GetInvocation(ctx context.Context, req *apipb.GetInvocationR
 
 	invocations := []*apipb.Invocation{}
 	err = db.ScanEach(rq, func(ctx context.Context, ti *tables.Invocation) error {
-		apiInvocation := &apipb.Invocation{
-			Id: &apipb.Invocation_Id{
-				InvocationId: ti.InvocationID,
-			},
-			Success:       ti.Success,
-			User:          ti.User,
-			DurationUsec:  ti.DurationUsec,
-			Host:          ti.Host,
-			Command:       ti.Command,
-			Pattern:       ti.Pattern,
-			ActionCount:   ti.ActionCount,
-			CreatedAtUsec: ti.CreatedAtUsec,
-			UpdatedAtUsec: ti.UpdatedAtUsec,
-			RepoUrl:       ti.RepoURL,
-			BranchName:    ti.BranchName,
-			CommitSha:     ti.CommitSHA,
-			Role:          ti.Role,
-			BazelExitCode: ti.BazelExitCode,
-		}
-
-		invocations = append(invocations, apiInvocation)
+		invocations = append(invocations, apiInvocationFromTable(ti))
 		return nil
 	})
 	if err != nil {
@@ -175,6 +165,119 @@ func (s *APIServer) GetInvocation(ctx context.Context, req *apipb.GetInvocationR
 	}, nil
 }
 
+func apiInvocationFromTable(ti *tables.Invocation) *apipb.Invocation {
+	return &apipb.Invocation{
+		Id: &apipb.Invocation_Id{
+			InvocationId: ti.InvocationID,
+		},
+		Success:          ti.Success,
+		User:             ti.User,
+		DurationUsec:     ti.DurationUsec,
+		Host:             ti.Host,
+		Command:          ti.Command,
+		Pattern:          ti.Pattern,
+		ActionCount:      ti.ActionCount,
+		CreatedAtUsec:    ti.CreatedAtUsec,
+		UpdatedAtUsec:    ti.UpdatedAtUsec,
+		RepoUrl:          ti.RepoURL,
+		BranchName:       ti.BranchName,
+		CommitSha:        ti.CommitSHA,
+		Role:             ti.Role,
+		BazelExitCode:    ti.BazelExitCode,
+		InvocationStatus: apiInvocationStatus(inspb.InvocationStatus(ti.InvocationStatus)),
+	}
+}
+
+func apiInvocationStatus(s inspb.InvocationStatus) apipb.Invocation_InvocationStatus {
+	switch s {
+	case inspb.InvocationStatus_PARTIAL_INVOCATION_STATUS:
+		return apipb.Invocation_IN_PROGRESS
+	case inspb.InvocationStatus_COMPLETE_INVOCATION_STATUS:
+		return apipb.Invocation_COMPLETE
+	case inspb.InvocationStatus_DISCONNECTED_INVOCATION_STATUS:
+		return apipb.Invocation_DISCONNECTED
+	default:
+		return apipb.Invocation_INVOCATION_STATUS_UNSPECIFIED
+	}
+}
+
+func (s *APIServer) CompareInvocations(ctx context.Context, req *apipb.CompareInvocationsRequest) (*apipb.CompareInvocationsResponse, error) {
+	// Check whether the user is authenticated. No need for the returned user
+	// here, because user filters will be applied by LookupInvocation.
+	if _, err := s.env.GetAuthenticator().AuthenticatedUser(ctx); err != nil {
+		return nil, err
+	}
+	if req.GetBaseInvocationId() == "" || req.GetInvocationId() == "" {
+		return nil, status.InvalidArgumentError("CompareInvocationsRequest must contain a base_invocation_id and an invocation_id")
+	}
+
+	base, err := build_event_handler.LookupInvocation(s.env, ctx, req.GetBaseInvocationId())
+	if err != nil {
+		return nil, err
+	}
+	inv, err := build_event_handler.LookupInvocation(s.env, ctx, req.GetInvocationId())
+	if err != nil {
+		return nil, err
+	}
+	return compareInvocations(base, inv), nil
+}
+
+func (s *APIServer) GetTimingTrend(ctx context.Context, req *apipb.GetTimingTrendRequest) (*apipb.GetTimingTrendResponse, error) {
+	if !timing_profile.Enabled() {
+		return nil, status.UnimplementedError("Timing profile ingestion is not enabled")
+	}
+	user, err := s.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	endTime := time.Now()
+	if req.GetEndTime() != nil {
+		endTime = req.GetEndTime().AsTime()
+	}
+	startTime := endTime.Add(-defaultTimingTrendWindow)
+	if req.GetStartTime() != nil {
+		startTime = req.GetStartTime().AsTime()
+	}
+	if !startTime.Before(endTime) {
+		return nil, status.InvalidArgumentError("start_time must be before end_time")
+	}
+	if endTime.Sub(startTime) > maxTimingTrendWindow {
+		return nil, status.InvalidArgumentErrorf("The time range may span at most %s", maxTimingTrendWindow)
+	}
+
+	q := query_builder.NewQuery(`SELECT p.*, i.created_at_usec AS invocation_created_at_usec FROM "InvocationTimingProfiles" p JOIN "Invocations" i ON i.invocation_id = p.invocation_id`)
+	q = q.AddWhereClause(`i.group_id = ?`, user.GetGroupID())
+	// Invocations that are only visible to their owner are excluded from
+	// the trend of other users.
+	if err := perms.AddPermissionsCheckToQueryWithTableAlias(ctx, s.env, q, "i"); err != nil {
+		return nil, err
+	}
+	q = q.AddWhereClause(`i.created_at_usec >= ?`, startTime.UnixMicro())
+	q = q.AddWhereClause(`i.created_at_usec < ?`, endTime.UnixMicro())
+	if repoURL := req.GetSelector().GetRepoUrl(); repoURL != "" {
+		q = q.AddWhereClause(`i.repo_url = ?`, repoURL)
+	}
+	if branchName := req.GetSelector().GetBranchName(); branchName != "" {
+		q = q.AddWhereClause(`i.branch_name = ?`, branchName)
+	}
+	if command := req.GetSelector().GetCommand(); command != "" {
+		q = q.AddWhereClause(`i.command = ?`, command)
+	}
+	if role := req.GetSelector().GetRole(); role != "" {
+		q = q.AddWhereClause(`i.role = ?`, role)
+	}
+	q = q.SetOrderBy(`i.created_at_usec`, false /*=ascending*/)
+	q = q.SetLimit(maxTimingTrendInvocations)
+	queryStr, args := q.Build()
+
+	rq := s.env.GetDBHandle().NewQuery(ctx, "api_server_get_timing_trend").Raw(queryStr, args...)
+	rows, err := db.ScanAll(rq, &timingTrendRow{})
+	if err != nil {
+		return nil, err
+	}
+	return &apipb.GetTimingTrendResponse{Bucket: timingTrend(rows, req.GetInterval())}, nil
+}
+
 func (s *APIServer) CacheEnabled() bool {
 	return *enableCache
 }
@@ -254,6 +357,57 @@ func (s *APIServer) GetTarget(ctx context.Context, req *apipb.GetTargetRequest)
 	}, nil
 }
 
+// maxFlakeStatsResults caps the number of targets returned by
+// GetTargetFlakeStats.
+const maxFlakeStatsResults = 1000
+
+func (s *APIServer) GetTargetFlakeStats(ctx context.Context, req *apipb.GetTargetFlakeStatsRequest) (*apipb.GetTargetFlakeStatsResponse, error) {
+	if !target_tracker.TargetTrackingEnabled() {
+		return nil, status.UnimplementedError("Target tracking is not enabled")
+	}
+	user, err := s.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	q := query_builder.NewQuery(`SELECT * FROM "TargetFlakeStats"`)
+	q = q.AddWhereClause(`group_id = ?`, user.GetGroupID())
+	if repoURL := req.GetSelector().GetRepoUrl(); repoURL != "" {
+		q = q.AddWhereClause(`repo_url = ?`, repoURL)
+	}
+	if label := req.GetSelector().GetLabel(); label != "" {
+		q = q.AddWhereClause(`label = ?`, label)
+	}
+	if minFlakeRate := req.GetSelector().GetMinFlakeRate(); minFlakeRate > 0 {
+		q = q.AddWhereClause(`flaky_runs >= ? * total_runs`, minFlakeRate)
+	}
+	q = q.SetOrderBy(`flaky_runs * 1.0 / total_runs`, false /*=ascending*/)
+	q = q.SetLimit(maxFlakeStatsResults)
+	queryStr, args := q.Build()
+
+	rq := s.env.GetDBHandle().NewQuery(ctx, "api_server_get_target_flake_stats").Raw(queryStr, args...)
+	rsp := &apipb.GetTargetFlakeStatsResponse{}
+	err = db.ScanEach(rq, func(ctx context.Context, ts *tables.TargetFlakeStats) error {
+		rsp.Stats = append(rsp.Stats, &apipb.TargetFlakeStats{
+			Label:           ts.Label,
+			RepoUrl:         ts.RepoURL,
+			WindowStartTime: timestamppb.New(time.UnixMicro(ts.WindowStartUsec)),
+			WindowEndTime:   timestamppb.New(time.UnixMicro(ts.WindowEndUsec)),
+			TotalRuns:       ts.TotalRuns,
+			FlakyRuns:       ts.FlakyRuns,
+			FailedRuns:      ts.FailedRuns,
+			FlakeRate:       flake_detector.FlakeRate(ts),
+			TotalAttempts:   ts.TotalAttempts,
+			FailedAttempts:  ts.FailedAttempts,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rsp, nil
+}
+
 func (s *APIServer) redisCachedActions(ctx context.Context, userInfo interfaces.UserInfo, iid, targetLabel string) ([]*apipb.Action, error) {
 	if !s.CacheEnabled() || s.env.GetMetricsCollector() == nil {
 		return nil, nil
@@ -366,6 +520,63 @@ func (s *APIServer) GetLog(ctx context.Context, req *apipb.GetLogRequest) (*apip
 	}, nil
 }
 
+func (s *APIServer) SearchLogs(ctx context.Context, req *apipb.SearchLogsRequest) (*apipb.SearchLogsResponse, error) {
+	logIndex := s.env.GetLogIndex()
+	if logIndex == nil {
+		return nil, status.UnimplementedError("Log search is not enabled")
+	}
+	user, err := s.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.GetQuery() == "" {
+		return nil, status.InvalidArgumentError("SearchLogsRequest must contain a query")
+	}
+
+	q := &interfaces.LogSearchQuery{
+		GroupID:    user.GetGroupID(),
+		Query:      req.GetQuery(),
+		MaxResults: int(req.GetMaxResults()),
+	}
+	if req.GetStartTime() != nil {
+		q.StartTimeUsec = req.GetStartTime().AsTime().UnixMicro()
+	}
+	if req.GetEndTime() != nil {
+		q.EndTimeUsec = req.GetEndTime().AsTime().UnixMicro()
+	}
+	matches, err := logIndex.SearchLogs(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	rsp := &apipb.SearchLogsResponse{}
+	// The index only knows the group of each log, so check that the user may
+	// read the invocation and download its logs, like GetLog does.
+	authorized := make(map[string]bool)
+	for _, m := range matches {
+		iid := m.Log.InvocationID
+		ok, checked := authorized[iid]
+		if !checked {
+			err := s.authorizeInvocationDownload(ctx, iid)
+			if err != nil && !db.IsRecordNotFound(err) && !status.IsNotFoundError(err) && !status.IsPermissionDeniedError(err) {
+				return nil, err
+			}
+			ok = err == nil
+			authorized[iid] = ok
+		}
+		if !ok {
+			continue
+		}
+		rsp.Match = append(rsp.Match, &apipb.LogMatch{
+			InvocationId: m.Log.InvocationID,
+			TargetLabel:  m.Log.TargetLabel,
+			Offset:       m.Offset,
+			LineNumber:   m.LineNumber,
+			Line:         m.Line,
+		})
+	}
+	return rsp, nil
+}
+
 type getFileWriter struct {
 	s apipb.ApiService_GetFileServer
 }
@@ -382,6 +593,9 @@ func (s *APIServer) GetFile(req *apipb.GetFileRequest, server apipb.ApiService_G
 	if _, err := s.env.GetAuthenticator().AuthenticatedUser(ctx); err != nil {
 		return err
 	}
+	if err := s.authorizeFileDownload(ctx, req); err != nil {
+		return err
+	}
 
 	parsedURL, err := url.Parse(req.GetUri())
 	if err != nil {
@@ -393,6 +607,27 @@ func (s *APIServer) GetFile(req *apipb.GetFileRequest, server apipb.ApiService_G
 	return s.env.GetPooledByteStreamClient().StreamBytestreamFile(ctx, parsedURL, writer)
 }
 
+func (s *APIServer) GetArtifactManifest(ctx context.Context, req *apipb.GetArtifactManifestRequest) (*apipb.GetArtifactManifestResponse, error) {
+	// No need for the returned user here, because user filters will be
+	// applied by LookupInvocation.
+	if _, err := s.env.GetAuthenticator().AuthenticatedUser(ctx); err != nil {
+		return nil, err
+	}
+	if req.GetInvocationId() == "" {
+		return nil, status.InvalidArgumentError("GetArtifactManifestRequest must contain a valid invocation_id")
+	}
+	inv, err := build_event_handler.LookupInvocation(s.env, ctx, req.GetInvocationId())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.authorizeInvocationDownload(ctx, req.GetInvocationId()); err != nil {
+		return nil, err
+	}
+	return &apipb.GetArtifactManifestResponse{
+		Artifact: artifactManifest(inv),
+	}, nil
+}
+
 func (s *APIServer) DeleteFile(ctx context.Context, req *apipb.DeleteFileRequest) (*apipb.DeleteFileResponse, error) {
 	if !*enableCacheDeleteAPI {
 		return nil, status.PermissionDeniedError("DeleteFile API not enabled")
@@ -455,6 +690,17 @@ func (s *APIServer) handleGetFileRequest(w http.ResponseWriter, r *http.Request)
 	req := apipb.GetFileRequest{}
 	protolet.ReadRequestToProto(r, &req)
 
+	if err := s.authorizeFileDownload(r.Context(), &req); err != nil {
+		if status.IsNotFoundError(err) {
+			http.Error(w, "Invocation not found", http.StatusNotFound)
+		} else if status.IsPermissionDeniedError(err) {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+		} else {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
 	parsedURL, err := url.Parse(req.GetUri())
 	if err != nil {
 		http.Error(w, "Invalid URI", http.StatusBadRequest)
@@ -467,6 +713,85 @@ func (s *APIServer) handleGetFileRequest(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+// authorizeInvocationDownload checks whether the authenticated user can
+// download the artifacts of an invocation that they can read.
+func (s *APIServer) authorizeInvocationDownload(ctx context.Context, iid string) error {
+	ti, err := s.env.GetInvocationDB().LookupInvocation(ctx, iid)
+	if err != nil {
+		return err
+	}
+	return perms.AuthorizeInvocationDownload(ctx, s.env, ti.UserID, ti.GroupID, ti.DownloadPerms)
+}
+
+// authorizeFileDownload checks whether the authenticated user can download
+// the requested file. Files of an invocation are subject to its download
+// permissions. Files that aren't requested as part of an invocation are read
+// directly from the cache, which requires the same access as reading them
+// with ByteStream.
+func (s *APIServer) authorizeFileDownload(ctx context.Context, req *apipb.GetFileRequest) error {
+	if req.GetInvocationId() != "" {
+		return s.authorizeInvocationDownload(ctx, req.GetInvocationId())
+	}
+	return scopes.AuthorizeRPC(ctx, s.env, byteStreamReadMethod)
+}
+
+func (s *APIServer) DownloadArtifactsHandler() http.Handler {
+	return http.HandlerFunc(s.handleDownloadArtifactsRequest)
+}
+
+// Streams all artifacts in an invocation's artifact manifest as a single
+// archive.
+func (s *APIServer) handleDownloadArtifactsRequest(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if _, err := s.env.GetAuthenticator().AuthenticatedUser(ctx); err != nil {
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+
+	req := &apipb.DownloadArtifactsRequest{}
+	if err := protolet.ReadRequestToProto(r, req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.GetInvocationId() == "" {
+		http.Error(w, "DownloadArtifactsRequest must contain a valid invocation_id", http.StatusBadRequest)
+		return
+	}
+	inv, err := build_event_handler.LookupInvocation(s.env, ctx, req.GetInvocationId())
+	if err == nil {
+		err = s.authorizeInvocationDownload(ctx, req.GetInvocationId())
+	}
+	if err != nil {
+		if status.IsNotFoundError(err) {
+			http.Error(w, "Invocation not found", http.StatusNotFound)
+		} else if status.IsPermissionDeniedError(err) {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+		} else {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	extension := "zip"
+	contentType := "application/zip"
+	if req.GetFormat() == apipb.DownloadArtifactsRequest_TAR {
+		extension = "tar"
+		contentType = "application/x-tar"
+	}
+	aw, err := newArchiveWriter(w, req.GetFormat())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s-artifacts.%s", req.GetInvocationId(), extension))
+	w.Header().Set("Content-Type", contentType)
+	// Once the archive has started streaming, errors can't be reported with
+	// the response status, so they leave the archive unfinished instead.
+	if err := writeArtifacts(ctx, s.env.GetPooledByteStreamClient(), aw, artifactManifest(inv)); err != nil {
+		log.CtxWarningf(ctx, "Failed to download artifacts for invocation %s: %s", req.GetInvocationId(), err)
+	}
+}
+
 func (s *APIServer) GetMetricsHandler() http.Handler {
 	return http.HandlerFunc(s.handleGetMetricsRequest)
 }
@@ -1,29 +1,52 @@
 package api
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/log_index"
 	"github.com/buildbuddy-io/buildbuddy/proto/api_key"
 	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/google/go-cmp/cmp"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/testing/protocmp"
 	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	apipb "github.com/buildbuddy-io/buildbuddy/proto/api/v1"
+	cmnpb "github.com/buildbuddy-io/buildbuddy/proto/api/v1/common"
 	bepb "github.com/buildbuddy-io/buildbuddy/proto/build_events"
+	capb "github.com/buildbuddy-io/buildbuddy/proto/cache"
+	clpb "github.com/buildbuddy-io/buildbuddy/proto/command_line"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
 	pepb "github.com/buildbuddy-io/buildbuddy/proto/publish_build_event"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
 )
 
@@ -88,6 +111,101 @@ func TestGetInvocationAuth(t *testing.T) {
 	require.Nil(t, resp)
 }
 
+func TestCompareInvocations(t *testing.T) {
+	env, ctx := getEnvAndCtx(t, "user1")
+	baseInvocationID := uuid.NewString()
+	invocationID := uuid.NewString()
+	streamBuild(t, env, baseInvocationID)
+	streamBuild(t, env, invocationID)
+	s := NewAPIServer(env)
+
+	resp, err := s.CompareInvocations(ctx, &apipb.CompareInvocationsRequest{BaseInvocationId: baseInvocationID, InvocationId: invocationID})
+	require.NoError(t, err)
+	assert.Empty(t, resp.Target)
+	assert.Empty(t, resp.Option)
+
+	_, err = s.CompareInvocations(ctx, &apipb.CompareInvocationsRequest{InvocationId: invocationID})
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error, got %v", err)
+}
+
+func TestCompareInvocationsAuth(t *testing.T) {
+	env, ctx := getEnvAndCtx(t, "")
+	baseInvocationID := uuid.NewString()
+	invocationID := uuid.NewString()
+	streamBuild(t, env, baseInvocationID)
+	streamBuild(t, env, invocationID)
+	s := NewAPIServer(env)
+
+	_, err := s.CompareInvocations(ctx, &apipb.CompareInvocationsRequest{BaseInvocationId: baseInvocationID, InvocationId: invocationID})
+	require.Error(t, err)
+}
+
+func TestCompareInvocations_Diff(t *testing.T) {
+	base := &inpb.Invocation{
+		InvocationId: "base",
+		CommitSha:    "abc",
+		DurationUsec: 10e6,
+		CacheStats:   &capb.CacheStats{ActionCacheHits: 9, ActionCacheMisses: 1},
+		StructuredCommandLine: []*clpb.CommandLine{
+			canonicalCommandLine("remote_cache=grpcs://remote.buildbuddy.io", "config=ci", "client_env=CI=true", "client_env=HOME=/home/base"),
+		},
+		Event: []*inpb.InvocationEvent{
+			targetConfigured("//:lib"),
+			targetConfigured("//:test"),
+			testSummary("//:test", build_event_stream.TestStatus_PASSED, time.Second),
+			actionExecuted("GoCompile", time.Second),
+		},
+	}
+	inv := &inpb.Invocation{
+		InvocationId: "inv",
+		CommitSha:    "def",
+		DurationUsec: 30e6,
+		CacheStats:   &capb.CacheStats{ActionCacheHits: 1, ActionCacheMisses: 3},
+		StructuredCommandLine: []*clpb.CommandLine{
+			canonicalCommandLine("config=ci", "config=slow", "client_env=CI=true", "client_env=HOME=/home/inv"),
+		},
+		Event: []*inpb.InvocationEvent{
+			targetConfigured("//:lib"),
+			targetConfigured("//:test"),
+			testSummary("//:test", build_event_stream.TestStatus_FAILED, 3*time.Second),
+			actionExecuted("GoCompile", 2*time.Second),
+			actionExecuted("GoCompile", 2*time.Second),
+		},
+	}
+
+	diff := compareInvocations(base, inv)
+
+	expected := &apipb.CompareInvocationsResponse{
+		Field: []*apipb.InvocationFieldDiff{
+			{Name: "commit_sha", BaseValue: "abc", Value: "def"},
+		},
+		BaseDurationUsec: 10e6,
+		DurationUsec:     30e6,
+		Option: []*apipb.OptionDiff{
+			{Name: "config", BaseValue: []string{"ci"}, Value: []string{"ci", "slow"}},
+			{Name: "remote_cache", BaseValue: []string{"grpcs://remote.buildbuddy.io"}},
+		},
+		EnvironmentVariable: []*apipb.OptionDiff{
+			{Name: "HOME", BaseValue: []string{"/home/base"}, Value: []string{"/home/inv"}},
+		},
+		Target: []*apipb.TargetDiff{
+			{
+				Label:                "//:test",
+				BaseStatus:           cmnpb.Status_PASSED,
+				Status:               cmnpb.Status_FAILED,
+				BaseTestDurationUsec: 1e6,
+				TestDurationUsec:     3e6,
+			},
+		},
+		BaseCacheStats: &apipb.InvocationCacheStats{ActionCacheHits: 9, ActionCacheMisses: 1, ActionCacheHitRate: 0.9},
+		CacheStats:     &apipb.InvocationCacheStats{ActionCacheHits: 1, ActionCacheMisses: 3, ActionCacheHitRate: 0.25},
+		ActionDuration: []*apipb.ActionDurationDiff{
+			{Mnemonic: "GoCompile", BaseCount: 1, Count: 2, BaseTotalDurationUsec: 1e6, TotalDurationUsec: 4e6},
+		},
+	}
+	assert.Empty(t, cmp.Diff(expected, diff, protocmp.Transform()))
+}
+
 func TestGetTarget(t *testing.T) {
 	testUUID, err := uuid.NewRandom()
 	require.NoError(t, err)
@@ -144,6 +262,124 @@ func TestGetTargetByTag(t *testing.T) {
 	assert.Equal(t, 2, len(resp.Target))
 }
 
+func TestGetTargetFlakeStats(t *testing.T) {
+	flags.Set(t, "app.enable_target_tracking", true)
+	env, ctx := getEnvAndCtx(t, "user1")
+	for _, stats := range []*tables.TargetFlakeStats{
+		{TargetID: 1, GroupID: "group1", Label: "//:stable", TotalRuns: 10},
+		{TargetID: 2, GroupID: "group1", Label: "//:flaky", TotalRuns: 10, FlakyRuns: 5},
+		{TargetID: 3, GroupID: "group1", Label: "//:sometimes_flaky", TotalRuns: 10, FlakyRuns: 1},
+		{TargetID: 2, GroupID: "group2", Label: "//:flaky", TotalRuns: 10, FlakyRuns: 10},
+	} {
+		err := env.GetDBHandle().NewQuery(ctx, "create_flake_stats").Create(stats)
+		require.NoError(t, err)
+	}
+	s := NewAPIServer(env)
+
+	resp, err := s.GetTargetFlakeStats(ctx, &apipb.GetTargetFlakeStatsRequest{})
+	require.NoError(t, err)
+	require.Len(t, resp.Stats, 3)
+	assert.Equal(t, "//:flaky", resp.Stats[0].Label)
+	assert.Equal(t, 0.5, resp.Stats[0].FlakeRate)
+	assert.Equal(t, "//:sometimes_flaky", resp.Stats[1].Label)
+	assert.Equal(t, "//:stable", resp.Stats[2].Label)
+
+	resp, err = s.GetTargetFlakeStats(ctx, &apipb.GetTargetFlakeStatsRequest{Selector: &apipb.TargetFlakeStatsSelector{MinFlakeRate: 0.1}})
+	require.NoError(t, err)
+	require.Len(t, resp.Stats, 2)
+
+	resp, err = s.GetTargetFlakeStats(ctx, &apipb.GetTargetFlakeStatsRequest{Selector: &apipb.TargetFlakeStatsSelector{Label: "//:stable"}})
+	require.NoError(t, err)
+	require.Len(t, resp.Stats, 1)
+}
+
+func TestGetTimingTrend(t *testing.T) {
+	flags.Set(t, "app.enable_timing_profile_ingestion", true)
+	env, ctx := getEnvAndCtx(t, "user1")
+	monday := time.Date(2024, time.March, 4, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		createdAt time.Time
+		ti        *tables.Invocation
+		profile   *tables.InvocationTimingProfile
+	}{
+		{
+			createdAt: monday,
+			ti:        &tables.Invocation{InvocationID: "inv1", GroupID: "group1", Perms: perms.GROUP_READ, RepoURL: "repo1"},
+			profile:   &tables.InvocationTimingProfile{InvocationID: "inv1", AnalysisPhaseUsec: 100, CriticalPathUsec: 1000},
+		},
+		{
+			createdAt: monday.Add(time.Hour),
+			ti:        &tables.Invocation{InvocationID: "inv2", GroupID: "group1", Perms: perms.GROUP_READ, RepoURL: "repo1"},
+			profile:   &tables.InvocationTimingProfile{InvocationID: "inv2", AnalysisPhaseUsec: 200, CriticalPathUsec: 3000},
+		},
+		{
+			createdAt: monday.Add(24 * time.Hour),
+			ti:        &tables.Invocation{InvocationID: "inv3", GroupID: "group1", Perms: perms.GROUP_READ, RepoURL: "repo1"},
+			profile:   &tables.InvocationTimingProfile{InvocationID: "inv3", AnalysisPhaseUsec: 600, CriticalPathUsec: 2000},
+		},
+		{
+			createdAt: monday.Add(24 * time.Hour),
+			ti:        &tables.Invocation{InvocationID: "inv4", GroupID: "group1", Perms: perms.GROUP_READ, RepoURL: "repo2"},
+			profile:   &tables.InvocationTimingProfile{InvocationID: "inv4", AnalysisPhaseUsec: 5000},
+		},
+		// Invocations of other groups, invocations that are only visible to
+		// another user and invocations without a profile aren't included.
+		{
+			createdAt: monday,
+			ti:        &tables.Invocation{InvocationID: "inv5", GroupID: "group2", Perms: perms.GROUP_READ, RepoURL: "repo1"},
+			profile:   &tables.InvocationTimingProfile{InvocationID: "inv5", AnalysisPhaseUsec: 5000},
+		},
+		{
+			createdAt: monday,
+			ti:        &tables.Invocation{InvocationID: "inv7", GroupID: "group1", UserID: "user2", Perms: perms.OWNER_READ, RepoURL: "repo1"},
+			profile:   &tables.InvocationTimingProfile{InvocationID: "inv7", AnalysisPhaseUsec: 5000},
+		},
+		{
+			createdAt: monday,
+			ti:        &tables.Invocation{InvocationID: "inv6", GroupID: "group1", Perms: perms.GROUP_READ, RepoURL: "repo1"},
+		},
+	} {
+		env.GetInvocationDB().SetNowFunc(func() time.Time { return test.createdAt })
+		err := env.GetDBHandle().NewQuery(ctx, "create_invocation").Create(test.ti)
+		require.NoError(t, err)
+		if test.profile != nil {
+			err := env.GetDBHandle().NewQuery(ctx, "create_timing_profile").Create(test.profile)
+			require.NoError(t, err)
+		}
+	}
+	env.GetInvocationDB().SetNowFunc(time.Now)
+	s := NewAPIServer(env)
+
+	req := &apipb.GetTimingTrendRequest{
+		Selector:  &apipb.TimingTrendSelector{RepoUrl: "repo1"},
+		StartTime: timestamppb.New(monday.AddDate(0, 0, -7)),
+		EndTime:   timestamppb.New(monday.AddDate(0, 0, 7)),
+	}
+	rsp, err := s.GetTimingTrend(ctx, req)
+	require.NoError(t, err)
+	require.Len(t, rsp.GetBucket(), 2)
+	assert.Equal(t, time.Date(2024, time.March, 4, 0, 0, 0, 0, time.UTC), rsp.GetBucket()[0].GetStartTime().AsTime())
+	assert.Equal(t, int64(2), rsp.GetBucket()[0].GetInvocationCount())
+	assert.Equal(t, int64(150), rsp.GetBucket()[0].GetMean().GetAnalysisPhaseDurationUsec())
+	assert.Equal(t, int64(2000), rsp.GetBucket()[0].GetMean().GetCriticalPathDurationUsec())
+	assert.Equal(t, time.Date(2024, time.March, 5, 0, 0, 0, 0, time.UTC), rsp.GetBucket()[1].GetStartTime().AsTime())
+	assert.Equal(t, int64(1), rsp.GetBucket()[1].GetInvocationCount())
+
+	req.Interval = apipb.GetTimingTrendRequest_WEEK
+	rsp, err = s.GetTimingTrend(ctx, req)
+	require.NoError(t, err)
+	require.Len(t, rsp.GetBucket(), 1)
+	assert.Equal(t, time.Date(2024, time.March, 4, 0, 0, 0, 0, time.UTC), rsp.GetBucket()[0].GetStartTime().AsTime())
+	assert.Equal(t, int64(3), rsp.GetBucket()[0].GetInvocationCount())
+	assert.Equal(t, int64(300), rsp.GetBucket()[0].GetMean().GetAnalysisPhaseDurationUsec())
+	assert.Equal(t, int64(200), rsp.GetBucket()[0].GetMedian().GetAnalysisPhaseDurationUsec())
+	assert.Equal(t, int64(2000), rsp.GetBucket()[0].GetMedian().GetCriticalPathDurationUsec())
+
+	req.StartTime = timestamppb.New(monday.AddDate(0, 0, -100))
+	_, err = s.GetTimingTrend(ctx, req)
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error, got %v", err)
+}
+
 func TestGetAction(t *testing.T) {
 	testUUID, err := uuid.NewRandom()
 	assert.NoError(t, err)
@@ -239,6 +475,342 @@ func TestGetLogAuth(t *testing.T) {
 	require.Nil(t, resp)
 }
 
+func TestSearchLogs(t *testing.T) {
+	env, ctx := getEnvAndCtx(t, "user1")
+	s := NewAPIServer(env)
+	_, err := s.SearchLogs(ctx, &apipb.SearchLogsRequest{Query: "hello"})
+	require.True(t, status.IsUnimplementedError(err), "expected Unimplemented error, got %v", err)
+
+	li, err := log_index.New(testfs.MakeTempDir(t))
+	require.NoError(t, err)
+	t.Cleanup(func() { li.Close() })
+	env.SetLogIndex(li)
+	user, err := env.GetAuthenticator().AuthenticatedUser(ctx)
+	require.NoError(t, err)
+	l := &interfaces.IndexedLog{GroupID: user.GetGroupID(), InvocationID: "inv1", TargetLabel: "//foo:foo_test", InvocationCreatedAtUsec: time.Now().UnixMicro()}
+	err = li.IndexLog(ctx, l, strings.NewReader("=== RUN TestFoo\nhello world\n"))
+	require.NoError(t, err)
+	_, err = env.GetInvocationDB().CreateInvocation(ctx, &tables.Invocation{InvocationID: "inv1", UserID: user.GetUserID(), GroupID: user.GetGroupID(), Perms: perms.GROUP_READ})
+	require.NoError(t, err)
+
+	rsp, err := s.SearchLogs(ctx, &apipb.SearchLogsRequest{Query: "hello"})
+	require.NoError(t, err)
+	expected := &apipb.SearchLogsResponse{
+		Match: []*apipb.LogMatch{{
+			InvocationId: "inv1",
+			TargetLabel:  "//foo:foo_test",
+			Offset:       int64(len("=== RUN TestFoo\n")),
+			LineNumber:   2,
+			Line:         "hello world",
+		}},
+	}
+	require.Empty(t, cmp.Diff(expected, rsp, protocmp.Transform()))
+
+	_, err = s.SearchLogs(ctx, &apipb.SearchLogsRequest{})
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error, got %v", err)
+}
+
+func TestSearchLogsInvocationPerms(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	ta := testauth.NewTestAuthenticator(testauth.TestUsers("user1", "group1", "user2", "group1"))
+	te.SetAuthenticator(ta)
+	li, err := log_index.New(testfs.MakeTempDir(t))
+	require.NoError(t, err)
+	t.Cleanup(func() { li.Close() })
+	te.SetLogIndex(li)
+	s := NewAPIServer(te)
+	ctx1, err := ta.WithAuthenticatedUser(context.Background(), "user1")
+	require.NoError(t, err)
+	ctx2, err := ta.WithAuthenticatedUser(context.Background(), "user2")
+	require.NoError(t, err)
+
+	// All of the invocations are user2's. They're inserted directly, since
+	// CreateInvocation adds the group's default permissions.
+	for _, inv := range []*tables.Invocation{
+		{InvocationID: "inv-group", Perms: perms.GROUP_READ},
+		{InvocationID: "inv-owner", Perms: perms.OWNER_READ},
+		{InvocationID: "inv-restricted-download", Perms: perms.GROUP_READ, DownloadPerms: perms.OWNER_READ},
+	} {
+		inv.UserID = "user2"
+		inv.GroupID = "group1"
+		err := te.GetDBHandle().NewQuery(ctx2, "api_test_create_invocation").Create(inv)
+		require.NoError(t, err)
+	}
+	// inv-deleted is the log of an invocation that no longer exists.
+	for _, iid := range []string{"inv-group", "inv-owner", "inv-restricted-download", "inv-deleted"} {
+		l := &interfaces.IndexedLog{GroupID: "group1", InvocationID: iid, InvocationCreatedAtUsec: time.Now().UnixMicro()}
+		err := li.IndexLog(ctx2, l, strings.NewReader("hello world\n"))
+		require.NoError(t, err)
+	}
+
+	searchInvocations := func(ctx context.Context) []string {
+		rsp, err := s.SearchLogs(ctx, &apipb.SearchLogsRequest{Query: "hello"})
+		require.NoError(t, err)
+		var iids []string
+		for _, m := range rsp.GetMatch() {
+			iids = append(iids, m.GetInvocationId())
+		}
+		return iids
+	}
+	// Other members of the group only see the logs they may download.
+	require.ElementsMatch(t, []string{"inv-group"}, searchInvocations(ctx1))
+	require.ElementsMatch(t, []string{"inv-group", "inv-owner", "inv-restricted-download"}, searchInvocations(ctx2))
+}
+
+func TestSearchLogsAuth(t *testing.T) {
+	env, ctx := getEnvAndCtx(t, "")
+	li, err := log_index.New(testfs.MakeTempDir(t))
+	require.NoError(t, err)
+	t.Cleanup(func() { li.Close() })
+	env.SetLogIndex(li)
+	s := NewAPIServer(env)
+	resp, err := s.SearchLogs(ctx, &apipb.SearchLogsRequest{Query: "hello"})
+	require.Error(t, err)
+	require.Nil(t, resp)
+}
+
+func TestGetArtifactManifest(t *testing.T) {
+	foo := bytestreamFile(t, "foo/foo", []byte("foo"))
+	fooLib := bytestreamFile(t, "foo/libfoo.a", []byte("libfoo"))
+	uploaded := bytestreamFile(t, "timing_profile.gz", []byte("profile"))
+	inv := &inpb.Invocation{
+		InvocationId: "inv",
+		Event: []*inpb.InvocationEvent{
+			namedSetOfFiles("1", []*build_event_stream.File{foo}, "2"),
+			namedSetOfFiles("2", []*build_event_stream.File{fooLib}),
+			targetCompleted("//foo:foo", "default", "1"),
+			namedSetOfFiles("3", []*build_event_stream.File{
+				uploaded,
+				// Files that aren't in the cache, or that would escape the
+				// archive root, are skipped.
+				{Name: "local.txt", File: &build_event_stream.File_Uri{Uri: "file:///tmp/local.txt"}},
+				{Name: "../../etc/passwd", File: &build_event_stream.File_Uri{Uri: foo.GetUri()}},
+			}),
+		},
+	}
+
+	manifest := artifactManifest(inv)
+
+	expected := []*apipb.Artifact{
+		{
+			Path:        "bazel-out/k8-fastbuild/bin/foo/foo",
+			File:        &apipb.File{Name: "foo/foo", Uri: foo.GetUri(), Hash: foo.GetDigest(), SizeBytes: 3},
+			TargetLabel: "//foo:foo",
+			OutputGroup: "default",
+		},
+		{
+			Path:        "bazel-out/k8-fastbuild/bin/foo/libfoo.a",
+			File:        &apipb.File{Name: "foo/libfoo.a", Uri: fooLib.GetUri(), Hash: fooLib.GetDigest(), SizeBytes: 6},
+			TargetLabel: "//foo:foo",
+			OutputGroup: "default",
+		},
+		{
+			Path: "bazel-out/k8-fastbuild/bin/timing_profile.gz",
+			File: &apipb.File{Name: "timing_profile.gz", Uri: uploaded.GetUri(), Hash: uploaded.GetDigest(), SizeBytes: 7},
+		},
+	}
+	assert.Empty(t, cmp.Diff(expected, manifest, protocmp.Transform()))
+}
+
+func TestGetArtifactManifestAuth(t *testing.T) {
+	testUUID, err := uuid.NewRandom()
+	require.NoError(t, err)
+	testInvocationID := testUUID.String()
+
+	env, ctx := getEnvAndCtx(t, "")
+	streamBuild(t, env, testInvocationID)
+	s := NewAPIServer(env)
+	resp, err := s.GetArtifactManifest(ctx, &apipb.GetArtifactManifestRequest{InvocationId: testInvocationID})
+	require.Error(t, err)
+	require.Nil(t, resp)
+}
+
+func TestInvocationDownloadPerms(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	ta := testauth.NewTestAuthenticator(testauth.TestUsers("user1", "group1", "user2", "group1"))
+	te.SetAuthenticator(ta)
+	f := bytestreamFile(t, "foo/foo", []byte("foo"))
+	bsClient := &fakeByteStreamClient{blobs: map[string][]byte{}}
+	bsClient.add(t, f.GetUri(), []byte("foo"))
+	te.SetPooledByteStreamClient(bsClient)
+	s := NewAPIServer(te)
+	ctx1, err := ta.WithAuthenticatedUser(context.Background(), "user1")
+	require.NoError(t, err)
+	ctx2, err := ta.WithAuthenticatedUser(context.Background(), "user2")
+	require.NoError(t, err)
+
+	// The invocation is user1's, and only user1 may download its artifacts.
+	testUUID, err := uuid.NewRandom()
+	require.NoError(t, err)
+	iid := testUUID.String()
+	streamBuild(t, te, iid)
+	err = te.GetDBHandle().NewQuery(ctx1, "api_test_restrict_download").Raw(
+		`UPDATE "Invocations" SET download_perms = ? WHERE invocation_id = ?`, perms.OWNER_READ, iid).Exec().Error
+	require.NoError(t, err)
+
+	_, err = s.GetArtifactManifest(ctx1, &apipb.GetArtifactManifestRequest{InvocationId: iid})
+	require.NoError(t, err)
+	_, err = s.GetArtifactManifest(ctx2, &apipb.GetArtifactManifestRequest{InvocationId: iid})
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+
+	getFile := func(ctx context.Context, req *apipb.GetFileRequest) *httptest.ResponseRecorder {
+		b, err := protojson.Marshal(req)
+		require.NoError(t, err)
+		r := httptest.NewRequest("POST", "/api/v1/GetFile", bytes.NewReader(b)).WithContext(ctx)
+		rec := httptest.NewRecorder()
+		s.GetFileHandler().ServeHTTP(rec, r)
+		return rec
+	}
+	rec := getFile(ctx1, &apipb.GetFileRequest{Uri: f.GetUri(), InvocationId: iid})
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "foo", rec.Body.String())
+	rec = getFile(ctx2, &apipb.GetFileRequest{Uri: f.GetUri(), InvocationId: iid})
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	// Files that aren't requested as part of an invocation are read from
+	// the cache like any other blob.
+	rec = getFile(ctx2, &apipb.GetFileRequest{Uri: f.GetUri()})
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	err = s.GetFile(&apipb.GetFileRequest{Uri: f.GetUri(), InvocationId: iid}, &fakeGetFileServer{ctx: ctx2})
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+	srv := &fakeGetFileServer{ctx: ctx1}
+	err = s.GetFile(&apipb.GetFileRequest{Uri: f.GetUri(), InvocationId: iid}, srv)
+	require.NoError(t, err)
+	require.Equal(t, "foo", srv.data.String())
+}
+
+func TestWriteArtifacts(t *testing.T) {
+	ctx := context.Background()
+	bsClient := &fakeByteStreamClient{blobs: map[string][]byte{}}
+	contents := map[string]string{
+		"bazel-out/k8-fastbuild/bin/foo/foo":      "foo",
+		"bazel-out/k8-fastbuild/bin/foo/libfoo.a": "libfoo",
+	}
+	var artifacts []*apipb.Artifact
+	for _, name := range []string{"foo/foo", "foo/libfoo.a"} {
+		f := bytestreamFile(t, name, []byte(contents["bazel-out/k8-fastbuild/bin/"+name]))
+		bsClient.add(t, f.GetUri(), []byte(contents["bazel-out/k8-fastbuild/bin/"+name]))
+		artifacts = append(artifacts, newArtifact(f, "//foo:foo", "default"))
+	}
+
+	buf := &bytes.Buffer{}
+	aw, err := newArchiveWriter(buf, apipb.DownloadArtifactsRequest_ZIP)
+	require.NoError(t, err)
+	err = writeArtifacts(ctx, bsClient, aw, artifacts)
+	require.NoError(t, err)
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	got := map[string]string{}
+	for _, f := range zr.File {
+		r, err := f.Open()
+		require.NoError(t, err)
+		b, err := io.ReadAll(r)
+		require.NoError(t, err)
+		got[f.Name] = string(b)
+	}
+	assert.Equal(t, contents, got)
+
+	buf = &bytes.Buffer{}
+	aw, err = newArchiveWriter(buf, apipb.DownloadArtifactsRequest_TAR)
+	require.NoError(t, err)
+	err = writeArtifacts(ctx, bsClient, aw, artifacts)
+	require.NoError(t, err)
+	tr := tar.NewReader(buf)
+	got = map[string]string{}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		b, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		got[h.Name] = string(b)
+	}
+	assert.Equal(t, contents, got)
+}
+
+func TestWriteArtifacts_DigestMismatch(t *testing.T) {
+	ctx := context.Background()
+	bsClient := &fakeByteStreamClient{blobs: map[string][]byte{}}
+	f := bytestreamFile(t, "foo/foo", []byte("foo"))
+	bsClient.add(t, f.GetUri(), []byte("bar"))
+
+	aw, err := newArchiveWriter(&bytes.Buffer{}, apipb.DownloadArtifactsRequest_ZIP)
+	require.NoError(t, err)
+	err = writeArtifacts(ctx, bsClient, aw, []*apipb.Artifact{newArtifact(f, "//foo:foo", "default")})
+	require.True(t, status.IsDataLossError(err), "expected DataLoss error, got %v", err)
+}
+
+func TestStreamInvocation(t *testing.T) {
+	testUUID, err := uuid.NewRandom()
+	require.NoError(t, err)
+	testInvocationID := testUUID.String()
+
+	env, ctx := getEnvAndCtx(t, "user1")
+	streamBuild(t, env, testInvocationID)
+	s := NewAPIServer(env)
+	req := httptest.NewRequest("GET", "/api/v1/StreamInvocation?invocation_id="+testInvocationID, nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	s.StreamInvocationHandler().ServeHTTP(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "text/event-stream", rec.Header().Get("Content-Type"))
+	var eventNames []string
+	events := map[string][]string{}
+	for _, block := range strings.Split(strings.TrimSpace(rec.Body.String()), "\n\n") {
+		lines := strings.Split(block, "\n")
+		require.Len(t, lines, 2)
+		name := strings.TrimPrefix(lines[0], "event: ")
+		eventNames = append(eventNames, name)
+		events[name] = append(events[name], strings.TrimPrefix(lines[1], "data: "))
+	}
+	// The invocation is complete, so all updates are sent at once.
+	require.Equal(t, "invocation", eventNames[0])
+	require.Equal(t, "done", eventNames[len(eventNames)-1])
+
+	inv := &apipb.Invocation{}
+	err = protojson.Unmarshal([]byte(events["invocation"][0]), inv)
+	require.NoError(t, err)
+	assert.Equal(t, testInvocationID, inv.GetId().GetInvocationId())
+	assert.Equal(t, apipb.Invocation_COMPLETE, inv.GetInvocationStatus())
+
+	var labels []string
+	for _, data := range events["build_event"] {
+		event := &build_event_stream.BuildEvent{}
+		err := protojson.Unmarshal([]byte(data), event)
+		require.NoError(t, err)
+		if label := event.GetId().GetTargetCompleted().GetLabel(); label != "" {
+			labels = append(labels, label)
+		}
+	}
+	assert.Equal(t, []string{"//my/target:foo", "//my/other/target:foo", "//my/third/target:foo"}, labels)
+
+	var logs string
+	for _, data := range events["log"] {
+		chunk := &apipb.LogChunk{}
+		err := protojson.Unmarshal([]byte(data), chunk)
+		require.NoError(t, err)
+		assert.False(t, chunk.GetLive())
+		logs += chunk.GetContents()
+	}
+	assert.Equal(t, "hello world", logs)
+}
+
+func TestStreamInvocationAuth(t *testing.T) {
+	testUUID, err := uuid.NewRandom()
+	require.NoError(t, err)
+	testInvocationID := testUUID.String()
+
+	env, ctx := getEnvAndCtx(t, "")
+	streamBuild(t, env, testInvocationID)
+	s := NewAPIServer(env)
+	req := httptest.NewRequest("GET", "/api/v1/StreamInvocation?invocation_id="+testInvocationID, nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	s.StreamInvocationHandler().ServeHTTP(rec, req)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
 func TestDeleteFile_CAS(t *testing.T) {
 	flags.Set(t, "enable_cache_delete_api", true)
 	var err error
@@ -614,3 +1186,160 @@ func finishedEvent() *anypb.Any {
 	})
 	return finishedAny
 }
+
+func canonicalCommandLine(options ...string) *clpb.CommandLine {
+	optionList := &clpb.OptionList{}
+	for _, o := range options {
+		name, value, _ := strings.Cut(o, "=")
+		optionList.Option = append(optionList.Option, &clpb.Option{
+			CombinedForm: "--" + o,
+			OptionName:   name,
+			OptionValue:  value,
+		})
+	}
+	return &clpb.CommandLine{
+		CommandLineLabel: "canonical",
+		Sections: []*clpb.CommandLineSection{
+			{
+				SectionLabel: "command options",
+				SectionType:  &clpb.CommandLineSection_OptionList{OptionList: optionList},
+			},
+		},
+	}
+}
+
+func targetConfigured(label string) *inpb.InvocationEvent {
+	return &inpb.InvocationEvent{
+		BuildEvent: &build_event_stream.BuildEvent{
+			Id: &build_event_stream.BuildEventId{
+				Id: &build_event_stream.BuildEventId_TargetConfigured{
+					TargetConfigured: &build_event_stream.BuildEventId_TargetConfiguredId{Label: label},
+				},
+			},
+			Payload: &build_event_stream.BuildEvent_Configured{
+				Configured: &build_event_stream.TargetConfigured{TargetKind: "go_test rule"},
+			},
+		},
+	}
+}
+
+func testSummary(label string, testStatus build_event_stream.TestStatus, duration time.Duration) *inpb.InvocationEvent {
+	return &inpb.InvocationEvent{
+		BuildEvent: &build_event_stream.BuildEvent{
+			Id: &build_event_stream.BuildEventId{
+				Id: &build_event_stream.BuildEventId_TestSummary{
+					TestSummary: &build_event_stream.BuildEventId_TestSummaryId{Label: label},
+				},
+			},
+			Payload: &build_event_stream.BuildEvent_TestSummary{
+				TestSummary: &build_event_stream.TestSummary{
+					OverallStatus:    testStatus,
+					FirstStartTime:   timestamppb.Now(),
+					TotalRunDuration: durationpb.New(duration),
+				},
+			},
+		},
+	}
+}
+
+func actionExecuted(mnemonic string, duration time.Duration) *inpb.InvocationEvent {
+	start := time.Now()
+	return &inpb.InvocationEvent{
+		BuildEvent: &build_event_stream.BuildEvent{
+			Payload: &build_event_stream.BuildEvent_Action{
+				Action: &build_event_stream.ActionExecuted{
+					Type:      mnemonic,
+					StartTime: timestamppb.New(start),
+					EndTime:   timestamppb.New(start.Add(duration)),
+				},
+			},
+		},
+	}
+}
+
+// fakeGetFileServer collects the data streamed by GetFile.
+type fakeGetFileServer struct {
+	apipb.ApiService_GetFileServer
+	ctx  context.Context
+	data bytes.Buffer
+}
+
+func (s *fakeGetFileServer) Context() context.Context {
+	return s.ctx
+}
+
+func (s *fakeGetFileServer) Send(rsp *apipb.GetFileResponse) error {
+	s.data.Write(rsp.GetData())
+	return nil
+}
+
+// fakeByteStreamClient serves blobs keyed by their bytestream URI path.
+type fakeByteStreamClient struct {
+	interfaces.PooledByteStreamClient
+	blobs map[string][]byte
+}
+
+func (c *fakeByteStreamClient) add(t *testing.T, uri string, b []byte) {
+	u, err := url.Parse(uri)
+	require.NoError(t, err)
+	c.blobs[u.Path] = b
+}
+
+func (c *fakeByteStreamClient) StreamBytestreamFile(ctx context.Context, u *url.URL, w io.Writer) error {
+	b, ok := c.blobs[u.Path]
+	if !ok {
+		return status.NotFoundErrorf("%s not found", u)
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func bytestreamFile(t *testing.T, name string, contents []byte) *build_event_stream.File {
+	d, err := digest.Compute(bytes.NewReader(contents), repb.DigestFunction_SHA256)
+	require.NoError(t, err)
+	return &build_event_stream.File{
+		Name:       name,
+		PathPrefix: []string{"bazel-out", "k8-fastbuild", "bin"},
+		File:       &build_event_stream.File_Uri{Uri: fmt.Sprintf("bytestream://localhost:1985/blobs/%s/%d", d.GetHash(), d.GetSizeBytes())},
+		Digest:     d.GetHash(),
+		Length:     d.GetSizeBytes(),
+	}
+}
+
+func namedSetOfFiles(id string, files []*build_event_stream.File, children ...string) *inpb.InvocationEvent {
+	fileSet := &build_event_stream.NamedSetOfFiles{Files: files}
+	for _, child := range children {
+		fileSet.FileSets = append(fileSet.FileSets, &build_event_stream.BuildEventId_NamedSetOfFilesId{Id: child})
+	}
+	return &inpb.InvocationEvent{
+		BuildEvent: &build_event_stream.BuildEvent{
+			Id: &build_event_stream.BuildEventId{
+				Id: &build_event_stream.BuildEventId_NamedSet{
+					NamedSet: &build_event_stream.BuildEventId_NamedSetOfFilesId{Id: id},
+				},
+			},
+			Payload: &build_event_stream.BuildEvent_NamedSetOfFiles{NamedSetOfFiles: fileSet},
+		},
+	}
+}
+
+func targetCompleted(label, outputGroup, fileSetID string) *inpb.InvocationEvent {
+	return &inpb.InvocationEvent{
+		BuildEvent: &build_event_stream.BuildEvent{
+			Id: &build_event_stream.BuildEventId{
+				Id: &build_event_stream.BuildEventId_TargetCompleted{
+					TargetCompleted: &build_event_stream.BuildEventId_TargetCompletedId{Label: label},
+				},
+			},
+			Payload: &build_event_stream.BuildEvent_Completed{
+				Completed: &build_event_stream.TargetComplete{
+					Success: true,
+					OutputGroup: []*build_event_stream.OutputGroup{{
+						Name:     outputGroup,
+						FileSets: []*build_event_stream.BuildEventId_NamedSetOfFilesId{{Id: fileSetID}},
+					}},
+				},
+			},
+		},
+	}
+}
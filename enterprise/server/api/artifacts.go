@@ -0,0 +1,218 @@
+package api
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"encoding/hex"
+	"io"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	apipb "github.com/buildbuddy-io/buildbuddy/proto/api/v1"
+	bespb "github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+// artifactManifest returns the named output artifacts of an invocation, which
+// must have been looked up with its events. Artifacts are attributed to the
+// first target output group that references them. Files that aren't stored
+// in the cache, or whose paths would escape the archive root, are skipped.
+func artifactManifest(inv *inpb.Invocation) []*apipb.Artifact {
+	fileSets := make(map[string]*bespb.NamedSetOfFiles)
+	var fileSetIDs []string
+	var completed []*bespb.BuildEvent
+	for _, event := range inv.GetEvent() {
+		switch p := event.GetBuildEvent().GetPayload().(type) {
+		case *bespb.BuildEvent_NamedSetOfFiles:
+			id := event.GetBuildEvent().GetId().GetNamedSet().GetId()
+			fileSets[id] = p.NamedSetOfFiles
+			fileSetIDs = append(fileSetIDs, id)
+		case *bespb.BuildEvent_Completed:
+			completed = append(completed, event.GetBuildEvent())
+		}
+	}
+
+	artifacts := make(map[string]*apipb.Artifact)
+	visited := make(map[string]bool)
+	var addFileSet func(id, label, outputGroup string)
+	addFileSet = func(id, label, outputGroup string) {
+		if visited[id] {
+			return
+		}
+		visited[id] = true
+		fileSet := fileSets[id]
+		for _, f := range fileSet.GetFiles() {
+			a := newArtifact(f, label, outputGroup)
+			if a == nil {
+				continue
+			}
+			if _, ok := artifacts[a.GetPath()]; !ok {
+				artifacts[a.GetPath()] = a
+			}
+		}
+		for _, child := range fileSet.GetFileSets() {
+			addFileSet(child.GetId(), label, outputGroup)
+		}
+	}
+	for _, event := range completed {
+		label := event.GetId().GetTargetCompleted().GetLabel()
+		for _, outputGroup := range event.GetCompleted().GetOutputGroup() {
+			for _, id := range outputGroup.GetFileSets() {
+				addFileSet(id.GetId(), label, outputGroup.GetName())
+			}
+		}
+	}
+	// Include file sets that aren't referenced by any target, such as
+	// artifacts uploaded by BuildBuddy's own tools.
+	for _, id := range fileSetIDs {
+		addFileSet(id, "", "")
+	}
+
+	manifest := make([]*apipb.Artifact, 0, len(artifacts))
+	for _, a := range artifacts {
+		manifest = append(manifest, a)
+	}
+	sort.Slice(manifest, func(i, j int) bool {
+		return manifest[i].GetPath() < manifest[j].GetPath()
+	})
+	return manifest
+}
+
+func newArtifact(f *bespb.File, label, outputGroup string) *apipb.Artifact {
+	rn, err := artifactResourceName(f.GetUri())
+	if err != nil {
+		return nil
+	}
+	p := path.Clean(path.Join(append(f.GetPathPrefix(), f.GetName())...))
+	if path.IsAbs(p) || p == "." || p == ".." || strings.HasPrefix(p, "../") {
+		return nil
+	}
+	return &apipb.Artifact{
+		Path: p,
+		File: &apipb.File{
+			Name:      f.GetName(),
+			Uri:       f.GetUri(),
+			Hash:      rn.GetDigest().GetHash(),
+			SizeBytes: rn.GetDigest().GetSizeBytes(),
+		},
+		TargetLabel: label,
+		OutputGroup: outputGroup,
+	}
+}
+
+func artifactResourceName(uri string) (*digest.ResourceName, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("invalid artifact URI %q: %s", uri, err)
+	}
+	if u.Scheme != "bytestream" {
+		return nil, status.InvalidArgumentErrorf("artifact URI %q is not a bytestream URI", uri)
+	}
+	return digest.ParseDownloadResourceName(strings.TrimPrefix(u.RequestURI(), "/"))
+}
+
+// archiveWriter writes files to an archive.
+type archiveWriter interface {
+	// Create adds a file with the given path and size to the archive, and
+	// returns a writer for its contents.
+	Create(name string, size int64) (io.Writer, error)
+	Close() error
+}
+
+type zipArchiveWriter struct {
+	*zip.Writer
+}
+
+func (w *zipArchiveWriter) Create(name string, size int64) (io.Writer, error) {
+	return w.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate})
+}
+
+type tarArchiveWriter struct {
+	*tar.Writer
+}
+
+func (w *tarArchiveWriter) Create(name string, size int64) (io.Writer, error) {
+	if err := w.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Size: size, Mode: 0644}); err != nil {
+		return nil, err
+	}
+	return w.Writer, nil
+}
+
+func newArchiveWriter(w io.Writer, format apipb.DownloadArtifactsRequest_Format) (archiveWriter, error) {
+	switch format {
+	case apipb.DownloadArtifactsRequest_ZIP:
+		return &zipArchiveWriter{zip.NewWriter(w)}, nil
+	case apipb.DownloadArtifactsRequest_TAR:
+		return &tarArchiveWriter{tar.NewWriter(w)}, nil
+	default:
+		return nil, status.InvalidArgumentErrorf("unsupported archive format %s", format)
+	}
+}
+
+// writeArtifacts streams the given artifacts from the cache into an archive,
+// verifying each against its digest. If an artifact can't be fetched or
+// doesn't match its digest, an error is returned without finishing the
+// archive, so that a partial archive can't be mistaken for a complete one.
+func writeArtifacts(ctx context.Context, bsClient interfaces.PooledByteStreamClient, aw archiveWriter, artifacts []*apipb.Artifact) error {
+	for _, a := range artifacts {
+		if err := writeArtifact(ctx, bsClient, aw, a); err != nil {
+			return err
+		}
+	}
+	return aw.Close()
+}
+
+func writeArtifact(ctx context.Context, bsClient interfaces.PooledByteStreamClient, aw archiveWriter, a *apipb.Artifact) error {
+	rn, err := artifactResourceName(a.GetFile().GetUri())
+	if err != nil {
+		return err
+	}
+	// Always fetch the uncompressed blob so that it can be verified against
+	// its digest.
+	rn.SetCompressor(repb.Compressor_IDENTITY)
+	resourceName, err := rn.DownloadString()
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(a.GetFile().GetUri())
+	if err != nil {
+		return err
+	}
+	u.Path = "/" + strings.TrimPrefix(resourceName, "/")
+
+	h, err := digest.HashForDigestType(rn.GetDigestFunction())
+	if err != nil {
+		return err
+	}
+	w, err := aw.Create(a.GetPath(), rn.GetDigest().GetSizeBytes())
+	if err != nil {
+		return err
+	}
+	cw := &countingWriter{w: io.MultiWriter(w, h)}
+	if err := bsClient.StreamBytestreamFile(ctx, u, cw); err != nil {
+		return err
+	}
+	if cw.n != rn.GetDigest().GetSizeBytes() || hex.EncodeToString(h.Sum(nil)) != rn.GetDigest().GetHash() {
+		return status.DataLossErrorf("artifact %q does not match its digest %s/%d", a.GetPath(), rn.GetDigest().GetHash(), rn.GetDigest().GetSizeBytes())
+	}
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
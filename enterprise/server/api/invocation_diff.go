@@ -0,0 +1,211 @@
+package api
+
+import (
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/event_parser"
+
+	api_common "github.com/buildbuddy-io/buildbuddy/server/api/common"
+
+	apipb "github.com/buildbuddy-io/buildbuddy/proto/api/v1"
+	bespb "github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	capb "github.com/buildbuddy-io/buildbuddy/proto/cache"
+	clpb "github.com/buildbuddy-io/buildbuddy/proto/command_line"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+const envVarOptionName = "client_env"
+
+// invocationFields are the top-level invocation fields compared by
+// CompareInvocations.
+var invocationFields = []struct {
+	name  string
+	value func(inv *inpb.Invocation) string
+}{
+	{"success", func(inv *inpb.Invocation) string { return strconv.FormatBool(inv.GetSuccess()) }},
+	{"bazel_exit_code", func(inv *inpb.Invocation) string { return inv.GetBazelExitCode() }},
+	{"user", func(inv *inpb.Invocation) string { return inv.GetUser() }},
+	{"host", func(inv *inpb.Invocation) string { return inv.GetHost() }},
+	{"command", func(inv *inpb.Invocation) string { return inv.GetCommand() }},
+	{"pattern", func(inv *inpb.Invocation) string { return strings.Join(inv.GetPattern(), " ") }},
+	{"action_count", func(inv *inpb.Invocation) string { return strconv.FormatInt(inv.GetActionCount(), 10) }},
+	{"repo_url", func(inv *inpb.Invocation) string { return inv.GetRepoUrl() }},
+	{"branch_name", func(inv *inpb.Invocation) string { return inv.GetBranchName() }},
+	{"commit_sha", func(inv *inpb.Invocation) string { return inv.GetCommitSha() }},
+	{"role", func(inv *inpb.Invocation) string { return inv.GetRole() }},
+	{"remote_execution_enabled", func(inv *inpb.Invocation) string { return strconv.FormatBool(inv.GetRemoteExecutionEnabled()) }},
+	{"upload_local_results_enabled", func(inv *inpb.Invocation) string { return strconv.FormatBool(inv.GetUploadLocalResultsEnabled()) }},
+	{"download_outputs_option", func(inv *inpb.Invocation) string { return inv.GetDownloadOutputsOption().String() }},
+}
+
+// compareInvocations returns the differences between two invocations, which
+// must have been looked up with their events.
+func compareInvocations(base, inv *inpb.Invocation) *apipb.CompareInvocationsResponse {
+	rsp := &apipb.CompareInvocationsResponse{
+		BaseDurationUsec: base.GetDurationUsec(),
+		DurationUsec:     inv.GetDurationUsec(),
+		BaseCacheStats:   invocationCacheStats(base.GetCacheStats()),
+		CacheStats:       invocationCacheStats(inv.GetCacheStats()),
+		Target:           diffTargets(base, inv),
+		ActionDuration:   diffActionDurations(base, inv),
+	}
+	for _, f := range invocationFields {
+		if baseValue, value := f.value(base), f.value(inv); baseValue != value {
+			rsp.Field = append(rsp.Field, &apipb.InvocationFieldDiff{
+				Name:      f.name,
+				BaseValue: baseValue,
+				Value:     value,
+			})
+		}
+	}
+	baseOptions, baseEnv := commandLineOptions(base)
+	options, env := commandLineOptions(inv)
+	rsp.Option = diffOptions(baseOptions, options)
+	rsp.EnvironmentVariable = diffOptions(baseEnv, env)
+	return rsp
+}
+
+// commandLineOptions returns the option values and environment variables from
+// the canonical command line of the invocation, keyed by name.
+func commandLineOptions(inv *inpb.Invocation) (options map[string][]string, env map[string][]string) {
+	options = make(map[string][]string)
+	env = make(map[string][]string)
+	for _, commandLine := range inv.GetStructuredCommandLine() {
+		if commandLine.GetCommandLineLabel() != event_parser.StructuredCommandLineLabelCanonical {
+			continue
+		}
+		for _, section := range commandLine.GetSections() {
+			p, ok := section.SectionType.(*clpb.CommandLineSection_OptionList)
+			if !ok {
+				continue
+			}
+			for _, option := range p.OptionList.GetOption() {
+				if option.GetOptionName() == envVarOptionName {
+					name, value, _ := strings.Cut(option.GetOptionValue(), "=")
+					env[name] = []string{value}
+					continue
+				}
+				options[option.GetOptionName()] = append(options[option.GetOptionName()], option.GetOptionValue())
+			}
+		}
+	}
+	return options, env
+}
+
+func diffOptions(base, options map[string][]string) []*apipb.OptionDiff {
+	var diffs []*apipb.OptionDiff
+	for _, name := range sortedKeys(base, options) {
+		if slices.Equal(base[name], options[name]) {
+			continue
+		}
+		diffs = append(diffs, &apipb.OptionDiff{
+			Name:      name,
+			BaseValue: base[name],
+			Value:     options[name],
+		})
+	}
+	return diffs
+}
+
+func diffTargets(base, inv *inpb.Invocation) []*apipb.TargetDiff {
+	baseTargets := api_common.TargetMapFromInvocation(base)
+	targets := api_common.TargetMapFromInvocation(inv)
+	var diffs []*apipb.TargetDiff
+	for _, label := range sortedKeys(baseTargets, targets) {
+		baseTarget, target := baseTargets[label], targets[label]
+		diff := &apipb.TargetDiff{
+			Label:                label,
+			BaseStatus:           baseTarget.GetStatus(),
+			Status:               target.GetStatus(),
+			BaseTestDurationUsec: baseTarget.GetTiming().GetDuration().AsDuration().Microseconds(),
+			TestDurationUsec:     target.GetTiming().GetDuration().AsDuration().Microseconds(),
+		}
+		if baseTarget == nil || target == nil || diff.BaseStatus != diff.Status || diff.BaseTestDurationUsec != diff.TestDurationUsec {
+			diffs = append(diffs, diff)
+		}
+	}
+	return diffs
+}
+
+type actionStats struct {
+	count         int64
+	totalDuration int64
+}
+
+// actionStatsByMnemonic aggregates the ActionExecuted events of an invocation
+// by mnemonic.
+func actionStatsByMnemonic(inv *inpb.Invocation) map[string]actionStats {
+	stats := make(map[string]actionStats)
+	for _, event := range inv.GetEvent() {
+		p, ok := event.GetBuildEvent().GetPayload().(*bespb.BuildEvent_Action)
+		if !ok {
+			continue
+		}
+		s := stats[p.Action.GetType()]
+		s.count++
+		if p.Action.GetStartTime() != nil && p.Action.GetEndTime() != nil {
+			s.totalDuration += p.Action.GetEndTime().AsTime().Sub(p.Action.GetStartTime().AsTime()).Microseconds()
+		}
+		stats[p.Action.GetType()] = s
+	}
+	return stats
+}
+
+func diffActionDurations(base, inv *inpb.Invocation) []*apipb.ActionDurationDiff {
+	baseStats := actionStatsByMnemonic(base)
+	stats := actionStatsByMnemonic(inv)
+	var diffs []*apipb.ActionDurationDiff
+	for _, mnemonic := range sortedKeys(baseStats, stats) {
+		if baseStats[mnemonic] == stats[mnemonic] {
+			continue
+		}
+		diffs = append(diffs, &apipb.ActionDurationDiff{
+			Mnemonic:              mnemonic,
+			BaseCount:             baseStats[mnemonic].count,
+			Count:                 stats[mnemonic].count,
+			BaseTotalDurationUsec: baseStats[mnemonic].totalDuration,
+			TotalDurationUsec:     stats[mnemonic].totalDuration,
+		})
+	}
+	return diffs
+}
+
+func invocationCacheStats(cs *capb.CacheStats) *apipb.InvocationCacheStats {
+	return &apipb.InvocationCacheStats{
+		ActionCacheHits:             cs.GetActionCacheHits(),
+		ActionCacheMisses:           cs.GetActionCacheMisses(),
+		ActionCacheHitRate:          hitRate(cs.GetActionCacheHits(), cs.GetActionCacheMisses()),
+		CasCacheHits:                cs.GetCasCacheHits(),
+		CasCacheMisses:              cs.GetCasCacheMisses(),
+		CasCacheHitRate:             hitRate(cs.GetCasCacheHits(), cs.GetCasCacheMisses()),
+		TotalDownloadSizeBytes:      cs.GetTotalDownloadSizeBytes(),
+		TotalUploadSizeBytes:        cs.GetTotalUploadSizeBytes(),
+		TotalCachedActionExecUsec:   cs.GetTotalCachedActionExecUsec(),
+		TotalUncachedActionExecUsec: cs.GetTotalUncachedActionExecUsec(),
+	}
+}
+
+func hitRate(hits, misses int64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// sortedKeys returns the union of the keys of a and b, sorted.
+func sortedKeys[V any](a, b map[string]V) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,314 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/backends/chunkstore"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/eventlog"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/buildbuddy-io/buildbuddy/server/util/protofile"
+	"github.com/buildbuddy-io/buildbuddy/server/util/redact"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"golang.org/x/time/rate"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	apipb "github.com/buildbuddy-io/buildbuddy/proto/api/v1"
+	elpb "github.com/buildbuddy-io/buildbuddy/proto/eventlog"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	inspb "github.com/buildbuddy-io/buildbuddy/proto/invocation_status"
+)
+
+const (
+	// Invocations are polled for updates at this interval, in case PubSub
+	// isn't configured or an update notification is missed. A keep-alive
+	// comment is sent to the client if nothing changed.
+	streamInvocationPollInterval = 3 * time.Second
+
+	// Limits how often invocations are checked for updates, in case of a high
+	// rate of update notifications.
+	streamInvocationMinUpdateInterval = 100 * time.Millisecond
+)
+
+func (s *APIServer) StreamInvocationHandler() http.Handler {
+	return http.HandlerFunc(s.handleStreamInvocationRequest)
+}
+
+// Streams updates to an invocation as server-sent events until the invocation
+// is no longer in progress.
+func (s *APIServer) handleStreamInvocationRequest(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if _, err := s.env.GetAuthenticator().AuthenticatedUser(ctx); err != nil {
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+	iid := r.URL.Query().Get("invocation_id")
+	if iid == "" {
+		http.Error(w, "Missing invocation_id param", http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	// Subscribe before the initial lookup so that no updates are missed.
+	updated := make(<-chan string)
+	if ps := s.env.GetPubSub(); ps != nil {
+		invocationUpdates := ps.Subscribe(ctx, build_event_handler.GetInvocationUpdatesPubSubChannel(iid))
+		defer invocationUpdates.Close()
+		logUpdates := ps.Subscribe(ctx, eventlog.GetEventLogPubSubChannel(iid))
+		defer logUpdates.Close()
+		updated = mergeUpdates(ctx, invocationUpdates.Chan(), logUpdates.Chan())
+	}
+	ti, err := s.env.GetInvocationDB().LookupInvocation(ctx, iid)
+	if err != nil {
+		if status.IsNotFoundError(err) {
+			http.Error(w, "Invocation not found", http.StatusNotFound)
+		} else if status.IsPermissionDeniedError(err) {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+		} else {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	f := newInvocationFollower(s.env, w, iid)
+	rateLimit := rate.NewLimiter(rate.Every(streamInvocationMinUpdateInterval), 1)
+	for {
+		sent, err := f.update(ctx, ti)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.CtxWarningf(ctx, "Failed to stream updates for invocation %s: %s", iid, err)
+				writeServerSentError(w, err)
+			}
+			return
+		}
+		if ti.InvocationStatus != int64(inspb.InvocationStatus_PARTIAL_INVOCATION_STATUS) {
+			// Everything was flushed before the invocation was finalized, so
+			// the client has received all updates.
+			writeServerSentEvent(w, "done", nil)
+			flusher.Flush()
+			return
+		}
+		if sent {
+			flusher.Flush()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-updated:
+		case <-time.After(streamInvocationPollInterval):
+			if !sent {
+				// Keep idle connections from being closed by proxies.
+				io.WriteString(w, ":\n\n")
+				flusher.Flush()
+			}
+		}
+		if err := rateLimit.Wait(ctx); err != nil {
+			return
+		}
+		ti, err = s.env.GetInvocationDB().LookupInvocation(ctx, iid)
+		if err != nil {
+			log.CtxWarningf(ctx, "Failed to look up invocation %s: %s", iid, err)
+			writeServerSentError(w, err)
+			return
+		}
+	}
+}
+
+// mergeUpdates merges notifications from multiple subscriptions into a single
+// channel, coalescing notifications that haven't been received yet.
+func mergeUpdates(ctx context.Context, chans ...<-chan string) <-chan string {
+	merged := make(chan string, 1)
+	for _, ch := range chans {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case msg, ok := <-ch:
+					if !ok {
+						return
+					}
+					select {
+					case merged <- msg:
+					default:
+						// An update is already pending.
+					}
+				}
+			}
+		}()
+	}
+	return merged
+}
+
+// invocationFollower sends the updates to an invocation since the last time it
+// was checked.
+type invocationFollower struct {
+	env environment.Env
+	w   io.Writer
+	iid string
+
+	attempt        uint64
+	invocation     *apipb.Invocation
+	nextEventChunk int
+	nextLogChunk   string
+	liveLogChunk   *apipb.LogChunk
+}
+
+func newInvocationFollower(env environment.Env, w io.Writer, iid string) *invocationFollower {
+	return &invocationFollower{
+		env:          env,
+		w:            w,
+		iid:          iid,
+		nextLogChunk: chunkstore.ChunkIndexAsStringId(0),
+	}
+}
+
+// update sends any updates to the invocation, events and logs, and returns
+// whether anything was sent.
+func (f *invocationFollower) update(ctx context.Context, ti *tables.Invocation) (bool, error) {
+	if ti.Attempt != f.attempt {
+		// A retried build event stream replaces all events and logs of the
+		// previous attempt, so start over.
+		f.attempt = ti.Attempt
+		f.nextEventChunk = 0
+		f.nextLogChunk = chunkstore.ChunkIndexAsStringId(0)
+		f.liveLogChunk = nil
+	}
+	sent := false
+	if inv := apiInvocationFromTable(ti); !proto.Equal(inv, f.invocation) {
+		if err := f.send("invocation", inv); err != nil {
+			return false, err
+		}
+		f.invocation = inv
+		sent = true
+	}
+	sentEvents, err := f.sendEvents(ctx, ti)
+	if err != nil {
+		return false, err
+	}
+	sentLogs, err := f.sendLogs(ctx)
+	if err != nil {
+		return false, err
+	}
+	return sent || sentEvents || sentLogs, nil
+}
+
+// sendEvents sends the build events in event stream chunks that were written
+// since the last update.
+func (f *invocationFollower) sendEvents(ctx context.Context, ti *tables.Invocation) (bool, error) {
+	var redactor *redact.StreamingRedactor
+	if ti.RedactionFlags&redact.RedactionFlagStandardRedactions != redact.RedactionFlagStandardRedactions {
+		redactor = redact.NewStreamingRedactor(f.env)
+	}
+	streamID := build_event_handler.GetStreamIdFromInvocationIdAndAttempt(f.iid, ti.Attempt)
+	allocator := func() proto.Message { return &inpb.InvocationEvent{} }
+	sent := false
+	for {
+		events, err := protofile.ReadChunk(ctx, f.env.GetBlobstore(), streamID, f.nextEventChunk, allocator)
+		if status.IsNotFoundError(err) {
+			return sent, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		for _, msg := range events {
+			event := msg.(*inpb.InvocationEvent)
+			if redactor != nil {
+				if err := redactor.RedactAPIKeysWithSlowRegexp(ctx, event.GetBuildEvent()); err != nil {
+					return false, err
+				}
+				if err := redactor.RedactMetadata(event.GetBuildEvent()); err != nil {
+					return false, err
+				}
+			}
+			if err := f.send("build_event", event.GetBuildEvent()); err != nil {
+				return false, err
+			}
+			sent = true
+		}
+		f.nextEventChunk++
+	}
+}
+
+// sendLogs sends the build log chunks that were written since the last
+// update, followed by the live chunk if it changed.
+func (f *invocationFollower) sendLogs(ctx context.Context) (bool, error) {
+	sent := false
+	for {
+		rsp, err := eventlog.GetEventLogChunk(ctx, f.env, &elpb.GetEventLogChunkRequest{
+			InvocationId: f.iid,
+			ChunkId:      f.nextLogChunk,
+		})
+		if err != nil {
+			return false, err
+		}
+		chunk := &apipb.LogChunk{
+			ChunkId:  f.nextLogChunk,
+			Contents: string(rsp.GetBuffer()),
+			Live:     rsp.GetLive(),
+		}
+		if chunk.GetLive() {
+			if !proto.Equal(chunk, f.liveLogChunk) {
+				if err := f.send("log", chunk); err != nil {
+					return false, err
+				}
+				f.liveLogChunk = chunk
+				sent = true
+			}
+			return sent, nil
+		}
+		if len(rsp.GetBuffer()) > 0 {
+			if err := f.send("log", chunk); err != nil {
+				return false, err
+			}
+			f.liveLogChunk = nil
+			sent = true
+		}
+		// An empty or unchanged next chunk ID means no more chunks have been
+		// written yet.
+		if rsp.GetNextChunkId() == "" || rsp.GetNextChunkId() == f.nextLogChunk {
+			return sent, nil
+		}
+		f.nextLogChunk = rsp.GetNextChunkId()
+	}
+}
+
+func (f *invocationFollower) send(event string, msg proto.Message) error {
+	b, err := protojson.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return writeServerSentEvent(f.w, event, b)
+}
+
+// writeServerSentEvent writes an event in the text/event-stream format. The
+// data must not contain newlines.
+func writeServerSentEvent(w io.Writer, event string, data []byte) error {
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
+
+func writeServerSentError(w io.Writer, e error) error {
+	b, err := json.Marshal(e.Error())
+	if err != nil {
+		return err
+	}
+	return writeServerSentEvent(w, "error", b)
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"sort"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	apipb "github.com/buildbuddy-io/buildbuddy/proto/api/v1"
+)
+
+const (
+	defaultTimingTrendWindow = 30 * 24 * time.Hour
+	maxTimingTrendWindow     = 90 * 24 * time.Hour
+
+	// The maximum number of invocations included in a timing trend. The most
+	// recent invocations are included first.
+	maxTimingTrendInvocations = 100_000
+)
+
+// timingTrendRow is an ingested timing profile joined with the creation time
+// of its invocation.
+type timingTrendRow struct {
+	tables.InvocationTimingProfile
+	InvocationCreatedAtUsec int64
+}
+
+// The durations of a TimingBreakdown, in field order.
+const numTimingDurations = 9
+
+func timingDurations(p *tables.InvocationTimingProfile) [numTimingDurations]int64 {
+	return [numTimingDurations]int64{
+		p.LaunchPhaseUsec,
+		p.InitPhaseUsec,
+		p.TargetPatternEvaluationPhaseUsec,
+		p.AnalysisPhaseUsec,
+		p.PreparationPhaseUsec,
+		p.ExecutionPhaseUsec,
+		p.FinishPhaseUsec,
+		p.CriticalPathUsec,
+		p.TotalUsec,
+	}
+}
+
+func timingBreakdown(d [numTimingDurations]int64) *apipb.TimingBreakdown {
+	return &apipb.TimingBreakdown{
+		LaunchPhaseDurationUsec:                  d[0],
+		InitPhaseDurationUsec:                    d[1],
+		TargetPatternEvaluationPhaseDurationUsec: d[2],
+		AnalysisPhaseDurationUsec:                d[3],
+		PreparationPhaseDurationUsec:             d[4],
+		ExecutionPhaseDurationUsec:               d[5],
+		FinishPhaseDurationUsec:                  d[6],
+		CriticalPathDurationUsec:                 d[7],
+		TotalDurationUsec:                        d[8],
+	}
+}
+
+// timingTrendBucketStart returns the start of the interval containing t.
+func timingTrendBucketStart(t time.Time, interval apipb.GetTimingTrendRequest_Interval) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	if interval == apipb.GetTimingTrendRequest_WEEK {
+		// Weeks start on Monday.
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	}
+	return day
+}
+
+// timingTrend groups the given rows into buckets of the given interval, and
+// computes the mean and median durations of each bucket.
+func timingTrend(rows []*timingTrendRow, interval apipb.GetTimingTrendRequest_Interval) []*apipb.TimingTrendBucket {
+	byStart := make(map[time.Time][][numTimingDurations]int64)
+	for _, row := range rows {
+		start := timingTrendBucketStart(time.UnixMicro(row.InvocationCreatedAtUsec), interval)
+		byStart[start] = append(byStart[start], timingDurations(&row.InvocationTimingProfile))
+	}
+	starts := make([]time.Time, 0, len(byStart))
+	for start := range byStart {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool {
+		return starts[i].Before(starts[j])
+	})
+
+	buckets := make([]*apipb.TimingTrendBucket, 0, len(starts))
+	for _, start := range starts {
+		durations := byStart[start]
+		var mean, median [numTimingDurations]int64
+		values := make([]int64, len(durations))
+		for i := range numTimingDurations {
+			sum := int64(0)
+			for j, d := range durations {
+				values[j] = d[i]
+				sum += d[i]
+			}
+			mean[i] = sum / int64(len(durations))
+			sort.Slice(values, func(a, b int) bool { return values[a] < values[b] })
+			if n := len(values); n%2 == 1 {
+				median[i] = values[n/2]
+			} else {
+				median[i] = (values[n/2-1] + values[n/2]) / 2
+			}
+		}
+		buckets = append(buckets, &apipb.TimingTrendBucket{
+			StartTime:       timestamppb.New(start),
+			InvocationCount: int64(len(durations)),
+			Mean:            timingBreakdown(mean),
+			Median:          timingBreakdown(median),
+		})
+	}
+	return buckets
+}
@@ -122,6 +122,11 @@ func (f *fakeCAS) GetTree(req *repb.GetTreeRequest, stream repb.ContentAddressab
 	return status.InternalError("Unexpected call to GetTree")
 }
 
+func (f *fakeCAS) SpliceBlob(ctx context.Context, req *repb.SpliceBlobRequest) (*repb.SpliceBlobResponse, error) {
+	f.t.Fatal("Unexpected call to SpliceBlob")
+	return nil, status.InternalError("Unexpected call to SpliceBlob")
+}
+
 func runFakeCAS(ctx context.Context, env *testenv.TestEnv, t *testing.T) (*fakeCAS, repb.ContentAddressableStorageClient) {
 	cas := fakeCAS{t: t, authenticator: env.GetAuthenticator(), updates: []update{}}
 	grpcServer, runFunc, lis := testenv.RegisterLocalGRPCServer(t, env)
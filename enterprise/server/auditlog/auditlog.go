@@ -4,7 +4,9 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
@@ -19,10 +21,13 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
 	"github.com/buildbuddy-io/buildbuddy/server/util/random"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/reflect/protoreflect"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
 	alpb "github.com/buildbuddy-io/buildbuddy/proto/auditlog"
+	oppb "github.com/buildbuddy-io/buildbuddy/proto/oidc_provider"
+	wfpb "github.com/buildbuddy-io/buildbuddy/proto/workflow"
 )
 
 var (
@@ -32,6 +37,12 @@ var (
 const (
 	// maximum number of entries we return in a single GetLogs request.
 	pageSize = 20
+
+	// maximum time range that can be exported in a single ExportLogs request.
+	maxExportRange = 90 * 24 * time.Hour
+	// maximum number of entries that can be exported in a single ExportLogs
+	// request.
+	maxExportEntries = 100_000
 )
 
 type Logger struct {
@@ -88,13 +99,33 @@ func clearRequestContext(request proto.Message) proto.Message {
 	return request
 }
 
+// redactRequest clears out credentials that must not be stored in the audit
+// log.
+func redactRequest(request proto.Message) proto.Message {
+	switch r := request.(type) {
+	case *wfpb.CreateWorkflowRequest:
+		if r.GetGitRepo().GetAccessToken() != "" {
+			r = r.CloneVT()
+			r.GitRepo.AccessToken = ""
+			return r
+		}
+	case *oppb.SetOIDCProviderRequest:
+		if r.GetProvider().GetClientSecret() != "" {
+			r = r.CloneVT()
+			r.Provider.ClientSecret = ""
+			return r
+		}
+	}
+	return request
+}
+
 func (l *Logger) insertLog(ctx context.Context, resource *alpb.ResourceID, action alpb.Action, request proto.Message) error {
 	u, err := l.env.GetAuthenticator().AuthenticatedUser(ctx)
 	if err != nil {
 		return status.WrapError(err, "auth failed")
 	}
 
-	request = clearRequestContext(request)
+	request = redactRequest(clearRequestContext(request))
 
 	var requestBytes []byte
 	if request != nil {
@@ -237,22 +268,99 @@ func (l *Logger) fillIDDescriptors(ctx context.Context, e *alpb.Entry_Request) e
 	return nil
 }
 
-func (l *Logger) GetLogs(ctx context.Context, req *alpb.GetAuditLogsRequest) (*alpb.GetAuditLogsResponse, error) {
+// authorizeGroup returns the ID of the authenticated group, if the
+// authenticated user is one of its admins.
+func (l *Logger) authorizeGroup(ctx context.Context) (string, error) {
 	u, err := l.env.GetAuthenticator().AuthenticatedUser(ctx)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-
 	if err := authutil.AuthorizeOrgAdmin(u, u.GetGroupID()); err != nil {
+		return "", err
+	}
+	return u.GetGroupID(), nil
+}
+
+func toProto(e *schema.AuditLog) (*alpb.Entry, error) {
+	request := &alpb.Entry_Request{}
+	if err := proto.Unmarshal([]byte(e.Request), request); err != nil {
 		return nil, err
 	}
 
+	resourceType := alpb.ResourceType(e.ResourceType)
+	// If no resource is specified, the resource is implicitely the owning
+	// organization.
+	if resourceType == alpb.ResourceType_UNKNOWN_RESOURCE {
+		resourceType = alpb.ResourceType_GROUP
+	}
+
+	entry := &alpb.Entry{
+		EventTime: timestamppb.New(time.UnixMicro(e.EventTimeUsec)),
+		AuthenticationInfo: &alpb.AuthenticationInfo{
+			ClientIp: e.ClientIP,
+		},
+		Resource: &alpb.ResourceID{
+			Type: resourceType,
+			Id:   e.ResourceID,
+			Name: e.ResourceName,
+		},
+		Action:  alpb.Action(e.Action),
+		Request: cleanRequest(request),
+	}
+	if e.AuthUserID != "" {
+		entry.AuthenticationInfo.User = &alpb.AuthenticatedUser{
+			UserId:    e.AuthUserID,
+			UserEmail: e.AuthUserEmail,
+		}
+	}
+	if e.AuthAPIKeyID != "" {
+		entry.AuthenticationInfo.ApiKey = &alpb.AuthenticatedAPIKey{
+			Id:    e.AuthAPIKeyID,
+			Label: e.AuthAPIKeyLabel,
+		}
+	}
+	return entry, nil
+}
+
+func newLogsQuery(groupID string, timestampAfter, timestampBefore *timestamppb.Timestamp) *query_builder.Query {
 	qb := query_builder.NewQuery(`
 		SELECT * FROM AuditLogs
 	`)
-	qb.AddWhereClause("group_id = ?", u.GetGroupID())
-	qb.AddWhereClause("event_time_usec >= ?", req.GetTimestampAfter().AsTime().UnixMicro())
-	qb.AddWhereClause("event_time_usec <= ?", req.GetTimestampBefore().AsTime().UnixMicro())
+	qb.AddWhereClause("group_id = ?", groupID)
+	qb.AddWhereClause("event_time_usec >= ?", timestampAfter.AsTime().UnixMicro())
+	qb.AddWhereClause("event_time_usec <= ?", timestampBefore.AsTime().UnixMicro())
+	qb.SetOrderBy("event_time_usec", true)
+	return qb
+}
+
+func (l *Logger) GetLogs(ctx context.Context, req *alpb.GetAuditLogsRequest) (*alpb.GetAuditLogsResponse, error) {
+	groupID, err := l.authorizeGroup(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	qb := newLogsQuery(groupID, req.GetTimestampAfter(), req.GetTimestampBefore())
+	if len(req.GetResourceType()) > 0 {
+		// Not []uint8, which would be passed as a single []byte argument
+		// instead of a list.
+		var resourceTypes []int32
+		for _, t := range req.GetResourceType() {
+			resourceTypes = append(resourceTypes, int32(t))
+			// Entries for the organization itself are stored without a
+			// resource type.
+			if t == alpb.ResourceType_GROUP {
+				resourceTypes = append(resourceTypes, int32(alpb.ResourceType_UNKNOWN_RESOURCE))
+			}
+		}
+		qb.AddWhereClause("resource_type IN ?", resourceTypes)
+	}
+	if len(req.GetAction()) > 0 {
+		var actions []int32
+		for _, a := range req.GetAction() {
+			actions = append(actions, int32(a))
+		}
+		qb.AddWhereClause("action IN ?", actions)
+	}
 	if req.PageToken != "" {
 		ts, err := strconv.ParseInt(req.PageToken, 10, 64)
 		if err != nil {
@@ -261,61 +369,118 @@ func (l *Logger) GetLogs(ctx context.Context, req *alpb.GetAuditLogsRequest) (*a
 		qb.AddWhereClause("event_time_usec >= ?", ts)
 	}
 	qb.SetLimit(pageSize + 1)
-	qb.SetOrderBy("event_time_usec", true)
 	q, args := qb.Build()
 
 	rq := l.dbh.NewQuery(ctx, "audit_logs_get_logs").Raw(q, args...)
 	resp := &alpb.GetAuditLogsResponse{}
 	err = db.ScanEach(rq, func(ctx context.Context, e *schema.AuditLog) error {
-		request := &alpb.Entry_Request{}
-		if err := proto.Unmarshal([]byte(e.Request), request); err != nil {
-			return err
-		}
-
 		if len(resp.Entries) == pageSize {
 			resp.NextPageToken = strconv.FormatInt(e.EventTimeUsec, 10)
 			return nil
 		}
-
-		resourceType := alpb.ResourceType(e.ResourceType)
-		// If no resource is specified, the resource is implicitely the owning
-		// organization.
-		if resourceType == alpb.ResourceType_UNKNOWN_RESOURCE {
-			resourceType = alpb.ResourceType_GROUP
+		entry, err := toProto(e)
+		if err != nil {
+			return err
 		}
+		resp.Entries = append(resp.Entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func exportBlobPrefix(groupID string) string {
+	return fmt.Sprintf("audit_logs/%s/", groupID)
+}
+
+// ExportLogs writes all entries of the authenticated group in the requested
+// time range to a new blob, so that they can be archived or ingested by other
+// systems without paging through GetLogs. The blob can be downloaded by the
+// group's admins via ReadExport.
+func (l *Logger) ExportLogs(ctx context.Context, req *alpb.ExportAuditLogsRequest) (*alpb.ExportAuditLogsResponse, error) {
+	groupID, err := l.authorizeGroup(ctx)
+	if err != nil {
+		return nil, err
+	}
+	bs := l.env.GetBlobstore()
+	if bs == nil {
+		return nil, status.FailedPreconditionError("exporting audit logs requires a blobstore")
+	}
+	if req.GetTimestampAfter() == nil || req.GetTimestampBefore() == nil {
+		return nil, status.InvalidArgumentError("timestamp_after and timestamp_before are required")
+	}
+	timeRange := req.GetTimestampBefore().AsTime().Sub(req.GetTimestampAfter().AsTime())
+	if timeRange < 0 || timeRange > maxExportRange {
+		return nil, status.InvalidArgumentErrorf("the exported time range must be between 0 and %s", maxExportRange)
+	}
 
-		entry := &alpb.Entry{
-			EventTime: timestamppb.New(time.UnixMicro(e.EventTimeUsec)),
-			AuthenticationInfo: &alpb.AuthenticationInfo{
-				ClientIp: e.ClientIP,
-			},
-			Resource: &alpb.ResourceID{
-				Type: resourceType,
-				Id:   e.ResourceID,
-				Name: e.ResourceName,
-			},
-			Action:  alpb.Action(e.Action),
-			Request: cleanRequest(request),
+	blobName := fmt.Sprintf("%sexport_%d.jsonl", exportBlobPrefix(groupID), random.RandUint64())
+	w, err := bs.Writer(ctx, blobName)
+	if err != nil {
+		return nil, status.WrapError(err, "could not create export blob")
+	}
+	defer w.Close()
+
+	qb := newLogsQuery(groupID, req.GetTimestampAfter(), req.GetTimestampBefore())
+	qb.SetLimit(maxExportEntries + 1)
+	q, args := qb.Build()
+	rq := l.dbh.NewQuery(ctx, "audit_logs_export_logs").Raw(q, args...)
+	count := int64(0)
+	err = db.ScanEach(rq, func(ctx context.Context, e *schema.AuditLog) error {
+		if count == maxExportEntries {
+			// The blob isn't committed, so nothing is exported.
+			return status.ResourceExhaustedErrorf("more than %d entries in the requested time range; export a shorter time range", maxExportEntries)
 		}
-		if e.AuthUserID != "" {
-			entry.AuthenticationInfo.User = &alpb.AuthenticatedUser{
-				UserId:    e.AuthUserID,
-				UserEmail: e.AuthUserEmail,
-			}
+		entry, err := toProto(e)
+		if err != nil {
+			return err
 		}
-		if e.AuthAPIKeyID != "" {
-			entry.AuthenticationInfo.ApiKey = &alpb.AuthenticatedAPIKey{
-				Id:    e.AuthAPIKeyID,
-				Label: e.AuthAPIKeyLabel,
-			}
+		b, err := protojson.Marshal(entry)
+		if err != nil {
+			return err
 		}
-
-		resp.Entries = append(resp.Entries, entry)
+		if _, err := w.Write(append(b, '\n')); err != nil {
+			return err
+		}
+		count++
 		return nil
 	})
-	if err != nil {
+	if status.IsResourceExhaustedError(err) {
 		return nil, err
 	}
+	if err != nil {
+		return nil, status.WrapError(err, "could not export audit logs")
+	}
+	if err := w.Commit(); err != nil {
+		return nil, status.WrapError(err, "could not write export blob")
+	}
 
-	return resp, nil
+	l.LogForGroup(ctx, groupID, alpb.Action_EXPORT_AUDIT_LOGS, req)
+	return &alpb.ExportAuditLogsResponse{
+		BlobName:    blobName,
+		EntryCount:  count,
+		DownloadUrl: "/file/download?audit_log_export=" + url.QueryEscape(blobName),
+	}, nil
+}
+
+// ReadExport returns the contents of a blob written by ExportLogs. Only admins
+// of the group whose entries were exported can read it.
+func (l *Logger) ReadExport(ctx context.Context, blobName string) ([]byte, error) {
+	groupID, err := l.authorizeGroup(ctx)
+	if err != nil {
+		return nil, err
+	}
+	prefix := exportBlobPrefix(groupID)
+	name, ok := strings.CutPrefix(blobName, prefix)
+	if !ok || name == "" || strings.Contains(name, "/") {
+		return nil, status.PermissionDeniedErrorf("audit log export %q does not belong to group %q", blobName, groupID)
+	}
+	bs := l.env.GetBlobstore()
+	if bs == nil {
+		return nil, status.FailedPreconditionError("exporting audit logs requires a blobstore")
+	}
+	return bs.ReadBlob(ctx, blobName)
 }
@@ -0,0 +1,287 @@
+package auditlog_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/auditlog"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testauth"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/clickhouse/schema"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+
+	alpb "github.com/buildbuddy-io/buildbuddy/proto/auditlog"
+)
+
+// olapDB stores audit logs in the test's SQL database, which runs the queries
+// of the audit logger just like ClickHouse would.
+type olapDB struct {
+	interfaces.OLAPDBHandle
+	dbh interfaces.DBHandle
+}
+
+func (o *olapDB) NewQuery(ctx context.Context, name string) interfaces.DBQuery {
+	return o.dbh.NewQuery(ctx, name)
+}
+
+func (o *olapDB) GORM(ctx context.Context, name string) *gorm.DB {
+	return o.dbh.GORM(ctx, name)
+}
+
+func (o *olapDB) InsertAuditLog(ctx context.Context, entry *schema.AuditLog) error {
+	return o.dbh.NewQuery(ctx, "auditlog_test_insert").Create(entry)
+}
+
+// setup returns the environment, the context of an admin of a new group, and
+// the ID of the group.
+func setup(t *testing.T) (*testenv.TestEnv, *olapDB, context.Context, string) {
+	flags.Set(t, "app.audit_logs_enabled", true)
+	env := enterprise_testenv.New(t)
+	enterprise_testauth.Configure(t, env)
+	ctx := context.Background()
+	err := env.GetDBHandle().GORM(ctx, "auditlog_test_migrate").AutoMigrate(&schema.AuditLog{})
+	require.NoError(t, err)
+	db := &olapDB{dbh: env.GetDBHandle()}
+	env.SetOLAPDBHandle(db)
+	require.NoError(t, auditlog.Register(env))
+
+	u := enterprise_testauth.CreateRandomUser(t, env, "org1.io")
+	auther := env.GetAuthenticator().(*testauth.TestAuthenticator)
+	ctx, err = auther.WithAuthenticatedUser(ctx, u.UserID)
+	require.NoError(t, err)
+	return env, db, ctx, u.Groups[0].Group.GroupID
+}
+
+// insertEntries inserts entries for the given group, one millisecond apart in
+// the order given, and returns them.
+func insertEntries(t *testing.T, db *olapDB, groupID string, entries ...*schema.AuditLog) []*schema.AuditLog {
+	// The logger always wraps the request of the logged RPC.
+	request, err := proto.Marshal(&alpb.Entry_Request{ApiRequest: &alpb.Entry_APIRequest{}})
+	require.NoError(t, err)
+	start := time.Now().Add(-1 * time.Hour)
+	for i, e := range entries {
+		e.AuditLogID = fmt.Sprintf("AL-%s-%d", groupID, i)
+		e.GroupID = groupID
+		e.EventTimeUsec = start.Add(time.Duration(i) * time.Millisecond).UnixMicro()
+		e.Request = string(request)
+		err := db.InsertAuditLog(context.Background(), e)
+		require.NoError(t, err)
+	}
+	return entries
+}
+
+func getResources(t *testing.T, logger interfaces.AuditLogger, ctx context.Context, req *alpb.GetAuditLogsRequest) ([]string, string) {
+	req.TimestampBefore = timestamppb.Now()
+	rsp, err := logger.GetLogs(ctx, req)
+	require.NoError(t, err)
+	var ids []string
+	for _, e := range rsp.GetEntries() {
+		ids = append(ids, e.GetResource().GetId())
+	}
+	return ids, rsp.GetNextPageToken()
+}
+
+func TestGetLogsFilters(t *testing.T) {
+	env, db, ctx, groupID := setup(t)
+	logger := env.GetAuditLogger()
+	insertEntries(t, db, groupID,
+		&schema.AuditLog{ResourceID: "", Action: uint8(alpb.Action_UPDATE)},
+		&schema.AuditLog{ResourceID: "IN1", ResourceType: uint8(alpb.ResourceType_INVOCATION), Action: uint8(alpb.Action_UPDATE)},
+		&schema.AuditLog{ResourceID: "SECRET1", ResourceType: uint8(alpb.ResourceType_SECRET), Action: uint8(alpb.Action_CREATE)},
+		&schema.AuditLog{ResourceID: "SECRET1", ResourceType: uint8(alpb.ResourceType_SECRET), Action: uint8(alpb.Action_DELETE)},
+		&schema.AuditLog{ResourceID: "WF1", ResourceType: uint8(alpb.ResourceType_WORKFLOW), Action: uint8(alpb.Action_DELETE)},
+	)
+	// Entries of other groups are never returned.
+	insertEntries(t, db, "GR-other",
+		&schema.AuditLog{ResourceID: "SECRET2", ResourceType: uint8(alpb.ResourceType_SECRET), Action: uint8(alpb.Action_DELETE)},
+	)
+
+	for _, tc := range []struct {
+		name          string
+		resourceTypes []alpb.ResourceType
+		actions       []alpb.Action
+		expected      []string
+	}{
+		{
+			name:     "no filters",
+			expected: []string{"", "IN1", "SECRET1", "SECRET1", "WF1"},
+		},
+		{
+			name:          "resource type",
+			resourceTypes: []alpb.ResourceType{alpb.ResourceType_SECRET},
+			expected:      []string{"SECRET1", "SECRET1"},
+		},
+		{
+			name:          "several resource types",
+			resourceTypes: []alpb.ResourceType{alpb.ResourceType_INVOCATION, alpb.ResourceType_WORKFLOW},
+			expected:      []string{"IN1", "WF1"},
+		},
+		{
+			name:          "group resource type",
+			resourceTypes: []alpb.ResourceType{alpb.ResourceType_GROUP},
+			expected:      []string{""},
+		},
+		{
+			name:     "action",
+			actions:  []alpb.Action{alpb.Action_DELETE},
+			expected: []string{"SECRET1", "WF1"},
+		},
+		{
+			name:     "several actions",
+			actions:  []alpb.Action{alpb.Action_CREATE, alpb.Action_UPDATE},
+			expected: []string{"", "IN1", "SECRET1"},
+		},
+		{
+			name:          "resource type and action",
+			resourceTypes: []alpb.ResourceType{alpb.ResourceType_SECRET, alpb.ResourceType_INVOCATION},
+			actions:       []alpb.Action{alpb.Action_UPDATE, alpb.Action_DELETE},
+			expected:      []string{"IN1", "SECRET1"},
+		},
+		{
+			name:          "no match",
+			resourceTypes: []alpb.ResourceType{alpb.ResourceType_IP_RULE},
+			expected:      nil,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ids, nextPageToken := getResources(t, logger, ctx, &alpb.GetAuditLogsRequest{
+				ResourceType: tc.resourceTypes,
+				Action:       tc.actions,
+			})
+			assert.Equal(t, tc.expected, ids)
+			assert.Empty(t, nextPageToken)
+		})
+	}
+}
+
+func TestGetLogsPaginationWithFilters(t *testing.T) {
+	env, db, ctx, groupID := setup(t)
+	logger := env.GetAuditLogger()
+	// Interleave the entries that match the filter with ones that don't, so
+	// that the page boundary falls between matching entries.
+	var entries []*schema.AuditLog
+	var expected []string
+	for i := 0; i < 25; i++ {
+		id := fmt.Sprintf("SECRET%d", i)
+		entries = append(entries,
+			&schema.AuditLog{ResourceID: id, ResourceType: uint8(alpb.ResourceType_SECRET), Action: uint8(alpb.Action_UPDATE)},
+			&schema.AuditLog{ResourceID: fmt.Sprintf("IN%d", i), ResourceType: uint8(alpb.ResourceType_INVOCATION), Action: uint8(alpb.Action_UPDATE)},
+			&schema.AuditLog{ResourceID: id, ResourceType: uint8(alpb.ResourceType_SECRET), Action: uint8(alpb.Action_GET)},
+		)
+		expected = append(expected, id)
+	}
+	insertEntries(t, db, groupID, entries...)
+
+	req := &alpb.GetAuditLogsRequest{
+		ResourceType: []alpb.ResourceType{alpb.ResourceType_SECRET},
+		Action:       []alpb.Action{alpb.Action_UPDATE},
+	}
+	page1, nextPageToken := getResources(t, logger, ctx, req)
+	require.NotEmpty(t, nextPageToken)
+	assert.Equal(t, expected[:20], page1)
+
+	req.PageToken = nextPageToken
+	page2, nextPageToken := getResources(t, logger, ctx, req)
+	assert.Empty(t, nextPageToken)
+	assert.Equal(t, expected[20:], page2)
+}
+
+func TestExportLogs(t *testing.T) {
+	env, db, ctx, groupID := setup(t)
+	logger := env.GetAuditLogger()
+	entries := insertEntries(t, db, groupID,
+		&schema.AuditLog{Action: uint8(alpb.Action_UPDATE), AuthUserID: "US1", AuthUserEmail: "user@org1.io", ClientIP: "1.2.3.4"},
+		&schema.AuditLog{ResourceID: "SECRET1", ResourceType: uint8(alpb.ResourceType_SECRET), Action: uint8(alpb.Action_CREATE), AuthAPIKeyID: "AK1", AuthAPIKeyLabel: "ci"},
+		&schema.AuditLog{ResourceID: "IN1", ResourceType: uint8(alpb.ResourceType_INVOCATION), Action: uint8(alpb.Action_ACCESS)},
+	)
+	insertEntries(t, db, "GR-other",
+		&schema.AuditLog{ResourceID: "SECRET2", ResourceType: uint8(alpb.ResourceType_SECRET), Action: uint8(alpb.Action_CREATE)},
+	)
+
+	before := timestamppb.Now()
+	after := timestamppb.New(before.AsTime().Add(-24 * time.Hour))
+	rsp, err := logger.ExportLogs(ctx, &alpb.ExportAuditLogsRequest{TimestampAfter: after, TimestampBefore: before})
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(entries)), rsp.GetEntryCount())
+	assert.Contains(t, rsp.GetBlobName(), groupID)
+	assert.Equal(t, "/file/download?audit_log_export="+url.QueryEscape(rsp.GetBlobName()), rsp.GetDownloadUrl())
+
+	// The export has one JSON-encoded entry per line, in the order GetLogs
+	// returns them.
+	logs, err := logger.GetLogs(ctx, &alpb.GetAuditLogsRequest{TimestampBefore: before})
+	require.NoError(t, err)
+	require.Len(t, logs.GetEntries(), len(entries))
+	b, err := logger.ReadExport(ctx, rsp.GetBlobName())
+	require.NoError(t, err)
+	lines := bytes.Split(bytes.TrimSuffix(b, []byte("\n")), []byte("\n"))
+	require.Len(t, lines, len(entries))
+	for i, line := range lines {
+		e := &alpb.Entry{}
+		require.NoError(t, protojson.Unmarshal(line, e))
+		assert.Empty(t, cmp.Diff(logs.GetEntries()[i], e, protocmp.Transform()))
+	}
+	assert.Equal(t, "user@org1.io", logs.GetEntries()[0].GetAuthenticationInfo().GetUser().GetUserEmail())
+	assert.Equal(t, "ci", logs.GetEntries()[1].GetAuthenticationInfo().GetApiKey().GetLabel())
+
+	// The export itself is logged.
+	ids, _ := getResources(t, logger, ctx, &alpb.GetAuditLogsRequest{
+		Action: []alpb.Action{alpb.Action_EXPORT_AUDIT_LOGS},
+	})
+	assert.Equal(t, []string{""}, ids)
+}
+
+func TestExportLogs_Limits(t *testing.T) {
+	env, _, ctx, _ := setup(t)
+	logger := env.GetAuditLogger()
+	now := time.Now()
+
+	for _, req := range []*alpb.ExportAuditLogsRequest{
+		{TimestampBefore: timestamppb.New(now)},
+		{TimestampAfter: timestamppb.New(now)},
+		{TimestampAfter: timestamppb.New(now), TimestampBefore: timestamppb.New(now.Add(-1 * time.Hour))},
+		{TimestampAfter: timestamppb.New(now.Add(-91 * 24 * time.Hour)), TimestampBefore: timestamppb.New(now)},
+	} {
+		_, err := logger.ExportLogs(ctx, req)
+		assert.True(t, status.IsInvalidArgumentError(err), "ExportLogs(%v): %v", req, err)
+	}
+}
+
+func TestReadExport_OtherGroup(t *testing.T) {
+	env, db, ctx, groupID := setup(t)
+	logger := env.GetAuditLogger()
+	insertEntries(t, db, groupID, &schema.AuditLog{Action: uint8(alpb.Action_UPDATE)})
+	now := time.Now()
+	rsp, err := logger.ExportLogs(ctx, &alpb.ExportAuditLogsRequest{
+		TimestampAfter:  timestamppb.New(now.Add(-24 * time.Hour)),
+		TimestampBefore: timestamppb.New(now),
+	})
+	require.NoError(t, err)
+
+	// Admins of other groups can't download the export.
+	u := enterprise_testauth.CreateRandomUser(t, env, "org2.io")
+	auther := env.GetAuthenticator().(*testauth.TestAuthenticator)
+	otherCtx, err := auther.WithAuthenticatedUser(context.Background(), u.UserID)
+	require.NoError(t, err)
+	_, err = logger.ReadExport(otherCtx, rsp.GetBlobName())
+	require.True(t, status.IsPermissionDeniedError(err), "ReadExport: %v", err)
+
+	// Nor can other blobs be read via ReadExport.
+	_, err = logger.ReadExport(ctx, "audit_logs/"+groupID+"/../../other_blob")
+	require.True(t, status.IsPermissionDeniedError(err), "ReadExport: %v", err)
+}
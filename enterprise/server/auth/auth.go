@@ -36,6 +36,9 @@ func Register(ctx context.Context, env *real_environment.RealEnv) error {
 	}
 	httpAuthenticators = append(httpAuthenticators, oidc)
 	userAuthenticators = append(userAuthenticators, oidc)
+	if oidc.GroupProviderService() != nil {
+		env.SetOIDCProviderService(oidc.GroupProviderService())
+	}
 
 	if saml.IsEnabled(env) {
 		samlAuthenticator, err := saml.NewSAMLAuthenticator(env)
@@ -23,6 +23,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
 	"github.com/buildbuddy-io/buildbuddy/server/util/random"
+	"github.com/buildbuddy-io/buildbuddy/server/util/scopes"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/subdomain"
 	"github.com/buildbuddy-io/buildbuddy/third_party/singleflight"
@@ -211,6 +212,7 @@ type apiKeyGroup struct {
 	// parent group is used to manage all the related groups and their users.
 	ChildGroupIDs          []string `gorm:"-"`
 	Capabilities           int32
+	Scopes                 int32
 	UseGroupOwnedExecutors bool
 	CacheEncryptionEnabled bool
 	EnforceIPRules         bool
@@ -236,6 +238,10 @@ func (g *apiKeyGroup) GetCapabilities() int32 {
 	return g.Capabilities
 }
 
+func (g *apiKeyGroup) GetScopes() int32 {
+	return g.Scopes
+}
+
 func (g *apiKeyGroup) HasCapability(cap akpb.ApiKey_Capability) bool {
 	return g.Capabilities&int32(cap) != 0
 }
@@ -537,6 +543,7 @@ func (d *AuthDB) newAPIKeyGroupQuery(subDomain string, allowUserOwnedKeys bool)
 	qb := query_builder.NewQuery(`
 		SELECT
 			ak.capabilities,
+			ak.scopes,
 			ak.api_key_id,
 			ak.user_id,
 			g.group_id,
@@ -615,6 +622,7 @@ func (d *AuthDB) createAPIKey(ctx context.Context, db interfaces.DB, ak tables.A
 			group_id,
 			perms,
 			capabilities,
+			scopes,
 			value,
 			encrypted_value,
 			nonce,
@@ -622,12 +630,13 @@ func (d *AuthDB) createAPIKey(ctx context.Context, db interfaces.DB, ak tables.A
 			visible_to_developers,
 			impersonation,
 			expiry_usec
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		pk,
 		ak.UserID,
 		ak.GroupID,
 		keyPerms,
 		ak.Capabilities,
+		ak.Scopes,
 		value,
 		encryptedValue,
 		nonce,
@@ -656,7 +665,7 @@ func (d *AuthDB) authorizeGroupAdminRole(ctx context.Context, groupID string) er
 	return authutil.AuthorizeOrgAdmin(u, groupID)
 }
 
-func (d *AuthDB) CreateAPIKey(ctx context.Context, groupID string, label string, caps []akpb.ApiKey_Capability, visibleToDevelopers bool) (*tables.APIKey, error) {
+func (d *AuthDB) CreateAPIKey(ctx context.Context, groupID string, label string, caps []akpb.ApiKey_Capability, keyScopes []akpb.ApiKey_Scope, visibleToDevelopers bool) (*tables.APIKey, error) {
 	if groupID == "" {
 		return nil, status.InvalidArgumentError("Group ID cannot be nil.")
 	}
@@ -671,6 +680,7 @@ func (d *AuthDB) CreateAPIKey(ctx context.Context, groupID string, label string,
 		GroupID:             groupID,
 		Label:               label,
 		Capabilities:        capabilities.ToInt(caps),
+		Scopes:              scopes.ToInt(keyScopes),
 		VisibleToDevelopers: visibleToDevelopers,
 	}
 	return d.createAPIKey(ctx, d.h, ak)
@@ -721,6 +731,23 @@ func (d *AuthDB) CreateAPIKeyWithoutAuthCheck(ctx context.Context, tx interfaces
 	return d.createAPIKey(ctx, tx, ak)
 }
 
+func (d *AuthDB) CreateShortLivedAPIKeyWithoutAuthCheck(ctx context.Context, groupID string, label string, caps []akpb.ApiKey_Capability, keyScopes []akpb.ApiKey_Scope, ttl time.Duration) (*tables.APIKey, error) {
+	if groupID == "" {
+		return nil, status.InvalidArgumentError("Group ID cannot be nil.")
+	}
+	if ttl <= 0 {
+		return nil, status.InvalidArgumentError("API key TTL must be positive.")
+	}
+	ak := tables.APIKey{
+		GroupID:      groupID,
+		Label:        label,
+		Capabilities: capabilities.ToInt(caps),
+		Scopes:       scopes.ToInt(keyScopes),
+		ExpiryUsec:   d.clock.Now().Add(ttl).UnixMicro(),
+	}
+	return d.createAPIKey(ctx, d.h, ak)
+}
+
 func (d *AuthDB) authorizeNewAPIKeyCapabilities(ctx context.Context, userID, groupID string, caps []akpb.ApiKey_Capability) error {
 	userCapabilities, err := capabilities.ForAuthenticatedUserGroup(ctx, d.env, groupID)
 	if err != nil {
@@ -750,7 +777,7 @@ func (d *AuthDB) authorizeNewAPIKeyCapabilities(ctx context.Context, userID, gro
 	return d.authorizeGroupAdminRole(ctx, groupID)
 }
 
-func (d *AuthDB) CreateUserAPIKey(ctx context.Context, groupID, userID, label string, caps []akpb.ApiKey_Capability) (*tables.APIKey, error) {
+func (d *AuthDB) CreateUserAPIKey(ctx context.Context, groupID, userID, label string, caps []akpb.ApiKey_Capability, keyScopes []akpb.ApiKey_Scope) (*tables.APIKey, error) {
 	if !*userOwnedKeysEnabled {
 		return nil, status.UnimplementedError("not implemented")
 	}
@@ -815,6 +842,7 @@ func (d *AuthDB) CreateUserAPIKey(ctx context.Context, groupID, userID, label st
 		GroupID:      u.GetGroupID(),
 		Label:        label,
 		Capabilities: capabilities.ToInt(caps),
+		Scopes:       scopes.ToInt(keyScopes),
 	}
 	return d.createAPIKey(ctx, d.h, ak)
 }
@@ -939,6 +967,9 @@ func (d *AuthDB) GetAPIKeys(ctx context.Context, groupID string) ([]*tables.APIK
 		q.AddWhereClause("visible_to_developers = ?", true)
 	}
 	q.AddWhereClause(`impersonation = false`)
+	// Short-lived keys, such as the ones issued for the OIDC tokens of CI
+	// jobs, are listed with their expiry until they expire, so that they
+	// can be revoked.
 	q.AddWhereClause(`expiry_usec = 0 OR expiry_usec > ?`, d.clock.Now().UnixMicro())
 	q.SetOrderBy("label", true /*ascending*/)
 	queryStr, args := q.Build()
@@ -1002,11 +1033,13 @@ func (d *AuthDB) UpdateAPIKey(ctx context.Context, key *tables.APIKey) error {
 		SET
 			label = ?,
 			capabilities = ?,
+			scopes = ?,
 			visible_to_developers = ?
 		WHERE
 			api_key_id = ?`,
 		key.Label,
 		key.Capabilities,
+		key.Scopes,
 		key.VisibleToDevelopers,
 		key.APIKeyID,
 	).Exec().Error
@@ -1021,6 +1054,13 @@ func (d *AuthDB) DeleteAPIKey(ctx context.Context, apiKeyID string) error {
 		`DELETE FROM "APIKeys" WHERE api_key_id = ?`, apiKeyID).Exec().Error
 }
 
+func (d *AuthDB) DeleteExpiredAPIKeys(ctx context.Context) error {
+	return d.h.NewQuery(ctx, "authdb_delete_expired_api_keys").Raw(
+		`DELETE FROM "APIKeys" WHERE expiry_usec > 0 AND expiry_usec <= ?`,
+		d.clock.Now().UnixMicro(),
+	).Exec().Error
+}
+
 func (d *AuthDB) GetUserAPIKeys(ctx context.Context, userID, groupID string) ([]*tables.APIKey, error) {
 	if !*userOwnedKeysEnabled {
 		return nil, status.UnimplementedError("not implemented")
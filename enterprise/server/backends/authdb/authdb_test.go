@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"math/rand"
 	"net/url"
+	"slices"
 	"sort"
 	"strconv"
 	"testing"
@@ -161,6 +162,68 @@ func TestKeyExpiration(t *testing.T) {
 	require.True(t, status.IsUnauthenticatedError(err))
 }
 
+func TestShortLivedAPIKeys(t *testing.T) {
+	flags.Set(t, "auth.api_key_group_cache_ttl", 0)
+	ctx := context.Background()
+	env := setupEnv(t)
+	fakeClock := clockwork.NewFakeClock()
+	env.SetClock(fakeClock)
+	adb, err := authdb.NewAuthDB(env, env.GetDBHandle())
+	require.NoError(t, err)
+
+	u := enterprise_testauth.CreateRandomUser(t, env, "org1.invalid")
+	groupID := u.Groups[0].Group.GroupID
+	auth := env.GetAuthenticator().(*testauth.TestAuthenticator)
+	adminCtx, err := auth.WithAuthenticatedUser(ctx, u.UserID)
+	require.NoError(t, err)
+	prevKeys, err := adb.GetAPIKeys(adminCtx, groupID)
+	require.NoError(t, err)
+
+	key, err := adb.CreateShortLivedAPIKeyWithoutAuthCheck(ctx, groupID, "short-lived", nil /*=caps*/, nil /*=scopes*/, time.Hour)
+	require.NoError(t, err)
+	_, err = adb.GetAPIKeyGroupFromAPIKey(ctx, key.Value)
+	require.NoError(t, err)
+
+	// Short-lived keys are listed with their expiry, so that they can be
+	// revoked.
+	keys, err := adb.GetAPIKeys(adminCtx, groupID)
+	require.NoError(t, err)
+	require.Len(t, keys, len(prevKeys)+1)
+	i := slices.IndexFunc(keys, func(k *tables.APIKey) bool { return k.APIKeyID == key.APIKeyID })
+	require.GreaterOrEqual(t, i, 0)
+	require.Equal(t, fakeClock.Now().Add(time.Hour).UnixMicro(), keys[i].ExpiryUsec)
+
+	// Org admins can revoke them before they expire.
+	revoked, err := adb.CreateShortLivedAPIKeyWithoutAuthCheck(ctx, groupID, "revoked", nil /*=caps*/, nil /*=scopes*/, time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, adb.DeleteAPIKey(adminCtx, revoked.APIKeyID))
+	_, err = adb.GetAPIKeyGroupFromAPIKey(ctx, revoked.Value)
+	require.True(t, status.IsUnauthenticatedError(err), "expected Unauthenticated, got %v", err)
+
+	// Keys are only deleted once they expire.
+	require.NoError(t, adb.DeleteExpiredAPIKeys(ctx))
+	_, err = adb.GetAPIKey(adminCtx, key.APIKeyID)
+	require.NoError(t, err)
+
+	// Expired keys aren't listed anymore, even before they're deleted.
+	fakeClock.Advance(2 * time.Hour)
+	keys, err = adb.GetAPIKeys(adminCtx, groupID)
+	require.NoError(t, err)
+	require.Equal(t, prevKeys, keys)
+
+	require.NoError(t, adb.DeleteExpiredAPIKeys(ctx))
+	n := int64(-1)
+	err = env.GetDBHandle().NewQuery(ctx, "authdb_test_count_keys").Raw(
+		`SELECT COUNT(*) FROM "APIKeys" WHERE api_key_id = ?`, key.APIKeyID).Take(&n)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), n)
+
+	// Keys that don't expire are kept.
+	keys, err = adb.GetAPIKeys(adminCtx, groupID)
+	require.NoError(t, err)
+	require.Equal(t, prevKeys, keys)
+}
+
 func TestGetAPIKeyGroupFromAPIKey(t *testing.T) {
 	for _, encrypt := range []bool{false, true} {
 		t.Run(fmt.Sprintf("encrypt_%t", encrypt), func(t *testing.T) {
@@ -317,6 +380,45 @@ func TestGetAPIKeys(t *testing.T) {
 	}
 }
 
+func TestAPIKeyScopes(t *testing.T) {
+	ctx := context.Background()
+	env := setupEnv(t)
+	flags.Set(t, "app.create_group_per_user", true)
+	flags.Set(t, "app.no_default_user_group", true)
+	adb := env.GetAuthDB()
+	udb := env.GetUserDB()
+
+	admin := createUser(t, ctx, env, "US1", "org1.io")
+	auth := env.GetAuthenticator().(*testauth.TestAuthenticator)
+	adminCtx, err := auth.WithAuthenticatedUser(ctx, admin.UserID)
+	require.NoError(t, err)
+	groupID, err := udb.CreateGroup(adminCtx, &tables.Group{})
+	require.NoError(t, err)
+	adminCtx, err = auth.WithAuthenticatedUser(ctx, admin.UserID)
+	require.NoError(t, err)
+
+	keyScopes := []akpb.ApiKey_Scope{akpb.ApiKey_CACHE_READ_SCOPE, akpb.ApiKey_BES_WRITE_SCOPE}
+	key, err := adb.CreateAPIKey(
+		adminCtx, groupID, "ci key",
+		[]akpb.ApiKey_Capability{akpb.ApiKey_CACHE_WRITE_CAPABILITY},
+		keyScopes, false /*=visibleToDevelopers*/)
+	require.NoError(t, err)
+
+	// The scopes should be carried over to the claims of the key.
+	akg, err := adb.GetAPIKeyGroupFromAPIKey(ctx, key.Value)
+	require.NoError(t, err)
+	assert.Equal(t, key.Scopes, akg.GetScopes())
+	assert.Equal(t, keyScopes, claims.APIKeyGroupClaims(akg).GetScopes())
+
+	// Updating the key without scopes should lift the restriction.
+	key.Scopes = 0
+	err = adb.UpdateAPIKey(adminCtx, key)
+	require.NoError(t, err)
+	updated, err := adb.GetAPIKey(adminCtx, key.APIKeyID)
+	require.NoError(t, err)
+	assert.Equal(t, int32(0), updated.Scopes)
+}
+
 func TestGetAPIKeyGroup_UserOwnedKeys(t *testing.T) {
 	ctx := context.Background()
 	env := setupEnv(t)
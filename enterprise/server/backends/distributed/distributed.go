@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -29,11 +30,14 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/lru"
 	"github.com/buildbuddy-io/buildbuddy/server/util/peerset"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
 	"google.golang.org/grpc/metadata"
 
+	capb "github.com/buildbuddy-io/buildbuddy/proto/cache"
 	dcpb "github.com/buildbuddy-io/buildbuddy/proto/distributed_cache"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
@@ -60,6 +64,13 @@ var (
 	lookasideCacheTTL        = flag.Duration("cache.distributed_cache.lookaside_cache_ttl", 1*time.Minute, "How long to hold stuff in the lookaside cache. Should be << atime_update_threshold")
 	maxLookasideEntryBytes   = flag.Int64("cache.distributed_cache.max_lookaside_entry_bytes", 10_000, "The biggest allowed entry size in the lookaside cache.")
 	maxHintedHandoffsPerPeer = flag.Int64("cache.distributed_cache.max_hinted_handoffs_per_peer", 100_000, "The maximum number of hinted handoffs to keep in memory. Each hinted handoff is a digest (~64 bytes), prefix, and peer (40 bytes). So keeping around 100000 of these means an extra 10MB per peer.")
+
+	rebalanceMaxBytesPerSecond = flag.Int64("cache.distributed_cache.rebalance_max_bytes_per_second", 50_000_000, "The maximum rate at which a rebalance copies data to its target peer. If <= 0, copies are not throttled.")
+)
+
+const (
+	// How often a rebalance reports its progress to the caller.
+	rebalanceProgressInterval = 5 * time.Second
 )
 
 type CacheConfig struct {
@@ -102,6 +113,7 @@ type peerInfo struct {
 }
 
 type Cache struct {
+	env                  environment.Env
 	local                interfaces.Cache
 	log                  log.Logger
 	lookasideMu          *sync.Mutex
@@ -115,6 +127,7 @@ type Cache struct {
 	heartbeatChannel     *heartbeat.Channel
 	heartbeatMu          *sync.Mutex
 	shutdownMu           *sync.RWMutex
+	rebalanceMu          *sync.Mutex
 	shutDownChan         chan struct{}
 	finishedShutdown     bool
 	config               CacheConfig
@@ -206,6 +219,7 @@ func NewDistributedCache(env environment.Env, c interfaces.Cache, config CacheCo
 		config.RPCHeartbeatInterval = 1 * time.Second
 	}
 	dc := &Cache{
+		env:                 env,
 		local:               c,
 		lookasideMu:         &sync.Mutex{},
 		log:                 log.NamedSubLogger(fmt.Sprintf("Coordinator(%s)", config.ListenAddr)),
@@ -216,6 +230,7 @@ func NewDistributedCache(env environment.Env, c interfaces.Cache, config CacheCo
 
 		heartbeatMu:      &sync.Mutex{},
 		shutdownMu:       &sync.RWMutex{},
+		rebalanceMu:      &sync.Mutex{},
 		shutDownChan:     nil,
 		finishedShutdown: true,
 		peerMetadata:     make(map[string]*peerInfo, 0),
@@ -250,6 +265,7 @@ func NewDistributedCache(env environment.Env, c interfaces.Cache, config CacheCo
 	}
 	dc.cacheProxy.SetHeartbeatCallbackFunc(dc.recvHeartbeatCallback)
 	dc.cacheProxy.SetHintedHandoffCallbackFunc(dc.recvHintedHandoffCallback)
+	dc.cacheProxy.SetRebalanceFunc(dc.rebalance)
 	if len(config.Nodes) > 0 {
 		// Nodes are hardcoded. Set them once and be done with it.
 		chash.Set(config.Nodes...)
@@ -647,6 +663,17 @@ func (c *Cache) remoteMetadata(ctx context.Context, peer string, r *rspb.Resourc
 	return c.cacheProxy.RemoteMetadata(ctx, peer, r)
 }
 
+func (c *Cache) remoteProvenance(ctx context.Context, peer string, r *rspb.ResourceName) (*capb.CacheEntryProvenance, error) {
+	if !c.config.DisableLocalLookup && peer == c.config.ListenAddr {
+		pc, ok := c.local.(interfaces.ProvenanceTrackingCache)
+		if !ok {
+			return nil, status.UnimplementedError("Provenance is not supported by the local cache.")
+		}
+		return pc.Provenance(ctx, r)
+	}
+	return c.cacheProxy.RemoteProvenance(ctx, peer, r)
+}
+
 func (c *Cache) remoteFindMissing(ctx context.Context, peer string, isolation *dcpb.Isolation, rns []*rspb.ResourceName) ([]*repb.Digest, error) {
 	if !c.config.DisableLocalLookup && peer == c.config.ListenAddr {
 		return c.local.FindMissing(ctx, rns)
@@ -735,7 +762,10 @@ func (c *Cache) sendFile(ctx context.Context, rn *rspb.ResourceName, dest string
 	if exists, err := c.cacheProxy.RemoteContains(ctx, dest, rn); err == nil && exists {
 		return nil
 	}
+	return c.writeLocalFileToPeer(ctx, rn, dest)
+}
 
+func (c *Cache) writeLocalFileToPeer(ctx context.Context, rn *rspb.ResourceName, dest string) error {
 	r, err := c.local.Reader(ctx, rn, 0, 0)
 	if err != nil {
 		return err
@@ -772,6 +802,94 @@ func (c *Cache) copyFile(ctx context.Context, rn *rspb.ResourceName, source stri
 	return rwc.Commit()
 }
 
+// rebalance copies every local entry for which targetPeer is one of the
+// primary replicas to targetPeer, unless it already has a copy. This restores
+// the replicas that were held by a node that targetPeer replaced.
+func (c *Cache) rebalance(ctx context.Context, targetPeer string, progressFn func(*dcpb.RebalanceResponse) error) error {
+	scanner, ok := c.local.(interfaces.ScannableCache)
+	if !ok {
+		return status.UnimplementedError("The local cache does not support rebalancing.")
+	}
+	if targetPeer == c.config.ListenAddr {
+		return status.InvalidArgumentError("A peer cannot rebalance to itself.")
+	}
+	if !slices.Contains(c.consistentHash.GetItems(), targetPeer) {
+		return status.InvalidArgumentErrorf("%q is not a member of the distributed cache.", targetPeer)
+	}
+	if !c.rebalanceMu.TryLock() {
+		return status.FailedPreconditionError("A rebalance is already in progress.")
+	}
+	defer c.rebalanceMu.Unlock()
+
+	// Entries are read and written as the group that owns them, so the scan
+	// must not inherit the caller's credentials. It is still canceled along
+	// with the request.
+	scanCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stop := context.AfterFunc(ctx, cancel)
+	defer stop()
+
+	limiter := rate.NewLimiter(rate.Inf, 0)
+	if *rebalanceMaxBytesPerSecond > 0 {
+		limiter = rate.NewLimiter(rate.Limit(*rebalanceMaxBytesPerSecond), int(*rebalanceMaxBytesPerSecond))
+	}
+	start := time.Now()
+	lastProgress := start
+	progress := &dcpb.RebalanceResponse{}
+	err := scanner.ScanResources(scanCtx, func(ctx context.Context, r *rspb.ResourceName) error {
+		progress.EntriesScanned++
+		if slices.Contains(c.writePeers(r.GetDigest()).PreferredPeers, targetPeer) {
+			copied, err := c.rebalanceEntry(ctx, limiter, r, targetPeer)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				progress.EntriesFailed++
+				c.log.Debugf("Rebalance: could not copy %q to %q: %s", cacheproxy.ResourceIsolationString(r), targetPeer, err)
+			} else if copied {
+				progress.EntriesCopied++
+				progress.BytesCopied += r.GetDigest().GetSizeBytes()
+			}
+		}
+		if time.Since(lastProgress) >= rebalanceProgressInterval {
+			lastProgress = time.Now()
+			return progressFn(progress)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.log.Infof("Rebalance to %q finished in %s: scanned %d entries, copied %d (%d bytes), %d failed", targetPeer, time.Since(start), progress.EntriesScanned, progress.EntriesCopied, progress.BytesCopied, progress.EntriesFailed)
+	progress.Done = true
+	return progressFn(progress)
+}
+
+// rebalanceEntry copies r to dest if dest doesn't have it yet, and returns
+// whether it was copied.
+func (c *Cache) rebalanceEntry(ctx context.Context, limiter *rate.Limiter, r *rspb.ResourceName, dest string) (bool, error) {
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, c.env)
+	if err != nil {
+		return false, err
+	}
+	exists, err := c.cacheProxy.RemoteContains(ctx, dest, r)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		return false, nil
+	}
+	if limiter.Limit() != rate.Inf {
+		if err := limiter.WaitN(ctx, int(min(r.GetDigest().GetSizeBytes(), int64(limiter.Burst())))); err != nil {
+			return false, err
+		}
+	}
+	if err := c.writeLocalFileToPeer(ctx, r, dest); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 type backfillOrder struct {
 	r      *rspb.ResourceName
 	source string
@@ -887,6 +1005,26 @@ func (c *Cache) Metadata(ctx context.Context, r *rspb.ResourceName) (*interfaces
 	return nil, status.NotFoundErrorf("Exhausted all peers attempting to query metadata %q.", d.GetHash())
 }
 
+// Provenance returns the provenance recorded for r by any of the peers that
+// store it.
+func (c *Cache) Provenance(ctx context.Context, r *rspb.ResourceName) (*capb.CacheEntryProvenance, error) {
+	d := r.GetDigest()
+	ps := c.readPeers(d)
+
+	for peer := ps.GetNextPeer(); peer != ""; peer = ps.GetNextPeer() {
+		prov, err := c.remoteProvenance(ctx, peer, r)
+		if err == nil {
+			return prov, nil
+		}
+		if status.IsNotFoundError(err) || status.IsUnimplementedError(err) {
+			continue
+		}
+		c.log.CtxDebugf(ctx, "Provenance(%q) lookup failed on peer %s: (err: %v)", cacheproxy.ResourceIsolationString(r), peer, err)
+		ps.MarkPeerAsFailed(peer)
+	}
+	return nil, status.NotFoundErrorf("Exhausted all peers attempting to query provenance %q.", d.GetHash())
+}
+
 func (c *Cache) FindMissing(ctx context.Context, resources []*rspb.ResourceName) ([]*repb.Digest, error) {
 	isolation := getIsolation(resources)
 	if isolation == nil {
@@ -1400,6 +1538,16 @@ func (c *Cache) SupportsCompressor(compressor repb.Compressor_Value) bool {
 	return false
 }
 
+// WriteLoad returns the write load of the local cache. Writes are spread
+// evenly across peers, so the local load is representative of the load that
+// a write will add to its replicas.
+func (c *Cache) WriteLoad() interfaces.CacheWriteLoad {
+	if r, ok := c.local.(interfaces.WriteLoadReportingCache); ok {
+		return r.WriteLoad()
+	}
+	return interfaces.CacheWriteLoad{}
+}
+
 func (c *Cache) SupportsEncryption(ctx context.Context) bool {
 	return c.local.SupportsEncryption(ctx)
 }
@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"slices"
 	"sync"
 	"testing"
 	"time"
@@ -25,11 +26,13 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
 
+	dcpb "github.com/buildbuddy-io/buildbuddy/proto/distributed_cache"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
 )
@@ -2277,3 +2280,106 @@ func (t *tracedCache) Writer(ctx context.Context, r *rspb.ResourceName) (interfa
 	t.addOps(Write, r)
 	return t.Cache.Writer(ctx, r)
 }
+
+// scannableMemoryCache is a memory cache that remembers which resources were
+// written to it, so that it can be scanned.
+type scannableMemoryCache struct {
+	interfaces.Cache
+
+	mu        sync.Mutex
+	resources []*rspb.ResourceName
+}
+
+func (c *scannableMemoryCache) Set(ctx context.Context, r *rspb.ResourceName, data []byte) error {
+	c.mu.Lock()
+	c.resources = append(c.resources, r)
+	c.mu.Unlock()
+	return c.Cache.Set(ctx, r, data)
+}
+
+func (c *scannableMemoryCache) ScanResources(ctx context.Context, fn func(ctx context.Context, r *rspb.ResourceName) error) error {
+	c.mu.Lock()
+	resources := append([]*rspb.ResourceName{}, c.resources...)
+	c.mu.Unlock()
+	for _, r := range resources {
+		if err := fn(ctx, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestRebalance(t *testing.T) {
+	env, _, ctx := getEnvAuthAndCtx(t)
+	singleCacheSizeBytes := int64(1000000)
+	numDigestsToWrite := 100
+	peer1 := fmt.Sprintf("localhost:%d", testport.FindFree(t))
+	peer2 := fmt.Sprintf("localhost:%d", testport.FindFree(t))
+	peer3 := fmt.Sprintf("localhost:%d", testport.FindFree(t))
+	baseConfig := CacheConfig{
+		ReplicationFactor:  2,
+		Nodes:              []string{peer1, peer2, peer3},
+		DisableLocalLookup: true,
+	}
+
+	// peer3 just replaced a node that held replicas, so its cache is empty
+	// while the other nodes still have all their data.
+	peers := []string{peer1, peer2, peer3}
+	baseCaches := map[string]*scannableMemoryCache{}
+	var dc1 *Cache
+	for _, peer := range peers {
+		baseCaches[peer] = &scannableMemoryCache{Cache: newMemoryCache(t, singleCacheSizeBytes)}
+		config := baseConfig
+		config.ListenAddr = peer
+		dc := startNewDCache(t, env, config, baseCaches[peer])
+		if peer == peer1 {
+			dc1 = dc
+		}
+	}
+	for _, peer := range peers {
+		waitForReady(t, peer)
+	}
+
+	var owned, notOwned []*rspb.ResourceName
+	for i := 0; i < numDigestsToWrite; i++ {
+		rn, buf := testdigest.RandomCASResourceBuf(t, 100)
+		peers := dc1.writePeers(rn.GetDigest()).PreferredPeers
+		for _, peer := range peers {
+			if peer != peer3 {
+				require.NoError(t, baseCaches[peer].Set(ctx, rn, buf))
+			}
+		}
+		if slices.Contains(peers, peer3) {
+			owned = append(owned, rn)
+		} else {
+			notOwned = append(notOwned, rn)
+		}
+	}
+	require.NotEmpty(t, owned)
+
+	for _, peer := range []string{peer1, peer2} {
+		var last *dcpb.RebalanceResponse
+		err := dc1.cacheProxy.RemoteRebalance(ctx, peer, peer3, func(rsp *dcpb.RebalanceResponse) {
+			last = rsp
+		})
+		require.NoError(t, err)
+		require.True(t, last.GetDone())
+		require.Equal(t, int64(0), last.GetEntriesFailed())
+		require.Equal(t, int64(len(baseCaches[peer].resources)), last.GetEntriesScanned())
+	}
+
+	for _, rn := range owned {
+		exists, err := baseCaches[peer3].Contains(ctx, rn)
+		require.NoError(t, err)
+		require.True(t, exists, "digest %q owned by %q was not copied", rn.GetDigest().GetHash(), peer3)
+	}
+	for _, rn := range notOwned {
+		exists, err := baseCaches[peer3].Contains(ctx, rn)
+		require.NoError(t, err)
+		require.False(t, exists, "digest %q not owned by %q was copied", rn.GetDigest().GetHash(), peer3)
+	}
+
+	// Rebalancing to a node that isn't part of the cluster fails.
+	err := dc1.cacheProxy.RemoteRebalance(ctx, peer1, "localhost:1", func(*dcpb.RebalanceResponse) {})
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+}
@@ -20,9 +20,12 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/google/tink/go/aead"
 	"github.com/google/tink/go/core/registry"
+	"github.com/google/tink/go/insecurecleartextkeyset"
 	"github.com/google/tink/go/integration/awskms"
 	"github.com/google/tink/go/integration/gcpkms"
+	"github.com/google/tink/go/keyset"
 	"github.com/google/tink/go/tink"
 	"google.golang.org/api/option"
 
@@ -35,6 +38,7 @@ const (
 	gcpKMSPrefix           = "gcp-kms://"
 	awsKMSPrefix           = "aws-kms://"
 	localInsecureKMSPrefix = "local-insecure-kms://"
+	localKeyFileKMSPrefix  = "local-key-file-kms://"
 )
 
 var (
@@ -46,6 +50,7 @@ var (
 	awsCredentialsFile        = flag.String("keystore.aws.credentials_file", "", "A path to a AWS CSV credentials file that will be used to authenticate. If not specified, credentials will be retrieved as described by https://docs.aws.amazon.com/sdkref/latest/guide/standardized-credentials.html")
 	awsCredentials            = flag.String("keystore.aws.credentials", "", "AWS CSV credentials that will be used to authenticate. If not specified, credentials will be retrieved as described by https://docs.aws.amazon.com/sdkref/latest/guide/standardized-credentials.html", flag.Secret)
 	localInsecureKMSDirectory = flag.String("keystore.local_insecure_kms_directory", "", "For development only. If set, keys in format local-insecure-kms://[id] are read from this directory.")
+	localKeyFileKMSDirectory  = flag.String("keystore.local_key_file_kms_directory", "", "If set, keys in format local-key-file-kms://[name] are read from Tink JSON keyset files in this directory. Keyset files must not be readable by other users.")
 )
 
 type KMS struct {
@@ -59,6 +64,9 @@ type KMS struct {
 
 	// May be nil if local development integration is not enabled.
 	localInsecureKMSClient registry.KMSClient
+
+	// May be nil if local key file integration is not enabled.
+	localKeyFileKMSClient registry.KMSClient
 }
 
 func New(ctx context.Context) (*KMS, error) {
@@ -72,6 +80,9 @@ func New(ctx context.Context) (*KMS, error) {
 	if err := kms.initLocalInsecureKMSClient(ctx); err != nil {
 		return nil, err
 	}
+	if err := kms.initLocalKeyFileKMSClient(ctx); err != nil {
+		return nil, err
+	}
 	_, err := kms.clientForURI(*masterKeyURI)
 	if err != nil {
 		return nil, status.InvalidArgumentErrorf("master key URI not supported")
@@ -173,6 +184,21 @@ func (k *KMS) initLocalInsecureKMSClient(ctx context.Context) error {
 	return nil
 }
 
+func (k *KMS) initLocalKeyFileKMSClient(ctx context.Context) error {
+	if *localKeyFileKMSDirectory == "" {
+		return nil
+	}
+	info, err := os.Stat(*localKeyFileKMSDirectory)
+	if err != nil {
+		return status.FailedPreconditionErrorf("could not access local key file directory: %s", err)
+	}
+	if !info.IsDir() {
+		return status.FailedPreconditionErrorf("local key file directory %q is not a directory", *localKeyFileKMSDirectory)
+	}
+	k.localKeyFileKMSClient = &LocalKeyFileKMS{root: *localKeyFileKMSDirectory}
+	return nil
+}
+
 func loadAWSCreds() (*awscreds.Value, error) {
 	var credsData []byte
 	if *awsCredentials != "" {
@@ -245,6 +271,8 @@ func (k *KMS) clientForURI(uri string) (registry.KMSClient, error) {
 		return client, nil
 	} else if strings.HasPrefix(uri, localInsecureKMSPrefix) && k.localInsecureKMSClient != nil {
 		return k.localInsecureKMSClient, nil
+	} else if strings.HasPrefix(uri, localKeyFileKMSPrefix) && k.localKeyFileKMSClient != nil {
+		return k.localKeyFileKMSClient, nil
 	}
 	log.Warningf("no matching client for URI %q", uri)
 	return nil, status.InvalidArgumentError("no matching client for key URI")
@@ -273,6 +301,9 @@ func (k *KMS) SupportedTypes() []interfaces.KMSType {
 	if k.awsClients != nil {
 		types = append(types, interfaces.KMSTypeAWS)
 	}
+	if k.localKeyFileKMSClient != nil {
+		types = append(types, interfaces.KMSTypeLocalKeyFile)
+	}
 	return types
 }
 
@@ -327,3 +358,43 @@ func (l *LocalInsecureKMS) GetAEAD(keyURI string) (tink.AEAD, error) {
 	}
 	return &gcmAESAEAD{g}, nil
 }
+
+// LocalKeyFileKMS is a KMS client that reads Tink keysets from JSON files in a
+// local directory managed by the server operator.
+//
+// Keys are rotated by adding a new key to the keyset and making it the
+// primary key. Data is always encrypted using the primary key, and can be
+// decrypted using any key in the keyset, so older keys should be kept in the
+// keyset until all data encrypted with them has been re-encrypted.
+type LocalKeyFileKMS struct {
+	root string
+}
+
+func (l *LocalKeyFileKMS) Supported(keyURI string) bool {
+	return strings.HasPrefix(keyURI, localKeyFileKMSPrefix)
+}
+
+func (l *LocalKeyFileKMS) GetAEAD(keyURI string) (tink.AEAD, error) {
+	name := strings.TrimPrefix(keyURI, localKeyFileKMSPrefix)
+	if name == "" || !filepath.IsLocal(name) {
+		return nil, status.InvalidArgumentErrorf("invalid key name %q", name)
+	}
+	path := filepath.Join(l.root, name)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, status.PermissionDeniedErrorf("key file %q must not be accessible by other users (mode %s)", name, info.Mode().Perm())
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	handle, err := insecurecleartextkeyset.Read(keyset.NewJSONReader(f))
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("could not read keyset %q: %s", name, err)
+	}
+	return aead.New(handle)
+}
@@ -0,0 +1,344 @@
+// Package log_index implements a full-text index over invocation console logs
+// and test logs, backed by the codesearch index stored in pebble.
+package log_index
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/codesearch/index"
+	"github.com/buildbuddy-io/buildbuddy/codesearch/query"
+	"github.com/buildbuddy-io/buildbuddy/codesearch/searcher"
+	"github.com/buildbuddy-io/buildbuddy/codesearch/types"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/disk"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/cockroachdb/pebble"
+
+	xxhash "github.com/cespare/xxhash/v2"
+)
+
+var (
+	indexBackend    = flag.String("app.log_index.backend", "", "If set, invocation console logs and test logs are indexed by the log index service at this address, which can be queried with the SearchLogs API. Takes precedence over app.log_index.directory.")
+	indexDirectory  = flag.String("app.log_index.directory", "", "If set, invocation console logs and test logs are indexed into a full-text search index in this directory, which can be queried with the SearchLogs API. The index is local to each app replica, so this should only be used with a single replica.")
+	maxLogSizeBytes = flag.Int64("app.log_index.max_log_size_bytes", 50_000_000, "Only the first max_log_size_bytes of each log are indexed.")
+)
+
+const (
+	// Logs are split into documents of at most this size, at line
+	// boundaries, so that matches don't require loading the whole log.
+	chunkSizeBytes = 1_000_000
+
+	defaultSearchWindow = 7 * 24 * time.Hour
+	// Searches are restricted by day, so limit the number of days searched.
+	maxSearchWindow = 90 * 24 * time.Hour
+
+	defaultMaxResults = 100
+	maxMaxResults     = 1000
+
+	dateFormat = "20060102"
+
+	// The following field names are used in the indexed docs. contentField
+	// must be "content", since that's the field searched by regexp queries.
+	idField           = "id"
+	contentField      = "content"
+	invocationIDField = "invocation_id"
+	targetLabelField  = "target_label"
+	createdAtField    = "created_at_usec"
+	dateField         = "date"
+	offsetField       = "offset"
+	lineField         = "line"
+)
+
+// LogIndex indexes logs in a local pebble database. Each group's logs are
+// written to a separate namespace.
+type LogIndex struct {
+	db *pebble.DB
+
+	// Serializes index writers, so that reindexing a log can't race with
+	// another writer adding the same documents.
+	mu sync.Mutex
+}
+
+func Register(env *real_environment.RealEnv) error {
+	if *indexBackend != "" {
+		li, err := NewRemote(env, *indexBackend)
+		if err != nil {
+			return err
+		}
+		env.SetLogIndex(li)
+		return nil
+	}
+	if *indexDirectory == "" {
+		return nil
+	}
+	li, err := New(*indexDirectory)
+	if err != nil {
+		return err
+	}
+	env.SetLogIndex(li)
+	env.GetHealthChecker().RegisterShutdownFunction(func(ctx context.Context) error {
+		return li.Close()
+	})
+	return nil
+}
+
+func New(rootDirectory string) (*LogIndex, error) {
+	if err := disk.EnsureDirectoryExists(rootDirectory); err != nil {
+		return nil, err
+	}
+	db, err := pebble.Open(rootDirectory, &pebble.Options{})
+	if err != nil {
+		return nil, status.InternalErrorf("open log index: %s", err)
+	}
+	return &LogIndex{db: db}, nil
+}
+
+func (li *LogIndex) Close() error {
+	return li.db.Close()
+}
+
+func makeDocument(l *interfaces.IndexedLog, offset, line int64, chunk []byte) types.Document {
+	id := xxhash.Sum64String(fmt.Sprintf("%s/%s/%d", l.InvocationID, l.TargetLabel, offset))
+	date := time.UnixMicro(l.InvocationCreatedAtUsec).UTC().Format(dateFormat)
+	fields := map[string]types.NamedField{
+		idField:           types.NewNamedField(types.KeywordField, idField, []byte(strconv.FormatUint(id, 10)), false /*=stored*/),
+		contentField:      types.NewNamedField(types.SparseNgramField, contentField, chunk, true /*=stored*/),
+		invocationIDField: types.NewNamedField(types.KeywordField, invocationIDField, []byte(l.InvocationID), true /*=stored*/),
+		createdAtField:    types.NewNamedField(types.KeywordField, createdAtField, []byte(strconv.FormatInt(l.InvocationCreatedAtUsec, 10)), true /*=stored*/),
+		dateField:         types.NewNamedField(types.KeywordField, dateField, []byte(date), false /*=stored*/),
+		offsetField:       types.NewNamedField(types.KeywordField, offsetField, []byte(strconv.FormatInt(offset, 10)), true /*=stored*/),
+		lineField:         types.NewNamedField(types.KeywordField, lineField, []byte(strconv.FormatInt(line, 10)), true /*=stored*/),
+	}
+	if l.TargetLabel != "" {
+		fields[targetLabelField] = types.NewNamedField(types.KeywordField, targetLabelField, []byte(l.TargetLabel), true /*=stored*/)
+	}
+	return types.NewMapDocument(fields)
+}
+
+func (li *LogIndex) IndexLog(ctx context.Context, l *interfaces.IndexedLog, r io.Reader) error {
+	if l.GroupID == "" || l.InvocationID == "" {
+		return status.InvalidArgumentError("indexed logs must have a group ID and invocation ID")
+	}
+	li.mu.Lock()
+	defer li.mu.Unlock()
+
+	w, err := index.NewWriter(li.db, l.GroupID)
+	if err != nil {
+		return err
+	}
+	r = io.LimitReader(r, *maxLogSizeBytes)
+	buf := make([]byte, chunkSizeBytes)
+	var offset int64
+	line := int64(1)
+	n := 0
+	for {
+		m, err := io.ReadFull(r, buf[n:])
+		n += m
+		eof := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !eof {
+			return err
+		}
+		// Split the log at the last complete line in the buffer, unless the
+		// line doesn't fit in a single chunk.
+		end := n
+		if i := bytes.LastIndexByte(buf[:n], '\n'); !eof && i >= 0 {
+			end = i + 1
+		}
+		if end > 0 {
+			chunk := buf[:end]
+			doc := makeDocument(l, offset, line, chunk)
+			if err := w.UpdateDocument(doc.Field(idField), doc); err != nil {
+				return err
+			}
+			offset += int64(end)
+			line += int64(bytes.Count(chunk, []byte{'\n'}))
+		}
+		n = copy(buf, buf[end:n])
+		if eof {
+			break
+		}
+	}
+	if err := deleteChunksAfter(ctx, li.db, w, l, offset); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// deleteChunksAfter deletes the chunks of a previously indexed version of the
+// log that start at or after the given offset, which would otherwise be left
+// behind when a log is reindexed with shorter contents.
+func deleteChunksAfter(ctx context.Context, db *pebble.DB, w *index.Writer, l *interfaces.IndexedLog, offset int64) error {
+	r := index.NewReader(ctx, db, l.GroupID)
+	docs, err := r.RawQuery(fmt.Sprintf("(:eq %s %s)", invocationIDField, strconv.Quote(l.InvocationID)))
+	if err != nil {
+		return err
+	}
+	for _, match := range docs {
+		doc, err := r.GetStoredDocument(match.Docid())
+		if err != nil {
+			return err
+		}
+		if storedString(doc, targetLabelField) != l.TargetLabel || storedInt(doc, offsetField) < offset {
+			continue
+		}
+		if err := w.DeleteDocument(match.Docid()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (li *LogIndex) DeleteInvocationLogs(ctx context.Context, groupID, invocationID string) error {
+	if groupID == "" || invocationID == "" {
+		return status.InvalidArgumentError("a group ID and invocation ID are required")
+	}
+	li.mu.Lock()
+	defer li.mu.Unlock()
+
+	r := index.NewReader(ctx, li.db, groupID)
+	docs, err := r.RawQuery(fmt.Sprintf("(:eq %s %s)", invocationIDField, strconv.Quote(invocationID)))
+	if err != nil {
+		return err
+	}
+	w, err := index.NewWriter(li.db, groupID)
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		if err := w.DeleteDocument(doc.Docid()); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// dateRangeQuery restricts a regexp query to documents from a set of days.
+type dateRangeQuery struct {
+	*query.ReQuery
+	squery string
+}
+
+func (q *dateRangeQuery) SQuery() string {
+	return q.squery
+}
+
+func storedString(doc types.Document, field string) string {
+	f := doc.Field(field)
+	if f == nil {
+		return ""
+	}
+	return string(f.Contents())
+}
+
+func storedInt(doc types.Document, field string) int64 {
+	i, _ := strconv.ParseInt(storedString(doc, field), 10, 64)
+	return i
+}
+
+// lineAt returns the byte offset and contents of the given 1-based line.
+func lineAt(buf []byte, lineNumber int) (int, []byte) {
+	offset := 0
+	for i := 1; i < lineNumber; i++ {
+		next := bytes.IndexByte(buf[offset:], '\n')
+		if next < 0 {
+			return len(buf), nil
+		}
+		offset += next + 1
+	}
+	line := buf[offset:]
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	return offset, line
+}
+
+func (li *LogIndex) SearchLogs(ctx context.Context, q *interfaces.LogSearchQuery) ([]*interfaces.LogMatch, error) {
+	if q.GroupID == "" {
+		return nil, status.InvalidArgumentError("log searches must be scoped to a group")
+	}
+	end := time.Now()
+	if q.EndTimeUsec > 0 {
+		end = time.UnixMicro(q.EndTimeUsec)
+	}
+	start := end.Add(-defaultSearchWindow)
+	if q.StartTimeUsec > 0 {
+		start = time.UnixMicro(q.StartTimeUsec)
+	}
+	if end.Before(start) {
+		return nil, status.InvalidArgumentError("end time must not be before start time")
+	}
+	if end.Sub(start) > maxSearchWindow {
+		return nil, status.InvalidArgumentErrorf("time range must not exceed %s", maxSearchWindow)
+	}
+	maxResults := defaultMaxResults
+	if q.MaxResults > 0 {
+		maxResults = min(q.MaxResults, maxMaxResults)
+	}
+
+	reQuery, err := query.NewReQuery(ctx, q.Query)
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("invalid query: %s", err)
+	}
+	if reQuery.SQuery() == "" {
+		return nil, status.InvalidArgumentError("query must not be empty")
+	}
+	var dateClauses []string
+	for day := start.UTC().Truncate(24 * time.Hour); !day.After(end); day = day.Add(24 * time.Hour) {
+		dateClauses = append(dateClauses, fmt.Sprintf("(:eq %s %s)", dateField, strconv.Quote(day.Format(dateFormat))))
+	}
+	sq := &dateRangeQuery{
+		ReQuery: reQuery,
+		squery:  fmt.Sprintf("(:and %s (:or %s))", reQuery.SQuery(), strings.Join(dateClauses, " ")),
+	}
+
+	// Each matching document has at least one matching line.
+	docs, err := searcher.New(ctx, index.NewReader(ctx, li.db, q.GroupID)).Search(sq, maxResults, 0)
+	if err != nil {
+		return nil, err
+	}
+	highlighter := reQuery.Highlighter()
+	matches := make([]*interfaces.LogMatch, 0)
+	for _, doc := range docs {
+		createdAtUsec := storedInt(doc, createdAtField)
+		if createdAtUsec < start.UnixMicro() || createdAtUsec > end.UnixMicro() {
+			continue
+		}
+		l := &interfaces.IndexedLog{
+			GroupID:                 q.GroupID,
+			InvocationID:            string(doc.Field(invocationIDField).Contents()),
+			TargetLabel:             string(doc.Field(targetLabelField).Contents()),
+			InvocationCreatedAtUsec: createdAtUsec,
+		}
+		content := doc.Field(contentField).Contents()
+		chunkOffset := storedInt(doc, offsetField)
+		chunkLine := storedInt(doc, lineField)
+		lastLine := 0
+		for _, region := range highlighter.Highlight(doc) {
+			// Only return each matching line once.
+			if region.Line() == lastLine {
+				continue
+			}
+			lastLine = region.Line()
+			offset, line := lineAt(content, region.Line())
+			matches = append(matches, &interfaces.LogMatch{
+				Log:        l,
+				Offset:     chunkOffset + int64(offset),
+				LineNumber: chunkLine + int64(region.Line()) - 1,
+				Line:       string(line),
+			})
+			if len(matches) >= maxResults {
+				return matches, nil
+			}
+		}
+	}
+	return matches, nil
+}
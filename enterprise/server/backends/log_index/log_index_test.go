@@ -0,0 +1,211 @@
+package log_index_test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/log_index"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	lipb "github.com/buildbuddy-io/buildbuddy/proto/log_index_service"
+)
+
+func newLogIndex(t *testing.T) *log_index.LogIndex {
+	li, err := log_index.New(testfs.MakeTempDir(t))
+	require.NoError(t, err)
+	t.Cleanup(func() { li.Close() })
+	return li
+}
+
+func TestSearchLogs(t *testing.T) {
+	ctx := context.Background()
+	li := newLogIndex(t)
+	now := time.Now()
+
+	consoleLog := &interfaces.IndexedLog{GroupID: "GR1", InvocationID: "inv1", InvocationCreatedAtUsec: now.UnixMicro()}
+	err := li.IndexLog(ctx, consoleLog, strings.NewReader("INFO: Analyzed 3 targets\nERROR: compilation failed\nINFO: Build completed\n"))
+	require.NoError(t, err)
+	testLog := &interfaces.IndexedLog{GroupID: "GR1", InvocationID: "inv1", TargetLabel: "//foo:foo_test", InvocationCreatedAtUsec: now.UnixMicro()}
+	err = li.IndexLog(ctx, testLog, strings.NewReader("=== RUN TestFoo\n--- FAIL: TestFoo\n    connection refused\n"))
+	require.NoError(t, err)
+	otherGroupLog := &interfaces.IndexedLog{GroupID: "GR2", InvocationID: "inv2", InvocationCreatedAtUsec: now.UnixMicro()}
+	err = li.IndexLog(ctx, otherGroupLog, strings.NewReader("ERROR: compilation failed\n"))
+	require.NoError(t, err)
+
+	matches, err := li.SearchLogs(ctx, &interfaces.LogSearchQuery{GroupID: "GR1", Query: "compilation failed"})
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+	assert.Equal(t, "inv1", matches[0].Log.InvocationID)
+	assert.Equal(t, "", matches[0].Log.TargetLabel)
+	assert.Equal(t, int64(len("INFO: Analyzed 3 targets\n")), matches[0].Offset)
+	assert.Equal(t, int64(2), matches[0].LineNumber)
+	assert.Equal(t, "ERROR: compilation failed", matches[0].Line)
+
+	matches, err = li.SearchLogs(ctx, &interfaces.LogSearchQuery{GroupID: "GR1", Query: "connection refused"})
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+	assert.Equal(t, "//foo:foo_test", matches[0].Log.TargetLabel)
+	assert.Equal(t, int64(3), matches[0].LineNumber)
+
+	// Logs outside of the time range are not returned.
+	matches, err = li.SearchLogs(ctx, &interfaces.LogSearchQuery{
+		GroupID:       "GR1",
+		Query:         "compilation failed",
+		StartTimeUsec: now.Add(-3 * time.Hour * 24).UnixMicro(),
+		EndTimeUsec:   now.Add(-2 * time.Hour * 24).UnixMicro(),
+	})
+	require.NoError(t, err)
+	assert.Empty(t, matches)
+
+	_, err = li.SearchLogs(ctx, &interfaces.LogSearchQuery{GroupID: "GR1", Query: ""})
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error, got %v", err)
+}
+
+func TestIndexLog_ReplacesPreviousContents(t *testing.T) {
+	ctx := context.Background()
+	li := newLogIndex(t)
+	l := &interfaces.IndexedLog{GroupID: "GR1", InvocationID: "inv1", InvocationCreatedAtUsec: time.Now().UnixMicro()}
+
+	err := li.IndexLog(ctx, l, strings.NewReader("first attempt\n"))
+	require.NoError(t, err)
+	err = li.IndexLog(ctx, l, strings.NewReader("second attempt\n"))
+	require.NoError(t, err)
+
+	matches, err := li.SearchLogs(ctx, &interfaces.LogSearchQuery{GroupID: "GR1", Query: "attempt"})
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+	assert.Equal(t, "second attempt", matches[0].Line)
+}
+
+func TestIndexLog_ShorterReindexDeletesTrailingChunks(t *testing.T) {
+	ctx := context.Background()
+	li := newLogIndex(t)
+	consoleLog := &interfaces.IndexedLog{GroupID: "GR1", InvocationID: "inv1", InvocationCreatedAtUsec: time.Now().UnixMicro()}
+	testLog := &interfaces.IndexedLog{GroupID: "GR1", InvocationID: "inv1", TargetLabel: "//foo:foo_test", InvocationCreatedAtUsec: time.Now().UnixMicro()}
+
+	// Spread the logs over multiple documents, with the needle in the last
+	// one.
+	line := strings.Repeat("x", 99) + "\n"
+	log := strings.Repeat(line, 20_000) + "needle\n"
+	err := li.IndexLog(ctx, consoleLog, strings.NewReader(log))
+	require.NoError(t, err)
+	err = li.IndexLog(ctx, testLog, strings.NewReader(log))
+	require.NoError(t, err)
+	matches, err := li.SearchLogs(ctx, &interfaces.LogSearchQuery{GroupID: "GR1", Query: "needle"})
+	require.NoError(t, err)
+	require.Len(t, matches, 2)
+
+	// Reindexing the console log with a single chunk drops its later chunks,
+	// but not the test log's.
+	err = li.IndexLog(ctx, consoleLog, strings.NewReader("short log\n"))
+	require.NoError(t, err)
+	matches, err = li.SearchLogs(ctx, &interfaces.LogSearchQuery{GroupID: "GR1", Query: "needle"})
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+	assert.Equal(t, "//foo:foo_test", matches[0].Log.TargetLabel)
+	matches, err = li.SearchLogs(ctx, &interfaces.LogSearchQuery{GroupID: "GR1", Query: "short log"})
+	require.NoError(t, err)
+	assert.Len(t, matches, 1)
+}
+
+func TestIndexLog_LargeLog(t *testing.T) {
+	ctx := context.Background()
+	li := newLogIndex(t)
+	l := &interfaces.IndexedLog{GroupID: "GR1", InvocationID: "inv1", InvocationCreatedAtUsec: time.Now().UnixMicro()}
+
+	// Spread the log over multiple documents.
+	line := strings.Repeat("x", 99) + "\n"
+	log := strings.Repeat(line, 20_000) + "needle\n"
+	err := li.IndexLog(ctx, l, strings.NewReader(log))
+	require.NoError(t, err)
+
+	matches, err := li.SearchLogs(ctx, &interfaces.LogSearchQuery{GroupID: "GR1", Query: "needle"})
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+	assert.Equal(t, int64(20_001), matches[0].LineNumber)
+	assert.Equal(t, int64(len(log)-len("needle\n")), matches[0].Offset)
+}
+
+func TestDeleteInvocationLogs(t *testing.T) {
+	ctx := context.Background()
+	li := newLogIndex(t)
+	now := time.Now().UnixMicro()
+
+	for _, l := range []*interfaces.IndexedLog{
+		{GroupID: "GR1", InvocationID: "inv1", InvocationCreatedAtUsec: now},
+		{GroupID: "GR1", InvocationID: "inv1", TargetLabel: "//foo:foo_test", InvocationCreatedAtUsec: now},
+		{GroupID: "GR1", InvocationID: "inv2", InvocationCreatedAtUsec: now},
+	} {
+		err := li.IndexLog(ctx, l, strings.NewReader("ERROR: compilation failed\n"))
+		require.NoError(t, err)
+	}
+
+	err := li.DeleteInvocationLogs(ctx, "GR1", "inv1")
+	require.NoError(t, err)
+
+	matches, err := li.SearchLogs(ctx, &interfaces.LogSearchQuery{GroupID: "GR1", Query: "compilation failed"})
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+	assert.Equal(t, "inv2", matches[0].Log.InvocationID)
+
+	// Reindexing a deleted log makes it searchable again.
+	err = li.IndexLog(ctx, &interfaces.IndexedLog{GroupID: "GR1", InvocationID: "inv1", InvocationCreatedAtUsec: now}, strings.NewReader("ERROR: compilation failed\n"))
+	require.NoError(t, err)
+	matches, err = li.SearchLogs(ctx, &interfaces.LogSearchQuery{GroupID: "GR1", Query: "compilation failed"})
+	require.NoError(t, err)
+	assert.Len(t, matches, 2)
+}
+
+func TestRemoteLogIndex(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1")))
+	lis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	srv, run := testenv.GRPCServer(te, lis)
+	t.Cleanup(srv.Stop)
+	lipb.RegisterLogIndexServiceServer(srv, log_index.NewServer(te, newLogIndex(t)))
+	go run()
+
+	li, err := log_index.NewRemote(te, "grpc://"+lis.Addr().String())
+	require.NoError(t, err)
+	ctx, err := te.GetAuthenticator().(*testauth.TestAuthenticator).WithAuthenticatedUser(context.Background(), "US1")
+	require.NoError(t, err)
+
+	// Spread the log over multiple uploaded chunks.
+	line := strings.Repeat("x", 99) + "\n"
+	log := strings.Repeat(line, 20_000) + "needle\n"
+	l := &interfaces.IndexedLog{GroupID: "GR1", InvocationID: "inv1", TargetLabel: "//foo:foo_test", InvocationCreatedAtUsec: time.Now().UnixMicro()}
+	err = li.IndexLog(ctx, l, strings.NewReader(log))
+	require.NoError(t, err)
+
+	matches, err := li.SearchLogs(ctx, &interfaces.LogSearchQuery{GroupID: "GR1", Query: "needle"})
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+	assert.Equal(t, l, matches[0].Log)
+	assert.Equal(t, int64(20_001), matches[0].LineNumber)
+	assert.Equal(t, int64(len(log)-len("needle\n")), matches[0].Offset)
+	assert.Equal(t, "needle", matches[0].Line)
+
+	// Other groups' logs can't be accessed.
+	err = li.IndexLog(ctx, &interfaces.IndexedLog{GroupID: "GR2", InvocationID: "inv2"}, strings.NewReader("needle\n"))
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+	_, err = li.SearchLogs(ctx, &interfaces.LogSearchQuery{GroupID: "GR2", Query: "needle"})
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+	err = li.DeleteInvocationLogs(ctx, "GR2", "inv1")
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+
+	err = li.DeleteInvocationLogs(ctx, "GR1", "inv1")
+	require.NoError(t, err)
+	matches, err = li.SearchLogs(ctx, &interfaces.LogSearchQuery{GroupID: "GR1", Query: "needle"})
+	require.NoError(t, err)
+	assert.Empty(t, matches)
+}
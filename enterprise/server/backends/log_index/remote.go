@@ -0,0 +1,120 @@
+package log_index
+
+import (
+	"context"
+	"io"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/grpc_client"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	lipb "github.com/buildbuddy-io/buildbuddy/proto/log_index_service"
+)
+
+const (
+	// Logs are uploaded to the log index service in chunks of this size.
+	uploadChunkSizeBytes = 1_000_000
+)
+
+// RemoteLogIndex is a LogIndex served by a log index service, so that all app
+// replicas share the same index.
+type RemoteLogIndex struct {
+	client lipb.LogIndexServiceClient
+}
+
+func NewRemote(env environment.Env, target string) (*RemoteLogIndex, error) {
+	conn, err := grpc_client.DialInternal(env, target)
+	if err != nil {
+		return nil, status.UnavailableErrorf("could not dial log index backend %q: %s", target, err)
+	}
+	return &RemoteLogIndex{
+		client: lipb.NewLogIndexServiceClient(conn),
+	}, nil
+}
+
+func indexedLogToProto(l *interfaces.IndexedLog) *lipb.IndexedLog {
+	return &lipb.IndexedLog{
+		GroupId:                 l.GroupID,
+		InvocationId:            l.InvocationID,
+		TargetLabel:             l.TargetLabel,
+		InvocationCreatedAtUsec: l.InvocationCreatedAtUsec,
+	}
+}
+
+func indexedLogFromProto(l *lipb.IndexedLog) *interfaces.IndexedLog {
+	return &interfaces.IndexedLog{
+		GroupID:                 l.GetGroupId(),
+		InvocationID:            l.GetInvocationId(),
+		TargetLabel:             l.GetTargetLabel(),
+		InvocationCreatedAtUsec: l.GetInvocationCreatedAtUsec(),
+	}
+}
+
+func (li *RemoteLogIndex) IndexLog(ctx context.Context, l *interfaces.IndexedLog, r io.Reader) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := li.client.IndexLog(ctx)
+	if err != nil {
+		return err
+	}
+	req := &lipb.IndexLogRequest{Log: indexedLogToProto(l)}
+	r = io.LimitReader(r, *maxLogSizeBytes)
+	for {
+		// Sent messages must not be modified, so each chunk gets its own
+		// buffer.
+		buf := make([]byte, uploadChunkSizeBytes)
+		n, err := io.ReadFull(r, buf)
+		eof := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !eof {
+			return err
+		}
+		if n > 0 || req.Log != nil {
+			req.Data = buf[:n]
+			if err := stream.Send(req); err == io.EOF {
+				// The server closed the stream; its status is returned
+				// by CloseAndRecv.
+				break
+			} else if err != nil {
+				return err
+			}
+			req = &lipb.IndexLogRequest{}
+		}
+		if eof {
+			break
+		}
+	}
+	_, err = stream.CloseAndRecv()
+	return err
+}
+
+func (li *RemoteLogIndex) SearchLogs(ctx context.Context, q *interfaces.LogSearchQuery) ([]*interfaces.LogMatch, error) {
+	rsp, err := li.client.SearchLogs(ctx, &lipb.SearchLogsRequest{
+		GroupId:       q.GroupID,
+		Query:         q.Query,
+		StartTimeUsec: q.StartTimeUsec,
+		EndTimeUsec:   q.EndTimeUsec,
+		MaxResults:    int32(q.MaxResults),
+	})
+	if err != nil {
+		return nil, err
+	}
+	matches := make([]*interfaces.LogMatch, 0, len(rsp.GetMatch()))
+	for _, m := range rsp.GetMatch() {
+		matches = append(matches, &interfaces.LogMatch{
+			Log:        indexedLogFromProto(m.GetLog()),
+			Offset:     m.GetOffset(),
+			LineNumber: m.GetLineNumber(),
+			Line:       m.GetLine(),
+		})
+	}
+	return matches, nil
+}
+
+func (li *RemoteLogIndex) DeleteInvocationLogs(ctx context.Context, groupID, invocationID string) error {
+	_, err := li.client.DeleteInvocationLogs(ctx, &lipb.DeleteInvocationLogsRequest{
+		GroupId:      groupID,
+		InvocationId: invocationID,
+	})
+	return err
+}
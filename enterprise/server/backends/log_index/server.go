@@ -0,0 +1,98 @@
+package log_index
+
+import (
+	"context"
+	"io"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/authutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	lipb "github.com/buildbuddy-io/buildbuddy/proto/log_index_service"
+)
+
+// Server serves a LogIndex to the app replicas over gRPC. Requests may only
+// access the logs of groups that the caller is a member of.
+type Server struct {
+	env environment.Env
+	li  interfaces.LogIndex
+}
+
+func NewServer(env environment.Env, li interfaces.LogIndex) *Server {
+	return &Server{env: env, li: li}
+}
+
+// streamReader reads the log contents sent on an IndexLog stream.
+type streamReader struct {
+	stream lipb.LogIndexService_IndexLogServer
+	buf    []byte
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		req, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		r.buf = req.GetData()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (s *Server) IndexLog(stream lipb.LogIndexService_IndexLogServer) error {
+	ctx := stream.Context()
+	req, err := stream.Recv()
+	if err == io.EOF {
+		return status.InvalidArgumentError("missing log")
+	} else if err != nil {
+		return err
+	}
+	l := indexedLogFromProto(req.GetLog())
+	if err := authutil.AuthorizeGroupAccess(ctx, s.env, l.GroupID); err != nil {
+		return err
+	}
+	r := &streamReader{stream: stream, buf: req.GetData()}
+	if err := s.li.IndexLog(ctx, l, r); err != nil {
+		return err
+	}
+	return stream.SendAndClose(&lipb.IndexLogResponse{})
+}
+
+func (s *Server) SearchLogs(ctx context.Context, req *lipb.SearchLogsRequest) (*lipb.SearchLogsResponse, error) {
+	if err := authutil.AuthorizeGroupAccess(ctx, s.env, req.GetGroupId()); err != nil {
+		return nil, err
+	}
+	matches, err := s.li.SearchLogs(ctx, &interfaces.LogSearchQuery{
+		GroupID:       req.GetGroupId(),
+		Query:         req.GetQuery(),
+		StartTimeUsec: req.GetStartTimeUsec(),
+		EndTimeUsec:   req.GetEndTimeUsec(),
+		MaxResults:    int(req.GetMaxResults()),
+	})
+	if err != nil {
+		return nil, err
+	}
+	rsp := &lipb.SearchLogsResponse{}
+	for _, m := range matches {
+		rsp.Match = append(rsp.Match, &lipb.LogMatch{
+			Log:        indexedLogToProto(m.Log),
+			Offset:     m.Offset,
+			LineNumber: m.LineNumber,
+			Line:       m.Line,
+		})
+	}
+	return rsp, nil
+}
+
+func (s *Server) DeleteInvocationLogs(ctx context.Context, req *lipb.DeleteInvocationLogsRequest) (*lipb.DeleteInvocationLogsResponse, error) {
+	if err := authutil.AuthorizeGroupAccess(ctx, s.env, req.GetGroupId()); err != nil {
+		return nil, err
+	}
+	if err := s.li.DeleteInvocationLogs(ctx, req.GetGroupId(), req.GetInvocationId()); err != nil {
+		return nil, err
+	}
+	return &lipb.DeleteInvocationLogsResponse{}, nil
+}
@@ -3,6 +3,7 @@ package migration_cache
 import (
 	"time"
 
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/pebble_cache"
 	"github.com/buildbuddy-io/buildbuddy/server/util/disk"
 )
 
@@ -39,20 +40,22 @@ type DiskCacheConfig struct {
 }
 
 type PebbleCacheConfig struct {
-	Name                        string                  `yaml:"name"`
-	RootDirectory               string                  `yaml:"root_directory"`
-	Partitions                  []disk.Partition        `yaml:"partitions"`
-	PartitionMappings           []disk.PartitionMapping `yaml:"partition_mappings"`
-	MaxSizeBytes                int64                   `yaml:"max_size_bytes"`
-	BlockCacheSizeBytes         int64                   `yaml:"block_cache_size_bytes"`
-	MaxInlineFileSizeBytes      int64                   `yaml:"max_inline_file_size_bytes"`
-	AtimeUpdateThreshold        *time.Duration          `yaml:"atime_update_threshold"`
-	AtimeBufferSize             *int                    `yaml:"atime_buffer_size"`
-	MinEvictionAge              *time.Duration          `yaml:"min_eviction_age"`
-	MinBytesAutoZstdCompression int64                   `yaml:"min_bytes_auto_zstd_compression"`
-	AverageChunkSizeBytes       int                     `yaml:"average_chunk_size_bytes"`
-	ClearCacheOnStartup         bool                    `yaml:"clear_cache_on_startup"`
-	ActiveKeyVersion            *int64                  `yaml:"active_key_version"`
+	Name                        string                         `yaml:"name"`
+	RootDirectory               string                         `yaml:"root_directory"`
+	Partitions                  []disk.Partition               `yaml:"partitions"`
+	PartitionMappings           []disk.PartitionMapping        `yaml:"partition_mappings"`
+	MaxSizeBytes                int64                          `yaml:"max_size_bytes"`
+	BlockCacheSizeBytes         int64                          `yaml:"block_cache_size_bytes"`
+	MaxInlineFileSizeBytes      int64                          `yaml:"max_inline_file_size_bytes"`
+	AtimeUpdateThreshold        *time.Duration                 `yaml:"atime_update_threshold"`
+	AtimeBufferSize             *int                           `yaml:"atime_buffer_size"`
+	MinEvictionAge              *time.Duration                 `yaml:"min_eviction_age"`
+	RetentionPolicies           []pebble_cache.RetentionPolicy `yaml:"retention_policies"`
+	MinBytesAutoZstdCompression int64                          `yaml:"min_bytes_auto_zstd_compression"`
+	AverageChunkSizeBytes       int                            `yaml:"average_chunk_size_bytes"`
+	MinBytesChunked             int64                          `yaml:"min_bytes_chunked"`
+	ClearCacheOnStartup         bool                           `yaml:"clear_cache_on_startup"`
+	ActiveKeyVersion            *int64                         `yaml:"active_key_version"`
 }
 
 func (cfg *MigrationConfig) SetConfigDefaults() {
@@ -157,7 +157,9 @@ func pebbleCacheFromConfig(env environment.Env, cfg *PebbleCacheConfig) (*pebble
 		AtimeUpdateThreshold:        cfg.AtimeUpdateThreshold,
 		AtimeBufferSize:             cfg.AtimeBufferSize,
 		MinEvictionAge:              cfg.MinEvictionAge,
+		RetentionPolicies:           cfg.RetentionPolicies,
 		AverageChunkSizeBytes:       cfg.AverageChunkSizeBytes,
+		MinBytesChunked:             cfg.MinBytesChunked,
 		ClearCacheOnStartup:         cfg.ClearCacheOnStartup,
 		ActiveKeyVersion:            cfg.ActiveKeyVersion,
 	}
@@ -0,0 +1,273 @@
+package pebble_cache
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bits-and-blooms/bloom/v3"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/raft/filestore"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/raft/keys"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/pebble"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/util/disk"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/prometheus/client_golang/prometheus"
+
+	rfpb "github.com/buildbuddy-io/buildbuddy/proto/raft"
+	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
+)
+
+const (
+	// How often partition filters are checked to see if they need to be
+	// rebuilt.
+	findMissingFilterCheckPeriod = 1 * time.Minute
+
+	// A filter is rebuilt once more than this fraction of the entries added
+	// to it have since been removed from the cache.
+	findMissingFilterMaxStaleFraction = 0.25
+
+	// Filter lookup results, for metrics.
+	definitelyMissingFilterResult = "definitely_missing"
+	maybePresentFilterResult      = "maybe_present"
+	notReadyFilterResult          = "not_ready"
+)
+
+// partitionFilter is a bloom filter over the entries stored in a single
+// partition, which lets FindMissing report entries that are definitely missing
+// without looking them up in pebble.
+//
+// Bloom filters don't support removal, so entries that are evicted or deleted
+// stay in the filter and only cost an exact pebble lookup. Once too many of
+// the filter's entries are stale, or it holds more entries than it was sized
+// for, it is rebuilt from a scan of the partition.
+type partitionFilter struct {
+	cacheName         string
+	partitionID       string
+	minCapacity       uint
+	falsePositiveRate float64
+
+	mu sync.RWMutex // PROTECTS(filter, building, capacity, added, removed)
+	// filter is nil until the first build completes. Until then, every
+	// lookup falls back to pebble.
+	filter *bloom.BloomFilter
+	// building is the filter being built while a rebuild is in progress.
+	// Entries written during the rebuild are added to both filters, so the
+	// new filter doesn't miss entries written after the scan started.
+	building *bloom.BloomFilter
+	capacity uint
+	added    int64
+	removed  int64
+}
+
+// findMissingFilters holds the filter for each partition. The map isn't
+// modified after the cache is created. All methods are safe to call on a nil
+// map, which means that filtering is disabled.
+type findMissingFilters map[string]*partitionFilter
+
+func newFindMissingFilters(cacheName string, partitions []disk.Partition, expectedEntries int64, falsePositiveRate float64) findMissingFilters {
+	if expectedEntries <= 0 {
+		return nil
+	}
+	filters := make(findMissingFilters, len(partitions))
+	for _, part := range partitions {
+		filters[part.ID] = &partitionFilter{
+			cacheName:         cacheName,
+			partitionID:       part.ID,
+			minCapacity:       uint(expectedEntries),
+			falsePositiveRate: falsePositiveRate,
+		}
+	}
+	return filters
+}
+
+func findMissingFilterKey(cacheType rspb.CacheType, hash string) []byte {
+	// Keys only need to distinguish entries within a partition. Entries
+	// for different groups or instance names sharing a partition only
+	// collide as false positives.
+	return []byte(strconv.Itoa(int(cacheType)) + "/" + hash)
+}
+
+func (f findMissingFilters) forRecord(r *rfpb.FileRecord) *partitionFilter {
+	return f[r.GetIsolation().GetPartitionId()]
+}
+
+// add records that the entry described by r was written. It must be called
+// after the entry is visible in pebble.
+func (f findMissingFilters) add(r *rfpb.FileRecord) {
+	pf := f.forRecord(r)
+	if pf == nil {
+		return
+	}
+	k := findMissingFilterKey(r.GetIsolation().GetCacheType(), r.GetDigest().GetHash())
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	if pf.filter != nil {
+		pf.filter.Add(k)
+	}
+	if pf.building != nil {
+		pf.building.Add(k)
+	}
+	pf.added++
+}
+
+// recordRemoval records that an entry was removed from the given partition.
+func (f findMissingFilters) recordRemoval(partitionID string) {
+	pf := f[partitionID]
+	if pf == nil {
+		return
+	}
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	pf.removed++
+}
+
+// definitelyMissing returns true if the entry described by r is known not to
+// be stored in the cache. A false result means the entry may or may not be
+// stored, and must be looked up.
+func (f findMissingFilters) definitelyMissing(r *rfpb.FileRecord) bool {
+	pf := f.forRecord(r)
+	if pf == nil {
+		return false
+	}
+	k := findMissingFilterKey(r.GetIsolation().GetCacheType(), r.GetDigest().GetHash())
+	pf.mu.RLock()
+	ready := pf.filter != nil
+	missing := ready && !pf.filter.Test(k)
+	pf.mu.RUnlock()
+
+	result := maybePresentFilterResult
+	if !ready {
+		result = notReadyFilterResult
+	} else if missing {
+		result = definitelyMissingFilterResult
+	}
+	metrics.PebbleCacheFindMissingFilterLookupCount.With(prometheus.Labels{
+		metrics.CacheNameLabel:                     pf.cacheName,
+		metrics.PartitionID:                        pf.partitionID,
+		metrics.PebbleCacheFindMissingFilterResult: result,
+	}).Inc()
+	return missing
+}
+
+func (pf *partitionFilter) needsRebuild() bool {
+	pf.mu.RLock()
+	defer pf.mu.RUnlock()
+	if pf.filter == nil {
+		return true
+	}
+	if uint(pf.added) > pf.capacity {
+		return true
+	}
+	return float64(pf.removed) > float64(pf.added)*findMissingFilterMaxStaleFraction
+}
+
+// rebuildFindMissingFilter replaces the filter for a partition with one built
+// from a scan of the entries currently stored in it.
+func (p *PebbleCache) rebuildFindMissingFilter(ctx context.Context, pf *partitionFilter) error {
+	pf.mu.Lock()
+	// Leave room for the partition to grow before the filter has to be
+	// rebuilt again.
+	capacity := max(pf.minCapacity, uint(2*max(pf.added-pf.removed, 0)))
+	pf.building = bloom.NewWithEstimates(capacity, pf.falsePositiveRate)
+	addedBeforeScan := pf.added
+	pf.mu.Unlock()
+
+	scanned, err := p.scanPartitionIntoFilter(ctx, pf)
+
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	if err != nil {
+		pf.building = nil
+		return err
+	}
+	pf.filter = pf.building
+	pf.building = nil
+	pf.capacity = capacity
+	// Entries written during the scan may also have been scanned, so this
+	// overestimates how many entries the filter holds. That only means the
+	// next rebuild happens a bit early.
+	pf.added = scanned + (pf.added - addedBeforeScan)
+	pf.removed = 0
+	return nil
+}
+
+func (p *PebbleCache) scanPartitionIntoFilter(ctx context.Context, pf *partitionFilter) (int64, error) {
+	db, err := p.leaser.DB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	start, end := keys.Range([]byte(filestore.PartitionDirectoryPrefix + pf.partitionID + "/"))
+	iter, err := db.NewIter(&pebble.IterOptions{
+		LowerBound: start,
+		UpperBound: end,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+
+	md := &rfpb.FileMetadata{}
+	scanned := int64(0)
+	for iter.First(); iter.Valid(); iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		if bytes.HasPrefix(iter.Key(), SystemKeyPrefix) {
+			continue
+		}
+		md.Reset()
+		if err := proto.Unmarshal(iter.Value(), md); err != nil {
+			log.Warningf("Pebble Cache [%s]: skipping key %q with unparseable metadata: %s", p.name, iter.Key(), err)
+			continue
+		}
+		// The entry belongs to this filter because its key is in the
+		// partition's range, not because of the partition in its metadata:
+		// entries copied between partitions keep their original
+		// FileRecord. The filter key only uses the cache type and hash,
+		// which copies don't change.
+		k := findMissingFilterKey(md.GetFileRecord().GetIsolation().GetCacheType(), md.GetFileRecord().GetDigest().GetHash())
+		pf.mu.Lock()
+		pf.building.Add(k)
+		pf.mu.Unlock()
+		scanned++
+	}
+	return scanned, nil
+}
+
+// maintainFindMissingFilters builds each partition's filter on startup, and
+// rebuilds filters as they become stale.
+func (p *PebbleCache) maintainFindMissingFilters(quitChan chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-quitChan
+		cancel()
+	}()
+	for {
+		for _, pf := range p.findMissingFilters {
+			if !pf.needsRebuild() {
+				continue
+			}
+			start := p.clock.Now()
+			if err := p.rebuildFindMissingFilter(ctx, pf); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Warningf("Pebble Cache [%s]: could not build FindMissing filter for partition %q: %s", p.name, pf.partitionID, err)
+				continue
+			}
+			log.Infof("Pebble Cache [%s]: built FindMissing filter for partition %q in %s", p.name, pf.partitionID, p.clock.Since(start))
+		}
+		select {
+		case <-quitChan:
+			return
+		case <-p.clock.After(findMissingFilterCheckPeriod):
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package pebble_cache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/raft/filestore"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/raft/keys"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/pebble"
+	"github.com/buildbuddy-io/buildbuddy/server/util/compression"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	rfpb "github.com/buildbuddy-io/buildbuddy/proto/raft"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
+)
+
+// GCOptions configures a garbage collection run.
+type GCOptions struct {
+	// Unreachable CAS entries that were accessed more recently than this are
+	// not deleted, so that blobs uploaded ahead of their ActionResult
+	// survive.
+	MinAge time.Duration
+
+	// If set, unreachable entries are counted but not deleted.
+	DryRun bool
+}
+
+// GCResult summarizes a garbage collection run.
+type GCResult struct {
+	ActionResultsScanned int64
+	ReachableDigests     int64
+	CASEntriesScanned    int64
+	DeletedEntries       int64
+	DeletedBytes         int64
+
+	// Partitions that were not collected because some of the ActionResults
+	// or Trees stored in them could not be read (for example because they
+	// are encrypted), so reachability could not be determined.
+	SkippedPartitions []string
+}
+
+// gcState holds the reachable CAS digests of each partition.
+type gcState struct {
+	reachable map[string]map[string]struct{}
+	skipped   map[string]struct{}
+}
+
+func (s *gcState) mark(partitionID string, d *repb.Digest) {
+	if d.GetHash() == "" {
+		return
+	}
+	m, ok := s.reachable[partitionID]
+	if !ok {
+		m = make(map[string]struct{})
+		s.reachable[partitionID] = m
+	}
+	m[d.GetHash()] = struct{}{}
+}
+
+func (s *gcState) isReachable(partitionID, hash string) bool {
+	_, ok := s.reachable[partitionID][hash]
+	return ok
+}
+
+// CollectGarbage deletes CAS entries that are not referenced by any
+// ActionResult in the cache, either directly or through an output directory
+// Tree. It is intended for deployments that don't rely on LRU eviction, and
+// should only be run while the cache isn't serving traffic, because blobs
+// uploaded concurrently may not be referenced by an ActionResult yet.
+func (p *PebbleCache) CollectGarbage(ctx context.Context, opts *GCOptions) (*GCResult, error) {
+	db, err := p.leaser.DB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	state := &gcState{
+		reachable: make(map[string]map[string]struct{}),
+		skipped:   make(map[string]struct{}),
+	}
+	res := &GCResult{}
+
+	// Mark: walk all ActionResults and the Trees of their output
+	// directories.
+	err = p.scanEntries(ctx, db, func(key filestore.PebbleKey, version filestore.PebbleKeyVersion, md *rfpb.FileMetadata) error {
+		if key.CacheType() != rspb.CacheType_AC {
+			return nil
+		}
+		res.ActionResultsScanned++
+		partitionID := md.GetFileRecord().GetIsolation().GetPartitionId()
+		if err := p.markActionResult(ctx, db, state, md); err != nil {
+			if _, ok := state.skipped[partitionID]; !ok {
+				log.Warningf("Pebble Cache [%s]: not collecting garbage in partition %q: could not read ActionResult %q: %s", p.name, partitionID, key.Hash(), err)
+			}
+			state.skipped[partitionID] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Chunks of chunked entries are only referenced by their parent entry,
+	// so mark the chunks of all reachable entries before sweeping.
+	err = p.scanEntries(ctx, db, func(key filestore.PebbleKey, version filestore.PebbleKeyVersion, md *rfpb.FileMetadata) error {
+		partitionID := md.GetFileRecord().GetIsolation().GetPartitionId()
+		if key.CacheType() != rspb.CacheType_CAS || !state.isReachable(partitionID, key.Hash()) {
+			return nil
+		}
+		for _, chunk := range md.GetStorageMetadata().GetChunkedMetadata().GetResource() {
+			state.mark(partitionID, chunk.GetDigest())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range state.reachable {
+		res.ReachableDigests += int64(len(m))
+	}
+
+	// Sweep: delete unreachable CAS entries that are old enough.
+	err = p.scanEntries(ctx, db, func(key filestore.PebbleKey, version filestore.PebbleKeyVersion, md *rfpb.FileMetadata) error {
+		if key.CacheType() != rspb.CacheType_CAS {
+			return nil
+		}
+		res.CASEntriesScanned++
+		partitionID := md.GetFileRecord().GetIsolation().GetPartitionId()
+		if _, ok := state.skipped[partitionID]; ok || state.isReachable(partitionID, key.Hash()) {
+			return nil
+		}
+		if p.clock.Since(time.UnixMicro(md.GetLastAccessUsec())) < opts.MinAge {
+			return nil
+		}
+		if !opts.DryRun {
+			deleted, err := p.deleteIfUnmodified(ctx, db, key, version, md.GetLastAccessUsec())
+			if err != nil {
+				log.Warningf("Pebble Cache [%s]: could not delete unreachable entry %q: %s", p.name, key.Hash(), err)
+				return nil
+			}
+			if !deleted {
+				return nil
+			}
+		}
+		res.DeletedEntries++
+		res.DeletedBytes += md.GetStoredSizeBytes()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for partitionID := range state.skipped {
+		res.SkippedPartitions = append(res.SkippedPartitions, partitionID)
+	}
+	log.Infof("Pebble Cache [%s]: garbage collection (dry run: %t) scanned %d ActionResults and %d CAS entries, %d digests reachable, deleted %d entries (%d bytes)", p.name, opts.DryRun, res.ActionResultsScanned, res.CASEntriesScanned, res.ReachableDigests, res.DeletedEntries, res.DeletedBytes)
+	return res, nil
+}
+
+// scanEntries calls fn with the metadata of every entry in the cache.
+func (p *PebbleCache) scanEntries(ctx context.Context, db pebble.IPebbleDB, fn func(key filestore.PebbleKey, version filestore.PebbleKeyVersion, md *rfpb.FileMetadata) error) error {
+	iter, err := db.NewIter(&pebble.IterOptions{
+		LowerBound: keys.MinByte,
+		UpperBound: keys.MaxByte,
+	})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if bytes.HasPrefix(iter.Key(), SystemKeyPrefix) {
+			continue
+		}
+		var key filestore.PebbleKey
+		version, err := key.FromBytes(iter.Key())
+		if err != nil {
+			log.Warningf("Pebble Cache [%s]: skipping unparseable key %q: %s", p.name, iter.Key(), err)
+			continue
+		}
+		md := &rfpb.FileMetadata{}
+		if err := proto.Unmarshal(iter.Value(), md); err != nil {
+			log.Warningf("Pebble Cache [%s]: skipping key %q with unparseable metadata: %s", p.name, iter.Key(), err)
+			continue
+		}
+		if err := fn(key, version, md); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markActionResult marks all CAS digests referenced by the ActionResult
+// stored in the entry described by md.
+func (p *PebbleCache) markActionResult(ctx context.Context, db pebble.IPebbleDB, state *gcState, md *rfpb.FileMetadata) error {
+	buf, err := p.readEntryForGC(ctx, db, md)
+	if err != nil {
+		return err
+	}
+	ar := &repb.ActionResult{}
+	if err := proto.Unmarshal(buf, ar); err != nil {
+		return err
+	}
+	partitionID := md.GetFileRecord().GetIsolation().GetPartitionId()
+	for _, f := range ar.GetOutputFiles() {
+		state.mark(partitionID, f.GetDigest())
+	}
+	state.mark(partitionID, ar.GetStdoutDigest())
+	state.mark(partitionID, ar.GetStderrDigest())
+	for _, d := range ar.GetOutputDirectories() {
+		state.mark(partitionID, d.GetTreeDigest())
+		treeMD, err := p.lookupMetadataForGC(ctx, db, md.GetFileRecord(), rspb.CacheType_CAS, d.GetTreeDigest(), repb.Compressor_IDENTITY)
+		if err != nil {
+			return err
+		}
+		buf, err := p.readEntryForGC(ctx, db, treeMD)
+		if err != nil {
+			return err
+		}
+		tree := &repb.Tree{}
+		if err := proto.Unmarshal(buf, tree); err != nil {
+			return err
+		}
+		for _, dir := range append([]*repb.Directory{tree.GetRoot()}, tree.GetChildren()...) {
+			for _, f := range dir.GetFiles() {
+				state.mark(partitionID, f.GetDigest())
+			}
+		}
+	}
+	return nil
+}
+
+// lookupMetadataForGC returns the metadata of the entry with the given cache
+// type and digest, stored in the same partition as the entry described by
+// ref.
+func (p *PebbleCache) lookupMetadataForGC(ctx context.Context, db pebble.IPebbleDB, ref *rfpb.FileRecord, cacheType rspb.CacheType, d *repb.Digest, compressor repb.Compressor_Value) (*rfpb.FileMetadata, error) {
+	fileRecord := &rfpb.FileRecord{
+		Isolation: &rfpb.Isolation{
+			CacheType:          cacheType,
+			RemoteInstanceName: ref.GetIsolation().GetRemoteInstanceName(),
+			PartitionId:        ref.GetIsolation().GetPartitionId(),
+			GroupId:            ref.GetIsolation().GetGroupId(),
+		},
+		Digest:         d,
+		DigestFunction: ref.GetDigestFunction(),
+		Compressor:     compressor,
+	}
+	key, err := p.fileStorer.PebbleKey(fileRecord)
+	if err != nil {
+		return nil, err
+	}
+	md := &rfpb.FileMetadata{}
+	if err := p.lookupFileMetadata(ctx, db, key, md); err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+// readEntryForGC returns the uncompressed contents of the entry described by
+// md. Unlike the regular read path it doesn't require an authenticated
+// context, and so it can't read encrypted entries.
+func (p *PebbleCache) readEntryForGC(ctx context.Context, db pebble.IPebbleDB, md *rfpb.FileMetadata) ([]byte, error) {
+	if md.GetEncryptionMetadata() != nil {
+		return nil, status.UnimplementedError("encrypted entries can't be read during garbage collection")
+	}
+	if chunkedMD := md.GetStorageMetadata().GetChunkedMetadata(); chunkedMD != nil {
+		var buf []byte
+		for _, chunk := range chunkedMD.GetResource() {
+			chunkMD, err := p.lookupMetadataForGC(ctx, db, md.GetFileRecord(), chunk.GetCacheType(), chunk.GetDigest(), chunk.GetCompressor())
+			if err != nil {
+				return nil, err
+			}
+			b, err := p.readEntryForGC(ctx, db, chunkMD)
+			if err != nil {
+				return nil, err
+			}
+			buf = append(buf, b...)
+		}
+		return buf, nil
+	}
+	rc, err := p.fileStorer.NewReader(ctx, p.blobDir(), md.GetStorageMetadata(), 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	if md.GetFileRecord().GetCompressor() == repb.Compressor_ZSTD {
+		dr, err := compression.NewZstdDecompressingReader(rc)
+		if err != nil {
+			return nil, err
+		}
+		defer dr.Close()
+		rc = dr
+	}
+	return io.ReadAll(rc)
+}
+
+// deleteIfUnmodified deletes the entry with the given key, unless it was
+// accessed since it was scanned.
+func (p *PebbleCache) deleteIfUnmodified(ctx context.Context, db pebble.IPebbleDB, key filestore.PebbleKey, version filestore.PebbleKeyVersion, lastAccessUsec int64) (bool, error) {
+	unlockFn := p.locker.Lock(key.LockID())
+	defer unlockFn()
+
+	keyBytes, err := key.Bytes(version)
+	if err != nil {
+		return false, err
+	}
+	md := &rfpb.FileMetadata{}
+	if err := readFileMetadata(ctx, db, keyBytes, md); err != nil {
+		if status.IsNotFoundError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if md.GetLastAccessUsec() != lastAccessUsec {
+		return false, nil
+	}
+	if err := p.deleteFileAndMetadata(ctx, key, version, md); err != nil {
+		return false, err
+	}
+	return true, nil
+}
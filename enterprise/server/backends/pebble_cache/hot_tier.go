@@ -0,0 +1,263 @@
+package pebble_cache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/raft/filestore"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/pebble"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/lru"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/prometheus/client_golang/prometheus"
+
+	rfpb "github.com/buildbuddy-io/buildbuddy/proto/raft"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
+)
+
+// hotTierEntry is the decompressed, decrypted contents of a single cache
+// entry, along with the atime that pebble last recorded for it.
+type hotTierEntry struct {
+	data           []byte
+	lastAccessUsec int64
+}
+
+// hotTier is an in-memory LRU of small entries that sits in front of the
+// on-disk store, so that repeatedly read ActionResults and small CAS blobs
+// can be served without reading from disk.
+//
+// Entries are only added after a successful read from pebble and are removed
+// whenever the underlying entry is overwritten, deleted, or evicted, so the
+// hot tier never serves data that pebble would not.
+type hotTier struct {
+	cacheName         string
+	maxEntrySizeBytes int64
+	clock             func() time.Time
+
+	mu  sync.Mutex // PROTECTS(lru)
+	lru *lru.LRU[*hotTierEntry]
+}
+
+// newHotTier returns a hot tier holding up to maxSizeBytes of data, or nil if
+// maxSizeBytes is not positive. All hotTier methods are safe to call on a nil
+// hotTier.
+func newHotTier(cacheName string, maxSizeBytes, maxEntrySizeBytes int64, clock func() time.Time) (*hotTier, error) {
+	if maxSizeBytes <= 0 {
+		return nil, nil
+	}
+	l, err := lru.NewLRU[*hotTierEntry](&lru.Config[*hotTierEntry]{
+		MaxSize: maxSizeBytes,
+		SizeFn:  func(e *hotTierEntry) int64 { return int64(len(e.data)) },
+		OnEvict: func(e *hotTierEntry, reason lru.EvictionReason) {
+			metrics.PebbleCacheHotTierEvictionCount.With(prometheus.Labels{
+				metrics.CacheNameLabel:                   cacheName,
+				metrics.PebbleCacheHotTierEvictionReason: string(reason),
+			}).Inc()
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &hotTier{
+		cacheName:         cacheName,
+		maxEntrySizeBytes: maxEntrySizeBytes,
+		clock:             clock,
+		lru:               l,
+	}, nil
+}
+
+func hotTierKey(key filestore.PebbleKey) (string, error) {
+	// Version5 keys are derived from every field that identifies an entry,
+	// so they're stable regardless of which version the entry is stored at.
+	keyBytes, err := key.Bytes(filestore.Version5)
+	if err != nil {
+		return "", err
+	}
+	return string(keyBytes), nil
+}
+
+// eligible returns whether reads of r may be served from the hot tier.
+func (h *hotTier) eligible(r *rspb.ResourceName) bool {
+	if h == nil {
+		return false
+	}
+	if r.GetCompressor() != repb.Compressor_IDENTITY {
+		return false
+	}
+	switch r.GetCacheType() {
+	case rspb.CacheType_AC, rspb.CacheType_CAS:
+		return r.GetDigest().GetSizeBytes() <= h.maxEntrySizeBytes
+	default:
+		return false
+	}
+}
+
+func (h *hotTier) recordLookup(cacheType rspb.CacheType, hit bool) {
+	hitStatus := metrics.MissStatusLabel
+	if hit {
+		hitStatus = metrics.HitStatusLabel
+	}
+	metrics.PebbleCacheHotTierRequestCount.With(prometheus.Labels{
+		metrics.CacheNameLabel:     h.cacheName,
+		metrics.CacheTypeLabel:     cacheType.String(),
+		metrics.CacheHitMissStatus: hitStatus,
+	}).Inc()
+}
+
+func (h *hotTier) updateSizeMetric() {
+	metrics.PebbleCacheHotTierSizeBytes.With(prometheus.Labels{
+		metrics.CacheNameLabel: h.cacheName,
+	}).Set(float64(h.lru.Size()))
+}
+
+// get returns the cached contents of key, if present. The returned slice
+// must not be modified. If the entry's atime is older than atimeThreshold,
+// staleAtimeUsec is set to the last recorded atime so that the caller can
+// forward an atime update to pebble, and the recorded atime is bumped so that
+// subsequent hits don't send duplicate updates.
+func (h *hotTier) get(key filestore.PebbleKey, atimeThreshold time.Duration) (data []byte, staleAtimeUsec int64, ok bool) {
+	if h == nil {
+		return nil, 0, false
+	}
+	k, err := hotTierKey(key)
+	if err != nil {
+		return nil, 0, false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e, ok := h.lru.Get(k)
+	if !ok {
+		return nil, 0, false
+	}
+	now := h.clock()
+	if now.Sub(time.UnixMicro(e.lastAccessUsec)) > atimeThreshold {
+		staleAtimeUsec = e.lastAccessUsec
+		e.lastAccessUsec = now.UnixMicro()
+	}
+	return e.data, staleAtimeUsec, true
+}
+
+func (h *hotTier) add(key filestore.PebbleKey, data []byte, lastAccessUsec int64) {
+	if h == nil || int64(len(data)) > h.maxEntrySizeBytes {
+		return
+	}
+	k, err := hotTierKey(key)
+	if err != nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lru.Add(k, &hotTierEntry{data: data, lastAccessUsec: lastAccessUsec})
+	h.updateSizeMetric()
+}
+
+// remove drops key from the hot tier. It must be called whenever the entry
+// stored under key is overwritten or deleted from pebble.
+func (h *hotTier) remove(key filestore.PebbleKey) {
+	if h == nil {
+		return
+	}
+	k, err := hotTierKey(key)
+	if err != nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.lru.Remove(k) {
+		h.updateSizeMetric()
+	}
+}
+
+// getFromHotTier returns the contents of r, serving them from the hot tier
+// if possible and populating the hot tier on a miss. It must only be called
+// for resources that are eligible for the hot tier.
+func (p *PebbleCache) getFromHotTier(ctx context.Context, db pebble.IPebbleDB, r *rspb.ResourceName) ([]byte, error) {
+	fileRecord, err := p.makeFileRecord(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	// Never hold plaintext copies of encrypted entries in memory; they would
+	// otherwise outlive a revoked encryption key.
+	if fileRecord.GetEncryption() != nil {
+		return p.readAll(ctx, db, r)
+	}
+	key, err := p.fileStorer.PebbleKey(fileRecord)
+	if err != nil {
+		return nil, err
+	}
+
+	if data, staleAtimeUsec, ok := p.hotTier.get(key, p.atimeUpdateThreshold); ok {
+		p.hotTier.recordLookup(r.GetCacheType(), true /*=hit*/)
+		if staleAtimeUsec != 0 {
+			// Keep the on-disk atime fresh so that pebble doesn't evict
+			// entries that are only being read from memory.
+			p.sendAtimeUpdate(key, staleAtimeUsec)
+		}
+		return slices.Clone(data), nil
+	}
+	p.hotTier.recordLookup(r.GetCacheType(), false /*=hit*/)
+
+	before, err := p.lookupHotTierMetadata(ctx, db, key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := p.readAll(ctx, db, r)
+	if err != nil {
+		return nil, err
+	}
+	if before.GetEncryptionMetadata() != nil {
+		return data, nil
+	}
+
+	// Only populate the hot tier if the entry wasn't overwritten while it
+	// was being read. Writers remove the key from the hot tier while
+	// holding the write lock, so holding the read lock here guarantees that
+	// a stale value is never added after a newer one was written.
+	unlockFn := p.locker.RLock(key.LockID())
+	defer unlockFn()
+	after := &rfpb.FileMetadata{}
+	if err := p.lookupFileMetadata(ctx, db, key, after); err != nil {
+		return data, nil
+	}
+	if after.GetLastModifyUsec() != before.GetLastModifyUsec() || !proto.Equal(after.GetStorageMetadata(), before.GetStorageMetadata()) {
+		log.CtxDebugf(ctx, "[%s] Not adding %q to hot tier: modified during read", p.name, key.String())
+		return data, nil
+	}
+	// The read above already sent an atime update if one was due.
+	lastAccessUsec := after.GetLastAccessUsec()
+	if olderThanThreshold(time.UnixMicro(lastAccessUsec), p.atimeUpdateThreshold) {
+		lastAccessUsec = p.clock.Now().UnixMicro()
+	}
+	p.hotTier.add(key, slices.Clone(data), lastAccessUsec)
+	return data, nil
+}
+
+func (p *PebbleCache) lookupHotTierMetadata(ctx context.Context, db pebble.IPebbleDB, key filestore.PebbleKey) (*rfpb.FileMetadata, error) {
+	unlockFn := p.locker.RLock(key.LockID())
+	defer unlockFn()
+	md := &rfpb.FileMetadata{}
+	if err := p.lookupFileMetadata(ctx, db, key, md); err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+// readAll returns the full contents of r from pebble, bypassing the hot tier.
+func (p *PebbleCache) readAll(ctx context.Context, db pebble.IPebbleDB, r *rspb.ResourceName) ([]byte, error) {
+	rc, err := p.readerWithMigration(ctx, db, r, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var buffer bytes.Buffer
+	if _, err := io.Copy(&buffer, rc); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
@@ -11,6 +11,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/raft/filestore"
@@ -22,9 +23,11 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/metrics"
 	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
 	"github.com/buildbuddy-io/buildbuddy/server/util/alert"
 	"github.com/buildbuddy-io/buildbuddy/server/util/approxlru"
 	"github.com/buildbuddy-io/buildbuddy/server/util/bytebufferpool"
+	"github.com/buildbuddy-io/buildbuddy/server/util/claims"
 	"github.com/buildbuddy-io/buildbuddy/server/util/compression"
 	"github.com/buildbuddy-io/buildbuddy/server/util/disk"
 	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
@@ -73,6 +76,7 @@ var (
 	samplesPerBatch           = flag.Int("cache.pebble.samples_per_batch", DefaultSamplesPerBatch, "How many keys we read forward every time we get a random key.")
 	samplerIterRefreshPeriod  = flag.Duration("cache.pebble.sampler_iter_refresh_peroid", DefaultSamplerIterRefreshPeriod, "How often we refresh iterator in sampler")
 	minEvictionAgeFlag        = flag.Duration("cache.pebble.min_eviction_age", DefaultMinEvictionAge, "Don't evict anything unless it's been idle for at least this long")
+	retentionPoliciesFlag     = flag.Slice("cache.pebble.retention_policies", []RetentionPolicy{}, "Overrides of cache.pebble.min_eviction_age for entries whose remote instance name matches a prefix. The longest matching prefix wins.")
 	forceCompaction           = flag.Bool("cache.pebble.force_compaction", false, "If set, compact the DB when it's created")
 	forceCalculateMetadata    = flag.Bool("cache.pebble.force_calculate_metadata", false, "If set, partition size and counts will be calculated even if cached information is available.")
 	samplesPerEviction        = flag.Int("cache.pebble.samples_per_eviction", 20, "How many records to sample on each eviction")
@@ -86,11 +90,25 @@ var (
 	activeKeyVersion  = flag.Int64("cache.pebble.active_key_version", int64(filestore.UnspecifiedKeyVersion), "The key version new data will be written with. If negative, will write to the highest existing version in the database, or the highest known version if a new database is created.")
 	migrationQPSLimit = flag.Int("cache.pebble.migration_qps_limit", 50, "QPS limit for data version migration")
 
+	// Encryption related flags
+	migrateUnencryptedEntries = flag.Bool("cache.pebble.migrate_unencrypted_entries", false, "If set, entries written before a group enabled encryption are re-written in encrypted form when they are read, instead of becoming unreadable.")
+
 	// Compression related flags
 	minBytesAutoZstdCompression = flag.Int64("cache.pebble.min_bytes_auto_zstd_compression", 100, "Blobs larger than this will be zstd compressed before written to disk.")
 
 	// Chunking related flags
 	averageChunkSizeBytes = flag.Int("cache.pebble.average_chunk_size_bytes", 0, "Average size of chunks that's stored in the cache. Disabled if 0.")
+	minBytesChunked       = flag.Int64("cache.pebble.min_bytes_chunked", 0, "When chunking is enabled, only blobs at least this large are stored as content-defined chunks. Blobs smaller than cache.pebble.average_chunk_size_bytes are never chunked, so values below it have no effect.")
+
+	hotTierMaxSizeBytes      = flag.Int64("cache.pebble.hot_tier_max_size_bytes", 0, "If positive, keep up to this many bytes of recently read ActionResults and small CAS blobs in memory in front of pebble. Disabled if 0.")
+	hotTierMaxEntrySizeBytes = flag.Int64("cache.pebble.hot_tier_max_entry_size_bytes", DefaultHotTierMaxEntrySizeBytes, "Only entries up to this size are eligible for the in-memory hot tier.")
+
+	findMissingFilterExpectedEntries   = flag.Int64("cache.pebble.find_missing_filter_expected_entries", 0, "If positive, keep a bloom filter of the entries in each partition, sized for at least this many entries, so that FindMissing can report definitely missing entries without reading from pebble. Disabled if 0.")
+	findMissingFilterFalsePositiveRate = flag.Float64("cache.pebble.find_missing_filter_false_positive_rate", DefaultFindMissingFilterFalsePositiveRate, "Target false positive rate of the FindMissing bloom filters. Lower rates use more memory.")
+
+	recordACProvenance = flag.Bool("cache.pebble.record_ac_provenance", false, "If true, record which invocation, group and action first wrote each AC entry, so that it can be looked up with the GetCacheEntryProvenance API.")
+
+	partitionUsageReportInterval = flag.Duration("cache.pebble.partition_usage_report_interval", 15*time.Minute, "How often to report the size of partitions mapped to a single group to the usage tracker. Disabled if 0.")
 )
 
 var (
@@ -127,6 +145,7 @@ const (
 	partitionDirectoryPrefix     = "PT"
 	partitionMetadataFlushPeriod = 5 * time.Second
 	metricsRefreshPeriod         = 30 * time.Second
+	writeLoadSamplePeriod        = 1 * time.Second
 
 	// CompressorBufSizeBytes is the buffer size we use for each chunk when compressing data
 	// It should be relatively large to get a good compression ratio bc each chunk is compressed independently
@@ -136,6 +155,10 @@ const (
 	DefaultBlockCacheSizeBytes    = int64(1000 * megabyte)
 	DefaultMaxInlineFileSizeBytes = int64(1024)
 
+	DefaultHotTierMaxEntrySizeBytes = int64(64 * 1024)
+
+	DefaultFindMissingFilterFalsePositiveRate = 0.01
+
 	// When a parition's size is lower than the SamplerSleepThreshold, the sampler thread
 	// will sleep for SamplerSleepDuration
 	SamplerSleepThreshold = float64(0.2)
@@ -165,10 +188,12 @@ type Options struct {
 	BlockCacheSizeBytes    int64
 	MaxInlineFileSizeBytes int64
 	AverageChunkSizeBytes  int
+	MinBytesChunked        int64
 
 	AtimeUpdateThreshold     *time.Duration
 	AtimeBufferSize          *int
 	MinEvictionAge           *time.Duration
+	RetentionPolicies        []RetentionPolicy
 	SampleBufferSize         *int
 	SamplesPerBatch          *int
 	SamplerIterRefreshPeriod *time.Duration
@@ -179,6 +204,21 @@ type Options struct {
 
 	ActiveKeyVersion *int64
 
+	MigrateUnencryptedEntries bool
+
+	// If positive, recently read entries up to HotTierMaxEntrySizeBytes are
+	// kept in an in-memory LRU of this size in front of pebble.
+	HotTierMaxSizeBytes      int64
+	HotTierMaxEntrySizeBytes int64
+
+	// If positive, FindMissing consults a per-partition bloom filter sized
+	// for at least this many entries before looking up entries in pebble.
+	FindMissingFilterExpectedEntries   int64
+	FindMissingFilterFalsePositiveRate float64
+
+	// If true, the writer of each new AC entry is recorded alongside it.
+	RecordACProvenance bool
+
 	Clock clockwork.Clock
 
 	ClearCacheOnStartup bool
@@ -188,12 +228,23 @@ type sizeUpdate struct {
 	partID    string
 	cacheType rspb.CacheType
 	delta     int64
+
+	// If set, this is not a size update; the channel is closed once all
+	// previously sent updates have been applied.
+	applied chan struct{}
 }
 
 type accessTimeUpdate struct {
 	key filestore.PebbleKey
 }
 
+// RetentionPolicy overrides the minimum eviction age for entries written
+// under a remote instance name prefix.
+type RetentionPolicy struct {
+	InstanceNamePrefix string        `yaml:"instance_name_prefix" json:"instance_name_prefix" usage:"The remote instance name prefix this policy applies to."`
+	MinEvictionAge     time.Duration `yaml:"min_eviction_age" json:"min_eviction_age" usage:"Don't evict matching entries unless they've been idle for at least this long."`
+}
+
 // PebbleCache implements the cache interface by storing metadata in a pebble
 // database and storing cache entry contents on disk.
 type PebbleCache struct {
@@ -206,8 +257,10 @@ type PebbleCache struct {
 	blockCacheSizeBytes    int64
 	maxInlineFileSizeBytes int64
 	averageChunkSizeBytes  int
+	minBytesChunked        int64
 
-	includeMetadataSize bool
+	includeMetadataSize       bool
+	migrateUnencryptedEntries bool
 
 	atimeUpdateThreshold time.Duration
 	atimeBufferSize      int
@@ -239,11 +292,25 @@ type PebbleCache struct {
 
 	fileStorer filestore.Store
 	bufferPool *bytebufferpool.VariableSizePool
+	hotTier    *hotTier
+
+	// Nil if FindMissing filtering is disabled.
+	findMissingFilters findMissingFilters
+
+	recordACProvenance bool
 
 	minBytesAutoZstdCompression int64
 
 	oldMetrics       pebble.Metrics
 	metricsCollector *pebble.MetricsCollector
+
+	// blobBytesWritten counts the bytes written to files outside of pebble.
+	blobBytesWritten atomic.Uint64
+
+	writeLoadMu         sync.Mutex // PROTECTS(writeLoad, writeLoadSampleTime, writeLoadBytesTotal)
+	writeLoad           interfaces.CacheWriteLoad
+	writeLoadSampleTime time.Time
+	writeLoadBytesTotal uint64
 }
 
 type keyMigrator interface {
@@ -318,9 +385,18 @@ func Register(env *real_environment.RealEnv) error {
 		SamplesPerBatch:             samplesPerBatch,
 		SamplerIterRefreshPeriod:    samplerIterRefreshPeriod,
 		MinEvictionAge:              minEvictionAgeFlag,
+		RetentionPolicies:           *retentionPoliciesFlag,
 		AverageChunkSizeBytes:       *averageChunkSizeBytes,
+		MinBytesChunked:             *minBytesChunked,
 		IncludeMetadataSize:         *includeMetadataSize,
 		ActiveKeyVersion:            activeKeyVersion,
+		MigrateUnencryptedEntries:   *migrateUnencryptedEntries,
+		HotTierMaxSizeBytes:         *hotTierMaxSizeBytes,
+		HotTierMaxEntrySizeBytes:    *hotTierMaxEntrySizeBytes,
+
+		FindMissingFilterExpectedEntries:   *findMissingFilterExpectedEntries,
+		FindMissingFilterFalsePositiveRate: *findMissingFilterFalsePositiveRate,
+		RecordACProvenance:                 *recordACProvenance,
 	}
 	c, err := NewPebbleCache(env, opts)
 	if err != nil {
@@ -415,6 +491,12 @@ func SetOptionDefaults(opts *Options) {
 	if opts.DeleteBufferSize == nil {
 		opts.DeleteBufferSize = &DefaultDeleteBufferSize
 	}
+	if opts.HotTierMaxEntrySizeBytes == 0 {
+		opts.HotTierMaxEntrySizeBytes = DefaultHotTierMaxEntrySizeBytes
+	}
+	if opts.FindMissingFilterFalsePositiveRate == 0 {
+		opts.FindMissingFilterFalsePositiveRate = DefaultFindMissingFilterFalsePositiveRate
+	}
 }
 
 func ensureDefaultPartitionExists(opts *Options) {
@@ -510,6 +592,10 @@ func NewPebbleCache(env environment.Env, opts *Options) (*PebbleCache, error) {
 	if clock == nil {
 		clock = clockwork.NewRealClock()
 	}
+	ht, err := newHotTier(opts.Name, opts.HotTierMaxSizeBytes, opts.HotTierMaxEntrySizeBytes, clock.Now)
+	if err != nil {
+		return nil, err
+	}
 	pc := &PebbleCache{
 		name:                        opts.Name,
 		rootDirectory:               opts.RootDirectory,
@@ -519,6 +605,7 @@ func NewPebbleCache(env environment.Env, opts *Options) (*PebbleCache, error) {
 		blockCacheSizeBytes:         opts.BlockCacheSizeBytes,
 		maxInlineFileSizeBytes:      opts.MaxInlineFileSizeBytes,
 		averageChunkSizeBytes:       opts.AverageChunkSizeBytes,
+		minBytesChunked:             opts.MinBytesChunked,
 		atimeUpdateThreshold:        *opts.AtimeUpdateThreshold,
 		atimeBufferSize:             *opts.AtimeBufferSize,
 		minEvictionAge:              *opts.MinEvictionAge,
@@ -538,9 +625,13 @@ func NewPebbleCache(env environment.Env, opts *Options) (*PebbleCache, error) {
 		evictors:                    make([]*partitionEvictor, len(opts.Partitions)),
 		fileStorer:                  filestore.New(),
 		bufferPool:                  bytebufferpool.VariableSize(CompressorBufSizeBytes),
+		hotTier:                     ht,
+		findMissingFilters:          newFindMissingFilters(opts.Name, opts.Partitions, opts.FindMissingFilterExpectedEntries, opts.FindMissingFilterFalsePositiveRate),
 		minBytesAutoZstdCompression: opts.MinBytesAutoZstdCompression,
 		metricsCollector:            mc,
 		includeMetadataSize:         opts.IncludeMetadataSize,
+		migrateUnencryptedEntries:   opts.MigrateUnencryptedEntries,
+		recordACProvenance:          opts.RecordACProvenance,
 	}
 
 	versionMetadata, err := pc.DatabaseVersionMetadata()
@@ -640,10 +731,12 @@ func NewPebbleCache(env environment.Env, opts *Options) (*PebbleCache, error) {
 			if err := disk.EnsureDirectoryExists(blobDir); err != nil {
 				return err
 			}
-			pe, err := newPartitionEvictor(env.GetServerContext(), part, pc.fileStorer, blobDir, pc.leaser, pc.locker, pc, clock, *opts.MinEvictionAge, opts.Name, opts.IncludeMetadataSize, *opts.SampleBufferSize, *opts.SamplesPerBatch, *opts.SamplerIterRefreshPeriod, *opts.DeleteBufferSize, *opts.NumDeleteWorkers)
+			pe, err := newPartitionEvictor(env.GetServerContext(), part, pc.fileStorer, blobDir, pc.leaser, pc.locker, pc, clock, *opts.MinEvictionAge, opts.RetentionPolicies, opts.Name, opts.IncludeMetadataSize, *opts.SampleBufferSize, *opts.SamplesPerBatch, *opts.SamplerIterRefreshPeriod, *opts.DeleteBufferSize, *opts.NumDeleteWorkers)
 			if err != nil {
 				return err
 			}
+			pe.hotTier = pc.hotTier
+			pe.findMissingFilters = pc.findMissingFilters
 			peMu.Lock()
 			pc.evictors[i] = pe
 			peMu.Unlock()
@@ -977,6 +1070,10 @@ func (p *PebbleCache) processSizeUpdates() {
 	p.statusMu.Unlock()
 
 	for edit := range p.edits {
+		if edit.applied != nil {
+			close(edit.applied)
+			continue
+		}
 		e := evictors[edit.partID]
 		e.updateSize(edit.cacheType, edit.delta)
 	}
@@ -1368,6 +1465,84 @@ func (p *PebbleCache) Statusz(ctx context.Context) string {
 	return buf
 }
 
+// checkPartitionQuota returns a ResourceExhausted error if the partition has a
+// hard quota and is already at its maximum size, or would exceed it after
+// writing another writeSizeBytes.
+func (p *PebbleCache) checkPartitionQuota(partID string, writeSizeBytes int64) error {
+	p.statusMu.Lock()
+	evictors := p.evictors
+	p.statusMu.Unlock()
+
+	for _, e := range evictors {
+		if e.part.ID != partID || !e.part.HardQuota {
+			continue
+		}
+		sizeBytes, _, _ := e.Counts()
+		if sizeBytes >= e.part.MaxSizeBytes || sizeBytes+writeSizeBytes > e.part.MaxSizeBytes {
+			return status.ResourceExhaustedErrorf("cache partition %q is over its quota of %d bytes", partID, e.part.MaxSizeBytes)
+		}
+	}
+	return nil
+}
+
+// partitionGroups returns a map from partition ID to the ID of the group that
+// owns it, for partitions that are only mapped to a single group.
+func (p *PebbleCache) partitionGroups() map[string]string {
+	groupsByPartition := make(map[string]map[string]struct{})
+	for _, pm := range p.partitionMappings {
+		if groupsByPartition[pm.PartitionID] == nil {
+			groupsByPartition[pm.PartitionID] = make(map[string]struct{})
+		}
+		groupsByPartition[pm.PartitionID][pm.GroupID] = struct{}{}
+	}
+	owners := make(map[string]string)
+	for partID, groups := range groupsByPartition {
+		if len(groups) != 1 || partID == DefaultPartitionID {
+			continue
+		}
+		for groupID := range groups {
+			owners[partID] = groupID
+		}
+	}
+	return owners
+}
+
+// reportPartitionUsage records the storage used by each partition owned by a
+// single group over the given interval with the usage tracker.
+func (p *PebbleCache) reportPartitionUsage(ut interfaces.UsageTracker, interval time.Duration) {
+	owners := p.partitionGroups()
+
+	p.statusMu.Lock()
+	evictors := p.evictors
+	p.statusMu.Unlock()
+
+	for _, e := range evictors {
+		groupID, ok := owners[e.part.ID]
+		if !ok {
+			continue
+		}
+		sizeBytes, _, _ := e.Counts()
+		counts := &tables.UsageCounts{
+			CacheStorageGBUsec: int64(float64(sizeBytes) / 1e9 * float64(interval.Microseconds())),
+		}
+		ctx := claims.AuthContextFromClaims(p.env.GetServerContext(), &claims.Claims{GroupID: groupID}, nil)
+		if err := ut.Increment(ctx, &tables.UsageLabels{}, counts); err != nil {
+			log.Warningf("Pebble Cache [%s]: could not report usage for partition %q: %s", p.name, e.part.ID, err)
+		}
+	}
+}
+
+func (p *PebbleCache) periodicReportPartitionUsage(quitChan chan struct{}, ut interfaces.UsageTracker, interval time.Duration) {
+	for {
+		select {
+		case <-quitChan:
+			return
+		case <-p.clock.After(interval):
+			p.reportPartitionUsage(ut, interval)
+		}
+	}
+}
+
 func (p *PebbleCache) userGroupID(ctx context.Context) string {
 	user, err := p.env.GetAuthenticator().AuthenticatedUser(ctx)
 	if err != nil {
@@ -1577,6 +1752,9 @@ func (p *PebbleCache) findMissing(ctx context.Context, db pebble.IPebbleDB, r *r
 	if err != nil {
 		return err
 	}
+	if p.findMissingFilters.definitelyMissing(fileRecord) {
+		return status.NotFoundErrorf("record %q not found", r.GetDigest().GetHash())
+	}
 	key, err := p.fileStorer.PebbleKey(fileRecord)
 	if err != nil {
 		return err
@@ -1604,6 +1782,14 @@ func (p *PebbleCache) findMissing(ctx context.Context, db pebble.IPebbleDB, r *r
 }
 
 func (p *PebbleCache) Get(ctx context.Context, r *rspb.ResourceName) ([]byte, error) {
+	if p.hotTier.eligible(r) {
+		db, err := p.leaser.DB()
+		if err != nil {
+			return nil, err
+		}
+		defer db.Close()
+		return p.getFromHotTier(ctx, db, r)
+	}
 	rc, err := p.Reader(ctx, r, 0, 0)
 	if err != nil {
 		return nil, err
@@ -1625,6 +1811,17 @@ func (p *PebbleCache) GetMulti(ctx context.Context, resources []*rspb.ResourceNa
 
 	buf := &bytes.Buffer{}
 	for _, r := range resources {
+		if p.hotTier.eligible(r) {
+			data, err := p.getFromHotTier(ctx, db, r)
+			if err != nil {
+				if status.IsNotFoundError(err) || os.IsNotExist(err) {
+					continue
+				}
+				return nil, err
+			}
+			foundMap[r.GetDigest()] = data
+			continue
+		}
 		rc, err := p.reader(ctx, db, r, 0, 0)
 		if err != nil {
 			if status.IsNotFoundError(err) || os.IsNotExist(err) {
@@ -1662,6 +1859,19 @@ func (p *PebbleCache) Set(ctx context.Context, r *rspb.ResourceName, data []byte
 }
 
 func (p *PebbleCache) SetMulti(ctx context.Context, kvs map[*rspb.ResourceName][]byte) error {
+	// Check partition quotas against the size of the whole batch up front,
+	// since size updates are applied asynchronously and so individual writes
+	// don't see the size of earlier writes in the batch.
+	batchSizeBytes := make(map[string]int64)
+	for r, data := range kvs {
+		_, partID := p.lookupGroupAndPartitionID(ctx, r.GetInstanceName())
+		batchSizeBytes[partID] += int64(len(data))
+	}
+	for partID, sizeBytes := range batchSizeBytes {
+		if err := p.checkPartitionQuota(partID, sizeBytes); err != nil {
+			return err
+		}
+	}
 	for r, data := range kvs {
 		if err := p.Set(ctx, r, data); err != nil {
 			return err
@@ -1739,6 +1949,11 @@ func (p *PebbleCache) deleteMetadataOnly(ctx context.Context, key filestore.Pebb
 	if err := db.Delete(fileMetadataKey, pebble.NoSync); err != nil {
 		return err
 	}
+	p.hotTier.remove(key)
+	p.findMissingFilters.recordRemoval(fileMetadata.GetFileRecord().GetIsolation().GetPartitionId())
+	if err := deleteProvenance(db, key); err != nil {
+		return err
+	}
 	p.sendSizeUpdate(fileMetadata.GetFileRecord().GetIsolation().GetPartitionId(), key.CacheType(), deleteSizeOp, fileMetadata, len(fileMetadataKey))
 	return nil
 }
@@ -1761,9 +1976,14 @@ func (p *PebbleCache) deleteFileAndMetadata(ctx context.Context, key filestore.P
 	if err := db.Delete(keyBytes, pebble.NoSync); err != nil {
 		return err
 	}
+	p.hotTier.remove(key)
+	if err := deleteProvenance(db, key); err != nil {
+		return err
+	}
 
 	storageMetadata := md.GetStorageMetadata()
 	partitionID := md.GetFileRecord().GetIsolation().GetPartitionId()
+	p.findMissingFilters.recordRemoval(partitionID)
 	switch {
 	case storageMetadata.GetFileMetadata() != nil:
 		fp := p.fileStorer.FilePath(p.blobDir(), storageMetadata.GetFileMetadata())
@@ -1838,7 +2058,15 @@ func (p *PebbleCache) Reader(ctx context.Context, r *rspb.ResourceName, uncompre
 	}
 	defer db.Close()
 
-	rc, err := p.reader(ctx, db, r, uncompressedOffset, limit)
+	if uncompressedOffset == 0 && limit == 0 && p.hotTier.eligible(r) {
+		data, err := p.getFromHotTier(ctx, db, r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+
+	rc, err := p.readerWithMigration(ctx, db, r, uncompressedOffset, limit)
 	if err != nil {
 		return nil, err
 	}
@@ -1852,6 +2080,98 @@ func (p *PebbleCache) Reader(ctx context.Context, r *rspb.ResourceName, uncompre
 	return pebble.ReadCloserWithFunc(rc, db.Close), nil
 }
 
+// readerWithMigration returns a reader for r, first migrating an unencrypted
+// copy of r if one exists and migration is enabled.
+func (p *PebbleCache) readerWithMigration(ctx context.Context, db pebble.IPebbleDB, r *rspb.ResourceName, uncompressedOffset, limit int64) (io.ReadCloser, error) {
+	rc, err := p.reader(ctx, db, r, uncompressedOffset, limit)
+	if status.IsNotFoundError(err) && p.migrateUnencryptedEntries {
+		migrated, migrateErr := p.migrateUnencryptedEntry(ctx, db, r)
+		if migrateErr != nil {
+			log.CtxWarningf(ctx, "Could not migrate unencrypted entry for %q: %s", r.GetDigest().GetHash(), migrateErr)
+		}
+		if migrated {
+			rc, err = p.reader(ctx, db, r, uncompressedOffset, limit)
+		}
+	}
+	return rc, err
+}
+
+// migrateUnencryptedEntry looks for an unencrypted copy of r that was written
+// before the group enabled encryption. If one is found, it is re-written using
+// the group's active encryption key. Unencrypted AC entries are then deleted,
+// since they're only visible to the group, but unencrypted CAS entries are
+// shared with other groups and so are left to be evicted normally.
+// Returns true if an entry was migrated.
+func (p *PebbleCache) migrateUnencryptedEntry(ctx context.Context, db pebble.IPebbleDB, r *rspb.ResourceName) (bool, error) {
+	encryptionEnabled, err := p.encryptionEnabled(ctx)
+	if err != nil || !encryptionEnabled {
+		return false, err
+	}
+	fileRecord, err := p.makeFileRecord(ctx, r)
+	if err != nil {
+		return false, err
+	}
+	fileRecord.Encryption = nil
+	key, err := p.fileStorer.PebbleKey(fileRecord)
+	if err != nil {
+		return false, err
+	}
+
+	unlockFn := p.locker.RLock(key.LockID())
+	fileMetadata := &rfpb.FileMetadata{}
+	version, err := p.lookupFileMetadataAndVersion(ctx, db, key, fileMetadata)
+	unlockFn()
+	if status.IsNotFoundError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if fileMetadata.GetEncryptionMetadata() != nil {
+		return false, nil
+	}
+	md := fileMetadata.GetStorageMetadata()
+	if md.GetChunkedMetadata() != nil {
+		return false, status.UnimplementedError("migration of chunked entries is not supported")
+	}
+
+	// Copy the stored bytes as-is; the writer will take care of encrypting
+	// them using the active key.
+	rc, err := p.fileStorer.NewReader(ctx, p.blobDir(), md, 0, 0)
+	if err != nil {
+		return false, err
+	}
+	defer rc.Close()
+	wr := &rspb.ResourceName{
+		Digest:         r.GetDigest(),
+		DigestFunction: r.GetDigestFunction(),
+		InstanceName:   r.GetInstanceName(),
+		Compressor:     fileMetadata.GetFileRecord().GetCompressor(),
+		CacheType:      r.GetCacheType(),
+	}
+	wc, err := p.Writer(ctx, wr)
+	if err != nil {
+		return false, err
+	}
+	defer wc.Close()
+	if _, err := io.Copy(wc, rc); err != nil {
+		return false, err
+	}
+	if err := wc.Commit(); err != nil {
+		return false, err
+	}
+
+	if r.GetCacheType() != rspb.CacheType_AC {
+		return true, nil
+	}
+	unlockFn = p.locker.Lock(key.LockID())
+	defer unlockFn()
+	if err := p.deleteFileAndMetadata(ctx, key, version, fileMetadata); err != nil {
+		log.CtxWarningf(ctx, "Could not delete unencrypted entry for %q after migration: %s", r.GetDigest().GetHash(), err)
+	}
+	return true, nil
+}
+
 // A writer that will chunk bytes written to it using Content-Defined Chunking,
 // and then, if configured, encrypt and compress the chunked bytes.
 type cdcWriter struct {
@@ -2052,6 +2372,8 @@ func (cdcw *cdcWriter) writeChunkWhenMultiple(chunkData []byte) error {
 		cdcw.eg.Go(func() error {
 			return cdcw.writeRawChunk(fileRecord, key, chunkData)
 		})
+	} else {
+		metrics.PebbleCacheDedupedChunkSizeBytes.With(prometheus.Labels{metrics.CacheNameLabel: p.name}).Add(float64(len(chunkData)))
 	}
 	return nil
 }
@@ -2158,20 +2480,34 @@ func (p *PebbleCache) Writer(ctx context.Context, r *rspb.ResourceName) (interfa
 	if err != nil {
 		return nil, err
 	}
+	if err := p.checkPartitionQuota(fileRecord.GetIsolation().GetPartitionId(), r.GetDigest().GetSizeBytes()); err != nil {
+		return nil, err
+	}
 	key, err := p.fileStorer.PebbleKey(fileRecord)
 	if err != nil {
 		return nil, err
 	}
 
-	if p.averageChunkSizeBytes > 0 && r.GetDigest().GetSizeBytes() >= int64(p.averageChunkSizeBytes) {
-		// Files smaller than averageChunkSizeBytes are highly like to only
-		// have one chunk, so we skip cdc-chunking step.
+	if p.shouldChunk(r) {
 		return p.newCDCCommitedWriteCloser(ctx, fileRecord, key, shouldCompress, isCompressed)
 	}
 
 	return p.newWrappedWriter(ctx, fileRecord, key, shouldCompress, rfpb.FileMetadata_COMPLETE_FILE_TYPE)
 }
 
+// shouldChunk returns whether the blob identified by r should be stored as
+// content-defined chunks rather than as a single entry.
+func (p *PebbleCache) shouldChunk(r *rspb.ResourceName) bool {
+	if p.averageChunkSizeBytes <= 0 {
+		return false
+	}
+	// Files smaller than averageChunkSizeBytes are highly like to only
+	// have one chunk, so we skip cdc-chunking step, even if minBytesChunked
+	// is lower.
+	minBytes := max(p.minBytesChunked, int64(p.averageChunkSizeBytes))
+	return r.GetDigest().GetSizeBytes() >= minBytes
+}
+
 // newWrappedWriter returns an interfaces.CommittedWriteCloser that on Write
 // will:
 // (1) compress the data if shouldCompress is true; and then
@@ -2251,9 +2587,17 @@ func (p *PebbleCache) writeMetadata(ctx context.Context, db pebble.IPebbleDB, ke
 		metrics.DecompressedBlobSizeWrite.With(labels).Add(float64(md.GetFileRecord().GetDigest().GetSizeBytes()))
 	}
 
+	if md.GetStorageMetadata().GetFileMetadata() != nil {
+		p.blobBytesWritten.Add(uint64(md.GetStoredSizeBytes()))
+	}
+
 	unlockFn := p.locker.Lock(key.LockID())
 	defer unlockFn()
 
+	// Readers only populate the hot tier while holding the read lock, so
+	// this can't race with a stale copy of the old entry being added.
+	p.hotTier.remove(key)
+
 	oldMD := rfpb.FileMetadataFromVTPool()
 	defer oldMD.ReturnToVTPool()
 	if version, err := p.lookupFileMetadataAndVersion(ctx, db, key, oldMD); err == nil {
@@ -2281,6 +2625,8 @@ func (p *PebbleCache) writeMetadata(ctx context.Context, db pebble.IPebbleDB, ke
 
 		partitionID := md.GetFileRecord().GetIsolation().GetPartitionId()
 		p.sendSizeUpdate(partitionID, key.CacheType(), addSizeOp, md, len(keyBytes))
+		p.findMissingFilters.add(md.GetFileRecord())
+		p.recordProvenance(ctx, db, key)
 
 		chunkedMD := md.GetStorageMetadata().GetChunkedMetadata()
 
@@ -2325,6 +2671,15 @@ func (p *PebbleCache) DoneScanning() bool {
 	return brokenFilesDone && orphanedFilesDone
 }
 
+// TestingWaitForSizeUpdates should be used by tests only.
+// This function waits until the partition sizes reflect all completed writes
+// and deletions.
+func (p *PebbleCache) TestingWaitForSizeUpdates() {
+	applied := make(chan struct{})
+	p.edits <- &sizeUpdate{applied: applied}
+	<-applied
+}
+
 // TestingWaitForGC should be used by tests only.
 // This function waits until any active file deletion has finished.
 func (p *PebbleCache) TestingWaitForGC() error {
@@ -2385,9 +2740,10 @@ type partitionEvictor struct {
 	casCount  int64
 	acCount   int64
 
-	atimeBufferSize  int
-	minEvictionAge   time.Duration
-	activeKeyVersion int64
+	atimeBufferSize   int
+	minEvictionAge    time.Duration
+	retentionPolicies []RetentionPolicy
+	activeKeyVersion  int64
 
 	samplesPerBatch          int
 	samplerIterRefreshPeriod time.Duration
@@ -2395,13 +2751,16 @@ type partitionEvictor struct {
 	numDeleteWorkers int
 
 	includeMetadataSize bool
+
+	hotTier            *hotTier
+	findMissingFilters findMissingFilters
 }
 
 type versionGetter interface {
 	minDatabaseVersion() filestore.PebbleKeyVersion
 }
 
-func newPartitionEvictor(ctx context.Context, part disk.Partition, fileStorer filestore.Store, blobDir string, dbg pebble.Leaser, locker lockmap.Locker, vg versionGetter, clock clockwork.Clock, minEvictionAge time.Duration, cacheName string, includeMetadataSize bool, sampleBufferSize int, samplesPerBatch int, samplerIterRefreshPeriod time.Duration, deleteBufferSize int, numDeleteWorkers int) (*partitionEvictor, error) {
+func newPartitionEvictor(ctx context.Context, part disk.Partition, fileStorer filestore.Store, blobDir string, dbg pebble.Leaser, locker lockmap.Locker, vg versionGetter, clock clockwork.Clock, minEvictionAge time.Duration, retentionPolicies []RetentionPolicy, cacheName string, includeMetadataSize bool, sampleBufferSize int, samplesPerBatch int, samplerIterRefreshPeriod time.Duration, deleteBufferSize int, numDeleteWorkers int) (*partitionEvictor, error) {
 	pe := &partitionEvictor{
 		ctx:                      ctx,
 		mu:                       &sync.Mutex{},
@@ -2414,6 +2773,7 @@ func newPartitionEvictor(ctx context.Context, part disk.Partition, fileStorer fi
 		rng:                      rand.New(rand.NewSource(time.Now().UnixNano())),
 		clock:                    clock,
 		minEvictionAge:           minEvictionAge,
+		retentionPolicies:        retentionPolicies,
 		cacheName:                cacheName,
 		samples:                  make(chan *approxlru.Sample[*evictionKey], sampleBufferSize),
 		samplesPerBatch:          samplesPerBatch,
@@ -2602,10 +2962,25 @@ func (e *partitionEvictor) generateSamplesForEviction(quitChan chan struct{}) er
 	}
 }
 
+// minEvictionAgeFor returns the minimum eviction age of the entry described
+// by md, taking retention policies into account.
+func (e *partitionEvictor) minEvictionAgeFor(md *rfpb.FileMetadata) time.Duration {
+	instanceName := md.GetFileRecord().GetIsolation().GetRemoteInstanceName()
+	minEvictionAge := e.minEvictionAge
+	matchedPrefixLen := -1
+	for _, rp := range e.retentionPolicies {
+		if len(rp.InstanceNamePrefix) > matchedPrefixLen && strings.HasPrefix(instanceName, rp.InstanceNamePrefix) {
+			minEvictionAge = rp.MinEvictionAge
+			matchedPrefixLen = len(rp.InstanceNamePrefix)
+		}
+	}
+	return minEvictionAge
+}
+
 func (e *partitionEvictor) maybeAddToSampleChan(iter pebble.Iterator, fileMetadata *rfpb.FileMetadata, quitChan chan struct{}, timer clockwork.Timer) {
 	atime := time.UnixMicro(fileMetadata.GetLastAccessUsec())
 	age := e.clock.Since(atime)
-	if age < e.minEvictionAge {
+	if age < e.minEvictionAgeFor(fileMetadata) {
 		return
 	}
 	sizeBytes := fileMetadata.GetStoredSizeBytes()
@@ -2902,6 +3277,11 @@ func (e *partitionEvictor) doEvict(sample *approxlru.Sample[*evictionKey]) {
 		log.Errorf("[%s] Error evicting file for key %q: %s (ignoring)", e.cacheName, sample.Key, err)
 		return
 	}
+	e.hotTier.remove(key)
+	e.findMissingFilters.recordRemoval(e.part.ID)
+	if err := deleteProvenance(db, key); err != nil {
+		log.Warningf("[%s] Error deleting provenance for key %q: %s", e.cacheName, sample.Key, err)
+	}
 	lbls := prometheus.Labels{metrics.PartitionID: e.part.ID, metrics.CacheNameLabel: e.cacheName}
 	metrics.DiskCacheNumEvictions.With(lbls).Inc()
 	metrics.DiskCacheBytesEvicted.With(lbls).Add(float64(sample.SizeBytes))
@@ -3054,6 +3434,39 @@ func (p *PebbleCache) refreshMetrics(quitChan chan struct{}) {
 	}
 }
 
+// WriteLoad returns the compaction backlog of the underlying pebble database
+// and the rate at which the cache has recently been writing to disk. The load
+// is sampled at most once every writeLoadSamplePeriod, so it's cheap to call
+// on every write.
+func (p *PebbleCache) WriteLoad() interfaces.CacheWriteLoad {
+	p.writeLoadMu.Lock()
+	defer p.writeLoadMu.Unlock()
+
+	now := p.clock.Now()
+	if now.Sub(p.writeLoadSampleTime) < writeLoadSamplePeriod {
+		return p.writeLoad
+	}
+	db, err := p.leaser.DB()
+	if err != nil {
+		return p.writeLoad
+	}
+	defer db.Close()
+
+	m := db.Metrics()
+	// Flushed bytes include the bytes written to the WAL.
+	total := m.Total()
+	bytesTotal := total.BytesFlushed + total.BytesCompacted + p.blobBytesWritten.Load()
+	load := interfaces.CacheWriteLoad{CompactionDebtBytes: m.Compact.EstimatedDebt}
+	if !p.writeLoadSampleTime.IsZero() {
+		elapsed := now.Sub(p.writeLoadSampleTime).Seconds()
+		load.DiskWriteBytesPerSecond = float64(bytesTotal-p.writeLoadBytesTotal) / elapsed
+	}
+	p.writeLoad = load
+	p.writeLoadSampleTime = now
+	p.writeLoadBytesTotal = bytesTotal
+	return load
+}
+
 func (p *PebbleCache) SupportsCompressor(compressor repb.Compressor_Value) bool {
 	switch compressor {
 	case repb.Compressor_IDENTITY, repb.Compressor_ZSTD:
@@ -3085,23 +3498,49 @@ type readCloser struct {
 
 // newChunkedReader returns a reader to read chunked content.
 // When shouldDecompress is true, the content read is decompressed.
-func (p *PebbleCache) newChunkedReader(ctx context.Context, chunkedMD *rfpb.StorageMetadata_ChunkedMetadata, shouldDecompress bool) (io.ReadCloser, error) {
+//
+// Chunks that lie entirely before uncompressedOffset are not read at all, and
+// the remaining offset is passed along to the first chunk if it's read
+// decompressed. The number of bytes skipped this way is returned, so that the
+// caller can discard the rest.
+func (p *PebbleCache) newChunkedReader(ctx context.Context, chunkedMD *rfpb.StorageMetadata_ChunkedMetadata, shouldDecompress bool, uncompressedOffset int64) (io.ReadCloser, int64, error) {
 	missing, err := p.FindMissing(ctx, chunkedMD.GetResource())
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	if len(missing) > 0 {
-		return nil, status.NotFoundError("chunks were missing")
+		return nil, 0, status.NotFoundError("chunks were missing")
+	}
+
+	var resources []*rspb.ResourceName
+	for _, resourceName := range chunkedMD.GetResource() {
+		rn := proto.Clone(resourceName).(*rspb.ResourceName)
+		if shouldDecompress && rn.GetCompressor() == repb.Compressor_ZSTD {
+			rn.Compressor = repb.Compressor_IDENTITY
+		}
+		resources = append(resources, rn)
+	}
+	skipped := int64(0)
+	firstChunkOffset := int64(0)
+	for len(resources) > 0 && resources[0].GetCompressor() == repb.Compressor_IDENTITY {
+		size := resources[0].GetDigest().GetSizeBytes()
+		if skipped+size > uncompressedOffset {
+			firstChunkOffset = uncompressedOffset - skipped
+			skipped = uncompressedOffset
+			break
+		}
+		skipped += size
+		resources = resources[1:]
 	}
 
 	pr, pw := io.Pipe()
 	go func() {
-		for _, resourceName := range chunkedMD.GetResource() {
-			rn := proto.Clone(resourceName).(*rspb.ResourceName)
-			if shouldDecompress && rn.GetCompressor() == repb.Compressor_ZSTD {
-				rn.Compressor = repb.Compressor_IDENTITY
+		for i, rn := range resources {
+			offset := int64(0)
+			if i == 0 {
+				offset = firstChunkOffset
 			}
-			rc, err := p.Reader(ctx, rn, 0, 0)
+			rc, err := p.Reader(ctx, rn, offset, 0)
 			if err != nil {
 				pw.CloseWithError(err)
 				return
@@ -3114,7 +3553,7 @@ func (p *PebbleCache) newChunkedReader(ctx context.Context, chunkedMD *rfpb.Stor
 		}
 		pw.Close()
 	}()
-	return pr, nil
+	return pr, skipped, nil
 }
 
 func (p *PebbleCache) reader(ctx context.Context, db pebble.IPebbleDB, r *rspb.ResourceName, uncompressedOffset int64, uncompressedLimit int64) (io.ReadCloser, error) {
@@ -3170,9 +3609,16 @@ func (p *PebbleCache) reader(ctx context.Context, db pebble.IPebbleDB, r *rspb.R
 	shouldDecompress := cachedCompression == repb.Compressor_ZSTD && requestedCompression == repb.Compressor_IDENTITY
 
 	var reader io.ReadCloser
+	// skippedOffset is the number of bytes at the start of the uncompressed
+	// contents that were skipped without being read.
+	skippedOffset := int64(0)
 	md := fileMetadata.GetStorageMetadata()
 	if chunkedMD := md.GetChunkedMetadata(); chunkedMD != nil {
-		reader, err = p.newChunkedReader(ctx, chunkedMD, shouldDecompress)
+		chunkOffset := int64(0)
+		if !shouldDecrypt {
+			chunkOffset = uncompressedOffset
+		}
+		reader, skippedOffset, err = p.newChunkedReader(ctx, chunkedMD, shouldDecompress, chunkOffset)
 	} else {
 		reader, err = p.fileStorer.NewReader(ctx, blobDir, md, offset, limit)
 	}
@@ -3197,14 +3643,27 @@ func (p *PebbleCache) reader(ctx context.Context, db pebble.IPebbleDB, r *rspb.R
 		if shouldDecompress && md.GetChunkedMetadata() == nil {
 			// We don't need to decompress the chunked reader's content since
 			// it already returns decompressed content from its children.
-			dr, err := compression.NewZstdDecompressingReader(reader)
+			// Stored blobs are made up of independently compressed frames,
+			// so only the frame containing the offset needs to be
+			// decompressed.
+			remaining, skipped, err := compression.SkipZstdFrames(reader, uncompressedOffset)
+			if err != nil {
+				_ = reader.Close()
+				return nil, err
+			}
+			skippedOffset = skipped
+			dr, err := compression.NewZstdDecompressingReader(&readCloser{remaining, reader})
 			if err != nil {
 				return nil, err
 			}
 			reader = dr
 		}
-		if uncompressedOffset != 0 {
-			if _, err := io.CopyN(io.Discard, reader, uncompressedOffset); err != nil {
+	}
+	// Chunked content is never read with the offset/limit applied by the
+	// file storer, even if it's stored uncompressed.
+	if !rawStorage || md.GetChunkedMetadata() != nil {
+		if uncompressedOffset > skippedOffset {
+			if _, err := io.CopyN(io.Discard, reader, uncompressedOffset-skippedOffset); err != nil {
 				_ = reader.Close()
 				return nil, err
 			}
@@ -3261,6 +3720,13 @@ func (p *PebbleCache) Start() error {
 		p.periodicFlushPartitionMetadata(p.quitChan)
 		return nil
 	})
+	if ut := p.env.GetUsageTracker(); ut != nil && *partitionUsageReportInterval > 0 {
+		interval := *partitionUsageReportInterval
+		p.eg.Go(func() error {
+			p.periodicReportPartitionUsage(p.quitChan, ut, interval)
+			return nil
+		})
+	}
 	p.egSizeUpdates.Go(func() error {
 		p.processSizeUpdates()
 		return nil
@@ -3287,6 +3753,12 @@ func (p *PebbleCache) Start() error {
 		p.refreshMetrics(p.quitChan)
 		return nil
 	})
+	if p.findMissingFilters != nil {
+		p.eg.Go(func() error {
+			p.maintainFindMissingFilters(p.quitChan)
+			return nil
+		})
+	}
 	return nil
 }
 
@@ -3338,6 +3810,29 @@ func (p *PebbleCache) Stop() error {
 	return nil
 }
 
+// ScanResources calls fn for each entry in the cache, including the chunks
+// of chunked entries.
+func (p *PebbleCache) ScanResources(ctx context.Context, fn func(ctx context.Context, r *rspb.ResourceName) error) error {
+	db, err := p.leaser.DB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return p.scanEntries(ctx, db, func(key filestore.PebbleKey, version filestore.PebbleKeyVersion, md *rfpb.FileMetadata) error {
+		fr := md.GetFileRecord()
+		r := digest.NewResourceName(fr.GetDigest(), fr.GetIsolation().GetRemoteInstanceName(), fr.GetIsolation().GetCacheType(), fr.GetDigestFunction()).ToProto()
+		groupCtx := ctx
+		if groupID := fr.GetIsolation().GetGroupId(); groupID != "" && groupID != interfaces.AuthAnonymousUser {
+			c := &claims.Claims{
+				GroupID:                groupID,
+				CacheEncryptionEnabled: md.GetEncryptionMetadata() != nil,
+			}
+			groupCtx = claims.AuthContextFromClaims(ctx, c, nil)
+		}
+		return fn(groupCtx, r)
+	})
+}
+
 func (p *PebbleCache) SupportsEncryption(ctx context.Context) bool {
 	_, partID := p.lookupGroupAndPartitionID(ctx, "")
 	for _, part := range p.partitions {
@@ -26,12 +26,15 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/raft/keys"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testmetrics"
+	"github.com/buildbuddy-io/buildbuddy/server/util/bazel_request"
 	"github.com/buildbuddy-io/buildbuddy/server/util/compression"
 	"github.com/buildbuddy-io/buildbuddy/server/util/disk"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
@@ -41,10 +44,15 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 	"github.com/cockroachdb/pebble"
 	"github.com/docker/go-units"
+	"github.com/google/go-cmp/cmp"
 	"github.com/jonboulle/clockwork"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/testing/protocmp"
 
+	capb "github.com/buildbuddy-io/buildbuddy/proto/cache"
 	rfpb "github.com/buildbuddy-io/buildbuddy/proto/raft"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
@@ -481,6 +489,150 @@ func TestIsolateByGroupIds(t *testing.T) {
 	}
 }
 
+func TestPartitionHardQuota(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	testAPIKey := "AK2222"
+	testGroup := "GR7890"
+	testUsers := testauth.TestUsers(testAPIKey, testGroup)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testUsers))
+
+	maxSizeBytes := int64(1_000_000_000) // 1GB
+	quotaBytes := int64(10_000)
+	minEvictionAge := time.Hour
+	partitionID := "FOO"
+	opts := &pebble_cache.Options{
+		RootDirectory:          testfs.MakeTempDir(t),
+		MaxSizeBytes:           maxSizeBytes,
+		MaxInlineFileSizeBytes: 1, // Ensure file is written to disk
+		MinEvictionAge:         &minEvictionAge,
+		Partitions: []disk.Partition{
+			{
+				ID:           pebble_cache.DefaultPartitionID,
+				MaxSizeBytes: maxSizeBytes,
+			},
+			{
+				ID:           partitionID,
+				MaxSizeBytes: quotaBytes,
+				HardQuota:    true,
+			},
+		},
+		PartitionMappings: []disk.PartitionMapping{
+			{
+				GroupID:     testGroup,
+				Prefix:      "",
+				PartitionID: partitionID,
+			},
+		},
+	}
+	pc, err := pebble_cache.NewPebbleCache(te, opts)
+	require.NoError(t, err)
+	pc.Start()
+	defer pc.Stop()
+
+	ctx := te.GetAuthenticator().AuthContextFromAPIKey(context.Background(), testAPIKey)
+	// Write until the quota is reached. Blobs are compressed, so the number
+	// of writes that fit depends on their content.
+	var lastErr error
+	for i := 0; i < 100; i++ {
+		r, buf := testdigest.NewRandomResourceAndBuf(t, 1000, rspb.CacheType_CAS, "")
+		if lastErr = pc.Set(ctx, r, buf); lastErr != nil {
+			break
+		}
+		// Size updates are applied asynchronously.
+		pc.TestingWaitForSizeUpdates()
+	}
+	require.Error(t, lastErr)
+	require.True(t, status.IsResourceExhaustedError(lastErr), "expected ResourceExhausted error, got %v", lastErr)
+
+	// Other tenants are not affected.
+	anonCtx := getAnonContext(t, te)
+	r, buf := testdigest.NewRandomResourceAndBuf(t, 1000, rspb.CacheType_CAS, "")
+	err = pc.Set(anonCtx, r, buf)
+	require.NoError(t, err)
+}
+
+func TestPartitionHardQuota_SetMulti(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	testAPIKey := "AK2222"
+	testGroup := "GR7890"
+	testUsers := testauth.TestUsers(testAPIKey, testGroup)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testUsers))
+
+	maxSizeBytes := int64(1_000_000_000) // 1GB
+	quotaBytes := int64(10_000)
+	minEvictionAge := time.Hour
+	partitionID := "FOO"
+	opts := &pebble_cache.Options{
+		RootDirectory:          testfs.MakeTempDir(t),
+		MaxSizeBytes:           maxSizeBytes,
+		MaxInlineFileSizeBytes: 1, // Ensure file is written to disk
+		MinEvictionAge:         &minEvictionAge,
+		Partitions: []disk.Partition{
+			{
+				ID:           pebble_cache.DefaultPartitionID,
+				MaxSizeBytes: maxSizeBytes,
+			},
+			{
+				ID:           partitionID,
+				MaxSizeBytes: quotaBytes,
+				HardQuota:    true,
+			},
+		},
+		PartitionMappings: []disk.PartitionMapping{
+			{
+				GroupID:     testGroup,
+				Prefix:      "",
+				PartitionID: partitionID,
+			},
+		},
+	}
+	pc, err := pebble_cache.NewPebbleCache(te, opts)
+	require.NoError(t, err)
+	pc.Start()
+	defer pc.Stop()
+
+	ctx := te.GetAuthenticator().AuthContextFromAPIKey(context.Background(), testAPIKey)
+
+	// A batch which would exceed the quota is rejected without writing any
+	// of its blobs, even though the partition is empty.
+	kvs := make(map[*rspb.ResourceName][]byte)
+	var rns []*rspb.ResourceName
+	for i := 0; i < 20; i++ {
+		r, buf := testdigest.NewRandomResourceAndBuf(t, 1000, rspb.CacheType_CAS, "")
+		kvs[r] = buf
+		rns = append(rns, r)
+	}
+	err = pc.SetMulti(ctx, kvs)
+	require.True(t, status.IsResourceExhaustedError(err), "expected ResourceExhausted error, got %v", err)
+	missing, err := pc.FindMissing(ctx, rns)
+	require.NoError(t, err)
+	require.Len(t, missing, len(rns))
+
+	// A batch which fits within the quota is written.
+	kvs = make(map[*rspb.ResourceName][]byte)
+	rns = nil
+	for i := 0; i < 5; i++ {
+		r, buf := testdigest.NewRandomResourceAndBuf(t, 1000, rspb.CacheType_CAS, "")
+		kvs[r] = buf
+		rns = append(rns, r)
+	}
+	err = pc.SetMulti(ctx, kvs)
+	require.NoError(t, err)
+	missing, err = pc.FindMissing(ctx, rns)
+	require.NoError(t, err)
+	require.Empty(t, missing)
+
+	// Other tenants are not affected.
+	anonCtx := getAnonContext(t, te)
+	kvs = make(map[*rspb.ResourceName][]byte)
+	for i := 0; i < 20; i++ {
+		r, buf := testdigest.NewRandomResourceAndBuf(t, 1000, rspb.CacheType_CAS, "")
+		kvs[r] = buf
+	}
+	err = pc.SetMulti(anonCtx, kvs)
+	require.NoError(t, err)
+}
+
 func TestCopyPartitionData(t *testing.T) {
 	chunkingOn := []bool{true, false}
 	for _, tc := range chunkingOn {
@@ -838,6 +990,89 @@ func TestMetadata(t *testing.T) {
 	}
 }
 
+func TestMinBytesChunked(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(emptyUserMap))
+	ctx := getAnonContext(t, te)
+
+	options := &pebble_cache.Options{
+		RootDirectory:               testfs.MakeTempDir(t),
+		MaxSizeBytes:                1_000_000_000, // 1GB
+		MaxInlineFileSizeBytes:      100,
+		MinBytesAutoZstdCompression: math.MaxInt64, // Turn off automatic compression
+		AverageChunkSizeBytes:       64 * 4,
+		MinBytesChunked:             10_000,
+	}
+	pc, err := pebble_cache.NewPebbleCache(te, options)
+	require.NoError(t, err)
+	err = pc.Start()
+	require.NoError(t, err)
+	defer pc.Stop()
+
+	for _, testSize := range []int64{1000, 9999, 10_000, 1_000_000} {
+		t.Run(fmt.Sprintf("testSize: %d", testSize), func(t *testing.T) {
+			r, buf := testdigest.RandomCASResourceBuf(t, testSize)
+			err := pc.Set(ctx, r, buf)
+			require.NoError(t, err)
+
+			md, err := pc.Metadata(ctx, r)
+			require.NoError(t, err)
+			if testSize >= options.MinBytesChunked {
+				// Chunked entries don't account for the size of their chunks.
+				require.Equal(t, int64(0), md.StoredSizeBytes)
+			} else {
+				require.Equal(t, testSize, md.StoredSizeBytes)
+			}
+
+			rbuf, err := pc.Get(ctx, r)
+			require.NoError(t, err)
+			require.Equal(t, buf, rbuf)
+		})
+	}
+}
+
+func TestMinBytesChunked_BelowAverageChunkSize(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(emptyUserMap))
+	ctx := getAnonContext(t, te)
+
+	options := &pebble_cache.Options{
+		RootDirectory:               testfs.MakeTempDir(t),
+		MaxSizeBytes:                1_000_000_000, // 1GB
+		MaxInlineFileSizeBytes:      100,
+		MinBytesAutoZstdCompression: math.MaxInt64, // Turn off automatic compression
+		AverageChunkSizeBytes:       4096,
+		MinBytesChunked:             100,
+	}
+	pc, err := pebble_cache.NewPebbleCache(te, options)
+	require.NoError(t, err)
+	err = pc.Start()
+	require.NoError(t, err)
+	defer pc.Stop()
+
+	// Blobs smaller than the average chunk size aren't chunked, even if
+	// they're larger than MinBytesChunked.
+	for _, testSize := range []int64{1000, 4095, 1_000_000} {
+		t.Run(fmt.Sprintf("testSize: %d", testSize), func(t *testing.T) {
+			r, buf := testdigest.RandomCASResourceBuf(t, testSize)
+			err := pc.Set(ctx, r, buf)
+			require.NoError(t, err)
+
+			md, err := pc.Metadata(ctx, r)
+			require.NoError(t, err)
+			if testSize >= int64(options.AverageChunkSizeBytes) {
+				require.Equal(t, int64(0), md.StoredSizeBytes)
+			} else {
+				require.Equal(t, testSize, md.StoredSizeBytes)
+			}
+
+			rbuf, err := pc.Get(ctx, r)
+			require.NoError(t, err)
+			require.Equal(t, buf, rbuf)
+		})
+	}
+}
+
 func randomDigests(t *testing.T, sizes ...int64) map[*rspb.ResourceName][]byte {
 	m := make(map[*rspb.ResourceName][]byte)
 	for _, size := range sizes {
@@ -1512,6 +1747,10 @@ func TestCompressionOffset(t *testing.T) {
 		averageChunkSizeBytes int
 		readOffset            int64
 		readLimit             int64
+		// If set, the blob is written as independently compressed frames
+		// of CompressorBufSizeBytes each, like the cache compresses blobs
+		// that are written uncompressed.
+		compressInFrames bool
 	}{
 		{
 			desc:       "disk_multiple_compression_chunk",
@@ -1539,6 +1778,27 @@ func TestCompressionOffset(t *testing.T) {
 			readOffset:            2 * 1024,
 			readLimit:             10,
 		},
+		{
+			desc:             "disk_offset_in_later_compression_frame",
+			blobSize:         3*pebble_cache.CompressorBufSizeBytes + 1,
+			readOffset:       2*pebble_cache.CompressorBufSizeBytes + 100,
+			readLimit:        10,
+			compressInFrames: true,
+		},
+		{
+			desc:             "disk_offset_at_compression_frame_boundary",
+			blobSize:         3*pebble_cache.CompressorBufSizeBytes + 1,
+			readOffset:       2 * pebble_cache.CompressorBufSizeBytes,
+			readLimit:        10,
+			compressInFrames: true,
+		},
+		{
+			desc:                  "chunking_on_offset_in_later_cdc_chunk",
+			blobSize:              64 * 1024,
+			averageChunkSizeBytes: averageChunkSizeBytes,
+			readOffset:            60 * 1024,
+			readLimit:             1000,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -1546,6 +1806,12 @@ func TestCompressionOffset(t *testing.T) {
 			// Make blob big enough to require multiple chunks to compress
 			decompressedRN, blob := testdigest.RandomCompressibleCASResourceBuf(t, tc.blobSize, "" /*instanceName*/)
 			compressedBuf := compression.CompressZstd(nil, blob)
+			if tc.compressInFrames {
+				rc, err := compression.NewZstdCompressingReader(io.NopCloser(bytes.NewReader(blob)), make([]byte, pebble_cache.CompressorBufSizeBytes), nil)
+				require.NoError(t, err)
+				compressedBuf, err = io.ReadAll(rc)
+				require.NoError(t, err)
+			}
 
 			compressedRN := proto.Clone(decompressedRN).(*rspb.ResourceName)
 			compressedRN.Compressor = repb.Compressor_ZSTD
@@ -1711,6 +1977,537 @@ func TestNoEarlyEviction(t *testing.T) {
 	}
 }
 
+func TestRetentionPolicies(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(emptyUserMap))
+	ctx := getAnonContext(t, te)
+	clock := clockwork.NewFakeClock()
+
+	digestSize := int64(100)
+	numDigests := 20
+	maxSizeBytes := int64(math.Ceil( // account for integer rounding
+		float64(numDigests) * float64(digestSize) * (1 / pebble_cache.JanitorCutoffThreshold))) // account for .9 evictor cutoff
+	atimeUpdateThreshold := time.Duration(0) // update atime on every access
+	atimeBufferSize := 0                     // blocking channel of atime updates
+	minEvictionAge := time.Duration(0)       // no min eviction age
+	samplesPerBatch := 50
+	opts := &pebble_cache.Options{
+		RootDirectory:               testfs.MakeTempDir(t),
+		MaxSizeBytes:                maxSizeBytes,
+		MaxInlineFileSizeBytes:      1,
+		MinBytesAutoZstdCompression: maxSizeBytes,
+		AtimeUpdateThreshold:        &atimeUpdateThreshold,
+		AtimeBufferSize:             &atimeBufferSize,
+		MinEvictionAge:              &minEvictionAge,
+		SamplesPerBatch:             &samplesPerBatch,
+		RetentionPolicies: []pebble_cache.RetentionPolicy{
+			{InstanceNamePrefix: "release", MinEvictionAge: time.Hour},
+			{InstanceNamePrefix: "release/ephemeral", MinEvictionAge: 0},
+		},
+		Clock: clock,
+	}
+	pc, err := pebble_cache.NewPebbleCache(te, opts)
+	require.NoError(t, err)
+	err = pc.Start()
+	require.NoError(t, err)
+
+	// Fill the cache with entries that are protected by a retention policy
+	// and entries that aren't.
+	var retained, evictable []*rspb.ResourceName
+	for i := 0; i < numDigests; i++ {
+		instanceName := "release/v1"
+		if i%2 == 0 {
+			instanceName = "release/ephemeral/v1"
+		}
+		r, buf := testdigest.NewRandomResourceAndBuf(t, digestSize, rspb.CacheType_CAS, instanceName)
+		err := pc.Set(ctx, r, buf)
+		require.NoError(t, err)
+		if i%2 == 0 {
+			evictable = append(evictable, r)
+		} else {
+			retained = append(retained, r)
+		}
+	}
+	clock.Advance(10 * time.Minute)
+
+	// Writing more entries forces the older unprotected entries out.
+	for i := 0; i < numDigests/4; i++ {
+		r, buf := testdigest.NewRandomResourceAndBuf(t, digestSize, rspb.CacheType_CAS, "")
+		err := pc.Set(ctx, r, buf)
+		require.NoError(t, err)
+	}
+
+	pc.Stop()
+	pc, err = pebble_cache.NewPebbleCache(te, opts)
+	require.NoError(t, err)
+	err = pc.Start()
+	require.NoError(t, err)
+	defer pc.Stop()
+
+	pc.TestingWaitForGC()
+
+	for _, r := range retained {
+		exists, err := pc.Contains(ctx, r)
+		require.NoError(t, err)
+		require.True(t, exists, "entry %q under a retention policy was evicted", r.GetDigest().GetHash())
+	}
+	numEvicted := 0
+	for _, r := range evictable {
+		exists, err := pc.Contains(ctx, r)
+		require.NoError(t, err)
+		if !exists {
+			numEvicted++
+		}
+	}
+	require.Greater(t, numEvicted, 0)
+}
+
+func TestCollectGarbage(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(emptyUserMap))
+	ctx := getAnonContext(t, te)
+	clock := clockwork.NewFakeClock()
+
+	maxSizeBytes := int64(100_000_000)
+	opts := &pebble_cache.Options{
+		RootDirectory:          testfs.MakeTempDir(t),
+		MaxSizeBytes:           maxSizeBytes,
+		MaxInlineFileSizeBytes: 100,
+		AverageChunkSizeBytes:  averageChunkSizeBytes,
+		Clock:                  clock,
+	}
+	pc, err := pebble_cache.NewPebbleCache(te, opts)
+	require.NoError(t, err)
+	err = pc.Start()
+	require.NoError(t, err)
+	defer pc.Stop()
+
+	writeCAS := func(size int64) *rspb.ResourceName {
+		r, buf := testdigest.NewRandomResourceAndBuf(t, size, rspb.CacheType_CAS, "")
+		require.NoError(t, pc.Set(ctx, r, buf))
+		return r
+	}
+	writeProto := func(msg proto.Message, cacheType rspb.CacheType) *rspb.ResourceName {
+		buf, err := proto.Marshal(msg)
+		require.NoError(t, err)
+		d, err := digest.Compute(bytes.NewReader(buf), repb.DigestFunction_SHA256)
+		require.NoError(t, err)
+		r := digest.NewResourceName(d, "", cacheType, repb.DigestFunction_SHA256).ToProto()
+		require.NoError(t, pc.Set(ctx, r, buf))
+		return r
+	}
+
+	// Reachable entries: a small and a chunked output file, stdout, and an
+	// output directory whose tree references another file.
+	outputFile := writeCAS(50)
+	chunkedOutputFile := writeCAS(averageChunkSizeBytes * 8)
+	stdout := writeCAS(200)
+	treeFile := writeCAS(300)
+	tree := writeProto(&repb.Tree{
+		Root: &repb.Directory{
+			Files: []*repb.FileNode{{Name: "file", Digest: treeFile.GetDigest()}},
+		},
+	}, rspb.CacheType_CAS)
+	actionDigest, err := digest.Compute(bytes.NewReader([]byte("action")), repb.DigestFunction_SHA256)
+	require.NoError(t, err)
+	ar := &repb.ActionResult{
+		OutputFiles: []*repb.OutputFile{
+			{Path: "a", Digest: outputFile.GetDigest()},
+			{Path: "b", Digest: chunkedOutputFile.GetDigest()},
+		},
+		OutputDirectories: []*repb.OutputDirectory{
+			{Path: "dir", TreeDigest: tree.GetDigest()},
+		},
+		StdoutDigest: stdout.GetDigest(),
+	}
+	arBuf, err := proto.Marshal(ar)
+	require.NoError(t, err)
+	arRN := digest.NewResourceName(actionDigest, "", rspb.CacheType_AC, repb.DigestFunction_SHA256).ToProto()
+	require.NoError(t, pc.Set(ctx, arRN, arBuf))
+	reachable := []*rspb.ResourceName{outputFile, chunkedOutputFile, stdout, treeFile, tree}
+
+	// Unreachable entries, which are deleted once they're old enough.
+	unreachable := []*rspb.ResourceName{writeCAS(50), writeCAS(averageChunkSizeBytes * 8)}
+	clock.Advance(2 * time.Hour)
+	recent := writeCAS(50)
+
+	requireExists := func(rns []*rspb.ResourceName, want bool) {
+		for _, r := range rns {
+			exists, err := pc.Contains(ctx, r)
+			require.NoError(t, err)
+			require.Equal(t, want, exists, "digest %q", r.GetDigest().GetHash())
+		}
+	}
+
+	gcOpts := &pebble_cache.GCOptions{MinAge: time.Hour, DryRun: true}
+	dryRunResult, err := pc.CollectGarbage(ctx, gcOpts)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), dryRunResult.ActionResultsScanned)
+	require.Greater(t, dryRunResult.DeletedEntries, int64(0))
+	require.Empty(t, dryRunResult.SkippedPartitions)
+	requireExists(reachable, true)
+	requireExists(unreachable, true)
+
+	gcOpts.DryRun = false
+	result, err := pc.CollectGarbage(ctx, gcOpts)
+	require.NoError(t, err)
+	require.Equal(t, dryRunResult.DeletedEntries, result.DeletedEntries)
+	require.Equal(t, dryRunResult.DeletedBytes, result.DeletedBytes)
+	requireExists(reachable, true)
+	requireExists(unreachable, false)
+	requireExists([]*rspb.ResourceName{recent, arRN}, true)
+
+	// A second run finds nothing left to delete.
+	result, err = pc.CollectGarbage(ctx, gcOpts)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), result.DeletedEntries)
+}
+
+func TestScanResources(t *testing.T) {
+	// ScanResources re-authenticates group-owned entries by minting a JWT,
+	// so make sure the test authenticator can verify it.
+	flags.Set(t, "auth.jwt_key", "testKey")
+	te := testenv.GetTestEnv(t)
+	testAPIKey := "AK2222"
+	testGroup := "GR7890"
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers(testAPIKey, testGroup)))
+	anonCtx := getAnonContext(t, te)
+	groupCtx := te.GetAuthenticator().AuthContextFromAPIKey(context.Background(), testAPIKey)
+	groupCtx, err := prefix.AttachUserPrefixToContext(groupCtx, te)
+	require.NoError(t, err)
+
+	maxSizeBytes := int64(1_000_000_000) // 1GB
+	opts := &pebble_cache.Options{
+		RootDirectory:          testfs.MakeTempDir(t),
+		MaxSizeBytes:           maxSizeBytes,
+		MaxInlineFileSizeBytes: 100,
+		Partitions: []disk.Partition{
+			{ID: "default", MaxSizeBytes: maxSizeBytes},
+			{ID: "FOO", MaxSizeBytes: maxSizeBytes},
+		},
+		PartitionMappings: []disk.PartitionMapping{
+			{GroupID: testGroup, Prefix: "", PartitionID: "FOO"},
+		},
+	}
+	pc, err := pebble_cache.NewPebbleCache(te, opts)
+	require.NoError(t, err)
+	err = pc.Start()
+	require.NoError(t, err)
+	defer pc.Stop()
+
+	written := make(map[string][]byte)
+	for i, ctx := range []context.Context{anonCtx, groupCtx, anonCtx, groupCtx} {
+		cacheType := rspb.CacheType_CAS
+		if i >= 2 {
+			cacheType = rspb.CacheType_AC
+		}
+		r, buf := testdigest.NewRandomResourceAndBuf(t, int64(50+i*100), cacheType, "instance")
+		require.NoError(t, pc.Set(ctx, r, buf))
+		written[r.GetDigest().GetHash()] = buf
+	}
+
+	scanned := 0
+	err = pc.ScanResources(context.Background(), func(ctx context.Context, r *rspb.ResourceName) error {
+		scanned++
+		want, ok := written[r.GetDigest().GetHash()]
+		require.True(t, ok, "unexpected resource %q", r.GetDigest().GetHash())
+		require.Equal(t, "instance", r.GetInstanceName())
+
+		// The context passed to the callback can read the resource from
+		// the partition it was written to.
+		ctx, err := prefix.AttachUserPrefixToContext(ctx, te)
+		require.NoError(t, err)
+		got, err := pc.Get(ctx, r)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, len(written), scanned)
+}
+
+func TestWriteLoad(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(emptyUserMap))
+	ctx := getAnonContext(t, te)
+	clock := clockwork.NewFakeClock()
+
+	opts := &pebble_cache.Options{
+		RootDirectory:          testfs.MakeTempDir(t),
+		MaxSizeBytes:           100_000_000,
+		MaxInlineFileSizeBytes: 100,
+		Clock:                  clock,
+	}
+	pc, err := pebble_cache.NewPebbleCache(te, opts)
+	require.NoError(t, err)
+	err = pc.Start()
+	require.NoError(t, err)
+	defer pc.Stop()
+
+	// There's no rate until there are two samples to compare.
+	require.Zero(t, pc.WriteLoad().DiskWriteBytesPerSecond)
+
+	r, buf := testdigest.NewRandomResourceAndBuf(t, 1_000_000, rspb.CacheType_CAS, "")
+	require.NoError(t, pc.Set(ctx, r, buf))
+
+	// The load is only sampled once per second.
+	require.Zero(t, pc.WriteLoad().DiskWriteBytesPerSecond)
+
+	md, err := pc.Metadata(ctx, r)
+	require.NoError(t, err)
+	clock.Advance(2 * time.Second)
+	load := pc.WriteLoad()
+	require.GreaterOrEqual(t, load.DiskWriteBytesPerSecond, float64(md.StoredSizeBytes)/2)
+
+	// Without further writes, the rate drops back down.
+	clock.Advance(2 * time.Second)
+	require.Less(t, pc.WriteLoad().DiskWriteBytesPerSecond, load.DiskWriteBytesPerSecond)
+}
+
+func TestFindMissingFilter(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(emptyUserMap))
+	ctx := getAnonContext(t, te)
+
+	cacheName := "find_missing_filter_test_cache"
+	opts := &pebble_cache.Options{
+		Name:          cacheName,
+		RootDirectory: testfs.MakeTempDir(t),
+		MaxSizeBytes:  int64(1_000_000_000), // 1GB
+	}
+
+	// Write some entries before the filter is enabled, so that they're only
+	// in the filter if the startup scan finds them.
+	var existing []*rspb.ResourceName
+	pc, err := pebble_cache.NewPebbleCache(te, opts)
+	require.NoError(t, err)
+	require.NoError(t, pc.Start())
+	for i := 0; i < 10; i++ {
+		r, buf := testdigest.RandomCASResourceBuf(t, 1000)
+		require.NoError(t, pc.Set(ctx, r, buf))
+		existing = append(existing, r)
+	}
+	acRN, acBuf := testdigest.RandomACResourceBuf(t, 100)
+	require.NoError(t, pc.Set(ctx, acRN, acBuf))
+	existing = append(existing, acRN)
+	require.NoError(t, pc.Stop())
+
+	opts.FindMissingFilterExpectedEntries = 1000
+	pc, err = pebble_cache.NewPebbleCache(te, opts)
+	require.NoError(t, err)
+	require.NoError(t, pc.Start())
+	defer pc.Stop()
+
+	lookupCount := func(result string) float64 {
+		return testmetrics.CounterValue(t, metrics.PebbleCacheFindMissingFilterLookupCount.With(prometheus.Labels{
+			metrics.CacheNameLabel:                     cacheName,
+			metrics.PartitionID:                        pebble_cache.DefaultPartitionID,
+			metrics.PebbleCacheFindMissingFilterResult: result,
+		}))
+	}
+
+	// Wait for the startup scan to build the filter.
+	definitelyMissingBefore := lookupCount("definitely_missing")
+	require.Eventually(t, func() bool {
+		r, _ := testdigest.RandomCASResourceBuf(t, 1000)
+		missing, err := pc.FindMissing(ctx, []*rspb.ResourceName{r})
+		require.NoError(t, err)
+		require.Len(t, missing, 1)
+		return lookupCount("definitely_missing") > definitelyMissingBefore
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// Entries written before and after the filter was built are found.
+	for i := 0; i < 10; i++ {
+		r, buf := testdigest.RandomCASResourceBuf(t, 1000)
+		require.NoError(t, pc.Set(ctx, r, buf))
+		existing = append(existing, r)
+	}
+	maybePresentBefore := lookupCount("maybe_present")
+	missing, err := pc.FindMissing(ctx, existing)
+	require.NoError(t, err)
+	require.Empty(t, missing)
+	require.Equal(t, float64(len(existing)), lookupCount("maybe_present")-maybePresentBefore)
+
+	// An AC entry doesn't make the CAS entry with the same digest present.
+	casRN := digest.NewResourceName(acRN.GetDigest(), acRN.GetInstanceName(), rspb.CacheType_CAS, acRN.GetDigestFunction()).ToProto()
+	exists, err := pc.Contains(ctx, casRN)
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	// Missing entries are mostly answered by the filter.
+	definitelyMissingBefore = lookupCount("definitely_missing")
+	var unknown []*rspb.ResourceName
+	for i := 0; i < 100; i++ {
+		r, _ := testdigest.RandomCASResourceBuf(t, 1000)
+		unknown = append(unknown, r)
+	}
+	missing, err = pc.FindMissing(ctx, unknown)
+	require.NoError(t, err)
+	require.Len(t, missing, len(unknown))
+	require.Greater(t, lookupCount("definitely_missing")-definitelyMissingBefore, float64(90))
+}
+
+func withRequestMetadata(t *testing.T, ctx context.Context, rmd *repb.RequestMetadata) context.Context {
+	b, err := proto.Marshal(rmd)
+	require.NoError(t, err)
+	return metadata.NewIncomingContext(ctx, metadata.Pairs(bazel_request.RequestMetadataKey, string(b)))
+}
+
+func TestACProvenance(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	userID := "US123"
+	groupID := "GR123"
+	auther := testauth.NewTestAuthenticator(map[string]interfaces.UserInfo{
+		userID: testauth.User(userID, groupID),
+	})
+	te.SetAuthenticator(auther)
+	ctx, err := auther.WithAuthenticatedUser(context.Background(), userID)
+	require.NoError(t, err)
+	ctx, err = prefix.AttachUserPrefixToContext(ctx, te)
+	require.NoError(t, err)
+
+	clock := clockwork.NewFakeClock()
+	opts := &pebble_cache.Options{
+		RootDirectory:      testfs.MakeTempDir(t),
+		MaxSizeBytes:       int64(1_000_000_000), // 1GB
+		RecordACProvenance: true,
+		Clock:              clock,
+	}
+	pc, err := pebble_cache.NewPebbleCache(te, opts)
+	require.NoError(t, err)
+	require.NoError(t, pc.Start())
+	defer pc.Stop()
+
+	firstCtx := withRequestMetadata(t, ctx, &repb.RequestMetadata{
+		ToolInvocationId: "invocation-1",
+		ActionId:         "action-1",
+		ActionMnemonic:   "GoCompile",
+		TargetId:         "//foo:bar",
+		ToolDetails:      &repb.ToolDetails{ToolName: "bazel"},
+	})
+	r, buf := testdigest.RandomACResourceBuf(t, 100)
+	require.NoError(t, pc.Set(firstCtx, r, buf))
+
+	want := &capb.CacheEntryProvenance{
+		GroupId:        groupID,
+		UserId:         userID,
+		InvocationId:   "invocation-1",
+		ActionId:       "action-1",
+		ActionMnemonic: "GoCompile",
+		TargetId:       "//foo:bar",
+		ToolName:       "bazel",
+		WriteUsec:      clock.Now().UnixMicro(),
+	}
+	got, err := pc.Provenance(ctx, r)
+	require.NoError(t, err)
+	require.Empty(t, cmp.Diff(want, got, protocmp.Transform()))
+
+	// Overwriting the entry keeps the first writer.
+	clock.Advance(time.Minute)
+	secondCtx := withRequestMetadata(t, ctx, &repb.RequestMetadata{ToolInvocationId: "invocation-2"})
+	require.NoError(t, pc.Set(secondCtx, r, []byte("poisoned")))
+	got, err = pc.Provenance(ctx, r)
+	require.NoError(t, err)
+	require.Empty(t, cmp.Diff(want, got, protocmp.Transform()))
+
+	// Provenance is scoped to the group that owns the entry.
+	_, err = pc.Provenance(getAnonContext(t, te), r)
+	require.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+
+	// Provenance isn't recorded for CAS entries.
+	casRN, casBuf := testdigest.RandomCASResourceBuf(t, 100)
+	require.NoError(t, pc.Set(firstCtx, casRN, casBuf))
+	_, err = pc.Provenance(ctx, casRN)
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+
+	unknownRN, _ := testdigest.RandomACResourceBuf(t, 100)
+	_, err = pc.Provenance(ctx, unknownRN)
+	require.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+}
+
+func TestHotTier(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(emptyUserMap))
+	ctx := getAnonContext(t, te)
+
+	cacheName := "hot_tier_test_cache"
+	opts := &pebble_cache.Options{
+		Name:                     cacheName,
+		RootDirectory:            testfs.MakeTempDir(t),
+		MaxSizeBytes:             int64(1_000_000_000), // 1GB
+		HotTierMaxSizeBytes:      10_000,
+		HotTierMaxEntrySizeBytes: 1_000,
+	}
+	pc, err := pebble_cache.NewPebbleCache(te, opts)
+	require.NoError(t, err)
+	require.NoError(t, pc.Start())
+	defer pc.Stop()
+
+	lookupCount := func(cacheType rspb.CacheType, hitStatus string) float64 {
+		return testmetrics.CounterValue(t, metrics.PebbleCacheHotTierRequestCount.With(prometheus.Labels{
+			metrics.CacheNameLabel:     cacheName,
+			metrics.CacheTypeLabel:     cacheType.String(),
+			metrics.CacheHitMissStatus: hitStatus,
+		}))
+	}
+
+	// Small CAS blobs are served from memory after the first read.
+	r, buf := testdigest.RandomCASResourceBuf(t, 100)
+	require.NoError(t, pc.Set(ctx, r, buf))
+	got, err := pc.Get(ctx, r)
+	require.NoError(t, err)
+	require.Equal(t, buf, got)
+	require.Equal(t, float64(1), lookupCount(rspb.CacheType_CAS, metrics.MissStatusLabel))
+	require.Equal(t, float64(0), lookupCount(rspb.CacheType_CAS, metrics.HitStatusLabel))
+
+	// Modifying the returned slice must not corrupt the cached copy.
+	got[0] ^= 0xFF
+	got, err = pc.Get(ctx, r)
+	require.NoError(t, err)
+	require.Equal(t, buf, got)
+	require.Equal(t, float64(1), lookupCount(rspb.CacheType_CAS, metrics.HitStatusLabel))
+
+	rc, err := pc.Reader(ctx, r, 0, 0)
+	require.NoError(t, err)
+	got, err = io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Equal(t, buf, got)
+	require.Equal(t, float64(2), lookupCount(rspb.CacheType_CAS, metrics.HitStatusLabel))
+
+	gotMulti, err := pc.GetMulti(ctx, []*rspb.ResourceName{r})
+	require.NoError(t, err)
+	require.Equal(t, buf, gotMulti[r.GetDigest()])
+	require.Equal(t, float64(3), lookupCount(rspb.CacheType_CAS, metrics.HitStatusLabel))
+
+	// Blobs larger than the max entry size always go to disk.
+	largeR, largeBuf := testdigest.RandomCASResourceBuf(t, 5_000)
+	require.NoError(t, pc.Set(ctx, largeR, largeBuf))
+	for i := 0; i < 2; i++ {
+		got, err := pc.Get(ctx, largeR)
+		require.NoError(t, err)
+		require.Equal(t, largeBuf, got)
+	}
+	require.Equal(t, float64(1), lookupCount(rspb.CacheType_CAS, metrics.MissStatusLabel))
+	require.Equal(t, float64(3), lookupCount(rspb.CacheType_CAS, metrics.HitStatusLabel))
+
+	// Overwriting an ActionResult invalidates the in-memory copy.
+	acR, acBuf := testdigest.RandomACResourceBuf(t, 100)
+	require.NoError(t, pc.Set(ctx, acR, acBuf))
+	for i := 0; i < 2; i++ {
+		got, err := pc.Get(ctx, acR)
+		require.NoError(t, err)
+		require.Equal(t, acBuf, got)
+	}
+	require.Equal(t, float64(1), lookupCount(rspb.CacheType_AC, metrics.HitStatusLabel))
+	_, newACBuf := testdigest.RandomACResourceBuf(t, 100)
+	require.NoError(t, pc.Set(ctx, acR, newACBuf))
+	got, err = pc.Get(ctx, acR)
+	require.NoError(t, err)
+	require.Equal(t, newACBuf, got)
+	require.Equal(t, float64(2), lookupCount(rspb.CacheType_AC, metrics.MissStatusLabel))
+}
+
 func TestLRU(t *testing.T) {
 	testCases := []struct {
 		desc                   string
@@ -3145,13 +3942,19 @@ func TestSampling(t *testing.T) {
 
 			// Now advance the clock past the min eviction age to allow eviction to
 			// kick in. The unencrypted test digest should be evicted.
-			clock.Advance(minEvictionAge - 1*time.Minute)
+			clock.Advance(minEvictionAge - 2*time.Minute)
 
 			for i := 0; ; i++ {
 				if exists, err := pc.Contains(anonCtx, rn); err == nil && !exists {
 					log.Infof("i = %d: unencrypted test digest is evicted", i)
 					break
 				}
+				// The sampler sleeps on the clock while the cache is empty,
+				// and may not have started sleeping when the clock was last
+				// advanced, so keep waking it. This stays well within the
+				// encrypted key's remaining 2 minutes before its min
+				// eviction age.
+				clock.Advance(pebble_cache.SamplerSleepDuration)
 				time.Sleep(100 * time.Millisecond)
 			}
 
@@ -0,0 +1,133 @@
+package pebble_cache
+
+import (
+	"context"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/raft/filestore"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/pebble"
+	"github.com/buildbuddy-io/buildbuddy/server/util/bazel_request"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	capb "github.com/buildbuddy-io/buildbuddy/proto/cache"
+	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
+)
+
+// provenanceKey returns the key under which the provenance of the AC entry
+// stored under key is recorded. Provenance records live in their own system
+// keyspace, next to (but outside of) the partition keyspaces, so that they're
+// never sampled for eviction or mistaken for cache entries.
+func provenanceKey(key filestore.PebbleKey) ([]byte, error) {
+	// Version5 keys are derived from every field that identifies an entry,
+	// so they're stable regardless of which version the entry is stored at.
+	keyBytes, err := key.Bytes(filestore.Version5)
+	if err != nil {
+		return nil, err
+	}
+	var k []byte
+	k = append(k, SystemKeyPrefix...)
+	k = append(k, []byte("provenance/")...)
+	k = append(k, keyBytes...)
+	return k, nil
+}
+
+func (p *PebbleCache) makeProvenance(ctx context.Context) *capb.CacheEntryProvenance {
+	rmd := bazel_request.GetRequestMetadata(ctx)
+	prov := &capb.CacheEntryProvenance{
+		InvocationId:   rmd.GetToolInvocationId(),
+		ActionId:       rmd.GetActionId(),
+		ActionMnemonic: rmd.GetActionMnemonic(),
+		TargetId:       rmd.GetTargetId(),
+		ToolName:       rmd.GetToolDetails().GetToolName(),
+		WriteUsec:      p.clock.Now().UnixMicro(),
+	}
+	if u, err := p.env.GetAuthenticator().AuthenticatedUser(ctx); err == nil {
+		prov.GroupId = u.GetGroupID()
+		prov.UserId = u.GetUserID()
+		prov.ApiKeyId = u.GetAPIKeyID()
+	}
+	return prov
+}
+
+// recordProvenance records who wrote the AC entry stored under key, unless a
+// previous writer was already recorded. The key must be locked for writing.
+//
+// Failing to record provenance doesn't fail the write.
+func (p *PebbleCache) recordProvenance(ctx context.Context, db pebble.IPebbleDB, key filestore.PebbleKey) {
+	if !p.recordACProvenance || key.CacheType() != rspb.CacheType_AC {
+		return
+	}
+	k, err := provenanceKey(key)
+	if err != nil {
+		log.CtxWarningf(ctx, "[%s] Could not record provenance for %q: %s", p.name, key.String(), err)
+		return
+	}
+	if _, err := pebble.GetCopy(db, k); err == nil {
+		return
+	} else if !status.IsNotFoundError(err) {
+		log.CtxWarningf(ctx, "[%s] Could not look up provenance for %q: %s", p.name, key.String(), err)
+		return
+	}
+	buf, err := proto.Marshal(p.makeProvenance(ctx))
+	if err != nil {
+		log.CtxWarningf(ctx, "[%s] Could not marshal provenance for %q: %s", p.name, key.String(), err)
+		return
+	}
+	if err := db.Set(k, buf, pebble.NoSync); err != nil {
+		log.CtxWarningf(ctx, "[%s] Could not record provenance for %q: %s", p.name, key.String(), err)
+	}
+}
+
+// deleteProvenance removes the provenance recorded for the entry stored under
+// key. It must be called whenever an AC entry is deleted or evicted, so that
+// the next writer of the entry is recorded as its first writer.
+func deleteProvenance(db pebble.IPebbleDB, key filestore.PebbleKey) error {
+	// Provenance may have been recorded while it was enabled, so clean it up
+	// regardless of whether it's currently being recorded.
+	if key.CacheType() != rspb.CacheType_AC {
+		return nil
+	}
+	k, err := provenanceKey(key)
+	if err != nil {
+		return err
+	}
+	return db.Delete(k, pebble.NoSync)
+}
+
+// Provenance returns who first wrote the given AC entry.
+func (p *PebbleCache) Provenance(ctx context.Context, r *rspb.ResourceName) (*capb.CacheEntryProvenance, error) {
+	if r.GetCacheType() != rspb.CacheType_AC {
+		return nil, status.InvalidArgumentError("provenance is only recorded for AC entries")
+	}
+	fileRecord, err := p.makeFileRecord(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	key, err := p.fileStorer.PebbleKey(fileRecord)
+	if err != nil {
+		return nil, err
+	}
+	k, err := provenanceKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := p.leaser.DB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	unlockFn := p.locker.RLock(key.LockID())
+	defer unlockFn()
+
+	prov := &capb.CacheEntryProvenance{}
+	if err := pebble.GetProto(db, k, prov); err != nil {
+		if status.IsNotFoundError(err) {
+			return nil, status.NotFoundErrorf("no provenance recorded for %q", r.GetDigest().GetHash())
+		}
+		return nil, err
+	}
+	return prov, nil
+}
@@ -336,6 +336,17 @@ func (p *StreamPubSub) Publish(ctx context.Context, channel *Channel, message st
 	return err
 }
 
+// Exists returns whether anything has been published on the channel (or, for
+// monitored channels, whether the channel has been created) and hasn't
+// expired.
+func (p *StreamPubSub) Exists(ctx context.Context, channel *Channel) (bool, error) {
+	n, err := p.rdb.Exists(ctx, channel.name).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
 func (p *StreamPubSub) Expire(ctx context.Context, channel *Channel, d time.Duration) error {
 	return p.rdb.Expire(ctx, channel.name, d).Err()
 }
@@ -365,7 +365,8 @@ func (d *UserDB) UpdateGroup(ctx context.Context, g *tables.Group) (string, erro
 			restrict_clean_workflow_runs_to_admins = ?,
 			enforce_ip_rules = ?,
 			is_parent = ?,
-			saml_idp_metadata_url = ?
+			saml_idp_metadata_url = ?,
+			invocation_retention_days = ?
 		WHERE group_id = ?`,
 		g.Name,
 		g.URLIdentifier,
@@ -382,6 +383,7 @@ func (d *UserDB) UpdateGroup(ctx context.Context, g *tables.Group) (string, erro
 		g.EnforceIPRules,
 		g.IsParent,
 		g.SamlIdpMetadataUrl,
+		g.InvocationRetentionDays,
 		g.GroupID,
 	).Exec().Error
 	if err != nil {
@@ -466,7 +468,7 @@ func (d *UserDB) RequestToJoinGroup(ctx context.Context, groupID string) (grpb.G
 		// If the org has an owned domain that matches the user's email,
 		// the user can join directly as a member.
 		membershipStatus = grpb.GroupMembershipStatus_REQUESTED
-		if !u.IsSAML() && group.OwnedDomain != "" && group.OwnedDomain == getEmailDomain(tu.Email) {
+		if !u.IsSAML() && tu.ProviderGroupID == "" && group.OwnedDomain != "" && group.OwnedDomain == getEmailDomain(tu.Email) {
 			membershipStatus = grpb.GroupMembershipStatus_MEMBER
 			return d.addUserToGroup(ctx, tx, userID, groupID)
 		}
@@ -707,12 +709,17 @@ func (d *UserDB) createUser(ctx context.Context, tx interfaces.DB, u *tables.Use
 	}
 
 	groupIDs := make([]string, 0)
+	// Roles that the authenticator explicitly assigned, by group ID.
+	groupRoles := make(map[string]role.Role)
 	for _, group := range u.Groups {
 		hydratedGroup, err := d.getGroupByURLIdentifier(ctx, tx, group.Group.URLIdentifier)
 		if err != nil {
 			return err
 		}
 		groupIDs = append(groupIDs, hydratedGroup.GroupID)
+		if group.Role != uint32(role.None) {
+			groupRoles[hydratedGroup.GroupID] = role.Role(group.Role)
+		}
 	}
 
 	// If the user signed up using an authenticator associated with a group (i.e. SAML or OIDC SSO),
@@ -759,14 +766,22 @@ func (d *UserDB) createUser(ctx context.Context, tx interfaces.DB, u *tables.Use
 	}
 
 	for _, groupID := range groupIDs {
+		r, ok := groupRoles[groupID]
+		if !ok {
+			r = role.Default
+		}
 		err := tx.NewQuery(ctx, "userdb_new_user_create_groups").Raw(`
 			INSERT INTO "UserGroups" (user_user_id, group_group_id, membership_status, role)
 			VALUES (?, ?, ?, ?)
-			`, u.UserID, groupID, int32(grpb.GroupMembershipStatus_MEMBER), uint32(role.Default),
+			`, u.UserID, groupID, int32(grpb.GroupMembershipStatus_MEMBER), uint32(r),
 		).Exec().Error
 		if err != nil {
 			return err
 		}
+		// Keep roles that were explicitly assigned.
+		if ok {
+			continue
+		}
 		// Promote from default role to admin if the user is the only one in the
 		// group after joining.
 		preExistingUsers := &struct{ Count int64 }{}
@@ -456,6 +456,36 @@ func TestCreateUser_OnPrem_OnlyFirstUserCreatedShouldBeMadeAdminOfDefaultGroup(t
 	require.Equal(t, grpb.Group_DEVELOPER_ROLE, us2.Role, "second user added to the default group should have the default role")
 }
 
+func TestCreateUser_ExplicitGroupRole(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	udb := env.GetUserDB()
+	createUser(t, ctx, env, "US1", "org1.io")
+	ctx1 := authUserCtx(ctx, env, t, "US1")
+	setUserOwnedKeysEnabled(t, ctx1, env, "GR1", false)
+	slug := getGroup(t, ctx1, env).Group.URLIdentifier
+
+	// Users that join with an explicit role get that role, even if they are
+	// the only member of the group.
+	createUser(t, ctx, env, "US2", "org2.io")
+	ctx2 := authUserCtx(ctx, env, t, "US2")
+	setUserOwnedKeysEnabled(t, ctx2, env, "GR2", false)
+	slug2 := getGroup(t, ctx2, env).Group.URLIdentifier
+	err := udb.InsertUser(ctx, &tables.User{
+		UserID: "US3",
+		SubID:  "US3-SubID",
+		Email:  "US3@org1.io",
+		Groups: []*tables.GroupRole{
+			{Group: tables.Group{URLIdentifier: slug}, Role: uint32(role.Reader)},
+			{Group: tables.Group{URLIdentifier: slug2}},
+		},
+	})
+	require.NoError(t, err)
+	ctx3 := authUserCtx(ctx, env, t, "US3")
+	require.Equal(t, role.Reader, role.Role(getGroupRole(t, ctx3, env, "GR1").Role))
+	require.Equal(t, role.Developer, role.Role(getGroupRole(t, ctx3, env, "GR2").Role))
+}
+
 func TestUpdateGroup(t *testing.T) {
 	env := newTestEnv(t)
 	flags.Set(t, "app.create_group_per_user", true)
@@ -760,11 +790,13 @@ func TestCreateAndGetAPIKey(t *testing.T) {
 	adminOnlyKey, err := adb.CreateAPIKey(
 		ctx1, groupID1, "Admin-only key",
 		[]akpb.ApiKey_Capability{akpb.ApiKey_CACHE_WRITE_CAPABILITY},
+		nil, /*=scopes*/
 		false /*=visibleToDevelopers*/)
 	require.NoError(t, err)
 	developerKey, err := adb.CreateAPIKey(
 		ctx1, groupID1, "Developer key",
 		[]akpb.ApiKey_Capability{akpb.ApiKey_CAS_WRITE_CAPABILITY},
+		nil, /*=scopes*/
 		true /*=visibleToDevelopers*/)
 	require.NoError(t, err)
 
@@ -811,6 +843,7 @@ func TestCreateAndGetAPIKey(t *testing.T) {
 	_, err = adb.CreateAPIKey(
 		ctx2, groupID1, "test-label-2",
 		[]akpb.ApiKey_Capability{akpb.ApiKey_CACHE_WRITE_CAPABILITY},
+		nil, /*=scopes*/
 		false /*=visibleToDevelopers*/)
 	require.Truef(
 		t, status.IsPermissionDeniedError(err),
@@ -820,6 +853,7 @@ func TestCreateAndGetAPIKey(t *testing.T) {
 	_, err = adb.CreateAPIKey(
 		ctx3, groupID1, "test-label-3",
 		[]akpb.ApiKey_Capability{akpb.ApiKey_CACHE_WRITE_CAPABILITY},
+		nil, /*=scopes*/
 		false /*=visibleToDevelopers*/)
 	require.Truef(
 		t, status.IsPermissionDeniedError(err),
@@ -904,7 +938,7 @@ func TestDeleteAPIKey(t *testing.T) {
 
 	uk3, err := adb.CreateUserAPIKey(
 		ctx3, gr1.Group.GroupID, "US3", "US3's Key",
-		[]akpb.ApiKey_Capability{akpb.ApiKey_CAS_WRITE_CAPABILITY})
+		[]akpb.ApiKey_Capability{akpb.ApiKey_CAS_WRITE_CAPABILITY}, nil /*=scopes*/)
 	require.NoError(t, err, "create a US3-owned key in org1")
 
 	err = adb.DeleteAPIKey(ctx1, uk3.APIKeyID)
@@ -963,7 +997,7 @@ func TestUserOwnedKeys_GetUpdateDeletePermissions(t *testing.T) {
 			ownerGroup := getGroup(t, ownerCtx, env).Group
 			ownerKey, err := adb.CreateUserAPIKey(
 				ownerCtx, ownerGroup.GroupID, test.Owner, test.Owner+"'s key",
-				[]akpb.ApiKey_Capability{akpb.ApiKey_CAS_WRITE_CAPABILITY},
+				[]akpb.ApiKey_Capability{akpb.ApiKey_CAS_WRITE_CAPABILITY}, nil, /*=scopes*/
 			)
 			require.NoError(t, err)
 
@@ -1046,7 +1080,7 @@ func TestUserOwnedKeys_RespectsEnabledSetting(t *testing.T) {
 	// Try to create a user-owned key; should fail by default.
 	_, err := adb.CreateUserAPIKey(
 		ctx1, gr1.GroupID, "US1", "US1's key",
-		[]akpb.ApiKey_Capability{akpb.ApiKey_CAS_WRITE_CAPABILITY})
+		[]akpb.ApiKey_Capability{akpb.ApiKey_CAS_WRITE_CAPABILITY}, nil /*=scopes*/)
 	require.Truef(
 		t, status.IsPermissionDeniedError(err),
 		"expected PermissionDenied since user-owned keys are not enabled; got: %v",
@@ -1057,7 +1091,7 @@ func TestUserOwnedKeys_RespectsEnabledSetting(t *testing.T) {
 
 	key1, err := adb.CreateUserAPIKey(
 		ctx1, gr1.GroupID, "US1", "US1's key",
-		[]akpb.ApiKey_Capability{akpb.ApiKey_CAS_WRITE_CAPABILITY})
+		[]akpb.ApiKey_Capability{akpb.ApiKey_CAS_WRITE_CAPABILITY}, nil /*=scopes*/)
 	require.NoError(
 		t, err,
 		"should be able to create a user-owned key after enabling the setting")
@@ -1125,7 +1159,7 @@ func TestUserOwnedKeys_RemoveUserFromGroup_KeyNoLongerWorks(t *testing.T) {
 
 	us2Key, err := adb.CreateUserAPIKey(
 		ctx2, gr1.GroupID, "US2", "US2's key",
-		[]akpb.ApiKey_Capability{akpb.ApiKey_CAS_WRITE_CAPABILITY})
+		[]akpb.ApiKey_Capability{akpb.ApiKey_CAS_WRITE_CAPABILITY}, nil /*=scopes*/)
 	require.NoError(t, err, "US2 should be able to create a user-owned key")
 
 	_, err = env.GetAuthDB().GetAPIKeyGroupFromAPIKey(ctx, us2Key.Value)
@@ -1164,7 +1198,7 @@ func TestUserOwnedKeys_ChangeRole_UpdatesCapabilities(t *testing.T) {
 	require.NoError(t, err)
 	us1Key, err := adb.CreateUserAPIKey(
 		ctx1, gr1.GroupID, "US1", "",
-		[]akpb.ApiKey_Capability{akpb.ApiKey_CACHE_WRITE_CAPABILITY})
+		[]akpb.ApiKey_Capability{akpb.ApiKey_CACHE_WRITE_CAPABILITY}, nil /*=scopes*/)
 	require.NoError(t, err, "US1 should be able to create a user-owned key")
 
 	_, err = env.GetAuthDB().GetAPIKeyGroupFromAPIKey(ctx, us1Key.Value)
@@ -1233,7 +1267,7 @@ func TestUserOwnedKeys_CreateAndUpdateCapabilities(t *testing.T) {
 			// Test create with capabilities
 
 			key, err := adb.CreateUserAPIKey(
-				ctx1, g.GroupID, "US1", "US1's key", test.Capabilities)
+				ctx1, g.GroupID, "US1", "US1's key", test.Capabilities, nil /*=scopes*/)
 			if test.OK {
 				require.NoError(t, err)
 				// Read back the capabilities, make sure they took effect.
@@ -1251,7 +1285,7 @@ func TestUserOwnedKeys_CreateAndUpdateCapabilities(t *testing.T) {
 
 			key, err = adb.CreateUserAPIKey(
 				ctx1, g.GroupID, "US1", "US1's key",
-				[]akpb.ApiKey_Capability{})
+				[]akpb.ApiKey_Capability{}, nil /*=scopes*/)
 			require.NoError(t, err)
 			key.Capabilities = capabilities.ToInt(test.Capabilities)
 			err = adb.UpdateAPIKey(ctx1, key)
@@ -1290,7 +1324,7 @@ func TestUserOwnedKeys_NotReturnedByGroupLevelAPIs(t *testing.T) {
 	}
 
 	// Create a user-level key.
-	_, err = adb.CreateUserAPIKey(ctx1, g.GroupID, "US1", "test-personal-key", nil /*=capabilities*/)
+	_, err = adb.CreateUserAPIKey(ctx1, g.GroupID, "US1", "test-personal-key", nil /*=capabilities*/, nil /*=scopes*/)
 	require.NoError(t, err)
 
 	// Test all group-level APIs; none should return the user-level key we
@@ -1383,7 +1417,7 @@ func TestUserOwnedKeys_CreateForOtherUser(t *testing.T) {
 				ctx1 := authUserCtx(ctx, env, t, "US1")
 				g := getGroup(t, ctx1, env).Group
 				setUserOwnedKeysEnabled(t, ctx1, env, g.GroupID, true)
-				k1, err := adb.CreateAPIKey(ctx1, "GR1", "", test.AuthKeyCaps, false)
+				k1, err := adb.CreateAPIKey(ctx1, "GR1", "", test.AuthKeyCaps, nil /*=scopes*/, false)
 				require.NoError(t, err)
 				keys["GR1"] = k1
 			}
@@ -1393,7 +1427,7 @@ func TestUserOwnedKeys_CreateForOtherUser(t *testing.T) {
 				ctx2 := authUserCtx(ctx, env, t, "US2")
 				g := getGroup(t, ctx2, env).Group
 				setUserOwnedKeysEnabled(t, ctx2, env, g.GroupID, true)
-				k2, err := adb.CreateAPIKey(ctx2, "GR2", "", test.AuthKeyCaps, false)
+				k2, err := adb.CreateAPIKey(ctx2, "GR2", "", test.AuthKeyCaps, nil /*=scopes*/, false)
 				require.NoError(t, err)
 				keys["GR2"] = k2
 				takeOwnershipOfDomain(t, ctx2, env, "US2")
@@ -1407,7 +1441,7 @@ func TestUserOwnedKeys_CreateForOtherUser(t *testing.T) {
 			} else {
 				authCtx = authUserCtx(ctx, env, t, test.AuthUserID)
 			}
-			k, err := adb.CreateUserAPIKey(authCtx, test.KeyGroupID, test.KeyUserID, "" /*=label*/, test.KeyCaps)
+			k, err := adb.CreateUserAPIKey(authCtx, test.KeyGroupID, test.KeyUserID, "" /*=label*/, test.KeyCaps, nil /*=scopes*/)
 			assert.Equal(t, test.Code.String(), gstatus.Code(err).String(), "%s", err)
 			if err == nil {
 				assert.Equal(t, test.KeyUserID, k.UserID)
@@ -1851,6 +1885,7 @@ func TestChildGroupAuth(t *testing.T) {
 	key1, err := env.GetAuthDB().CreateAPIKey(
 		ctx1, us1Group.GroupID, "admin",
 		[]akpb.ApiKey_Capability{akpb.ApiKey_ORG_ADMIN_CAPABILITY},
+		nil, /*=scopes*/
 		false /*=visibleToDevelopers*/)
 	require.NoError(t, err)
 	adminCtx1 := env.GetAuthenticator().AuthContextFromAPIKey(ctx, key1.Value)
@@ -1861,6 +1896,7 @@ func TestChildGroupAuth(t *testing.T) {
 	key2, err := env.GetAuthDB().CreateAPIKey(
 		ctx2, us2Group.GroupID, "admin",
 		[]akpb.ApiKey_Capability{akpb.ApiKey_ORG_ADMIN_CAPABILITY},
+		nil, /*=scopes*/
 		false /*=visibleToDevelopers*/)
 	require.NoError(t, err)
 	//adminCtx2 := env.GetAuthenticator().AuthContextFromAPIKey(ctx, key2.Value)
@@ -111,13 +111,59 @@ func (u *Uploader) uploadDirectory(namedSetID, root string) error {
 		return err
 	}
 
+	files, err := u.waitForUploads(uploadChans)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		// No artifacts uploaded; don't publish an unnecessary event
+		return nil
+	}
+	return u.bep.Publish(&bespb.BuildEvent{
+		Id: &bespb.BuildEventId{Id: &bespb.BuildEventId_NamedSet{
+			NamedSet: &bespb.BuildEventId_NamedSetOfFilesId{Id: namedSetID},
+		}},
+		Payload: &bespb.BuildEvent_NamedSetOfFiles{NamedSetOfFiles: &bespb.NamedSetOfFiles{
+			Files: files,
+		}},
+	})
+}
+
+// UploadWorkflowArtifact uploads the given files in the background, and
+// publishes them as a WorkflowArtifactPublished event with the given name.
+// File names are computed as their path relative to the root directory.
+func (u *Uploader) UploadWorkflowArtifact(name, root string, paths []string) {
+	u.eg.Go(func() error {
+		uploadChans := make([]chan *Result, 0, len(paths))
+		for _, p := range paths {
+			uploadChans = append(uploadChans, u.uploadFile(name, filepath.Join(root, p), p))
+		}
+		files, err := u.waitForUploads(uploadChans)
+		if err != nil {
+			return err
+		}
+		return u.bep.Publish(&bespb.BuildEvent{
+			Id: &bespb.BuildEventId{Id: &bespb.BuildEventId_WorkflowArtifactPublished{
+				WorkflowArtifactPublished: &bespb.BuildEventId_WorkflowArtifactPublishedId{Name: name},
+			}},
+			Payload: &bespb.BuildEvent_WorkflowArtifactPublished{WorkflowArtifactPublished: &bespb.WorkflowArtifactPublished{
+				Name:  name,
+				Files: files,
+			}},
+		})
+	})
+}
+
+// waitForUploads waits for the given uploads to complete, and returns the
+// uploaded files.
+func (u *Uploader) waitForUploads(uploadChans []chan *Result) ([]*bespb.File, error) {
 	var files []*bespb.File
 	for _, uploadChan := range uploadChans {
 		r := <-uploadChan
 		rn := digest.NewResourceName(r.Digest, u.instanceName, rspb.CacheType_CAS, repb.DigestFunction_SHA256)
 		rnString, err := rn.DownloadString()
 		if err != nil {
-			return err
+			return nil, err
 		}
 		uri := fmt.Sprintf("%s/%s", u.bytestreamURIPrefix, rnString)
 		f := &bespb.File{
@@ -128,18 +174,7 @@ func (u *Uploader) uploadDirectory(namedSetID, root string) error {
 		}
 		files = append(files, f)
 	}
-	if len(files) == 0 {
-		// No artifacts uploaded; don't publish an unnecessary event
-		return nil
-	}
-	return u.bep.Publish(&bespb.BuildEvent{
-		Id: &bespb.BuildEventId{Id: &bespb.BuildEventId_NamedSet{
-			NamedSet: &bespb.BuildEventId_NamedSetOfFilesId{Id: namedSetID},
-		}},
-		Payload: &bespb.BuildEvent_NamedSetOfFiles{NamedSetOfFiles: &bespb.NamedSetOfFiles{
-			Files: files,
-		}},
-	})
+	return files, nil
 }
 
 // uploadFile starts a background file upload.
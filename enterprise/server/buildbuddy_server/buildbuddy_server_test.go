@@ -54,6 +54,7 @@ func TestCreateGroup(t *testing.T) {
 	adminKey, err := te.GetAuthDB().CreateAPIKey(
 		userCtx, parentGroup.GroupID, "admin",
 		[]akpb.ApiKey_Capability{akpb.ApiKey_ORG_ADMIN_CAPABILITY},
+		nil, /*=scopes*/
 		false /*=visibleToDevelopers*/)
 	require.NoError(t, err)
 	adminKeyCtx := te.GetAuthenticator().AuthContextFromAPIKey(ctx, adminKey.Value)
@@ -87,3 +88,51 @@ func TestCreateGroup(t *testing.T) {
 	require.Equal(t, parentGroup.SamlIdpMetadataUrl, g.SamlIdpMetadataUrl)
 	require.False(t, g.IsParent)
 }
+
+func TestUpdateApiKeyKeepsScopes(t *testing.T) {
+	te := enterprise_testenv.New(t)
+	enterprise_testauth.Configure(t, te)
+	ctx := context.Background()
+
+	flags.Set(t, "app.create_group_per_user", true)
+	flags.Set(t, "app.no_default_user_group", true)
+
+	err := te.GetUserDB().InsertUser(ctx, &tables.User{UserID: "US1", SubID: "US1SubID"})
+	require.NoError(t, err)
+	userCtx := authUserCtx(ctx, te, t, "US1")
+	g := getGroup(t, userCtx, te).Group
+
+	keyScopes := []akpb.ApiKey_Scope{akpb.ApiKey_CACHE_READ_SCOPE, akpb.ApiKey_BES_WRITE_SCOPE}
+	key, err := te.GetAuthDB().CreateAPIKey(
+		userCtx, g.GroupID, "scoped",
+		[]akpb.ApiKey_Capability{akpb.ApiKey_CACHE_WRITE_CAPABILITY},
+		keyScopes, false /*=visibleToDevelopers*/)
+	require.NoError(t, err)
+
+	server, err := buildbuddy_server.NewBuildBuddyServer(te, nil)
+	require.NoError(t, err)
+
+	// Updating only the label should keep the scopes of the key.
+	_, err = server.UpdateApiKey(userCtx, &akpb.UpdateApiKeyRequest{
+		Id:         key.APIKeyID,
+		Label:      "renamed",
+		Capability: []akpb.ApiKey_Capability{akpb.ApiKey_CACHE_WRITE_CAPABILITY},
+	})
+	require.NoError(t, err)
+	updated, err := te.GetAuthDB().GetAPIKey(userCtx, key.APIKeyID)
+	require.NoError(t, err)
+	require.Equal(t, "renamed", updated.Label)
+	require.Equal(t, key.Scopes, updated.Scopes)
+
+	// Setting an empty list of scopes should lift the restriction.
+	_, err = server.UpdateApiKey(userCtx, &akpb.UpdateApiKeyRequest{
+		Id:         key.APIKeyID,
+		Label:      "renamed",
+		Capability: []akpb.ApiKey_Capability{akpb.ApiKey_CACHE_WRITE_CAPABILITY},
+		Scopes:     &akpb.ApiKeyScopes{},
+	})
+	require.NoError(t, err)
+	updated, err = te.GetAuthDB().GetAPIKey(userCtx, key.APIKeyID)
+	require.NoError(t, err)
+	require.Equal(t, int32(0), updated.Scopes)
+}
@@ -94,6 +94,10 @@ const (
 	// stream.
 	artifactsDirEnvVarName = "BUILDBUDDY_ARTIFACTS_DIRECTORY"
 
+	// The maximum number of files published for each artifact declared by
+	// an action.
+	maxArtifactFiles = 1000
+
 	defaultGitRemoteName = "origin"
 	forkGitRemoteName    = "fork"
 
@@ -101,6 +105,10 @@ const (
 	// depth required.
 	smartFetchDepth = -1
 
+	// Trigger event of merge queue runs, which test a pull request merged into
+	// the latest target branch.
+	mergeQueueEventName = "merge_queue"
+
 	// Env vars set by workflow runner
 	// NOTE: These env vars are not populated for non-private repos.
 
@@ -169,7 +177,7 @@ var (
 	// Flags to configure setting up git repo
 	triggerEvent    = flag.String("trigger_event", "", "Event type that triggered the action runner.")
 	pushedRepoURL   = flag.String("pushed_repo_url", "", "URL of the pushed repo. This is required.")
-	pushedBranch    = flag.String("pushed_branch", "", "Branch name of the commit to be checked out.")
+	pushedBranch    = flag.String("pushed_branch", "", "Branch name of the commit to be checked out. May also be a full ref, such as a Gerrit change ref (refs/changes/23/123/2).")
 	commitSHA       = flag.String("commit_sha", "", "Commit SHA to report statuses for.")
 	prNumber        = flag.Int64("pull_request_number", 0, "PR number, if applicable (0 if not triggered by a PR).")
 	patchURIs       = flag.Slice("patch_uri", []string{}, "URIs of patches to apply to the repo after checkout. Can be specified multiple times to apply multiple patches.")
@@ -177,8 +185,12 @@ var (
 	gitFetchFilters = flag.Slice("git_fetch_filters", []string{}, "Filters to apply to `git fetch` commands.")
 	gitFetchDepth   = flag.Int("git_fetch_depth", smartFetchDepth, "Depth to use for `git fetch` commands.")
 	// Flags to configure merge-with-base behavior
-	targetRepoURL = flag.String("target_repo_url", "", "If different from pushed_repo_url, indicates a fork (`pushed_repo_url`) is being merged into this repo.")
-	targetBranch  = flag.String("target_branch", "", "If different from pushed_branch, pushed_branch should be merged into this branch in the target repo.")
+	targetRepoURL   = flag.String("target_repo_url", "", "If different from pushed_repo_url, indicates a fork (`pushed_repo_url`) is being merged into this repo.")
+	targetBranch    = flag.String("target_branch", "", "If different from pushed_branch, pushed_branch should be merged into this branch in the target repo.")
+	mergeCommitSHAs = flag.Slice("merge_commit_sha", []string{}, "Commits in the target repo to merge after merging the target branch, such as the other pull requests of a merge queue batch. Can be specified multiple times.")
+	// Flags to configure path filtering
+	filterChangedPaths  = flag.Bool("filter_changed_paths", false, "If set, skip the action's commands if none of the changed files match the action's path filters.")
+	changedFilesBaseSHA = flag.String("changed_files_base_sha", "", "Commit to compare against when computing the changed files for `filter_changed_paths`. Defaults to the target branch if unset.")
 
 	shutdownAndExit = flag.Bool("shutdown_and_exit", false, "If set, runs bazel shutdown with the configured bazel_command, and exits. No other commands are run.")
 
@@ -253,6 +265,10 @@ type workspace struct {
 	// reported for all action logs instead of actually executing the action.
 	setupError error
 
+	// Why the action's commands are skipped, or "" if they should run. This
+	// is set if none of the changed files match the action's path filters.
+	skipReason string
+
 	// The start time of the setup phase.
 	startTime time.Time
 
@@ -969,9 +985,18 @@ func (ar *actionRunner) Run(ctx context.Context, ws *workspace) error {
 	if err != nil {
 		return err
 	}
+	statusName := ""
+	if *serializedAction != "" {
+		a, err := deserializeAction(*serializedAction)
+		if err != nil {
+			return err
+		}
+		statusName = a.StatusName
+	}
 	wfc := &bespb.WorkflowConfigured{
 		WorkflowId:         *workflowID,
 		ActionName:         actionName,
+		StatusName:         statusName,
 		ActionTriggerEvent: *triggerEvent,
 		PushedRepoUrl:      *pushedRepoURL,
 		PushedBranch:       *pushedBranch,
@@ -1047,7 +1072,7 @@ func (ar *actionRunner) Run(ctx context.Context, ws *workspace) error {
 	// will execute the configured bazel commands. Otherwise, the runner will
 	// exit early without running those commands and does not need to create
 	// invocation streams for them.
-	if ws.setupError == nil {
+	if ws.setupError == nil && ws.skipReason == "" {
 		for _, bazelCmd := range action.BazelCommands {
 			iid, err := newUUID()
 			if err != nil {
@@ -1070,6 +1095,10 @@ func (ar *actionRunner) Run(ctx context.Context, ws *workspace) error {
 	if ws.setupError != nil {
 		return ws.setupError
 	}
+	if ws.skipReason != "" {
+		writeCommandSummary(ar.reporter, "Skipping action: %s", ws.skipReason)
+		return nil
+	}
 
 	uploader := ar.reporter.uploader
 	// Log upload results at the end of all Bazel commands.
@@ -1092,6 +1121,9 @@ func (ar *actionRunner) Run(ctx context.Context, ws *workspace) error {
 				units.HumanSize(float64(u.Digest.SizeBytes)), u.Duration)
 		}
 	}()
+	// Publish the artifacts declared by the action once its commands have
+	// run, whether or not they succeeded.
+	defer ar.publishArtifacts(ws, action)
 
 	for i, step := range action.Steps {
 		cmdStartTime := time.Now()
@@ -1366,6 +1398,37 @@ func (ar *actionRunner) Run(ctx context.Context, ws *workspace) error {
 	return nil
 }
 
+// publishArtifacts uploads the files matched by each artifact declared by the
+// action, and publishes them so that they're copied to durable storage once
+// the invocation is complete.
+func (ar *actionRunner) publishArtifacts(ws *workspace, action *config.Action) {
+	if len(action.Artifacts) == 0 {
+		return
+	}
+	uploader := ar.reporter.uploader
+	if uploader == nil {
+		ar.reporter.Printf("WARNING: not publishing artifacts since no cache backend is configured")
+		return
+	}
+	root := filepath.Join(ws.rootDir, repoDirName)
+	for _, artifact := range action.Artifacts {
+		paths, err := artifact.MatchFiles(root)
+		if err != nil {
+			ar.reporter.Printf("WARNING: failed to find the files of artifact %q: %s", artifact.Name, err)
+			continue
+		}
+		if len(paths) == 0 {
+			ar.reporter.Printf("WARNING: no files matched the paths of artifact %q", artifact.Name)
+			continue
+		}
+		if len(paths) > maxArtifactFiles {
+			ar.reporter.Printf("WARNING: only publishing the first %d of the %d files of artifact %q", maxArtifactFiles, len(paths), artifact.Name)
+			paths = paths[:maxArtifactFiles]
+		}
+		uploader.UploadWorkflowArtifact(artifact.Name, root, paths) // does not return an error
+	}
+}
+
 func (ar *actionRunner) workspaceStatusEvent() *bespb.BuildEvent {
 	buildUser := os.Getenv("BUILD_USER")
 	if buildUser == "" {
@@ -1988,6 +2051,17 @@ func (ws *workspace) sync(ctx context.Context) error {
 			return err
 		}
 		writeCommandSummary(ws.log, "Merged into the target branch %s. HEAD is now at %s.", *targetBranch, mergedCommitSHA)
+		if ws.setupError == nil && len(*mergeCommitSHAs) > 0 {
+			if err := ws.mergeCommits(ctx, *mergeCommitSHAs); err != nil {
+				return err
+			}
+		}
+	}
+
+	if *filterChangedPaths && ws.setupError == nil {
+		if err := ws.applyPathFilter(ctx, action); err != nil {
+			return err
+		}
 	}
 
 	if len(*patchURIs) > 0 {
@@ -2007,8 +2081,93 @@ func (ws *workspace) sync(ctx context.Context) error {
 }
 
 func (ws *workspace) shouldMergeBranches(actionTriggers *config.Triggers) bool {
-	return actionTriggers.GetPullRequestTrigger().GetMergeWithBase() &&
-		ws.hasMultipleBranches()
+	// Merge queue runs always test the pull request merged into the latest
+	// target branch.
+	mergeWithBase := actionTriggers.GetPullRequestTrigger().GetMergeWithBase() || *triggerEvent == mergeQueueEventName
+	return mergeWithBase && ws.hasMultipleBranches()
+}
+
+// mergeCommits merges the given commits of the target repo, in order, into
+// the checked out branch. A merge conflict is recorded as a setup error.
+func (ws *workspace) mergeCommits(ctx context.Context, shas []string) error {
+	// Fetch with --depth=0 to ensure the merge base commits are fetched
+	if err := ws.fetch(ctx, *targetRepoURL, shas, 0 /*=fetchDepth*/); err != nil {
+		return status.WrapError(err, "fetch merge commits")
+	}
+	for _, sha := range shas {
+		if _, err := git(ctx, ws.log, "merge", "--no-edit", sha); err != nil && !isAlreadyUpToDate(err) {
+			errMsg := err.Output
+			if _, err := git(ctx, ws.log, "merge", "--abort"); err != nil {
+				errMsg += "\n" + err.Output
+			}
+			ws.setupError = status.FailedPreconditionErrorf(
+				"Merge conflict between %q and commit %s.\n\n%s",
+				*pushedBranch, sha, errMsg,
+			)
+			return nil
+		}
+	}
+	mergedCommitSHA, err := git(ctx, io.Discard, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	writeCommandSummary(ws.log, "Merged %d other pull request(s) in the merge queue. HEAD is now at %s.", len(shas), mergedCommitSHA)
+	return nil
+}
+
+// applyPathFilter computes the files changed by the pushed commit, and marks
+// the action as skipped if none of them match the action's path filters. If
+// the changed files can't be determined, the action runs as usual.
+func (ws *workspace) applyPathFilter(ctx context.Context, action *config.Action) error {
+	filter := config.GetPathFilter(action, *triggerEvent)
+	if filter == nil {
+		return nil
+	}
+	baseRef := *changedFilesBaseSHA
+	if baseRef != "" {
+		baseRepoURL := *targetRepoURL
+		if baseRepoURL == "" {
+			baseRepoURL = *pushedRepoURL
+		}
+		// Fetch with --depth=0 to ensure the merge base commit is fetched
+		if err := ws.fetch(ctx, baseRepoURL, []string{baseRef}, 0 /*=fetchDepth*/); err != nil {
+			writeCommandSummary(ws.log, "WARNING: failed to fetch base commit %s, so path filters are ignored: %s", baseRef, err)
+			return nil
+		}
+	} else if ws.hasMultipleBranches() {
+		if err := ws.fetchTargetRef(ctx); err != nil {
+			writeCommandSummary(ws.log, "WARNING: failed to fetch target branch %s, so path filters are ignored: %s", *targetBranch, err)
+			return nil
+		}
+		baseRef = fmt.Sprintf("%s/%s", gitRemoteName(*targetRepoURL), *targetBranch)
+	} else {
+		writeCommandSummary(ws.log, "WARNING: could not determine the changed files, so path filters are ignored.")
+		return nil
+	}
+	// Compare against the pushed commit rather than HEAD, so that changes
+	// merged in from the target branch aren't counted.
+	output, err := git(ctx, io.Discard, "diff", "--name-only", "--no-renames", baseRef+"..."+*commitSHA)
+	if err != nil {
+		writeCommandSummary(ws.log, "WARNING: failed to compute changed files, so path filters are ignored: %s", err)
+		return nil
+	}
+	var changedFiles []string
+	for _, line := range strings.Split(output, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			changedFiles = append(changedFiles, line)
+		}
+	}
+	matches, filterErr := filter.MatchesChangedFiles(changedFiles)
+	if filterErr != nil {
+		ws.setupError = status.InvalidArgumentErrorf("Invalid path filter for action %q: %s", action.Name, filterErr)
+		return nil
+	}
+	if !matches {
+		ws.skipReason = fmt.Sprintf("none of the %d changed file(s) match the path filters.", len(changedFiles))
+		return nil
+	}
+	writeCommandSummary(ws.log, "Changed files match the path filters.")
+	return nil
 }
 
 func (ws *workspace) hasMultipleBranches() bool {
@@ -2026,8 +2185,10 @@ func (ws *workspace) fetchPushedRef(ctx context.Context) error {
 	}
 
 	refToFetch := *commitSHA
-	if refToFetch == "" {
-		refToFetch = *pushedBranch
+	if refToFetch == "" || isFullRef(*pushedBranch) {
+		// Full refs such as Gerrit's refs/changes/* aren't advertised as
+		// branches, so fetch the ref itself rather than its commit.
+		refToFetch = pushedRefSpec()
 	}
 
 	// If the merge commit has not been generated, fetch the full history
@@ -2044,9 +2205,9 @@ func (ws *workspace) fetchPushedRef(ctx context.Context) error {
 			writeCommandSummary(ws.log, "Git does not support fetching non-HEAD commits by default."+
 				" You must set the `uploadpack.allowAnySHA1InWant`"+
 				" config option in the repo that is being fetched.")
-			if refToFetch != *pushedBranch && *pushedBranch != "" {
+			if refToFetch != pushedRefSpec() && *pushedBranch != "" {
 				writeCommandSummary(ws.log, "Attempting to fetch the branch with --depth=0 instead...")
-				refToFetch = *pushedBranch
+				refToFetch = pushedRefSpec()
 				fetchDepth = 0
 				return ws.fetch(ctx, *pushedRepoURL, []string{refToFetch}, fetchDepth)
 			}
@@ -2064,10 +2225,10 @@ func (ws *workspace) fetchTargetRef(ctx context.Context) error {
 
 // checkoutRef checks out a reference that the rest of the remote run should run off
 func (ws *workspace) checkoutRef(ctx context.Context) error {
-	checkoutLocalBranchName := *pushedBranch
+	checkoutLocalBranchName := localBranchName(*pushedBranch)
 	checkoutRef := *commitSHA
 	if checkoutRef == "" {
-		checkoutRef = fmt.Sprintf("%s/%s", gitRemoteName(*pushedRepoURL), *pushedBranch)
+		checkoutRef = fmt.Sprintf("%s/%s", gitRemoteName(*pushedRepoURL), localBranchName(*pushedBranch))
 	}
 
 	if checkoutLocalBranchName != "" {
@@ -2083,6 +2244,31 @@ func (ws *workspace) checkoutRef(ctx context.Context) error {
 	return nil
 }
 
+// isFullRef returns whether the pushed branch is a full ref name, such as a
+// Gerrit change ref (refs/changes/23/123/2), rather than a branch name.
+func isFullRef(branch string) bool {
+	return strings.HasPrefix(branch, "refs/")
+}
+
+// localBranchName returns the name of the local branch that the pushed branch
+// is checked out to.
+func localBranchName(branch string) string {
+	if !isFullRef(branch) {
+		return branch
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(branch, "refs/heads/"), "refs/")
+}
+
+// pushedRefSpec returns the refspec that fetches the pushed branch. Full refs
+// aren't covered by the remote's default refspec, so they're explicitly
+// fetched into the remote-tracking ref that checkoutRef uses.
+func pushedRefSpec() string {
+	if !isFullRef(*pushedBranch) {
+		return *pushedBranch
+	}
+	return fmt.Sprintf("+%s:refs/remotes/%s/%s", *pushedBranch, gitRemoteName(*pushedRepoURL), localBranchName(*pushedBranch))
+}
+
 func (ws *workspace) config(ctx context.Context) error {
 	useSystemGitCredentials := os.Getenv("USE_SYSTEM_GIT_CREDENTIALS") == "1"
 
@@ -19,12 +19,15 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/clientidentity"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/commandutil"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/container"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/doctor"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/filecache"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/runner"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/snaputil"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/executor_identity"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/priority_task_scheduler"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/scheduler_client"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/task_leaser"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/tasksize"
 	"github.com/buildbuddy-io/buildbuddy/server/config"
 	"github.com/buildbuddy-io/buildbuddy/server/hostid"
@@ -64,6 +67,10 @@ var (
 	localCacheDirectory       = flag.String("executor.local_cache_directory", "/tmp/buildbuddy/filecache", "A local on-disk cache directory. Must be on the same device (disk partition, Docker volume, etc.) as the configured root_directory, since files are hard-linked to this cache for performance reasons. Otherwise, 'Invalid cross-device link' errors may result.")
 	localCacheSizeBytes       = flag.Int64("executor.local_cache_size_bytes", 1_000_000_000 /* 1 GB */, "The maximum size, in bytes, to use for the local on-disk cache")
 	startupWarmupMaxWaitSecs  = flag.Int64("executor.startup_warmup_max_wait_secs", 0, "Maximum time to block startup while waiting for default image to be pulled. Default is no wait.")
+	runDoctor                 = flag.Bool("executor.doctor", false, "If true, run preflight checks of the host and configuration, such as KVM and cgroup availability and connectivity to the app and cache, print a report, and exit instead of starting the executor. Exits with a non-zero status if any check failed.")
+	doctorOutputFormat        = flag.String("executor.doctor.output_format", "text", "Format of the report printed by --executor.doctor: 'text' or 'json'.")
+	doctorDiskTestSizeBytes   = flag.Int64("executor.doctor.disk_test_size_bytes", 256*1024*1024, "Amount of data written to the filecache directory by --executor.doctor to measure disk throughput. Set to 0 to skip the measurement.")
+	drainTimeout              = flag.Duration("executor.drain_timeout", 10*time.Minute, "How long running tasks are given to finish when the executor is drained, before they're cancelled and retried on other executors. Can be overridden by the drain request's `timeout` parameter.")
 
 	listen            = flag.String("listen", "0.0.0.0", "The interface to listen on (default: 0.0.0.0)")
 	port              = flag.Int("port", 8080, "The port to listen for HTTP traffic on")
@@ -72,6 +79,70 @@ var (
 	serverType        = flag.String("server_type", "prod-buildbuddy-executor", "The server type to match on health checks")
 )
 
+// drainHandler drains the executor on POST requests, and responds once the
+// executor has deregistered from the scheduler. The `timeout` query parameter
+// overrides --executor.drain_timeout.
+func drainHandler(reg *scheduler_client.Registration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "drain requests must use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		timeout := *drainTimeout
+		if t := r.URL.Query().Get("timeout"); t != "" {
+			d, err := time.ParseDuration(t)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid timeout %q: %s", t, err), http.StatusBadRequest)
+				return
+			}
+			timeout = d
+		}
+		log.Infof("Draining executor, running tasks have %s to finish", timeout)
+		// Don't stop draining if the client goes away.
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := reg.Drain(ctx); err != nil {
+			log.Warningf("Failed to drain executor: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "drained")
+	})
+}
+
+// reloadHandler reloads the config on POST requests, like SIGHUP does.
+func reloadHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "reload requests must use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		log.Infof("Re-reading buildbuddy config from '%s'", config.Path())
+		if err := config.Reload(); err != nil {
+			log.Warningf("Failed to reload config: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "reloaded")
+	})
+}
+
+// registerAdminHandlers registers the handlers that drain the executor and
+// reload its config. They're served on the monitoring port, behind its auth,
+// so that whoever can reach the executor can't take it out of the pool or
+// change its config.
+func registerAdminHandlers(reg *scheduler_client.Registration) {
+	monitoring.HandleAdmin("/drain", drainHandler(reg))
+	monitoring.HandleAdmin("/reload", reloadHandler())
+}
+
+func setAssignableResourceMetrics() {
+	// Note: Using math.Floor here to match the int64() conversions in
+	// scheduler_server.go
+	metrics.RemoteExecutionAssignableMilliCPU.Set(math.Floor(float64(resources.GetAllocatedCPUMillis()) * tasksize.MaxResourceCapacityRatio))
+	metrics.RemoteExecutionAssignableRAMBytes.Set(math.Floor(float64(resources.GetAllocatedRAMBytes()) * tasksize.MaxResourceCapacityRatio))
+}
+
 func init() {
 	// Register the codec for all RPC servers and clients.
 	vtprotocodec.Register()
@@ -116,17 +187,14 @@ func getExecutorHostID() string {
 	return hostID
 }
 
-func GetConfiguredEnvironmentOrDie(healthChecker *healthcheck.HealthChecker) *real_environment.RealEnv {
+func GetConfiguredEnvironmentOrDie(healthChecker *healthcheck.HealthChecker, executorID string) *real_environment.RealEnv {
 	realEnv := real_environment.NewRealEnv(healthChecker)
 
 	mmapLRUEnabled := *platform.EnableFirecracker && (*snaputil.EnableLocalSnapshotSharing || *snaputil.EnableRemoteSnapshotSharing)
 	if err := resources.Configure(mmapLRUEnabled); err != nil {
 		log.Fatal(status.Message(err))
 	}
-	// Note: Using math.Floor here to match the int64() conversions in
-	// scheduler_server.go
-	metrics.RemoteExecutionAssignableMilliCPU.Set(math.Floor(float64(resources.GetAllocatedCPUMillis()) * tasksize.MaxResourceCapacityRatio))
-	metrics.RemoteExecutionAssignableRAMBytes.Set(math.Floor(float64(resources.GetAllocatedRAMBytes()) * tasksize.MaxResourceCapacityRatio))
+	setAssignableResourceMetrics()
 
 	if err := auth.Register(context.Background(), realEnv); err != nil {
 		if err := auth.RegisterNullAuth(realEnv); err != nil {
@@ -158,6 +226,13 @@ func GetConfiguredEnvironmentOrDie(healthChecker *healthcheck.HealthChecker) *re
 	// Identify ourselves as an executor client in gRPC requests to the app.
 	usageutil.SetClientType("executor")
 
+	// Fetch the mTLS client certificate, if enabled, before connecting to
+	// the app and cache. The certificate is bound to the executor ID that
+	// the executor leases tasks with.
+	if err := executor_identity.Register(context.Background(), *appTarget, task_leaser.APIKey(), executorID); err != nil {
+		log.Fatalf("%v", err)
+	}
+
 	cache := *cacheTarget
 	if cache == "" {
 		cache = *appTarget
@@ -186,6 +261,45 @@ func GetConfiguredEnvironmentOrDie(healthChecker *healthcheck.HealthChecker) *re
 	return realEnv
 }
 
+// doctorAndExit runs the executor doctor checks, prints the report, and exits.
+func doctorAndExit(ctx context.Context) {
+	// Only the client identity is needed to connect to the app and cache;
+	// avoid setting up anything else that modifies the host.
+	env := real_environment.NewRealEnv(healthcheck.NewHealthChecker(*serverType))
+	if err := clientidentity.Register(env); err != nil {
+		log.Fatal(err.Error())
+	}
+	cache := *cacheTarget
+	if cache == "" {
+		cache = *appTarget
+	}
+	report := doctor.Run(ctx, env, &doctor.Options{
+		AppTarget:         *appTarget,
+		CacheTarget:       cache,
+		APIKey:            task_leaser.APIKey(),
+		BuildRoot:         runner.GetBuildRoot(),
+		LocalCacheDir:     *localCacheDirectory,
+		DiskTestSizeBytes: *doctorDiskTestSizeBytes,
+		Executor:          platform.GetExecutorProperties(),
+	})
+	var err error
+	switch *doctorOutputFormat {
+	case "json":
+		err = report.WriteJSON(os.Stdout)
+	case "text":
+		err = report.WriteText(os.Stdout)
+	default:
+		log.Fatalf("Unknown --executor.doctor.output_format %q", *doctorOutputFormat)
+	}
+	if err != nil {
+		log.Fatalf("Failed to write report: %s", err)
+	}
+	if report.Failed() {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
 func main() {
 	setUmask()
 
@@ -208,6 +322,10 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *runDoctor {
+		doctorAndExit(rootContext)
+	}
+
 	// Note: cleanupFUSEMounts needs to happen before deleteBuildRootOnStartup.
 	cleanupFUSEMounts()
 
@@ -223,19 +341,19 @@ func main() {
 
 	setupNetworking(rootContext)
 
-	healthChecker := healthcheck.NewHealthChecker(*serverType)
-	env := GetConfiguredEnvironmentOrDie(healthChecker)
-
-	if err := tracing.Configure(env); err != nil {
-		log.Fatalf("Could not configure tracing: %s", err)
-	}
-
 	executorUUID, err := uuid.NewRandom()
 	if err != nil {
 		log.Fatalf("Failed to generate executor instance ID: %s", err)
 	}
 	executorID := executorUUID.String()
 
+	healthChecker := healthcheck.NewHealthChecker(*serverType)
+	env := GetConfiguredEnvironmentOrDie(healthChecker, executorID)
+
+	if err := tracing.Configure(env); err != nil {
+		log.Fatalf("Could not configure tracing: %s", err)
+	}
+
 	imageCacheAuth := container.NewImageCacheAuthenticator(container.ImageCacheAuthenticatorOpts{})
 	env.SetImageCacheAuthenticator(imageCacheAuth)
 
@@ -254,6 +372,31 @@ func main() {
 	}
 
 	container.Metrics.Start(rootContext)
+
+	http.Handle("/healthz", env.GetHealthChecker().LivenessHandler())
+	http.Handle("/readyz", env.GetHealthChecker().ReadinessHandler())
+
+	schedulerOpts := &scheduler_client.Options{}
+	reg, err := scheduler_client.NewRegistration(env, taskScheduler, executorID, executor.HostID(), schedulerOpts)
+	if err != nil {
+		log.Fatalf("Error initializing executor registration: %s", err)
+	}
+	// Apply changes to the pool, resources, and enabled isolation types when
+	// the config is reloaded, without restarting the executor, so that it
+	// keeps its file cache and warm runners.
+	config.RegisterReloadFunc(func() error {
+		if err := resources.Reconfigure(); err != nil {
+			return err
+		}
+		setAssignableResourceMetrics()
+		taskScheduler.UpdateResourceCapacity()
+		if err := runnerPool.UpdateContainerProviders(); err != nil {
+			return err
+		}
+		return reg.UpdateNode()
+	})
+	registerAdminHandlers(reg)
+
 	monitoring.StartMonitoringHandler(env, fmt.Sprintf("%s:%d", *listen, *monitoringPort))
 
 	// Setup SSL for monitoring endpoints (optional).
@@ -266,15 +409,6 @@ func main() {
 		}
 	}
 
-	http.Handle("/healthz", env.GetHealthChecker().LivenessHandler())
-	http.Handle("/readyz", env.GetHealthChecker().ReadinessHandler())
-
-	schedulerOpts := &scheduler_client.Options{}
-	reg, err := scheduler_client.NewRegistration(env, taskScheduler, executorID, executor.HostID(), schedulerOpts)
-	if err != nil {
-		log.Fatalf("Error initializing executor registration: %s", err)
-	}
-
 	warmupDone := make(chan struct{})
 	go func() {
 		executor.Warmup()
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/monitoring"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminHandlersRequireMonitoringAuth(t *testing.T) {
+	registerAdminHandlers(nil /*=reg*/)
+	mux := http.NewServeMux()
+	monitoring.RegisterMonitoringHandlers(real_environment.NewBatchEnv(), mux)
+
+	for _, path := range []string{"/drain", "/reload"} {
+		t.Run(path, func(t *testing.T) {
+			// The handler must not be reachable on the executor's main
+			// HTTP port, which serves the default mux.
+			_, pattern := http.DefaultServeMux.Handler(httptest.NewRequest(http.MethodPost, path, nil))
+			require.Empty(t, pattern)
+
+			// Without monitoring basic auth, only loopback requests are
+			// allowed on the monitoring port.
+			req := httptest.NewRequest(http.MethodPost, path, nil)
+			req.RemoteAddr = "10.0.0.1:1234"
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			require.Equal(t, http.StatusForbidden, rec.Code)
+		})
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/distributed"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/gcs_cache"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/kms"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/log_index"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/memcache"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/migration_cache"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/pebble_cache"
@@ -30,12 +31,14 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/crypter_service"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/execution_search_service"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/execution_service"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/flake_detector"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/gcplink"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/githubapp"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/hostedrunner"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/invocation_search_service"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/invocation_stat_service"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/iprules"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/oidc_federation"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/quota"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/registry"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/execution_server"
@@ -55,7 +58,9 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/dsingleflight"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/redisutil"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/bitbucket"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/gerrit"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/github"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/gitlab"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/workspace"
 	"github.com/buildbuddy-io/buildbuddy/server/config"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
@@ -125,6 +130,8 @@ func convertToProdOrDie(ctx context.Context, env *real_environment.RealEnv) {
 	env.SetGitProviders([]interfaces.GitProvider{
 		github.NewProvider(env),
 		bitbucket.NewProvider(),
+		gitlab.NewProvider(),
+		gerrit.NewProvider(),
 	})
 	if err := githubapp.Register(env); err != nil {
 		log.Fatalf("Failed to register GitHub app: %s", err)
@@ -282,6 +289,9 @@ func main() {
 	if err := iprules.Register(realEnv); err != nil {
 		log.Fatalf("%v", err)
 	}
+	if err := oidc_federation.Register(realEnv); err != nil {
+		log.Fatalf("%v", err)
+	}
 	if err := clientidentity.Register(realEnv); err != nil {
 		log.Fatalf("%v", err)
 	}
@@ -291,12 +301,18 @@ func main() {
 	if err := codesearch.Register(realEnv); err != nil {
 		log.Fatalf("%v", err)
 	}
+	if err := log_index.Register(realEnv); err != nil {
+		log.Fatalf("%v", err)
+	}
 	if err := registry.Register(realEnv); err != nil {
 		log.Fatalf("%v", err)
 	}
 	if err := workspace.Register(realEnv); err != nil {
 		log.Fatalf("%v", err)
 	}
+	if err := flake_detector.Register(realEnv); err != nil {
+		log.Fatalf("%v", err)
+	}
 
 	executionService := execution_service.NewExecutionService(realEnv)
 	realEnv.SetExecutionService(executionService)
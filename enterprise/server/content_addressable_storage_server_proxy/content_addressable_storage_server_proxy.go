@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
@@ -13,7 +15,9 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/buildbuddy-io/buildbuddy/server/util/retry"
 	"github.com/buildbuddy-io/buildbuddy/server/util/rpcutil"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/tracing"
@@ -24,12 +28,41 @@ import (
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 )
 
-var enableGetTreeCaching = flag.Bool("cache_proxy.enable_get_tree_caching", false, "If true, the Cache Proxy attempts to serve GetTree requests out of the local cache. If false, GetTree requests are always proxied to the remote, authoritative cache.")
+var (
+	enableGetTreeCaching    = flag.Bool("cache_proxy.enable_get_tree_caching", false, "If true, the Cache Proxy attempts to serve GetTree requests out of the local cache. If false, GetTree requests are always proxied to the remote, authoritative cache.")
+	asyncBatchUpdateBlobs   = flag.Bool("cache_proxy.async_batch_update_blobs", false, "If true, the Cache Proxy acknowledges BatchUpdateBlobs requests once the blobs are written to the local cache, and writes them to the remote cache in the background.")
+	maxAsyncRemoteWrites    = flag.Int("cache_proxy.max_async_remote_writes", 100, "The maximum number of background BatchUpdateBlobs requests to the remote cache. Once reached, requests are written to the remote cache synchronously.")
+	asyncRemoteWriteTimeout = flag.Duration("cache_proxy.async_remote_write_timeout", time.Minute, "The timeout for background BatchUpdateBlobs requests to the remote cache.")
+)
 
 type CASServerProxy struct {
+	env          environment.Env
 	atimeUpdater interfaces.AtimeUpdater
 	local        repb.ContentAddressableStorageClient
 	remote       repb.ContentAddressableStorageClient
+
+	// Limits the number of in-flight background writes to the remote cache.
+	asyncWrites chan struct{}
+
+	mu sync.Mutex
+	// The background writes to the remote cache, by the user prefix of the
+	// group that made them.
+	pendingWrites map[string]*pendingRemoteWrites
+}
+
+// pendingRemoteWrites are the background writes of a group to the remote
+// cache. Before the group writes to the remote action cache, they're waited
+// for, so that remote action results never reference blobs that are only in
+// the local cache.
+type pendingRemoteWrites struct {
+	inFlight int
+	// idle is closed once no writes are in flight.
+	idle chan struct{}
+	// failed are the requests whose writes failed, without the blob
+	// contents. Their blobs are only in the local cache until they're
+	// uploaded by FlushRemoteWrites. Until then, the group's writes are
+	// synchronous.
+	failed []*repb.BatchUpdateBlobsRequest
 }
 
 func Register(env *real_environment.RealEnv) error {
@@ -55,9 +88,12 @@ func New(env environment.Env) (*CASServerProxy, error) {
 		return nil, fmt.Errorf("A remote ContentAddressableStorageClient is required to enable the ContentAddressableStorageServerProxy")
 	}
 	proxy := CASServerProxy{
-		atimeUpdater: atimeUpdater,
-		local:        local,
-		remote:       remote,
+		env:           env,
+		atimeUpdater:  atimeUpdater,
+		local:         local,
+		remote:        remote,
+		asyncWrites:   make(chan struct{}, *maxAsyncRemoteWrites),
+		pendingWrites: make(map[string]*pendingRemoteWrites),
 	}
 	return &proxy, nil
 }
@@ -117,13 +153,257 @@ func (s *CASServerProxy) FindMissingBlobs(ctx context.Context, req *repb.FindMis
 func (s *CASServerProxy) BatchUpdateBlobs(ctx context.Context, req *repb.BatchUpdateBlobsRequest) (*repb.BatchUpdateBlobsResponse, error) {
 	ctx, spn := tracing.StartSpan(ctx)
 	defer spn.End()
-	_, err := s.local.BatchUpdateBlobs(ctx, req)
+	localResp, err := s.local.BatchUpdateBlobs(ctx, req)
 	if err != nil {
 		log.Warningf("Local BatchUpdateBlobs error: %s", err)
+	} else if *asyncBatchUpdateBlobs && allOK(localResp) && s.updateRemoteAsync(ctx, req) {
+		return localResp, nil
 	}
 	return s.remote.BatchUpdateBlobs(ctx, req)
 }
 
+func allOK(resp *repb.BatchUpdateBlobsResponse) bool {
+	for _, r := range resp.GetResponses() {
+		if r.GetStatus().GetCode() != int32(codes.OK) {
+			return false
+		}
+	}
+	return true
+}
+
+// updateRemoteAsync writes the blobs in req to the remote cache in the
+// background. Returns false if too many background writes are already in
+// progress, or if earlier background writes of the group failed, in which
+// case the caller should write the blobs synchronously.
+func (s *CASServerProxy) updateRemoteAsync(ctx context.Context, req *repb.BatchUpdateBlobsRequest) bool {
+	groupPrefix, err := prefix.UserPrefix(ctx, s.env)
+	if err != nil {
+		return false
+	}
+	select {
+	case s.asyncWrites <- struct{}{}:
+	default:
+		return false
+	}
+	s.mu.Lock()
+	p := s.pendingWritesLocked(groupPrefix)
+	if len(p.failed) > 0 {
+		s.mu.Unlock()
+		<-s.asyncWrites
+		return false
+	}
+	if p.inFlight == 0 {
+		p.idle = make(chan struct{})
+	}
+	p.inFlight++
+	s.mu.Unlock()
+
+	// Keep the request metadata (e.g. credentials), but don't cancel the
+	// write when the client's request finishes.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), *asyncRemoteWriteTimeout)
+	go func() {
+		defer func() { <-s.asyncWrites }()
+		defer cancel()
+		err := s.updateRemote(ctx, req)
+		if err != nil {
+			log.CtxWarningf(ctx, "Remote BatchUpdateBlobs error: %s", err)
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err != nil {
+			p.failed = append(p.failed, withoutData(req))
+		}
+		p.inFlight--
+		if p.inFlight == 0 {
+			close(p.idle)
+			s.maybeDeletePendingWritesLocked(groupPrefix)
+		}
+	}()
+	return true
+}
+
+// updateRemote writes the blobs in req to the remote cache, retrying the
+// blobs that couldn't be written with backoff.
+func (s *CASServerProxy) updateRemote(ctx context.Context, req *repb.BatchUpdateBlobsRequest) error {
+	var lastErr error
+	for r := retry.DefaultWithContext(ctx); r.Next(); {
+		rsp, err := s.remote.BatchUpdateBlobs(ctx, req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		req = unwrittenBlobs(req, rsp)
+		if len(req.GetRequests()) == 0 {
+			return nil
+		}
+		lastErr = status.InternalErrorf("%d blobs could not be written", len(req.GetRequests()))
+	}
+	return lastErr
+}
+
+// unwrittenBlobs returns the part of req whose blobs weren't written
+// according to rsp.
+func unwrittenBlobs(req *repb.BatchUpdateBlobsRequest, rsp *repb.BatchUpdateBlobsResponse) *repb.BatchUpdateBlobsRequest {
+	failed := make(map[digest.Key]struct{})
+	for _, r := range rsp.GetResponses() {
+		if r.GetStatus().GetCode() != int32(codes.OK) {
+			failed[digest.NewKey(r.GetDigest())] = struct{}{}
+		}
+	}
+	unwritten := &repb.BatchUpdateBlobsRequest{
+		InstanceName:   req.GetInstanceName(),
+		DigestFunction: req.GetDigestFunction(),
+	}
+	for _, r := range req.GetRequests() {
+		if _, ok := failed[digest.NewKey(r.GetDigest())]; ok {
+			unwritten.Requests = append(unwritten.Requests, r)
+		}
+	}
+	return unwritten
+}
+
+// withoutData returns a copy of req without the blob contents, which are
+// read back from the local cache if needed.
+func withoutData(req *repb.BatchUpdateBlobsRequest) *repb.BatchUpdateBlobsRequest {
+	stripped := &repb.BatchUpdateBlobsRequest{
+		InstanceName:   req.GetInstanceName(),
+		DigestFunction: req.GetDigestFunction(),
+	}
+	for _, r := range req.GetRequests() {
+		stripped.Requests = append(stripped.Requests, &repb.BatchUpdateBlobsRequest_Request{Digest: r.GetDigest()})
+	}
+	return stripped
+}
+
+func (s *CASServerProxy) pendingWritesLocked(groupPrefix string) *pendingRemoteWrites {
+	p := s.pendingWrites[groupPrefix]
+	if p == nil {
+		p = &pendingRemoteWrites{}
+		s.pendingWrites[groupPrefix] = p
+	}
+	return p
+}
+
+func (s *CASServerProxy) maybeDeletePendingWritesLocked(groupPrefix string) {
+	if p := s.pendingWrites[groupPrefix]; p != nil && p.inFlight == 0 && len(p.failed) == 0 {
+		delete(s.pendingWrites, groupPrefix)
+	}
+}
+
+// FlushRemoteWrites waits for the authenticated group's background writes to
+// the remote cache to finish, and synchronously uploads the blobs of the
+// writes that failed from the local cache. Afterwards, all of the blobs that
+// the group wrote through the proxy are in the remote cache, so it's safe to
+// write action results referencing them to the remote action cache.
+func (s *CASServerProxy) FlushRemoteWrites(ctx context.Context) error {
+	if !*asyncBatchUpdateBlobs {
+		return nil
+	}
+	groupPrefix, err := prefix.UserPrefix(ctx, s.env)
+	if err != nil {
+		// The group can't have written anything in the background.
+		return nil
+	}
+	s.mu.Lock()
+	p := s.pendingWrites[groupPrefix]
+	if p == nil {
+		s.mu.Unlock()
+		return nil
+	}
+	idle := p.idle
+	inFlight := p.inFlight > 0
+	s.mu.Unlock()
+	if inFlight {
+		select {
+		case <-idle:
+		case <-ctx.Done():
+			return status.DeadlineExceededErrorf("wait for background writes to the remote cache: %s", ctx.Err())
+		}
+	}
+
+	s.mu.Lock()
+	failed := p.failed
+	p.failed = nil
+	s.mu.Unlock()
+	for i, req := range failed {
+		if err := s.uploadFromLocal(ctx, req); err != nil {
+			// Blobs that are in neither cache can't be written by
+			// retrying, so only this flush fails because of them.
+			retry := failed[i:]
+			if status.IsNotFoundError(err) {
+				retry = failed[i+1:]
+			}
+			s.mu.Lock()
+			p := s.pendingWritesLocked(groupPrefix)
+			p.failed = append(p.failed, retry...)
+			s.maybeDeletePendingWritesLocked(groupPrefix)
+			s.mu.Unlock()
+			if status.IsNotFoundError(err) {
+				return err
+			}
+			return status.UnavailableErrorf("write blobs to the remote cache: %s", err)
+		}
+	}
+	s.mu.Lock()
+	s.maybeDeletePendingWritesLocked(groupPrefix)
+	s.mu.Unlock()
+	return nil
+}
+
+// uploadFromLocal writes the blobs in req, which has no blob contents, from
+// the local cache to the remote cache. Blobs that were evicted from the local
+// cache are skipped if the remote cache has them, and a NotFound error is
+// returned if it doesn't.
+func (s *CASServerProxy) uploadFromLocal(ctx context.Context, req *repb.BatchUpdateBlobsRequest) error {
+	readReq := &repb.BatchReadBlobsRequest{
+		InstanceName:   req.GetInstanceName(),
+		DigestFunction: req.GetDigestFunction(),
+	}
+	for _, r := range req.GetRequests() {
+		readReq.Digests = append(readReq.Digests, r.GetDigest())
+	}
+	readRsp, err := s.local.BatchReadBlobs(ctx, readReq)
+	if err != nil {
+		return err
+	}
+	updateReq := &repb.BatchUpdateBlobsRequest{
+		InstanceName:   req.GetInstanceName(),
+		DigestFunction: req.GetDigestFunction(),
+	}
+	var evicted []*repb.Digest
+	for _, r := range readRsp.GetResponses() {
+		if r.GetStatus().GetCode() != int32(codes.OK) {
+			evicted = append(evicted, r.GetDigest())
+			continue
+		}
+		updateReq.Requests = append(updateReq.Requests, &repb.BatchUpdateBlobsRequest_Request{
+			Digest:     r.GetDigest(),
+			Data:       r.GetData(),
+			Compressor: r.GetCompressor(),
+		})
+	}
+	var lostErr error
+	if len(evicted) > 0 {
+		missingRsp, err := s.remote.FindMissingBlobs(ctx, &repb.FindMissingBlobsRequest{
+			InstanceName:   req.GetInstanceName(),
+			BlobDigests:    evicted,
+			DigestFunction: req.GetDigestFunction(),
+		})
+		if err != nil {
+			return err
+		}
+		if missing := missingRsp.GetMissingBlobDigests(); len(missing) > 0 {
+			lostErr = status.NotFoundErrorf("%d blobs, e.g. %s, are neither in the local nor in the remote cache", len(missing), missing[0].GetHash())
+		}
+	}
+	if len(updateReq.GetRequests()) > 0 {
+		if err := s.updateRemote(ctx, updateReq); err != nil {
+			return err
+		}
+	}
+	return lostErr
+}
+
 func (s *CASServerProxy) BatchReadBlobs(ctx context.Context, req *repb.BatchReadBlobsRequest) (*repb.BatchReadBlobsResponse, error) {
 	ctx, spn := tracing.StartSpan(ctx)
 	defer spn.End()
@@ -222,6 +502,17 @@ func (s *CASServerProxy) batchReadBlobsRemote(ctx context.Context, readReq *repb
 	return readResp, nil
 }
 
+// SpliceBlob splices the blob in the remote cache, which is where the chunks
+// are written to. If BatchUpdateBlobs requests are acknowledged before the
+// blobs reach the remote cache, some of the chunks may not have been written
+// yet, in which case this returns NotFound and clients fall back to uploading
+// the whole blob.
+func (s *CASServerProxy) SpliceBlob(ctx context.Context, req *repb.SpliceBlobRequest) (*repb.SpliceBlobResponse, error) {
+	ctx, spn := tracing.StartSpan(ctx)
+	defer spn.End()
+	return s.remote.SpliceBlob(ctx, req)
+}
+
 func (s *CASServerProxy) GetTree(req *repb.GetTreeRequest, stream repb.ContentAddressableStorage_GetTreeServer) error {
 	if *enableGetTreeCaching {
 		return s.getTree(req, stream)
@@ -11,8 +11,11 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/byte_stream_server"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/content_addressable_storage_server"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/cas"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 	"github.com/buildbuddy-io/buildbuddy/server/util/uuid"
 	"github.com/jonboulle/clockwork"
@@ -21,6 +24,7 @@ import (
 	"google.golang.org/grpc/codes"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
 	bspb "google.golang.org/genproto/googleapis/bytestream"
 )
 
@@ -306,6 +310,33 @@ func TestReadUpdateBlobs(t *testing.T) {
 	expectNoAtimeUpdate(t, clock, requestCount)
 }
 
+func TestUpdateBlobsAsync(t *testing.T) {
+	flags.Set(t, "cache_proxy.async_batch_update_blobs", true)
+	ctx := context.Background()
+	conn, requestCount, _ := runRemoteCASS(ctx, testenv.GetTestEnv(t), t)
+	casClient := repb.NewContentAddressableStorageClient(conn)
+	proxyEnv := testenv.GetTestEnv(t)
+	proxyEnv.SetAtimeUpdater(&noOpAtimeUpdater{})
+	proxyConn := runCASProxy(ctx, conn, proxyEnv, t)
+	proxy := repb.NewContentAddressableStorageClient(proxyConn)
+
+	fooDigestProto := digestProto(fooDigest, 3)
+
+	// The write is acknowledged once it's in the local cache, and is
+	// eventually written to the remote cache.
+	update(ctx, proxy, map[*repb.Digest]string{fooDigestProto: "foo"}, t)
+	require.Eventually(t, func() bool {
+		resp, err := casClient.FindMissingBlobs(ctx, findMissingBlobsRequest([]*repb.Digest{fooDigestProto}))
+		return err == nil && len(resp.GetMissingBlobDigests()) == 0
+	}, 10*time.Second, 10*time.Millisecond)
+	read(ctx, casClient, []*repb.Digest{fooDigestProto}, map[string]string{fooDigest: "foo"}, t)
+
+	// Reads are served from the local cache.
+	requestCount.Store(0)
+	read(ctx, proxy, []*repb.Digest{fooDigestProto}, map[string]string{fooDigest: "foo"}, t)
+	require.Equal(t, int32(0), requestCount.Load())
+}
+
 func makeTree(ctx context.Context, client bspb.ByteStreamClient, t *testing.T) (*repb.Digest, []string) {
 	child1 := uuid.New()
 	digest1, files1 := cas.MakeTree(ctx, t, client, "", 2, 2)
@@ -461,3 +492,133 @@ func testGetTree(t *testing.T, withCaching bool) {
 		require.Equal(t, int32(1), streamRequests.Load())
 	}
 }
+
+// failingCASClient fails BatchUpdateBlobs requests while failing is set.
+type failingCASClient struct {
+	repb.ContentAddressableStorageClient
+	failing atomic.Bool
+}
+
+func (c *failingCASClient) BatchUpdateBlobs(ctx context.Context, req *repb.BatchUpdateBlobsRequest, opts ...grpc.CallOption) (*repb.BatchUpdateBlobsResponse, error) {
+	if c.failing.Load() {
+		return nil, status.UnavailableError("remote cache is down")
+	}
+	return c.ContentAddressableStorageClient.BatchUpdateBlobs(ctx, req, opts...)
+}
+
+func TestUpdateBlobsAsync_FlushesFailedWrites(t *testing.T) {
+	flags.Set(t, "cache_proxy.async_batch_update_blobs", true)
+	flags.Set(t, "cache_proxy.async_remote_write_timeout", 100*time.Millisecond)
+	ctx := context.Background()
+	conn, _, _ := runRemoteCASS(ctx, testenv.GetTestEnv(t), t)
+	casClient := repb.NewContentAddressableStorageClient(conn)
+	proxyEnv := testenv.GetTestEnv(t)
+	proxyEnv.SetAtimeUpdater(&noOpAtimeUpdater{})
+	proxyEnv.SetContentAddressableStorageClient(casClient)
+	_, localCAS := runLocalCASS(ctx, proxyEnv, t)
+	proxyEnv.SetLocalCASClient(localCAS)
+	proxy, err := New(proxyEnv)
+	require.NoError(t, err)
+	remote := &failingCASClient{ContentAddressableStorageClient: casClient}
+	proxy.remote = remote
+
+	fooDigestProto := digestProto(fooDigest, 3)
+	barDigestProto := digestProto(barDigest, 3)
+
+	// The write is acknowledged, but doesn't reach the remote cache.
+	remote.failing.Store(true)
+	_, err = proxy.BatchUpdateBlobs(ctx, updateBlobsRequest(map[*repb.Digest]string{fooDigestProto: "foo"}))
+	require.NoError(t, err)
+
+	// Once the background write failed, writes are synchronous until the
+	// failed blobs are uploaded.
+	require.Eventually(t, func() bool {
+		_, err = proxy.BatchUpdateBlobs(ctx, updateBlobsRequest(map[*repb.Digest]string{barDigestProto: "bar"}))
+		return status.IsUnavailableError(err)
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// Flushing fails while the remote cache is down, and uploads the blobs
+	// from the local cache once it's back.
+	flushCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	err = proxy.FlushRemoteWrites(flushCtx)
+	require.True(t, status.IsUnavailableError(err), "expected Unavailable error, got %v", err)
+	findMissing(ctx, casClient, []*repb.Digest{fooDigestProto}, []*repb.Digest{fooDigestProto}, t)
+
+	remote.failing.Store(false)
+	err = proxy.FlushRemoteWrites(ctx)
+	require.NoError(t, err)
+	read(ctx, casClient, []*repb.Digest{fooDigestProto}, map[string]string{fooDigest: "foo"}, t)
+
+	// Flushing waits for the writes in flight.
+	_, err = proxy.BatchUpdateBlobs(ctx, updateBlobsRequest(map[*repb.Digest]string{barDigestProto: "bar"}))
+	require.NoError(t, err)
+	err = proxy.FlushRemoteWrites(ctx)
+	require.NoError(t, err)
+	read(ctx, casClient, []*repb.Digest{barDigestProto}, map[string]string{barDigest: "bar"}, t)
+}
+
+func TestUpdateBlobsAsync_FlushSkipsEvictedBlobs(t *testing.T) {
+	flags.Set(t, "cache_proxy.async_batch_update_blobs", true)
+	flags.Set(t, "cache_proxy.async_remote_write_timeout", 100*time.Millisecond)
+	ctx := context.Background()
+	conn, _, _ := runRemoteCASS(ctx, testenv.GetTestEnv(t), t)
+	casClient := repb.NewContentAddressableStorageClient(conn)
+	proxyEnv := testenv.GetTestEnv(t)
+	proxyEnv.SetAtimeUpdater(&noOpAtimeUpdater{})
+	proxyEnv.SetContentAddressableStorageClient(casClient)
+	_, localCAS := runLocalCASS(ctx, proxyEnv, t)
+	proxyEnv.SetLocalCASClient(localCAS)
+	proxy, err := New(proxyEnv)
+	require.NoError(t, err)
+	remote := &failingCASClient{ContentAddressableStorageClient: casClient}
+	proxy.remote = remote
+
+	fooDigestProto := digestProto(fooDigest, 3)
+	barDigestProto := digestProto(barDigest, 3)
+	evict := func(d *repb.Digest) {
+		ctx, err := prefix.AttachUserPrefixToContext(ctx, proxyEnv)
+		require.NoError(t, err)
+		rn := digest.NewResourceName(d, "", rspb.CacheType_CAS, repb.DigestFunction_SHA256).ToProto()
+		err = proxyEnv.GetCache().Delete(ctx, rn)
+		require.NoError(t, err)
+	}
+	hasFailedWrites := func() bool {
+		proxy.mu.Lock()
+		defer proxy.mu.Unlock()
+		for _, p := range proxy.pendingWrites {
+			if len(p.failed) > 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	// foo doesn't reach the remote cache and is evicted from the local
+	// cache before it's flushed, so it's lost. Only the first flush fails.
+	remote.failing.Store(true)
+	_, err = proxy.BatchUpdateBlobs(ctx, updateBlobsRequest(map[*repb.Digest]string{fooDigestProto: "foo"}))
+	require.NoError(t, err)
+	require.Eventually(t, hasFailedWrites, 10*time.Second, 10*time.Millisecond)
+	evict(fooDigestProto)
+	remote.failing.Store(false)
+	err = proxy.FlushRemoteWrites(ctx)
+	require.True(t, status.IsNotFoundError(err), "expected NotFound error, got %v", err)
+	err = proxy.FlushRemoteWrites(ctx)
+	require.NoError(t, err)
+	require.False(t, hasFailedWrites())
+
+	// bar is evicted from the local cache too, but someone else wrote it to
+	// the remote cache in the meantime.
+	remote.failing.Store(true)
+	_, err = proxy.BatchUpdateBlobs(ctx, updateBlobsRequest(map[*repb.Digest]string{barDigestProto: "bar"}))
+	require.NoError(t, err)
+	require.Eventually(t, hasFailedWrites, 10*time.Second, 10*time.Millisecond)
+	evict(barDigestProto)
+	_, err = casClient.BatchUpdateBlobs(ctx, updateBlobsRequest(map[*repb.Digest]string{barDigestProto: "bar"}))
+	require.NoError(t, err)
+	remote.failing.Store(false)
+	err = proxy.FlushRemoteWrites(ctx)
+	require.NoError(t, err)
+	require.False(t, hasFailedWrites())
+}
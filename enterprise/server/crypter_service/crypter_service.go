@@ -278,6 +278,7 @@ func (c *keyCache) refreshKeySingleAttempt(ctx context.Context, ck cacheKey) ([]
 			SELECT * FROM "EncryptionKeyVersions" ekv
 			JOIN "EncryptionKeys" ek ON ekv.encryption_key_id = ek.encryption_key_id
 			WHERE ek.group_id = ?
+			ORDER BY ekv.version DESC
 		`
 		args = []interface{}{ck.groupID}
 	}
@@ -886,74 +887,91 @@ func buildKeyURI(kmsConfig *enpb.KMSConfig) (string, error) {
 		}
 		return fmt.Sprintf("aws-kms://%s", ac.GetKeyArn()), nil
 	}
+	if lc := kmsConfig.GetLocalKeyFileKmsConfig(); lc != nil {
+		if strings.TrimSpace(lc.GetKeyName()) == "" {
+			return "", status.InvalidArgumentError("Key name is required")
+		}
+		return fmt.Sprintf("local-key-file-kms://%s", lc.GetKeyName()), nil
+	}
 
 	return "", status.FailedPreconditionError("KMS config is empty")
 }
 
-func (c *Crypter) enableEncryption(ctx context.Context, kmsConfig *enpb.KMSConfig) error {
-	groupKeyURI, err := buildKeyURI(kmsConfig)
-	if err != nil {
-		return err
-	}
-
-	u, err := c.env.GetAuthenticator().AuthenticatedUser(ctx)
-	if err != nil {
-		return err
-	}
-
+// newKeyVersion generates a fresh composite key for the given group and
+// returns it as a key version whose portions are encrypted using the master
+// key and the customer key at groupKeyURI respectively.
+func (c *Crypter) newKeyVersion(groupID, keyID string, version int32, groupKeyURI string) (*tables.EncryptionKeyVersion, error) {
 	// Get the KMS clients for the customer and our own keys. This doesn't
 	// actually talk to the KMS systems yet.
 	groupKeyClient, err := c.env.GetKMS().FetchKey(groupKeyURI)
 	if err != nil {
-		return status.UnavailableErrorf("invalid key URI: %s", err)
+		return nil, status.UnavailableErrorf("invalid key URI: %s", err)
 	}
 	masterKeyClient, err := c.env.GetKMS().FetchMasterKey()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Generate the master & group (customer) portions of the composite key.
 	masterKeyPart := make([]byte, 32)
 	_, err = rand.Read(masterKeyPart)
 	if err != nil {
-		return status.InternalErrorf("could not generate key: %s", err)
+		return nil, status.InternalErrorf("could not generate key: %s", err)
 	}
 	groupKeyPart := make([]byte, 32)
 	_, err = rand.Read(groupKeyPart)
 	if err != nil {
-		return status.InternalErrorf("could not generate key: %s", err)
-	}
-	keyID, err := tables.PrimaryKeyForTable("EncryptionKeys")
-	if err != nil {
-		return status.InternalErrorf("could not generate key id: %s", err)
+		return nil, status.InternalErrorf("could not generate key: %s", err)
 	}
 
-	encMasterKeyPart, err := masterKeyClient.Encrypt(masterKeyPart, []byte(u.GetGroupID()))
+	encMasterKeyPart, err := masterKeyClient.Encrypt(masterKeyPart, []byte(groupID))
 	if err != nil {
-		return status.InternalErrorf("could not encrypt master portion of composite key: %s", err)
+		return nil, status.InternalErrorf("could not encrypt master portion of composite key: %s", err)
 	}
 	// This is where we'd fail if the customer supplied an invalid key, so we
 	// intentionally use a different error code here.
-	encGroupKeyPart, err := groupKeyClient.Encrypt(groupKeyPart, []byte(u.GetGroupID()))
+	encGroupKeyPart, err := groupKeyClient.Encrypt(groupKeyPart, []byte(groupID))
 	if err != nil {
-		return status.UnavailableErrorf("could not use customer key for encryption: %s", err)
+		return nil, status.UnavailableErrorf("could not use customer key for encryption: %s", err)
 	}
 
-	// We're good to go. Now just need to update the database.
-
-	key := &tables.EncryptionKey{
-		EncryptionKeyID: keyID,
-		GroupID:         u.GetGroupID(),
-	}
 	now := c.clock.Now()
-	keyVersion := &tables.EncryptionKeyVersion{
+	return &tables.EncryptionKeyVersion{
 		EncryptionKeyID:             keyID,
-		Version:                     1,
+		Version:                     version,
 		MasterEncryptedKey:          encMasterKeyPart,
 		GroupKeyURI:                 groupKeyURI,
 		GroupEncryptedKey:           encGroupKeyPart,
 		LastEncryptionAttemptAtUsec: now.UnixMicro(),
 		LastEncryptedAtUsec:         now.UnixMicro(),
+	}, nil
+}
+
+func (c *Crypter) enableEncryption(ctx context.Context, kmsConfig *enpb.KMSConfig) error {
+	groupKeyURI, err := buildKeyURI(kmsConfig)
+	if err != nil {
+		return err
+	}
+
+	u, err := c.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	keyID, err := tables.PrimaryKeyForTable("EncryptionKeys")
+	if err != nil {
+		return status.InternalErrorf("could not generate key id: %s", err)
+	}
+	keyVersion, err := c.newKeyVersion(u.GetGroupID(), keyID, 1, groupKeyURI)
+	if err != nil {
+		return err
+	}
+
+	// We're good to go. Now just need to update the database.
+
+	key := &tables.EncryptionKey{
+		EncryptionKeyID: keyID,
+		GroupID:         u.GetGroupID(),
 	}
 	err = c.env.GetDBHandle().Transaction(ctx, func(tx interfaces.DB) error {
 		if err := tx.NewQuery(ctx, "crypter_create_key").Create(key); err != nil {
@@ -974,6 +992,63 @@ func (c *Crypter) enableEncryption(ctx context.Context, kmsConfig *enpb.KMSConfi
 	return nil
 }
 
+// rotateKey adds a new version of the group's encryption key protected by the
+// customer key described by kmsConfig. New data is encrypted using the newest
+// version while older versions are retained so that existing data remains
+// readable.
+func (c *Crypter) rotateKey(ctx context.Context, kmsConfig *enpb.KMSConfig) error {
+	groupKeyURI, err := buildKeyURI(kmsConfig)
+	if err != nil {
+		return err
+	}
+
+	u, err := c.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	// The key ID and version are filled in below, once the group's key is
+	// locked.
+	keyVersion, err := c.newKeyVersion(u.GetGroupID(), "" /*=keyID*/, 0 /*=version*/, groupKeyURI)
+	if err != nil {
+		return err
+	}
+
+	dbh := c.env.GetDBHandle()
+	err = dbh.Transaction(ctx, func(tx interfaces.DB) error {
+		// Lock the group's key so that concurrent rotations are serialized
+		// and each one adds a distinct version.
+		key := &tables.EncryptionKey{}
+		err := tx.NewQuery(ctx, "crypter_lock_key").Raw(
+			`SELECT * FROM "EncryptionKeys" WHERE group_id = ? `+dbh.SelectForUpdateModifier(), u.GetGroupID()).Take(key)
+		if err != nil {
+			if db.IsRecordNotFound(err) {
+				return status.FailedPreconditionError("encryption is enabled but no key exists for the group")
+			}
+			return err
+		}
+		latest := &tables.EncryptionKeyVersion{}
+		err = tx.NewQuery(ctx, "crypter_get_latest_key_version").Raw(`
+			SELECT * FROM "EncryptionKeyVersions"
+			WHERE encryption_key_id = ?
+			ORDER BY version DESC
+		`, key.EncryptionKeyID).Take(latest)
+		if err != nil && !db.IsRecordNotFound(err) {
+			return err
+		}
+		keyVersion.EncryptionKeyID = key.EncryptionKeyID
+		keyVersion.Version = latest.Version + 1
+		return tx.NewQuery(ctx, "crypter_create_key_version").Create(keyVersion)
+	})
+	if status.IsFailedPreconditionError(err) {
+		return err
+	}
+	if err != nil {
+		return status.InternalErrorf("could not update key information: %s", err)
+	}
+	return nil
+}
+
 func (c *Crypter) disableEncryption(ctx context.Context) error {
 	u, err := c.env.GetAuthenticator().AuthenticatedUser(ctx)
 	if err != nil {
@@ -1021,6 +1096,12 @@ func (c *Crypter) SetEncryptionConfig(ctx context.Context, req *enpb.SetEncrypti
 	if err != nil {
 		return nil, err
 	}
+	if g.CacheEncryptionEnabled && req.Enabled && req.GetKmsConfig() != nil {
+		if err := c.rotateKey(ctx, req.GetKmsConfig()); err != nil {
+			return nil, err
+		}
+		return &enpb.SetEncryptionConfigResponse{}, nil
+	}
 	if g.CacheEncryptionEnabled == req.Enabled {
 		return &enpb.SetEncryptionConfigResponse{}, nil
 	}
@@ -1060,6 +1141,8 @@ func (c *Crypter) GetEncryptionConfig(ctx context.Context, req *enpb.GetEncrypti
 			rsp.SupportedKms = append(rsp.SupportedKms, enpb.KMS_GCP)
 		case interfaces.KMSTypeAWS:
 			rsp.SupportedKms = append(rsp.SupportedKms, enpb.KMS_AWS)
+		case interfaces.KMSTypeLocalKeyFile:
+			rsp.SupportedKms = append(rsp.SupportedKms, enpb.KMS_LOCAL_KEY_FILE)
 		default:
 			log.Warningf("unknown KMS type %q", t)
 		}
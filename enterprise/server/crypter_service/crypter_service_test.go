@@ -35,6 +35,7 @@ import (
 	enpb "github.com/buildbuddy-io/buildbuddy/proto/encryption"
 	rfpb "github.com/buildbuddy-io/buildbuddy/proto/raft"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
 )
 
 var (
@@ -794,6 +795,288 @@ func TestConfigAPI(t *testing.T) {
 	require.True(t, status.IsNotFoundError(err))
 }
 
+func TestKeyRotation(t *testing.T) {
+	flags.Set(t, "auth.api_key_group_cache_ttl", 0)
+
+	env, kms := getEnv(t)
+
+	auther := enterprise_testauth.Configure(t, env)
+	users := enterprise_testauth.CreateRandomGroups(t, env)
+	var userID, groupID string
+	for _, u := range users {
+		if len(u.Groups) != 1 || u.Groups[0].Role != uint32(role.Admin) {
+			continue
+		}
+		userID = u.UserID
+		groupID = u.Groups[0].Group.GroupID
+		break
+	}
+
+	for _, id := range []string{"groupKey1", "groupKey2"} {
+		key := make([]byte, 32)
+		_, err := rand.Read(key)
+		require.NoError(t, err)
+		kms.SetKey("local-insecure-kms://"+id, key)
+	}
+
+	userCtx, err := auther.WithAuthenticatedUser(context.Background(), userID)
+	require.NoError(t, err)
+
+	apiKeys, err := env.GetAuthDB().GetAPIKeys(userCtx, groupID)
+	require.NoError(t, err)
+	apiKeyCtx := auther.AuthContextFromAPIKey(context.Background(), apiKeys[0].Value)
+
+	rootDir := testfs.MakeTempDir(t)
+	opts := &pebble_cache.Options{
+		RootDirectory:             rootDir,
+		MaxSizeBytes:              int64(1000000),
+		MigrateUnencryptedEntries: true,
+	}
+	pc, err := pebble_cache.NewPebbleCache(env, opts)
+	env.SetCache(pc)
+	require.NoError(t, err)
+	err = pc.Start()
+	require.NoError(t, err)
+	defer pc.Stop()
+
+	clock := clockwork.NewFakeClock()
+	crypter, err := New(env, clock)
+	require.NoError(t, err)
+	env.SetCrypter(crypter)
+
+	// Write unencrypted data before encryption is enabled.
+	plaintextResource, plaintextBuf := testdigest.RandomCASResourceBuf(t, 1000)
+	err = pc.Set(apiKeyCtx, plaintextResource, plaintextBuf)
+	require.NoError(t, err)
+
+	_, err = crypter.SetEncryptionConfig(userCtx, &enpb.SetEncryptionConfigRequest{
+		Enabled:   true,
+		KmsConfig: &enpb.KMSConfig{LocalInsecureKmsConfig: &enpb.LocalInsecureKMSConfig{KeyId: "groupKey1"}},
+	})
+	require.NoError(t, err)
+	apiKeyCtx = auther.AuthContextFromAPIKey(context.Background(), apiKeys[0].Value)
+
+	ak, err := crypter.ActiveKey(apiKeyCtx)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, ak.GetVersion())
+	v1Resource, v1Buf := testdigest.RandomCASResourceBuf(t, 1000)
+	err = pc.Set(apiKeyCtx, v1Resource, v1Buf)
+	require.NoError(t, err)
+
+	// The unencrypted data should be migrated when it's read.
+	buf, err := pc.Get(apiKeyCtx, plaintextResource)
+	require.NoError(t, err)
+	require.Equal(t, plaintextBuf, buf)
+
+	// Rotate to a new customer key.
+	_, err = crypter.SetEncryptionConfig(userCtx, &enpb.SetEncryptionConfigRequest{
+		Enabled:   true,
+		KmsConfig: &enpb.KMSConfig{LocalInsecureKmsConfig: &enpb.LocalInsecureKMSConfig{KeyId: "groupKey2"}},
+	})
+	require.NoError(t, err)
+	advanceTimeAndWaitForRefresh(clock, crypter, 11*time.Minute)
+
+	ak, err = crypter.ActiveKey(apiKeyCtx)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, ak.GetVersion())
+	v2Resource, v2Buf := testdigest.RandomCASResourceBuf(t, 1000)
+	err = pc.Set(apiKeyCtx, v2Resource, v2Buf)
+	require.NoError(t, err)
+
+	// Data written with either key version should be readable.
+	for _, tc := range []struct {
+		rn  *rspb.ResourceName
+		buf []byte
+	}{
+		{plaintextResource, plaintextBuf},
+		{v1Resource, v1Buf},
+		{v2Resource, v2Buf},
+	} {
+		buf, err := pc.Get(apiKeyCtx, tc.rn)
+		require.NoError(t, err)
+		require.Equal(t, tc.buf, buf)
+	}
+
+	// Once the old customer key is gone, data written with it becomes
+	// unreadable but new data is unaffected.
+	kms.RemoveKey("local-insecure-kms://groupKey1")
+	advanceTimeAndWaitForRefresh(clock, crypter, 11*time.Minute)
+
+	_, err = pc.Get(apiKeyCtx, v1Resource)
+	require.True(t, status.IsUnavailableError(err), "expected Unavailable error, got %v", err)
+	buf, err = pc.Get(apiKeyCtx, v2Resource)
+	require.NoError(t, err)
+	require.Equal(t, v2Buf, buf)
+}
+
+func TestMigrationKeepsSharedCASEntries(t *testing.T) {
+	flags.Set(t, "auth.api_key_group_cache_ttl", 0)
+
+	env, kms := getEnv(t)
+
+	auther := enterprise_testauth.Configure(t, env)
+	users := enterprise_testauth.CreateRandomGroups(t, env)
+	var userIDs, groupIDs []string
+	for _, u := range users {
+		if len(u.Groups) != 1 || u.Groups[0].Role != uint32(role.Admin) {
+			continue
+		}
+		if len(groupIDs) > 0 && groupIDs[0] == u.Groups[0].Group.GroupID {
+			continue
+		}
+		userIDs = append(userIDs, u.UserID)
+		groupIDs = append(groupIDs, u.Groups[0].Group.GroupID)
+		if len(groupIDs) == 2 {
+			break
+		}
+	}
+	require.Len(t, groupIDs, 2)
+
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	kms.SetKey("local-insecure-kms://groupKey", key)
+
+	var apiKeys []string
+	for i, groupID := range groupIDs {
+		userCtx, err := auther.WithAuthenticatedUser(context.Background(), userIDs[i])
+		require.NoError(t, err)
+		keys, err := env.GetAuthDB().GetAPIKeys(userCtx, groupID)
+		require.NoError(t, err)
+		apiKeys = append(apiKeys, keys[0].Value)
+	}
+	apiKeyCtxs := make([]context.Context, len(apiKeys))
+	for i, apiKey := range apiKeys {
+		apiKeyCtxs[i] = auther.AuthContextFromAPIKey(context.Background(), apiKey)
+	}
+
+	opts := &pebble_cache.Options{
+		RootDirectory:             testfs.MakeTempDir(t),
+		MaxSizeBytes:              int64(1000000),
+		MigrateUnencryptedEntries: true,
+	}
+	pc, err := pebble_cache.NewPebbleCache(env, opts)
+	require.NoError(t, err)
+	env.SetCache(pc)
+	err = pc.Start()
+	require.NoError(t, err)
+	defer pc.Stop()
+
+	crypter, err := New(env, clockwork.NewFakeClock())
+	require.NoError(t, err)
+	env.SetCrypter(crypter)
+
+	// Write the same CAS blob from both groups, and an AC entry from the
+	// first group, before encryption is enabled.
+	casResource, casBuf := testdigest.RandomCASResourceBuf(t, 1000)
+	for _, ctx := range apiKeyCtxs {
+		err = pc.Set(ctx, casResource, casBuf)
+		require.NoError(t, err)
+	}
+	acResource, acBuf := testdigest.RandomACResourceBuf(t, 1000)
+	err = pc.Set(apiKeyCtxs[0], acResource, acBuf)
+	require.NoError(t, err)
+
+	// Enable encryption for the first group only.
+	userCtx, err := auther.WithAuthenticatedUser(context.Background(), userIDs[0])
+	require.NoError(t, err)
+	_, err = crypter.SetEncryptionConfig(userCtx, &enpb.SetEncryptionConfigRequest{
+		Enabled:   true,
+		KmsConfig: &enpb.KMSConfig{LocalInsecureKmsConfig: &enpb.LocalInsecureKMSConfig{KeyId: "groupKey"}},
+	})
+	require.NoError(t, err)
+	apiKeyCtxs[0] = auther.AuthContextFromAPIKey(context.Background(), apiKeys[0])
+	ak, err := crypter.ActiveKey(apiKeyCtxs[0])
+	require.NoError(t, err)
+	require.EqualValues(t, 1, ak.GetVersion())
+
+	// Reading from the first group migrates both entries.
+	for _, tc := range []struct {
+		rn  *rspb.ResourceName
+		buf []byte
+	}{
+		{casResource, casBuf},
+		{acResource, acBuf},
+	} {
+		buf, err := pc.Get(apiKeyCtxs[0], tc.rn)
+		require.NoError(t, err)
+		require.Equal(t, tc.buf, buf)
+	}
+
+	// The unencrypted CAS entry is shared, so the other group can still read
+	// it after the migration.
+	buf, err := pc.Get(apiKeyCtxs[1], casResource)
+	require.NoError(t, err)
+	require.Equal(t, casBuf, buf)
+}
+
+func TestConcurrentKeyRotation(t *testing.T) {
+	flags.Set(t, "auth.api_key_group_cache_ttl", 0)
+
+	env, kms := getEnv(t)
+
+	auther := enterprise_testauth.Configure(t, env)
+	users := enterprise_testauth.CreateRandomGroups(t, env)
+	var userID, groupID string
+	for _, u := range users {
+		if len(u.Groups) != 1 || u.Groups[0].Role != uint32(role.Admin) {
+			continue
+		}
+		userID = u.UserID
+		groupID = u.Groups[0].Group.GroupID
+		break
+	}
+
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	kms.SetKey("local-insecure-kms://groupKey", key)
+
+	userCtx, err := auther.WithAuthenticatedUser(context.Background(), userID)
+	require.NoError(t, err)
+
+	crypter, err := New(env, clockwork.NewFakeClock())
+	require.NoError(t, err)
+	env.SetCrypter(crypter)
+
+	req := &enpb.SetEncryptionConfigRequest{
+		Enabled:   true,
+		KmsConfig: &enpb.KMSConfig{LocalInsecureKmsConfig: &enpb.LocalInsecureKMSConfig{KeyId: "groupKey"}},
+	}
+	_, err = crypter.SetEncryptionConfig(userCtx, req)
+	require.NoError(t, err)
+
+	// Concurrent rotations should each add a distinct key version.
+	numRotations := 10
+	var wg sync.WaitGroup
+	errs := make([]error, numRotations)
+	for i := range numRotations {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = crypter.SetEncryptionConfig(userCtx, req)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	var versions []int32
+	err = env.GetDBHandle().NewQuery(context.Background(), "test_get_key_versions").Raw(`
+		SELECT ekv.version FROM "EncryptionKeyVersions" ekv
+		JOIN "EncryptionKeys" ek ON ekv.encryption_key_id = ek.encryption_key_id
+		WHERE ek.group_id = ?
+		ORDER BY ekv.version
+	`, groupID).Take(&versions)
+	require.NoError(t, err)
+	var expected []int32
+	for v := range numRotations + 1 {
+		expected = append(expected, int32(v+1))
+	}
+	require.Equal(t, expected, versions)
+}
+
 func TestKeyReencryption(t *testing.T) {
 	env, kms := getEnv(t)
 
@@ -0,0 +1,214 @@
+package flake_detector
+
+import (
+	"context"
+	"flag"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/redisutil"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/target_tracker"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"gorm.io/gorm/clause"
+
+	bespb "github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+)
+
+var (
+	detectionInterval = flag.Duration("app.flake_detection_interval", time.Hour, "How often to recompute the flake rates of test targets. Requires app.enable_target_tracking. If 0, flake rates are not computed.")
+	detectionWindow   = flag.Duration("app.flake_detection_window", 7*24*time.Hour, "The rolling window of CI invocations over which test target flake rates are computed.")
+)
+
+const (
+	// Key used to make sure that only one app recomputes flake stats at a
+	// time. The lock only reduces DB load; concurrent runs compute the same
+	// stats.
+	redisLockKey = "lock.flake_detector"
+
+	// How long a run may hold the lock for.
+	redisLockExpiry = 5 * time.Minute
+
+	upsertBatchSize = 100
+)
+
+// failedStatuses are the test statuses that count as a failed run or attempt.
+var failedStatuses = []int32{
+	int32(bespb.TestStatus_FAILED),
+	int32(bespb.TestStatus_TIMEOUT),
+}
+
+// FlakeDetector periodically computes how flaky each tracked test target has
+// been over a rolling window, from the target statuses and test attempts
+// written by the target tracker, and stores the results in the
+// TargetFlakeStats table.
+type FlakeDetector struct {
+	env  environment.Env
+	lock interfaces.DistributedLock
+	quit chan struct{}
+}
+
+func Register(env *real_environment.RealEnv) error {
+	if !target_tracker.TargetTrackingEnabled() || *detectionInterval <= 0 {
+		return nil
+	}
+	if env.GetDBHandle() == nil {
+		return status.FailedPreconditionError("flake detection requires a database")
+	}
+	var lock interfaces.DistributedLock
+	if rdb := env.GetDefaultRedisClient(); rdb != nil {
+		l, err := redisutil.NewWeakLock(rdb, redisLockKey, redisLockExpiry)
+		if err != nil {
+			return err
+		}
+		lock = l
+	}
+	d := New(env, lock)
+	d.Start()
+	env.GetHealthChecker().RegisterShutdownFunction(func(ctx context.Context) error {
+		d.Stop()
+		return nil
+	})
+	return nil
+}
+
+// New returns a flake detector. If lock is nil, every app computes flake stats.
+func New(env environment.Env, lock interfaces.DistributedLock) *FlakeDetector {
+	return &FlakeDetector{
+		env:  env,
+		lock: lock,
+		quit: make(chan struct{}),
+	}
+}
+
+func (d *FlakeDetector) Start() {
+	go func() {
+		ticker := time.NewTicker(*detectionInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.quit:
+				return
+			case <-ticker.C:
+			}
+			if err := d.Run(d.env.GetServerContext()); err != nil {
+				log.Warningf("Failed to compute test flake stats: %s", err)
+			}
+		}
+	}()
+}
+
+func (d *FlakeDetector) Stop() {
+	close(d.quit)
+}
+
+// Run recomputes the flake stats of all targets that ran within the detection
+// window, and deletes the stats of targets that didn't.
+func (d *FlakeDetector) Run(ctx context.Context) error {
+	if d.lock != nil {
+		// Another app is already computing the stats.
+		err := d.lock.Lock(ctx)
+		if status.IsResourceExhaustedError(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := d.lock.Unlock(ctx); err != nil {
+				log.Warningf("Failed to unlock distributed lock: %s", err)
+			}
+		}()
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, redisLockExpiry)
+		defer cancel()
+	}
+
+	now := d.env.GetClock().Now()
+	windowStart := now.Add(-*detectionWindow)
+	stats, err := d.computeStats(ctx, windowStart)
+	if err != nil {
+		return err
+	}
+	for _, s := range stats {
+		s.WindowStartUsec = windowStart.UnixMicro()
+		s.WindowEndUsec = now.UnixMicro()
+	}
+	dbh := d.env.GetDBHandle()
+	if len(stats) > 0 {
+		err := dbh.GORM(ctx, "flake_detector_upsert_stats").Clauses(clause.OnConflict{UpdateAll: true}).CreateInBatches(stats, upsertBatchSize).Error
+		if err != nil {
+			return err
+		}
+	}
+	err = dbh.NewQuery(ctx, "flake_detector_delete_stale_stats").Raw(
+		`DELETE FROM "TargetFlakeStats" WHERE window_end_usec < ?`, now.UnixMicro()).Exec().Error
+	if err != nil {
+		return err
+	}
+	log.Infof("Computed flake stats for %d test target(s)", len(stats))
+	return nil
+}
+
+type statsKey struct {
+	targetID int64
+	groupID  string
+}
+
+func (d *FlakeDetector) computeStats(ctx context.Context, windowStart time.Time) ([]*tables.TargetFlakeStats, error) {
+	dbh := d.env.GetDBHandle()
+	// Target IDs are derived from the repo URL and label, so they are only
+	// unique within a group.
+	rq := dbh.NewQuery(ctx, "flake_detector_get_run_stats").Raw(`
+		SELECT t.target_id, t.group_id, t.repo_url, t.label,
+			COUNT(*) AS total_runs,
+			SUM(CASE WHEN ts.status = ? THEN 1 ELSE 0 END) AS flaky_runs,
+			SUM(CASE WHEN ts.status IN ? THEN 1 ELSE 0 END) AS failed_runs
+		FROM "TargetStatuses" AS ts
+		JOIN "Invocations" AS i ON i.invocation_uuid = ts.invocation_uuid
+		JOIN "Targets" AS t ON t.target_id = ts.target_id AND t.group_id = i.group_id
+		WHERE ts.created_at_usec >= ?
+		GROUP BY t.target_id, t.group_id, t.repo_url, t.label`,
+		int32(bespb.TestStatus_FLAKY), failedStatuses, windowStart.UnixMicro())
+	stats, err := db.ScanAll(rq, &tables.TargetFlakeStats{})
+	if err != nil {
+		return nil, err
+	}
+	statsByKey := make(map[statsKey]*tables.TargetFlakeStats, len(stats))
+	for _, s := range stats {
+		statsByKey[statsKey{s.TargetID, s.GroupID}] = s
+	}
+
+	rq = dbh.NewQuery(ctx, "flake_detector_get_attempt_stats").Raw(`
+		SELECT ta.target_id, i.group_id,
+			COUNT(*) AS total_attempts,
+			SUM(CASE WHEN ta.status IN ? THEN 1 ELSE 0 END) AS failed_attempts
+		FROM "TargetTestAttempts" AS ta
+		JOIN "Invocations" AS i ON i.invocation_uuid = ta.invocation_uuid
+		WHERE ta.created_at_usec >= ?
+		GROUP BY ta.target_id, i.group_id`,
+		failedStatuses, windowStart.UnixMicro())
+	err = db.ScanEach(rq, func(ctx context.Context, a *tables.TargetFlakeStats) error {
+		if s, ok := statsByKey[statsKey{a.TargetID, a.GroupID}]; ok {
+			s.TotalAttempts = a.TotalAttempts
+			s.FailedAttempts = a.FailedAttempts
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// FlakeRate returns the fraction of the target's runs that were flaky.
+func FlakeRate(s *tables.TargetFlakeStats) float64 {
+	if s.TotalRuns == 0 {
+		return 0
+	}
+	return float64(s.FlakyRuns) / float64(s.TotalRuns)
+}
@@ -0,0 +1,75 @@
+package flake_detector_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/flake_detector"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+
+	bespb "github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+)
+
+const (
+	repoURL  = "https://github.com/buildbuddy-io/buildbuddy"
+	targetID = 123
+)
+
+func TestRun(t *testing.T) {
+	env := testenv.GetTestEnv(t)
+	ctx := context.Background()
+	dbh := env.GetDBHandle()
+	create := func(row interface{}) {
+		err := dbh.NewQuery(ctx, "create").Create(row)
+		require.NoError(t, err)
+	}
+
+	// Both groups have the same target, which must not be mixed up.
+	for _, groupID := range []string{"GR1", "GR2"} {
+		create(&tables.Target{TargetID: targetID, GroupID: groupID, RepoURL: repoURL, Label: "//:test"})
+	}
+	run := func(groupID string, overallStatus bespb.TestStatus, attemptStatuses ...bespb.TestStatus) {
+		iid, err := uuid.NewRandom()
+		require.NoError(t, err)
+		invocationUUID := iid[:]
+		create(&tables.Invocation{InvocationID: iid.String(), InvocationUUID: invocationUUID, GroupID: groupID})
+		create(&tables.TargetStatus{TargetID: targetID, InvocationUUID: invocationUUID, Status: int32(overallStatus)})
+		for i, s := range attemptStatuses {
+			create(&tables.TargetTestAttempt{TargetID: targetID, InvocationUUID: invocationUUID, Attempt: int32(i + 1), Status: int32(s)})
+		}
+	}
+	run("GR1", bespb.TestStatus_PASSED, bespb.TestStatus_PASSED)
+	run("GR1", bespb.TestStatus_FLAKY, bespb.TestStatus_FAILED, bespb.TestStatus_PASSED)
+	run("GR1", bespb.TestStatus_FLAKY, bespb.TestStatus_TIMEOUT, bespb.TestStatus_PASSED)
+	run("GR1", bespb.TestStatus_FAILED, bespb.TestStatus_FAILED, bespb.TestStatus_FAILED)
+	run("GR2", bespb.TestStatus_PASSED, bespb.TestStatus_PASSED)
+	// Stats of targets that no longer ran in the window are deleted.
+	create(&tables.TargetFlakeStats{TargetID: 456, GroupID: "GR1", Label: "//:stale", TotalRuns: 1})
+
+	err := flake_detector.New(env, nil /*=lock*/).Run(ctx)
+	require.NoError(t, err)
+
+	var stats []*tables.TargetFlakeStats
+	err = dbh.NewQuery(ctx, "get").Raw(`SELECT * FROM "TargetFlakeStats" ORDER BY group_id`).Take(&stats)
+	require.NoError(t, err)
+	require.Len(t, stats, 2)
+
+	require.Equal(t, "GR1", stats[0].GroupID)
+	require.Equal(t, "//:test", stats[0].Label)
+	require.Equal(t, repoURL, stats[0].RepoURL)
+	require.Equal(t, int64(4), stats[0].TotalRuns)
+	require.Equal(t, int64(2), stats[0].FlakyRuns)
+	require.Equal(t, int64(1), stats[0].FailedRuns)
+	require.Equal(t, int64(7), stats[0].TotalAttempts)
+	require.Equal(t, int64(4), stats[0].FailedAttempts)
+	require.Equal(t, 0.5, flake_detector.FlakeRate(stats[0]))
+	require.Less(t, stats[0].WindowStartUsec, stats[0].WindowEndUsec)
+
+	require.Equal(t, "GR2", stats[1].GroupID)
+	require.Equal(t, int64(1), stats[1].TotalRuns)
+	require.Equal(t, int64(0), stats[1].FlakyRuns)
+	require.Equal(t, int64(1), stats[1].TotalAttempts)
+}
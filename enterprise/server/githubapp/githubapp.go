@@ -207,6 +207,8 @@ func (a *GitHubApp) handleWebhookEvent(ctx context.Context, eventType string, ev
 		return a.handlePullRequestEvent(ctx, eventType, event)
 	case *github.PullRequestReviewEvent:
 		return a.handlePullRequestReviewEvent(ctx, eventType, event)
+	case *github.IssueCommentEvent:
+		return a.handleIssueCommentEvent(ctx, eventType, event)
 	default:
 		// Event type not yet handled
 		return nil
@@ -269,6 +271,10 @@ func (a *GitHubApp) handlePullRequestReviewEvent(ctx context.Context, eventType
 	return a.maybeTriggerBuildBuddyWorkflow(ctx, eventType, event)
 }
 
+func (a *GitHubApp) handleIssueCommentEvent(ctx context.Context, eventType string, event *github.IssueCommentEvent) error {
+	return a.maybeTriggerBuildBuddyWorkflow(ctx, eventType, event)
+}
+
 func (a *GitHubApp) startGitHubActionsRunnerTask(ctx context.Context, event *github.WorkflowJobEvent) error {
 	if event.WorkflowJob == nil {
 		return status.FailedPreconditionError("workflow job cannot be nil")
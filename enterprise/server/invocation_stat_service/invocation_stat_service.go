@@ -17,6 +17,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/db"
 	"github.com/buildbuddy-io/buildbuddy/server/util/filter"
 	"github.com/buildbuddy-io/buildbuddy/server/util/git"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"golang.org/x/sync/errgroup"
@@ -324,7 +325,7 @@ func (i *InvocationStatService) flattenTrendsQuery(innerQuery string) string {
 	FROM (` + innerQuery + ")"
 }
 
-func (i *InvocationStatService) addWhereClauses(q *query_builder.Query, tq *stpb.TrendQuery, includeExecutionDimensionFilters bool, reqCtx *ctxpb.RequestContext) error {
+func (i *InvocationStatService) addWhereClauses(ctx context.Context, q *query_builder.Query, tq *stpb.TrendQuery, includeExecutionDimensionFilters bool, reqCtx *ctxpb.RequestContext) error {
 
 	if user := tq.GetUser(); user != "" {
 		q.AddWhereClause("user = ?", user)
@@ -426,9 +427,29 @@ func (i *InvocationStatService) addWhereClauses(q *query_builder.Query, tq *stpb
 	}
 
 	q.AddWhereClause(`group_id = ?`, reqCtx.GetGroupId())
+	if !includeExecutionDimensionFilters {
+		i.addInvocationVisibilityClause(ctx, q)
+	}
 	return nil
 }
 
+// addInvocationVisibilityClause excludes the invocations that are only
+// visible to their owner from the stats, unless the authenticated user is
+// their owner.
+func (i *InvocationStatService) addInvocationVisibilityClause(ctx context.Context, q *query_builder.Query) {
+	userID := ""
+	if u, err := i.env.GetAuthenticator().AuthenticatedUser(ctx); err == nil {
+		userID = u.GetUserID()
+	}
+	if i.isOLAPDBEnabled() {
+		// Invocations that were flushed before their permissions were
+		// stored in the OLAP DB have perms = 0.
+		q.AddWhereClause(`(perms = 0 OR bitAnd(perms, ?) != 0 OR user_id = ?)`, perms.GROUP_READ|perms.OTHERS_READ, userID)
+	} else {
+		q.AddWhereClause(`(perms & ? != 0 OR user_id = ?)`, perms.GROUP_READ|perms.OTHERS_READ, userID)
+	}
+}
+
 func (i *InvocationStatService) getInvocationSummary(ctx context.Context, req *stpb.GetTrendRequest) (*stpb.Summary, error) {
 	if !i.isOLAPDBEnabled() {
 		// Invocation Summary is only available with OLAP DB enabled.
@@ -453,7 +474,7 @@ func (i *InvocationStatService) getInvocationSummary(ctx context.Context, req *s
     `)
 
 	reqCtx := req.GetRequestContext()
-	if err := i.addWhereClauses(q, req.GetQuery(), false, reqCtx); err != nil {
+	if err := i.addWhereClauses(ctx, q, req.GetQuery(), false, reqCtx); err != nil {
 		return nil, err
 	}
 	qStr, qArgs := q.Build()
@@ -469,7 +490,7 @@ func (i *InvocationStatService) getInvocationTrend(ctx context.Context, req *stp
 	reqCtx := req.GetRequestContext()
 
 	q := query_builder.NewQueryWithArgs(i.getTrendBasicQuery(req.GetQuery(), timeSettings, reqCtx.GetTimezoneOffsetMinutes()))
-	if err := i.addWhereClauses(q, req.GetQuery(), false, reqCtx); err != nil {
+	if err := i.addWhereClauses(ctx, q, req.GetQuery(), false, reqCtx); err != nil {
 		return nil, err
 	}
 	if i.finerTimeBucketsEnabled() {
@@ -553,7 +574,7 @@ func (i *InvocationStatService) getExecutionTrend(ctx context.Context, req *stpb
 	reqCtx := req.GetRequestContext()
 
 	q := query_builder.NewQueryWithArgs(i.getExecutionTrendQuery(timeSettings, reqCtx.GetTimezoneOffsetMinutes()))
-	if err := i.addWhereClauses(q, req.GetQuery(), true, req.GetRequestContext()); err != nil {
+	if err := i.addWhereClauses(ctx, q, req.GetQuery(), true, req.GetRequestContext()); err != nil {
 		return nil, err
 	}
 	if *finerTimeBuckets {
@@ -872,9 +893,9 @@ func (i *InvocationStatService) generateQueryInputs(ctx context.Context, table s
 		MetricArrayStr:         metricArrayStr}, nil
 }
 
-func (i *InvocationStatService) getWhereClauseForHeatmapQuery(m *sfpb.Metric, q *stpb.TrendQuery, reqCtx *ctxpb.RequestContext) (string, []interface{}, error) {
+func (i *InvocationStatService) getWhereClauseForHeatmapQuery(ctx context.Context, m *sfpb.Metric, q *stpb.TrendQuery, reqCtx *ctxpb.RequestContext) (string, []interface{}, error) {
 	placeholderQuery := query_builder.NewQuery("")
-	if err := i.addWhereClauses(placeholderQuery, q, m.Execution != nil, reqCtx); err != nil {
+	if err := i.addWhereClauses(ctx, placeholderQuery, q, m.Execution != nil, reqCtx); err != nil {
 		return "", nil, err
 	}
 	if m.GetInvocation() == sfpb.InvocationMetricType_DURATION_USEC_INVOCATION_METRIC {
@@ -902,7 +923,7 @@ func (i *InvocationStatService) getHeatmapQueryAndBuckets(ctx context.Context, r
 	if err != nil {
 		return nil, err
 	}
-	whereClauseStr, whereClauseArgs, err := i.getWhereClauseForHeatmapQuery(req.GetMetric(), req.GetQuery(), req.GetRequestContext())
+	whereClauseStr, whereClauseArgs, err := i.getWhereClauseForHeatmapQuery(ctx, req.GetMetric(), req.GetQuery(), req.GetRequestContext())
 	if err != nil {
 		return nil, err
 	}
@@ -1097,6 +1118,7 @@ func (i *InvocationStatService) GetInvocationStat(ctx context.Context, req *inpb
 	}
 
 	q.AddWhereClause(`group_id = ?`, groupID)
+	i.addInvocationVisibilityClause(ctx, q)
 	q.SetGroupBy("name")
 	q.SetOrderBy("latest_build_time_usec" /*ascending=*/, false)
 	q.SetLimit(int64(limit))
@@ -1191,7 +1213,7 @@ func (i *InvocationStatService) getDrilldownQuery(ctx context.Context, req *stpb
 	}
 	placeholderQuery := query_builder.NewQuery("")
 
-	if err := i.addWhereClauses(placeholderQuery, req.GetQuery(), req.GetDrilldownMetric().Execution != nil, req.GetRequestContext()); err != nil {
+	if err := i.addWhereClauses(ctx, placeholderQuery, req.GetQuery(), req.GetDrilldownMetric().Execution != nil, req.GetRequestContext()); err != nil {
 		return "", nil, err
 	}
 
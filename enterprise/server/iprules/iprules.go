@@ -24,7 +24,9 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/lru"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
 
+	alpb "github.com/buildbuddy-io/buildbuddy/proto/auditlog"
 	irpb "github.com/buildbuddy-io/buildbuddy/proto/iprules"
 	snpb "github.com/buildbuddy-io/buildbuddy/proto/server_notification"
 )
@@ -33,71 +35,94 @@ var (
 	enableIPRules = flag.Bool("auth.ip_rules.enable", false, "If true, IP rules will be checked during auth.")
 	cacheTTL      = flag.Duration("auth.ip_rules.cache_ttl", 5*time.Minute, "Duration of time IP rules will be cached in memory.")
 	allowIPV6     = flag.Bool("auth.ip_rules.allow_ipv6", false, "If true, IPv6 rules will be allowed.")
+
+	overrideDuration = flag.Duration("auth.ip_rules.override_duration", 1*time.Hour, "How long an org admin can bypass their organization's IP rules for after creating an override.")
 )
 
 const (
 	// The number of IP rules (net.IPNet instances) that we will store in memory.
 	cacheSize = 100_000
+
+	// The number of IP rules overrides that we will store in memory.
+	overrideCacheSize = 10_000
+
+	// Denied requests are audit logged at most once per interval for each
+	// group, client IP and credential, since blocked clients tend to retry.
+	deniedRequestLogInterval  = 1 * time.Minute
+	deniedRequestLogCacheSize = 10_000
+
+	maxOverrideReasonLength = 1000
 )
 
-type ipRuleCacheEntry struct {
-	allowed      []*net.IPNet
+type groupCacheEntry[T any] struct {
+	value        T
 	expiresAfter time.Time
 }
 
-type ipRuleCache interface {
-	Add(groupID string, allowed []*net.IPNet)
-	Get(groupID string) ([]*net.IPNet, bool)
+// groupCache caches a value for each group for auth.ip_rules.cache_ttl.
+type groupCache[T any] interface {
+	Add(groupID string, value T)
+	Get(groupID string) (T, bool)
+	Remove(groupID string)
 }
 
-type memIpRuleCache struct {
+type memGroupCache[T any] struct {
 	mu  sync.Mutex
-	lru interfaces.LRU[*ipRuleCacheEntry]
+	lru interfaces.LRU[*groupCacheEntry[T]]
 }
 
-func (c *memIpRuleCache) Get(groupID string) (allowed []*net.IPNet, ok bool) {
+func (c *memGroupCache[T]) Get(groupID string) (value T, ok bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	entry, ok := c.lru.Get(groupID)
 	if !ok {
-		return nil, ok
+		return value, ok
 	}
 	if time.Now().After(entry.expiresAfter) {
 		c.lru.Remove(groupID)
-		return nil, false
+		return value, false
 	}
-	return entry.allowed, true
+	return entry.value, true
+}
+
+func (c *memGroupCache[T]) Add(groupID string, value T) {
+	c.mu.Lock()
+	c.lru.Add(groupID, &groupCacheEntry[T]{value: value, expiresAfter: time.Now().Add(*cacheTTL)})
+	c.mu.Unlock()
 }
 
-func (c *memIpRuleCache) Add(groupID string, allowed []*net.IPNet) {
+func (c *memGroupCache[T]) Remove(groupID string) {
 	c.mu.Lock()
-	c.lru.Add(groupID, &ipRuleCacheEntry{allowed: allowed, expiresAfter: time.Now().Add(*cacheTTL)})
+	c.lru.Remove(groupID)
 	c.mu.Unlock()
 }
 
-type noopIpRuleCache struct {
+type noopGroupCache[T any] struct {
+}
+
+func (c *noopGroupCache[T]) Add(groupID string, value T) {
 }
 
-func (c *noopIpRuleCache) Add(groupID string, allowed []*net.IPNet) {
+func (c *noopGroupCache[T]) Get(groupID string) (value T, ok bool) {
+	return value, false
 }
 
-func (c *noopIpRuleCache) Get(groupID string) ([]*net.IPNet, bool) {
-	return nil, false
+func (c *noopGroupCache[T]) Remove(groupID string) {
 }
 
-func newIpRuleCache() (ipRuleCache, error) {
+func newGroupCache[T any](maxSize int64, sizeFn func(T) int64) (groupCache[T], error) {
 	if *cacheTTL == 0 {
-		return &noopIpRuleCache{}, nil
+		return &noopGroupCache[T]{}, nil
 	}
-	config := &lru.Config[*ipRuleCacheEntry]{
-		MaxSize: cacheSize,
-		SizeFn:  func(v *ipRuleCacheEntry) int64 { return int64(len(v.allowed)) },
+	config := &lru.Config[*groupCacheEntry[T]]{
+		MaxSize: maxSize,
+		SizeFn:  func(v *groupCacheEntry[T]) int64 { return sizeFn(v.value) },
 	}
-	l, err := lru.NewLRU[*ipRuleCacheEntry](config)
+	l, err := lru.NewLRU[*groupCacheEntry[T]](config)
 	if err != nil {
 		return nil, err
 	}
-	return &memIpRuleCache{
+	return &memGroupCache[T]{
 		lru: l,
 	}, nil
 }
@@ -105,18 +130,40 @@ func newIpRuleCache() (ipRuleCache, error) {
 type Service struct {
 	env environment.Env
 
-	cache ipRuleCache
+	// The allowed IP ranges of each group.
+	cache groupCache[[]*net.IPNet]
+	// When the overrides of each group's IP rules that are in effect expire,
+	// keyed by the ID of the user who created them.
+	overrides groupCache[map[string]int64]
+
+	// When denied requests were last audit logged, by group, client IP and
+	// credential.
+	deniedRequestsMu     sync.Mutex
+	deniedRequestsLogged interfaces.LRU[time.Time]
 }
 
 func New(env environment.Env) (*Service, error) {
-	cache, err := newIpRuleCache()
+	cache, err := newGroupCache(cacheSize, func(allowed []*net.IPNet) int64 { return int64(len(allowed)) })
+	if err != nil {
+		return nil, err
+	}
+	overrides, err := newGroupCache(overrideCacheSize, func(expiryByUser map[string]int64) int64 { return int64(max(len(expiryByUser), 1)) })
+	if err != nil {
+		return nil, err
+	}
+	deniedRequestsLogged, err := lru.NewLRU[time.Time](&lru.Config[time.Time]{
+		MaxSize: deniedRequestLogCacheSize,
+		SizeFn:  func(time.Time) int64 { return 1 },
+	})
 	if err != nil {
 		return nil, err
 	}
 
 	svc := &Service{
-		env:   env,
-		cache: cache,
+		env:                  env,
+		cache:                cache,
+		overrides:            overrides,
+		deniedRequestsLogged: deniedRequestsLogged,
 	}
 	if sns := env.GetServerNotificationService(); sns != nil {
 		go func() {
@@ -126,6 +173,7 @@ func New(env environment.Env) (*Service, error) {
 					alert.UnexpectedEvent("iprules_invalid_proto_type", "received proto type %T", msg)
 					continue
 				}
+				svc.overrides.Remove(ic.GetGroupId())
 				if err := svc.refreshRules(env.GetServerContext(), ic.GetGroupId()); err != nil {
 					log.Warningf("could not refresh IP rules for group %q: %s", ic.GetGroupId(), err)
 				}
@@ -219,15 +267,77 @@ func (s *Service) checkRules(ctx context.Context, groupID string, skipCache bool
 	return status.PermissionDeniedErrorf("Client %q is not allowed by Organization IP rules", rawClientIP)
 }
 
-func (s *Service) authorize(ctx context.Context, groupID string) error {
+func (s *Service) authorize(ctx context.Context, u interfaces.UserInfo, groupID string) error {
 	start := time.Now()
 	err := s.checkRules(ctx, groupID, false /*=skipCache*/, "" /*skipRuleID*/)
+	if status.IsPermissionDeniedError(err) && s.hasOverride(ctx, u, groupID) {
+		err = nil
+	}
 	metrics.IPRulesCheckLatencyUsec.With(
 		prometheus.Labels{metrics.StatusHumanReadableLabel: status.MetricsLabel(err)},
 	).Observe(float64(time.Since(start).Microseconds()))
 	return err
 }
 
+// hasOverride returns whether the user is an org admin who created an
+// override of the group's IP rules that is still in effect. Overrides only
+// apply to users that are signed in, not to API keys.
+func (s *Service) hasOverride(ctx context.Context, u interfaces.UserInfo, groupID string) bool {
+	if u.GetUserID() == "" || u.GetAPIKeyID() != "" {
+		return false
+	}
+	if err := authutil.AuthorizeOrgAdmin(u, groupID); err != nil {
+		return false
+	}
+	expiryByUser, ok := s.overrides.Get(groupID)
+	if !ok {
+		var err error
+		expiryByUser, err = s.loadOverridesFromDB(ctx, groupID)
+		if err != nil {
+			log.CtxWarningf(ctx, "Could not look up IP rules overrides for group %q: %s", groupID, err)
+			return false
+		}
+		s.overrides.Add(groupID, expiryByUser)
+	}
+	return time.Now().UnixMicro() < expiryByUser[u.GetUserID()]
+}
+
+// loadOverridesFromDB returns when the overrides of the group's IP rules that
+// are in effect expire, keyed by the ID of the user who created them.
+func (s *Service) loadOverridesFromDB(ctx context.Context, groupID string) (map[string]int64, error) {
+	rq := s.env.GetDBHandle().NewQuery(ctx, "iprules_get_overrides").Raw(
+		`SELECT * FROM "IPRuleOverrides" WHERE group_id = ? AND expiry_usec > ?`,
+		groupID, time.Now().UnixMicro())
+	expiryByUser := make(map[string]int64)
+	err := db.ScanEach(rq, func(ctx context.Context, o *tables.IPRuleOverride) error {
+		expiryByUser[o.UserID] = max(expiryByUser[o.UserID], o.ExpiryUsec)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return expiryByUser, nil
+}
+
+// logDeniedRequest records a request that was denied by the group's IP rules
+// in the audit log.
+func (s *Service) logDeniedRequest(ctx context.Context, u interfaces.UserInfo, method string) {
+	al := s.env.GetAuditLogger()
+	if al == nil {
+		return
+	}
+	key := strings.Join([]string{u.GetGroupID(), clientip.Get(ctx), u.GetUserID(), u.GetAPIKeyID()}, "/")
+	s.deniedRequestsMu.Lock()
+	last, ok := s.deniedRequestsLogged.Get(key)
+	if ok && time.Since(last) < deniedRequestLogInterval {
+		s.deniedRequestsMu.Unlock()
+		return
+	}
+	s.deniedRequestsLogged.Add(key, time.Now())
+	s.deniedRequestsMu.Unlock()
+	al.LogForGroup(ctx, u.GetGroupID(), alpb.Action_IP_RULES_ACCESS_DENIED, &irpb.DeniedRequest{Method: method})
+}
+
 func (s *Service) AuthorizeGroup(ctx context.Context, groupID string) error {
 	u, err := s.env.GetAuthenticator().AuthenticatedUser(ctx)
 	if err != nil {
@@ -246,10 +356,17 @@ func (s *Service) AuthorizeGroup(ctx context.Context, groupID string) error {
 		return nil
 	}
 
-	return s.authorize(ctx, groupID)
+	return s.authorize(ctx, u, groupID)
 }
 
 func (s *Service) Authorize(ctx context.Context) error {
+	method, _ := grpc.Method(ctx)
+	return s.authorizeRequest(ctx, method)
+}
+
+// authorizeRequest checks the IP rules of the authenticated group for a
+// request to the given gRPC method or HTTP path.
+func (s *Service) authorizeRequest(ctx context.Context, method string) error {
 	u, err := s.env.GetAuthenticator().AuthenticatedUser(ctx)
 	if err != nil {
 		// If auth failed we don't need to (and can't) apply IP rules.
@@ -278,7 +395,11 @@ func (s *Service) Authorize(ctx context.Context) error {
 		}
 	}
 
-	return s.authorize(ctx, u.GetGroupID())
+	err = s.authorize(ctx, u, u.GetGroupID())
+	if status.IsPermissionDeniedError(err) {
+		s.logDeniedRequest(ctx, u, method)
+	}
+	return err
 }
 
 func (s *Service) AuthorizeHTTPRequest(ctx context.Context, r *http.Request) error {
@@ -293,15 +414,15 @@ func (s *Service) AuthorizeHTTPRequest(ctx context.Context, r *http.Request) err
 		return nil
 	}
 
-	// All other APIs are subject to IP access checks.
-	if strings.HasPrefix(r.URL.Path, "/rpc/") || strings.HasPrefix(r.URL.Path, "/api/") {
-		err := s.Authorize(ctx)
-		if err != nil {
-			return err
-		}
+	// Org admins that are locked out can create an override, which is
+	// audit logged.
+	if r.URL.Path == "/rpc/BuildBuddyService/CreateIPRulesOverride" {
+		return nil
 	}
 
-	return nil
+	// All other authenticated endpoints, including file downloads, are
+	// subject to IP access checks.
+	return s.authorizeRequest(ctx, r.URL.Path)
 }
 
 func (s *Service) checkAccess(ctx context.Context, groupID string) error {
@@ -371,6 +492,113 @@ func (s *Service) SetIPRuleConfig(ctx context.Context, req *irpb.SetRulesConfigR
 	return &irpb.SetRulesConfigResponse{}, nil
 }
 
+func (s *Service) CreateOverride(ctx context.Context, req *irpb.CreateOverrideRequest) (*irpb.CreateOverrideResponse, error) {
+	groupID := req.GetRequestContext().GetGroupId()
+	if err := s.checkAccess(ctx, groupID); err != nil {
+		return nil, err
+	}
+	u, err := s.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if u.GetUserID() == "" || u.GetAPIKeyID() != "" {
+		return nil, status.PermissionDeniedError("IP rules overrides can only be created by signed-in users")
+	}
+	reason := strings.TrimSpace(req.GetReason())
+	if reason == "" {
+		return nil, status.InvalidArgumentError("A reason is required to override IP rules")
+	}
+	if len(reason) > maxOverrideReasonLength {
+		return nil, status.InvalidArgumentErrorf("Reason must be at most %d characters", maxOverrideReasonLength)
+	}
+	g, err := s.env.GetUserDB().GetGroupByID(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+	if !g.EnforceIPRules {
+		return nil, status.FailedPreconditionError("IP rules are not enforced for this organization")
+	}
+
+	id, err := tables.PrimaryKeyForTable("IPRuleOverrides")
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	expiry := now.Add(*overrideDuration)
+	err = s.env.GetDBHandle().Transaction(ctx, func(tx interfaces.DB) error {
+		// Clean up the group's expired overrides.
+		if err := tx.NewQuery(ctx, "iprules_delete_expired_overrides").Raw(
+			`DELETE FROM "IPRuleOverrides" WHERE group_id = ? AND expiry_usec <= ?`, groupID, now.UnixMicro()).Exec().Error; err != nil {
+			return err
+		}
+		return tx.NewQuery(ctx, "iprules_create_override").Create(&tables.IPRuleOverride{
+			IPRuleOverrideID: id,
+			GroupID:          groupID,
+			UserID:           u.GetUserID(),
+			Reason:           reason,
+			ExpiryUsec:       expiry.UnixMicro(),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Make the other apps pick up the override right away rather than when
+	// their cached overrides expire.
+	s.overrides.Remove(groupID)
+	s.publishRuleInvalidation(ctx, groupID)
+	log.CtxInfof(ctx, "User %q overrode IP rules of group %q until %s: %s", u.GetUserID(), groupID, expiry, reason)
+	return &irpb.CreateOverrideResponse{ExpiryUsec: expiry.UnixMicro(), OverrideId: id}, nil
+}
+
+func (s *Service) GetOverrides(ctx context.Context, req *irpb.GetOverridesRequest) (*irpb.GetOverridesResponse, error) {
+	groupID := req.GetRequestContext().GetGroupId()
+	if err := s.checkAccess(ctx, groupID); err != nil {
+		return nil, err
+	}
+	rq := s.env.GetDBHandle().NewQuery(ctx, "iprules_list_overrides").Raw(
+		`SELECT * FROM "IPRuleOverrides" WHERE group_id = ? AND expiry_usec > ? ORDER BY created_at_usec`,
+		groupID, time.Now().UnixMicro())
+	rsp := &irpb.GetOverridesResponse{}
+	err := db.ScanEach(rq, func(ctx context.Context, o *tables.IPRuleOverride) error {
+		rsp.Overrides = append(rsp.Overrides, &irpb.Override{
+			OverrideId:    o.IPRuleOverrideID,
+			UserId:        o.UserID,
+			Reason:        o.Reason,
+			CreatedAtUsec: o.CreatedAtUsec,
+			ExpiryUsec:    o.ExpiryUsec,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rsp, nil
+}
+
+func (s *Service) DeleteOverride(ctx context.Context, req *irpb.DeleteOverrideRequest) (*irpb.DeleteOverrideResponse, error) {
+	groupID := req.GetRequestContext().GetGroupId()
+	if err := s.checkAccess(ctx, groupID); err != nil {
+		return nil, err
+	}
+	if req.GetOverrideId() == "" {
+		return nil, status.InvalidArgumentError("An override ID is required")
+	}
+	result := s.env.GetDBHandle().NewQuery(ctx, "iprules_delete_override").Raw(
+		`DELETE FROM "IPRuleOverrides" WHERE group_id = ? AND ip_rule_override_id = ?`,
+		groupID, req.GetOverrideId()).Exec()
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, status.NotFoundErrorf("IP rules override %q not found", req.GetOverrideId())
+	}
+	// Revoke the override on the other apps right away rather than when
+	// their cached overrides expire.
+	s.overrides.Remove(groupID)
+	s.publishRuleInvalidation(ctx, groupID)
+	return &irpb.DeleteOverrideResponse{}, nil
+}
+
 func (s *Service) GetRules(ctx context.Context, req *irpb.GetRulesRequest) (*irpb.GetRulesResponse, error) {
 	rules, err := s.loadRulesFromDB(ctx, req.GetRequestContext().GetGroupId())
 	if err != nil {
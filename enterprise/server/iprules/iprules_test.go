@@ -2,14 +2,19 @@ package iprules_test
 
 import (
 	"context"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/iprules"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testauth"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testenv"
+	alpb "github.com/buildbuddy-io/buildbuddy/proto/auditlog"
 	ctxpb "github.com/buildbuddy-io/buildbuddy/proto/context"
 	irpb "github.com/buildbuddy-io/buildbuddy/proto/iprules"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauditlog"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
 	"github.com/buildbuddy-io/buildbuddy/server/util/authutil"
 	"github.com/buildbuddy-io/buildbuddy/server/util/clientip"
@@ -165,3 +170,210 @@ func TestEnforcement(t *testing.T) {
 	require.Error(t, err)
 	require.True(t, status.IsPermissionDeniedError(err))
 }
+
+// enforceRules enables IP rule enforcement for the user's group with a single
+// rule, and returns a context for the user.
+func enforceRules(t *testing.T, env environment.Env, irs *iprules.Service, userID string) context.Context {
+	ctx := context.Background()
+	auther := env.GetAuthenticator().(*testauth.TestAuthenticator)
+	authCtx, err := auther.WithAuthenticatedUser(ctx, userID)
+	require.NoError(t, err)
+	u, err := env.GetUserDB().GetUserByIDWithoutAuthCheck(ctx, userID)
+	require.NoError(t, err)
+	g := u.Groups[0].Group
+
+	_, err = irs.AddRule(authCtx, &irpb.AddRuleRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: g.GroupID},
+		Rule:           &irpb.IPRule{Cidr: "1.2.3.0/24", Description: "rule1"},
+	})
+	require.NoError(t, err)
+	g.EnforceIPRules = true
+	g.URLIdentifier = strings.ToLower(userID)
+	_, err = env.GetUserDB().UpdateGroup(authCtx, &g)
+	require.NoError(t, err)
+
+	// Re-auth to pick up new group settings.
+	authCtx, err = auther.WithAuthenticatedUser(ctx, userID)
+	require.NoError(t, err)
+	return authCtx
+}
+
+func TestOverride(t *testing.T) {
+	env := getEnv(t)
+	u := enterprise_testauth.CreateRandomUser(t, env, "org1.invalid")
+	groupID := u.Groups[0].Group.GroupID
+	irs := newIPRulesService(t, env)
+
+	req := &irpb.CreateOverrideRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: groupID},
+		Reason:         "office IP changed",
+	}
+
+	// Overrides can't be created when rules aren't enforced.
+	auther := env.GetAuthenticator().(*testauth.TestAuthenticator)
+	authCtx, err := auther.WithAuthenticatedUser(context.Background(), u.UserID)
+	require.NoError(t, err)
+	_, err = irs.CreateOverride(authCtx, req)
+	require.True(t, status.IsFailedPreconditionError(err), "unexpected error: %v", err)
+
+	authCtx = enforceRules(t, env, irs, u.UserID)
+	authCtx = context.WithValue(authCtx, clientip.ContextKey, "5.6.7.8")
+	err = irs.Authorize(authCtx)
+	require.True(t, status.IsPermissionDeniedError(err), "unexpected error: %v", err)
+
+	// A reason is required.
+	_, err = irs.CreateOverride(authCtx, &irpb.CreateOverrideRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: groupID},
+		Reason:         "  ",
+	})
+	require.True(t, status.IsInvalidArgumentError(err), "unexpected error: %v", err)
+	_, err = irs.CreateOverride(authCtx, &irpb.CreateOverrideRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: groupID},
+		Reason:         strings.Repeat("a", 1001),
+	})
+	require.True(t, status.IsInvalidArgumentError(err), "unexpected error: %v", err)
+
+	// Creating an override from a denied IP is allowed, and lets the admin
+	// back in.
+	httpReq := httptest.NewRequest("POST", "/rpc/BuildBuddyService/CreateIPRulesOverride", nil)
+	require.NoError(t, irs.AuthorizeHTTPRequest(authCtx, httpReq))
+	rsp, err := irs.CreateOverride(authCtx, req)
+	require.NoError(t, err)
+	require.Greater(t, rsp.GetExpiryUsec(), int64(0))
+	err = irs.Authorize(authCtx)
+	require.NoError(t, err)
+	err = irs.AuthorizeGroup(authCtx, groupID)
+	require.NoError(t, err)
+
+	// Expired overrides don't apply.
+	flags.Set(t, "auth.ip_rules.override_duration", -1)
+	u2 := enterprise_testauth.CreateRandomUser(t, env, "org2.invalid")
+	authCtx2 := enforceRules(t, env, irs, u2.UserID)
+	authCtx2 = context.WithValue(authCtx2, clientip.ContextKey, "5.6.7.8")
+	_, err = irs.CreateOverride(authCtx2, &irpb.CreateOverrideRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: u2.Groups[0].Group.GroupID},
+		Reason:         "office IP changed",
+	})
+	require.NoError(t, err)
+	err = irs.Authorize(authCtx2)
+	require.True(t, status.IsPermissionDeniedError(err), "unexpected error: %v", err)
+
+	// Overrides are per group.
+	_, err = irs.CreateOverride(authCtx, &irpb.CreateOverrideRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: u2.Groups[0].Group.GroupID},
+		Reason:         "office IP changed",
+	})
+	require.True(t, status.IsPermissionDeniedError(err), "unexpected error: %v", err)
+}
+
+func TestListAndDeleteOverrides(t *testing.T) {
+	env := getEnv(t)
+	u := enterprise_testauth.CreateRandomUser(t, env, "org1.invalid")
+	groupID := u.Groups[0].Group.GroupID
+	flags.Set(t, "auth.ip_rules.enable", true)
+	flags.Set(t, "auth.ip_rules.cache_ttl", time.Hour)
+	irs, err := iprules.New(env)
+	require.NoError(t, err)
+	authCtx := enforceRules(t, env, irs, u.UserID)
+	authCtx = context.WithValue(authCtx, clientip.ContextKey, "5.6.7.8")
+	rc := &ctxpb.RequestContext{GroupId: groupID}
+
+	created, err := irs.CreateOverride(authCtx, &irpb.CreateOverrideRequest{
+		RequestContext: rc,
+		Reason:         "office IP changed",
+	})
+	require.NoError(t, err)
+	require.NoError(t, irs.Authorize(authCtx))
+
+	rsp, err := irs.GetOverrides(authCtx, &irpb.GetOverridesRequest{RequestContext: rc})
+	require.NoError(t, err)
+	require.Len(t, rsp.GetOverrides(), 1)
+	o := rsp.GetOverrides()[0]
+	require.Equal(t, created.GetOverrideId(), o.GetOverrideId())
+	require.Equal(t, u.UserID, o.GetUserId())
+	require.Equal(t, "office IP changed", o.GetReason())
+	require.Equal(t, created.GetExpiryUsec(), o.GetExpiryUsec())
+
+	// Other groups' overrides can't be listed or revoked.
+	u2 := enterprise_testauth.CreateRandomUser(t, env, "org2.invalid")
+	authCtx2 := enforceRules(t, env, irs, u2.UserID)
+	_, err = irs.GetOverrides(authCtx2, &irpb.GetOverridesRequest{RequestContext: rc})
+	require.True(t, status.IsPermissionDeniedError(err), "unexpected error: %v", err)
+	_, err = irs.DeleteOverride(authCtx2, &irpb.DeleteOverrideRequest{RequestContext: rc, OverrideId: o.GetOverrideId()})
+	require.True(t, status.IsPermissionDeniedError(err), "unexpected error: %v", err)
+	_, err = irs.DeleteOverride(authCtx2, &irpb.DeleteOverrideRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: u2.Groups[0].Group.GroupID},
+		OverrideId:     o.GetOverrideId(),
+	})
+	require.True(t, status.IsNotFoundError(err), "unexpected error: %v", err)
+
+	// Revoking the override takes effect right away, even though overrides
+	// are cached.
+	_, err = irs.DeleteOverride(authCtx, &irpb.DeleteOverrideRequest{RequestContext: rc, OverrideId: o.GetOverrideId()})
+	require.NoError(t, err)
+	err = irs.Authorize(authCtx)
+	require.True(t, status.IsPermissionDeniedError(err), "unexpected error: %v", err)
+	rsp, err = irs.GetOverrides(authCtx, &irpb.GetOverridesRequest{RequestContext: rc})
+	require.NoError(t, err)
+	require.Empty(t, rsp.GetOverrides())
+}
+
+func TestOverrideCached(t *testing.T) {
+	env := getEnv(t)
+	u := enterprise_testauth.CreateRandomUser(t, env, "org1.invalid")
+	groupID := u.Groups[0].Group.GroupID
+	flags.Set(t, "auth.ip_rules.enable", true)
+	flags.Set(t, "auth.ip_rules.cache_ttl", time.Hour)
+	irs, err := iprules.New(env)
+	require.NoError(t, err)
+	authCtx := enforceRules(t, env, irs, u.UserID)
+	authCtx = context.WithValue(authCtx, clientip.ContextKey, "5.6.7.8")
+
+	// The lack of an override is cached, but creating one takes effect right
+	// away.
+	err = irs.Authorize(authCtx)
+	require.True(t, status.IsPermissionDeniedError(err), "unexpected error: %v", err)
+	_, err = irs.CreateOverride(authCtx, &irpb.CreateOverrideRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: groupID},
+		Reason:         "office IP changed",
+	})
+	require.NoError(t, err)
+	require.NoError(t, irs.Authorize(authCtx))
+
+	// Once loaded, the override is served from the cache.
+	require.NoError(t, env.GetDBHandle().NewQuery(context.Background(), "iprules_test_delete_overrides").Raw(
+		`DELETE FROM "IPRuleOverrides" WHERE group_id = ?`, groupID).Exec().Error)
+	require.NoError(t, irs.Authorize(authCtx))
+}
+
+func TestDeniedRequestsAreAuditLogged(t *testing.T) {
+	env := enterprise_testenv.New(t)
+	enterprise_testauth.Configure(t, env)
+	al := testauditlog.New(t)
+	env.SetAuditLogger(al)
+	u := enterprise_testauth.CreateRandomUser(t, env, "org1.invalid")
+	irs := newIPRulesService(t, env)
+	authCtx := enforceRules(t, env, irs, u.UserID)
+
+	authCtx = context.WithValue(authCtx, clientip.ContextKey, "1.2.3.4")
+	require.NoError(t, irs.Authorize(authCtx))
+	require.Empty(t, al.GetAllEntries())
+
+	// Repeated denials from the same client are only logged once.
+	authCtx = context.WithValue(authCtx, clientip.ContextKey, "5.6.7.8")
+	for i := 0; i < 3; i++ {
+		err := irs.AuthorizeHTTPRequest(authCtx, httptest.NewRequest("GET", "/file/download", nil))
+		require.True(t, status.IsPermissionDeniedError(err), "unexpected error: %v", err)
+	}
+	entries := al.GetAllEntries()
+	require.Len(t, entries, 1)
+	require.Equal(t, alpb.Action_IP_RULES_ACCESS_DENIED, entries[0].Action)
+	require.Equal(t, u.Groups[0].Group.GroupID, entries[0].Resource.GetId())
+	require.Equal(t, "/file/download", entries[0].Request.(*irpb.DeniedRequest).GetMethod())
+
+	// Denials from another client are logged separately.
+	authCtx = context.WithValue(authCtx, clientip.ContextKey, "9.9.9.9")
+	err := irs.Authorize(authCtx)
+	require.True(t, status.IsPermissionDeniedError(err), "unexpected error: %v", err)
+	require.Len(t, al.GetAllEntries(), 2)
+}
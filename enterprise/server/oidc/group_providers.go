@@ -0,0 +1,503 @@
+package oidc
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/authutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/role"
+	"github.com/buildbuddy-io/buildbuddy/server/util/ssrf"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	oppb "github.com/buildbuddy-io/buildbuddy/proto/oidc_provider"
+	oidc "github.com/coreos/go-oidc/v3/oidc"
+)
+
+var (
+	enableGroupProviders = flag.Bool("auth.group_oidc_providers.enabled", false, "If true, each organization can register its own OIDC provider, which its members log in with at /login?slug=<org URL identifier> or on the organization's subdomain, in addition to the auth.oauth_providers configured for the whole server.")
+)
+
+const (
+	// The issuer cookie of users that logged in with the provider of a group
+	// is this prefix followed by the group ID, since several groups may
+	// register the same issuer with different clients.
+	groupIssuerPrefix = "group:"
+
+	// How long the authenticator of a group is used before checking whether
+	// the group changed its provider.
+	groupAuthenticatorTTL = 1 * time.Minute
+
+	// How long requests for the configuration and keys of a provider may
+	// take.
+	providerRequestTimeout = 10 * time.Second
+
+	maxRoleMappings = 100
+)
+
+// GroupProvidersEnabled returns whether groups can register their own OIDC
+// provider.
+func GroupProvidersEnabled() bool {
+	return *enableGroupProviders
+}
+
+// groupAuthenticator authenticates the members of a group with the provider
+// that the group registered, mapping the claims of their ID tokens as the
+// group configured.
+type groupAuthenticator struct {
+	*oidcAuthenticator
+	groupID      string
+	provider     *tables.GroupOIDCProvider
+	roleMappings []*tables.GroupOIDCRoleMapping
+	expiresAfter time.Time
+}
+
+func (a *groupAuthenticator) getIssuer() string {
+	return groupIssuerPrefix + a.groupID
+}
+
+func (a *groupAuthenticator) verifyTokenAndExtractUser(ctx context.Context, jwt string, checkExpiry bool) (*userToken, error) {
+	validToken, err := a.verifyToken(ctx, jwt, checkExpiry)
+	if err != nil {
+		return nil, err
+	}
+	ut, err := extractToken(a.issuer, a.slug, validToken)
+	if err != nil {
+		return nil, err
+	}
+	ut.providerGroupID = a.groupID
+	claims := map[string]any{}
+	if err := validToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+	if c := a.provider.EmailClaim; c != "" {
+		ut.Email = stringClaim(claims, c)
+	}
+	if c := a.provider.FirstNameClaim; c != "" {
+		ut.GivenName = stringClaim(claims, c)
+	}
+	if c := a.provider.LastNameClaim; c != "" {
+		ut.FamilyName = stringClaim(claims, c)
+	}
+	// The role is only given when the user signs up, so changing the mappings
+	// or the user's IdP groups doesn't change the role of existing members.
+	if c := a.provider.GroupsClaim; c != "" {
+		idpGroups := stringsClaim(claims, c)
+		for _, m := range a.roleMappings {
+			if slices.Contains(idpGroups, m.IDPGroup) {
+				ut.role = role.Role(m.Role)
+				break
+			}
+		}
+	}
+	return ut, nil
+}
+
+func stringClaim(claims map[string]any, name string) string {
+	s, _ := claims[name].(string)
+	return s
+}
+
+// stringsClaim returns the values of a claim that lists strings. Some IdPs
+// send a single string instead of a list when there's only one value.
+func stringsClaim(claims map[string]any, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+// groupProviders manages the OIDC providers that groups register for their
+// members, and the authenticators for them.
+type groupProviders struct {
+	env     environment.Env
+	authURL *url.URL
+	// The client used to fetch the configuration and keys of providers, which
+	// refuses to connect to internal addresses since the issuer URLs are
+	// chosen by org admins.
+	httpClient *http.Client
+
+	mu sync.Mutex
+	// Authenticators keyed by group ID, created on first use since creating
+	// one requires fetching the provider's discovery document.
+	authenticators map[string]*groupAuthenticator
+}
+
+func newGroupProviders(env environment.Env, authURL *url.URL) *groupProviders {
+	return &groupProviders{
+		env:            env,
+		authURL:        authURL,
+		httpClient:     ssrf.NewClient(providerRequestTimeout),
+		authenticators: make(map[string]*groupAuthenticator),
+	}
+}
+
+// GroupProviderService returns the service that manages the OIDC providers
+// of groups, or nil if groups can't register their own provider.
+func (a *OpenIDAuthenticator) GroupProviderService() interfaces.OIDCProviderService {
+	if a.groupProviders == nil {
+		return nil
+	}
+	return a.groupProviders
+}
+
+func (a *OpenIDAuthenticator) getGroupAuthConfig(ctx context.Context, groupID string) authenticator {
+	if a.groupProviders == nil {
+		return nil
+	}
+	auth, err := a.groupProviders.authenticator(ctx, groupID)
+	if err != nil {
+		if !status.IsNotFoundError(err) {
+			log.CtxWarningf(ctx, "Failed to look up the OIDC provider of group %q: %s", groupID, err)
+		}
+		return nil
+	}
+	return auth
+}
+
+func (a *OpenIDAuthenticator) getGroupAuthConfigForSlug(ctx context.Context, slug string) authenticator {
+	if a.groupProviders == nil || slug == "" {
+		return nil
+	}
+	userDB := a.env.GetUserDB()
+	if userDB == nil {
+		return nil
+	}
+	g, err := userDB.GetGroupByURLIdentifier(ctx, slug)
+	if err != nil {
+		if !status.IsNotFoundError(err) {
+			log.CtxWarningf(ctx, "Failed to look up group for slug %q: %s", slug, err)
+		}
+		return nil
+	}
+	return a.getGroupAuthConfig(ctx, g.GroupID)
+}
+
+func (p *groupProviders) clientContext(ctx context.Context) context.Context {
+	return oidc.ClientContext(ctx, p.httpClient)
+}
+
+// encryptClientSecret encrypts the client secret of a group's provider with
+// the KMS master key, binding it to the group so that it can't be used for
+// another group's provider.
+func (p *groupProviders) encryptClientSecret(groupID, secret string) (string, error) {
+	masterKey, err := p.env.GetKMS().FetchMasterKey()
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := masterKey.Encrypt([]byte(secret), []byte(groupID))
+	if err != nil {
+		return "", status.InternalErrorf("encrypt client secret: %s", err)
+	}
+	return base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// decryptClientSecret decrypts a client secret that was encrypted with
+// encryptClientSecret.
+func (p *groupProviders) decryptClientSecret(groupID, encrypted string) (string, error) {
+	masterKey, err := p.env.GetKMS().FetchMasterKey()
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", status.InternalErrorf("malformed client secret of group %q", groupID)
+	}
+	secret, err := masterKey.Decrypt(ciphertext, []byte(groupID))
+	if err != nil {
+		return "", status.InternalErrorf("decrypt client secret of group %q: %s", groupID, err)
+	}
+	return string(secret), nil
+}
+
+func (p *groupProviders) lookupProvider(ctx context.Context, groupID string) (*tables.GroupOIDCProvider, error) {
+	row := &tables.GroupOIDCProvider{}
+	err := p.env.GetDBHandle().NewQuery(ctx, "oidc_get_group_provider").Raw(
+		`SELECT * FROM "GroupOIDCProviders" WHERE group_id = ?`, groupID,
+	).Take(row)
+	if db.IsRecordNotFound(err) {
+		return nil, status.NotFoundErrorf("group %q has no OIDC provider", groupID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return row, nil
+}
+
+func (p *groupProviders) lookupRoleMappings(ctx context.Context, groupID string) ([]*tables.GroupOIDCRoleMapping, error) {
+	rq := p.env.GetDBHandle().NewQuery(ctx, "oidc_get_group_role_mappings").Raw(
+		`SELECT * FROM "GroupOIDCRoleMappings" WHERE group_id = ? ORDER BY position`, groupID)
+	return db.ScanAll(rq, &tables.GroupOIDCRoleMapping{})
+}
+
+// authenticator returns the authenticator for the provider of the given group.
+func (p *groupProviders) authenticator(ctx context.Context, groupID string) (*groupAuthenticator, error) {
+	p.mu.Lock()
+	cached := p.authenticators[groupID]
+	p.mu.Unlock()
+	if cached != nil && time.Now().Before(cached.expiresAfter) {
+		return cached, nil
+	}
+
+	row, err := p.lookupProvider(ctx, groupID)
+	if err != nil {
+		if status.IsNotFoundError(err) {
+			p.invalidate(groupID)
+		}
+		return nil, err
+	}
+	roleMappings, err := p.lookupRoleMappings(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+	g, err := p.env.GetUserDB().GetGroupByID(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	var oa *oidcAuthenticator
+	if cached != nil && cached.provider.IssuerURL == row.IssuerURL && cached.provider.ClientID == row.ClientID && cached.provider.EncryptedClientSecret == row.EncryptedClientSecret && cached.slug == g.URLIdentifier {
+		// Keep the fetched configuration and keys of the provider.
+		oa = cached.oidcAuthenticator
+	} else {
+		clientSecret, err := p.decryptClientSecret(groupID, row.EncryptedClientSecret)
+		if err != nil {
+			return nil, err
+		}
+		// The provider keeps using the context to fetch its keys, so it must
+		// outlive the request.
+		oa = newOIDCAuthenticator(p.clientContext(p.env.GetServerContext()), OauthProvider{
+			IssuerURL:    row.IssuerURL,
+			ClientID:     row.ClientID,
+			ClientSecret: clientSecret,
+			Slug:         g.URLIdentifier,
+		}, p.authURL)
+		// Token requests go to an endpoint that the group configured, so
+		// they must not reach internal addresses either.
+		oa.httpClient = p.httpClient
+	}
+	auth := &groupAuthenticator{
+		oidcAuthenticator: oa,
+		groupID:           groupID,
+		provider:          row,
+		roleMappings:      roleMappings,
+		expiresAfter:      time.Now().Add(groupAuthenticatorTTL),
+	}
+	p.mu.Lock()
+	p.authenticators[groupID] = auth
+	p.mu.Unlock()
+	return auth, nil
+}
+
+// invalidate makes the next login of the group's members use its current
+// provider. Other apps pick up the change within groupAuthenticatorTTL.
+func (p *groupProviders) invalidate(groupID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.authenticators, groupID)
+}
+
+func (p *groupProviders) checkAccess(ctx context.Context, groupID string) error {
+	if groupID == "" {
+		return status.InvalidArgumentError("Missing organization identifier.")
+	}
+	u, err := p.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return err
+	}
+	return authutil.AuthorizeOrgAdmin(u, groupID)
+}
+
+func (p *groupProviders) GetOIDCProvider(ctx context.Context, req *oppb.GetOIDCProviderRequest) (*oppb.GetOIDCProviderResponse, error) {
+	groupID := req.GetRequestContext().GetGroupId()
+	if err := p.checkAccess(ctx, groupID); err != nil {
+		return nil, err
+	}
+	row, err := p.lookupProvider(ctx, groupID)
+	if status.IsNotFoundError(err) {
+		return &oppb.GetOIDCProviderResponse{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	roleMappings, err := p.lookupRoleMappings(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+	provider := &oppb.OIDCProvider{
+		IssuerUrl:       row.IssuerURL,
+		ClientId:        row.ClientID,
+		ClientSecretSet: row.EncryptedClientSecret != "",
+		ClaimMapping: &oppb.ClaimMapping{
+			Email:     row.EmailClaim,
+			FirstName: row.FirstNameClaim,
+			LastName:  row.LastNameClaim,
+			Groups:    row.GroupsClaim,
+		},
+	}
+	for _, m := range roleMappings {
+		r, err := role.ToProto(role.Role(m.Role))
+		if err != nil {
+			return nil, err
+		}
+		provider.RoleMapping = append(provider.RoleMapping, &oppb.RoleMapping{
+			IdpGroup: m.IDPGroup,
+			Role:     r,
+		})
+	}
+	return &oppb.GetOIDCProviderResponse{Provider: provider}, nil
+}
+
+func validateIssuerURL(issuer string) error {
+	u, err := url.Parse(issuer)
+	if err != nil || u.Host == "" {
+		return status.InvalidArgumentErrorf("invalid issuer URL %q", issuer)
+	}
+	if u.Scheme != "https" {
+		return status.InvalidArgumentErrorf("issuer URL %q must use HTTPS", issuer)
+	}
+	return nil
+}
+
+func (p *groupProviders) SetOIDCProvider(ctx context.Context, req *oppb.SetOIDCProviderRequest) (*oppb.SetOIDCProviderResponse, error) {
+	groupID := req.GetRequestContext().GetGroupId()
+	if err := p.checkAccess(ctx, groupID); err != nil {
+		return nil, err
+	}
+	g, err := p.env.GetUserDB().GetGroupByID(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+	if g.URLIdentifier == "" {
+		return nil, status.FailedPreconditionError("The organization must have a URL identifier for its members to log in with its OIDC provider.")
+	}
+
+	pr := req.GetProvider()
+	row := &tables.GroupOIDCProvider{
+		GroupID:        groupID,
+		IssuerURL:      strings.TrimSpace(pr.GetIssuerUrl()),
+		ClientID:       strings.TrimSpace(pr.GetClientId()),
+		EmailClaim:     strings.TrimSpace(pr.GetClaimMapping().GetEmail()),
+		FirstNameClaim: strings.TrimSpace(pr.GetClaimMapping().GetFirstName()),
+		LastNameClaim:  strings.TrimSpace(pr.GetClaimMapping().GetLastName()),
+		GroupsClaim:    strings.TrimSpace(pr.GetClaimMapping().GetGroups()),
+	}
+	if err := validateIssuerURL(row.IssuerURL); err != nil {
+		return nil, err
+	}
+	if row.ClientID == "" {
+		return nil, status.InvalidArgumentError("missing client ID")
+	}
+	existing, err := p.lookupProvider(ctx, groupID)
+	if err != nil && !status.IsNotFoundError(err) {
+		return nil, err
+	}
+	if pr.GetClientSecret() != "" {
+		row.EncryptedClientSecret, err = p.encryptClientSecret(groupID, pr.GetClientSecret())
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if existing == nil || existing.EncryptedClientSecret == "" {
+			return nil, status.InvalidArgumentError("missing client secret")
+		}
+		row.EncryptedClientSecret = existing.EncryptedClientSecret
+	}
+
+	if len(pr.GetRoleMapping()) > maxRoleMappings {
+		return nil, status.InvalidArgumentErrorf("at most %d role mappings may be set", maxRoleMappings)
+	}
+	if len(pr.GetRoleMapping()) > 0 && row.GroupsClaim == "" {
+		return nil, status.InvalidArgumentError("role mappings require the groups claim to be set")
+	}
+	roleMappings := make([]*tables.GroupOIDCRoleMapping, 0, len(pr.GetRoleMapping()))
+	for i, m := range pr.GetRoleMapping() {
+		if m.GetIdpGroup() == "" {
+			return nil, status.InvalidArgumentError("role mappings must have an IdP group")
+		}
+		r, err := role.FromProto(m.GetRole())
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("invalid role for IdP group %q: %s", m.GetIdpGroup(), err)
+		}
+		roleMappings = append(roleMappings, &tables.GroupOIDCRoleMapping{
+			GroupID:  groupID,
+			Position: int32(i),
+			IDPGroup: m.GetIdpGroup(),
+			Role:     uint32(r),
+		})
+	}
+
+	// Catch typos in the issuer URL before members try to log in with it.
+	if _, err := oidc.NewProvider(p.clientContext(ctx), row.IssuerURL); err != nil {
+		// Don't return the error, which may include the response of whatever
+		// server the URL points to.
+		log.CtxInfof(ctx, "Failed to get the configuration of OIDC issuer %q for group %q: %s", row.IssuerURL, groupID, err)
+		return nil, status.InvalidArgumentErrorf("could not get the OIDC configuration of issuer %q, check that %s/.well-known/openid-configuration exists and lists %q as the issuer", row.IssuerURL, strings.TrimSuffix(row.IssuerURL, "/"), row.IssuerURL)
+	}
+
+	err = p.env.GetDBHandle().Transaction(ctx, func(tx interfaces.DB) error {
+		if err := tx.NewQuery(ctx, "oidc_delete_group_provider").Raw(
+			`DELETE FROM "GroupOIDCProviders" WHERE group_id = ?`, groupID).Exec().Error; err != nil {
+			return err
+		}
+		if err := tx.NewQuery(ctx, "oidc_create_group_provider").Create(row); err != nil {
+			return err
+		}
+		if err := tx.NewQuery(ctx, "oidc_delete_group_role_mappings").Raw(
+			`DELETE FROM "GroupOIDCRoleMappings" WHERE group_id = ?`, groupID).Exec().Error; err != nil {
+			return err
+		}
+		for _, m := range roleMappings {
+			if err := tx.NewQuery(ctx, "oidc_create_group_role_mapping").Create(m); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.invalidate(groupID)
+	return &oppb.SetOIDCProviderResponse{}, nil
+}
+
+func (p *groupProviders) DeleteOIDCProvider(ctx context.Context, req *oppb.DeleteOIDCProviderRequest) (*oppb.DeleteOIDCProviderResponse, error) {
+	groupID := req.GetRequestContext().GetGroupId()
+	if err := p.checkAccess(ctx, groupID); err != nil {
+		return nil, err
+	}
+	err := p.env.GetDBHandle().Transaction(ctx, func(tx interfaces.DB) error {
+		if err := tx.NewQuery(ctx, "oidc_delete_group_provider").Raw(
+			`DELETE FROM "GroupOIDCProviders" WHERE group_id = ?`, groupID).Exec().Error; err != nil {
+			return err
+		}
+		return tx.NewQuery(ctx, "oidc_delete_group_role_mappings").Raw(
+			`DELETE FROM "GroupOIDCRoleMappings" WHERE group_id = ?`, groupID).Exec().Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.invalidate(groupID)
+	return &oppb.DeleteOIDCProviderResponse{}, nil
+}
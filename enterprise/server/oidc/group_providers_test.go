@@ -0,0 +1,476 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/kms"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testauth"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
+	"github.com/buildbuddy-io/buildbuddy/server/util/cookie"
+	requestcontext "github.com/buildbuddy-io/buildbuddy/server/util/request_context"
+	"github.com/buildbuddy-io/buildbuddy/server/util/role"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/subdomain"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	ctxpb "github.com/buildbuddy-io/buildbuddy/proto/context"
+	grpb "github.com/buildbuddy-io/buildbuddy/proto/group"
+	oppb "github.com/buildbuddy-io/buildbuddy/proto/oidc_provider"
+)
+
+const (
+	testClientID = "buildbuddy-client"
+	testKeyID    = "test-key"
+)
+
+// fakeIdP serves the discovery document and signing keys of an OIDC provider
+// over HTTPS, and issues ID tokens like the provider would.
+type fakeIdP struct {
+	t      *testing.T
+	url    string
+	key    *rsa.PrivateKey
+	server *httptest.Server
+	// The token endpoint advertised by the provider, defaulting to one served
+	// by the fake IdP.
+	tokenURL string
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	f := &fakeIdP{t: t, key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		tokenURL := f.tokenURL
+		if tokenURL == "" {
+			tokenURL = f.url + "/token"
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                f.url,
+			"authorization_endpoint":                f.url + "/authorize",
+			"token_endpoint":                        tokenURL,
+			"jwks_uri":                              f.url + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		b64 := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": testKeyID,
+				"n":   b64(key.N.Bytes()),
+				"e":   b64(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	f.server = httptest.NewTLSServer(mux)
+	t.Cleanup(f.server.Close)
+	f.url = f.server.URL
+	return f
+}
+
+func (f *fakeIdP) token(claims jwt.MapClaims) string {
+	c := jwt.MapClaims{
+		"iss": f.url,
+		"aud": testClientID,
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(5 * time.Minute).Unix(),
+	}
+	for k, v := range claims {
+		c[k] = v
+	}
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, c)
+	tok.Header["kid"] = testKeyID
+	s, err := tok.SignedString(f.key)
+	require.NoError(f.t, err)
+	return s
+}
+
+func setupGroupProviders(t *testing.T) (environment.Env, *OpenIDAuthenticator, *fakeIdP) {
+	flags.Set(t, "auth.group_oidc_providers.enabled", true)
+	// The fake IdP listens on a loopback address.
+	flags.Set(t, "app.allowed_private_destination_cidrs", []string{"127.0.0.0/8", "::1/128"})
+	kmsDir := testfs.MakeTempDir(t)
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(kmsDir, "master"), key, 0600))
+	flags.Set(t, "keystore.local_insecure_kms_directory", kmsDir)
+	flags.Set(t, "keystore.master_key_uri", "local-insecure-kms://master")
+
+	idp := newFakeIdP(t)
+	env := enterprise_testenv.New(t)
+	enterprise_testauth.Configure(t, env)
+	kmsClient, err := kms.New(context.Background())
+	require.NoError(t, err)
+	env.SetKMS(kmsClient)
+	auth, err := newOpenIDAuthenticator(context.Background(), env, nil /*=oauthProviders*/, "")
+	require.NoError(t, err)
+	// Trust the certificate of the fake IdP, keeping the client that refuses
+	// other internal addresses.
+	auth.groupProviders.httpClient.Transport.(*http.Transport).TLSClientConfig = idp.server.Client().Transport.(*http.Transport).TLSClientConfig
+	return env, auth, idp
+}
+
+// createGroup creates a group with the given URL identifier and returns the
+// context of its admin.
+func createGroup(t *testing.T, env environment.Env, slug string) (context.Context, string) {
+	u := enterprise_testauth.CreateRandomUser(t, env, slug+".invalid")
+	auther := env.GetAuthenticator().(*testauth.TestAuthenticator)
+	ctx, err := auther.WithAuthenticatedUser(context.Background(), u.UserID)
+	require.NoError(t, err)
+	groupID := u.Groups[0].Group.GroupID
+	_, err = env.GetUserDB().UpdateGroup(ctx, &tables.Group{GroupID: groupID, URLIdentifier: slug})
+	require.NoError(t, err)
+	return ctx, groupID
+}
+
+func setProvider(ctx context.Context, s *groupProviders, groupID string, p *oppb.OIDCProvider) error {
+	_, err := s.SetOIDCProvider(ctx, &oppb.SetOIDCProviderRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: groupID},
+		Provider:       p,
+	})
+	return err
+}
+
+func getProvider(t *testing.T, ctx context.Context, s *groupProviders, groupID string) *oppb.OIDCProvider {
+	rsp, err := s.GetOIDCProvider(ctx, &oppb.GetOIDCProviderRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: groupID},
+	})
+	require.NoError(t, err)
+	return rsp.GetProvider()
+}
+
+func TestSetGroupOIDCProviderValidation(t *testing.T) {
+	env, auth, idp := setupGroupProviders(t)
+	ctx, groupID := createGroup(t, env, "acme")
+	s := auth.groupProviders
+
+	for _, tc := range []struct {
+		name     string
+		provider *oppb.OIDCProvider
+	}{
+		{
+			name:     "http issuer",
+			provider: &oppb.OIDCProvider{IssuerUrl: "http://idp.example.com", ClientId: testClientID, ClientSecret: "secret"},
+		},
+		{
+			name:     "missing client ID",
+			provider: &oppb.OIDCProvider{IssuerUrl: idp.url, ClientSecret: "secret"},
+		},
+		{
+			name:     "missing client secret",
+			provider: &oppb.OIDCProvider{IssuerUrl: idp.url, ClientId: testClientID},
+		},
+		{
+			name: "role mapping without groups claim",
+			provider: &oppb.OIDCProvider{
+				IssuerUrl:    idp.url,
+				ClientId:     testClientID,
+				ClientSecret: "secret",
+				RoleMapping:  []*oppb.RoleMapping{{IdpGroup: "admins", Role: grpb.Group_ADMIN_ROLE}},
+			},
+		},
+		{
+			name: "role mapping without role",
+			provider: &oppb.OIDCProvider{
+				IssuerUrl:    idp.url,
+				ClientId:     testClientID,
+				ClientSecret: "secret",
+				ClaimMapping: &oppb.ClaimMapping{Groups: "groups"},
+				RoleMapping:  []*oppb.RoleMapping{{IdpGroup: "admins"}},
+			},
+		},
+		{
+			name:     "issuer without discovery document",
+			provider: &oppb.OIDCProvider{IssuerUrl: idp.url + "/missing", ClientId: testClientID, ClientSecret: "secret"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := setProvider(ctx, s, groupID, tc.provider)
+			assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error, got %v", err)
+		})
+	}
+	assert.Nil(t, getProvider(t, ctx, s, groupID))
+}
+
+func TestSetGroupOIDCProviderInternalIssuer(t *testing.T) {
+	env, auth, idp := setupGroupProviders(t)
+	ctx, groupID := createGroup(t, env, "acme")
+	flags.Set(t, "app.allowed_private_destination_cidrs", []string{})
+
+	err := setProvider(ctx, auth.groupProviders, groupID, &oppb.OIDCProvider{IssuerUrl: idp.url, ClientId: testClientID, ClientSecret: "secret"})
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error, got %v", err)
+	assert.Nil(t, getProvider(t, ctx, auth.groupProviders, groupID))
+}
+
+func TestGroupOIDCProviderCRUD(t *testing.T) {
+	env, auth, idp := setupGroupProviders(t)
+	ctx, groupID := createGroup(t, env, "acme")
+	otherCtx, otherGroupID := createGroup(t, env, "other")
+	s := auth.groupProviders
+
+	require.Nil(t, getProvider(t, ctx, s, groupID))
+
+	err := setProvider(ctx, s, groupID, &oppb.OIDCProvider{
+		IssuerUrl:    idp.url,
+		ClientId:     testClientID,
+		ClientSecret: "secret",
+		ClaimMapping: &oppb.ClaimMapping{Email: "upn", Groups: "roles"},
+		RoleMapping: []*oppb.RoleMapping{
+			{IdpGroup: "bb-admins", Role: grpb.Group_ADMIN_ROLE},
+			{IdpGroup: "bb-readers", Role: grpb.Group_READER_ROLE},
+		},
+	})
+	require.NoError(t, err)
+
+	// The secret is never returned.
+	expected := &oppb.OIDCProvider{
+		IssuerUrl:       idp.url,
+		ClientId:        testClientID,
+		ClientSecretSet: true,
+		ClaimMapping:    &oppb.ClaimMapping{Email: "upn", Groups: "roles"},
+		RoleMapping: []*oppb.RoleMapping{
+			{IdpGroup: "bb-admins", Role: grpb.Group_ADMIN_ROLE},
+			{IdpGroup: "bb-readers", Role: grpb.Group_READER_ROLE},
+		},
+	}
+	assert.Equal(t, expected.String(), getProvider(t, ctx, s, groupID).String())
+
+	// Updating the provider without a secret keeps the current one.
+	err = setProvider(ctx, s, groupID, &oppb.OIDCProvider{IssuerUrl: idp.url, ClientId: "new-client"})
+	require.NoError(t, err)
+	row, err := s.lookupProvider(ctx, groupID)
+	require.NoError(t, err)
+	assert.Equal(t, "new-client", row.ClientID)
+	assert.NotContains(t, row.EncryptedClientSecret, "secret")
+	secret, err := s.decryptClientSecret(groupID, row.EncryptedClientSecret)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", secret)
+	// The secret can't be decrypted for another group.
+	_, err = s.decryptClientSecret(otherGroupID, row.EncryptedClientSecret)
+	assert.Error(t, err)
+	p := getProvider(t, ctx, s, groupID)
+	assert.Empty(t, p.GetRoleMapping())
+	assert.Empty(t, p.GetClaimMapping().GetEmail())
+
+	// Only admins of the group can manage its provider.
+	rc := &ctxpb.RequestContext{GroupId: groupID}
+	_, err = s.GetOIDCProvider(otherCtx, &oppb.GetOIDCProviderRequest{RequestContext: rc})
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+	err = setProvider(otherCtx, s, groupID, &oppb.OIDCProvider{IssuerUrl: idp.url, ClientId: "evil-client", ClientSecret: "evil"})
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+	_, err = s.DeleteOIDCProvider(otherCtx, &oppb.DeleteOIDCProviderRequest{RequestContext: rc})
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+
+	_, err = s.DeleteOIDCProvider(ctx, &oppb.DeleteOIDCProviderRequest{RequestContext: rc})
+	require.NoError(t, err)
+	assert.Nil(t, getProvider(t, ctx, s, groupID))
+	assert.Nil(t, auth.getAuthConfig(ctx, groupIssuerPrefix+groupID))
+}
+
+func TestGroupOIDCProviderLogin(t *testing.T) {
+	env, auth, idp := setupGroupProviders(t)
+	ctx, groupID := createGroup(t, env, "acme")
+	err := setProvider(ctx, auth.groupProviders, groupID, &oppb.OIDCProvider{
+		IssuerUrl:    idp.url,
+		ClientId:     testClientID,
+		ClientSecret: "secret",
+		ClaimMapping: &oppb.ClaimMapping{Email: "upn", Groups: "roles"},
+		RoleMapping: []*oppb.RoleMapping{
+			{IdpGroup: "bb-admins", Role: grpb.Group_ADMIN_ROLE},
+			{IdpGroup: "bb-devs", Role: grpb.Group_DEVELOPER_ROLE},
+		},
+	})
+	require.NoError(t, err)
+
+	// Logging in with the group's slug redirects to its provider.
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/login?slug=acme&redirect_url=/", nil)
+	require.NoError(t, auth.Login(w, r))
+	loc, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, idp.url+"/authorize", loc.Scheme+"://"+loc.Host+loc.Path)
+	assert.Equal(t, testClientID, loc.Query().Get("client_id"))
+	issuerCookie := getResponseCookie(w.Result(), cookie.AuthIssuerCookie)
+	require.NotNil(t, issuerCookie)
+	assert.Equal(t, groupIssuerPrefix+groupID, issuerCookie.Value)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/login?slug=unknown&redirect_url=/", nil)
+	err = auth.Login(w, r)
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+
+	// ID tokens are mapped as the group configured.
+	a := auth.getAuthConfig(ctx, issuerCookie.Value)
+	require.NotNil(t, a)
+	ut, err := a.verifyTokenAndExtractUser(ctx, idp.token(jwt.MapClaims{
+		"sub":         "user1",
+		"email":       "ignored@example.com",
+		"upn":         "user1@acme.example.com",
+		"given_name":  "Ada",
+		"family_name": "Lovelace",
+		"roles":       []string{"everyone", "bb-devs", "bb-admins"},
+	}), true /*=checkExpiry*/)
+	require.NoError(t, err)
+	assert.Equal(t, idp.url+"/user1", ut.GetSubID())
+	assert.Equal(t, "user1@acme.example.com", ut.Email)
+	assert.Equal(t, "Ada", ut.GivenName)
+	assert.Equal(t, "Lovelace", ut.FamilyName)
+	// The first mapping that matches wins.
+	assert.Equal(t, role.Admin, ut.role)
+
+	// New users join the group with the mapped role.
+	user := &tables.User{}
+	require.NoError(t, auth.FillUser(context.WithValue(ctx, contextUserKey, ut), user))
+	require.Len(t, user.Groups, 1)
+	assert.Equal(t, "acme", user.Groups[0].Group.URLIdentifier)
+	assert.Equal(t, uint32(role.Admin), user.Groups[0].Role)
+
+	// Users outside of the mapped IdP groups get the default role.
+	ut, err = a.verifyTokenAndExtractUser(ctx, idp.token(jwt.MapClaims{"sub": "user2", "roles": "everyone"}), true /*=checkExpiry*/)
+	require.NoError(t, err)
+	assert.Equal(t, role.None, ut.role)
+
+	// Tokens issued to other clients of the provider aren't accepted.
+	_, err = a.verifyTokenAndExtractUser(ctx, idp.token(jwt.MapClaims{"sub": "user1", "aud": "other-client"}), true /*=checkExpiry*/)
+	assert.Error(t, err)
+}
+
+func TestGroupOIDCProviderInternalTokenEndpoint(t *testing.T) {
+	env, auth, idp := setupGroupProviders(t)
+	// The issuer is allowed, but it sends token requests to an internal
+	// address.
+	idp.tokenURL = "https://10.0.0.1/token"
+	ctx, groupID := createGroup(t, env, "acme")
+	err := setProvider(ctx, auth.groupProviders, groupID, &oppb.OIDCProvider{
+		IssuerUrl:    idp.url,
+		ClientId:     testClientID,
+		ClientSecret: "secret",
+	})
+	require.NoError(t, err)
+	a := auth.getAuthConfig(ctx, groupIssuerPrefix+groupID)
+	require.NotNil(t, a)
+
+	_, err = a.exchange(ctx, "code")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "connecting to internal address 10.0.0.1 is not allowed")
+
+	_, err = a.renewToken(ctx, "refresh-token")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "connecting to internal address 10.0.0.1 is not allowed")
+}
+
+func TestGroupOIDCProviderSubdomainLogin(t *testing.T) {
+	u, err := url.Parse("https://app.buildbuddy.test")
+	require.NoError(t, err)
+	flags.Set(t, "app.build_buddy_url", *u)
+	flags.Set(t, "app.enable_subdomain_matching", true)
+	env, auth, idp := setupGroupProviders(t)
+	ctx, groupID := createGroup(t, env, "acme")
+	err = setProvider(ctx, auth.groupProviders, groupID, &oppb.OIDCProvider{
+		IssuerUrl:    idp.url,
+		ClientId:     testClientID,
+		ClientSecret: "secret",
+	})
+	require.NoError(t, err)
+
+	// On the group's subdomain, members log in with its provider even if they
+	// last logged in with another one.
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/login?redirect_url=/", nil)
+	r.AddCookie(&http.Cookie{Name: cookie.AuthIssuerCookie, Value: "https://accounts.google.com"})
+	r = r.WithContext(subdomain.SetHost(r.Context(), "acme.buildbuddy.test"))
+	require.NoError(t, auth.Login(w, r))
+	issuerCookie := getResponseCookie(w.Result(), cookie.AuthIssuerCookie)
+	require.NotNil(t, issuerCookie)
+	assert.Equal(t, groupIssuerPrefix+groupID, issuerCookie.Value)
+}
+
+func TestGroupOIDCProviderUsersCantJoinOrgsByDomain(t *testing.T) {
+	env, auth, idp := setupGroupProviders(t)
+	ctx, groupID := createGroup(t, env, "acme")
+	err := setProvider(ctx, auth.groupProviders, groupID, &oppb.OIDCProvider{
+		IssuerUrl:    idp.url,
+		ClientId:     testClientID,
+		ClientSecret: "secret",
+		ClaimMapping: &oppb.ClaimMapping{Email: "upn"},
+	})
+	require.NoError(t, err)
+	flags.Set(t, "app.user_owned_keys_enabled", true)
+	_, err = env.GetUserDB().UpdateGroup(ctx, &tables.Group{GroupID: groupID, URLIdentifier: "acme", UserOwnedKeysEnabled: true})
+	require.NoError(t, err)
+	victimCtx, victimGroupID := createGroup(t, env, "victim")
+	_, err = env.GetUserDB().UpdateGroup(victimCtx, &tables.Group{GroupID: victimGroupID, URLIdentifier: "victim", OwnedDomain: "victim.example.com"})
+	require.NoError(t, err)
+
+	// The admins of acme control both the IdP and the claim that the email
+	// comes from, so they can make it any address.
+	jwt := idp.token(jwt.MapClaims{"sub": "attacker", "upn": "attacker@victim.example.com"})
+	a := auth.getAuthConfig(ctx, groupIssuerPrefix+groupID)
+	require.NotNil(t, a)
+	ut, err := a.verifyTokenAndExtractUser(ctx, jwt, true /*=checkExpiry*/)
+	require.NoError(t, err)
+	user := &tables.User{}
+	require.NoError(t, auth.FillUser(context.WithValue(ctx, contextUserKey, ut), user))
+	require.NoError(t, env.GetUserDB().InsertUser(ctx, user))
+	sessionID := "e34ff952-6ef0-4a35-ae3d-fe6166fe277e"
+	err = env.GetAuthDB().InsertOrUpdateUserSession(ctx, sessionID, &tables.Session{
+		SessionID:   sessionID,
+		SubID:       ut.GetSubID(),
+		AccessToken: "access",
+	})
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: cookie.JWTCookie, Value: jwt})
+	r.AddCookie(&http.Cookie{Name: cookie.AuthIssuerCookie, Value: groupIssuerPrefix + groupID})
+	r.AddCookie(&http.Cookie{Name: cookie.SessionIDCookie, Value: sessionID})
+	userCtx := auth.AuthenticatedHTTPContext(httptest.NewRecorder(), r)
+	env.(*testenv.TestEnv).SetAuthenticator(auth)
+	u, err := auth.AuthenticatedUser(userCtx)
+	require.NoError(t, err)
+	assert.Equal(t, user.UserID, u.GetUserID())
+
+	// Joining the org that owns the email's domain needs an admin's approval,
+	// including when the user authenticates with their own API key, whose
+	// claims don't say how the user logged in.
+	keyCtx := auth.AuthenticatedHTTPContext(httptest.NewRecorder(), r.WithContext(requestcontext.ContextWithProtoRequestContext(r.Context(), &ctxpb.RequestContext{GroupId: groupID})))
+	key, err := env.GetAuthDB().CreateUserAPIKey(keyCtx, groupID, user.UserID, "key", nil /*=capabilities*/, nil /*=scopes*/)
+	require.NoError(t, err)
+	apiKeyCtx := auth.AuthContextFromAPIKey(context.Background(), key.Value)
+	u, err = auth.AuthenticatedUser(apiKeyCtx)
+	require.NoError(t, err)
+	assert.Equal(t, user.UserID, u.GetUserID())
+	membershipStatus, err := env.GetUserDB().RequestToJoinGroup(apiKeyCtx, victimGroupID)
+	require.NoError(t, err)
+	assert.Equal(t, grpb.GroupMembershipStatus_REQUESTED, membershipStatus)
+
+	_, err = env.GetUserDB().RequestToJoinGroup(userCtx, victimGroupID)
+	require.True(t, status.IsAlreadyExistsError(err), "expected AlreadyExists error, got %v", err)
+	assert.Equal(t, "You've already requested to join this organization.", status.Message(err))
+}
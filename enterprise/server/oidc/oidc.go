@@ -21,6 +21,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/random"
+	"github.com/buildbuddy-io/buildbuddy/server/util/role"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/subdomain"
 	"github.com/buildbuddy-io/buildbuddy/server/util/urlutil"
@@ -97,6 +98,11 @@ type userToken struct {
 	Picture    string `json:"picture"`
 	issuer     string
 	slug       string
+	// The ID of the group whose provider issued the token, if any.
+	providerGroupID string
+	// The role that the user gets in the group with the slug when they sign
+	// up. role.None means the group's default role.
+	role role.Role
 }
 
 func (t *userToken) getIssuer() string {
@@ -129,6 +135,9 @@ type oidcAuthenticator struct {
 	provider           func() (*oidc.Provider, error)
 	issuer             string
 	slug               string
+	// The client used to call the token endpoint of the provider, or nil to
+	// use the default client.
+	httpClient *http.Client
 }
 
 func extractToken(issuer, slug string, idToken *oidc.IDToken) (*userToken, error) {
@@ -163,17 +172,30 @@ func (a *oidcAuthenticator) exchange(ctx context.Context, code string, opts ...o
 	if err != nil {
 		return nil, err
 	}
-	return oauth2Config.Exchange(ctx, code, opts...)
+	return oauth2Config.Exchange(a.clientContext(ctx), code, opts...)
 }
 
-func (a *oidcAuthenticator) verifyTokenAndExtractUser(ctx context.Context, jwt string, checkExpiry bool) (*userToken, error) {
+// clientContext returns a context that makes token requests go through the
+// authenticator's HTTP client.
+func (a *oidcAuthenticator) clientContext(ctx context.Context) context.Context {
+	if a.httpClient == nil {
+		return ctx
+	}
+	return oidc.ClientContext(ctx, a.httpClient)
+}
+
+func (a *oidcAuthenticator) verifyToken(ctx context.Context, jwt string, checkExpiry bool) (*oidc.IDToken, error) {
 	conf := *a.oidcConfig // copy
 	conf.SkipExpiryCheck = !checkExpiry
 	provider, err := a.provider()
 	if err != nil {
 		return nil, err
 	}
-	validToken, err := provider.Verifier(&conf).Verify(ctx, jwt)
+	return provider.Verifier(&conf).Verify(ctx, jwt)
+}
+
+func (a *oidcAuthenticator) verifyTokenAndExtractUser(ctx context.Context, jwt string, checkExpiry bool) (*userToken, error) {
+	validToken, err := a.verifyToken(ctx, jwt, checkExpiry)
 	if err != nil {
 		return nil, err
 	}
@@ -205,7 +227,7 @@ func (a *oidcAuthenticator) renewToken(ctx context.Context, refreshToken string)
 	if err != nil {
 		return nil, err
 	}
-	src := oauth2Config.TokenSource(ctx, &oauth2.Token{RefreshToken: refreshToken})
+	src := oauth2Config.TokenSource(a.clientContext(ctx), &oauth2.Token{RefreshToken: refreshToken})
 	t, err := src.Token() // this actually renews the token
 	if err != nil {
 		return nil, status.PermissionDeniedErrorf("%s: %s", authutil.ExpiredSessionMsg, err.Error())
@@ -225,81 +247,96 @@ type OpenIDAuthenticator struct {
 	authenticators       []authenticator
 	enableAnonymousUsage bool
 	adminGroupID         string
-}
-
-func createAuthenticatorsFromConfig(ctx context.Context, env environment.Env, authConfigs []OauthProvider, authURL *url.URL) ([]authenticator, error) {
-	var authenticators []authenticator
-	for _, authConfig := range authConfigs {
-		// declare local var that shadows loop var for closure capture
-		authConfig := authConfig
-		oidcConfig := &oidc.Config{
-			ClientID:        authConfig.ClientID,
-			SkipExpiryCheck: false,
-		}
-		authenticator := &oidcAuthenticator{
-			slug:       authConfig.Slug,
-			issuer:     authConfig.IssuerURL,
-			oidcConfig: oidcConfig,
-		}
-
-		// initialize provider and oauth2Config.Endpoint on-demand, since our self oauth provider won't be reachable until the server starts
-		var oauth2ConfigMutex sync.Mutex
-		authenticator.oauth2Config = func() (*oauth2.Config, error) {
-			oauth2ConfigMutex.Lock()
-			defer oauth2ConfigMutex.Unlock()
-			var err error
-			if authenticator.cachedOauth2Config == nil {
-				var provider *oidc.Provider
-				if provider, err = authenticator.provider(); err == nil {
-					// "openid" is a required scope for OpenID Connect flows.
-					scopes := []string{oidc.ScopeOpenID, "profile", "email"}
-					// Google reject the offline_access scope in favor of access_type=offline url param which already gets
-					// set in our auth flow thanks to the oauth2.AccessTypeOffline authCodeOption at the top of this file.
-					// https://github.com/coreos/go-oidc/blob/v2.2.1/oidc.go#L30
-					if authConfig.IssuerURL != "https://accounts.google.com" && !*disableRefreshToken {
-						scopes = append(scopes, oidc.ScopeOfflineAccess)
-					}
-					// Configure an OpenID Connect aware OAuth2 client.
-					authenticator.cachedOauth2Config = &oauth2.Config{
-						ClientID:     authConfig.ClientID,
-						ClientSecret: authConfig.ClientSecret,
-						RedirectURL:  authURL.String(),
-						Endpoint:     provider.Endpoint(),
-						Scopes:       scopes,
-					}
+	// The providers that groups registered for their members, or nil if
+	// groups can't register their own provider.
+	groupProviders *groupProviders
+}
+
+// newOIDCAuthenticator returns an authenticator for the given provider. The
+// context is used to fetch the provider's configuration and keys, so it must
+// outlive the requests that use the authenticator.
+func newOIDCAuthenticator(ctx context.Context, authConfig OauthProvider, authURL *url.URL) *oidcAuthenticator {
+	oidcConfig := &oidc.Config{
+		ClientID:        authConfig.ClientID,
+		SkipExpiryCheck: false,
+	}
+	authenticator := &oidcAuthenticator{
+		slug:       authConfig.Slug,
+		issuer:     authConfig.IssuerURL,
+		oidcConfig: oidcConfig,
+	}
+
+	// initialize provider and oauth2Config.Endpoint on-demand, since our self oauth provider won't be reachable until the server starts
+	var oauth2ConfigMutex sync.Mutex
+	authenticator.oauth2Config = func() (*oauth2.Config, error) {
+		oauth2ConfigMutex.Lock()
+		defer oauth2ConfigMutex.Unlock()
+		var err error
+		if authenticator.cachedOauth2Config == nil {
+			var provider *oidc.Provider
+			if provider, err = authenticator.provider(); err == nil {
+				// "openid" is a required scope for OpenID Connect flows.
+				scopes := []string{oidc.ScopeOpenID, "profile", "email"}
+				// Google reject the offline_access scope in favor of access_type=offline url param which already gets
+				// set in our auth flow thanks to the oauth2.AccessTypeOffline authCodeOption at the top of this file.
+				// https://github.com/coreos/go-oidc/blob/v2.2.1/oidc.go#L30
+				if authConfig.IssuerURL != "https://accounts.google.com" && !*disableRefreshToken {
+					scopes = append(scopes, oidc.ScopeOfflineAccess)
+				}
+				// Configure an OpenID Connect aware OAuth2 client.
+				authenticator.cachedOauth2Config = &oauth2.Config{
+					ClientID:     authConfig.ClientID,
+					ClientSecret: authConfig.ClientSecret,
+					RedirectURL:  authURL.String(),
+					Endpoint:     provider.Endpoint(),
+					Scopes:       scopes,
 				}
 			}
-			return authenticator.cachedOauth2Config, err
 		}
+		return authenticator.cachedOauth2Config, err
+	}
 
-		var providerMutex sync.Mutex
-		authenticator.provider = func() (*oidc.Provider, error) {
-			providerMutex.Lock()
-			defer providerMutex.Unlock()
-			var err error
-			if authenticator.cachedProvider == nil {
-				if authenticator.cachedProvider, err = oidc.NewProvider(ctx, authConfig.IssuerURL); err != nil {
-					log.Errorf("Error Initializing auth: %v", err)
-				}
+	var providerMutex sync.Mutex
+	authenticator.provider = func() (*oidc.Provider, error) {
+		providerMutex.Lock()
+		defer providerMutex.Unlock()
+		var err error
+		if authenticator.cachedProvider == nil {
+			if authenticator.cachedProvider, err = oidc.NewProvider(ctx, authConfig.IssuerURL); err != nil {
+				log.Errorf("Error Initializing auth: %v", err)
 			}
-			return authenticator.cachedProvider, err
 		}
+		return authenticator.cachedProvider, err
+	}
+	return authenticator
+}
 
-		authenticators = append(authenticators, authenticator)
+func createAuthenticatorsFromConfig(ctx context.Context, env environment.Env, authConfigs []OauthProvider, authURL *url.URL) ([]authenticator, error) {
+	var authenticators []authenticator
+	for _, authConfig := range authConfigs {
+		authenticators = append(authenticators, newOIDCAuthenticator(ctx, authConfig, authURL))
 	}
 	return authenticators, nil
 }
 
 func newOpenIDAuthenticator(ctx context.Context, env environment.Env, oauthProviders []OauthProvider, adminGroupID string) (*OpenIDAuthenticator, error) {
+	authURL := build_buddy_url.WithPath("/auth/")
 	authenticators, err := createAuthenticatorsFromConfig(
 		ctx,
 		env,
 		oauthProviders,
-		build_buddy_url.WithPath("/auth/"),
+		authURL,
 	)
 	if err != nil {
 		return nil, err
 	}
+	var gp *groupProviders
+	if GroupProvidersEnabled() {
+		if env.GetKMS() == nil {
+			return nil, status.FailedPreconditionError("KMS is required by auth.group_oidc_providers, to encrypt the client secrets of the providers")
+		}
+		gp = newGroupProviders(env, authURL)
+	}
 
 	claimsFunc := claims.ParseClaims
 	claimsCache, err := claims.NewClaimsCache()
@@ -317,6 +354,7 @@ func newOpenIDAuthenticator(ctx context.Context, env environment.Env, oauthProvi
 		parseClaims:          claimsFunc,
 		enableAnonymousUsage: AnonymousUsageEnabled(),
 		adminGroupID:         adminGroupID,
+		groupProviders:       gp,
 	}, nil
 }
 
@@ -347,7 +385,7 @@ func NewOpenIDAuthenticator(ctx context.Context, env environment.Env, adminGroup
 		)
 	}
 
-	if len(authConfigs) == 0 {
+	if len(authConfigs) == 0 && !GroupProvidersEnabled() {
 		return nil, status.FailedPreconditionErrorf("No auth providers specified in config!")
 	}
 
@@ -390,6 +428,9 @@ func (a *OpenIDAuthenticator) PublicIssuers() []string {
 }
 
 func (a *OpenIDAuthenticator) SSOEnabled() bool {
+	if a.groupProviders != nil {
+		return true
+	}
 	for _, authenticator := range a.authenticators {
 		if authenticator.getSlug() != "" {
 			return true
@@ -405,7 +446,10 @@ func (a *OpenIDAuthenticator) validateRedirectURL(redirectURL string) error {
 	return build_buddy_url.ValidateRedirect(redirectURL)
 }
 
-func (a *OpenIDAuthenticator) getAuthConfig(issuer string) authenticator {
+func (a *OpenIDAuthenticator) getAuthConfig(ctx context.Context, issuer string) authenticator {
+	if groupID, ok := strings.CutPrefix(issuer, groupIssuerPrefix); ok {
+		return a.getGroupAuthConfig(ctx, groupID)
+	}
 	for _, a := range a.authenticators {
 		if urlutil.SameHostname(a.getIssuer(), issuer) {
 			return a
@@ -414,13 +458,13 @@ func (a *OpenIDAuthenticator) getAuthConfig(issuer string) authenticator {
 	return nil
 }
 
-func (a *OpenIDAuthenticator) getAuthConfigForSlug(slug string) authenticator {
+func (a *OpenIDAuthenticator) getAuthConfigForSlug(ctx context.Context, slug string) authenticator {
 	for _, a := range a.authenticators {
 		if strings.EqualFold(a.getSlug(), slug) {
 			return a
 		}
 	}
-	return nil
+	return a.getGroupAuthConfigForSlug(ctx, slug)
 }
 
 func (a *OpenIDAuthenticator) getAuthCodeOptions(r *http.Request) []oauth2.AuthCodeOption {
@@ -506,13 +550,20 @@ func (a *OpenIDAuthenticator) AuthenticateGRPCRequest(ctx context.Context) (inte
 func (a *OpenIDAuthenticator) authenticateGRPCRequest(ctx context.Context, acceptJWT bool) (*claims.Claims, error) {
 	p, ok := peer.FromContext(ctx)
 
+	// Client certificates identify API keys by their subject, which is only
+	// trusted if they were issued by the built-in CA: other trusted CAs, such
+	// as the ones in ssl.trust_bundle_file, can issue any subject.
 	if ok && p != nil && p.AuthInfo != nil {
-		certs := p.AuthInfo.(credentials.TLSInfo).State.PeerCertificates
-		if len(certs) > 0 && certs[0].Subject.CommonName == "BuildBuddy API Key" && certs[0].Subject.SerialNumber != "" {
-			return a.claimsFromAPIKey(ctx, certs[0].Subject.SerialNumber)
-		}
-		if len(certs) > 0 && certs[0].Subject.CommonName == "BuildBuddy ID" && certs[0].Subject.SerialNumber != "" {
-			return a.claimsFromAPIKeyID(ctx, certs[0].Subject.SerialNumber)
+		state := p.AuthInfo.(credentials.TLSInfo).State
+		certs := state.PeerCertificates
+		ssl := a.env.GetSSLService()
+		if len(certs) > 0 && certs[0].Subject.SerialNumber != "" && ssl != nil && ssl.IsIssuedByAuthority(state.VerifiedChains) {
+			if certs[0].Subject.CommonName == "BuildBuddy API Key" {
+				return a.claimsFromAPIKey(ctx, certs[0].Subject.SerialNumber)
+			}
+			if certs[0].Subject.CommonName == "BuildBuddy ID" {
+				return a.claimsFromAPIKeyID(ctx, certs[0].Subject.SerialNumber)
+			}
 		}
 	}
 
@@ -600,7 +651,7 @@ func (a *OpenIDAuthenticator) authenticateUser(w http.ResponseWriter, r *http.Re
 	issuer := cookie.GetCookie(r, cookie.AuthIssuerCookie)
 	sessionID := cookie.GetCookie(r, cookie.SessionIDCookie)
 
-	auth := a.getAuthConfig(issuer)
+	auth := a.getAuthConfig(ctx, issuer)
 	if auth == nil {
 		return nil, nil, status.PermissionDeniedErrorf("No config found for issuer: %s", issuer)
 	}
@@ -712,27 +763,37 @@ func (a *OpenIDAuthenticator) FillUser(ctx context.Context, user *tables.User) e
 	user.LastName = t.FamilyName
 	user.Email = t.Email
 	user.ImageURL = t.Picture
+	user.ProviderGroupID = t.providerGroupID
 	if t.slug != "" {
 		user.Groups = []*tables.GroupRole{
-			{Group: tables.Group{URLIdentifier: t.slug}},
+			{Group: tables.Group{URLIdentifier: t.slug}, Role: uint32(t.role)},
 		}
 	}
 	return nil
 }
 
 func (a *OpenIDAuthenticator) Login(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
 	issuer := cookie.GetCookie(r, cookie.AuthIssuerCookie)
-	if issuerParam := r.URL.Query().Get(authIssuerParam); issuerParam != "" {
+	issuerParam := r.URL.Query().Get(authIssuerParam)
+	if issuerParam != "" {
 		issuer = issuerParam
 	}
-	auth := a.getAuthConfig(issuer)
+	auth := a.getAuthConfig(ctx, issuer)
 
 	if slug := r.URL.Query().Get(slugParam); slug != "" {
-		auth = a.getAuthConfigForSlug(slug)
+		auth = a.getAuthConfigForSlug(ctx, slug)
 		if auth == nil {
 			return status.PermissionDeniedErrorf("No SSO config found for slug: %s", slug)
 		}
 		issuer = auth.getIssuer()
+	} else if sd := subdomain.Get(ctx); sd != "" && issuerParam == "" {
+		// On the subdomain of a group with its own provider, members log in
+		// with that provider.
+		if groupAuth := a.getGroupAuthConfigForSlug(ctx, sd); groupAuth != nil {
+			auth = groupAuth
+			issuer = auth.getIssuer()
+		}
 	}
 
 	if issuer == "" {
@@ -813,7 +874,7 @@ func (a *OpenIDAuthenticator) Auth(w http.ResponseWriter, r *http.Request) error
 
 	// Lookup issuer from the cookie we set in /login.
 	issuer := cookie.GetCookie(r, cookie.AuthIssuerCookie)
-	auth := a.getAuthConfig(issuer)
+	auth := a.getAuthConfig(ctx, issuer)
 	if auth == nil {
 		return status.PermissionDeniedErrorf("No config found for issuer: %s", issuer)
 	}
@@ -0,0 +1,464 @@
+// Package oidc_federation lets CI jobs authenticate without long-lived API
+// keys: a job exchanges the OIDC token issued to it by its CI provider for a
+// short-lived API key of an organization, if one of the organization's trust
+// policies matches the repository and branch that the token was issued for.
+package oidc_federation
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/endpoint_urls/build_buddy_url"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/authutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/capabilities"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/scopes"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/third_party/singleflight"
+	"github.com/golang-jwt/jwt"
+
+	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
+	ofpb "github.com/buildbuddy-io/buildbuddy/proto/oidc_federation"
+	oidc "github.com/coreos/go-oidc/v3/oidc"
+)
+
+const (
+	GitHubActionsIssuer = "https://token.actions.githubusercontent.com"
+	GitLabIssuer        = "https://gitlab.com"
+
+	// Prefix of the refs of branches in GitHub Actions tokens.
+	githubBranchRefPrefix = "refs/heads/"
+
+	// How long to wait before fetching the configuration of an issuer again
+	// after failing to.
+	issuerRetryInterval = 1 * time.Minute
+
+	// How often the API keys that were issued for OIDC tokens are deleted
+	// once they expire.
+	expiredAPIKeyCleanupInterval = 1 * time.Hour
+)
+
+var (
+	enabled        = flag.Bool("auth.oidc_federation.enabled", false, "If true, CI jobs can exchange the OIDC tokens issued by their CI provider for short-lived API keys, according to the trust policies of each organization.")
+	allowedIssuers = flag.Slice("auth.oidc_federation.issuers", []string{GitHubActionsIssuer, GitLabIssuer}, "The OIDC token issuers that trust policies can be created for, e.g. the URL of a self-hosted GitLab instance.")
+	audience       = flag.String("auth.oidc_federation.audience", "", "The audience that exchanged OIDC tokens must be issued for. Defaults to app.build_buddy_url.")
+	apiKeyTTL      = flag.Duration("auth.oidc_federation.api_key_ttl", 1*time.Hour, "How long the API keys that OIDC tokens are exchanged for are valid.")
+)
+
+// ciToken holds the claims of an OIDC token that trust policies match on.
+type ciToken struct {
+	Issuer string `json:"iss"`
+
+	// GitHub Actions: "owner/repo".
+	Repository string `json:"repository"`
+	// GitLab CI: "group/subgroup/project".
+	ProjectPath string `json:"project_path"`
+
+	// GitHub Actions IDs of the repository and its owner.
+	RepositoryID      string `json:"repository_id"`
+	RepositoryOwnerID string `json:"repository_owner_id"`
+	// GitLab CI IDs of the project and its namespace.
+	ProjectID   string `json:"project_id"`
+	NamespaceID string `json:"namespace_id"`
+
+	// GitHub Actions: "refs/heads/main", "refs/tags/v1", "refs/pull/1/merge".
+	// GitLab CI: "main", "v1".
+	Ref string `json:"ref"`
+	// "branch" or "tag" on both GitHub Actions and GitLab CI.
+	RefType string `json:"ref_type"`
+}
+
+func (t *ciToken) repository() string {
+	if t.Repository != "" {
+		return t.Repository
+	}
+	return t.ProjectPath
+}
+
+func (t *ciToken) repositoryID() string {
+	if t.RepositoryID != "" {
+		return t.RepositoryID
+	}
+	return t.ProjectID
+}
+
+func (t *ciToken) repositoryOwnerID() string {
+	if t.RepositoryOwnerID != "" {
+		return t.RepositoryOwnerID
+	}
+	return t.NamespaceID
+}
+
+// branch returns the branch the token was issued for, or false if it wasn't
+// issued for a branch.
+func (t *ciToken) branch() (string, bool) {
+	if t.RefType != "branch" {
+		return "", false
+	}
+	return strings.TrimPrefix(t.Ref, githubBranchRefPrefix), true
+}
+
+func normalizeIssuer(issuer string) string {
+	return strings.TrimSuffix(strings.TrimSpace(issuer), "/")
+}
+
+func isAllowedIssuer(issuer string) bool {
+	for _, allowed := range *allowedIssuers {
+		if normalizeIssuer(allowed) == issuer {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns whether the policy trusts the given token. The token's
+// issuer and repository are expected to have been matched already.
+func matches(p *tables.OIDCTrustPolicy, t *ciToken) bool {
+	if p.RepositoryID != "" && p.RepositoryID != t.repositoryID() {
+		return false
+	}
+	if p.RepositoryOwnerID != "" && p.RepositoryOwnerID != t.repositoryOwnerID() {
+		return false
+	}
+	if p.Branch == "" {
+		return true
+	}
+	branch, ok := t.branch()
+	if !ok {
+		return false
+	}
+	match, err := path.Match(p.Branch, branch)
+	return err == nil && match
+}
+
+type Service struct {
+	env environment.Env
+
+	// Deduplicates concurrent fetches of the configuration of an issuer.
+	verifierGroup singleflight.Group[string, *oidc.IDTokenVerifier]
+
+	mu sync.Mutex
+	// Token verifiers keyed by issuer, created on first use since creating
+	// one requires fetching the issuer's discovery document.
+	verifiers map[string]*oidc.IDTokenVerifier
+	// When the configuration of issuers that couldn't be fetched may be
+	// fetched again.
+	issuerRetryTimes map[string]time.Time
+}
+
+func New(env environment.Env) *Service {
+	return &Service{
+		env:              env,
+		verifiers:        make(map[string]*oidc.IDTokenVerifier),
+		issuerRetryTimes: make(map[string]time.Time),
+	}
+}
+
+func Register(env *real_environment.RealEnv) error {
+	if !*enabled {
+		return nil
+	}
+	s := New(env)
+	s.startExpiredAPIKeyCleanup()
+	env.SetOIDCFederationService(s)
+	return nil
+}
+
+// startExpiredAPIKeyCleanup periodically deletes the short-lived API keys,
+// such as the ones issued for OIDC tokens, that have expired until the server
+// shuts down.
+func (s *Service) startExpiredAPIKeyCleanup() {
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := s.env.GetClock().NewTicker(expiredAPIKeyCleanupInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.Chan():
+			}
+			if err := s.env.GetAuthDB().DeleteExpiredAPIKeys(s.env.GetServerContext()); err != nil {
+				log.Warningf("Failed to delete expired API keys: %s", err)
+			}
+		}
+	}()
+	s.env.GetHealthChecker().RegisterShutdownFunction(func(ctx context.Context) error {
+		close(quit)
+		<-done
+		return nil
+	})
+}
+
+func (s *Service) checkAccess(ctx context.Context, groupID string) error {
+	u, err := s.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return err
+	}
+	return authutil.AuthorizeOrgAdmin(u, groupID)
+}
+
+func toProto(p *tables.OIDCTrustPolicy) *ofpb.TrustPolicy {
+	return &ofpb.TrustPolicy{
+		TrustPolicyId:     p.TrustPolicyID,
+		Label:             p.Label,
+		Issuer:            p.Issuer,
+		Repository:        p.Repository,
+		Branch:            p.Branch,
+		Capability:        capabilities.FromInt(p.Capabilities),
+		Scope:             scopes.FromInt(p.Scopes),
+		RepositoryId:      p.RepositoryID,
+		RepositoryOwnerId: p.RepositoryOwnerID,
+	}
+}
+
+func (s *Service) GetTrustPolicy(ctx context.Context, groupID, trustPolicyID string) (*tables.OIDCTrustPolicy, error) {
+	if err := s.checkAccess(ctx, groupID); err != nil {
+		return nil, err
+	}
+	p := &tables.OIDCTrustPolicy{}
+	err := s.env.GetDBHandle().NewQuery(ctx, "oidc_federation_get_trust_policy").Raw(
+		`SELECT * FROM "OIDCTrustPolicies" WHERE group_id = ? AND trust_policy_id = ?`,
+		groupID, trustPolicyID,
+	).Take(p)
+	if db.IsRecordNotFound(err) {
+		return nil, status.NotFoundErrorf("trust policy %q not found", trustPolicyID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (s *Service) GetTrustPolicies(ctx context.Context, req *ofpb.GetTrustPoliciesRequest) (*ofpb.GetTrustPoliciesResponse, error) {
+	groupID := req.GetRequestContext().GetGroupId()
+	if err := s.checkAccess(ctx, groupID); err != nil {
+		return nil, err
+	}
+	rq := s.env.GetDBHandle().NewQuery(ctx, "oidc_federation_get_trust_policies").Raw(
+		`SELECT * FROM "OIDCTrustPolicies" WHERE group_id = ? ORDER BY created_at_usec`, groupID)
+	policies, err := db.ScanAll(rq, &tables.OIDCTrustPolicy{})
+	if err != nil {
+		return nil, err
+	}
+	rsp := &ofpb.GetTrustPoliciesResponse{}
+	for _, p := range policies {
+		rsp.TrustPolicy = append(rsp.TrustPolicy, toProto(p))
+	}
+	return rsp, nil
+}
+
+func validateTrustPolicy(p *ofpb.TrustPolicy) error {
+	if !isAllowedIssuer(normalizeIssuer(p.GetIssuer())) {
+		return status.InvalidArgumentErrorf("issuer %q is not allowed, expected one of %s", p.GetIssuer(), strings.Join(*allowedIssuers, ", "))
+	}
+	if strings.TrimSpace(p.GetRepository()) == "" {
+		return status.InvalidArgumentError("missing repository")
+	}
+	// Names of GitHub repositories and GitLab projects can be reused after
+	// renaming or deleting them, so policies must also match on their IDs.
+	missingIDs := strings.TrimSpace(p.GetRepositoryId()) == "" || strings.TrimSpace(p.GetRepositoryOwnerId()) == ""
+	switch normalizeIssuer(p.GetIssuer()) {
+	case GitHubActionsIssuer:
+		if missingIDs {
+			return status.InvalidArgumentError("trust policies for GitHub Actions must set repository_id and repository_owner_id")
+		}
+	case GitLabIssuer:
+		if missingIDs {
+			return status.InvalidArgumentError("trust policies for GitLab CI must set repository_id and repository_owner_id to the project_id and namespace_id claims")
+		}
+	}
+	if _, err := path.Match(p.GetBranch(), ""); err != nil {
+		return status.InvalidArgumentErrorf("invalid branch pattern %q: %s", p.GetBranch(), err)
+	}
+	// CI jobs shouldn't be able to manage the organization.
+	if slices.Contains(p.GetCapability(), akpb.ApiKey_ORG_ADMIN_CAPABILITY) {
+		return status.InvalidArgumentError("trust policies can't grant the org admin capability")
+	}
+	return nil
+}
+
+func (s *Service) CreateTrustPolicy(ctx context.Context, req *ofpb.CreateTrustPolicyRequest) (*ofpb.CreateTrustPolicyResponse, error) {
+	groupID := req.GetRequestContext().GetGroupId()
+	if err := s.checkAccess(ctx, groupID); err != nil {
+		return nil, err
+	}
+	if err := validateTrustPolicy(req.GetTrustPolicy()); err != nil {
+		return nil, err
+	}
+	id, err := tables.PrimaryKeyForTable("OIDCTrustPolicies")
+	if err != nil {
+		return nil, err
+	}
+	tp := req.GetTrustPolicy()
+	p := &tables.OIDCTrustPolicy{
+		TrustPolicyID:     id,
+		GroupID:           groupID,
+		Label:             tp.GetLabel(),
+		Issuer:            normalizeIssuer(tp.GetIssuer()),
+		Repository:        strings.TrimSpace(tp.GetRepository()),
+		Branch:            tp.GetBranch(),
+		Capabilities:      capabilities.ToInt(tp.GetCapability()),
+		Scopes:            scopes.ToInt(tp.GetScope()),
+		RepositoryID:      strings.TrimSpace(tp.GetRepositoryId()),
+		RepositoryOwnerID: strings.TrimSpace(tp.GetRepositoryOwnerId()),
+	}
+	if err := s.env.GetDBHandle().NewQuery(ctx, "oidc_federation_create_trust_policy").Create(p); err != nil {
+		return nil, err
+	}
+	return &ofpb.CreateTrustPolicyResponse{TrustPolicy: toProto(p)}, nil
+}
+
+func (s *Service) DeleteTrustPolicy(ctx context.Context, req *ofpb.DeleteTrustPolicyRequest) (*ofpb.DeleteTrustPolicyResponse, error) {
+	groupID := req.GetRequestContext().GetGroupId()
+	if err := s.checkAccess(ctx, groupID); err != nil {
+		return nil, err
+	}
+	err := s.env.GetDBHandle().NewQuery(ctx, "oidc_federation_delete_trust_policy").Raw(
+		`DELETE FROM "OIDCTrustPolicies" WHERE group_id = ? AND trust_policy_id = ?`,
+		groupID, req.GetTrustPolicyId(),
+	).Exec().Error
+	if err != nil {
+		return nil, err
+	}
+	return &ofpb.DeleteTrustPolicyResponse{}, nil
+}
+
+// getVerifier returns the verifier of the tokens of the given issuer, which
+// must be normalized and allowed.
+func (s *Service) getVerifier(ctx context.Context, issuer string) (*oidc.IDTokenVerifier, error) {
+	s.mu.Lock()
+	v, ok := s.verifiers[issuer]
+	retryTime := s.issuerRetryTimes[issuer]
+	s.mu.Unlock()
+	if ok {
+		return v, nil
+	}
+	// Tokens don't need to be valid to get here, so don't let callers make
+	// us fetch the configuration of an issuer that is down over and over.
+	if s.env.GetClock().Now().Before(retryTime) {
+		return nil, status.UnavailableErrorf("could not get the configuration of issuer %q, retrying later", issuer)
+	}
+	v, _, err := s.verifierGroup.Do(ctx, issuer, func(ctx context.Context) (*oidc.IDTokenVerifier, error) {
+		// The provider keeps using the context to fetch the issuer's keys,
+		// so it must outlive the request.
+		provider, err := oidc.NewProvider(s.env.GetServerContext(), issuer)
+		if err != nil {
+			s.mu.Lock()
+			s.issuerRetryTimes[issuer] = s.env.GetClock().Now().Add(issuerRetryInterval)
+			s.mu.Unlock()
+			return nil, status.UnavailableErrorf("could not get the configuration of issuer %q: %s", issuer, err)
+		}
+		aud := *audience
+		if aud == "" {
+			aud = build_buddy_url.String()
+		}
+		v := provider.Verifier(&oidc.Config{ClientID: aud})
+		s.mu.Lock()
+		s.verifiers[issuer] = v
+		delete(s.issuerRetryTimes, issuer)
+		s.mu.Unlock()
+		return v, nil
+	})
+	return v, err
+}
+
+func (s *Service) verifyToken(ctx context.Context, rawToken string) (*ciToken, error) {
+	// Look at the issuer before verifying the token, to know which keys it
+	// should be signed with.
+	unverified := &ciToken{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(rawToken, &unverifiedClaims{unverified}); err != nil {
+		return nil, status.UnauthenticatedErrorf("invalid OIDC token: %s", err)
+	}
+	issuer := normalizeIssuer(unverified.Issuer)
+	if !isAllowedIssuer(issuer) {
+		return nil, status.UnauthenticatedErrorf("OIDC tokens issued by %q are not trusted", unverified.Issuer)
+	}
+	v, err := s.getVerifier(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+	idToken, err := v.Verify(ctx, rawToken)
+	if err != nil {
+		return nil, status.UnauthenticatedErrorf("invalid OIDC token: %s", err)
+	}
+	t := &ciToken{}
+	if err := idToken.Claims(t); err != nil {
+		return nil, status.UnauthenticatedErrorf("invalid OIDC token claims: %s", err)
+	}
+	t.Issuer = issuer
+	return t, nil
+}
+
+func (s *Service) ExchangeToken(ctx context.Context, req *ofpb.ExchangeTokenRequest) (*ofpb.ExchangeTokenResponse, error) {
+	if req.GetToken() == "" {
+		return nil, status.InvalidArgumentError("missing token")
+	}
+	if req.GetGroupId() == "" {
+		return nil, status.InvalidArgumentError("missing group_id")
+	}
+	t, err := s.verifyToken(ctx, req.GetToken())
+	if err != nil {
+		return nil, err
+	}
+	if t.repository() == "" {
+		return nil, status.PermissionDeniedError("the OIDC token was not issued to a repository")
+	}
+
+	// Only the policies of the requested organization are considered, so
+	// that other organizations can't make the token fail to exchange or be
+	// exchanged for their keys by creating policies for the same repository.
+	rq := s.env.GetDBHandle().NewQuery(ctx, "oidc_federation_get_matching_trust_policies").Raw(
+		`SELECT * FROM "OIDCTrustPolicies" WHERE group_id = ? AND issuer = ? AND repository = ? ORDER BY created_at_usec`,
+		req.GetGroupId(), t.Issuer, t.repository())
+	policies, err := db.ScanAll(rq, &tables.OIDCTrustPolicy{})
+	if err != nil {
+		return nil, err
+	}
+	// Use the oldest matching policy.
+	i := slices.IndexFunc(policies, func(p *tables.OIDCTrustPolicy) bool { return matches(p, t) })
+	if i < 0 {
+		return nil, status.PermissionDeniedErrorf("no trust policy of organization %q matches repository %q and ref %q", req.GetGroupId(), t.repository(), t.Ref)
+	}
+	p := policies[i]
+
+	label := fmt.Sprintf("Issued to %s@%s by trust policy %s", t.repository(), t.Ref, p.TrustPolicyID)
+	key, err := s.env.GetAuthDB().CreateShortLivedAPIKeyWithoutAuthCheck(
+		ctx, p.GroupID, label, capabilities.FromInt(p.Capabilities), scopes.FromInt(p.Scopes), *apiKeyTTL)
+	if err != nil {
+		return nil, err
+	}
+	log.CtxInfof(ctx, "Exchanged OIDC token of %s@%s for API key %s of group %s", t.repository(), t.Ref, key.APIKeyID, p.GroupID)
+	return &ofpb.ExchangeTokenResponse{
+		ApiKey: &akpb.ApiKey{
+			Id:         key.APIKeyID,
+			Value:      key.Value,
+			Label:      key.Label,
+			Capability: capabilities.FromInt(key.Capabilities),
+			Scope:      scopes.FromInt(key.Scopes),
+		},
+		ExpiresAtUsec: key.ExpiryUsec,
+	}, nil
+}
+
+// unverifiedClaims adapts ciToken to the jwt.Claims interface, so that the
+// issuer can be read before the token is verified.
+type unverifiedClaims struct {
+	*ciToken
+}
+
+func (c *unverifiedClaims) Valid() error {
+	return nil
+}
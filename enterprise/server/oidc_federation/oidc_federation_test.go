@@ -0,0 +1,409 @@
+package oidc_federation_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/oidc_federation"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testauth"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/util/scopes"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
+	ctxpb "github.com/buildbuddy-io/buildbuddy/proto/context"
+	ofpb "github.com/buildbuddy-io/buildbuddy/proto/oidc_federation"
+)
+
+const (
+	testAudience = "https://buildbuddy.test"
+	testKeyID    = "test-key"
+)
+
+// fakeIssuer serves the discovery document and signing keys of an OIDC
+// issuer, and issues tokens like a CI provider would.
+type fakeIssuer struct {
+	t      *testing.T
+	url    string
+	key    *rsa.PrivateKey
+	server *httptest.Server
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	f := &fakeIssuer{t: t, key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                f.url,
+			"jwks_uri":                              f.url + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		b64 := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": testKeyID,
+				"n":   b64(key.N.Bytes()),
+				"e":   b64(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+	f.url = f.server.URL
+	return f
+}
+
+func (f *fakeIssuer) token(claims jwt.MapClaims) string {
+	c := jwt.MapClaims{
+		"iss": f.url,
+		"aud": testAudience,
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(5 * time.Minute).Unix(),
+	}
+	for k, v := range claims {
+		c[k] = v
+	}
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, c)
+	tok.Header["kid"] = testKeyID
+	s, err := tok.SignedString(f.key)
+	require.NoError(f.t, err)
+	return s
+}
+
+func githubToken(f *fakeIssuer, repository, branch string) string {
+	return f.token(jwt.MapClaims{
+		"sub":        "repo:" + repository + ":ref:refs/heads/" + branch,
+		"repository": repository,
+		"ref":        "refs/heads/" + branch,
+		"ref_type":   "branch",
+	})
+}
+
+func setup(t *testing.T) (environment.Env, *oidc_federation.Service, *fakeIssuer) {
+	issuer := newFakeIssuer(t)
+	flags.Set(t, "auth.oidc_federation.enabled", true)
+	flags.Set(t, "auth.oidc_federation.issuers", []string{issuer.url})
+	flags.Set(t, "auth.oidc_federation.audience", testAudience)
+
+	env := enterprise_testenv.New(t)
+	enterprise_testauth.Configure(t, env)
+	return env, oidc_federation.New(env), issuer
+}
+
+func authenticatedAdmin(t *testing.T, env environment.Env) (context.Context, string) {
+	u := enterprise_testauth.CreateRandomUser(t, env, "org1.invalid")
+	auther := env.GetAuthenticator().(*testauth.TestAuthenticator)
+	ctx, err := auther.WithAuthenticatedUser(context.Background(), u.UserID)
+	require.NoError(t, err)
+	return ctx, u.Groups[0].Group.GroupID
+}
+
+func createPolicy(t *testing.T, ctx context.Context, s *oidc_federation.Service, groupID string, p *ofpb.TrustPolicy) *ofpb.TrustPolicy {
+	rsp, err := s.CreateTrustPolicy(ctx, &ofpb.CreateTrustPolicyRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: groupID},
+		TrustPolicy:    p,
+	})
+	require.NoError(t, err)
+	return rsp.GetTrustPolicy()
+}
+
+func TestCreateTrustPolicyValidation(t *testing.T) {
+	env, s, issuer := setup(t)
+	flags.Set(t, "auth.oidc_federation.issuers", []string{issuer.url, oidc_federation.GitHubActionsIssuer, oidc_federation.GitLabIssuer})
+	ctx, groupID := authenticatedAdmin(t, env)
+
+	for _, tc := range []struct {
+		name   string
+		policy *ofpb.TrustPolicy
+	}{
+		{
+			name:   "issuer not allowed",
+			policy: &ofpb.TrustPolicy{Issuer: "https://evil.invalid", Repository: "acme/repo"},
+		},
+		{
+			name:   "missing repository",
+			policy: &ofpb.TrustPolicy{Issuer: issuer.url},
+		},
+		{
+			name:   "invalid branch pattern",
+			policy: &ofpb.TrustPolicy{Issuer: issuer.url, Repository: "acme/repo", Branch: "release/["},
+		},
+		{
+			name:   "GitHub Actions without repository IDs",
+			policy: &ofpb.TrustPolicy{Issuer: oidc_federation.GitHubActionsIssuer, Repository: "acme/repo"},
+		},
+		{
+			name:   "GitLab CI without project IDs",
+			policy: &ofpb.TrustPolicy{Issuer: oidc_federation.GitLabIssuer, Repository: "acme/group/repo", RepositoryId: "123"},
+		},
+		{
+			name: "org admin capability",
+			policy: &ofpb.TrustPolicy{
+				Issuer:     issuer.url,
+				Repository: "acme/repo",
+				Capability: []akpb.ApiKey_Capability{akpb.ApiKey_ORG_ADMIN_CAPABILITY},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := s.CreateTrustPolicy(ctx, &ofpb.CreateTrustPolicyRequest{
+				RequestContext: &ctxpb.RequestContext{GroupId: groupID},
+				TrustPolicy:    tc.policy,
+			})
+			require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+		})
+	}
+}
+
+func TestTrustPolicyCRUD(t *testing.T) {
+	env, s, issuer := setup(t)
+	ctx, groupID := authenticatedAdmin(t, env)
+	otherCtx, _ := authenticatedAdmin(t, env)
+
+	p := createPolicy(t, ctx, s, groupID, &ofpb.TrustPolicy{
+		Label:      "CI",
+		Issuer:     issuer.url + "/",
+		Repository: "acme/repo",
+		Branch:     "main",
+		Capability: []akpb.ApiKey_Capability{akpb.ApiKey_CACHE_WRITE_CAPABILITY},
+	})
+	require.NotEmpty(t, p.GetTrustPolicyId())
+	// Trailing slashes are dropped to match the iss claim.
+	assert.Equal(t, issuer.url, p.GetIssuer())
+
+	rsp, err := s.GetTrustPolicies(ctx, &ofpb.GetTrustPoliciesRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: groupID},
+	})
+	require.NoError(t, err)
+	require.Len(t, rsp.GetTrustPolicy(), 1)
+	assert.Equal(t, p.GetTrustPolicyId(), rsp.GetTrustPolicy()[0].GetTrustPolicyId())
+
+	// Admins of other groups can't see or delete the policy.
+	_, err = s.GetTrustPolicies(otherCtx, &ofpb.GetTrustPoliciesRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: groupID},
+	})
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+	_, err = s.DeleteTrustPolicy(otherCtx, &ofpb.DeleteTrustPolicyRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: groupID},
+		TrustPolicyId:  p.GetTrustPolicyId(),
+	})
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+
+	_, err = s.DeleteTrustPolicy(ctx, &ofpb.DeleteTrustPolicyRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: groupID},
+		TrustPolicyId:  p.GetTrustPolicyId(),
+	})
+	require.NoError(t, err)
+	rsp, err = s.GetTrustPolicies(ctx, &ofpb.GetTrustPoliciesRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: groupID},
+	})
+	require.NoError(t, err)
+	require.Empty(t, rsp.GetTrustPolicy())
+}
+
+func TestExchangeToken(t *testing.T) {
+	env, s, issuer := setup(t)
+	ctx, groupID := authenticatedAdmin(t, env)
+
+	createPolicy(t, ctx, s, groupID, &ofpb.TrustPolicy{
+		Issuer:     issuer.url,
+		Repository: "acme/repo",
+		Branch:     "release/*",
+		Capability: []akpb.ApiKey_Capability{akpb.ApiKey_CACHE_WRITE_CAPABILITY},
+		Scope:      []akpb.ApiKey_Scope{akpb.ApiKey_CACHE_READ_SCOPE, akpb.ApiKey_CACHE_WRITE_SCOPE},
+	})
+
+	// The exchange doesn't require any other credentials.
+	rsp, err := s.ExchangeToken(context.Background(), &ofpb.ExchangeTokenRequest{
+		Token:   githubToken(issuer, "acme/repo", "release/v1"),
+		GroupId: groupID,
+	})
+	require.NoError(t, err)
+	key := rsp.GetApiKey()
+	require.NotEmpty(t, key.GetValue())
+	assert.Equal(t, []akpb.ApiKey_Capability{akpb.ApiKey_CACHE_WRITE_CAPABILITY}, key.GetCapability())
+	assert.Greater(t, rsp.GetExpiresAtUsec(), time.Now().UnixMicro())
+	assert.LessOrEqual(t, rsp.GetExpiresAtUsec(), time.Now().Add(time.Hour).UnixMicro())
+
+	// The issued key authenticates as the group, restricted to the policy's
+	// scopes.
+	akg, err := env.GetAuthDB().GetAPIKeyGroupFromAPIKey(context.Background(), key.GetValue())
+	require.NoError(t, err)
+	assert.Equal(t, groupID, akg.GetGroupID())
+	assert.Equal(t, scopes.ToInt(key.GetScope()), akg.GetScopes())
+	assert.Equal(t, []akpb.ApiKey_Scope{akpb.ApiKey_CACHE_READ_SCOPE, akpb.ApiKey_CACHE_WRITE_SCOPE}, key.GetScope())
+
+	// The key is listed along with the keys of the group, so that it can be
+	// revoked.
+	keys, err := env.GetAuthDB().GetAPIKeys(ctx, groupID)
+	require.NoError(t, err)
+	i := slices.IndexFunc(keys, func(k *tables.APIKey) bool { return k.APIKeyID == key.GetId() })
+	require.GreaterOrEqual(t, i, 0)
+	assert.Equal(t, rsp.GetExpiresAtUsec(), keys[i].ExpiryUsec)
+}
+
+func TestExchangeTokenRepositoryIDs(t *testing.T) {
+	env, s, issuer := setup(t)
+	ctx, groupID := authenticatedAdmin(t, env)
+
+	createPolicy(t, ctx, s, groupID, &ofpb.TrustPolicy{
+		Issuer:            issuer.url,
+		Repository:        "acme/repo",
+		RepositoryId:      "123",
+		RepositoryOwnerId: "45",
+	})
+	token := func(repositoryID, ownerID string) string {
+		return issuer.token(jwt.MapClaims{
+			"repository":          "acme/repo",
+			"repository_id":       repositoryID,
+			"repository_owner_id": ownerID,
+			"ref":                 "refs/heads/main",
+			"ref_type":            "branch",
+		})
+	}
+
+	_, err := s.ExchangeToken(context.Background(), &ofpb.ExchangeTokenRequest{Token: token("123", "45"), GroupId: groupID})
+	require.NoError(t, err)
+
+	// A repository that took over the name of the trusted one has another
+	// ID.
+	_, err = s.ExchangeToken(context.Background(), &ofpb.ExchangeTokenRequest{Token: token("678", "45"), GroupId: groupID})
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+	_, err = s.ExchangeToken(context.Background(), &ofpb.ExchangeTokenRequest{Token: token("123", "90"), GroupId: groupID})
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+	_, err = s.ExchangeToken(context.Background(), &ofpb.ExchangeTokenRequest{Token: githubToken(issuer, "acme/repo", "main"), GroupId: groupID})
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+}
+
+func TestExchangeTokenUnavailableIssuer(t *testing.T) {
+	env, s, issuer := setup(t)
+	ctx, groupID := authenticatedAdmin(t, env)
+	createPolicy(t, ctx, s, groupID, &ofpb.TrustPolicy{Issuer: issuer.url, Repository: "acme/repo"})
+	token := githubToken(issuer, "acme/repo", "main")
+
+	// Failing to fetch the configuration of the issuer should be cached, so
+	// that tokens can't be used to make the server fetch it over and over.
+	issuer.server.Close()
+	_, err := s.ExchangeToken(context.Background(), &ofpb.ExchangeTokenRequest{Token: token, GroupId: groupID})
+	require.True(t, status.IsUnavailableError(err), "expected Unavailable, got %v", err)
+	_, err = s.ExchangeToken(context.Background(), &ofpb.ExchangeTokenRequest{Token: token, GroupId: groupID})
+	require.True(t, status.IsUnavailableError(err), "expected Unavailable, got %v", err)
+	assert.Contains(t, err.Error(), "retrying later")
+}
+
+func TestExchangeTokenDenied(t *testing.T) {
+	env, s, issuer := setup(t)
+	ctx, groupID := authenticatedAdmin(t, env)
+
+	createPolicy(t, ctx, s, groupID, &ofpb.TrustPolicy{
+		Issuer:     issuer.url,
+		Repository: "acme/repo",
+		Branch:     "main",
+	})
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		check func(error) bool
+	}{
+		{
+			name:  "other branch",
+			token: githubToken(issuer, "acme/repo", "feature"),
+			check: status.IsPermissionDeniedError,
+		},
+		{
+			name:  "other repository",
+			token: githubToken(issuer, "acme/other", "main"),
+			check: status.IsPermissionDeniedError,
+		},
+		{
+			name: "tag with the branch name",
+			token: issuer.token(jwt.MapClaims{
+				"repository": "acme/repo",
+				"ref":        "refs/tags/main",
+				"ref_type":   "tag",
+			}),
+			check: status.IsPermissionDeniedError,
+		},
+		{
+			name: "wrong audience",
+			token: issuer.token(jwt.MapClaims{
+				"aud":        "https://other.invalid",
+				"repository": "acme/repo",
+				"ref":        "refs/heads/main",
+				"ref_type":   "branch",
+			}),
+			check: status.IsUnauthenticatedError,
+		},
+		{
+			name: "expired",
+			token: issuer.token(jwt.MapClaims{
+				"exp":        time.Now().Add(-time.Minute).Unix(),
+				"repository": "acme/repo",
+				"ref":        "refs/heads/main",
+				"ref_type":   "branch",
+			}),
+			check: status.IsUnauthenticatedError,
+		},
+		{
+			name:  "not a JWT",
+			token: "foo",
+			check: status.IsUnauthenticatedError,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := s.ExchangeToken(context.Background(), &ofpb.ExchangeTokenRequest{Token: tc.token, GroupId: groupID})
+			require.True(t, tc.check(err), "unexpected error %v", err)
+		})
+	}
+}
+
+func TestExchangeTokenMultipleGroups(t *testing.T) {
+	env, s, issuer := setup(t)
+	ctx1, groupID1 := authenticatedAdmin(t, env)
+	ctx2, groupID2 := authenticatedAdmin(t, env)
+	createPolicy(t, ctx1, s, groupID1, &ofpb.TrustPolicy{Issuer: issuer.url, Repository: "acme/repo", Branch: "main"})
+	// Another organization trusts the same repository, e.g. because it's
+	// public.
+	createPolicy(t, ctx2, s, groupID2, &ofpb.TrustPolicy{Issuer: issuer.url, Repository: "acme/repo"})
+
+	// The organization must always be named.
+	_, err := s.ExchangeToken(context.Background(), &ofpb.ExchangeTokenRequest{Token: githubToken(issuer, "acme/repo", "main")})
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+
+	// The other organization's policy doesn't get in the way.
+	rsp, err := s.ExchangeToken(context.Background(), &ofpb.ExchangeTokenRequest{Token: githubToken(issuer, "acme/repo", "main"), GroupId: groupID1})
+	require.NoError(t, err)
+	akg, err := env.GetAuthDB().GetAPIKeyGroupFromAPIKey(context.Background(), rsp.GetApiKey().GetValue())
+	require.NoError(t, err)
+	assert.Equal(t, groupID1, akg.GetGroupID())
+
+	// If the named organization's policy doesn't match, the token isn't
+	// exchanged for a key of the other organization.
+	_, err = s.ExchangeToken(context.Background(), &ofpb.ExchangeTokenRequest{Token: githubToken(issuer, "acme/repo", "feature"), GroupId: groupID1})
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+}
@@ -7,11 +7,13 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/redisutil"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/metrics"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/go-redis/redis/v8"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -26,6 +28,10 @@ const (
 	// short grace period in the event of missed leases.
 	DefaultClaimedExecutionTTL = 20 * time.Second
 
+	// How often callers waiting on another caller's scheduling claim check
+	// whether the execution has been scheduled.
+	schedulingClaimPollInterval = 25 * time.Millisecond
+
 	// Redis Hash keys for storing information about action-merging.
 	//
 	// The execution ID of the canonical (first-submitted) execution
@@ -53,6 +59,9 @@ var (
 	enableActionMerging = flag.Bool("remote_execution.enable_action_merging", true, "If enabled, identical actions being executed concurrently are merged into a single execution.")
 	hedgedActionCount   = flag.Int("remote_execution.action_merging_hedge_count", 0, "When action merging is enabled, this flag controls how many additional, 'hedged' attempts an action is run in the background. Note that even hedged actions are run at most once per execution request.")
 	hedgeAfterDelay     = flag.Duration("remote_execution.action_merging_hedge_delay", 0*time.Second, "When action merging hedging is enabled, up to --remote_execution.action_merging_hedge_count hedged actions are run with this delay of linear backoff.")
+
+	enableSchedulingClaims = flag.Bool("remote_execution.enable_scheduling_claims", false, "When action merging is enabled, app instances claim an action before scheduling an execution for it, so that identical actions requested from different app instances at the same time are only scheduled once, and share the same operation.")
+	schedulingClaimTTL     = flag.Duration("remote_execution.scheduling_claim_ttl", 10*time.Second, "How long a claim to schedule an action lasts. If the app instance holding the claim doesn't schedule the action within this time, other app instances may schedule it instead.")
 )
 
 // Returns the redis key pointing to the hash storing action merging state. The
@@ -74,6 +83,19 @@ func redisKeyForPendingExecutionDigest(executionID string) string {
 	return fmt.Sprintf("pendingExecutionDigest/%d/%s", keyVersion, executionID)
 }
 
+// Returns the redis key for the claim to schedule an execution of the action.
+func redisKeyForSchedulingClaim(ctx context.Context, adResource *digest.ResourceName) (string, error) {
+	userPrefix, err := prefix.UserPrefixFromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	downloadString, err := adResource.DownloadString()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("schedulingClaim/%d/%s%s", keyVersion, userPrefix, downloadString), nil
+}
+
 // Action merging is an optimization that detects when an execution is
 // requested for an action that is in-flight, but not yet in the action cache.
 // This optimization is particularly helpful for preventing duplicate work for
@@ -252,6 +274,58 @@ func FindPendingExecution(ctx context.Context, rdb redis.UniversalClient, schedu
 	return executionID, shouldHedge(hash), nil
 }
 
+// Action merging only finds executions once they've been recorded as queued,
+// so identical actions requested at the same time (e.g. from different app
+// instances) can all miss each other and be scheduled separately. Scheduling
+// claims close this gap: before scheduling an action, callers claim it, and
+// callers that find it already claimed wait for the claiming caller to
+// schedule it and then merge with that execution.
+//
+// ClaimScheduling returns the execution ID of a pending execution that the
+// caller should merge with. Otherwise, if the returned claim is non-nil, the
+// caller holds the claim and must unlock it once it has scheduled the
+// execution (or failed to). Unlocking only releases the claim if it is still
+// held by the caller, so a claim that expired and was taken over by another
+// caller is left in place.
+func ClaimScheduling(ctx context.Context, rdb redis.UniversalClient, schedulerService interfaces.SchedulerService, adResource *digest.ResourceName) (executionID string, claim interfaces.DistributedLock, err error) {
+	if !*enableActionMerging || !*enableSchedulingClaims {
+		return "", nil, nil
+	}
+
+	key, err := redisKeyForSchedulingClaim(ctx, adResource)
+	if err != nil {
+		return "", nil, err
+	}
+	lock, err := redisutil.NewWeakLock(rdb, key, *schedulingClaimTTL)
+	if err != nil {
+		return "", nil, err
+	}
+	for {
+		err := lock.Lock(ctx)
+		if err == nil {
+			return "", lock, nil
+		}
+		if !status.IsResourceExhaustedError(err) {
+			return "", nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return "", nil, ctx.Err()
+		case <-time.After(schedulingClaimPollInterval):
+		}
+		// If the claim is released without a pending execution being
+		// recorded (e.g. because scheduling failed, or because the action opts
+		// out of merging), try to claim the action again.
+		executionID, _, err := FindPendingExecution(ctx, rdb, schedulerService, adResource)
+		if err != nil {
+			return "", nil, err
+		}
+		if executionID != "" {
+			return executionID, nil, nil
+		}
+	}
+}
+
 // Returns true if a hedged execution should be run given the provided
 // action-merging hash from Redis.
 func shouldHedge(hash map[string]string) bool {
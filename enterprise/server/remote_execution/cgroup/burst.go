@@ -0,0 +1,101 @@
+package cgroup
+
+import (
+	"time"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+// Once a task runs out of burst credit, it stays limited to its guaranteed
+// share until it has earned back this fraction of the maximum credit, so that
+// the limit isn't toggled on every reading.
+const resumeBurstCreditFraction = 0.1
+
+// CPUBurstCredit tracks the burst credit of a task running with a burstable
+// CPU policy. The task is guaranteed its estimated CPU, and may use idle CPU
+// beyond that while it has credit. Credit is earned while the task uses less
+// than its guaranteed share and spent while it uses more, so tasks with short
+// spikes of parallelism can burst, while tasks that consistently use more than
+// their estimate are eventually limited to it.
+//
+// Tasks start with the maximum credit, so that short tasks can always burst.
+type CPUBurstCredit struct {
+	guaranteedMilliCPU int64
+	maxCreditNanos     int64
+
+	creditNanos int64
+	limited     bool
+
+	started                bool
+	lastTime               time.Time
+	lastCPUNanos           int64
+	baselineThrottledNanos int64
+
+	burstNanos     int64
+	limitedNanos   int64
+	throttledNanos int64
+}
+
+// NewCPUBurstCredit returns the burst credit of a task guaranteed the given
+// milliCPU, which may accumulate up to maxCredit of CPU time above its
+// guaranteed share.
+func NewCPUBurstCredit(guaranteedMilliCPU int64, maxCredit time.Duration) *CPUBurstCredit {
+	return &CPUBurstCredit{
+		guaranteedMilliCPU: guaranteedMilliCPU,
+		maxCreditNanos:     maxCredit.Nanoseconds(),
+		creditNanos:        maxCredit.Nanoseconds(),
+	}
+}
+
+// GuaranteedMilliCPU returns the CPU guaranteed to the task.
+func (b *CPUBurstCredit) GuaranteedMilliCPU() int64 {
+	return b.guaranteedMilliCPU
+}
+
+// Observe updates the credit from a reading, taken at the given time, of the
+// task cgroup's total CPU usage and time throttled by its CPU limit. It
+// returns whether the task should be limited to its guaranteed share.
+//
+// The first reading only sets the baseline that later readings are compared
+// against.
+func (b *CPUBurstCredit) Observe(now time.Time, cpuNanos, throttledNanos int64) (limited bool) {
+	if !b.started {
+		b.started = true
+		b.lastTime = now
+		b.lastCPUNanos = cpuNanos
+		b.baselineThrottledNanos = throttledNanos
+		return b.limited
+	}
+	elapsed := now.Sub(b.lastTime).Nanoseconds()
+	used := cpuNanos - b.lastCPUNanos
+	guaranteed := elapsed * b.guaranteedMilliCPU / 1000
+	b.lastTime = now
+	b.lastCPUNanos = cpuNanos
+
+	if used > guaranteed {
+		b.burstNanos += used - guaranteed
+	}
+	if b.limited {
+		b.limitedNanos += elapsed
+	}
+	b.throttledNanos = throttledNanos - b.baselineThrottledNanos
+	b.creditNanos = min(max(b.creditNanos+guaranteed-used, 0), b.maxCreditNanos)
+
+	if !b.limited && b.creditNanos == 0 {
+		b.limited = true
+	} else if b.limited && float64(b.creditNanos) >= float64(b.maxCreditNanos)*resumeBurstCreditFraction {
+		b.limited = false
+	}
+	return b.limited
+}
+
+// Stats returns the burst accounting of the task so far.
+func (b *CPUBurstCredit) Stats() *repb.CPUBurstStats {
+	return &repb.CPUBurstStats{
+		GuaranteedMilliCpu:   b.guaranteedMilliCPU,
+		BurstCpuNanos:        b.burstNanos,
+		LimitedNanos:         b.limitedNanos,
+		ThrottledNanos:       b.throttledNanos,
+		RemainingCreditNanos: b.creditNanos,
+	}
+}
@@ -26,6 +26,9 @@ const (
 
 	// Placeholder value representing the container ID in cgroup path templates.
 	cidPlaceholder = "{{.ContainerID}}"
+
+	// Period used for cpu.max quotas.
+	cpuMaxPeriod = 100 * time.Millisecond
 )
 
 // Paths holds cgroup path templates that map a container ID to their cgroupfs
@@ -86,6 +89,14 @@ func (p *Paths) Stats(ctx context.Context, cid string) (*repb.UsageStats, error)
 		return nil, err
 	}
 
+	// Read peak memory usage. memory.peak is only available in newer kernels
+	// (5.19+), so ignore NotExist errors.
+	memPeakPath := filepath.Join(dir, "memory.peak")
+	peakMemoryBytes, err := readInt64FromFile(memPeakPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
 	// Read PSI metrics.
 	// Note that PSI may not be supported in all environments,
 	// so ignore NotExist errors.
@@ -109,11 +120,12 @@ func (p *Paths) Stats(ctx context.Context, cid string) (*repb.UsageStats, error)
 	}
 
 	return &repb.UsageStats{
-		CpuNanos:       cpuMicros * 1e3,
-		MemoryBytes:    memoryBytes,
-		CpuPressure:    cpuPressure,
-		MemoryPressure: memPressure,
-		IoPressure:     ioPressure,
+		CpuNanos:        cpuMicros * 1e3,
+		MemoryBytes:     memoryBytes,
+		PeakMemoryBytes: peakMemoryBytes,
+		CpuPressure:     cpuPressure,
+		MemoryPressure:  memPressure,
+		IoPressure:      ioPressure,
 	}, nil
 }
 
@@ -205,6 +217,153 @@ func (p *Paths) find(ctx context.Context, cid string) error {
 	return status.InternalErrorf("failed to locate cgroup under %s", cgroupfsPath)
 }
 
+// DelegatedControllers returns the cgroup v2 controllers, such as "cpu" and
+// "memory", that are available in the cgroup of the current process. When the
+// executor runs as an unprivileged user, these are the controllers that were
+// delegated to the user (for example, with systemd's Delegate= option), which
+// are the only ones that rootless containers can use. It returns an empty list
+// if the host does not use cgroup v2.
+func DelegatedControllers() ([]string, error) {
+	b, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return nil, err
+	}
+	path, ok := parseUnifiedCgroupPath(string(b))
+	if !ok {
+		return nil, nil
+	}
+	b, err = os.ReadFile(filepath.Join(cgroupfsPath, path, "cgroup.controllers"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(b)), nil
+}
+
+// parseUnifiedCgroupPath returns the path of the cgroup v2 cgroup from the
+// contents of /proc/<pid>/cgroup. The cgroup v2 entry is the line with
+// hierarchy ID 0 and no controllers, like "0::/user.slice/user-1000.slice".
+func parseUnifiedCgroupPath(procCgroup string) (string, bool) {
+	for _, line := range strings.Split(procCgroup, "\n") {
+		path, ok := strings.CutPrefix(strings.TrimSpace(line), "0::")
+		if ok && path != "" {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// Limits are resource limits for a cgroup v2 cgroup. Zero values mean no
+// limit.
+type Limits struct {
+	// MemoryMaxBytes is the hard memory limit (memory.max). Processes in the
+	// cgroup are OOM-killed if they can't be kept under it.
+	MemoryMaxBytes int64
+
+	// CPUWeight is the cgroup's share of CPU time relative to its siblings
+	// (cpu.weight), between 1 and 10000. Cgroups have a weight of 100 by
+	// default.
+	CPUWeight int64
+
+	// CPUMaxMilliCPU is the hard CPU limit (cpu.max), in milliCPU.
+	CPUMaxMilliCPU int64
+
+	// IO limits the IO bandwidth of the cgroup on a block device (io.max).
+	IO *IOLimit
+}
+
+// IOLimit is a bandwidth limit for a single block device.
+type IOLimit struct {
+	// Device is the device number of the block device, as "MAJOR:MINOR".
+	Device string
+
+	// ReadBPS and WriteBPS are the maximum read and write bandwidth, in bytes
+	// per second.
+	ReadBPS  int64
+	WriteBPS int64
+}
+
+// Unified returns the limits as cgroup v2 interface file contents, keyed by
+// file name, as used in the "unified" resources of an OCI spec.
+func (l *Limits) Unified() map[string]string {
+	m := map[string]string{}
+	if l.MemoryMaxBytes > 0 {
+		m["memory.max"] = strconv.FormatInt(l.MemoryMaxBytes, 10)
+	}
+	if l.CPUWeight > 0 {
+		m["cpu.weight"] = strconv.FormatInt(min(l.CPUWeight, 10000), 10)
+	}
+	if l.CPUMaxMilliCPU > 0 {
+		m["cpu.max"] = cpuMax(l.CPUMaxMilliCPU)
+	}
+	if io := l.IO; io != nil && (io.ReadBPS > 0 || io.WriteBPS > 0) {
+		line := io.Device
+		if io.ReadBPS > 0 {
+			line += fmt.Sprintf(" rbps=%d", io.ReadBPS)
+		}
+		if io.WriteBPS > 0 {
+			line += fmt.Sprintf(" wbps=%d", io.WriteBPS)
+		}
+		m["io.max"] = line
+	}
+	return m
+}
+
+// Create creates a cgroup v2 cgroup with the given cgroupfs directory and
+// applies the limits to it. The parent cgroup must have the controllers for
+// the limits enabled in its cgroup.subtree_control.
+func Create(dir string, limits *Limits) error {
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return status.UnavailableErrorf("create cgroup: %s", err)
+	}
+	for name, value := range limits.Unified() {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0); err != nil {
+			os.Remove(dir)
+			return status.UnavailableErrorf("set %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// cpuMax returns the cpu.max contents limiting a cgroup to the given milliCPU,
+// or removing the limit if it's 0.
+func cpuMax(milliCPU int64) string {
+	period := cpuMaxPeriod.Microseconds()
+	if milliCPU <= 0 {
+		return fmt.Sprintf("max %d", period)
+	}
+	return fmt.Sprintf("%d %d", milliCPU*period/1000, period)
+}
+
+// SetCPUMax sets the hard CPU limit (cpu.max) of a running container's cgroup,
+// in milliCPU. A limit of 0 removes the limit. Only cgroup v2 is supported.
+func (p *Paths) SetCPUMax(ctx context.Context, cid string, milliCPU int64) error {
+	if err := p.find(ctx, cid); err != nil {
+		return err
+	}
+	if p.CgroupVersion() != 2 {
+		return status.UnimplementedError("setting CPU limits requires cgroup v2")
+	}
+	dir := strings.ReplaceAll(p.V2DirTemplate, cidPlaceholder, cid)
+	return os.WriteFile(filepath.Join(dir, "cpu.max"), []byte(cpuMax(milliCPU)), 0)
+}
+
+// CPUThrottledUsec returns the total time that a container's cgroup has been
+// throttled by its CPU limit (throttled_usec in cpu.stat). Only cgroup v2 is
+// supported.
+func (p *Paths) CPUThrottledUsec(ctx context.Context, cid string) (int64, error) {
+	if err := p.find(ctx, cid); err != nil {
+		return 0, err
+	}
+	if p.CgroupVersion() != 2 {
+		return 0, status.UnimplementedError("reading CPU throttling requires cgroup v2")
+	}
+	dir := strings.ReplaceAll(p.V2DirTemplate, cidPlaceholder, cid)
+	return readCgroupInt64Field(filepath.Join(dir, "cpu.stat"), "throttled_usec")
+}
+
 // readInt64FromFile reads a file expected to contain a single int64.
 func readInt64FromFile(path string) (int64, error) {
 	b, err := os.ReadFile(path)
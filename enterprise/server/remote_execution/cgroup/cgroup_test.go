@@ -1,8 +1,11 @@
 package cgroup
 
 import (
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/stretchr/testify/require"
@@ -32,3 +35,140 @@ full avg10=0.01 avg60=0.50 avg300=1.23 total=23456
 		},
 	}, psi, protocmp.Transform()))
 }
+
+func TestLimitsUnified(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		limits *Limits
+		want   map[string]string
+	}{
+		{
+			name:   "no limits",
+			limits: &Limits{},
+			want:   map[string]string{},
+		},
+		{
+			name: "all limits",
+			limits: &Limits{
+				MemoryMaxBytes: 2_000_000_000,
+				CPUWeight:      250,
+				IO:             &IOLimit{Device: "259:0", ReadBPS: 100_000_000, WriteBPS: 50_000_000},
+			},
+			want: map[string]string{
+				"memory.max": "2000000000",
+				"cpu.weight": "250",
+				"io.max":     "259:0 rbps=100000000 wbps=50000000",
+			},
+		},
+		{
+			name: "CPU weight is clamped",
+			limits: &Limits{
+				CPUWeight: 100_000,
+			},
+			want: map[string]string{
+				"cpu.weight": "10000",
+			},
+		},
+		{
+			name: "CPU max",
+			limits: &Limits{
+				CPUMaxMilliCPU: 1500,
+			},
+			want: map[string]string{
+				"cpu.max": "150000 100000",
+			},
+		},
+		{
+			name: "read-only IO limit",
+			limits: &Limits{
+				IO: &IOLimit{Device: "8:0", ReadBPS: 1000},
+			},
+			want: map[string]string{
+				"io.max": "8:0 rbps=1000",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.want, tc.limits.Unified())
+		})
+	}
+}
+
+func TestCPUBurstCredit(t *testing.T) {
+	// 1 CPU guaranteed, with up to 1s of burst credit.
+	b := NewCPUBurstCredit(1000, time.Second)
+	start := time.Unix(0, 0)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+	cpu := int64(0)
+
+	require.False(t, b.Observe(at(0), cpu, 0))
+
+	// Using 2 CPUs spends credit at 1s per second, so the task stays
+	// unlimited until the credit runs out after 1s.
+	cpu += (1 * time.Second).Nanoseconds()
+	require.False(t, b.Observe(at(500*time.Millisecond), cpu, 0))
+	cpu += (1 * time.Second).Nanoseconds()
+	require.True(t, b.Observe(at(1*time.Second), cpu, 0))
+
+	// While limited, using the full guaranteed share doesn't earn credit.
+	cpu += (1 * time.Second).Nanoseconds()
+	require.True(t, b.Observe(at(2*time.Second), cpu, 100*time.Millisecond.Nanoseconds()))
+
+	// Idling earns credit back, and the task is unlimited once it has earned
+	// back enough.
+	cpu += (50 * time.Millisecond).Nanoseconds()
+	require.True(t, b.Observe(at(2100*time.Millisecond), cpu, 100*time.Millisecond.Nanoseconds()))
+	require.False(t, b.Observe(at(2200*time.Millisecond), cpu, 100*time.Millisecond.Nanoseconds()))
+
+	require.Empty(t, cmp.Diff(&repb.CPUBurstStats{
+		GuaranteedMilliCpu:   1000,
+		BurstCpuNanos:        (1 * time.Second).Nanoseconds(),
+		LimitedNanos:         (1200 * time.Millisecond).Nanoseconds(),
+		ThrottledNanos:       (100 * time.Millisecond).Nanoseconds(),
+		RemainingCreditNanos: (150 * time.Millisecond).Nanoseconds(),
+	}, b.Stats(), protocmp.Transform()))
+}
+
+func TestCreate(t *testing.T) {
+	// Use a regular directory in place of cgroupfs.
+	dir := filepath.Join(t.TempDir(), "task")
+	err := Create(dir, &Limits{IO: &IOLimit{Device: "8:0", ReadBPS: 1000, WriteBPS: 2000}})
+	require.NoError(t, err)
+
+	b, err := os.ReadFile(filepath.Join(dir, "io.max"))
+	require.NoError(t, err)
+	require.Equal(t, "8:0 rbps=1000 wbps=2000", string(b))
+}
+
+func TestParseUnifiedCgroupPath(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		procCgroup string
+		wantPath   string
+		wantOK     bool
+	}{
+		{
+			name:       "v2",
+			procCgroup: "0::/user.slice/user-1000.slice/user@1000.service/app.slice/executor.service\n",
+			wantPath:   "/user.slice/user-1000.slice/user@1000.service/app.slice/executor.service",
+			wantOK:     true,
+		},
+		{
+			name:       "hybrid",
+			procCgroup: "12:memory:/user.slice\n1:name=systemd:/user.slice\n0::/user.slice/user-1000.slice\n",
+			wantPath:   "/user.slice/user-1000.slice",
+			wantOK:     true,
+		},
+		{
+			name:       "v1",
+			procCgroup: "12:memory:/user.slice\n4:cpu,cpuacct:/user.slice\n",
+			wantOK:     false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path, ok := parseUnifiedCgroupPath(tc.procCgroup)
+			require.Equal(t, tc.wantOK, ok)
+			require.Equal(t, tc.wantPath, path)
+		})
+	}
+}
@@ -0,0 +1,28 @@
+//go:build linux && !android
+
+package commandutil
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+// startInCgroup configures cmd to start directly in the cgroup with the given
+// cgroupfs directory, so that there is no window in which the process runs
+// outside of the cgroup. The returned func must be called after the process
+// is started.
+func startInCgroup(cmd *exec.Cmd, dir string) (cleanup func(), err error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, status.UnavailableErrorf("open cgroup: %s", err)
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(f.Fd())
+	return func() { f.Close() }, nil
+}
@@ -0,0 +1,13 @@
+//go:build (darwin && !ios) || windows
+
+package commandutil
+
+import (
+	"os/exec"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+func startInCgroup(cmd *exec.Cmd, dir string) (cleanup func(), err error) {
+	return nil, status.UnimplementedError("cgroups are only supported on Linux")
+}
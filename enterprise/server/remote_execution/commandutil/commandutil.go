@@ -150,6 +150,41 @@ type RunOpts struct {
 	// Signal is an optional channel that can be used to send signals to the
 	// process once started.
 	Signal chan syscall.Signal
+
+	// Limits optionally limits the resources used by the process tree. Limits
+	// are only supported on Windows, where they are enforced by the job object
+	// containing the process tree, and are ignored on other platforms.
+	Limits *ResourceLimits
+
+	// CgroupDir optionally starts the process in an existing cgroup v2 cgroup,
+	// given as its cgroupfs directory, so that the process tree is subject to
+	// the cgroup's limits. Only supported on Linux.
+	CgroupDir string
+}
+
+// ResourceLimits are limits on the resources used by a process tree.
+type ResourceLimits struct {
+	// MemoryMaxBytes is the maximum amount of memory that the process tree
+	// can commit, or 0 for no limit. Allocations past the limit fail.
+	MemoryMaxBytes int64
+
+	// MilliCPU is the maximum CPU usage of the process tree in milli-CPUs, or
+	// 0 for no limit.
+	MilliCPU int64
+}
+
+func (l *ResourceLimits) GetMemoryMaxBytes() int64 {
+	if l == nil {
+		return 0
+	}
+	return l.MemoryMaxBytes
+}
+
+func (l *ResourceLimits) GetMilliCPU() int64 {
+	if l == nil {
+		return 0
+	}
+	return l.MilliCPU
 }
 
 // Run a command, retrying "text file busy" errors and killing the process tree
@@ -184,12 +219,12 @@ func RunWithOpts(ctx context.Context, command *repb.Command, opts *RunOpts) *int
 	}
 }
 
-func startNewProcess(ctx context.Context, cmd *exec.Cmd) (*process, error) {
+func startNewProcess(ctx context.Context, cmd *exec.Cmd, limits *ResourceLimits) (*process, error) {
 	p := &process{
 		cmd:        cmd,
 		terminated: make(chan struct{}),
 	}
-	if err := p.preStart(); err != nil {
+	if err := p.preStart(limits); err != nil {
 		return nil, fmt.Errorf("fail to setup preStart: %w", err)
 	}
 	if err := p.cmd.Start(); err != nil {
@@ -244,7 +279,14 @@ func RunWithProcessTreeCleanup(ctx context.Context, cmd *exec.Cmd, opts *RunOpts
 		opts = &RunOpts{}
 	}
 
-	p, err := startNewProcess(ctx, cmd)
+	if opts.CgroupDir != "" {
+		closeCgroup, err := startInCgroup(cmd, opts.CgroupDir)
+		if err != nil {
+			return nil, err
+		}
+		defer closeCgroup()
+	}
+	p, err := startNewProcess(ctx, cmd, opts.Limits)
 	if err != nil {
 		return nil, err
 	}
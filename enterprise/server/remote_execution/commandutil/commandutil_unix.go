@@ -19,7 +19,7 @@ type process struct {
 	terminated chan struct{}
 }
 
-func (p *process) preStart() error {
+func (p *process) preStart(limits *ResourceLimits) error {
 	return nil
 }
 
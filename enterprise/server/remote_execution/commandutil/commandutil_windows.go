@@ -6,9 +6,11 @@ import (
 	"context"
 	"fmt"
 	"os/exec"
+	"runtime"
 	"syscall"
 	"unsafe"
 
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"golang.org/x/sys/windows"
 
@@ -26,8 +28,42 @@ const (
 	// - https://learn.microsoft.com/en-us/windows/win32/api/jobapi2/nf-jobapi2-assignprocesstojobobject#parameters
 	// - https://learn.microsoft.com/en-us/windows/win32/procthread/process-security-and-access-rights
 	processWithJobObjPerm = windows.PROCESS_SET_QUOTA | windows.PROCESS_TERMINATE | windows.PROCESS_QUERY_LIMITED_INFORMATION
+
+	// Flags for JOBOBJECT_CPU_RATE_CONTROL_INFORMATION, which are not defined
+	// by golang.org/x/sys/windows.
+	//
+	// Reference:
+	// https://learn.microsoft.com/en-us/windows/win32/api/winnt/ns-winnt-jobobject_cpu_rate_control_information
+	jobObjectCPURateControlEnable  = 0x1
+	jobObjectCPURateControlHardCap = 0x4
+	// CPU rates are expressed as the number of cycles per 10,000 cycles, across
+	// all processors.
+	maxCPURate = 10000
 )
 
+// jobObjectCPURateControlInformation is JOBOBJECT_CPU_RATE_CONTROL_INFORMATION,
+// with the CpuRate member of the union.
+type jobObjectCPURateControlInformation struct {
+	ControlFlags uint32
+	CpuRate      uint32
+}
+
+// jobObjectBasicAccountingInformation is
+// JOBOBJECT_BASIC_ACCOUNTING_INFORMATION. Times are in 100ns units.
+//
+// Reference:
+// https://learn.microsoft.com/en-us/windows/win32/api/winnt/ns-winnt-jobobject_basic_accounting_information
+type jobObjectBasicAccountingInformation struct {
+	TotalUserTime             int64
+	TotalKernelTime           int64
+	ThisPeriodTotalUserTime   int64
+	ThisPeriodTotalKernelTime int64
+	TotalPageFaultCount       uint32
+	TotalProcesses            uint32
+	ActiveProcesses           uint32
+	TotalTerminatedProcesses  uint32
+}
+
 // process struct is a wrapper around exec.Cmd that adds support for killing the
 // process tree.
 
@@ -41,29 +77,52 @@ type process struct {
 	jobHandle windows.Handle
 }
 
-func createJobObjInfo() (uintptr, uint32) {
+// setJobLimits sets the limits of the job object. Processes in the job are
+// always killed when the job handle is closed.
+func setJobLimits(job windows.Handle, limits *ResourceLimits) error {
 	extLimitInfo := windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION{
 		BasicLimitInformation: windows.JOBOBJECT_BASIC_LIMIT_INFORMATION{
 			LimitFlags: windows.JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE,
 		},
 	}
-	return uintptr(unsafe.Pointer(&extLimitInfo)), uint32(unsafe.Sizeof(extLimitInfo))
+	if limits.GetMemoryMaxBytes() > 0 {
+		extLimitInfo.BasicLimitInformation.LimitFlags |= windows.JOB_OBJECT_LIMIT_JOB_MEMORY
+		extLimitInfo.JobMemoryLimit = uintptr(limits.GetMemoryMaxBytes())
+	}
+	if _, err := windows.SetInformationJobObject(
+		job,
+		windows.JobObjectExtendedLimitInformation,
+		uintptr(unsafe.Pointer(&extLimitInfo)),
+		uint32(unsafe.Sizeof(extLimitInfo))); err != nil {
+		return fmt.Errorf("failed to set job object info: %w", err)
+	}
+
+	if limits.GetMilliCPU() > 0 {
+		rate := limits.GetMilliCPU() * maxCPURate / int64(runtime.NumCPU()*1000)
+		cpuInfo := jobObjectCPURateControlInformation{
+			ControlFlags: jobObjectCPURateControlEnable | jobObjectCPURateControlHardCap,
+			CpuRate:      uint32(min(max(rate, 1), maxCPURate)),
+		}
+		if _, err := windows.SetInformationJobObject(
+			job,
+			windows.JobObjectCpuRateControlInformation,
+			uintptr(unsafe.Pointer(&cpuInfo)),
+			uint32(unsafe.Sizeof(cpuInfo))); err != nil {
+			return fmt.Errorf("failed to set job object CPU rate: %w", err)
+		}
+	}
+	return nil
 }
 
 // preStart creates a job object and sets the job object info.
-func (p *process) preStart() error {
+func (p *process) preStart(limits *ResourceLimits) error {
 	job, err := windows.CreateJobObject(nil, nil)
 	if err != nil {
 		return fmt.Errorf("failed to create job object: %w", err)
 	}
-
-	jobObjInfo, jobObjInfoLength := createJobObjInfo()
-	if _, err := windows.SetInformationJobObject(
-		job,
-		windows.JobObjectExtendedLimitInformation,
-		jobObjInfo,
-		jobObjInfoLength); err != nil {
-		return fmt.Errorf("failed to set job object info: %w", err)
+	if err := setJobLimits(job, limits); err != nil {
+		windows.CloseHandle(job)
+		return err
 	}
 	p.jobHandle = job
 
@@ -95,7 +154,40 @@ func (p *process) postStart() error {
 func (p *process) wait() (*espb.Rusage, error) {
 	defer close(p.terminated)
 	err := p.cmd.Wait()
-	return nil, err
+	rusage, rusageErr := p.jobRusage()
+	if rusageErr != nil {
+		log.Warningf("Failed to get job object usage: %s", rusageErr)
+	}
+	return rusage, err
+}
+
+// jobRusage returns the resource usage of all processes in the job, which
+// includes the descendants of the top-level process.
+func (p *process) jobRusage() (*espb.Rusage, error) {
+	acct := jobObjectBasicAccountingInformation{}
+	if err := windows.QueryInformationJobObject(
+		p.jobHandle,
+		windows.JobObjectBasicAccountingInformation,
+		uintptr(unsafe.Pointer(&acct)),
+		uint32(unsafe.Sizeof(acct)),
+		nil); err != nil {
+		return nil, fmt.Errorf("query job accounting info: %w", err)
+	}
+	extLimitInfo := windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION{}
+	if err := windows.QueryInformationJobObject(
+		p.jobHandle,
+		windows.JobObjectExtendedLimitInformation,
+		uintptr(unsafe.Pointer(&extLimitInfo)),
+		uint32(unsafe.Sizeof(extLimitInfo)),
+		nil); err != nil {
+		return nil, fmt.Errorf("query job limit info: %w", err)
+	}
+	return &espb.Rusage{
+		UserCpuTimeUsec:         acct.TotalUserTime / 10,
+		SysCpuTimeUsec:          acct.TotalKernelTime / 10,
+		MaxResidentSetSizeBytes: int64(extLimitInfo.PeakJobMemoryUsed),
+		PageFaults:              int64(acct.TotalPageFaultCount),
+	}, nil
 }
 
 func (p *process) signal(sig syscall.Signal) error {
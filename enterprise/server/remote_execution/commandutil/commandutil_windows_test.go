@@ -53,3 +53,36 @@ func TestComplexProcessTree(t *testing.T) {
 	assert.NoError(t, res.Error)
 	assert.Equal(t, 0, res.ExitCode)
 }
+
+func TestRun_Win_MemoryLimit(t *testing.T) {
+	workDir := testfs.MakeTempDir(t)
+	testfs.WriteAllFileContents(t, workDir, map[string]string{
+		"mem.py": useMemPythonScript(500e6, 0),
+	})
+	cmd := &repb.Command{Arguments: []string{"python", "mem.py"}}
+	res := commandutil.RunWithOpts(context.Background(), cmd, &commandutil.RunOpts{
+		Dir:    workDir,
+		Limits: &commandutil.ResourceLimits{MemoryMaxBytes: 100e6},
+	})
+
+	// The allocation fails with a MemoryError.
+	assert.NoError(t, res.Error)
+	assert.NotEqual(t, 0, res.ExitCode)
+	assert.Contains(t, string(res.Stderr), "MemoryError")
+}
+
+func TestRun_Win_UsageStats(t *testing.T) {
+	workDir := testfs.MakeTempDir(t)
+	testfs.WriteAllFileContents(t, workDir, map[string]string{
+		"cpu.py": useCPUPythonScript(1 * time.Second),
+		"mem.py": useMemPythonScript(250e6, 0),
+	})
+	cmd := &repb.Command{Arguments: []string{"powershell", "-c", "python cpu.py; python mem.py"}}
+	res := commandutil.Run(context.Background(), cmd, workDir, nopStatsListener, &interfaces.Stdio{})
+
+	assert.NoError(t, res.Error)
+	assert.Equal(t, 0, res.ExitCode)
+	// Usage includes the python subprocesses.
+	assert.GreaterOrEqual(t, res.UsageStats.GetPeakMemoryBytes(), int64(250e6))
+	assert.GreaterOrEqual(t, res.UsageStats.GetCpuNanos(), int64(500*time.Millisecond))
+}
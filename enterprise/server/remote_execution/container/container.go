@@ -215,6 +215,10 @@ type UsageStats struct {
 	// This is needed so that we can determine PSI stall totals when using
 	// a recycled runner.
 	baselineCPUPressure, baselineMemoryPressure, baselineIOPressure *repb.PSI
+	// recycled is whether an earlier task ran in the container, in which case
+	// the peak memory usage reported by the cgroup (which covers the cgroup's
+	// whole lifetime) can't be attributed to the current task.
+	recycled bool
 }
 
 // Reset resets resource usage counters in preparation for a new task, so that
@@ -231,6 +235,7 @@ func (s *UsageStats) Reset() {
 	s.baselineMemoryPressure = s.last.GetMemoryPressure()
 	s.baselineIOPressure = s.last.GetIoPressure()
 	s.peakMemoryUsageBytes = 0
+	s.recycled = true
 }
 
 // TODO: remove after debugging stats issue
@@ -279,11 +284,18 @@ func (s *UsageStats) TaskStats() *repb.UsageStats {
 // Update updates the usage for the current task, given a reading from the
 // lifetime stats (e.g. cgroup created when the task container was initially
 // created).
+//
+// If the lifetime stats include the peak memory usage, it's used for the
+// first task in the container, since it also covers spikes in usage that
+// happen between readings.
 func (s *UsageStats) Update(lifetimeStats *repb.UsageStats) {
 	s.last = lifetimeStats.CloneVT()
 	if lifetimeStats.GetMemoryBytes() > s.peakMemoryUsageBytes {
 		s.peakMemoryUsageBytes = lifetimeStats.GetMemoryBytes()
 	}
+	if !s.recycled && lifetimeStats.GetPeakMemoryBytes() > s.peakMemoryUsageBytes {
+		s.peakMemoryUsageBytes = lifetimeStats.GetPeakMemoryBytes()
+	}
 }
 
 // TrackStats starts a goroutine to monitor the container's resource usage. It
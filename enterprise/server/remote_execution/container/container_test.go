@@ -357,6 +357,28 @@ func TestUsageStats(t *testing.T) {
 	}, s.TaskStats(), protocmp.Transform()))
 }
 
+func TestUsageStats_CgroupPeakMemory(t *testing.T) {
+	s := &container.UsageStats{}
+	s.Reset()
+
+	// The cgroup's peak memory usage is higher than any of the readings,
+	// and should be used for the first task.
+	s.Update(&repb.UsageStats{
+		MemoryBytes:     50 * 1024 * 1024,
+		PeakMemoryBytes: 80 * 1024 * 1024,
+	})
+	require.Equal(t, int64(80*1024*1024), s.TaskStats().GetPeakMemoryBytes())
+
+	// After the container is recycled, the cgroup's peak memory usage
+	// covers earlier tasks too, so only the readings should be used.
+	s.Reset()
+	s.Update(&repb.UsageStats{
+		MemoryBytes:     40 * 1024 * 1024,
+		PeakMemoryBytes: 80 * 1024 * 1024,
+	})
+	require.Equal(t, int64(40*1024*1024), s.TaskStats().GetPeakMemoryBytes())
+}
+
 func makePSI(someTotal, fullTotal int64) *repb.PSI {
 	return &repb.PSI{
 		Some: &repb.PSI_Metrics{
@@ -6,39 +6,111 @@ import (
 	"flag"
 	"io"
 	"os"
+	"path/filepath"
 	"syscall"
 
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/cgroup"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/commandutil"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/container"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/tasksize"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/oci"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/procstats"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/random"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
 )
 
 var (
 	bareEnableStats = flag.Bool("executor.bare.enable_stats", false, "Whether to enable stats for bare command execution.")
 	enableLogFiles  = flag.Bool("executor.bare.enable_log_files", false, "Whether to send bare runner output to log files for debugging. These files are stored adjacent to the task directory and are deleted when the task is complete.")
+
+	enforceTaskSize   = flag.Bool("executor.bare.enforce_task_size", false, "If true, commands are limited according to the estimated size of their task: memory is limited to a multiple of the estimated memory (see executor.bare.memory_limit_factor), and CPU usage is capped at the estimated CPU. Only supported on Windows, where the limits are enforced using job objects.")
+	memoryLimitFactor = flag.Float64("executor.bare.memory_limit_factor", 2, "If executor.bare.enforce_task_size is set, commands are limited to this multiple of their task's estimated memory usage. Allocations beyond the limit fail.")
+
+	cgroupParent             = flag.String("executor.bare.cgroup_parent", "", "Linux only: the cgroupfs directory of a cgroup v2 cgroup delegated to the executor. If set, commands of tasks with disk bandwidth limits (see executor.bare.io_limit_device) run in their own child cgroups under it, so the io controller must be enabled in its cgroup.subtree_control.")
+	ioLimitDevice            = flag.String("executor.bare.io_limit_device", "", "Linux only: if executor.bare.cgroup_parent is set, the block device whose bandwidth is limited, as MAJOR:MINOR (see lsblk). Tasks are limited according to their estimated compute units (see executor.bare.io_read_bps_per_compute_unit). Tasks that set the EstimatedDiskBandwidth platform property are limited to that many bytes per second of reads and of writes, unless the per-compute-unit limits are lower.")
+	ioReadBPSPerComputeUnit  = flag.Int64("executor.bare.io_read_bps_per_compute_unit", 0, "Linux only: if executor.bare.io_limit_device is set, the read bandwidth, in bytes per second, allowed for each estimated compute unit of a task. 0 means unlimited.")
+	ioWriteBPSPerComputeUnit = flag.Int64("executor.bare.io_write_bps_per_compute_unit", 0, "Linux only: if executor.bare.io_limit_device is set, the write bandwidth, in bytes per second, allowed for each estimated compute unit of a task. 0 means unlimited.")
 )
 
 type Opts struct {
 	// EnableStats specifies whether to collect stats while the command is
 	// in progress.
 	EnableStats bool
+
+	// Limits are the resource limits applied to each command. They are
+	// only enforced on Windows.
+	Limits *commandutil.ResourceLimits
+
+	// CgroupLimits are the limits applied to a cgroup created for each
+	// command under executor.bare.cgroup_parent, or nil to run commands in
+	// the executor's cgroup. Only supported on Linux.
+	CgroupLimits *cgroup.Limits
 }
 
 type Provider struct {
 }
 
-func (p *Provider) New(ctx context.Context, _ *container.Init) (container.CommandContainer, error) {
+func (p *Provider) New(ctx context.Context, args *container.Init) (container.CommandContainer, error) {
 	opts := &Opts{
-		EnableStats: *bareEnableStats,
+		EnableStats:  *bareEnableStats,
+		Limits:       taskResourceLimits(args.Task.GetSchedulingMetadata().GetTaskSize()),
+		CgroupLimits: taskCgroupLimits(args.Task.GetSchedulingMetadata().GetTaskSize(), args.Props),
 	}
 	return NewBareCommandContainer(opts), nil
 }
 
+func taskResourceLimits(size *scpb.TaskSize) *commandutil.ResourceLimits {
+	if !*enforceTaskSize {
+		return nil
+	}
+	return &commandutil.ResourceLimits{
+		MemoryMaxBytes: int64(float64(size.GetEstimatedMemoryBytes()) * *memoryLimitFactor),
+		MilliCPU:       size.GetEstimatedMilliCpu(),
+	}
+}
+
+// taskCgroupLimits returns the limits of the cgroups that the commands of a
+// task of the given size and platform properties run in, or nil if the task's
+// commands don't need their own cgroups.
+func taskCgroupLimits(size *scpb.TaskSize, props *platform.Properties) *cgroup.Limits {
+	if *cgroupParent == "" || *ioLimitDevice == "" {
+		return nil
+	}
+	computeUnits := float64(size.GetEstimatedMilliCpu()) / tasksize.ComputeUnitsToMilliCPU
+	io := &cgroup.IOLimit{
+		Device:   *ioLimitDevice,
+		ReadBPS:  int64(computeUnits * float64(*ioReadBPSPerComputeUnit)),
+		WriteBPS: int64(computeUnits * float64(*ioWriteBPSPerComputeUnit)),
+	}
+	// Tasks can ask for less bandwidth than the configured limits, but not
+	// more.
+	if bw := props.EstimatedDiskBandwidth; bw > 0 {
+		io.ReadBPS = minLimit(io.ReadBPS, bw)
+		io.WriteBPS = minLimit(io.WriteBPS, bw)
+	}
+	if io.ReadBPS <= 0 && io.WriteBPS <= 0 {
+		return nil
+	}
+	return &cgroup.Limits{IO: io}
+}
+
+// minLimit returns the lower of two limits, where 0 means unlimited.
+func minLimit(a, b int64) int64 {
+	if a <= 0 {
+		return b
+	}
+	if b <= 0 {
+		return a
+	}
+	return min(a, b)
+}
+
 // bareCommandContainer executes commands directly, without any isolation
 // between containers.
 type bareCommandContainer struct {
@@ -127,12 +199,44 @@ func (c *bareCommandContainer) exec(ctx context.Context, cmd *repb.Command, work
 		stdio.Stderr = io.MultiWriter(stdio.Stderr, stderrFile)
 	}
 
-	return commandutil.RunWithOpts(ctx, cmd, &commandutil.RunOpts{
+	opts := &commandutil.RunOpts{
 		Dir:           workDir,
 		StatsListener: statsListener,
 		Stdio:         stdio,
 		Signal:        c.signal,
-	})
+		Limits:        c.opts.Limits,
+	}
+	if c.opts.CgroupLimits != nil {
+		dir, err := createCgroup(c.opts.CgroupLimits)
+		if err != nil {
+			return commandutil.ErrorResult(err)
+		}
+		defer removeCgroup(ctx, dir)
+		opts.CgroupDir = dir
+	}
+	return commandutil.RunWithOpts(ctx, cmd, opts)
+}
+
+// createCgroup creates a cgroup for a single command under
+// executor.bare.cgroup_parent.
+func createCgroup(limits *cgroup.Limits) (string, error) {
+	id, err := random.RandomString(16)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(*cgroupParent, "buildbuddy-bare-"+id)
+	if err := cgroup.Create(dir, limits); err != nil {
+		return "", status.WrapError(err, "create command cgroup")
+	}
+	return dir, nil
+}
+
+func removeCgroup(ctx context.Context, dir string) {
+	// Removal fails if any processes started by the command are still
+	// running in the cgroup.
+	if err := os.Remove(dir); err != nil {
+		log.CtxWarningf(ctx, "Failed to remove command cgroup: %s", err)
+	}
 }
 
 func (c *bareCommandContainer) IsImageCached(ctx context.Context) (bool, error) { return false, nil }
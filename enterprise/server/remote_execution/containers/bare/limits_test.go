@@ -0,0 +1,67 @@
+package bare
+
+import (
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/cgroup"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/assert"
+
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+)
+
+func TestTaskCgroupLimits(t *testing.T) {
+	flags.Set(t, "executor.bare.cgroup_parent", "/sys/fs/cgroup/executor")
+	flags.Set(t, "executor.bare.io_limit_device", "259:0")
+	size := &scpb.TaskSize{EstimatedMilliCpu: 2000}
+	for _, tc := range []struct {
+		name          string
+		readBPSPerCU  int64
+		writeBPSPerCU int64
+		diskBandwidth int64
+		want          *cgroup.IOLimit
+	}{
+		{
+			name:          "compute unit limits",
+			readBPSPerCU:  100e6,
+			writeBPSPerCU: 50e6,
+			want:          &cgroup.IOLimit{Device: "259:0", ReadBPS: 200e6, WriteBPS: 100e6},
+		},
+		{
+			name:          "lower disk bandwidth",
+			readBPSPerCU:  100e6,
+			writeBPSPerCU: 50e6,
+			diskBandwidth: 10e6,
+			want:          &cgroup.IOLimit{Device: "259:0", ReadBPS: 10e6, WriteBPS: 10e6},
+		},
+		{
+			name:          "disk bandwidth can't exceed compute unit limits",
+			readBPSPerCU:  100e6,
+			writeBPSPerCU: 50e6,
+			diskBandwidth: 150e6,
+			want:          &cgroup.IOLimit{Device: "259:0", ReadBPS: 150e6, WriteBPS: 100e6},
+		},
+		{
+			name:          "disk bandwidth without compute unit limits",
+			diskBandwidth: 150e6,
+			want:          &cgroup.IOLimit{Device: "259:0", ReadBPS: 150e6, WriteBPS: 150e6},
+		},
+		{
+			name: "unlimited",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			flags.Set(t, "executor.bare.io_read_bps_per_compute_unit", tc.readBPSPerCU)
+			flags.Set(t, "executor.bare.io_write_bps_per_compute_unit", tc.writeBPSPerCU)
+
+			limits := taskCgroupLimits(size, &platform.Properties{EstimatedDiskBandwidth: tc.diskBandwidth})
+
+			if tc.want == nil {
+				assert.Nil(t, limits)
+				return
+			}
+			assert.Equal(t, &cgroup.Limits{IO: tc.want}, limits)
+		})
+	}
+}
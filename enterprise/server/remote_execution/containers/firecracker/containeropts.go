@@ -41,6 +41,15 @@ type ContainerOpts struct {
 	// The action directory with inputs / outputs.
 	ActionWorkingDirectory string
 
+	// RemoteSnapshotSharing specifies whether snapshots of this VM should be
+	// stored in the remote cache, so that the VM can be resumed on other
+	// executors. Has no effect unless remote snapshot sharing is enabled.
+	RemoteSnapshotSharing bool
+
+	// DiskBandwidth limits the bandwidth of each of the VM's drives, in bytes
+	// per second. 0 means no limit.
+	DiskBandwidth int64
+
 	// Optional flags -- these will default to sane values.
 	// They are here primarily for debugging and running
 	// VMs outside of the normal action-execution framework.
@@ -35,6 +35,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/uffd"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/vbd"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/vmexec_client"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/tasksize"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/ext4"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/oci"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/ociconv"
@@ -62,6 +63,7 @@ import (
 	vmsupport_bundle "github.com/buildbuddy-io/buildbuddy/enterprise/vmsupport"
 	fcpb "github.com/buildbuddy-io/buildbuddy/proto/firecracker"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
 	vmxpb "github.com/buildbuddy-io/buildbuddy/proto/vmexec"
 	vmfspb "github.com/buildbuddy-io/buildbuddy/proto/vmvfs"
 	dockerclient "github.com/docker/docker/client"
@@ -82,6 +84,7 @@ var workspaceDiskSlackSpaceMB = flag.Int64("executor.firecracker_workspace_disk_
 var healthCheckInterval = flag.Duration("executor.firecracker_health_check_interval", 10*time.Second, "How often to run VM health checks while tasks are executing.")
 var healthCheckTimeout = flag.Duration("executor.firecracker_health_check_timeout", 30*time.Second, "Timeout for VM health check requests.")
 var overprovisionCPUs = flag.Int("executor.firecracker_overprovision_cpus", 3, "Number of CPUs to overprovision for VMs. This allows VMs to more effectively utilize CPU resources on the host machine. Set to -1 to allow all VMs to use max CPU.")
+var diskBPSPerComputeUnit = flag.Int64("executor.firecracker_disk_bps_per_compute_unit", 0, "The disk bandwidth, in bytes per second, allowed for each estimated compute unit of a task. Each of the VM's drives is limited to this bandwidth for reads and writes combined. Tasks that set the EstimatedDiskBandwidth platform property are limited to that bandwidth instead, unless this limit is lower. 0 means unlimited.")
 var initOnAllocAndFree = flag.Bool("executor.firecracker_init_on_alloc_and_free", false, "Set init_on_alloc=1 and init_on_free=1 in firecracker vms")
 
 var forceRemoteSnapshotting = flag.Bool("debug_force_remote_snapshots", false, "When remote snapshotting is enabled, force remote snapshotting even for tasks which otherwise wouldn't support it.")
@@ -439,6 +442,10 @@ func NewProvider(env environment.Env, hostBuildRoot string) (*Provider, error) {
 		return nil, status.WrapError(err, "enable masquerading")
 	}
 
+	if err := startVMDebugServer(env); err != nil {
+		return nil, status.WrapError(err, "start VM debug server")
+	}
+
 	return &Provider{
 		env:            env,
 		dockerClient:   client,
@@ -477,6 +484,8 @@ func (p *Provider) New(ctx context.Context, args *container.Init) (container.Com
 		DockerClient:           p.dockerClient,
 		ActionWorkingDirectory: args.WorkDir,
 		ExecutorConfig:         p.executorConfig,
+		RemoteSnapshotSharing:  args.Props.RemoteSnapshotSharing,
+		DiskBandwidth:          taskDiskBandwidth(sizeEstimate, args.Props),
 	}
 	c, err := NewContainer(ctx, p.env, args.Task.GetExecutionTask(), opts)
 	if err != nil {
@@ -496,7 +505,12 @@ type FirecrackerContainer struct {
 	containerImage   string // the OCI container image. ex "alpine:latest"
 	actionWorkingDir string // the action directory with inputs / outputs
 	pulled           bool   // whether the container ext4 image has been pulled
-	user             string // user to execute all commands as
+	// Credentials passed to PullImage, used to pull the image if the snapshot
+	// is corrupted and the VM has to be booted from scratch instead.
+	pullCredentials oci.Credentials
+	user            string // user to execute all commands as
+	// Bandwidth limit of each drive, in bytes per second, or 0 if unlimited.
+	diskBandwidth int64
 
 	rmOnce *sync.Once
 	rmErr  error
@@ -603,6 +617,7 @@ func NewContainer(ctx context.Context, env environment.Env, task *repb.Execution
 		loader:             loader,
 		vmLog:              vmLog,
 		mountWorkspaceFile: *firecrackerMountWorkspaceFile,
+		diskBandwidth:      opts.DiskBandwidth,
 		cancelVmCtx:        func(err error) {},
 	}
 
@@ -614,7 +629,7 @@ func NewContainer(ctx context.Context, env environment.Env, task *repb.Execution
 		c.vmIdx = opts.ForceVMIdx
 	}
 
-	c.supportsRemoteSnapshots = *snaputil.EnableRemoteSnapshotSharing && (platform.IsCICommand(task.GetCommand(), platform.GetProto(task.GetAction(), task.GetCommand())) || *forceRemoteSnapshotting)
+	c.supportsRemoteSnapshots = *snaputil.EnableRemoteSnapshotSharing && (platform.IsCICommand(task.GetCommand(), platform.GetProto(task.GetAction(), task.GetCommand())) || opts.RemoteSnapshotSharing || *forceRemoteSnapshotting)
 
 	if opts.OverrideSnapshotKey == nil {
 		c.vmConfig.DebugMode = *debugTerminal
@@ -630,7 +645,12 @@ func NewContainer(ctx context.Context, env environment.Env, task *repb.Execution
 		// TODO(Maggie): Once local snapshot sharing is stable, remove runner ID
 		// from the snapshot key
 		runnerID := c.id
-		if *snaputil.EnableLocalSnapshotSharing {
+		// Runner IDs are only unique to this executor, so snapshots that are
+		// shared with other executors because of the remote-snapshot-sharing
+		// platform property can't be keyed by them. Other VMs that support
+		// remote snapshots, such as CI VMs, keep their existing keys.
+		snapshotSharingRequested := c.supportsRemoteSnapshots && opts.RemoteSnapshotSharing
+		if *snaputil.EnableLocalSnapshotSharing || snapshotSharingRequested {
 			runnerID = ""
 		}
 		c.snapshotKeySet, err = loader.SnapshotKeySet(ctx, task, cd.GetHash(), runnerID)
@@ -641,7 +661,7 @@ func NewContainer(ctx context.Context, env environment.Env, task *repb.Execution
 		// Create(), load the snapshot instead of creating a new VM.
 
 		recyclingEnabled := platform.IsTrue(platform.FindValue(platform.GetProto(task.GetAction(), task.GetCommand()), platform.RecycleRunnerPropertyName))
-		if recyclingEnabled && *snaputil.EnableLocalSnapshotSharing {
+		if recyclingEnabled && (*snaputil.EnableLocalSnapshotSharing || snapshotSharingRequested) {
 			snap, err := loader.GetSnapshot(ctx, c.snapshotKeySet, c.supportsRemoteSnapshots)
 			c.createFromSnapshot = (err == nil)
 			label := ""
@@ -1104,6 +1124,10 @@ func (c *FirecrackerContainer) LoadSnapshot(ctx context.Context) error {
 		return status.UnavailableErrorf("error resuming VM: %s", err)
 	}
 
+	if err := c.updateDiskRateLimits(ctx); err != nil {
+		return err
+	}
+
 	conn, err := c.dialVMExecServer(ctx)
 	if err != nil {
 		return err
@@ -1111,14 +1135,106 @@ func (c *FirecrackerContainer) LoadSnapshot(ctx context.Context) error {
 	defer conn.Close()
 
 	execClient := vmxpb.NewExecClient(conn)
-	_, err = execClient.Initialize(ctx, &vmxpb.InitializeRequest{
-		UnixTimestampNanoseconds: time.Now().UnixNano(),
+	// The guest clock stops while the VM is paused, so it's behind by however
+	// long the snapshot was stored. Resync it before running anything in the
+	// VM, since e.g. TLS certificate validation depends on it.
+	syncStart := time.Now()
+	rsp, err := execClient.Initialize(ctx, &vmxpb.InitializeRequest{
+		UnixTimestampNanoseconds: syncStart.UnixNano(),
 		ClearArpCache:            true,
 	})
 	if err != nil {
 		return status.WrapError(err, "Failed to initialize firecracker VM exec client")
 	}
+	c.observeClockDrift(ctx, syncStart, time.Now(), rsp.GetPreviousUnixTimestampNanoseconds())
+
+	if err := c.snapshotCorruptionError(); err != nil {
+		return err
+	}
+
+	c.registerLiveVM()
+	return nil
+}
 
+// taskDiskBandwidth returns the disk bandwidth limit, in bytes per second, of
+// a VM running a task of the given size and platform properties, or 0 if it's
+// unlimited.
+func taskDiskBandwidth(size *scpb.TaskSize, props *platform.Properties) int64 {
+	computeUnits := float64(size.GetEstimatedMilliCpu()) / tasksize.ComputeUnitsToMilliCPU
+	bw := int64(computeUnits * float64(*diskBPSPerComputeUnit))
+	// Tasks can ask for less bandwidth than the configured limit, but not
+	// more.
+	if taskBW := props.EstimatedDiskBandwidth; taskBW > 0 && (bw <= 0 || taskBW < bw) {
+		bw = taskBW
+	}
+	return bw
+}
+
+// diskRateLimiter returns a drive rate limiter which limits the drive's
+// bandwidth to the given number of bytes per second, or which has no limit if
+// it's 0, since firecracker disables token buckets with size 0.
+func diskRateLimiter(bytesPerSec int64) *fcmodels.RateLimiter {
+	return &fcmodels.RateLimiter{
+		Bandwidth: &fcmodels.TokenBucket{
+			Size:       fcclient.Int64(bytesPerSec),
+			RefillTime: fcclient.Int64(time.Second.Milliseconds()),
+		},
+	}
+}
+
+// updateDiskRateLimits applies the current task's disk bandwidth limit to the
+// drives of a VM resumed from a snapshot. Drive rate limiters are restored
+// from the snapshot, so they may have been set for a different task.
+func (c *FirecrackerContainer) updateDiskRateLimits(ctx context.Context) error {
+	driveIDs := []string{containerDriveID, scratchDriveID, workspaceDriveID}
+	if *EnableRootfs {
+		driveIDs = []string{rootDriveID, workspaceDriveID}
+	}
+	limiter := diskRateLimiter(c.diskBandwidth)
+	for _, id := range driveIDs {
+		err := c.machine.UpdateGuestDrive(ctx, id, "" /*=pathOnHost*/, func(params *operations.PatchGuestDriveByIDParams) {
+			params.Body.RateLimiter = limiter
+		})
+		if err != nil {
+			return status.UnavailableErrorf("update rate limiter of drive %q: %s", id, err)
+		}
+	}
+	return nil
+}
+
+// observeClockDrift records how far the guest clock had drifted when it was
+// resynchronized by an Initialize call made between start and end.
+func (c *FirecrackerContainer) observeClockDrift(ctx context.Context, start, end time.Time, guestUnixNanos int64) {
+	// Guests running an older vmexec don't report their clock.
+	if guestUnixNanos == 0 {
+		return
+	}
+	// The guest read its clock at some point during the call, so compare it
+	// against the midpoint to account for the round trip.
+	hostTime := start.Add(end.Sub(start) / 2)
+	drift := time.Unix(0, guestUnixNanos).Sub(hostTime)
+	metrics.FirecrackerGuestClockDriftUsec.Observe(float64(drift.Abs().Microseconds()))
+	log.CtxDebugf(ctx, "Resynchronized guest clock, which had drifted by %s", drift)
+}
+
+// snapshotCorruptionError returns a DataLoss error if any snapshot chunk
+// loaded into the VM failed validation, in which case the guest state can no
+// longer be trusted.
+func (c *FirecrackerContainer) snapshotCorruptionError() error {
+	stores := map[string]*copy_on_write.COWStore{
+		rootDriveID:        c.rootStore,
+		scratchDriveID:     c.scratchStore,
+		workspaceDriveID:   c.workspaceStore,
+		memoryChunkDirName: c.memoryStore,
+	}
+	for name, store := range stores {
+		if store == nil {
+			continue
+		}
+		if err := store.CorruptionError(); err != nil {
+			return status.WrapErrorf(err, "snapshot artifact %q is corrupted", name)
+		}
+	}
 	return nil
 }
 
@@ -1497,6 +1613,12 @@ func (c *FirecrackerContainer) getConfig(ctx context.Context, rootFS, containerF
 		},
 	}...)
 
+	if c.diskBandwidth > 0 {
+		for i := range cfg.Drives {
+			cfg.Drives[i].RateLimiter = diskRateLimiter(c.diskBandwidth)
+		}
+	}
+
 	if c.vmConfig.EnableNetworking {
 		cfg.NetworkInterfaces = []fcclient.NetworkInterface{
 			{
@@ -1870,7 +1992,31 @@ func (c *FirecrackerContainer) Create(ctx context.Context, actionWorkingDir stri
 
 	if c.createFromSnapshot {
 		log.Debugf("Create: will unpause snapshot")
-		return c.Unpause(ctx)
+		err := c.Unpause(ctx)
+		if err == nil {
+			return nil
+		}
+		corruptionErr := c.snapshotCorruptionError()
+		if corruptionErr == nil && status.IsDataLossError(err) {
+			corruptionErr = err
+		}
+		if corruptionErr == nil {
+			return err
+		}
+		// Resuming from a corrupted snapshot would lead to confusing failures
+		// inside the guest, so boot a new VM instead.
+		log.CtxWarningf(ctx, "Snapshot is corrupted, falling back to a clean boot: %s", corruptionErr)
+		metrics.SnapshotCorruptionFallbacks.Inc()
+		if err := c.Remove(ctx); err != nil {
+			log.CtxWarningf(ctx, "Failed to clean up VM loaded from corrupted snapshot: %s", err)
+		}
+		c.createFromSnapshot = false
+		c.recycled = false
+		c.snapshot = nil
+		c.pulled = false
+		if err := c.PullImage(ctx, c.pullCredentials); err != nil {
+			return status.WrapError(err, "pull image after failing to load corrupted snapshot")
+		}
 	}
 
 	ctx, span := tracing.StartSpan(ctx)
@@ -1973,6 +2119,7 @@ func (c *FirecrackerContainer) create(ctx context.Context) error {
 		return status.InternalErrorf("Failed starting machine: %s", err)
 	}
 	c.machine = m
+	c.registerLiveVM()
 	return nil
 }
 
@@ -2215,6 +2362,15 @@ func (c *FirecrackerContainer) Exec(ctx context.Context, cmd *repb.Command, stdi
 	defer conn.Close()
 
 	result, vmHealthy := c.SendExecRequestToGuest(ctx, conn, cmd, workDir, stdio)
+	if err := c.snapshotCorruptionError(); err != nil {
+		// The guest read corrupted snapshot data while executing the command,
+		// so its result can't be trusted. Return a retryable error so that the
+		// action is retried on a new VM.
+		log.CtxWarningf(ctx, "Snapshot corruption detected during execution: %s", err)
+		result.Error = status.UnavailableErrorf("VM snapshot was corrupted: %s", status.Message(err))
+		result.DoNotRecycle = true
+		return result
+	}
 
 	ctx, cancel = background.ExtendContextForFinalization(ctx, finalizationTimeout)
 	defer cancel()
@@ -2298,6 +2454,7 @@ func (c *FirecrackerContainer) PullImage(ctx context.Context, creds oci.Credenti
 		return nil
 	}
 	c.pulled = true
+	c.pullCredentials = creds
 
 	// If we're creating from a snapshot, we don't need to pull the base image
 	// since the rootfs image contains our full desired disk contents.
@@ -2350,6 +2507,8 @@ func (c *FirecrackerContainer) remove(ctx context.Context) error {
 
 	defer c.cancelVmCtx(fmt.Errorf("VM removed"))
 
+	c.unregisterLiveVM()
+
 	var lastErr error
 
 	// Note: we don't attempt any kind of clean shutdown here, because at this
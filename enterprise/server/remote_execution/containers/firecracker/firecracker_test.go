@@ -12,6 +12,8 @@ import (
 	"path/filepath"
 	"regexp"
 	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"testing"
@@ -138,7 +140,7 @@ func TestGuestAPIVersion(t *testing.T) {
 	// Note that if you go with option 1, ALL VM snapshots will be invalidated
 	// which will negatively affect customer experience. Be careful!
 	const (
-		expectedHash    = "d9644bd5f756f270b44cba7fef86476de294590c6ffaca232cd32e9bef80a477"
+		expectedHash    = "3933c378caefcb98232f251182a06731fbd6444997bc7bfb9063512a391d9fce"
 		expectedVersion = "13"
 	)
 	assert.Equal(t, expectedHash, firecracker.GuestAPIHash)
@@ -390,6 +392,47 @@ func TestFirecrackerLifecycle(t *testing.T) {
 	assertCommandResult(t, expectedResult, res)
 }
 
+func TestFirecrackerDiskBandwidthLimit(t *testing.T) {
+	ctx := context.Background()
+	env := getTestEnv(ctx, t, envOpts{})
+	rootDir := testfs.MakeTempDir(t)
+	workDir := testfs.MakeDirAll(t, rootDir, "work")
+
+	opts := firecracker.ContainerOpts{
+		ContainerImage:         busyboxImage,
+		ActionWorkingDirectory: workDir,
+		VMConfiguration: &fcpb.VMConfiguration{
+			NumCpus:           1,
+			MemSizeMb:         2500,
+			EnableNetworking:  false,
+			ScratchDiskSizeMb: 100,
+		},
+		ExecutorConfig: getExecutorConfig(t),
+		DiskBandwidth:  1e6,
+	}
+	c, err := firecracker.NewContainer(ctx, env, &repb.ExecutionTask{}, opts)
+	require.NoError(t, err)
+	err = container.PullImageIfNecessary(ctx, env, c, oci.Credentials{}, opts.ContainerImage)
+	require.NoError(t, err)
+	err = c.Create(ctx, opts.ActionWorkingDirectory)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	// Writing 3MB through a 1MB/s limiter takes at least 2 seconds, since
+	// the limiter's bucket starts out full.
+	cmd := &repb.Command{
+		Arguments: []string{"dd", "if=/dev/zero", "of=/tmp/out", "bs=1M", "count=3", "conv=fsync"},
+	}
+	start := time.Now()
+	res := c.Exec(ctx, cmd, nil)
+	require.NoError(t, res.Error)
+	require.Equal(t, 0, res.ExitCode, "stderr: %s", string(res.Stderr))
+	assert.GreaterOrEqual(t, time.Since(start), 1500*time.Millisecond)
+}
+
 func TestFirecrackerSnapshotAndResume(t *testing.T) {
 	// Test for both small and large memory sizes
 	for _, memorySize := range []int64{minMemSizeMB, 4000} {
@@ -505,6 +548,62 @@ func TestFirecrackerSnapshotAndResume(t *testing.T) {
 	}
 }
 
+func TestFirecrackerSnapshotAndResume_ResyncsClock(t *testing.T) {
+	ctx := context.Background()
+	env := getTestEnv(ctx, t, envOpts{})
+	env.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1")))
+	rootDir := testfs.MakeTempDir(t)
+	workDir := testfs.MakeDirAll(t, rootDir, "work")
+
+	cfg := getExecutorConfig(t)
+	opts := firecracker.ContainerOpts{
+		ContainerImage:         busyboxImage,
+		ActionWorkingDirectory: workDir,
+		VMConfiguration: &fcpb.VMConfiguration{
+			NumCpus:            1,
+			MemSizeMb:          minMemSizeMB,
+			EnableNetworking:   false,
+			ScratchDiskSizeMb:  100,
+			KernelVersion:      cfg.KernelVersion,
+			FirecrackerVersion: cfg.FirecrackerVersion,
+			GuestApiVersion:    cfg.GuestAPIVersion,
+		},
+		ExecutorConfig: cfg,
+	}
+	task := &repb.ExecutionTask{
+		Command: &repb.Command{
+			Platform: &repb.Platform{Properties: []*repb.Platform_Property{
+				{Name: "recycle-runner", Value: "true"},
+			}},
+			Arguments: []string{"./buildbuddy_ci_runner"},
+		},
+	}
+	c, err := firecracker.NewContainer(ctx, env, task, opts)
+	require.NoError(t, err)
+	err = container.PullImageIfNecessary(ctx, env, c, oci.Credentials{}, opts.ContainerImage)
+	require.NoError(t, err)
+	err = c.Create(ctx, opts.ActionWorkingDirectory)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	err = c.Pause(ctx)
+	require.NoError(t, err)
+	// Stay paused for longer than the allowed drift, so that the test fails
+	// if the clock isn't resynced.
+	time.Sleep(5 * time.Second)
+	err = c.Unpause(ctx)
+	require.NoError(t, err)
+
+	res := c.Exec(ctx, &repb.Command{Arguments: []string{"date", "+%s"}}, nil /*=stdio*/)
+	require.NoError(t, res.Error)
+	guestUnix, err := strconv.ParseInt(strings.TrimSpace(string(res.Stdout)), 10, 64)
+	require.NoError(t, err)
+	assert.InDelta(t, time.Now().Unix(), guestUnix, 2)
+}
+
 func TestFirecracker_LocalSnapshotSharing(t *testing.T) {
 	if !*snaputil.EnableLocalSnapshotSharing {
 		t.Skip("Snapshot sharing is not enabled")
@@ -821,6 +920,99 @@ func TestFirecracker_RemoteSnapshotSharing(t *testing.T) {
 	require.NotEmpty(t, res.VMMetadata.GetSnapshotId())
 }
 
+func TestFirecracker_RemoteSnapshotSharing_PlatformProperty(t *testing.T) {
+	if !*snaputil.EnableRemoteSnapshotSharing {
+		t.Skip("Snapshot sharing is not enabled")
+	}
+
+	ctx := context.Background()
+	env := getTestEnv(ctx, t, envOpts{})
+	cfg := getExecutorConfig(t)
+
+	env.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1")))
+	setFileCache := func(name string) {
+		fc, err := filecache.NewFileCache(testfs.MakeDirAll(t, cfg.JailerRoot, name), fileCacheSize, false)
+		require.NoError(t, err)
+		fc.WaitForDirectoryScanToComplete()
+		env.SetFileCache(fc)
+	}
+	setFileCache("filecache")
+
+	var containersToCleanup []*firecracker.FirecrackerContainer
+	t.Cleanup(func() {
+		for _, vm := range containersToCleanup {
+			err := vm.Remove(ctx)
+			assert.NoError(t, err)
+		}
+	})
+
+	// A regular action (not a workflow), which requests remote snapshot
+	// sharing.
+	task := &repb.ExecutionTask{
+		Command: &repb.Command{
+			Platform: &repb.Platform{Properties: []*repb.Platform_Property{
+				{Name: "recycle-runner", Value: "true"},
+				{Name: "remote-snapshot-sharing", Value: "true"},
+			}},
+			Arguments: []string{"./run_tests"},
+		},
+	}
+	newVM := func(remoteSnapshotSharing bool) *firecracker.FirecrackerContainer {
+		opts := firecracker.ContainerOpts{
+			ContainerImage:         busyboxImage,
+			ActionWorkingDirectory: testfs.MakeTempDir(t),
+			VMConfiguration: &fcpb.VMConfiguration{
+				NumCpus:            1,
+				MemSizeMb:          minMemSizeMB, // small to make snapshotting faster.
+				EnableNetworking:   false,
+				ScratchDiskSizeMb:  100,
+				KernelVersion:      cfg.KernelVersion,
+				FirecrackerVersion: cfg.FirecrackerVersion,
+				GuestApiVersion:    cfg.GuestAPIVersion,
+			},
+			ExecutorConfig:        cfg,
+			RemoteSnapshotSharing: remoteSnapshotSharing,
+		}
+		vm, err := firecracker.NewContainer(ctx, env, task, opts)
+		require.NoError(t, err)
+		containersToCleanup = append(containersToCleanup, vm)
+		return vm
+	}
+
+	baseVM := newVM(true /*=remoteSnapshotSharing*/)
+	err := container.PullImageIfNecessary(ctx, env, baseVM, oci.Credentials{}, busyboxImage)
+	require.NoError(t, err)
+	err = baseVM.Create(ctx, testfs.MakeTempDir(t))
+	require.NoError(t, err)
+	res := baseVM.Exec(ctx, appendToLog("Base"), nil /*=stdio*/)
+	require.NoError(t, res.Error)
+	require.Equal(t, "Base\n", string(res.Stdout))
+	err = baseVM.Pause(ctx)
+	require.NoError(t, err)
+
+	// Replace the local filecache, as if the next VM were started on another
+	// executor. The snapshot should be fetched from the remote cache.
+	setFileCache("filecache2")
+	forkedVM := newVM(true /*=remoteSnapshotSharing*/)
+	err = forkedVM.Unpause(ctx)
+	require.NoError(t, err)
+	res = forkedVM.Exec(ctx, appendToLog("Fork remote fetch"), nil /*=stdio*/)
+	require.NoError(t, res.Error)
+	require.Equal(t, "Base\nFork remote fetch\n", string(res.Stdout))
+	err = forkedVM.Pause(ctx)
+	require.NoError(t, err)
+
+	// Without the property, snapshots of regular actions are only looked up
+	// locally, so a VM on another executor starts from scratch.
+	setFileCache("filecache3")
+	localVM := newVM(false /*=remoteSnapshotSharing*/)
+	err = localVM.Create(ctx, testfs.MakeTempDir(t))
+	require.NoError(t, err)
+	res = localVM.Exec(ctx, appendToLog("Local only"), nil /*=stdio*/)
+	require.NoError(t, res.Error)
+	require.Equal(t, "Local only\n", string(res.Stdout))
+}
+
 func TestFirecracker_RemoteSnapshotSharing_RemoteInstanceName(t *testing.T) {
 	if !*snaputil.EnableRemoteSnapshotSharing {
 		t.Skip("Snapshot sharing is not enabled")
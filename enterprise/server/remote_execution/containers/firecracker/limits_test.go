@@ -0,0 +1,55 @@
+package firecracker
+
+import (
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/assert"
+
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+)
+
+func TestTaskDiskBandwidth(t *testing.T) {
+	size := &scpb.TaskSize{EstimatedMilliCpu: 2000}
+	for _, tc := range []struct {
+		name          string
+		bpsPerCU      int64
+		diskBandwidth int64
+		want          int64
+	}{
+		{
+			name:     "compute unit limit",
+			bpsPerCU: 100e6,
+			want:     200e6,
+		},
+		{
+			name:          "lower disk bandwidth",
+			bpsPerCU:      100e6,
+			diskBandwidth: 10e6,
+			want:          10e6,
+		},
+		{
+			name:          "disk bandwidth can't exceed compute unit limit",
+			bpsPerCU:      100e6,
+			diskBandwidth: 300e6,
+			want:          200e6,
+		},
+		{
+			name:          "disk bandwidth without compute unit limit",
+			diskBandwidth: 150e6,
+			want:          150e6,
+		},
+		{
+			name: "unlimited",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			flags.Set(t, "executor.firecracker_disk_bps_per_compute_unit", tc.bpsPerCU)
+
+			bw := taskDiskBandwidth(size, &platform.Properties{EstimatedDiskBandwidth: tc.diskBandwidth})
+
+			assert.Equal(t, tc.want, bw)
+		})
+	}
+}
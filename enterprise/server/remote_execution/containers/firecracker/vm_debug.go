@@ -0,0 +1,331 @@
+package firecracker
+
+import (
+	"context"
+	"flag"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/vsock"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/grpc_server"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc"
+
+	vmdbpb "github.com/buildbuddy-io/buildbuddy/proto/vmdebug"
+	vmxpb "github.com/buildbuddy-io/buildbuddy/proto/vmexec"
+)
+
+var vmDebugSocketPath = flag.String("executor.firecracker_vm_debug_socket_path", "", "If set, the executor serves the VMDebug gRPC service on a unix socket at this path, which allows running commands, copying files, and forwarding ports in running VMs. Only processes running as the executor's user can connect to the socket.")
+
+var (
+	liveVMsMu sync.Mutex // PROTECTS(liveVMs)
+	liveVMs   = map[string]*liveVM{}
+)
+
+// liveVM is a running VM which can be debugged using the VMDebug service.
+type liveVM struct {
+	info *vmdbpb.ListVMsResponse_VM
+	// Path to the VM's vsock socket on the host.
+	vsockPath string
+}
+
+// registerLiveVM makes the VM available to the VMDebug service. It should be
+// called once the VM is started.
+func (c *FirecrackerContainer) registerLiveVM() {
+	vm := &liveVM{
+		info: &vmdbpb.ListVMsResponse_VM{
+			VmId:           c.id,
+			ExecutionId:    c.task.GetExecutionId(),
+			ContainerImage: c.containerImage,
+			Recycled:       c.recycled,
+		},
+		vsockPath: filepath.Join(c.getChroot(), firecrackerVSockPath),
+	}
+	liveVMsMu.Lock()
+	defer liveVMsMu.Unlock()
+	liveVMs[c.id] = vm
+}
+
+func (c *FirecrackerContainer) unregisterLiveVM() {
+	liveVMsMu.Lock()
+	defer liveVMsMu.Unlock()
+	delete(liveVMs, c.id)
+}
+
+// startVMDebugServer starts the VMDebug service if
+// --executor.firecracker_vm_debug_socket_path is set.
+func startVMDebugServer(env environment.Env) error {
+	if *vmDebugSocketPath == "" {
+		return nil
+	}
+	lis, err := listenVMDebug(*vmDebugSocketPath)
+	if err != nil {
+		return err
+	}
+	server := grpc.NewServer(grpc.MaxRecvMsgSize(grpc_server.MaxRecvMsgSizeBytes()))
+	vmdbpb.RegisterVMDebugServer(server, &vmDebugServer{})
+	go func() {
+		if err := server.Serve(lis); err != nil {
+			log.Errorf("VM debug server failed: %s", err)
+		}
+	}()
+	env.GetHealthChecker().RegisterShutdownFunction(grpc_server.GRPCShutdownFunc(server))
+	log.Infof("VM debug server listening on %s", lis.Addr())
+	return nil
+}
+
+// listenVMDebug listens on a unix socket at the given path. Since the VMDebug
+// service is unauthenticated, only the executor's user can use the socket, and
+// connections from processes of other users are dropped, in case they connect
+// before the socket's permissions are restricted.
+func listenVMDebug(path string) (net.Listener, error) {
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, status.UnavailableErrorf("listen on %q: %s", path, err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		lis.Close()
+		return nil, status.InternalErrorf("restrict permissions of %q: %s", path, err)
+	}
+	return &vmDebugListener{Listener: lis, uid: os.Getuid()}, nil
+}
+
+// vmDebugListener only accepts connections from processes running as the
+// given user.
+type vmDebugListener struct {
+	net.Listener
+	uid int
+}
+
+func (l *vmDebugListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		uid, err := peerUID(conn)
+		if err == nil && uid == l.uid {
+			return conn, nil
+		}
+		if err != nil {
+			log.Warningf("Dropping VM debug connection: %s", err)
+		} else {
+			log.Warningf("Dropping VM debug connection from uid %d", uid)
+		}
+		conn.Close()
+	}
+}
+
+// peerUID returns the user of the process on the other end of a unix socket
+// connection.
+func peerUID(conn net.Conn) (int, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0, status.InternalErrorf("unexpected connection type %T", conn)
+	}
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return 0, status.InternalErrorf("get raw connection: %s", err)
+	}
+	var cred *unix.Ucred
+	var credErr error
+	if err := rc.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return 0, status.InternalErrorf("get raw connection: %s", err)
+	}
+	if credErr != nil {
+		return 0, status.InternalErrorf("get peer credentials: %s", credErr)
+	}
+	return int(cred.Uid), nil
+}
+
+type vmDebugServer struct{}
+
+func (s *vmDebugServer) ListVMs(ctx context.Context, req *vmdbpb.ListVMsRequest) (*vmdbpb.ListVMsResponse, error) {
+	liveVMsMu.Lock()
+	defer liveVMsMu.Unlock()
+	rsp := &vmdbpb.ListVMsResponse{}
+	for _, vm := range liveVMs {
+		rsp.Vms = append(rsp.Vms, vm.info)
+	}
+	sort.Slice(rsp.Vms, func(i, j int) bool {
+		return rsp.Vms[i].GetVmId() < rsp.Vms[j].GetVmId()
+	})
+	return rsp, nil
+}
+
+// dialGuest connects to the exec service of the given VM.
+func (s *vmDebugServer) dialGuest(ctx context.Context, vmID string) (vmxpb.ExecClient, *grpc.ClientConn, error) {
+	if vmID == "" {
+		return nil, nil, status.InvalidArgumentError("missing vm_id")
+	}
+	liveVMsMu.Lock()
+	vm, ok := liveVMs[vmID]
+	liveVMsMu.Unlock()
+	if !ok {
+		return nil, nil, status.NotFoundErrorf("VM %q is not running on this executor", vmID)
+	}
+	ctx, cancel := context.WithTimeout(ctx, vSocketDialTimeout)
+	defer cancel()
+	conn, err := vsock.SimpleGRPCDial(ctx, vm.vsockPath, vsock.VMExecPort)
+	if err != nil {
+		return nil, nil, status.UnavailableErrorf("dial VM %q: %s", vmID, err)
+	}
+	return vmxpb.NewExecClient(conn), conn, nil
+}
+
+// proxyStream forwards requests from the client to the guest until the client
+// closes its end of the stream, and responses from the guest to the client
+// until the guest closes its end of the stream.
+func proxyStream[Req, Rsp any](recvClient func() (Req, error), sendGuest func(Req) error, closeGuestSend func() error, recvGuest func() (Rsp, error), sendClient func(Rsp) error) error {
+	go func() {
+		for {
+			req, err := recvClient()
+			if err == io.EOF {
+				closeGuestSend()
+				return
+			}
+			if err != nil {
+				// The client stream failed, which cancels the guest stream.
+				return
+			}
+			if err := sendGuest(req); err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		rsp, err := recvGuest()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := sendClient(rsp); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *vmDebugServer) Exec(stream vmdbpb.VMDebug_ExecServer) error {
+	ctx := stream.Context()
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	client, conn, err := s.dialGuest(ctx, req.GetVmId())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	log.CtxInfof(ctx, "Debug exec in VM %s: %q", req.GetVmId(), req.GetRequest().GetStart().GetArguments())
+	guest, err := client.ExecStreamed(ctx)
+	if err != nil {
+		return err
+	}
+	if err := guest.Send(req.GetRequest()); err != nil {
+		return err
+	}
+	return proxyStream(
+		func() (*vmxpb.ExecStreamedRequest, error) {
+			req, err := stream.Recv()
+			return req.GetRequest(), err
+		},
+		guest.Send, guest.CloseSend, guest.Recv, stream.Send)
+}
+
+func (s *vmDebugServer) ReadFile(req *vmdbpb.ReadFileRequest, stream vmdbpb.VMDebug_ReadFileServer) error {
+	ctx := stream.Context()
+	client, conn, err := s.dialGuest(ctx, req.GetVmId())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	guest, err := client.ReadFile(ctx, req.GetRequest())
+	if err != nil {
+		return err
+	}
+	for {
+		rsp, err := guest.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(rsp); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *vmDebugServer) WriteFile(stream vmdbpb.VMDebug_WriteFileServer) error {
+	ctx := stream.Context()
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	client, conn, err := s.dialGuest(ctx, req.GetVmId())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	log.CtxInfof(ctx, "Debug write to %q in VM %s", req.GetRequest().GetPath(), req.GetVmId())
+	guest, err := client.WriteFile(ctx)
+	if err != nil {
+		return err
+	}
+	for {
+		if err := guest.Send(req.GetRequest()); err != nil {
+			return err
+		}
+		req, err = stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	rsp, err := guest.CloseAndRecv()
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(rsp)
+}
+
+func (s *vmDebugServer) ForwardPort(stream vmdbpb.VMDebug_ForwardPortServer) error {
+	ctx := stream.Context()
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	client, conn, err := s.dialGuest(ctx, req.GetVmId())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	log.CtxInfof(ctx, "Debug port forward to port %d in VM %s", req.GetRequest().GetPort(), req.GetVmId())
+	guest, err := client.ForwardPort(ctx)
+	if err != nil {
+		return err
+	}
+	if err := guest.Send(req.GetRequest()); err != nil {
+		return err
+	}
+	return proxyStream(
+		func() (*vmxpb.ForwardPortRequest, error) {
+			req, err := stream.Recv()
+			return req.GetRequest(), err
+		},
+		guest.Send, guest.CloseSend, guest.Recv, stream.Send)
+}
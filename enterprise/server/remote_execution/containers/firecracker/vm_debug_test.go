@@ -0,0 +1,73 @@
+package firecracker
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	vmdbpb "github.com/buildbuddy-io/buildbuddy/proto/vmdebug"
+)
+
+// serveVMDebug serves the VMDebug service on the listener and returns a client
+// of the service at the given socket path.
+func serveVMDebug(t *testing.T, lis net.Listener, path string) vmdbpb.VMDebugClient {
+	server := grpc.NewServer()
+	vmdbpb.RegisterVMDebugServer(server, &vmDebugServer{})
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.NewClient("unix://"+path, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return vmdbpb.NewVMDebugClient(conn)
+}
+
+func TestListenVMDebug(t *testing.T) {
+	path := filepath.Join(testfs.MakeTempDir(t), "vmdebug.sock")
+	lis, err := listenVMDebug(path)
+	require.NoError(t, err)
+
+	// Only the executor's user can access the socket.
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeSocket|0600, info.Mode())
+
+	client := serveVMDebug(t, lis, path)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	rsp, err := client.ListVMs(ctx, &vmdbpb.ListVMsRequest{})
+	require.NoError(t, err)
+	assert.Empty(t, rsp.GetVms())
+}
+
+func TestListenVMDebug_DropsConnectionsFromOtherUsers(t *testing.T) {
+	path := filepath.Join(testfs.MakeTempDir(t), "vmdebug.sock")
+	lis, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	// Pretend that the executor runs as another user than the test.
+	lis = &vmDebugListener{Listener: lis, uid: os.Getuid() + 1}
+
+	client := serveVMDebug(t, lis, path)
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	_, err = client.ListVMs(ctx, &vmdbpb.ListVMsRequest{})
+	require.Error(t, err)
+}
+
+func TestListenVMDebug_SocketInUse(t *testing.T) {
+	path := filepath.Join(testfs.MakeTempDir(t), "vmdebug.sock")
+	lis, err := listenVMDebug(path)
+	require.NoError(t, err)
+	defer lis.Close()
+
+	_, err = listenVMDebug(path)
+	require.Error(t, err)
+}
@@ -0,0 +1,445 @@
+// Package macvm runs actions inside macOS VMs, using Apple's
+// Virtualization.framework.
+//
+// VMs are managed using tart (https://tart.run), which wraps
+// Virtualization.framework in a signed binary with the entitlements needed to
+// create VMs. VM images are OCI artifacts which are pulled once and kept in
+// tart's local cache. Each container gets its own VM, which is cloned from the
+// cached image using an APFS copy-on-write clone, so creating a VM doesn't copy
+// the image's disk and writes in one VM are never visible to others.
+//
+// The workspace is shared with the guest using virtiofs, and commands are run
+// in the guest using the tart guest agent, which must be installed in the
+// image.
+package macvm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/commandutil"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/container"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/oci"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/lockingbuffer"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/random"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+var (
+	tartBinary  = flag.String("executor.macvm.tart_binary", "tart", "Path to the tart binary, which is used to create and run macOS VMs.")
+	bootTimeout = flag.Duration("executor.macvm.boot_timeout", 3*time.Minute, "How long to wait for a VM's guest agent to become ready after starting the VM.")
+	pullTimeout = flag.Duration("executor.macvm.pull_timeout", 30*time.Minute, "Timeout for VM image pulls. macOS images are often tens of gigabytes.")
+	minMemoryMB = flag.Int64("executor.macvm.min_memory_mb", 4096, "The minimum amount of memory given to each VM. VMs get the estimated memory usage of their task if it's larger.")
+	logVMOutput = flag.Bool("executor.macvm.log_vm_output", false, "If true, output from the tart process running each VM is logged, for debugging.")
+)
+
+const (
+	// Prefix of the names of VMs created by the executor, which is used to
+	// find VMs left behind by a previous executor process.
+	vmNamePrefix = "buildbuddy-macvm-"
+
+	// Name of the shared directory containing the workspace. Virtiofs shared
+	// directories are automatically mounted in the guest under
+	// guestSharedDirsRoot.
+	workspaceDirTag     = "workspace"
+	guestSharedDirsRoot = "/Volumes/My Shared Files"
+
+	// Prefix of the names of files in the workspace which set the environment
+	// of guest commands.
+	envFilePrefix = ".buildbuddy-macvm-env-"
+
+	readinessPollInterval = 500 * time.Millisecond
+	stopTimeoutSeconds    = 10
+)
+
+// Provider creates macOS VM containers.
+type Provider struct {
+	env environment.Env
+}
+
+// NewProvider returns a provider of macOS VM containers. VMs left behind by a
+// previous executor process are deleted, since their workspaces no longer
+// exist.
+func NewProvider(env environment.Env) (*Provider, error) {
+	ctx := env.GetServerContext()
+	res := runTart(ctx, env.GetCommandRunner(), nil /*=stdio*/, "--version")
+	if res.Error != nil {
+		return nil, status.FailedPreconditionErrorf("run %s: %s", *tartBinary, res.Error)
+	}
+	if res.ExitCode != 0 {
+		return nil, status.FailedPreconditionErrorf("%s --version failed: exit code %d: %q", *tartBinary, res.ExitCode, string(res.Stderr))
+	}
+	vms, err := listVMs(ctx, env.GetCommandRunner(), "local")
+	if err != nil {
+		return nil, err
+	}
+	for _, vm := range vms {
+		if !strings.HasPrefix(vm.Name, vmNamePrefix) {
+			continue
+		}
+		log.Infof("Deleting orphaned macOS VM %s", vm.Name)
+		if err := deleteVM(ctx, env.GetCommandRunner(), vm.Name); err != nil {
+			log.Warningf("Failed to delete orphaned macOS VM %s: %s", vm.Name, err)
+		}
+	}
+	return &Provider{env: env}, nil
+}
+
+func (p *Provider) New(ctx context.Context, args *container.Init) (container.CommandContainer, error) {
+	if strings.EqualFold(args.Props.DockerNetwork, "off") {
+		return nil, status.InvalidArgumentError("dockerNetwork=off is not supported by macvm isolation")
+	}
+	size := args.Task.GetSchedulingMetadata().GetTaskSize()
+	return &macVMContainer{
+		env:      p.env,
+		image:    args.Props.ContainerImage,
+		numCPUs:  max(1, (size.GetEstimatedMilliCpu()+999)/1000),
+		memoryMB: max(*minMemoryMB, size.GetEstimatedMemoryBytes()/1e6),
+	}, nil
+}
+
+// macVMContainer runs commands in a macOS VM which is created from the
+// container image.
+type macVMContainer struct {
+	env      environment.Env
+	image    string
+	numCPUs  int64
+	memoryMB int64
+
+	// name is the VM name, which is set when the VM is created.
+	name    string
+	workDir string
+
+	mu sync.Mutex // PROTECTS(vmCmd, vmOutput, vmExited)
+	// vmCmd is the 'tart run' process running the VM.
+	vmCmd    *exec.Cmd
+	vmOutput *lockingbuffer.LockingBuffer
+	// vmExited is closed once the 'tart run' process exits.
+	vmExited chan struct{}
+}
+
+func (c *macVMContainer) IsolationType() string {
+	return "macvm"
+}
+
+func (c *macVMContainer) Run(ctx context.Context, command *repb.Command, workDir string, creds oci.Credentials) *interfaces.CommandResult {
+	if err := container.PullImageIfNecessary(ctx, c.env, c, creds, c.image); err != nil {
+		return commandutil.ErrorResult(status.UnavailableErrorf("failed to pull VM image: %s", err))
+	}
+	if err := c.Create(ctx, workDir); err != nil {
+		return commandutil.ErrorResult(err)
+	}
+	defer func() {
+		if err := c.Remove(context.WithoutCancel(ctx)); err != nil {
+			log.CtxWarningf(ctx, "Failed to remove macOS VM: %s", err)
+		}
+	}()
+	return c.Exec(ctx, command, &interfaces.Stdio{})
+}
+
+// Create clones a VM from the image, starts it with the workspace shared with
+// the guest, and waits for the guest agent to become ready.
+func (c *macVMContainer) Create(ctx context.Context, workDir string) error {
+	suffix, err := random.RandomString(20)
+	if err != nil {
+		return status.UnavailableErrorf("generate VM name: %s", err)
+	}
+	c.name = vmNamePrefix + strings.ToLower(suffix)
+	c.workDir = workDir
+
+	if err := c.runTartCommand(ctx, "clone", c.image, c.name); err != nil {
+		return status.UnavailableErrorf("clone VM image: %s", err)
+	}
+	if err := c.runTartCommand(ctx, "set", "--cpu", fmt.Sprint(c.numCPUs), "--memory", fmt.Sprint(c.memoryMB), c.name); err != nil {
+		c.removeVM(ctx)
+		return status.UnavailableErrorf("configure VM: %s", err)
+	}
+	if err := c.startVM(); err != nil {
+		c.removeVM(ctx)
+		return err
+	}
+	if err := c.waitUntilReady(ctx); err != nil {
+		c.removeVM(ctx)
+		return err
+	}
+	return nil
+}
+
+// startVM starts the VM in a 'tart run' process, which keeps running until the
+// VM is stopped.
+func (c *macVMContainer) startVM() error {
+	cmd := exec.Command(*tartBinary, "run", "--no-graphics", "--no-audio", fmt.Sprintf("--dir=%s:%s", workspaceDirTag, c.workDir), c.name)
+	output := lockingbuffer.New()
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if *logVMOutput {
+		cmd.Stdout = log.Writer(fmt.Sprintf("[%s] ", c.name))
+		cmd.Stderr = cmd.Stdout
+	}
+	if err := cmd.Start(); err != nil {
+		return status.UnavailableErrorf("start VM: %s", err)
+	}
+	exited := make(chan struct{})
+	c.mu.Lock()
+	c.vmCmd = cmd
+	c.vmOutput = output
+	c.vmExited = exited
+	c.mu.Unlock()
+	go func() {
+		defer close(exited)
+		if err := cmd.Wait(); err != nil {
+			log.Debugf("macOS VM %s exited: %s", c.name, err)
+		}
+	}()
+	return nil
+}
+
+// waitUntilReady waits until the guest agent can run commands, which happens
+// once the guest has booted.
+func (c *macVMContainer) waitUntilReady(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, *bootTimeout)
+	defer cancel()
+	c.mu.Lock()
+	exited := c.vmExited
+	c.mu.Unlock()
+	for {
+		res := runTart(ctx, c.env.GetCommandRunner(), nil /*=stdio*/, "exec", c.name, "true")
+		if res.Error == nil && res.ExitCode == 0 {
+			return nil
+		}
+		select {
+		case <-exited:
+			c.mu.Lock()
+			output := c.vmOutput.String()
+			c.mu.Unlock()
+			return status.UnavailableErrorf("VM exited while booting: %q", output)
+		case <-ctx.Done():
+			return status.DeadlineExceededErrorf("VM guest agent was not ready after %s", *bootTimeout)
+		case <-time.After(readinessPollInterval):
+		}
+	}
+}
+
+// guestCommand returns the arguments of 'tart exec' which run the given command
+// in the guest, from the guest path of the workspace. The command's environment
+// is read from envFile, a file in the workspace written by writeEnvFile, since
+// arguments of the 'tart exec' process are visible to all users on the host.
+func guestCommand(name string, cmd *repb.Command, envFile string, interactive bool) []string {
+	args := []string{"exec"}
+	if interactive {
+		args = append(args, "-i")
+	}
+	args = append(args, name)
+	// The guest agent doesn't support setting the working directory or
+	// environment, so use a shell to set them.
+	workspaceDir := guestSharedDirsRoot + "/" + workspaceDirTag
+	workDir := workspaceDir
+	if wd := cmd.GetWorkingDirectory(); wd != "" {
+		workDir += "/" + wd
+	}
+	args = append(args, "/bin/sh", "-c", `cd "$1" && env_file="$2" && shift 2 && . "$env_file"`, "sh", workDir, workspaceDir+"/"+envFile)
+	return append(args, cmd.GetArguments()...)
+}
+
+// writeEnvFile writes a shell script to the workspace which, when sourced by
+// the guest command, deletes itself and execs the command with its
+// environment variables set. It returns the name of the file.
+func (c *macVMContainer) writeEnvFile(cmd *repb.Command) (string, error) {
+	suffix, err := random.RandomString(20)
+	if err != nil {
+		return "", status.UnavailableErrorf("generate env file name: %s", err)
+	}
+	name := envFilePrefix + strings.ToLower(suffix)
+	var script strings.Builder
+	script.WriteString("rm -f \"$env_file\"\nexec /usr/bin/env")
+	for _, envVar := range cmd.GetEnvironmentVariables() {
+		script.WriteString(" " + shellQuote(envVar.GetName()+"="+envVar.GetValue()))
+	}
+	script.WriteString(" \"$@\"\n")
+	if err := os.WriteFile(filepath.Join(c.workDir, name), []byte(script.String()), 0600); err != nil {
+		return "", status.UnavailableErrorf("write env file: %s", err)
+	}
+	return name, nil
+}
+
+// shellQuote quotes s as a single-quoted shell word.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func (c *macVMContainer) Exec(ctx context.Context, cmd *repb.Command, stdio *interfaces.Stdio) *interfaces.CommandResult {
+	if c.name == "" {
+		return commandutil.ErrorResult(status.FailedPreconditionError("VM is not created"))
+	}
+	envFile, err := c.writeEnvFile(cmd)
+	if err != nil {
+		return commandutil.ErrorResult(err)
+	}
+	// The guest deletes the file before running the command, but it won't if
+	// the exec fails.
+	defer os.Remove(filepath.Join(c.workDir, envFile))
+	res := runTart(ctx, c.env.GetCommandRunner(), stdio, guestCommand(c.name, cmd, envFile, stdio != nil && stdio.Stdin != nil)...)
+	res.CommandDebugString = fmt.Sprintf("(macvm) %s", cmd.GetArguments())
+	// If the VM exited, the exec failed because the VM went away rather than
+	// because of the command.
+	c.mu.Lock()
+	exited := c.vmExited
+	c.mu.Unlock()
+	select {
+	case <-exited:
+		if res.Error == nil {
+			res.ExitCode = commandutil.NoExitCode
+			res.Error = status.UnavailableError("VM exited while running command")
+		}
+	default:
+	}
+	return res
+}
+
+func (c *macVMContainer) Signal(ctx context.Context, sig syscall.Signal) error {
+	return status.UnimplementedError("not implemented")
+}
+
+func (c *macVMContainer) IsImageCached(ctx context.Context) (bool, error) {
+	vms, err := listVMs(ctx, c.env.GetCommandRunner(), "oci")
+	if err != nil {
+		return false, err
+	}
+	for _, vm := range vms {
+		if vm.Name == c.image {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c *macVMContainer) PullImage(ctx context.Context, creds oci.Credentials) error {
+	// Pull using the server context, so that the pull isn't cancelled if the
+	// task is, since other tasks are likely to need the image too.
+	ctx, cancel := context.WithTimeout(c.env.GetServerContext(), *pullTimeout)
+	defer cancel()
+	cmd := &repb.Command{Arguments: []string{*tartBinary, "pull", c.image}}
+	if !creds.IsEmpty() {
+		// Setting any environment variables replaces the executor's
+		// environment, which tart needs to find its cache.
+		for _, kv := range os.Environ() {
+			name, value, _ := strings.Cut(kv, "=")
+			cmd.EnvironmentVariables = append(cmd.EnvironmentVariables, &repb.Command_EnvironmentVariable{Name: name, Value: value})
+		}
+		cmd.EnvironmentVariables = append(cmd.EnvironmentVariables,
+			&repb.Command_EnvironmentVariable{Name: "TART_REGISTRY_USERNAME", Value: creds.Username},
+			&repb.Command_EnvironmentVariable{Name: "TART_REGISTRY_PASSWORD", Value: creds.Password},
+		)
+	}
+	start := time.Now()
+	res := c.env.GetCommandRunner().Run(ctx, cmd, "" /*=workDir*/, nil /*=statsListener*/, &interfaces.Stdio{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.ExitCode != 0 {
+		return status.UnavailableErrorf("tart pull failed: exit code %d: %q", res.ExitCode, string(res.Stderr))
+	}
+	log.CtxInfof(ctx, "Pulled macOS VM image %s in %s", c.image, time.Since(start))
+	return nil
+}
+
+// Start is a no-op, since VMs are started by Create.
+func (c *macVMContainer) Start(ctx context.Context) error { return nil }
+
+// VMs can't be suspended without saving their memory to disk, which is slower
+// than keeping them running, so paused VMs keep running.
+func (c *macVMContainer) Pause(ctx context.Context) error   { return nil }
+func (c *macVMContainer) Unpause(ctx context.Context) error { return nil }
+
+func (c *macVMContainer) Remove(ctx context.Context) error {
+	if c.name == "" {
+		return nil
+	}
+	return c.removeVM(ctx)
+}
+
+// removeVM stops the VM if it's running, and deletes its clone of the image.
+func (c *macVMContainer) removeVM(ctx context.Context) error {
+	c.mu.Lock()
+	cmd, exited := c.vmCmd, c.vmExited
+	c.mu.Unlock()
+	if cmd != nil {
+		if err := c.runTartCommand(ctx, "stop", "--timeout", fmt.Sprint(stopTimeoutSeconds), c.name); err != nil {
+			log.CtxWarningf(ctx, "Failed to stop macOS VM %s: %s", c.name, err)
+			cmd.Process.Kill()
+		}
+		<-exited
+	}
+	return deleteVM(ctx, c.env.GetCommandRunner(), c.name)
+}
+
+func (c *macVMContainer) Stats(ctx context.Context) (*repb.UsageStats, error) {
+	return nil, nil
+}
+
+func (c *macVMContainer) runTartCommand(ctx context.Context, args ...string) error {
+	res := runTart(ctx, c.env.GetCommandRunner(), nil /*=stdio*/, args...)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.ExitCode != 0 {
+		return status.UnavailableErrorf("tart %s failed: exit code %d: %q", args[0], res.ExitCode, string(res.Stderr))
+	}
+	return nil
+}
+
+func runTart(ctx context.Context, commandRunner interfaces.CommandRunner, stdio *interfaces.Stdio, args ...string) *interfaces.CommandResult {
+	if stdio == nil {
+		stdio = &interfaces.Stdio{}
+	}
+	command := &repb.Command{Arguments: append([]string{*tartBinary}, args...)}
+	return commandRunner.Run(ctx, command, "" /*=workDir*/, nil /*=statsListener*/, stdio)
+}
+
+// tartVM is an entry of 'tart list --format=json'.
+type tartVM struct {
+	Name    string `json:"Name"`
+	Running bool   `json:"Running"`
+}
+
+// listVMs lists the VMs from the given source, either "local" for VMs created
+// by cloning, or "oci" for pulled images.
+func listVMs(ctx context.Context, commandRunner interfaces.CommandRunner, source string) ([]*tartVM, error) {
+	res := runTart(ctx, commandRunner, nil /*=stdio*/, "list", "--format=json", "--source="+source)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.ExitCode != 0 {
+		return nil, status.UnavailableErrorf("tart list failed: exit code %d: %q", res.ExitCode, string(res.Stderr))
+	}
+	var vms []*tartVM
+	if err := json.Unmarshal(res.Stdout, &vms); err != nil {
+		return nil, status.InternalErrorf("parse tart list output: %s", err)
+	}
+	return vms, nil
+}
+
+func deleteVM(ctx context.Context, commandRunner interfaces.CommandRunner, name string) error {
+	res := runTart(ctx, commandRunner, nil /*=stdio*/, "delete", name)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.ExitCode != 0 && !strings.Contains(string(res.Stderr), "does not exist") {
+		return status.UnavailableErrorf("tart delete failed: exit code %d: %q", res.ExitCode, string(res.Stderr))
+	}
+	return nil
+}
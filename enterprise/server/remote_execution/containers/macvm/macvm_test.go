@@ -0,0 +1,194 @@
+package macvm_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/commandutil"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/container"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/containers/macvm"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/oci"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+)
+
+const testImage = "ghcr.io/cirruslabs/macos-sequoia-base:latest"
+
+// fakeTartScript emulates tart, running "guest" commands on the host with the
+// guest workspace path mapped to the shared host dir. Commands are logged to
+// tart.log in stateDir.
+const fakeTartScript = `#!/bin/sh
+STATE_DIR=%q
+echo "$@" >> "$STATE_DIR/tart.log"
+case "$1" in
+--version)
+  echo "2.0.0"
+  ;;
+list)
+  case "$3" in
+  --source=local) echo '[{"Name":"buildbuddy-macvm-orphan","Running":false},{"Name":"my-vm","Running":false}]' ;;
+  --source=oci) echo '[{"Name":"%s","Running":false}]' ;;
+  esac
+  ;;
+run)
+  # Record the host path of the workspace, from --dir=workspace:PATH.
+  echo "${4#--dir=workspace:}" > "$STATE_DIR/workspace"
+  touch "$STATE_DIR/running"
+  while [ -e "$STATE_DIR/running" ]; do sleep 0.05; done
+  ;;
+stop)
+  rm -f "$STATE_DIR/running"
+  ;;
+exec)
+  shift
+  if [ "$1" = "-i" ]; then shift; fi
+  shift
+  [ -e "$STATE_DIR/running" ] || exit 1
+  if [ "$#" -eq 1 ]; then exec "$1"; fi
+  # Args are: /bin/sh -c SCRIPT sh GUEST_WORKDIR GUEST_ENV_FILE ARGS...
+  SCRIPT="$3"
+  HOST_WORKSPACE="$(cat "$STATE_DIR/workspace")"
+  HOST_WORKDIR="$HOST_WORKSPACE${5#"/Volumes/My Shared Files/workspace"}"
+  HOST_ENV_FILE="$HOST_WORKSPACE${6#"/Volumes/My Shared Files/workspace"}"
+  shift 6
+  exec /bin/sh -c "$SCRIPT" sh "$HOST_WORKDIR" "$HOST_ENV_FILE" "$@"
+  ;;
+esac
+`
+
+func setupFakeTart(t *testing.T) (env *testenv.TestEnv, stateDir string) {
+	stateDir = testfs.MakeTempDir(t)
+	testfs.WriteAllFileContents(t, stateDir, map[string]string{
+		"tart": fmt.Sprintf(fakeTartScript, stateDir, testImage),
+	})
+	testfs.MakeExecutable(t, stateDir, "tart")
+	flags.Set(t, "executor.macvm.tart_binary", filepath.Join(stateDir, "tart"))
+	env = testenv.GetTestEnv(t)
+	env.SetCommandRunner(&commandutil.CommandRunner{})
+	return env, stateDir
+}
+
+func tartLog(t *testing.T, stateDir string) []string {
+	return strings.Split(strings.TrimSpace(testfs.ReadFileAsString(t, stateDir, "tart.log")), "\n")
+}
+
+func newContainer(t *testing.T, env *testenv.TestEnv) container.CommandContainer {
+	provider, err := macvm.NewProvider(env)
+	require.NoError(t, err)
+	task := &repb.ScheduledTask{SchedulingMetadata: &scpb.SchedulingMetadata{
+		TaskSize: &scpb.TaskSize{EstimatedMilliCpu: 2500, EstimatedMemoryBytes: 8e9},
+	}}
+	c, err := provider.New(context.Background(), &container.Init{
+		Task:  task,
+		Props: &platform.Properties{ContainerImage: testImage},
+	})
+	require.NoError(t, err)
+	return c
+}
+
+func TestNewProvider_DeletesOrphanedVMs(t *testing.T) {
+	env, stateDir := setupFakeTart(t)
+
+	_, err := macvm.NewProvider(env)
+	require.NoError(t, err)
+
+	log := tartLog(t, stateDir)
+	assert.Contains(t, log, "delete buildbuddy-macvm-orphan")
+	assert.NotContains(t, log, "delete my-vm")
+}
+
+func TestIsImageCached(t *testing.T) {
+	env, _ := setupFakeTart(t)
+	provider, err := macvm.NewProvider(env)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	c := newContainer(t, env)
+	cached, err := c.IsImageCached(ctx)
+	require.NoError(t, err)
+	assert.True(t, cached)
+
+	c, err = provider.New(ctx, &container.Init{Props: &platform.Properties{ContainerImage: "ghcr.io/cirruslabs/macos-sonoma-base:latest"}})
+	require.NoError(t, err)
+	cached, err = c.IsImageCached(ctx)
+	require.NoError(t, err)
+	assert.False(t, cached)
+}
+
+func TestCreateExecRemove(t *testing.T) {
+	env, stateDir := setupFakeTart(t)
+	ctx := context.Background()
+	workDir := testfs.MakeTempDir(t)
+	testfs.WriteAllFileContents(t, workDir, map[string]string{
+		"pkg/world.txt": "world",
+	})
+	c := newContainer(t, env)
+
+	err := c.Create(ctx, workDir)
+	require.NoError(t, err)
+
+	cmd := &repb.Command{
+		Arguments: []string{"sh", "-c", `printf "$GREETING $(cat world.txt) $SECRET"`},
+		EnvironmentVariables: []*repb.Command_EnvironmentVariable{
+			{Name: "GREETING", Value: "hello"},
+			{Name: "SECRET", Value: "it's a secret"},
+		},
+		WorkingDirectory: "pkg",
+	}
+	res := c.Exec(ctx, cmd, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	assert.Equal(t, 0, res.ExitCode)
+	assert.Equal(t, "hello world it's a secret", string(res.Stdout))
+	// The environment isn't passed as arguments, and the file containing it
+	// is removed.
+	assert.NotContains(t, testfs.ReadFileAsString(t, stateDir, "tart.log"), "secret")
+	testfs.AssertExactFileContents(t, workDir, map[string]string{"pkg/world.txt": "world"})
+
+	res = c.Exec(ctx, &repb.Command{Arguments: []string{"sh", "-c", "exit 3"}}, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	assert.Equal(t, 3, res.ExitCode)
+
+	err = c.Remove(ctx)
+	require.NoError(t, err)
+
+	log := tartLog(t, stateDir)
+	var vmName string
+	for _, line := range log {
+		if name, ok := strings.CutPrefix(line, "clone "+testImage+" "); ok {
+			vmName = name
+		}
+	}
+	require.NotEmpty(t, vmName)
+	// The VM is sized according to the task, with CPUs rounded up.
+	assert.Contains(t, log, "set --cpu 3 --memory 8000 "+vmName)
+	assert.Contains(t, log, "run --no-graphics --no-audio --dir=workspace:"+workDir+" "+vmName)
+	assert.Contains(t, log, "stop --timeout 10 "+vmName)
+	assert.Equal(t, "delete "+vmName, log[len(log)-1])
+}
+
+func TestRun(t *testing.T) {
+	env, stateDir := setupFakeTart(t)
+	ctx := context.Background()
+	workDir := testfs.MakeTempDir(t)
+	c := newContainer(t, env)
+
+	res := c.Run(ctx, &repb.Command{Arguments: []string{"sh", "-c", "echo hello > out.txt"}}, workDir, oci.Credentials{})
+	require.NoError(t, res.Error)
+	assert.Equal(t, 0, res.ExitCode)
+	assert.Equal(t, "hello\n", testfs.ReadFileAsString(t, workDir, "out.txt"))
+
+	// The VM is deleted after running the command.
+	log := tartLog(t, stateDir)
+	assert.True(t, strings.HasPrefix(log[len(log)-1], "delete buildbuddy-macvm-"), "last tart command should delete the VM, got %q", log[len(log)-1])
+}
@@ -0,0 +1,121 @@
+package ociruntime
+
+import (
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/buildbuddy-io/buildbuddy/server/resources"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"golang.org/x/sys/unix"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const (
+	nvidiaVisibleDevicesEnvVar     = "NVIDIA_VISIBLE_DEVICES"
+	nvidiaDriverCapabilitiesEnvVar = "NVIDIA_DRIVER_CAPABILITIES"
+	// Driver capabilities mounted by the nvidia-container-toolkit hook unless
+	// the command requests others.
+	defaultNvidiaDriverCapabilities = "compute,utility"
+)
+
+var (
+	// Device nodes shared by all NVIDIA GPUs, which are mounted in
+	// containers assigned any GPU, if they exist on the host.
+	nvidiaControlDevices = []string{
+		"/dev/nvidiactl",
+		"/dev/nvidia-uvm",
+		"/dev/nvidia-uvm-tools",
+		"/dev/nvidia-modeset",
+	}
+)
+
+// gpuPool assigns the executor's GPUs to containers, so that each GPU is used
+// by at most one container at a time.
+type gpuPool struct {
+	mu   sync.Mutex // PROTECTS(free)
+	free []resources.GPU
+}
+
+func newGPUPool(gpus []resources.GPU) *gpuPool {
+	return &gpuPool{free: append([]resources.GPU{}, gpus...)}
+}
+
+// Get takes n GPUs from the pool. The scheduler doesn't assign tasks
+// requesting more GPUs than are free, so running out of GPUs is unexpected.
+func (p *gpuPool) Get(n int) ([]resources.GPU, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n > len(p.free) {
+		return nil, status.ResourceExhaustedErrorf("requested %d GPUs, but only %d are available", n, len(p.free))
+	}
+	gpus := p.free[:n:n]
+	p.free = p.free[n:]
+	return gpus, nil
+}
+
+// Put returns GPUs taken with Get to the pool.
+func (p *gpuPool) Put(gpus []resources.GPU) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.free = append(p.free, gpus...)
+}
+
+// gpuDevices returns the device nodes that give a container access to the
+// given GPUs, along with the device cgroup rules allowing their use.
+func gpuDevices(gpus []resources.GPU) ([]specs.LinuxDevice, []specs.LinuxDeviceCgroup, error) {
+	paths := make([]string, 0, len(gpus)+len(nvidiaControlDevices))
+	for _, gpu := range gpus {
+		paths = append(paths, gpu.DevicePath())
+	}
+	for _, path := range nvidiaControlDevices {
+		if _, err := os.Stat(path); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	devices := make([]specs.LinuxDevice, 0, len(paths))
+	rules := make([]specs.LinuxDeviceCgroup, 0, len(paths))
+	for _, path := range paths {
+		st := &unix.Stat_t{}
+		if err := unix.Stat(path, st); err != nil {
+			return nil, nil, status.UnavailableErrorf("stat GPU device: %s", err)
+		}
+		major, minor := int64(unix.Major(st.Rdev)), int64(unix.Minor(st.Rdev))
+		devices = append(devices, specs.LinuxDevice{
+			Path:     path,
+			Type:     "c",
+			Major:    major,
+			Minor:    minor,
+			FileMode: pointer(os.FileMode(st.Mode & 0777)),
+			UID:      pointer(st.Uid),
+			GID:      pointer(st.Gid),
+		})
+		rules = append(rules, specs.LinuxDeviceCgroup{
+			Allow:  true,
+			Type:   "c",
+			Major:  pointer(major),
+			Minor:  pointer(minor),
+			Access: "rwm",
+		})
+	}
+	return devices, rules, nil
+}
+
+// withGPUEnv returns the given container env with the variables read by the
+// nvidia-container-toolkit hook. The visible devices always reflect the GPUs
+// assigned to the container, so that commands can't request other GPUs.
+func withGPUEnv(env []string, gpus []resources.GPU) []string {
+	uuids := make([]string, 0, len(gpus))
+	for _, gpu := range gpus {
+		uuids = append(uuids, gpu.UUID)
+	}
+	out := make([]string, 0, len(env)+2)
+	out = append(out, nvidiaDriverCapabilitiesEnvVar+"="+defaultNvidiaDriverCapabilities)
+	for _, e := range env {
+		if !strings.HasPrefix(e, nvidiaVisibleDevicesEnvVar+"=") {
+			out = append(out, e)
+		}
+	}
+	return append(out, nvidiaVisibleDevicesEnvVar+"="+strings.Join(uuids, ","))
+}
@@ -0,0 +1,47 @@
+package ociruntime
+
+import (
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/resources"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGPUPool(t *testing.T) {
+	gpu0 := resources.GPU{PCIAddress: "0000:3b:00.0", UUID: "GPU-0", Minor: 0}
+	gpu1 := resources.GPU{PCIAddress: "0000:af:00.0", UUID: "GPU-1", Minor: 1}
+	p := newGPUPool([]resources.GPU{gpu0, gpu1})
+
+	a, err := p.Get(1)
+	require.NoError(t, err)
+	require.Equal(t, []resources.GPU{gpu0}, a)
+	// GPUs can't be assigned to two containers at once.
+	_, err = p.Get(2)
+	require.Error(t, err)
+	b, err := p.Get(1)
+	require.NoError(t, err)
+	require.Equal(t, []resources.GPU{gpu1}, b)
+
+	// Returning GPUs to the pool shouldn't affect other assigned GPUs.
+	p.Put(a)
+	require.Equal(t, []resources.GPU{gpu1}, b)
+	p.Put(b)
+	all, err := p.Get(2)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []resources.GPU{gpu0, gpu1}, all)
+}
+
+func TestWithGPUEnv(t *testing.T) {
+	gpus := []resources.GPU{
+		{PCIAddress: "0000:3b:00.0", UUID: "GPU-0", Minor: 0},
+		{PCIAddress: "0000:af:00.0", UUID: "GPU-1", Minor: 1},
+	}
+	// Commands can request other driver capabilities, but not other GPUs.
+	env := withGPUEnv([]string{"PATH=/bin", "NVIDIA_VISIBLE_DEVICES=all", "NVIDIA_DRIVER_CAPABILITIES=all"}, gpus)
+	require.Equal(t, []string{
+		"NVIDIA_DRIVER_CAPABILITIES=compute,utility",
+		"PATH=/bin",
+		"NVIDIA_DRIVER_CAPABILITIES=all",
+		"NVIDIA_VISIBLE_DEVICES=GPU-0,GPU-1",
+	}, env)
+}
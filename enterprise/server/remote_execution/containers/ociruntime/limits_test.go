@@ -0,0 +1,71 @@
+package ociruntime
+
+import (
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/cgroup"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/assert"
+
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+)
+
+func TestTaskResourceLimits_IO(t *testing.T) {
+	flags.Set(t, "executor.oci.enforce_task_size", true)
+	flags.Set(t, "executor.oci.io_limit_device", "259:0")
+	size := &scpb.TaskSize{EstimatedMilliCpu: 2000}
+	for _, tc := range []struct {
+		name                      string
+		readBPSPerCU              int64
+		writeBPSPerCU             int64
+		diskBandwidth             int64
+		wantReadBPS, wantWriteBPS int64
+	}{
+		{
+			name:          "compute unit limits",
+			readBPSPerCU:  100e6,
+			writeBPSPerCU: 50e6,
+			wantReadBPS:   200e6,
+			wantWriteBPS:  100e6,
+		},
+		{
+			name:          "lower disk bandwidth",
+			readBPSPerCU:  100e6,
+			writeBPSPerCU: 50e6,
+			diskBandwidth: 10e6,
+			wantReadBPS:   10e6,
+			wantWriteBPS:  10e6,
+		},
+		{
+			name:          "disk bandwidth can't exceed compute unit limits",
+			readBPSPerCU:  100e6,
+			writeBPSPerCU: 50e6,
+			diskBandwidth: 150e6,
+			wantReadBPS:   150e6,
+			wantWriteBPS:  100e6,
+		},
+		{
+			name:          "disk bandwidth without compute unit limits",
+			diskBandwidth: 150e6,
+			wantReadBPS:   150e6,
+			wantWriteBPS:  150e6,
+		},
+		{
+			name: "unlimited",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			flags.Set(t, "executor.oci.io_read_bps_per_compute_unit", tc.readBPSPerCU)
+			flags.Set(t, "executor.oci.io_write_bps_per_compute_unit", tc.writeBPSPerCU)
+
+			limits := taskResourceLimits(size, &platform.Properties{EstimatedDiskBandwidth: tc.diskBandwidth})
+
+			assert.Equal(t, &cgroup.IOLimit{
+				Device:   "259:0",
+				ReadBPS:  tc.wantReadBPS,
+				WriteBPS: tc.wantWriteBPS,
+			}, limits.IO)
+		})
+	}
+}
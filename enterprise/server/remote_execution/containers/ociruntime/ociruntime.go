@@ -25,9 +25,13 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/cgroup"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/commandutil"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/container"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/estargzfs"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/tasksize"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/oci"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/resources"
 	"github.com/buildbuddy-io/buildbuddy/server/util/disk"
 	"github.com/buildbuddy-io/buildbuddy/server/util/hash"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
@@ -38,8 +42,12 @@ import (
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/sys/unix"
 
+	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+	ctrname "github.com/google/go-containerregistry/pkg/name"
 	ctr "github.com/google/go-containerregistry/pkg/v1"
+	digest "github.com/opencontainers/go-digest"
 	specs "github.com/opencontainers/runtime-spec/specs-go"
 )
 
@@ -51,6 +59,16 @@ var (
 	cpuLimit       = flag.Int("executor.oci.cpu_limit", 0, "Hard limit for CPU resources, expressed as CPU count. Default (0) is no limit.")
 	dns            = flag.String("executor.oci.dns", "8.8.8.8", "Specifies a custom DNS server for use inside OCI containers. If set to the empty string, mount /etc/resolv.conf from the host.")
 	netPoolSize    = flag.Int("executor.oci.network_pool_size", 0, "Limit on the number of networks to be reused between containers. Setting to 0 disables pooling. Setting to -1 uses the recommended default.")
+	nvidiaHook     = flag.String("executor.oci.nvidia_container_runtime_hook", "nvidia-container-runtime-hook", "Path of the nvidia-container-toolkit OCI hook, which mounts the NVIDIA driver libraries in containers assigned GPUs (see executor.gpus). If the hook isn't found, containers only get the GPU device nodes, so images must provide driver libraries matching the host's driver.")
+	lazyPulling    = flag.Bool("executor.oci.lazy_image_pulling", false, "If true, eStargz image layers are mounted with FUSE and their files are fetched from the registry on demand, so that containers can start before the image is fully downloaded. Each layer is still downloaded in full in the background. Other layers are pulled as usual.")
+
+	enforceTaskSize          = flag.Bool("executor.oci.enforce_task_size", false, "If true, each container's cgroup is limited according to the estimated size of its task: memory.max is set from the estimated memory (see executor.oci.memory_limit_factor), cpu.weight from the estimated CPU, and io.max from the estimated disk bandwidth or compute units (see executor.oci.io_limit_device). Requires cgroup v2.")
+	memoryLimitFactor        = flag.Float64("executor.oci.memory_limit_factor", 2, "If executor.oci.enforce_task_size is set, containers are limited to this multiple of their task's estimated memory usage. Tasks that exceed the limit are OOM-killed.")
+	ioLimitDevice            = flag.String("executor.oci.io_limit_device", "", "If executor.oci.enforce_task_size is set, the block device whose bandwidth is limited, as MAJOR:MINOR (see lsblk). This should be the device backing the executor's root directory. Tasks that set the EstimatedDiskBandwidth platform property are limited to that many bytes per second of reads and of writes, unless the per-compute-unit limits are lower.")
+	ioReadBPSPerComputeUnit  = flag.Int64("executor.oci.io_read_bps_per_compute_unit", 0, "If executor.oci.io_limit_device is set, the read bandwidth, in bytes per second, allowed for each estimated compute unit of a task. 0 means unlimited.")
+	ioWriteBPSPerComputeUnit = flag.Int64("executor.oci.io_write_bps_per_compute_unit", 0, "If executor.oci.io_limit_device is set, the write bandwidth, in bytes per second, allowed for each estimated compute unit of a task. 0 means unlimited.")
+	cpuPolicy                = flag.String("executor.oci.cpu_policy", cpuPolicyShares, "If executor.oci.enforce_task_size is set, how containers are limited to their task's estimated CPU. 'shares' only sets cpu.weight, so containers can use idle CPU without limit. 'hard' also sets cpu.max, so containers can never use more than their estimate. 'burst' lets containers use idle CPU while they have burst credit (see executor.oci.cpu_burst_credit), and limits them to their estimate with cpu.max once the credit runs out.")
+	cpuBurstCredit           = flag.Duration("executor.oci.cpu_burst_credit", 30*time.Second, "If executor.oci.cpu_policy is 'burst', the maximum CPU time that a task may use above its estimated CPU before it's limited to its estimate. Tasks earn credit while using less than their estimate.")
 )
 
 const (
@@ -67,6 +85,16 @@ const (
 	// backwards-compatible changes to image cache storage, and older version
 	// directories can be cleaned up.
 	imageCacheVersion = "v1" // TODO: add automatic cleanup if this is bumped.
+
+	// Image cache subdirectories holding lazily pulled layers: the layer
+	// mount points, and the layer blobs downloaded in the background.
+	lazyLayersDir = "lazy"
+	layerBlobsDir = "blobs"
+
+	// Values of executor.oci.cpu_policy.
+	cpuPolicyShares = "shares"
+	cpuPolicyHard   = "hard"
+	cpuPolicyBurst  = "burst"
 )
 
 //go:embed seccomp.json
@@ -132,6 +160,11 @@ type provider struct {
 	runtime string
 
 	networkPool *networking.ContainerNetworkPool
+
+	// GPUs that may be assigned to containers, and the resolved path of the
+	// nvidia-container-toolkit hook, or "" if it wasn't found.
+	gpuPool        *gpuPool
+	nvidiaHookPath string
 }
 
 func NewProvider(env environment.Env, buildRoot string) (*provider, error) {
@@ -154,6 +187,18 @@ func NewProvider(env environment.Env, buildRoot string) (*provider, error) {
 		return nil, status.FailedPreconditionError("could not find a usable container runtime in PATH")
 	}
 
+	if *enforceTaskSize {
+		// The task size limits are set using cgroup v2 interface files.
+		if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err != nil {
+			return nil, status.FailedPreconditionErrorf("executor.oci.enforce_task_size requires cgroup v2: %s", err)
+		}
+		switch *cpuPolicy {
+		case cpuPolicyShares, cpuPolicyHard, cpuPolicyBurst:
+		default:
+			return nil, status.InvalidArgumentErrorf("invalid executor.oci.cpu_policy %q", *cpuPolicy)
+		}
+	}
+
 	// TODO: make these root dirs configurable via flag
 	containersRoot := filepath.Join(buildRoot, "executor", "oci", "run")
 	if err := os.MkdirAll(containersRoot, 0755); err != nil {
@@ -166,11 +211,29 @@ func NewProvider(env environment.Env, buildRoot string) (*provider, error) {
 	if err := os.MkdirAll(filepath.Join(imgRoot, imageCacheVersion), 0755); err != nil {
 		return nil, err
 	}
+	if *lazyPulling {
+		// Lazily pulled layers are served by this process, so any mounts
+		// left over from a previous executor no longer work.
+		if err := estargzfs.CleanStaleMounts(filepath.Join(imgRoot, imageCacheVersion, lazyLayersDir)); err != nil {
+			return nil, status.UnavailableErrorf("clean stale lazy layer mounts: %s", err)
+		}
+	}
 	imageStore := NewImageStore(imgRoot)
+	env.GetHealthChecker().RegisterShutdownFunction(imageStore.Shutdown)
 
 	networkPool := networking.NewContainerNetworkPool(*netPoolSize)
 	env.GetHealthChecker().RegisterShutdownFunction(networkPool.Shutdown)
 
+	gpus := resources.GetAllocatedGPUs()
+	nvidiaHookPath := ""
+	if len(gpus) > 0 {
+		if path, err := exec.LookPath(*nvidiaHook); err == nil {
+			nvidiaHookPath = path
+		} else {
+			log.Warningf("nvidia-container-toolkit hook %q not found (%s); containers assigned GPUs will only get GPU device nodes", *nvidiaHook, err)
+		}
+	}
+
 	return &provider{
 		env:            env,
 		runtime:        rt,
@@ -179,6 +242,8 @@ func NewProvider(env environment.Env, buildRoot string) (*provider, error) {
 		imageCacheRoot: imgRoot,
 		imageStore:     imageStore,
 		networkPool:    networkPool,
+		gpuPool:        newGPUPool(gpus),
+		nvidiaHookPath: nvidiaHookPath,
 	}, nil
 }
 
@@ -191,14 +256,100 @@ func (p *provider) New(ctx context.Context, args *container.Init) (container.Com
 		imageCacheRoot: p.imageCacheRoot,
 		imageStore:     p.imageStore,
 		networkPool:    p.networkPool,
-
-		imageRef:       args.Props.ContainerImage,
-		networkEnabled: args.Props.DockerNetwork != "off",
-		user:           args.Props.DockerUser,
-		forceRoot:      args.Props.DockerForceRoot,
+		gpuPool:        p.gpuPool,
+		nvidiaHookPath: p.nvidiaHookPath,
+
+		imageRef:               args.Props.ContainerImage,
+		networkPolicy:          networkPolicy(args.Props),
+		requestedNetworkPolicy: args.Props.NetworkPolicy,
+		user:                   args.Props.DockerUser,
+		forceRoot:              args.Props.DockerForceRoot,
+		resourceLimits:         taskResourceLimits(args.Task.GetSchedulingMetadata().GetTaskSize(), args.Props),
+		cpuBurst:               taskCPUBurstCredit(args.Task.GetSchedulingMetadata().GetTaskSize()),
+		gpuCount:               args.Props.GPUs,
 	}, nil
 }
 
+// taskResourceLimits returns the cgroup limits for a container running a task
+// of the given size and platform properties, or nil if task sizes aren't
+// enforced.
+//
+// Containers are limited according to the task they're created for. Recycled
+// containers are only reused for tasks with the same platform properties, so
+// later tasks usually have a similar size.
+func taskResourceLimits(size *scpb.TaskSize, props *platform.Properties) *cgroup.Limits {
+	if !*enforceTaskSize {
+		return nil
+	}
+	limits := &cgroup.Limits{
+		MemoryMaxBytes: int64(float64(size.GetEstimatedMemoryBytes()) * *memoryLimitFactor),
+		// 1 CPU gets the default weight of 100.
+		CPUWeight: size.GetEstimatedMilliCpu() / 10,
+	}
+	if *cpuPolicy == cpuPolicyHard {
+		limits.CPUMaxMilliCPU = size.GetEstimatedMilliCpu()
+		if *cpuLimit > 0 {
+			limits.CPUMaxMilliCPU = min(limits.CPUMaxMilliCPU, int64(*cpuLimit)*1000)
+		}
+	}
+	if *ioLimitDevice != "" {
+		computeUnits := float64(size.GetEstimatedMilliCpu()) / tasksize.ComputeUnitsToMilliCPU
+		limits.IO = &cgroup.IOLimit{
+			Device:   *ioLimitDevice,
+			ReadBPS:  int64(computeUnits * float64(*ioReadBPSPerComputeUnit)),
+			WriteBPS: int64(computeUnits * float64(*ioWriteBPSPerComputeUnit)),
+		}
+		// Tasks can ask for less bandwidth than the configured limits, but
+		// not more.
+		if bw := props.EstimatedDiskBandwidth; bw > 0 {
+			limits.IO.ReadBPS = minLimit(limits.IO.ReadBPS, bw)
+			limits.IO.WriteBPS = minLimit(limits.IO.WriteBPS, bw)
+		}
+	}
+	return limits
+}
+
+// minLimit returns the lower of two limits, where 0 means unlimited.
+func minLimit(a, b int64) int64 {
+	if a <= 0 {
+		return b
+	}
+	if b <= 0 {
+		return a
+	}
+	return min(a, b)
+}
+
+// taskCPUBurstCredit returns the burst credit tracker for a container running
+// a task of the given size, or nil if the burst CPU policy isn't enabled.
+func taskCPUBurstCredit(size *scpb.TaskSize) *cgroup.CPUBurstCredit {
+	if !*enforceTaskSize || *cpuPolicy != cpuPolicyBurst || size.GetEstimatedMilliCpu() <= 0 {
+		return nil
+	}
+	return cgroup.NewCPUBurstCredit(size.GetEstimatedMilliCpu(), *cpuBurstCredit)
+}
+
+// unlimitedCPUMaxMilliCPU returns the cpu.max limit of containers that aren't
+// limited to their task's estimated CPU, in milliCPU. 0 means unlimited.
+func unlimitedCPUMaxMilliCPU() int64 {
+	return int64(*cpuLimit) * 1000
+}
+
+func networkPolicy(props *platform.Properties) networking.NetworkPolicy {
+	switch props.NetworkPolicy {
+	case platform.NoNetworkPolicy:
+		return networking.NoNetwork
+	case platform.InternalOnlyNetworkPolicy:
+		return networking.InternalNetwork
+	case platform.FullNetworkPolicy:
+		return networking.FullNetwork
+	}
+	if props.DockerNetwork == "off" {
+		return networking.NoNetwork
+	}
+	return networking.FullNetwork
+}
+
 type ociContainer struct {
 	env environment.Env
 
@@ -215,10 +366,28 @@ type ociContainer struct {
 	networkPool      *networking.ContainerNetworkPool
 	network          *networking.ContainerNetwork
 
-	imageRef       string
-	networkEnabled bool
-	user           string
-	forceRoot      bool
+	imageRef      string
+	networkPolicy networking.NetworkPolicy
+	// The network-policy platform property, if set. The enforced policy is
+	// reported in the action's metadata when it's set.
+	requestedNetworkPolicy string
+	user                   string
+	forceRoot              bool
+	// Limits applied to the container's cgroup, or nil if the container is
+	// not limited.
+	resourceLimits *cgroup.Limits
+	// Burst credit of the current task if the burst CPU policy is enabled,
+	// and whether the container is currently limited to its guaranteed CPU
+	// because the credit ran out.
+	cpuBurst        *cgroup.CPUBurstCredit
+	cpuBurstLimited bool
+
+	gpuPool        *gpuPool
+	nvidiaHookPath string
+	// Number of GPUs requested for the container, and the GPUs assigned to
+	// it while it exists.
+	gpuCount int
+	gpus     []resources.GPU
 }
 
 // Returns the OCI bundle directory for the container.
@@ -262,6 +431,9 @@ func (c *ociContainer) createBundle(ctx context.Context, cmd *repb.Command) erro
 	hostsFileLines := strings.Split(strings.TrimSpace(string(hostsFile)), "\n")
 	if c.network.HostNetwork() != nil {
 		hostsFileLines = append(hostsFileLines, fmt.Sprintf("%s %s", c.network.HostNetwork().NamespacedIP(), c.containerName()))
+		if networking.IPv6Enabled() {
+			hostsFileLines = append(hostsFileLines, fmt.Sprintf("%s %s", c.network.HostNetwork().NamespacedIPv6(), c.containerName()))
+		}
 	} else {
 		hostsFileLines = append(hostsFileLines, fmt.Sprintf("127.0.0.1 %s", c.containerName()))
 	}
@@ -387,6 +559,9 @@ func (c *ociContainer) Create(ctx context.Context, workDir string) error {
 func (c *ociContainer) Exec(ctx context.Context, cmd *repb.Command, stdio *interfaces.Stdio) *interfaces.CommandResult {
 	// Reset CPU usage and peak memory since we're starting a new task.
 	c.stats.Reset()
+	if c.cpuBurst != nil {
+		c.resetCPUBurst(ctx)
+	}
 	args := []string{"exec", "--cwd=" + execrootPath}
 	// Respect command env. Note, when setting any --env vars at all, it
 	// completely overrides the env from the bundle, rather than just adding
@@ -451,6 +626,11 @@ func (c *ociContainer) Remove(ctx context.Context) error {
 		firstErr = status.UnavailableErrorf("cleanup network: %s", err)
 	}
 
+	if c.gpus != nil {
+		c.gpuPool.Put(c.gpus)
+		c.gpus = nil
+	}
+
 	if err := os.RemoveAll(c.bundlePath()); err != nil && firstErr == nil {
 		firstErr = status.UnavailableErrorf("remove bundle: %s", err)
 	}
@@ -459,8 +639,8 @@ func (c *ociContainer) Remove(ctx context.Context) error {
 }
 
 func (c *ociContainer) createNetwork(ctx context.Context) error {
-	// TODO: should we pool loopback-only networks too?
-	if c.networkEnabled {
+	// TODO: should we pool loopback-only and internal-only networks too?
+	if c.networkPolicy == networking.FullNetwork {
 		network := c.networkPool.Get(ctx)
 		if network != nil {
 			c.network = network
@@ -468,8 +648,7 @@ func (c *ociContainer) createNetwork(ctx context.Context) error {
 		}
 	}
 
-	loopbackOnly := !c.networkEnabled
-	network, err := networking.CreateContainerNetwork(ctx, loopbackOnly)
+	network, err := networking.CreateContainerNetwork(ctx, c.networkPolicy)
 	if err != nil {
 		return status.WrapError(err, "create network")
 	}
@@ -485,8 +664,8 @@ func (c *ociContainer) cleanupNetwork(ctx context.Context) error {
 		return nil
 	}
 
-	// Add to the pool but only if this is not a loopback-only network.
-	if c.networkEnabled {
+	// Add to the pool but only if this is a full network.
+	if c.networkPolicy == networking.FullNetwork {
 		if c.networkPool.Add(ctx, n) {
 			return nil
 		}
@@ -501,16 +680,68 @@ func (c *ociContainer) Stats(ctx context.Context) (*repb.UsageStats, error) {
 		return nil, err
 	}
 	c.stats.Update(lifetimeStats)
-	return c.stats.TaskStats(), nil
+	taskStats := c.stats.TaskStats()
+	if c.cpuBurst != nil {
+		c.updateCPUBurst(ctx, lifetimeStats.GetCpuNanos())
+		taskStats.CpuBurst = c.cpuBurst.Stats()
+	}
+	return taskStats, nil
+}
+
+// updateCPUBurst updates the burst credit of the current task from the
+// container's lifetime CPU usage, and limits the container to its guaranteed
+// CPU while it's out of credit.
+func (c *ociContainer) updateCPUBurst(ctx context.Context, cpuNanos int64) {
+	throttledUsec, err := c.cgroupPaths.CPUThrottledUsec(ctx, c.cid)
+	if err != nil {
+		log.CtxWarningf(ctx, "Failed to read CPU throttling stats: %s", err)
+		return
+	}
+	limited := c.cpuBurst.Observe(time.Now(), cpuNanos, throttledUsec*1e3)
+	if limited == c.cpuBurstLimited {
+		return
+	}
+	milliCPU := unlimitedCPUMaxMilliCPU()
+	if limited {
+		milliCPU = c.cpuBurst.GuaranteedMilliCPU()
+	}
+	// If this fails, the limit is retried on the next update.
+	if err := c.cgroupPaths.SetCPUMax(ctx, c.cid, milliCPU); err != nil {
+		log.CtxWarningf(ctx, "Failed to update CPU limit: %s", err)
+		return
+	}
+	c.cpuBurstLimited = limited
+}
+
+// resetCPUBurst starts tracking burst credit for a new task, lifting the CPU
+// limit if the previous task ran out of credit.
+func (c *ociContainer) resetCPUBurst(ctx context.Context) {
+	if c.cpuBurstLimited {
+		if err := c.cgroupPaths.SetCPUMax(ctx, c.cid, unlimitedCPUMaxMilliCPU()); err != nil {
+			log.CtxWarningf(ctx, "Failed to reset CPU limit: %s", err)
+		} else {
+			c.cpuBurstLimited = false
+		}
+	}
+	c.cpuBurst = cgroup.NewCPUBurstCredit(c.cpuBurst.GuaranteedMilliCPU(), *cpuBurstCredit)
 }
 
 // Instruments an OCI runtime call with monitor() to ensure that resource usage
 // metrics are updated while the function is being executed, and that the
 // resource usage results are populated in the returned CommandResult.
 func (c *ociContainer) doWithStatsTracking(ctx context.Context, invokeRuntimeFn func(ctx context.Context) *interfaces.CommandResult) *interfaces.CommandResult {
+	// The network's packet counters aren't reset between tasks, so count
+	// the packets that were blocked while this task ran.
+	blockedPacketsBefore := c.blockedPackets(ctx)
 	stop, statsCh := container.TrackStats(ctx, c)
 	res := invokeRuntimeFn(ctx)
 	stop()
+	if c.requestedNetworkPolicy != "" {
+		res.NetworkPolicyMetadata = &espb.NetworkPolicyMetadata{
+			Policy:         c.requestedNetworkPolicy,
+			BlockedPackets: c.blockedPackets(ctx) - blockedPacketsBefore,
+		}
+	}
 	// statsCh will report stats for processes inside the container, and
 	// res.UsageStats will report stats for the container runtime itself.
 	// Combine these stats to get the total usage.
@@ -528,6 +759,20 @@ func (c *ociContainer) doWithStatsTracking(ctx context.Context, invokeRuntimeFn
 	return res
 }
 
+// blockedPackets returns the number of packets that the container's network
+// has blocked since it was created.
+func (c *ociContainer) blockedPackets(ctx context.Context) int64 {
+	if c.requestedNetworkPolicy == "" || c.network == nil {
+		return 0
+	}
+	n, err := c.network.BlockedPackets(ctx)
+	if err != nil {
+		log.CtxWarningf(ctx, "Could not count packets blocked by the network policy: %s", err)
+		return 0
+	}
+	return n
+}
+
 func (c *ociContainer) createRootfs(ctx context.Context) error {
 	if err := os.MkdirAll(c.rootfsPath(), 0755); err != nil {
 		return fmt.Errorf("create rootfs dir: %w", err)
@@ -555,8 +800,7 @@ func (c *ociContainer) createRootfs(ctx context.Context) error {
 	// but manifest layers are ordered from lowermost to uppermost. So we
 	// iterate in reverse order when building the lowerdir args.
 	for i := len(image.Layers) - 1; i >= 0; i-- {
-		layer := image.Layers[i]
-		path := layerPath(c.imageCacheRoot, layer.DiffID)
+		path := image.Layers[i].path
 		// Skip empty dirs - these can cause conflicts since they will always
 		// have the same digest, and also just add more overhead.
 		// TODO: precompute this
@@ -642,7 +886,9 @@ func (c *ociContainer) createSpec(ctx context.Context, cmd *repb.Command) (*spec
 	}
 
 	cpuSpecs := &specs.LinuxCPU{}
-	if *cpuLimit != 0 {
+	// With the hard CPU policy, cpu.max is set from the task's estimate,
+	// which already accounts for the CPU limit.
+	if *cpuLimit != 0 && (c.resourceLimits == nil || c.resourceLimits.CPUMaxMilliCPU == 0) {
 		period := 100 * time.Millisecond
 		cpuSpecs = &specs.LinuxCPU{
 			Quota:  pointer(int64(*cpuLimit) * period.Microseconds()),
@@ -650,6 +896,34 @@ func (c *ociContainer) createSpec(ctx context.Context, cmd *repb.Command) (*spec
 		}
 	}
 
+	var unified map[string]string
+	if c.resourceLimits != nil {
+		unified = c.resourceLimits.Unified()
+	}
+
+	devices := []specs.LinuxDevice{}
+	var deviceRules []specs.LinuxDeviceCgroup
+	var hooks *specs.Hooks
+	if c.gpuCount > 0 {
+		if c.gpus == nil {
+			gpus, err := c.gpuPool.Get(c.gpuCount)
+			if err != nil {
+				return nil, fmt.Errorf("assign GPUs: %w", err)
+			}
+			c.gpus = gpus
+		}
+		devices, deviceRules, err = gpuDevices(c.gpus)
+		if err != nil {
+			return nil, err
+		}
+		env = withGPUEnv(env, c.gpus)
+		if c.nvidiaHookPath != "" {
+			hooks = &specs.Hooks{
+				Prestart: []specs.Hook{{Path: c.nvidiaHookPath, Args: []string{"nvidia-container-runtime-hook", "prestart"}}},
+			}
+		}
+	}
+
 	spec := specs.Spec{
 		Version: ociVersion,
 		Process: &specs.Process{
@@ -674,6 +948,7 @@ func (c *ociContainer) createSpec(ctx context.Context, cmd *repb.Command) (*spec
 			Readonly: false,
 		},
 		Hostname: c.containerName(),
+		Hooks:    hooks,
 		Mounts: []specs.Mount{
 			{
 				Destination: "/proc",
@@ -768,13 +1043,15 @@ func (c *ociContainer) createSpec(ctx context.Context, cmd *repb.Command) (*spec
 				},
 			},
 			Seccomp: &seccomp,
-			Devices: []specs.LinuxDevice{},
+			Devices: devices,
 			Sysctl: map[string]string{
 				"net.ipv4.ping_group_range": fmt.Sprintf("%d %d", user.GID, user.GID),
 			},
 			Resources: &specs.LinuxResources{
-				Pids: pids,
-				CPU:  cpuSpecs,
+				Pids:    pids,
+				CPU:     cpuSpecs,
+				Unified: unified,
+				Devices: deviceRules,
 			},
 			// TODO: grok MaskedPaths and ReadonlyPaths - just copied from podman.
 			MaskedPaths: []string{
@@ -1033,6 +1310,18 @@ func layerPath(imageCacheRoot string, hash ctr.Hash) string {
 	return filepath.Join(imageCacheRoot, imageCacheVersion, hash.Algorithm, hash.Hex)
 }
 
+// lazyLayerPath returns the path where the lazily pulled image layer with the
+// given hash is mounted.
+func lazyLayerPath(imageCacheRoot string, hash ctr.Hash) string {
+	return filepath.Join(imageCacheRoot, imageCacheVersion, lazyLayersDir, hash.Algorithm, hash.Hex)
+}
+
+// layerBlobPath returns the path where the compressed layer blob with the
+// given digest is stored, for lazily pulled layers.
+func layerBlobPath(imageCacheRoot string, blobDigest ctr.Hash) string {
+	return filepath.Join(imageCacheRoot, imageCacheVersion, layerBlobsDir, blobDigest.Algorithm, blobDigest.Hex)
+}
+
 // ImageStore handles image layer storage for OCI containers.
 type ImageStore struct {
 	layersDir      string
@@ -1041,6 +1330,8 @@ type ImageStore struct {
 
 	mu           sync.RWMutex
 	cachedImages map[string]*Image
+	// Mounted lazily pulled layers, keyed by layer path.
+	lazyLayers map[string]*estargzfs.FS
 }
 
 // Image represents a cached image, including all layer digests and image
@@ -1058,15 +1349,35 @@ type Image struct {
 type ImageLayer struct {
 	// DiffID is the uncompressed image digest.
 	DiffID ctr.Hash
+
+	// path is the directory holding the layer contents. This is either the
+	// extracted layer or, for lazily pulled layers, the layer mount point.
+	path string
 }
 
 func NewImageStore(layersDir string) *ImageStore {
 	return &ImageStore{
 		layersDir:    layersDir,
 		cachedImages: map[string]*Image{},
+		lazyLayers:   map[string]*estargzfs.FS{},
 	}
 }
 
+// Shutdown unmounts all lazily pulled layers.
+func (s *ImageStore) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var lastErr error
+	for path, layerFS := range s.lazyLayers {
+		if err := layerFS.Unmount(ctx); err != nil {
+			log.CtxWarningf(ctx, "Failed to unmount lazily pulled layer: %s", err)
+			lastErr = err
+		}
+		delete(s.lazyLayers, path)
+	}
+	return lastErr
+}
+
 // Pull downloads and extracts image layers to a directory, skipping layers
 // that have already been downloaded, and deduping concurrent downloads for the
 // same layer.
@@ -1116,6 +1427,18 @@ func (s *ImageStore) pull(ctx context.Context, imageName string, creds oci.Crede
 	if err != nil {
 		return nil, status.UnavailableErrorf("get image layers: %s", err)
 	}
+	// Layer descriptors are needed to tell whether layers can be pulled
+	// lazily.
+	var layerDescriptors []ctr.Descriptor
+	if *lazyPulling {
+		manifest, err := img.Manifest()
+		if err != nil {
+			return nil, status.UnavailableErrorf("get image manifest: %s", err)
+		}
+		if len(manifest.Layers) == len(layers) {
+			layerDescriptors = manifest.Layers
+		}
+	}
 
 	resolvedImage := &Image{
 		Layers: make([]*ImageLayer, 0, len(layers)),
@@ -1124,7 +1447,7 @@ func (s *ImageStore) pull(ctx context.Context, imageName string, creds oci.Crede
 	// Download and extract layers concurrently.
 	var eg errgroup.Group
 	eg.SetLimit(min(8, runtime.NumCPU()))
-	for _, layer := range layers {
+	for i, layer := range layers {
 		layer := layer
 		resolvedLayer := &ImageLayer{}
 		resolvedImage.Layers = append(resolvedImage.Layers, resolvedLayer)
@@ -1136,6 +1459,7 @@ func (s *ImageStore) pull(ctx context.Context, imageName string, creds oci.Crede
 			resolvedLayer.DiffID = d
 
 			destDir := layerPath(s.layersDir, d)
+			resolvedLayer.path = destDir
 
 			// If the destination directory already exists then we can skip
 			// the download.
@@ -1147,6 +1471,15 @@ func (s *ImageStore) pull(ctx context.Context, imageName string, creds oci.Crede
 				return nil
 			}
 
+			if layerDescriptors != nil && layerDescriptors[i].Annotations[estargzfs.TOCDigestAnnotation] != "" {
+				path, err := s.mountLazyLayer(ctx, imageName, layerDescriptors[i], d, creds)
+				if err != nil {
+					return err
+				}
+				resolvedLayer.path = path
+				return nil
+			}
+
 			size, err := layer.Size()
 			if err != nil {
 				return status.UnavailableErrorf("get layer size: %s", err)
@@ -1180,6 +1513,60 @@ func (s *ImageStore) pull(ctx context.Context, imageName string, creds oci.Crede
 	return resolvedImage, nil
 }
 
+// mountLazyLayer mounts the eStargz layer with the given descriptor, so that
+// its files are fetched from the registry when they are first read. It
+// returns the layer mount point.
+func (s *ImageStore) mountLazyLayer(ctx context.Context, imageName string, desc ctr.Descriptor, diffID ctr.Hash, creds oci.Credentials) (string, error) {
+	mountPath := lazyLayerPath(s.layersDir, diffID)
+	s.mu.RLock()
+	_, ok := s.lazyLayers[mountPath]
+	s.mu.RUnlock()
+	if ok {
+		return mountPath, nil
+	}
+
+	imageRef, err := ctrname.ParseReference(imageName)
+	if err != nil {
+		return "", status.InvalidArgumentErrorf("invalid image %q", imageName)
+	}
+	tocDigest, err := digest.Parse(desc.Annotations[estargzfs.TOCDigestAnnotation])
+	if err != nil {
+		return "", status.InvalidArgumentErrorf("invalid estargz TOC digest for layer %s: %s", desc.Digest, err)
+	}
+
+	// As with regular layers, dedupe concurrent mounts of the same layer.
+	key := hash.Strings(mountPath, creds.Username, creds.Password)
+	_, _, err = s.layerPullGroup.Do(ctx, key, func(ctx context.Context) (any, error) {
+		s.mu.RLock()
+		_, ok := s.lazyLayers[mountPath]
+		s.mu.RUnlock()
+		if ok {
+			return nil, nil
+		}
+		start := time.Now()
+		// The layer stays mounted after this pull completes, and is read
+		// by later tasks.
+		ctx = context.WithoutCancel(ctx)
+		blob, err := oci.NewRemoteBlob(ctx, imageRef.Context().Digest(desc.Digest.String()), desc.Size, creds)
+		if err != nil {
+			return nil, err
+		}
+		layerFS, err := estargzfs.Mount(ctx, mountPath, blob, digest.Digest(desc.Digest.String()), tocDigest, layerBlobPath(s.layersDir, desc.Digest))
+		if err != nil {
+			return nil, err
+		}
+		log.CtxDebugf(ctx, "Mounted lazily pulled layer %s in %s", diffID.Hex, time.Since(start))
+		s.mu.Lock()
+		s.lazyLayers[mountPath] = layerFS
+		s.mu.Unlock()
+		return nil, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return mountPath, nil
+}
+
 // downloadLayer downloads and extracts the given layer to the given destination
 // dir. The extracted layer is suitable for use as an overlayfs lowerdir.
 func downloadLayer(ctx context.Context, layer ctr.Layer, destDir string) error {
@@ -38,6 +38,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
 	wkpb "github.com/buildbuddy-io/buildbuddy/proto/worker"
 )
 
@@ -194,6 +195,50 @@ func TestCPULimit(t *testing.T) {
 	assert.Equal(t, 0, res.ExitCode)
 }
 
+func TestCPUPolicy_Hard(t *testing.T) {
+	setupNetworking(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+	flags.Set(t, "executor.oci.enforce_task_size", true)
+	flags.Set(t, "executor.oci.cpu_policy", "hard")
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{
+		Task: &repb.ScheduledTask{SchedulingMetadata: &scpb.SchedulingMetadata{
+			TaskSize: &scpb.TaskSize{EstimatedMilliCpu: 1500, EstimatedMemoryBytes: 1e9},
+		}},
+		Props: &platform.Properties{ContainerImage: image},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	// The container is limited to the task's estimated CPU.
+	cmd := &repb.Command{
+		Arguments: []string{"sh", "-c", `
+			cat /sys/fs/cgroup/cpu.max
+		`},
+	}
+	res := c.Run(ctx, cmd, wd, oci.Credentials{})
+	require.NoError(t, res.Error)
+	assert.Equal(t, "150000 100000\n", string(res.Stdout))
+	assert.Empty(t, string(res.Stderr))
+	assert.Equal(t, 0, res.ExitCode)
+}
+
 func TestRunUsageStats(t *testing.T) {
 	setupNetworking(t)
 
@@ -974,7 +1019,7 @@ func TestPersistentWorker(t *testing.T) {
 	}
 
 	// Start worker (Exec)
-	worker := persistentworker.Start(ctx, ws, c, "proto" /*=protocol*/, &repb.Command{
+	worker := persistentworker.Start(ctx, ws, c, "proto" /*=protocol*/, false /*=multiplex*/, &repb.Command{
 		Arguments: []string{"./testworker", "--persistent_worker", "--response_base64", responseBase64},
 	})
 
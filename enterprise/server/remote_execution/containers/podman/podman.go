@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -63,6 +64,8 @@ var (
 	podmanDNS           = flag.String("executor.podman.dns", "8.8.8.8", "Specifies a custom DNS server for podman to use. Defaults to 8.8.8.8. If set to empty, no --dns= flag will be passed to podman.")
 	podmanGPU           = flag.String("executor.podman.gpus", "", "Specifies the value of the --gpus= flag to pass to podman. Set to 'all' to pass all GPUs.")
 	podmanPidsLimit     = flag.String("executor.podman.pids_limit", "", "Specifies the value of the --pids-limit= flag to pass to podman. Set to '-1' for unlimited PIDs. The default is 2048 on systems that support pids cgroup controller.")
+	rootless            = flag.Bool("executor.podman.rootless", false, "Run podman in rootless mode. The executor must run as a non-root user that has subordinate UID and GID ranges in /etc/subuid and /etc/subgid. Resource stats require the cpu and memory cgroup controllers to be delegated to the user.")
+	rootlessNetwork     = flag.String("executor.podman.rootless_network", "", "The network mode for rootless containers that don't set a network, either 'slirp4netns' or 'pasta'. If empty, podman's default is used.")
 
 	// Additional time used to kill the container if the command doesn't exit cleanly
 	containerFinalizationTimeout = 10 * time.Second
@@ -118,6 +121,14 @@ type Provider struct {
 	buildRoot        string
 	sociStore        soci_store.Store
 	imageExistsCache *imageExistsCache
+
+	// Whether containers can't be placed in their own cgroups, because podman
+	// is running rootless and the cpu and memory controllers were not
+	// delegated to the executor user.
+	cgroupsDisabled bool
+	// Whether the pids cgroup controller is unavailable, so that
+	// --pids-limit can't be applied.
+	pidsLimitUnsupported bool
 }
 
 func NewProvider(env environment.Env, buildRoot string) (*Provider, error) {
@@ -140,28 +151,69 @@ func NewProvider(env environment.Env, buildRoot string) (*Provider, error) {
 		return nil, err
 	}
 
+	containersConfDir := "/etc/containers"
+	if *rootless {
+		// Rootless podman reads containers.conf from the user's config dir.
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			return nil, status.UnavailableErrorf("could not determine containers.conf directory: %s", err)
+		}
+		containersConfDir = filepath.Join(configDir, "containers")
+	}
 	if *parallelPulls < 0 {
 		return nil, status.InvalidArgumentErrorf("executor.podman.parallel_pulls must not be negative (was %d)", *parallelPulls)
 	} else if *parallelPulls > 0 {
 		containersConf := fmt.Sprintf(`
 [engine]
 image_parallel_copies = %d`, *parallelPulls)
-		if err := os.MkdirAll("/etc/containers", 0644); err != nil {
+		if err := os.MkdirAll(containersConfDir, 0755); err != nil {
 			return nil, err
 		}
-		if err := os.WriteFile("/etc/containers/containers.conf", []byte(containersConf), 0644); err != nil {
+		if err := os.WriteFile(filepath.Join(containersConfDir, "containers.conf"), []byte(containersConf), 0644); err != nil {
 			return nil, status.UnavailableErrorf("could not write containers.conf: %s", err)
 		}
 	}
 
-	return &Provider{
+	p := &Provider{
 		env:              env,
 		podmanVersion:    podmanVersion,
 		cgroupPaths:      &cgroup.Paths{},
 		sociStore:        sociStore,
 		buildRoot:        buildRoot,
 		imageExistsCache: imageExistsCache,
-	}, nil
+	}
+	if *rootless {
+		if err := p.initRootless(); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// initRootless checks that podman can run rootless, and detects which
+// cgroup controllers are available to rootless containers.
+func (p *Provider) initRootless() error {
+	if os.Getuid() == 0 {
+		return status.FailedPreconditionError("executor.podman.rootless is set, but the executor is running as root")
+	}
+	switch *rootlessNetwork {
+	case "", "slirp4netns", "pasta":
+	default:
+		return status.InvalidArgumentErrorf("invalid executor.podman.rootless_network %q: must be 'slirp4netns' or 'pasta'", *rootlessNetwork)
+	}
+	controllers, err := cgroup.DelegatedControllers()
+	if err != nil {
+		return status.UnavailableErrorf("detect delegated cgroup controllers: %s", err)
+	}
+	if !slices.Contains(controllers, "cpu") || !slices.Contains(controllers, "memory") {
+		log.Warningf("The cpu and memory cgroup controllers are not delegated to the executor user (available controllers: %v). Rootless containers will run without cgroups, and resource usage stats will not be reported.", controllers)
+		p.cgroupsDisabled = true
+	}
+	if *podmanPidsLimit != "" && (p.cgroupsDisabled || !slices.Contains(controllers, "pids")) {
+		log.Warningf("The pids cgroup controller is unavailable to rootless containers, so executor.podman.pids_limit will not be applied.")
+		p.pidsLimitUnsupported = true
+	}
+	return nil
 }
 
 func getPodmanVersion(ctx context.Context, commandRunner interfaces.CommandRunner) (*semver.Version, error) {
@@ -224,7 +276,9 @@ func (p *Provider) New(ctx context.Context, args *container.Init) (container.Com
 			CapAdd:             capAdd,
 			Devices:            devices,
 			Volumes:            volumes,
-			EnableStats:        *podmanEnableStats,
+			EnableStats:        *podmanEnableStats && !p.cgroupsDisabled,
+			DisableCgroups:     p.cgroupsDisabled,
+			DisablePidsLimit:   p.pidsLimitUnsupported,
 		},
 	}, nil
 }
@@ -241,6 +295,13 @@ type PodmanOptions struct {
 	// EnableStats determines whether to enable the stats API. This also enables
 	// resource monitoring while tasks are in progress.
 	EnableStats bool
+	// DisableCgroups runs containers without their own cgroups. This is
+	// needed for rootless containers if cgroup controllers are not delegated
+	// to the executor user.
+	DisableCgroups bool
+	// DisablePidsLimit ignores the configured pids limit, for hosts that
+	// don't support it.
+	DisablePidsLimit bool
 }
 
 // podmanCommandContainer containerizes a single command's execution using a Podman container.
@@ -323,6 +384,9 @@ func (c *podmanCommandContainer) getPodmanRunArgs(workDir string) []string {
 		networkMode = ""
 	default: // ignore other values for now, sticking to the configured default.
 	}
+	if networkMode == "" && *rootless {
+		networkMode = *rootlessNetwork
+	}
 	if networkMode != "" {
 		args = append(args, "--network="+networkMode)
 	}
@@ -340,9 +404,12 @@ func (c *podmanCommandContainer) getPodmanRunArgs(workDir string) []string {
 	if *podmanGPU != "" {
 		args = append(args, "--gpus="+*podmanGPU)
 	}
-	if *podmanPidsLimit != "" {
+	if *podmanPidsLimit != "" && !c.options.DisablePidsLimit {
 		args = append(args, "--pids-limit="+*podmanPidsLimit)
 	}
+	if c.options.DisableCgroups {
+		args = append(args, "--cgroups=disabled")
+	}
 	for _, device := range c.options.Devices {
 		deviceSpecs := make([]string, 0)
 		if device.PathOnHost != "" {
@@ -882,6 +949,11 @@ func ConfigureIsolation(ctx context.Context) error {
 	if !networking.IsSecondaryNetworkEnabled() && !networking.IsPrivateRangeBlackholingEnabled() {
 		return nil
 	}
+	if *rootless {
+		// Rootless containers don't use the podman default network, so host
+		// routing and firewall rules can't be applied to them.
+		return status.FailedPreconditionError("network isolation is not supported with rootless podman")
+	}
 
 	// Run a dummy container so that the podman network gets initialized.
 	// This is to make sure that any iptables rules that we add get added
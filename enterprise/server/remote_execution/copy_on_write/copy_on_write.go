@@ -140,6 +140,12 @@ type COWStore struct {
 	// usageLock protects chunkOperationToUsageSummary
 	usageLock                    sync.Mutex
 	chunkOperationToUsageSummary map[string]usageSummary
+
+	// corruptionLock protects corruptionErr
+	corruptionLock sync.Mutex
+	// The first error encountered when fetching a chunk that failed
+	// validation.
+	corruptionErr error
 }
 
 // NewCOWStore creates a COWStore from the given chunks. The chunks should be
@@ -184,6 +190,10 @@ func NewCOWStore(ctx context.Context, env environment.Env, name string, chunks [
 		chunkOperationToUsageSummary: make(map[string]usageSummary, 0),
 	}
 
+	for _, c := range chunks {
+		c.onFetchError = s.recordFetchError
+	}
+
 	s.eagerFetchEg.Go(func() error {
 		s.eagerFetchChunksInBackground()
 		return nil
@@ -192,6 +202,26 @@ func NewCOWStore(ctx context.Context, env environment.Env, name string, chunks [
 	return s, nil
 }
 
+func (s *COWStore) recordFetchError(err error) {
+	if !status.IsDataLossError(err) {
+		return
+	}
+	s.corruptionLock.Lock()
+	defer s.corruptionLock.Unlock()
+	if s.corruptionErr == nil {
+		s.corruptionErr = err
+	}
+}
+
+// CorruptionError returns a DataLoss error if any chunk fetched by the store
+// failed validation, or nil otherwise. Once a chunk is corrupted, the
+// contents of the store can no longer be trusted.
+func (s *COWStore) CorruptionError() error {
+	s.corruptionLock.Lock()
+	defer s.corruptionLock.Unlock()
+	return s.corruptionErr
+}
+
 // GetRelativeOffsetFromChunkStart returns the relative offset from the
 // beginning of the chunk
 //
@@ -976,6 +1006,9 @@ type Mmap struct {
 	fetched    bool
 	closed     bool
 	lazyDigest *repb.Digest
+
+	// Optional callback invoked when fetching the chunk fails.
+	onFetchError func(error)
 }
 
 // NewLazyMmap returns an mmap that is set up only when the file is read or
@@ -1130,6 +1163,9 @@ func (m *Mmap) fetch(path string) error {
 	}
 	src, err := snaputil.GetArtifact(m.ctx, m.env.GetFileCache(), m.env.GetByteStreamClient(), m.remoteEnabled, m.lazyDigest, m.remoteInstanceName, path)
 	if err != nil {
+		if m.onFetchError != nil {
+			m.onFetchError(err)
+		}
 		return status.WrapErrorf(err, "fetch snapshot chunk for offset %d digest %s", m.Offset, m.lazyDigest.Hash)
 	}
 	m.source = src
@@ -16,6 +16,7 @@ import (
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/copy_on_write"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/copy_on_write/cow_cgo_testutil"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/filecache"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/snaputil"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/metrics"
@@ -26,6 +27,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testmetrics"
 	"github.com/buildbuddy-io/buildbuddy/server/util/disk"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
@@ -263,6 +265,46 @@ func TestCOW_SparseData(t *testing.T) {
 	require.True(t, ioBlocksInDirtyFile == 1 || ioBlocksInDirtyFile == 4, "unexpected number of IO blocks (%d)", ioBlocksInDirtyFile)
 }
 
+func TestCOW_CorruptedChunk(t *testing.T) {
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+	fc, err := filecache.NewFileCache(testfs.MakeTempDir(t), 100_000, false)
+	require.NoError(t, err)
+	env.SetFileCache(fc)
+
+	chunkSizeBytes := backingFileSizeBytes / 2
+	chunks := make([]*copy_on_write.Mmap, 0, 2)
+	for i, content := range [][]byte{randBytes(t, int(chunkSizeBytes)), randBytes(t, int(chunkSizeBytes))} {
+		offset := int64(i) * chunkSizeBytes
+		d, err := digest.Compute(bytes.NewReader(content), repb.DigestFunction_BLAKE3)
+		require.NoError(t, err)
+		if i == 1 {
+			// Cache different contents under the second chunk's digest.
+			content = randBytes(t, int(chunkSizeBytes))
+		}
+		err = fc.AddFile(ctx, &repb.FileNode{Digest: d}, makeTempFile(t, content))
+		require.NoError(t, err)
+		c, err := copy_on_write.NewLazyMmap(ctx, env, testfs.MakeTempDir(t), offset, d, "", false /*=remoteEnabled*/)
+		require.NoError(t, err)
+		chunks = append(chunks, c)
+	}
+	dataDir := testfs.MakeTempDir(t)
+	s, err := copy_on_write.NewCOWStore(ctx, env, "test", chunks, chunkSizeBytes, backingFileSizeBytes, dataDir, "", false /*=remoteEnabled*/)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	// Reading the valid chunk should succeed.
+	_, err = s.ReadAt(make([]byte, chunkSizeBytes), 0)
+	require.NoError(t, err)
+	require.NoError(t, s.CorruptionError())
+
+	// Reading the corrupted chunk should fail, and the store should report
+	// that it's corrupted.
+	_, err = s.ReadAt(make([]byte, chunkSizeBytes), chunkSizeBytes)
+	require.Error(t, err)
+	require.True(t, status.IsDataLossError(s.CorruptionError()), "expected DataLoss, got %v", s.CorruptionError())
+}
+
 func TestCOW_Resize(t *testing.T) {
 	const chunkSize = 2 * 4096
 	ctx := context.Background()
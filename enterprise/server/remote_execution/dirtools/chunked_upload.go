@@ -0,0 +1,473 @@
+package dirtools
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/chunker"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/rpcutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc/codes"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	gstatus "google.golang.org/grpc/status"
+)
+
+const (
+	// The average size of the chunks that large output files are split into.
+	// Chunks are at most 4x this size, so they always fit in a
+	// BatchUpdateBlobs request.
+	averageChunkSizeBytes = 512 * 1024
+
+	// The maximum number of in-flight BatchUpdateBlobs requests per chunked
+	// upload. Once reached, reading the file blocks until a request
+	// completes, which bounds how much of the file is buffered in memory.
+	maxConcurrentChunkBatches = 4
+
+	// How often output files are checked for new data while the command
+	// that writes them is running.
+	outputStreamingInterval = 1 * time.Second
+)
+
+// chunkedUploadsEnabled returns whether output files at least
+// chunkedUploadThresholdBytes large should be uploaded in chunks.
+func chunkedUploadsEnabled(ctx context.Context, env environment.Env) bool {
+	if *chunkedUploadThresholdBytes <= 0 {
+		return false
+	}
+	capabilitiesClient := env.GetCapabilitiesClient()
+	if capabilitiesClient == nil {
+		return false
+	}
+	supported, err := cachetools.SupportsSpliceBlob(ctx, capabilitiesClient)
+	if err != nil {
+		log.CtxWarningf(ctx, "Could not determine whether the cache supports splicing blobs: %s", err)
+	}
+	return supported
+}
+
+// chunkSet is a set of chunks that are known to be in the CAS.
+type chunkSet struct {
+	mu     sync.Mutex
+	chunks map[digest.Key]struct{}
+}
+
+func newChunkSet() *chunkSet {
+	return &chunkSet{chunks: make(map[digest.Key]struct{})}
+}
+
+func (s *chunkSet) contains(dk digest.Key) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.chunks[dk]
+	return ok
+}
+
+func (s *chunkSet) add(digests []*repb.Digest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range digests {
+		s.chunks[digest.NewKey(d)] = struct{}{}
+	}
+}
+
+// chunkedUpload uploads a file to the CAS as a series of content-defined
+// chunks, so that the file only needs to be read once: chunks are uploaded
+// while the rest of the file is read and the file's digest is computed. Once
+// all of the chunks are uploaded, the cache splices them into the file's blob.
+//
+// Chunks that are already in the CAS aren't uploaded again, so outputs that
+// only differ slightly from earlier outputs (such as archives) upload fewer
+// bytes. Neither are chunks that were uploaded by an OutputStreamer while
+// the file was being written.
+type chunkedUpload struct {
+	ctx            context.Context
+	env            environment.Env
+	instanceName   string
+	digestFunction repb.DigestFunction_Value
+
+	// Chunks that are known to be in the CAS. Chunks are added once they are
+	// uploaded.
+	uploadedChunks *chunkSet
+
+	eg    *errgroup.Group
+	egCtx context.Context
+
+	mu        sync.Mutex // protects(chunks, uploaded, batch, batchSize)
+	chunks    []*repb.Digest
+	uploaded  map[digest.Key]struct{}
+	batch     *repb.BatchUpdateBlobsRequest
+	batchSize int64
+
+	done chan error
+}
+
+func newChunkedUpload(ctx context.Context, env environment.Env, instanceName string, digestFunction repb.DigestFunction_Value, uploadedChunks *chunkSet) *chunkedUpload {
+	eg, egCtx := errgroup.WithContext(ctx)
+	eg.SetLimit(maxConcurrentChunkBatches)
+	u := &chunkedUpload{
+		ctx:            ctx,
+		env:            env,
+		instanceName:   instanceName,
+		digestFunction: digestFunction,
+		uploadedChunks: uploadedChunks,
+		eg:             eg,
+		egCtx:          egCtx,
+		uploaded:       make(map[digest.Key]struct{}),
+		done:           make(chan error, 1),
+	}
+	u.resetBatch()
+	return u
+}
+
+// uploadFileInChunks reads the file at fullPath, uploading it to the CAS in
+// chunks, and returns its digest once the file has been read. The upload
+// finishes in the background; call Wait to wait for it. Chunks in
+// uploadedChunks aren't uploaded.
+func uploadFileInChunks(ctx context.Context, env environment.Env, instanceName string, digestFunction repb.DigestFunction_Value, fullPath string, uploadedChunks *chunkSet) (*repb.Digest, *chunkedUpload, error) {
+	if env.GetContentAddressableStorageClient() == nil {
+		return nil, nil, status.FailedPreconditionError("missing CAS client")
+	}
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return nil, nil, status.UnavailableErrorf("open output file: %s", err)
+	}
+	defer f.Close()
+	checksum, err := digest.HashForDigestType(digestFunction)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	u := newChunkedUpload(ctx, env, instanceName, digestFunction, uploadedChunks)
+	c, err := chunker.New(u.egCtx, averageChunkSizeBytes, u.addChunk)
+	if err != nil {
+		return nil, nil, err
+	}
+	n, err := io.Copy(io.MultiWriter(checksum, c), f)
+	if closeErr := c.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// Wait for in-flight requests, so that nothing outlives the call.
+		u.eg.Wait()
+		return nil, nil, err
+	}
+	u.flush()
+
+	d := &repb.Digest{Hash: fmt.Sprintf("%x", checksum.Sum(nil)), SizeBytes: n}
+	go func() {
+		u.done <- u.splice(d)
+	}()
+	return d, u, nil
+}
+
+// Wait waits for the file's chunks to be uploaded and spliced.
+func (u *chunkedUpload) Wait() error {
+	return <-u.done
+}
+
+func (u *chunkedUpload) resetBatch() {
+	u.batch = &repb.BatchUpdateBlobsRequest{
+		InstanceName:   u.instanceName,
+		DigestFunction: u.digestFunction,
+	}
+	u.batchSize = 0
+}
+
+// addChunk is called by the chunker with each chunk of the file, in order.
+func (u *chunkedUpload) addChunk(data []byte) error {
+	// Stop chunking once an upload fails.
+	if err := u.egCtx.Err(); err != nil {
+		return err
+	}
+	d, err := digest.Compute(bytes.NewReader(data), u.digestFunction)
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.chunks = append(u.chunks, d)
+	dk := digest.NewKey(d)
+	if _, ok := u.uploaded[dk]; ok {
+		return nil
+	}
+	u.uploaded[dk] = struct{}{}
+	if u.uploadedChunks.contains(dk) {
+		return nil
+	}
+
+	if u.batchSize+int64(len(data)) > rpcutil.GRPCMaxSizeBytes {
+		u.flushLocked()
+	}
+	// The chunker reuses its buffer for the next chunk.
+	u.batch.Requests = append(u.batch.Requests, &repb.BatchUpdateBlobsRequest_Request{
+		Digest: d,
+		Data:   bytes.Clone(data),
+	})
+	u.batchSize += int64(len(data))
+	return nil
+}
+
+// flush uploads the chunks in the current batch which aren't already in the
+// CAS. It blocks if too many batches are already being uploaded.
+func (u *chunkedUpload) flush() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.flushLocked()
+}
+
+func (u *chunkedUpload) flushLocked() {
+	req := u.batch
+	u.resetBatch()
+	if len(req.GetRequests()) == 0 {
+		return
+	}
+	u.eg.Go(func() error {
+		casClient := u.env.GetContentAddressableStorageClient()
+		findReq := &repb.FindMissingBlobsRequest{
+			InstanceName:   req.GetInstanceName(),
+			DigestFunction: req.GetDigestFunction(),
+		}
+		for _, r := range req.GetRequests() {
+			findReq.BlobDigests = append(findReq.BlobDigests, r.GetDigest())
+		}
+		findRsp, err := casClient.FindMissingBlobs(u.egCtx, findReq)
+		if err != nil {
+			return err
+		}
+		missing := make(map[digest.Key]struct{}, len(findRsp.GetMissingBlobDigests()))
+		for _, d := range findRsp.GetMissingBlobDigests() {
+			missing[digest.NewKey(d)] = struct{}{}
+		}
+		updateReq := &repb.BatchUpdateBlobsRequest{
+			InstanceName:   req.GetInstanceName(),
+			DigestFunction: req.GetDigestFunction(),
+		}
+		for _, r := range req.GetRequests() {
+			if _, ok := missing[digest.NewKey(r.GetDigest())]; ok {
+				updateReq.Requests = append(updateReq.Requests, r)
+			}
+		}
+		if len(updateReq.GetRequests()) > 0 {
+			rsp, err := casClient.BatchUpdateBlobs(u.egCtx, updateReq)
+			if err != nil {
+				return err
+			}
+			for _, r := range rsp.GetResponses() {
+				if r.GetStatus().GetCode() != int32(codes.OK) {
+					return gstatus.ErrorProto(r.GetStatus())
+				}
+			}
+		}
+		u.uploadedChunks.add(findReq.GetBlobDigests())
+		return nil
+	})
+}
+
+// splice waits for all of the chunks to be uploaded, then splices them into
+// the blob with the given digest.
+func (u *chunkedUpload) splice(d *repb.Digest) error {
+	if err := u.eg.Wait(); err != nil {
+		return err
+	}
+	_, err := u.env.GetContentAddressableStorageClient().SpliceBlob(u.ctx, &repb.SpliceBlobRequest{
+		InstanceName:   u.instanceName,
+		BlobDigest:     d,
+		ChunkDigests:   u.chunks,
+		DigestFunction: u.digestFunction,
+	})
+	return err
+}
+
+// OutputStreamer uploads chunks of large output files to the CAS while the
+// command that writes them is still running, so that fewer bytes are left to
+// upload once the command exits.
+//
+// Output files are polled for data appended since the last poll, which is
+// split into chunks in the same way that UploadTree splits the whole file, so
+// UploadTree can skip the chunks that were already uploaded. Files that are
+// replaced or truncated are chunked again from the start. UploadTree still
+// reads and hashes every output file once the command exits, so outputs are
+// correct even if a file is modified in place after it was chunked; the
+// chunks uploaded for the old contents are just wasted.
+type OutputStreamer struct {
+	ctx            context.Context
+	env            environment.Env
+	instanceName   string
+	digestFunction repb.DigestFunction_Value
+	outputPaths    []string
+
+	pollCtx    context.Context
+	cancelPoll context.CancelFunc
+	done       chan struct{}
+	stopOnce   sync.Once
+
+	files          map[string]*streamedFile
+	replacedFiles  []*streamedFile
+	uploadedChunks *chunkSet
+}
+
+type streamedFile struct {
+	info    fs.FileInfo
+	offset  int64
+	upload  *chunkedUpload
+	chunker *chunker.Chunker
+	cancel  context.CancelFunc
+	failed  bool
+}
+
+// StreamOutputs starts uploading chunks of the command's output files under
+// rootDir as they are written. It returns nil if outputs aren't uploaded in
+// chunks. Call Stop once the command exits, then pass the streamer to
+// UploadTree.
+func StreamOutputs(ctx context.Context, env environment.Env, instanceName string, digestFunction repb.DigestFunction_Value, rootDir string, cmd *repb.Command) *OutputStreamer {
+	if !chunkedUploadsEnabled(ctx, env) || env.GetContentAddressableStorageClient() == nil {
+		return nil
+	}
+	outputPaths := cmd.GetOutputPaths()
+	if len(outputPaths) == 0 {
+		outputPaths = append(cmd.GetOutputFiles(), cmd.GetOutputDirectories()...)
+	}
+	pollCtx, cancelPoll := context.WithCancel(ctx)
+	s := &OutputStreamer{
+		ctx:            ctx,
+		env:            env,
+		instanceName:   instanceName,
+		digestFunction: digestFunction,
+		pollCtx:        pollCtx,
+		cancelPoll:     cancelPoll,
+		done:           make(chan struct{}),
+		files:          make(map[string]*streamedFile),
+		uploadedChunks: newChunkSet(),
+	}
+	for _, p := range outputPaths {
+		s.outputPaths = append(s.outputPaths, filepath.Join(rootDir, p))
+	}
+	go s.run()
+	return s
+}
+
+func (s *OutputStreamer) run() {
+	defer close(s.done)
+	t := time.NewTicker(outputStreamingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.pollCtx.Done():
+			return
+		case <-t.C:
+		}
+		s.poll()
+	}
+}
+
+// poll uploads the chunks of output files written since the last poll.
+func (s *OutputStreamer) poll() {
+	for _, outputPath := range s.outputPaths {
+		filepath.WalkDir(outputPath, func(path string, d fs.DirEntry, err error) error {
+			if s.pollCtx.Err() != nil {
+				return filepath.SkipAll
+			}
+			// Output paths that don't exist yet are skipped.
+			if err != nil || !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			s.streamFile(path, info)
+			return nil
+		})
+	}
+	// Upload the chunks found so far, rather than waiting for full batches.
+	for _, f := range s.files {
+		f.upload.flush()
+	}
+}
+
+func (s *OutputStreamer) streamFile(path string, info fs.FileInfo) {
+	f := s.files[path]
+	if f != nil && (!os.SameFile(f.info, info) || info.Size() < f.offset) {
+		// The file was replaced or truncated, so the data chunked so far
+		// isn't part of it anymore.
+		f.stop()
+		s.replacedFiles = append(s.replacedFiles, f)
+		f = nil
+		delete(s.files, path)
+	}
+	if f == nil {
+		if info.Size() < *chunkedUploadThresholdBytes {
+			return
+		}
+		ctx, cancel := context.WithCancel(s.pollCtx)
+		upload := newChunkedUpload(s.ctx, s.env, s.instanceName, s.digestFunction, s.uploadedChunks)
+		c, err := chunker.New(ctx, averageChunkSizeBytes, upload.addChunk)
+		if err != nil {
+			cancel()
+			log.CtxWarningf(s.ctx, "Failed to stream output file %q: %s", path, err)
+			return
+		}
+		f = &streamedFile{info: info, upload: upload, chunker: c, cancel: cancel}
+		s.files[path] = f
+	}
+	if f.failed || info.Size() == f.offset {
+		return
+	}
+	n, err := copyFileRange(f.chunker, path, f.offset, info.Size()-f.offset)
+	f.offset += n
+	if err != nil {
+		// The file is still uploaded once the command exits.
+		log.CtxDebugf(s.ctx, "Stopped streaming output file %q: %s", path, err)
+		f.failed = true
+	}
+}
+
+// copyFileRange copies n bytes of the file at path, starting at offset, to w.
+func copyFileRange(w io.Writer, path string, offset, n int64) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, io.NewSectionReader(f, offset, n))
+}
+
+// stop stops chunking the file, and uploads the chunks found so far.
+func (f *streamedFile) stop() {
+	// Canceling the chunker discards the data that isn't part of a complete
+	// chunk yet, since the rest of the chunk isn't written yet.
+	f.cancel()
+	f.chunker.Close()
+	f.upload.flush()
+}
+
+// Stop stops streaming output files, and waits for the chunks found so far
+// to be uploaded.
+func (s *OutputStreamer) Stop() {
+	s.stopOnce.Do(func() {
+		s.cancelPoll()
+		<-s.done
+		for path, f := range s.files {
+			f.stop()
+			if err := f.upload.eg.Wait(); err != nil {
+				log.CtxDebugf(s.ctx, "Failed to stream output file %q: %s", path, err)
+			}
+		}
+		for _, f := range s.replacedFiles {
+			f.upload.eg.Wait()
+		}
+	})
+}
@@ -32,7 +32,8 @@ import (
 )
 
 var (
-	enableDownloadCompresssion = flag.Bool("cache.client.enable_download_compression", true, "If true, enable compression of downloads from remote caches")
+	enableDownloadCompresssion  = flag.Bool("cache.client.enable_download_compression", true, "If true, enable compression of downloads from remote caches")
+	chunkedUploadThresholdBytes = flag.Int64("cache.client.chunked_upload_threshold_bytes", 0, "If set, output files at least this large are uploaded as chunks that the remote cache then splices into the file. Chunks are uploaded while the action writes the file, and the rest when the action exits. Only used if the remote cache supports splicing blobs. 0 disables chunked uploads.")
 )
 
 func groupIDStringFromContext(ctx context.Context) string {
@@ -241,6 +242,9 @@ type fileToUpload struct {
 	fullPath string
 	digest   *repb.Digest
 	info     os.FileInfo
+
+	// If set, the file is already being uploaded in chunks.
+	chunked *chunkedUpload
 }
 
 func newFileToUpload(digestFunction repb.DigestFunction_Value, fullPath string, info os.FileInfo) (*fileToUpload, error) {
@@ -280,18 +284,43 @@ func uploadFiles(ctx context.Context, uploader *cachetools.BatchCASUploader, fc
 				log.Warningf("Error adding file to filecache: %s", err)
 			}
 		}
-		f, err := os.Open(uploadableFile.fullPath)
-		if err != nil {
-			return status.UnavailableErrorf("open output file: %s", err)
+		if uploadableFile.chunked != nil {
+			continue
 		}
-		// Note: uploader.Upload closes the file after it is uploaded.
-		if err := uploader.Upload(uploadableFile.digest, f); err != nil {
+		if err := uploadFile(uploader, uploadableFile); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+func uploadFile(uploader *cachetools.BatchCASUploader, uploadableFile *fileToUpload) error {
+	f, err := os.Open(uploadableFile.fullPath)
+	if err != nil {
+		return status.UnavailableErrorf("open output file: %s", err)
+	}
+	// Note: uploader.Upload closes the file after it is uploaded.
+	return uploader.Upload(uploadableFile.digest, f)
+}
+
+// waitForChunkedUploads waits for the files that are being uploaded in chunks.
+// If a chunked upload fails, for example because the cache evicted one of
+// the chunks before it could be spliced, the whole file is uploaded instead.
+func waitForChunkedUploads(ctx context.Context, uploader *cachetools.BatchCASUploader, filesToUpload []*fileToUpload) error {
+	for _, uploadableFile := range filesToUpload {
+		if uploadableFile.chunked == nil {
+			continue
+		}
+		if err := uploadableFile.chunked.Wait(); err != nil {
+			log.CtxWarningf(ctx, "Chunked upload of %q failed, uploading the whole file instead: %s", uploadableFile.fullPath, err)
+			if err := uploadFile(uploader, uploadableFile); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // handleSymlink adds the symlink to the directory and actionResult proto so that
 // they could be recreated on the Bazel client side if needed.
 func handleSymlink(dirHelper *DirHelper, rootDir string, cmd *repb.Command, actionResult *repb.ActionResult, directory *repb.Directory, fqfn string) error {
@@ -363,15 +392,43 @@ func handleSymlink(dirHelper *DirHelper, rootDir string, cmd *repb.Command, acti
 	return nil
 }
 
-func UploadTree(ctx context.Context, env environment.Env, dirHelper *DirHelper, instanceName string, digestFunction repb.DigestFunction_Value, rootDir string, cmd *repb.Command, actionResult *repb.ActionResult) (*TransferInfo, error) {
+// UploadTree uploads the command's outputs under rootDir and adds them to
+// actionResult. If streamed is non-nil, it must be stopped; the chunks that
+// it uploaded aren't uploaded again.
+func UploadTree(ctx context.Context, env environment.Env, dirHelper *DirHelper, instanceName string, digestFunction repb.DigestFunction_Value, rootDir string, cmd *repb.Command, actionResult *repb.ActionResult, streamed *OutputStreamer) (*TransferInfo, error) {
 	txInfo := &TransferInfo{}
 	startTime := time.Now()
 	outputDirectoryPaths := make([]string, 0)
 	filesToUpload := make([]*fileToUpload, 0)
 	visitedDirectories := make([]*dirToUpload, 0)
 
+	useChunkedUploads := sync.OnceValue(func() bool {
+		return chunkedUploadsEnabled(ctx, env)
+	})
+	uploadedChunks := newChunkSet()
+	if streamed != nil {
+		uploadedChunks = streamed.uploadedChunks
+	}
+	newUploadableFile := func(fullPath string, info os.FileInfo) (*fileToUpload, error) {
+		if *chunkedUploadThresholdBytes <= 0 || info.Size() < *chunkedUploadThresholdBytes || !useChunkedUploads() {
+			return newFileToUpload(digestFunction, fullPath, info)
+		}
+		// Upload large files while they're being hashed, rather than reading
+		// them once to compute their digest and again to upload them.
+		d, chunked, err := uploadFileInChunks(ctx, env, instanceName, digestFunction, fullPath, uploadedChunks)
+		if err != nil {
+			return nil, err
+		}
+		return &fileToUpload{
+			fullPath: fullPath,
+			digest:   d,
+			info:     info,
+			chunked:  chunked,
+		}, nil
+	}
+
 	visitFile := func(fullPath string, info os.FileInfo) (*repb.FileNode, error) {
-		uploadableFile, err := newFileToUpload(digestFunction, fullPath, info)
+		uploadableFile, err := newUploadableFile(fullPath, info)
 		if err != nil {
 			return nil, err
 		}
@@ -462,6 +519,9 @@ func UploadTree(ctx context.Context, env environment.Env, dirHelper *DirHelper,
 	if err := uploadFiles(ctx, uploader, env.GetFileCache(), filesToUpload); err != nil {
 		return nil, err
 	}
+	if err := waitForChunkedUploads(ctx, uploader, filesToUpload); err != nil {
+		return nil, err
+	}
 
 	// Upload Directory protos.
 	// TODO: skip uploading Directory protos which are not part of any tree?
@@ -689,6 +749,7 @@ func (ff *BatchFileFetcher) linkFromFileCache(filePointers []*FilePointer, opts
 			numFilesLinked++
 			ff.statsMu.Lock()
 			ff.stats.LocalCacheHits++
+			ff.stats.LocalCacheHitSizeBytes += fp.FileNode.GetDigest().GetSizeBytes()
 			ff.statsMu.Unlock()
 		}
 	}
@@ -1,6 +1,7 @@
 package dirtools_test
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io/fs"
@@ -9,11 +10,14 @@ import (
 	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/dirtools"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/filecache"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/byte_stream_server"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/content_addressable_storage_server"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
@@ -22,9 +26,11 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/hash"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
@@ -615,7 +621,7 @@ func TestUploadTree(t *testing.T) {
 			dirHelper := dirtools.NewDirHelper(rootDir, tc.cmd, fs.FileMode(0o755))
 
 			actionResult := &repb.ActionResult{}
-			txInfo, err := dirtools.UploadTree(ctx, env, dirHelper, "", repb.DigestFunction_SHA256, rootDir, tc.cmd, actionResult)
+			txInfo, err := dirtools.UploadTree(ctx, env, dirHelper, "", repb.DigestFunction_SHA256, rootDir, tc.cmd, actionResult, nil /*=streamed*/)
 			require.NoError(t, err)
 
 			assert.Equal(t, tc.expectedInfo.FileCount, txInfo.FileCount)
@@ -673,6 +679,140 @@ func TestUploadTree(t *testing.T) {
 	}
 }
 
+type spliceBlobCapabilitiesClient struct {
+	repb.CapabilitiesClient
+}
+
+func (*spliceBlobCapabilitiesClient) GetCapabilities(ctx context.Context, req *repb.GetCapabilitiesRequest, opts ...grpc.CallOption) (*repb.ServerCapabilities, error) {
+	return &repb.ServerCapabilities{
+		CacheCapabilities: &repb.CacheCapabilities{SpliceBlobSupport: true},
+	}, nil
+}
+
+type spliceCountingCASClient struct {
+	repb.ContentAddressableStorageClient
+	splices       atomic.Int32
+	uploadedBytes atomic.Int64
+	queriedBytes  atomic.Int64
+}
+
+func (c *spliceCountingCASClient) FindMissingBlobs(ctx context.Context, req *repb.FindMissingBlobsRequest, opts ...grpc.CallOption) (*repb.FindMissingBlobsResponse, error) {
+	for _, d := range req.GetBlobDigests() {
+		c.queriedBytes.Add(d.GetSizeBytes())
+	}
+	return c.ContentAddressableStorageClient.FindMissingBlobs(ctx, req, opts...)
+}
+
+func (c *spliceCountingCASClient) BatchUpdateBlobs(ctx context.Context, req *repb.BatchUpdateBlobsRequest, opts ...grpc.CallOption) (*repb.BatchUpdateBlobsResponse, error) {
+	rsp, err := c.ContentAddressableStorageClient.BatchUpdateBlobs(ctx, req, opts...)
+	if err == nil {
+		for _, r := range req.GetRequests() {
+			c.uploadedBytes.Add(int64(len(r.GetData())))
+		}
+	}
+	return rsp, err
+}
+
+func (c *spliceCountingCASClient) SpliceBlob(ctx context.Context, req *repb.SpliceBlobRequest, opts ...grpc.CallOption) (*repb.SpliceBlobResponse, error) {
+	rsp, err := c.ContentAddressableStorageClient.SpliceBlob(ctx, req, opts...)
+	if err == nil {
+		c.splices.Add(1)
+	}
+	return rsp, err
+}
+
+func TestUploadTreeInChunks(t *testing.T) {
+	flags.Set(t, "cache.client.chunked_upload_threshold_bytes", 1024*1024)
+	env, ctx := testEnv(t)
+	env.SetCapabilitiesClient(&spliceBlobCapabilitiesClient{})
+	casClient := &spliceCountingCASClient{ContentAddressableStorageClient: env.GetContentAddressableStorageClient()}
+	env.SetContentAddressableStorageClient(casClient)
+
+	rootDir := testfs.MakeTempDir(t)
+	_, small := testdigest.RandomCASResourceBuf(t, 1000)
+	_, large := testdigest.RandomCASResourceBuf(t, 8*1024*1024)
+	testfs.WriteAllFileContents(t, rootDir, map[string]string{
+		"small.txt":     string(small),
+		"out/large.bin": string(large),
+	})
+	cmd := &repb.Command{OutputPaths: []string{"small.txt", "out"}}
+	dirHelper := dirtools.NewDirHelper(rootDir, cmd, fs.FileMode(0o755))
+
+	actionResult := &repb.ActionResult{}
+	_, err := dirtools.UploadTree(ctx, env, dirHelper, "", repb.DigestFunction_SHA256, rootDir, cmd, actionResult, nil /*=streamed*/)
+	require.NoError(t, err)
+	// Only the large file should have been uploaded in chunks.
+	assert.Equal(t, int32(1), casClient.splices.Load())
+
+	for path, contents := range map[string][]byte{"small.txt": small, "out/large.bin": large} {
+		d, err := digest.Compute(bytes.NewReader(contents), repb.DigestFunction_SHA256)
+		require.NoError(t, err)
+		got, err := env.GetCache().Get(ctx, &rspb.ResourceName{
+			CacheType: rspb.CacheType_CAS,
+			Digest:    d,
+		})
+		require.NoError(t, err, "%s should be in the CAS", path)
+		assert.True(t, bytes.Equal(contents, got), "%s contents should match", path)
+	}
+	require.Len(t, actionResult.GetOutputDirectories(), 1)
+	tree := &repb.Tree{}
+	treeRN := digest.NewResourceName(actionResult.GetOutputDirectories()[0].GetTreeDigest(), "", rspb.CacheType_CAS, repb.DigestFunction_SHA256)
+	err = cachetools.ReadProtoFromCAS(ctx, env.GetCache(), treeRN, tree)
+	require.NoError(t, err)
+	require.Len(t, tree.GetRoot().GetFiles(), 1)
+	assert.Equal(t, int64(len(large)), tree.GetRoot().GetFiles()[0].GetDigest().GetSizeBytes())
+}
+
+func TestStreamOutputs(t *testing.T) {
+	flags.Set(t, "cache.client.chunked_upload_threshold_bytes", 1024*1024)
+	env, ctx := testEnv(t)
+	env.SetCapabilitiesClient(&spliceBlobCapabilitiesClient{})
+	casClient := &spliceCountingCASClient{ContentAddressableStorageClient: env.GetContentAddressableStorageClient()}
+	env.SetContentAddressableStorageClient(casClient)
+
+	rootDir := testfs.MakeTempDir(t)
+	cmd := &repb.Command{OutputPaths: []string{"out"}}
+	dirHelper := dirtools.NewDirHelper(rootDir, cmd, fs.FileMode(0o755))
+	require.NoError(t, dirHelper.CreateOutputDirs())
+	streamer := dirtools.StreamOutputs(ctx, env, "", repb.DigestFunction_SHA256, rootDir, cmd)
+	require.NotNil(t, streamer)
+
+	// Write the first half of the output, and wait for most of it to be
+	// uploaded while the file is still being written.
+	_, large := testdigest.RandomCASResourceBuf(t, 16*1024*1024)
+	require.NoError(t, os.MkdirAll(filepath.Join(rootDir, "out"), 0755))
+	f, err := os.Create(filepath.Join(rootDir, "out", "large.bin"))
+	require.NoError(t, err)
+	_, err = f.Write(large[:len(large)/2])
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return casClient.uploadedBytes.Load() >= 4*1024*1024
+	}, 10*time.Second, 50*time.Millisecond)
+
+	_, err = f.Write(large[len(large)/2:])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	streamer.Stop()
+	queriedBytes := casClient.queriedBytes.Load()
+
+	actionResult := &repb.ActionResult{}
+	_, err = dirtools.UploadTree(ctx, env, dirHelper, "", repb.DigestFunction_SHA256, rootDir, cmd, actionResult, streamer)
+	require.NoError(t, err)
+	// Chunks that were uploaded while the file was written aren't uploaded
+	// again.
+	assert.LessOrEqual(t, casClient.queriedBytes.Load()-queriedBytes, int64(len(large)-4*1024*1024))
+	assert.Equal(t, int32(1), casClient.splices.Load())
+
+	d, err := digest.Compute(bytes.NewReader(large), repb.DigestFunction_SHA256)
+	require.NoError(t, err)
+	got, err := env.GetCache().Get(ctx, &rspb.ResourceName{
+		CacheType: rspb.CacheType_CAS,
+		Digest:    d,
+	})
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(large, got))
+}
+
 func getDigestForMsg(t *testing.T, in proto.Message) *repb.Digest {
 	d, err := digest.ComputeForMessage(in, repb.DigestFunction_SHA256)
 	require.NoError(t, err)
@@ -0,0 +1,267 @@
+// Package doctor runs preflight checks of an executor's host and
+// configuration, so that common setup problems, such as a missing /dev/kvm or
+// an unreachable cache, are reported up front rather than as task failures
+// after the executor is registered.
+package doctor
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/authutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/grpc_client"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/metadata"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	// Timeout for each check.
+	checkTimeout = 30 * time.Second
+
+	// Filecache disks slower than this are reported with a warning, since
+	// actions with many inputs will spend most of their time on disk IO.
+	minDiskThroughputBytesPerSec = 100e6
+)
+
+type Status string
+
+const (
+	StatusOK      Status = "OK"
+	StatusWarning Status = "WARNING"
+	StatusFailed  Status = "FAILED"
+	// StatusSkipped means that the check doesn't apply to the executor's
+	// configuration, such as checking for KVM when firecracker is disabled.
+	StatusSkipped Status = "SKIPPED"
+)
+
+// Result is the result of a single check.
+type Result struct {
+	Name    string `json:"name"`
+	Status  Status `json:"status"`
+	Message string `json:"message"`
+	// DurationUsec is how long the check took.
+	DurationUsec int64 `json:"duration_usec"`
+}
+
+// Report contains the results of all checks, in the order they were run.
+type Report struct {
+	Results []*Result `json:"results"`
+}
+
+// Failed returns whether any check failed. Warnings don't count as failures.
+func (r *Report) Failed() bool {
+	for _, res := range r.Results {
+		if res.Status == StatusFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteText writes the report in a human-readable format, with one line per
+// check.
+func (r *Report) WriteText(w io.Writer) error {
+	counts := map[Status]int{}
+	for _, res := range r.Results {
+		counts[res.Status]++
+		if _, err := fmt.Fprintf(w, "[%-7s] %s: %s\n", res.Status, res.Name, res.Message); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "\n%d checks: %d ok, %d warnings, %d failed, %d skipped\n", len(r.Results), counts[StatusOK], counts[StatusWarning], counts[StatusFailed], counts[StatusSkipped])
+	return err
+}
+
+// WriteJSON writes the report as JSON.
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// Options describes the executor configuration to check.
+type Options struct {
+	// AppTarget and CacheTarget are the gRPC targets of the app and the
+	// cache.
+	AppTarget   string
+	CacheTarget string
+	// APIKey is the executor API key, which is sent with requests to the
+	// cache.
+	APIKey string
+
+	// BuildRoot is the directory containing action workspaces, and
+	// LocalCacheDir is the filecache directory. Files are hardlinked between
+	// them, so they must be on the same device.
+	BuildRoot     string
+	LocalCacheDir string
+	// DiskTestSizeBytes is the amount of data written to measure the
+	// throughput of the filecache disk, or 0 to skip the measurement.
+	DiskTestSizeBytes int64
+
+	// Executor contains the isolation types enabled on the executor, which
+	// determine which host features are required.
+	Executor *platform.ExecutorProperties
+}
+
+type check struct {
+	name string
+	run  func(ctx context.Context, env environment.Env, opts *Options) (Status, string)
+}
+
+// Run runs all checks and returns the report.
+func Run(ctx context.Context, env environment.Env, opts *Options) *Report {
+	checks := platformChecks()
+	checks = append(checks,
+		check{"filecache_hardlink", checkFilecacheHardlink},
+		check{"filecache_disk_throughput", checkDiskThroughput},
+		check{"app_connectivity", checkAppConnectivity},
+		check{"cache_connectivity", checkCacheConnectivity},
+	)
+	return runChecks(ctx, env, opts, checks)
+}
+
+func runChecks(ctx context.Context, env environment.Env, opts *Options, checks []check) *Report {
+	report := &Report{}
+	for _, c := range checks {
+		ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+		start := time.Now()
+		s, msg := c.run(ctx, env, opts)
+		cancel()
+		report.Results = append(report.Results, &Result{
+			Name:         c.name,
+			Status:       s,
+			Message:      msg,
+			DurationUsec: time.Since(start).Microseconds(),
+		})
+	}
+	return report
+}
+
+// checkFilecacheHardlink checks that files in the filecache can be hardlinked
+// into the build root, which fails if they're on different devices.
+func checkFilecacheHardlink(ctx context.Context, env environment.Env, opts *Options) (Status, string) {
+	for _, dir := range []string{opts.LocalCacheDir, opts.BuildRoot} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return StatusFailed, fmt.Sprintf("create %q: %s", dir, err)
+		}
+	}
+	src, err := os.CreateTemp(opts.LocalCacheDir, "doctor-*")
+	if err != nil {
+		return StatusFailed, fmt.Sprintf("create file in filecache dir: %s", err)
+	}
+	src.Close()
+	defer os.Remove(src.Name())
+	dst := filepath.Join(opts.BuildRoot, filepath.Base(src.Name()))
+	if err := os.Link(src.Name(), dst); err != nil {
+		return StatusFailed, fmt.Sprintf("hardlink from filecache dir %q to root directory %q failed: %s. Both directories must be on the same device.", opts.LocalCacheDir, opts.BuildRoot, err)
+	}
+	os.Remove(dst)
+	return StatusOK, fmt.Sprintf("files can be hardlinked from %q to %q", opts.LocalCacheDir, opts.BuildRoot)
+}
+
+// checkDiskThroughput measures the sequential write throughput of the
+// filecache disk, including syncing the data to disk.
+func checkDiskThroughput(ctx context.Context, env environment.Env, opts *Options) (Status, string) {
+	if opts.DiskTestSizeBytes <= 0 {
+		return StatusSkipped, "disk throughput test is disabled"
+	}
+	if err := os.MkdirAll(opts.LocalCacheDir, 0755); err != nil {
+		return StatusFailed, fmt.Sprintf("create %q: %s", opts.LocalCacheDir, err)
+	}
+	f, err := os.CreateTemp(opts.LocalCacheDir, "doctor-*")
+	if err != nil {
+		return StatusFailed, fmt.Sprintf("create file in filecache dir: %s", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// Write random data so that the result isn't skewed by filesystem
+	// compression.
+	buf := make([]byte, 1024*1024)
+	if _, err := rand.Read(buf); err != nil {
+		return StatusFailed, fmt.Sprintf("generate test data: %s", err)
+	}
+	start := time.Now()
+	for written := int64(0); written < opts.DiskTestSizeBytes; {
+		if ctx.Err() != nil {
+			return StatusWarning, fmt.Sprintf("wrote only %d of %d bytes in %s", written, opts.DiskTestSizeBytes, time.Since(start))
+		}
+		n, err := f.Write(buf[:min(int64(len(buf)), opts.DiskTestSizeBytes-written)])
+		if err != nil {
+			return StatusFailed, fmt.Sprintf("write to filecache dir: %s", err)
+		}
+		written += int64(n)
+	}
+	if err := f.Sync(); err != nil {
+		return StatusFailed, fmt.Sprintf("sync file in filecache dir: %s", err)
+	}
+	throughput := float64(opts.DiskTestSizeBytes) / time.Since(start).Seconds()
+	msg := fmt.Sprintf("wrote %d bytes to %q at %.1f MB/s", opts.DiskTestSizeBytes, opts.LocalCacheDir, throughput/1e6)
+	if throughput < minDiskThroughputBytesPerSec {
+		return StatusWarning, msg + fmt.Sprintf(", which is slower than the recommended %.0f MB/s", minDiskThroughputBytesPerSec/1e6)
+	}
+	return StatusOK, msg
+}
+
+func checkAppConnectivity(ctx context.Context, env environment.Env, opts *Options) (Status, string) {
+	conn, err := grpc_client.DialInternalWithoutPooling(env, opts.AppTarget)
+	if err != nil {
+		return StatusFailed, fmt.Sprintf("dial app %q: %s", opts.AppTarget, err)
+	}
+	defer conn.Close()
+	conn.Connect()
+	for {
+		state := conn.GetState()
+		if state == connectivity.Ready {
+			return StatusOK, fmt.Sprintf("connected to app %q", opts.AppTarget)
+		}
+		if !conn.WaitForStateChange(ctx, state) {
+			return StatusFailed, fmt.Sprintf("could not connect to app %q within %s (connection state: %s)", opts.AppTarget, checkTimeout, state)
+		}
+	}
+}
+
+// checkCacheConnectivity checks that the cache is reachable and accepts the
+// executor's API key, by fetching the cache capabilities.
+func checkCacheConnectivity(ctx context.Context, env environment.Env, opts *Options) (Status, string) {
+	conn, err := grpc_client.DialInternalWithoutPooling(env, opts.CacheTarget)
+	if err != nil {
+		return StatusFailed, fmt.Sprintf("dial cache %q: %s", opts.CacheTarget, err)
+	}
+	defer conn.Close()
+	if opts.APIKey != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, authutil.APIKeyHeader, opts.APIKey)
+	}
+	_, err = repb.NewCapabilitiesClient(conn).GetCapabilities(ctx, &repb.GetCapabilitiesRequest{})
+	if status.IsUnauthenticatedError(err) || status.IsPermissionDeniedError(err) {
+		return StatusFailed, fmt.Sprintf("cache %q rejected the executor's API key: %s", opts.CacheTarget, status.Message(err))
+	}
+	if err != nil {
+		return StatusFailed, fmt.Sprintf("get capabilities from cache %q: %s", opts.CacheTarget, err)
+	}
+	return StatusOK, fmt.Sprintf("connected to cache %q", opts.CacheTarget)
+}
+
+// requiredBy returns the enabled isolation types which require a host
+// feature, formatted for messages. It returns "" if none of them are enabled.
+func requiredBy(opts *Options, types ...platform.ContainerType) string {
+	var enabled []string
+	for _, t := range types {
+		if opts.Executor.SupportsIsolation(t) {
+			enabled = append(enabled, string(t))
+		}
+	}
+	return strings.Join(enabled, ", ")
+}
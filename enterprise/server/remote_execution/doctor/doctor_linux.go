@@ -0,0 +1,100 @@
+//go:build linux && !android
+
+package doctor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/cgroup"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+)
+
+// Controllers used to enforce task resource limits and collect usage stats.
+var requiredCgroupControllers = []string{"cpu", "memory", "pids"}
+
+func platformChecks() []check {
+	return []check{
+		{"kvm", checkKVM},
+		{"vhost_vsock", checkVhostVsock},
+		{"cgroup_v2", checkCgroupV2},
+		{"iptables", checkIPTables},
+	}
+}
+
+func checkKVM(ctx context.Context, env environment.Env, opts *Options) (Status, string) {
+	if requiredBy(opts, platform.FirecrackerContainerType) == "" {
+		return StatusSkipped, "firecracker isolation is not enabled"
+	}
+	f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		return StatusFailed, fmt.Sprintf("open /dev/kvm: %s. Firecracker requires KVM; make sure that the host supports virtualization and that the executor has access to /dev/kvm.", err)
+	}
+	f.Close()
+	return StatusOK, "/dev/kvm is accessible"
+}
+
+func checkVhostVsock(ctx context.Context, env environment.Env, opts *Options) (Status, string) {
+	if requiredBy(opts, platform.FirecrackerContainerType) == "" {
+		return StatusSkipped, "firecracker isolation is not enabled"
+	}
+	if _, err := os.Stat("/dev/vhost-vsock"); err != nil {
+		return StatusFailed, fmt.Sprintf("stat /dev/vhost-vsock: %s. Firecracker communicates with VMs over vsock; try 'modprobe vhost_vsock'.", err)
+	}
+	return StatusOK, "/dev/vhost-vsock is present"
+}
+
+func checkCgroupV2(ctx context.Context, env environment.Env, opts *Options) (Status, string) {
+	controllers, err := cgroup.DelegatedControllers()
+	if err != nil {
+		return StatusFailed, fmt.Sprintf("read cgroup controllers: %s", err)
+	}
+	// OCI containers are placed in child cgroups of the executor, so they
+	// can't be run without the controllers. Other isolation types only use
+	// them for stats.
+	failStatus := StatusWarning
+	if requiredBy(opts, platform.OCIContainerType) != "" {
+		failStatus = StatusFailed
+	}
+	if controllers == nil {
+		return failStatus, "the host does not use cgroup v2, so task resource usage will not be reported"
+	}
+	var missing []string
+	for _, c := range requiredCgroupControllers {
+		if !slices.Contains(controllers, c) {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) > 0 {
+		return failStatus, fmt.Sprintf("cgroup v2 controllers %s are not available to the executor (available: %s). When running as a non-root user, the controllers must be delegated to it, for example with systemd's Delegate= option.", strings.Join(missing, ", "), strings.Join(controllers, ", "))
+	}
+	return StatusOK, fmt.Sprintf("cgroup v2 controllers are available: %s", strings.Join(controllers, ", "))
+}
+
+// checkIPTables checks that iptables can be used to set up networking for
+// VMs and containers. It reports whether iptables uses the legacy or the
+// nf_tables backend, since rules from both backends interact poorly.
+func checkIPTables(ctx context.Context, env environment.Env, opts *Options) (Status, string) {
+	types := requiredBy(opts, platform.FirecrackerContainerType, platform.OCIContainerType)
+	if types == "" {
+		return StatusSkipped, "no isolation type that uses iptables is enabled"
+	}
+	path, err := exec.LookPath("iptables")
+	if err != nil {
+		return StatusFailed, fmt.Sprintf("iptables not found in PATH, but it is required by %s isolation", types)
+	}
+	out, err := exec.CommandContext(ctx, path, "--version").CombinedOutput()
+	if err != nil {
+		return StatusFailed, fmt.Sprintf("iptables --version: %s: %q", err, strings.TrimSpace(string(out)))
+	}
+	version := strings.TrimSpace(string(out))
+	if out, err := exec.CommandContext(ctx, path, "--wait", "-S", "FORWARD").CombinedOutput(); err != nil {
+		return StatusFailed, fmt.Sprintf("list iptables rules: %s: %q. The executor needs CAP_NET_ADMIN to set up networking for %s isolation.", err, strings.TrimSpace(string(out)), types)
+	}
+	return StatusOK, version
+}
@@ -0,0 +1,9 @@
+//go:build (darwin && !ios) || windows
+
+package doctor
+
+// The host checks are specific to linux isolation types, so only the
+// filecache and connectivity checks are run on other platforms.
+func platformChecks() []check {
+	return nil
+}
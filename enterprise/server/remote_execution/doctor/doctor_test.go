@@ -0,0 +1,93 @@
+package doctor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testOptions(t *testing.T) *Options {
+	root := testfs.MakeTempDir(t)
+	return &Options{
+		BuildRoot:         filepath.Join(root, "remotebuilds"),
+		LocalCacheDir:     filepath.Join(root, "filecache"),
+		DiskTestSizeBytes: 4 * 1024 * 1024,
+		Executor:          &platform.ExecutorProperties{SupportedIsolationTypes: []platform.ContainerType{platform.BareContainerType}},
+	}
+}
+
+func TestFilecacheChecks(t *testing.T) {
+	opts := testOptions(t)
+
+	report := runChecks(context.Background(), nil, opts, []check{
+		{"filecache_hardlink", checkFilecacheHardlink},
+		{"filecache_disk_throughput", checkDiskThroughput},
+	})
+
+	require.Len(t, report.Results, 2)
+	assert.Equal(t, StatusOK, report.Results[0].Status, report.Results[0].Message)
+	assert.NotEqual(t, StatusFailed, report.Results[1].Status, report.Results[1].Message)
+	assert.False(t, report.Failed())
+	// Test files are cleaned up.
+	for _, dir := range []string{opts.LocalCacheDir, opts.BuildRoot} {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	}
+}
+
+func TestDiskThroughputDisabled(t *testing.T) {
+	opts := testOptions(t)
+	opts.DiskTestSizeBytes = 0
+
+	s, _ := checkDiskThroughput(context.Background(), nil, opts)
+
+	assert.Equal(t, StatusSkipped, s)
+}
+
+func TestPlatformChecksSkippedForBareIsolation(t *testing.T) {
+	opts := testOptions(t)
+
+	report := runChecks(context.Background(), nil, opts, platformChecks())
+
+	for _, res := range report.Results {
+		if res.Name != "cgroup_v2" {
+			assert.Equal(t, StatusSkipped, res.Status, res.Name)
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	report := &Report{Results: []*Result{
+		{Name: "kvm", Status: StatusOK, Message: "/dev/kvm is accessible"},
+		{Name: "cache_connectivity", Status: StatusFailed, Message: "connection refused"},
+		{Name: "iptables", Status: StatusSkipped, Message: "not enabled"},
+	}}
+	assert.True(t, report.Failed())
+
+	buf := &bytes.Buffer{}
+	err := report.WriteText(buf)
+	require.NoError(t, err)
+	assert.Equal(t, `[OK     ] kvm: /dev/kvm is accessible
+[FAILED ] cache_connectivity: connection refused
+[SKIPPED] iptables: not enabled
+
+3 checks: 1 ok, 0 warnings, 1 failed, 1 skipped
+`, buf.String())
+
+	buf.Reset()
+	err = report.WriteJSON(buf)
+	require.NoError(t, err)
+	decoded := &Report{}
+	err = json.Unmarshal(buf.Bytes(), decoded)
+	require.NoError(t, err)
+	assert.Equal(t, report, decoded)
+}
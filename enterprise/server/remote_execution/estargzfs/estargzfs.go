@@ -0,0 +1,517 @@
+// Package estargzfs serves eStargz image layers as read-only FUSE
+// filesystems. File contents are fetched from the layer blob on demand, so
+// containers can start before their image has been fully downloaded.
+//
+// See https://github.com/containerd/stargz-snapshotter/blob/main/docs/estargz.md
+package estargzfs
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	digest "github.com/opencontainers/go-digest"
+)
+
+const (
+	// TOCDigestAnnotation is the layer descriptor annotation holding the
+	// digest of an eStargz layer's table of contents. Layers without this
+	// annotation can't be mounted lazily.
+	TOCDigestAnnotation = "containerd.io/snapshot/stargz/toc.digest"
+
+	// fsName is the name given to mounted filesystems in /proc/mounts.
+	fsName = "estargz"
+
+	// Size of the reads used to download the full blob in the background.
+	downloadChunkSize = 8 * 1024 * 1024
+
+	whiteoutPrefix       = ".wh."
+	opaqueWhiteoutMarker = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// overlayfs reads either the trusted or the user xattr namespace, depending
+// on whether the overlay is mounted with the "userxattr" option.
+var opaqueXattrs = []string{"trusted.overlay.opaque", "user.overlay.opaque"}
+
+// Blob provides random access to a compressed layer blob.
+type Blob interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// FS is a mounted eStargz layer.
+type FS struct {
+	reader    *estargz.Reader
+	verifier  estargz.TOCEntryVerifier
+	blob      *cachingBlob
+	server    *fuse.Server
+	mountPath string
+
+	cancelDownload context.CancelFunc
+	downloadDone   chan struct{}
+}
+
+// Mount mounts the eStargz layer stored in the given blob to the given
+// directory. The layer's table of contents is fetched and checked against
+// tocDigest before mounting, and file contents are checked against the chunk
+// digests in the table of contents as they're read.
+//
+// The full blob is downloaded to cachePath in the background. Once the
+// download completes, reads are served from the local copy instead of the
+// blob. If cachePath already holds the full blob, it is used immediately.
+// blobDigest is the digest of the compressed blob, used to verify the
+// download.
+func Mount(ctx context.Context, mountPath string, blob Blob, blobDigest, tocDigest digest.Digest, cachePath string) (*FS, error) {
+	cb := &cachingBlob{src: blob}
+	if f, err := os.Open(cachePath); err == nil {
+		cb.local.Store(f)
+	}
+
+	r, err := estargz.Open(io.NewSectionReader(cb, 0, blob.Size()))
+	if err != nil {
+		cb.Close()
+		return nil, status.UnavailableErrorf("open estargz layer: %s", err)
+	}
+	verifier, err := r.VerifyTOC(tocDigest)
+	if err != nil {
+		cb.Close()
+		return nil, status.DataLossErrorf("verify estargz TOC: %s", err)
+	}
+	root, ok := r.Lookup("")
+	if !ok {
+		cb.Close()
+		return nil, status.DataLossError("estargz layer has no root directory")
+	}
+
+	if err := os.MkdirAll(mountPath, 0755); err != nil {
+		cb.Close()
+		return nil, status.UnavailableErrorf("create mount dir: %s", err)
+	}
+	f := &FS{
+		reader:       r,
+		verifier:     verifier,
+		blob:         cb,
+		mountPath:    mountPath,
+		downloadDone: make(chan struct{}),
+	}
+	// Layer contents never change, so the kernel can cache them for as long
+	// as the FS is mounted.
+	timeout := 24 * time.Hour
+	opts := &fusefs.Options{
+		EntryTimeout: &timeout,
+		AttrTimeout:  &timeout,
+		MountOptions: fuse.MountOptions{
+			// The container runtime accesses the layer as another user.
+			AllowOther: true,
+			// Don't depend on `fusermount`.
+			// Disable fallback to fusermount as well, since it can cause
+			// deadlocks. See https://github.com/hanwen/go-fuse/issues/506
+			DirectMountStrict: true,
+			FsName:            fsName,
+			Name:              fsName,
+		},
+	}
+	rootNode := &node{fs: f, entry: root}
+	server, err := fusefs.Mount(mountPath, rootNode, opts)
+	if err != nil {
+		cb.Close()
+		return nil, status.UnavailableErrorf("mount estargz layer to %q: %s", mountPath, err)
+	}
+	f.server = server
+
+	if cb.local.Load() != nil {
+		close(f.downloadDone)
+	} else {
+		dlCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		f.cancelDownload = cancel
+		go func() {
+			defer close(f.downloadDone)
+			start := time.Now()
+			if err := cb.download(dlCtx, blobDigest, cachePath); err != nil {
+				if dlCtx.Err() == nil {
+					log.CtxWarningf(ctx, "Failed to download estargz layer %s in the background (contents will continue to be fetched on demand): %s", blobDigest, err)
+				}
+				return
+			}
+			log.CtxDebugf(ctx, "Downloaded estargz layer %s in %s", blobDigest, time.Since(start))
+		}()
+	}
+	return f, nil
+}
+
+// Unmount unmounts the FS and stops the background download, if it's still
+// running.
+func (f *FS) Unmount(ctx context.Context) error {
+	if f.cancelDownload != nil {
+		f.cancelDownload()
+	}
+	<-f.downloadDone
+	err := f.server.Unmount()
+	if err == nil {
+		f.server.Wait()
+	}
+	if closeErr := f.blob.Close(); closeErr != nil {
+		log.CtxWarningf(ctx, "Failed to close estargz layer cache file: %s", closeErr)
+	}
+	if err != nil {
+		return status.UnavailableErrorf("unmount estargz layer at %q: %s", f.mountPath, err)
+	}
+	return nil
+}
+
+// Downloaded returns whether the full layer blob has been downloaded, so
+// that reads no longer fetch from the remote blob.
+func (f *FS) Downloaded() bool {
+	return f.blob.local.Load() != nil
+}
+
+// CleanStaleMounts unmounts estargz mounts under the given directory which
+// were left behind by a previous process.
+func CleanStaleMounts(dir string) error {
+	mf, err := os.Open("/proc/mounts")
+	if err != nil {
+		return err
+	}
+	defer mf.Close()
+	scanner := bufio.NewScanner(mf)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		name, mountPath := fields[0], fields[1]
+		if name != fsName || !strings.HasPrefix(mountPath, dir+string(filepath.Separator)) {
+			continue
+		}
+		if err := unix.Unmount(mountPath, unix.MNT_DETACH); err != nil {
+			// Fall back to fusermount in case we don't have permission to
+			// unmount directly.
+			if b, err := exec.Command("fusermount", "-u", mountPath).CombinedOutput(); err != nil {
+				return status.InternalErrorf("unmount %q: fusermount -u: %q", mountPath, string(b))
+			}
+		}
+		log.Debugf("Unmounted stale estargz layer at %q", mountPath)
+	}
+	return scanner.Err()
+}
+
+// cachingBlob reads from a remote blob until the full blob has been
+// downloaded, and from the local copy afterwards.
+type cachingBlob struct {
+	src   Blob
+	local atomic.Pointer[os.File]
+}
+
+func (b *cachingBlob) ReadAt(p []byte, off int64) (int, error) {
+	if f := b.local.Load(); f != nil {
+		return f.ReadAt(p, off)
+	}
+	return b.src.ReadAt(p, off)
+}
+
+// download copies the full blob to the given path, verifying its digest,
+// then switches reads over to the local copy.
+func (b *cachingBlob) download(ctx context.Context, blobDigest digest.Digest, path string) error {
+	if blobDigest.Algorithm() != digest.SHA256 {
+		return status.UnimplementedErrorf("unsupported blob digest algorithm %q", blobDigest.Algorithm())
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	w := io.MultiWriter(tmp, h)
+	buf := make([]byte, downloadChunkSize)
+	for off := int64(0); off < b.src.Size(); {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := b.src.ReadAt(buf[:min(int64(len(buf)), b.src.Size()-off)], off)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n == 0 {
+			return status.DataLossErrorf("blob is shorter than expected (%d < %d bytes)", off, b.src.Size())
+		}
+		if _, err := w.Write(buf[:n]); err != nil {
+			return err
+		}
+		off += int64(n)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != blobDigest.Encoded() {
+		return status.DataLossErrorf("downloaded blob digest mismatch: got sha256:%s, want %s", got, blobDigest)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	b.local.Store(f)
+	return nil
+}
+
+func (b *cachingBlob) Close() error {
+	if f := b.local.Load(); f != nil {
+		return f.Close()
+	}
+	return nil
+}
+
+// node is a file, directory, or other entry in the layer.
+type node struct {
+	fusefs.Inode
+	fs    *FS
+	entry *estargz.TOCEntry
+
+	// Whether the directory hides the contents of lower layers.
+	opaque bool
+	// Whether the node marks a deleted file. Whiteouts are exposed as 0/0
+	// character devices, as expected by overlayfs.
+	whiteout bool
+}
+
+var _ fusefs.NodeOnAdder = (*node)(nil)
+var _ fusefs.NodeGetattrer = (*node)(nil)
+var _ fusefs.NodeOpener = (*node)(nil)
+var _ fusefs.NodeReadlinker = (*node)(nil)
+var _ fusefs.NodeGetxattrer = (*node)(nil)
+var _ fusefs.NodeListxattrer = (*node)(nil)
+
+// OnAdd populates the tree from the layer's table of contents when the root
+// node is mounted.
+func (n *node) OnAdd(ctx context.Context) {
+	if !n.IsRoot() {
+		return
+	}
+	// Hardlinks share the source entry, so reuse its inode.
+	inodes := map[*estargz.TOCEntry]*fusefs.Inode{}
+	var add func(parent *node)
+	add = func(parent *node) {
+		parent.entry.ForeachChild(func(name string, ent *estargz.TOCEntry) bool {
+			if parent.IsRoot() && (name == estargz.PrefetchLandmark || name == estargz.NoPrefetchLandmark) {
+				return true
+			}
+			if name == opaqueWhiteoutMarker {
+				parent.opaque = true
+				return true
+			}
+			if strings.HasPrefix(name, whiteoutPrefix) {
+				child := &node{fs: n.fs, entry: ent, whiteout: true}
+				inode := parent.NewPersistentInode(ctx, child, fusefs.StableAttr{Mode: syscall.S_IFCHR})
+				parent.AddChild(strings.TrimPrefix(name, whiteoutPrefix), inode, false /*=overwrite*/)
+				return true
+			}
+			if inode, ok := inodes[ent]; ok {
+				parent.AddChild(name, inode, false /*=overwrite*/)
+				return true
+			}
+			child := &node{fs: n.fs, entry: ent}
+			inode := parent.NewPersistentInode(ctx, child, fusefs.StableAttr{Mode: fileType(ent)})
+			parent.AddChild(name, inode, false /*=overwrite*/)
+			if ent.Type == "dir" {
+				add(child)
+			} else {
+				inodes[ent] = inode
+			}
+			return true
+		})
+	}
+	add(n)
+}
+
+func (n *node) Getattr(ctx context.Context, _ fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if n.whiteout {
+		out.Mode = syscall.S_IFCHR
+		out.Nlink = 1
+		return fusefs.OK
+	}
+	e := n.entry
+	out.Mode = fileType(e) | uint32(e.Mode&07777)
+	out.Uid = uint32(e.UID)
+	out.Gid = uint32(e.GID)
+	out.Nlink = uint32(max(e.NumLink, 1))
+	switch e.Type {
+	case "reg":
+		out.Size = uint64(e.Size)
+	case "symlink":
+		out.Size = uint64(len(e.LinkName))
+	case "char", "block":
+		out.Rdev = uint32(unix.Mkdev(uint32(e.DevMajor), uint32(e.DevMinor)))
+	}
+	out.Blksize = 4096
+	out.Blocks = (out.Size + 511) / 512
+	out.SetTimes(nil, pointer(e.ModTime()), nil)
+	return fusefs.OK
+}
+
+func (n *node) Open(ctx context.Context, flags uint32) (fusefs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	if n.whiteout || n.entry.Type != "reg" {
+		return nil, 0, syscall.EINVAL
+	}
+	r, err := n.fs.reader.OpenFile(n.entry.Name)
+	if err != nil {
+		log.CtxErrorf(ctx, "Failed to open estargz file %q: %s", n.entry.Name, err)
+		return nil, 0, syscall.EIO
+	}
+	return &fileHandle{fs: n.fs, path: n.entry.Name, r: r}, fuse.FOPEN_KEEP_CACHE, fusefs.OK
+}
+
+func (n *node) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	if n.whiteout || n.entry.Type != "symlink" {
+		return nil, syscall.EINVAL
+	}
+	return []byte(n.entry.LinkName), fusefs.OK
+}
+
+func (n *node) xattrs() map[string][]byte {
+	if n.whiteout {
+		return nil
+	}
+	if !n.opaque {
+		return n.entry.Xattrs
+	}
+	attrs := make(map[string][]byte, len(n.entry.Xattrs)+len(opaqueXattrs))
+	for k, v := range n.entry.Xattrs {
+		attrs[k] = v
+	}
+	for _, k := range opaqueXattrs {
+		attrs[k] = []byte{'y'}
+	}
+	return attrs
+}
+
+func (n *node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	v, ok := n.xattrs()[attr]
+	if !ok {
+		return 0, syscall.ENODATA
+	}
+	if len(dest) < len(v) {
+		return uint32(len(v)), syscall.ERANGE
+	}
+	return uint32(copy(dest, v)), fusefs.OK
+}
+
+func (n *node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	var names []byte
+	for k := range n.xattrs() {
+		names = append(names, k...)
+		names = append(names, 0)
+	}
+	if len(dest) < len(names) {
+		return uint32(len(names)), syscall.ERANGE
+	}
+	return uint32(copy(dest, names)), fusefs.OK
+}
+
+type fileHandle struct {
+	fs   *FS
+	path string
+	r    *io.SectionReader
+
+	mu sync.Mutex // protects chunk and chunkData
+	// The last chunk read from the file, and its verified contents. The
+	// kernel reads files in pieces which are usually much smaller than
+	// chunks, so this saves decompressing and verifying the same chunk for
+	// each piece.
+	chunk     *estargz.TOCEntry
+	chunkData []byte
+}
+
+var _ fusefs.FileReader = (*fileHandle)(nil)
+
+func (h *fileHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := 0
+	for n < len(dest) && off+int64(n) < h.r.Size() {
+		ce, data, err := h.readChunk(off + int64(n))
+		if err != nil {
+			log.CtxErrorf(ctx, "Failed to read estargz file %q: %s", h.path, err)
+			return nil, syscall.EIO
+		}
+		n += copy(dest[n:], data[off+int64(n)-ce.ChunkOffset:])
+	}
+	return fuse.ReadResultData(dest[:n]), fusefs.OK
+}
+
+// readChunk returns the chunk containing the given file offset, along with
+// its contents, which are checked against the chunk digest in the table of
+// contents.
+func (h *fileHandle) readChunk(off int64) (*estargz.TOCEntry, []byte, error) {
+	ce, ok := h.fs.reader.ChunkEntryForOffset(h.path, off)
+	if !ok {
+		return nil, nil, status.InternalErrorf("no chunk at offset %d", off)
+	}
+	if ce == h.chunk {
+		return ce, h.chunkData, nil
+	}
+	data := make([]byte, ce.ChunkSize)
+	if _, err := h.r.ReadAt(data, ce.ChunkOffset); err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	v, err := h.fs.verifier.Verifier(ce)
+	if err != nil {
+		return nil, nil, status.DataLossErrorf("get verifier for chunk at offset %d: %s", ce.ChunkOffset, err)
+	}
+	if _, err := v.Write(data); err != nil {
+		return nil, nil, err
+	}
+	if !v.Verified() {
+		return nil, nil, status.DataLossErrorf("digest mismatch for chunk at offset %d", ce.ChunkOffset)
+	}
+	h.chunk, h.chunkData = ce, data
+	return ce, data, nil
+}
+
+// fileType returns the S_IFMT bits for the given entry.
+func fileType(e *estargz.TOCEntry) uint32 {
+	switch e.Type {
+	case "dir":
+		return syscall.S_IFDIR
+	case "symlink":
+		return syscall.S_IFLNK
+	case "char":
+		return syscall.S_IFCHR
+	case "block":
+		return syscall.S_IFBLK
+	case "fifo":
+		return syscall.S_IFIFO
+	default:
+		return syscall.S_IFREG
+	}
+}
+
+func pointer[T any](val T) *T {
+	return &val
+}
@@ -0,0 +1,254 @@
+package estargzfs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/estargzfs"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testmount"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/stretchr/testify/require"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestMain(m *testing.M) {
+	testmount.RunWithLimitedMountPermissions(m)
+}
+
+// countingBlob is an in-memory blob that counts reads.
+type countingBlob struct {
+	*bytes.Reader
+	reads atomic.Int64
+}
+
+func (b *countingBlob) ReadAt(p []byte, off int64) (int, error) {
+	b.reads.Add(1)
+	return b.Reader.ReadAt(p, off)
+}
+
+// gzipCompression builds eStargz blobs like the default gzip compression,
+// but writes the footer by hand. The upstream footer writer relies on
+// compress/flate output sizes which vary between Go versions.
+type gzipCompression struct {
+	*estargz.GzipCompressor
+	*estargz.GzipDecompressor
+}
+
+func (c *gzipCompression) WriteTOCAndFooter(w io.Writer, off int64, toc *estargz.JTOC, diffHash hash.Hash) (digest.Digest, error) {
+	tocJSON, err := json.MarshalIndent(toc, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	gz := gzip.NewWriter(w)
+	gw := io.Writer(gz)
+	if diffHash != nil {
+		gw = io.MultiWriter(gz, diffHash)
+	}
+	tw := tar.NewWriter(gw)
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: estargz.TOCTarName, Size: int64(len(tocJSON))}); err != nil {
+		return "", err
+	}
+	if _, err := tw.Write(tocJSON); err != nil {
+		return "", err
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+
+	// An empty gzip stream whose extra field holds the TOC offset.
+	footer := []byte{0x1f, 0x8b, 0x08, 0x04, 0, 0, 0, 0, 0, 0xff, 26, 0, 'S', 'G', 22, 0}
+	footer = append(footer, fmt.Sprintf("%016xSTARGZ", off)...)
+	footer = append(footer, 0x01, 0x00, 0x00, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0)
+	if len(footer) != estargz.FooterSize {
+		return "", fmt.Errorf("footer is %d bytes, want %d", len(footer), estargz.FooterSize)
+	}
+	if _, err := w.Write(footer); err != nil {
+		return "", err
+	}
+	return digest.FromBytes(tocJSON), nil
+}
+
+type tarEntry struct {
+	hdr     *tar.Header
+	content string
+}
+
+func buildLayer(t *testing.T, entries []tarEntry) (*countingBlob, digest.Digest, digest.Digest) {
+	return buildLayerWithCompressionLevel(t, gzip.BestCompression, entries)
+}
+
+func buildLayerWithCompressionLevel(t *testing.T, level int, entries []tarEntry) (*countingBlob, digest.Digest, digest.Digest) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		e.hdr.Size = int64(len(e.content))
+		e.hdr.ModTime = time.Unix(1e9, 0)
+		require.NoError(t, tw.WriteHeader(e.hdr))
+		_, err := tw.Write([]byte(e.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	compression := &gzipCompression{estargz.NewGzipCompressorWithLevel(level), &estargz.GzipDecompressor{}}
+	blob, err := estargz.Build(io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len())), estargz.WithCompression(compression))
+	require.NoError(t, err)
+	defer blob.Close()
+	b, err := io.ReadAll(blob)
+	require.NoError(t, err)
+	blobDigest := digest.Digest(fmt.Sprintf("sha256:%x", sha256.Sum256(b)))
+	return &countingBlob{Reader: bytes.NewReader(b)}, blobDigest, blob.TOCDigest()
+}
+
+func TestMount(t *testing.T) {
+	ctx := context.Background()
+	root := testfs.MakeTempDir(t)
+	blob, blobDigest, tocDigest := buildLayer(t, []tarEntry{
+		{hdr: &tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: &tar.Header{Name: "bin/hello", Typeflag: tar.TypeReg, Mode: 0755}, content: "hello world\n"},
+		{hdr: &tar.Header{Name: "bin/hello-link", Typeflag: tar.TypeLink, Linkname: "bin/hello"}},
+		{hdr: &tar.Header{Name: "bin/sh", Typeflag: tar.TypeSymlink, Linkname: "hello"}},
+		{hdr: &tar.Header{Name: ".wh.deleted", Typeflag: tar.TypeReg, Mode: 0644}},
+		{hdr: &tar.Header{Name: "opaque/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: &tar.Header{Name: "opaque/.wh..wh..opq", Typeflag: tar.TypeReg, Mode: 0644}},
+		{hdr: &tar.Header{Name: "opaque/new", Typeflag: tar.TypeReg, Mode: 0644}, content: "new"},
+	})
+
+	mountPath := filepath.Join(root, "mnt")
+	cachePath := filepath.Join(root, "blobs", blobDigest.Encoded())
+	fs, err := estargzfs.Mount(ctx, mountPath, blob, blobDigest, tocDigest, cachePath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := fs.Unmount(ctx)
+		require.NoError(t, err)
+	})
+
+	b, err := os.ReadFile(filepath.Join(mountPath, "bin/hello"))
+	require.NoError(t, err)
+	require.Equal(t, "hello world\n", string(b))
+	info, err := os.Stat(filepath.Join(mountPath, "bin/hello"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0755), info.Mode())
+	require.Equal(t, uint64(2), info.Sys().(*syscall.Stat_t).Nlink)
+
+	linkInfo, err := os.Stat(filepath.Join(mountPath, "bin/hello-link"))
+	require.NoError(t, err)
+	require.True(t, os.SameFile(info, linkInfo))
+
+	target, err := os.Readlink(filepath.Join(mountPath, "bin/sh"))
+	require.NoError(t, err)
+	require.Equal(t, "hello", target)
+
+	// Whiteouts are exposed in overlayfs format.
+	info, err = os.Lstat(filepath.Join(mountPath, "deleted"))
+	require.NoError(t, err)
+	require.Equal(t, os.ModeDevice|os.ModeCharDevice, info.Mode().Type())
+	require.Equal(t, uint64(0), info.Sys().(*syscall.Stat_t).Rdev)
+	_, err = os.Lstat(filepath.Join(mountPath, ".wh.deleted"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	entries, err := os.ReadDir(filepath.Join(mountPath, "opaque"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "new", entries[0].Name())
+	val := make([]byte, 16)
+	n, err := syscall.Getxattr(filepath.Join(mountPath, "opaque"), "user.overlay.opaque", val)
+	require.NoError(t, err)
+	require.Equal(t, "y", string(val[:n]))
+
+	// The whole blob should eventually be downloaded to the cache path, after
+	// which reads no longer go to the blob.
+	require.Eventually(t, fs.Downloaded, 10*time.Second, 10*time.Millisecond)
+	cached, err := os.ReadFile(cachePath)
+	require.NoError(t, err)
+	require.Equal(t, blobDigest, digest.FromBytes(cached))
+	reads := blob.reads.Load()
+	_, err = os.ReadFile(filepath.Join(mountPath, "opaque/new"))
+	require.NoError(t, err)
+	require.Equal(t, reads, blob.reads.Load())
+}
+
+func TestMount_UsesCachedBlob(t *testing.T) {
+	ctx := context.Background()
+	root := testfs.MakeTempDir(t)
+	blob, blobDigest, tocDigest := buildLayer(t, []tarEntry{
+		{hdr: &tar.Header{Name: "hello", Typeflag: tar.TypeReg, Mode: 0644}, content: "hello"},
+	})
+	cachePath := filepath.Join(root, "blob")
+	b := make([]byte, blob.Size())
+	_, err := blob.Reader.ReadAt(b, 0)
+	require.NoError(t, err)
+	err = os.WriteFile(cachePath, b, 0644)
+	require.NoError(t, err)
+
+	fs, err := estargzfs.Mount(ctx, filepath.Join(root, "mnt"), blob, blobDigest, tocDigest, cachePath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := fs.Unmount(ctx)
+		require.NoError(t, err)
+	})
+	require.True(t, fs.Downloaded())
+	content, err := os.ReadFile(filepath.Join(root, "mnt", "hello"))
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(content))
+	require.Equal(t, int64(0), blob.reads.Load())
+}
+
+func TestMount_WrongTOCDigest(t *testing.T) {
+	ctx := context.Background()
+	root := testfs.MakeTempDir(t)
+	blob, blobDigest, _ := buildLayer(t, []tarEntry{
+		{hdr: &tar.Header{Name: "hello", Typeflag: tar.TypeReg, Mode: 0644}, content: "hello"},
+	})
+	_, err := estargzfs.Mount(ctx, filepath.Join(root, "mnt"), blob, blobDigest, digest.FromString("foo"), filepath.Join(root, "blob"))
+	require.Error(t, err)
+}
+
+func TestMount_TamperedContents(t *testing.T) {
+	ctx := context.Background()
+	root := testfs.MakeTempDir(t)
+	// Store file contents uncompressed, so that they can be modified without
+	// breaking decompression.
+	blob, blobDigest, tocDigest := buildLayerWithCompressionLevel(t, gzip.NoCompression, []tarEntry{
+		{hdr: &tar.Header{Name: "hello", Typeflag: tar.TypeReg, Mode: 0644}, content: "hello, untampered world"},
+		{hdr: &tar.Header{Name: "other", Typeflag: tar.TypeReg, Mode: 0644}, content: "other"},
+	})
+	b := make([]byte, blob.Size())
+	_, err := blob.Reader.ReadAt(b, 0)
+	require.NoError(t, err)
+	i := bytes.Index(b, []byte("untampered"))
+	require.NotEqual(t, -1, i)
+	copy(b[i:], "  tampered")
+	tampered := &countingBlob{Reader: bytes.NewReader(b)}
+
+	// The table of contents is intact, so the layer can be mounted, but the
+	// modified file can't be read.
+	fs, err := estargzfs.Mount(ctx, filepath.Join(root, "mnt"), tampered, blobDigest, tocDigest, filepath.Join(root, "blob"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := fs.Unmount(ctx)
+		require.NoError(t, err)
+	})
+	_, err = os.ReadFile(filepath.Join(root, "mnt", "hello"))
+	require.ErrorIs(t, err, syscall.EIO)
+	content, err := os.ReadFile(filepath.Join(root, "mnt", "other"))
+	require.NoError(t, err)
+	require.Equal(t, "other", string(content))
+}
@@ -0,0 +1,94 @@
+package execution_server
+
+import (
+	"context"
+	"sync"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/operation"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/genproto/googleapis/longrunning"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+var (
+	maxBatchExecuteActions  = flag.Int("remote_execution.max_batch_execute_actions", 10_000, "The maximum number of actions that can be executed in a single BatchExecute call.")
+	batchExecuteConcurrency = flag.Int("remote_execution.batch_execute_concurrency", 500, "The maximum number of actions in a single BatchExecute call that are executed concurrently. The remaining actions are executed as earlier ones complete.")
+)
+
+// batchExecuteStream is a streamLike that keeps the last operation sent to
+// it, so that only the final operation of each action in a batch is returned
+// to the client.
+type batchExecuteStream struct {
+	ctx    context.Context
+	lastOp *longrunning.Operation
+}
+
+func (s *batchExecuteStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *batchExecuteStream) Send(op *longrunning.Operation) error {
+	s.lastOp = op
+	return nil
+}
+
+// BatchExecute executes many actions in a single call, streaming a response
+// for each action as soon as it completes.
+func (s *ExecutionServer) BatchExecute(req *repb.BatchExecuteRequest, stream repb.Execution_BatchExecuteServer) error {
+	if len(req.GetActionDigests()) == 0 {
+		return status.InvalidArgumentError("no action digests")
+	}
+	if len(req.GetActionDigests()) > *maxBatchExecuteActions {
+		return status.InvalidArgumentErrorf("too many action digests (%d); at most %d actions can be executed in a single call", len(req.GetActionDigests()), *maxBatchExecuteActions)
+	}
+
+	var mu sync.Mutex // PROTECTS(stream)
+	eg, ctx := errgroup.WithContext(stream.Context())
+	eg.SetLimit(*batchExecuteConcurrency)
+	for i, d := range req.GetActionDigests() {
+		if ctx.Err() != nil {
+			break
+		}
+		eg.Go(func() error {
+			rsp := s.executeInBatch(ctx, req, d)
+			rsp.Index = int32(i)
+			mu.Lock()
+			defer mu.Unlock()
+			return stream.Send(rsp)
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	// If the client went away, some actions may not have been executed.
+	return ctx.Err()
+}
+
+// executeInBatch executes one of the actions in a batch and waits for it to
+// complete. Failures are returned in the response's status, so that they
+// don't fail the rest of the batch.
+func (s *ExecutionServer) executeInBatch(ctx context.Context, batchReq *repb.BatchExecuteRequest, actionDigest *repb.Digest) *repb.BatchExecuteResponse {
+	req := &repb.ExecuteRequest{
+		InstanceName:       batchReq.GetInstanceName(),
+		SkipCacheLookup:    batchReq.GetSkipCacheLookup(),
+		ActionDigest:       actionDigest,
+		ExecutionPolicy:    batchReq.GetExecutionPolicy(),
+		ResultsCachePolicy: batchReq.GetResultsCachePolicy(),
+		DigestFunction:     batchReq.GetDigestFunction(),
+	}
+	stream := &batchExecuteStream{ctx: ctx}
+	err := s.execute(req, stream)
+	rsp := &repb.BatchExecuteResponse{OperationName: stream.lastOp.GetName()}
+	if err == nil && operation.ExtractStage(stream.lastOp) != repb.ExecutionStage_COMPLETED {
+		err = status.UnavailableErrorf("execution %q did not complete", rsp.GetOperationName())
+	}
+	if err != nil {
+		rsp.Response = operation.ErrorResponse(err)
+		return rsp
+	}
+	rsp.Response = operation.ExtractExecuteResponse(stream.lastOp)
+	return rsp
+}
@@ -0,0 +1,179 @@
+package execution_server
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/pubsub"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_execution/execution_output"
+	"github.com/buildbuddy-io/buildbuddy/server/util/background"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+)
+
+var (
+	maxExecutionOutputStreamBytes = flag.Int64("remote_execution.max_execution_output_stream_bytes", 16*1024*1024, "The maximum number of bytes of each of an in-progress execution's stdout and stderr that are kept for streaming. Output past this limit can only be read from the action result, once the execution completes.")
+)
+
+const (
+	// Published on an execution output stream once all of the output has
+	// been published. Output is published base64-encoded, so it can't be
+	// confused with this marker.
+	executionOutputEndMarker = "end"
+)
+
+var executionOutputStreams = []string{execution_output.Stdout, execution_output.Stderr}
+
+func redisKeyForExecutionOutputStream(executionID, stream string) string {
+	// Shard by execution ID, like the execution's status stream.
+	return fmt.Sprintf("executionOutput/{%s}/%s", executionID, stream)
+}
+
+func (s *ExecutionServer) executionOutputChannel(executionID, stream string) *pubsub.Channel {
+	return s.streamPubSub.MonitoredChannel(redisKeyForExecutionOutputStream(executionID, stream))
+}
+
+// PublishExecutionOutput is called by executors to publish the output of
+// in-progress executions, which is streamed to clients by
+// ReadExecutionOutput.
+func (s *ExecutionServer) PublishExecutionOutput(stream repb.Execution_PublishExecutionOutputServer) error {
+	ctx, err := prefix.AttachUserPrefixToContext(stream.Context(), s.env)
+	if err != nil {
+		return err
+	}
+	executionID := ""
+	published := map[string]int64{}
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			s.finishExecutionOutput(ctx, executionID)
+			return stream.SendAndClose(&repb.PublishExecutionOutputResponse{})
+		}
+		if err != nil {
+			// The executor may have gone away, so let readers know that no
+			// more output is coming.
+			s.finishExecutionOutput(ctx, executionID)
+			return err
+		}
+		if executionID == "" {
+			if _, err := digest.ParseUploadResourceName(req.GetExecutionId()); err != nil {
+				return status.InvalidArgumentErrorf("invalid execution ID %q: %s", req.GetExecutionId(), err)
+			}
+			executionID = req.GetExecutionId()
+			ctx = log.EnrichContext(ctx, log.ExecutionIDKey, executionID)
+			for _, name := range executionOutputStreams {
+				if err := s.streamPubSub.CreateMonitoredChannel(ctx, redisKeyForExecutionOutputStream(executionID, name)); err != nil {
+					return status.UnavailableErrorf("create %s stream: %s", name, err)
+				}
+			}
+		}
+
+		for name, data := range map[string][]byte{execution_output.Stdout: req.GetStdout(), execution_output.Stderr: req.GetStderr()} {
+			if len(data) == 0 {
+				continue
+			}
+			if remaining := *maxExecutionOutputStreamBytes - published[name]; int64(len(data)) > remaining {
+				if remaining > 0 {
+					log.CtxInfof(ctx, "Execution %s exceeded %d bytes, truncating the streamed output", name, *maxExecutionOutputStreamBytes)
+				}
+				data = data[:max(remaining, 0)]
+			}
+			if len(data) == 0 {
+				continue
+			}
+			if err := s.streamPubSub.Publish(ctx, s.executionOutputChannel(executionID, name), base64.StdEncoding.EncodeToString(data)); err != nil {
+				return status.UnavailableErrorf("publish %s: %s", name, err)
+			}
+			published[name] += int64(len(data))
+		}
+	}
+}
+
+// finishExecutionOutput marks the execution's output streams as complete.
+func (s *ExecutionServer) finishExecutionOutput(ctx context.Context, executionID string) {
+	if executionID == "" {
+		return
+	}
+	ctx, cancel := background.ExtendContextForFinalization(ctx, updateExecutionTimeout)
+	defer cancel()
+	for _, name := range executionOutputStreams {
+		channel := s.executionOutputChannel(executionID, name)
+		if err := s.streamPubSub.Publish(ctx, channel, executionOutputEndMarker); err != nil {
+			log.CtxWarningf(ctx, "Could not finish execution %s stream: %s", name, err)
+			continue
+		}
+		if err := s.streamPubSub.Expire(ctx, channel, completedPubSubChanExpiration); err != nil {
+			log.CtxWarningf(ctx, "Could not expire execution %s stream: %s", name, err)
+		}
+	}
+}
+
+// ReadExecutionOutput streams the output of an execution, from the beginning
+// of the output, until the executor finishes publishing it.
+func (s *ExecutionServer) ReadExecutionOutput(req *bspb.ReadRequest, stream bspb.ByteStream_ReadServer) error {
+	executionID, name, ok := execution_output.ParseStreamName(req.GetResourceName())
+	if !ok {
+		return status.InvalidArgumentErrorf("%q is not an execution output stream name", req.GetResourceName())
+	}
+	ctx, err := prefix.AttachUserPrefixToContext(stream.Context(), s.env)
+	if err != nil {
+		return err
+	}
+	ctx = log.EnrichContext(ctx, log.ExecutionIDKey, executionID)
+
+	channel := s.executionOutputChannel(executionID, name)
+	// Subscriptions to monitored channels fail with a retryable error if the
+	// channel doesn't exist, so check for it first.
+	exists, err := s.streamPubSub.Exists(ctx, channel)
+	if err != nil {
+		return status.UnavailableErrorf("check for %s stream: %s", name, err)
+	}
+	if !exists {
+		return status.NotFoundErrorf("%s of execution %q is not being streamed; the execution may not have started running, or may have completed too long ago", name, executionID)
+	}
+
+	subscriber := s.streamPubSub.SubscribeHead(ctx, channel)
+	defer subscriber.Close()
+	// The offset of the start of the next message in the stream's output.
+	offset := int64(0)
+	sent := int64(0)
+	for msg := range subscriber.Chan() {
+		if msg.Err != nil {
+			return msg.Err
+		}
+		if msg.Data == executionOutputEndMarker {
+			return nil
+		}
+		data, err := base64.StdEncoding.DecodeString(msg.Data)
+		if err != nil {
+			return status.InternalErrorf("decode %s: %s", name, err)
+		}
+		start := min(max(req.GetReadOffset()-offset, 0), int64(len(data)))
+		offset += int64(len(data))
+		data = data[start:]
+		if req.GetReadLimit() > 0 {
+			data = data[:min(int64(len(data)), req.GetReadLimit()-sent)]
+		}
+		if len(data) > 0 {
+			if err := stream.Send(&bspb.ReadResponse{Data: data}); err != nil {
+				return err
+			}
+			sent += int64(len(data))
+		}
+		if req.GetReadLimit() > 0 && sent >= req.GetReadLimit() {
+			return nil
+		}
+	}
+	if ctx.Err() != nil {
+		return status.FromContextError(ctx)
+	}
+	return status.UnavailableErrorf("%s stream of execution %q closed", name, executionID)
+}
@@ -17,6 +17,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/tasksize"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/execution"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/oci"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/metrics"
@@ -72,9 +73,35 @@ const (
 
 var (
 	enableRedisAvailabilityMonitoring = flag.Bool("remote_execution.enable_redis_availability_monitoring", false, "If enabled, the execution server will detect if Redis has lost state and will ask Bazel to retry executions.")
+	retryInfrastructureFailures       = flag.Bool("remote_execution.retry_infrastructure_failures", false, "If enabled, executions from Bazel that fail due to infrastructure problems (such as input fetch failures or executor crashes) are transparently retried on other executors, instead of returning the failure to Bazel.")
+	enableGroupRegistryCredentials    = flag.Bool("remote_execution.enable_group_container_registry_credentials", false, "If enabled, container registry credentials stored in the group's "+oci.RegistryCredentialsSecretName+" secret (in docker config.json format) are passed to executors for image pulls, unless the action sets its own credentials.")
 	sharedExecutorPoolTeeRate         = flag.Float64("remote_execution.shared_executor_pool_tee_rate", 0, "If non-zero, work for the default shared executor pool will be teed to a separate experiment pool at this rate.", flag.Internal)
 )
 
+// groupRegistryCredentials returns the credentials stored for the given
+// image's registry in the group's registry credentials secret, or nil if the
+// group has no credentials for the registry.
+func groupRegistryCredentials(ctx context.Context, secretService interfaces.SecretService, groupID, image string) (*repb.ContainerRegistryCredentials, error) {
+	config, err := secretService.GetSecret(ctx, groupID, oci.RegistryCredentialsSecretName)
+	if status.IsNotFoundError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	creds, err := oci.CredentialsFromDockerConfig(config, strings.TrimPrefix(image, platform.DockerPrefix))
+	if err != nil {
+		return nil, status.WrapErrorf(err, "read %s secret", oci.RegistryCredentialsSecretName)
+	}
+	if creds.IsEmpty() {
+		return nil, nil
+	}
+	return &repb.ContainerRegistryCredentials{
+		Username: creds.Username,
+		Password: creds.Password,
+	}, nil
+}
+
 func fillExecutionFromActionMetadata(md *repb.ExecutedActionMetadata, execution *tables.Execution) {
 	// IOStats
 	execution.FileDownloadCount = md.GetIoStats().GetFileDownloadCount()
@@ -483,14 +510,18 @@ func (s *ExecutionServer) Dispatch(ctx context.Context, req *repb.ExecuteRequest
 	return id, err
 }
 
-func (s *ExecutionServer) dispatchHedge(ctx context.Context, req *repb.ExecuteRequest) (string, error) {
-	id, _, err := s.dispatch(ctx, req, &dispatchOpts{recordActionMergingState: false})
+// dispatchHedge dispatches a copy of the execution with the given ID, which
+// isn't assigned to the executor running the original.
+func (s *ExecutionServer) dispatchHedge(ctx context.Context, req *repb.ExecuteRequest, originalExecutionID string) (string, error) {
+	id, _, err := s.dispatch(ctx, req, &dispatchOpts{recordActionMergingState: false, hedgedExecutionID: originalExecutionID})
 	return id, err
 }
 
 type dispatchOpts struct {
 	recordActionMergingState bool
 	teedRequest              bool
+	// The ID of the execution that this one is a hedged copy of, if any.
+	hedgedExecutionID string
 }
 
 func (s *ExecutionServer) dispatch(ctx context.Context, req *repb.ExecuteRequest, opts *dispatchOpts) (string, *interfaces.PoolInfo, error) {
@@ -591,6 +622,22 @@ func (s *ExecutionServer) dispatch(ctx context.Context, req *repb.ExecuteRequest
 		executionTask.Command.EnvironmentVariables = append(executionTask.Command.EnvironmentVariables, envVars...)
 	}
 
+	if *enableGroupRegistryCredentials && secretService != nil && props.ContainerImage != "" && props.ContainerRegistryUsername == "" && props.ContainerRegistryPassword == "" {
+		creds, err := groupRegistryCredentials(ctx, secretService, taskGroupID, props.ContainerImage)
+		if err != nil {
+			return "", nil, err
+		}
+		executionTask.ContainerRegistryCredentials = creds
+	}
+
+	pool, err := s.env.GetSchedulerService().GetPoolInfo(ctx, props.OS, props.Pool, props.WorkflowID, props.PoolType)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := applyTimeoutTier(executionTask, props, pool.Name); err != nil {
+		return "", nil, err
+	}
+
 	executionTask.QueuedTimestamp = timestamppb.Now()
 	serializedTask, err := proto.Marshal(executionTask)
 	if err != nil {
@@ -605,11 +652,6 @@ func (s *ExecutionServer) dispatch(ctx context.Context, req *repb.ExecuteRequest
 		predictedSize = sizer.Predict(ctx, executionTask)
 	}
 
-	pool, err := s.env.GetSchedulerService().GetPoolInfo(ctx, props.OS, props.Pool, props.WorkflowID, props.PoolType)
-	if err != nil {
-		return "", nil, err
-	}
-
 	metrics.RemoteExecutionRequests.With(prometheus.Labels{metrics.GroupID: taskGroupID, metrics.OS: props.OS, metrics.Arch: props.Arch}).Inc()
 
 	if s.enableRedisAvailabilityMonitoring {
@@ -619,15 +661,18 @@ func (s *ExecutionServer) dispatch(ctx context.Context, req *repb.ExecuteRequest
 	}
 
 	schedulingMetadata := &scpb.SchedulingMetadata{
-		Os:                props.OS,
-		Arch:              props.Arch,
-		Pool:              pool.Name,
-		TaskSize:          taskSize,
-		MeasuredTaskSize:  measuredSize,
-		PredictedTaskSize: predictedSize,
-		ExecutorGroupId:   pool.GroupID,
-		TaskGroupId:       taskGroupID,
-		Priority:          req.GetExecutionPolicy().GetPriority(),
+		Os:                          props.OS,
+		Arch:                        props.Arch,
+		Pool:                        pool.Name,
+		TaskSize:                    taskSize,
+		MeasuredTaskSize:            measuredSize,
+		PredictedTaskSize:           predictedSize,
+		ExecutorGroupId:             pool.GroupID,
+		TaskGroupId:                 taskGroupID,
+		Priority:                    req.GetExecutionPolicy().GetPriority(),
+		PriorityLane:                props.PriorityLane,
+		RetryInfrastructureFailures: *retryInfrastructureFailures,
+		HedgedTaskId:                opts.hedgedExecutionID,
 	}
 	scheduleReq := &scpb.ScheduleTaskRequest{
 		TaskId:         executionID,
@@ -635,7 +680,9 @@ func (s *ExecutionServer) dispatch(ctx context.Context, req *repb.ExecuteRequest
 		SerializedTask: serializedTask,
 	}
 
-	if opts.recordActionMergingState {
+	// Actions that opt out of action merging aren't recorded, so that
+	// identical requests can't find and merge with this execution.
+	if opts.recordActionMergingState && !props.DisableActionMerging {
 		if err := action_merger.RecordQueuedExecution(ctx, s.rdb, executionID, r); err != nil {
 			log.CtxWarningf(ctx, "could not record queued pending execution %q: %s", executionID, err)
 		}
@@ -644,15 +691,39 @@ func (s *ExecutionServer) dispatch(ctx context.Context, req *repb.ExecuteRequest
 	if _, err := scheduler.ScheduleTask(ctx, scheduleReq); err != nil {
 		ctx, cancel := background.ExtendContextForFinalization(ctx, 10*time.Second)
 		defer cancel()
-		if opts.recordActionMergingState {
+		if opts.recordActionMergingState && !props.DisableActionMerging {
 			_ = action_merger.DeletePendingExecution(ctx, s.rdb, executionID)
 		}
+		// Return load shedding errors as-is so that clients see when to retry.
+		if status.IsResourceExhaustedError(err) {
+			return "", nil, err
+		}
 		return "", nil, status.UnavailableErrorf("Error scheduling execution task %q: %s", executionID, err)
 	}
 
 	return executionID, pool, nil
 }
 
+// actionMergingDisabledByHeaders returns whether the request's remote header
+// platform overrides opt it out of action merging.
+//
+// Actions that opt out via their own platform are never recorded as pending,
+// so there's nothing for them to merge with. Header overrides aren't part of
+// the action digest though, so a request can opt out of merging with an
+// identical action that didn't.
+func actionMergingDisabledByHeaders(ctx context.Context) bool {
+	overrides := platform.RemoteHeaderOverrides(ctx)
+	if len(overrides) == 0 {
+		return false
+	}
+	props, err := platform.ParseProperties(&repb.ExecutionTask{PlatformOverrides: &repb.Platform{Properties: overrides}})
+	if err != nil {
+		// Invalid overrides fail the request when it's dispatched.
+		return false
+	}
+	return props.DisableActionMerging
+}
+
 func (s *ExecutionServer) execute(req *repb.ExecuteRequest, stream streamLike) error {
 	// Enforce a priority range of -1000 to 1000 for now so that we have some
 	// flexibility to assign different meanings to priority values later on.
@@ -674,6 +745,7 @@ func (s *ExecutionServer) execute(req *repb.ExecuteRequest, stream streamLike) e
 
 	hedge := false
 	executionID := ""
+	var schedulingClaim interfaces.DistributedLock
 	if !req.GetSkipCacheLookup() {
 		if actionResult, err := s.getActionResultFromCache(ctx, adInstanceDigest); err == nil {
 			r := digest.NewResourceName(req.GetActionDigest(), req.GetInstanceName(), rspb.CacheType_CAS, req.GetDigestFunction())
@@ -693,11 +765,24 @@ func (s *ExecutionServer) execute(req *repb.ExecuteRequest, stream streamLike) e
 		// Check if there's already an identical action pending execution. If
 		// so, wait on the result of that execution instead of starting a new
 		// one.
-		ee, h, err := action_merger.FindPendingExecution(ctx, s.rdb, s.env.GetSchedulerService(), adInstanceDigest)
-		hedge = h
-		if err != nil {
-			log.CtxWarningf(ctx, "could not check for existing execution: %s", err)
+		ee, h := "", false
+		if actionMergingDisabledByHeaders(ctx) {
+			log.CtxInfof(ctx, "Action merging disabled for execution request %q for invocation %q", downloadString, invocationID)
+		} else {
+			ee, h, err = action_merger.FindPendingExecution(ctx, s.rdb, s.env.GetSchedulerService(), adInstanceDigest)
+			if err != nil {
+				log.CtxWarningf(ctx, "could not check for existing execution: %s", err)
+			}
+			if ee == "" {
+				// Claim the action before scheduling it, in case an
+				// identical action is being scheduled at the same time.
+				ee, schedulingClaim, err = action_merger.ClaimScheduling(ctx, s.rdb, s.env.GetSchedulerService(), adInstanceDigest)
+				if err != nil {
+					log.CtxWarningf(ctx, "could not claim execution scheduling: %s", err)
+				}
+			}
 		}
+		hedge = h
 		if ee != "" {
 			ctx = log.EnrichContext(ctx, log.ExecutionIDKey, ee)
 			log.CtxInfof(ctx, "Reusing execution %q for execution request %q for invocation %q", ee, downloadString, invocationID)
@@ -717,6 +802,13 @@ func (s *ExecutionServer) execute(req *repb.ExecuteRequest, stream streamLike) e
 	if executionID == "" {
 		log.CtxInfof(ctx, "Scheduling new execution for %q for invocation %q", downloadString, invocationID)
 		newExecutionID, err := s.Dispatch(ctx, req)
+		if schedulingClaim != nil {
+			// The execution is recorded as pending once it's dispatched, so
+			// identical actions can merge with it without the claim.
+			if err := schedulingClaim.Unlock(ctx); err != nil {
+				log.CtxWarningf(ctx, "could not release execution scheduling claim: %s", err)
+			}
+		}
 		if err != nil {
 			log.CtxWarningf(ctx, "Error dispatching execution for %q: %s", downloadString, err)
 			return err
@@ -724,6 +816,7 @@ func (s *ExecutionServer) execute(req *repb.ExecuteRequest, stream streamLike) e
 		ctx = log.EnrichContext(ctx, log.ExecutionIDKey, newExecutionID)
 		executionID = newExecutionID
 		log.CtxInfof(ctx, "Scheduled execution %q for request %q for invocation %q", executionID, downloadString, invocationID)
+		go s.monitorSpeculativeExecution(ctx, req, executionID)
 		tracing.AddStringAttributeToCurrentSpan(ctx, "execution_result", "merged")
 		tracing.AddStringAttributeToCurrentSpan(ctx, "execution_id", executionID)
 	}
@@ -731,7 +824,7 @@ func (s *ExecutionServer) execute(req *repb.ExecuteRequest, stream streamLike) e
 	// in the background.
 	if hedge {
 		action_merger.RecordHedgedExecution(ctx, s.rdb, adInstanceDigest, s.getGroupIDForMetrics(ctx))
-		hedgedExecutionID, err := s.dispatchHedge(ctx, req)
+		hedgedExecutionID, err := s.dispatchHedge(ctx, req, executionID)
 		if err != nil {
 			log.CtxWarningf(ctx, "Error dispatching execution for action %q and invocation %q: %s", downloadString, invocationID, err)
 			return err
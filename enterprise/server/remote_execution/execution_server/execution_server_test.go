@@ -3,9 +3,13 @@ package execution_server_test
 import (
 	"context"
 	"io"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/action_merger"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/execution_server"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/operation"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/tasksize"
@@ -17,6 +21,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_execution/execution_output"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testcache"
@@ -26,26 +31,33 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 	"github.com/go-redis/redis/v8"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/protobuf/testing/protocmp"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
 	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+	dpb "google.golang.org/protobuf/types/known/durationpb"
 	tspb "google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type schedulerServerMock struct {
 	interfaces.SchedulerService
 
-	canceledCount int
-	scheduleReqs  []*scpb.ScheduleTaskRequest
+	mu              sync.Mutex // PROTECTS(scheduleReqs, canceledTaskIDs)
+	canceledCount   int
+	canceledTaskIDs []string
+	scheduleReqs    []*scpb.ScheduleTaskRequest
 }
 
 func (s *schedulerServerMock) GetPoolInfo(context.Context, string, string, string, interfaces.PoolType) (*interfaces.PoolInfo, error) {
@@ -53,15 +65,43 @@ func (s *schedulerServerMock) GetPoolInfo(context.Context, string, string, strin
 }
 
 func (s *schedulerServerMock) ScheduleTask(ctx context.Context, req *scpb.ScheduleTaskRequest) (*scpb.ScheduleTaskResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.scheduleReqs = append(s.scheduleReqs, req)
 	return &scpb.ScheduleTaskResponse{}, nil
 }
 
+func (s *schedulerServerMock) ExistsTask(ctx context.Context, taskID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, req := range s.scheduleReqs {
+		if req.GetTaskId() == taskID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func (s *schedulerServerMock) CancelTask(ctx context.Context, taskID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.canceledCount++
+	s.canceledTaskIDs = append(s.canceledTaskIDs, taskID)
 	return true, nil
 }
 
+func (s *schedulerServerMock) getScheduleReqs() []*scpb.ScheduleTaskRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.scheduleReqs)
+}
+
+func (s *schedulerServerMock) getCanceledTaskIDs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.canceledTaskIDs)
+}
+
 func setupEnv(t *testing.T) (*testenv.TestEnv, *grpc.ClientConn) {
 	env := testenv.GetTestEnv(t)
 
@@ -146,6 +186,182 @@ func TestDispatch(t *testing.T) {
 	assert.Equal(t, iid, task.GetRequestMetadata().GetToolInvocationId(), "invocation ID should be passed along")
 }
 
+func TestDispatch_DisableActionMerging(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		platform     *repb.Platform
+		wantRecorded bool
+	}{
+		{name: "default", platform: nil, wantRecorded: true},
+		{
+			name: "disabled",
+			platform: &repb.Platform{Properties: []*repb.Platform_Property{
+				{Name: "disable-action-merging", Value: "true"},
+			}},
+			wantRecorded: false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			env, _ := setupEnv(t)
+			ctx, err := env.GetAuthenticator().(*testauth.TestAuthenticator).WithAuthenticatedUser(context.Background(), "US1")
+			require.NoError(t, err)
+			ctx, err = prefix.AttachUserPrefixToContext(ctx, env)
+			require.NoError(t, err)
+
+			cd, err := cachetools.UploadProto(ctx, env.GetByteStreamClient(), "", repb.DigestFunction_SHA256, &repb.Command{Arguments: []string{"date"}})
+			require.NoError(t, err)
+			action := &repb.Action{CommandDigest: cd, Platform: tc.platform}
+			ad, err := cachetools.UploadProto(ctx, env.GetByteStreamClient(), "", repb.DigestFunction_SHA256, action)
+			require.NoError(t, err)
+			arn := digest.NewResourceName(ad, "", rspb.CacheType_CAS, repb.DigestFunction_SHA256)
+
+			taskID, err := env.GetRemoteExecutionService().Dispatch(ctx, &repb.ExecuteRequest{ActionDigest: ad})
+			require.NoError(t, err)
+
+			// Identical requests should only find the execution to merge with
+			// if merging is enabled.
+			pendingID, _, err := action_merger.FindPendingExecution(ctx, env.GetRemoteExecutionRedisClient(), env.GetSchedulerService(), arn)
+			require.NoError(t, err)
+			if tc.wantRecorded {
+				assert.Equal(t, taskID, pendingID)
+			} else {
+				assert.Empty(t, pendingID)
+			}
+		})
+	}
+}
+
+func TestExecute_SchedulingClaims(t *testing.T) {
+	flags.Set(t, "remote_execution.enable_scheduling_claims", true)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	env, conn := setupEnv(t)
+	client := repb.NewExecutionClient(conn)
+	arn := uploadEmptyAction(ctx, t, env, "", repb.DigestFunction_SHA256)
+
+	// Request identical executions at the same time. Only one of them should
+	// be scheduled, and they should all wait on its operation.
+	opNames := make([]string, 10)
+	eg, egCtx := errgroup.WithContext(ctx)
+	for i := range opNames {
+		eg.Go(func() error {
+			stream, err := client.Execute(egCtx, &repb.ExecuteRequest{
+				ActionDigest:   arn.GetDigest(),
+				DigestFunction: arn.GetDigestFunction(),
+			})
+			if err != nil {
+				return err
+			}
+			op, err := stream.Recv()
+			if err != nil {
+				return err
+			}
+			opNames[i] = op.GetName()
+			return nil
+		})
+	}
+	require.NoError(t, eg.Wait())
+
+	sched := env.GetSchedulerService().(*schedulerServerMock)
+	require.Len(t, sched.scheduleReqs, 1)
+	for _, name := range opNames {
+		require.Equal(t, sched.scheduleReqs[0].GetTaskId(), name)
+	}
+}
+
+func TestClaimScheduling_ExpiredClaim(t *testing.T) {
+	flags.Set(t, "remote_execution.enable_scheduling_claims", true)
+	flags.Set(t, "remote_execution.scheduling_claim_ttl", 100*time.Millisecond)
+	env, _ := setupEnv(t)
+	ctx, err := prefix.AttachUserPrefixToContext(context.Background(), env)
+	require.NoError(t, err)
+	rdb := env.GetRemoteExecutionRedisClient()
+	arn := digest.NewResourceName(&repb.Digest{Hash: strings.Repeat("a", 64), SizeBytes: 1}, "", rspb.CacheType_CAS, repb.DigestFunction_SHA256)
+
+	executionID, claim1, err := action_merger.ClaimScheduling(ctx, rdb, env.GetSchedulerService(), arn)
+	require.NoError(t, err)
+	require.Empty(t, executionID)
+	require.NotNil(t, claim1)
+
+	// Once the first claim expires, another caller can claim the action.
+	executionID, claim2, err := action_merger.ClaimScheduling(ctx, rdb, env.GetSchedulerService(), arn)
+	require.NoError(t, err)
+	require.Empty(t, executionID)
+	require.NotNil(t, claim2)
+
+	// Releasing the expired claim shouldn't release the new claim.
+	err = claim1.Unlock(ctx)
+	require.NoError(t, err)
+	claimCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, claim, err := action_merger.ClaimScheduling(claimCtx, rdb, env.GetSchedulerService(), arn)
+	require.Error(t, err)
+	require.Nil(t, claim)
+
+	err = claim2.Unlock(ctx)
+	require.NoError(t, err)
+	_, claim3, err := action_merger.ClaimScheduling(ctx, rdb, env.GetSchedulerService(), arn)
+	require.NoError(t, err)
+	require.NotNil(t, claim3)
+}
+
+func TestDispatch_TimeoutTiers(t *testing.T) {
+	flags.Set(t, "remote_execution.timeout_tiers", []execution_server.TimeoutTier{
+		{Mnemonic: "CppCompile", DefaultTimeout: 5 * time.Minute, MaxTimeout: 10 * time.Minute},
+		{DefaultTimeout: 1 * time.Hour},
+	})
+	env, _ := setupEnv(t)
+	for _, tc := range []struct {
+		name               string
+		mnemonic           string
+		timeout            time.Duration
+		wantDefaultTimeout time.Duration
+		wantErr            bool
+	}{
+		{name: "mnemonic default", mnemonic: "CppCompile", wantDefaultTimeout: 5 * time.Minute},
+		{name: "mnemonic requested timeout", mnemonic: "CppCompile", timeout: 10 * time.Minute},
+		{name: "mnemonic requested timeout too long", mnemonic: "CppCompile", timeout: 11 * time.Minute, wantErr: true},
+		{name: "fallback default", mnemonic: "Javac", wantDefaultTimeout: 1 * time.Hour},
+		{name: "fallback requested timeout", mnemonic: "Javac", timeout: 2 * time.Hour},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := withIncomingMetadata(t, context.Background(), &repb.RequestMetadata{ActionMnemonic: tc.mnemonic})
+			ctx, err := env.GetAuthenticator().(*testauth.TestAuthenticator).WithAuthenticatedUser(ctx, "US1")
+			require.NoError(t, err)
+			ctx, err = prefix.AttachUserPrefixToContext(ctx, env)
+			require.NoError(t, err)
+
+			cd, err := cachetools.UploadProto(ctx, env.GetByteStreamClient(), "", repb.DigestFunction_SHA256, &repb.Command{Arguments: []string{"date"}})
+			require.NoError(t, err)
+			action := &repb.Action{CommandDigest: cd}
+			if tc.timeout > 0 {
+				action.Timeout = dpb.New(tc.timeout)
+			}
+			ad, err := cachetools.UploadProto(ctx, env.GetByteStreamClient(), "", repb.DigestFunction_SHA256, action)
+			require.NoError(t, err)
+
+			sched := env.GetSchedulerService().(*schedulerServerMock)
+			sched.scheduleReqs = nil
+			_, err = env.GetRemoteExecutionService().Dispatch(ctx, &repb.ExecuteRequest{ActionDigest: ad})
+			if tc.wantErr {
+				require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error, got %v", err)
+				return
+			}
+			require.NoError(t, err)
+
+			require.Len(t, sched.scheduleReqs, 1)
+			task := &repb.ExecutionTask{}
+			err = proto.Unmarshal(sched.scheduleReqs[0].SerializedTask, task)
+			require.NoError(t, err)
+			if tc.wantDefaultTimeout > 0 {
+				require.Equal(t, tc.wantDefaultTimeout, task.GetDefaultTimeout().AsDuration())
+			} else {
+				require.Nil(t, task.GetDefaultTimeout())
+			}
+		})
+	}
+}
+
 func TestCancel(t *testing.T) {
 	env, _ := setupEnv(t)
 	ctx := context.Background()
@@ -321,6 +537,169 @@ func TestExecuteAndPublishOperation(t *testing.T) {
 	assert.Empty(t, cmp.Diff(expectedExecuteResponse, cachedExecuteResponse, protocmp.Transform()))
 }
 
+// startSpeculativeExecution starts executing an action that requests
+// speculative execution, marks it as executing, and waits for its hedged
+// copy to be dispatched. It returns the Execute stream, along with the IDs of
+// the original execution and its copy.
+func startSpeculativeExecution(ctx context.Context, t *testing.T, env *testenv.TestEnv, client repb.ExecutionClient) (repb.Execution_ExecuteClient, *digest.ResourceName, string, string) {
+	flags.Set(t, "remote_execution.max_concurrent_speculative_executions_per_group", 1)
+	flags.Set(t, "remote_execution.speculative_execution_min_samples", 1)
+	// Record a fast previous execution, so that the action is copied as soon
+	// as it starts executing.
+	err := env.GetRemoteExecutionRedisClient().LPush(ctx, "speculativeExecution/durations/GR1/Javac", 1).Err()
+	require.NoError(t, err)
+
+	arn := uploadAction(ctx, t, env, "", repb.DigestFunction_SHA256, &repb.Platform{
+		Properties: []*repb.Platform_Property{{Name: "speculative-execution", Value: "true"}},
+	})
+	stream, err := client.Execute(ctx, &repb.ExecuteRequest{
+		ActionDigest:   arn.GetDigest(),
+		DigestFunction: arn.GetDigestFunction(),
+	})
+	require.NoError(t, err)
+	op, err := stream.Recv()
+	require.NoError(t, err)
+	originalID := op.GetName()
+
+	publishOperation(ctx, t, client, repb.ExecutionStage_EXECUTING, originalID, arn, operation.InProgressExecuteResponse())
+	sched := env.GetSchedulerService().(*schedulerServerMock)
+	require.Eventually(t, func() bool {
+		return len(sched.getScheduleReqs()) == 2
+	}, 10*time.Second, 10*time.Millisecond)
+	hedge := sched.getScheduleReqs()[1]
+	// The copy must not run on the executor running the original.
+	require.Equal(t, originalID, hedge.GetMetadata().GetHedgedTaskId())
+	return stream, arn, originalID, hedge.GetTaskId()
+}
+
+func publishOperation(ctx context.Context, t *testing.T, client repb.ExecutionClient, stage repb.ExecutionStage_Value, taskID string, arn *digest.ResourceName, rsp *repb.ExecuteResponse) {
+	stream, err := client.PublishOperation(ctx)
+	require.NoError(t, err)
+	op, err := operation.Assemble(stage, taskID, arn, rsp)
+	require.NoError(t, err)
+	err = stream.Send(op)
+	require.NoError(t, err)
+	_, err = stream.CloseAndRecv()
+	require.NoError(t, err)
+}
+
+// waitForResult returns the result of the execution streamed back on an
+// Execute stream.
+func waitForResult(t *testing.T, stream repb.Execution_ExecuteClient) *repb.ExecuteResponse {
+	for {
+		op, err := stream.Recv()
+		require.NoError(t, err)
+		if operation.ExtractStage(op) == repb.ExecutionStage_COMPLETED {
+			return operation.ExtractExecuteResponse(op)
+		}
+	}
+}
+
+func speculativeExecutionContext(t *testing.T) context.Context {
+	ctx := metadata.AppendToOutgoingContext(context.Background(), testauth.APIKeyHeader, "US1")
+	ctx, err := bazel_request.WithRequestMetadata(ctx, &repb.RequestMetadata{
+		ToolInvocationId: "93383cc1-5d6c-4ad1-a321-8ee87c2f6816",
+		ActionMnemonic:   "Javac",
+	})
+	require.NoError(t, err)
+	return ctx
+}
+
+func TestSpeculativeExecution_HedgeWins(t *testing.T) {
+	ctx := speculativeExecutionContext(t)
+	env, conn := setupEnv(t)
+	client := repb.NewExecutionClient(conn)
+	stream, arn, originalID, hedgeID := startSpeculativeExecution(ctx, t, env, client)
+
+	hedgeResult := &repb.ActionResult{StdoutRaw: []byte("hedge")}
+	publishOperation(ctx, t, client, repb.ExecutionStage_COMPLETED, hedgeID, arn, operation.ExecuteResponseWithResult(hedgeResult, nil))
+
+	// The original execution completes with the copy's result, and is
+	// canceled.
+	rsp := waitForResult(t, stream)
+	assert.Empty(t, cmp.Diff(hedgeResult, rsp.GetResult(), protocmp.Transform()))
+	sched := env.GetSchedulerService().(*schedulerServerMock)
+	require.Eventually(t, func() bool {
+		return slices.Contains(sched.getCanceledTaskIDs(), originalID)
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.NotContains(t, sched.getCanceledTaskIDs(), hedgeID)
+}
+
+func TestSpeculativeExecution_OriginalWins(t *testing.T) {
+	ctx := speculativeExecutionContext(t)
+	env, conn := setupEnv(t)
+	client := repb.NewExecutionClient(conn)
+	stream, arn, originalID, hedgeID := startSpeculativeExecution(ctx, t, env, client)
+
+	originalResult := &repb.ActionResult{StdoutRaw: []byte("original")}
+	publishOperation(ctx, t, client, repb.ExecutionStage_COMPLETED, originalID, arn, operation.ExecuteResponseWithResult(originalResult, nil))
+
+	// The copy is canceled once the original finishes first.
+	rsp := waitForResult(t, stream)
+	assert.Empty(t, cmp.Diff(originalResult, rsp.GetResult(), protocmp.Transform()))
+	sched := env.GetSchedulerService().(*schedulerServerMock)
+	require.Eventually(t, func() bool {
+		return slices.Contains(sched.getCanceledTaskIDs(), hedgeID)
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.NotContains(t, sched.getCanceledTaskIDs(), originalID)
+}
+
+func TestBatchExecute(t *testing.T) {
+	ctx := context.Background()
+	env, conn := setupEnv(t)
+	client := repb.NewExecutionClient(conn)
+
+	const instanceName = "test-instance"
+	const digestFunction = repb.DigestFunction_SHA256
+
+	// Upload an action with a cached result, and refer to an action that
+	// doesn't exist, which can't be executed.
+	arn := uploadEmptyAction(ctx, t, env, instanceName, digestFunction)
+	actionResult := &repb.ActionResult{ExitCode: 42}
+	acrn := digest.NewResourceName(arn.GetDigest(), instanceName, rspb.CacheType_AC, digestFunction)
+	err := cachetools.UploadActionResult(ctx, env.GetActionCacheClient(), acrn, actionResult)
+	require.NoError(t, err)
+	missingDigest := &repb.Digest{Hash: strings.Repeat("a", 64), SizeBytes: 10}
+
+	stream, err := client.BatchExecute(ctx, &repb.BatchExecuteRequest{
+		InstanceName:   instanceName,
+		ActionDigests:  []*repb.Digest{arn.GetDigest(), missingDigest},
+		DigestFunction: digestFunction,
+	})
+	require.NoError(t, err)
+	responses := map[int32]*repb.BatchExecuteResponse{}
+	for {
+		rsp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		responses[rsp.GetIndex()] = rsp
+	}
+	require.Len(t, responses, 2)
+
+	assert.NotEmpty(t, responses[0].GetOperationName())
+	assert.True(t, responses[0].GetResponse().GetCachedResult())
+	assert.Empty(t, cmp.Diff(actionResult, responses[0].GetResponse().GetResult(), protocmp.Transform()))
+
+	assert.NotEqual(t, int32(codes.OK), responses[1].GetResponse().GetStatus().GetCode())
+}
+
+func TestBatchExecute_TooManyActions(t *testing.T) {
+	flags.Set(t, "remote_execution.max_batch_execute_actions", 1)
+	ctx := context.Background()
+	env, conn := setupEnv(t)
+	client := repb.NewExecutionClient(conn)
+
+	arn := uploadEmptyAction(ctx, t, env, "", repb.DigestFunction_SHA256)
+	stream, err := client.BatchExecute(ctx, &repb.BatchExecuteRequest{
+		ActionDigests: []*repb.Digest{arn.GetDigest(), arn.GetDigest()},
+	})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error, got %v", err)
+}
+
 func TestMarkFailed(t *testing.T) {
 	env, _ := setupEnv(t)
 	ctx := context.Background()
@@ -370,11 +749,85 @@ func TestMarkFailed(t *testing.T) {
 
 }
 
+func TestExecutionOutputStreaming(t *testing.T) {
+	_, conn := setupEnv(t)
+	ctx := context.Background()
+	executionClient := repb.NewExecutionClient(conn)
+	bsClient := bspb.NewByteStreamClient(conn)
+
+	executionID := "test-instance-name/uploads/1797f326-0cd2-45d2-9ad4-f766fd81f2dc/blobs/1111111111111111111111111111111111111111111111111111111111111111/100"
+	stdoutName := execution_output.StreamName(executionID, execution_output.Stdout)
+	stderrName := execution_output.StreamName(executionID, execution_output.Stderr)
+
+	// Output can't be read before the executor starts publishing it.
+	_, err := readExecutionOutput(ctx, bsClient, &bspb.ReadRequest{ResourceName: stdoutName})
+	require.True(t, status.IsNotFoundError(err), "error should be NotFoundError, but was %s", err)
+
+	publisher, err := operation.PublishOutput(ctx, executionClient, executionID, 10*time.Millisecond)
+	require.NoError(t, err)
+	_, err = publisher.Stdout().Write([]byte("hello "))
+	require.NoError(t, err)
+	_, err = publisher.Stderr().Write([]byte("warning"))
+	require.NoError(t, err)
+
+	// Start reading while the execution is still in progress.
+	var streamed string
+	var streamErr error
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		for {
+			streamed, streamErr = readExecutionOutput(ctx, bsClient, &bspb.ReadRequest{ResourceName: stdoutName})
+			if !status.IsNotFoundError(streamErr) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	_, err = publisher.Stdout().Write([]byte("world"))
+	require.NoError(t, err)
+	publisher.Close()
+
+	<-readDone
+	require.NoError(t, streamErr)
+	assert.Equal(t, "hello world", streamed)
+	out, err := readExecutionOutput(ctx, bsClient, &bspb.ReadRequest{ResourceName: stderrName})
+	require.NoError(t, err)
+	assert.Equal(t, "warning", out)
+	out, err = readExecutionOutput(ctx, bsClient, &bspb.ReadRequest{ResourceName: stdoutName, ReadOffset: 3, ReadLimit: 5})
+	require.NoError(t, err)
+	assert.Equal(t, "lo wo", out)
+}
+
+func readExecutionOutput(ctx context.Context, client bspb.ByteStreamClient, req *bspb.ReadRequest) (string, error) {
+	stream, err := client.Read(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	out := ""
+	for {
+		rsp, err := stream.Recv()
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		out += string(rsp.GetData())
+	}
+}
+
 func uploadEmptyAction(ctx context.Context, t *testing.T, env *real_environment.RealEnv, instanceName string, df repb.DigestFunction_Value) *digest.ResourceName {
+	return uploadAction(ctx, t, env, instanceName, df, nil /*=platform*/)
+}
+
+func uploadAction(ctx context.Context, t *testing.T, env *real_environment.RealEnv, instanceName string, df repb.DigestFunction_Value, platform *repb.Platform) *digest.ResourceName {
 	cmd := &repb.Command{Arguments: []string{"test"}}
 	cd, err := cachetools.UploadProto(ctx, env.GetByteStreamClient(), instanceName, df, cmd)
 	require.NoError(t, err)
-	action := &repb.Action{CommandDigest: cd}
+	action := &repb.Action{CommandDigest: cd, Platform: platform}
 	ad, err := cachetools.UploadProto(ctx, env.GetByteStreamClient(), instanceName, df, action)
 	require.NoError(t, err)
 	return digest.NewResourceName(ad, instanceName, rspb.CacheType_CAS, df)
@@ -0,0 +1,316 @@
+package execution_server
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/pubsub"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/operation"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/util/background"
+	"github.com/buildbuddy-io/buildbuddy/server/util/bazel_request"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/genproto/googleapis/longrunning"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
+)
+
+var (
+	maxConcurrentSpeculativeExecutions = flag.Int("remote_execution.max_concurrent_speculative_executions_per_group", 0, "The maximum number of speculative copies of slow actions (requested with the speculative-execution platform property) that each group may have running at once. If 0, actions are never executed speculatively.")
+	speculativeExecutionPercentile     = flag.Float64("remote_execution.speculative_execution_percentile", 95, "Actions requesting speculative execution are copied once they've been executing for longer than this percentile of recent execution durations for the same mnemonic.")
+	speculativeExecutionMinSamples     = flag.Int("remote_execution.speculative_execution_min_samples", 20, "The number of recent executions of a mnemonic that are needed before its actions are executed speculatively.")
+)
+
+const (
+	// The number of recent execution durations kept per group and mnemonic.
+	speculativeExecutionDurationSamples = 200
+	// How long execution durations are kept after the last execution of a
+	// mnemonic.
+	speculativeExecutionDurationsTTL = 24 * time.Hour
+	// How long the count of a group's running speculative executions is kept
+	// after it's last updated, so that counts leaked by crashed apps expire.
+	speculativeExecutionCountTTL = 1 * time.Hour
+
+	speculativeExecutionHedgeWon    = "hedge_won"
+	speculativeExecutionOriginalWon = "original_won"
+	speculativeExecutionHedgeFailed = "hedge_failed"
+	speculativeExecutionCapped      = "capped"
+)
+
+func redisKeyForExecutionDurations(groupID, mnemonic string) string {
+	return fmt.Sprintf("speculativeExecution/durations/%s/%s", groupID, mnemonic)
+}
+
+func redisKeyForSpeculativeExecutionCount(groupID string) string {
+	return fmt.Sprintf("speculativeExecution/count/%s", groupID)
+}
+
+// monitorSpeculativeExecution watches a newly dispatched execution, and if it
+// requested speculative execution and runs for longer than is usual for its
+// mnemonic, runs a second copy of it and completes the execution with the
+// result of whichever copy finishes first. It returns once the execution is
+// complete, or the client stops waiting for it.
+func (s *ExecutionServer) monitorSpeculativeExecution(ctx context.Context, req *repb.ExecuteRequest, executionID string) {
+	if *maxConcurrentSpeculativeExecutions <= 0 || s.rdb == nil {
+		return
+	}
+	mnemonic := bazel_request.GetRequestMetadata(ctx).GetActionMnemonic()
+	if mnemonic == "" {
+		return
+	}
+	// Speculative executions are capped per group, so they aren't run for
+	// anonymous users.
+	user, err := s.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return
+	}
+	groupID := user.GetGroupID()
+	adResource := digest.NewResourceName(req.GetActionDigest(), req.GetInstanceName(), rspb.CacheType_CAS, req.GetDigestFunction())
+	action, cmd, err := s.fetchActionAndCommand(ctx, adResource)
+	if err != nil {
+		log.CtxWarningf(ctx, "Could not read action for speculative execution: %s", err)
+		return
+	}
+	props, err := platform.ParseProperties(&repb.ExecutionTask{Action: action, Command: cmd})
+	if err != nil || !props.SpeculativeExecution {
+		return
+	}
+	threshold, ok, err := s.speculativeExecutionThreshold(ctx, groupID, mnemonic)
+	if err != nil {
+		log.CtxWarningf(ctx, "Could not compute speculative execution threshold for mnemonic %q: %s", mnemonic, err)
+		return
+	}
+
+	original := s.streamPubSub.SubscribeHead(ctx, s.pubSubChannelForExecutionID(executionID))
+	defer original.Close()
+	var slow <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-slow:
+			s.runSpeculativeExecution(ctx, req, executionID, adResource, groupID, original)
+			return
+		case msg, open := <-original.Chan():
+			if !open || msg.Err != nil {
+				return
+			}
+			op, err := operation.Decode(msg.Data)
+			if err != nil {
+				continue
+			}
+			switch operation.ExtractStage(op) {
+			case repb.ExecutionStage_EXECUTING:
+				if ok && slow == nil {
+					slow = time.After(threshold)
+				}
+			case repb.ExecutionStage_COMPLETED:
+				s.recordExecutionDuration(ctx, groupID, mnemonic, operation.ExtractExecuteResponse(op))
+				return
+			}
+		}
+	}
+}
+
+// runSpeculativeExecution runs a copy of a slow execution, and completes the
+// execution with the result of whichever of the original and the copy
+// finishes first, canceling the other.
+func (s *ExecutionServer) runSpeculativeExecution(ctx context.Context, req *repb.ExecuteRequest, executionID string, adResource *digest.ResourceName, groupID string, original *pubsub.StreamSubscription) {
+	if !s.acquireSpeculativeExecution(ctx, groupID) {
+		recordSpeculativeExecutionOutcome(groupID, speculativeExecutionCapped)
+		return
+	}
+	// Clean up even if the client stops waiting, so that the copy doesn't
+	// keep running, and the group's count of running copies stays accurate.
+	defer func() {
+		ctx, cancel := background.ExtendContextForFinalization(ctx, 10*time.Second)
+		defer cancel()
+		if err := s.rdb.Decr(ctx, redisKeyForSpeculativeExecutionCount(groupID)).Err(); err != nil {
+			log.CtxWarningf(ctx, "Could not release speculative execution for group %q: %s", groupID, err)
+		}
+	}()
+
+	hedgeID, err := s.dispatchHedge(ctx, req, executionID)
+	if err != nil {
+		log.CtxWarningf(ctx, "Could not dispatch speculative execution: %s", err)
+		return
+	}
+	log.CtxInfof(ctx, "Execution %q is slow, dispatched speculative execution %q", executionID, hedgeID)
+	hedge := s.streamPubSub.SubscribeHead(ctx, s.pubSubChannelForExecutionID(hedgeID))
+	defer hedge.Close()
+	hedgeChan := hedge.Chan()
+	for {
+		select {
+		case <-ctx.Done():
+			s.cancelLoser(ctx, hedgeID)
+			return
+		case msg, open := <-original.Chan():
+			if !open || msg.Err != nil {
+				s.cancelLoser(ctx, hedgeID)
+				return
+			}
+			if op, err := operation.Decode(msg.Data); err == nil && operation.ExtractStage(op) == repb.ExecutionStage_COMPLETED {
+				log.CtxInfof(ctx, "Execution %q finished before speculative execution %q", executionID, hedgeID)
+				recordSpeculativeExecutionOutcome(groupID, speculativeExecutionOriginalWon)
+				s.cancelLoser(ctx, hedgeID)
+				return
+			}
+		case msg, open := <-hedgeChan:
+			if !open || msg.Err != nil {
+				hedgeChan = nil
+				continue
+			}
+			op, err := operation.Decode(msg.Data)
+			if err != nil || operation.ExtractStage(op) != repb.ExecutionStage_COMPLETED {
+				continue
+			}
+			rsp := operation.ExtractExecuteResponse(op)
+			if rsp == nil || rsp.GetStatus().GetCode() != 0 {
+				// Let the original execution finish instead.
+				log.CtxInfof(ctx, "Speculative execution %q failed: %v", hedgeID, rsp.GetStatus())
+				recordSpeculativeExecutionOutcome(groupID, speculativeExecutionHedgeFailed)
+				hedgeChan = nil
+				continue
+			}
+			log.CtxInfof(ctx, "Speculative execution %q finished before execution %q", hedgeID, executionID)
+			if err := s.completeWithSpeculativeResult(ctx, executionID, adResource, rsp); err != nil {
+				log.CtxWarningf(ctx, "Could not complete execution %q with speculative result: %s", executionID, err)
+				return
+			}
+			recordSpeculativeExecutionOutcome(groupID, speculativeExecutionHedgeWon)
+			s.cancelLoser(ctx, executionID)
+			return
+		}
+	}
+}
+
+// completeWithSpeculativeResult completes the execution with the response of
+// its speculative copy, as if the execution had returned it.
+func (s *ExecutionServer) completeWithSpeculativeResult(ctx context.Context, executionID string, adResource *digest.ResourceName, rsp *repb.ExecuteResponse) error {
+	// Clients stop waiting as soon as the result is published, which cancels
+	// ctx, so make sure the execution is still updated afterwards.
+	ctx, cancel := background.ExtendContextForFinalization(ctx, updateExecutionTimeout)
+	defer cancel()
+	op, err := operation.Assemble(repb.ExecutionStage_COMPLETED, executionID, adResource, rsp)
+	if err != nil {
+		return err
+	}
+	if err := s.publishOperation(ctx, executionID, op); err != nil {
+		return err
+	}
+	if err := s.updateExecution(ctx, executionID, repb.ExecutionStage_COMPLETED, rsp); err != nil {
+		return err
+	}
+	if err := s.cacheExecuteResponse(ctx, executionID, rsp); err != nil {
+		log.CtxWarningf(ctx, "Failed to cache execute response for execution %q: %s", executionID, err)
+	}
+	return nil
+}
+
+func (s *ExecutionServer) publishOperation(ctx context.Context, executionID string, op *longrunning.Operation) error {
+	data, err := proto.Marshal(op)
+	if err != nil {
+		return err
+	}
+	return s.streamPubSub.Publish(ctx, s.pubSubChannelForExecutionID(executionID), base64.StdEncoding.EncodeToString(data))
+}
+
+func (s *ExecutionServer) cancelLoser(ctx context.Context, executionID string) {
+	ctx, cancel := background.ExtendContextForFinalization(ctx, 10*time.Second)
+	defer cancel()
+	if _, err := s.env.GetSchedulerService().CancelTask(ctx, executionID); err != nil {
+		log.CtxWarningf(ctx, "Could not cancel execution %q: %s", executionID, err)
+	}
+}
+
+// acquireSpeculativeExecution reserves one of the group's speculative
+// executions, returning false if they're all in use. The caller must release
+// the reservation by decrementing the group's count.
+func (s *ExecutionServer) acquireSpeculativeExecution(ctx context.Context, groupID string) bool {
+	key := redisKeyForSpeculativeExecutionCount(groupID)
+	pipe := s.rdb.TxPipeline()
+	incr := pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, speculativeExecutionCountTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.CtxWarningf(ctx, "Could not acquire speculative execution for group %q: %s", groupID, err)
+		return false
+	}
+	if incr.Val() > int64(*maxConcurrentSpeculativeExecutions) {
+		if err := s.rdb.Decr(ctx, key).Err(); err != nil {
+			log.CtxWarningf(ctx, "Could not release speculative execution for group %q: %s", groupID, err)
+		}
+		return false
+	}
+	return true
+}
+
+// recordExecutionDuration records how long a successful execution of the
+// mnemonic took to run.
+func (s *ExecutionServer) recordExecutionDuration(ctx context.Context, groupID, mnemonic string, rsp *repb.ExecuteResponse) {
+	if rsp.GetStatus().GetCode() != 0 || rsp.GetCachedResult() {
+		return
+	}
+	dur, err := executionDuration(rsp.GetResult().GetExecutionMetadata())
+	if err != nil {
+		return
+	}
+	// The client may stop waiting as soon as the execution completes.
+	ctx, cancel := background.ExtendContextForFinalization(ctx, 5*time.Second)
+	defer cancel()
+	key := redisKeyForExecutionDurations(groupID, mnemonic)
+	pipe := s.rdb.TxPipeline()
+	pipe.LPush(ctx, key, dur.Milliseconds())
+	pipe.LTrim(ctx, key, 0, speculativeExecutionDurationSamples-1)
+	pipe.Expire(ctx, key, speculativeExecutionDurationsTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.CtxWarningf(ctx, "Could not record execution duration for mnemonic %q: %s", mnemonic, err)
+	}
+}
+
+// speculativeExecutionThreshold returns how long the mnemonic's actions may
+// execute before they're copied, or false if there aren't enough recent
+// executions of the mnemonic to tell.
+func (s *ExecutionServer) speculativeExecutionThreshold(ctx context.Context, groupID, mnemonic string) (time.Duration, bool, error) {
+	vals, err := s.rdb.LRange(ctx, redisKeyForExecutionDurations(groupID, mnemonic), 0, -1).Result()
+	if err != nil {
+		return 0, false, err
+	}
+	durations := make([]time.Duration, 0, len(vals))
+	for _, v := range vals {
+		ms, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			continue
+		}
+		durations = append(durations, time.Duration(ms)*time.Millisecond)
+	}
+	if len(durations) == 0 || len(durations) < *speculativeExecutionMinSamples {
+		return 0, false, nil
+	}
+	return durationPercentile(durations, *speculativeExecutionPercentile), true, nil
+}
+
+// durationPercentile returns the p-th percentile of the durations, using the
+// nearest-rank method.
+func durationPercentile(durations []time.Duration, p float64) time.Duration {
+	sorted := slices.Sorted(slices.Values(durations))
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[min(max(rank-1, 0), len(sorted)-1)]
+}
+
+func recordSpeculativeExecutionOutcome(groupID, outcome string) {
+	metrics.RemoteExecutionSpeculativeExecutions.With(prometheus.Labels{
+		metrics.GroupID:                          groupID,
+		metrics.SpeculativeExecutionOutcomeLabel: outcome,
+	}).Inc()
+}
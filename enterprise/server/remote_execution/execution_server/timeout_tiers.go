@@ -0,0 +1,70 @@
+package execution_server
+
+import (
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+var (
+	timeoutTiers = flag.Slice("remote_execution.timeout_tiers", []TimeoutTier{}, "Default and maximum timeouts for actions with a given mnemonic, or scheduled on a given pool. Each action uses the first tier that matches it. Actions that don't match any tier use the executor's default and maximum timeouts.")
+)
+
+// TimeoutTier configures the timeouts of the actions that it matches.
+type TimeoutTier struct {
+	Mnemonic       string        `yaml:"mnemonic" json:"mnemonic" usage:"The action mnemonic that the tier applies to, such as CppCompile. If empty, the tier applies to all mnemonics."`
+	Pool           string        `yaml:"pool" json:"pool" usage:"The executor pool that the tier applies to. If empty, the tier applies to all pools."`
+	DefaultTimeout time.Duration `yaml:"default_timeout" json:"default_timeout" usage:"The timeout of matching actions that don't request a timeout. If 0, the executor's default timeout is used."`
+	MaxTimeout     time.Duration `yaml:"max_timeout" json:"max_timeout" usage:"The longest timeout that matching actions may request. Actions requesting longer timeouts are rejected. If 0, only the executor's maximum timeout applies."`
+}
+
+func (t *TimeoutTier) matches(mnemonic, pool string) bool {
+	if t.Mnemonic != "" && t.Mnemonic != mnemonic {
+		return false
+	}
+	if t.Pool != "" && !strings.EqualFold(t.Pool, pool) {
+		return false
+	}
+	return true
+}
+
+func findTimeoutTier(mnemonic, pool string) (TimeoutTier, bool) {
+	for _, tier := range *timeoutTiers {
+		if tier.matches(mnemonic, pool) {
+			return tier, true
+		}
+	}
+	return TimeoutTier{}, false
+}
+
+// applyTimeoutTier applies the timeouts of the tier that matches the task,
+// if any: it checks that the task doesn't request a longer timeout than the
+// tier allows, and otherwise sets the task's default timeout.
+func applyTimeoutTier(task *repb.ExecutionTask, props *platform.Properties, pool string) error {
+	tier, ok := findTimeoutTier(task.GetRequestMetadata().GetActionMnemonic(), pool)
+	if !ok {
+		return nil
+	}
+	// The timeout can be requested either by the action itself (e.g.
+	// --test_timeout for test actions), or by platform properties.
+	requested := task.GetAction().GetTimeout().AsDuration()
+	if requested <= 0 {
+		requested = props.DefaultTimeout
+	}
+	if requested <= 0 {
+		if tier.DefaultTimeout > 0 {
+			task.DefaultTimeout = durationpb.New(tier.DefaultTimeout)
+		}
+		return nil
+	}
+	if tier.MaxTimeout > 0 && requested > tier.MaxTimeout {
+		return status.InvalidArgumentErrorf("requested timeout (%s) is longer than the maximum allowed for this action (%s)", requested, tier.MaxTimeout)
+	}
+	return nil
+}
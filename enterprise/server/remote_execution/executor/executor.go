@@ -26,6 +26,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/tracing"
 	"github.com/prometheus/client_golang/prometheus"
 	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
@@ -46,6 +47,7 @@ var (
 	slowTaskThreshold          = flag.Duration("executor.slow_task_threshold", 1*time.Hour, "Warn about tasks that take longer than this threshold.")
 	defaultTerminationGrace    = flag.Duration("executor.default_termination_grace_period", 0, "Default termination grace period for all actions. (Termination grace period is the time to wait between an action timing out and forcefully shutting it down.)")
 	maxTerminationGracePeriod  = flag.Duration("executor.max_termination_grace_period", 1*time.Minute, "Max termination grace period that actions can request. An error will be returned if a task requests a grace period greater than this value. (Termination grace period is the time to wait between an action timing out and forcefully shutting it down.)")
+	publishExecutionOutput     = flag.Bool("executor.publish_execution_output", false, "If true, the stdout and stderr of running actions are published to the app as they're written, so that clients can stream them before the action completes.")
 )
 
 const (
@@ -53,6 +55,10 @@ const (
 	// The deadline of the original request may be extended by up to this amount
 	// in order to give enough time to upload action outputs.
 	uploadDeadlineExtension = time.Minute * 1
+
+	// How often the output of running actions is published, if
+	// executor.publish_execution_output is enabled.
+	executionOutputPublishInterval = 1 * time.Second
 )
 
 type Executor struct {
@@ -96,6 +102,10 @@ type executionTimeouts struct {
 
 	// ForceKillAfter specifies when the task gets forcefully shut down.
 	ForceKillAfter time.Duration
+
+	// DefaultTimeout is the default timeout that was applied to the task, or
+	// 0 if the task requested its own timeout.
+	DefaultTimeout time.Duration
 }
 
 func parseTimeouts(task *repb.ExecutionTask) (*executionTimeouts, error) {
@@ -111,9 +121,17 @@ func parseTimeouts(task *repb.ExecutionTask) (*executionTimeouts, error) {
 	if timeout <= 0 {
 		timeout = props.DefaultTimeout
 	}
+	defaultTimeout := time.Duration(0)
+	// Fall back to the default configured for the task's mnemonic or pool in
+	// the app, if any.
+	if timeout <= 0 {
+		timeout = task.GetDefaultTimeout().AsDuration()
+		defaultTimeout = timeout
+	}
 	// Fall back to the configured default.
 	if timeout <= 0 {
 		timeout = *defaultTaskTimeout
+		defaultTimeout = timeout
 	}
 	// Enforce the configured max timeout by returning an error if the requested
 	// timeout is too long.
@@ -131,6 +149,7 @@ func parseTimeouts(task *repb.ExecutionTask) (*executionTimeouts, error) {
 	timeouts := &executionTimeouts{
 		TerminateAfter: timeout,
 		ForceKillAfter: timeout + props.TerminationGracePeriod,
+		DefaultTimeout: defaultTimeout,
 	}
 
 	return timeouts, nil
@@ -150,7 +169,18 @@ func isClientBazel(task *repb.ExecutionTask) bool {
 	return !platform.IsCICommand(task.GetCommand(), platform.GetProto(task.GetAction(), task.GetCommand()))
 }
 
-func shouldRetry(task *repb.ExecutionTask, taskError error) bool {
+// isInfrastructureFailure returns whether the error was caused by a problem
+// with the executor rather than with the action, such as the executor failing
+// to fetch inputs, a VM or container failing to start, or the host running out
+// of memory. Such tasks may succeed if retried on another executor.
+func isInfrastructureFailure(err error) bool {
+	return status.IsUnavailableError(err) ||
+		status.IsInternalError(err) ||
+		status.IsResourceExhaustedError(err) ||
+		status.IsAbortedError(err)
+}
+
+func shouldRetry(st *repb.ScheduledTask, taskError error) bool {
 	// If the task is invalid / misconfigured, more attempts won't help.
 	if isTaskMisconfigured(taskError) {
 		return false
@@ -160,11 +190,19 @@ func shouldRetry(task *repb.ExecutionTask, taskError error) bool {
 		return false
 	}
 	// Bazel has retry functionality built in, so if we know the client is Bazel,
-	// let Bazel retry it instead of us doing it.
-	return !isClientBazel(task)
+	// let Bazel retry it instead of us doing it, unless we've been asked to
+	// retry infrastructure failures transparently.
+	if isClientBazel(st.GetExecutionTask()) {
+		return st.GetSchedulingMetadata().GetRetryInfrastructureFailures() && isInfrastructureFailure(taskError)
+	}
+	return true
 }
 
-func (s *Executor) ExecuteTaskAndStreamResults(ctx context.Context, st *repb.ScheduledTask, stream *operation.Publisher) (retry bool, err error) {
+// ExecuteTaskAndStreamResults executes the task, publishing its progress and
+// result to the stream. If the runner tracks which inputs the task's command
+// read, they're passed to recordAccessedInputs (if non-nil) once the command
+// exits.
+func (s *Executor) ExecuteTaskAndStreamResults(ctx context.Context, st *repb.ScheduledTask, stream *operation.Publisher, recordAccessedInputs func([]*scpb.TaskInput)) (retry bool, err error) {
 	// From here on in we use these liberally, so check that they are setup properly
 	// in the environment.
 	if s.env.GetActionCacheClient() == nil || s.env.GetByteStreamClient() == nil || s.env.GetContentAddressableStorageClient() == nil {
@@ -207,9 +245,10 @@ func (s *Executor) ExecuteTaskAndStreamResults(ctx context.Context, st *repb.Sch
 		IoStats:                  &repb.IOStats{},
 		EstimatedTaskSize:        st.GetSchedulingMetadata().GetTaskSize(),
 		DoNotCache:               task.GetAction().GetDoNotCache(),
+		RetryCount:               st.GetSchedulingMetadata().GetRetryCount(),
 	}
 	finishWithErrFn := func(finalErr error) (retry bool, err error) {
-		if shouldRetry(task, finalErr) {
+		if shouldRetry(st, finalErr) {
 			return true, finalErr
 		}
 		resp := operation.ErrorResponse(finalErr)
@@ -243,12 +282,22 @@ func (s *Executor) ExecuteTaskAndStreamResults(ctx context.Context, st *repb.Sch
 		}
 	}
 
+	// Prefetch the inputs that the task is likely to read while the runner is
+	// set up (which may involve pulling an image or booting a VM).
+	prefetchCtx, cancelPrefetch := context.WithCancel(ctx)
+	defer cancelPrefetch()
+	s.prefetchHotInputs(prefetchCtx, st)
+
 	log.CtxDebugf(ctx, "Getting a runner for task.")
 	r, err := s.runnerPool.Get(ctx, st)
 	if err != nil {
 		return finishWithErrFn(status.WrapErrorf(err, "error creating runner for command"))
 	}
 	actionMetrics.Isolation = r.GetIsolationType()
+	isolationWarning := platform.IsolationFallbackWarning(task, r.GetIsolationType())
+	if isolationWarning != "" {
+		log.CtxWarning(ctx, isolationWarning)
+	}
 	finishedCleanly := false
 	defer func() {
 		// Note: recycling is done in the foreground here in order to ensure
@@ -274,6 +323,8 @@ func (s *Executor) ExecuteTaskAndStreamResults(ctx context.Context, st *repb.Sch
 	if err := r.DownloadInputs(ctx, md.IoStats); err != nil {
 		return finishWithErrFn(err)
 	}
+	// Prefetching is no longer useful once the inputs are downloaded.
+	cancelPrefetch()
 
 	md.InputFetchCompletedTimestamp = timestamppb.Now()
 	md.ExecutionStartTimestamp = timestamppb.Now()
@@ -282,6 +333,24 @@ func (s *Executor) ExecuteTaskAndStreamResults(ctx context.Context, st *repb.Sch
 		// These errors are failure-specific. Pass through unchanged.
 		return finishWithErrFn(err)
 	}
+	if execTimeouts.DefaultTimeout > 0 {
+		md.DefaultTimeout = durationpb.New(execTimeouts.DefaultTimeout)
+	}
+
+	// Output is published using the task's context rather than the command's,
+	// so that output written just before the command times out can still be
+	// published.
+	var liveOutput *interfaces.Stdio
+	var outputPublisher *operation.OutputPublisher
+	if *publishExecutionOutput && s.env.GetRemoteExecutionClient() != nil {
+		outputPublisher, err = operation.PublishOutput(ctx, s.env.GetRemoteExecutionClient(), taskID, executionOutputPublishInterval)
+		if err != nil {
+			log.CtxWarningf(ctx, "Could not start publishing output, it won't be streamed: %s", err)
+		} else {
+			stream.SetOutputStreamed()
+			liveOutput = &interfaces.Stdio{Stdout: outputPublisher.Stdout(), Stderr: outputPublisher.Stderr()}
+		}
+	}
 
 	now := time.Now()
 	terminateAt := now.Add(execTimeouts.TerminateAfter)
@@ -314,7 +383,7 @@ func (s *Executor) ExecuteTaskAndStreamResults(ctx context.Context, st *repb.Sch
 	_ = stream.SetState(repb.ExecutionProgress_EXECUTING_COMMAND)
 	cmdResultChan := make(chan *interfaces.CommandResult, 1)
 	go func() {
-		cmdResultChan <- r.Run(ctx)
+		cmdResultChan <- r.Run(ctx, liveOutput)
 	}()
 
 	// Run a timer that periodically sends update messages back
@@ -332,6 +401,11 @@ func (s *Executor) ExecuteTaskAndStreamResults(ctx context.Context, st *repb.Sch
 			}
 		}
 	}
+	// Finish publishing output before the execution can complete, so that
+	// clients streaming it see all of it.
+	if outputPublisher != nil {
+		outputPublisher.Close()
+	}
 
 	if cmdResult.ExitCode != 0 {
 		log.CtxDebugf(ctx, "%q finished with non-zero exit code (%d). Err: %s, Stdout: %s, Stderr: %s", taskID, cmdResult.ExitCode, cmdResult.Error, cmdResult.Stdout, cmdResult.Stderr)
@@ -353,6 +427,9 @@ func (s *Executor) ExecuteTaskAndStreamResults(ctx context.Context, st *repb.Sch
 	if cmdResult.Error != nil {
 		log.CtxWarningf(ctx, "Command execution returned error: %s", cmdResult.Error)
 	}
+	if recordAccessedInputs != nil && len(cmdResult.AccessedInputs) > 0 {
+		recordAccessedInputs(taskInputs(cmdResult.AccessedInputs))
+	}
 
 	// Note: we continue to upload outputs, stderr, etc. below even if
 	// cmdResult.Error is present, because these outputs are helpful
@@ -370,6 +447,14 @@ func (s *Executor) ExecuteTaskAndStreamResults(ctx context.Context, st *repb.Sch
 			log.CtxErrorf(ctx, "Could not encode VMMetadata to `any` type: %s", err)
 		}
 	}
+	if cmdResult.NetworkPolicyMetadata != nil {
+		networkPolicyMetadata, err := anypb.New(cmdResult.NetworkPolicyMetadata)
+		if err == nil {
+			md.AuxiliaryMetadata = append(md.AuxiliaryMetadata, networkPolicyMetadata)
+		} else {
+			log.CtxErrorf(ctx, "Could not encode NetworkPolicyMetadata to `any` type: %s", err)
+		}
+	}
 	md.ExecutionCompletedTimestamp = timestamppb.Now()
 	md.OutputUploadStartTimestamp = timestamppb.Now()
 
@@ -377,6 +462,7 @@ func (s *Executor) ExecuteTaskAndStreamResults(ctx context.Context, st *repb.Sch
 	actionResult.ExitCode = int32(cmdResult.ExitCode)
 	actionMetrics.Result = actionResult
 	executeResponse := operation.ExecuteResponseWithResult(actionResult, cmdResult.Error)
+	executeResponse.Message = isolationWarning
 
 	log.CtxDebugf(ctx, "Uploading outputs.")
 	stage.Set("output_upload")
@@ -404,7 +490,7 @@ func (s *Executor) ExecuteTaskAndStreamResults(ctx context.Context, st *repb.Sch
 
 	// If there's an error that we know the client won't retry, return an error
 	// so that the scheduler can retry it.
-	if cmdResult.Error != nil && shouldRetry(task, cmdResult.Error) {
+	if cmdResult.Error != nil && shouldRetry(st, cmdResult.Error) {
 		return finishWithErrFn(cmdResult.Error)
 	}
 	// Otherwise, send the error back to the client via the ExecuteResponse
@@ -466,6 +552,7 @@ func (m *ActionMetrics) Report(ctx context.Context) {
 		metrics.FileDownloadCount.Observe(float64(md.IoStats.FileDownloadCount))
 		metrics.FileDownloadSizeBytes.Observe(float64(md.IoStats.FileDownloadSizeBytes))
 		metrics.FileDownloadDurationUsec.Observe(float64(md.IoStats.FileDownloadDurationUsec))
+		metrics.FileLocalCacheHitSizeBytes.Observe(float64(md.IoStats.LocalCacheHitSizeBytes))
 		metrics.FileUploadCount.Observe(float64(md.IoStats.FileUploadCount))
 		metrics.FileUploadSizeBytes.Observe(float64(md.IoStats.FileUploadSizeBytes))
 		metrics.FileUploadDurationUsec.Observe(float64(md.IoStats.FileUploadDurationUsec))
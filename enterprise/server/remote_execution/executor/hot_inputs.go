@@ -0,0 +1,154 @@
+package executor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/dirtools"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+)
+
+const (
+	// The maximum number of accessed inputs reported to the scheduler for
+	// each task, which keeps the lease request well under the gRPC message
+	// size limit. The scheduler keeps fewer than this by default.
+	maxReportedAccessedInputs = 10_000
+)
+
+// prefetchHotInputs starts fetching the task's hot inputs into the filecache,
+// so that fetching them overlaps with setting up the runner. Only hot inputs
+// that are files in the task's input tree are fetched, since they're what
+// similar actions read, not necessarily this one. The returned channel is
+// closed once prefetching finishes.
+//
+// Prefetching is best-effort: hot inputs are only a hint, and inputs that
+// fail to prefetch are downloaded as usual. Callers should cancel the context
+// once the inputs are downloaded, rather than wait for prefetching to finish.
+func (s *Executor) prefetchHotInputs(ctx context.Context, st *repb.ScheduledTask) <-chan struct{} {
+	done := make(chan struct{})
+	fc := s.env.GetFileCache()
+	if fc == nil || len(st.GetHotInputs()) == 0 {
+		close(done)
+		return done
+	}
+	go func() {
+		defer close(done)
+		start := time.Now()
+		req := st.GetExecutionTask().GetExecuteRequest()
+		inputs, err := s.hotInputsInTree(ctx, st)
+		if err != nil {
+			log.CtxInfof(ctx, "Could not read input tree to prefetch hot inputs: %s", err)
+			return
+		}
+		n, err := s.fetchIntoFileCache(ctx, req.GetInstanceName(), req.GetDigestFunction(), inputs)
+		if err != nil {
+			log.CtxInfof(ctx, "Could not prefetch hot inputs: %s", err)
+			return
+		}
+		log.CtxDebugf(ctx, "Prefetched %d of %d hot inputs in %s", n, len(st.GetHotInputs()), time.Since(start))
+	}()
+	return done
+}
+
+// hotInputsInTree returns the task's hot inputs that are files in its input
+// tree.
+func (s *Executor) hotInputsInTree(ctx context.Context, st *repb.ScheduledTask) ([]*scpb.TaskInput, error) {
+	task := st.GetExecutionTask()
+	rn := digest.NewResourceName(
+		task.GetAction().GetInputRootDigest(),
+		task.GetExecuteRequest().GetInstanceName(),
+		rspb.CacheType_CAS, task.GetExecuteRequest().GetDigestFunction())
+	tree, err := cachetools.GetTreeFromRootDirectoryDigest(ctx, s.env.GetContentAddressableStorageClient(), rn)
+	if err != nil {
+		return nil, err
+	}
+	inTree := make(map[string]struct{})
+	for _, dir := range append([]*repb.Directory{tree.GetRoot()}, tree.GetChildren()...) {
+		for _, f := range dir.GetFiles() {
+			inTree[inputKey(f.GetDigest().GetHash(), f.GetIsExecutable())] = struct{}{}
+		}
+	}
+	var inputs []*scpb.TaskInput
+	for _, input := range st.GetHotInputs() {
+		if _, ok := inTree[inputKey(input.GetHash(), input.GetIsExecutable())]; ok {
+			inputs = append(inputs, input)
+		}
+	}
+	return inputs, nil
+}
+
+// inputKey identifies input files with the same contents and executable bit.
+func inputKey(hash string, isExecutable bool) string {
+	return hash + "/" + strconv.FormatBool(isExecutable)
+}
+
+// fetchIntoFileCache fetches the inputs that aren't already in the filecache
+// into it, and returns how many were fetched.
+func (s *Executor) fetchIntoFileCache(ctx context.Context, instanceName string, digestFunction repb.DigestFunction_Value, inputs []*scpb.TaskInput) (int, error) {
+	fc := s.env.GetFileCache()
+	dir, err := os.MkdirTemp(fc.TempDir(), "hot-inputs-*")
+	if err != nil {
+		return 0, err
+	}
+	// The fetched files are linked into the filecache, so the temporary
+	// copies can be removed once they're fetched.
+	defer os.RemoveAll(dir)
+
+	filesToFetch := dirtools.FileMap{}
+	for i, input := range inputs {
+		node := &repb.FileNode{
+			Name:         strconv.Itoa(i),
+			Digest:       &repb.Digest{Hash: input.GetHash(), SizeBytes: input.GetSizeBytes()},
+			IsExecutable: input.GetIsExecutable(),
+		}
+		dk := digest.NewKey(node.GetDigest())
+		if _, ok := filesToFetch[dk]; ok || fc.ContainsFile(ctx, node) {
+			continue
+		}
+		filesToFetch[dk] = []*dirtools.FilePointer{{
+			FullPath:     filepath.Join(dir, node.GetName()),
+			RelativePath: node.GetName(),
+			FileNode:     node,
+		}}
+	}
+	if len(filesToFetch) == 0 {
+		return 0, nil
+	}
+	ff := dirtools.NewBatchFileFetcher(ctx, s.env, instanceName, digestFunction)
+	if err := ff.FetchFiles(filesToFetch, &dirtools.DownloadTreeOpts{}); err != nil {
+		return 0, err
+	}
+	return len(filesToFetch), nil
+}
+
+// taskInputs converts the input files that a task read into the form that's
+// reported to the scheduler.
+func taskInputs(nodes []*repb.FileNode) []*scpb.TaskInput {
+	inputs := make([]*scpb.TaskInput, 0, min(len(nodes), maxReportedAccessedInputs))
+	seen := make(map[string]struct{}, len(nodes))
+	for _, node := range nodes {
+		if len(inputs) == maxReportedAccessedInputs {
+			break
+		}
+		k := inputKey(node.GetDigest().GetHash(), node.GetIsExecutable())
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		seen[k] = struct{}{}
+		inputs = append(inputs, &scpb.TaskInput{
+			Hash:         node.GetDigest().GetHash(),
+			SizeBytes:    node.GetDigest().GetSizeBytes(),
+			IsExecutable: node.GetIsExecutable(),
+		})
+	}
+	return inputs
+}
@@ -0,0 +1,169 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/filecache"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testcache"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+)
+
+func setupEnv(t *testing.T) *testenv.TestEnv {
+	env := testenv.GetTestEnv(t)
+	fc, err := filecache.NewFileCache(testfs.MakeTempDir(t), 100_000, false)
+	require.NoError(t, err)
+	fc.WaitForDirectoryScanToComplete()
+	env.SetFileCache(fc)
+	_, run, lis := testenv.RegisterLocalGRPCServer(t, env)
+	testcache.Setup(t, env, lis)
+	go run()
+	return env
+}
+
+// writeCASBlob writes a random blob to the CAS and returns it as a task input.
+func writeCASBlob(ctx context.Context, t *testing.T, env *testenv.TestEnv) *scpb.TaskInput {
+	rn, buf := testdigest.RandomCASResourceBuf(t, 100)
+	err := env.GetCache().Set(ctx, rn, buf)
+	require.NoError(t, err)
+	return &scpb.TaskInput{Hash: rn.GetDigest().GetHash(), SizeBytes: rn.GetDigest().GetSizeBytes()}
+}
+
+func fileNode(input *scpb.TaskInput) *repb.FileNode {
+	return &repb.FileNode{
+		Digest:       &repb.Digest{Hash: input.GetHash(), SizeBytes: input.GetSizeBytes()},
+		IsExecutable: input.GetIsExecutable(),
+	}
+}
+
+// scheduledTask returns a task with the given hot inputs, whose input tree
+// holds the given files.
+func scheduledTask(ctx context.Context, t *testing.T, env *testenv.TestEnv, files, hotInputs []*scpb.TaskInput) *repb.ScheduledTask {
+	dir := &repb.Directory{}
+	for i, f := range files {
+		node := fileNode(f)
+		node.Name = fmt.Sprintf("file%d", i)
+		dir.Files = append(dir.Files, node)
+	}
+	rootDigest, err := cachetools.UploadProto(ctx, env.GetByteStreamClient(), "", repb.DigestFunction_SHA256, dir)
+	require.NoError(t, err)
+	return &repb.ScheduledTask{
+		ExecutionTask: &repb.ExecutionTask{
+			ExecuteRequest: &repb.ExecuteRequest{DigestFunction: repb.DigestFunction_SHA256},
+			Action:         &repb.Action{InputRootDigest: rootDigest},
+		},
+		HotInputs: hotInputs,
+	}
+}
+
+func TestPrefetchHotInputs(t *testing.T) {
+	env := setupEnv(t)
+	ctx, err := prefix.AttachUserPrefixToContext(context.Background(), env)
+	require.NoError(t, err)
+	fc := env.GetFileCache()
+	s := &Executor{env: env}
+
+	cached := writeCASBlob(ctx, t, env)
+	notCached := writeCASBlob(ctx, t, env)
+	executable := writeCASBlob(ctx, t, env)
+	executable.IsExecutable = true
+
+	// Add one of the inputs to the filecache up front.
+	n, err := s.fetchIntoFileCache(ctx, "", repb.DigestFunction_SHA256, []*scpb.TaskInput{cached})
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.True(t, fc.ContainsFile(ctx, fileNode(cached)))
+
+	st := scheduledTask(ctx, t, env, []*scpb.TaskInput{cached, notCached, executable}, []*scpb.TaskInput{cached, notCached, notCached, executable})
+	<-s.prefetchHotInputs(ctx, st)
+
+	for _, input := range st.GetHotInputs() {
+		assert.True(t, fc.ContainsFile(ctx, fileNode(input)), "hot input %s should be in the filecache", input.GetHash())
+	}
+	// The temporary copies of the fetched inputs should be removed.
+	entries, err := os.ReadDir(fc.TempDir())
+	require.NoError(t, err)
+	for _, e := range entries {
+		assert.NotRegexp(t, "^hot-inputs-", filepath.Base(e.Name()))
+	}
+
+	// Inputs that are all in the filecache aren't fetched again.
+	n, err = s.fetchIntoFileCache(ctx, "", repb.DigestFunction_SHA256, st.GetHotInputs())
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestPrefetchHotInputs_MissingInput(t *testing.T) {
+	env := setupEnv(t)
+	ctx, err := prefix.AttachUserPrefixToContext(context.Background(), env)
+	require.NoError(t, err)
+	s := &Executor{env: env}
+
+	// Prefetching is best-effort, so inputs that can't be fetched (e.g.
+	// because they've been evicted from the cache) are skipped.
+	missing := &scpb.TaskInput{Hash: "0000000000000000000000000000000000000000000000000000000000000000", SizeBytes: 5}
+	st := scheduledTask(ctx, t, env, []*scpb.TaskInput{missing}, []*scpb.TaskInput{missing})
+	<-s.prefetchHotInputs(ctx, st)
+	assert.False(t, env.GetFileCache().ContainsFile(ctx, fileNode(missing)))
+}
+
+func TestPrefetchHotInputs_OnlyInputTree(t *testing.T) {
+	env := setupEnv(t)
+	ctx, err := prefix.AttachUserPrefixToContext(context.Background(), env)
+	require.NoError(t, err)
+	fc := env.GetFileCache()
+	s := &Executor{env: env}
+
+	inTree := writeCASBlob(ctx, t, env)
+	notInTree := writeCASBlob(ctx, t, env)
+	executable := writeCASBlob(ctx, t, env)
+	nonExecutable := &scpb.TaskInput{Hash: executable.GetHash(), SizeBytes: executable.GetSizeBytes()}
+	executable.IsExecutable = true
+
+	// Hot inputs that the task's input tree doesn't have, or only has with
+	// another executable bit, aren't fetched.
+	st := scheduledTask(ctx, t, env, []*scpb.TaskInput{inTree, nonExecutable}, []*scpb.TaskInput{inTree, notInTree, executable})
+	<-s.prefetchHotInputs(ctx, st)
+	assert.True(t, fc.ContainsFile(ctx, fileNode(inTree)))
+	assert.False(t, fc.ContainsFile(ctx, fileNode(notInTree)))
+	assert.False(t, fc.ContainsFile(ctx, fileNode(executable)))
+}
+
+func TestTaskInputs(t *testing.T) {
+	a := &repb.Digest{Hash: "aaaa", SizeBytes: 1}
+	b := &repb.Digest{Hash: "bbbb", SizeBytes: 2}
+	nodes := []*repb.FileNode{
+		{Name: "a", Digest: a},
+		{Name: "b", Digest: b},
+		// Duplicate contents are only reported once, unless the file's
+		// executable bit differs.
+		{Name: "a_copy", Digest: a},
+		{Name: "a_executable", Digest: a, IsExecutable: true},
+	}
+	expected := []*scpb.TaskInput{
+		{Hash: "aaaa", SizeBytes: 1},
+		{Hash: "bbbb", SizeBytes: 2},
+		{Hash: "aaaa", SizeBytes: 1, IsExecutable: true},
+	}
+	assert.Empty(t, cmp.Diff(expected, taskInputs(nodes), protocmp.Transform()))
+
+	var many []*repb.FileNode
+	for i := range maxReportedAccessedInputs + 1 {
+		many = append(many, &repb.FileNode{Digest: &repb.Digest{Hash: fmt.Sprintf("%064x", i), SizeBytes: 1}})
+	}
+	assert.Len(t, taskInputs(many), maxReportedAccessedInputs)
+}
@@ -0,0 +1,142 @@
+package filecache
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// Size of the plaintext chunks which are encrypted individually, so that
+	// files can be encrypted and decrypted without buffering them in memory.
+	encryptionChunkSize = 64 * 1024
+
+	nonceSize              = chacha20poly1305.NonceSizeX
+	encryptedChunkOverhead = nonceSize + chacha20poly1305.Overhead
+)
+
+// newCipher returns a cipher using a random key. The key is only kept in
+// memory, so files encrypted by a previous executor process can't be
+// decrypted.
+func newCipher() (cipher.AEAD, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, status.InternalErrorf("generate filecache encryption key: %s", err)
+	}
+	return chacha20poly1305.NewX(key)
+}
+
+// chunkAuthData returns the additional authenticated data of a chunk. It binds
+// each chunk to the filecache key and to its position in the file, so that
+// chunks can't be swapped between entries, reordered, or truncated.
+func chunkAuthData(key string, chunkIndex uint32, lastChunk bool) []byte {
+	b := make([]byte, 0, len(key)+5)
+	b = append(b, key...)
+	b = binary.LittleEndian.AppendUint32(b, chunkIndex)
+	if lastChunk {
+		return append(b, 1)
+	}
+	return append(b, 0)
+}
+
+// encryptFile writes an encrypted copy of src to dst. Each chunk of dst is a
+// random nonce followed by the sealed chunk.
+func encryptFile(aead cipher.AEAD, key, src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return wrapOSError(err, "open file to encrypt")
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return wrapOSError(err, "stat file to encrypt")
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return wrapOSError(err, "create encrypted file")
+	}
+	defer out.Close()
+
+	numChunks := max(1, (info.Size()+encryptionChunkSize-1)/encryptionChunkSize)
+	w := bufio.NewWriter(out)
+	plaintext := make([]byte, encryptionChunkSize)
+	buf := make([]byte, encryptionChunkSize+encryptedChunkOverhead)
+	for i := int64(0); i < numChunks; i++ {
+		n, err := io.ReadFull(in, plaintext)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return status.InternalErrorf("read file to encrypt: %s", err)
+		}
+		nonce := buf[:nonceSize]
+		if _, err := rand.Read(nonce); err != nil {
+			return status.InternalErrorf("generate nonce: %s", err)
+		}
+		sealed := aead.Seal(nonce, nonce, plaintext[:n], chunkAuthData(key, uint32(i), i == numChunks-1))
+		if _, err := w.Write(sealed); err != nil {
+			return status.InternalErrorf("write encrypted file: %s", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return status.InternalErrorf("write encrypted file: %s", err)
+	}
+	return out.Close()
+}
+
+// decryptFile writes the decrypted contents of src, which was written by
+// encryptFile, to dst. As with hardlinking, nothing is written if dst already
+// exists. If decryption fails, dst is removed, so that partially decrypted
+// contents are never left behind.
+func decryptFile(aead cipher.AEAD, key, src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return wrapOSError(err, "open encrypted file")
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return wrapOSError(err, "stat encrypted file")
+	}
+	numChunks := (info.Size() + encryptionChunkSize + encryptedChunkOverhead - 1) / (encryptionChunkSize + encryptedChunkOverhead)
+	if numChunks == 0 {
+		return status.DataLossErrorf("encrypted file %q is empty", src)
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if os.IsExist(err) {
+		return nil
+	}
+	if err != nil {
+		return wrapOSError(err, "create decrypted file")
+	}
+	defer func() {
+		if err != nil {
+			out.Close()
+			os.Remove(dst)
+		}
+	}()
+
+	r := bufio.NewReader(in)
+	buf := make([]byte, encryptionChunkSize+encryptedChunkOverhead)
+	for i := int64(0); i < numChunks; i++ {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return status.InternalErrorf("read encrypted file: %s", err)
+		}
+		if n < encryptedChunkOverhead {
+			return status.DataLossErrorf("encrypted file %q is truncated", src)
+		}
+		nonce, sealed := buf[:nonceSize], buf[nonceSize:n]
+		plaintext, err := aead.Open(sealed[:0], nonce, sealed, chunkAuthData(key, uint32(i), i == numChunks-1))
+		if err != nil {
+			return status.DataLossErrorf("decrypt %q: %s", src, err)
+		}
+		if _, err := out.Write(plaintext); err != nil {
+			return status.InternalErrorf("write decrypted file: %s", err)
+		}
+	}
+	return out.Close()
+}
@@ -0,0 +1,156 @@
+package filecache
+
+import (
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/lru"
+)
+
+// fairShareLRU is an LRU which keeps a separate LRU for each group. When the
+// cache is full, it evicts the least recently used entry of the group using
+// the most space, so that a group which adds lots of files evicts its own
+// files rather than those of other groups. Each group can always use at least
+// an equal share of the cache, and groups can use more than that while other
+// groups are not using their share.
+//
+// Keys must be prefixed with the group ID followed by a slash.
+type fairShareLRU struct {
+	maxSize int64
+	sizeFn  lru.SizeFn[*entry]
+	onEvict lru.EvictedCallback[*entry]
+
+	groups map[string]*lru.LRU[*entry]
+}
+
+func newFairShareLRU(maxSize int64, sizeFn lru.SizeFn[*entry], onEvict lru.EvictedCallback[*entry]) *fairShareLRU {
+	return &fairShareLRU{
+		maxSize: maxSize,
+		sizeFn:  sizeFn,
+		onEvict: onEvict,
+		groups:  map[string]*lru.LRU[*entry]{},
+	}
+}
+
+func groupIDFromKey(key string) string {
+	groupID, _, _ := strings.Cut(key, "/")
+	return groupID
+}
+
+// group returns the LRU for the group of the given key, creating it if it
+// doesn't exist.
+func (l *fairShareLRU) group(key string) (*lru.LRU[*entry], error) {
+	groupID := groupIDFromKey(key)
+	if g, ok := l.groups[groupID]; ok {
+		return g, nil
+	}
+	// Eviction is handled by fairShareLRU, so the max size of each group LRU
+	// is never reached.
+	g, err := lru.NewLRU[*entry](&lru.Config[*entry]{MaxSize: l.maxSize, SizeFn: l.sizeFn, OnEvict: l.onEvict})
+	if err != nil {
+		return nil, err
+	}
+	l.groups[groupID] = g
+	return g, nil
+}
+
+func (l *fairShareLRU) add(key string, value *entry, back bool) bool {
+	size := l.sizeFn(value)
+	if size > l.maxSize {
+		return false
+	}
+	l.Remove(key)
+	for l.Size()+size > l.maxSize {
+		if _, ok := l.RemoveOldest(); !ok {
+			break
+		}
+	}
+	g, err := l.group(key)
+	if err != nil {
+		return false
+	}
+	if back {
+		return g.PushBack(key, value)
+	}
+	return g.Add(key, value)
+}
+
+func (l *fairShareLRU) Add(key string, value *entry) bool {
+	return l.add(key, value, false /*=back*/)
+}
+
+func (l *fairShareLRU) PushBack(key string, value *entry) bool {
+	return l.add(key, value, true /*=back*/)
+}
+
+func (l *fairShareLRU) Get(key string) (*entry, bool) {
+	g, ok := l.groups[groupIDFromKey(key)]
+	if !ok {
+		return nil, false
+	}
+	return g.Get(key)
+}
+
+func (l *fairShareLRU) Contains(key string) bool {
+	g, ok := l.groups[groupIDFromKey(key)]
+	return ok && g.Contains(key)
+}
+
+func (l *fairShareLRU) Remove(key string) bool {
+	groupID := groupIDFromKey(key)
+	g, ok := l.groups[groupID]
+	if !ok {
+		return false
+	}
+	removed := g.Remove(key)
+	if g.Len() == 0 {
+		delete(l.groups, groupID)
+	}
+	return removed
+}
+
+func (l *fairShareLRU) Purge() {
+	for _, g := range l.groups {
+		g.Purge()
+	}
+	l.groups = map[string]*lru.LRU[*entry]{}
+}
+
+func (l *fairShareLRU) Size() int64 {
+	size := int64(0)
+	for _, g := range l.groups {
+		size += g.Size()
+	}
+	return size
+}
+
+func (l *fairShareLRU) Len() int {
+	n := 0
+	for _, g := range l.groups {
+		n += g.Len()
+	}
+	return n
+}
+
+// RemoveOldest removes the least recently used entry of the group using the
+// most space.
+func (l *fairShareLRU) RemoveOldest() (*entry, bool) {
+	var largestGroupID string
+	var largest *lru.LRU[*entry]
+	for groupID, g := range l.groups {
+		if largest == nil || g.Size() > largest.Size() {
+			largestGroupID, largest = groupID, g
+		}
+	}
+	if largest == nil {
+		return nil, false
+	}
+	v, ok := largest.RemoveOldest()
+	if largest.Len() == 0 {
+		delete(l.groups, largestGroupID)
+	}
+	return v, ok
+}
+
+func (l *fairShareLRU) Metrics() string {
+	return ""
+}
@@ -2,6 +2,7 @@ package filecache
 
 import (
 	"context"
+	"crypto/cipher"
 	"errors"
 	"flag"
 	"fmt"
@@ -42,7 +43,11 @@ const (
 	tmpDir = "_tmp"
 )
 
-var enableAlwaysClone = flag.Bool("executor.local_cache_always_clone", false, "If true, files from the filecache will always be cloned instead of hardlinked")
+var (
+	enableAlwaysClone  = flag.Bool("executor.local_cache_always_clone", false, "If true, files from the filecache will always be cloned instead of hardlinked")
+	enableEncryption   = flag.Bool("executor.local_cache_encryption_enabled", false, "If true, files in the filecache are encrypted at rest with a key that is only kept in memory. Files are copied out of the filecache instead of hardlinked, and the filecache is cleared when the executor starts.")
+	enableFairEviction = flag.Bool("executor.local_cache_fair_share_eviction_enabled", false, "If true, when the filecache is full, files are evicted from the group using the most space instead of evicting the least recently used file overall. This prevents a single group from evicting all files of other groups.")
+)
 
 // fileCache implements a fixed-size, filesystem backed, LRU cache.
 //
@@ -74,6 +79,9 @@ type fileCache struct {
 	lock        sync.RWMutex
 	l           interfaces.LRU[*entry]
 	dirScanDone chan struct{}
+
+	// If set, files are encrypted with this cipher when added to the cache.
+	aead cipher.AEAD
 }
 
 // entry is used to hold a value in the evictList
@@ -109,6 +117,16 @@ func NewFileCache(rootDir string, maxSizeBytes int64, deleteContent bool) (*file
 	if maxSizeBytes <= 0 {
 		return nil, errors.New("Must provide a positive size")
 	}
+	var aead cipher.AEAD
+	if *enableEncryption {
+		var err error
+		aead, err = newCipher()
+		if err != nil {
+			return nil, err
+		}
+		// Files encrypted by a previous executor process can't be decrypted.
+		deleteContent = true
+	}
 	if deleteContent {
 		log.Infof("Cleaning up filecache %q", rootDir)
 		if err := disk.ForceRemove(context.Background(), rootDir); err != nil {
@@ -118,14 +136,21 @@ func NewFileCache(rootDir string, maxSizeBytes int64, deleteContent bool) (*file
 	if err := disk.EnsureDirectoryExists(rootDir); err != nil {
 		return nil, err
 	}
-	l, err := lru.NewLRU[*entry](&lru.Config[*entry]{MaxSize: maxSizeBytes, OnEvict: evictFn, SizeFn: sizeFn})
-	if err != nil {
-		return nil, err
+	var l interfaces.LRU[*entry]
+	if *enableFairEviction {
+		l = newFairShareLRU(maxSizeBytes, sizeFn, evictFn)
+	} else {
+		var err error
+		l, err = lru.NewLRU[*entry](&lru.Config[*entry]{MaxSize: maxSizeBytes, OnEvict: evictFn, SizeFn: sizeFn})
+		if err != nil {
+			return nil, err
+		}
 	}
 	c := &fileCache{
 		rootDir:     rootDir,
 		l:           l,
 		dirScanDone: make(chan struct{}),
+		aead:        aead,
 	}
 	if err := os.RemoveAll(c.TempDir()); err != nil {
 		return nil, status.WrapErrorf(err, "failed to clear filecache temp dir")
@@ -133,7 +158,12 @@ func NewFileCache(rootDir string, maxSizeBytes int64, deleteContent bool) (*file
 	if err := os.MkdirAll(c.TempDir(), 0755); err != nil {
 		return nil, status.WrapErrorf(err, "failed to create filecache temp dir")
 	}
-	go c.scanDir()
+	if c.aead != nil {
+		// The filecache was cleared, so there is nothing to scan.
+		close(c.dirScanDone)
+	} else {
+		go c.scanDir()
+	}
 	return c, nil
 }
 
@@ -253,6 +283,22 @@ func (c *fileCache) FastLinkFile(ctx context.Context, node *repb.FileNode, outpu
 	if !ok {
 		return false
 	}
+	if c.aead != nil {
+		if err := decryptFile(c.aead, key, v.value, outputPath); err != nil {
+			log.Warningf("Failed to decrypt file from cache: %s", err)
+			if status.IsDataLossError(err) {
+				// Evict the corrupted entry, unless it was replaced
+				// concurrently.
+				c.lock.Lock()
+				if cur, ok := c.l.Get(key); ok && cur == v {
+					c.l.Remove(key)
+				}
+				c.lock.Unlock()
+			}
+			return false
+		}
+		return true
+	}
 	if err := cloneOrLink(groupID, v.value, outputPath); err != nil {
 		log.Warningf("Failed to link file from cache: %s", err)
 		return false
@@ -267,6 +313,21 @@ func (c *fileCache) addFileToGroup(groupID string, node *repb.FileNode, existing
 	// which is not good.
 	k := groupSpecificKey(groupID, node)
 
+	if c.aead != nil {
+		// Encrypt to a temp file without holding the lock, then move it into
+		// place below.
+		tmp, err := c.tempPath(node.GetDigest().GetHash())
+		if err != nil {
+			return err
+		}
+		if err := encryptFile(c.aead, k, existingFilePath, tmp); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		defer os.Remove(tmp)
+		existingFilePath = tmp
+	}
+
 	info, err := os.Stat(existingFilePath)
 	if err != nil {
 		return wrapOSError(err, "stat")
@@ -285,7 +346,11 @@ func (c *fileCache) addFileToGroup(groupID string, node *repb.FileNode, existing
 	if err := disk.EnsureDirectoryExists(filepath.Dir(fp)); err != nil {
 		return err
 	}
-	if err := cloneOrLink(groupID, existingFilePath, fp); err != nil {
+	if c.aead != nil {
+		if err := os.Rename(existingFilePath, fp); err != nil {
+			return wrapOSError(err, "rename")
+		}
+	} else if err := cloneOrLink(groupID, existingFilePath, fp); err != nil {
 		return err
 	}
 	e := &entry{
@@ -295,6 +360,7 @@ func (c *fileCache) addFileToGroup(groupID string, node *repb.FileNode, existing
 	}
 	metrics.FileCacheAddedFileSizeBytes.Observe(float64(e.sizeBytes))
 	success := c.l.Add(k, e)
+	metrics.FileCacheTrackedBytes.Set(float64(c.l.Size()))
 	if !success {
 		return status.InternalErrorf("could not add key %s to filecache lru", k)
 	}
@@ -320,13 +386,25 @@ func (c *fileCache) DeleteFile(ctx context.Context, node *repb.FileNode) bool {
 
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	return c.l.Remove(k)
+	removed := c.l.Remove(k)
+	metrics.FileCacheTrackedBytes.Set(float64(c.l.Size()))
+	return removed
 }
 
 func (c *fileCache) WaitForDirectoryScanToComplete() {
 	<-c.dirScanDone
 }
 
+func (c *fileCache) FlushStats() {
+	c.lock.Lock()
+	lruSize := c.l.Size()
+	lruLen := c.l.Len()
+	c.lock.Unlock()
+
+	metrics.FileCacheTrackedBytes.Set(float64(lruSize))
+	log.Infof("filecache(%q) is tracking %d files. Total tracked bytes: %d", c.rootDir, lruLen, lruSize)
+}
+
 // Read atomically reads a file from filecache.
 func (c *fileCache) Read(ctx context.Context, node *repb.FileNode) ([]byte, error) {
 	tmp, err := c.tempPath(node.GetDigest().GetHash())
@@ -7,6 +7,7 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -315,6 +316,138 @@ func TestFileCacheEvictionAfterStartupScan(t *testing.T) {
 	}
 }
 
+func TestFileCacheEncryption(t *testing.T) {
+	flags.Set(t, "executor.local_cache_encryption_enabled", true)
+	ctx := context.Background()
+	filecacheRoot := testfs.MakeTempDir(t)
+	// Files left by a previous executor can't be decrypted, so they should be
+	// deleted.
+	writeFileContent(t, filecacheRoot, "ANON/"+hash.String("A"), "A", false)
+	fc, err := filecache.NewFileCache(filecacheRoot, 1_000_000, false)
+	require.NoError(t, err)
+	fc.WaitForDirectoryScanToComplete()
+	require.False(t, fc.ContainsFile(ctx, nodeFromString("A", false)))
+	require.NoFileExists(t, filepath.Join(filecacheRoot, "ANON", hash.String("A")))
+
+	baseDir := testfs.MakeTempDir(t)
+	// Use content spanning multiple encryption chunks.
+	content := strings.Repeat("0123456789", 20_000)
+	writeFileContent(t, baseDir, "file", content, true)
+	node := nodeFromString(content, true)
+	err = fc.AddFile(ctx, node, filepath.Join(baseDir, "file"))
+	require.NoError(t, err)
+
+	// The file should be encrypted on disk.
+	cachedPath := filepath.Join(filecacheRoot, "ANON", node.GetDigest().GetHash()+".executable")
+	b, err := os.ReadFile(cachedPath)
+	require.NoError(t, err)
+	require.NotContains(t, string(b), "0123456789")
+
+	// Linking should write the decrypted file, preserving the mode.
+	linked := fc.FastLinkFile(ctx, node, filepath.Join(baseDir, "linked"))
+	require.True(t, linked)
+	assertFileContents(t, filepath.Join(baseDir, "linked"), content)
+	info, err := os.Stat(filepath.Join(baseDir, "linked"))
+	require.NoError(t, err)
+	require.Equal(t, fs.FileMode(0755), info.Mode().Perm())
+	out, err := fc.Read(ctx, node)
+	require.NoError(t, err)
+	require.Equal(t, content, string(out))
+
+	// A tampered file should fail to decrypt and be evicted.
+	f, err := os.OpenFile(cachedPath, os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("tampered"), 100)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	linked = fc.FastLinkFile(ctx, node, filepath.Join(baseDir, "tampered"))
+	require.False(t, linked)
+	require.False(t, fc.ContainsFile(ctx, node))
+	require.NoFileExists(t, filepath.Join(baseDir, "tampered"))
+}
+
+func TestFileCacheEncryption_CorruptedCiphertext(t *testing.T) {
+	flags.Set(t, "executor.local_cache_encryption_enabled", true)
+	ctx := context.Background()
+	filecacheRoot := testfs.MakeTempDir(t)
+	fc, err := filecache.NewFileCache(filecacheRoot, 1_000_000, false)
+	require.NoError(t, err)
+	fc.WaitForDirectoryScanToComplete()
+
+	baseDir := testfs.MakeTempDir(t)
+	content := strings.Repeat("0123456789", 20_000)
+	writeFileContent(t, baseDir, "file", content, false)
+	node := nodeFromString(content, false)
+	err = fc.AddFile(ctx, node, filepath.Join(baseDir, "file"))
+	require.NoError(t, err)
+
+	// Corrupt the last chunk, so that the earlier chunks are decrypted before
+	// the corruption is detected.
+	cachedPath := filepath.Join(filecacheRoot, "ANON", node.GetDigest().GetHash())
+	info, err := os.Stat(cachedPath)
+	require.NoError(t, err)
+	f, err := os.OpenFile(cachedPath, os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("corrupted"), info.Size()-20)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// The partially decrypted file shouldn't be left behind.
+	linked := fc.FastLinkFile(ctx, node, filepath.Join(baseDir, "linked"))
+	require.False(t, linked)
+	require.NoFileExists(t, filepath.Join(baseDir, "linked"))
+	require.False(t, fc.ContainsFile(ctx, node))
+
+	// Linking again after re-adding the file should work.
+	err = fc.AddFile(ctx, node, filepath.Join(baseDir, "file"))
+	require.NoError(t, err)
+	linked = fc.FastLinkFile(ctx, node, filepath.Join(baseDir, "linked"))
+	require.True(t, linked)
+	assertFileContents(t, filepath.Join(baseDir, "linked"), content)
+}
+
+func TestFileCacheFairShareEviction(t *testing.T) {
+	flags.Set(t, "executor.local_cache_fair_share_eviction_enabled", true)
+	ctx := context.Background()
+	// For now just assume the disk block size is 4096
+	const fsBlockSize = 4096
+	// Create a filecache that can only fit 4 physical blocks.
+	filecacheRoot := testfs.MakeTempDir(t)
+	fc, err := filecache.NewFileCache(filecacheRoot, 4*fsBlockSize, false)
+	require.NoError(t, err)
+	fc.WaitForDirectoryScanToComplete()
+	tempDir := fc.TempDir()
+	ctx1 := claims.AuthContextFromClaims(ctx, &claims.Claims{GroupID: "GR1"}, nil)
+	ctx2 := claims.AuthContextFromClaims(ctx, &claims.Claims{GroupID: "GR2"}, nil)
+
+	add := func(ctx context.Context, name string) {
+		writeFileContent(t, tempDir, name, name, false)
+		err := fc.AddFile(ctx, nodeFromString(name, false), filepath.Join(tempDir, name))
+		require.NoError(t, err)
+	}
+	// GR1 adds a file, then GR2 fills the cache.
+	add(ctx1, "1A")
+	add(ctx2, "2A")
+	add(ctx2, "2B")
+	add(ctx2, "2C")
+	// GR2 is using more than its share, so adding more files should evict
+	// its own files, even though GR1's file is the least recently used.
+	add(ctx2, "2D")
+	add(ctx2, "2E")
+	require.True(t, fc.ContainsFile(ctx1, nodeFromString("1A", false)))
+	require.False(t, fc.ContainsFile(ctx2, nodeFromString("2A", false)))
+	require.False(t, fc.ContainsFile(ctx2, nodeFromString("2B", false)))
+	require.True(t, fc.ContainsFile(ctx2, nodeFromString("2E", false)))
+
+	// GR1 can grow up to its share by evicting GR2's files.
+	add(ctx1, "1B")
+	require.True(t, fc.ContainsFile(ctx1, nodeFromString("1A", false)))
+	require.True(t, fc.ContainsFile(ctx1, nodeFromString("1B", false)))
+	require.False(t, fc.ContainsFile(ctx2, nodeFromString("2C", false)))
+	require.True(t, fc.ContainsFile(ctx2, nodeFromString("2D", false)))
+	require.True(t, fc.ContainsFile(ctx2, nodeFromString("2E", false)))
+}
+
 func TestScanWithConcurrentRemove(t *testing.T) {
 	for i := 0; i < 100; i++ {
 		ctx := context.Background()
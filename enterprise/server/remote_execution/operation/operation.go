@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_execution/execution_output"
 	"github.com/buildbuddy-io/buildbuddy/server/util/flagutil"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
@@ -43,6 +44,10 @@ type Publisher struct {
 	// auxiliary metadata.
 	executionStageProgress repb.ExecutionProgress_ExecutionState
 
+	// Whether the task's output is being published with an OutputPublisher,
+	// in which case progress updates include the names of its output streams.
+	outputStreamed bool
+
 	mu     sync.Mutex
 	stream *retryingClient
 }
@@ -83,6 +88,10 @@ func (p *Publisher) Ping() error {
 			AuxiliaryMetadata: []*anypb.Any{progressAny},
 		},
 	}
+	if p.outputStreamed {
+		md.StdoutStreamName = execution_output.StreamName(p.taskID, execution_output.Stdout)
+		md.StderrStreamName = execution_output.StreamName(p.taskID, execution_output.Stderr)
+	}
 	op, err := assemble(p.taskID, md, nil /*=response*/)
 	if err != nil {
 		return status.WrapError(err, "assemble operation")
@@ -98,6 +107,13 @@ func (p *Publisher) SetState(state repb.ExecutionProgress_ExecutionState) error
 	return p.Ping()
 }
 
+// SetOutputStreamed marks the task's output as being published with an
+// OutputPublisher, so that later progress updates tell clients where to
+// stream it from.
+func (p *Publisher) SetOutputStreamed() {
+	p.outputStreamed = true
+}
+
 // CloseAndRecv closes the send direction of the stream and waits for the
 // server to ack.
 func (p *Publisher) CloseAndRecv() (*repb.PublishOperationResponse, error) {
@@ -0,0 +1,160 @@
+package operation
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	// The maximum number of bytes of each output stream that are sent in a
+	// single request, to keep requests well under the gRPC message size
+	// limit. Once this much of a stream's output is buffered, writes to it
+	// send the buffered output instead of waiting for the next flush.
+	maxOutputChunkBytes = 1024 * 1024
+)
+
+// OutputPublisher publishes the stdout and stderr of an in-progress
+// execution, so that clients can stream it while the action runs.
+//
+// Output is buffered and published periodically. Publishing output is
+// best-effort, since the complete output is always available in the action
+// result: if publishing fails, the error is logged and later output is
+// discarded.
+type OutputPublisher struct {
+	ctx    context.Context
+	taskID string
+
+	sendMu sync.Mutex // PROTECTS(stream)
+	stream repb.Execution_PublishExecutionOutputClient
+
+	mu     sync.Mutex // PROTECTS(stdout, stderr, failed)
+	stdout bytes.Buffer
+	stderr bytes.Buffer
+	failed bool
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// PublishOutput starts a PublishExecutionOutput stream for the given task,
+// which publishes the output written to the publisher's Stdout and Stderr
+// writers every flushInterval. The publisher must be closed once the task's
+// command exits.
+func PublishOutput(ctx context.Context, client repb.ExecutionClient, taskID string, flushInterval time.Duration) (*OutputPublisher, error) {
+	stream, err := client.PublishExecutionOutput(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.Send(&repb.PublishExecutionOutputRequest{ExecutionId: taskID}); err != nil {
+		return nil, err
+	}
+	p := &OutputPublisher{
+		ctx:     ctx,
+		taskID:  taskID,
+		stream:  stream,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go p.flushPeriodically(flushInterval)
+	return p, nil
+}
+
+// Stdout returns a writer for the task's stdout.
+func (p *OutputPublisher) Stdout() io.Writer {
+	return &outputWriter{p: p, buf: &p.stdout}
+}
+
+// Stderr returns a writer for the task's stderr.
+func (p *OutputPublisher) Stderr() io.Writer {
+	return &outputWriter{p: p, buf: &p.stderr}
+}
+
+func (p *OutputPublisher) flushPeriodically(interval time.Duration) {
+	defer close(p.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+			p.flush()
+		}
+	}
+}
+
+// flush sends all of the buffered output.
+func (p *OutputPublisher) flush() {
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+	for {
+		p.mu.Lock()
+		if p.failed || (p.stdout.Len() == 0 && p.stderr.Len() == 0) {
+			p.mu.Unlock()
+			return
+		}
+		req := &repb.PublishExecutionOutputRequest{
+			Stdout: bytes.Clone(p.stdout.Next(maxOutputChunkBytes)),
+			Stderr: bytes.Clone(p.stderr.Next(maxOutputChunkBytes)),
+		}
+		p.mu.Unlock()
+
+		if err := p.stream.Send(req); err != nil {
+			log.CtxWarningf(p.ctx, "Could not publish output of %q, its remaining output won't be streamed: %s", p.taskID, err)
+			p.mu.Lock()
+			p.failed = true
+			p.stdout.Reset()
+			p.stderr.Reset()
+			p.mu.Unlock()
+			return
+		}
+	}
+}
+
+// Close publishes any remaining output and closes the stream.
+func (p *OutputPublisher) Close() {
+	close(p.stop)
+	<-p.stopped
+	p.flush()
+
+	p.mu.Lock()
+	failed := p.failed
+	p.mu.Unlock()
+	if failed {
+		return
+	}
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+	if _, err := p.stream.CloseAndRecv(); err != nil {
+		log.CtxWarningf(p.ctx, "Could not finish publishing output of %q: %s", p.taskID, err)
+	}
+}
+
+type outputWriter struct {
+	p   *OutputPublisher
+	buf *bytes.Buffer
+}
+
+func (w *outputWriter) Write(b []byte) (int, error) {
+	w.p.mu.Lock()
+	if !w.p.failed {
+		w.buf.Write(b)
+	}
+	full := w.buf.Len() >= maxOutputChunkBytes
+	w.p.mu.Unlock()
+	// Don't buffer an unbounded amount of output from commands that write
+	// faster than the periodic flushes.
+	if full {
+		w.p.flush()
+	}
+	return len(b), nil
+}
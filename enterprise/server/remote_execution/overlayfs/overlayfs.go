@@ -24,6 +24,10 @@ type Overlay struct {
 	// This is not exposed to actions.
 	LowerDir string
 
+	// ExtraLowerDirs are read-only directories layered below LowerDir. They
+	// are not owned by the overlay and are not modified or removed by it.
+	ExtraLowerDirs []string
+
 	// WorkDir is the path to the directory containing temporary files used by
 	// the overlayfs driver.
 	WorkDir string
@@ -34,6 +38,11 @@ type Overlay struct {
 type Opts struct {
 	// DirPerms are the permissions to use when creating directories.
 	DirPerms fs.FileMode
+
+	// ExtraLowerDirs are additional read-only directories to layer below the
+	// converted directory, ordered from uppermost to lowermost. The caller is
+	// responsible for keeping them unmodified until the overlay is removed.
+	ExtraLowerDirs []string
 }
 
 type ApplyOpts struct {
@@ -46,3 +55,11 @@ type ApplyOpts struct {
 	// some persistent processes may be left running from the workload.
 	AllowRename bool
 }
+
+// CopyUpStats describes the regular files written to the upper dir while the
+// overlay was in use, which includes both files copied up from the lower dirs
+// due to writes and newly created files.
+type CopyUpStats struct {
+	FileCount int64
+	SizeBytes int64
+}
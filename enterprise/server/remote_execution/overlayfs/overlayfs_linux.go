@@ -42,6 +42,8 @@ func Convert(ctx context.Context, path string, opts Opts) (*Overlay, error) {
 		WorkDir:  path + workSuffix,
 		UpperDir: path + upperSuffix,
 		opts:     opts,
+
+		ExtraLowerDirs: opts.ExtraLowerDirs,
 	}
 
 	if opts.DirPerms == 0 {
@@ -56,7 +58,8 @@ func Convert(ctx context.Context, path string, opts Opts) (*Overlay, error) {
 			return nil, status.WrapError(err, "create overlay directory")
 		}
 	}
-	args := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s,userxattr", fs.LowerDir, fs.UpperDir, fs.WorkDir)
+	lowerDirs := append([]string{fs.LowerDir}, fs.ExtraLowerDirs...)
+	args := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s,userxattr", strings.Join(lowerDirs, ":"), fs.UpperDir, fs.WorkDir)
 	if err := syscall.Mount("", fs.MountDir, "overlay", syscall.MS_RELATIME, args); err != nil {
 		return nil, status.WrapError(err, "mount overlayfs")
 	}
@@ -79,14 +82,16 @@ func (o *Overlay) Remove(ctx context.Context) error {
 }
 
 // Apply applies all changes from the upperdir to the lowerdir, and clears the
-// upperdir.
+// upperdir. It returns stats about the files that were written to the upperdir.
 //
 // This is intended to be called after a task is run so that outputs can be
 // safely hardlinked to the filecache.
-func (o *Overlay) Apply(ctx context.Context, opts ApplyOpts) error {
+func (o *Overlay) Apply(ctx context.Context, opts ApplyOpts) (*CopyUpStats, error) {
 	_, span := tracing.StartSpan(ctx)
 	defer span.End()
 
+	stats := &CopyUpStats{}
+
 	// Walk the upper dir and move all files into lowerdir, or if the file is a
 	// whiteout, delete from lowerdir.
 	err := filepath.WalkDir(o.UpperDir, func(path string, entry fs.DirEntry, err error) error {
@@ -124,6 +129,15 @@ func (o *Overlay) Apply(ctx context.Context, opts ApplyOpts) error {
 			return status.WrapError(err, "remove existing file in lower dir")
 		}
 
+		info, err := entry.Info()
+		if err != nil {
+			return status.WrapError(err, "get entry info")
+		}
+		if info.Mode().IsRegular() {
+			stats.FileCount++
+			stats.SizeBytes += info.Size()
+		}
+
 		if opts.AllowRename {
 			if err := os.Rename(path, lowerPath); err != nil {
 				return status.WrapError(err, "rename file to lower dir")
@@ -131,10 +145,6 @@ func (o *Overlay) Apply(ctx context.Context, opts ApplyOpts) error {
 			return nil
 		}
 
-		info, err := entry.Info()
-		if err != nil {
-			return status.WrapError(err, "get entry info")
-		}
 		if info.Mode()&os.ModeSymlink == os.ModeSymlink {
 			// Symlinks are safe to rename since the symlink target is not read
 			// or written via a file handle, but rather via dedicated system
@@ -155,18 +165,18 @@ func (o *Overlay) Apply(ctx context.Context, opts ApplyOpts) error {
 		return nil
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 	entries, err := os.ReadDir(o.UpperDir)
 	if err != nil {
-		return status.WrapError(err, "read upper dir")
+		return nil, status.WrapError(err, "read upper dir")
 	}
 	for _, e := range entries {
 		if err := os.RemoveAll(filepath.Join(o.UpperDir, e.Name())); err != nil {
-			return status.WrapError(err, "remove upper dir entry")
+			return nil, status.WrapError(err, "remove upper dir entry")
 		}
 	}
-	return nil
+	return stats, nil
 }
 
 func forceMkdir(path string, perm fs.FileMode) error {
@@ -17,6 +17,6 @@ func (o *Overlay) Remove(ctx context.Context) error {
 	return status.UnimplementedErrorf("overlayfs is not supported on %s", runtime.GOOS)
 }
 
-func (o *Overlay) Apply(ctx context.Context, opts ApplyOpts) error {
-	return status.UnimplementedErrorf("overlayfs is not supported on %s", runtime.GOOS)
+func (o *Overlay) Apply(ctx context.Context, opts ApplyOpts) (*CopyUpStats, error) {
+	return nil, status.UnimplementedErrorf("overlayfs is not supported on %s", runtime.GOOS)
 }
@@ -96,8 +96,14 @@ func TestOverlayWorkspace(t *testing.T) {
 	require.Equal(t, originalPermsD, statD.Mode().Perm())
 
 	// Apply the changes to the lower dir.
-	err = o.Apply(ctx, overlayfs.ApplyOpts{})
+	stats, err := o.Apply(ctx, overlayfs.ApplyOpts{})
 	require.NoError(t, err)
+	// a.txt and dir2/d.txt were copied up, and dir3/e.txt/child.txt was
+	// created.
+	require.Equal(t, &overlayfs.CopyUpStats{
+		FileCount: 3,
+		SizeBytes: int64(len("A-MODIFIED") + len("D") + len("child-contents")),
+	}, stats)
 	lowerdir := ws + ".lower"
 	testfs.AssertExactFileContents(t, lowerdir, map[string]string{
 		"a.txt":                "A-MODIFIED",
@@ -139,6 +145,57 @@ func TestOverlayWorkspace(t *testing.T) {
 	require.Equal(t, "A-MODIFIED", string(b))
 }
 
+func TestOverlayWorkspace_ExtraLowerDirs(t *testing.T) {
+	tmp := testfs.MakeTempDir(t)
+	ws := testfs.MakeDirAll(t, tmp, "workspace")
+	testfs.MakeDirAll(t, ws, "out")
+	layer := testfs.MakeDirAll(t, tmp, "layer")
+	testfs.WriteAllFileContents(t, layer, map[string]string{
+		"input.txt":      "INPUT",
+		"dir/other.txt":  "OTHER",
+		"dir/unused.txt": "UNUSED",
+	})
+
+	ctx := context.Background()
+	o, err := overlayfs.Convert(ctx, ws, overlayfs.Opts{ExtraLowerDirs: []string{layer}})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := o.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	// Layer files should be visible in the workspace.
+	testfs.AssertExactFileContents(t, ws, map[string]string{
+		"input.txt":      "INPUT",
+		"dir/other.txt":  "OTHER",
+		"dir/unused.txt": "UNUSED",
+	})
+	// Modify a layer file and write an output.
+	err = os.WriteFile(filepath.Join(ws, "dir/other.txt"), []byte("MODIFIED"), 0644)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(ws, "out/output.txt"), []byte("OUTPUT"), 0644)
+	require.NoError(t, err)
+
+	stats, err := o.Apply(ctx, overlayfs.ApplyOpts{})
+	require.NoError(t, err)
+	require.Equal(t, &overlayfs.CopyUpStats{
+		FileCount: 2,
+		SizeBytes: int64(len("MODIFIED") + len("OUTPUT")),
+	}, stats)
+
+	// Only the written files should be applied to the lower dir, and the
+	// layer should be unmodified.
+	testfs.AssertExactFileContents(t, o.LowerDir, map[string]string{
+		"dir/other.txt":  "MODIFIED",
+		"out/output.txt": "OUTPUT",
+	})
+	testfs.AssertExactFileContents(t, layer, map[string]string{
+		"input.txt":      "INPUT",
+		"dir/other.txt":  "OTHER",
+		"dir/unused.txt": "UNUSED",
+	})
+}
+
 func BenchmarkOverlayfsIO(b *testing.B) {
 	type testCase struct {
 		OverlayEnabled bool
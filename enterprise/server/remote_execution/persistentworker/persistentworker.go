@@ -3,14 +3,18 @@ package persistentworker
 import (
 	"bufio"
 	"context"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/commandutil"
@@ -40,6 +44,10 @@ const (
 
 	// Protocol value identifying the protobuf persistent worker protocol.
 	protobufProtocol = "proto"
+
+	// Node property that Bazel sets on the inputs that make up a worker's
+	// tools when --experimental_remote_mark_tool_inputs is set.
+	toolInputNodePropertyName = "bazel_tool_input"
 )
 
 var (
@@ -49,10 +57,18 @@ var (
 
 // Worker represents a persistent worker process that receives commands over
 // stdin and sends responses on stdout.
+//
+// Multiplex workers may be sent several requests at once, which are told
+// apart by their request IDs. Other workers are sent one request at a time.
 type Worker struct {
 	workspace *workspace.Workspace
 	container container.CommandContainer
 	protocol  string // "json" or "proto"
+	multiplex bool
+
+	// Identifies the startup arguments and tool inputs that the worker was
+	// started with.
+	fingerprint string
 
 	stdinWriter *io.PipeWriter
 	stderr      lockingbuffer.LockingBuffer
@@ -60,6 +76,20 @@ type Worker struct {
 	stdoutReader *bufio.Reader
 	jsonDecoder  *json.Decoder
 
+	// Held while a request is being sent, and for the whole request if the
+	// worker doesn't support multiplexing.
+	writeMu sync.Mutex
+	execMu  sync.Mutex
+
+	mu            sync.Mutex // PROTECTS(nextRequestID, pending, readErr, abandoned)
+	nextRequestID int32
+	pending       map[int32]chan *wkpb.WorkResponse
+	readErr       error
+	// Set if a request to a non-multiplex worker was abandoned before its
+	// response was read, in which case the next response can't be matched
+	// to the next request.
+	abandoned bool
+
 	stop func() error
 }
 
@@ -67,17 +97,21 @@ type Worker struct {
 // a long-running Exec() command.
 // The provided context should be a long-lived context that lives longer
 // than just a single task.
-func Start(ctx context.Context, workspace *workspace.Workspace, container container.CommandContainer, protocol string, command *repb.Command) *Worker {
+func Start(ctx context.Context, workspace *workspace.Workspace, container container.CommandContainer, protocol string, multiplex bool, command *repb.Command) *Worker {
 	stdinReader, stdinWriter := io.Pipe()
 	stdoutReader, stdoutWriter := io.Pipe()
 
+	args := parseArgs(command.GetArguments())
 	w := &Worker{
-		container: container,
-		workspace: workspace,
-		protocol:  protocol,
+		container:   container,
+		workspace:   workspace,
+		protocol:    protocol,
+		multiplex:   multiplex,
+		fingerprint: fingerprint(workspace, args.WorkerArgs),
 
 		stdinWriter:  stdinWriter,
 		stdoutReader: bufio.NewReader(stdoutReader),
+		pending:      map[int32]chan *wkpb.WorkResponse{},
 	}
 	if protocol == jsonProtocol {
 		w.jsonDecoder = json.NewDecoder(stdoutReader)
@@ -104,7 +138,6 @@ func Start(ctx context.Context, workspace *workspace.Workspace, container contai
 		}
 	}
 
-	args := parseArgs(command.GetArguments())
 	command = command.CloneVT()
 	command.Arguments = append(args.WorkerArgs, "--persistent_worker")
 
@@ -121,13 +154,122 @@ func Start(ctx context.Context, workspace *workspace.Workspace, container contai
 		res := w.container.Exec(ctx, command, stdio)
 		log.Debugf("Persistent worker exited with response: %+v, flagFiles: %+v, workerArgs: %+v", res, args.FlagFiles, args.WorkerArgs)
 	}()
+	go w.readResponses()
 
 	return w
 }
 
+// IsStale returns whether the worker can't run the given command because the
+// command's worker startup arguments, or the contents of the worker's tool
+// inputs, changed since the worker was started. Stale workers should be
+// stopped and replaced.
+func (w *Worker) IsStale(command *repb.Command) bool {
+	return fingerprint(w.workspace, parseArgs(command.GetArguments()).WorkerArgs) != w.fingerprint
+}
+
+// fingerprint identifies the worker process needed to run a command with the
+// given worker startup arguments: the arguments themselves, and the digests
+// of the inputs that make up the worker's tools. Tool inputs are the inputs
+// referenced by the startup arguments, such as the worker binary or jar, and
+// any inputs that Bazel marked as tool inputs.
+func fingerprint(ws *workspace.Workspace, workerArgs []string) string {
+	h := sha256.New()
+	var toolPaths []string
+	for _, arg := range workerArgs {
+		fmt.Fprintf(h, "arg:%q\n", arg)
+		toolPaths = append(toolPaths, filepath.Clean(arg))
+		if _, v, ok := strings.Cut(arg, "="); ok {
+			toolPaths = append(toolPaths, filepath.Clean(v))
+		}
+	}
+	for path, node := range ws.Inputs {
+		for _, p := range node.GetNodeProperties().GetProperties() {
+			if p.GetName() == toolInputNodePropertyName {
+				toolPaths = append(toolPaths, path)
+				break
+			}
+		}
+	}
+	slices.Sort(toolPaths)
+	for _, path := range slices.Compact(toolPaths) {
+		if node, ok := ws.Inputs[path]; ok {
+			fmt.Fprintf(h, "tool:%q:%s/%d\n", path, node.GetDigest().GetHash(), node.GetDigest().GetSizeBytes())
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// readResponses reads responses from the worker and passes each one to the
+// request that it's for, until the worker exits.
+func (w *Worker) readResponses() {
+	for {
+		rsp := &wkpb.WorkResponse{}
+		if err := w.unmarshalWorkResponse(rsp); err != nil {
+			w.mu.Lock()
+			w.readErr = err
+			for id, ch := range w.pending {
+				close(ch)
+				delete(w.pending, id)
+			}
+			w.mu.Unlock()
+			return
+		}
+		w.mu.Lock()
+		ch, ok := w.pending[rsp.GetRequestId()]
+		delete(w.pending, rsp.GetRequestId())
+		w.mu.Unlock()
+		if !ok {
+			log.Warningf("Persistent worker sent a response for unknown request %d", rsp.GetRequestId())
+			continue
+		}
+		ch <- rsp
+	}
+}
+
+// startRequest registers a new request and returns its ID, along with the
+// channel that its response will be passed to. The channel is closed if the
+// worker exits before responding.
+func (w *Worker) startRequest() (int32, chan *wkpb.WorkResponse, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.readErr != nil {
+		return 0, nil, w.readErr
+	}
+	if w.abandoned {
+		return 0, nil, status.UnavailableError("persistent worker is still busy with an abandoned request")
+	}
+	// Non-multiplex workers ignore request IDs, and leave them unset in their
+	// responses.
+	id := int32(0)
+	if w.multiplex {
+		w.nextRequestID++
+		id = w.nextRequestID
+	}
+	ch := make(chan *wkpb.WorkResponse, 1)
+	w.pending[id] = ch
+	return id, ch, nil
+}
+
+// abandonRequest stops waiting for the response to the given request.
+func (w *Worker) abandonRequest(id int32) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.pending[id]; !ok {
+		return
+	}
+	delete(w.pending, id)
+	if !w.multiplex {
+		w.abandoned = true
+	}
+}
+
 func (w *Worker) Exec(ctx context.Context, command *repb.Command) *interfaces.CommandResult {
-	// Clear any stderr that might be associated with a previous request.
-	w.stderr.Reset()
+	if !w.multiplex {
+		w.execMu.Lock()
+		defer w.execMu.Unlock()
+		// Clear any stderr that might be associated with a previous request.
+		w.stderr.Reset()
+	}
 
 	args := parseArgs(command.GetArguments())
 	expandedArguments, err := w.expandFlagFiles(args.FlagFiles)
@@ -148,23 +290,45 @@ func (w *Worker) Exec(ctx context.Context, command *repb.Command) *interfaces.Co
 		})
 	}
 
+	id, responses, err := w.startRequest()
+	if err != nil {
+		return commandutil.ErrorResult(status.UnavailableErrorf(
+			"persistent worker can't accept requests: %s\npersistent worker stderr:\n%s",
+			err, w.stderrDebugString()))
+	}
+
 	// Write the encoded request to stdin.
 	req := &wkpb.WorkRequest{
 		Inputs:    inputs,
 		Arguments: expandedArguments,
+		RequestId: id,
 	}
-	if err := w.marshalWorkRequest(req); err != nil {
+	w.writeMu.Lock()
+	err = w.marshalWorkRequest(req)
+	w.writeMu.Unlock()
+	if err != nil {
+		w.abandonRequest(id)
 		return commandutil.ErrorResult(status.UnavailableErrorf(
 			"failed to send persistent work request: %s\npersistent worker stderr:\n%s",
 			err, w.stderrDebugString()))
 	}
 
-	// Decode the response from stdout.
-	rsp := &wkpb.WorkResponse{}
-	if err := w.unmarshalWorkResponse(rsp); err != nil {
-		return commandutil.ErrorResult(status.UnavailableErrorf(
-			"failed to read persistent work response: %s\npersistent worker stderr:\n%s",
-			err, w.stderrDebugString()))
+	// Wait for the response to be read from stdout.
+	var rsp *wkpb.WorkResponse
+	select {
+	case <-ctx.Done():
+		w.abandonRequest(id)
+		return commandutil.ErrorResult(status.FromContextError(ctx))
+	case r, ok := <-responses:
+		if !ok {
+			w.mu.Lock()
+			err := w.readErr
+			w.mu.Unlock()
+			return commandutil.ErrorResult(status.UnavailableErrorf(
+				"failed to read persistent work response: %s\npersistent worker stderr:\n%s",
+				err, w.stderrDebugString()))
+		}
+		rsp = r
 	}
 	return &interfaces.CommandResult{
 		Stderr:   []byte(rsp.Output),
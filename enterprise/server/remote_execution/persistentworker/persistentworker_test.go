@@ -0,0 +1,195 @@
+package persistentworker
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/container"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/workspace"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	wkpb "github.com/buildbuddy-io/buildbuddy/proto/worker"
+)
+
+// fakeWorkerContainer runs a fake worker process that speaks the proto
+// worker protocol.
+type fakeWorkerContainer struct {
+	container.CommandContainer
+	serve func(requests <-chan *wkpb.WorkRequest, respond func(*wkpb.WorkResponse))
+}
+
+func (c *fakeWorkerContainer) Exec(ctx context.Context, cmd *repb.Command, stdio *interfaces.Stdio) *interfaces.CommandResult {
+	requests := make(chan *wkpb.WorkRequest)
+	go func() {
+		defer close(requests)
+		r := bufio.NewReader(stdio.Stdin)
+		for {
+			size, err := binary.ReadUvarint(r)
+			if err != nil {
+				return
+			}
+			data := make([]byte, size)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+			req := &wkpb.WorkRequest{}
+			if err := proto.Unmarshal(data, req); err != nil {
+				return
+			}
+			requests <- req
+		}
+	}()
+	var mu sync.Mutex
+	respond := func(rsp *wkpb.WorkResponse) {
+		mu.Lock()
+		defer mu.Unlock()
+		buf := protowire.AppendVarint(nil, uint64(proto.Size(rsp)))
+		buf, _ = proto.MarshalOptions{}.MarshalAppend(buf, rsp)
+		stdio.Stdout.Write(buf)
+	}
+	c.serve(requests, respond)
+	return &interfaces.CommandResult{}
+}
+
+// echo returns the response of a worker that echoes the request's arguments.
+func echo(req *wkpb.WorkRequest) *wkpb.WorkResponse {
+	return &wkpb.WorkResponse{
+		RequestId: req.GetRequestId(),
+		Output:    strings.Join(req.GetArguments(), " "),
+	}
+}
+
+// startWorker starts a worker with the given fake process, and returns it
+// along with the command to send it a request whose arguments are args.
+func startWorker(t *testing.T, multiplex bool, serve func(requests <-chan *wkpb.WorkRequest, respond func(*wkpb.WorkResponse))) (*Worker, func(args ...string) *repb.Command) {
+	ws, err := workspace.New(nil /*=env*/, testfs.MakeTempDir(t), &workspace.Opts{})
+	require.NoError(t, err)
+	n := 0
+	command := func(args ...string) *repb.Command {
+		n++
+		name := filepath.Join("flagfile", strings.Repeat("x", n))
+		require.NoError(t, os.MkdirAll(filepath.Join(ws.Path(), "flagfile"), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(ws.Path(), name), []byte(strings.Join(args, "\n")), 0644))
+		return &repb.Command{Arguments: []string{"./worker", "@" + name}}
+	}
+	c := &fakeWorkerContainer{serve: serve}
+	w := Start(context.Background(), ws, c, "proto" /*=protocol*/, multiplex, command())
+	t.Cleanup(func() { w.Stop() })
+	return w, command
+}
+
+func TestExec(t *testing.T) {
+	w, command := startWorker(t, false /*=multiplex*/, func(requests <-chan *wkpb.WorkRequest, respond func(*wkpb.WorkResponse)) {
+		for req := range requests {
+			// Non-multiplex workers are sent requests without IDs.
+			assert.Equal(t, int32(0), req.GetRequestId())
+			respond(echo(req))
+		}
+	})
+
+	for _, arg := range []string{"a", "b", "c"} {
+		res := w.Exec(context.Background(), command(arg))
+		require.NoError(t, res.Error)
+		assert.Equal(t, arg, string(res.Stderr))
+	}
+}
+
+func TestExec_Multiplex(t *testing.T) {
+	const numRequests = 3
+	w, command := startWorker(t, true /*=multiplex*/, func(requests <-chan *wkpb.WorkRequest, respond func(*wkpb.WorkResponse)) {
+		// Wait until every request was sent before responding, and respond
+		// in reverse order.
+		var reqs []*wkpb.WorkRequest
+		for req := range requests {
+			reqs = append(reqs, req)
+			if len(reqs) == numRequests {
+				break
+			}
+		}
+		for i := len(reqs) - 1; i >= 0; i-- {
+			respond(echo(reqs[i]))
+		}
+		for range requests {
+		}
+	})
+
+	var wg sync.WaitGroup
+	results := make([]*interfaces.CommandResult, numRequests)
+	for i := range numRequests {
+		cmd := command("request", strings.Repeat("x", i+1))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = w.Exec(context.Background(), cmd)
+		}()
+	}
+	wg.Wait()
+
+	// Each request got its own response.
+	for i, res := range results {
+		require.NoError(t, res.Error)
+		assert.Equal(t, "request "+strings.Repeat("x", i+1), string(res.Stderr))
+	}
+}
+
+func TestExec_AbandonedRequest(t *testing.T) {
+	release := make(chan struct{})
+	w, command := startWorker(t, false /*=multiplex*/, func(requests <-chan *wkpb.WorkRequest, respond func(*wkpb.WorkResponse)) {
+		for req := range requests {
+			<-release
+			respond(echo(req))
+		}
+	})
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	res := w.Exec(ctx, command("slow"))
+	require.True(t, status.IsDeadlineExceededError(res.Error), "expected DeadlineExceeded, got %v", res.Error)
+
+	// The response to the abandoned request would be mistaken for the
+	// response to the next one, so the worker can't be used anymore.
+	res = w.Exec(context.Background(), command("next"))
+	require.True(t, status.IsUnavailableError(res.Error), "expected Unavailable, got %v", res.Error)
+}
+
+func TestExec_MultiplexAbandonedRequest(t *testing.T) {
+	w, command := startWorker(t, true /*=multiplex*/, func(requests <-chan *wkpb.WorkRequest, respond func(*wkpb.WorkResponse)) {
+		for req := range requests {
+			if req.GetArguments()[0] == "slow" {
+				// Respond to the slow request after the next one.
+				next := <-requests
+				respond(echo(next))
+			}
+			respond(echo(req))
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	res := w.Exec(ctx, command("slow"))
+	require.True(t, status.IsDeadlineExceededError(res.Error), "expected DeadlineExceeded, got %v", res.Error)
+
+	// Multiplex workers keep accepting requests, and late responses to
+	// abandoned requests are dropped.
+	for _, arg := range []string{"next", "last"} {
+		res = w.Exec(context.Background(), command(arg))
+		require.NoError(t, res.Error)
+		assert.Equal(t, arg, string(res.Stderr))
+	}
+}
@@ -4,13 +4,18 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
+	"math"
+	"os"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/resources"
 	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
@@ -30,8 +35,11 @@ var (
 	enablePodman               = flag.Bool("executor.enable_podman", false, "Enables running execution commands inside podman containers.")
 	enableOCI                  = flag.Bool("executor.enable_oci", false, "Enables running execution commands using an OCI runtime directly.")
 	enableSandbox              = flag.Bool("executor.enable_sandbox", false, "Enables running execution commands inside of sandbox-exec.")
+	enableMacVM                = flag.Bool("executor.enable_macvm", false, "Enables running execution commands inside of macOS VMs, using Virtualization.framework. Requires tart (see executor.macvm.tart_binary).")
+	defaultMacVMImage          = flag.String("executor.macvm.default_image", "", "The default VM image to use for actions with macvm isolation that don't set a container-image. Ex: ghcr.io/cirruslabs/macos-sequoia-xcode:latest")
 	EnableFirecracker          = flag.Bool("executor.enable_firecracker", false, "Enables running execution commands inside of firecracker VMs")
 	containerRegistryRegion    = flag.String("executor.container_registry_region", "", "All occurrences of '{{region}}' in container image names will be replaced with this string, if specified.")
+	firecrackerFallbackType    = flag.String("executor.firecracker_fallback_isolation_type", "", "If set, actions that request firecracker isolation are run with this isolation type instead when firecracker is unavailable on this executor, for example because /dev/kvm is missing. If empty, such actions fail.")
 	forcedNetworkIsolationType = flag.String("executor.forced_network_isolation_type", "", "If set, run all commands that require networking with this isolation")
 	defaultImage               = flag.String("executor.default_image", Ubuntu16_04Image, "The default docker image to use to warm up executors or if no platform property is set. Ex: gcr.io/flame-public/executor-docker-default:enterprise-v1.5.4")
 	enableVFS                  = flag.Bool("executor.enable_vfs", false, "Whether FUSE based filesystem is enabled.")
@@ -71,36 +79,45 @@ const (
 	// empty or unset.
 	unsetContainerImageVal = "none"
 
-	RecycleRunnerPropertyName            = "recycle-runner"
-	AffinityRoutingPropertyName          = "affinity-routing"
-	RunnerRecyclingMaxWaitPropertyName   = "runner-recycling-max-wait"
-	preserveWorkspacePropertyName        = "preserve-workspace"
-	nonrootWorkspacePropertyName         = "nonroot-workspace"
-	overlayfsWorkspacePropertyName       = "overlayfs-workspace"
-	cleanWorkspaceInputsPropertyName     = "clean-workspace-inputs"
-	persistentWorkerPropertyName         = "persistent-workers"
-	persistentWorkerKeyPropertyName      = "persistentWorkerKey"
-	persistentWorkerProtocolPropertyName = "persistentWorkerProtocol"
-	WorkflowIDPropertyName               = "workflow-id"
-	workloadIsolationPropertyName        = "workload-isolation-type"
-	initDockerdPropertyName              = "init-dockerd"
-	enableDockerdTCPPropertyName         = "enable-dockerd-tcp"
-	enableVFSPropertyName                = "enable-vfs"
-	HostedBazelAffinityKeyPropertyName   = "hosted-bazel-affinity-key"
-	useSelfHostedExecutorsPropertyName   = "use-self-hosted-executors"
-	disableMeasuredTaskSizePropertyName  = "debug-disable-measured-task-size"
-	disablePredictedTaskSizePropertyName = "debug-disable-predicted-task-size"
-	extraArgsPropertyName                = "extra-args"
-	EnvOverridesPropertyName             = "env-overrides"
-	EnvOverridesBase64PropertyName       = "env-overrides-base64"
-	IncludeSecretsPropertyName           = "include-secrets"
-	DefaultTimeoutPropertyName           = "default-timeout"
-	TerminationGracePeriodPropertyName   = "termination-grace-period"
+	RecycleRunnerPropertyName             = "recycle-runner"
+	AffinityRoutingPropertyName           = "affinity-routing"
+	RunnerRecyclingMaxWaitPropertyName    = "runner-recycling-max-wait"
+	preserveWorkspacePropertyName         = "preserve-workspace"
+	nonrootWorkspacePropertyName          = "nonroot-workspace"
+	overlayfsWorkspacePropertyName        = "overlayfs-workspace"
+	cleanWorkspaceInputsPropertyName      = "clean-workspace-inputs"
+	persistentWorkerPropertyName          = "persistent-workers"
+	persistentWorkerKeyPropertyName       = "persistentWorkerKey"
+	persistentWorkerProtocolPropertyName  = "persistentWorkerProtocol"
+	persistentWorkerMultiplexPropertyName = "persistentWorkerMultiplex"
+	WorkflowIDPropertyName                = "workflow-id"
+	workloadIsolationPropertyName         = "workload-isolation-type"
+	initDockerdPropertyName               = "init-dockerd"
+	enableDockerdTCPPropertyName          = "enable-dockerd-tcp"
+	enableVFSPropertyName                 = "enable-vfs"
+	HostedBazelAffinityKeyPropertyName    = "hosted-bazel-affinity-key"
+	useSelfHostedExecutorsPropertyName    = "use-self-hosted-executors"
+	disableMeasuredTaskSizePropertyName   = "debug-disable-measured-task-size"
+	disablePredictedTaskSizePropertyName  = "debug-disable-predicted-task-size"
+	extraArgsPropertyName                 = "extra-args"
+	EnvOverridesPropertyName              = "env-overrides"
+	EnvOverridesBase64PropertyName        = "env-overrides-base64"
+	IncludeSecretsPropertyName            = "include-secrets"
+	DefaultTimeoutPropertyName            = "default-timeout"
+	TerminationGracePeriodPropertyName    = "termination-grace-period"
+	priorityLanePropertyName              = "priority-lane"
+	disableActionMergingPropertyName      = "disable-action-merging"
+	speculativeExecutionPropertyName      = "speculative-execution"
+	NetworkPolicyPropertyName             = "network-policy"
+	remoteSnapshotSharingPropertyName     = "remote-snapshot-sharing"
+	disableIsolationFallbackPropertyName  = "disable-isolation-fallback"
+	gpusPropertyName                      = "gpus"
 
 	OperatingSystemPropertyName = "OSFamily"
 	LinuxOperatingSystemName    = "linux"
 	defaultOperatingSystemName  = LinuxOperatingSystemName
 	DarwinOperatingSystemName   = "darwin"
+	WindowsOperatingSystemName  = "windows"
 
 	CPUArchitecturePropertyName = "Arch"
 	AMD64ArchitectureName       = "amd64"
@@ -114,6 +131,11 @@ const (
 	// Using the property defined here: https://github.com/bazelbuild/bazel-toolchains/blob/v5.1.0/rules/exec_properties/exec_properties.bzl#L156
 	dockerNetworkPropertyName = "dockerNetwork"
 
+	// Values of the network-policy property.
+	NoNetworkPolicy           = "none"
+	InternalOnlyNetworkPolicy = "internal-only"
+	FullNetworkPolicy         = "full"
+
 	// A BuildBuddy Compute Unit is defined as 1 cpu and 2.5GB of memory.
 	EstimatedComputeUnitsPropertyName = "EstimatedComputeUnits"
 
@@ -124,6 +146,12 @@ const (
 	// requires a relatively large amount of free space compared to typical actions.
 	EstimatedFreeDiskPropertyName = "EstimatedFreeDiskBytes"
 
+	// EstimatedDiskBandwidthPropertyName specifies the disk bandwidth that a
+	// task needs, in bytes per second. Executors can limit tasks to their
+	// estimated bandwidth, so tasks doing lots of IO, such as large link
+	// steps, don't starve other tasks on the same disk.
+	EstimatedDiskBandwidthPropertyName = "EstimatedDiskBandwidth"
+
 	EstimatedCPUPropertyName    = "EstimatedCPU"
 	EstimatedMemoryPropertyName = "EstimatedMemory"
 
@@ -136,6 +164,7 @@ const (
 	FirecrackerContainerType ContainerType = "firecracker"
 	OCIContainerType         ContainerType = "oci"
 	SandboxContainerType     ContainerType = "sandbox"
+	MacVMContainerType       ContainerType = "macvm"
 
 	// The app will mint a signed client identity token to workflows.
 	workflowClientIdentityTokenLifetime = 12 * time.Hour
@@ -155,6 +184,7 @@ type Properties struct {
 	EstimatedMilliCPU         int64
 	EstimatedMemoryBytes      int64
 	EstimatedFreeDiskBytes    int64
+	EstimatedDiskBandwidth    int64
 	CustomResources           []*scpb.CustomResource
 	ContainerImage            string
 	ContainerRegistryUsername string
@@ -213,8 +243,48 @@ type Properties struct {
 	PersistentWorker         bool
 	PersistentWorkerKey      string
 	PersistentWorkerProtocol string
-	WorkflowID               string
-	HostedBazelAffinityKey   string
+	// Whether the persistent worker supports multiplexed requests.
+	PersistentWorkerMultiplex bool
+	WorkflowID                string
+	HostedBazelAffinityKey    string
+
+	// PriorityLane is the name of the scheduler priority lane that the task
+	// is queued in. The scheduler maps lane names to weights.
+	PriorityLane string
+
+	// DisableActionMerging specifies that the action should always get its
+	// own execution, rather than being merged with an identical in-flight
+	// execution. This is intended for non-deterministic actions, whose
+	// callers expect each request to run the action again.
+	DisableActionMerging bool
+
+	// SpeculativeExecution specifies that if the action runs for longer than
+	// is usual for its mnemonic, a second copy of the action may be started
+	// on another executor, and the result of whichever copy finishes first is
+	// used.
+	SpeculativeExecution bool
+
+	// NetworkPolicy restricts which addresses the action can reach: "none"
+	// (loopback only), "internal-only" (private IP ranges only), or "full".
+	// If empty, the action's network is configured by DockerNetwork.
+	NetworkPolicy string
+
+	// RemoteSnapshotSharing specifies that snapshots of the action's recycled
+	// firecracker VM should be saved to the remote cache, so that the VM can
+	// be resumed on any executor in the pool rather than only on the executor
+	// that created the snapshot. Has no effect unless remote snapshot sharing
+	// is enabled on the executor.
+	RemoteSnapshotSharing bool
+
+	// DisableIsolationFallback specifies that the action should fail rather
+	// than run with the executor's fallback isolation type if firecracker was
+	// requested but is unavailable on the executor.
+	DisableIsolationFallback bool
+
+	// GPUs is the number of GPUs assigned to the action. GPUs are scheduled
+	// as a custom resource, so GPU requests are also included in
+	// CustomResources.
+	GPUs int
 
 	// DisableMeasuredTaskSize disables measurement-based task sizing, even if
 	// it is enabled via flag, and instead uses the default / platform based
@@ -299,21 +369,54 @@ func ParseProperties(task *repb.ExecutionTask) (*Properties, error) {
 		return nil, err
 	}
 
+	networkPolicy := strings.ToLower(stringProp(m, NetworkPolicyPropertyName, ""))
+	switch networkPolicy {
+	case "", NoNetworkPolicy, InternalOnlyNetworkPolicy, FullNetworkPolicy:
+	default:
+		return nil, status.InvalidArgumentErrorf("parse execution property %q: value must be one of %q, %q, or %q", NetworkPolicyPropertyName, NoNetworkPolicy, InternalOnlyNetworkPolicy, FullNetworkPolicy)
+	}
+
 	// Parse custom resources
 	var customResources []*scpb.CustomResource
 	for k, v := range m {
 		if strings.HasPrefix(k, customResourcePrefix) {
-			name := strings.TrimPrefix(k, customResourcePrefix)
+			name := resources.NormalizeCustomResourceName(strings.TrimPrefix(k, customResourcePrefix))
+			if name == "" {
+				return nil, status.InvalidArgumentErrorf("parse execution property %q: resource name is required", k)
+			}
 			value, err := strconv.ParseFloat(v, 32)
 			if err != nil {
 				return nil, status.InvalidArgumentErrorf("parse execution property %q: value is not a valid float32", k)
 			}
+			if value < 0 || math.IsNaN(value) || math.IsInf(value, 0) {
+				return nil, status.InvalidArgumentErrorf("parse execution property %q: value must be a non-negative number", k)
+			}
 			customResources = append(customResources, &scpb.CustomResource{
 				Name:  name,
 				Value: float32(value),
 			})
 		}
 	}
+	gpus := 0
+	if v := stringProp(m, gpusPropertyName, ""); v != "" {
+		gpus, err = strconv.Atoi(v)
+		if err != nil || gpus < 0 {
+			return nil, status.InvalidArgumentErrorf("parse execution property %q: value must be a non-negative integer", gpusPropertyName)
+		}
+	}
+	if gpus > 0 {
+		if slices.ContainsFunc(customResources, func(r *scpb.CustomResource) bool { return r.GetName() == resources.GPUResourceName }) {
+			return nil, status.InvalidArgumentErrorf("execution properties %q and %q cannot both be set", gpusPropertyName, customResourcePrefix+resources.GPUResourceName)
+		}
+		customResources = append(customResources, &scpb.CustomResource{
+			Name:  resources.GPUResourceName,
+			Value: float32(gpus),
+		})
+	}
+	// Sort so that tasks requesting the same resources have identical sizes.
+	slices.SortFunc(customResources, func(a, b *scpb.CustomResource) int {
+		return strings.Compare(a.GetName(), b.GetName())
+	})
 
 	poolType := interfaces.PoolTypeDefault
 	if val, ok := m[strings.ToLower(useSelfHostedExecutorsPropertyName)]; ok {
@@ -333,6 +436,7 @@ func ParseProperties(task *repb.ExecutionTask) (*Properties, error) {
 		EstimatedMemoryBytes:      iecBytesProp(m, EstimatedMemoryPropertyName, 0),
 		EstimatedMilliCPU:         milliCPUProp(m, EstimatedCPUPropertyName, 0),
 		EstimatedFreeDiskBytes:    iecBytesProp(m, EstimatedFreeDiskPropertyName, 0),
+		EstimatedDiskBandwidth:    iecBytesProp(m, EstimatedDiskBandwidthPropertyName, 0),
 		CustomResources:           customResources,
 		ContainerImage:            stringProp(m, containerImagePropertyName, ""),
 		ContainerRegistryUsername: stringProp(m, containerRegistryUsernamePropertyName, ""),
@@ -358,8 +462,16 @@ func ParseProperties(task *repb.ExecutionTask) (*Properties, error) {
 		PersistentWorker:          boolProp(m, persistentWorkerPropertyName, false),
 		PersistentWorkerKey:       stringProp(m, persistentWorkerKeyPropertyName, ""),
 		PersistentWorkerProtocol:  stringProp(m, persistentWorkerProtocolPropertyName, ""),
+		PersistentWorkerMultiplex: boolProp(m, persistentWorkerMultiplexPropertyName, false),
 		WorkflowID:                stringProp(m, WorkflowIDPropertyName, ""),
 		HostedBazelAffinityKey:    stringProp(m, HostedBazelAffinityKeyPropertyName, ""),
+		PriorityLane:              strings.ToLower(stringProp(m, priorityLanePropertyName, "")),
+		DisableActionMerging:      boolProp(m, disableActionMergingPropertyName, false),
+		SpeculativeExecution:      boolProp(m, speculativeExecutionPropertyName, false),
+		NetworkPolicy:             networkPolicy,
+		RemoteSnapshotSharing:     boolProp(m, remoteSnapshotSharingPropertyName, false),
+		DisableIsolationFallback:  boolProp(m, disableIsolationFallbackPropertyName, false),
+		GPUs:                      gpus,
 		DisableMeasuredTaskSize:   boolProp(m, disableMeasuredTaskSizePropertyName, false),
 		DisablePredictedTaskSize:  boolProp(m, disablePredictedTaskSizePropertyName, false),
 		ExtraArgs:                 stringListProp(m, extraArgsPropertyName),
@@ -412,24 +524,24 @@ func GetExecutorProperties() *ExecutorProperties {
 	// isolation method to use if none was set.
 
 	if *enableOCI {
-		if runtime.GOOS == "darwin" {
-			log.Warningf("OCI runtime was enabled, but is unsupported on darwin. Ignoring.")
+		if runtime.GOOS != "linux" {
+			log.Warningf("OCI runtime was enabled, but is unsupported on %s. Ignoring.", runtime.GOOS)
 		} else {
 			p.SupportedIsolationTypes = append(p.SupportedIsolationTypes, OCIContainerType)
 		}
 	}
 
 	if *dockerSocket != "" {
-		if runtime.GOOS == "darwin" {
-			log.Warning("Docker was enabled, but is unsupported on darwin. Ignoring.")
+		if runtime.GOOS != "linux" {
+			log.Warningf("Docker was enabled, but is unsupported on %s. Ignoring.", runtime.GOOS)
 		} else {
 			p.SupportedIsolationTypes = append(p.SupportedIsolationTypes, DockerContainerType)
 		}
 	}
 
 	if *enablePodman {
-		if runtime.GOOS == "darwin" {
-			log.Warning("Podman was enabled, but is unsupported on darwin. Ignoring.")
+		if runtime.GOOS != "linux" {
+			log.Warningf("Podman was enabled, but is unsupported on %s. Ignoring.", runtime.GOOS)
 		} else {
 			p.SupportedIsolationTypes = append(p.SupportedIsolationTypes, PodmanContainerType)
 		}
@@ -438,7 +550,7 @@ func GetExecutorProperties() *ExecutorProperties {
 	if *EnableFirecracker {
 		if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
 			log.Warningf("Firecracker was enabled, but is unsupported on %s/%s. Ignoring.", runtime.GOOS, runtime.GOARCH)
-		} else {
+		} else if kvmAvailable() {
 			p.SupportedIsolationTypes = append(p.SupportedIsolationTypes, FirecrackerContainerType)
 		}
 	}
@@ -451,8 +563,16 @@ func GetExecutorProperties() *ExecutorProperties {
 		}
 	}
 
+	if *enableMacVM {
+		if runtime.GOOS == "darwin" && runtime.GOARCH == "arm64" {
+			p.SupportedIsolationTypes = append(p.SupportedIsolationTypes, MacVMContainerType)
+		} else {
+			log.Warningf("macOS VMs were enabled, but are unsupported on %s/%s. Ignoring.", runtime.GOOS, runtime.GOARCH)
+		}
+	}
+
 	// Special case: for backwards compatibility, support bare-runners when docker
-	// is not enabled. Typically, this happens for macs.
+	// is not enabled. Typically, this happens for macs and windows.
 	if *enableBareRunner || len(p.SupportedIsolationTypes) == 0 {
 		p.SupportedIsolationTypes = append(p.SupportedIsolationTypes, BareContainerType)
 	}
@@ -460,6 +580,34 @@ func GetExecutorProperties() *ExecutorProperties {
 	return p
 }
 
+// kvmAvailable returns whether /dev/kvm can be opened, which is required to
+// run firecracker VMs. It is typically unavailable when the executor is itself
+// running in a VM that does not support nested virtualization.
+var kvmAvailable = sync.OnceValue(func() bool {
+	f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		log.Warningf("Firecracker was enabled, but /dev/kvm is unavailable (%s). Ignoring.", err)
+		return false
+	}
+	f.Close()
+	return true
+})
+
+// IsolationFallbackWarning returns a warning to be shown to the user if the
+// task requested firecracker isolation, but was run with the fallback
+// isolation type because firecracker is unavailable on this executor. It
+// returns an empty string otherwise.
+func IsolationFallbackWarning(task *repb.ExecutionTask, effectiveIsolationType string) string {
+	if *firecrackerFallbackType == "" || effectiveIsolationType != *firecrackerFallbackType {
+		return ""
+	}
+	props, err := ParseProperties(task)
+	if err != nil || props.WorkloadIsolationType != string(FirecrackerContainerType) {
+		return ""
+	}
+	return fmt.Sprintf("Firecracker isolation was requested, but is unavailable on the executor. The action was run with %q isolation instead. Set the %q platform property to \"true\" to fail instead.", effectiveIsolationType, disableIsolationFallbackPropertyName)
+}
+
 // ApplyOverrides modifies the platformProps and command as needed to match the
 // locally configured executor properties.
 func ApplyOverrides(env environment.Env, executorProps *ExecutorProperties, platformProps *Properties, command *repb.Command) error {
@@ -469,7 +617,7 @@ func ApplyOverrides(env environment.Env, executorProps *ExecutorProperties, plat
 
 	// If forcedNetworkIsolationType is set, force isolation (usually to
 	// firecracker) for this command.
-	if *forcedNetworkIsolationType != "" && platformProps.DockerNetwork != "none" {
+	if *forcedNetworkIsolationType != "" && platformProps.DockerNetwork != "none" && platformProps.NetworkPolicy != NoNetworkPolicy {
 		platformProps.WorkloadIsolationType = *forcedNetworkIsolationType
 	}
 
@@ -482,11 +630,33 @@ func ApplyOverrides(env environment.Env, executorProps *ExecutorProperties, plat
 		}
 	}
 
+	// If firecracker is unavailable on this executor, fall back to the
+	// configured isolation type, unless the task opted out of falling back.
+	if platformProps.WorkloadIsolationType == string(FirecrackerContainerType) &&
+		!executorProps.SupportsIsolation(FirecrackerContainerType) &&
+		*firecrackerFallbackType != "" &&
+		!platformProps.DisableIsolationFallback {
+		platformProps.WorkloadIsolationType = *firecrackerFallbackType
+	}
+
 	// Check that the selected isolation type is supported by this executor.
 	if !executorProps.SupportsIsolation(ContainerType(platformProps.WorkloadIsolationType)) {
 		return status.InvalidArgumentErrorf("The requested workload isolation type %q is unsupported by this executor. Supported types: %s)", platformProps.WorkloadIsolationType, executorProps.SupportedIsolationTypes)
 	}
 
+	// Restricted network policies are enforced using the net namespaces that
+	// are set up for OCI containers.
+	if platformProps.NetworkPolicy != "" && platformProps.NetworkPolicy != FullNetworkPolicy && platformProps.WorkloadIsolationType != string(OCIContainerType) {
+		return status.InvalidArgumentErrorf("The network policy %q is only supported with workload isolation type %q.", platformProps.NetworkPolicy, OCIContainerType)
+	}
+
+	// GPUs are only passed through to OCI containers.
+	// TODO: pass GPUs through to firecracker VMs. This requires VFIO PCI
+	// passthrough, which the firecracker VMM doesn't support yet.
+	if platformProps.GPUs > 0 && platformProps.WorkloadIsolationType != string(OCIContainerType) {
+		return status.InvalidArgumentErrorf("GPUs are only supported with workload isolation type %q.", OCIContainerType)
+	}
+
 	// Normalize the container image string
 	if platformProps.WorkloadIsolationType == string(BareContainerType) {
 		// BareRunner strings become ""
@@ -497,6 +667,19 @@ func ApplyOverrides(env environment.Env, executorProps *ExecutorProperties, plat
 			// image but bare runner is configured.
 			return status.InvalidArgumentError("Container images are not supported by this executor.")
 		}
+	} else if platformProps.WorkloadIsolationType == string(MacVMContainerType) {
+		// VM images are OCI artifacts, which are referenced the same way as
+		// container images, but there is no sensible default for them.
+		if strings.EqualFold(platformProps.ContainerImage, "none") || platformProps.ContainerImage == "" {
+			if *defaultMacVMImage == "" {
+				return status.InvalidArgumentError("A container-image is required for macvm isolation.")
+			}
+			platformProps.ContainerImage = *defaultMacVMImage
+		} else if !strings.HasPrefix(platformProps.ContainerImage, DockerPrefix) {
+			return status.InvalidArgumentError("Malformed container image string.")
+		} else {
+			platformProps.ContainerImage = containerImageName(platformProps.ContainerImage)
+		}
 	} else {
 		// OCI container references lose the "docker://" prefix. If no
 		// container was set then we set our default.
@@ -511,7 +694,8 @@ func ApplyOverrides(env environment.Env, executorProps *ExecutorProperties, plat
 		platformProps.ContainerImage = containerImageName(platformProps.ContainerImage)
 	}
 
-	if strings.EqualFold(platformProps.OS, DarwinOperatingSystemName) {
+	// Xcode is located on the host, so VMs have to provide their own.
+	if strings.EqualFold(platformProps.OS, DarwinOperatingSystemName) && platformProps.WorkloadIsolationType != string(MacVMContainerType) {
 		appleSDKVersion := ""
 		appleSDKPlatform := "MacOSX"
 		xcodeVersion := executorProps.DefaultXcodeVersion
@@ -750,6 +934,12 @@ func DefaultImage() string {
 	return *defaultImage
 }
 
+// DefaultMacVMImage returns the default VM image for macvm isolation, or "" if
+// there is no default.
+func DefaultMacVMImage() string {
+	return *defaultMacVMImage
+}
+
 // IsCICommand returns whether the given command is either a BuildBuddy workflow
 // or a GitHub Actions runner task. These commands are longer-running and may
 // themselves invoke bazel.
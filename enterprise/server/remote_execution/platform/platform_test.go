@@ -213,6 +213,25 @@ func TestParse_EstimatedFreeDisk(t *testing.T) {
 	}
 }
 
+func TestParse_EstimatedDiskBandwidth(t *testing.T) {
+	for _, testCase := range []struct {
+		rawValue      string
+		expectedValue int64
+	}{
+		{"", 0},
+		{"NOT_AN_INT", 0},
+		{"1e8", 100_000_000},
+		{"100MB", 100 * 1024 * 1024},
+	} {
+		plat := &repb.Platform{Properties: []*repb.Platform_Property{
+			{Name: "EstimatedDiskBandwidth", Value: testCase.rawValue},
+		}}
+		platformProps, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+		require.NoError(t, err)
+		assert.Equal(t, testCase.expectedValue, platformProps.EstimatedDiskBandwidth)
+	}
+}
+
 func TestParse_EstimatedCPU(t *testing.T) {
 	for _, testCase := range []struct {
 		name          string
@@ -305,13 +324,58 @@ func TestParse_CustomResources_Valid(t *testing.T) {
 	}}, p.CustomResources, protocmp.Transform()))
 }
 
-func TestParse_CustomResources_Invalid(t *testing.T) {
+func TestParse_CustomResources_Multiple(t *testing.T) {
 	props := []*repb.Platform_Property{
+		{Name: "resources:xilinx-license", Value: "1"},
+		{Name: "resources:NVIDIA.com/gpu", Value: "2"},
+	}
+	task := &repb.ExecutionTask{Command: &repb.Command{Platform: &repb.Platform{Properties: props}}}
+	p, err := ParseProperties(task)
+	require.NoError(t, err)
+	require.Empty(t, cmp.Diff([]*scpb.CustomResource{
+		{Name: "nvidia.com/gpu", Value: 2},
+		{Name: "xilinx-license", Value: 1},
+	}, p.CustomResources, protocmp.Transform()))
+}
+
+func TestParse_CustomResources_Invalid(t *testing.T) {
+	for _, prop := range []*repb.Platform_Property{
 		{Name: "resources:foo", Value: "blah"},
+		{Name: "resources:foo", Value: "-1"},
+		{Name: "resources:foo", Value: "NaN"},
+		{Name: "resources:", Value: "1"},
+	} {
+		task := &repb.ExecutionTask{Command: &repb.Command{Platform: &repb.Platform{Properties: []*repb.Platform_Property{prop}}}}
+		_, err := ParseProperties(task)
+		require.True(t, status.IsInvalidArgumentError(err), "%s=%s: expected InvalidArgument, got %s", prop.GetName(), prop.GetValue(), gstatus.Code(err))
+	}
+}
+
+func TestParse_GPUs(t *testing.T) {
+	props := []*repb.Platform_Property{
+		{Name: "gpus", Value: "2"},
+		{Name: "resources:xilinx-license", Value: "1"},
 	}
 	task := &repb.ExecutionTask{Command: &repb.Command{Platform: &repb.Platform{Properties: props}}}
-	_, err := ParseProperties(task)
-	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %s", gstatus.Code(err))
+	p, err := ParseProperties(task)
+	require.NoError(t, err)
+	require.Equal(t, 2, p.GPUs)
+	require.Empty(t, cmp.Diff([]*scpb.CustomResource{
+		{Name: "gpu", Value: 2},
+		{Name: "xilinx-license", Value: 1},
+	}, p.CustomResources, protocmp.Transform()))
+}
+
+func TestParse_GPUs_Invalid(t *testing.T) {
+	for _, props := range [][]*repb.Platform_Property{
+		{{Name: "gpus", Value: "-1"}},
+		{{Name: "gpus", Value: "0.5"}},
+		{{Name: "gpus", Value: "1"}, {Name: "resources:gpu", Value: "1"}},
+	} {
+		task := &repb.ExecutionTask{Command: &repb.Command{Platform: &repb.Platform{Properties: props}}}
+		_, err := ParseProperties(task)
+		require.True(t, status.IsInvalidArgumentError(err), "%v: expected InvalidArgument, got %s", props, gstatus.Code(err))
+	}
 }
 
 func TestParse_ApplyOverrides(t *testing.T) {
@@ -603,6 +667,122 @@ func TestForceNetworkIsolationType(t *testing.T) {
 	}
 }
 
+func TestNetworkPolicy(t *testing.T) {
+	// Invalid values:
+	plat := &repb.Platform{Properties: []*repb.Platform_Property{
+		{Name: "network-policy", Value: "internal"},
+	}}
+	_, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %s", err)
+
+	ociOnly := &ExecutorProperties{SupportedIsolationTypes: []ContainerType{OCIContainerType}}
+	for _, testCase := range []struct {
+		rawValue       string
+		executorProps  *ExecutorProperties
+		expectedPolicy string
+		errorExpected  bool
+	}{
+		{"", podmanAndFirecracker, "", false},
+		{"full", podmanAndFirecracker, "full", false},
+		{"None", ociOnly, "none", false},
+		{"internal-only", ociOnly, "internal-only", false},
+		// Restricted policies can only be enforced for OCI containers.
+		{"none", podmanAndFirecracker, "none", true},
+		{"internal-only", podmanAndFirecracker, "internal-only", true},
+	} {
+		plat := &repb.Platform{Properties: []*repb.Platform_Property{
+			{Name: "container-image", Value: "docker://alpine"},
+			{Name: "network-policy", Value: testCase.rawValue},
+		}}
+		platformProps, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+		require.NoError(t, err)
+		assert.Equal(t, testCase.expectedPolicy, platformProps.NetworkPolicy)
+
+		env := testenv.GetTestEnv(t)
+		env.SetXcodeLocator(&xcodeLocator{})
+		err = ApplyOverrides(env, testCase.executorProps, platformProps, &repb.Command{})
+		if testCase.errorExpected {
+			assert.True(t, status.IsInvalidArgumentError(err), "%+v: expected InvalidArgument, got %s", testCase, err)
+		} else {
+			assert.NoError(t, err, "%+v", testCase)
+		}
+	}
+}
+
+func TestGPUsRequireOCI(t *testing.T) {
+	ociOnly := &ExecutorProperties{SupportedIsolationTypes: []ContainerType{OCIContainerType}}
+	for _, testCase := range []struct {
+		isolationType string
+		executorProps *ExecutorProperties
+		errorExpected bool
+	}{
+		{"oci", ociOnly, false},
+		{"", ociOnly, false},
+		{"podman", podmanAndFirecracker, true},
+		{"firecracker", podmanAndFirecracker, true},
+	} {
+		plat := &repb.Platform{Properties: []*repb.Platform_Property{
+			{Name: "container-image", Value: "docker://alpine"},
+			{Name: "workload-isolation-type", Value: testCase.isolationType},
+			{Name: "gpus", Value: "1"},
+		}}
+		platformProps, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+		require.NoError(t, err)
+
+		env := testenv.GetTestEnv(t)
+		env.SetXcodeLocator(&xcodeLocator{})
+		err = ApplyOverrides(env, testCase.executorProps, platformProps, &repb.Command{})
+		if testCase.errorExpected {
+			assert.True(t, status.IsInvalidArgumentError(err), "%+v: expected InvalidArgument, got %s", testCase, err)
+		} else {
+			assert.NoError(t, err, "%+v", testCase)
+		}
+	}
+}
+
+func TestFirecrackerFallback(t *testing.T) {
+	podmanOnly := &ExecutorProperties{SupportedIsolationTypes: []ContainerType{PodmanContainerType}}
+	for _, testCase := range []struct {
+		name                  string
+		executorProps         *ExecutorProperties
+		fallbackType          string
+		disableFallback       bool
+		expectedIsolationType string
+		errorExpected         bool
+		expectWarning         bool
+	}{
+		{name: "firecracker available", executorProps: podmanAndFirecracker, fallbackType: "podman", expectedIsolationType: "firecracker"},
+		{name: "no fallback configured", executorProps: podmanOnly, errorExpected: true},
+		{name: "fallback", executorProps: podmanOnly, fallbackType: "podman", expectedIsolationType: "podman", expectWarning: true},
+		{name: "fallback disabled by task", executorProps: podmanOnly, fallbackType: "podman", disableFallback: true, errorExpected: true},
+		{name: "fallback type unsupported", executorProps: podmanOnly, fallbackType: "oci", errorExpected: true},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			flags.Set(t, "executor.firecracker_fallback_isolation_type", testCase.fallbackType)
+			plat := &repb.Platform{Properties: []*repb.Platform_Property{
+				{Name: "container-image", Value: "docker://alpine"},
+				{Name: "workload-isolation-type", Value: "firecracker"},
+				{Name: "disable-isolation-fallback", Value: fmt.Sprint(testCase.disableFallback)},
+			}}
+			task := &repb.ExecutionTask{Command: &repb.Command{Platform: plat}}
+			platformProps, err := ParseProperties(task)
+			require.NoError(t, err)
+
+			env := testenv.GetTestEnv(t)
+			env.SetXcodeLocator(&xcodeLocator{})
+			err = ApplyOverrides(env, testCase.executorProps, platformProps, &repb.Command{})
+			if testCase.errorExpected {
+				require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %s", err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, testCase.expectedIsolationType, platformProps.WorkloadIsolationType)
+			warning := IsolationFallbackWarning(task, platformProps.WorkloadIsolationType)
+			require.Equal(t, testCase.expectWarning, warning != "", "warning: %q", warning)
+		})
+	}
+}
+
 type xcodeLocator struct {
 	sdks12_2    map[string]string
 	sdks12_4    map[string]string
@@ -628,3 +808,42 @@ func (x *xcodeLocator) PathsForVersionAndSDK(xcodeVersion string, sdk string) (s
 	sdkRoot := fmt.Sprintf("%s/%s", developerDir, sdkPath)
 	return developerDir, sdkRoot, nil
 }
+
+func TestMacVMImage(t *testing.T) {
+	macVMOnly := &ExecutorProperties{SupportedIsolationTypes: []ContainerType{MacVMContainerType}}
+	for _, testCase := range []struct {
+		name          string
+		image         string
+		defaultImage  string
+		expectedImage string
+		errorExpected bool
+	}{
+		{"explicit image", "docker://ghcr.io/cirruslabs/macos-sequoia-base:latest", "", "ghcr.io/cirruslabs/macos-sequoia-base:latest", false},
+		{"default image", "", "ghcr.io/cirruslabs/macos-sonoma-base:latest", "ghcr.io/cirruslabs/macos-sonoma-base:latest", false},
+		{"no default image", "", "", "", true},
+		{"malformed image", "ghcr.io/cirruslabs/macos-sequoia-base:latest", "", "", true},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			flags.Set(t, "executor.macvm.default_image", testCase.defaultImage)
+			plat := &repb.Platform{Properties: []*repb.Platform_Property{
+				{Name: "OSFamily", Value: "darwin"},
+				{Name: "workload-isolation-type", Value: "macvm"},
+				{Name: "container-image", Value: testCase.image},
+			}}
+			platformProps, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+			require.NoError(t, err)
+
+			env := testenv.GetTestEnv(t)
+			command := &repb.Command{}
+			err = ApplyOverrides(env, macVMOnly, platformProps, command)
+			if testCase.errorExpected {
+				assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %s", err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expectedImage, platformProps.ContainerImage)
+			// Host Xcode paths don't apply to VMs.
+			assert.Empty(t, command.GetEnvironmentVariables())
+		})
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"context"
 	"crypto/sha256"
 	"fmt"
+	"io"
+	"maps"
 	"math"
 	"path/filepath"
 	"strings"
@@ -61,9 +63,18 @@ var (
 	// How much memory a runner is allowed to use before we decide that it
 	// can't be added to the pool and must be cleaned up instead.
 	maxRunnerMemoryUsageBytes = flag.Int64("executor.runner_pool.max_runner_memory_usage_bytes", 0, "Maximum memory usage for a recycled runner; runners exceeding this threshold are not recycled.")
+	// Recycling policies which bound how long a runner can be reused, so that
+	// state left behind by earlier tasks can't accumulate indefinitely.
+	maxRunnerTaskCount        = flag.Int64("executor.runner_pool.max_runner_task_count", 0, "Maximum number of tasks that a recycled runner can be assigned; runners that reach this count are not recycled. 0 means no limit.")
+	maxRunnerAge              = flag.Duration("executor.runner_pool.max_runner_age", 0, "Maximum age of a recycled runner; runners older than this are not recycled, and paused runners older than this are removed instead of being reused. 0 means no limit.")
+	recycleOnFailure          = flag.Bool("executor.runner_pool.recycle_on_failure", true, "Whether to recycle runners after tasks that exit with a non-zero exit code. Runners are never recycled after tasks that fail to execute.")
 	podmanWarmupDefaultImages = flag.Bool("executor.podman.warmup_default_images", true, "Whether to warmup the default podman images or not.")
 
 	overlayfsEnabled = flag.Bool("executor.workspace.overlayfs_enabled", false, "Enable overlayfs support for anonymous action workspaces. ** UNSTABLE **")
+	// Input layers are shared between workspaces, so they are only used for
+	// actions which don't recycle or preserve their workspace.
+	overlayfsInputLayersEnabled = flag.Bool("executor.workspace.overlayfs_input_layers_enabled", false, "If overlayfs is enabled for an action running with bare or OCI isolation, mount its inputs from a shared read-only input tree rather than materializing them in the workspace. Actions with the same input root share the same input tree. ** UNSTABLE **")
+	maxOverlayfsInputLayers     = flag.Int("executor.workspace.overlayfs_max_input_layers", 100, "Maximum number of unused input trees to keep for executor.workspace.overlayfs_input_layers_enabled. The files in these trees count towards disk usage even after they are evicted from the local cache.")
 )
 
 const (
@@ -173,6 +184,9 @@ type taskRunner struct {
 	VFS *vfs.VFS
 	// VFSServer holds the RPC server that serves FUSE filesystem requests.
 	VFSServer *vfs_server.Server
+	// vfsInputs provides the current task's inputs to the VFS server, and
+	// tracks which of them the task has read.
+	vfsInputs *vfs_server.CASLazyFileProvider
 
 	// task is the current task assigned to the runner.
 	task *repb.ExecutionTask
@@ -180,6 +194,11 @@ type taskRunner struct {
 	// assigned a new task. Note: this is not necessarily the same as the number
 	// of tasks that have actually been executed.
 	taskNumber int64
+	// createdAt is when the runner was created.
+	createdAt time.Time
+	// lastTaskFailed is whether the last command run by the runner exited
+	// with a non-zero exit code.
+	lastTaskFailed bool
 	// State is the current state of the runner as it pertains to reuse.
 	state state
 
@@ -212,8 +231,8 @@ func (r *taskRunner) String() string {
 		truncate(r.key.InstanceName, 8, "..."), truncate(ph, 8, ""))
 }
 
-func (r *taskRunner) pullCredentials() (oci.Credentials, error) {
-	return oci.CredentialsFromProperties(r.PlatformProperties)
+func (r *taskRunner) pullCredentials(ctx context.Context) (oci.Credentials, error) {
+	return oci.CredentialsFromProperties(ctx, r.PlatformProperties, r.task.GetContainerRegistryCredentials())
 }
 
 func (r *taskRunner) PrepareForTask(ctx context.Context) error {
@@ -232,7 +251,7 @@ func (r *taskRunner) PrepareForTask(ctx context.Context) error {
 
 	// Pull the container image before Run() is called, so that we don't
 	// use up the whole exec ctx timeout with a slow container pull.
-	creds, err := r.pullCredentials()
+	creds, err := r.pullCredentials(ctx)
 	if err != nil {
 		return err
 	}
@@ -298,7 +317,7 @@ func (r *taskRunner) DownloadInputs(ctx context.Context, ioStats *repb.IOStats)
 }
 
 // Run runs the task that is currently bound to the command runner.
-func (r *taskRunner) Run(ctx context.Context) (res *interfaces.CommandResult) {
+func (r *taskRunner) Run(ctx context.Context, liveOutput *interfaces.Stdio) (res *interfaces.CommandResult) {
 	start := time.Now()
 	defer func() {
 		// Discard nonsensical PSI full-stall durations which are greater
@@ -337,6 +356,11 @@ func (r *taskRunner) Run(ctx context.Context) (res *interfaces.CommandResult) {
 			log.CtxInfof(ctx, "Action created %q file in workspace root; not recycling", doNotRecycleMarkerFile)
 			res.DoNotRecycle = true
 		}
+
+		if r.vfsInputs != nil {
+			res.AccessedInputs = r.vfsInputs.PlacedFiles()
+		}
+		r.lastTaskFailed = res.ExitCode != 0
 	}()
 
 	wsPath := r.Workspace.Path()
@@ -346,11 +370,16 @@ func (r *taskRunner) Run(ctx context.Context) (res *interfaces.CommandResult) {
 
 	command := r.task.GetCommand()
 
-	if !r.PlatformProperties.RecycleRunner {
+	// Upload large output files while the command writes them.
+	defer r.Workspace.StreamOutputs(ctx)()
+
+	if !r.PlatformProperties.RecycleRunner && liveOutput == nil {
 		// If the container is not recyclable, then use `Run` to walk through
-		// the entire container lifecycle in a single step.
+		// the entire container lifecycle in a single step. Output can only be
+		// streamed from commands that are exec'd in the container, so when
+		// it's requested, walk through the lifecycle below instead.
 		// TODO: Remove this `Run` method and call lifecycle methods directly.
-		creds, err := r.pullCredentials()
+		creds, err := r.pullCredentials(ctx)
 		if err != nil {
 			return commandutil.ErrorResult(err)
 		}
@@ -368,7 +397,7 @@ func (r *taskRunner) Run(ctx context.Context) (res *interfaces.CommandResult) {
 	r.p.mu.RUnlock()
 	switch s {
 	case initial:
-		creds, err := r.pullCredentials()
+		creds, err := r.pullCredentials(ctx)
 		if err != nil {
 			return commandutil.ErrorResult(err)
 		}
@@ -396,7 +425,7 @@ func (r *taskRunner) Run(ctx context.Context) (res *interfaces.CommandResult) {
 		return r.sendPersistentWorkRequest(ctx, command)
 	}
 
-	execResult := r.Container.Exec(ctx, command, &interfaces.Stdio{})
+	execResult := r.exec(ctx, command, liveOutput)
 
 	if r.hasMaxResourceUtilization(ctx, execResult.UsageStats) {
 		r.doNotReuse = true
@@ -405,6 +434,24 @@ func (r *taskRunner) Run(ctx context.Context) (res *interfaces.CommandResult) {
 	return execResult
 }
 
+// exec runs the command in the container, writing its output to liveOutput
+// (if non-nil) as well as to the result.
+func (r *taskRunner) exec(ctx context.Context, command *repb.Command, liveOutput *interfaces.Stdio) *interfaces.CommandResult {
+	if liveOutput == nil {
+		return r.Container.Exec(ctx, command, &interfaces.Stdio{})
+	}
+	// Output is only buffered into the result if the stdio doesn't have its
+	// own writers, so buffer it here.
+	var stdout, stderr bytes.Buffer
+	res := r.Container.Exec(ctx, command, &interfaces.Stdio{
+		Stdout: io.MultiWriter(&stdout, liveOutput.Stdout),
+		Stderr: io.MultiWriter(&stderr, liveOutput.Stderr),
+	})
+	res.Stdout = stdout.Bytes()
+	res.Stderr = stderr.Bytes()
+	return res
+}
+
 func (r *taskRunner) GracefulTerminate(ctx context.Context) error {
 	return r.Container.Signal(ctx, syscall.SIGTERM)
 }
@@ -412,9 +459,19 @@ func (r *taskRunner) GracefulTerminate(ctx context.Context) error {
 func (r *taskRunner) sendPersistentWorkRequest(ctx context.Context, command *repb.Command) *interfaces.CommandResult {
 	// Mark the runner as doNotReuse until the task is completed without error.
 	r.doNotReuse = true
+	if r.worker != nil && r.worker.IsStale(command) {
+		// The worker key doesn't always capture the worker's startup flags
+		// and tools, so replace the worker rather than sending it requests
+		// that it was started with the wrong flags or tools for.
+		log.CtxInfof(ctx, "Restarting persistent worker since its startup flags or tool inputs changed")
+		if err := r.worker.Stop(); err != nil {
+			log.CtxWarningf(ctx, "Failed to stop stale persistent worker: %s", err)
+		}
+		r.worker = nil
+	}
 	if r.worker == nil {
 		log.CtxInfof(ctx, "Starting persistent worker")
-		r.worker = persistentworker.Start(r.env.GetServerContext(), r.Workspace, r.Container, r.PlatformProperties.PersistentWorkerProtocol, command)
+		r.worker = persistentworker.Start(r.env.GetServerContext(), r.Workspace, r.Container, r.PlatformProperties.PersistentWorkerProtocol, r.PlatformProperties.PersistentWorkerMultiplex, command)
 	}
 	res := r.worker.Exec(ctx, command)
 	if res.Error == nil {
@@ -431,6 +488,10 @@ func (r *taskRunner) UploadOutputs(ctx context.Context, ioStats *repb.IOStats, e
 	ioStats.FileUploadCount = txInfo.FileCount
 	ioStats.FileUploadDurationUsec = txInfo.TransferDuration.Microseconds()
 	ioStats.FileUploadSizeBytes = txInfo.BytesTransferred
+	if stats := r.Workspace.CopyUpStats(); stats != nil {
+		ioStats.OverlayCopyUpCount = stats.FileCount
+		ioStats.OverlayCopyUpSizeBytes = stats.SizeBytes
+	}
 	return nil
 }
 
@@ -546,6 +607,7 @@ type pool struct {
 	env                environment.Env
 	podID              string
 	buildRoot          string
+	inputLayers        *workspace.InputLayerCache
 	overrideProvider   container.Provider
 	containerProviders map[platform.ContainerType]container.Provider
 
@@ -556,7 +618,7 @@ type pool struct {
 	// pendingRemovals keeps track of which runners are pending removal.
 	pendingRemovals sync.WaitGroup
 
-	mu             sync.RWMutex // protects(isShuttingDown), protects(runners)
+	mu             sync.RWMutex // protects(isShuttingDown), protects(runners), protects(containerProviders)
 	isShuttingDown bool
 	// runners holds all runners managed by the pool.
 	runners []*taskRunner
@@ -591,6 +653,13 @@ func NewPool(env environment.Env, opts *PoolOptions) (*pool, error) {
 		p.containerProviders = providers
 	}
 
+	if *overlayfsEnabled && *overlayfsInputLayersEnabled {
+		p.inputLayers, err = workspace.NewInputLayerCache(env, filepath.Join(p.buildRoot, "_input_layers"), *maxOverlayfsInputLayers)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	p.setLimits()
 	hc.RegisterShutdownFunction(p.Shutdown)
 	return p, nil
@@ -600,6 +669,40 @@ func (p *pool) GetBuildRoot() string {
 	return p.buildRoot
 }
 
+// UpdateContainerProviders initializes container providers for isolation types
+// that were enabled after the pool was created, for example by a config
+// reload. Providers for isolation types that were disabled are kept, since
+// runners may still be using them, but new tasks requesting those types are
+// rejected when their platform properties are parsed.
+func (p *pool) UpdateContainerProviders() error {
+	if p.overrideProvider != nil {
+		return nil
+	}
+	p.mu.RLock()
+	existing := p.containerProviders
+	p.mu.RUnlock()
+
+	added := &platform.ExecutorProperties{}
+	for _, t := range platform.GetExecutorProperties().SupportedIsolationTypes {
+		if _, ok := existing[t]; !ok {
+			added.SupportedIsolationTypes = append(added.SupportedIsolationTypes, t)
+		}
+	}
+	if len(added.SupportedIsolationTypes) == 0 {
+		return nil
+	}
+	providers := maps.Clone(existing)
+	if err := p.registerContainerProviders(providers, added); err != nil {
+		return err
+	}
+	log.Infof("Enabled isolation types %s", added.SupportedIsolationTypes)
+
+	p.mu.Lock()
+	p.containerProviders = providers
+	p.mu.Unlock()
+	return nil
+}
+
 // Add pauses the runner and makes it available to be returned from the pool
 // via Get.
 //
@@ -811,7 +914,7 @@ func (p *pool) warmupImage(ctx context.Context, cfg *WarmupConfig) error {
 		return err
 	}
 
-	creds, err := oci.CredentialsFromProperties(platProps)
+	creds, err := oci.CredentialsFromProperties(ctx, platProps, nil)
 	if err != nil {
 		return err
 	}
@@ -870,6 +973,18 @@ func (p *pool) warmupConfigs() []WarmupConfig {
 			continue
 		}
 
+		// Linux images can't be run in macOS VMs, so only warm up the
+		// default VM image.
+		if isolation == platform.MacVMContainerType {
+			if image := platform.DefaultMacVMImage(); image != "" {
+				out = append(out, WarmupConfig{
+					Image:     image,
+					Isolation: string(isolation),
+				})
+			}
+			continue
+		}
+
 		// Warm up the default execution image for all isolation types, as well
 		// as the new Ubuntu 20.04 image.
 		out = append(out, WarmupConfig{
@@ -939,6 +1054,11 @@ func (p *pool) Get(ctx context.Context, st *repb.ScheduledTask) (interfaces.Runn
 	if props.RecycleRunner && props.EnableVFS {
 		return nil, status.InvalidArgumentError("VFS is not yet supported for recycled runners")
 	}
+	if props.RecycleRunner && props.GPUs > 0 {
+		// Recycled runners would hold on to their GPUs while idle, leaving
+		// the executor unable to run other GPU tasks that it was assigned.
+		return nil, status.InvalidArgumentError("runner recycling is not supported for actions requesting GPUs")
+	}
 
 	persistentWorkerKey, _ := persistentworker.Key(props, task.GetCommand().GetArguments())
 	key := &rnpb.RunnerKey{
@@ -1003,6 +1123,9 @@ func (p *pool) newRunner(ctx context.Context, key *rnpb.RunnerKey, props *platfo
 		NonrootWritable: props.NonrootWorkspace || props.DockerUser != "",
 		UseOverlayfs:    useOverlayfs,
 	}
+	if useOverlayfs && p.useInputLayers(props) {
+		wsOpts.InputLayers = p.inputLayers
+	}
 	ws, err := workspace.New(p.env, p.buildRoot, wsOpts)
 	if err != nil {
 		return nil, err
@@ -1018,6 +1141,7 @@ func (p *pool) newRunner(ctx context.Context, key *rnpb.RunnerKey, props *platfo
 		key:                key,
 		debugID:            debugID,
 		taskNumber:         1,
+		createdAt:          time.Now(),
 		task:               st.GetExecutionTask(),
 		PlatformProperties: props,
 		Container:          ctr,
@@ -1054,7 +1178,9 @@ func (p *pool) newContainer(ctx context.Context, props *platform.Properties, tas
 	}
 
 	isolationType := platform.ContainerType(props.WorkloadIsolationType)
+	p.mu.RLock()
 	containerProvider, ok := p.containerProviders[isolationType]
+	p.mu.RUnlock()
 	if !ok {
 		return nil, status.UnimplementedErrorf("no container provider registered for %q isolation", isolationType)
 	}
@@ -1066,6 +1192,20 @@ func (p *pool) newContainer(ctx context.Context, props *platform.Properties, tas
 	return container.NewTracedCommandContainer(c), nil
 }
 
+// useInputLayers returns whether an overlayfs workspace should mount its inputs
+// from a shared input layer.
+func (p *pool) useInputLayers(props *platform.Properties) bool {
+	if p.inputLayers == nil || props.RecycleRunner || props.PreserveWorkspace {
+		return false
+	}
+	switch platform.ContainerType(props.WorkloadIsolationType) {
+	case platform.BareContainerType, platform.OCIContainerType:
+		return true
+	default:
+		return false
+	}
+}
+
 func isOverlayfsEnabledForAction(ctx context.Context, props *platform.Properties) (bool, error) {
 	if !*overlayfsEnabled {
 		// overlayfs is disabled executor-wide.
@@ -1164,6 +1304,16 @@ func (p *pool) take(ctx context.Context, key *rnpb.RunnerKey) *taskRunner {
 		if !bytes.Equal(taskKeyBytes, runnerKeyBytes) {
 			continue
 		}
+		if *maxRunnerAge > 0 && time.Since(r.createdAt) >= *maxRunnerAge {
+			log.CtxInfof(ctx, "Removing runner %s from the pool (max age %s exceeded)", r, *maxRunnerAge)
+			p.runners = append(p.runners[:i], p.runners[i+1:]...)
+			metrics.RunnerPoolCount.Dec()
+			metrics.RunnerPoolDiskUsageBytes.Sub(float64(r.diskUsageBytes))
+			metrics.RunnerPoolMemoryUsageBytes.Sub(float64(r.memoryUsageBytes))
+			observeRetirement(r, "max_age")
+			r.RemoveInBackground()
+			continue
+		}
 
 		r.state = ready
 
@@ -1315,6 +1465,11 @@ func (p *pool) TryRecycle(ctx context.Context, r interfaces.Runner, finishedClea
 		log.CtxWarningf(ctx, "Failed to recycle runner %s due to previous execution error", cr)
 		return
 	}
+	if reason, msg := retireReason(cr); reason != "" {
+		log.CtxInfof(ctx, "Not recycling runner %s: %s", cr, msg)
+		observeRetirement(cr, reason)
+		return
+	}
 	// Clean the workspace before recycling the runner (to save on disk space).
 	if err := cr.Workspace.Clean(); err != nil {
 		log.CtxErrorf(ctx, "Failed to recycle runner %s: failed to clean workspace: %s", cr, err)
@@ -1350,6 +1505,29 @@ func (p *pool) TryRecycle(ctx context.Context, r interfaces.Runner, finishedClea
 	recycled = true
 }
 
+// retireReason returns a metrics label and a message describing why the
+// runner should not be recycled according to the configured recycling
+// policies. It returns an empty label if the runner can be recycled.
+func retireReason(r *taskRunner) (label, msg string) {
+	if *maxRunnerTaskCount > 0 && r.taskNumber >= *maxRunnerTaskCount {
+		return "max_task_count", fmt.Sprintf("runner was assigned %d tasks (max %d)", r.taskNumber, *maxRunnerTaskCount)
+	}
+	if age := time.Since(r.createdAt); *maxRunnerAge > 0 && age >= *maxRunnerAge {
+		return "max_age", fmt.Sprintf("runner age %s exceeds max age %s", age.Truncate(time.Second), *maxRunnerAge)
+	}
+	if !*recycleOnFailure && r.lastTaskFailed {
+		return "task_failed", "task exited with a non-zero exit code"
+	}
+	return "", ""
+}
+
+func observeRetirement(r *taskRunner, reason string) {
+	metrics.RunnerPoolRetirements.With(prometheus.Labels{
+		metrics.RunnerPoolRetireReason: reason,
+		metrics.IsolationTypeLabel:     r.PlatformProperties.WorkloadIsolationType,
+	}).Inc()
+}
+
 func (p *pool) setLimits() {
 	totalRAMBytes := int64(float64(resources.GetAllocatedRAMBytes()) * tasksize.MaxResourceCapacityRatio)
 	estimatedRAMBytes := int64(float64(tasksize.DefaultMemEstimate) * runnerMemUsageEstimateMultiplierBytes)
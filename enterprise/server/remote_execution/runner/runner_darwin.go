@@ -7,8 +7,10 @@ import (
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/container"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/containers/bare"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/containers/macvm"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/containers/sandbox"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 )
@@ -18,6 +20,14 @@ func (p *pool) registerContainerProviders(providers map[platform.ContainerType]c
 		providers[platform.SandboxContainerType] = &sandbox.Provider{}
 	}
 
+	if executor.SupportsIsolation(platform.MacVMContainerType) {
+		macVMProvider, err := macvm.NewProvider(p.env)
+		if err != nil {
+			return status.FailedPreconditionErrorf("Failed to initialize macOS VM provider: %s", err)
+		}
+		providers[platform.MacVMContainerType] = macVMProvider
+	}
+
 	if executor.SupportsIsolation(platform.BareContainerType) {
 		providers[platform.BareContainerType] = &bare.Provider{}
 	}
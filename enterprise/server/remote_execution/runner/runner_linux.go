@@ -118,6 +118,7 @@ func (r *taskRunner) prepareVFS(ctx context.Context, layout *container.FileSyste
 		if err := r.VFSServer.Prepare(p); err != nil {
 			return err
 		}
+		r.vfsInputs = p
 	}
 	if r.VFS != nil {
 		if err := r.VFS.PrepareForTask(ctx, r.task.GetExecutionId()); err != nil {
@@ -190,7 +190,7 @@ func withAuthenticatedUser(t *testing.T, ctx context.Context, env *testenv.TestE
 }
 
 func mustRun(t *testing.T, r *taskRunner) {
-	res := r.Run(context.Background())
+	res := r.Run(context.Background(), nil /*=liveOutput*/)
 	require.NoError(t, res.Error)
 }
 
@@ -401,7 +401,7 @@ func TestRunnerPool_Shutdown_RunnersReturnRetriableOrNilError(t *testing.T) {
 			// Random delay to simulate downloading inputs
 			sleepRandMicros(10)
 			tasksStarted <- struct{}{}
-			if result := r.Run(ctx); result.Error != nil {
+			if result := r.Run(ctx, nil /*=liveOutput*/); result.Error != nil {
 				return result.Error
 			}
 			// Random delay to simulate uploading outputs
@@ -556,6 +556,68 @@ func TestRunnerPool_DiskLimitExceeded_CannotAdd(t *testing.T) {
 	assert.Equal(t, 0, pool.PausedRunnerCount())
 }
 
+func TestRunnerPool_MaxRunnerTaskCount_NotRecycled(t *testing.T) {
+	flags.Set(t, "executor.runner_pool.max_runner_task_count", 2)
+	env := newTestEnv(t)
+	pool := newRunnerPool(t, env, noLimitsCfg())
+	ctx := withAuthenticatedUser(t, context.Background(), env, "US1")
+
+	r1 := mustGetNewRunner(t, ctx, pool, newTask())
+	pool.TryRecycle(ctx, r1, true)
+	require.Equal(t, 1, pool.PausedRunnerCount())
+
+	// The second task reaches the max task count, so the runner shouldn't be
+	// recycled after it.
+	r2 := mustGetPausedRunner(t, ctx, pool, newTask())
+	assert.Same(t, r1, r2)
+	pool.TryRecycle(ctx, r2, true)
+	assert.Equal(t, 0, pool.PausedRunnerCount())
+	assert.Equal(t, 0, pool.RunnerCount())
+}
+
+func TestRunnerPool_MaxRunnerAge_PausedRunnerRemoved(t *testing.T) {
+	env := newTestEnv(t)
+	pool := newRunnerPool(t, env, noLimitsCfg())
+	ctx := withAuthenticatedUser(t, context.Background(), env, "US1")
+
+	r1 := mustGetNewRunner(t, ctx, pool, newTask())
+	mustAddWithoutEviction(t, ctx, pool, r1)
+
+	// The paused runner is now past the max age, so it should be removed
+	// rather than reused.
+	flags.Set(t, "executor.runner_pool.max_runner_age", time.Nanosecond)
+	r2 := mustGet(t, ctx, pool, newTask())
+	assert.NotSame(t, r1, r2)
+	assert.Equal(t, 0, pool.PausedRunnerCount())
+	assert.Equal(t, 1, pool.RunnerCount())
+}
+
+func TestRunnerPool_RecycleOnFailure(t *testing.T) {
+	for _, recycleOnFailure := range []bool{true, false} {
+		t.Run(fmt.Sprintf("recycleOnFailure=%t", recycleOnFailure), func(t *testing.T) {
+			flags.Set(t, "executor.runner_pool.recycle_on_failure", recycleOnFailure)
+			env := newTestEnv(t)
+			pool := newRunnerPool(t, env, noLimitsCfg())
+			ctx := withAuthenticatedUser(t, context.Background(), env, "US1")
+			task := newTask()
+			task.ExecutionTask.Command.Arguments = []string{"sh", "-c", "exit 1"}
+
+			r, err := pool.Get(ctx, task)
+			require.NoError(t, err)
+			res := r.Run(ctx, nil /*=liveOutput*/)
+			require.NoError(t, res.Error)
+			require.Equal(t, 1, res.ExitCode)
+			pool.TryRecycle(ctx, r, true)
+
+			if recycleOnFailure {
+				assert.Equal(t, 1, pool.PausedRunnerCount())
+			} else {
+				assert.Equal(t, 0, pool.PausedRunnerCount())
+			}
+		})
+	}
+}
+
 func TestRunnerPool_ActiveRunnersTakenFromPool_NotRemovedOnShutdown(t *testing.T) {
 	env := newTestEnv(t)
 	pool := newRunnerPool(t, env, noLimitsCfg())
@@ -730,7 +792,7 @@ func TestRunnerPool_PersistentWorker(t *testing.T) {
 
 			r, err := pool.Get(ctx, newPersistentRunnerTask(t, "abc", "", testCase.protocol, resp))
 			require.NoError(t, err)
-			res := r.Run(ctx)
+			res := r.Run(ctx, nil /*=liveOutput*/)
 			require.NoError(t, res.Error)
 			assert.Equal(t, 0, res.ExitCode)
 			assert.Equal(t, []byte(resp.Output), res.Stderr)
@@ -745,7 +807,7 @@ func TestRunnerPool_PersistentWorker(t *testing.T) {
 
 			r, err := pool.Get(ctx, newPersistentRunnerTask(t, "abc", "", testCase.protocol, resp))
 			require.NoError(t, err)
-			res := r.Run(ctx)
+			res := r.Run(ctx, nil /*=liveOutput*/)
 			require.NoError(t, res.Error)
 			assert.Equal(t, 0, res.ExitCode)
 			assert.Equal(t, []byte(resp.Output), res.Stderr)
@@ -760,7 +822,7 @@ func TestRunnerPool_PersistentWorker(t *testing.T) {
 
 			r, err := pool.Get(ctx, newPersistentRunnerTask(t, "def", "", testCase.protocol, resp))
 			require.NoError(t, err)
-			res := r.Run(ctx)
+			res := r.Run(ctx, nil /*=liveOutput*/)
 			require.NoError(t, res.Error)
 			assert.Equal(t, 0, res.ExitCode)
 			assert.Equal(t, []byte(resp.Output), res.Stderr)
@@ -770,6 +832,25 @@ func TestRunnerPool_PersistentWorker(t *testing.T) {
 	}
 }
 
+func TestRunnerPool_PersistentWorker_RestartsWhenStartupFlagsChange(t *testing.T) {
+	env := newTestEnv(t)
+	pool := newRunnerPool(t, env, noLimitsCfg())
+	ctx := withAuthenticatedUser(t, context.Background(), env, "US1")
+
+	for _, output := range []string{"first output", "second output"} {
+		// The worker key stays the same, but the worker's startup flags
+		// (which determine its response) change.
+		resp := &wkpb.WorkResponse{Output: output}
+		r, err := pool.Get(ctx, newPersistentRunnerTask(t, "abc", "", "proto", resp))
+		require.NoError(t, err)
+		res := r.Run(ctx, nil /*=liveOutput*/)
+		require.NoError(t, res.Error)
+		assert.Equal(t, []byte(output), res.Stderr)
+		pool.TryRecycle(ctx, r, true)
+		assert.Equal(t, 1, pool.PausedRunnerCount())
+	}
+}
+
 func TestRunnerPool_PersistentWorkerUnknownProtocol(t *testing.T) {
 	resp := &wkpb.WorkResponse{
 		ExitCode: 0,
@@ -782,7 +863,7 @@ func TestRunnerPool_PersistentWorkerUnknownProtocol(t *testing.T) {
 	// Make a new persistent worker
 	r, err := pool.Get(ctx, newPersistentRunnerTask(t, "abc", "", "unknown", resp))
 	require.NoError(t, err)
-	res := r.Run(context.Background())
+	res := r.Run(context.Background(), nil /*=liveOutput*/)
 	require.Error(t, res.Error)
 }
 
@@ -794,7 +875,7 @@ func TestRunnerPool_PersistentWorker_UnknownFlagFileError(t *testing.T) {
 	// Persistent worker with unknown flagfile
 	r, err := pool.Get(ctx, newPersistentRunnerTask(t, "abc", "@flagfile", "", &wkpb.WorkResponse{}))
 	require.NoError(t, err)
-	res := r.Run(context.Background())
+	res := r.Run(context.Background(), nil /*=liveOutput*/)
 	require.Error(t, res.Error)
 
 	// Make sure that after the error, trying to recycle doesn't put the worker
@@ -811,7 +892,7 @@ func TestRunnerPool_PersistentWorker_Crash_ShowsWorkerStderrInOutput(t *testing.
 	// Persistent worker with runner that crashes
 	r, err := pool.Get(ctx, newPersistentRunnerTask(t, "abc", "--fail_with_stderr=TestStderrMessage", "", &wkpb.WorkResponse{}))
 	require.NoError(t, err)
-	res := r.Run(context.Background())
+	res := r.Run(context.Background(), nil /*=liveOutput*/)
 	require.Error(t, res.Error)
 	assert.Contains(t, res.Error.Error(), "persistent worker stderr:", res.Error.Error())
 	assert.Contains(t, res.Error.Error(), "TestStderrMessage")
@@ -839,7 +920,7 @@ func TestRunnerPool_RecycleAfterCreateFailed_CallsRemove(t *testing.T) {
 	require.NoError(t, err)
 	// Try running a task; Create() should fail with our fixed error, and be
 	// surfaced in the command result.
-	res := r.Run(ctx)
+	res := r.Run(ctx, nil /*=liveOutput*/)
 	require.Equal(t, fakeCreateError, res.Error)
 	pool.TryRecycle(ctx, r, false /*=finishedCleanly*/)
 	// Remove should be called, closing this channel.
@@ -860,7 +941,7 @@ func TestDoNotRecycleSpecialFile(t *testing.T) {
 			}
 			r, err := pool.Get(ctx, task)
 			require.NoError(t, err)
-			res := r.Run(ctx)
+			res := r.Run(ctx, nil /*=liveOutput*/)
 			assert.Equal(t, createFile, res.DoNotRecycle)
 			pool.TryRecycle(ctx, r, false)
 		})
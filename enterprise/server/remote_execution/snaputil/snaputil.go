@@ -16,6 +16,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/random"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/prometheus/client_golang/prometheus"
 	"google.golang.org/genproto/googleapis/bytestream"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
@@ -26,6 +27,7 @@ var EnableLocalSnapshotSharing = flag.Bool("executor.enable_local_snapshot_shari
 var EnableRemoteSnapshotSharing = flag.Bool("executor.enable_remote_snapshot_sharing", false, "Enables remote snapshot sharing for firecracker VMs. Also requires that executor.firecracker_enable_nbd and executor.firecracker_enable_uffd are true.")
 var RemoteSnapshotReadonly = flag.Bool("executor.remote_snapshot_readonly", false, "Disables remote snapshot writes.")
 var VerboseLogging = flag.Bool("executor.verbose_snapshot_logs", false, "Enables extra-verbose snapshot logs (even at debug log level)")
+var verifyArtifacts = flag.Bool("executor.verify_snapshot_artifacts", true, "Verifies that snapshot artifacts, including copy-on-write chunks, match their digest when fetched from the local filecache or remote cache. Corrupted artifacts are evicted from the local filecache, and VMs whose snapshot fails verification while being resumed are booted from scratch instead.")
 
 // ChunkSource represents how a snapshot chunk was initialized
 type ChunkSource int
@@ -72,7 +74,21 @@ func GetArtifact(ctx context.Context, localCache interfaces.FileCache, bsClient
 	node := &repb.FileNode{Digest: d}
 	fetchedLocally := localCache.FastLinkFile(ctx, node, outputPath)
 	if fetchedLocally {
-		return ChunkSourceLocalFilecache, nil
+		err := verifyArtifact(outputPath, d, ChunkSourceLocalFilecache)
+		if err == nil {
+			return ChunkSourceLocalFilecache, nil
+		}
+		// Evict the corrupted artifact so that it's fetched from the remote
+		// cache instead, or so that snapshots referencing it are no longer
+		// found.
+		log.CtxWarningf(ctx, "Evicting corrupted snapshot artifact from local filecache: %s", err)
+		localCache.DeleteFile(ctx, node)
+		if err := os.Remove(outputPath); err != nil {
+			return 0, status.InternalErrorf("remove corrupted snapshot artifact: %s", err)
+		}
+		if !*EnableRemoteSnapshotSharing || !remoteEnabled {
+			return 0, err
+		}
 	}
 
 	if !*EnableRemoteSnapshotSharing || !remoteEnabled {
@@ -96,6 +112,12 @@ func GetArtifact(ctx context.Context, localCache interfaces.FileCache, bsClient
 	if err := cachetools.GetBlob(ctx, bsClient, r, f); err != nil {
 		return 0, status.WrapError(err, "remote fetch snapshot artifact")
 	}
+	if err := verifyArtifact(outputPath, d, ChunkSourceRemoteCache); err != nil {
+		if err := os.Remove(outputPath); err != nil {
+			log.CtxWarningf(ctx, "Failed to remove corrupted snapshot artifact: %s", err)
+		}
+		return 0, err
+	}
 
 	// Save to local cache so next time fetching won't require a remote get
 	if err := cacheLocally(ctx, localCache, d, outputPath); err != nil {
@@ -173,6 +195,30 @@ func CacheBytes(ctx context.Context, localCache interfaces.FileCache, bsClient b
 	return Cache(ctx, localCache, bsClient, remoteEnabled, d, remoteInstanceName, tmpPath)
 }
 
+// verifyArtifact returns a DataLoss error if the contents of the artifact at
+// path don't match its digest.
+func verifyArtifact(path string, d *repb.Digest, source ChunkSource) error {
+	if !*verifyArtifacts {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	actual, err := digest.Compute(f, repb.DigestFunction_BLAKE3)
+	if err != nil {
+		return status.UnavailableErrorf("compute digest of snapshot artifact: %s", err)
+	}
+	if actual.GetHash() != d.GetHash() || actual.GetSizeBytes() != d.GetSizeBytes() {
+		metrics.SnapshotArtifactVerificationFailures.With(prometheus.Labels{
+			metrics.ChunkSource: ChunkSourceLabel(source),
+		}).Inc()
+		return status.DataLossErrorf("snapshot artifact %s/%d from %s is corrupted: contents have digest %s/%d", d.GetHash(), d.GetSizeBytes(), source, actual.GetHash(), actual.GetSizeBytes())
+	}
+	return nil
+}
+
 var chrootPrefix = regexp.MustCompile("^.*/firecracker/[^/]+/root/")
 
 // StripChroot removes the jailer chroot directory from a given snapshot
@@ -3,7 +3,9 @@ package snaputil_test
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"math/rand"
+	"os"
 	"path/filepath"
 	"testing"
 
@@ -161,3 +163,47 @@ func TestCacheAndFetchBytes(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, randomStr, string(fetchedBytes))
 }
+
+func TestGetArtifact_CorruptedLocalArtifact(t *testing.T) {
+	for _, remoteEnabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("remoteEnabled=%t", remoteEnabled), func(t *testing.T) {
+			flags.Set(t, "executor.enable_remote_snapshot_sharing", true)
+
+			env := setupEnv(t)
+			ctx, err := prefix.AttachUserPrefixToContext(context.Background(), env)
+			require.NoError(t, err)
+			tmpDir := testfs.MakeTempDir(t)
+			fc := env.GetFileCache()
+
+			b := []byte("snapshot chunk contents")
+			d, err := digest.Compute(bytes.NewReader(b), repb.DigestFunction_BLAKE3)
+			require.NoError(t, err)
+			err = snaputil.CacheBytes(ctx, fc, env.GetByteStreamClient(), remoteEnabled, d, "", b)
+			require.NoError(t, err)
+
+			// Replace the filecache entry with corrupted contents of the
+			// same size.
+			fc.DeleteFile(ctx, &repb.FileNode{Digest: d})
+			corrupted := bytes.ToUpper(b)
+			corruptedPath := testfs.MakeTempFile(t, tmpDir, "corrupted-*")
+			err = os.WriteFile(corruptedPath, corrupted, 0644)
+			require.NoError(t, err)
+			err = fc.AddFile(ctx, &repb.FileNode{Digest: d}, corruptedPath)
+			require.NoError(t, err)
+
+			outputPath := filepath.Join(tmpDir, "fetch")
+			chunkSrc, err := snaputil.GetArtifact(ctx, fc, env.GetByteStreamClient(), remoteEnabled, d, "", outputPath)
+			if remoteEnabled {
+				// The artifact should be re-fetched from the remote cache.
+				require.NoError(t, err)
+				require.Equal(t, snaputil.ChunkSourceRemoteCache, chunkSrc)
+				require.Equal(t, string(b), testfs.ReadFileAsString(t, tmpDir, "fetch"))
+			} else {
+				require.True(t, status.IsDataLossError(err), "expected DataLoss, got %v", err)
+				require.NoFileExists(t, outputPath)
+				// The corrupted artifact should be evicted.
+				require.False(t, fc.ContainsFile(ctx, &repb.FileNode{Digest: d}))
+			}
+		})
+	}
+}
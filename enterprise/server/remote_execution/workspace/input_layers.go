@@ -0,0 +1,201 @@
+package workspace
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/dirtools"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/util/claims"
+	"github.com/buildbuddy-io/buildbuddy/server/util/disk"
+	"github.com/buildbuddy-io/buildbuddy/server/util/hash"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/third_party/singleflight"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+// InputLayerCache is a cache of materialized action input trees, which are
+// shared between overlayfs workspaces as read-only lower dirs. Actions with
+// identical input roots, such as test shards and retries, only need to mount
+// an existing layer rather than creating every input file and directory in
+// their workspace.
+//
+// Layer files are hardlinked from the filecache, and since the layers are only
+// ever mounted as overlayfs lower dirs, writes by actions are copied up to the
+// workspace's upper dir rather than modifying the filecache entries. Layers
+// keep their files alive even if the filecache evicts them, so the number of
+// layers kept is bounded.
+type InputLayerCache struct {
+	env       environment.Env
+	rootDir   string
+	maxLayers int
+
+	materializeGroup singleflight.Group[string, *inputLayer]
+
+	mu     sync.Mutex // PROTECTS(layers)
+	layers map[string]*inputLayer
+}
+
+type inputLayer struct {
+	key  string
+	path string
+
+	// The fields below are protected by InputLayerCache.mu.
+
+	// Number of workspaces using the layer.
+	refs     int
+	lastUsed time.Time
+	removed  bool
+	// Stats from materializing the layer, which are reported by the first
+	// workspace that uses the layer.
+	txInfo *dirtools.TransferInfo
+}
+
+// NewInputLayerCache returns a cache which keeps up to maxLayers unused layers
+// under rootDir. Any existing contents of rootDir are removed, since layers
+// from a previous executor process are not tracked.
+func NewInputLayerCache(env environment.Env, rootDir string, maxLayers int) (*InputLayerCache, error) {
+	if err := disk.ForceRemove(env.GetServerContext(), rootDir); err != nil {
+		return nil, status.UnavailableErrorf("remove stale input layers: %s", err)
+	}
+	if err := os.MkdirAll(rootDir, 0755); err != nil {
+		return nil, status.UnavailableErrorf("create input layer dir: %s", err)
+	}
+	return &InputLayerCache{
+		env:       env,
+		rootDir:   rootDir,
+		maxLayers: maxLayers,
+		layers:    map[string]*inputLayer{},
+	}, nil
+}
+
+// layerKey returns the cache key of an input root. Layers are not shared
+// between groups, matching the filecache.
+func layerKey(ctx context.Context, instanceName string, digestFunction repb.DigestFunction_Value, rootDigest *repb.Digest, nonrootWritable bool) string {
+	groupID := interfaces.AuthAnonymousUser
+	if c, err := claims.ClaimsFromContext(ctx); err == nil {
+		groupID = c.GroupID
+	}
+	return fmt.Sprintf("%s/%s/%d/%s/%t", groupID, hash.String(instanceName), digestFunction, rootDigest.GetHash(), nonrootWritable)
+}
+
+// acquire returns a layer containing the given input tree, materializing it if
+// it isn't cached. The layer must be released once it is no longer mounted.
+//
+// The returned TransferInfo describes the work done to materialize the layer,
+// and is empty if the layer was already used by another workspace.
+func (c *InputLayerCache) acquire(ctx context.Context, instanceName string, digestFunction repb.DigestFunction_Value, rootDigest *repb.Digest, tree *repb.Tree, opts *dirtools.DownloadTreeOpts) (*inputLayer, *dirtools.TransferInfo, error) {
+	key := layerKey(ctx, instanceName, digestFunction, rootDigest, opts.NonrootWritable)
+	for {
+		c.mu.Lock()
+		if l, ok := c.layers[key]; ok {
+			l.refs++
+			l.lastUsed = time.Now()
+			txInfo := l.txInfo
+			l.txInfo = nil
+			c.mu.Unlock()
+			if txInfo == nil {
+				metrics.WorkspaceInputLayerRequests.With(prometheus.Labels{
+					metrics.CacheHitMissStatus: metrics.HitStatusLabel,
+				}).Inc()
+				txInfo = &dirtools.TransferInfo{}
+			}
+			return l, txInfo, nil
+		}
+		c.mu.Unlock()
+
+		l, _, err := c.materializeGroup.Do(ctx, key, func(ctx context.Context) (*inputLayer, error) {
+			return c.materialize(ctx, key, instanceName, digestFunction, tree, opts)
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		c.mu.Lock()
+		if !l.removed {
+			if _, ok := c.layers[key]; !ok {
+				c.layers[key] = l
+				metrics.WorkspaceInputLayerCount.Set(float64(len(c.layers)))
+			}
+		}
+		c.mu.Unlock()
+		// Loop around to take a reference, or to materialize the layer again
+		// if it was evicted in the meantime.
+	}
+}
+
+func (c *InputLayerCache) materialize(ctx context.Context, key, instanceName string, digestFunction repb.DigestFunction_Value, tree *repb.Tree, opts *dirtools.DownloadTreeOpts) (*inputLayer, error) {
+	metrics.WorkspaceInputLayerRequests.With(prometheus.Labels{
+		metrics.CacheHitMissStatus: metrics.MissStatusLabel,
+	}).Inc()
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, status.UnavailableErrorf("failed to generate input layer ID")
+	}
+	path := filepath.Join(c.rootDir, id.String())
+	// Download to a temporary dir so that a failed download doesn't leave a
+	// partial layer behind.
+	tmpPath := path + ".tmp"
+	if err := os.Mkdir(tmpPath, 0755); err != nil {
+		return nil, status.UnavailableErrorf("create input layer: %s", err)
+	}
+	txInfo, err := dirtools.DownloadTree(ctx, c.env, instanceName, digestFunction, tree, tmpPath, opts)
+	if err != nil {
+		if err := disk.ForceRemove(ctx, tmpPath); err != nil {
+			log.CtxWarningf(ctx, "Failed to remove partial input layer: %s", err)
+		}
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return nil, status.UnavailableErrorf("rename input layer: %s", err)
+	}
+	return &inputLayer{key: key, path: path, lastUsed: time.Now(), txInfo: txInfo}, nil
+}
+
+// release drops a reference taken by acquire, and evicts unused layers if there
+// are too many.
+func (c *InputLayerCache) release(ctx context.Context, l *inputLayer) {
+	c.mu.Lock()
+	l.refs--
+	l.lastUsed = time.Now()
+	evicted := c.evictLocked()
+	c.mu.Unlock()
+
+	for _, l := range evicted {
+		if err := disk.ForceRemove(ctx, l.path); err != nil {
+			log.CtxWarningf(ctx, "Failed to remove input layer %q: %s", l.path, err)
+		}
+	}
+}
+
+// evictLocked removes the least recently used unreferenced layers from the
+// cache until at most maxLayers remain, and returns them. Layers that are in
+// use are never evicted, so the cache may temporarily exceed maxLayers.
+func (c *InputLayerCache) evictLocked() []*inputLayer {
+	var evicted []*inputLayer
+	for len(c.layers) > c.maxLayers {
+		var oldest *inputLayer
+		for _, l := range c.layers {
+			if l.refs == 0 && (oldest == nil || l.lastUsed.Before(oldest.lastUsed)) {
+				oldest = l
+			}
+		}
+		if oldest == nil {
+			break
+		}
+		oldest.removed = true
+		delete(c.layers, oldest.key)
+		evicted = append(evicted, oldest)
+	}
+	metrics.WorkspaceInputLayerCount.Set(float64(len(c.layers)))
+	return evicted
+}
@@ -6,10 +6,10 @@ import (
 	"fmt"
 	"io/fs"
 	"os"
-	"path"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	_ "embed"
 
@@ -20,6 +20,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/ci_runner_util"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
 	"github.com/buildbuddy-io/buildbuddy/server/util/disk"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
@@ -47,6 +48,12 @@ type Workspace struct {
 	env     environment.Env
 	rootDir string
 	overlay *overlayfs.Overlay
+	// inputLayer is the shared lower dir containing the action inputs, if
+	// Opts.InputLayers is set.
+	inputLayer *inputLayer
+	// copyUpStats are the overlay upper dir stats from the last call to
+	// UploadOutputs.
+	copyUpStats *overlayfs.CopyUpStats
 	// dirPerms are the permissions set on the workspace root directory as well as
 	// any input or output directories created by the executor. It does not affect
 	// file permissions.
@@ -60,6 +67,9 @@ type Workspace struct {
 	// TODO: Make sure these files are written read-only
 	// to make sure this map accurately reflects the filesystem.
 	Inputs map[string]*repb.FileNode
+	// outputStreamer uploads the current task's large output files while
+	// they're written, if StreamOutputs was called.
+	outputStreamer *dirtools.OutputStreamer
 
 	mu       sync.Mutex // protects(removing)
 	removing bool
@@ -76,6 +86,12 @@ type Opts struct {
 	// UseOverlayfs specifies whether the workspace should use overlayfs to
 	// allow copy-on-write for workspace inputs.
 	UseOverlayfs bool
+	// InputLayers, if set, provides the action inputs as a read-only overlayfs
+	// lower dir shared with other workspaces, instead of materializing the
+	// inputs in the workspace. The overlay is mounted when inputs are
+	// downloaded, so the workspace can only be used for a single task.
+	// Requires UseOverlayfs.
+	InputLayers *InputLayerCache
 }
 
 // New creates a new workspace directly under the given parent directory.
@@ -94,7 +110,7 @@ func New(env environment.Env, parentDir string, opts *Opts) (*Workspace, error)
 	}
 
 	var overlay *overlayfs.Overlay
-	if opts.UseOverlayfs {
+	if opts.UseOverlayfs && opts.InputLayers == nil {
 		overlayOpts := overlayfs.Opts{DirPerms: dirPerms}
 		overlay, err = overlayfs.Convert(context.TODO(), rootDir, overlayOpts)
 		if err != nil {
@@ -135,6 +151,26 @@ func (ws *Workspace) SetTask(ctx context.Context, task *repb.ExecutionTask) {
 	ws.task = task
 	cmd := task.GetCommand()
 	ws.dirHelper = dirtools.NewDirHelper(ws.inputRoot(), cmd, ws.dirPerms)
+	ws.outputStreamer = nil
+}
+
+// StreamOutputs starts uploading the current task's large output files while
+// the command writes them, so that UploadOutputs has less left to upload.
+// The returned function stops streaming, and must be called once the command
+// exits.
+func (ws *Workspace) StreamOutputs(ctx context.Context) (stop func()) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.removing {
+		return func() {}
+	}
+	instanceName := ws.task.GetExecuteRequest().GetInstanceName()
+	digestFunction := ws.task.GetExecuteRequest().GetDigestFunction()
+	ws.outputStreamer = dirtools.StreamOutputs(ctx, ws.env, instanceName, digestFunction, ws.Path(), ws.task.GetCommand())
+	if ws.outputStreamer == nil {
+		return func() {}
+	}
+	return ws.outputStreamer.Stop
 }
 
 // CommandWorkingDirectory returns the absolute path to the working directory
@@ -177,6 +213,9 @@ func (ws *Workspace) DownloadInputs(ctx context.Context, tree *repb.Tree) (*dirt
 	opts := &dirtools.DownloadTreeOpts{
 		NonrootWritable: ws.Opts.NonrootWritable,
 	}
+	if ws.Opts.InputLayers != nil {
+		return ws.mountInputLayer(ctx, tree, opts)
+	}
 	if ws.Opts.Preserve {
 		opts.Skip = ws.Inputs
 		opts.TrackTransfers = true
@@ -199,10 +238,45 @@ func (ws *Workspace) DownloadInputs(ctx context.Context, tree *repb.Tree) (*dirt
 	return txInfo, err
 }
 
+// mountInputLayer mounts the workspace overlay with the action inputs provided
+// by a shared input layer.
+func (ws *Workspace) mountInputLayer(ctx context.Context, tree *repb.Tree, opts *dirtools.DownloadTreeOpts) (*dirtools.TransferInfo, error) {
+	if ws.overlay != nil {
+		return nil, status.FailedPreconditionError("input layer workspaces can only be used for a single task")
+	}
+	execReq := ws.task.GetExecuteRequest()
+	start := time.Now()
+	layer, txInfo, err := ws.Opts.InputLayers.acquire(ctx, execReq.GetInstanceName(), execReq.GetDigestFunction(), ws.task.GetAction().GetInputRootDigest(), tree, opts)
+	if err != nil {
+		return nil, err
+	}
+	// Once the overlay is mounted, the workspace owns the layer reference,
+	// and releases it when it's removed.
+	mounted := false
+	defer func() {
+		if !mounted {
+			ws.Opts.InputLayers.release(ctx, layer)
+		}
+	}()
+	// Output dirs were already created in the workspace dir, which becomes
+	// the overlay's uppermost lower dir.
+	overlayOpts := overlayfs.Opts{DirPerms: ws.dirPerms, ExtraLowerDirs: []string{layer.path}}
+	overlay, err := overlayfs.Convert(ctx, ws.rootDir, overlayOpts)
+	if err != nil {
+		return nil, status.UnavailableErrorf("failed to create workspace overlayfs at %q: %s", ws.rootDir, err)
+	}
+	mounted = true
+	ws.overlay = overlay
+	ws.inputLayer = layer
+	ws.dirHelper = dirtools.NewDirHelper(ws.inputRoot(), ws.task.GetCommand(), ws.dirPerms)
+	log.CtxInfof(ctx, "Mounted input layer in %s, downloaded %d bytes to materialize it", time.Since(start), txInfo.BytesTransferred)
+	return txInfo, nil
+}
+
 // AddCIRunner adds the BuildBuddy CI runner to the workspace root if it doesn't
 // already exist.
 func (ws *Workspace) AddCIRunner(ctx context.Context) error {
-	destPath := path.Join(ws.Path(), ci_runner_util.ExecutableName)
+	destPath := filepath.Join(ws.Path(), ci_runner_util.ExecutableName)
 	exists, err := disk.FileExists(ctx, destPath)
 	if err != nil {
 		return err
@@ -223,12 +297,14 @@ func (ws *Workspace) CleanInputsIfNecessary(keep map[string]*repb.FileNode) erro
 	}
 	inputFilesToCleanUp := make(map[string]*repb.FileNode)
 	// Curly braces indicate a comma separated list of patterns: https://pkg.go.dev/github.com/gobwas/glob#Compile
-	glob, err := glob.Compile(fmt.Sprintf("{%s}", ws.Opts.CleanInputs), os.PathSeparator)
+	// Patterns use forward slashes on all platforms, so input paths are
+	// converted to slash-separated paths before matching.
+	glob, err := glob.Compile(fmt.Sprintf("{%s}", ws.Opts.CleanInputs), '/')
 	if err != nil {
 		return status.FailedPreconditionErrorf("Invalid glob {%s} used for input cleaning: %s", ws.Opts.CleanInputs, err.Error())
 	}
 	for path, node := range ws.Inputs {
-		if ws.Opts.CleanInputs == "*" || glob.Match(path) {
+		if ws.Opts.CleanInputs == "*" || glob.Match(filepath.ToSlash(path)) {
 			inputFilesToCleanUp[path] = node
 		}
 	}
@@ -262,7 +338,14 @@ func (ws *Workspace) UploadOutputs(ctx context.Context, cmd *repb.Command, execu
 	instanceName := ws.task.GetExecuteRequest().GetInstanceName()
 	digestFunction := ws.task.GetExecuteRequest().GetDigestFunction()
 
+	streamed := ws.outputStreamer
+	ws.outputStreamer = nil
+	if streamed != nil {
+		streamed.Stop()
+	}
+
 	var txInfo *dirtools.TransferInfo
+	var copyUpStats *overlayfs.CopyUpStats
 	var stdoutDigest, stderrDigest *repb.Digest
 
 	eg, egCtx := errgroup.WithContext(ctx)
@@ -294,12 +377,14 @@ func (ws *Workspace) UploadOutputs(ctx context.Context, cmd *repb.Command, execu
 			// upperdir here rather than copying.
 			recyclingEnabled := platform.IsTrue(platform.FindValue(platform.GetProto(ws.task.GetAction(), ws.task.GetCommand()), platform.RecycleRunnerPropertyName))
 			opts := overlayfs.ApplyOpts{AllowRename: !recyclingEnabled}
-			if err := ws.overlay.Apply(egCtx, opts); err != nil {
+			stats, err := ws.overlay.Apply(egCtx, opts)
+			if err != nil {
 				return status.WrapError(err, "apply overlay upperdir changes")
 			}
+			copyUpStats = stats
 		}
 		var err error
-		txInfo, err = dirtools.UploadTree(egCtx, ws.env, ws.dirHelper, instanceName, digestFunction, ws.inputRoot(), cmd, executeResponse.Result)
+		txInfo, err = dirtools.UploadTree(egCtx, ws.env, ws.dirHelper, instanceName, digestFunction, ws.inputRoot(), cmd, executeResponse.Result, streamed)
 		return err
 	})
 	var logsMu sync.Mutex
@@ -324,6 +409,10 @@ func (ws *Workspace) UploadOutputs(ctx context.Context, cmd *repb.Command, execu
 	if err := eg.Wait(); err != nil {
 		return nil, err
 	}
+	ws.copyUpStats = copyUpStats
+	if copyUpStats != nil {
+		metrics.WorkspaceCopyUpSizeBytes.Observe(float64(copyUpStats.SizeBytes))
+	}
 	executeResponse.Result.StdoutDigest = stdoutDigest
 	executeResponse.Result.StderrDigest = stderrDigest
 	executeResponse.ServerLogs = serverLogs
@@ -332,15 +421,31 @@ func (ws *Workspace) UploadOutputs(ctx context.Context, cmd *repb.Command, execu
 	return txInfo, nil
 }
 
+// CopyUpStats returns stats about the files written to the workspace overlay
+// during the last task, which are computed by UploadOutputs. It returns nil if
+// overlayfs is not used.
+func (ws *Workspace) CopyUpStats() *overlayfs.CopyUpStats {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.copyUpStats
+}
+
 func (ws *Workspace) Remove(ctx context.Context) error {
 	ws.mu.Lock()
 	ws.removing = true
+	overlay, layer := ws.overlay, ws.inputLayer
 	// No need to keep the lock held while removing; other operations will
 	// immediately fail since we've set the removing bit.
 	ws.mu.Unlock()
 
-	if ws.overlay != nil {
-		return ws.overlay.Remove(ctx)
+	if overlay != nil {
+		// Only release the layer after trying to unmount the overlay, since
+		// evicting the layer removes its files. The layer is released even if
+		// removal fails, so that it isn't referenced forever.
+		if layer != nil {
+			defer ws.Opts.InputLayers.release(ctx, layer)
+		}
+		return overlay.Remove(ctx)
 	}
 
 	// Sometimes removal fails if badly-behaved actions write their
@@ -380,7 +485,10 @@ func (ws *Workspace) Clean() error {
 	// as-is.
 	if ws.Opts.Preserve {
 		cmd := ws.task.GetCommand()
+		// Output paths are slash-separated, while input paths use the OS path
+		// separator.
 		for _, path := range cmd.GetOutputFiles() {
+			path := filepath.FromSlash(path)
 			if err := os.RemoveAll(filepath.Join(ws.Path(), path)); err != nil && !os.IsNotExist(err) {
 				return status.UnavailableErrorf("Failed to clean workspace: %s", err)
 			}
@@ -391,6 +499,7 @@ func (ws *Workspace) Clean() error {
 			// a directory, then we need to remove all `inputs` under that directory.
 		}
 		for _, outputDirPath := range cmd.GetOutputDirectories() {
+			outputDirPath := filepath.FromSlash(outputDirPath)
 			if err := os.RemoveAll(filepath.Join(ws.Path(), outputDirPath)); err != nil && !os.IsNotExist(err) {
 				return status.UnavailableErrorf("Failed to clean workspace: %s", err)
 			}
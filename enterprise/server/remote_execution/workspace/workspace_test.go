@@ -9,14 +9,20 @@ import (
 	"testing"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/workspace"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testmount"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 )
 
+func TestMain(m *testing.M) {
+	testmount.RunWithLimitedMountPermissions(m)
+}
+
 func newWorkspace(t *testing.T, opts *workspace.Opts) *workspace.Workspace {
 	te := testenv.GetTestEnv(t)
 	root := testfs.MakeTempDir(t)
@@ -244,3 +250,63 @@ func TestCleanInputsIfNecessary_CleanMatching(t *testing.T) {
 		"expected all KEEPME filePaths (and no others) in the workspace after cleanup",
 	)
 }
+
+func TestInputLayers_SharedBetweenWorkspaces(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	ctx := context.Background()
+	root := testfs.MakeTempDir(t)
+	layersDir := filepath.Join(root, "layers")
+	layers, err := workspace.NewInputLayerCache(te, layersDir, 0 /*=maxLayers*/)
+	require.NoError(t, err)
+
+	// Use a tree containing only directories, so that nothing needs to be
+	// fetched from the cache.
+	child := &repb.Directory{}
+	childDigest, err := digest.ComputeForMessage(child, repb.DigestFunction_SHA256)
+	require.NoError(t, err)
+	rootDir := &repb.Directory{
+		Directories: []*repb.DirectoryNode{{Name: "input_dir", Digest: childDigest}},
+	}
+	rootDigest, err := digest.ComputeForMessage(rootDir, repb.DigestFunction_SHA256)
+	require.NoError(t, err)
+	tree := &repb.Tree{Root: rootDir, Children: []*repb.Directory{child}}
+	task := &repb.ExecutionTask{
+		ExecuteRequest: &repb.ExecuteRequest{DigestFunction: repb.DigestFunction_SHA256},
+		Action:         &repb.Action{InputRootDigest: rootDigest},
+		Command:        &repb.Command{OutputDirectories: []string{"out"}},
+	}
+
+	var workspaces []*workspace.Workspace
+	for i := 0; i < 2; i++ {
+		ws, err := workspace.New(te, root, &workspace.Opts{UseOverlayfs: true, InputLayers: layers})
+		require.NoError(t, err)
+		ws.SetTask(ctx, task)
+		err = ws.CreateOutputDirs()
+		require.NoError(t, err)
+		_, err = ws.DownloadInputs(ctx, tree)
+		require.NoError(t, err)
+		workspaces = append(workspaces, ws)
+
+		// Inputs and output dirs should both be visible in the workspace,
+		// and writes shouldn't affect the layer.
+		require.DirExists(t, filepath.Join(ws.Path(), "input_dir"))
+		require.DirExists(t, filepath.Join(ws.Path(), "out"))
+		err = os.WriteFile(filepath.Join(ws.Path(), "input_dir", "file.txt"), []byte("data"), 0644)
+		require.NoError(t, err)
+	}
+
+	// Both workspaces should share a single layer.
+	entries, err := os.ReadDir(layersDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	testfs.AssertExactFileContents(t, filepath.Join(layersDir, entries[0].Name()), map[string]string{})
+
+	// The layer should be evicted once it's no longer used.
+	for _, ws := range workspaces {
+		err := ws.Remove(ctx)
+		require.NoError(t, err)
+	}
+	entries, err = os.ReadDir(layersDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -24,7 +25,9 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/cookie"
 	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/role"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/subdomain"
 	"github.com/crewjam/saml"
 	"github.com/crewjam/saml/samlsp"
 	"github.com/golang-jwt/jwt"
@@ -37,8 +40,21 @@ var (
 	key      = flag.String("auth.saml.key", "", "PEM encoded certificate key used for SAML auth.", flag.Secret)
 
 	trustedIDPCertFiles = flag.Slice("auth.saml.trusted_idp_cert_files", []string{}, "List of PEM-encoded trusted IDP certificates. Intended for testing and development only.")
+
+	groupAttributes = flag.Slice("auth.saml.group_attributes", []string{"groups", "Groups", "memberOf", "http://schemas.microsoft.com/ws/2008/06/identity/claims/groups"}, "Names of the SAML attributes that list the IdP groups that a user belongs to. These are matched against auth.saml.group_mappings.")
+	groupMappings   = flag.Slice("auth.saml.group_mappings", []GroupMapping{}, "Maps the IdP groups of users that sign up with SAML to BuildBuddy organizations and roles. The first mapping that matches an organization wins.")
 )
 
+// GroupMapping maps an IdP group, listed in one of the
+// auth.saml.group_attributes of a SAML assertion, to a BuildBuddy organization
+// and role.
+type GroupMapping struct {
+	Slug       string `yaml:"slug" json:"slug" usage:"The slug of the organization whose IdP sends the group."`
+	IDPGroup   string `yaml:"idp_group" json:"idp_group" usage:"The value of the group attribute to match."`
+	TargetSlug string `yaml:"target_slug" json:"target_slug" usage:"The slug of the organization that matching users join. It must use the same IdP as slug. Defaults to slug."`
+	Role       string `yaml:"role" json:"role" usage:"The role that matching users are given in the organization: admin, writer, developer or reader. Defaults to developer."`
+}
+
 const (
 	authRedirectParam      = "redirect_url"
 	slugParam              = "slug"
@@ -289,9 +305,11 @@ func (a *SAMLAuthenticator) FillUser(ctx context.Context, user *tables.User) err
 		user.LastName = firstSet(attributes, samlLastNameAttributes)
 		user.Email = firstSet(attributes, samlEmailAttributes)
 		if slug, ok := ctx.Value(contextSamlSlugKey).(string); ok && slug != "" {
-			user.Groups = []*tables.GroupRole{
-				{Group: tables.Group{URLIdentifier: slug}},
+			groups, err := a.groupRolesForAttributes(ctx, slug, attributes)
+			if err != nil {
+				return err
 			}
+			user.Groups = groups
 		}
 		return nil
 	}
@@ -328,7 +346,7 @@ func (a *SAMLAuthenticator) Auth(w http.ResponseWriter, r *http.Request) error {
 		return status.NotFoundErrorf("SAML Auth Failed: %s", err)
 	}
 	// Store slug as a cookie to enable logins directly from the /acs page.
-	slug := r.URL.Query().Get(slugParam)
+	slug := a.getSlugFromRequest(r)
 	cookie.SetCookie(w, slugCookie, slug, time.Now().Add(cookieDuration), true /* httpOnly= */)
 
 	sp.ServeHTTP(w, r)
@@ -461,14 +479,124 @@ func (a *SAMLAuthenticator) serviceProviderFromRequest(r *http.Request) (*samlsp
 	return samlSP, nil
 }
 
+// getSlugFromRequest returns the slug of the organization whose IdP the
+// request is for. An explicit slug param takes precedence, followed by the
+// organization's subdomain (if subdomain matching is enabled), so each tenant
+// subdomain logs in with its own IdP, and finally the slug of the last login.
 func (a *SAMLAuthenticator) getSlugFromRequest(r *http.Request) string {
 	slug := r.URL.Query().Get(slugParam)
+	if slug == "" {
+		slug = subdomain.Get(r.Context())
+	}
 	if slug == "" {
 		slug = cookie.GetCookie(r, slugCookie)
 	}
 	return slug
 }
 
+// groupRolesForAttributes returns the organizations that a user who logged in
+// with the IdP of the given organization joins when they sign up, together
+// with their roles. The user always joins the organization that they logged in
+// with, and also joins the organizations that their IdP groups are mapped to
+// by auth.saml.group_mappings.
+func (a *SAMLAuthenticator) groupRolesForAttributes(ctx context.Context, slug string, attributes samlsp.Attributes) ([]*tables.GroupRole, error) {
+	roles := MappedRoles(slug, idpGroups(attributes))
+	groups := []*tables.GroupRole{
+		{Group: tables.Group{URLIdentifier: slug}, Role: uint32(roles[slug])},
+	}
+	var idpMetadataURL string
+	for _, m := range *groupMappings {
+		targetSlug := m.targetSlug()
+		r, ok := roles[targetSlug]
+		if !ok || targetSlug == slug {
+			continue
+		}
+		// Only trust the IdP of an organization to grant access to the
+		// organizations that use the same IdP, such as its child
+		// organizations.
+		if idpMetadataURL == "" {
+			g, err := a.groupForSlug(ctx, slug)
+			if err != nil {
+				return nil, err
+			}
+			idpMetadataURL = g.SamlIdpMetadataUrl
+		}
+		// A misconfigured mapping only skips that organization, so that it
+		// can't lock every user of the IdP out.
+		g, err := a.groupForSlug(ctx, targetSlug)
+		if err != nil {
+			log.CtxWarningf(ctx, "Skipping SAML group mapping for %q: could not look up target organization %q: %s", slug, targetSlug, err)
+			continue
+		}
+		if g.SamlIdpMetadataUrl != idpMetadataURL {
+			log.CtxWarningf(ctx, "Skipping SAML group mapping for %q: target organization %q uses a different IdP", slug, targetSlug)
+			continue
+		}
+		groups = append(groups, &tables.GroupRole{Group: tables.Group{URLIdentifier: targetSlug}, Role: uint32(r)})
+		// Only add each organization once.
+		delete(roles, targetSlug)
+	}
+	return groups, nil
+}
+
+// idpGroups returns the IdP groups listed in the
+// auth.saml.group_attributes of the given attributes.
+func idpGroups(attributes samlsp.Attributes) []string {
+	var groups []string
+	for _, name := range *groupAttributes {
+		groups = append(groups, attributes[name]...)
+	}
+	return groups
+}
+
+// HasGroupMappings returns whether any of the auth.saml.group_mappings of
+// the organization with the given slug assign roles in that organization.
+func HasGroupMappings(slug string) bool {
+	for _, m := range *groupMappings {
+		if m.Slug == slug && m.targetSlug() == slug {
+			return true
+		}
+	}
+	return false
+}
+
+// MappedRoles returns the roles that the given IdP groups map to in each
+// organization, according to the auth.saml.group_mappings of the organization
+// with the given slug. The first mapping that matches an organization wins.
+// Organizations that no mapping matches aren't included, except for the
+// given organization itself, which defaults to role.None. Mappings with an
+// invalid role are skipped.
+func MappedRoles(slug string, idpGroups []string) map[string]role.Role {
+	roles := map[string]role.Role{slug: role.None}
+	for _, m := range *groupMappings {
+		if m.Slug != slug || !slices.Contains(idpGroups, m.IDPGroup) {
+			continue
+		}
+		targetSlug := m.targetSlug()
+		if r, ok := roles[targetSlug]; ok && r != role.None {
+			continue
+		}
+		r := role.Default
+		if m.Role != "" {
+			var err error
+			r, err = role.Parse(m.Role)
+			if err != nil {
+				log.Warningf("Skipping SAML group mapping for %q with IdP group %q: %s", slug, m.IDPGroup, err)
+				continue
+			}
+		}
+		roles[targetSlug] = r
+	}
+	return roles
+}
+
+func (m GroupMapping) targetSlug() string {
+	if m.TargetSlug != "" {
+		return m.TargetSlug
+	}
+	return m.Slug
+}
+
 func (a *SAMLAuthenticator) getSAMLMetadataUrlForSlug(ctx context.Context, slug string) (*url.URL, error) {
 	group, err := a.groupForSlug(ctx, slug)
 	if err != nil {
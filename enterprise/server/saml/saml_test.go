@@ -0,0 +1,135 @@
+package saml
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/role"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/crewjam/saml/samlsp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMappedRoles(t *testing.T) {
+	flags.Set(t, "auth.saml.group_mappings", []GroupMapping{
+		{Slug: "acme", IDPGroup: "eng-admins", Role: "admin"},
+		{Slug: "acme", IDPGroup: "eng", TargetSlug: "acme-ci"},
+		{Slug: "acme", IDPGroup: "eng", Role: "reader"},
+		{Slug: "acme", IDPGroup: "ops", TargetSlug: "acme-ci", Role: "admin"},
+		{Slug: "other", IDPGroup: "eng", TargetSlug: "other-ci", Role: "admin"},
+	})
+	for _, test := range []struct {
+		name       string
+		attributes samlsp.Attributes
+		want       map[string]role.Role
+	}{
+		{
+			name:       "no groups",
+			attributes: samlsp.Attributes{"email": {"a@acme.io"}},
+			want:       map[string]role.Role{"acme": role.None},
+		},
+		{
+			name:       "unmapped group",
+			attributes: samlsp.Attributes{"groups": {"sales"}},
+			want:       map[string]role.Role{"acme": role.None},
+		},
+		{
+			name:       "mapped group",
+			attributes: samlsp.Attributes{"groups": {"eng"}},
+			want:       map[string]role.Role{"acme": role.Reader, "acme-ci": role.Developer},
+		},
+		{
+			name:       "first mapping wins",
+			attributes: samlsp.Attributes{"memberOf": {"eng", "eng-admins", "ops"}},
+			want:       map[string]role.Role{"acme": role.Admin, "acme-ci": role.Developer},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			roles := MappedRoles("acme", idpGroups(test.attributes))
+			require.Equal(t, test.want, roles)
+		})
+	}
+}
+
+func TestHasGroupMappings(t *testing.T) {
+	flags.Set(t, "auth.saml.group_mappings", []GroupMapping{
+		{Slug: "acme", IDPGroup: "eng", Role: "admin"},
+		{Slug: "other", IDPGroup: "eng", TargetSlug: "other-ci"},
+	})
+	require.True(t, HasGroupMappings("acme"))
+	require.False(t, HasGroupMappings("other"))
+	require.False(t, HasGroupMappings("other-ci"))
+}
+
+func TestMappedRoles_InvalidRole(t *testing.T) {
+	flags.Set(t, "auth.saml.group_mappings", []GroupMapping{
+		{Slug: "acme", IDPGroup: "eng", Role: "owner"},
+		{Slug: "acme", IDPGroup: "eng", Role: "writer"},
+		{Slug: "acme", IDPGroup: "eng", TargetSlug: "acme-ci", Role: "owner"},
+	})
+	// Invalid mappings are skipped, so later mappings can still match.
+	roles := MappedRoles("acme", []string{"eng"})
+	require.Equal(t, map[string]role.Role{"acme": role.Writer}, roles)
+}
+
+func TestGroupRolesForAttributes(t *testing.T) {
+	ctx := context.Background()
+	env := enterprise_testenv.New(t)
+	for _, g := range []*tables.Group{
+		{GroupID: "GR1", URLIdentifier: "acme", SamlIdpMetadataUrl: "https://idp.acme.io/metadata"},
+		{GroupID: "GR2", URLIdentifier: "acme-ci", SamlIdpMetadataUrl: "https://idp.acme.io/metadata"},
+		{GroupID: "GR3", URLIdentifier: "rival", SamlIdpMetadataUrl: "https://idp.rival.io/metadata"},
+	} {
+		err := env.GetDBHandle().NewQuery(ctx, "create_group").Create(g)
+		require.NoError(t, err)
+	}
+	flags.Set(t, "auth.saml.group_mappings", []GroupMapping{
+		{Slug: "acme", IDPGroup: "eng", Role: "admin"},
+		{Slug: "acme", IDPGroup: "eng", TargetSlug: "acme-ci", Role: "owner"},
+		{Slug: "acme", IDPGroup: "eng", TargetSlug: "acme-ci", Role: "writer"},
+		{Slug: "acme", IDPGroup: "ops", TargetSlug: "rival", Role: "admin"},
+		{Slug: "acme", IDPGroup: "ops", TargetSlug: "missing", Role: "admin"},
+		{Slug: "acme", IDPGroup: "ops", Role: "reader"},
+	})
+	a, err := NewSAMLAuthenticator(env)
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		name       string
+		attributes samlsp.Attributes
+		want       map[string]role.Role
+	}{
+		{
+			name:       "no groups",
+			attributes: samlsp.Attributes{"email": {"a@acme.io"}},
+			want:       map[string]role.Role{"acme": role.None},
+		},
+		{
+			name:       "invalid role is skipped",
+			attributes: samlsp.Attributes{"groups": {"eng"}},
+			want:       map[string]role.Role{"acme": role.Admin, "acme-ci": role.Writer},
+		},
+		{
+			name:       "organization with a different IdP is skipped",
+			attributes: samlsp.Attributes{"groups": {"ops"}},
+			want:       map[string]role.Role{"acme": role.Reader},
+		},
+		{
+			name:       "all groups",
+			attributes: samlsp.Attributes{"groups": {"eng", "ops"}},
+			want:       map[string]role.Role{"acme": role.Admin, "acme-ci": role.Writer},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			groups, err := a.groupRolesForAttributes(ctx, "acme", test.attributes)
+			require.NoError(t, err)
+			roles := make(map[string]role.Role)
+			for _, g := range groups {
+				roles[g.Group.URLIdentifier] = role.Role(g.Role)
+			}
+			require.Equal(t, test.want, roles)
+		})
+	}
+}
@@ -0,0 +1,134 @@
+// Package executor_identity fetches and renews the executor's mTLS client
+// certificate from the app's built-in CA.
+package executor_identity
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"sync/atomic"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/authutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/grpc_client"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"google.golang.org/grpc/metadata"
+
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+)
+
+var (
+	useBuiltinCA = flag.Bool("executor.mtls.use_builtin_ca", false, "If true, the executor fetches a short-lived client certificate with a SPIFFE ID from the app's built-in CA, using its API key, and presents it to the app and cache. The certificate is renewed in the background. The app must set ssl.client_ca_cert, ssl.client_ca_key and ssl.spiffe_trust_domain.")
+)
+
+const (
+	// How long to wait before retrying a failed renewal.
+	renewRetryInterval = 30 * time.Second
+)
+
+type identity struct {
+	client      scpb.SchedulerClient
+	apiKey      string
+	executorID  string
+	certificate atomic.Pointer[tls.Certificate]
+}
+
+// Register fetches a certificate for the executor and sets it as the client
+// certificate for gRPC connections. It must be called before dialing the app
+// and cache.
+func Register(ctx context.Context, appTarget, apiKey, executorID string) error {
+	if !*useBuiltinCA {
+		return nil
+	}
+	// This connection is made without a client certificate, so the app
+	// can't require one.
+	conn, err := grpc_client.DialSimpleWithoutPooling(appTarget)
+	if err != nil {
+		return status.UnavailableErrorf("could not connect to app %q: %s", appTarget, err)
+	}
+	id := &identity{
+		client:     scpb.NewSchedulerClient(conn),
+		apiKey:     apiKey,
+		executorID: executorID,
+	}
+	cert, err := id.renew(ctx)
+	if err != nil {
+		conn.Close()
+		return status.WrapError(err, "fetch executor certificate")
+	}
+	grpc_client.SetClientCertificateSource(func() (*tls.Certificate, error) {
+		return id.certificate.Load(), nil
+	})
+	go func() {
+		defer conn.Close()
+		id.renewPeriodically(ctx, cert)
+	}()
+	return nil
+}
+
+// renew fetches a new certificate and key pair.
+func (i *identity) renew(ctx context.Context) (*x509.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		return nil, err
+	}
+	if i.apiKey != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, authutil.APIKeyHeader, i.apiKey)
+	}
+	rsp, err := i.client.IssueExecutorCertificate(ctx, &scpb.IssueExecutorCertificateRequest{
+		CertificateSigningRequest: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})),
+		ExecutorId:                i.executorID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	tlsCert, err := tls.X509KeyPair([]byte(rsp.GetCertificate()), keyPEM)
+	if err != nil {
+		return nil, status.InternalErrorf("invalid certificate from app: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		return nil, status.InternalErrorf("invalid certificate from app: %s", err)
+	}
+	i.certificate.Store(&tlsCert)
+	log.Infof("Fetched executor certificate for %q, expiring at %s", rsp.GetSpiffeId(), leaf.NotAfter)
+	return leaf, nil
+}
+
+// renewPeriodically renews the certificate when 2/3 of its lifetime has
+// passed, so that there's time to retry before it expires.
+func (i *identity) renewPeriodically(ctx context.Context, cert *x509.Certificate) {
+	for {
+		lifetime := cert.NotAfter.Sub(cert.NotBefore)
+		delay := time.Until(cert.NotBefore.Add(lifetime * 2 / 3))
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			next, err := i.renew(ctx)
+			if err == nil {
+				cert = next
+				break
+			}
+			log.Warningf("Failed to renew executor certificate expiring at %s: %s", cert.NotAfter, err)
+			delay = renewRetryInterval
+		}
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"container/list"
 	"context"
 	"flag"
+	"fmt"
+	"maps"
+	"slices"
 	"sync"
 	"time"
 
@@ -39,9 +42,104 @@ var (
 
 var shuttingDownLogOnce sync.Once
 
-type groupPriorityQueue struct {
+// priorityLane holds a group's queued tasks for a single priority lane.
+type priorityLane struct {
 	*priority_queue.PriorityQueue
+	name   string
+	weight int64
+	// credit is the lane's current smooth weighted round-robin credit.
+	credit int64
+}
+
+// groupPriorityQueue holds a group's queued tasks, split into priority lanes.
+// Tasks are dequeued from the non-empty lanes using smooth weighted
+// round-robin, so each lane gets a share of the group's turns proportional to
+// its weight, and lanes with a lower weight are never starved.
+type groupPriorityQueue struct {
 	groupID string
+	// Non-empty lanes, in the order they were created.
+	lanes []*priorityLane
+}
+
+func newGroupPriorityQueue(groupID string) *groupPriorityQueue {
+	return &groupPriorityQueue{groupID: groupID}
+}
+
+func (pq *groupPriorityQueue) Push(req *scpb.EnqueueTaskReservationRequest) {
+	name := req.GetSchedulingMetadata().GetPriorityLane()
+	weight := max(int64(req.GetSchedulingMetadata().GetPriorityLaneWeight()), 1)
+	for _, l := range pq.lanes {
+		if l.name == name {
+			// Pick up weight changes from the scheduler's config.
+			l.weight = weight
+			l.Push(req)
+			return
+		}
+	}
+	l := &priorityLane{
+		PriorityQueue: priority_queue.NewPriorityQueue(),
+		name:          name,
+		weight:        weight,
+	}
+	l.Push(req)
+	pq.lanes = append(pq.lanes, l)
+}
+
+// nextLane returns the index of the lane that the next task will be dequeued
+// from, or -1 if there are no tasks.
+func (pq *groupPriorityQueue) nextLane() int {
+	next := -1
+	for i, l := range pq.lanes {
+		if next < 0 || l.credit+l.weight > pq.lanes[next].credit+pq.lanes[next].weight {
+			next = i
+		}
+	}
+	return next
+}
+
+func (pq *groupPriorityQueue) Peek() *scpb.EnqueueTaskReservationRequest {
+	i := pq.nextLane()
+	if i < 0 {
+		return nil
+	}
+	return pq.lanes[i].Peek()
+}
+
+func (pq *groupPriorityQueue) Pop() *scpb.EnqueueTaskReservationRequest {
+	i := pq.nextLane()
+	if i < 0 {
+		return nil
+	}
+	totalWeight := int64(0)
+	for _, l := range pq.lanes {
+		l.credit += l.weight
+		totalWeight += l.weight
+	}
+	l := pq.lanes[i]
+	l.credit -= totalWeight
+	req := l.Pop()
+	if l.Len() == 0 {
+		// Lanes only earn credit while they have queued tasks, so that a lane
+		// can't save up turns while it's idle.
+		pq.lanes = append(pq.lanes[:i], pq.lanes[i+1:]...)
+	}
+	return req
+}
+
+func (pq *groupPriorityQueue) GetAll() []*scpb.EnqueueTaskReservationRequest {
+	var reservations []*scpb.EnqueueTaskReservationRequest
+	for _, l := range pq.lanes {
+		reservations = append(reservations, l.GetAll()...)
+	}
+	return reservations
+}
+
+func (pq *groupPriorityQueue) Len() int {
+	n := 0
+	for _, l := range pq.lanes {
+		n += l.Len()
+	}
+	return n
 }
 
 type taskQueue struct {
@@ -91,10 +189,7 @@ func (t *taskQueue) Enqueue(req *scpb.EnqueueTaskReservationRequest) {
 			return
 		}
 	} else {
-		pq = &groupPriorityQueue{
-			PriorityQueue: priority_queue.NewPriorityQueue(),
-			groupID:       taskGroupID,
-		}
+		pq = newGroupPriorityQueue(taskGroupID)
 		el := t.pqs.PushBack(pq)
 		t.pqByGroupID[taskGroupID] = el
 		if t.currentPQ == nil {
@@ -168,6 +263,7 @@ type Options struct {
 
 type PriorityTaskScheduler struct {
 	env              environment.Env
+	options          *Options
 	log              log.Logger
 	shuttingDown     bool
 	exec             *executor.Executor
@@ -188,25 +284,35 @@ type PriorityTaskScheduler struct {
 	exclusiveTaskScheduling bool
 }
 
-func NewPriorityTaskScheduler(env environment.Env, exec *executor.Executor, runnerPool interfaces.RunnerPool, options *Options) *PriorityTaskScheduler {
-	ramBytesCapacity := options.RAMBytesCapacityOverride
-	if ramBytesCapacity == 0 {
-		ramBytesCapacity = int64(float64(resources.GetAllocatedRAMBytes()) * tasksize.MaxResourceCapacityRatio)
+// resourceCapacity returns the resources available to tasks, which are the
+// executor's allocated resources unless overridden by options.
+func resourceCapacity(options *Options) (ramBytes, cpuMillis int64, custom map[string]customResourceCount) {
+	ramBytes = options.RAMBytesCapacityOverride
+	if ramBytes == 0 {
+		ramBytes = int64(float64(resources.GetAllocatedRAMBytes()) * tasksize.MaxResourceCapacityRatio)
 	}
-	cpuMillisCapacity := options.CPUMillisCapacityOverride
-	if cpuMillisCapacity == 0 {
-		cpuMillisCapacity = int64(float64(resources.GetAllocatedCPUMillis()) * tasksize.MaxResourceCapacityRatio)
+	cpuMillis = options.CPUMillisCapacityOverride
+	if cpuMillis == 0 {
+		cpuMillis = int64(float64(resources.GetAllocatedCPUMillis()) * tasksize.MaxResourceCapacityRatio)
 	}
-	customResourcesCapacity := map[string]customResourceCount{}
-	customResourcesUsed := map[string]customResourceCount{}
+	custom = map[string]customResourceCount{}
 	for _, r := range resources.GetAllocatedCustomResources() {
-		customResourcesCapacity[r.GetName()] = customResource(r.GetValue())
-		customResourcesUsed[r.GetName()] = 0
+		custom[r.GetName()] = customResource(r.GetValue())
+	}
+	return ramBytes, cpuMillis, custom
+}
+
+func NewPriorityTaskScheduler(env environment.Env, exec *executor.Executor, runnerPool interfaces.RunnerPool, options *Options) *PriorityTaskScheduler {
+	ramBytesCapacity, cpuMillisCapacity, customResourcesCapacity := resourceCapacity(options)
+	customResourcesUsed := map[string]customResourceCount{}
+	for name := range customResourcesCapacity {
+		customResourcesUsed[name] = 0
 	}
 
 	rootContext, rootCancel := context.WithCancel(context.Background())
 	qes := &PriorityTaskScheduler{
 		env:                     env,
+		options:                 options,
 		q:                       newTaskQueue(),
 		exec:                    exec,
 		runnerPool:              runnerPool,
@@ -289,19 +395,65 @@ func (q *PriorityTaskScheduler) Shutdown(ctx context.Context) error {
 	return nil
 }
 
+// Drain stops claiming queued work and waits for the tasks that are running
+// to finish. Tasks that are still running when the context is done are
+// cancelled, and Drain returns once they have exited.
+//
+// The task reservations that were queued are removed from the queue and
+// returned, so that they can be re-enqueued on other executors. Work is never
+// claimed after draining, so the executor should shut down afterwards.
+func (q *PriorityTaskScheduler) Drain(ctx context.Context) []*scpb.EnqueueTaskReservationRequest {
+	ctx = q.enrichContext(ctx)
+	q.mu.Lock()
+	q.shuttingDown = true
+	var queued []*scpb.EnqueueTaskReservationRequest
+	for {
+		reservation := q.q.Dequeue()
+		if reservation == nil {
+			break
+		}
+		queued = append(queued, reservation)
+	}
+	q.mu.Unlock()
+	log.CtxInfof(ctx, "Draining executor, returning %d queued task reservations", len(queued))
+
+	cancelled := false
+	for {
+		q.mu.Lock()
+		activeTasks := len(q.activeTaskCancelFuncs)
+		if activeTasks > 0 && !cancelled && ctx.Err() != nil {
+			log.CtxWarningf(ctx, "Drain deadline exceeded, cancelling %d running tasks", activeTasks)
+			for cancel := range q.activeTaskCancelFuncs {
+				(*cancel)()
+			}
+			cancelled = true
+		}
+		q.mu.Unlock()
+		if activeTasks == 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	log.CtxInfof(ctx, "Executor drained")
+	return queued
+}
+
 func (q *PriorityTaskScheduler) EnqueueTaskReservation(ctx context.Context, req *scpb.EnqueueTaskReservationRequest) (*scpb.EnqueueTaskReservationResponse, error) {
 	ctx = log.EnrichContext(ctx, log.ExecutionIDKey, req.GetTaskId())
 
-	if req.GetTaskSize().GetEstimatedMemoryBytes() > q.ramBytesCapacity ||
-		req.GetTaskSize().GetEstimatedMilliCpu() > q.cpuMillisCapacity {
+	q.mu.Lock()
+	ramBytesCapacity, cpuMillisCapacity := q.ramBytesCapacity, q.cpuMillisCapacity
+	q.mu.Unlock()
+	if req.GetTaskSize().GetEstimatedMemoryBytes() > ramBytesCapacity ||
+		req.GetTaskSize().GetEstimatedMilliCpu() > cpuMillisCapacity {
 		// TODO(bduffany): Return an error here instead. Currently we cannot
 		// return an error because it causes the executor to disconnect and
 		// reconnect to the scheduler, and the scheduler will keep attempting to
 		// re-enqueue the oversized task onto this executor once reconnected.
 		log.CtxErrorf(ctx,
 			"Task exceeds executor capacity: requires %d bytes memory of %d available and %d milliCPU of %d available",
-			req.GetTaskSize().GetEstimatedMemoryBytes(), q.ramBytesCapacity,
-			req.GetTaskSize().GetEstimatedMilliCpu(), q.cpuMillisCapacity,
+			req.GetTaskSize().GetEstimatedMemoryBytes(), ramBytesCapacity,
+			req.GetTaskSize().GetEstimatedMilliCpu(), cpuMillisCapacity,
 		)
 	}
 
@@ -325,6 +477,37 @@ func (q *PriorityTaskScheduler) EnqueueTaskReservation(ctx context.Context, req
 	return &scpb.EnqueueTaskReservationResponse{}, nil
 }
 
+// UpdateResourceCapacity re-reads the resources available to tasks, after the
+// executor's allocated resources have been reconfigured. Running tasks keep
+// their resources, so if the capacity shrinks, queued tasks wait until enough
+// running tasks have finished.
+func (q *PriorityTaskScheduler) UpdateResourceCapacity() {
+	ramBytesCapacity, cpuMillisCapacity, customResourcesCapacity := resourceCapacity(q.options)
+	q.mu.Lock()
+	q.ramBytesCapacity = ramBytesCapacity
+	q.cpuMillisCapacity = cpuMillisCapacity
+	q.customResourcesCapacity = customResourcesCapacity
+	for name := range customResourcesCapacity {
+		if _, ok := q.customResourcesUsed[name]; !ok {
+			q.customResourcesUsed[name] = 0
+		}
+	}
+	// Stop tracking resources that were removed, unless they are still used
+	// by running tasks.
+	for name, used := range q.customResourcesUsed {
+		if _, ok := customResourcesCapacity[name]; !ok && used == 0 {
+			delete(q.customResourcesUsed, name)
+		}
+	}
+	log.Infof("Updated task resource capacity: %s", q.stats())
+	q.mu.Unlock()
+	// Wake up the scheduling loop in case queued tasks fit now.
+	select {
+	case q.checkQueueSignal <- struct{}{}:
+	default:
+	}
+}
+
 func (q *PriorityTaskScheduler) propagateExecutionTaskValuesToContext(ctx context.Context, execTask *repb.ExecutionTask) context.Context {
 	// Make sure we identify any executor cache requests as being from the
 	// executor, and also set the client origin (e.g. internal / external).
@@ -345,7 +528,7 @@ func (q *PriorityTaskScheduler) propagateExecutionTaskValuesToContext(ctx contex
 	return ctx
 }
 
-func (q *PriorityTaskScheduler) runTask(ctx context.Context, st *repb.ScheduledTask) (retry bool, err error) {
+func (q *PriorityTaskScheduler) runTask(ctx context.Context, st *repb.ScheduledTask, recordAccessedInputs func([]*scpb.TaskInput)) (retry bool, err error) {
 	if q.env.GetRemoteExecutionClient() == nil {
 		return false, status.FailedPreconditionError("Execution client not configured")
 	}
@@ -364,7 +547,7 @@ func (q *PriorityTaskScheduler) runTask(ctx context.Context, st *repb.ScheduledT
 	// TODO(http://go/b/1192): Figure out why CloseAndRecv() hangs if we call
 	// it too soon after establishing the clientStream, and remove this delay.
 	const closeStreamDelay = 10 * time.Millisecond
-	if retry, err := q.exec.ExecuteTaskAndStreamResults(ctx, st, clientStream); err != nil {
+	if retry, err := q.exec.ExecuteTaskAndStreamResults(ctx, st, clientStream, recordAccessedInputs); err != nil {
 		log.CtxWarningf(ctx, "ExecuteTaskAndStreamResults error: %s", err)
 		time.Sleep(time.Until(start.Add(closeStreamDelay)))
 		_, _ = clientStream.CloseAndRecv()
@@ -385,6 +568,9 @@ func (q *PriorityTaskScheduler) trackTask(res *scpb.EnqueueTaskReservationReques
 		for _, r := range size.GetCustomResources() {
 			if _, ok := q.customResourcesUsed[r.GetName()]; ok {
 				q.customResourcesUsed[r.GetName()] += customResource(r.GetValue())
+				metrics.RemoteExecutionAssignedCustomResources.With(prometheus.Labels{
+					metrics.CustomResourceNameLabel: r.GetName(),
+				}).Set(q.customResourcesUsed[r.GetName()].Float64())
 			}
 		}
 		metrics.RemoteExecutionAssignedRAMBytes.Set(float64(q.ramBytesUsed))
@@ -401,6 +587,9 @@ func (q *PriorityTaskScheduler) untrackTask(res *scpb.EnqueueTaskReservationRequ
 		for _, r := range size.GetCustomResources() {
 			if _, ok := q.customResourcesUsed[r.GetName()]; ok {
 				q.customResourcesUsed[r.GetName()] -= customResource(r.GetValue())
+				metrics.RemoteExecutionAssignedCustomResources.With(prometheus.Labels{
+					metrics.CustomResourceNameLabel: r.GetName(),
+				}).Set(q.customResourcesUsed[r.GetName()].Float64())
 			}
 		}
 		metrics.RemoteExecutionAssignedRAMBytes.Set(float64(q.ramBytesUsed))
@@ -412,11 +601,15 @@ func (q *PriorityTaskScheduler) untrackTask(res *scpb.EnqueueTaskReservationRequ
 func (q *PriorityTaskScheduler) stats() string {
 	ramBytesRemaining := q.ramBytesCapacity - q.ramBytesUsed
 	cpuMillisRemaining := q.cpuMillisCapacity - q.cpuMillisUsed
+	custom := ""
+	for _, name := range slices.Sorted(maps.Keys(q.customResourcesCapacity)) {
+		custom += fmt.Sprintf(", %s: %g of %g allocated", name, q.customResourcesUsed[name].Float64(), q.customResourcesCapacity[name].Float64())
+	}
 	return message.NewPrinter(language.English).Sprintf(
-		"Mem: %d of %d bytes allocated (%d remaining), CPU: %d of %d milliCPU allocated (%d remaining), Tasks: %d active, %d queued",
+		"Mem: %d of %d bytes allocated (%d remaining), CPU: %d of %d milliCPU allocated (%d remaining)%s, Tasks: %d active, %d queued",
 		q.ramBytesUsed, q.ramBytesCapacity, ramBytesRemaining,
 		q.cpuMillisUsed, q.cpuMillisCapacity, cpuMillisRemaining,
-		len(q.activeTaskCancelFuncs), q.q.Len())
+		custom, len(q.activeTaskCancelFuncs), q.q.Len())
 }
 
 func (q *PriorityTaskScheduler) canFitTask(res *scpb.EnqueueTaskReservationRequest) bool {
@@ -532,8 +725,9 @@ func (q *PriorityTaskScheduler) handleTask() {
 		scheduledTask := &repb.ScheduledTask{
 			ExecutionTask:      execTask,
 			SchedulingMetadata: reservation.GetSchedulingMetadata(),
+			HotInputs:          taskLease.HotInputs(),
 		}
-		retry, err := q.runTask(ctx, scheduledTask)
+		retry, err := q.runTask(ctx, scheduledTask, taskLease.RecordAccessedInputs)
 		if err != nil {
 			log.CtxErrorf(ctx, "Error running task %q (re-enqueue for retry: %t): %s", reservation.GetTaskId(), retry, err)
 		}
@@ -574,3 +768,7 @@ func customResource(value float32) customResourceCount {
 	millionths := int64(value * 1e6)
 	return customResourceCount(millionths)
 }
+
+func (c customResourceCount) Float64() float64 {
+	return float64(c) / 1e6
+}
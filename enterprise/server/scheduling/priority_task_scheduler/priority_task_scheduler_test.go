@@ -1,6 +1,7 @@
 package priority_task_scheduler
 
 import (
+	"fmt"
 	"testing"
 
 	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
@@ -81,3 +82,50 @@ func TestTaskQueue_MultipleGroups(t *testing.T) {
 	require.Equal(t, "group1Task3", q.Dequeue().GetTaskId())
 	require.Nil(t, q.Dequeue())
 }
+
+func newLaneTaskReservationRequest(taskID, taskGroupID, lane string, weight int32) *scpb.EnqueueTaskReservationRequest {
+	req := newTaskReservationRequest(taskID, taskGroupID, 0)
+	req.SchedulingMetadata.PriorityLane = lane
+	req.SchedulingMetadata.PriorityLaneWeight = weight
+	return req
+}
+
+func TestTaskQueue_PriorityLanes(t *testing.T) {
+	q := newTaskQueue()
+
+	// Queue a backlog of batch tasks, followed by some interactive tasks.
+	for i := 0; i < 5; i++ {
+		q.Enqueue(newLaneTaskReservationRequest(fmt.Sprintf("batch%d", i), testGroupID1, "batch", 1))
+	}
+	for i := 0; i < 8; i++ {
+		q.Enqueue(newLaneTaskReservationRequest(fmt.Sprintf("interactive%d", i), testGroupID1, "interactive", 4))
+	}
+	require.Equal(t, 13, q.Len())
+
+	// While both lanes have tasks, they should be dequeued in proportion to
+	// their weights, and Peek should agree with Dequeue.
+	dequeued := map[string]int{}
+	for i := 0; i < 10; i++ {
+		peeked := q.Peek()
+		req := q.Dequeue()
+		require.Equal(t, peeked.GetTaskId(), req.GetTaskId())
+		dequeued[req.GetSchedulingMetadata().GetPriorityLane()]++
+	}
+	require.Equal(t, map[string]int{"interactive": 8, "batch": 2}, dequeued)
+
+	// Tasks within a lane are dequeued in order.
+	require.Equal(t, "batch2", q.Dequeue().GetTaskId())
+	require.Equal(t, "batch3", q.Dequeue().GetTaskId())
+	require.Equal(t, "batch4", q.Dequeue().GetTaskId())
+	require.Nil(t, q.Dequeue())
+	require.Equal(t, 0, q.Len())
+
+	// An idle lane doesn't save up turns: after the batch lane drains, a new
+	// batch task doesn't jump ahead of interactive tasks queued with it.
+	q.Enqueue(newLaneTaskReservationRequest("interactive8", testGroupID1, "interactive", 4))
+	q.Enqueue(newLaneTaskReservationRequest("interactive9", testGroupID1, "interactive", 4))
+	q.Enqueue(newLaneTaskReservationRequest("batch5", testGroupID1, "batch", 1))
+	require.Equal(t, "interactive8", q.Dequeue().GetTaskId())
+	require.Equal(t, "interactive9", q.Dequeue().GetTaskId())
+	require.Equal(t, "batch5", q.Dequeue().GetTaskId())
+}
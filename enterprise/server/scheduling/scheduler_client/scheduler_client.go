@@ -22,11 +22,16 @@ import (
 	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
 )
 
-var pool = flag.String("executor.pool", "", "Executor pool name. Only one of this config option or the MY_POOL environment variable should be specified.")
+var (
+	pool   = flag.String("executor.pool", "", "Executor pool name. Only one of this config option or the MY_POOL environment variable should be specified.")
+	region = flag.String("executor.region", "", "The region that the executor is running in, such as us-west1. If set, the scheduler prefers executors in the same region as the app when scheduling tasks.")
+)
 
 const (
 	schedulerCheckInInterval         = 5 * time.Second
 	registrationFailureRetryInterval = 1 * time.Second
+	// How long to wait for the executor to deregister once it has drained.
+	deregistrationTimeout = 10 * time.Second
 )
 
 // Options provide overrides for executor registration properties.
@@ -59,6 +64,7 @@ func makeExecutionNode(pool, executorID, executorHostID string, options *Options
 		Version:                   version.AppVersion(),
 		ExecutorId:                executorID,
 		ExecutorHostId:            executorHostID,
+		Region:                    strings.ToLower(*region),
 	}, nil
 }
 
@@ -72,14 +78,63 @@ func sleepWithContext(ctx context.Context, delay time.Duration) (done bool) {
 }
 
 type Registration struct {
+	env             environment.Env
 	schedulerClient scpb.SchedulerClient
 	taskScheduler   *priority_task_scheduler.PriorityTaskScheduler
-	node            *scpb.ExecutionNode
 	apiKey          string
 	shutdownSignal  chan struct{}
+	shutdownOnce    sync.Once
+	options         *Options
+	// Closed once the executor stops maintaining its registration.
+	stopped chan struct{}
+	// Signalled when the registration has changed, or when there are drained
+	// tasks to return to the scheduler.
+	drainSignal chan struct{}
 
 	mu        sync.Mutex
+	node      *scpb.ExecutionNode
 	connected bool
+	draining  bool
+	// IDs of tasks that won't be run because the executor is draining, which
+	// haven't been returned to the scheduler yet.
+	drainedTaskIDs []string
+}
+
+func (r *Registration) getNode() *scpb.ExecutionNode {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.node
+}
+
+func (r *Registration) getDraining() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.draining
+}
+
+// addDrainedTasks queues task IDs to be returned to the scheduler.
+func (r *Registration) addDrainedTasks(taskIDs ...string) {
+	r.mu.Lock()
+	r.drainedTaskIDs = append(r.drainedTaskIDs, taskIDs...)
+	r.mu.Unlock()
+	select {
+	case r.drainSignal <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Registration) takeDrainedTasks() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	taskIDs := r.drainedTaskIDs
+	r.drainedTaskIDs = nil
+	return taskIDs
+}
+
+func (r *Registration) signalShutdown() {
+	r.shutdownOnce.Do(func() {
+		close(r.shutdownSignal)
+	})
 }
 
 func (r *Registration) getConnected() bool {
@@ -103,7 +158,7 @@ func (r *Registration) Check(ctx context.Context) error {
 
 func (r *Registration) processWorkStream(ctx context.Context, stream scpb.Scheduler_RegisterAndStreamWorkClient, schedulerMsgs chan *scpb.RegisterAndStreamWorkResponse, schedulerErr chan error, registrationTicker *time.Ticker) (bool, error) {
 	registrationMsg := &scpb.RegisterAndStreamWorkRequest{
-		RegisterExecutorRequest: &scpb.RegisterExecutorRequest{Node: r.node},
+		RegisterExecutorRequest: &scpb.RegisterExecutorRequest{Node: r.getNode()},
 	}
 
 	select {
@@ -113,7 +168,7 @@ func (r *Registration) processWorkStream(ctx context.Context, stream scpb.Schedu
 	case <-r.shutdownSignal:
 		log.Info("Executor shutting down, cancelling node registration.")
 		taskReservations := r.taskScheduler.GetQueuedTaskReservations()
-		var taskIDs []string
+		taskIDs := r.takeDrainedTasks()
 		for _, r := range taskReservations {
 			taskIDs = append(taskIDs, r.GetTaskId())
 		}
@@ -131,6 +186,17 @@ func (r *Registration) processWorkStream(ctx context.Context, stream scpb.Schedu
 			out, _ := prototext.Marshal(msg)
 			return false, status.FailedPreconditionErrorf("message from scheduler did not contain a task reservation request:\n%s", string(out))
 		}
+		if r.getDraining() {
+			// The scheduler sent the reservation before it saw that the
+			// executor is draining. Ack it, and hand it back.
+			taskID := msg.GetEnqueueTaskReservationRequest().GetTaskId()
+			rspMsg := &scpb.RegisterAndStreamWorkRequest{EnqueueTaskReservationResponse: &scpb.EnqueueTaskReservationResponse{TaskId: taskID}}
+			if err := stream.Send(rspMsg); err != nil {
+				return false, status.UnavailableErrorf("could not send task reservation response: %s", err)
+			}
+			r.addDrainedTasks(taskID)
+			return false, nil
+		}
 
 		rsp, err := r.taskScheduler.EnqueueTaskReservation(ctx, msg.GetEnqueueTaskReservationRequest())
 		if err != nil {
@@ -142,6 +208,24 @@ func (r *Registration) processWorkStream(ctx context.Context, stream scpb.Schedu
 		if err := stream.Send(rspMsg); err != nil {
 			return false, status.UnavailableErrorf("could not send task reservation response: %s", err)
 		}
+	case <-r.drainSignal:
+		// Send the draining registration first, so that the scheduler stops
+		// sending task reservations before the drained tasks are re-enqueued.
+		if err := stream.Send(registrationMsg); err != nil {
+			r.addDrainedTasks()
+			return false, status.UnavailableErrorf("could not send registration message: %s", err)
+		}
+		taskIDs := r.takeDrainedTasks()
+		if len(taskIDs) == 0 {
+			return false, nil
+		}
+		req := &scpb.RegisterAndStreamWorkRequest{
+			DrainingRequest: &scpb.DrainingRequest{TaskId: taskIDs},
+		}
+		if err := stream.Send(req); err != nil {
+			r.addDrainedTasks(taskIDs...)
+			return false, status.UnavailableErrorf("could not send drained tasks: %s", err)
+		}
 	case err := <-schedulerErr:
 		return false, status.WrapError(err, "failed to receive message from scheduler")
 	case <-registrationTicker.C:
@@ -155,10 +239,7 @@ func (r *Registration) processWorkStream(ctx context.Context, stream scpb.Schedu
 // maintainRegistrationAndStreamWork maintains registration with a scheduler server using the newer
 // RegisterAndStreamWork API which supports both registration and task reservations.
 func (r *Registration) maintainRegistrationAndStreamWork(ctx context.Context) {
-	registrationMsg := &scpb.RegisterAndStreamWorkRequest{
-		RegisterExecutorRequest: &scpb.RegisterExecutorRequest{Node: r.node},
-	}
-
+	defer close(r.stopped)
 	defer r.setConnected(false)
 
 	registrationTicker := time.NewTicker(schedulerCheckInInterval)
@@ -173,6 +254,9 @@ func (r *Registration) maintainRegistrationAndStreamWork(ctx context.Context) {
 			}
 			continue
 		}
+		registrationMsg := &scpb.RegisterAndStreamWorkRequest{
+			RegisterExecutorRequest: &scpb.RegisterExecutorRequest{Node: r.getNode()},
+		}
 		if err := stream.Send(registrationMsg); err != nil {
 			log.Errorf("error registering node with scheduler: %s, will retry...", err)
 			continue
@@ -228,14 +312,95 @@ func (r *Registration) Start(ctx context.Context) {
 	}()
 }
 
+// Drain gracefully takes the executor out of service, so that it can be
+// restarted without failing in-flight actions.
+//
+// The scheduler is told that the executor is draining, so that it stops
+// sending it task reservations, and the queued task reservations are handed
+// back to be re-enqueued on other executors. Running tasks are given until
+// the context is done to finish, after which they're cancelled and retried
+// elsewhere. Once they have exited, the file cache stats are flushed and the
+// executor deregisters from the scheduler, which also makes it report that
+// it's not ready.
+func (r *Registration) Drain(ctx context.Context) error {
+	r.mu.Lock()
+	if r.draining {
+		r.mu.Unlock()
+		return status.FailedPreconditionError("executor is already draining")
+	}
+	r.draining = true
+	r.node = r.node.CloneVT()
+	r.node.Draining = true
+	r.mu.Unlock()
+	r.addDrainedTasks()
+
+	var taskIDs []string
+	for _, reservation := range r.taskScheduler.Drain(ctx) {
+		taskIDs = append(taskIDs, reservation.GetTaskId())
+	}
+	r.addDrainedTasks(taskIDs...)
+
+	if fc := r.env.GetFileCache(); fc != nil {
+		fc.FlushStats()
+	}
+
+	log.Info("Executor drained, deregistering from the scheduler.")
+	r.signalShutdown()
+	select {
+	case <-r.stopped:
+		return nil
+	case <-time.After(deregistrationTimeout):
+		return status.DeadlineExceededError("timed out deregistering from the scheduler")
+	}
+}
+
+// UpdateNode re-reads the executor's pool name and allocated resources, for
+// example after the config is reloaded, and immediately re-registers with the
+// scheduler if they changed. The executor keeps its ID, so its running tasks,
+// runners, and file cache are unaffected.
+func (r *Registration) UpdateNode() error {
+	poolName, err := getPoolName()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	old := r.node
+	r.mu.Unlock()
+	node, err := makeExecutionNode(poolName, old.GetExecutorId(), old.GetExecutorHostId(), r.options)
+	if err != nil {
+		return status.InternalErrorf("Error determining node properties: %s", err)
+	}
+
+	r.mu.Lock()
+	node.Draining = r.draining
+	if node.EqualVT(r.node) {
+		r.mu.Unlock()
+		return nil
+	}
+	r.node = node
+	r.mu.Unlock()
+	log.Infof("Executor registration changed, re-registering with the scheduler (pool: %q, milliCPU: %d, memory bytes: %d)", node.GetPool(), node.GetAssignableMilliCpu(), node.GetAssignableMemoryBytes())
+	// Wake up the registration loop to send the new registration.
+	r.addDrainedTasks()
+	return nil
+}
+
+func getPoolName() (string, error) {
+	if *pool == "" {
+		return resources.GetPoolName(), nil
+	}
+	if resources.GetPoolName() != "" {
+		return "", status.InvalidArgumentError("Only one of the `MY_POOL` environment variable and `executor.pool` config option may be set")
+	}
+	return *pool, nil
+}
+
 // NewRegistration creates a handle to maintain registration with a scheduler server.
 // The registration is not initiated until Start is called on the returned handle.
 func NewRegistration(env environment.Env, taskScheduler *priority_task_scheduler.PriorityTaskScheduler, executorID, executorHostID string, options *Options) (*Registration, error) {
-	poolName := *pool
-	if poolName == "" {
-		poolName = resources.GetPoolName()
-	} else if resources.GetPoolName() != "" {
-		log.Fatal("Only one of the `MY_POOL` environment variable and `executor.pool` config option may be set")
+	poolName, err := getPoolName()
+	if err != nil {
+		log.Fatal(status.Message(err))
 	}
 	node, err := makeExecutionNode(poolName, executorID, executorHostID, options)
 	if err != nil {
@@ -246,19 +411,21 @@ func NewRegistration(env environment.Env, taskScheduler *priority_task_scheduler
 		apiKey = options.APIKeyOverride
 	}
 
-	shutdownSignal := make(chan struct{})
-	env.GetHealthChecker().RegisterShutdownFunction(func(ctx context.Context) error {
-		close(shutdownSignal)
-		return nil
-	})
-
 	registration := &Registration{
+		env:             env,
 		schedulerClient: env.GetSchedulerClient(),
 		taskScheduler:   taskScheduler,
 		node:            node,
 		apiKey:          apiKey,
-		shutdownSignal:  shutdownSignal,
+		options:         options,
+		shutdownSignal:  make(chan struct{}),
+		stopped:         make(chan struct{}),
+		drainSignal:     make(chan struct{}, 1),
 	}
+	env.GetHealthChecker().RegisterShutdownFunction(func(ctx context.Context) error {
+		registration.signalShutdown()
+		return nil
+	})
 	env.GetHealthChecker().AddHealthCheck("registered_to_scheduler", registration)
 	return registration, nil
 }
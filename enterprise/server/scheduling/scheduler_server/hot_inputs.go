@@ -0,0 +1,93 @@
+package scheduler_server
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/go-redis/redis/v8"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+)
+
+var (
+	enableHotInputHints = flag.Bool("remote_execution.enable_hot_input_hints", false, "If true, the scheduler records which inputs each task read (when reported by the executor) and hints them to executors leasing similar tasks, so that they can be prefetched before the task runs.")
+	maxHotInputs        = flag.Int("remote_execution.max_hot_inputs", 1000, "The maximum number of hot inputs hinted for each task. The inputs that were read first are kept.")
+)
+
+const (
+	// How long the inputs read by a task are kept. Each run of a similar task
+	// replaces them.
+	hotInputsExpiration = 3 * 24 * time.Hour
+
+	hotInputsRedisKeyPrefix = "hotInputs"
+)
+
+// hotInputsKeyForTask returns the Redis key holding the inputs read by earlier
+// runs of tasks that are similar to the given task, or "" if hot input hints
+// are disabled.
+//
+// Tasks are similar if they're owned by the same group and run the same
+// command. Inputs can differ, which is the common case for actions like
+// compiles, whose inputs change from build to build while most of the headers
+// and tools that they read stay the same.
+func hotInputsKeyForTask(task *persistedTask) string {
+	if !*enableHotInputHints {
+		return ""
+	}
+	execTask := &repb.ExecutionTask{}
+	if err := proto.Unmarshal(task.serializedTask, execTask); err != nil {
+		log.Warningf("Could not unmarshal task %q to compute its hot inputs: %s", task.taskID, err)
+		return ""
+	}
+	b, err := proto.Marshal(execTask.GetCommand())
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s/%x", hotInputsRedisKeyPrefix, task.metadata.GetTaskGroupId(), sha256.Sum256(b))
+}
+
+// getHotInputs returns the inputs stored under the given key. Hints are
+// best-effort, so errors are logged rather than returned.
+func (s *SchedulerServer) getHotInputs(ctx context.Context, key string) []*scpb.TaskInput {
+	if key == "" || s.rdb == nil {
+		return nil
+	}
+	b, err := s.rdb.Get(ctx, key).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			log.CtxWarningf(ctx, "Could not read hot inputs: %s", err)
+		}
+		return nil
+	}
+	profile := &scpb.TaskInputProfile{}
+	if err := proto.Unmarshal(b, profile); err != nil {
+		log.CtxWarningf(ctx, "Could not unmarshal hot inputs: %s", err)
+		return nil
+	}
+	return profile.GetInputs()
+}
+
+// recordAccessedInputs stores the inputs that a task read under the given
+// key, replacing the inputs read by earlier runs of similar tasks.
+func (s *SchedulerServer) recordAccessedInputs(ctx context.Context, key string, inputs []*scpb.TaskInput) {
+	if key == "" || s.rdb == nil || len(inputs) == 0 {
+		return
+	}
+	if len(inputs) > *maxHotInputs {
+		inputs = inputs[:*maxHotInputs]
+	}
+	b, err := proto.Marshal(&scpb.TaskInputProfile{Inputs: inputs})
+	if err != nil {
+		log.CtxWarningf(ctx, "Could not marshal accessed inputs: %s", err)
+		return
+	}
+	if err := s.rdb.Set(ctx, key, b, hotInputsExpiration).Err(); err != nil {
+		log.CtxWarningf(ctx, "Could not record accessed inputs: %s", err)
+	}
+}
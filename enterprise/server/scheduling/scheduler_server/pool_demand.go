@@ -0,0 +1,247 @@
+package scheduler_server
+
+import (
+	"context"
+	"math/rand"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/util/authutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+)
+
+var (
+	poolDemandMetricsInterval = flag.Duration("remote_execution.pool_demand_metrics_interval", 0, "How often to export demand metrics (queued task count, age, and size) for the executor pools that have executors connected to this scheduler, for use by executor autoscalers. If 0, the metrics aren't exported.")
+)
+
+const (
+	// The maximum number of queued tasks whose sizes are read to estimate the
+	// total size of a pool's queued tasks.
+	poolDemandTaskSizeSampleCount = 500
+)
+
+// GetPoolDemand reports demand for each of the group's executor pools.
+func (s *SchedulerServer) GetPoolDemand(ctx context.Context, req *scpb.GetPoolDemandRequest) (*scpb.GetPoolDemandResponse, error) {
+	groupID := req.GetRequestContext().GetGroupId()
+	if err := authutil.AuthorizeGroupAccess(ctx, s.env, groupID); err != nil {
+		return nil, err
+	}
+	user, err := s.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// If executor auth is not enabled, executors do not belong to any group.
+	if !s.requireExecutorAuthorization {
+		groupID = ""
+	}
+	poolKeys, err := s.rdb.SMembers(ctx, s.redisKeyForExecutorPools(groupID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	rsp := &scpb.GetPoolDemandResponse{}
+	for _, k := range poolKeys {
+		executors, err := s.rdb.HGetAll(ctx, k).Result()
+		if err != nil {
+			return nil, err
+		}
+		var key *nodePoolKey
+		demand := &scpb.PoolDemand{}
+		for _, data := range executors {
+			registeredNode := &scpb.RegisteredExecutionNode{}
+			if err := proto.Unmarshal([]byte(data), registeredNode); err != nil {
+				return nil, err
+			}
+			if err := perms.AuthorizeRead(user, registeredNode.GetAcl()); err != nil {
+				continue
+			}
+			if time.Since(registeredNode.GetLastPingTime().AsTime()) > executorMaxRegistrationStaleness {
+				continue
+			}
+			node := registeredNode.GetRegistration()
+			if key == nil {
+				key = &nodePoolKey{os: node.GetOs(), arch: node.GetArch(), pool: node.GetPool()}
+				if s.enableUserOwnedExecutors {
+					key.groupID = registeredNode.GetGroupId()
+				}
+				demand.Os = key.os
+				demand.Arch = key.arch
+				demand.Pool = key.pool
+			}
+			demand.ExecutorCount++
+			demand.AssignableMilliCpu += node.GetAssignableMilliCpu()
+			demand.AssignableMemoryBytes += node.GetAssignableMemoryBytes()
+		}
+		if key == nil {
+			continue
+		}
+		if err := s.addQueuedDemand(ctx, *key, demand); err != nil {
+			return nil, err
+		}
+		rsp.Pool = append(rsp.Pool, demand)
+	}
+	slices.SortFunc(rsp.Pool, func(a, b *scpb.PoolDemand) int {
+		return strings.Compare(a.GetOs()+"/"+a.GetArch()+"/"+a.GetPool(), b.GetOs()+"/"+b.GetArch()+"/"+b.GetPool())
+	})
+	return rsp, nil
+}
+
+// addQueuedDemand fills in the demand for the pool's unclaimed tasks.
+func (s *SchedulerServer) addQueuedDemand(ctx context.Context, key nodePoolKey, demand *scpb.PoolDemand) error {
+	// Unclaimed tasks are scored by the time they were queued, so they're
+	// returned oldest first.
+	unclaimed, err := s.rdb.ZRangeWithScores(ctx, key.redisUnclaimedTasksKey(), 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	demand.QueuedTaskCount = int64(len(unclaimed))
+	if len(unclaimed) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	taskIDs := make([]string, 0, len(unclaimed))
+	ages := make([]time.Duration, 0, len(unclaimed))
+	for i := len(unclaimed) - 1; i >= 0; i-- {
+		if id, ok := unclaimed[i].Member.(string); ok {
+			taskIDs = append(taskIDs, id)
+		}
+		ages = append(ages, max(now.Sub(time.Unix(int64(unclaimed[i].Score), 0)), 0))
+	}
+	// ages is sorted from youngest to oldest.
+	demand.QueuedTaskAgeP50 = durationpb.New(percentile(ages, 50))
+	demand.QueuedTaskAgeP90 = durationpb.New(percentile(ages, 90))
+	demand.QueuedTaskAgeP99 = durationpb.New(percentile(ages, 99))
+	demand.QueuedTaskAgeMax = durationpb.New(ages[len(ages)-1])
+
+	milliCPU, memoryBytes, err := s.estimateQueuedTaskSize(ctx, taskIDs)
+	if err != nil {
+		return err
+	}
+	demand.QueuedMilliCpu = milliCPU
+	demand.QueuedMemoryBytes = memoryBytes
+	return nil
+}
+
+// percentile returns the p-th percentile of the sorted durations, using the
+// nearest-rank method.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	return sorted[max(rank-1, 0)]
+}
+
+// estimateQueuedTaskSize returns the total estimated size of the given tasks,
+// extrapolated from a random sample of them.
+func (s *SchedulerServer) estimateQueuedTaskSize(ctx context.Context, taskIDs []string) (milliCPU, memoryBytes int64, err error) {
+	sample := slices.Clone(taskIDs)
+	rand.Shuffle(len(sample), func(i, j int) {
+		sample[i], sample[j] = sample[j], sample[i]
+	})
+	sample = sample[:min(len(sample), poolDemandTaskSizeSampleCount)]
+
+	pipe := s.rdb.Pipeline()
+	cmds := make([]*redis.StringCmd, 0, len(sample))
+	for _, id := range sample {
+		cmds = append(cmds, pipe.HGet(ctx, s.redisKeyForTask(id), redisTaskMetadataField))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return 0, 0, status.InternalErrorf("could not read queued tasks: %s", err)
+	}
+
+	found := int64(0)
+	for _, cmd := range cmds {
+		// Tasks may have been claimed and completed since they were listed.
+		b, err := cmd.Bytes()
+		if err != nil {
+			continue
+		}
+		md := &scpb.SchedulingMetadata{}
+		if err := proto.Unmarshal(b, md); err != nil {
+			continue
+		}
+		found++
+		milliCPU += md.GetTaskSize().GetEstimatedMilliCpu()
+		memoryBytes += md.GetTaskSize().GetEstimatedMemoryBytes()
+	}
+	if found == 0 {
+		return 0, 0, nil
+	}
+	n := int64(len(taskIDs))
+	return milliCPU * n / found, memoryBytes * n / found, nil
+}
+
+// exportPoolDemandMetrics periodically exports demand metrics for the pools
+// that have executors connected to this scheduler, until the server shuts
+// down.
+func (s *SchedulerServer) exportPoolDemandMetrics() {
+	exported := map[nodePoolKey]struct{}{}
+	for {
+		select {
+		case <-s.shuttingDown:
+			return
+		case <-s.clock.After(*poolDemandMetricsInterval):
+		}
+
+		s.mu.RLock()
+		var pools []*nodePool
+		for _, np := range s.pools {
+			pools = append(pools, np)
+		}
+		s.mu.RUnlock()
+
+		current := map[nodePoolKey]struct{}{}
+		for _, np := range pools {
+			if len(np.GetNodes(true /*=connectedOnly*/)) == 0 {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), *poolDemandMetricsInterval)
+			demand := &scpb.PoolDemand{}
+			err := s.addQueuedDemand(ctx, np.key, demand)
+			cancel()
+			if err != nil {
+				log.Warningf("Could not compute demand for pool %+v: %s", np.key, err)
+				continue
+			}
+			current[np.key] = struct{}{}
+			labels := poolDemandMetricLabels(np.key)
+			metrics.RemoteExecutionPoolQueuedTaskCount.With(labels).Set(float64(demand.GetQueuedTaskCount()))
+			metrics.RemoteExecutionPoolQueuedTaskMaxAgeSeconds.With(labels).Set(demand.GetQueuedTaskAgeMax().AsDuration().Seconds())
+			metrics.RemoteExecutionPoolQueuedMilliCPU.With(labels).Set(float64(demand.GetQueuedMilliCpu()))
+			metrics.RemoteExecutionPoolQueuedMemoryBytes.With(labels).Set(float64(demand.GetQueuedMemoryBytes()))
+		}
+		// Stop exporting pools whose executors have all disconnected, so that
+		// their last values don't keep driving autoscaling.
+		for key := range exported {
+			if _, ok := current[key]; ok {
+				continue
+			}
+			labels := poolDemandMetricLabels(key)
+			metrics.RemoteExecutionPoolQueuedTaskCount.Delete(labels)
+			metrics.RemoteExecutionPoolQueuedTaskMaxAgeSeconds.Delete(labels)
+			metrics.RemoteExecutionPoolQueuedMilliCPU.Delete(labels)
+			metrics.RemoteExecutionPoolQueuedMemoryBytes.Delete(labels)
+		}
+		exported = current
+	}
+}
+
+func poolDemandMetricLabels(key nodePoolKey) prometheus.Labels {
+	return prometheus.Labels{
+		metrics.GroupID: key.groupID,
+		metrics.OS:      key.os,
+		metrics.Arch:    key.arch,
+		metrics.Pool:    key.pool,
+	}
+}
@@ -0,0 +1,205 @@
+package scheduler_server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	alpb "github.com/buildbuddy-io/buildbuddy/proto/auditlog"
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+	gstatus "google.golang.org/grpc/status"
+)
+
+var (
+	queueTimeSLOs              = flag.Slice("remote_execution.queue_time_slos", []QueueTimeSLO{}, "Per-group queue-time budgets. While a group's pool has had a task queued for longer than the group's budget, the group's new tasks are scheduled on the first of its borrow pools that is within budget.")
+	loadSheddingMaxQueuedTasks = flag.Int64("remote_execution.load_shedding_max_queued_tasks", 0, "If set, new tasks are rejected with RESOURCE_EXHAUSTED when their pool, and every pool they could borrow capacity from, have at least this many unclaimed tasks. If 0, tasks are never shed.")
+	loadSheddingRetryDelay     = flag.Duration("remote_execution.load_shedding_retry_delay", 30*time.Second, "How long clients are asked to wait before retrying tasks that were shed.")
+)
+
+// QueueTimeSLO configures how long a group's tasks may be queued before the
+// group borrows capacity from other pools.
+type QueueTimeSLO struct {
+	GroupID     string        `yaml:"group_id" json:"group_id" usage:"The group whose tasks the budget applies to."`
+	Budget      time.Duration `yaml:"budget" json:"budget" usage:"How long the group's tasks may be queued before they're scheduled on a borrow pool."`
+	BorrowPools []string      `yaml:"borrow_pools" json:"borrow_pools" usage:"Pools, in order of preference, that the group's tasks may be scheduled on while their own pool is over budget. These are usually lower-priority pools with the same OS and arch."`
+}
+
+// How many of a pool's oldest unclaimed tasks are checked when measuring its
+// queue time. Tasks that are cancelled before being claimed stay in the
+// unclaimed list until they're trimmed, so they're skipped.
+const queueTimeOldestTasksChecked = 10
+
+// Metric labels for each queue-time SLO decision.
+var queueTimeSLODecisionLabels = map[scpb.QueueTimeSLODecision_Decision]string{
+	scpb.QueueTimeSLODecision_BORROWED:    "borrowed",
+	scpb.QueueTimeSLODecision_OVER_BUDGET: "over_budget",
+	scpb.QueueTimeSLODecision_SHED:        "shed",
+}
+
+// poolLoad describes the unclaimed tasks in a pool.
+type poolLoad struct {
+	queuedTaskCount int64
+	// How long the oldest unclaimed task has been queued.
+	queueTime time.Duration
+}
+
+func (l *poolLoad) saturated() bool {
+	return *loadSheddingMaxQueuedTasks > 0 && l.queuedTaskCount >= *loadSheddingMaxQueuedTasks
+}
+
+func findQueueTimeSLO(groupID string) (QueueTimeSLO, bool) {
+	if groupID == "" {
+		return QueueTimeSLO{}, false
+	}
+	for _, slo := range *queueTimeSLOs {
+		if slo.GroupID == groupID {
+			return slo, true
+		}
+	}
+	return QueueTimeSLO{}, false
+}
+
+func (s *SchedulerServer) getPoolLoad(ctx context.Context, key nodePoolKey) (*poolLoad, error) {
+	unclaimedKey := key.redisUnclaimedTasksKey()
+	pipe := s.rdb.Pipeline()
+	countCmd := pipe.ZCard(ctx, unclaimedKey)
+	oldestCmd := pipe.ZRangeWithScores(ctx, unclaimedKey, 0, queueTimeOldestTasksChecked-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	oldest := oldestCmd.Val()
+	if len(oldest) == 0 {
+		return &poolLoad{queuedTaskCount: countCmd.Val()}, nil
+	}
+
+	pipe = s.rdb.Pipeline()
+	existsCmds := make([]*redis.IntCmd, 0, len(oldest))
+	for _, z := range oldest {
+		id, _ := z.Member.(string)
+		existsCmds = append(existsCmds, pipe.Exists(ctx, s.redisKeyForTask(id)))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	load := &poolLoad{queuedTaskCount: countCmd.Val()}
+	for i, cmd := range existsCmds {
+		if cmd.Val() == 0 {
+			continue
+		}
+		load.queueTime = max(time.Since(time.Unix(int64(oldest[i].Score), 0)), 0)
+		break
+	}
+	return load, nil
+}
+
+// applyQueueTimeSLO decides where a new task is scheduled based on its
+// group's queue-time budget and the load on the pools it could run on. The
+// task is moved to a borrow pool by updating its metadata, or rejected with
+// a RESOURCE_EXHAUSTED error if it should be shed.
+//
+// Load can't always be measured, such as when Redis is slow, so errors
+// measuring it are logged and the task is scheduled as requested.
+func (s *SchedulerServer) applyQueueTimeSLO(ctx context.Context, taskID string, metadata *scpb.SchedulingMetadata) error {
+	slo, hasSLO := findQueueTimeSLO(metadata.GetTaskGroupId())
+	if !hasSLO && *loadSheddingMaxQueuedTasks <= 0 {
+		return nil
+	}
+	key := nodePoolKey{
+		os:      metadata.GetOs(),
+		arch:    metadata.GetArch(),
+		pool:    metadata.GetPool(),
+		groupID: metadata.GetExecutorGroupId(),
+	}
+	load, err := s.getPoolLoad(ctx, key)
+	if err != nil {
+		log.CtxWarningf(ctx, "Could not measure load of pool %+v: %s", key, err)
+		return nil
+	}
+	overBudget := hasSLO && load.queueTime > slo.Budget
+	if !overBudget && !load.saturated() {
+		return nil
+	}
+
+	if hasSLO {
+		for _, pool := range slo.BorrowPools {
+			if pool == key.pool {
+				continue
+			}
+			borrowKey := key
+			borrowKey.pool = pool
+			if n, err := s.getOrCreatePool(borrowKey).NodeCount(ctx, metadata.GetTaskSize()); err != nil || n == 0 {
+				continue
+			}
+			borrowLoad, err := s.getPoolLoad(ctx, borrowKey)
+			if err != nil {
+				log.CtxWarningf(ctx, "Could not measure load of pool %+v: %s", borrowKey, err)
+				continue
+			}
+			if borrowLoad.queueTime > slo.Budget || borrowLoad.saturated() {
+				continue
+			}
+			log.CtxInfof(ctx, "Queue-time SLO: group %q has waited %s in pool %q (budget %s, %d queued tasks), scheduling on pool %q", slo.GroupID, load.queueTime, key.pool, slo.Budget, load.queuedTaskCount, pool)
+			s.recordQueueTimeSLODecision(ctx, taskID, metadata, pool, load, slo, scpb.QueueTimeSLODecision_BORROWED)
+			metadata.Pool = pool
+			return nil
+		}
+	}
+
+	if load.saturated() {
+		log.CtxInfof(ctx, "Queue-time SLO: shedding task for group %q, pool %q and its borrow pools are saturated (%d queued tasks, oldest queued %s ago)", metadata.GetTaskGroupId(), key.pool, load.queuedTaskCount, load.queueTime)
+		s.recordQueueTimeSLODecision(ctx, taskID, metadata, "" /*=scheduledPool*/, load, slo, scpb.QueueTimeSLODecision_SHED)
+		return loadShedError(key.pool)
+	}
+	log.CtxInfof(ctx, "Queue-time SLO: group %q has waited %s in pool %q (budget %s), but no borrow pool has capacity", slo.GroupID, load.queueTime, key.pool, slo.Budget)
+	s.recordQueueTimeSLODecision(ctx, taskID, metadata, key.pool, load, slo, scpb.QueueTimeSLODecision_OVER_BUDGET)
+	return nil
+}
+
+// recordQueueTimeSLODecision records a decision in metrics and in the group's
+// audit log. scheduledPool is empty if the task was shed.
+func (s *SchedulerServer) recordQueueTimeSLODecision(ctx context.Context, taskID string, metadata *scpb.SchedulingMetadata, scheduledPool string, load *poolLoad, slo QueueTimeSLO, decision scpb.QueueTimeSLODecision_Decision) {
+	metrics.RemoteExecutionQueueTimeSLODecisionCount.With(prometheus.Labels{
+		metrics.GroupID:                   metadata.GetTaskGroupId(),
+		metrics.Pool:                      metadata.GetPool(),
+		metrics.QueueTimeSLODecisionLabel: queueTimeSLODecisionLabels[decision],
+	}).Inc()
+
+	al := s.env.GetAuditLogger()
+	if al == nil || metadata.GetTaskGroupId() == "" {
+		return
+	}
+	d := &scpb.QueueTimeSLODecision{
+		Decision:        decision,
+		TaskId:          taskID,
+		RequestedPool:   metadata.GetPool(),
+		ScheduledPool:   scheduledPool,
+		QueuedTaskCount: load.queuedTaskCount,
+		QueueTime:       durationpb.New(load.queueTime),
+	}
+	if slo.GroupID != "" {
+		d.Budget = durationpb.New(slo.Budget)
+	}
+	al.LogForGroup(ctx, metadata.GetTaskGroupId(), alpb.Action_QUEUE_TIME_SLO_DECISION, d)
+}
+
+func loadShedError(pool string) error {
+	delay := *loadSheddingRetryDelay
+	msg := fmt.Sprintf("Executor pool %q is saturated. Retry after %s.", pool, delay)
+	st, err := gstatus.New(codes.ResourceExhausted, msg).WithDetails(&errdetails.RetryInfo{
+		RetryDelay: durationpb.New(delay),
+	})
+	if err != nil {
+		return status.ResourceExhaustedError(msg)
+	}
+	return st.Err()
+}
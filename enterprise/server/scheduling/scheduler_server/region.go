@@ -0,0 +1,79 @@
+package scheduler_server
+
+import (
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/prometheus/client_golang/prometheus"
+
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+)
+
+var (
+	appRegion                  = flag.String("remote_execution.region", "", "The region that the app (and its cache) is running in, such as us-west1. If set, tasks are scheduled on executors in the same region (see executor.region) in preference to executors in other regions.")
+	crossRegionSchedulingDelay = flag.Duration("remote_execution.cross_region_scheduling_delay", 0, "If remote_execution.region is set, task reservations enqueued on executors in other regions are delayed by this much when a reservation was also enqueued on an executor in the app's region, so that executors in the app's region get a chance to run the task first.")
+)
+
+const (
+	sameRegionLocality    = "same_region"
+	crossRegionLocality   = "cross_region"
+	unknownRegionLocality = "unknown"
+)
+
+// inAppRegion returns whether the node is in the same region as the app. If
+// the app's region isn't configured, all nodes are considered to be in it.
+func inAppRegion(node *scpb.ExecutionNode) bool {
+	return *appRegion == "" || strings.EqualFold(node.GetRegion(), *appRegion)
+}
+
+// preferAppRegion moves the nodes that are in other regions than the app to
+// the end of the ranking, preserving the relative order of the nodes in each
+// group. Executors in other regions are only used once there aren't enough
+// executors in the app's region.
+func preferAppRegion(nodes []interfaces.RankedExecutionNode) []interfaces.RankedExecutionNode {
+	if *appRegion == "" {
+		return nodes
+	}
+	out := make([]interfaces.RankedExecutionNode, 0, len(nodes))
+	var crossRegion []interfaces.RankedExecutionNode
+	for _, node := range nodes {
+		if inAppRegion(node.GetExecutionNode().(*executionNode).ExecutionNode) {
+			out = append(out, node)
+		} else {
+			crossRegion = append(crossRegion, node)
+		}
+	}
+	return append(out, crossRegion...)
+}
+
+// getCrossRegionSchedulingDelay returns the delay that should be applied to
+// a task reservation enqueued on the given node, given whether a reservation
+// was already enqueued on a node in the app's region.
+func getCrossRegionSchedulingDelay(node *scpb.ExecutionNode, scheduledInAppRegion bool) time.Duration {
+	if !scheduledInAppRegion || inAppRegion(node) {
+		return 0
+	}
+	return *crossRegionSchedulingDelay
+}
+
+// recordRegionLocality records whether a task was claimed by an executor in
+// the app's region. node is nil if the executor is unknown.
+func recordRegionLocality(pool string, node *scpb.ExecutionNode) {
+	if *appRegion == "" {
+		return
+	}
+	locality := unknownRegionLocality
+	if node.GetRegion() != "" {
+		locality = crossRegionLocality
+		if inAppRegion(node) {
+			locality = sameRegionLocality
+		}
+	}
+	metrics.RemoteExecutionRegionLocalityCount.With(prometheus.Labels{
+		metrics.Pool:                pool,
+		metrics.RegionLocalityLabel: locality,
+	}).Inc()
+}
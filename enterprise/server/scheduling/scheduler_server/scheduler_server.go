@@ -2,10 +2,13 @@ package scheduler_server
 
 import (
 	"context"
-	"flag"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"math/rand"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -20,11 +23,13 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
 	"github.com/buildbuddy-io/buildbuddy/server/resources"
 	"github.com/buildbuddy-io/buildbuddy/server/util/background"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
 	"github.com/buildbuddy-io/buildbuddy/server/util/grpc_client"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
 	"github.com/buildbuddy-io/buildbuddy/server/util/random"
+	"github.com/buildbuddy-io/buildbuddy/server/util/spiffe"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/tracing"
 	"github.com/go-redis/redis/v8"
@@ -51,8 +56,38 @@ var (
 	leaseGracePeriod             = flag.Duration("remote_execution.lease_grace_period", 10*time.Second, "How long to wait for the executor to renew the lease after the TTL duration has elapsed.")
 	leaseReconnectGracePeriod    = flag.Duration("remote_execution.lease_reconnect_grace_period", 1*time.Second, "How long to delay re-enqueued tasks in order to allow the previous lease holder to renew its lease (following a server shutdown).")
 	maxSchedulingDelay           = flag.Duration("remote_execution.max_scheduling_delay", 5*time.Second, "Max duration that actions can sit in a non-preferred executor's queue before they are executed.")
+	maxTaskAttempts              = flag.Int64("remote_execution.max_task_attempts", 5, "The maximum number of times a task may be attempted, including retries after executor failures, before it is failed.")
+	taskRetryInitialBackoff      = flag.Duration("remote_execution.task_retry_initial_backoff", 0, "How long to delay the first retry of a task after it fails on an executor. Each subsequent retry of the task is delayed twice as long as the last, up to remote_execution.task_retry_max_backoff. If 0, retries aren't delayed.")
+	taskRetryMaxBackoff          = flag.Duration("remote_execution.task_retry_max_backoff", 1*time.Minute, "The maximum delay before retrying a task after it fails on an executor.")
+	priorityLanes                = flag.Slice("remote_execution.priority_lanes", defaultPriorityLanes, "Priority lanes that tasks can be queued in using the priority-lane platform property. Executors dequeue from each group's lanes in proportion to the lanes' weights. Tasks without a lane, or with an unknown lane, are queued in the default lane.")
+	executorIdentityRules        = flag.Slice("remote_execution.executor_identity_rules", []ExecutorIdentityRule{}, "Rules that bind the SPIFFE IDs of executors, from their mTLS client certificates, to the executor pools they may register in. If any rules are set, an executor with a SPIFFE ID can only register in the pools of the rules matching its ID.")
+	requireExecutorIdentity      = flag.Bool("remote_execution.require_executor_identity", false, "If true, executors must present an mTLS client certificate with a SPIFFE ID in order to register and lease tasks.")
 )
 
+// ExecutorIdentityRule allows executors with matching SPIFFE IDs to register
+// in a set of pools.
+type ExecutorIdentityRule struct {
+	SPIFFEID string   `yaml:"spiffe_id" json:"spiffe_id" usage:"Pattern that the executor's SPIFFE ID must match, using path.Match syntax. Ex: 'spiffe://buildbuddy.example.com/group/GR123/executor/*'."`
+	Pools    []string `yaml:"pools" json:"pools" usage:"The executor pools that matching executors may register in. The default pool is named ''."`
+}
+
+// Executor IDs become a segment of the SPIFFE ID in issued certificates, so
+// they may not contain slashes.
+var executorIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// PriorityLane configures a lane that tasks can be queued in using the
+// priority-lane platform property.
+type PriorityLane struct {
+	Name   string `yaml:"name" json:"name" usage:"The lane name, matched case-insensitively against the priority-lane platform property."`
+	Weight int32  `yaml:"weight" json:"weight" usage:"The lane's share of each executor's capacity, relative to the other lanes with queued tasks from the same group."`
+}
+
+var defaultPriorityLanes = []PriorityLane{
+	{Name: "interactive", Weight: 8},
+	{Name: defaultPriorityLaneName, Weight: 4},
+	{Name: "batch", Weight: 1},
+}
+
 const (
 	// This number controls how many reservations the scheduler will
 	// enqueue (across executor nodes) for each task. Typically this
@@ -71,9 +106,6 @@ const (
 	// this amount of time.
 	executorMaxRegistrationStaleness = 10 * time.Minute
 
-	// The maximum number of times a task may be re-enqueued.
-	maxTaskAttemptCount = 5
-
 	// The maximum number of times the scheduler will attempt to enqueue a
 	// single task across the entire executor pool.
 	maxAttemptedEnqueueCount = 100
@@ -90,6 +122,8 @@ const (
 	redisTaskQueuedAtUsec     = "queuedAtUsec"
 	redisTaskAttempCountField = "attemptCount"
 	redisTaskClaimedField     = "claimed"
+	// Comma-separated IDs of the executors that claimed the task, in order.
+	redisTaskAttemptedExecutorIDsField = "attemptedExecutorIds"
 
 	// Maximum number of unclaimed task IDs we track per pool.
 	maxUnclaimedTasksTracked = 10_000
@@ -114,8 +148,13 @@ const (
 
 	// Platform property value corresponding with the darwin (Mac) operating system.
 	darwinOperatingSystemName = "darwin"
+	// Platform property value corresponding with the windows operating system.
+	windowsOperatingSystemName = "windows"
 
 	defaultSchedulingDelay = 0 * time.Second
+
+	// Lane for tasks that don't request a lane, or request an unknown one.
+	defaultPriorityLaneName = "default"
 )
 
 var (
@@ -172,6 +211,15 @@ var (
 		end
 		if isNewAttempt then
 			redis.call("hincrby", KEYS[1], "attemptCount", 1)
+			if ARGV[5] ~= "" then
+				local attempted = redis.call("hget", KEYS[1], "attemptedExecutorIds")
+				if attempted and attempted ~= "" then
+					attempted = attempted .. "," .. ARGV[5]
+				else
+					attempted = ARGV[5]
+				end
+				redis.call("hset", KEYS[1], "attemptedExecutorIds", attempted)
+			end
 		end
 		redis.call("hset", KEYS[1], "leaseId", ARGV[4])	
 
@@ -255,10 +303,16 @@ func (h *executorHandle) authorize(ctx context.Context) (string, error) {
 	if !h.requireAuthorization {
 		return "", nil
 	}
+	return authorizeExecutor(ctx, h.env)
+}
+
+// authorizeExecutor checks that the request has an API key with the executor
+// registration capability, and returns the key's group ID.
+func authorizeExecutor(ctx context.Context, env environment.Env) (string, error) {
 	// We intentionally use AuthenticateGRPCRequest instead of AuthenticatedUser to ensure that we refresh the
 	// credentials to handle the case where the API key is deleted (or capabilities are updated) after the stream was
 	// created.
-	user, err := h.env.GetAuthenticator().AuthenticateGRPCRequest(ctx)
+	user, err := env.GetAuthenticator().AuthenticateGRPCRequest(ctx)
 	if err != nil {
 		return "", err
 	}
@@ -330,6 +384,16 @@ func (h *executorHandle) Serve(ctx context.Context) error {
 			}
 			if req.GetRegisterExecutorRequest() != nil {
 				registration := req.GetRegisterExecutorRequest().GetNode()
+				if prev := h.getRegistration(); prev != nil && !samePool(prev, registration) {
+					// The executor's config was reloaded with a different
+					// pool. Remove it from the old pool so that it no longer
+					// gets tasks from there.
+					log.CtxInfof(ctx, "Executor %q moved from pool %q to %q", executorID, prev.GetPool(), registration.GetPool())
+					removeConnectedExecutor()
+				}
+				if err := h.scheduler.checkExecutorIdentity(ctx, h.GroupID(), registration.GetPool()); err != nil {
+					return err
+				}
 				if err := h.scheduler.AddConnectedExecutor(ctx, h, registration); err != nil {
 					return err
 				}
@@ -337,6 +401,14 @@ func (h *executorHandle) Serve(ctx context.Context) error {
 				executorID = registration.GetExecutorId()
 			} else if req.GetEnqueueTaskReservationResponse() != nil {
 				h.handleTaskReservationResponse(req.GetEnqueueTaskReservationResponse())
+			} else if req.GetDrainingRequest() != nil {
+				for _, taskID := range req.GetDrainingRequest().GetTaskId() {
+					leaseID := ""
+					reconnectToken := ""
+					if err := h.scheduler.reEnqueueTask(ctx, taskID, leaseID, reconnectToken, 1 /*=numReplicas*/, "executor draining"); err != nil {
+						log.CtxWarningf(ctx, "Could not re-enqueue task reservation for draining executor %q: %s", executorID, err)
+					}
+				}
 			} else if req.GetShuttingDownRequest() != nil {
 				log.CtxInfof(ctx, "Executor %q is going away, re-enqueueing %d task reservations", executorID, len(req.GetShuttingDownRequest().GetTaskId()))
 				// Remove the executor first so that we don't try to send any work its way.
@@ -561,6 +633,20 @@ func filterToDebugExecutorID(nodes []*executionNode, task *repb.ExecutionTask) [
 	return nil
 }
 
+// excludeExecutors returns the nodes other than the given executors.
+func excludeExecutors(nodes []*executionNode, executorIDs []string) []*executionNode {
+	if len(executorIDs) == 0 {
+		return nodes
+	}
+	out := make([]*executionNode, 0, len(nodes))
+	for _, n := range nodes {
+		if !slices.Contains(executorIDs, n.GetExecutorId()) {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
 type nodePoolKey struct {
 	groupID string
 	os      string
@@ -625,6 +711,12 @@ func (np *nodePool) fetchExecutionNodes(ctx context.Context) ([]*executionNode,
 			continue
 		}
 
+		// Draining executors are still registered, so that they show up as
+		// draining, but they shouldn't be sent new work.
+		if node.GetRegistration().GetDraining() {
+			continue
+		}
+
 		executors = append(executors, &executionNode{
 			ExecutionNode:     node.GetRegistration(),
 			schedulerHostPort: node.GetSchedulerHostPort(),
@@ -686,11 +778,22 @@ func (np *nodePool) NodeCount(ctx context.Context, taskSize *scpb.TaskSize) (int
 	return fitCount, nil
 }
 
+// AddConnectedExecutor adds the executor to the pool, and returns whether it
+// was newly added. If the executor is already in the pool, its registration
+// is updated, since executors can change their advertised resources when
+// their config is reloaded.
 func (np *nodePool) AddConnectedExecutor(node *scpb.ExecutionNode, handle *executorHandle) bool {
 	np.mu.Lock()
 	defer np.mu.Unlock()
-	for _, e := range np.connectedExecutors {
+	for i, e := range np.connectedExecutors {
 		if e.GetExecutorId() == node.GetExecutorId() {
+			if !e.ExecutionNode.EqualVT(node) {
+				// Replace the slice rather than the element, since callers
+				// may be reading a previously returned slice without the lock.
+				nodes := slices.Clone(np.connectedExecutors)
+				nodes[i] = &executionNode{ExecutionNode: node, handle: e.handle}
+				np.connectedExecutors = nodes
+			}
 			return false
 		}
 	}
@@ -730,6 +833,22 @@ func (np *nodePool) FindConnectedExecutorByID(executorID string) *executionNode
 	return nil
 }
 
+// FindExecutorByID returns the node of the executor with the given ID, which
+// may be connected to this or another scheduler, or nil if it isn't known.
+func (np *nodePool) FindExecutorByID(executorID string) *executionNode {
+	if node := np.FindConnectedExecutorByID(executorID); node != nil {
+		return node
+	}
+	np.mu.Lock()
+	defer np.mu.Unlock()
+	for _, node := range np.nodes {
+		if node.GetExecutorId() == executorID {
+			return node
+		}
+	}
+	return nil
+}
+
 func (np *nodePool) AddUnclaimedTask(ctx context.Context, taskID string) error {
 	ctx, span := tracing.StartSpan(ctx)
 	defer span.End()
@@ -796,6 +915,8 @@ type persistedTask struct {
 	serializedTask  []byte
 	queuedTimestamp time.Time
 	attemptCount    int64
+	// IDs of the executors that claimed the task, in order.
+	attemptedExecutorIDs []string
 }
 
 type schedulerClient struct {
@@ -900,8 +1021,12 @@ type SchedulerServer struct {
 	enableUserOwnedExecutors bool
 	// Force darwin executions to use executors owned by user.
 	forceUserOwnedDarwinExecutors bool
+	// Force windows executions to use executors owned by user.
+	forceUserOwnedWindowsExecutors bool
 	// If enabled, executors will be required to present an API key with appropriate capabilities in order to register.
 	requireExecutorAuthorization bool
+	// If enabled, executors will be required to present a client certificate with a SPIFFE ID.
+	requireExecutorIdentity bool
 
 	enableRedisAvailabilityMonitoring bool
 
@@ -975,15 +1100,33 @@ func NewSchedulerServerWithOptions(env environment.Env, options *Options) (*Sche
 		shuttingDown:                      shuttingDown,
 		enableUserOwnedExecutors:          remote_execution_config.RemoteExecutionEnabled() && scheduler_server_config.UserOwnedExecutorsEnabled(),
 		forceUserOwnedDarwinExecutors:     remote_execution_config.RemoteExecutionEnabled() && scheduler_server_config.ForceUserOwnedDarwinExecutors(),
+		forceUserOwnedWindowsExecutors:    remote_execution_config.RemoteExecutionEnabled() && scheduler_server_config.ForceUserOwnedWindowsExecutors(),
 		requireExecutorAuthorization:      options.RequireExecutorAuthorization || (remote_execution_config.RemoteExecutionEnabled() && *requireExecutorAuthorization),
+		requireExecutorIdentity:           remote_execution_config.RemoteExecutionEnabled() && *requireExecutorIdentity,
 		enableRedisAvailabilityMonitoring: remote_execution_config.RemoteExecutionEnabled() && env.GetRemoteExecutionService().RedisAvailabilityMonitoringEnabled(),
 		ownHostPort:                       fmt.Sprintf("%s:%d", ownHostname, ownPort),
 		actionMergingLeaseTTL:             actionMergingLeaseTTL,
 	}
 	s.schedulerClientCache = newSchedulerClientCache(env, s.ownHostPort, s)
+	if *poolDemandMetricsInterval > 0 {
+		go s.exportPoolDemandMetrics()
+	}
 	return s, nil
 }
 
+// forceUserOwnedExecutors returns whether actions for the given OS must run on
+// user-owned executors.
+func (s *SchedulerServer) forceUserOwnedExecutors(os string) bool {
+	switch os {
+	case darwinOperatingSystemName:
+		return s.forceUserOwnedDarwinExecutors
+	case windowsOperatingSystemName:
+		return s.forceUserOwnedWindowsExecutors
+	default:
+		return false
+	}
+}
+
 func (s *SchedulerServer) GetPoolInfo(ctx context.Context, os, requestedPool, workflowID string, poolType interfaces.PoolType) (*interfaces.PoolInfo, error) {
 	// Note: The defaultPoolName flag only applies to the shared executor pool.
 	// The pool name for self-hosted pools is always determined directly from
@@ -1014,6 +1157,9 @@ func (s *SchedulerServer) GetPoolInfo(ctx context.Context, os, requestedPool, wo
 			if s.forceUserOwnedDarwinExecutors && os == darwinOperatingSystemName {
 				return nil, status.FailedPreconditionErrorf("Darwin remote build execution is not enabled for anonymous requests.")
 			}
+			if s.forceUserOwnedWindowsExecutors && os == windowsOperatingSystemName {
+				return nil, status.FailedPreconditionErrorf("Windows remote build execution is not enabled for anonymous requests.")
+			}
 			if poolType == interfaces.PoolTypeSelfHosted {
 				return nil, status.FailedPreconditionErrorf("Self-hosted executors not enabled for anonymous requests.")
 			}
@@ -1029,7 +1175,7 @@ func (s *SchedulerServer) GetPoolInfo(ctx context.Context, os, requestedPool, wo
 	if user.GetUseGroupOwnedExecutors() && poolType != interfaces.PoolTypeShared {
 		return selfHostedPool, nil
 	}
-	if s.forceUserOwnedDarwinExecutors && os == darwinOperatingSystemName {
+	if s.forceUserOwnedExecutors(os) {
 		return selfHostedPool, nil
 	}
 	if poolType == interfaces.PoolTypeSelfHosted {
@@ -1038,6 +1184,12 @@ func (s *SchedulerServer) GetPoolInfo(ctx context.Context, os, requestedPool, wo
 	return sharedPool, nil
 }
 
+// samePool returns whether two registrations of an executor are in the same
+// pool.
+func samePool(a, b *scpb.ExecutionNode) bool {
+	return a.GetOs() == b.GetOs() && a.GetArch() == b.GetArch() && a.GetPool() == b.GetPool()
+}
+
 func (s *SchedulerServer) checkPreconditions(node *scpb.ExecutionNode) error {
 	if node.GetHost() == "" {
 		return status.FailedPreconditionError("executor node registration is missing 'host' field")
@@ -1053,7 +1205,8 @@ func (s *SchedulerServer) RemoveConnectedExecutor(ctx context.Context, handle *e
 	}
 	pool, ok := s.getPool(nodePoolKey)
 	if ok {
-		if !pool.RemoveConnectedExecutor(node.GetExecutorId()) {
+		// Draining executors were already removed from the pool.
+		if !pool.RemoveConnectedExecutor(node.GetExecutorId()) && !node.GetDraining() {
 			log.CtxWarningf(ctx, "Executor %q not in pool %+v", node.GetExecutorId(), nodePoolKey)
 		}
 	} else {
@@ -1089,6 +1242,14 @@ func (s *SchedulerServer) AddConnectedExecutor(ctx context.Context, handle *exec
 	}
 
 	pool := s.getOrCreatePool(poolKey)
+	if node.GetDraining() {
+		// Keep the executor registered until it finishes its running tasks
+		// and shuts down, but stop sending it task reservations.
+		if pool.RemoveConnectedExecutor(node.GetExecutorId()) {
+			log.CtxInfof(ctx, "Scheduler: executor %q (host ID %q) in pool %+v is draining", node.GetExecutorId(), node.GetExecutorHostId(), poolKey)
+		}
+		return nil
+	}
 	newExecutor := pool.AddConnectedExecutor(node, handle)
 	if !newExecutor {
 		return nil
@@ -1147,6 +1308,147 @@ func (s *SchedulerServer) insertOrUpdateNode(ctx context.Context, executorHandle
 	return err
 }
 
+// checkExecutorIdentity checks that the executor's SPIFFE ID allows it to
+// register in the given pool. Executors without a SPIFFE ID are only allowed
+// if identities aren't required and no identity rules apply to the group or
+// pool.
+func (s *SchedulerServer) checkExecutorIdentity(ctx context.Context, groupID, pool string) error {
+	id, ok := spiffe.PeerID(ctx)
+	if !ok {
+		if s.requireExecutorIdentity || s.identityRulesApply(groupID, pool) {
+			return status.UnauthenticatedError("executor must present a client certificate with a SPIFFE ID")
+		}
+		return nil
+	}
+	// Certificates issued by IssueExecutorCertificate are bound to the group
+	// of the API key that requested them.
+	if ssl := s.env.GetSSLService(); ssl != nil && ssl.SPIFFETrustDomain() != "" {
+		prefix := "spiffe://" + ssl.SPIFFETrustDomain() + "/group/"
+		if rest, ok := strings.CutPrefix(id, prefix); ok && !strings.HasPrefix(rest, groupID+"/") {
+			return status.PermissionDeniedErrorf("executor identity %q does not belong to the group of its API key", id)
+		}
+	}
+	rules := *executorIdentityRules
+	if len(rules) == 0 {
+		return nil
+	}
+	for _, r := range rules {
+		if spiffe.MatchID(r.SPIFFEID, id) && slices.Contains(r.Pools, pool) {
+			return nil
+		}
+	}
+	return status.PermissionDeniedErrorf("executor identity %q is not allowed to register in pool %q", id, pool)
+}
+
+// identityRulesApply returns whether any executor identity rule allows
+// executors to register in the pool, or is for identities issued by the
+// built-in CA to the group's executors. Executors in such pools and groups
+// must present an identity, so that they can't bypass the rules by not
+// presenting one.
+func (s *SchedulerServer) identityRulesApply(groupID, pool string) bool {
+	var groupPrefix string
+	if ssl := s.env.GetSSLService(); ssl != nil && ssl.SPIFFETrustDomain() != "" && groupID != "" {
+		groupPrefix = "spiffe://" + ssl.SPIFFETrustDomain() + "/group/" + groupID + "/"
+	}
+	for _, r := range *executorIdentityRules {
+		if slices.Contains(r.Pools, pool) {
+			return true
+		}
+		if groupPrefix != "" && strings.HasPrefix(r.SPIFFEID, groupPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkLeaseIdentity checks that the executor's SPIFFE ID, if any, allows it
+// to lease the task: certificates issued by IssueExecutorCertificate can only
+// be used by the executor they were issued to, and the identity must be
+// allowed to run tasks of the task's group and pool. Executors without a
+// SPIFFE ID may only lease tasks that no identity rules apply to.
+func (s *SchedulerServer) checkLeaseIdentity(ctx context.Context, executorID, taskID string) error {
+	id, ok := spiffe.PeerID(ctx)
+	if !ok {
+		if s.requireExecutorIdentity {
+			return status.UnauthenticatedError("executor must present a client certificate with a SPIFFE ID")
+		}
+		if len(*executorIdentityRules) == 0 {
+			return nil
+		}
+	}
+	if ssl := s.env.GetSSLService(); ssl != nil && ssl.SPIFFETrustDomain() != "" {
+		if boundID, ok := issuedExecutorID(ssl.SPIFFETrustDomain(), id); ok && boundID != executorID {
+			return status.PermissionDeniedErrorf("executor identity %q does not belong to executor %q", id, executorID)
+		}
+	}
+	task, err := s.readTask(ctx, taskID)
+	if err != nil {
+		return err
+	}
+	return s.checkExecutorIdentity(ctx, task.metadata.GetExecutorGroupId(), task.metadata.GetPool())
+}
+
+// issuedExecutorID returns the ID of the executor that a SPIFFE ID issued by
+// IssueExecutorCertificate in the given trust domain was issued to.
+func issuedExecutorID(trustDomain, id string) (string, bool) {
+	u, err := spiffe.ParseID(id)
+	if err != nil || u.Host != trustDomain {
+		return "", false
+	}
+	segments := strings.Split(strings.TrimPrefix(u.Path, "/"), "/")
+	if len(segments) < 2 || segments[len(segments)-2] != "executor" {
+		return "", false
+	}
+	return segments[len(segments)-1], true
+}
+
+func (s *SchedulerServer) IssueExecutorCertificate(ctx context.Context, req *scpb.IssueExecutorCertificateRequest) (*scpb.IssueExecutorCertificateResponse, error) {
+	ssl := s.env.GetSSLService()
+	if ssl == nil || !ssl.IsSVIDIssuanceEnabled() {
+		return nil, status.UnimplementedError("Executor certificate issuance is not enabled")
+	}
+	if !executorIDPattern.MatchString(req.GetExecutorId()) || req.GetExecutorId() == "." || req.GetExecutorId() == ".." {
+		return nil, status.InvalidArgumentErrorf("invalid executor ID %q", req.GetExecutorId())
+	}
+	// Without executor authorization, anyone could get a certificate for
+	// any executor ID, so issued certificates can't be trusted to identify
+	// executors.
+	if !s.requireExecutorAuthorization && (s.requireExecutorIdentity || len(*executorIdentityRules) > 0) {
+		return nil, status.FailedPreconditionError("Executor certificates can only be issued with remote_execution.require_executor_authorization while executor identities are enforced")
+	}
+	var segments []string
+	if s.requireExecutorAuthorization {
+		groupID, err := authorizeExecutor(ctx, s.env)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, "group", groupID)
+	}
+	segments = append(segments, "executor", req.GetExecutorId())
+	id, err := spiffe.NewID(ssl.SPIFFETrustDomain(), segments...)
+	if err != nil {
+		return nil, err
+	}
+	certPEM, err := ssl.SignSVID(req.GetCertificateSigningRequest(), id)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return nil, status.InternalError("signed certificate did not contain valid PEM data")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, status.InternalErrorf("could not parse signed certificate: %s", err)
+	}
+	log.CtxInfof(ctx, "Issued certificate for %q, expiring at %s", id, cert.NotAfter)
+	return &scpb.IssueExecutorCertificateResponse{
+		Certificate:    certPEM,
+		SpiffeId:       id,
+		ExpirationTime: timestamppb.New(cert.NotAfter),
+	}, nil
+}
+
 func (s *SchedulerServer) RegisterAndStreamWork(stream scpb.Scheduler_RegisterAndStreamWorkServer) error {
 	handle := newExecutorHandle(s.env, s, s.requireExecutorAuthorization, stream)
 	return handle.Serve(stream.Context())
@@ -1163,6 +1465,9 @@ func (s *SchedulerServer) assignWorkToNode(ctx context.Context, handle *executor
 
 	var reqs []*scpb.EnqueueTaskReservationRequest
 	for _, task := range tasks {
+		if slices.Contains(task.metadata.GetExcludedExecutorIds(), handle.getRegistration().GetExecutorId()) {
+			continue
+		}
 		req := &scpb.EnqueueTaskReservationRequest{
 			TaskId:             task.taskID,
 			TaskSize:           task.metadata.GetTaskSize(),
@@ -1263,7 +1568,7 @@ func (s *SchedulerServer) unclaimTask(ctx context.Context, taskID, leaseID, reco
 	return nil
 }
 
-func (s *SchedulerServer) claimTask(ctx context.Context, taskID, reconnectToken string, clientSupportsReconnect bool) (string, error) {
+func (s *SchedulerServer) claimTask(ctx context.Context, taskID, executorID, reconnectToken string, clientSupportsReconnect bool) (string, error) {
 	leaseId, err := random.RandomString(20)
 	if err != nil {
 		return "", status.InternalErrorf("could not generate lease ID: %s", err)
@@ -1272,7 +1577,7 @@ func (s *SchedulerServer) claimTask(ctx context.Context, taskID, reconnectToken
 	r, err := redisAcquireClaim.Run(
 		ctx, s.rdb,
 		[]string{s.redisKeyForTask(taskID)},
-		checkTaskReconnectToken, reconnectToken, time.Now().UnixNano(), leaseId,
+		checkTaskReconnectToken, reconnectToken, time.Now().UnixNano(), leaseId, executorID,
 	).Result()
 	if err != nil {
 		log.CtxErrorf(ctx, "claimTask error: redis script failed: %s", err)
@@ -1375,6 +1680,7 @@ func (s *SchedulerServer) readTask(ctx context.Context, taskID string) (*persist
 		redisTaskMetadataField,
 		redisTaskQueuedAtUsec,
 		redisTaskAttempCountField,
+		redisTaskAttemptedExecutorIDsField,
 	}
 	key := s.redisKeyForTask(taskID)
 	vals, err := s.rdb.HMGet(ctx, key, fields...).Result()
@@ -1426,12 +1732,19 @@ func (s *SchedulerServer) readTask(ctx context.Context, taskID string) (*persist
 		return nil, status.InvalidArgumentErrorf("could not parse attempt count %q: %v", attemptCountStr, attemptCount)
 	}
 
+	// Attempted executor IDs field. Not set if the task was never claimed.
+	var attemptedExecutorIDs []string
+	if attemptedStr, ok := vals[4].(string); ok && attemptedStr != "" {
+		attemptedExecutorIDs = strings.Split(attemptedStr, ",")
+	}
+
 	return &persistedTask{
-		taskID:          taskID,
-		metadata:        metadata,
-		serializedTask:  serializedTask,
-		queuedTimestamp: time.UnixMicro(queuedAtUsec),
-		attemptCount:    attemptCount,
+		taskID:               taskID,
+		metadata:             metadata,
+		serializedTask:       serializedTask,
+		queuedTimestamp:      time.UnixMicro(queuedAtUsec),
+		attemptCount:         attemptCount,
+		attemptedExecutorIDs: attemptedExecutorIDs,
 	}, nil
 }
 
@@ -1457,6 +1770,7 @@ func (s *SchedulerServer) LeaseTask(stream scpb.Scheduler_LeaseTaskServer) error
 	taskID := ""
 	reconnectToken := ""
 	leaseID := ""
+	hotInputsKey := ""
 
 	// TODO(vadim): remove after executor ID in lease request is rolled out
 	executorID := "unknown"
@@ -1535,7 +1849,10 @@ func (s *SchedulerServer) LeaseTask(stream scpb.Scheduler_LeaseTaskServer) error
 		}
 		if !claimed {
 			log.CtxInfof(ctx, "LeaseTask attempt (reconnect=%t) from executor %q", req.GetReconnectToken() != "", executorID)
-			leaseID, err = s.claimTask(ctx, taskID, req.GetReconnectToken(), req.GetSupportsReconnect())
+			if err := s.checkLeaseIdentity(ctx, req.GetExecutorId(), taskID); err != nil {
+				return err
+			}
+			leaseID, err = s.claimTask(ctx, taskID, executorID, req.GetReconnectToken(), req.GetSupportsReconnect())
 			if err != nil {
 				log.CtxDebugf(ctx, "LeaseTask claim attempt (reconnect=%t) failed: %s", req.GetReconnectToken() != "", err)
 				return err
@@ -1561,6 +1878,11 @@ func (s *SchedulerServer) LeaseTask(stream scpb.Scheduler_LeaseTaskServer) error
 				if err != nil {
 					log.CtxWarningf(ctx, "Could not remove task from unclaimed list: %s", err)
 				}
+				var node *scpb.ExecutionNode
+				if n := nodePool.FindExecutorByID(req.GetExecutorId()); n != nil {
+					node = n.ExecutionNode
+				}
+				recordRegionLocality(key.pool, node)
 			}
 
 			// Prometheus: observe queue wait time.
@@ -1568,6 +1890,8 @@ func (s *SchedulerServer) LeaseTask(stream scpb.Scheduler_LeaseTaskServer) error
 			queueWaitTimeMs.Observe(float64(ageInMillis))
 			rsp.SerializedTask = task.serializedTask
 			rsp.LeaseId = leaseID
+			hotInputsKey = hotInputsKeyForTask(task)
+			rsp.HotInputs = s.getHotInputs(ctx, hotInputsKey)
 			// If both the client and server have lease reconnect enabled,
 			// generate a reconnect token.
 			if *leaseReconnectGracePeriod > 0 && req.GetSupportsReconnect() {
@@ -1597,6 +1921,7 @@ func (s *SchedulerServer) LeaseTask(stream scpb.Scheduler_LeaseTaskServer) error
 			if err == nil {
 				claimed = false
 				log.CtxInfof(ctx, "LeaseTask task %q successfully finalized by %q", taskID, executorID)
+				s.recordAccessedInputs(ctx, hotInputsKey, req.GetAccessedInputs())
 			} else {
 				log.CtxWarningf(ctx, "Could not delete claimed task %q: %s", taskID, err)
 			}
@@ -1662,6 +1987,8 @@ type enqueueTaskReservationOpts struct {
 	// If false, this scheduler will make RPCs to other schedulers to have them enqueue tasks on their connected
 	// executors.
 	scheduleOnConnectedExecutors bool
+	// Executors to rank last, regardless of the task router's ranking.
+	deprioritizedExecutorIDs []string
 }
 
 func (s *SchedulerServer) enqueueTaskReservations(ctx context.Context, enqueueRequest *scpb.EnqueueTaskReservationRequest, serializedTask []byte, opts enqueueTaskReservationOpts) error {
@@ -1693,6 +2020,7 @@ func (s *SchedulerServer) enqueueTaskReservations(ctx context.Context, enqueueRe
 
 	probeCount := min(opts.numReplicas, nodeCount)
 	scheduledOnPreferredNode := false
+	scheduledInAppRegion := false
 
 	startTime := time.Now()
 	var successfulReservations []string
@@ -1722,6 +2050,7 @@ func (s *SchedulerServer) enqueueTaskReservations(ctx context.Context, enqueueRe
 		enqueued, _ := s.enqueue(ctx, preferredNode, enqueueRequest, opts)
 		if enqueued {
 			scheduledOnPreferredNode = true
+			scheduledInAppRegion = inAppRegion(preferredNode.ExecutionNode)
 			successfulReservations = append(successfulReservations, successfulReservation(preferredNode, enqueueStart))
 		}
 	}
@@ -1747,7 +2076,13 @@ func (s *SchedulerServer) enqueueTaskReservations(ctx context.Context, enqueueRe
 			if len(candidateNodes) == 0 {
 				return status.UnavailableErrorf("requested executor ID not found")
 			}
+			candidateNodes = excludeExecutors(candidateNodes, enqueueRequest.GetSchedulingMetadata().GetExcludedExecutorIds())
+			if len(candidateNodes) == 0 {
+				return status.UnavailableErrorf("No executors in pool %q other than the ones running hedged task %q.", pool, enqueueRequest.GetSchedulingMetadata().GetHedgedTaskId())
+			}
 			rankedNodes = s.taskRouter.RankNodes(ctx, task.GetAction(), cmd, remoteInstanceName, toNodeInterfaces(candidateNodes))
+			rankedNodes = preferAppRegion(rankedNodes)
+			rankedNodes = deprioritizeExecutors(rankedNodes, opts.deprioritizedExecutorIDs)
 		}
 
 		select {
@@ -1770,13 +2105,18 @@ func (s *SchedulerServer) enqueueTaskReservations(ctx context.Context, enqueueRe
 		// Set the executor ID in case the node is owned by another scheduler, so
 		// that the scheduler can prefer this node for the probe.
 		enqueueRequest.ExecutorId = rankedNode.GetExecutionNode().GetExecutorId()
+		node := rankedNode.GetExecutionNode().(*executionNode)
 		enqueueStart := time.Now()
-		if delayable && scheduledOnPreferredNode && !rankedNode.IsPreferred() && nonPreferredDelay > 0*time.Second {
-			enqueueRequest.Delay = durationpb.New(nonPreferredDelay)
+		delay := getCrossRegionSchedulingDelay(node.ExecutionNode, scheduledInAppRegion)
+		if scheduledOnPreferredNode && !rankedNode.IsPreferred() {
+			delay = max(delay, nonPreferredDelay)
+		}
+		if delayable && delay > 0*time.Second {
+			enqueueRequest.Delay = durationpb.New(delay)
 		} else if delayable {
 			enqueueRequest.Delay = nil
 		}
-		enqueued, rpcErr := s.enqueue(ctx, rankedNode.GetExecutionNode().(*executionNode), enqueueRequest, opts)
+		enqueued, rpcErr := s.enqueue(ctx, node, enqueueRequest, opts)
 		if rpcErr != nil {
 			time.Sleep(schedulerEnqueueTaskReservationFailureSleep)
 		}
@@ -1784,7 +2124,10 @@ func (s *SchedulerServer) enqueueTaskReservations(ctx context.Context, enqueueRe
 			if rankedNode.IsPreferred() {
 				scheduledOnPreferredNode = true
 			}
-			successfulReservations = append(successfulReservations, successfulReservation(rankedNode.GetExecutionNode().(*executionNode), enqueueStart))
+			if inAppRegion(node.ExecutionNode) {
+				scheduledInAppRegion = true
+			}
+			successfulReservations = append(successfulReservations, successfulReservation(node, enqueueStart))
 		}
 	}
 	return nil
@@ -1876,6 +2219,11 @@ func (s *SchedulerServer) ScheduleTask(ctx context.Context, req *scpb.ScheduleTa
 	}
 	taskID := req.GetTaskId()
 	metadata := req.GetMetadata()
+	assignPriorityLane(ctx, metadata)
+	s.excludeHedgedTaskExecutors(ctx, metadata)
+	if err := s.applyQueueTimeSLO(ctx, taskID, metadata); err != nil {
+		return nil, err
+	}
 	if err := s.insertTask(ctx, taskID, metadata, req.GetSerializedTask()); err != nil {
 		return nil, err
 	}
@@ -1895,6 +2243,53 @@ func (s *SchedulerServer) ScheduleTask(ctx context.Context, req *scpb.ScheduleTa
 	return &scpb.ScheduleTaskResponse{}, nil
 }
 
+// excludeHedgedTaskExecutors excludes the executors that were assigned the
+// original of a hedged task from running the copy. If the original task is no
+// longer known, the copy may run anywhere.
+func (s *SchedulerServer) excludeHedgedTaskExecutors(ctx context.Context, metadata *scpb.SchedulingMetadata) {
+	if metadata.GetHedgedTaskId() == "" {
+		return
+	}
+	original, err := s.readTask(ctx, metadata.GetHedgedTaskId())
+	if err != nil {
+		log.CtxInfof(ctx, "Could not read hedged task %q: %s", metadata.GetHedgedTaskId(), err)
+		return
+	}
+	metadata.ExcludedExecutorIds = original.attemptedExecutorIDs
+}
+
+// assignPriorityLane resolves the task's requested priority lane to a
+// configured lane, and sets the lane's weight for executors to use when
+// dequeueing. The lane is stored along with the rest of the metadata, so it's
+// kept if the task is re-enqueued.
+func assignPriorityLane(ctx context.Context, metadata *scpb.SchedulingMetadata) {
+	requested := strings.ToLower(metadata.GetPriorityLane())
+	if requested == "" {
+		requested = defaultPriorityLaneName
+	}
+	lane, ok := findPriorityLane(requested)
+	if !ok {
+		log.CtxInfof(ctx, "Unknown priority lane %q, using %q", requested, defaultPriorityLaneName)
+		lane, ok = findPriorityLane(defaultPriorityLaneName)
+	}
+	if !ok {
+		// The default lane isn't configured, so all unknown lanes share a
+		// lane with the lowest possible weight.
+		lane = PriorityLane{Name: defaultPriorityLaneName, Weight: 1}
+	}
+	metadata.PriorityLane = strings.ToLower(lane.Name)
+	metadata.PriorityLaneWeight = max(lane.Weight, 1)
+}
+
+func findPriorityLane(name string) (PriorityLane, bool) {
+	for _, l := range *priorityLanes {
+		if strings.EqualFold(l.Name, name) {
+			return l, true
+		}
+	}
+	return PriorityLane{}, false
+}
+
 func (s *SchedulerServer) CancelTask(ctx context.Context, taskID string) (bool, error) {
 	return s.deleteTask(ctx, taskID)
 }
@@ -1927,7 +2322,7 @@ func (s *SchedulerServer) reEnqueueTask(ctx context.Context, taskID, leaseID, re
 	if err != nil {
 		return err
 	}
-	if task.attemptCount >= maxTaskAttemptCount {
+	if task.attemptCount >= *maxTaskAttempts {
 		if _, err := s.deleteTask(ctx, taskID); err != nil {
 			return err
 		}
@@ -1950,19 +2345,23 @@ func (s *SchedulerServer) reEnqueueTask(ctx context.Context, taskID, leaseID, re
 		// Proceed despite error - it's fine if it's already unclaimed.
 	}
 	log.CtxDebugf(ctx, "Re-enqueueing task")
-	delay := time.Duration(0)
+	delay := taskRetryBackoff(task.attemptCount)
 	if reconnectToken != "" {
 		delay = *leaseReconnectGracePeriod
 	}
+	metadata := task.metadata.CloneVT()
+	metadata.RetryCount = int32(task.attemptCount)
 	enqueueRequest := &scpb.EnqueueTaskReservationRequest{
 		TaskId:             taskID,
-		TaskSize:           task.metadata.GetTaskSize(),
-		SchedulingMetadata: task.metadata,
+		TaskSize:           metadata.GetTaskSize(),
+		SchedulingMetadata: metadata,
 		Delay:              durationpb.New(delay),
 	}
 	opts := enqueueTaskReservationOpts{
 		numReplicas:                  numReplicas,
 		scheduleOnConnectedExecutors: false,
+		// Retry on executors that haven't failed the task yet, if possible.
+		deprioritizedExecutorIDs: task.attemptedExecutorIDs,
 	}
 	if err := s.enqueueTaskReservations(ctx, enqueueRequest, task.serializedTask, opts); err != nil {
 		// Unavailable indicates that it's impossible to schedule the task (no executors in pool).
@@ -1977,6 +2376,37 @@ func (s *SchedulerServer) reEnqueueTask(ctx context.Context, taskID, leaseID, re
 	return nil
 }
 
+// taskRetryBackoff returns how long to delay a task that has been attempted
+// the given number of times before retrying it.
+func taskRetryBackoff(attemptCount int64) time.Duration {
+	if *taskRetryInitialBackoff <= 0 || attemptCount <= 0 {
+		return 0
+	}
+	backoff := *taskRetryInitialBackoff
+	for i := int64(1); i < attemptCount && backoff < *taskRetryMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, *taskRetryMaxBackoff)
+}
+
+// deprioritizeExecutors moves the nodes of the given executors to the end of
+// the ranking, preserving the relative order of the other nodes.
+func deprioritizeExecutors(nodes []interfaces.RankedExecutionNode, executorIDs []string) []interfaces.RankedExecutionNode {
+	if len(executorIDs) == 0 {
+		return nodes
+	}
+	out := make([]interfaces.RankedExecutionNode, 0, len(nodes))
+	var deprioritized []interfaces.RankedExecutionNode
+	for _, node := range nodes {
+		if slices.Contains(executorIDs, node.GetExecutionNode().GetExecutorId()) {
+			deprioritized = append(deprioritized, node)
+		} else {
+			out = append(out, node)
+		}
+	}
+	return append(out, deprioritized...)
+}
+
 func (s *SchedulerServer) ReEnqueueTask(ctx context.Context, req *scpb.ReEnqueueTaskRequest) (*scpb.ReEnqueueTaskResponse, error) {
 	ctx = log.EnrichContext(ctx, log.ExecutionIDKey, req.GetTaskId())
 	reconnectToken := ""
@@ -2053,13 +2483,12 @@ func (s *SchedulerServer) GetExecutionNodes(ctx context.Context, req *scpb.GetEx
 
 	executors := make([]*scpb.GetExecutionNodesResponse_Executor, len(executionNodes))
 	for i, node := range executionNodes {
-		isDarwinExecutor := strings.EqualFold(node.Os, platform.DarwinOperatingSystemName)
 		executors[i] = &scpb.GetExecutionNodesResponse_Executor{
 			Node: node,
 			IsDefault: !s.requireExecutorAuthorization ||
 				groupID == *sharedExecutorPoolGroupID ||
 				(s.enableUserOwnedExecutors &&
-					(g.UseGroupOwnedExecutors || (s.forceUserOwnedDarwinExecutors && isDarwinExecutor))),
+					(g.UseGroupOwnedExecutors || s.forceUserOwnedExecutors(strings.ToLower(node.Os)))),
 		}
 	}
 
@@ -2,7 +2,12 @@ package scheduler_server
 
 import (
 	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
 	"io"
+	"net"
+	"net/url"
 	"sort"
 	"sync"
 	"sync/atomic"
@@ -14,6 +19,8 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/testredis"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/ssl"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauditlog"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
@@ -23,10 +30,15 @@ import (
 	"github.com/google/uuid"
 	"github.com/jonboulle/clockwork"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/protobuf/types/known/durationpb"
 
+	alpb "github.com/buildbuddy-io/buildbuddy/proto/auditlog"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+	gstatus "google.golang.org/grpc/status"
 )
 
 const (
@@ -208,6 +220,33 @@ func TestSchedulerServerGetPoolInfoDarwinNoAuth(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestSchedulerServerGetPoolInfoWindows(t *testing.T) {
+	s, ctx := getScheduleServer(t, true, false, "user1")
+	p, err := s.GetPoolInfo(ctx, "windows", "", "" /*=workflowID*/, interfaces.PoolTypeDefault)
+	require.NoError(t, err)
+	require.Equal(t, "sharedGroupID", p.GroupID)
+	require.Equal(t, "defaultPoolName", p.Name)
+
+	// Forcing user-owned darwin executors doesn't affect windows.
+	s.forceUserOwnedDarwinExecutors = true
+	p, err = s.GetPoolInfo(ctx, "windows", "", "" /*=workflowID*/, interfaces.PoolTypeDefault)
+	require.NoError(t, err)
+	require.Equal(t, "sharedGroupID", p.GroupID)
+
+	s.forceUserOwnedWindowsExecutors = true
+	p, err = s.GetPoolInfo(ctx, "windows", "", "" /*=workflowID*/, interfaces.PoolTypeDefault)
+	require.NoError(t, err)
+	require.Equal(t, "group1", p.GroupID)
+	require.Equal(t, "", p.Name)
+}
+
+func TestSchedulerServerGetPoolInfoWindowsNoAuth(t *testing.T) {
+	s, ctx := getScheduleServer(t, true, false, "")
+	s.forceUserOwnedWindowsExecutors = true
+	_, err := s.GetPoolInfo(ctx, "windows", "", "" /*=workflowID*/, interfaces.PoolTypeDefault)
+	require.Error(t, err)
+}
+
 func TestSchedulerServerGetPoolInfoSelfHostedNoAuth(t *testing.T) {
 	s, ctx := getScheduleServer(t, true, false, "")
 	_, err := s.GetPoolInfo(ctx, "linux", "", "" /*=workflowID*/, interfaces.PoolTypeSelfHosted)
@@ -277,6 +316,9 @@ type fakeExecutor struct {
 
 	unhealthy atomic.Bool
 
+	stream scpb.Scheduler_RegisterAndStreamWorkClient
+	pool   string
+
 	mu    sync.Mutex
 	tasks map[string]task
 }
@@ -301,19 +343,26 @@ func (e *fakeExecutor) markUnhealthy() {
 	e.unhealthy.Store(true)
 }
 
+func (e *fakeExecutor) node() *scpb.ExecutionNode {
+	return &scpb.ExecutionNode{
+		ExecutorId:            e.id,
+		Os:                    defaultOS,
+		Arch:                  defaultArch,
+		Host:                  "foo",
+		Pool:                  e.pool,
+		AssignableMemoryBytes: 1000000,
+		AssignableMilliCpu:    1000000,
+	}
+}
+
 func (e *fakeExecutor) Register() {
 	stream, err := e.schedulerClient.RegisterAndStreamWork(e.ctx)
 	require.NoError(e.t, err)
+	e.stream = stream
 	err = stream.Send(&scpb.RegisterAndStreamWorkRequest{
 		RegisterExecutorRequest: &scpb.RegisterExecutorRequest{
-			Node: &scpb.ExecutionNode{
-				ExecutorId:            e.id,
-				Os:                    defaultOS,
-				Arch:                  defaultArch,
-				Host:                  "foo",
-				AssignableMemoryBytes: 1000000,
-				AssignableMilliCpu:    1000000,
-			}},
+			Node: e.node(),
+		},
 	})
 	require.NoError(e.t, err)
 
@@ -346,6 +395,31 @@ func (e *fakeExecutor) Register() {
 	time.Sleep(100 * time.Millisecond)
 }
 
+func (e *fakeExecutor) Drain() {
+	node := e.node()
+	node.Draining = true
+	err := e.stream.Send(&scpb.RegisterAndStreamWorkRequest{
+		RegisterExecutorRequest: &scpb.RegisterExecutorRequest{Node: node},
+	})
+	require.NoError(e.t, err)
+
+	// Give the scheduler a moment to process the registration.
+	time.Sleep(100 * time.Millisecond)
+}
+
+// SetPool re-registers the executor in a different pool over its existing
+// stream, as executors do when their config is reloaded.
+func (e *fakeExecutor) SetPool(pool string) {
+	e.pool = pool
+	err := e.stream.Send(&scpb.RegisterAndStreamWorkRequest{
+		RegisterExecutorRequest: &scpb.RegisterExecutorRequest{Node: e.node()},
+	})
+	require.NoError(e.t, err)
+
+	// Give the scheduler a moment to process the registration.
+	time.Sleep(100 * time.Millisecond)
+}
+
 func (e *fakeExecutor) WaitForTask(taskID string) {
 	e.WaitForTaskWithDelay(taskID, 0*time.Second)
 }
@@ -386,10 +460,11 @@ func (e *fakeExecutor) ResetTasks() {
 }
 
 type taskLease struct {
-	t       *testing.T
-	stream  scpb.Scheduler_LeaseTaskClient
-	taskID  string
-	leaseID string
+	t         *testing.T
+	stream    scpb.Scheduler_LeaseTaskClient
+	taskID    string
+	leaseID   string
+	hotInputs []*scpb.TaskInput
 }
 
 func (tl *taskLease) Renew() error {
@@ -406,11 +481,24 @@ func (tl *taskLease) Renew() error {
 	return nil
 }
 
+func (tl *taskLease) Finalize(accessedInputs []*scpb.TaskInput) {
+	err := tl.stream.Send(&scpb.LeaseTaskRequest{
+		TaskId:         tl.taskID,
+		Finalize:       true,
+		AccessedInputs: accessedInputs,
+	})
+	require.NoError(tl.t, err)
+	rsp, err := tl.stream.Recv()
+	require.NoError(tl.t, err)
+	require.True(tl.t, rsp.GetClosedCleanly())
+}
+
 func (e *fakeExecutor) Claim(taskID string) *taskLease {
 	stream, err := e.schedulerClient.LeaseTask(e.ctx)
 	require.NoError(e.t, err)
 	err = stream.Send(&scpb.LeaseTaskRequest{
-		TaskId: taskID,
+		TaskId:     taskID,
+		ExecutorId: e.id,
 	})
 	require.NoError(e.t, err)
 	rsp, err := stream.Recv()
@@ -418,10 +506,11 @@ func (e *fakeExecutor) Claim(taskID string) *taskLease {
 	require.NotZero(e.t, rsp.GetLeaseDurationSeconds())
 
 	lease := &taskLease{
-		t:       e.t,
-		stream:  stream,
-		taskID:  taskID,
-		leaseID: rsp.GetLeaseId(),
+		t:         e.t,
+		stream:    stream,
+		taskID:    taskID,
+		leaseID:   rsp.GetLeaseId(),
+		hotInputs: rsp.GetHotInputs(),
 	}
 	return lease
 }
@@ -461,6 +550,32 @@ func scheduleTask(ctx context.Context, t *testing.T, env environment.Env, props
 	return taskID
 }
 
+// scheduleHedgedTask schedules a hedged copy of the given task, returning the
+// copy's task ID.
+func scheduleHedgedTask(ctx context.Context, t *testing.T, env environment.Env, hedgedTaskID string) (string, error) {
+	id, err := uuid.NewRandom()
+	require.NoError(t, err)
+	taskID := id.String()
+
+	taskBytes, err := proto.Marshal(&repb.ExecutionTask{ExecutionId: taskID, Command: &repb.Command{}})
+	require.NoError(t, err)
+	_, err = env.GetSchedulerService().ScheduleTask(ctx, &scpb.ScheduleTaskRequest{
+		TaskId: taskID,
+		Metadata: &scpb.SchedulingMetadata{
+			Os:   defaultOS,
+			Arch: defaultArch,
+			TaskSize: &scpb.TaskSize{
+				EstimatedMemoryBytes:   100,
+				EstimatedMilliCpu:      100,
+				EstimatedFreeDiskBytes: 100,
+			},
+			HedgedTaskId: hedgedTaskID,
+		},
+		SerializedTask: taskBytes,
+	})
+	return taskID, err
+}
+
 func enqueueTaskReservation(ctx context.Context, t *testing.T, env environment.Env, delay time.Duration) string {
 	id, err := uuid.NewRandom()
 	require.NoError(t, err)
@@ -548,6 +663,74 @@ func TestExecutorReEnqueue_NonMatchingLeaseID(t *testing.T) {
 	require.True(t, status.IsPermissionDeniedError(err))
 }
 
+func TestHedgedTask_NotAssignedToOriginalExecutor(t *testing.T) {
+	env, ctx := getEnv(t, &schedulerOpts{}, "user1")
+
+	fe1 := newFakeExecutorWithId(ctx, t, "executor-1", env.GetSchedulerClient())
+	fe1.Register()
+	fe2 := newFakeExecutorWithId(ctx, t, "executor-2", env.GetSchedulerClient())
+	fe2.Register()
+
+	taskID := scheduleTask(ctx, t, env, map[string]string{})
+	fe1.WaitForTask(taskID)
+	fe1.Claim(taskID)
+
+	hedgeID, err := scheduleHedgedTask(ctx, t, env, taskID)
+	require.NoError(t, err)
+	fe2.WaitForTask(hedgeID)
+	fe1.EnsureTaskNotReceived(hedgeID)
+}
+
+func TestHedgedTask_NoOtherExecutors(t *testing.T) {
+	env, ctx := getEnv(t, &schedulerOpts{}, "user1")
+
+	fe := newFakeExecutor(ctx, t, env.GetSchedulerClient())
+	fe.Register()
+
+	taskID := scheduleTask(ctx, t, env, map[string]string{})
+	fe.WaitForTask(taskID)
+	fe.Claim(taskID)
+
+	hedgeID, err := scheduleHedgedTask(ctx, t, env, taskID)
+	require.True(t, status.IsUnavailableError(err), "expected Unavailable, got %v", err)
+	fe.EnsureTaskNotReceived(hedgeID)
+}
+
+func TestHotInputHints(t *testing.T) {
+	flags.Set(t, "remote_execution.enable_hot_input_hints", true)
+	flags.Set(t, "remote_execution.max_hot_inputs", 2)
+	env, ctx := getEnv(t, &schedulerOpts{}, "user1")
+
+	fe := newFakeExecutor(ctx, t, env.GetSchedulerClient())
+	fe.Register()
+
+	taskID := scheduleTask(ctx, t, env, map[string]string{})
+	fe.WaitForTask(taskID)
+	lease := fe.Claim(taskID)
+	require.Empty(t, lease.hotInputs)
+	lease.Finalize([]*scpb.TaskInput{
+		{Hash: "aaa", SizeBytes: 1},
+		{Hash: "bbb", SizeBytes: 2, IsExecutable: true},
+		{Hash: "ccc", SizeBytes: 3},
+	})
+
+	// A task running the same command should be hinted the inputs that the
+	// first task read first.
+	taskID = scheduleTask(ctx, t, env, map[string]string{})
+	fe.WaitForTask(taskID)
+	lease = fe.Claim(taskID)
+	require.Len(t, lease.hotInputs, 2)
+	require.Equal(t, "aaa", lease.hotInputs[0].GetHash())
+	require.Equal(t, "bbb", lease.hotInputs[1].GetHash())
+	require.True(t, lease.hotInputs[1].GetIsExecutable())
+
+	// Tasks running other commands shouldn't be hinted anything.
+	taskID = scheduleTask(ctx, t, env, map[string]string{"OSFamily": "linux"})
+	fe.WaitForTask(taskID)
+	lease = fe.Claim(taskID)
+	require.Empty(t, lease.hotInputs)
+}
+
 func TestLeaseExpiration(t *testing.T) {
 	flags.Set(t, "remote_execution.lease_duration", 10*time.Second)
 	flags.Set(t, "remote_execution.lease_grace_period", 10*time.Second)
@@ -670,6 +853,56 @@ func TestSchedulingDelay_PreferredExecutorUnhealthy(t *testing.T) {
 	fe1.WaitForTaskWithDelay(taskID, 0*time.Second)
 }
 
+func TestDrainingExecutor(t *testing.T) {
+	env, ctx := getEnv(t, &schedulerOpts{}, "user1")
+
+	fe1 := newFakeExecutorWithId(ctx, t, "1", env.GetSchedulerClient())
+	fe2 := newFakeExecutorWithId(ctx, t, "2", env.GetSchedulerClient())
+	fe1.Register()
+	fe2.Register()
+	fe2.Drain()
+
+	taskID := scheduleTask(ctx, t, env, map[string]string{})
+
+	fe1.WaitForTask(taskID)
+	fe2.EnsureTaskNotReceived(taskID)
+
+	// Draining executors stay registered until they shut down, so that they
+	// show up as draining.
+	nodes, err := env.GetSchedulerService().(*SchedulerServer).getExecutionNodesFromRedis(ctx, "" /*=groupID*/)
+	require.NoError(t, err)
+	draining := map[string]bool{}
+	for _, node := range nodes {
+		draining[node.GetExecutorId()] = node.GetDraining()
+	}
+	require.Equal(t, map[string]bool{"1": false, "2": true}, draining)
+}
+
+func TestExecutorChangesPool(t *testing.T) {
+	env, ctx := getEnv(t, &schedulerOpts{}, "user1")
+
+	fe1 := newFakeExecutorWithId(ctx, t, "1", env.GetSchedulerClient())
+	fe2 := newFakeExecutorWithId(ctx, t, "2", env.GetSchedulerClient())
+	fe1.Register()
+	fe2.Register()
+	fe2.SetPool("other")
+
+	// The executor no longer gets tasks from its old pool.
+	taskID := scheduleTask(ctx, t, env, map[string]string{})
+	fe1.WaitForTask(taskID)
+	fe2.EnsureTaskNotReceived(taskID)
+
+	nodes, err := env.GetSchedulerService().(*SchedulerServer).getExecutionNodesFromRedis(ctx, "" /*=groupID*/)
+	require.NoError(t, err)
+	pools := map[string]string{}
+	for _, node := range nodes {
+		_, ok := pools[node.GetExecutorId()]
+		require.False(t, ok, "executor %q is registered more than once", node.GetExecutorId())
+		pools[node.GetExecutorId()] = node.GetPool()
+	}
+	require.Equal(t, map[string]string{"1": "", "2": "other"}, pools)
+}
+
 func TestEnqueueTaskReservation_DoesntOverwriteDelay(t *testing.T) {
 	env, ctx := getEnv(t, &schedulerOpts{}, "user1")
 
@@ -680,3 +913,359 @@ func TestEnqueueTaskReservation_DoesntOverwriteDelay(t *testing.T) {
 
 	fe1.WaitForTaskWithDelay(taskID, 3*time.Second)
 }
+
+func TestGetPoolDemand(t *testing.T) {
+	env, _ := getEnv(t, &schedulerOpts{}, "")
+	ctx := testauth.WithAuthenticatedUserInfo(context.Background(), testauth.User("user1", "group1"))
+	req := &scpb.GetPoolDemandRequest{RequestContext: testauth.RequestContext("user1", "group1")}
+
+	fe := newFakeExecutor(ctx, t, env.GetSchedulerClient())
+	fe.Register()
+
+	taskID1 := scheduleTask(ctx, t, env, map[string]string{})
+	taskID2 := scheduleTask(ctx, t, env, map[string]string{})
+	fe.WaitForTask(taskID1)
+	fe.WaitForTask(taskID2)
+
+	rsp, err := env.GetSchedulerService().GetPoolDemand(ctx, req)
+	require.NoError(t, err)
+	require.Len(t, rsp.GetPool(), 1)
+	demand := rsp.GetPool()[0]
+	require.Equal(t, defaultOS, demand.GetOs())
+	require.Equal(t, defaultArch, demand.GetArch())
+	require.Equal(t, int64(1), demand.GetExecutorCount())
+	require.Equal(t, int64(1000000), demand.GetAssignableMilliCpu())
+	require.Equal(t, int64(2), demand.GetQueuedTaskCount())
+	require.Equal(t, int64(200), demand.GetQueuedMilliCpu())
+	require.Equal(t, int64(200), demand.GetQueuedMemoryBytes())
+
+	// Claimed tasks are no longer queued.
+	fe.Claim(taskID1)
+	rsp, err = env.GetSchedulerService().GetPoolDemand(ctx, req)
+	require.NoError(t, err)
+	require.Len(t, rsp.GetPool(), 1)
+	require.Equal(t, int64(1), rsp.GetPool()[0].GetQueuedTaskCount())
+	require.Equal(t, int64(100), rsp.GetPool()[0].GetQueuedMilliCpu())
+
+	// Users can only see the demand of groups they belong to.
+	req.RequestContext = testauth.RequestContext("user1", "group2")
+	_, err = env.GetSchedulerService().GetPoolDemand(ctx, req)
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+}
+
+func TestPercentile(t *testing.T) {
+	var ages []time.Duration
+	for i := 1; i <= 10; i++ {
+		ages = append(ages, time.Duration(i)*time.Second)
+	}
+	require.Equal(t, 5*time.Second, percentile(ages, 50))
+	require.Equal(t, 9*time.Second, percentile(ages, 90))
+	require.Equal(t, 10*time.Second, percentile(ages, 99))
+	require.Equal(t, 3*time.Second, percentile([]time.Duration{3 * time.Second}, 50))
+}
+
+func TestAssignPriorityLane(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		lanes      []PriorityLane
+		requested  string
+		wantLane   string
+		wantWeight int32
+	}{
+		{name: "unset", lanes: defaultPriorityLanes, requested: "", wantLane: "default", wantWeight: 4},
+		{name: "configured", lanes: defaultPriorityLanes, requested: "interactive", wantLane: "interactive", wantWeight: 8},
+		{name: "case insensitive", lanes: defaultPriorityLanes, requested: "BATCH", wantLane: "batch", wantWeight: 1},
+		{name: "unknown", lanes: defaultPriorityLanes, requested: "urgent", wantLane: "default", wantWeight: 4},
+		{name: "no default lane", lanes: []PriorityLane{{Name: "batch", Weight: 2}}, requested: "urgent", wantLane: "default", wantWeight: 1},
+		{name: "non-positive weight", lanes: []PriorityLane{{Name: "batch", Weight: 0}}, requested: "batch", wantLane: "batch", wantWeight: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			flags.Set(t, "remote_execution.priority_lanes", tc.lanes)
+			md := &scpb.SchedulingMetadata{PriorityLane: tc.requested}
+			assignPriorityLane(context.Background(), md)
+			require.Equal(t, tc.wantLane, md.GetPriorityLane())
+			require.Equal(t, tc.wantWeight, md.GetPriorityLaneWeight())
+		})
+	}
+}
+
+func TestCheckExecutorIdentity(t *testing.T) {
+	flags.Set(t, "ssl.spiffe_trust_domain", "bb.example.com")
+	flags.Set(t, "remote_execution.executor_identity_rules", []ExecutorIdentityRule{
+		{SPIFFEID: "spiffe://bb.example.com/group/group1/executor/*", Pools: []string{"", "linux-amd64"}},
+		{SPIFFEID: "spiffe://spire.example.com/ns/gpu/*", Pools: []string{"gpu"}},
+	})
+	env := testenv.GetTestEnv(t)
+	env.SetSSLService(&ssl.SSLService{})
+	s := &SchedulerServer{env: env, requireExecutorAuthorization: true}
+
+	for _, tc := range []struct {
+		name    string
+		id      string
+		groupID string
+		pool    string
+		wantErr func(error) bool
+	}{
+		{name: "no identity", id: "", groupID: "group3", pool: "other"},
+		{name: "no identity in pool with rules", id: "", groupID: "group3", pool: "gpu", wantErr: status.IsUnauthenticatedError},
+		{name: "no identity in group with rules", id: "", groupID: "group1", pool: "other", wantErr: status.IsUnauthenticatedError},
+		{name: "default pool", id: "spiffe://bb.example.com/group/group1/executor/e1", groupID: "group1", pool: ""},
+		{name: "allowed pool", id: "spiffe://bb.example.com/group/group1/executor/e1", groupID: "group1", pool: "linux-amd64"},
+		{name: "disallowed pool", id: "spiffe://bb.example.com/group/group1/executor/e1", groupID: "group1", pool: "gpu", wantErr: status.IsPermissionDeniedError},
+		{name: "other group", id: "spiffe://bb.example.com/group/group1/executor/e1", groupID: "group2", pool: "", wantErr: status.IsPermissionDeniedError},
+		{name: "external identity", id: "spiffe://spire.example.com/ns/gpu/worker", groupID: "group2", pool: "gpu"},
+		{name: "no matching rule", id: "spiffe://spire.example.com/ns/ci/worker", groupID: "group2", pool: "gpu", wantErr: status.IsPermissionDeniedError},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := contextWithPeerID(t, tc.id)
+			err := s.checkExecutorIdentity(ctx, tc.groupID, tc.pool)
+			if tc.wantErr == nil {
+				require.NoError(t, err)
+			} else {
+				require.True(t, tc.wantErr(err), "unexpected error: %v", err)
+			}
+		})
+	}
+
+	// Certificates of the built-in CA are bound to their group even if
+	// executors don't need an API key.
+	s.requireExecutorAuthorization = false
+	err := s.checkExecutorIdentity(contextWithPeerID(t, "spiffe://bb.example.com/group/group1/executor/e1"), "", "")
+	require.True(t, status.IsPermissionDeniedError(err), "unexpected error: %v", err)
+
+	s.requireExecutorIdentity = true
+	err = s.checkExecutorIdentity(contextWithPeerID(t, ""), "group1", "")
+	require.True(t, status.IsUnauthenticatedError(err), "unexpected error: %v", err)
+
+	flags.Set(t, "remote_execution.executor_identity_rules", []ExecutorIdentityRule{})
+	err = s.checkExecutorIdentity(contextWithPeerID(t, "spiffe://spire.example.com/ns/ci/worker"), "group1", "gpu")
+	require.NoError(t, err)
+}
+
+func TestIssueExecutorCertificateRequiresAuthorizationWithIdentities(t *testing.T) {
+	flags.Set(t, "ssl.enable_ssl", true)
+	flags.Set(t, "ssl.spiffe_trust_domain", "bb.example.com")
+	env := testenv.GetTestEnv(t)
+	env.SetSSLService(&ssl.SSLService{AuthorityCert: &x509.Certificate{}, AuthorityKey: &rsa.PrivateKey{}})
+	s := &SchedulerServer{env: env}
+	req := &scpb.IssueExecutorCertificateRequest{ExecutorId: "e1"}
+
+	flags.Set(t, "remote_execution.executor_identity_rules", []ExecutorIdentityRule{
+		{SPIFFEID: "spiffe://bb.example.com/executor/*", Pools: []string{"gpu"}},
+	})
+	_, err := s.IssueExecutorCertificate(context.Background(), req)
+	require.True(t, status.IsFailedPreconditionError(err), "unexpected error: %v", err)
+
+	flags.Set(t, "remote_execution.executor_identity_rules", []ExecutorIdentityRule{})
+	s.requireExecutorIdentity = true
+	_, err = s.IssueExecutorCertificate(context.Background(), req)
+	require.True(t, status.IsFailedPreconditionError(err), "unexpected error: %v", err)
+}
+
+func TestCheckLeaseIdentity(t *testing.T) {
+	flags.Set(t, "ssl.spiffe_trust_domain", "bb.example.com")
+	flags.Set(t, "remote_execution.executor_identity_rules", []ExecutorIdentityRule{
+		{SPIFFEID: "spiffe://bb.example.com/group/group1/executor/*", Pools: []string{"linux"}},
+		{SPIFFEID: "spiffe://spire.example.com/ns/gpu/*", Pools: []string{"gpu"}},
+	})
+	env, ctx := getEnv(t, &schedulerOpts{}, "user1")
+	env.SetSSLService(&ssl.SSLService{})
+	s := env.GetSchedulerService().(*SchedulerServer)
+	s.requireExecutorAuthorization = true
+
+	insertTask := func(groupID, pool string) string {
+		taskID := uuid.New().String()
+		err := s.insertTask(ctx, taskID, &scpb.SchedulingMetadata{ExecutorGroupId: groupID, Pool: pool}, []byte("task"))
+		require.NoError(t, err)
+		return taskID
+	}
+	linuxTask := insertTask("group1", "linux")
+	otherGroupTask := insertTask("group2", "linux")
+	gpuTask := insertTask("group2", "gpu")
+	unrestrictedTask := insertTask("group3", "other")
+
+	// Executors register certificates for the ID they lease tasks with,
+	// which is distinct from their host ID.
+	hostID := "host-1"
+	executorID := "5f0c0b8e-9a43-4b2e-8d1f-2f1d8e2c6a7b"
+	issuedID := "spiffe://bb.example.com/group/group1/executor/" + executorID
+
+	for _, tc := range []struct {
+		name       string
+		id         string
+		executorID string
+		taskID     string
+		wantErr    func(error) bool
+	}{
+		{name: "no identity", executorID: executorID, taskID: unrestrictedTask},
+		{name: "no identity for task with rules", executorID: executorID, taskID: gpuTask, wantErr: status.IsUnauthenticatedError},
+		{name: "issued identity", id: issuedID, executorID: executorID, taskID: linuxTask},
+		{name: "issued identity with host ID", id: issuedID, executorID: hostID, taskID: linuxTask, wantErr: status.IsPermissionDeniedError},
+		{name: "issued to another executor", id: issuedID, executorID: "e2", taskID: linuxTask, wantErr: status.IsPermissionDeniedError},
+		{name: "missing executor ID", id: issuedID, executorID: "", taskID: linuxTask, wantErr: status.IsPermissionDeniedError},
+		{name: "task of another group", id: issuedID, executorID: executorID, taskID: otherGroupTask, wantErr: status.IsPermissionDeniedError},
+		{name: "task in disallowed pool", id: issuedID, executorID: executorID, taskID: gpuTask, wantErr: status.IsPermissionDeniedError},
+		{name: "external identity", id: "spiffe://spire.example.com/ns/gpu/worker", executorID: "e3", taskID: gpuTask},
+		{name: "external identity in disallowed pool", id: "spiffe://spire.example.com/ns/gpu/worker", executorID: "e3", taskID: otherGroupTask, wantErr: status.IsPermissionDeniedError},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := s.checkLeaseIdentity(contextWithPeerID(t, tc.id), tc.executorID, tc.taskID)
+			if tc.wantErr == nil {
+				require.NoError(t, err)
+			} else {
+				require.True(t, tc.wantErr(err), "unexpected error: %v", err)
+			}
+		})
+	}
+
+	s.requireExecutorIdentity = true
+	err := s.checkLeaseIdentity(contextWithPeerID(t, ""), executorID, unrestrictedTask)
+	require.True(t, status.IsUnauthenticatedError(err), "unexpected error: %v", err)
+}
+
+// contextWithPeerID returns a context for a gRPC peer that presented a
+// verified certificate with the given SPIFFE ID.
+func contextWithPeerID(t *testing.T, id string) context.Context {
+	p := &peer.Peer{Addr: &net.TCPAddr{}}
+	if id != "" {
+		u, err := url.Parse(id)
+		require.NoError(t, err)
+		p.AuthInfo = credentials.TLSInfo{State: tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{{URIs: []*url.URL{u}}}},
+		}}
+	}
+	return peer.NewContext(context.Background(), p)
+}
+
+func TestTaskRetryBackoff(t *testing.T) {
+	flags.Set(t, "remote_execution.task_retry_initial_backoff", 1*time.Second)
+	flags.Set(t, "remote_execution.task_retry_max_backoff", 5*time.Second)
+	require.Equal(t, time.Duration(0), taskRetryBackoff(0))
+	require.Equal(t, 1*time.Second, taskRetryBackoff(1))
+	require.Equal(t, 2*time.Second, taskRetryBackoff(2))
+	require.Equal(t, 4*time.Second, taskRetryBackoff(3))
+	require.Equal(t, 5*time.Second, taskRetryBackoff(4))
+	require.Equal(t, 5*time.Second, taskRetryBackoff(100))
+
+	flags.Set(t, "remote_execution.task_retry_initial_backoff", time.Duration(0))
+	require.Equal(t, time.Duration(0), taskRetryBackoff(3))
+}
+
+func TestDeprioritizeExecutors(t *testing.T) {
+	var nodes []interfaces.RankedExecutionNode
+	for _, id := range []string{"e1", "e2", "e3", "e4"} {
+		nodes = append(nodes, fakeRankedNode{node: &executionNode{ExecutionNode: &scpb.ExecutionNode{ExecutorId: id}}})
+	}
+	ids := func(nodes []interfaces.RankedExecutionNode) []string {
+		var ids []string
+		for _, n := range nodes {
+			ids = append(ids, n.GetExecutionNode().GetExecutorId())
+		}
+		return ids
+	}
+	require.Equal(t, []string{"e1", "e2", "e3", "e4"}, ids(deprioritizeExecutors(nodes, nil)))
+	require.Equal(t, []string{"e2", "e4", "e1", "e3"}, ids(deprioritizeExecutors(nodes, []string{"e3", "e1"})))
+	require.Equal(t, []string{"e1", "e2", "e3", "e4"}, ids(deprioritizeExecutors(nodes, []string{"unknown"})))
+}
+
+func TestExcludeExecutors(t *testing.T) {
+	var nodes []*executionNode
+	for _, id := range []string{"e1", "e2", "e3"} {
+		nodes = append(nodes, &executionNode{ExecutionNode: &scpb.ExecutionNode{ExecutorId: id}})
+	}
+	ids := func(nodes []*executionNode) []string {
+		var ids []string
+		for _, n := range nodes {
+			ids = append(ids, n.GetExecutorId())
+		}
+		return ids
+	}
+	require.Equal(t, []string{"e1", "e2", "e3"}, ids(excludeExecutors(nodes, nil)))
+	require.Equal(t, []string{"e2"}, ids(excludeExecutors(nodes, []string{"e3", "e1"})))
+	require.Empty(t, excludeExecutors(nodes, []string{"e1", "e2", "e3"}))
+}
+
+func TestPreferAppRegion(t *testing.T) {
+	var nodes []interfaces.RankedExecutionNode
+	for _, n := range []*scpb.ExecutionNode{
+		{ExecutorId: "e1", Region: "us-east1"},
+		{ExecutorId: "e2", Region: "us-west1"},
+		{ExecutorId: "e3"},
+		{ExecutorId: "e4", Region: "us-west1"},
+	} {
+		nodes = append(nodes, fakeRankedNode{node: &executionNode{ExecutionNode: n}})
+	}
+	ids := func(nodes []interfaces.RankedExecutionNode) []string {
+		var ids []string
+		for _, n := range nodes {
+			ids = append(ids, n.GetExecutionNode().GetExecutorId())
+		}
+		return ids
+	}
+	// Without an app region, the ranking is unchanged.
+	require.Equal(t, []string{"e1", "e2", "e3", "e4"}, ids(preferAppRegion(nodes)))
+	require.Zero(t, getCrossRegionSchedulingDelay(nodes[0].GetExecutionNode().(*executionNode).ExecutionNode, true))
+
+	flags.Set(t, "remote_execution.region", "US-West1")
+	flags.Set(t, "remote_execution.cross_region_scheduling_delay", 2*time.Second)
+	require.Equal(t, []string{"e2", "e4", "e1", "e3"}, ids(preferAppRegion(nodes)))
+
+	east := nodes[0].GetExecutionNode().(*executionNode).ExecutionNode
+	west := nodes[1].GetExecutionNode().(*executionNode).ExecutionNode
+	require.Equal(t, 2*time.Second, getCrossRegionSchedulingDelay(east, true))
+	require.Zero(t, getCrossRegionSchedulingDelay(east, false))
+	require.Zero(t, getCrossRegionSchedulingDelay(west, true))
+}
+
+func TestLoadShedding(t *testing.T) {
+	flags.Set(t, "remote_execution.load_shedding_max_queued_tasks", int64(2))
+	flags.Set(t, "remote_execution.load_shedding_retry_delay", 10*time.Second)
+	env, ctx := getEnv(t, &schedulerOpts{}, "user1")
+	al := testauditlog.New(t)
+	env.SetAuditLogger(al)
+
+	fe := newFakeExecutor(ctx, t, env.GetSchedulerClient())
+	fe.Register()
+
+	taskID1 := scheduleTask(ctx, t, env, map[string]string{})
+	taskID2 := scheduleTask(ctx, t, env, map[string]string{})
+	fe.WaitForTask(taskID1)
+	fe.WaitForTask(taskID2)
+	require.Empty(t, al.GetAllEntries())
+
+	// The pool is saturated, so new tasks are shed.
+	taskBytes, err := proto.Marshal(&repb.ExecutionTask{ExecutionId: "shed"})
+	require.NoError(t, err)
+	_, err = env.GetSchedulerService().ScheduleTask(ctx, &scpb.ScheduleTaskRequest{
+		TaskId: "shed",
+		Metadata: &scpb.SchedulingMetadata{
+			Os:          defaultOS,
+			Arch:        defaultArch,
+			TaskSize:    &scpb.TaskSize{EstimatedMemoryBytes: 100, EstimatedMilliCpu: 100},
+			TaskGroupId: "group1",
+		},
+		SerializedTask: taskBytes,
+	})
+	require.True(t, status.IsResourceExhaustedError(err), "expected ResourceExhausted, got %v", err)
+	var retryDelay time.Duration
+	for _, d := range gstatus.Convert(err).Details() {
+		if info, ok := d.(*errdetails.RetryInfo); ok {
+			retryDelay = info.GetRetryDelay().AsDuration()
+		}
+	}
+	require.Equal(t, 10*time.Second, retryDelay)
+
+	// The decision is recorded in the group's audit log.
+	entries := al.GetAllEntries()
+	require.Len(t, entries, 1)
+	require.Equal(t, alpb.Action_QUEUE_TIME_SLO_DECISION, entries[0].Action)
+	require.Equal(t, "group1", entries[0].Resource.GetId())
+	decision := entries[0].Request.(*scpb.QueueTimeSLODecision)
+	require.Equal(t, scpb.QueueTimeSLODecision_SHED, decision.GetDecision())
+	require.Equal(t, "shed", decision.GetTaskId())
+	require.Equal(t, int64(2), decision.GetQueuedTaskCount())
+
+	// Once a task is claimed, there's room for new tasks again.
+	fe.Claim(taskID1)
+	scheduleTask(ctx, t, env, map[string]string{})
+}
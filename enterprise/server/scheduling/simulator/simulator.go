@@ -0,0 +1,376 @@
+// Package simulator replays recorded task submissions against alternative
+// scheduler configurations, so that capacity changes (such as resizing
+// executor pools, or changing how tasks are routed to executors) can be
+// evaluated offline.
+//
+// Executors are modeled the same way that the scheduler and executors work:
+// each task is enqueued on a few executors in its pool, and each executor
+// runs the tasks in its queue in FIFO order whenever it has enough free CPU
+// and memory for the task at the head of the queue. The first executor to
+// start a task runs it, and the task is skipped by the other executors. Tasks
+// are assumed to take as long to run as they did when they were recorded.
+package simulator
+
+import (
+	"bufio"
+	"cmp"
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/tasksize"
+	"github.com/buildbuddy-io/buildbuddy/server/util/histogram"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+// RoutingPolicy determines which executors a task is enqueued on.
+type RoutingPolicy string
+
+const (
+	// RandomRouting enqueues each task on executors chosen at random, which
+	// is what the scheduler does.
+	RandomRouting RoutingPolicy = "random"
+
+	// LeastLoadedRouting enqueues each task on the executors with the fewest
+	// queued and running tasks.
+	LeastLoadedRouting RoutingPolicy = "least_loaded"
+
+	// The number of executors that each task is enqueued on by default,
+	// which matches the scheduler.
+	defaultProbes = 3
+)
+
+// Task is a recorded task submission.
+//
+// The JSON field names match the columns of the Executions table in
+// ClickHouse, so that tasks can be exported from production with a query like:
+//
+//	SELECT queued_timestamp_usec, worker_start_timestamp_usec,
+//	  worker_completed_timestamp_usec, estimated_milli_cpu,
+//	  estimated_memory_bytes
+//	FROM Executions
+//	WHERE ...
+//	FORMAT JSONEachRow
+//	SETTINGS output_format_json_quote_64bit_integers = 0
+//
+// Executions don't record their pool, so exported tasks are simulated on the
+// default pool unless a pool is added to each task.
+type Task struct {
+	Pool                         string `json:"pool"`
+	QueuedTimestampUsec          int64  `json:"queued_timestamp_usec"`
+	WorkerStartTimestampUsec     int64  `json:"worker_start_timestamp_usec"`
+	WorkerCompletedTimestampUsec int64  `json:"worker_completed_timestamp_usec"`
+	EstimatedMilliCPU            int64  `json:"estimated_milli_cpu"`
+	EstimatedMemoryBytes         int64  `json:"estimated_memory_bytes"`
+}
+
+// ReadTasks reads tasks in JSON lines format.
+func ReadTasks(r io.Reader) ([]*Task, error) {
+	var tasks []*Task
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1024*1024)
+	for line := 1; s.Scan(); line++ {
+		if strings.TrimSpace(s.Text()) == "" {
+			continue
+		}
+		t := &Task{}
+		if err := json.Unmarshal(s.Bytes(), t); err != nil {
+			return nil, status.InvalidArgumentErrorf("line %d: %s", line, err)
+		}
+		tasks = append(tasks, t)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+// PoolConfig configures the executors in a pool.
+type PoolConfig struct {
+	// Name is the name of the pool. The default pool has an empty name.
+	Name string `yaml:"name"`
+
+	// Executors is the number of executors in the pool.
+	Executors int `yaml:"executors"`
+
+	// MilliCPU and MemoryBytes are the resources of each executor.
+	MilliCPU    int64 `yaml:"milli_cpu"`
+	MemoryBytes int64 `yaml:"memory_bytes"`
+}
+
+// Config is a scheduler configuration to simulate.
+type Config struct {
+	Pools []PoolConfig `yaml:"pools"`
+
+	// Routing determines which executors each task is enqueued on. Defaults
+	// to RandomRouting.
+	Routing RoutingPolicy `yaml:"routing"`
+
+	// Probes is the number of executors that each task is enqueued on.
+	// Defaults to 3.
+	Probes int `yaml:"probes"`
+
+	// Seed seeds the random choices made by the simulation, so that runs are
+	// reproducible.
+	Seed uint64 `yaml:"seed"`
+}
+
+// PoolReport summarizes the simulated queue times of a pool's tasks.
+type PoolReport struct {
+	Name string
+
+	// Tasks is the number of tasks that were run.
+	Tasks int
+
+	// Unschedulable is the number of tasks that were too large to run on any
+	// executor in the pool, or whose pool isn't configured.
+	Unschedulable int
+
+	// Simulated queue times, in microseconds.
+	QueueTimes *histogram.Histogram
+
+	// Recorded queue times, in microseconds, for comparison.
+	RecordedQueueTimes *histogram.Histogram
+}
+
+// Report is the result of a simulation.
+type Report struct {
+	Pools []*PoolReport
+}
+
+// Write writes a human-readable summary of the report.
+func (r *Report) Write(w io.Writer) error {
+	for _, p := range r.Pools {
+		name := p.Name
+		if name == "" {
+			name = "(default)"
+		}
+		simulated := p.QueueTimes.Percentiles()
+		recorded := p.RecordedQueueTimes.Percentiles()
+		_, err := fmt.Fprintf(w, `Pool %s: %d tasks, %d unschedulable
+  Simulated queue time: p50=%s p95=%s p99=%s
+  Recorded queue time:  p50=%s p95=%s p99=%s
+
+Simulated queue time distribution (usec):
+%s
+`,
+			name, p.Tasks, p.Unschedulable,
+			usec(simulated.P50), usec(simulated.P95), usec(simulated.P99),
+			usec(recorded.P50), usec(recorded.P95), usec(recorded.P99),
+			p.QueueTimes)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func usec(v int64) time.Duration {
+	return time.Duration(v) * time.Microsecond
+}
+
+// Run simulates running the tasks using the given configuration.
+func Run(cfg *Config, tasks []*Task) (*Report, error) {
+	routing := cmp.Or(cfg.Routing, RandomRouting)
+	if routing != RandomRouting && routing != LeastLoadedRouting {
+		return nil, status.InvalidArgumentErrorf("unknown routing policy %q", routing)
+	}
+	probes := cmp.Or(cfg.Probes, defaultProbes)
+	rng := rand.New(rand.NewPCG(cfg.Seed, cfg.Seed))
+
+	// Pools don't share executors, so they can be simulated independently.
+	tasksByPool := map[string][]*Task{}
+	for _, t := range tasks {
+		tasksByPool[t.Pool] = append(tasksByPool[t.Pool], t)
+	}
+	report := &Report{}
+	for _, poolCfg := range cfg.Pools {
+		if poolCfg.Executors <= 0 {
+			return nil, status.InvalidArgumentErrorf("pool %q must have at least one executor", poolCfg.Name)
+		}
+		p := &pool{
+			routing: routing,
+			probes:  min(probes, poolCfg.Executors),
+			rng:     rng,
+			report:  newPoolReport(poolCfg.Name),
+		}
+		for range poolCfg.Executors {
+			p.executors = append(p.executors, &executor{
+				freeMilliCPU:    poolCfg.MilliCPU,
+				freeMemoryBytes: poolCfg.MemoryBytes,
+			})
+		}
+		p.run(poolCfg, tasksByPool[poolCfg.Name])
+		report.Pools = append(report.Pools, p.report)
+		delete(tasksByPool, poolCfg.Name)
+	}
+	// Report tasks on unconfigured pools as unschedulable.
+	for _, name := range slices.Sorted(maps.Keys(tasksByPool)) {
+		pr := newPoolReport(name)
+		pr.Unschedulable = len(tasksByPool[name])
+		report.Pools = append(report.Pools, pr)
+	}
+	return report, nil
+}
+
+func newPoolReport(name string) *PoolReport {
+	return &PoolReport{
+		Name:               name,
+		QueueTimes:         histogram.New(),
+		RecordedQueueTimes: histogram.New(),
+	}
+}
+
+// simTask is a task being simulated.
+type simTask struct {
+	submitUsec   int64
+	durationUsec int64
+	milliCPU     int64
+	memoryBytes  int64
+	started      bool
+}
+
+type executor struct {
+	freeMilliCPU    int64
+	freeMemoryBytes int64
+	running         int
+	queue           []*simTask
+}
+
+func (e *executor) load() int {
+	return e.running + len(e.queue)
+}
+
+// startTasks starts tasks from the head of the executor's queue until the
+// task at the head doesn't fit, and returns the started tasks.
+func (e *executor) startTasks() []*simTask {
+	var started []*simTask
+	for len(e.queue) > 0 {
+		t := e.queue[0]
+		if t.started {
+			// Another executor already started the task.
+			e.queue = e.queue[1:]
+			continue
+		}
+		if t.milliCPU > e.freeMilliCPU || t.memoryBytes > e.freeMemoryBytes {
+			break
+		}
+		e.queue = e.queue[1:]
+		t.started = true
+		e.freeMilliCPU -= t.milliCPU
+		e.freeMemoryBytes -= t.memoryBytes
+		e.running++
+		started = append(started, t)
+	}
+	return started
+}
+
+// completion is a running task, which completes at endUsec.
+type completion struct {
+	endUsec  int64
+	task     *simTask
+	executor *executor
+}
+
+type completionHeap []*completion
+
+func (h completionHeap) Len() int           { return len(h) }
+func (h completionHeap) Less(i, j int) bool { return h[i].endUsec < h[j].endUsec }
+func (h completionHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *completionHeap) Push(x any)        { *h = append(*h, x.(*completion)) }
+func (h *completionHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+type pool struct {
+	routing   RoutingPolicy
+	probes    int
+	rng       *rand.Rand
+	executors []*executor
+	running   completionHeap
+	report    *PoolReport
+}
+
+func (p *pool) run(cfg PoolConfig, tasks []*Task) {
+	simTasks := make([]*simTask, 0, len(tasks))
+	for _, t := range tasks {
+		st := &simTask{
+			submitUsec:   t.QueuedTimestampUsec,
+			durationUsec: max(0, t.WorkerCompletedTimestampUsec-t.WorkerStartTimestampUsec),
+			milliCPU:     cmp.Or(t.EstimatedMilliCPU, tasksize.DefaultCPUEstimate),
+			memoryBytes:  cmp.Or(t.EstimatedMemoryBytes, tasksize.DefaultMemEstimate),
+		}
+		if st.milliCPU > cfg.MilliCPU || st.memoryBytes > cfg.MemoryBytes {
+			p.report.Unschedulable++
+			continue
+		}
+		if t.WorkerStartTimestampUsec >= t.QueuedTimestampUsec {
+			p.report.RecordedQueueTimes.Add(t.WorkerStartTimestampUsec - t.QueuedTimestampUsec)
+		}
+		simTasks = append(simTasks, st)
+	}
+	slices.SortStableFunc(simTasks, func(a, b *simTask) int {
+		return cmp.Compare(a.submitUsec, b.submitUsec)
+	})
+
+	for len(simTasks) > 0 || len(p.running) > 0 {
+		// Complete running tasks before submitting tasks at the same time,
+		// since completions free up resources.
+		if len(p.running) > 0 && (len(simTasks) == 0 || p.running[0].endUsec <= simTasks[0].submitUsec) {
+			c := heap.Pop(&p.running).(*completion)
+			e := c.executor
+			e.freeMilliCPU += c.task.milliCPU
+			e.freeMemoryBytes += c.task.memoryBytes
+			e.running--
+			p.startTasks(c.endUsec, e)
+			continue
+		}
+		t := simTasks[0]
+		simTasks = simTasks[1:]
+		for _, e := range p.route() {
+			e.queue = append(e.queue, t)
+			p.startTasks(t.submitUsec, e)
+		}
+	}
+}
+
+func (p *pool) startTasks(nowUsec int64, e *executor) {
+	for _, t := range e.startTasks() {
+		p.report.Tasks++
+		p.report.QueueTimes.Add(nowUsec - t.submitUsec)
+		heap.Push(&p.running, &completion{
+			endUsec:  nowUsec + t.durationUsec,
+			task:     t,
+			executor: e,
+		})
+	}
+}
+
+// route returns the executors that a task should be enqueued on.
+func (p *pool) route() []*executor {
+	if p.routing == LeastLoadedRouting {
+		executors := slices.Clone(p.executors)
+		// Shuffle first so that ties are broken at random.
+		p.rng.Shuffle(len(executors), func(i, j int) {
+			executors[i], executors[j] = executors[j], executors[i]
+		})
+		slices.SortStableFunc(executors, func(a, b *executor) int {
+			return cmp.Compare(a.load(), b.load())
+		})
+		return executors[:p.probes]
+	}
+	executors := make([]*executor, 0, p.probes)
+	for _, i := range p.rng.Perm(len(p.executors))[:p.probes] {
+		executors = append(executors, p.executors[i])
+	}
+	return executors
+}
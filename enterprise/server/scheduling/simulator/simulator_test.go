@@ -0,0 +1,110 @@
+package simulator_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/simulator"
+	"github.com/stretchr/testify/require"
+)
+
+func task(pool string, submitSec, durationSec, milliCPU int64) *simulator.Task {
+	return &simulator.Task{
+		Pool:                         pool,
+		QueuedTimestampUsec:          submitSec * 1e6,
+		WorkerStartTimestampUsec:     submitSec * 1e6,
+		WorkerCompletedTimestampUsec: (submitSec + durationSec) * 1e6,
+		EstimatedMilliCPU:            milliCPU,
+		EstimatedMemoryBytes:         1e9,
+	}
+}
+
+func TestReadTasks(t *testing.T) {
+	tasks, err := simulator.ReadTasks(strings.NewReader(`{"queued_timestamp_usec":1000000,"worker_start_timestamp_usec":1000000,"worker_completed_timestamp_usec":3000000,"estimated_milli_cpu":1000,"estimated_memory_bytes":1000000000}
+
+{"pool":"gpu","queued_timestamp_usec":2000000,"worker_start_timestamp_usec":2000000,"worker_completed_timestamp_usec":4000000,"estimated_milli_cpu":1000,"estimated_memory_bytes":1000000000}
+`))
+	require.NoError(t, err)
+	require.Equal(t, []*simulator.Task{task("", 1, 2, 1000), task("gpu", 2, 2, 1000)}, tasks)
+
+	_, err = simulator.ReadTasks(strings.NewReader("not json\n"))
+	require.Error(t, err)
+}
+
+func TestRun(t *testing.T) {
+	// Four tasks using a whole executor each, submitted at the same time.
+	tasks := []*simulator.Task{
+		task("", 0, 10, 4000),
+		task("", 0, 10, 4000),
+		task("", 0, 10, 4000),
+		task("", 0, 10, 4000),
+	}
+	for _, tc := range []struct {
+		name      string
+		executors int
+		// Simulated median queue time, in seconds.
+		wantP50 int64
+	}{
+		{name: "enough executors", executors: 4, wantP50: 0},
+		{name: "too few executors", executors: 2, wantP50: 0},
+		{name: "one executor", executors: 1, wantP50: 10},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			report, err := simulator.Run(&simulator.Config{
+				Pools: []simulator.PoolConfig{
+					{Executors: tc.executors, MilliCPU: 4000, MemoryBytes: 16e9},
+				},
+				Routing: simulator.LeastLoadedRouting,
+			}, tasks)
+			require.NoError(t, err)
+			require.Len(t, report.Pools, 1)
+			p := report.Pools[0]
+			require.Equal(t, 4, p.Tasks)
+			require.Equal(t, 0, p.Unschedulable)
+			require.Equal(t, tc.wantP50*1e6, p.QueueTimes.Percentiles().P50)
+		})
+	}
+}
+
+func TestRun_Unschedulable(t *testing.T) {
+	report, err := simulator.Run(&simulator.Config{
+		Pools: []simulator.PoolConfig{
+			{Executors: 2, MilliCPU: 4000, MemoryBytes: 16e9},
+		},
+	}, []*simulator.Task{
+		task("", 0, 10, 1000),
+		// Too large for the pool's executors.
+		task("", 0, 10, 8000),
+		// On a pool that isn't configured.
+		task("gpu", 0, 10, 1000),
+	})
+	require.NoError(t, err)
+	require.Len(t, report.Pools, 2)
+	require.Equal(t, "", report.Pools[0].Name)
+	require.Equal(t, 1, report.Pools[0].Tasks)
+	require.Equal(t, 1, report.Pools[0].Unschedulable)
+	require.Equal(t, "gpu", report.Pools[1].Name)
+	require.Equal(t, 0, report.Pools[1].Tasks)
+	require.Equal(t, 1, report.Pools[1].Unschedulable)
+}
+
+func TestRun_RandomRoutingIsReproducible(t *testing.T) {
+	var tasks []*simulator.Task
+	for i := range int64(100) {
+		tasks = append(tasks, task("", i, 5, 2000))
+	}
+	cfg := &simulator.Config{
+		Pools: []simulator.PoolConfig{
+			{Executors: 4, MilliCPU: 4000, MemoryBytes: 16e9},
+		},
+		Routing: simulator.RandomRouting,
+		Probes:  2,
+		Seed:    42,
+	}
+	r1, err := simulator.Run(cfg, tasks)
+	require.NoError(t, err)
+	r2, err := simulator.Run(cfg, tasks)
+	require.NoError(t, err)
+	require.Equal(t, r1.Pools[0].QueueTimes.Percentiles(), r2.Pools[0].QueueTimes.Percentiles())
+	require.Equal(t, 100, r1.Pools[0].Tasks)
+}
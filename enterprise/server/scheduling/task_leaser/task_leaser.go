@@ -39,6 +39,8 @@ type TaskLeaser struct {
 	stream            scpb.Scheduler_LeaseTaskClient
 	ttl               time.Duration
 	cancelFunc        context.CancelFunc
+	hotInputs         []*scpb.TaskInput
+	accessedInputs    []*scpb.TaskInput
 }
 
 func NewTaskLeaser(env environment.Env, executorID string, taskID string) *TaskLeaser {
@@ -108,6 +110,9 @@ func (t *TaskLeaser) pingServer(ctx context.Context) (b []byte, err error) {
 	if rsp.GetLeaseId() != "" {
 		t.leaseID = rsp.GetLeaseId()
 	}
+	if len(rsp.GetHotInputs()) > 0 {
+		t.hotInputs = rsp.GetHotInputs()
+	}
 	t.ttl = time.Duration(rsp.GetLeaseDurationSeconds()) * time.Second
 	return rsp.GetSerializedTask(), nil
 }
@@ -165,6 +170,22 @@ func (t *TaskLeaser) Claim(ctx context.Context) (context.Context, []byte, error)
 	return ctx, serializedTask, err
 }
 
+// HotInputs returns the inputs that the scheduler hinted the task is likely to
+// read. It must be called after Claim.
+func (t *TaskLeaser) HotInputs() []*scpb.TaskInput {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.hotInputs
+}
+
+// RecordAccessedInputs records the inputs that the task read, which are
+// reported to the scheduler when the task is finalized.
+func (t *TaskLeaser) RecordAccessedInputs(inputs []*scpb.TaskInput) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.accessedInputs = inputs
+}
+
 func (t *TaskLeaser) closed() bool {
 	select {
 	case <-t.quit:
@@ -195,6 +216,7 @@ func (t *TaskLeaser) Close(ctx context.Context, taskErr error, retry bool) {
 	// retried.
 	if taskErr == nil || !retry {
 		req.Finalize = true
+		req.AccessedInputs = t.accessedInputs
 	} else {
 		req.ReEnqueue = true
 		s, _ := gstatus.FromError(taskErr)
@@ -10,18 +10,24 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
 	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/util/hash"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
 )
 
 var (
 	affinityRoutingEnabled      = flag.Bool("executor.affinity_routing_enabled", true, "Enables affinity routing, which attempts to route actions to the executor that most recently ran that action.")
+	inputTreeRoutingEnabled     = flag.Bool("executor.input_tree_routing_enabled", false, "Enables input tree routing, which attempts to route actions that affinity routing can't place to the executor that most recently ran actions sharing the most top-level input directories, to maximize local file cache hits.")
 	defaultBranchRoutingEnabled = flag.Bool("remote_execution.workflow_default_branch_routing_enabled", false, "Enables default branch routing for workflows. When routing a workflow action, if there are no executors that ran that action for the same git branch, try to route it to an executor that ran the action for the same default branch.")
 )
 
@@ -41,6 +47,13 @@ const (
 	// set less than the number of probes so that we can autoscale the workflow
 	// executor pool effectively.
 	ciRunnerPreferredNodeLimit = 1
+
+	// The max number of top-level input directories of an action that are
+	// used for input tree routing.
+	inputTreeRoutingDirLimit = 50
+	// The max number of executor hosts tracked per top-level input directory
+	// for input tree routing.
+	inputTreeRoutingHostLimit = 3
 )
 
 type taskRouter struct {
@@ -110,19 +123,6 @@ func (tr *taskRouter) RankNodes(ctx context.Context, action *repb.Action, cmd *r
 	})
 
 	params := getRoutingParams(ctx, tr.env, action, cmd, remoteInstanceName)
-	strategy := tr.selectRouter(params)
-	if strategy == nil {
-		return nonePreferred(nodes)
-	}
-
-	preferredNodeLimit, routingKeys, err := strategy.RoutingInfo(params)
-	if err != nil {
-		log.Errorf("Failed to compute routing info: %s", err)
-		return nonePreferred(nodes)
-	}
-	if preferredNodeLimit == 0 {
-		return nonePreferred(nodes)
-	}
 
 	// Note: if multiple executors live on the same host, the last one in the
 	// list wins. For now, this is fine because we don't recommend running
@@ -135,23 +135,70 @@ func (tr *taskRouter) RankNodes(ctx context.Context, action *repb.Action, cmd *r
 		nodeByHostID[node.GetExecutorHostId()] = node
 	}
 
+	preferred, err := tr.strategyPreferredNodes(ctx, params, nodeByHostID)
+	if err != nil {
+		log.Errorf("Failed to rank nodes: %s", err)
+		return nonePreferred(nodes)
+	}
+	// Fall back to input tree routing if the routing strategy doesn't prefer
+	// any of the nodes.
+	if len(preferred) == 0 && *inputTreeRoutingEnabled {
+		preferred = tr.inputTreePreferredNodes(ctx, action, params, nodeByHostID)
+	}
+	if len(preferred) == 0 {
+		return nonePreferred(nodes)
+	}
+
 	// Executor IDs of the nodes we've added to the front of the list so far.
 	preferredSet := map[string]struct{}{}
 	ranked := make([]interfaces.RankedExecutionNode, 0, len(nodes))
+	for _, node := range preferred {
+		preferredSet[node.GetExecutorId()] = struct{}{}
+		ranked = append(ranked, rankedExecutionNode{node: node, preferred: true})
+	}
+
+	// Randomly shuffle non-preferred nodes at the end of the ranking.
+	for _, node := range nodes {
+		if _, ok := preferredSet[node.GetExecutorId()]; ok {
+			continue
+		}
+		ranked = append(ranked, rankedExecutionNode{node: node})
+	}
+
+	return ranked
+}
+
+// strategyPreferredNodes returns the nodes preferred by the routing strategy
+// that applies to the given routing params, in order of preference.
+func (tr *taskRouter) strategyPreferredNodes(ctx context.Context, params routingParams, nodeByHostID map[string]interfaces.ExecutionNode) ([]interfaces.ExecutionNode, error) {
+	strategy := tr.selectRouter(params)
+	if strategy == nil {
+		return nil, nil
+	}
+
+	preferredNodeLimit, routingKeys, err := strategy.RoutingInfo(params)
+	if err != nil {
+		return nil, status.InternalErrorf("failed to compute routing info: %s", err)
+	}
+	if preferredNodeLimit == 0 {
+		return nil, nil
+	}
+
+	// Executor IDs of the nodes we've preferred so far.
+	preferredSet := map[string]struct{}{}
+	var preferred []interfaces.ExecutionNode
 
 	// Routing keys should be prioritized in the order they were returned
 	for _, routingKey := range routingKeys {
 		preferredHostIDs, err := tr.rdb.LRange(ctx, routingKey, 0, -1).Result()
 		if err != nil {
-			log.Errorf("Failed to rank nodes: redis LRANGE failed: %s", err)
-			return nonePreferred(nodes)
+			return nil, status.UnavailableErrorf("redis LRANGE failed: %s", err)
 		}
 
 		log.Debugf("Preferred executor host IDs for %q: %v", routingKey, preferredHostIDs)
 
-		// Place all preferred nodes first.
-		// For each routing key, preferred nodes should be prioritized in the order
-		// they appear in the Redis list.
+		// For each routing key, preferred nodes should be prioritized in the
+		// order they appear in the Redis list.
 		for _, hostID := range preferredHostIDs[:min(preferredNodeLimit, len(preferredHostIDs))] {
 			node := nodeByHostID[hostID]
 			if node == nil {
@@ -161,19 +208,10 @@ func (tr *taskRouter) RankNodes(ctx context.Context, action *repb.Action, cmd *r
 				continue
 			}
 			preferredSet[node.GetExecutorId()] = struct{}{}
-			ranked = append(ranked, rankedExecutionNode{node: node, preferred: true})
-		}
-	}
-
-	// Randomly shuffle non-preferred nodes at the end of the ranking.
-	for _, node := range nodes {
-		if _, ok := preferredSet[node.GetExecutorId()]; ok {
-			continue
+			preferred = append(preferred, node)
 		}
-		ranked = append(ranked, rankedExecutionNode{node: node})
 	}
-
-	return ranked
+	return preferred, nil
 }
 
 // MarkComplete updates the routing table after a task is completed, so that
@@ -181,6 +219,13 @@ func (tr *taskRouter) RankNodes(ctx context.Context, action *repb.Action, cmd *r
 // given node.
 func (tr *taskRouter) MarkComplete(ctx context.Context, action *repb.Action, cmd *repb.Command, remoteInstanceName, executorHostID string) {
 	params := getRoutingParams(ctx, tr.env, action, cmd, remoteInstanceName)
+	tr.markStrategyComplete(ctx, params, executorHostID)
+	if *inputTreeRoutingEnabled {
+		tr.markInputTreeComplete(ctx, action, params, executorHostID)
+	}
+}
+
+func (tr *taskRouter) markStrategyComplete(ctx context.Context, params routingParams, executorHostID string) {
 	strategy := tr.selectRouter(params)
 	if strategy == nil {
 		return
@@ -203,19 +248,138 @@ func (tr *taskRouter) MarkComplete(ctx context.Context, action *repb.Action, cmd
 	routingKey := routingKeys[0]
 
 	pipe := tr.rdb.TxPipeline()
+	pushPreferredHost(ctx, pipe, routingKey, executorHostID, preferredNodeLimit)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Errorf("Failed to mark task complete: redis pipeline failed: %s", err)
+		return
+	}
+
+	log.Debugf("Preferred executor host ID %q added to %q", executorHostID, routingKey)
+}
+
+// pushPreferredHost adds the executor host to the head of the list stored at
+// routingKey.
+func pushPreferredHost(ctx context.Context, pipe redis.Pipeliner, routingKey, executorHostID string, limit int) {
 	// Push the node to the head of the list (but first remove it if already
 	// present to avoid dupes), trim to max length to prevent it from growing
 	// too large, and renew the TTL.
 	pipe.LRem(ctx, routingKey, 1, executorHostID)
 	pipe.LPush(ctx, routingKey, executorHostID)
-	pipe.LTrim(ctx, routingKey, 0, int64(preferredNodeLimit)-1)
+	pipe.LTrim(ctx, routingKey, 0, int64(limit)-1)
 	pipe.Expire(ctx, routingKey, routingPropsKeyTTL)
-	if _, err := pipe.Exec(ctx); err != nil {
-		log.Errorf("Failed to mark task complete: redis pipeline failed: %s", err)
-		return
+}
+
+// An inputTreeRoutingKey is the routing key of one of an action's top-level
+// input directories.
+type inputTreeRoutingKey struct {
+	key string
+	// The size of the directory's Directory proto, which is used to weigh
+	// directories by the number of entries they contain.
+	weight int64
+}
+
+// inputTreeRoutingKeys returns the routing keys of the top-level directories
+// of the action's input tree.
+//
+// Top-level directories are identified by their digest rather than their
+// name, so actions sharing a directory tree (for example, the same external
+// repository) share its routing key even if the rest of their inputs differ.
+func (tr *taskRouter) inputTreeRoutingKeys(ctx context.Context, action *repb.Action, params routingParams) ([]inputTreeRoutingKey, error) {
+	cache := tr.env.GetCache()
+	rootDigest := action.GetInputRootDigest()
+	if cache == nil || rootDigest == nil {
+		return nil, nil
+	}
+	// The digest function isn't passed to the router, so infer it from the
+	// digest. Actions using digest functions that can't be inferred (such as
+	// BLAKE3) may not be routed by input tree.
+	rn := digest.NewResourceName(rootDigest, params.remoteInstanceName, rspb.CacheType_CAS, digest.InferOldStyleDigestFunctionInDesperation(rootDigest))
+	root := &repb.Directory{}
+	if err := cachetools.ReadProtoFromCAS(ctx, cache, rn, root); err != nil {
+		return nil, err
 	}
 
-	log.Debugf("Preferred executor host ID %q added to %q", executorHostID, routingKey)
+	parts := []string{"task_route_input_tree", params.groupID}
+	if params.remoteInstanceName != "" {
+		parts = append(parts, params.remoteInstanceName)
+	}
+	keys := make([]inputTreeRoutingKey, 0, min(len(root.GetDirectories()), inputTreeRoutingDirLimit))
+	for _, dir := range root.GetDirectories()[:min(len(root.GetDirectories()), inputTreeRoutingDirLimit)] {
+		keys = append(keys, inputTreeRoutingKey{
+			key:    strings.Join(append(parts, dir.GetDigest().GetHash()), "/"),
+			weight: dir.GetDigest().GetSizeBytes(),
+		})
+	}
+	return keys, nil
+}
+
+// inputTreePreferredNodes returns the node on the host that recently ran
+// actions sharing the largest part of the action's top-level input
+// directories, if any.
+func (tr *taskRouter) inputTreePreferredNodes(ctx context.Context, action *repb.Action, params routingParams, nodeByHostID map[string]interfaces.ExecutionNode) []interfaces.ExecutionNode {
+	keys, err := tr.inputTreeRoutingKeys(ctx, action, params)
+	if err != nil {
+		log.CtxDebugf(ctx, "Failed to compute input tree routing keys: %s", err)
+		return nil
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	pipe := tr.rdb.Pipeline()
+	cmds := make([]*redis.StringSliceCmd, 0, len(keys))
+	for _, k := range keys {
+		cmds = append(cmds, pipe.LRange(ctx, k.key, 0, -1))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		log.CtxWarningf(ctx, "Failed to rank nodes by input tree: redis pipeline failed: %s", err)
+		return nil
+	}
+
+	// Score each connected host by the total weight of the directories it
+	// recently ran actions with.
+	scores := map[string]int64{}
+	for i, cmd := range cmds {
+		for _, hostID := range cmd.Val() {
+			if _, ok := nodeByHostID[hostID]; ok {
+				scores[hostID] += max(keys[i].weight, 1)
+			}
+		}
+	}
+	bestHostID := ""
+	for hostID, score := range scores {
+		if score > scores[bestHostID] || (score == scores[bestHostID] && hostID < bestHostID) {
+			bestHostID = hostID
+		}
+	}
+	if bestHostID == "" {
+		metrics.RemoteExecutionInputTreeRoutedTaskCount.With(prometheus.Labels{
+			metrics.InputTreeRoutingStatusLabel: "no_match",
+		}).Inc()
+		return nil
+	}
+	metrics.RemoteExecutionInputTreeRoutedTaskCount.With(prometheus.Labels{
+		metrics.InputTreeRoutingStatusLabel: "preferred",
+	}).Inc()
+	return []interfaces.ExecutionNode{nodeByHostID[bestHostID]}
+}
+
+func (tr *taskRouter) markInputTreeComplete(ctx context.Context, action *repb.Action, params routingParams, executorHostID string) {
+	keys, err := tr.inputTreeRoutingKeys(ctx, action, params)
+	if err != nil {
+		log.CtxDebugf(ctx, "Failed to compute input tree routing keys: %s", err)
+		return
+	}
+	if len(keys) == 0 {
+		return
+	}
+	pipe := tr.rdb.TxPipeline()
+	for _, k := range keys {
+		pushPreferredHost(ctx, pipe, k.key, executorHostID, inputTreeRoutingHostLimit)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Errorf("Failed to mark task complete for input tree routing: redis pipeline failed: %s", err)
+	}
 }
 
 // Contains the parameters required to make a routing decision.
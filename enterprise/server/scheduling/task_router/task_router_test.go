@@ -3,6 +3,7 @@ package task_router_test
 import (
 	"context"
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/task_router"
@@ -10,6 +11,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/testredis"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
 	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 	"github.com/stretchr/testify/require"
@@ -415,6 +417,52 @@ func TestTaskRouter_WorkflowGitRefRouting_DefaultRef(t *testing.T) {
 	require.Equal(t, executorHostID1, ranked[0].GetExecutionNode().GetExecutorHostId())
 }
 
+func TestTaskRouter_InputTreeRouting(t *testing.T) {
+	flags.Set(t, "executor.input_tree_routing_enabled", true)
+	env := newTestEnv(t)
+	router := newTaskRouter(t, env)
+	nodes := sequentiallyNumberedNodes(100)
+	ctx := withAuthUser(t, context.Background(), env, "US1")
+	instanceName := "test-instance"
+	// Commands without outputs aren't routed by affinity routing.
+	cmd := &repb.Command{}
+
+	externalDir := &repb.DirectoryNode{Name: "external", Digest: &repb.Digest{Hash: strings.Repeat("a", 64), SizeBytes: 1000}}
+	srcDir := &repb.DirectoryNode{Name: "src", Digest: &repb.Digest{Hash: strings.Repeat("b", 64), SizeBytes: 10}}
+	otherSrcDir := &repb.DirectoryNode{Name: "src", Digest: &repb.Digest{Hash: strings.Repeat("c", 64), SizeBytes: 10}}
+	unrelatedDir := &repb.DirectoryNode{Name: "unrelated", Digest: &repb.Digest{Hash: strings.Repeat("d", 64), SizeBytes: 10}}
+	newAction := func(dirs ...*repb.DirectoryNode) *repb.Action {
+		d, err := cachetools.UploadProtoToCAS(ctx, env.GetCache(), instanceName, repb.DigestFunction_SHA256, &repb.Directory{Directories: dirs})
+		require.NoError(t, err)
+		return &repb.Action{InputRootDigest: d}
+	}
+
+	router.MarkComplete(ctx, newAction(externalDir, srcDir), cmd, instanceName, executorHostID1)
+	router.MarkComplete(ctx, newAction(otherSrcDir), cmd, instanceName, executorHostID2)
+
+	// Actions sharing the large external directory should be routed to
+	// executor 1, even if the rest of their inputs were last seen on executor
+	// 2.
+	ranked := router.RankNodes(ctx, newAction(externalDir, otherSrcDir), cmd, instanceName, nodes)
+	requireSameExecutionNodes(t, nodes, ranked)
+	require.Equal(t, executorHostID1, ranked[0].GetExecutionNode().GetExecutorHostId())
+	require.True(t, ranked[0].IsPreferred())
+	requireNonePreferred(t, ranked)
+
+	ranked = router.RankNodes(ctx, newAction(otherSrcDir), cmd, instanceName, nodes)
+	require.Equal(t, executorHostID2, ranked[0].GetExecutionNode().GetExecutorHostId())
+
+	// Actions that don't share any inputs shouldn't be routed.
+	ranked = router.RankNodes(ctx, newAction(unrelatedDir), cmd, instanceName, nodes)
+	requireSameExecutionNodes(t, nodes, ranked)
+	require.False(t, ranked[0].IsPreferred())
+
+	// Other groups shouldn't be routed using this group's input trees.
+	ctx2 := withAuthUser(t, context.Background(), env, "US2")
+	ranked = router.RankNodes(ctx2, newAction(externalDir, srcDir), cmd, instanceName, nodes)
+	require.False(t, ranked[0].IsPreferred())
+}
+
 func requireNonePreferred(t *testing.T, rankedNodes []interfaces.RankedExecutionNode) {
 	for i := 1; i < len(rankedNodes); i++ {
 		require.False(t, rankedNodes[i].IsPreferred())
@@ -0,0 +1,498 @@
+package scim
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/saml"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/role"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	grpb "github.com/buildbuddy-io/buildbuddy/proto/group"
+)
+
+const (
+	DisplayNameAttribute = "displayName"
+	ExternalIDAttribute  = "externalId"
+	MembersAttribute     = "members"
+)
+
+// Matches the path of patch operations that remove a single member, like
+// `members[value eq "US123"]`.
+var memberFilterPathRegexp = regexp.MustCompile(`^members\[value eq "([^"]+)"\]$`)
+
+func (s *SCIMServer) getSCIMGroup(ctx context.Context, g *tables.Group, id string) (*tables.SCIMGroup, error) {
+	sg := &tables.SCIMGroup{}
+	err := s.env.GetDBHandle().NewQuery(ctx, "scim_get_group").Raw(`
+		SELECT * FROM "SCIMGroups" WHERE scim_group_id = ? AND group_id = ?`,
+		id, g.GroupID,
+	).Take(sg)
+	if db.IsRecordNotFound(err) {
+		return nil, status.NotFoundErrorf("group %q not found", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sg, nil
+}
+
+// getMemberIDs returns the IDs of the members of the given SCIM group that
+// are still members of the org.
+func (s *SCIMServer) getMemberIDs(ctx context.Context, g *tables.Group, sg *tables.SCIMGroup) ([]string, error) {
+	rq := s.env.GetDBHandle().NewQuery(ctx, "scim_get_group_members").Raw(`
+		SELECT m.* FROM "SCIMGroupMembers" m
+		JOIN "UserGroups" ug ON ug.user_user_id = m.user_id
+		WHERE m.scim_group_id = ? AND ug.group_group_id = ? AND ug.membership_status = ?
+		ORDER BY m.user_id`,
+		sg.SCIMGroupID, g.GroupID, int32(grpb.GroupMembershipStatus_MEMBER),
+	)
+	var ids []string
+	err := db.ScanEach(rq, func(ctx context.Context, m *tables.SCIMGroupMember) error {
+		ids = append(ids, m.UserID)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (s *SCIMServer) toGroupResource(ctx context.Context, g *tables.Group, sg *tables.SCIMGroup) (*GroupResource, error) {
+	memberIDs, err := s.getMemberIDs(ctx, g, sg)
+	if err != nil {
+		return nil, err
+	}
+	gr := newGroupResource(sg)
+	for _, id := range memberIDs {
+		gr.Members = append(gr.Members, GroupMemberResource{Value: id})
+	}
+	return gr, nil
+}
+
+// checkMembers returns an error if any of the given users aren't members of
+// the org.
+func (s *SCIMServer) checkMembers(ctx context.Context, g *tables.Group, userIDs []string) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+	rq := s.env.GetDBHandle().NewQuery(ctx, "scim_check_group_members").Raw(`
+		SELECT * FROM "UserGroups"
+		WHERE group_group_id = ? AND membership_status = ? AND user_user_id IN ?`,
+		g.GroupID, int32(grpb.GroupMembershipStatus_MEMBER), userIDs,
+	)
+	members := make(map[string]struct{}, len(userIDs))
+	err := db.ScanEach(rq, func(ctx context.Context, ug *tables.UserGroup) error {
+		members[ug.UserUserID] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range userIDs {
+		if _, ok := members[id]; !ok {
+			return status.InvalidArgumentErrorf("user %q is not a member of the organization", id)
+		}
+	}
+	return nil
+}
+
+// replaceMembers replaces the members of the given SCIM group.
+func (s *SCIMServer) replaceMembers(ctx context.Context, tx interfaces.DB, sg *tables.SCIMGroup, userIDs []string) error {
+	err := tx.NewQuery(ctx, "scim_delete_group_members").Raw(`
+		DELETE FROM "SCIMGroupMembers" WHERE scim_group_id = ?`, sg.SCIMGroupID,
+	).Exec().Error
+	if err != nil {
+		return err
+	}
+	for _, id := range userIDs {
+		m := &tables.SCIMGroupMember{SCIMGroupID: sg.SCIMGroupID, UserID: id}
+		if err := tx.NewQuery(ctx, "scim_add_group_member").Create(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyGroupRoles updates the roles of the given users in the org according
+// to the SCIM groups that they are members of and the
+// auth.saml.group_mappings of the org. Users who aren't in any mapped group
+// get the default role. Roles are left as they are if the org doesn't map
+// any groups to roles.
+func (s *SCIMServer) applyGroupRoles(ctx context.Context, g *tables.Group, userIDs []string) error {
+	if !saml.HasGroupMappings(g.URLIdentifier) {
+		return nil
+	}
+	var updates []*grpb.UpdateGroupUsersRequest_Update
+	for _, id := range userIDs {
+		rq := s.env.GetDBHandle().NewQuery(ctx, "scim_get_user_groups").Raw(`
+			SELECT sg.* FROM "SCIMGroups" sg
+			JOIN "SCIMGroupMembers" m ON m.scim_group_id = sg.scim_group_id
+			WHERE sg.group_id = ? AND m.user_id = ?`,
+			g.GroupID, id,
+		)
+		var idpGroups []string
+		err := db.ScanEach(rq, func(ctx context.Context, sg *tables.SCIMGroup) error {
+			idpGroups = append(idpGroups, sg.DisplayName)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		roles := saml.MappedRoles(g.URLIdentifier, idpGroups)
+		r := roles[g.URLIdentifier]
+		if r == role.None {
+			r = role.Default
+		}
+		update, err := roleUpdateRequest(id, r)
+		if err != nil {
+			return err
+		}
+		updates = append(updates, update...)
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+	return s.env.GetUserDB().UpdateGroupUsers(ctx, g.GroupID, updates)
+}
+
+func (s *SCIMServer) getGroups(ctx context.Context, r *http.Request, g *tables.Group) (interface{}, error) {
+	startIndex, count, err := pageParams(r)
+	if err != nil {
+		return nil, err
+	}
+	q := `SELECT * FROM "SCIMGroups" WHERE group_id = ?`
+	args := []any{g.GroupID}
+	if filter := r.URL.Query().Get("filter"); filter != "" {
+		displayName, err := parseGroupFilter(filter)
+		if err != nil {
+			return nil, err
+		}
+		q += ` AND display_name = ?`
+		args = append(args, displayName)
+	}
+	q += ` ORDER BY display_name, scim_group_id`
+	rq := s.env.GetDBHandle().NewQuery(ctx, "scim_get_groups").Raw(q, args...)
+	sgs, err := db.ScanAll(rq, &tables.SCIMGroup{})
+	if err != nil {
+		return nil, err
+	}
+	totalResults := len(sgs)
+	sgs = page(sgs, startIndex, count)
+
+	groups := []*GroupResource{}
+	// Okta excludes the members when it only needs the group.
+	excludeMembers := slices.Contains(strings.Split(r.URL.Query().Get("excludedAttributes"), ","), MembersAttribute)
+	for _, sg := range sgs {
+		if excludeMembers {
+			groups = append(groups, newGroupResource(sg))
+			continue
+		}
+		gr, err := s.toGroupResource(ctx, g, sg)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, gr)
+	}
+	return &GroupListResponseResource{
+		Schemas:      []string{ListResponseSchema},
+		TotalResults: totalResults,
+		StartIndex:   startIndex + 1,
+		ItemsPerPage: len(groups),
+		Resources:    groups,
+	}, nil
+}
+
+func parseGroupFilter(filter string) (string, error) {
+	attr, rest, _ := strings.Cut(filter, " ")
+	op, value, _ := strings.Cut(rest, " ")
+	if attr != DisplayNameAttribute {
+		return "", status.InvalidArgumentErrorf("unsupported filter attribute %q", attr)
+	}
+	if op != "eq" {
+		return "", status.InvalidArgumentErrorf("unsupported filter operator %q", op)
+	}
+	displayName, err := strconv.Unquote(value)
+	if err != nil {
+		return "", status.InvalidArgumentErrorf("unsupported filter %q", filter)
+	}
+	return displayName, nil
+}
+
+func (s *SCIMServer) getGroup(ctx context.Context, r *http.Request, g *tables.Group) (interface{}, error) {
+	sg, err := s.getSCIMGroup(ctx, g, path.Base(r.URL.Path))
+	if err != nil {
+		return nil, err
+	}
+	return s.toGroupResource(ctx, g, sg)
+}
+
+func memberIDs(members []GroupMemberResource) []string {
+	ids := make([]string, 0, len(members))
+	for _, m := range members {
+		ids = append(ids, m.Value)
+	}
+	return ids
+}
+
+func (s *SCIMServer) createGroup(ctx context.Context, r *http.Request, g *tables.Group) (interface{}, error) {
+	req, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	log.CtxDebugf(ctx, "SCIM create group request: %s", string(req))
+	gr := GroupResource{}
+	if err := json.Unmarshal(req, &gr); err != nil {
+		return nil, err
+	}
+	if gr.DisplayName == "" {
+		return nil, status.InvalidArgumentError("displayName is required")
+	}
+	members := memberIDs(gr.Members)
+	if err := s.checkMembers(ctx, g, members); err != nil {
+		return nil, err
+	}
+	pk, err := tables.PrimaryKeyForTable("SCIMGroups")
+	if err != nil {
+		return nil, err
+	}
+	sg := &tables.SCIMGroup{
+		SCIMGroupID: pk,
+		GroupID:     g.GroupID,
+		DisplayName: gr.DisplayName,
+		ExternalID:  gr.ExternalID,
+	}
+	err = s.env.GetDBHandle().Transaction(ctx, func(tx interfaces.DB) error {
+		if err := tx.NewQuery(ctx, "scim_create_group").Create(sg); err != nil {
+			return err
+		}
+		return s.replaceMembers(ctx, tx, sg, members)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.applyGroupRoles(ctx, g, members); err != nil {
+		return nil, err
+	}
+	return s.toGroupResource(ctx, g, sg)
+}
+
+func (s *SCIMServer) updateGroup(ctx context.Context, r *http.Request, g *tables.Group) (interface{}, error) {
+	req, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	gr := GroupResource{}
+	if err := json.Unmarshal(req, &gr); err != nil {
+		return nil, err
+	}
+	sg, err := s.getSCIMGroup(ctx, g, path.Base(r.URL.Path))
+	if err != nil {
+		return nil, err
+	}
+	if gr.DisplayName != "" {
+		sg.DisplayName = gr.DisplayName
+	}
+	if gr.ExternalID != "" {
+		sg.ExternalID = gr.ExternalID
+	}
+	if err := s.setMembers(ctx, g, sg, memberIDs(gr.Members)); err != nil {
+		return nil, err
+	}
+	return s.toGroupResource(ctx, g, sg)
+}
+
+// setMembers saves the given group with the given members, and updates the
+// roles of the users whose membership changed.
+func (s *SCIMServer) setMembers(ctx context.Context, g *tables.Group, sg *tables.SCIMGroup, members []string) error {
+	if err := s.checkMembers(ctx, g, members); err != nil {
+		return err
+	}
+	oldMembers, err := s.getMemberIDs(ctx, g, sg)
+	if err != nil {
+		return err
+	}
+	var removed []string
+	for _, id := range oldMembers {
+		if !slices.Contains(members, id) {
+			removed = append(removed, id)
+		}
+	}
+	err = s.env.GetDBHandle().Transaction(ctx, func(tx interfaces.DB) error {
+		err := tx.NewQuery(ctx, "scim_update_group").Raw(`
+			UPDATE "SCIMGroups" SET display_name = ?, external_id = ? WHERE scim_group_id = ?`,
+			sg.DisplayName, sg.ExternalID, sg.SCIMGroupID,
+		).Exec().Error
+		if err != nil {
+			return err
+		}
+		return s.replaceMembers(ctx, tx, sg, members)
+	})
+	if err != nil {
+		return err
+	}
+	// Renaming the group may change the roles of all of its members.
+	return s.applyGroupRoles(ctx, g, slices.Concat(members, removed))
+}
+
+// parseMemberValues parses the members in the value of a patch operation.
+func parseMemberValues(value any) ([]string, error) {
+	values, ok := value.([]any)
+	if !ok {
+		return nil, status.InvalidArgumentErrorf("expected list of members but got %T", value)
+	}
+	var ids []string
+	for _, v := range values {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil, status.InvalidArgumentErrorf("expected member but got %T", v)
+		}
+		id, ok := m["value"].(string)
+		if !ok || id == "" {
+			return nil, status.InvalidArgumentError("member is missing value")
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (s *SCIMServer) patchGroup(ctx context.Context, r *http.Request, g *tables.Group) (interface{}, error) {
+	req, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	log.CtxDebugf(ctx, "SCIM patch group request: %s", string(req))
+	pr := PatchResource{}
+	if err := json.Unmarshal(req, &pr); err != nil {
+		return nil, err
+	}
+	sg, err := s.getSCIMGroup(ctx, g, path.Base(r.URL.Path))
+	if err != nil {
+		return nil, err
+	}
+	members, err := s.getMemberIDs(ctx, g, sg)
+	if err != nil {
+		return nil, err
+	}
+
+	handleReplace := func(name string, value any) error {
+		switch name {
+		case DisplayNameAttribute:
+			v, ok := value.(string)
+			if !ok {
+				return status.InvalidArgumentErrorf("expected string attribute for display name but got %T", value)
+			}
+			sg.DisplayName = v
+		case ExternalIDAttribute:
+			v, ok := value.(string)
+			if !ok {
+				return status.InvalidArgumentErrorf("expected string attribute for external ID but got %T", value)
+			}
+			sg.ExternalID = v
+		case MembersAttribute:
+			ids, err := parseMemberValues(value)
+			if err != nil {
+				return err
+			}
+			members = ids
+		case "id":
+			// Okta includes the ID when replacing the display name.
+		default:
+			return status.InvalidArgumentErrorf("unsupported attribute %q", name)
+		}
+		return nil
+	}
+
+	for _, op := range pr.Operations {
+		switch {
+		case strings.EqualFold(op.Op, "replace"):
+			if op.Path == "" {
+				// If path is not set, then the value is a map of the
+				// properties to be modified.
+				m, ok := op.Value.(map[string]any)
+				if !ok {
+					return nil, status.InvalidArgumentErrorf("path was empty, but value was not a map but %T", op.Value)
+				}
+				for k, v := range m {
+					if err := handleReplace(k, v); err != nil {
+						return nil, err
+					}
+				}
+			} else if err := handleReplace(op.Path, op.Value); err != nil {
+				return nil, err
+			}
+		case strings.EqualFold(op.Op, "add"):
+			if op.Path != MembersAttribute {
+				return nil, status.InvalidArgumentErrorf("unsupported attribute %q", op.Path)
+			}
+			ids, err := parseMemberValues(op.Value)
+			if err != nil {
+				return nil, err
+			}
+			for _, id := range ids {
+				if !slices.Contains(members, id) {
+					members = append(members, id)
+				}
+			}
+		case strings.EqualFold(op.Op, "remove"):
+			var ids []string
+			if m := memberFilterPathRegexp.FindStringSubmatch(op.Path); m != nil {
+				ids = []string{m[1]}
+			} else if op.Path == MembersAttribute {
+				if op.Value == nil {
+					ids = members
+				} else if ids, err = parseMemberValues(op.Value); err != nil {
+					return nil, err
+				}
+			} else {
+				return nil, status.InvalidArgumentErrorf("unsupported attribute %q", op.Path)
+			}
+			members = slices.DeleteFunc(members, func(id string) bool {
+				return slices.Contains(ids, id)
+			})
+		default:
+			return nil, status.InvalidArgumentErrorf("unsupported operation %q", op.Op)
+		}
+	}
+
+	if err := s.setMembers(ctx, g, sg, members); err != nil {
+		return nil, err
+	}
+	return s.toGroupResource(ctx, g, sg)
+}
+
+func (s *SCIMServer) deleteGroup(ctx context.Context, r *http.Request, g *tables.Group) (interface{}, error) {
+	sg, err := s.getSCIMGroup(ctx, g, path.Base(r.URL.Path))
+	if err != nil {
+		return nil, err
+	}
+	members, err := s.getMemberIDs(ctx, g, sg)
+	if err != nil {
+		return nil, err
+	}
+	err = s.env.GetDBHandle().Transaction(ctx, func(tx interfaces.DB) error {
+		if err := s.replaceMembers(ctx, tx, sg, nil); err != nil {
+			return err
+		}
+		return tx.NewQuery(ctx, "scim_delete_group").Raw(`
+			DELETE FROM "SCIMGroups" WHERE scim_group_id = ?`, sg.SCIMGroupID,
+		).Exec().Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.applyGroupRoles(ctx, g, members); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
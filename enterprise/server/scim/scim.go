@@ -32,10 +32,12 @@ var (
 )
 
 const (
-	usersPath = "/scim/Users"
+	usersPath  = "/scim/Users"
+	groupsPath = "/scim/Groups"
 
 	ListResponseSchema  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
 	UserResourceSchema  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	GroupResourceSchema = "urn:ietf:params:scim:schemas:core:2.0:Group"
 	PatchResourceSchema = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
 
 	ActiveAttribute     = "active"
@@ -120,15 +122,17 @@ type GroupMemberResource struct {
 type GroupResource struct {
 	Schemas     []string              `json:"schemas"`
 	ID          string                `json:"id"`
+	ExternalID  string                `json:"externalId,omitempty"`
 	DisplayName string                `json:"displayName"`
 	Members     []GroupMemberResource `json:"members,omitempty"`
 }
 
-func newGroupResource(g *tables.Group) *GroupResource {
+func newGroupResource(sg *tables.SCIMGroup) *GroupResource {
 	return &GroupResource{
-		Schemas:     []string{UserResourceSchema},
-		ID:          g.GroupID,
-		DisplayName: g.Name,
+		Schemas:     []string{GroupResourceSchema},
+		ID:          sg.SCIMGroupID,
+		ExternalID:  sg.ExternalID,
+		DisplayName: sg.DisplayName,
 	}
 }
 
@@ -247,6 +251,24 @@ func (s *SCIMServer) getRequestHandler(r *http.Request) (handlerFunc, error) {
 			return s.deleteUser, nil
 		}
 	}
+	if strings.HasPrefix(r.URL.Path, groupsPath) {
+		switch r.Method {
+		case http.MethodGet:
+			if r.URL.Path == groupsPath {
+				return s.getGroups, nil
+			} else {
+				return s.getGroup, nil
+			}
+		case http.MethodPost:
+			return s.createGroup, nil
+		case http.MethodPut:
+			return s.updateGroup, nil
+		case http.MethodPatch:
+			return s.patchGroup, nil
+		case http.MethodDelete:
+			return s.deleteGroup, nil
+		}
+	}
 
 	return nil, status.NotFoundError("not found")
 }
@@ -292,13 +314,14 @@ func (s *SCIMServer) getFilteredUsers(ctx context.Context, g *tables.Group, filt
 	return []*UserResource{ur}, nil
 }
 
-func (s *SCIMServer) getUsers(ctx context.Context, r *http.Request, g *tables.Group) (interface{}, error) {
-	startIndex := 0
+// pageParams returns the 0-based start index and the count of the list
+// request. A count of 0 means all the resources.
+func pageParams(r *http.Request) (startIndex, count int, err error) {
 	startIndexParam := r.URL.Query().Get("startIndex")
 	if startIndexParam != "" {
 		v, err := strconv.Atoi(startIndexParam)
 		if err != nil {
-			return nil, status.InvalidArgumentErrorf("invalid startIndex value: %s", err)
+			return 0, 0, status.InvalidArgumentErrorf("invalid startIndex value: %s", err)
 		}
 		startIndex = v - 1
 		if startIndex < 0 {
@@ -306,18 +329,41 @@ func (s *SCIMServer) getUsers(ctx context.Context, r *http.Request, g *tables.Gr
 		}
 	}
 
-	count := 0
 	countParam := r.URL.Query().Get("count")
 	if countParam != "" {
 		v, err := strconv.Atoi(countParam)
 		if err != nil {
-			return nil, status.InvalidArgumentErrorf("invalud count value: %s", err)
+			return 0, 0, status.InvalidArgumentErrorf("invalud count value: %s", err)
 		}
 		count = v
 		if count < 0 {
 			count = 0
 		}
 	}
+	return startIndex, count, nil
+}
+
+// page returns the requested page of the given resources.
+func page[T any](resources []T, startIndex, count int) []T {
+	if startIndex > len(resources) {
+		startIndex = len(resources)
+	}
+	resources = resources[startIndex:]
+
+	if count == 0 {
+		count = len(resources)
+	}
+	if count > len(resources) {
+		count = len(resources)
+	}
+	return resources[:count]
+}
+
+func (s *SCIMServer) getUsers(ctx context.Context, r *http.Request, g *tables.Group) (interface{}, error) {
+	startIndex, count, err := pageParams(r)
+	if err != nil {
+		return nil, err
+	}
 
 	users := []*UserResource{}
 	filter := r.URL.Query().Get("filter")
@@ -353,25 +399,13 @@ func (s *SCIMServer) getUsers(ctx context.Context, r *http.Request, g *tables.Gr
 		return strings.Compare(a.UserName, b.UserName)
 	})
 	totalResults := len(users)
-
-	if startIndex > len(users) {
-		startIndex = len(users)
-	}
-	users = users[startIndex:]
-
-	if count == 0 {
-		count = len(users)
-	}
-	if count > len(users) {
-		count = len(users)
-	}
-	users = users[:count]
+	users = page(users, startIndex, count)
 
 	return &UserListResponseResource{
 		Schemas:      []string{ListResponseSchema},
 		TotalResults: totalResults,
 		StartIndex:   startIndex + 1,
-		ItemsPerPage: count,
+		ItemsPerPage: len(users),
 		Resources:    users,
 	}, nil
 }
@@ -12,6 +12,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/saml"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scim"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testauth"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testenv"
@@ -22,6 +23,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testhttp"
 	"github.com/buildbuddy-io/buildbuddy/server/util/role"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 	"github.com/stretchr/testify/require"
 
 	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
@@ -45,7 +47,7 @@ func prepareGroup(t *testing.T, ctx context.Context, env environment.Env) string
 	require.NoError(t, err)
 	g := u.Groups[0].Group
 
-	apiKey, err := env.GetAuthDB().CreateAPIKey(ctx, g.GroupID, "SCIM", []akpb.ApiKey_Capability{akpb.ApiKey_ORG_ADMIN_CAPABILITY}, false)
+	apiKey, err := env.GetAuthDB().CreateAPIKey(ctx, g.GroupID, "SCIM", []akpb.ApiKey_Capability{akpb.ApiKey_ORG_ADMIN_CAPABILITY}, nil /*=scopes*/, false)
 	require.NoError(t, err)
 
 	g.SamlIdpMetadataUrl = "foo"
@@ -722,3 +724,161 @@ func TestUpdateUser(t *testing.T) {
 	require.NoError(t, err)
 	verifyRole(t, updatedUser, role.Admin.String())
 }
+
+func TestGroups(t *testing.T) {
+	env := getEnv(t)
+	udb := env.GetUserDB()
+	ctx := context.Background()
+	flags.Set(t, "auth.saml.group_mappings", []saml.GroupMapping{
+		{Slug: "gr100-slug", IDPGroup: "admins", Role: "admin"},
+		{Slug: "gr100-slug", IDPGroup: "readers", Role: "reader"},
+	})
+
+	err := udb.InsertUser(ctx, &tables.User{
+		UserID: "US100",
+		SubID:  "SubID100",
+		Email:  "user100@org1.io",
+	})
+	require.NoError(t, err)
+	userCtx := authUserCtx(ctx, env, t, "US100")
+	apiKey := prepareGroup(t, userCtx, env)
+	for _, id := range []string{"US101", "US102"} {
+		err := udb.InsertUser(userCtx, &tables.User{
+			UserID: id,
+			SubID:  "SubID" + id,
+			Email:  strings.ToLower(id) + "@org1.io",
+		})
+		require.NoError(t, err)
+	}
+	// Create a user in a different group.
+	err = udb.InsertUser(ctx, &tables.User{
+		UserID: "US999",
+		SubID:  "SubID999",
+		Email:  "user999@org999.io",
+	})
+	require.NoError(t, err)
+
+	ss := scim.NewSCIMServer(env)
+	mux := http.NewServeMux()
+	ss.RegisterHandlers(mux)
+
+	baseURL := testhttp.StartServer(t, mux).String()
+	tc := &testClient{t: t, apiKey: apiKey}
+
+	getRole := func(userID string) string {
+		code, body := tc.Get(baseURL + "/scim/Users/" + userID)
+		require.Equal(t, http.StatusOK, code, "body: %s", string(body))
+		ur := scim.UserResource{}
+		err := json.Unmarshal(body, &ur)
+		require.NoError(t, err)
+		return ur.Role
+	}
+	createGroup := func(displayName string, members ...string) scim.GroupResource {
+		gr := &scim.GroupResource{
+			Schemas:     []string{scim.GroupResourceSchema},
+			DisplayName: displayName,
+		}
+		for _, m := range members {
+			gr.Members = append(gr.Members, scim.GroupMemberResource{Value: m})
+		}
+		body, err := json.Marshal(gr)
+		require.NoError(t, err)
+		code, body := tc.Post(baseURL+"/scim/Groups", body)
+		require.Equal(t, http.StatusOK, code, "body: %s", string(body))
+		created := scim.GroupResource{}
+		err = json.Unmarshal(body, &created)
+		require.NoError(t, err)
+		require.Equal(t, displayName, created.DisplayName)
+		require.NotEmpty(t, created.ID)
+		return created
+	}
+
+	// Members of mapped groups get the mapped roles. The first mapping wins.
+	admins := createGroup("admins", "US101")
+	require.Equal(t, role.Admin.String(), getRole("US101"))
+	require.Equal(t, role.Developer.String(), getRole("US102"))
+	readers := createGroup("readers", "US101", "US102")
+	require.Equal(t, role.Admin.String(), getRole("US101"))
+	require.Equal(t, role.Reader.String(), getRole("US102"))
+
+	// Users from other orgs can't be added.
+	{
+		gr := &scim.GroupResource{DisplayName: "others", Members: []scim.GroupMemberResource{{Value: "US999"}}}
+		body, err := json.Marshal(gr)
+		require.NoError(t, err)
+		code, body := tc.Post(baseURL+"/scim/Groups", body)
+		require.Equal(t, http.StatusBadRequest, code, "body: %s", string(body))
+	}
+
+	// Filter groups by name.
+	{
+		code, body := tc.Get(baseURL + "/scim/Groups?filter=" + url.QueryEscape(`displayName eq "readers"`))
+		require.Equal(t, http.StatusOK, code, "body: %s", string(body))
+		lr := scim.GroupListResponseResource{}
+		err := json.Unmarshal(body, &lr)
+		require.NoError(t, err)
+		require.Equal(t, 1, lr.TotalResults)
+		require.Equal(t, readers.ID, lr.Resources[0].ID)
+		require.Equal(t, []scim.GroupMemberResource{{Value: "US101"}, {Value: "US102"}}, lr.Resources[0].Members)
+	}
+
+	// Removing a member from a group updates their role.
+	{
+		pr := &scim.PatchResource{
+			Schemas: []string{scim.PatchResourceSchema},
+			Operations: []scim.OperationResource{
+				{Op: "remove", Path: `members[value eq "US101"]`},
+			},
+		}
+		body, err := json.Marshal(pr)
+		require.NoError(t, err)
+		code, body := tc.Patch(baseURL+"/scim/Groups/"+admins.ID, body)
+		require.Equal(t, http.StatusOK, code, "body: %s", string(body))
+		require.Equal(t, role.Reader.String(), getRole("US101"))
+	}
+
+	// Adding a member to a group updates their role.
+	{
+		pr := &scim.PatchResource{
+			Schemas: []string{scim.PatchResourceSchema},
+			Operations: []scim.OperationResource{
+				{Op: "add", Path: "members", Value: []map[string]string{{"value": "US102"}}},
+			},
+		}
+		body, err := json.Marshal(pr)
+		require.NoError(t, err)
+		code, body := tc.Patch(baseURL+"/scim/Groups/"+admins.ID, body)
+		require.Equal(t, http.StatusOK, code, "body: %s", string(body))
+		gr := scim.GroupResource{}
+		err = json.Unmarshal(body, &gr)
+		require.NoError(t, err)
+		require.Equal(t, []scim.GroupMemberResource{{Value: "US102"}}, gr.Members)
+		require.Equal(t, role.Admin.String(), getRole("US102"))
+	}
+
+	// Renaming a group to an unmapped name resets the roles of its members.
+	{
+		pr := &scim.PatchResource{
+			Schemas: []string{scim.PatchResourceSchema},
+			Operations: []scim.OperationResource{
+				{Op: "replace", Value: map[string]string{"id": admins.ID, "displayName": "former-admins"}},
+			},
+		}
+		body, err := json.Marshal(pr)
+		require.NoError(t, err)
+		code, body := tc.Patch(baseURL+"/scim/Groups/"+admins.ID, body)
+		require.Equal(t, http.StatusOK, code, "body: %s", string(body))
+		require.Equal(t, role.Reader.String(), getRole("US102"))
+	}
+
+	// Deleting a group resets the roles of its members.
+	{
+		code, body := tc.Delete(baseURL + "/scim/Groups/" + readers.ID)
+		require.Equal(t, http.StatusNoContent, code, "body: %s", string(body))
+		require.Equal(t, role.Developer.String(), getRole("US101"))
+		require.Equal(t, role.Developer.String(), getRole("US102"))
+
+		code, body = tc.Get(baseURL + "/scim/Groups/" + readers.ID)
+		require.Equal(t, http.StatusNotFound, code, "body: %s", string(body))
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
 	"github.com/buildbuddy-io/buildbuddy/server/util/authutil"
 	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/git"
 	"github.com/buildbuddy-io/buildbuddy/server/util/hash"
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
@@ -99,11 +100,62 @@ func (s *SecretService) listSecretsIncludingValues(ctx context.Context) (*skpb.L
 	return rsp, nil
 }
 
+// listRepoSecretsIncludingValues returns the repo secrets owned by the given
+// group. If repoURL is empty, the secrets for all repos are returned.
+func (s *SecretService) listRepoSecretsIncludingValues(ctx context.Context, groupID, repoURL string) ([]*skpb.Secret, error) {
+	dbHandle := s.env.GetDBHandle()
+	if dbHandle == nil {
+		return nil, status.FailedPreconditionError("A database is required")
+	}
+
+	queryStr := `SELECT repo_url, name, value FROM "RepoSecrets" WHERE group_id = ?`
+	args := []any{groupID}
+	if repoURL != "" {
+		queryStr += ` AND repo_url = ?`
+		args = append(args, repoURL)
+	}
+	queryStr += ` ORDER BY repo_url ASC, name ASC`
+	rq := dbHandle.NewQuery(ctx, "secrets_list_repo_secrets").Raw(queryStr, args...)
+	var secrets []*skpb.Secret
+	err := db.ScanEach(rq, func(ctx context.Context, k *tables.RepoSecret) error {
+		secrets = append(secrets, &skpb.Secret{
+			Name:    k.Name,
+			Value:   k.Value,
+			RepoUrl: k.RepoURL,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+// normalizeRepoURL returns the form of the repo URL that repo secrets are
+// stored under, so that e.g. "git@github.com:foo/bar.git" and
+// "https://github.com/foo/bar" refer to the same secrets.
+func normalizeRepoURL(repoURL string) (string, error) {
+	u, err := git.NormalizeRepoURL(repoURL)
+	if err != nil {
+		return "", status.InvalidArgumentErrorf("invalid repo URL %q: %s", repoURL, err)
+	}
+	return u.String(), nil
+}
+
 func (s *SecretService) ListSecrets(ctx context.Context, req *skpb.ListSecretsRequest) (*skpb.ListSecretsResponse, error) {
 	rsp, err := s.listSecretsIncludingValues(ctx)
 	if err != nil {
 		return nil, err
 	}
+	u, err := s.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	repoSecrets, err := s.listRepoSecretsIncludingValues(ctx, u.GetGroupID(), "" /*=repoURL*/)
+	if err != nil {
+		return nil, err
+	}
+	rsp.Secret = append(rsp.Secret, repoSecrets...)
 	for _, s := range rsp.Secret {
 		// N.B. Omit the value; the frontend doesn't need it and
 		// we don't want these transiting the network any more
@@ -114,7 +166,8 @@ func (s *SecretService) ListSecrets(ctx context.Context, req *skpb.ListSecretsRe
 }
 
 // UpdateSecret updates the secret with the given name associated with the group
-// the user is authenticated as, creating it if it does not exist. It returns,
+// the user is authenticated as, creating it if it does not exist. If the secret
+// has a repo URL, the repo secret for that repo is updated instead. It returns,
 // in order, the response proto, whether the secret was newly created or not,
 // and any error encountered.
 func (s *SecretService) UpdateSecret(ctx context.Context, req *skpb.UpdateSecretRequest) (*skpb.UpdateSecretResponse, bool, error) {
@@ -136,6 +189,13 @@ func (s *SecretService) UpdateSecret(ctx context.Context, req *skpb.UpdateSecret
 	if !secretNameRegexp.MatchString(req.GetSecret().GetName()) {
 		return nil, false, status.InvalidArgumentError("Secret names may only contain: [a-zA-Z0-9_]")
 	}
+	repoURL := ""
+	if req.GetSecret().GetRepoUrl() != "" {
+		repoURL, err = normalizeRepoURL(req.GetSecret().GetRepoUrl())
+		if err != nil {
+			return nil, false, err
+		}
+	}
 	udb := s.env.GetUserDB()
 	if udb == nil {
 		return nil, false, status.FailedPreconditionError("No UserDB configured")
@@ -154,6 +214,14 @@ func (s *SecretService) UpdateSecret(ctx context.Context, req *skpb.UpdateSecret
 		return nil, false, err
 	}
 
+	if repoURL != "" {
+		newSecret, err := s.updateRepoSecret(ctx, u, repoURL, req.GetSecret(), secretPerms.Perms)
+		if err != nil {
+			return nil, false, err
+		}
+		return &skpb.UpdateSecretResponse{}, newSecret, nil
+	}
+
 	newSecret := false
 	err = dbHandle.Transaction(ctx, func(tx interfaces.DB) error {
 		// TODO(zoey): remove this SELECT and replace with INSERT
@@ -200,6 +268,37 @@ func (s *SecretService) UpdateSecret(ctx context.Context, req *skpb.UpdateSecret
 	return &skpb.UpdateSecretResponse{}, newSecret, nil
 }
 
+func (s *SecretService) updateRepoSecret(ctx context.Context, u interfaces.UserInfo, repoURL string, secret *skpb.Secret, secretPerms int32) (bool, error) {
+	dbHandle := s.env.GetDBHandle()
+	newSecret := false
+	err := dbHandle.Transaction(ctx, func(tx interfaces.DB) error {
+		var existing tables.RepoSecret
+		err := tx.NewQuery(ctx, "secrets_get_repo_secret_for_update").Raw(`
+			SELECT *
+			FROM "RepoSecrets"
+			WHERE group_id = ? AND repo_url = ? AND name = ?
+			`+dbHandle.SelectForUpdateModifier(), u.GetGroupID(), repoURL, secret.GetName()).Take(&existing)
+		if err == nil {
+			return tx.NewQuery(ctx, "secrets_update_repo_secret").Raw(`
+				UPDATE "RepoSecrets"
+				SET value = ?
+				WHERE group_id = ? AND repo_url = ? AND name = ?`,
+				secret.GetValue(), u.GetGroupID(), repoURL, secret.GetName()).Exec().Error
+		}
+		if !db.IsRecordNotFound(err) {
+			return err
+		}
+		newSecret = true
+		return tx.NewQuery(ctx, "secrets_insert_repo_secret").Raw(
+			`INSERT INTO "RepoSecrets" (group_id, repo_url, name, user_id, value, perms) VALUES(?, ?, ?, ?, ?, ?)`,
+			u.GetGroupID(), repoURL, secret.GetName(), u.GetUserID(), secret.GetValue(), secretPerms).Exec().Error
+	})
+	if err != nil {
+		return false, err
+	}
+	return newSecret, nil
+}
+
 func (s *SecretService) DeleteSecret(ctx context.Context, req *skpb.DeleteSecretRequest) (*skpb.DeleteSecretResponse, error) {
 	u, err := s.env.GetAuthenticator().AuthenticatedUser(ctx)
 	if err != nil {
@@ -214,6 +313,20 @@ func (s *SecretService) DeleteSecret(ctx context.Context, req *skpb.DeleteSecret
 		return nil, status.InvalidArgumentError("A non-empty secret name is required")
 	}
 
+	if req.GetSecret().GetRepoUrl() != "" {
+		repoURL, err := normalizeRepoURL(req.GetSecret().GetRepoUrl())
+		if err != nil {
+			return nil, err
+		}
+		err = dbHandle.NewQuery(ctx, "secrets_delete_repo_secret").Raw(
+			`DELETE FROM "RepoSecrets" WHERE group_id = ? AND repo_url = ? AND name = ?`,
+			u.GetGroupID(), repoURL, req.GetSecret().GetName()).Exec().Error
+		if err != nil {
+			return nil, err
+		}
+		return &skpb.DeleteSecretResponse{}, nil
+	}
+
 	err = dbHandle.NewQuery(ctx, "secrets_delete").Raw(
 		`DELETE FROM "Secrets" WHERE group_id = ? AND name = ?`, u.GetGroupID(), req.GetSecret().GetName()).Exec().Error
 	if err != nil {
@@ -241,16 +354,47 @@ func (s *SecretService) GetSecretEnvVars(ctx context.Context, groupID string) ([
 	if err != nil {
 		return nil, err
 	}
+	return s.openSecrets(grp, rsp.GetSecret())
+}
+
+// GetRepoSecretEnvVars returns the decrypted repo secrets that the given group
+// has stored for the given repo.
+func (s *SecretService) GetRepoSecretEnvVars(ctx context.Context, groupID, repoURL string) ([]*repb.Command_EnvironmentVariable, error) {
+	if err := authutil.AuthorizeGroupAccess(ctx, s.env, groupID); err != nil {
+		return nil, err
+	}
+	repoURL, err := normalizeRepoURL(repoURL)
+	if err != nil {
+		return nil, err
+	}
+
+	udb := s.env.GetUserDB()
+	if udb == nil {
+		return nil, status.FailedPreconditionError("No UserDB configured")
+	}
+
+	grp, err := udb.GetGroupByID(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets, err := s.listRepoSecretsIncludingValues(ctx, groupID, repoURL)
+	if err != nil {
+		return nil, err
+	}
+	return s.openSecrets(grp, secrets)
+}
 
+func (s *SecretService) openSecrets(grp *tables.Group, secrets []*skpb.Secret) ([]*repb.Command_EnvironmentVariable, error) {
 	// No secrets, or public key not set up? Let's exit early instead of throwing
 	// an error later.
-	if len(rsp.GetSecret()) == 0 || grp.PublicKey == "" {
+	if len(secrets) == 0 || grp.PublicKey == "" {
 		return []*repb.Command_EnvironmentVariable{}, nil
 	}
 
-	names := make([]string, 0, len(rsp.GetSecret()))
-	encValues := make([]string, 0, len(rsp.GetSecret()))
-	for _, nameAndEncValue := range rsp.GetSecret() {
+	names := make([]string, 0, len(secrets))
+	encValues := make([]string, 0, len(secrets))
+	for _, nameAndEncValue := range secrets {
 		names = append(names, nameAndEncValue.GetName())
 		encValues = append(encValues, nameAndEncValue.GetValue())
 	}
@@ -269,3 +413,41 @@ func (s *SecretService) GetSecretEnvVars(ctx context.Context, groupID string) ([
 	}
 	return envVars, nil
 }
+
+// GetSecret returns the decrypted value of the secret with the given name
+// belonging to the given group. It returns a NotFound error if the secret
+// does not exist.
+func (s *SecretService) GetSecret(ctx context.Context, groupID, name string) (string, error) {
+	if err := authutil.AuthorizeGroupAccess(ctx, s.env, groupID); err != nil {
+		return "", err
+	}
+	dbHandle := s.env.GetDBHandle()
+	if dbHandle == nil {
+		return "", status.FailedPreconditionError("A database is required")
+	}
+	udb := s.env.GetUserDB()
+	if udb == nil {
+		return "", status.FailedPreconditionError("No UserDB configured")
+	}
+
+	grp, err := udb.GetGroupByID(ctx, groupID)
+	if err != nil {
+		return "", err
+	}
+	if grp.PublicKey == "" {
+		return "", status.NotFoundErrorf("secret %q not found", name)
+	}
+
+	secret := &tables.Secret{}
+	err = dbHandle.NewQuery(ctx, "secrets_get").Raw(
+		`SELECT * FROM "Secrets" WHERE group_id = ? AND name = ?`,
+		groupID, name,
+	).Take(secret)
+	if err != nil {
+		if db.IsRecordNotFound(err) {
+			return "", status.NotFoundErrorf("secret %q not found", name)
+		}
+		return "", err
+	}
+	return keystore.OpenAnonymousSealedBox(s.env, grp.PublicKey, grp.EncryptedPrivateKey, secret.Value)
+}
@@ -13,37 +13,21 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testauth"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testenv"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/keystore"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
 	"github.com/buildbuddy-io/buildbuddy/server/util/authutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	skpb "github.com/buildbuddy-io/buildbuddy/proto/secrets"
 )
 
-func TestUpdateSecret(t *testing.T) {
-	te := enterprise_testenv.New(t)
-	authenticator := enterprise_testauth.Configure(t, te)
-
-	// Get slices of users by gid with the admin user at the beginning
-	groups := make(map[string][]*tables.User, 12)
-	for _, u := range enterprise_testauth.CreateRandomGroups(t, te) {
-		for _, g := range u.Groups {
-			gid := g.Group.GroupID
-			if users, ok := groups[gid]; ok {
-				if err := authutil.AuthorizeOrgAdmin(authenticator.UserProvider(u.UserID), gid); err == nil {
-					groups[gid] = append([]*tables.User{u}, users...)
-				} else {
-					groups[gid] = append(users, u)
-				}
-			} else {
-				groups[gid] = []*tables.User{u}
-			}
-		}
-	}
-
+func setupSecretService(t *testing.T, te *testenv.TestEnv) interfaces.SecretService {
 	// Generate the master key
 	masterKey := make([]byte, 32)
 	_, err := rand.Read(masterKey)
@@ -74,6 +58,49 @@ func TestUpdateSecret(t *testing.T) {
 
 	secretService := te.GetSecretService()
 	require.NotNil(t, secretService)
+	return secretService
+}
+
+func setupGroupKeys(t *testing.T, te *testenv.TestEnv, gid string) (string, string) {
+	pubKey, encPrivKey, err := keystore.GenerateSealedBoxKeys(te)
+	require.NoError(t, err)
+
+	res := te.GetDBHandle().NewQuery(context.Background(), "update_group_keys_for_test").Raw(`
+		UPDATE "Groups" SET
+			public_key = ?,
+			encrypted_private_key = ?
+		WHERE group_id = ?`,
+		pubKey,
+		encPrivKey,
+		gid,
+	).Exec()
+	require.NoError(t, res.Error)
+	require.Equal(t, int64(1), res.RowsAffected)
+	return pubKey, encPrivKey
+}
+
+func TestUpdateSecret(t *testing.T) {
+	te := enterprise_testenv.New(t)
+	authenticator := enterprise_testauth.Configure(t, te)
+
+	// Get slices of users by gid with the admin user at the beginning
+	groups := make(map[string][]*tables.User, 12)
+	for _, u := range enterprise_testauth.CreateRandomGroups(t, te) {
+		for _, g := range u.Groups {
+			gid := g.Group.GroupID
+			if users, ok := groups[gid]; ok {
+				if err := authutil.AuthorizeOrgAdmin(authenticator.UserProvider(u.UserID), gid); err == nil {
+					groups[gid] = append([]*tables.User{u}, users...)
+				} else {
+					groups[gid] = append(users, u)
+				}
+			} else {
+				groups[gid] = []*tables.User{u}
+			}
+		}
+	}
+
+	secretService := setupSecretService(t, te)
 
 	dbh := te.GetDBHandle()
 	require.NotNil(t, dbh)
@@ -82,23 +109,7 @@ func TestUpdateSecret(t *testing.T) {
 	pubKeys := make(map[string]string, len(groups))
 	encPrivKeys := make(map[string]string, len(groups))
 	for gid := range groups {
-		pubKey, encPrivKey, err := keystore.GenerateSealedBoxKeys(te)
-		require.NoError(t, err)
-
-		pubKeys[gid] = pubKey
-		encPrivKeys[gid] = encPrivKey
-
-		res := dbh.NewQuery(context.Background(), "update_group_keys_for_test").Raw(`
-			UPDATE "Groups" SET
-				public_key = ?,
-				encrypted_private_key = ?
-			WHERE group_id = ?`,
-			pubKey,
-			encPrivKey,
-			gid,
-		).Exec()
-		require.NoError(t, res.Error)
-		require.Equal(t, int64(1), res.RowsAffected)
+		pubKeys[gid], encPrivKeys[gid] = setupGroupKeys(t, te, gid)
 	}
 
 	values := make(map[string]string)
@@ -170,6 +181,14 @@ func TestUpdateSecret(t *testing.T) {
 		lastUser := users[len(users)-1]
 		assert.Equal(t, values[lastUser.UserID], value)
 
+		userCtx, err := authenticator.WithAuthenticatedUser(context.Background(), lastUser.UserID)
+		require.NoError(t, err)
+		value, err = secretService.GetSecret(userCtx, gid, secretName)
+		assert.NoError(t, err)
+		assert.Equal(t, values[lastUser.UserID], value)
+		_, err = secretService.GetSecret(userCtx, gid, "NONEXISTENT_SECRET")
+		assert.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+
 		for i, u := range users {
 			var count int64
 			err := te.GetDBHandle().NewQuery(context.Background(), "verify_update_secret_for_test").Raw(`
@@ -199,3 +218,68 @@ func TestUpdateSecret(t *testing.T) {
 		}
 	}
 }
+
+func TestRepoSecrets(t *testing.T) {
+	te := enterprise_testenv.New(t)
+	authenticator := enterprise_testauth.Configure(t, te)
+	secretService := setupSecretService(t, te)
+
+	u := enterprise_testauth.CreateRandomUser(t, te, "org1.io")
+	ctx, err := authenticator.WithAuthenticatedUser(context.Background(), u.UserID)
+	require.NoError(t, err)
+	gid := u.Groups[0].Group.GroupID
+	pubKey, _ := setupGroupKeys(t, te, gid)
+
+	updateSecret := func(name, value, repoURL string) bool {
+		encValue, err := keystore.NewAnonymousSealedBox(pubKey, value)
+		require.NoError(t, err)
+		_, newSecret, err := secretService.UpdateSecret(ctx, &skpb.UpdateSecretRequest{
+			Secret: &skpb.Secret{Name: name, Value: encValue, RepoUrl: repoURL},
+		})
+		require.NoError(t, err)
+		return newSecret
+	}
+	assert.True(t, updateSecret("TOKEN", "org-token", ""))
+	assert.True(t, updateSecret("TOKEN", "old-repo-token", "git@github.com:acme/app.git"))
+	assert.False(t, updateSecret("TOKEN", "repo-token", "https://github.com/acme/app"))
+	assert.True(t, updateSecret("OTHER_TOKEN", "other-token", "https://github.com/acme/other"))
+
+	rsp, err := secretService.ListSecrets(ctx, &skpb.ListSecretsRequest{})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []*skpb.Secret{
+		{Name: "TOKEN"},
+		{Name: "TOKEN", RepoUrl: "https://github.com/acme/app"},
+		{Name: "OTHER_TOKEN", RepoUrl: "https://github.com/acme/other"},
+	}, rsp.GetSecret())
+
+	// Repo secrets are not included in the org secrets.
+	envVars, err := secretService.GetSecretEnvVars(ctx, gid)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []*repb.Command_EnvironmentVariable{
+		{Name: "TOKEN", Value: "org-token"},
+	}, envVars)
+
+	envVars, err = secretService.GetRepoSecretEnvVars(ctx, gid, "https://github.com/acme/app.git")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []*repb.Command_EnvironmentVariable{
+		{Name: "TOKEN", Value: "repo-token"},
+	}, envVars)
+
+	_, err = secretService.DeleteSecret(ctx, &skpb.DeleteSecretRequest{
+		Secret: &skpb.Secret{Name: "TOKEN", RepoUrl: "https://github.com/acme/app"},
+	})
+	require.NoError(t, err)
+	envVars, err = secretService.GetRepoSecretEnvVars(ctx, gid, "https://github.com/acme/app")
+	require.NoError(t, err)
+	assert.Empty(t, envVars)
+	value, err := secretService.GetSecret(ctx, gid, "TOKEN")
+	require.NoError(t, err)
+	assert.Equal(t, "org-token", value)
+
+	// Users can't read the repo secrets of other groups.
+	u2 := enterprise_testauth.CreateRandomUser(t, te, "org2.io")
+	ctx2, err := authenticator.WithAuthenticatedUser(context.Background(), u2.UserID)
+	require.NoError(t, err)
+	_, err = secretService.GetRepoSecretEnvVars(ctx2, gid, "https://github.com/acme/other")
+	assert.Error(t, err)
+}
@@ -1222,6 +1222,61 @@ func TestRunAction_PushedAndTargetBranchAreEqual(t *testing.T) {
 	}
 }
 
+func TestRunAction_GerritChangeRef(t *testing.T) {
+	wsPath := testfs.MakeTempDir(t)
+	repoPath, _ := makeGitRepo(t, workspaceContentsWithRunScript)
+
+	// Gerrit stores patch sets under refs/changes/* rather than in branches.
+	testshell.Run(t, repoPath, `
+		git checkout -b change
+		printf "echo 'change args: {{' \$@ '}}'\n" > print_args.sh
+		git add print_args.sh
+		git commit -m "Update print_args.sh"
+		git update-ref refs/changes/23/123/2 HEAD
+		git checkout master
+		git branch -D change
+	`)
+	commitSHA := strings.TrimSpace(testshell.Run(t, repoPath, `git rev-parse refs/changes/23/123/2`))
+
+	testCases := []struct {
+		name      string
+		repoFlags []string
+	}{
+		{
+			name: "With commit sha",
+			repoFlags: []string{
+				"--pushed_branch=refs/changes/23/123/2",
+				"--commit_sha=" + commitSHA,
+			},
+		},
+		{
+			name: "Without commit sha",
+			repoFlags: []string{
+				"--pushed_branch=refs/changes/23/123/2",
+			},
+		},
+	}
+	baselineRunnerFlags := []string{
+		"--workflow_id=test-workflow",
+		"--action_name=Print args",
+		"--trigger_event=pull_request",
+		"--pushed_repo_url=file://" + repoPath,
+		"--target_repo_url=file://" + repoPath,
+		"--target_branch=master",
+		"--fallback_to_clean_checkout=false",
+	}
+	// Start the app so the runner can use it as the BES backend.
+	app := buildbuddy.Run(t)
+	baselineRunnerFlags = append(baselineRunnerFlags, app.BESBazelFlags()...)
+
+	for _, tc := range testCases {
+		runnerFlags := append(baselineRunnerFlags, tc.repoFlags...)
+		result := invokeRunner(t, runnerFlags, []string{}, wsPath)
+		checkRunnerResult(t, result)
+		assert.Contains(t, result.Output, "change args: {{ Hello world }}", tc.name)
+	}
+}
+
 func TestEnvExpansion(t *testing.T) {
 	wsPath := testfs.MakeTempDir(t)
 	repoPath, headCommitSHA := makeGitRepo(t, workspaceContentsWithEnvVars)
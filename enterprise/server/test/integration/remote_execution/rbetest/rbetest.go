@@ -1309,11 +1309,13 @@ type testRunner struct {
 	interceptor RunInterceptor
 }
 
-func (r *testRunner) Run(ctx context.Context) *interfaces.CommandResult {
+func (r *testRunner) Run(ctx context.Context, liveOutput *interfaces.Stdio) *interfaces.CommandResult {
 	if r.interceptor == nil {
-		return r.Runner.Run(ctx)
+		return r.Runner.Run(ctx, liveOutput)
 	}
-	return r.interceptor(ctx, r.Runner.Run)
+	return r.interceptor(ctx, func(ctx context.Context) *interfaces.CommandResult {
+		return r.Runner.Run(ctx, liveOutput)
+	})
 }
 
 // WaitForAnyPooledRunner waits for the runner pool count across all executors
@@ -596,6 +596,9 @@ func countsToMap(tu *tables.UsageCounts) (map[string]int64, error) {
 	if tu.MemoryGBUsec > 0 {
 		counts["memory_gb_usec"] = tu.MemoryGBUsec
 	}
+	if tu.CacheStorageGBUsec > 0 {
+		counts["cache_storage_gb_usec"] = tu.CacheStorageGBUsec
+	}
 	return counts, nil
 }
 
@@ -623,5 +626,6 @@ func stringMapToCounts(h map[string]string) (*tables.UsageCounts, error) {
 		TotalCachedActionExecUsec:            hInt64["total_cached_action_exec_usec"],
 		CPUNanos:                             hInt64["cpu_nanos"],
 		MemoryGBUsec:                         hInt64["memory_gb_usec"],
+		CacheStorageGBUsec:                   hInt64["cache_storage_gb_usec"],
 	}, nil
 }
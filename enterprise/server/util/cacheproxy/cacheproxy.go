@@ -24,6 +24,7 @@ import (
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/reflection"
 
+	capb "github.com/buildbuddy-io/buildbuddy/proto/cache"
 	dcpb "github.com/buildbuddy-io/buildbuddy/proto/distributed_cache"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
@@ -46,6 +47,7 @@ type CacheProxy struct {
 	clients               map[string]*grpc_client.ClientConnPool
 	heartbeatCallback     func(ctx context.Context, peer string)
 	hintedHandoffCallback func(ctx context.Context, peer string, r *rspb.ResourceName)
+	rebalanceFunc         func(ctx context.Context, targetPeer string, progressFn func(*dcpb.RebalanceResponse) error) error
 	listenAddr            string
 	zone                  string
 }
@@ -113,6 +115,10 @@ func (c *CacheProxy) SetHintedHandoffCallbackFunc(fn func(ctx context.Context, p
 	c.hintedHandoffCallback = fn
 }
 
+func (c *CacheProxy) SetRebalanceFunc(fn func(ctx context.Context, targetPeer string, progressFn func(*dcpb.RebalanceResponse) error) error) {
+	c.rebalanceFunc = fn
+}
+
 func digestFromKey(k *dcpb.Key) *repb.Digest {
 	return &repb.Digest{
 		Hash:      k.GetKey(),
@@ -232,6 +238,22 @@ func (c *CacheProxy) Metadata(ctx context.Context, req *dcpb.MetadataRequest) (*
 	}, nil
 }
 
+func (c *CacheProxy) GetProvenance(ctx context.Context, req *dcpb.GetProvenanceRequest) (*dcpb.GetProvenanceResponse, error) {
+	ctx, err := c.readWriteContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pc, ok := c.cache.(interfaces.ProvenanceTrackingCache)
+	if !ok {
+		return nil, status.UnimplementedError("Provenance is not supported by this peer.")
+	}
+	prov, err := pc.Provenance(ctx, req.GetResource())
+	if err != nil {
+		return nil, err
+	}
+	return &dcpb.GetProvenanceResponse{Provenance: prov}, nil
+}
+
 // ResourceIsolationString returns a compact representation of a resource's isolation that is suitable for logging.
 func ResourceIsolationString(r *rspb.ResourceName) string {
 	rep := filepath.Join(r.GetInstanceName(), digest.CacheTypeToPrefix(r.GetCacheType()), r.GetDigest().GetHash())
@@ -391,6 +413,16 @@ func (c *CacheProxy) Heartbeat(ctx context.Context, req *dcpb.HeartbeatRequest)
 	return &dcpb.HeartbeatResponse{}, nil
 }
 
+func (c *CacheProxy) Rebalance(req *dcpb.RebalanceRequest, stream dcpb.DistributedCache_RebalanceServer) error {
+	if req.GetTargetPeer() == "" {
+		return status.InvalidArgumentError("A target peer is required.")
+	}
+	if c.rebalanceFunc == nil {
+		return status.UnimplementedError("Rebalancing is not supported by this peer.")
+	}
+	return c.rebalanceFunc(stream.Context(), req.GetTargetPeer(), stream.Send)
+}
+
 func (c *CacheProxy) RemoteContains(ctx context.Context, peer string, r *rspb.ResourceName) (bool, error) {
 	isolation := &dcpb.Isolation{
 		CacheType:          r.GetCacheType(),
@@ -430,6 +462,18 @@ func (c *CacheProxy) RemoteMetadata(ctx context.Context, peer string, r *rspb.Re
 	}, nil
 }
 
+func (c *CacheProxy) RemoteProvenance(ctx context.Context, peer string, r *rspb.ResourceName) (*capb.CacheEntryProvenance, error) {
+	client, err := c.getClient(ctx, peer)
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := client.GetProvenance(ctx, &dcpb.GetProvenanceRequest{Resource: r})
+	if err != nil {
+		return nil, err
+	}
+	return rsp.GetProvenance(), nil
+}
+
 func (c *CacheProxy) RemoteFindMissing(ctx context.Context, peer string, isolation *dcpb.Isolation, resources []*rspb.ResourceName) ([]*repb.Digest, error) {
 	req := &dcpb.FindMissingRequest{
 		Isolation: isolation,
@@ -713,6 +757,29 @@ func (c *CacheProxy) RemoteWriter(ctx context.Context, peer, handoffPeer string,
 	return c.newBufferedStreamWriteCloser(wc), nil
 }
 
+// RemoteRebalance asks peer to copy the entries owned by targetPeer to it, and
+// calls progressFn with each progress update.
+func (c *CacheProxy) RemoteRebalance(ctx context.Context, peer, targetPeer string, progressFn func(*dcpb.RebalanceResponse)) error {
+	client, err := c.getClient(ctx, peer)
+	if err != nil {
+		return err
+	}
+	stream, err := client.Rebalance(c.prepareContext(ctx), &dcpb.RebalanceRequest{TargetPeer: targetPeer})
+	if err != nil {
+		return err
+	}
+	for {
+		rsp, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		progressFn(rsp)
+	}
+}
+
 func (c *CacheProxy) SendHeartbeat(ctx context.Context, peer string) error {
 	client, err := c.getClient(ctx, peer)
 	if err != nil {
@@ -0,0 +1,191 @@
+// Package cron parses standard five-field cron expressions and computes their
+// activation times.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How far ahead Next searches for an activation before giving up. Expressions
+// like "0 0 30 2 *" never match.
+const maxSearchDuration = 5 * 365 * 24 * time.Hour
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var monthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var dayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+type field struct {
+	name  string
+	min   int
+	max   int
+	names map[string]int
+}
+
+var (
+	minuteField = field{"minute", 0, 59, nil}
+	hourField   = field{"hour", 0, 23, nil}
+	domField    = field{"day of month", 1, 31, nil}
+	monthField  = field{"month", 1, 12, monthNames}
+	// 7 is accepted as an alias for Sunday.
+	dowField = field{"day of week", 0, 7, dayNames}
+)
+
+// Schedule is a parsed cron expression.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// Whether the day-of-month and day-of-week fields are restricted (not
+	// "*"). If both are, a day matches if either field matches.
+	domRestricted, dowRestricted bool
+}
+
+// Parse parses a cron expression with the fields "minute hour day-of-month
+// month day-of-week", or one of the macros "@yearly", "@monthly", "@weekly",
+// "@daily" and "@hourly".
+func Parse(spec string) (*Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if expanded, ok := macros[strings.ToLower(spec)]; ok {
+		spec = expanded
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q: expected 5 fields, got %d", spec, len(fields))
+	}
+	s := &Schedule{}
+	var err error
+	if s.minute, err = parseField(fields[0], minuteField); err != nil {
+		return nil, err
+	}
+	if s.hour, err = parseField(fields[1], hourField); err != nil {
+		return nil, err
+	}
+	if s.dom, err = parseField(fields[2], domField); err != nil {
+		return nil, err
+	}
+	if s.month, err = parseField(fields[3], monthField); err != nil {
+		return nil, err
+	}
+	if s.dow, err = parseField(fields[4], dowField); err != nil {
+		return nil, err
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1 << 0
+	}
+	s.domRestricted = !strings.HasPrefix(fields[2], "*")
+	s.dowRestricted = !strings.HasPrefix(fields[4], "*")
+	return s, nil
+}
+
+func parseField(expr string, f field) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(expr, ",") {
+		lo, hi, step := f.min, f.max, 1
+		rangeExpr, stepExpr, hasStep := strings.Cut(item, "/")
+		if hasStep {
+			n, err := strconv.Atoi(stepExpr)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q in %s field", stepExpr, f.name)
+			}
+			step = n
+		}
+		if rangeExpr != "*" {
+			start, end, isRange := strings.Cut(rangeExpr, "-")
+			var err error
+			if lo, err = parseValue(start, f); err != nil {
+				return 0, err
+			}
+			if isRange {
+				if hi, err = parseValue(end, f); err != nil {
+					return 0, err
+				}
+			} else if !hasStep {
+				hi = lo
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("invalid range %q in %s field", rangeExpr, f.name)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func parseValue(s string, f field) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q in %s field", s, f.name)
+	}
+	if v < f.min || v > f.max {
+		return 0, fmt.Errorf("value %d out of range [%d, %d] in %s field", v, f.min, f.max, f.name)
+	}
+	return v, nil
+}
+
+func (s *Schedule) matchesDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domRestricted && s.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// Next returns the first activation time strictly after t, in t's location.
+// It returns the zero time if the schedule never activates.
+//
+// Activations that fall in a daylight saving time gap are skipped, and
+// activations in an hour that is repeated when the clocks go back happen
+// twice.
+func (s *Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	limit := t.Add(maxSearchDuration)
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			next := time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			if !next.After(t) {
+				// The next hour is ambiguous, and resolved to before t.
+				next = t.Add(time.Hour - time.Duration(t.Minute())*time.Minute)
+			}
+			t = next
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
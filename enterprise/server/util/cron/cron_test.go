@@ -0,0 +1,87 @@
+package cron_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/cron"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func parseTime(t *testing.T, loc *time.Location, value string) time.Time {
+	ts, err := time.ParseInLocation("2006-01-02 15:04", value, loc)
+	require.NoError(t, err)
+	return ts
+}
+
+func TestNext(t *testing.T) {
+	for _, test := range []struct {
+		spec  string
+		after string
+		next  string
+	}{
+		{"* * * * *", "2024-03-01 10:15", "2024-03-01 10:16"},
+		{"0 3 * * *", "2024-03-01 10:15", "2024-03-02 03:00"},
+		{"0 3 * * *", "2024-03-02 02:59", "2024-03-02 03:00"},
+		{"*/15 * * * *", "2024-03-01 10:15", "2024-03-01 10:30"},
+		{"5/20 9-10 * * *", "2024-03-01 10:45", "2024-03-02 09:05"},
+		{"0 0 1 * *", "2024-01-31 12:00", "2024-02-01 00:00"},
+		{"0 0 29 2 *", "2024-03-01 00:00", "2028-02-29 00:00"},
+		{"30 9 * * mon-fri", "2024-03-01 10:00", "2024-03-04 09:30"},
+		{"0 0 * * 7", "2024-03-01 00:00", "2024-03-03 00:00"},
+		{"0 12 * jan,jul *", "2024-03-01 00:00", "2024-07-01 12:00"},
+		// If both day of month and day of week are restricted, either one
+		// matching is enough.
+		{"0 0 15 * fri", "2024-03-01 00:00", "2024-03-08 00:00"},
+		{"@daily", "2024-03-01 10:15", "2024-03-02 00:00"},
+		{"@hourly", "2024-03-01 10:15", "2024-03-01 11:00"},
+		{"@weekly", "2024-03-01 10:15", "2024-03-03 00:00"},
+	} {
+		s, err := cron.Parse(test.spec)
+		require.NoError(t, err, test.spec)
+		next := s.Next(parseTime(t, time.UTC, test.after))
+		assert.Equal(t, parseTime(t, time.UTC, test.next), next, "%q after %s", test.spec, test.after)
+	}
+}
+
+func TestNext_TimeZone(t *testing.T) {
+	loc, err := time.LoadLocation("America/Los_Angeles")
+	require.NoError(t, err)
+	s, err := cron.Parse("30 2 * * *")
+	require.NoError(t, err)
+
+	next := s.Next(parseTime(t, loc, "2024-03-01 12:00"))
+	assert.Equal(t, parseTime(t, loc, "2024-03-02 02:30"), next)
+	assert.Equal(t, "2024-03-02 10:30", next.UTC().Format("2006-01-02 15:04"))
+
+	// 2:30 doesn't exist on the day the clocks go forward.
+	next = s.Next(parseTime(t, loc, "2024-03-10 00:00"))
+	assert.Equal(t, parseTime(t, loc, "2024-03-11 02:30"), next)
+}
+
+func TestNext_NeverActivates(t *testing.T) {
+	s, err := cron.Parse("0 0 31 2 *")
+	require.NoError(t, err)
+	assert.True(t, s.Next(time.Now()).IsZero())
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"10-5 * * * *",
+		"* * * foo *",
+		"@every 5m",
+	} {
+		_, err := cron.Parse(spec)
+		assert.Error(t, err, "%q", spec)
+	}
+}
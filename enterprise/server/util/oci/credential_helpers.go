@@ -0,0 +1,215 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"golang.org/x/oauth2/google"
+
+	awssession "github.com/aws/aws-sdk-go/aws/session"
+	awsecr "github.com/aws/aws-sdk-go/service/ecr"
+)
+
+const (
+	// Built-in credential helpers, which exchange the executor's cloud
+	// identity for a registry token.
+	ecrCredentialHelper = "ecr"
+	gcrCredentialHelper = "gcr"
+	acrCredentialHelper = "acr"
+
+	// Prefix of external credential helper binaries, which implement the
+	// docker credential helper protocol.
+	// See https://github.com/docker/docker-credential-helpers
+	dockerCredentialHelperPrefix = "docker-credential-"
+
+	// How long credentials returned by credential helpers are cached, if the
+	// helper doesn't say when they expire.
+	defaultCredentialHelperTTL = 5 * time.Minute
+	// ACR refresh tokens are valid for 3 hours, but the exchange response
+	// doesn't include the expiration time.
+	acrRefreshTokenTTL = 1 * time.Hour
+	// How long before expiration cached credentials are refreshed.
+	credentialRefreshMargin = 5 * time.Minute
+
+	credentialHelperTimeout = 30 * time.Second
+
+	// Username to use with GCP access tokens.
+	gcpAccessTokenUsername = "oauth2accesstoken"
+	// Username to use with ACR refresh tokens.
+	acrRefreshTokenUsername = "00000000-0000-0000-0000-000000000000"
+	// Azure instance metadata endpoint returning managed identity tokens.
+	azureMetadataTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01&resource=https%3A%2F%2Fmanagement.azure.com%2F"
+)
+
+var (
+	ecrHostnameRegexp = regexp.MustCompile(`^\d+\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?$`)
+
+	helperCredentialsMu sync.Mutex // PROTECTS(helperCredentials)
+	helperCredentials   = map[string]*cachedCredentials{}
+)
+
+type cachedCredentials struct {
+	creds   Credentials
+	expires time.Time
+}
+
+// credentialsFromHelper returns credentials for the given registry from the
+// given credential helper. Credentials are cached until shortly before they
+// expire.
+func credentialsFromHelper(ctx context.Context, helper, hostname string) (Credentials, error) {
+	key := helper + "/" + hostname
+	helperCredentialsMu.Lock()
+	cached, ok := helperCredentials[key]
+	helperCredentialsMu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.creds, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, credentialHelperTimeout)
+	defer cancel()
+	var creds Credentials
+	var expires time.Time
+	var err error
+	switch helper {
+	case ecrCredentialHelper:
+		creds, expires, err = ecrCredentials(ctx, hostname)
+	case gcrCredentialHelper:
+		creds, expires, err = gcpCredentials(ctx)
+	case acrCredentialHelper:
+		creds, expires, err = acrCredentials(ctx, hostname)
+	default:
+		creds, err = dockerCredentialHelperCredentials(ctx, helper, hostname)
+		expires = time.Now().Add(defaultCredentialHelperTTL)
+	}
+	if err != nil {
+		return Credentials{}, status.WrapErrorf(err, "get %q credentials from %q credential helper", hostname, helper)
+	}
+
+	helperCredentialsMu.Lock()
+	helperCredentials[key] = &cachedCredentials{creds: creds, expires: expires.Add(-credentialRefreshMargin)}
+	helperCredentialsMu.Unlock()
+	return creds, nil
+}
+
+// ecrCredentials exchanges the executor's AWS credentials for an ECR
+// authorization token.
+func ecrCredentials(ctx context.Context, hostname string) (Credentials, time.Time, error) {
+	m := ecrHostnameRegexp.FindStringSubmatch(hostname)
+	if m == nil {
+		return Credentials{}, time.Time{}, status.InvalidArgumentErrorf("%q is not an ECR registry", hostname)
+	}
+	sess, err := awssession.NewSession(&aws.Config{Region: aws.String(m[1])})
+	if err != nil {
+		return Credentials{}, time.Time{}, status.UnavailableErrorf("create AWS session: %s", err)
+	}
+	rsp, err := awsecr.New(sess).GetAuthorizationTokenWithContext(ctx, &awsecr.GetAuthorizationTokenInput{})
+	if err != nil {
+		return Credentials{}, time.Time{}, status.UnavailableErrorf("get ECR authorization token: %s", err)
+	}
+	if len(rsp.AuthorizationData) == 0 {
+		return Credentials{}, time.Time{}, status.UnavailableError("ECR returned no authorization data")
+	}
+	data := rsp.AuthorizationData[0]
+	b, err := base64.StdEncoding.DecodeString(aws.StringValue(data.AuthorizationToken))
+	if err != nil {
+		return Credentials{}, time.Time{}, status.UnavailableErrorf("decode ECR authorization token: %s", err)
+	}
+	username, password, ok := strings.Cut(string(b), ":")
+	if !ok {
+		return Credentials{}, time.Time{}, status.UnavailableError("malformed ECR authorization token")
+	}
+	return Credentials{Username: username, Password: password}, aws.TimeValue(data.ExpiresAt), nil
+}
+
+// gcpCredentials returns an access token for the executor's GCP application
+// default credentials, which can be used with GCR and Artifact Registry.
+func gcpCredentials(ctx context.Context) (Credentials, time.Time, error) {
+	ts, err := google.DefaultTokenSource(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		return Credentials{}, time.Time{}, status.UnavailableErrorf("get GCP default credentials: %s", err)
+	}
+	token, err := ts.Token()
+	if err != nil {
+		return Credentials{}, time.Time{}, status.UnavailableErrorf("get GCP access token: %s", err)
+	}
+	return Credentials{Username: gcpAccessTokenUsername, Password: token.AccessToken}, token.Expiry, nil
+}
+
+// acrCredentials exchanges an access token for the executor's Azure managed
+// identity for an ACR refresh token.
+func acrCredentials(ctx context.Context, hostname string) (Credentials, time.Time, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, azureMetadataTokenURL, nil)
+	if err != nil {
+		return Credentials{}, time.Time{}, err
+	}
+	req.Header.Set("Metadata", "true")
+	var tokenRsp struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := doJSON(req, &tokenRsp); err != nil {
+		return Credentials{}, time.Time{}, status.UnavailableErrorf("get Azure managed identity token: %s", err)
+	}
+
+	form := url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {hostname},
+		"access_token": {tokenRsp.AccessToken},
+	}
+	req, err = http.NewRequestWithContext(ctx, http.MethodPost, "https://"+hostname+"/oauth2/exchange", strings.NewReader(form.Encode()))
+	if err != nil {
+		return Credentials{}, time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var exchangeRsp struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := doJSON(req, &exchangeRsp); err != nil {
+		return Credentials{}, time.Time{}, status.UnavailableErrorf("exchange Azure token for ACR refresh token: %s", err)
+	}
+	return Credentials{Username: acrRefreshTokenUsername, Password: exchangeRsp.RefreshToken}, time.Now().Add(acrRefreshTokenTTL), nil
+}
+
+func doJSON(req *http.Request, rsp any) error {
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return status.UnavailableErrorf("HTTP %s", res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(rsp)
+}
+
+// dockerCredentialHelperCredentials runs "docker-credential-<helper> get" to
+// get credentials for the given registry.
+func dockerCredentialHelperCredentials(ctx context.Context, helper, hostname string) (Credentials, error) {
+	cmd := exec.CommandContext(ctx, dockerCredentialHelperPrefix+helper, "get")
+	cmd.Stdin = strings.NewReader(hostname)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// Helpers print errors to stdout.
+		return Credentials{}, status.UnavailableErrorf("%s: %q", err, strings.TrimSpace(stdout.String()+stderr.String()))
+	}
+	var rsp struct {
+		Username string
+		Secret   string
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &rsp); err != nil {
+		return Credentials{}, status.UnavailableErrorf("parse credential helper output: %s", err)
+	}
+	return credentials(rsp.Username, rsp.Secret)
+}
@@ -2,9 +2,13 @@ package oci
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"runtime"
+	"strings"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
 	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
@@ -20,6 +24,7 @@ import (
 	"github.com/google/go-containerregistry/pkg/v1/types"
 
 	rgpb "github.com/buildbuddy-io/buildbuddy/proto/registry"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	ctrname "github.com/google/go-containerregistry/pkg/name"
 )
 
@@ -31,8 +36,20 @@ type Registry struct {
 	Hostnames []string `yaml:"hostnames" json:"hostnames"`
 	Username  string   `yaml:"username" json:"username"`
 	Password  string   `yaml:"password" json:"password" config:"secret"`
+	// CredentialHelper gets credentials for the registry instead of the
+	// static username and password. "ecr", "gcr", and "acr" exchange the
+	// executor's cloud identity for a registry token. Any other value runs
+	// the docker-credential-<helper> binary.
+	CredentialHelper string `yaml:"credential_helper" json:"credential_helper"`
 }
 
+const (
+	// RegistryCredentialsSecretName is the name of the group secret which
+	// holds the group's container registry credentials, in the format of
+	// the "auths" section of a docker config.json file.
+	RegistryCredentialsSecretName = "CONTAINER_REGISTRY_CREDENTIALS"
+)
+
 type Credentials struct {
 	Username string
 	Password string
@@ -43,10 +60,10 @@ func CredentialsFromProto(creds *rgpb.Credentials) (Credentials, error) {
 }
 
 // Extracts the container registry Credentials from the provided platform
-// properties, falling back to credentials specified in
-// --executor.container_registries if the platform properties credentials are
-// absent.
-func CredentialsFromProperties(props *platform.Properties) (Credentials, error) {
+// properties, falling back to the group credentials sent with the task, then
+// to credentials specified in --executor.container_registries if the platform
+// properties credentials are absent.
+func CredentialsFromProperties(ctx context.Context, props *platform.Properties, taskCreds *repb.ContainerRegistryCredentials) (Credentials, error) {
 	imageRef := props.ContainerImage
 	if imageRef == "" {
 		return Credentials{}, nil
@@ -59,6 +76,13 @@ func CredentialsFromProperties(props *platform.Properties) (Credentials, error)
 		return creds, nil
 	}
 
+	creds, err = credentials(taskCreds.GetUsername(), taskCreds.GetPassword())
+	if err != nil {
+		return Credentials{}, fmt.Errorf("Received invalid group container registry credentials: %w", err)
+	} else if !creds.IsEmpty() {
+		return creds, nil
+	}
+
 	// If no credentials were provided, fallback to any specified by
 	// --executor.container_registries.
 	if len(*registries) == 0 {
@@ -74,6 +98,9 @@ func CredentialsFromProperties(props *platform.Properties) (Credentials, error)
 	for _, cfg := range *registries {
 		for _, cfgHostname := range cfg.Hostnames {
 			if refHostname == cfgHostname {
+				if cfg.CredentialHelper != "" {
+					return credentialsFromHelper(ctx, cfg.CredentialHelper, refHostname)
+				}
 				return Credentials{
 					Username: cfg.Username,
 					Password: cfg.Password,
@@ -85,6 +112,50 @@ func CredentialsFromProperties(props *platform.Properties) (Credentials, error)
 	return Credentials{}, nil
 }
 
+// CredentialsFromDockerConfig returns the credentials for the given image from
+// the "auths" section of a docker config.json file. Both the base64-encoded
+// "auth" field and separate "username" and "password" fields are supported.
+// If the config has no credentials for the image's registry, empty
+// credentials are returned.
+func CredentialsFromDockerConfig(configJSON, imageRef string) (Credentials, error) {
+	var config struct {
+		Auths map[string]struct {
+			Auth     string `json:"auth"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal([]byte(configJSON), &config); err != nil {
+		return Credentials{}, status.InvalidArgumentErrorf("parse registry credentials: %s", err)
+	}
+	ref, err := reference.ParseNormalizedNamed(imageRef)
+	if err != nil {
+		return Credentials{}, status.InvalidArgumentErrorf("invalid image %q", imageRef)
+	}
+	refHostname := reference.Domain(ref)
+	for hostname, auth := range config.Auths {
+		// Docker config keys may be URLs, e.g. "https://index.docker.io/v1/".
+		hostname = strings.TrimPrefix(strings.TrimPrefix(hostname, "https://"), "http://")
+		hostname, _, _ = strings.Cut(hostname, "/")
+		if hostname == "index.docker.io" {
+			hostname = "docker.io"
+		}
+		if hostname != refHostname {
+			continue
+		}
+		if auth.Auth == "" {
+			return credentials(auth.Username, auth.Password)
+		}
+		b, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return Credentials{}, status.InvalidArgumentErrorf("decode registry credentials for %q: %s", hostname, err)
+		}
+		username, password, _ := strings.Cut(string(b), ":")
+		return credentials(username, password)
+	}
+	return Credentials{}, nil
+}
+
 func credentials(username, password string) (Credentials, error) {
 	if username == "" && password != "" {
 		return Credentials{}, status.InvalidArgumentError(
@@ -187,3 +258,79 @@ func RuntimePlatform() *rgpb.Platform {
 		Os:   runtime.GOOS,
 	}
 }
+
+// RemoteBlob provides random access to a blob stored in a remote registry,
+// by issuing an HTTP range request for each read.
+type RemoteBlob struct {
+	ctx    context.Context
+	client *http.Client
+	url    string
+	size   int64
+}
+
+// NewRemoteBlob returns a RemoteBlob for the blob with the given digest and
+// size. Reads are authorized with the given credentials, and fail once ctx is
+// done.
+func NewRemoteBlob(ctx context.Context, ref ctrname.Digest, size int64, credentials Credentials) (*RemoteBlob, error) {
+	auth := authn.Anonymous
+	if !credentials.IsEmpty() {
+		auth = &authn.Basic{
+			Username: credentials.Username,
+			Password: credentials.Password,
+		}
+	}
+	repo := ref.Context()
+	tr, err := transport.NewWithContext(ctx, repo.Registry, auth, remote.DefaultTransport, []string{repo.Scope(transport.PullScope)})
+	if err != nil {
+		if t, ok := err.(*transport.Error); ok && t.StatusCode == http.StatusUnauthorized {
+			return nil, status.PermissionDeniedErrorf("could not authorize blob access: %s", err)
+		}
+		return nil, status.UnavailableErrorf("could not create registry transport: %s", err)
+	}
+	return &RemoteBlob{
+		ctx:    ctx,
+		client: &http.Client{Transport: tr},
+		url:    fmt.Sprintf("%s://%s/v2/%s/blobs/%s", repo.Registry.Scheme(), repo.RegistryStr(), repo.RepositoryStr(), ref.DigestStr()),
+		size:   size,
+	}, nil
+}
+
+func (b *RemoteBlob) Size() int64 {
+	return b.size
+}
+
+func (b *RemoteBlob) ReadAt(p []byte, off int64) (int, error) {
+	if off >= b.size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(p)), b.size)
+	req, err := http.NewRequestWithContext(b.ctx, http.MethodGet, b.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, end-1))
+	rsp, err := b.client.Do(req)
+	if err != nil {
+		return 0, status.UnavailableErrorf("fetch blob range: %s", err)
+	}
+	defer rsp.Body.Close()
+	switch rsp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The registry doesn't support range requests and returned the whole
+		// blob. Skip to the requested range.
+		if _, err := io.CopyN(io.Discard, rsp.Body, off); err != nil {
+			return 0, status.UnavailableErrorf("read blob: %s", err)
+		}
+	default:
+		return 0, status.UnavailableErrorf("fetch blob range: unexpected HTTP status %s", rsp.Status)
+	}
+	n, err := io.ReadFull(rsp.Body, p[:end-off])
+	if err != nil {
+		return n, status.UnavailableErrorf("read blob range: %s", err)
+	}
+	if end-off < int64(len(p)) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -2,21 +2,26 @@ package oci_test
 
 import (
 	"context"
+	"io"
 	"net/http"
+	"os"
 	"regexp"
 	"runtime"
 	"testing"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/oci"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testregistry"
 	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	rgpb "github.com/buildbuddy-io/buildbuddy/proto/registry"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 )
 
 func TestCredentialsFromProto(t *testing.T) {
@@ -64,7 +69,7 @@ func TestCredentialsFromProperties(t *testing.T) {
 	flags.Set(t, "executor.container_registries", registries)
 
 	props := &platform.Properties{}
-	c, err := oci.CredentialsFromProperties(props)
+	c, err := oci.CredentialsFromProperties(context.Background(), props, nil)
 	require.NoError(t, err)
 	assert.True(t, c.IsEmpty())
 
@@ -73,7 +78,7 @@ func TestCredentialsFromProperties(t *testing.T) {
 		ContainerRegistryUsername: "username",
 		ContainerRegistryPassword: "",
 	}
-	_, err = oci.CredentialsFromProperties(props)
+	_, err = oci.CredentialsFromProperties(context.Background(), props, nil)
 	assert.True(t, status.IsInvalidArgumentError(err))
 
 	props = &platform.Properties{
@@ -81,7 +86,7 @@ func TestCredentialsFromProperties(t *testing.T) {
 		ContainerRegistryUsername: "",
 		ContainerRegistryPassword: "password",
 	}
-	_, err = oci.CredentialsFromProperties(props)
+	_, err = oci.CredentialsFromProperties(context.Background(), props, nil)
 	assert.True(t, status.IsInvalidArgumentError(err))
 
 	for _, testCase := range []struct {
@@ -117,7 +122,7 @@ func TestCredentialsFromProperties(t *testing.T) {
 	} {
 		props = &platform.Properties{ContainerImage: testCase.imageRef}
 
-		creds, err := oci.CredentialsFromProperties(props)
+		creds, err := oci.CredentialsFromProperties(context.Background(), props, nil)
 
 		assert.NoError(t, err)
 		assert.Equal(
@@ -128,6 +133,103 @@ func TestCredentialsFromProperties(t *testing.T) {
 	}
 }
 
+func TestCredentialsFromProperties_TaskCredentials(t *testing.T) {
+	flags.Set(t, "executor.container_registries", []oci.Registry{
+		{
+			Hostnames: []string{"gcr.io"},
+			Username:  "gcruser",
+			Password:  "gcrpass",
+		},
+	})
+	ctx := context.Background()
+	taskCreds := &repb.ContainerRegistryCredentials{Username: "groupuser", Password: "grouppass"}
+
+	// Credentials sent with the task take priority over the executor's.
+	c, err := oci.CredentialsFromProperties(ctx, &platform.Properties{ContainerImage: "gcr.io/foo/bar"}, taskCreds)
+	require.NoError(t, err)
+	assert.Equal(t, creds("groupuser", "grouppass"), c)
+
+	// Credentials in platform properties take priority over both.
+	c, err = oci.CredentialsFromProperties(ctx, &platform.Properties{
+		ContainerImage:            "gcr.io/foo/bar",
+		ContainerRegistryUsername: "propuser",
+		ContainerRegistryPassword: "proppass",
+	}, taskCreds)
+	require.NoError(t, err)
+	assert.Equal(t, creds("propuser", "proppass"), c)
+
+	_, err = oci.CredentialsFromProperties(ctx, &platform.Properties{ContainerImage: "gcr.io/foo/bar"}, &repb.ContainerRegistryCredentials{Username: "groupuser"})
+	assert.True(t, status.IsInvalidArgumentError(err))
+}
+
+func TestCredentialsFromProperties_CredentialHelper(t *testing.T) {
+	// Install a fake credential helper which returns credentials derived
+	// from the requested registry.
+	binDir := testfs.MakeTempDir(t)
+	testfs.WriteAllFileContents(t, binDir, map[string]string{
+		"docker-credential-fake": `#!/bin/sh
+[ "$1" = get ] || exit 1
+read host
+echo "{\"ServerURL\":\"$host\",\"Username\":\"helperuser\",\"Secret\":\"secret-for-$host\"}"
+`,
+	})
+	testfs.MakeExecutable(t, binDir, "docker-credential-fake")
+	t.Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+
+	flags.Set(t, "executor.container_registries", []oci.Registry{
+		{
+			Hostnames:        []string{"helper.registry.io"},
+			CredentialHelper: "fake",
+		},
+		{
+			Hostnames:        []string{"missing-helper.registry.io"},
+			CredentialHelper: "missing",
+		},
+	})
+	ctx := context.Background()
+
+	c, err := oci.CredentialsFromProperties(ctx, &platform.Properties{ContainerImage: "helper.registry.io/foo/bar"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, creds("helperuser", "secret-for-helper.registry.io"), c)
+
+	_, err = oci.CredentialsFromProperties(ctx, &platform.Properties{ContainerImage: "missing-helper.registry.io/foo/bar"}, nil)
+	assert.Error(t, err)
+}
+
+func TestCredentialsFromDockerConfig(t *testing.T) {
+	config := `{
+		"auths": {
+			"gcr.io": {"username": "_json_key", "password": "{\"key\": \"value\"}"},
+			"https://index.docker.io/v1/": {"auth": "ZG9ja2VydXNlcjpkb2NrZXJwYXNz"},
+			"bad.registry.io": {"username": "user"}
+		}
+	}`
+	for _, tc := range []struct {
+		imageRef string
+		want     oci.Credentials
+		wantErr  bool
+	}{
+		{imageRef: "gcr.io/foo/bar:latest", want: creds("_json_key", `{"key": "value"}`)},
+		{imageRef: "alpine", want: creds("dockeruser", "dockerpass")},
+		{imageRef: "docker.io/library/alpine", want: creds("dockeruser", "dockerpass")},
+		{imageRef: "unrecognized-registry.io/foo", want: oci.Credentials{}},
+		{imageRef: "bad.registry.io/foo", wantErr: true},
+	} {
+		t.Run(tc.imageRef, func(t *testing.T) {
+			c, err := oci.CredentialsFromDockerConfig(config, tc.imageRef)
+			if tc.wantErr {
+				require.True(t, status.IsInvalidArgumentError(err), "want InvalidArgument error, got %v", err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.want, c)
+		})
+	}
+
+	_, err := oci.CredentialsFromDockerConfig("not json", "alpine")
+	require.True(t, status.IsInvalidArgumentError(err))
+}
+
 func creds(username, password string) oci.Credentials {
 	return oci.Credentials{Username: username, Password: password}
 }
@@ -191,3 +293,38 @@ func TestResolve_Unauthorized(t *testing.T) {
 		oci.Credentials{})
 	require.True(t, status.IsPermissionDeniedError(err))
 }
+
+func TestRemoteBlob(t *testing.T) {
+	ctx := context.Background()
+	registry := testregistry.Run(t, testregistry.Opts{})
+	imageName := registry.PushRandomImage(t)
+	img, err := oci.Resolve(ctx, imageName, oci.RuntimePlatform(), oci.Credentials{})
+	require.NoError(t, err)
+	layers, err := img.Layers()
+	require.NoError(t, err)
+	d, err := layers[0].Digest()
+	require.NoError(t, err)
+	size, err := layers[0].Size()
+	require.NoError(t, err)
+	rc, err := layers[0].Compressed()
+	require.NoError(t, err)
+	defer rc.Close()
+	want, err := io.ReadAll(rc)
+	require.NoError(t, err)
+
+	ref, err := name.ParseReference(imageName)
+	require.NoError(t, err)
+	blob, err := oci.NewRemoteBlob(ctx, ref.Context().Digest(d.String()), size, oci.Credentials{})
+	require.NoError(t, err)
+	require.Equal(t, size, blob.Size())
+
+	buf := make([]byte, 100)
+	n, err := blob.ReadAt(buf, 10)
+	require.NoError(t, err)
+	require.Equal(t, want[10:110], buf[:n])
+
+	// Reads past the end of the blob are truncated.
+	n, err = blob.ReadAt(buf, size-10)
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, want[size-10:], buf[:n])
+}
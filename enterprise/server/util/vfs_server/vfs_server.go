@@ -10,6 +10,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"syscall"
@@ -70,6 +71,9 @@ type CASLazyFileProvider struct {
 	remoteInstanceName string
 	digestFunction     repb.DigestFunction_Value
 	inputFiles         map[string]*repb.FileNode
+
+	mu     sync.Mutex // PROTECTS(placed)
+	placed []*repb.FileNode
 }
 
 func NewCASLazyFileProvider(env environment.Env, ctx context.Context, remoteInstanceName string, digestFunction repb.DigestFunction_Value, inputTree *repb.Tree) (*CASLazyFileProvider, error) {
@@ -126,9 +130,21 @@ func (p *CASLazyFileProvider) Place(relPath, fullPath string) error {
 	if err := ff.FetchFiles(fileMap, &dirtools.DownloadTreeOpts{}); err != nil {
 		return err
 	}
+	p.mu.Lock()
+	p.placed = append(p.placed, fileNode)
+	p.mu.Unlock()
 	return nil
 }
 
+// PlacedFiles returns the input files that have been placed, in the order
+// that they were placed. The VFS server places files the first time that
+// they're opened, so these are the inputs that have been read.
+func (p *CASLazyFileProvider) PlacedFiles() []*repb.FileNode {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.placed)
+}
+
 func (p *CASLazyFileProvider) GetAllFilePaths() []*LazyFile {
 	var lazyFiles []*LazyFile
 	for p, fileNode := range p.inputFiles {
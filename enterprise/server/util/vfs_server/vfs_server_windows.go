@@ -24,6 +24,10 @@ func NewCASLazyFileProvider(env environment.Env, ctx context.Context, remoteInst
 	panic("not implemented")
 }
 
+func (p *CASLazyFileProvider) PlacedFiles() []*repb.FileNode {
+	return nil
+}
+
 type Server struct {
 }
 
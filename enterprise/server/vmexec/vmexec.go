@@ -6,6 +6,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -128,14 +129,16 @@ func (x *execServer) Initialize(ctx context.Context, req *vmxpb.InitializeReques
 		}
 		log.Debugf("Cleared ARP cache")
 	}
+	rsp := &vmxpb.InitializeResponse{}
 	if req.GetUnixTimestampNanoseconds() > 1 {
+		rsp.PreviousUnixTimestampNanoseconds = time.Now().UnixNano()
 		tv := syscall.NsecToTimeval(req.GetUnixTimestampNanoseconds())
 		if err := syscall.Settimeofday(&tv); err != nil {
 			return nil, err
 		}
 		log.Debugf("Set time of day to %d", req.GetUnixTimestampNanoseconds())
 	}
-	return &vmxpb.InitializeResponse{}, nil
+	return rsp, nil
 }
 
 func (x *execServer) Sync(ctx context.Context, req *vmxpb.SyncRequest) (*vmxpb.SyncResponse, error) {
@@ -225,6 +228,158 @@ func (x *execServer) Exec(ctx context.Context, req *vmxpb.ExecRequest) (*vmxpb.E
 	return rsp, nil
 }
 
+// Size of the chunks streamed by ReadFile and ForwardPort.
+const streamChunkSize = 64 * 1024
+
+func (x *execServer) ReadFile(req *vmxpb.ReadFileRequest, stream vmxpb.Exec_ReadFileServer) error {
+	if !filepath.IsAbs(req.GetPath()) {
+		return status.InvalidArgumentErrorf("path %q is not absolute", req.GetPath())
+	}
+	f, err := os.Open(req.GetPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return status.NotFoundErrorf("open %s: %s", req.GetPath(), err)
+		}
+		return status.InternalErrorf("open %s: %s", req.GetPath(), err)
+	}
+	defer f.Close()
+	buf := make([]byte, streamChunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if err := stream.Send(&vmxpb.ReadFileResponse{Data: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return status.InternalErrorf("read %s: %s", req.GetPath(), err)
+		}
+	}
+}
+
+func (x *execServer) WriteFile(stream vmxpb.Exec_WriteFileServer) error {
+	req, err := stream.Recv()
+	if err == io.EOF {
+		return status.InvalidArgumentError("stream was closed without receiving a request")
+	}
+	if err != nil {
+		return err
+	}
+	path := req.GetPath()
+	if !filepath.IsAbs(path) {
+		return status.InvalidArgumentErrorf("path %q is not absolute", path)
+	}
+	mode := os.FileMode(0644)
+	if req.GetMode() != 0 {
+		mode = os.FileMode(req.GetMode()) & os.ModePerm
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return status.InternalErrorf("create parent directory: %s", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return status.InternalErrorf("open %s: %s", path, err)
+	}
+	defer f.Close()
+	if err := f.Chmod(mode); err != nil {
+		return status.InternalErrorf("chmod %s: %s", path, err)
+	}
+	var size int64
+	for {
+		n, err := f.Write(req.GetData())
+		size += int64(n)
+		if err != nil {
+			return status.InternalErrorf("write %s: %s", path, err)
+		}
+		req, err = stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return status.InternalErrorf("close %s: %s", path, err)
+	}
+	log.Infof("Wrote %d bytes to %s", size, path)
+	return stream.SendAndClose(&vmxpb.WriteFileResponse{SizeBytes: size})
+}
+
+func (x *execServer) ForwardPort(stream vmxpb.Exec_ForwardPortServer) error {
+	req, err := stream.Recv()
+	if err == io.EOF {
+		return status.InvalidArgumentError("stream was closed without receiving a request")
+	}
+	if err != nil {
+		return err
+	}
+	port := req.GetPort()
+	if port <= 0 || port > 65535 {
+		return status.InvalidArgumentErrorf("invalid port %d", port)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(stream.Context(), "tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		return status.UnavailableErrorf("connect to port %d: %s", port, err)
+	}
+	defer conn.Close()
+
+	writeErr := make(chan error, 1)
+	go func() {
+		data := req.GetData()
+		for {
+			if _, err := conn.Write(data); err != nil {
+				writeErr <- status.UnavailableErrorf("write to port %d: %s", port, err)
+				return
+			}
+			next, err := stream.Recv()
+			if err == io.EOF {
+				// Let the server know that the client is done sending, but
+				// keep reading the server's response.
+				if tc, ok := conn.(*net.TCPConn); ok {
+					tc.CloseWrite()
+				}
+				writeErr <- nil
+				return
+			}
+			if err != nil {
+				writeErr <- err
+				// Unblock the read loop below.
+				conn.Close()
+				return
+			}
+			data = next.GetData()
+		}
+	}()
+	buf := make([]byte, streamChunkSize)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if err := stream.Send(&vmxpb.ForwardPortResponse{Data: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			select {
+			case err := <-writeErr:
+				if err != nil {
+					return err
+				}
+			default:
+			}
+			return status.UnavailableErrorf("read from port %d: %s", port, err)
+		}
+	}
+	return nil
+}
+
 type message struct {
 	Response *vmxpb.ExecStreamedResponse
 	Err      error
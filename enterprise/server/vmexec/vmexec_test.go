@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"net"
+	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -154,6 +157,81 @@ func TestExecStreamed_Crash(t *testing.T) {
 	assert.Equal(t, commandutil.KilledExitCode, res.ExitCode)
 }
 
+func TestWriteAndReadFile(t *testing.T) {
+	ctx := context.Background()
+	client := startExecService(t)
+	path := filepath.Join(testfs.MakeTempDir(t), "dir", "file")
+
+	wc, err := client.WriteFile(ctx)
+	require.NoError(t, err)
+	err = wc.Send(&vmxpb.WriteFileRequest{Path: path, Mode: 0755, Data: []byte("hello ")})
+	require.NoError(t, err)
+	err = wc.Send(&vmxpb.WriteFileRequest{Data: []byte("world")})
+	require.NoError(t, err)
+	rsp, err := wc.CloseAndRecv()
+	require.NoError(t, err)
+	assert.Equal(t, int64(len("hello world")), rsp.GetSizeBytes())
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+
+	rc, err := client.ReadFile(ctx, &vmxpb.ReadFileRequest{Path: path})
+	require.NoError(t, err)
+	var contents []byte
+	for {
+		rsp, err := rc.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		contents = append(contents, rsp.GetData()...)
+	}
+	assert.Equal(t, "hello world", string(contents))
+
+	rc, err = client.ReadFile(ctx, &vmxpb.ReadFileRequest{Path: path + "-nonexistent"})
+	require.NoError(t, err)
+	_, err = rc.Recv()
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+}
+
+func TestForwardPort(t *testing.T) {
+	ctx := context.Background()
+	client := startExecService(t)
+	// Start an echo server which uppercases what it receives.
+	lis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { lis.Close() })
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b, _ := io.ReadAll(conn)
+		conn.Write(bytes.ToUpper(b))
+	}()
+
+	stream, err := client.ForwardPort(ctx)
+	require.NoError(t, err)
+	port := lis.Addr().(*net.TCPAddr).Port
+	err = stream.Send(&vmxpb.ForwardPortRequest{Port: int32(port), Data: []byte("hello ")})
+	require.NoError(t, err)
+	err = stream.Send(&vmxpb.ForwardPortRequest{Data: []byte("world")})
+	require.NoError(t, err)
+	err = stream.CloseSend()
+	require.NoError(t, err)
+	var received []byte
+	for {
+		rsp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		received = append(received, rsp.GetData()...)
+	}
+	assert.Equal(t, "HELLO WORLD", string(received))
+}
+
 func startExecService(t *testing.T) vmxpb.ExecClient {
 	lis, err := net.Listen("tcp", "0.0.0.0:0")
 	require.NoError(t, err)
@@ -10,8 +10,12 @@ import (
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/fieldgetter"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/webhook_data"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/webhook_signature"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	gh_backend "github.com/buildbuddy-io/buildbuddy/server/backends/github"
+	gitutil "github.com/buildbuddy-io/buildbuddy/server/util/git"
 )
 
 const (
@@ -26,6 +30,9 @@ func NewProvider() interfaces.GitProvider {
 }
 
 func (*bitbucketGitProvider) ParseWebhookData(r *http.Request) (*interfaces.WebhookData, error) {
+	if eventName := r.Header.Get("X-Event-Key"); isDataCenterEvent(eventName) {
+		return parseDataCenterWebhookData(r, eventName)
+	}
 	if userAgent := r.Header.Get("User-Agent"); userAgent != expectedUserAgent {
 		return nil, status.UnimplementedErrorf("unexpected user agent: %q; only %q is supported", userAgent, expectedUserAgent)
 	}
@@ -91,30 +98,86 @@ func (*bitbucketGitProvider) ParseWebhookData(r *http.Request) (*interfaces.Webh
 }
 
 func (*bitbucketGitProvider) MatchRepoURL(u *url.URL) bool {
-	return u.Host == "bitbucket.com"
+	return u.Host == "bitbucket.com" || isDataCenterHost(u.Host)
 }
 
 func (*bitbucketGitProvider) MatchWebhookRequest(r *http.Request) bool {
 	return r.Header.Get("X-Event-Key") != ""
 }
 
-func (*bitbucketGitProvider) RegisterWebhook(ctx context.Context, accessToken, repoURL, webhookURL string) (string, error) {
-	return "", status.UnimplementedError("Not implemented")
+// dataCenterClientForRepo returns a Data Center API client for the given repo,
+// or an Unimplemented error if the repo is hosted on bitbucket.org.
+func dataCenterClientForRepo(accessToken, repoURL string) (*dataCenterClient, error) {
+	u, err := gitutil.NormalizeRepoURL(repoURL)
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("failed to parse Bitbucket repo URL %q: %s", repoURL, err)
+	}
+	if !isDataCenterHost(u.Host) {
+		return nil, status.UnimplementedError("Not implemented")
+	}
+	return newDataCenterClient(accessToken, repoURL)
+}
+
+// VerifyWebhookSignature checks the X-Hub-Signature header, which both
+// Bitbucket Cloud and Data Center set to the HMAC of the payload when the
+// webhook has a secret.
+func (*bitbucketGitProvider) VerifyWebhookSignature(r *http.Request, secret string) error {
+	return webhook_signature.VerifySHA256(r, "X-Hub-Signature", secret)
+}
+
+func (*bitbucketGitProvider) RegisterWebhook(ctx context.Context, accessToken, repoURL, webhookURL, secret string) (string, error) {
+	c, err := dataCenterClientForRepo(accessToken, repoURL)
+	if err != nil {
+		return "", err
+	}
+	return c.registerWebhook(ctx, webhookURL, secret)
 }
 
 func (*bitbucketGitProvider) UnregisterWebhook(ctx context.Context, accessToken, repoURL, webhookID string) error {
-	return status.UnimplementedError("Not implemented")
+	c, err := dataCenterClientForRepo(accessToken, repoURL)
+	if err != nil {
+		return err
+	}
+	return c.unregisterWebhook(ctx, webhookID)
 }
 
 func (*bitbucketGitProvider) GetFileContents(ctx context.Context, accessToken, repoURL, filePath, ref string) ([]byte, error) {
-	return nil, status.UnimplementedError("Not implemented")
+	c, err := dataCenterClientForRepo(accessToken, repoURL)
+	if err != nil {
+		return nil, err
+	}
+	return c.getFileContents(ctx, filePath, ref)
 }
 
 func (*bitbucketGitProvider) IsTrusted(ctx context.Context, accessToken, repoURL, user string) (bool, error) {
-	return false, status.UnimplementedError("Not implemented")
+	c, err := dataCenterClientForRepo(accessToken, repoURL)
+	if err != nil {
+		return false, err
+	}
+	return c.isTrusted(ctx, user)
 }
 
 func (*bitbucketGitProvider) CreateStatus(ctx context.Context, accessToken, repoURL, commitSHA string, payload any) error {
+	c, err := dataCenterClientForRepo(accessToken, repoURL)
+	if err != nil {
+		return err
+	}
+	s, ok := payload.(*gh_backend.GithubStatusPayload)
+	if !ok {
+		return status.InvalidArgumentErrorf("invalid Bitbucket status payload type %T (expected %T)", payload, &gh_backend.GithubStatusPayload{})
+	}
+	return c.createStatus(ctx, commitSHA, s)
+}
+
+func (*bitbucketGitProvider) MergePullRequest(ctx context.Context, accessToken, repoURL string, number int64, commitSHA, mergeMethod string) error {
+	return status.UnimplementedError("Not implemented")
+}
+
+func (*bitbucketGitProvider) GetPullRequest(ctx context.Context, accessToken, repoURL string, number int64) (*interfaces.WebhookData, error) {
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (*bitbucketGitProvider) CreatePullRequestComment(ctx context.Context, accessToken, repoURL string, number int64, body string) error {
 	return status.UnimplementedError("Not implemented")
 }
 
@@ -0,0 +1,402 @@
+package bitbucket
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/fieldgetter"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/webhook_data"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	gh_backend "github.com/buildbuddy-io/buildbuddy/server/backends/github"
+	gitutil "github.com/buildbuddy-io/buildbuddy/server/util/git"
+)
+
+var (
+	dataCenterHosts = flag.Slice("bitbucket.data_center_hosts", []string{}, "Hosts of self-hosted Bitbucket Data Center (or Bitbucket Server) instances that workflows may be set up for. Ex: bitbucket.example.com")
+)
+
+const (
+	// Data Center event keys.
+	// See https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html
+	refsChangedEvent         = "repo:refs_changed"
+	prOpenedEvent            = "pr:opened"
+	prFromRefUpdatedEvent    = "pr:from_ref_updated"
+	prReviewerApprovedEvent  = "pr:reviewer:approved"
+	dataCenterBranchRefType  = "BRANCH"
+	dataCenterDeleteRefType  = "DELETE"
+	dataCenterHTTPCloneLink  = "http"
+	dataCenterWebhookName    = "BuildBuddy"
+	dataCenterErrorBodyLimit = 1000
+)
+
+func isDataCenterEvent(eventName string) bool {
+	return eventName == refsChangedEvent || strings.HasPrefix(eventName, "pr:")
+}
+
+func isDataCenterHost(host string) bool {
+	return slices.Contains(*dataCenterHosts, host)
+}
+
+func parseDataCenterWebhookData(r *http.Request, eventName string) (*interfaces.WebhookData, error) {
+	switch eventName {
+	case refsChangedEvent:
+		payload := &DataCenterRefsChangedEventPayload{}
+		if err := unmarshalBody(r, payload); err != nil {
+			return nil, status.InvalidArgumentErrorf("failed to unmarshal %q event payload: %s", eventName, err)
+		}
+		v, err := fieldgetter.ExtractValues(
+			payload,
+			"Changes.0.Ref.DisplayID",
+			"Changes.0.Ref.Type",
+			"Changes.0.ToHash",
+			"Changes.0.Type",
+			"Repository.Public",
+		)
+		if err != nil {
+			return nil, err
+		}
+		if t := v["Changes.0.Ref.Type"]; t != dataCenterBranchRefType {
+			log.Printf("Ignoring non-branch push event (type %q)", t)
+			return nil, nil
+		}
+		if v["Changes.0.Type"] == dataCenterDeleteRefType {
+			log.Printf("Ignoring branch deletion event")
+			return nil, nil
+		}
+		repoURL, err := payload.Repository.httpCloneURL()
+		if err != nil {
+			return nil, err
+		}
+		branch := v["Changes.0.Ref.DisplayID"]
+		return &interfaces.WebhookData{
+			EventName:          webhook_data.EventName.Push,
+			PushedRepoURL:      repoURL,
+			PushedBranch:       branch,
+			SHA:                v["Changes.0.ToHash"],
+			TargetRepoURL:      repoURL,
+			TargetBranch:       branch,
+			IsTargetRepoPublic: v["Repository.Public"] == "true",
+		}, nil
+	case prOpenedEvent, prFromRefUpdatedEvent, prReviewerApprovedEvent:
+		payload := &DataCenterPullRequestEventPayload{}
+		if err := unmarshalBody(r, payload); err != nil {
+			return nil, status.InvalidArgumentErrorf("failed to unmarshal %q event payload: %s", eventName, err)
+		}
+		v, err := fieldgetter.ExtractValues(
+			payload,
+			"PullRequest.ID",
+			"PullRequest.Author.User.Name",
+			"PullRequest.FromRef.DisplayID",
+			"PullRequest.FromRef.LatestCommit",
+			"PullRequest.ToRef.DisplayID",
+			"PullRequest.ToRef.Repository.Public",
+		)
+		if err != nil {
+			return nil, err
+		}
+		pushedRepoURL, err := payload.PullRequest.FromRef.Repository.httpCloneURL()
+		if err != nil {
+			return nil, err
+		}
+		targetRepoURL, err := payload.PullRequest.ToRef.Repository.httpCloneURL()
+		if err != nil {
+			return nil, err
+		}
+		number, err := strconv.ParseInt(v["PullRequest.ID"], 10, 64)
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("invalid pull request ID %q", v["PullRequest.ID"])
+		}
+		wd := &interfaces.WebhookData{
+			EventName:          webhook_data.EventName.PullRequest,
+			PushedRepoURL:      pushedRepoURL,
+			PushedBranch:       v["PullRequest.FromRef.DisplayID"],
+			SHA:                v["PullRequest.FromRef.LatestCommit"],
+			TargetRepoURL:      targetRepoURL,
+			TargetBranch:       v["PullRequest.ToRef.DisplayID"],
+			IsTargetRepoPublic: v["PullRequest.ToRef.Repository.Public"] == "true",
+			PullRequestNumber:  number,
+			PullRequestAuthor:  v["PullRequest.Author.User.Name"],
+		}
+		if eventName == prReviewerApprovedEvent {
+			v, err := fieldgetter.ExtractValues(payload, "Participant.User.Name")
+			if err != nil {
+				return nil, err
+			}
+			wd.PullRequestApprover = v["Participant.User.Name"]
+		}
+		return wd, nil
+	default:
+		log.Printf("Ignoring webhook event: %s", eventName)
+		return nil, nil
+	}
+}
+
+// dataCenterClient calls the REST API of a Bitbucket Data Center instance,
+// scoped to a single repo.
+type dataCenterClient struct {
+	accessToken string
+	// URL of the repo within the REST API.
+	repoURL string
+}
+
+// newDataCenterClient returns a client for the given repo clone URL, which
+// has the form https://<host>[/<context-path>]/scm/<project-key>/<slug>.
+func newDataCenterClient(accessToken, repoURL string) (*dataCenterClient, error) {
+	u, err := gitutil.NormalizeRepoURL(repoURL)
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("failed to parse Bitbucket repo URL %q: %s", repoURL, err)
+	}
+	contextPath, repoPath, ok := strings.Cut(u.Path, "/scm/")
+	parts := strings.Split(strings.Trim(repoPath, "/"), "/")
+	if !ok || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, status.InvalidArgumentErrorf("invalid Bitbucket Data Center repo URL %q", repoURL)
+	}
+	apiURL := u.Scheme + "://" + u.Host + contextPath + "/rest/api/1.0"
+	return &dataCenterClient{
+		accessToken: accessToken,
+		repoURL:     apiURL + "/projects/" + url.PathEscape(parts[0]) + "/repos/" + url.PathEscape(parts[1]),
+	}, nil
+}
+
+func (c *dataCenterClient) registerWebhook(ctx context.Context, webhookURL, secret string) (string, error) {
+	hook := &struct {
+		ID int64 `json:"id"`
+	}{}
+	req := map[string]any{
+		"name":   dataCenterWebhookName,
+		"url":    webhookURL,
+		"active": true,
+		"events": []string{refsChangedEvent, prOpenedEvent, prFromRefUpdatedEvent, prReviewerApprovedEvent},
+	}
+	if secret != "" {
+		req["configuration"] = map[string]string{"secret": secret}
+	}
+	err := c.do(ctx, http.MethodPost, c.repoURL+"/webhooks", req, hook)
+	if err != nil {
+		return "", err
+	}
+	if hook.ID == 0 {
+		return "", status.UnknownError("Bitbucket returned invalid response from webhooks API (missing ID field).")
+	}
+	return strconv.FormatInt(hook.ID, 10), nil
+}
+
+func (c *dataCenterClient) unregisterWebhook(ctx context.Context, webhookID string) error {
+	if _, err := strconv.ParseInt(webhookID, 10, 64); err != nil {
+		return status.InvalidArgumentErrorf("invalid Bitbucket webhook ID %q", webhookID)
+	}
+	return c.do(ctx, http.MethodDelete, c.repoURL+"/webhooks/"+webhookID, nil, nil)
+}
+
+func (c *dataCenterClient) getFileContents(ctx context.Context, filePath, ref string) ([]byte, error) {
+	var b []byte
+	u := c.repoURL + "/raw/" + escapePath(filePath) + "?at=" + url.QueryEscape(ref)
+	err := c.doRaw(ctx, http.MethodGet, u, nil, func(r io.Reader) error {
+		var err error
+		b, err = io.ReadAll(r)
+		return err
+	})
+	if status.IsNotFoundError(err) {
+		// Bitbucket's API response is the same whether the repo or the file
+		// doesn't exist, so check whether the repo exists, so that the
+		// workflow is aborted if it doesn't rather than using the default
+		// config.
+		if err := c.do(ctx, http.MethodGet, c.repoURL, nil, nil); status.IsNotFoundError(err) {
+			return nil, status.FailedPreconditionError("repository not found or inaccessible")
+		} else if err != nil {
+			return nil, status.UnavailableErrorf("get repository: %s", err)
+		}
+		return nil, status.NotFoundErrorf("%s: not found", filePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// isTrusted returns whether the user has write access to the repo, either
+// through a repo permission or a permission on the repo's project.
+func (c *dataCenterClient) isTrusted(ctx context.Context, user string) (bool, error) {
+	projectURL, _, _ := strings.Cut(c.repoURL, "/repos/")
+	for _, permissionsURL := range []string{c.repoURL + "/permissions/users", projectURL + "/permissions/users"} {
+		rsp := &struct {
+			Values []struct {
+				User struct {
+					Name string `json:"name"`
+				} `json:"user"`
+				Permission string `json:"permission"`
+			} `json:"values"`
+		}{}
+		if err := c.do(ctx, http.MethodGet, permissionsURL+"?filter="+url.QueryEscape(user), nil, rsp); err != nil {
+			return false, status.InternalErrorf("failed to look up permissions of %s: %s", user, err)
+		}
+		for _, v := range rsp.Values {
+			if v.User.Name != user {
+				continue
+			}
+			switch v.Permission {
+			case "REPO_WRITE", "REPO_ADMIN", "PROJECT_WRITE", "PROJECT_ADMIN":
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (c *dataCenterClient) createStatus(ctx context.Context, commitSHA string, s *gh_backend.GithubStatusPayload) error {
+	var state string
+	switch gh_backend.State(s.GetState()) {
+	case gh_backend.PendingState:
+		state = "INPROGRESS"
+	case gh_backend.SuccessState:
+		state = "SUCCESSFUL"
+	case gh_backend.FailureState, gh_backend.ErrorState:
+		state = "FAILED"
+	default:
+		return status.InvalidArgumentErrorf("unknown commit status state %q", s.GetState())
+	}
+	return c.do(ctx, http.MethodPost, c.repoURL+"/commits/"+url.PathEscape(commitSHA)+"/builds", map[string]any{
+		"key":         s.GetContext(),
+		"name":        s.GetContext(),
+		"state":       state,
+		"url":         s.GetTargetURL(),
+		"description": s.GetDescription(),
+	}, nil)
+}
+
+func (c *dataCenterClient) do(ctx context.Context, method, u string, body, rsp any) error {
+	return c.doRaw(ctx, method, u, body, func(r io.Reader) error {
+		if rsp == nil {
+			return nil
+		}
+		return json.NewDecoder(r).Decode(rsp)
+	})
+}
+
+func (c *dataCenterClient) doRaw(ctx context.Context, method, u string, body any, read func(r io.Reader) error) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", "Bearer "+c.accessToken)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return status.UnavailableErrorf("Bitbucket API request failed: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return status.NotFoundErrorf("Bitbucket API returned 404 for %s %s", method, req.URL.Path)
+	}
+	if res.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(res.Body, dataCenterErrorBodyLimit))
+		return status.UnknownErrorf("Bitbucket API returned HTTP %d for %s %s: %s", res.StatusCode, method, req.URL.Path, string(b))
+	}
+	return read(res.Body)
+}
+
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// DataCenterRefsChangedEventPayload represents a subset of Bitbucket Data
+// Center's "repo:refs_changed" event schema.
+// See https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-Push
+type DataCenterRefsChangedEventPayload struct {
+	Repository *DataCenterRepository  `json:"repository"`
+	Changes    []*DataCenterRefChange `json:"changes"`
+}
+type DataCenterRefChange struct {
+	Ref    *DataCenterRef `json:"ref"`
+	ToHash string         `json:"toHash"`
+	// Type is one of ADD, UPDATE or DELETE.
+	Type string `json:"type"`
+}
+type DataCenterRef struct {
+	// DisplayID is the ref name without the refs/heads/ prefix.
+	DisplayID string `json:"displayId"`
+	// Type is BRANCH or TAG.
+	Type string `json:"type"`
+}
+
+// DataCenterPullRequestEventPayload represents a subset of Bitbucket Data
+// Center's pull request event schema.
+// See https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-Pullrequest
+type DataCenterPullRequestEventPayload struct {
+	PullRequest *DataCenterPullRequest `json:"pullRequest"`
+	// Participant is set on "pr:reviewer:*" events.
+	Participant *DataCenterParticipant `json:"participant"`
+}
+type DataCenterPullRequest struct {
+	ID      int64                     `json:"id"`
+	Author  *DataCenterParticipant    `json:"author"`
+	FromRef *DataCenterPullRequestRef `json:"fromRef"`
+	ToRef   *DataCenterPullRequestRef `json:"toRef"`
+}
+type DataCenterPullRequestRef struct {
+	DisplayID    string                `json:"displayId"`
+	LatestCommit string                `json:"latestCommit"`
+	Repository   *DataCenterRepository `json:"repository"`
+}
+type DataCenterParticipant struct {
+	User *DataCenterUser `json:"user"`
+}
+type DataCenterUser struct {
+	Name string `json:"name"`
+}
+
+// DataCenterRepository represents a subset of Bitbucket Data Center's
+// repository schema.
+type DataCenterRepository struct {
+	Public bool                       `json:"public"`
+	Links  *DataCenterRepositoryLinks `json:"links"`
+}
+type DataCenterRepositoryLinks struct {
+	Clone []*DataCenterLink `json:"clone"`
+}
+type DataCenterLink struct {
+	Href string `json:"href"`
+	Name string `json:"name"`
+}
+
+func (r *DataCenterRepository) httpCloneURL() (string, error) {
+	if r != nil && r.Links != nil {
+		for _, l := range r.Links.Clone {
+			if l.Name == dataCenterHTTPCloneLink {
+				// Clone URLs contain the username of the user who triggered
+				// the event, which normalization strips.
+				u, err := gitutil.NormalizeRepoURL(l.Href)
+				if err != nil {
+					return "", status.InvalidArgumentErrorf("invalid repository clone URL %q: %s", l.Href, err)
+				}
+				return u.String(), nil
+			}
+		}
+	}
+	return "", status.InvalidArgumentError("repository is missing an HTTP clone link")
+}
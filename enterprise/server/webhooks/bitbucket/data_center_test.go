@@ -0,0 +1,223 @@
+package bitbucket_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/bitbucket"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/bitbucket/test_data"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/webhook_signature"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testhttp"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	gh_backend "github.com/buildbuddy-io/buildbuddy/server/backends/github"
+)
+
+func dataCenterWebhookRequest(t *testing.T, eventType string, payload []byte) *http.Request {
+	req := webhookRequest(t, eventType, payload)
+	req.Header.Set("User-Agent", "Atlassian HttpClient 2.0.0 / Bitbucket-7.21.0 (7021000) / Default")
+	return req
+}
+
+func TestParseRequest_ValidDataCenterPushEvent_Success(t *testing.T) {
+	req := dataCenterWebhookRequest(t, "repo:refs_changed", test_data.DataCenterPushEvent)
+
+	data, err := bitbucket.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, &interfaces.WebhookData{
+		EventName:          "push",
+		PushedRepoURL:      "https://bitbucket.example.com/scm/bb/buildbuddy-ci-playground",
+		PushedBranch:       "main",
+		SHA:                "178864a7d521b6f5e720b386b2c2b0ef8563e0dc",
+		TargetRepoURL:      "https://bitbucket.example.com/scm/bb/buildbuddy-ci-playground",
+		TargetBranch:       "main",
+		IsTargetRepoPublic: true,
+	}, data)
+}
+
+func TestParseRequest_ValidDataCenterPullRequestEvent_Success(t *testing.T) {
+	req := dataCenterWebhookRequest(t, "pr:from_ref_updated", test_data.DataCenterPullRequestEvent)
+
+	data, err := bitbucket.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, &interfaces.WebhookData{
+		EventName:          "pull_request",
+		PushedRepoURL:      "https://bitbucket.example.com/scm/~contributor/buildbuddy-ci-playground",
+		PushedBranch:       "feature",
+		SHA:                "ef8755f06ee4b28c96a847a95cb8ec8ed6ddd1ca",
+		TargetRepoURL:      "https://bitbucket.example.com/scm/bb/buildbuddy-ci-playground",
+		TargetBranch:       "main",
+		IsTargetRepoPublic: true,
+		PullRequestNumber:  5,
+		PullRequestAuthor:  "contributor",
+	}, data)
+}
+
+func TestParseRequest_ValidDataCenterPullRequestApprovedEvent_Success(t *testing.T) {
+	req := dataCenterWebhookRequest(t, "pr:reviewer:approved", test_data.DataCenterPullRequestApprovedEvent)
+
+	data, err := bitbucket.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "contributor", data.PullRequestAuthor)
+	assert.Equal(t, "maintainer", data.PullRequestApprover)
+}
+
+func TestParseRequest_UnknownDataCenterEvent_Ignored(t *testing.T) {
+	req := dataCenterWebhookRequest(t, "pr:comment:added", []byte(`{}`))
+
+	data, err := bitbucket.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+}
+
+// startDataCenterServer starts a fake Bitbucket Data Center server and
+// returns the clone URL of a repo hosted on it.
+func startDataCenterServer(t *testing.T, handler http.HandlerFunc) string {
+	u := testhttp.StartServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer TOKEN" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}))
+	host := "localhost:" + u.Port()
+	flags.Set(t, "bitbucket.data_center_hosts", []string{host})
+	// Repo URLs are normalized to https unless they point to localhost.
+	return "http://" + host + "/scm/bb/ci-playground.git"
+}
+
+const repoAPIPath = "/rest/api/1.0/projects/bb/repos/ci-playground"
+
+func TestDataCenterCreateStatus(t *testing.T) {
+	var path string
+	var body map[string]any
+	repoURL := startDataCenterServer(t, func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	payload := gh_backend.NewGithubStatusPayload("Test", "https://app.buildbuddy.io/invocation/foo", "Running...", gh_backend.PendingState)
+
+	err := bitbucket.NewProvider().CreateStatus(context.Background(), "TOKEN", repoURL, "abc123", payload)
+
+	require.NoError(t, err)
+	assert.Equal(t, repoAPIPath+"/commits/abc123/builds", path)
+	assert.Equal(t, map[string]any{
+		"key":         "Test",
+		"name":        "Test",
+		"state":       "INPROGRESS",
+		"url":         "https://app.buildbuddy.io/invocation/foo",
+		"description": "Running...",
+	}, body)
+}
+
+func TestDataCenterGetFileContents(t *testing.T) {
+	repoURL := startDataCenterServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case repoAPIPath + "/raw/buildbuddy.yaml":
+			assert.Equal(t, "abc123", r.URL.Query().Get("at"))
+			w.Write([]byte("actions: []\n"))
+		case repoAPIPath:
+			w.Write([]byte(`{"slug": "ci-playground"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	p := bitbucket.NewProvider()
+	ctx := context.Background()
+
+	b, err := p.GetFileContents(ctx, "TOKEN", repoURL, "buildbuddy.yaml", "abc123")
+	require.NoError(t, err)
+	assert.Equal(t, "actions: []\n", string(b))
+
+	_, err = p.GetFileContents(ctx, "TOKEN", repoURL, "missing.yaml", "abc123")
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound error, got %v", err)
+
+	_, err = p.GetFileContents(ctx, "TOKEN", "http://localhost:1/scm/bb/unknown-host", "buildbuddy.yaml", "abc123")
+	assert.True(t, status.IsUnimplementedError(err), "expected Unimplemented error for unconfigured host, got %v", err)
+}
+
+func TestDataCenterIsTrusted(t *testing.T) {
+	repoURL := startDataCenterServer(t, func(w http.ResponseWriter, r *http.Request) {
+		user := r.URL.Query().Get("filter")
+		switch {
+		case r.URL.Path == repoAPIPath+"/permissions/users" && user == "repo-writer":
+			w.Write([]byte(`{"values": [{"user": {"name": "repo-writer"}, "permission": "REPO_WRITE"}]}`))
+		case r.URL.Path == "/rest/api/1.0/projects/bb/permissions/users" && user == "project-admin":
+			w.Write([]byte(`{"values": [{"user": {"name": "project-admin"}, "permission": "PROJECT_ADMIN"}]}`))
+		case user == "reader":
+			w.Write([]byte(`{"values": [{"user": {"name": "reader"}, "permission": "REPO_READ"}]}`))
+		default:
+			w.Write([]byte(`{"values": []}`))
+		}
+	})
+	p := bitbucket.NewProvider()
+	for _, tc := range []struct {
+		user    string
+		trusted bool
+	}{
+		{"repo-writer", true},
+		{"project-admin", true},
+		{"reader", false},
+		{"outsider", false},
+	} {
+		trusted, err := p.IsTrusted(context.Background(), "TOKEN", repoURL, tc.user)
+		require.NoError(t, err)
+		assert.Equal(t, tc.trusted, trusted, "user %s", tc.user)
+	}
+}
+
+func TestDataCenterRegisterWebhook(t *testing.T) {
+	var method, path string
+	var events []any
+	var configuration any
+	repoURL := startDataCenterServer(t, func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		path = r.URL.Path
+		if r.Method == http.MethodPost {
+			body := map[string]any{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			events = body["events"].([]any)
+			configuration = body["configuration"]
+			w.Write([]byte(`{"id": 7}`))
+		}
+	})
+	p := bitbucket.NewProvider()
+
+	id, err := p.RegisterWebhook(context.Background(), "TOKEN", repoURL, "https://app.buildbuddy.io/webhooks/workflow/foo", "SECRET")
+	require.NoError(t, err)
+	assert.Equal(t, "7", id)
+	assert.Equal(t, repoAPIPath+"/webhooks", path)
+	assert.Contains(t, events, "repo:refs_changed")
+	assert.Equal(t, map[string]any{"secret": "SECRET"}, configuration)
+
+	err = p.UnregisterWebhook(context.Background(), "TOKEN", repoURL, id)
+	require.NoError(t, err)
+	assert.Equal(t, http.MethodDelete, method)
+	assert.Equal(t, repoAPIPath+"/webhooks/7", path)
+}
+
+func TestDataCenterVerifyWebhookSignature(t *testing.T) {
+	p := bitbucket.NewProvider()
+	req := dataCenterWebhookRequest(t, "repo:refs_changed", test_data.DataCenterPushEvent)
+	req.Header.Set("X-Hub-Signature", webhook_signature.SignSHA256("SECRET", test_data.DataCenterPushEvent))
+
+	require.NoError(t, p.VerifyWebhookSignature(req, "SECRET"))
+	data, err := p.ParseWebhookData(req)
+	require.NoError(t, err)
+	assert.Equal(t, "push", data.EventName)
+
+	req = dataCenterWebhookRequest(t, "repo:refs_changed", test_data.DataCenterPushEvent)
+	err = p.VerifyWebhookSignature(req, "SECRET")
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+}
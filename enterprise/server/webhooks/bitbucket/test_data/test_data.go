@@ -7,3 +7,12 @@ var PushEvent []byte
 
 //go:embed pull_request_event.json
 var PullRequestEvent []byte
+
+//go:embed data_center_push_event.json
+var DataCenterPushEvent []byte
+
+//go:embed data_center_pull_request_event.json
+var DataCenterPullRequestEvent []byte
+
+//go:embed data_center_pull_request_approved_event.json
+var DataCenterPullRequestApprovedEvent []byte
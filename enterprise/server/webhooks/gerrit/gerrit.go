@@ -0,0 +1,448 @@
+package gerrit
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/fieldgetter"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/webhook_data"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	gh_backend "github.com/buildbuddy-io/buildbuddy/server/backends/github"
+	gitutil "github.com/buildbuddy-io/buildbuddy/server/util/git"
+)
+
+var (
+	servers = flag.Slice("gerrit.servers", []Server{}, "Gerrit servers that workflows may be set up for. The access token of these workflows must be the HTTP password of the configured account.")
+)
+
+type Server struct {
+	Host     string `yaml:"host" json:"host" usage:"The host name of the Gerrit server. Ex: review.example.com"`
+	Username string `yaml:"username" json:"username" usage:"The username of the Gerrit account that workflows use to call the REST API and vote on changes."`
+}
+
+const (
+	patchsetCreatedEvent = "patchset-created"
+	changeMergedEvent    = "change-merged"
+
+	// The label that workflow results are reported to.
+	verifiedLabel = "Verified"
+
+	// Tag of the review messages posted by BuildBuddy. Gerrit treats messages
+	// with the "autogenerated:" prefix as bot messages, which can be hidden in
+	// the UI.
+	reviewTag = "autogenerated:buildbuddy"
+
+	// Gerrit prefixes JSON responses with this line to prevent XSSI.
+	xssiPrefix = ")]}'"
+
+	// The maximum webhook payload size that is inspected when classifying
+	// webhook requests.
+	maxPayloadSize = 25_000_000
+)
+
+type gerritGitProvider struct {
+	client *http.Client
+}
+
+func NewProvider() interfaces.GitProvider {
+	return &gerritGitProvider{client: http.DefaultClient}
+}
+
+func lookupServer(host string) *Server {
+	for i := range *servers {
+		if (*servers)[i].Host == host {
+			return &(*servers)[i]
+		}
+	}
+	return nil
+}
+
+func (*gerritGitProvider) MatchRepoURL(u *url.URL) bool {
+	return lookupServer(u.Host) != nil
+}
+
+// MatchWebhookRequest matches requests sent by the Gerrit webhooks plugin.
+// The plugin doesn't send any identifying headers, so the payload is
+// inspected instead. Events forwarded from `gerrit stream-events` have the
+// same format and are matched as well.
+func (*gerritGitProvider) MatchWebhookRequest(r *http.Request) bool {
+	b, err := io.ReadAll(io.LimitReader(r.Body, maxPayloadSize))
+	if err != nil {
+		return false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(b))
+	payload := &struct {
+		Type   string           `json:"type"`
+		Change *json.RawMessage `json:"change"`
+	}{}
+	if err := json.Unmarshal(b, payload); err != nil {
+		return false
+	}
+	return payload.Type != "" && payload.Change != nil
+}
+
+func (*gerritGitProvider) ParseWebhookData(r *http.Request) (*interfaces.WebhookData, error) {
+	payload := &EventPayload{}
+	if err := unmarshalBody(r, payload); err != nil {
+		return nil, status.InvalidArgumentErrorf("failed to unmarshal %q event payload: %s", payload.Type, err)
+	}
+	switch payload.Type {
+	case patchsetCreatedEvent:
+		v, err := fieldgetter.ExtractValues(
+			payload,
+			"Change.Project",
+			"Change.Branch",
+			"Change.Number",
+			"Change.URL",
+			"PatchSet.Revision",
+			"PatchSet.Ref",
+			"Uploader.Username",
+		)
+		if err != nil {
+			return nil, err
+		}
+		repoURL, err := repoURLFromChange(v["Change.URL"], v["Change.Project"])
+		if err != nil {
+			return nil, err
+		}
+		number, err := strconv.ParseInt(v["Change.Number"], 10, 64)
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("invalid change number %q", v["Change.Number"])
+		}
+		// Patch sets are fetched from refs/changes/* in the target repo, but
+		// anyone with refs/for/* push permission may upload them, so they're
+		// only trusted if the uploader is.
+		return &interfaces.WebhookData{
+			EventName:           webhook_data.EventName.PullRequest,
+			PushedRepoURL:       repoURL,
+			PushedBranch:        v["PatchSet.Ref"],
+			SHA:                 v["PatchSet.Revision"],
+			TargetRepoURL:       repoURL,
+			TargetBranch:        v["Change.Branch"],
+			IsUploadedForReview: true,
+			PullRequestNumber:   number,
+			PullRequestAuthor:   v["Uploader.Username"],
+		}, nil
+	case changeMergedEvent:
+		v, err := fieldgetter.ExtractValues(
+			payload,
+			"Change.Project",
+			"Change.Branch",
+			"Change.URL",
+			"NewRev",
+		)
+		if err != nil {
+			return nil, err
+		}
+		repoURL, err := repoURLFromChange(v["Change.URL"], v["Change.Project"])
+		if err != nil {
+			return nil, err
+		}
+		// Gerrit events don't include the project's default branch, so
+		// TargetRepoDefaultBranch is left unset.
+		return &interfaces.WebhookData{
+			EventName:     webhook_data.EventName.Push,
+			PushedRepoURL: repoURL,
+			PushedBranch:  v["Change.Branch"],
+			SHA:           v["NewRev"],
+			TargetRepoURL: repoURL,
+			TargetBranch:  v["Change.Branch"],
+		}, nil
+	default:
+		log.Printf("Ignoring webhook event: %s", payload.Type)
+		return nil, nil
+	}
+}
+
+// repoURLFromChange returns the URL of the repo of a change, given the
+// change's URL and project name.
+func repoURLFromChange(changeURL, project string) (string, error) {
+	u, err := url.Parse(changeURL)
+	if err != nil || u.Host == "" {
+		return "", status.InvalidArgumentErrorf("invalid change URL %q", changeURL)
+	}
+	return u.Scheme + "://" + u.Host + "/" + project, nil
+}
+
+// VerifyWebhookSignature always fails, since the webhooks plugin doesn't sign
+// deliveries. Workflows for Gerrit repos can't be used when webhook signatures
+// are required.
+func (*gerritGitProvider) VerifyWebhookSignature(r *http.Request, secret string) error {
+	return status.UnimplementedError("Gerrit webhook deliveries are not signed")
+}
+
+func (*gerritGitProvider) RegisterWebhook(ctx context.Context, accessToken, repoURL, webhookURL, secret string) (string, error) {
+	return "", status.UnimplementedError("Gerrit webhooks must be configured with the webhooks plugin")
+}
+
+func (*gerritGitProvider) UnregisterWebhook(ctx context.Context, accessToken, repoURL, webhookID string) error {
+	return status.UnimplementedError("Gerrit webhooks must be configured with the webhooks plugin")
+}
+
+func (p *gerritGitProvider) GetFileContents(ctx context.Context, accessToken, repoURL, filePath, ref string) ([]byte, error) {
+	c, err := newClient(p.client, accessToken, repoURL)
+	if err != nil {
+		return nil, err
+	}
+	var encoded []byte
+	path := "/projects/" + url.PathEscape(c.project) + "/commits/" + url.PathEscape(ref) + "/files/" + url.PathEscape(filePath) + "/content"
+	err = c.do(ctx, http.MethodGet, path, nil, func(r io.Reader) error {
+		var err error
+		encoded, err = io.ReadAll(r)
+		return err
+	})
+	if status.IsNotFoundError(err) {
+		// Gerrit's API response is the same whether the project or the file
+		// doesn't exist, so check whether the project exists, so that the
+		// workflow is aborted if it doesn't rather than using the default
+		// config.
+		if err := c.doJSON(ctx, http.MethodGet, "/projects/"+url.PathEscape(c.project), nil, nil); status.IsNotFoundError(err) {
+			return nil, status.FailedPreconditionErrorf("repository %q not found or inaccessible", repoURL)
+		} else if err != nil {
+			return nil, status.UnavailableErrorf("get repository %q: %s", repoURL, err)
+		}
+		return nil, status.NotFoundErrorf("%s: not found in %s", filePath, repoURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	b, err := base64.StdEncoding.DecodeString(string(encoded))
+	if err != nil {
+		return nil, status.UnknownErrorf("failed to decode %s: %s", filePath, err)
+	}
+	return b, nil
+}
+
+// IsTrusted returns whether the user may push to the repo's default branch.
+func (p *gerritGitProvider) IsTrusted(ctx context.Context, accessToken, repoURL, user string) (bool, error) {
+	c, err := newClient(p.client, accessToken, repoURL)
+	if err != nil {
+		return false, err
+	}
+	var head string
+	if err := c.doJSON(ctx, http.MethodGet, "/projects/"+url.PathEscape(c.project)+"/HEAD", nil, &head); err != nil {
+		return false, status.InternalErrorf("failed to get HEAD of %s: %s", repoURL, err)
+	}
+	q := url.Values{}
+	q.Set("account", user)
+	q.Set("ref", head)
+	q.Set("perm", "push")
+	rsp := &struct {
+		Status int `json:"status"`
+	}{}
+	path := "/projects/" + url.PathEscape(c.project) + "/check.access?" + q.Encode()
+	if err := c.doJSON(ctx, http.MethodGet, path, nil, rsp); err != nil {
+		if status.IsNotFoundError(err) {
+			return false, nil
+		}
+		return false, status.InternalErrorf("failed to check access of %s to %s: %s", user, repoURL, err)
+	}
+	return rsp.Status == http.StatusOK, nil
+}
+
+// CreateStatus reports a workflow status as a Verified vote on the change
+// that the commit belongs to. The payload is a GitHub status payload.
+//
+// Pending statuses are not reported, since votes can't express them. A
+// passing action doesn't override the rejection of another action on the same
+// patch set.
+func (p *gerritGitProvider) CreateStatus(ctx context.Context, accessToken, repoURL, commitSHA string, payload any) error {
+	s, ok := payload.(*gh_backend.GithubStatusPayload)
+	if !ok {
+		return status.InvalidArgumentErrorf("invalid Gerrit status payload type %T (expected %T)", payload, &gh_backend.GithubStatusPayload{})
+	}
+	var vote int
+	switch gh_backend.State(s.GetState()) {
+	case gh_backend.PendingState:
+		return nil
+	case gh_backend.SuccessState:
+		vote = 1
+	case gh_backend.FailureState, gh_backend.ErrorState:
+		vote = -1
+	default:
+		return status.InvalidArgumentErrorf("unknown commit status state %q", s.GetState())
+	}
+	c, err := newClient(p.client, accessToken, repoURL)
+	if err != nil {
+		return err
+	}
+
+	q := url.Values{}
+	q.Set("q", fmt.Sprintf("commit:%s project:%s", commitSHA, c.project))
+	var changes []struct {
+		Number int64 `json:"_number"`
+	}
+	if err := c.doJSON(ctx, http.MethodGet, "/changes/?"+q.Encode(), nil, &changes); err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		// Commits that were pushed directly to a branch don't belong to a
+		// change.
+		log.CtxDebugf(ctx, "Not reporting Gerrit vote for %s @ %s (no matching change)", repoURL, commitSHA)
+		return nil
+	}
+	revisionPath := fmt.Sprintf("/changes/%s~%d/revisions/%s", url.PathEscape(c.project), changes[0].Number, url.PathEscape(commitSHA))
+
+	if vote > 0 {
+		votes := map[string]int{}
+		if err := c.doJSON(ctx, http.MethodGet, revisionPath+"/reviewers/self/votes", nil, &votes); err != nil && !status.IsNotFoundError(err) {
+			return err
+		}
+		if votes[verifiedLabel] < 0 {
+			vote = -1
+		}
+	}
+	message := fmt.Sprintf("%s: %s", s.GetContext(), s.GetDescription())
+	if s.GetTargetURL() != "" {
+		message += "\n\n" + s.GetTargetURL()
+	}
+	review := map[string]any{
+		"message": message,
+		"tag":     reviewTag,
+		"labels":  map[string]int{verifiedLabel: vote},
+	}
+	return c.doJSON(ctx, http.MethodPost, revisionPath+"/review", review, nil)
+}
+
+// MergePullRequest is not implemented, since changes are submitted according
+// to the project's submit requirements rather than a merge queue.
+func (p *gerritGitProvider) MergePullRequest(ctx context.Context, accessToken, repoURL string, number int64, commitSHA, mergeMethod string) error {
+	return status.UnimplementedError("Not implemented")
+}
+
+// GetPullRequest and CreatePullRequestComment are not implemented, since
+// pull request commands are only supported for GitHub.
+func (p *gerritGitProvider) GetPullRequest(ctx context.Context, accessToken, repoURL string, number int64) (*interfaces.WebhookData, error) {
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (p *gerritGitProvider) CreatePullRequestComment(ctx context.Context, accessToken, repoURL string, number int64, body string) error {
+	return status.UnimplementedError("Not implemented")
+}
+
+type client struct {
+	httpClient *http.Client
+	// Base URL of the authenticated REST API.
+	apiURL   string
+	username string
+	password string
+	project  string
+}
+
+func newClient(httpClient *http.Client, accessToken, repoURL string) (*client, error) {
+	u, err := gitutil.NormalizeRepoURL(repoURL)
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("failed to parse Gerrit repo URL %q: %s", repoURL, err)
+	}
+	s := lookupServer(u.Host)
+	if s == nil {
+		return nil, status.InvalidArgumentErrorf("%s is not a configured Gerrit server", u.Host)
+	}
+	project := strings.TrimPrefix(strings.Trim(u.Path, "/"), "a/")
+	if project == "" {
+		return nil, status.InvalidArgumentErrorf("invalid Gerrit repo URL %q", repoURL)
+	}
+	return &client{
+		httpClient: httpClient,
+		apiURL:     u.Scheme + "://" + u.Host + "/a",
+		username:   s.Username,
+		password:   accessToken,
+		project:    project,
+	}, nil
+}
+
+func (c *client) doJSON(ctx context.Context, method, path string, body, rsp any) error {
+	return c.do(ctx, method, path, body, func(r io.Reader) error {
+		if rsp == nil {
+			return nil
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		b = bytes.TrimPrefix(b, []byte(xssiPrefix))
+		return json.Unmarshal(b, rsp)
+	})
+}
+
+func (c *client) do(ctx context.Context, method, path string, body any, read func(r io.Reader) error) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.apiURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.SetBasicAuth(c.username, c.password)
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return status.UnavailableErrorf("Gerrit API request failed: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return status.NotFoundErrorf("Gerrit API returned 404 for %s %s", method, req.URL.Path)
+	}
+	if res.StatusCode >= 300 {
+		const limit = 1000
+		b, _ := io.ReadAll(io.LimitReader(res.Body, limit))
+		return status.UnknownErrorf("Gerrit API returned HTTP %d for %s %s: %s", res.StatusCode, method, req.URL.Path, string(b))
+	}
+	return read(res.Body)
+}
+
+func unmarshalBody(r *http.Request, payload interface{}) error {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, payload)
+}
+
+// EventPayload represents the subset of Gerrit's event schema shared by
+// patchset-created and change-merged events.
+// See https://gerrit-review.googlesource.com/Documentation/cmd-stream-events.html#events
+type EventPayload struct {
+	Type     string    `json:"type"`
+	Change   *Change   `json:"change"`
+	PatchSet *PatchSet `json:"patchSet"`
+	// Uploader is set on patchset-created events.
+	Uploader *Account `json:"uploader"`
+	// NewRev is set on change-merged events, and is the resulting revision of
+	// the target branch.
+	NewRev string `json:"newRev"`
+}
+type Change struct {
+	Project string   `json:"project"`
+	Branch  string   `json:"branch"`
+	Number  int64    `json:"number"`
+	URL     string   `json:"url"`
+	Owner   *Account `json:"owner"`
+}
+type PatchSet struct {
+	Number   int64  `json:"number"`
+	Revision string `json:"revision"`
+	Ref      string `json:"ref"`
+}
+type Account struct {
+	Username string `json:"username"`
+}
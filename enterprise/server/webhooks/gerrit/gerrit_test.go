@@ -0,0 +1,233 @@
+package gerrit_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/gerrit"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/gerrit/test_data"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testhttp"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	gh_backend "github.com/buildbuddy-io/buildbuddy/server/backends/github"
+)
+
+func webhookRequest(t *testing.T, payload []byte) *http.Request {
+	req, err := http.NewRequest("POST", "https://buildbuddy.io/webhooks/foo", bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	return req
+}
+
+func TestMatchWebhookRequest(t *testing.T) {
+	p := gerrit.NewProvider()
+	req := webhookRequest(t, test_data.PatchsetCreatedEvent)
+
+	assert.True(t, p.MatchWebhookRequest(req))
+	// The payload can still be parsed after matching the request.
+	data, err := p.ParseWebhookData(req)
+	require.NoError(t, err)
+	assert.NotNil(t, data)
+
+	assert.False(t, p.MatchWebhookRequest(webhookRequest(t, []byte(`{"ref": "refs/heads/main"}`))))
+	assert.False(t, p.MatchWebhookRequest(webhookRequest(t, []byte(`not json`))))
+}
+
+func TestParseRequest_ValidPatchsetCreatedEvent_Success(t *testing.T) {
+	req := webhookRequest(t, test_data.PatchsetCreatedEvent)
+
+	data, err := gerrit.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, &interfaces.WebhookData{
+		EventName:           "pull_request",
+		PushedRepoURL:       "https://review.buildbuddy.io/buildbuddy-ci-playground",
+		PushedBranch:        "refs/changes/23/123/2",
+		SHA:                 "0b1b0c1f0ae8e7d0c1a1e1f3e4a2a0b1c2d3e4f5",
+		TargetRepoURL:       "https://review.buildbuddy.io/buildbuddy-ci-playground",
+		TargetBranch:        "main",
+		IsUploadedForReview: true,
+		PullRequestNumber:   123,
+		PullRequestAuthor:   "buildbuddy-bot",
+	}, data)
+}
+
+func TestParseRequest_ValidChangeMergedEvent_Success(t *testing.T) {
+	req := webhookRequest(t, test_data.ChangeMergedEvent)
+
+	data, err := gerrit.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, &interfaces.WebhookData{
+		EventName:     "push",
+		PushedRepoURL: "https://review.buildbuddy.io/buildbuddy-ci-playground",
+		PushedBranch:  "main",
+		SHA:           "4f0c8e1b2a3d4c5b6a7980f1e2d3c4b5a6978877",
+		TargetRepoURL: "https://review.buildbuddy.io/buildbuddy-ci-playground",
+		TargetBranch:  "main",
+	}, data)
+}
+
+func TestParseRequest_UnknownEvent_Ignored(t *testing.T) {
+	req := webhookRequest(t, []byte(`{"type": "comment-added", "change": {}}`))
+
+	data, err := gerrit.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+}
+
+// startAPIServer starts a fake Gerrit server and returns the URL of a repo
+// hosted on it.
+func startAPIServer(t *testing.T, handler http.HandlerFunc) string {
+	u := testhttp.StartServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "buildbuddy" || password != "PASSWORD" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}))
+	host := "localhost:" + u.Port()
+	flags.Set(t, "gerrit.servers", []gerrit.Server{{Host: host, Username: "buildbuddy"}})
+	// Repo URLs are normalized to https unless they point to localhost.
+	return "http://" + host + "/buildbuddy/ci-playground"
+}
+
+func writeJSON(w http.ResponseWriter, s string) {
+	w.Write([]byte(")]}'\n" + s))
+}
+
+func TestMatchRepoURL(t *testing.T) {
+	repoURL := startAPIServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	p := gerrit.NewProvider()
+
+	u, err := url.Parse(repoURL)
+	require.NoError(t, err)
+	assert.True(t, p.MatchRepoURL(u))
+	u, err = url.Parse("https://github.com/buildbuddy-io/buildbuddy")
+	require.NoError(t, err)
+	assert.False(t, p.MatchRepoURL(u))
+}
+
+func TestGetFileContents(t *testing.T) {
+	repoURL := startAPIServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/a/projects/buildbuddy%2Fci-playground/commits/abc123/files/buildbuddy.yaml/content":
+			w.Write([]byte(base64.StdEncoding.EncodeToString([]byte("actions: []\n"))))
+		case "/a/projects/buildbuddy%2Fci-playground":
+			writeJSON(w, `{"id": "buildbuddy%2Fci-playground"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	p := gerrit.NewProvider()
+	ctx := context.Background()
+
+	b, err := p.GetFileContents(ctx, "PASSWORD", repoURL, "buildbuddy.yaml", "abc123")
+	require.NoError(t, err)
+	assert.Equal(t, "actions: []\n", string(b))
+
+	_, err = p.GetFileContents(ctx, "PASSWORD", repoURL, "missing.yaml", "abc123")
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound error, got %v", err)
+
+	_, err = p.GetFileContents(ctx, "PASSWORD", repoURL+"-missing", "buildbuddy.yaml", "abc123")
+	assert.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition error, got %v", err)
+}
+
+func TestIsTrusted(t *testing.T) {
+	repoURL := startAPIServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/a/projects/buildbuddy%2Fci-playground/HEAD":
+			writeJSON(w, `"refs/heads/main"`)
+		case "/a/projects/buildbuddy%2Fci-playground/check.access":
+			assert.Equal(t, "refs/heads/main", r.URL.Query().Get("ref"))
+			assert.Equal(t, "push", r.URL.Query().Get("perm"))
+			if r.URL.Query().Get("account") == "maintainer" {
+				writeJSON(w, `{"status": 200}`)
+			} else {
+				writeJSON(w, `{"status": 403, "message": "not permitted"}`)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	p := gerrit.NewProvider()
+
+	trusted, err := p.IsTrusted(context.Background(), "PASSWORD", repoURL, "maintainer")
+	require.NoError(t, err)
+	assert.True(t, trusted)
+	trusted, err = p.IsTrusted(context.Background(), "PASSWORD", repoURL, "outsider")
+	require.NoError(t, err)
+	assert.False(t, trusted)
+}
+
+func TestCreateStatus(t *testing.T) {
+	currentVote := 0
+	var reviews []map[string]any
+	repoURL := startAPIServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/a/changes/":
+			if r.URL.Query().Get("q") == "commit:abc123 project:buildbuddy/ci-playground" {
+				writeJSON(w, `[{"_number": 123}]`)
+			} else {
+				writeJSON(w, `[]`)
+			}
+		case "/a/changes/buildbuddy%2Fci-playground~123/revisions/abc123/reviewers/self/votes":
+			writeJSON(w, `{"Code-Review": 0, "Verified": `+strconv.Itoa(currentVote)+`}`)
+		case "/a/changes/buildbuddy%2Fci-playground~123/revisions/abc123/review":
+			b, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			review := map[string]any{}
+			require.NoError(t, json.Unmarshal(b, &review))
+			reviews = append(reviews, review)
+			currentVote = int(review["labels"].(map[string]any)["Verified"].(float64))
+			writeJSON(w, `{}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	p := gerrit.NewProvider()
+	ctx := context.Background()
+
+	// Pending statuses aren't reported.
+	err := p.CreateStatus(ctx, "PASSWORD", repoURL, "abc123", gh_backend.NewGithubStatusPayload("Test", "https://app.buildbuddy.io/invocation/1", "Running...", gh_backend.PendingState))
+	require.NoError(t, err)
+	assert.Empty(t, reviews)
+
+	err = p.CreateStatus(ctx, "PASSWORD", repoURL, "abc123", gh_backend.NewGithubStatusPayload("Test", "https://app.buildbuddy.io/invocation/1", "Failed", gh_backend.FailureState))
+	require.NoError(t, err)
+	require.Len(t, reviews, 1)
+	assert.Equal(t, "Test: Failed\n\nhttps://app.buildbuddy.io/invocation/1", reviews[0]["message"])
+	assert.Equal(t, "autogenerated:buildbuddy", reviews[0]["tag"])
+	assert.Equal(t, -1, currentVote)
+
+	// A passing action doesn't override the failure of another action.
+	err = p.CreateStatus(ctx, "PASSWORD", repoURL, "abc123", gh_backend.NewGithubStatusPayload("Lint", "https://app.buildbuddy.io/invocation/2", "Successful", gh_backend.SuccessState))
+	require.NoError(t, err)
+	require.Len(t, reviews, 2)
+	assert.Equal(t, -1, currentVote)
+
+	currentVote = 0
+	err = p.CreateStatus(ctx, "PASSWORD", repoURL, "abc123", gh_backend.NewGithubStatusPayload("Lint", "https://app.buildbuddy.io/invocation/2", "Successful", gh_backend.SuccessState))
+	require.NoError(t, err)
+	assert.Equal(t, 1, currentVote)
+
+	// Commits that don't belong to a change are ignored.
+	err = p.CreateStatus(ctx, "PASSWORD", repoURL, "def456", gh_backend.NewGithubStatusPayload("Lint", "https://app.buildbuddy.io/invocation/2", "Successful", gh_backend.SuccessState))
+	require.NoError(t, err)
+	assert.Len(t, reviews, 3)
+}
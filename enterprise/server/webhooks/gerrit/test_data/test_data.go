@@ -0,0 +1,9 @@
+package test_data
+
+import _ "embed"
+
+//go:embed patchset_created_event.json
+var PatchsetCreatedEvent []byte
+
+//go:embed change_merged_event.json
+var ChangeMergedEvent []byte
@@ -12,6 +12,7 @@ import (
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/fieldgetter"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/webhook_data"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/webhook_signature"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
@@ -24,7 +25,12 @@ import (
 
 var (
 	// GitHub event names to listen for on the webhook.
-	eventsToReceive = []string{"push", "pull_request", "pull_request_review"}
+	eventsToReceive = []string{"push", "pull_request", "pull_request_review", "issue_comment"}
+)
+
+const (
+	// GitHub lists at most this many commits in a push event payload.
+	maxPushEventCommits = 2048
 )
 
 type githubGitProvider struct {
@@ -45,7 +51,7 @@ func newGitHubClient(ctx context.Context, accessToken string) *gh.Client {
 
 // RegisterWebhook registers the given webhook to the repo and returns the ID of
 // the registered webhook.
-func (*githubGitProvider) RegisterWebhook(ctx context.Context, accessToken, repoURL, webhookURL string) (string, error) {
+func (*githubGitProvider) RegisterWebhook(ctx context.Context, accessToken, repoURL, webhookURL, secret string) (string, error) {
 	owner, repo, err := parseOwnerRepo(repoURL)
 	if err != nil {
 		return "", err
@@ -54,13 +60,17 @@ func (*githubGitProvider) RegisterWebhook(ctx context.Context, accessToken, repo
 	// GitHub's API documentation says this is the only allowed string for the
 	// name field. TODO: Is this actually required?
 	name := "web"
+	config := map[string]interface{}{
+		"url":    webhookURL,
+		"events": eventsToReceive,
+	}
+	if secret != "" {
+		config["secret"] = secret
+	}
 	hook, _, err := client.Repositories.CreateHook(ctx, owner, repo, &gh.Hook{
 		Name:   &name,
 		Events: eventsToReceive,
-		Config: map[string]interface{}{
-			"url":    webhookURL,
-			"events": eventsToReceive,
-		},
+		Config: config,
 	})
 	if err != nil {
 		return "", gitHubErrorToStatus(err)
@@ -101,6 +111,12 @@ func (*githubGitProvider) MatchWebhookRequest(r *http.Request) bool {
 	return r.Header.Get("X-Github-Event") != ""
 }
 
+// VerifyWebhookSignature checks the X-Hub-Signature-256 header, which GitHub
+// sets to the HMAC of the payload when the webhook has a secret.
+func (*githubGitProvider) VerifyWebhookSignature(r *http.Request, secret string) error {
+	return webhook_signature.VerifySHA256(r, "X-Hub-Signature-256", secret)
+}
+
 func (*githubGitProvider) ParseWebhookData(r *http.Request) (*interfaces.WebhookData, error) {
 	payload, err := webhookJSONPayload(r)
 	if err != nil {
@@ -136,11 +152,14 @@ func ParseWebhookData(event interface{}) (*interfaces.WebhookData, error) {
 			return nil, err
 		}
 		branch := strings.TrimPrefix(v["Ref"], "refs/heads/")
+		baseSHA, changedFiles := pushChangedFiles(event)
 		return &interfaces.WebhookData{
 			EventName:               webhook_data.EventName.Push,
 			PushedRepoURL:           v["Repo.CloneURL"],
 			PushedBranch:            branch,
 			SHA:                     v["HeadCommit.ID"],
+			BaseSHA:                 baseSHA,
+			ChangedFiles:            changedFiles,
 			TargetRepoURL:           v["Repo.CloneURL"],
 			TargetRepoDefaultBranch: v["Repo.DefaultBranch"],
 			TargetBranch:            branch,
@@ -148,6 +167,11 @@ func ParseWebhookData(event interface{}) (*interfaces.WebhookData, error) {
 		}, nil
 
 	case *gh.PullRequestEvent:
+		// Labeling and closing pull requests only updates the merge queue.
+		switch event.GetAction() {
+		case "labeled", "unlabeled", "closed":
+			return parseMergeQueueEvent(event)
+		}
 		// Run workflows when the PR is opened, pushed to, or reopened, to match
 		// GitHub the behavior of GitHub actions. Also run workflows when the base
 		// branch changes, to accommodate stacked changes.
@@ -177,11 +201,95 @@ func ParseWebhookData(event interface{}) (*interfaces.WebhookData, error) {
 		wd.PullRequestNumber = int64(event.GetPullRequest().GetNumber())
 		return wd, nil
 
+	case *gh.IssueCommentEvent:
+		// Only handle new pull request comments that are BuildBuddy commands.
+		if event.GetAction() != "created" || !event.GetIssue().IsPullRequest() {
+			return nil, nil
+		}
+		if !webhook_data.IsCommand(event.GetComment().GetBody()) {
+			return nil, nil
+		}
+		v, err := fieldgetter.ExtractValues(
+			event,
+			"Repo.CloneURL",
+			"Repo.Private",
+			"Repo.DefaultBranch",
+			"Issue.User.Login",
+			"Comment.User.Login",
+		)
+		if err != nil {
+			return nil, err
+		}
+		// The event doesn't include the branches of the pull request, so they
+		// are looked up with GetPullRequest when handling the command.
+		return &interfaces.WebhookData{
+			EventName:                   webhook_data.EventName.PullRequestComment,
+			TargetRepoURL:               v["Repo.CloneURL"],
+			TargetRepoDefaultBranch:     v["Repo.DefaultBranch"],
+			IsTargetRepoPublic:          v["Repo.Private"] == "false",
+			PullRequestNumber:           int64(event.GetIssue().GetNumber()),
+			PullRequestAuthor:           v["Issue.User.Login"],
+			Sender:                      v["Comment.User.Login"],
+			PullRequestComment:          event.GetComment().GetBody(),
+			PullRequestCommentCreatedAt: event.GetComment().GetCreatedAt().Time,
+		}, nil
+
 	default:
 		return nil, nil
 	}
 }
 
+// parseMergeQueueEvent extracts WebhookData from a pull_request event that
+// adds a pull request to the merge queue or removes it.
+func parseMergeQueueEvent(event *gh.PullRequestEvent) (*interfaces.WebhookData, error) {
+	wd, err := parsePullRequestOrReview(event)
+	if err != nil {
+		return nil, err
+	}
+	switch event.GetAction() {
+	case "labeled":
+		wd.EventName = webhook_data.EventName.PullRequestLabeled
+		// Labeling a pull request updates it, so this is when the label
+		// was added.
+		wd.PullRequestLabeledAt = event.GetPullRequest().GetUpdatedAt().Time
+	case "unlabeled":
+		wd.EventName = webhook_data.EventName.PullRequestUnlabeled
+	case "closed":
+		wd.EventName = webhook_data.EventName.PullRequestClosed
+	}
+	wd.PullRequestNumber = int64(event.GetPullRequest().GetNumber())
+	wd.PullRequestLabel = event.GetLabel().GetName()
+	wd.Sender = event.GetSender().GetLogin()
+	return wd, nil
+}
+
+// pushChangedFiles returns the commit a push event's branch pointed to before
+// the push, and the files changed by the pushed commits. The changed files are
+// nil if the event doesn't list all of them, such as when the branch is
+// created or force-pushed, or when too many commits were pushed.
+func pushChangedFiles(event *gh.PushEvent) (baseSHA string, changedFiles []string) {
+	if event.GetCreated() || event.GetBefore() == "" || strings.Trim(event.GetBefore(), "0") == "" {
+		return "", nil
+	}
+	baseSHA = event.GetBefore()
+	if event.GetForced() || len(event.Commits) == 0 || len(event.Commits) >= maxPushEventCommits {
+		return baseSHA, nil
+	}
+	seen := map[string]bool{}
+	changedFiles = []string{}
+	for _, c := range event.Commits {
+		for _, files := range [][]string{c.Added, c.Removed, c.Modified} {
+			for _, f := range files {
+				if !seen[f] {
+					seen[f] = true
+					changedFiles = append(changedFiles, f)
+				}
+			}
+		}
+	}
+	return baseSHA, changedFiles
+}
+
 // parsePullRequestOrReview extracts WebhookData from a pull_request or
 // pull_request_review event.
 func parsePullRequestOrReview(event interface{}) (*interfaces.WebhookData, error) {
@@ -194,6 +302,7 @@ func parsePullRequestOrReview(event interface{}) (*interfaces.WebhookData, error
 		"PullRequest.Base.Repo.Private",
 		"PullRequest.Base.Repo.DefaultBranch",
 		"PullRequest.Base.Ref",
+		"PullRequest.Base.SHA",
 		"PullRequest.User.Login",
 	)
 	if err != nil {
@@ -206,6 +315,7 @@ func parsePullRequestOrReview(event interface{}) (*interfaces.WebhookData, error
 		PushedRepoURL:           v["PullRequest.Head.Repo.CloneURL"],
 		PushedBranch:            v["PullRequest.Head.Ref"],
 		SHA:                     v["PullRequest.Head.SHA"],
+		BaseSHA:                 v["PullRequest.Base.SHA"],
 		TargetRepoURL:           v["PullRequest.Base.Repo.CloneURL"],
 		TargetRepoDefaultBranch: v["PullRequest.Base.Repo.DefaultBranch"],
 		IsTargetRepoPublic:      isTargetRepoPublic,
@@ -275,6 +385,61 @@ func (g *githubGitProvider) CreateStatus(ctx context.Context, token, repoURL, co
 	return client.CreateStatus(ctx, ownerRepo, commitSHA, s)
 }
 
+// MergePullRequest merges the pull request using the merge API, which fails if
+// the head of the pull request has moved past the given commit.
+func (*githubGitProvider) MergePullRequest(ctx context.Context, accessToken, repoURL string, number int64, commitSHA, mergeMethod string) error {
+	owner, repo, err := parseOwnerRepo(repoURL)
+	if err != nil {
+		return err
+	}
+	client := newGitHubClient(ctx, accessToken)
+	result, _, err := client.PullRequests.Merge(ctx, owner, repo, int(number), "" /*=commitMessage*/, &gh.PullRequestOptions{
+		SHA:         commitSHA,
+		MergeMethod: mergeMethod,
+	})
+	if err != nil {
+		return status.UnavailableErrorf("failed to merge pull request #%d of %s: %s", number, repoURL, err)
+	}
+	if !result.GetMerged() {
+		return status.FailedPreconditionErrorf("pull request #%d of %s was not merged: %s", number, repoURL, result.GetMessage())
+	}
+	return nil
+}
+
+func (*githubGitProvider) GetPullRequest(ctx context.Context, accessToken, repoURL string, number int64) (*interfaces.WebhookData, error) {
+	owner, repo, err := parseOwnerRepo(repoURL)
+	if err != nil {
+		return nil, err
+	}
+	client := newGitHubClient(ctx, accessToken)
+	pr, rsp, err := client.PullRequests.Get(ctx, owner, repo, int(number))
+	if rsp != nil && rsp.StatusCode == http.StatusNotFound {
+		return nil, status.NotFoundErrorf("pull request #%d of %s not found", number, repoURL)
+	}
+	if err != nil {
+		return nil, status.UnavailableErrorf("failed to get pull request #%d of %s: %s", number, repoURL, err)
+	}
+	wd, err := parsePullRequestOrReview(&gh.PullRequestEvent{PullRequest: pr})
+	if err != nil {
+		return nil, err
+	}
+	wd.PullRequestNumber = int64(pr.GetNumber())
+	wd.PushedRepoPushedAt = pr.GetHead().GetRepo().GetPushedAt().Time
+	return wd, nil
+}
+
+func (*githubGitProvider) CreatePullRequestComment(ctx context.Context, accessToken, repoURL string, number int64, body string) error {
+	owner, repo, err := parseOwnerRepo(repoURL)
+	if err != nil {
+		return err
+	}
+	client := newGitHubClient(ctx, accessToken)
+	if _, _, err := client.Issues.CreateComment(ctx, owner, repo, int(number), &gh.IssueComment{Body: &body}); err != nil {
+		return status.UnavailableErrorf("failed to comment on pull request #%d of %s: %s", number, repoURL, err)
+	}
+	return nil
+}
+
 func webhookJSONPayload(r *http.Request) ([]byte, error) {
 	contentType, _, err := mime.ParseMediaType(r.Header.Get("content-type"))
 	if err != nil {
@@ -4,12 +4,16 @@ import (
 	"bytes"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/github"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/github/test_data"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/webhook_signature"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func webhookRequest(t *testing.T, eventType string, payload []byte) *http.Request {
@@ -34,6 +38,8 @@ func TestParseRequest_ValidPushEvent_Success(t *testing.T) {
 		PushedRepoURL:           "https://github.com/test/hello_bb_ci.git",
 		PushedBranch:            "main",
 		SHA:                     "258044d28288d5f6f1c5928b0e22580296fec666",
+		BaseSHA:                 "24acd998f1de16bc8dc4e3edc23a0ab472591e74",
+		ChangedFiles:            []string{"BUILD"},
 		TargetRepoURL:           "https://github.com/test/hello_bb_ci.git",
 		TargetRepoDefaultBranch: "main",
 		TargetBranch:            "main",
@@ -52,6 +58,7 @@ func TestParseRequest_ValidPullRequestEvent_Success(t *testing.T) {
 		PushedRepoURL:           "https://github.com/test/hello_bb_ci.git",
 		PushedBranch:            "pr-1613157046",
 		SHA:                     "21006e203e433034cd4d82859d28d3bc1dbdf9f7",
+		BaseSHA:                 "258044d28288d5f6f1c5928b0e22580296fec666",
 		TargetRepoURL:           "https://github.com/test/hello_bb_ci.git",
 		TargetRepoDefaultBranch: "main",
 		TargetBranch:            "main",
@@ -72,6 +79,7 @@ func TestParseRequest_ValidPullRequestReviewEvent_Success(t *testing.T) {
 		PushedRepoURL:           "https://github.com/test2/bb-workflows-test.git",
 		PushedBranch:            "pr-test",
 		SHA:                     "7d27db5443e48541a49693422c3b30fe6e8e3e9f",
+		BaseSHA:                 "7cc36618a593b550cedea1e4ec7076e1cede9cad",
 		TargetRepoURL:           "https://github.com/test/bb-workflows-test.git",
 		TargetRepoDefaultBranch: "main",
 		IsTargetRepoPublic:      true,
@@ -82,6 +90,61 @@ func TestParseRequest_ValidPullRequestReviewEvent_Success(t *testing.T) {
 	}, data)
 }
 
+func TestParseRequest_ValidPullRequestLabeledEvent_Success(t *testing.T) {
+	env := testenv.GetTestEnv(t)
+	req := webhookRequest(t, "pull_request", test_data.PullRequestLabeledEvent)
+
+	data, err := github.NewProvider(env).ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, &interfaces.WebhookData{
+		EventName:               "pull_request_labeled",
+		PushedRepoURL:           "https://github.com/test/hello_bb_ci.git",
+		PushedBranch:            "pr-1613157046",
+		SHA:                     "21006e203e433034cd4d82859d28d3bc1dbdf9f7",
+		BaseSHA:                 "258044d28288d5f6f1c5928b0e22580296fec666",
+		TargetRepoURL:           "https://github.com/test/hello_bb_ci.git",
+		TargetRepoDefaultBranch: "main",
+		TargetBranch:            "main",
+		PullRequestAuthor:       "test",
+		PullRequestNumber:       37,
+		PullRequestLabel:        "merge-queue",
+		PullRequestLabeledAt:    time.Date(2021, 2, 12, 19, 10, 49, 0, time.UTC),
+		Sender:                  "test-maintainer",
+	}, data)
+}
+
+func TestParseRequest_ValidPullRequestCommentEvent_Success(t *testing.T) {
+	env := testenv.GetTestEnv(t)
+	req := webhookRequest(t, "issue_comment", test_data.PullRequestCommentEvent)
+
+	data, err := github.NewProvider(env).ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, &interfaces.WebhookData{
+		EventName:                   "pull_request_comment",
+		TargetRepoURL:               "https://github.com/test/hello_bb_ci.git",
+		TargetRepoDefaultBranch:     "main",
+		IsTargetRepoPublic:          true,
+		PullRequestNumber:           37,
+		PullRequestAuthor:           "test",
+		Sender:                      "test-maintainer",
+		PullRequestComment:          "/buildbuddy run Test all targets",
+		PullRequestCommentCreatedAt: time.Date(2021, time.February, 15, 16, 2, 11, 0, time.UTC),
+	}, data)
+}
+
+func TestParseRequest_PullRequestCommentEventWithoutCommand_Ignored(t *testing.T) {
+	env := testenv.GetTestEnv(t)
+	payload := bytes.Replace(test_data.PullRequestCommentEvent, []byte("/buildbuddy run Test all targets"), []byte("LGTM, thanks /buildbuddy"), 1)
+	req := webhookRequest(t, "issue_comment", payload)
+
+	data, err := github.NewProvider(env).ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+}
+
 func TestParseRequest_InvalidEvent_Error(t *testing.T) {
 	env := testenv.GetTestEnv(t)
 	req := webhookRequest(t, "push", []byte{})
@@ -91,3 +154,21 @@ func TestParseRequest_InvalidEvent_Error(t *testing.T) {
 	assert.Error(t, err)
 	assert.Nil(t, data)
 }
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	env := testenv.GetTestEnv(t)
+	req := webhookRequest(t, "push", test_data.PushEvent)
+	req.Header.Set("X-Hub-Signature-256", webhook_signature.SignSHA256("secret", test_data.PushEvent))
+	p := github.NewProvider(env)
+
+	err := p.VerifyWebhookSignature(req, "secret")
+	require.NoError(t, err)
+	data, err := p.ParseWebhookData(req)
+	require.NoError(t, err)
+	assert.Equal(t, "push", data.EventName)
+
+	req = webhookRequest(t, "push", test_data.PushEvent)
+	req.Header.Set("X-Hub-Signature-256", webhook_signature.SignSHA256("other", test_data.PushEvent))
+	err = p.VerifyWebhookSignature(req, "secret")
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+}
@@ -10,3 +10,9 @@ var PullRequestEvent []byte
 
 //go:embed pull_request_approved_review_event.json
 var PullRequestApprovedReviewEvent []byte
+
+//go:embed pull_request_labeled_event.json
+var PullRequestLabeledEvent []byte
+
+//go:embed pull_request_comment_event.json
+var PullRequestCommentEvent []byte
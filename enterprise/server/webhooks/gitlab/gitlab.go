@@ -0,0 +1,459 @@
+package gitlab
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/fieldgetter"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/webhook_data"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/webhook_signature"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	gh_backend "github.com/buildbuddy-io/buildbuddy/server/backends/github"
+	gitutil "github.com/buildbuddy-io/buildbuddy/server/util/git"
+)
+
+const (
+	eventHeader = "X-Gitlab-Event"
+	tokenHeader = "X-Gitlab-Token"
+
+	pushHookEvent         = "Push Hook"
+	mergeRequestHookEvent = "Merge Request Hook"
+
+	// The "after" SHA of pushes that delete a branch.
+	deletedBranchSHA = "0000000000000000000000000000000000000000"
+
+	// The visibility level of public projects.
+	publicVisibilityLevel = 20
+
+	// The minimum access level of trusted project members (Developer).
+	// See https://docs.gitlab.com/ee/api/members.html#roles
+	developerAccessLevel = 30
+
+	// userIDPrefix marks a merge request author that is identified by user
+	// ID rather than username. Merge request events only include the
+	// author's ID, so this is used when the author didn't trigger the event.
+	// GitLab usernames can't contain '#', so this can't be a username.
+	userIDPrefix = "#"
+)
+
+type gitlabGitProvider struct {
+	client *http.Client
+}
+
+func NewProvider() interfaces.GitProvider {
+	return &gitlabGitProvider{client: http.DefaultClient}
+}
+
+func (*gitlabGitProvider) MatchRepoURL(u *url.URL) bool {
+	return u.Host == "gitlab.com"
+}
+
+func (*gitlabGitProvider) MatchWebhookRequest(r *http.Request) bool {
+	return r.Header.Get(eventHeader) != ""
+}
+
+func (*gitlabGitProvider) ParseWebhookData(r *http.Request) (*interfaces.WebhookData, error) {
+	switch eventName := r.Header.Get(eventHeader); eventName {
+	case pushHookEvent:
+		payload := &PushEventPayload{}
+		if err := unmarshalBody(r, payload); err != nil {
+			return nil, status.InvalidArgumentErrorf("failed to unmarshal push event payload: %s", err)
+		}
+		// Ignore branch deletion events.
+		if payload.After == deletedBranchSHA {
+			return nil, nil
+		}
+		v, err := fieldgetter.ExtractValues(
+			payload,
+			"After",
+			"Ref",
+			"Project.GitHTTPURL",
+			"Project.DefaultBranch",
+			"Project.VisibilityLevel",
+		)
+		if err != nil {
+			return nil, err
+		}
+		branch := strings.TrimPrefix(v["Ref"], "refs/heads/")
+		return &interfaces.WebhookData{
+			EventName:               webhook_data.EventName.Push,
+			PushedRepoURL:           v["Project.GitHTTPURL"],
+			PushedBranch:            branch,
+			SHA:                     v["After"],
+			TargetRepoURL:           v["Project.GitHTTPURL"],
+			TargetRepoDefaultBranch: v["Project.DefaultBranch"],
+			TargetBranch:            branch,
+			IsTargetRepoPublic:      v["Project.VisibilityLevel"] == strconv.Itoa(publicVisibilityLevel),
+		}, nil
+	case mergeRequestHookEvent:
+		payload := &MergeRequestEventPayload{}
+		if err := unmarshalBody(r, payload); err != nil {
+			return nil, status.InvalidArgumentErrorf("failed to unmarshal merge request event payload: %s", err)
+		}
+		attrs := payload.ObjectAttributes
+		if attrs == nil {
+			return nil, status.InvalidArgumentError("merge request event payload is missing object_attributes")
+		}
+		v, err := fieldgetter.ExtractValues(
+			payload,
+			"User.ID",
+			"User.Username",
+			"ObjectAttributes.IID",
+			"ObjectAttributes.AuthorID",
+			"ObjectAttributes.SourceBranch",
+			"ObjectAttributes.TargetBranch",
+			"ObjectAttributes.LastCommit.ID",
+			"ObjectAttributes.Source.GitHTTPURL",
+			"ObjectAttributes.Target.GitHTTPURL",
+			"ObjectAttributes.Target.DefaultBranch",
+			"ObjectAttributes.Target.VisibilityLevel",
+		)
+		if err != nil {
+			return nil, err
+		}
+		wd := &interfaces.WebhookData{
+			EventName:               webhook_data.EventName.PullRequest,
+			PushedRepoURL:           v["ObjectAttributes.Source.GitHTTPURL"],
+			PushedBranch:            v["ObjectAttributes.SourceBranch"],
+			SHA:                     v["ObjectAttributes.LastCommit.ID"],
+			TargetRepoURL:           v["ObjectAttributes.Target.GitHTTPURL"],
+			TargetRepoDefaultBranch: v["ObjectAttributes.Target.DefaultBranch"],
+			TargetBranch:            v["ObjectAttributes.TargetBranch"],
+			IsTargetRepoPublic:      v["ObjectAttributes.Target.VisibilityLevel"] == strconv.Itoa(publicVisibilityLevel),
+		}
+		wd.PullRequestNumber, err = strconv.ParseInt(v["ObjectAttributes.IID"], 10, 64)
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("invalid merge request IID %q", v["ObjectAttributes.IID"])
+		}
+		// Merge request events only include the author's username if the
+		// author triggered the event, e.g. when someone else pushes to the
+		// merge request, so fall back to the author's user ID.
+		author := userIDPrefix + v["ObjectAttributes.AuthorID"]
+		if v["User.ID"] == v["ObjectAttributes.AuthorID"] {
+			author = v["User.Username"]
+		}
+		switch attrs.Action {
+		case "open", "reopen":
+			wd.PullRequestAuthor = author
+		case "update":
+			// Only run workflows when commits are pushed or the target branch
+			// changes, not when e.g. the title or labels are edited.
+			if attrs.OldRev == "" && payload.Changes.TargetBranch == nil {
+				return nil, nil
+			}
+			wd.PullRequestAuthor = author
+		case "approved", "approval":
+			wd.PullRequestApprover = v["User.Username"]
+		default:
+			return nil, nil
+		}
+		return wd, nil
+	default:
+		log.Printf("Ignoring webhook event: %s", eventName)
+		return nil, nil
+	}
+}
+
+// VerifyWebhookSignature checks the X-Gitlab-Token header. GitLab doesn't sign
+// payloads; it sends the webhook's secret token as-is.
+func (*gitlabGitProvider) VerifyWebhookSignature(r *http.Request, secret string) error {
+	return webhook_signature.VerifyToken(r, tokenHeader, secret)
+}
+
+func (p *gitlabGitProvider) RegisterWebhook(ctx context.Context, accessToken, repoURL, webhookURL, secret string) (string, error) {
+	hook := &struct {
+		ID int64 `json:"id"`
+	}{}
+	req := map[string]any{
+		"url":                     webhookURL,
+		"push_events":             true,
+		"merge_requests_events":   true,
+		"enable_ssl_verification": true,
+	}
+	if secret != "" {
+		req["token"] = secret
+	}
+	err := p.call(ctx, accessToken, repoURL, http.MethodPost, "/hooks", req, hook)
+	if err != nil {
+		return "", err
+	}
+	if hook.ID == 0 {
+		return "", status.UnknownError("GitLab returned invalid response from hooks API (missing ID field).")
+	}
+	return strconv.FormatInt(hook.ID, 10), nil
+}
+
+func (p *gitlabGitProvider) UnregisterWebhook(ctx context.Context, accessToken, repoURL, webhookID string) error {
+	if _, err := strconv.ParseInt(webhookID, 10, 64); err != nil {
+		return status.InvalidArgumentErrorf("invalid GitLab webhook ID %q", webhookID)
+	}
+	return p.call(ctx, accessToken, repoURL, http.MethodDelete, "/hooks/"+webhookID, nil, nil)
+}
+
+func (p *gitlabGitProvider) GetFileContents(ctx context.Context, accessToken, repoURL, filePath, ref string) ([]byte, error) {
+	path := "/repository/files/" + url.PathEscape(filePath) + "/raw?ref=" + url.QueryEscape(ref)
+	b, err := p.get(ctx, accessToken, repoURL, path)
+	if status.IsNotFoundError(err) {
+		// GitLab's API response is the same whether the project or the file
+		// doesn't exist, so check whether the project exists, so that the
+		// workflow is aborted if it doesn't rather than using the default
+		// config.
+		if _, err := p.get(ctx, accessToken, repoURL, ""); status.IsNotFoundError(err) {
+			return nil, status.FailedPreconditionErrorf("repository %q not found or inaccessible", repoURL)
+		} else if err != nil {
+			return nil, status.UnavailableErrorf("get repository %q: %s", repoURL, err)
+		}
+		return nil, status.NotFoundErrorf("%s: not found in %s", filePath, repoURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// IsTrusted returns whether the user is a member of the project with at least
+// Developer access. The user is either a username, or a user ID prefixed with
+// userIDPrefix.
+func (p *gitlabGitProvider) IsTrusted(ctx context.Context, accessToken, repoURL, user string) (bool, error) {
+	userID, err := p.userID(ctx, accessToken, repoURL, user)
+	if err != nil {
+		return false, err
+	}
+	if userID == 0 {
+		return false, nil
+	}
+	member := &struct {
+		AccessLevel int `json:"access_level"`
+	}{}
+	err = p.call(ctx, accessToken, repoURL, http.MethodGet, fmt.Sprintf("/members/all/%d", userID), nil, member)
+	if status.IsNotFoundError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, status.InternalErrorf("failed to determine whether %s is a member of %s: %s", user, repoURL, err)
+	}
+	return member.AccessLevel >= developerAccessLevel, nil
+}
+
+// userID returns the ID of the given user, or 0 if the user doesn't exist.
+func (p *gitlabGitProvider) userID(ctx context.Context, accessToken, repoURL, user string) (int64, error) {
+	if id, ok := strings.CutPrefix(user, userIDPrefix); ok {
+		userID, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return 0, status.InvalidArgumentErrorf("invalid GitLab user ID %q", id)
+		}
+		return userID, nil
+	}
+	api, _, err := apiURLs(repoURL)
+	if err != nil {
+		return 0, err
+	}
+	var users []struct {
+		ID int64 `json:"id"`
+	}
+	if err := p.do(ctx, accessToken, http.MethodGet, api+"/users?username="+url.QueryEscape(user), nil, &users); err != nil {
+		return 0, status.InternalErrorf("failed to look up GitLab user %s: %s", user, err)
+	}
+	if len(users) == 0 {
+		return 0, nil
+	}
+	return users[0].ID, nil
+}
+
+// CreateStatus publishes a commit status. The payload is a GitHub status
+// payload, which is translated to GitLab's commit status API.
+func (p *gitlabGitProvider) CreateStatus(ctx context.Context, accessToken, repoURL, commitSHA string, payload any) error {
+	s, ok := payload.(*gh_backend.GithubStatusPayload)
+	if !ok {
+		return status.InvalidArgumentErrorf("invalid GitLab status payload type %T (expected %T)", payload, &gh_backend.GithubStatusPayload{})
+	}
+	state, err := gitlabState(gh_backend.State(s.GetState()))
+	if err != nil {
+		return err
+	}
+	return p.call(ctx, accessToken, repoURL, http.MethodPost, "/statuses/"+url.PathEscape(commitSHA), map[string]any{
+		"state":       state,
+		"name":        s.GetContext(),
+		"target_url":  s.GetTargetURL(),
+		"description": s.GetDescription(),
+	}, nil)
+}
+
+func (p *gitlabGitProvider) MergePullRequest(ctx context.Context, accessToken, repoURL string, number int64, commitSHA, mergeMethod string) error {
+	return status.UnimplementedError("Not implemented")
+}
+
+func (p *gitlabGitProvider) GetPullRequest(ctx context.Context, accessToken, repoURL string, number int64) (*interfaces.WebhookData, error) {
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (p *gitlabGitProvider) CreatePullRequestComment(ctx context.Context, accessToken, repoURL string, number int64, body string) error {
+	return status.UnimplementedError("Not implemented")
+}
+
+// gitlabState maps a GitHub commit status state to the corresponding GitLab
+// state.
+func gitlabState(state gh_backend.State) (string, error) {
+	switch state {
+	case gh_backend.PendingState:
+		return "pending", nil
+	case gh_backend.SuccessState:
+		return "success", nil
+	case gh_backend.FailureState, gh_backend.ErrorState:
+		return "failed", nil
+	default:
+		return "", status.InvalidArgumentErrorf("unknown commit status state %q", state)
+	}
+}
+
+// apiURLs returns the base URL of the GitLab API serving the given repo, and
+// the URL of the repo's project within that API.
+func apiURLs(repoURL string) (string, string, error) {
+	u, err := gitutil.NormalizeRepoURL(repoURL)
+	if err != nil {
+		return "", "", status.InvalidArgumentErrorf("failed to parse GitLab repo URL %q: %s", repoURL, err)
+	}
+	// Projects may be nested in subgroups, so the whole path identifies the
+	// project.
+	project := strings.Trim(u.Path, "/")
+	if !strings.Contains(project, "/") {
+		return "", "", status.InvalidArgumentErrorf("invalid GitLab repo URL %q", repoURL)
+	}
+	api := u.Scheme + "://" + u.Host + "/api/v4"
+	return api, api + "/projects/" + url.PathEscape(project), nil
+}
+
+// call makes a request to the given path relative to the repo's project in
+// the GitLab API.
+func (p *gitlabGitProvider) call(ctx context.Context, accessToken, repoURL, method, path string, body, rsp any) error {
+	_, project, err := apiURLs(repoURL)
+	if err != nil {
+		return err
+	}
+	return p.do(ctx, accessToken, method, project+path, body, rsp)
+}
+
+func (p *gitlabGitProvider) get(ctx context.Context, accessToken, repoURL, path string) ([]byte, error) {
+	var b []byte
+	_, project, err := apiURLs(repoURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.doRaw(ctx, accessToken, http.MethodGet, project+path, nil, func(r io.Reader) error {
+		var err error
+		b, err = io.ReadAll(r)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (p *gitlabGitProvider) do(ctx context.Context, accessToken, method, u string, body, rsp any) error {
+	return p.doRaw(ctx, accessToken, method, u, body, func(r io.Reader) error {
+		if rsp == nil {
+			return nil
+		}
+		return json.NewDecoder(r).Decode(rsp)
+	})
+}
+
+func (p *gitlabGitProvider) doRaw(ctx context.Context, accessToken, method, u string, body any, read func(r io.Reader) error) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	res, err := p.client.Do(req)
+	if err != nil {
+		return status.UnavailableErrorf("GitLab API request failed: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return status.NotFoundErrorf("GitLab API returned 404 for %s %s", method, req.URL.Path)
+	}
+	if res.StatusCode >= 300 {
+		const limit = 1000
+		b, _ := io.ReadAll(io.LimitReader(res.Body, limit))
+		return status.UnknownErrorf("GitLab API returned HTTP %d for %s %s: %s", res.StatusCode, method, req.URL.Path, string(b))
+	}
+	return read(res.Body)
+}
+
+func unmarshalBody(r *http.Request, payload interface{}) error {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, payload)
+}
+
+// PushEventPayload represents a subset of GitLab's push event schema.
+// See https://docs.gitlab.com/ee/user/project/integrations/webhook_events.html#push-events
+type PushEventPayload struct {
+	After   string   `json:"after"`
+	Ref     string   `json:"ref"`
+	Project *Project `json:"project"`
+}
+
+// MergeRequestEventPayload represents a subset of GitLab's merge request
+// event schema.
+// See https://docs.gitlab.com/ee/user/project/integrations/webhook_events.html#merge-request-events
+type MergeRequestEventPayload struct {
+	// User is the user that triggered the event.
+	User             *User                   `json:"user"`
+	ObjectAttributes *MergeRequestAttributes `json:"object_attributes"`
+	Changes          MergeRequestChanges     `json:"changes"`
+}
+type User struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+}
+type MergeRequestAttributes struct {
+	IID          int64    `json:"iid"`
+	AuthorID     int64    `json:"author_id"`
+	Action       string   `json:"action"`
+	SourceBranch string   `json:"source_branch"`
+	TargetBranch string   `json:"target_branch"`
+	Source       *Project `json:"source"`
+	Target       *Project `json:"target"`
+	LastCommit   *Commit  `json:"last_commit"`
+	// OldRev is set on "update" events that push new commits.
+	OldRev string `json:"oldrev"`
+}
+type MergeRequestChanges struct {
+	// TargetBranch is set if the target branch was changed.
+	TargetBranch *json.RawMessage `json:"target_branch"`
+}
+type Commit struct {
+	ID string `json:"id"`
+}
+
+// Project represents a subset of GitLab's project schema, which is a common
+// entity used in multiple webhook events.
+type Project struct {
+	GitHTTPURL      string `json:"git_http_url"`
+	DefaultBranch   string `json:"default_branch"`
+	VisibilityLevel int    `json:"visibility_level"`
+}
@@ -0,0 +1,282 @@
+package gitlab_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/gitlab"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/gitlab/test_data"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testhttp"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	gh_backend "github.com/buildbuddy-io/buildbuddy/server/backends/github"
+)
+
+func webhookRequest(t *testing.T, eventType string, payload []byte) *http.Request {
+	req, err := http.NewRequest("POST", "https://buildbuddy.io/webhooks/foo", bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("X-Gitlab-Event", eventType)
+	req.Header.Add("Content-Type", "application/json")
+	return req
+}
+
+func TestParseRequest_ValidPushEvent_Success(t *testing.T) {
+	req := webhookRequest(t, "Push Hook", test_data.PushEvent)
+
+	data, err := gitlab.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, &interfaces.WebhookData{
+		EventName:               "push",
+		PushedRepoURL:           "https://gitlab.com/buildbuddy/buildbuddy-ci-playground.git",
+		PushedBranch:            "main",
+		SHA:                     "da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+		TargetRepoURL:           "https://gitlab.com/buildbuddy/buildbuddy-ci-playground.git",
+		TargetRepoDefaultBranch: "main",
+		TargetBranch:            "main",
+		IsTargetRepoPublic:      true,
+	}, data)
+}
+
+func TestParseRequest_BranchDeletion_Ignored(t *testing.T) {
+	payload := strings.ReplaceAll(string(test_data.PushEvent), `"after": "da1560886d4f094c3e6c9ef40349f7d38b5d27d7"`, `"after": "0000000000000000000000000000000000000000"`)
+	req := webhookRequest(t, "Push Hook", []byte(payload))
+
+	data, err := gitlab.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+}
+
+func TestParseRequest_ValidMergeRequestEvent_Success(t *testing.T) {
+	req := webhookRequest(t, "Merge Request Hook", test_data.MergeRequestEvent)
+
+	data, err := gitlab.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, &interfaces.WebhookData{
+		EventName:               "pull_request",
+		PushedRepoURL:           "https://gitlab.com/buildbuddy-bot/buildbuddy-ci-playground.git",
+		PushedBranch:            "test-1614593937",
+		SHA:                     "b83d6e391c22777fca1ed3012fce84f633d7fed0",
+		TargetRepoURL:           "https://gitlab.com/buildbuddy/buildbuddy-ci-playground.git",
+		TargetRepoDefaultBranch: "main",
+		TargetBranch:            "main",
+		PullRequestNumber:       7,
+		PullRequestAuthor:       "buildbuddy-bot",
+	}, data)
+}
+
+func TestParseRequest_MergeRequestUpdatedByOtherUser_UsesAuthorID(t *testing.T) {
+	// A trusted user pushing to someone else's merge request must not make
+	// them its author.
+	payload := strings.ReplaceAll(string(test_data.MergeRequestEvent), `"author_id": 4,`, `"author_id": 8,`)
+	req := webhookRequest(t, "Merge Request Hook", []byte(payload))
+
+	data, err := gitlab.NewProvider().ParseWebhookData(req)
+
+	require.NoError(t, err)
+	assert.Equal(t, "#8", data.PullRequestAuthor)
+}
+
+func TestParseRequest_MergeRequestMetadataUpdate_Ignored(t *testing.T) {
+	payload := strings.ReplaceAll(string(test_data.MergeRequestEvent), `"oldrev": "95790bf891e76fee5e1747ab589903a6a1f80f22",`, "")
+	req := webhookRequest(t, "Merge Request Hook", []byte(payload))
+
+	data, err := gitlab.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+}
+
+func TestParseRequest_MergeRequestApprovedEvent_Success(t *testing.T) {
+	req := webhookRequest(t, "Merge Request Hook", test_data.MergeRequestApprovedEvent)
+
+	data, err := gitlab.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, &interfaces.WebhookData{
+		EventName:               "pull_request",
+		PushedRepoURL:           "https://gitlab.com/buildbuddy-bot/buildbuddy-ci-playground.git",
+		PushedBranch:            "test-1614593937",
+		SHA:                     "b83d6e391c22777fca1ed3012fce84f633d7fed0",
+		TargetRepoURL:           "https://gitlab.com/buildbuddy/buildbuddy-ci-playground.git",
+		TargetRepoDefaultBranch: "main",
+		TargetBranch:            "main",
+		PullRequestNumber:       7,
+		PullRequestApprover:     "buildbuddy-reviewer",
+	}, data)
+}
+
+func TestParseRequest_MergeRequestApprovalEvent_Success(t *testing.T) {
+	req := webhookRequest(t, "Merge Request Hook", test_data.MergeRequestApprovalEvent)
+
+	data, err := gitlab.NewProvider().ParseWebhookData(req)
+
+	require.NoError(t, err)
+	assert.Equal(t, "buildbuddy-reviewer-2", data.PullRequestApprover)
+	assert.Empty(t, data.PullRequestAuthor)
+	assert.Equal(t, int64(7), data.PullRequestNumber)
+}
+
+func TestParseRequest_NoteEvent_Ignored(t *testing.T) {
+	req := webhookRequest(t, "Note Hook", test_data.NoteEvent)
+
+	data, err := gitlab.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+}
+
+func TestParseRequest_UnknownEvent_Ignored(t *testing.T) {
+	req := webhookRequest(t, "Job Hook", []byte(`{}`))
+
+	data, err := gitlab.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+}
+
+// startAPIServer starts a fake GitLab API server and returns the URL of a
+// repo hosted on it.
+func startAPIServer(t *testing.T, handler http.HandlerFunc) string {
+	u := testhttp.StartServer(t, handler)
+	// Repo URLs are normalized to https unless they point to localhost.
+	return "http://localhost:" + u.Port() + "/buildbuddy/sub/ci-playground.git"
+}
+
+func TestCreateStatus(t *testing.T) {
+	var path, auth string
+	var body map[string]any
+	repoURL := startAPIServer(t, func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.EscapedPath()
+		auth = r.Header.Get("Authorization")
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		w.WriteHeader(http.StatusCreated)
+	})
+	payload := gh_backend.NewGithubStatusPayload("Test", "https://app.buildbuddy.io/invocation/foo", "Failed", gh_backend.FailureState)
+
+	err := gitlab.NewProvider().CreateStatus(context.Background(), "TOKEN", repoURL, "abc123", payload)
+
+	require.NoError(t, err)
+	assert.Equal(t, "/api/v4/projects/buildbuddy%2Fsub%2Fci-playground/statuses/abc123", path)
+	assert.Equal(t, "Bearer TOKEN", auth)
+	assert.Equal(t, map[string]any{
+		"state":       "failed",
+		"name":        "Test",
+		"target_url":  "https://app.buildbuddy.io/invocation/foo",
+		"description": "Failed",
+	}, body)
+}
+
+func TestGetFileContents(t *testing.T) {
+	repoURL := startAPIServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/api/v4/projects/buildbuddy%2Fsub%2Fci-playground/repository/files/buildbuddy.yaml/raw":
+			assert.Equal(t, "main", r.URL.Query().Get("ref"))
+			w.Write([]byte("actions: []\n"))
+		case "/api/v4/projects/buildbuddy%2Fsub%2Fci-playground":
+			w.Write([]byte(`{"id": 1}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	p := gitlab.NewProvider()
+	ctx := context.Background()
+
+	b, err := p.GetFileContents(ctx, "TOKEN", repoURL, "buildbuddy.yaml", "main")
+	require.NoError(t, err)
+	assert.Equal(t, "actions: []\n", string(b))
+
+	_, err = p.GetFileContents(ctx, "TOKEN", repoURL, "missing.yaml", "main")
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound error, got %v", err)
+
+	missingRepoURL := strings.Replace(repoURL, "ci-playground", "missing", 1)
+	_, err = p.GetFileContents(ctx, "TOKEN", missingRepoURL, "buildbuddy.yaml", "main")
+	assert.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition error, got %v", err)
+}
+
+func TestIsTrusted(t *testing.T) {
+	repoURL := startAPIServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/api/v4/users":
+			switch r.URL.Query().Get("username") {
+			case "developer":
+				w.Write([]byte(`[{"id": 1}]`))
+			case "guest":
+				w.Write([]byte(`[{"id": 2}]`))
+			case "outsider":
+				w.Write([]byte(`[{"id": 3}]`))
+			default:
+				w.Write([]byte(`[]`))
+			}
+		case "/api/v4/projects/buildbuddy%2Fsub%2Fci-playground/members/all/1":
+			w.Write([]byte(`{"id": 1, "access_level": 30}`))
+		case "/api/v4/projects/buildbuddy%2Fsub%2Fci-playground/members/all/2":
+			w.Write([]byte(`{"id": 2, "access_level": 10}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	p := gitlab.NewProvider()
+	for _, tc := range []struct {
+		user    string
+		trusted bool
+	}{
+		{"developer", true},
+		{"guest", false},
+		{"outsider", false},
+		{"nonexistent", false},
+		// Merge request authors may be identified by user ID.
+		{"#1", true},
+		{"#2", false},
+	} {
+		trusted, err := p.IsTrusted(context.Background(), "TOKEN", repoURL, tc.user)
+		require.NoError(t, err)
+		assert.Equal(t, tc.trusted, trusted, "user %s", tc.user)
+	}
+}
+
+func TestRegisterWebhook(t *testing.T) {
+	var method, path string
+	var hook map[string]any
+	repoURL := startAPIServer(t, func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		path = r.URL.EscapedPath()
+		if r.Method == http.MethodPost {
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&hook))
+			w.Write([]byte(`{"id": 42}`))
+		}
+	})
+	p := gitlab.NewProvider()
+
+	id, err := p.RegisterWebhook(context.Background(), "TOKEN", repoURL, "https://app.buildbuddy.io/webhooks/workflow/foo", "SECRET")
+	require.NoError(t, err)
+	assert.Equal(t, "42", id)
+	assert.Equal(t, "/api/v4/projects/buildbuddy%2Fsub%2Fci-playground/hooks", path)
+	assert.Equal(t, "SECRET", hook["token"])
+
+	err = p.UnregisterWebhook(context.Background(), "TOKEN", repoURL, id)
+	require.NoError(t, err)
+	assert.Equal(t, http.MethodDelete, method)
+	assert.Equal(t, "/api/v4/projects/buildbuddy%2Fsub%2Fci-playground/hooks/42", path)
+}
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	p := gitlab.NewProvider()
+	req := webhookRequest(t, "Push Hook", test_data.PushEvent)
+	req.Header.Set("X-Gitlab-Token", "SECRET")
+	require.NoError(t, p.VerifyWebhookSignature(req, "SECRET"))
+
+	err := p.VerifyWebhookSignature(req, "OTHER")
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+}
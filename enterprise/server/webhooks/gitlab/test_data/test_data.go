@@ -0,0 +1,18 @@
+package test_data
+
+import _ "embed"
+
+//go:embed push_event.json
+var PushEvent []byte
+
+//go:embed merge_request_event.json
+var MergeRequestEvent []byte
+
+//go:embed merge_request_approved_event.json
+var MergeRequestApprovedEvent []byte
+
+//go:embed merge_request_approval_event.json
+var MergeRequestApprovalEvent []byte
+
+//go:embed note_event.json
+var NoteEvent []byte
@@ -2,6 +2,7 @@ package webhook_data
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 )
@@ -12,20 +13,56 @@ var (
 		Push           string
 		PullRequest    string
 		ManualDispatch string
+		Schedule       string
+		MergeQueue     string
+
+		// Pull request events that only update the merge queue, and don't
+		// trigger any actions directly.
+		PullRequestLabeled   string
+		PullRequestUnlabeled string
+		PullRequestClosed    string
+
+		// Pull request comments that are commands to BuildBuddy.
+		PullRequestComment string
 	}
 )
 
+// CommandPrefix is the prefix of the pull request comments that are commands
+// to BuildBuddy, such as "/buildbuddy retry".
+const CommandPrefix = "/buildbuddy"
+
 func init() {
 	EventName.Push = "push"
 	EventName.PullRequest = "pull_request"
 	EventName.ManualDispatch = "manual_dispatch"
+	EventName.Schedule = "schedule"
+	EventName.MergeQueue = "merge_queue"
+	EventName.PullRequestLabeled = "pull_request_labeled"
+	EventName.PullRequestUnlabeled = "pull_request_unlabeled"
+	EventName.PullRequestClosed = "pull_request_closed"
+	EventName.PullRequestComment = "pull_request_comment"
+}
+
+// IsCommand returns whether the pull request comment is a command to
+// BuildBuddy, i.e. its first word is CommandPrefix.
+func IsCommand(comment string) bool {
+	fields := strings.Fields(comment)
+	return len(fields) > 0 && fields[0] == CommandPrefix
+}
+
+// IsFork returns whether the event's commit was pushed to a fork of the
+// target repo, such as the head branch of a pull request from a fork.
+// Commits in forks aren't trusted unless their author is.
+func IsFork(wd *interfaces.WebhookData) bool {
+	return wd.TargetRepoURL != "" && wd.PushedRepoURL != wd.TargetRepoURL
 }
 
 func DebugString(wd *interfaces.WebhookData) string {
 	return fmt.Sprintf(
-		"event=%s, pushed=%s@%s:%s, target=%s@%s (public=%t, default_branch=%s), pr #%d (author=%s, approver=%s)",
+		"event=%s, pushed=%s@%s:%s (base=%s, changed_files=%d), target=%s@%s (public=%t, default_branch=%s), pr #%d (author=%s, approver=%s, label=%s, sender=%s)",
 		wd.EventName,
-		wd.PushedRepoURL, wd.PushedBranch, wd.SHA,
+		wd.PushedRepoURL, wd.PushedBranch, wd.SHA, wd.BaseSHA, len(wd.ChangedFiles),
 		wd.TargetRepoURL, wd.TargetBranch, wd.IsTargetRepoPublic, wd.TargetRepoDefaultBranch,
-		wd.PullRequestNumber, wd.PullRequestAuthor, wd.PullRequestApprover)
+		wd.PullRequestNumber, wd.PullRequestAuthor, wd.PullRequestApprover,
+		wd.PullRequestLabel, wd.Sender)
 }
@@ -0,0 +1,73 @@
+// Package webhook_signature contains helpers for verifying that webhook
+// deliveries were sent by a Git provider that knows the webhook's secret.
+package webhook_signature
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+const sha256Prefix = "sha256="
+
+// ReadBody reads the request body and replaces it with an in-memory copy, so
+// that the body can be read again when parsing the webhook payload.
+func ReadBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, status.InternalErrorf("failed to read request body: %s", err)
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(b))
+	return b, nil
+}
+
+// SignSHA256 returns the "sha256=<hex>" HMAC signature of the payload.
+func SignSHA256(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return sha256Prefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySHA256 verifies that the request body matches the "sha256=<hex>"
+// HMAC signature in the given header, as sent by GitHub and Bitbucket.
+func VerifySHA256(r *http.Request, header, secret string) error {
+	signature := r.Header.Get(header)
+	if signature == "" {
+		return status.PermissionDeniedErrorf("missing %s header", header)
+	}
+	if !strings.HasPrefix(signature, sha256Prefix) {
+		return status.PermissionDeniedErrorf("unsupported %s algorithm", header)
+	}
+	body, err := ReadBody(r)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(signature), []byte(SignSHA256(secret, body))) {
+		return status.PermissionDeniedError("webhook signature mismatch")
+	}
+	return nil
+}
+
+// VerifyToken verifies that the given header contains the secret itself, as
+// sent by GitLab, which does not sign webhook payloads.
+func VerifyToken(r *http.Request, header, secret string) error {
+	token := r.Header.Get(header)
+	if token == "" {
+		return status.PermissionDeniedErrorf("missing %s header", header)
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		return status.PermissionDeniedError("webhook token mismatch")
+	}
+	return nil
+}
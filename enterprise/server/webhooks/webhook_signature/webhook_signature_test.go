@@ -0,0 +1,60 @@
+package webhook_signature_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/webhook_signature"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const payload = `{"ref": "refs/heads/main"}`
+
+func request(header, value string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/webhooks/workflow/abc", strings.NewReader(payload))
+	if value != "" {
+		r.Header.Set(header, value)
+	}
+	return r
+}
+
+func TestVerifySHA256(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		signature string
+		ok        bool
+	}{
+		{"valid", webhook_signature.SignSHA256("secret", []byte(payload)), true},
+		{"wrong secret", webhook_signature.SignSHA256("other", []byte(payload)), false},
+		{"wrong algorithm", "sha1=0123", false},
+		{"missing", "", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := request("X-Hub-Signature-256", test.signature)
+			err := webhook_signature.VerifySHA256(r, "X-Hub-Signature-256", "secret")
+			if test.ok {
+				require.NoError(t, err)
+				// The body can still be read after verification.
+				b, err := io.ReadAll(r.Body)
+				require.NoError(t, err)
+				assert.Equal(t, payload, string(b))
+			} else {
+				assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyToken(t *testing.T) {
+	require.NoError(t, webhook_signature.VerifyToken(request("X-Gitlab-Token", "secret"), "X-Gitlab-Token", "secret"))
+
+	err := webhook_signature.VerifyToken(request("X-Gitlab-Token", "other"), "X-Gitlab-Token", "secret")
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+	err = webhook_signature.VerifyToken(request("X-Gitlab-Token", ""), "X-Gitlab-Token", "secret")
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+}
@@ -3,13 +3,20 @@ package config
 import (
 	"fmt"
 	"io"
+	"io/fs"
+	"maps"
+	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/cron"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/webhook_data"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/accumulator"
+	"github.com/gobwas/glob"
 	"gopkg.in/yaml.v2"
 
 	rnpb "github.com/buildbuddy-io/buildbuddy/proto/runner"
@@ -27,14 +34,79 @@ const (
 	// KytheActionName is the name used for actions automatically
 	// run by us if code search is enabled.
 	KytheActionName = "Generate CodeSearch Index"
+
+	// The maximum number of combinations that a matrix may expand to.
+	maxMatrixCombinations = 64
+
+	// The maximum number of artifacts that an action may publish.
+	maxArtifacts = 20
 )
 
 type BuildBuddyConfig struct {
-	Actions []*Action `yaml:"actions"`
+	Actions    []*Action   `yaml:"actions"`
+	MergeQueue *MergeQueue `yaml:"merge_queue"`
+}
+
+const (
+	defaultMergeQueueLabel = "merge-queue"
+
+	MergeMethodMerge  = "merge"
+	MergeMethodSquash = "squash"
+	MergeMethodRebase = "rebase"
+)
+
+// MergeQueue configures the merge queue of a repo. Pull requests that are
+// added to the queue are tested against the latest target branch by the
+// actions with a merge_queue trigger, and merged when they pass.
+type MergeQueue struct {
+	// Label is the pull request label that adds a pull request to the queue.
+	// Removing the label removes the pull request from the queue. Defaults to
+	// "merge-queue".
+	Label string `yaml:"label"`
+	// BatchSize is the maximum number of pull requests that are tested
+	// together. If a batch fails, its pull requests are retried one at a time.
+	// Defaults to 1.
+	BatchSize int `yaml:"batch_size"`
+	// MergeMethod is how pull requests are merged: "merge", "squash" or
+	// "rebase". Defaults to "merge".
+	MergeMethod string `yaml:"merge_method"`
+}
+
+func (q *MergeQueue) GetLabel() string {
+	if q.Label == "" {
+		return defaultMergeQueueLabel
+	}
+	return q.Label
+}
+
+func (q *MergeQueue) GetBatchSize() int {
+	if q.BatchSize < 1 {
+		return 1
+	}
+	return q.BatchSize
+}
+
+func (q *MergeQueue) GetMergeMethod() string {
+	if q.MergeMethod == "" {
+		return MergeMethodMerge
+	}
+	return q.MergeMethod
+}
+
+// Validate returns an error if the merge queue config is invalid.
+func (q *MergeQueue) Validate() error {
+	if q.BatchSize < 0 {
+		return fmt.Errorf("invalid merge queue batch_size %d: must be positive", q.BatchSize)
+	}
+	if !slices.Contains([]string{MergeMethodMerge, MergeMethodSquash, MergeMethodRebase}, q.GetMergeMethod()) {
+		return fmt.Errorf("invalid merge queue merge_method %q: must be one of %q, %q or %q", q.MergeMethod, MergeMethodMerge, MergeMethodSquash, MergeMethodRebase)
+	}
+	return nil
 }
 
 type Action struct {
 	Name              string            `yaml:"name"`
+	StatusName        string            `yaml:"status_name"`
 	Triggers          *Triggers         `yaml:"triggers"`
 	OS                string            `yaml:"os"`
 	Arch              string            `yaml:"arch"`
@@ -51,6 +123,16 @@ type Action struct {
 	BazelCommands     []string          `yaml:"bazel_commands"`
 	Steps             []*rnpb.Step      `yaml:"steps"`
 	Timeout           *time.Duration    `yaml:"timeout"`
+	Concurrency       *Concurrency      `yaml:"concurrency"`
+	// Artifacts are the files that the action publishes once it's done. See
+	// Artifact.
+	Artifacts []*Artifact `yaml:"artifacts"`
+	// Matrix runs a copy of the action for each combination of the values
+	// of its env vars. See ExpandMatrix.
+	Matrix map[string][]string `yaml:"matrix"`
+
+	// The matrix action that this action is a combination of, if any.
+	matrixParent *Action
 }
 
 type Step struct {
@@ -64,6 +146,15 @@ func (a *Action) GetTriggers() *Triggers {
 	return a.Triggers
 }
 
+// GetStatusName returns the name of the commit status reported for the
+// action, which defaults to the action name.
+func (a *Action) GetStatusName() string {
+	if a.StatusName != "" {
+		return a.StatusName
+	}
+	return a.Name
+}
+
 func (a *Action) GetGitFetchFilters() []string {
 	if a.GitFetchFilters == nil {
 		// Default to blob:none if unspecified.
@@ -77,6 +168,9 @@ func (a *Action) GetGitFetchFilters() []string {
 type Triggers struct {
 	Push        *PushTrigger        `yaml:"push"`
 	PullRequest *PullRequestTrigger `yaml:"pull_request"`
+	Schedule    []*ScheduleTrigger  `yaml:"schedule"`
+	Dispatch    *DispatchTrigger    `yaml:"dispatch"`
+	MergeQueue  *MergeQueueTrigger  `yaml:"merge_queue"`
 }
 
 func (t *Triggers) GetPullRequestTrigger() *PullRequestTrigger {
@@ -87,11 +181,13 @@ func (t *Triggers) GetPullRequestTrigger() *PullRequestTrigger {
 }
 
 type PushTrigger struct {
-	Branches []string `yaml:"branches"`
+	Branches   []string `yaml:"branches"`
+	PathFilter `yaml:",inline"`
 }
 
 type PullRequestTrigger struct {
-	Branches []string `yaml:"branches"`
+	Branches   []string `yaml:"branches"`
+	PathFilter `yaml:",inline"`
 	// NOTE: If nil, defaults to true.
 	MergeWithBase *bool `yaml:"merge_with_base"`
 	// If MergeWithBase is enabled, determines whether the CI runner should manually
@@ -111,6 +207,314 @@ func (t *PullRequestTrigger) GetForceManualMerge() bool {
 	return t.GetMergeWithBase() && (t.ForceManualMergeWithBase == nil || *t.ForceManualMergeWithBase)
 }
 
+// PathFilter restricts a trigger to events that change files matching the
+// given glob patterns, relative to the repo root. "*" matches any part of a
+// path segment, and "**" matches any number of segments.
+type PathFilter struct {
+	// Paths are the patterns of the files that trigger the action. If empty,
+	// all files do, unless they're ignored.
+	Paths []string `yaml:"paths"`
+	// PathsIgnore are the patterns of the files that don't trigger the
+	// action.
+	PathsIgnore []string `yaml:"paths_ignore"`
+}
+
+// HasPathFilters returns whether the trigger only runs for some changed
+// files.
+func (f *PathFilter) HasPathFilters() bool {
+	return f != nil && (len(f.Paths) > 0 || len(f.PathsIgnore) > 0)
+}
+
+// MatchesChangedFiles returns whether any of the changed files matches the
+// path filters.
+func (f *PathFilter) MatchesChangedFiles(files []string) (bool, error) {
+	if !f.HasPathFilters() {
+		return true, nil
+	}
+	paths, err := compilePathPatterns(f.Paths)
+	if err != nil {
+		return false, err
+	}
+	ignore, err := compilePathPatterns(f.PathsIgnore)
+	if err != nil {
+		return false, err
+	}
+	for _, file := range files {
+		if (len(paths) == 0 || matchesAnyPath(paths, file)) && !matchesAnyPath(ignore, file) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func compilePathPatterns(patterns []string) ([]glob.Glob, error) {
+	globs := make([]glob.Glob, 0, len(patterns))
+	for _, p := range patterns {
+		g, err := glob.Compile(strings.TrimPrefix(p, "/"), '/')
+		if err != nil {
+			return nil, fmt.Errorf("invalid path pattern %q: %s", p, err)
+		}
+		globs = append(globs, g)
+	}
+	return globs, nil
+}
+
+func matchesAnyPath(globs []glob.Glob, file string) bool {
+	for _, g := range globs {
+		if g.Match(file) {
+			return true
+		}
+	}
+	return false
+}
+
+var artifactNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Artifact is a named set of files that an action publishes once its
+// commands have run, whether or not they succeeded. The files are copied
+// from the cache to durable storage, so that they can be downloaded from the
+// invocation until they expire, even after they've been evicted from the
+// cache.
+type Artifact struct {
+	// Name is the name of the artifact, which must be unique within the
+	// action.
+	Name string `yaml:"name"`
+	// Paths are the glob patterns of the files to publish, relative to the
+	// repo root, with the same syntax as path filters. Symlinks such as
+	// "bazel-bin" are followed, so "bazel-bin/app/*.tar" publishes the
+	// tarballs built in the app package.
+	Paths []string `yaml:"paths"`
+}
+
+// MatchFiles returns the paths of the regular files under root that match
+// the artifact's patterns, relative to root.
+func (a *Artifact) MatchFiles(root string) ([]string, error) {
+	globs, err := compilePathPatterns(a.Paths)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var files []string
+	for i, p := range a.Paths {
+		// Only walk the part of the tree that the pattern can match, which
+		// is the directory named by its segments before the first one with
+		// a wildcard.
+		var prefix []string
+		for _, segment := range strings.Split(strings.TrimPrefix(p, "/"), "/") {
+			if strings.ContainsAny(segment, "*?[{\\") {
+				break
+			}
+			prefix = append(prefix, segment)
+		}
+		start, err := filepath.EvalSymlinks(filepath.Join(root, filepath.Join(prefix...)))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = filepath.WalkDir(start, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(start, path)
+			if err != nil {
+				return err
+			}
+			name := filepath.ToSlash(filepath.Join(filepath.Join(prefix...), rel))
+			if d.IsDir() || seen[name] || !globs[i].Match(name) {
+				return nil
+			}
+			if d.Type()&fs.ModeSymlink != 0 {
+				info, err := os.Stat(path)
+				if err != nil || !info.Mode().IsRegular() {
+					return nil
+				}
+			} else if !d.Type().IsRegular() {
+				return nil
+			}
+			seen[name] = true
+			files = append(files, name)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	slices.Sort(files)
+	return files, nil
+}
+
+// validateArtifacts returns an error if an action declares an invalid
+// artifact.
+func validateArtifacts(actions []*Action) error {
+	for _, a := range actions {
+		if len(a.Artifacts) > maxArtifacts {
+			return fmt.Errorf("action %q: more than %d artifacts", a.Name, maxArtifacts)
+		}
+		names := map[string]bool{}
+		for _, artifact := range a.Artifacts {
+			if !artifactNameRegexp.MatchString(artifact.Name) {
+				return fmt.Errorf("action %q: invalid artifact name %q: must contain only letters, digits, '.', '_' and '-', and start with a letter or digit", a.Name, artifact.Name)
+			}
+			if names[artifact.Name] {
+				return fmt.Errorf("action %q: duplicate artifact name %q", a.Name, artifact.Name)
+			}
+			names[artifact.Name] = true
+			if len(artifact.Paths) == 0 {
+				return fmt.Errorf("action %q: artifact %q has no paths", a.Name, artifact.Name)
+			}
+			for _, p := range artifact.Paths {
+				if slices.Contains(strings.Split(p, "/"), "..") {
+					return fmt.Errorf("action %q: artifact %q: path %q is outside of the repo", a.Name, artifact.Name, p)
+				}
+			}
+			if _, err := compilePathPatterns(artifact.Paths); err != nil {
+				return fmt.Errorf("action %q: artifact %q: %w", a.Name, artifact.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// MergeQueueTrigger runs an action to test the pull requests in the merge
+// queue. All of the actions with a merge_queue trigger must pass before the
+// pull requests are merged.
+type MergeQueueTrigger struct {
+	// Branches are the target branches whose merge queues run the action.
+	Branches []string `yaml:"branches"`
+}
+
+type ScheduleTrigger struct {
+	// Cron is a cron expression with the fields "minute hour day-of-month
+	// month day-of-week", like "0 3 * * *".
+	Cron string `yaml:"cron"`
+	// Timezone is the IANA time zone that Cron is evaluated in, like
+	// "America/Los_Angeles". Defaults to UTC.
+	Timezone string `yaml:"timezone"`
+	// Branch is the branch that the action is run on.
+	Branch string `yaml:"branch"`
+	// Jitter is the maximum delay added to each run, to spread out actions
+	// that are scheduled at the same time. The delay is consistent from one
+	// scheduled run to the next.
+	Jitter *time.Duration `yaml:"jitter"`
+	// CatchUp determines whether to run the action once if scheduled runs were
+	// missed, for example because the schedule was disabled or BuildBuddy was
+	// unavailable. If false, missed runs are skipped.
+	CatchUp bool `yaml:"catch_up"`
+}
+
+// Parse returns the parsed cron schedule and the time zone it's evaluated in.
+func (t *ScheduleTrigger) Parse() (*cron.Schedule, *time.Location, error) {
+	if t.Branch == "" {
+		return nil, nil, fmt.Errorf("schedule %q is missing a branch", t.Cron)
+	}
+	s, err := cron.Parse(t.Cron)
+	if err != nil {
+		return nil, nil, err
+	}
+	loc := time.UTC
+	if t.Timezone != "" {
+		loc, err = time.LoadLocation(t.Timezone)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid timezone %q: %s", t.Timezone, err)
+		}
+	}
+	return s, loc, nil
+}
+
+func (t *ScheduleTrigger) GetJitter() time.Duration {
+	if t.Jitter == nil || *t.Jitter < 0 {
+		return 0
+	}
+	return *t.Jitter
+}
+
+// defaultConcurrencyGroup puts the runs of an action on the same branch in the
+// same concurrency group.
+const defaultConcurrencyGroup = "{action}:{branch}"
+
+// Concurrency limits an action to one run at a time per concurrency group.
+type Concurrency struct {
+	// Group is the name of the concurrency group. It can contain the
+	// placeholders "{action}", "{branch}", "{base_branch}" and "{pr_number}",
+	// which are replaced with the action name, the pushed branch, the branch
+	// that a pull request targets, and the pull request number.
+	Group string `yaml:"group"`
+	// CancelInProgress determines whether a new run cancels the in-progress
+	// runs in its group. If false, the new run waits for them to finish.
+	CancelInProgress bool `yaml:"cancel_in_progress"`
+}
+
+// GetGroup returns the name of the concurrency group of a run of the action.
+func (c *Concurrency) GetGroup(actionName, branch, baseBranch string, pullRequestNumber int64) string {
+	group := c.Group
+	if group == "" {
+		group = defaultConcurrencyGroup
+	}
+	return strings.NewReplacer(
+		"{action}", actionName,
+		"{branch}", branch,
+		"{base_branch}", baseBranch,
+		"{pr_number}", strconv.FormatInt(pullRequestNumber, 10),
+	).Replace(group)
+}
+
+var inputNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// DispatchTrigger allows an action to be run on demand with the
+// DispatchWorkflowAction API.
+type DispatchTrigger struct {
+	// Inputs are the parameters that can be passed when dispatching the
+	// action. Each input is passed to the action as an env var.
+	Inputs []*DispatchInput `yaml:"inputs"`
+}
+
+type DispatchInput struct {
+	// Name is the name of the input, which is also the name of the env var
+	// that it's passed as.
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+	// Required determines whether a value must be passed for the input.
+	Required bool `yaml:"required"`
+	// Default is the value of the input if none is passed.
+	Default string `yaml:"default"`
+	// Options, if set, are the only values that the input accepts.
+	Options []string `yaml:"options"`
+}
+
+// ResolveInputs validates the given input values against the declared inputs,
+// and returns the env vars to set for the dispatched action, including the
+// defaults of the inputs that weren't passed.
+func (t *DispatchTrigger) ResolveInputs(values map[string]string) (map[string]string, error) {
+	env := make(map[string]string, len(t.Inputs))
+	declared := make(map[string]bool, len(t.Inputs))
+	for _, input := range t.Inputs {
+		if !inputNameRegexp.MatchString(input.Name) {
+			return nil, fmt.Errorf("invalid input name %q: must contain only letters, digits and underscores, and not start with a digit", input.Name)
+		}
+		declared[input.Name] = true
+		value, ok := values[input.Name]
+		if !ok {
+			if input.Required {
+				return nil, fmt.Errorf("missing required input %q", input.Name)
+			}
+			env[input.Name] = input.Default
+			continue
+		}
+		if len(input.Options) > 0 && !slices.Contains(input.Options, value) {
+			return nil, fmt.Errorf("invalid value %q for input %q: must be one of %v", value, input.Name, input.Options)
+		}
+		env[input.Name] = value
+	}
+	for name := range values {
+		if !declared[name] {
+			return nil, fmt.Errorf("unknown input %q", name)
+		}
+	}
+	return env, nil
+}
+
 type ResourceRequests struct {
 	// Memory is a numeric quantity of memory in bytes, or human-readable IEC
 	// byte notation like "1GB" = 1024^3 bytes.
@@ -166,9 +570,133 @@ func NewConfig(r io.Reader) (*BuildBuddyConfig, error) {
 	if err := yaml.Unmarshal(byt, cfg); err != nil {
 		return nil, err
 	}
+	actions, err := expandMatrices(cfg.Actions)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Actions = actions
+	if err := validateStatusNames(cfg.Actions); err != nil {
+		return nil, err
+	}
+	if err := validateArtifacts(cfg.Actions); err != nil {
+		return nil, err
+	}
 	return cfg, nil
 }
 
+// MatrixParent returns the matrix action that the action is a combination
+// of, or nil if the action isn't part of a matrix.
+func (a *Action) MatrixParent() *Action {
+	return a.matrixParent
+}
+
+func expandMatrices(actions []*Action) ([]*Action, error) {
+	expanded := make([]*Action, 0, len(actions))
+	for _, a := range actions {
+		if len(a.Matrix) == 0 {
+			expanded = append(expanded, a)
+			continue
+		}
+		combinations, err := ExpandMatrix(a)
+		if err != nil {
+			return nil, fmt.Errorf("action %q: %w", a.Name, err)
+		}
+		expanded = append(expanded, combinations...)
+	}
+	names := map[string]bool{}
+	for _, a := range expanded {
+		if names[a.Name] {
+			return nil, fmt.Errorf("duplicate action name %q", a.Name)
+		}
+		names[a.Name] = true
+	}
+	return expanded, nil
+}
+
+// ExpandMatrix returns a copy of the action for each combination of its
+// matrix values. Each copy sets the env vars of the matrix to the values of
+// its combination, and is named after them, so that each one reports a
+// distinct status. For example, the matrix {"CONFIG": ["asan", "tsan"]} of
+// the action "Test" expands to the actions "Test (CONFIG=asan)" and
+// "Test (CONFIG=tsan)".
+func ExpandMatrix(a *Action) ([]*Action, error) {
+	keys := make([]string, 0, len(a.Matrix))
+	numCombinations := 1
+	for key, values := range a.Matrix {
+		if !inputNameRegexp.MatchString(key) {
+			return nil, fmt.Errorf("invalid matrix key %q: must contain only letters, digits and underscores, and not start with a digit", key)
+		}
+		if len(values) == 0 {
+			return nil, fmt.Errorf("matrix key %q has no values", key)
+		}
+		numCombinations *= len(values)
+		if numCombinations > maxMatrixCombinations {
+			return nil, fmt.Errorf("matrix has more than %d combinations", maxMatrixCombinations)
+		}
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	combinations := []map[string]string{{}}
+	for _, key := range keys {
+		next := make([]map[string]string, 0, len(combinations)*len(a.Matrix[key]))
+		for _, c := range combinations {
+			for _, value := range a.Matrix[key] {
+				combination := maps.Clone(c)
+				combination[key] = value
+				next = append(next, combination)
+			}
+		}
+		combinations = next
+	}
+
+	actions := make([]*Action, 0, len(combinations))
+	for _, combination := range combinations {
+		labels := make([]string, 0, len(keys))
+		for _, key := range keys {
+			labels = append(labels, key+"="+combination[key])
+		}
+		suffix := " (" + strings.Join(labels, ", ") + ")"
+		leg := *a
+		leg.Name = a.Name + suffix
+		if a.StatusName != "" {
+			leg.StatusName = a.StatusName + suffix
+		}
+		leg.Env = maps.Clone(a.Env)
+		if leg.Env == nil {
+			leg.Env = map[string]string{}
+		}
+		maps.Copy(leg.Env, combination)
+		leg.Matrix = nil
+		leg.matrixParent = a
+		actions = append(actions, &leg)
+	}
+	return actions, nil
+}
+
+// validateStatusNames returns an error if an action's configured status name
+// is also the status name of another action, since their statuses would
+// overwrite each other.
+func validateStatusNames(actions []*Action) error {
+	// Maps each status_name to the action that sets it.
+	seen := map[string]string{}
+	for _, a := range actions {
+		if a.StatusName == "" {
+			continue
+		}
+		if _, ok := seen[a.StatusName]; ok {
+			return fmt.Errorf("duplicate status_name %q", a.StatusName)
+		}
+		seen[a.StatusName] = a.Name
+	}
+	for _, a := range actions {
+		if other, ok := seen[a.Name]; ok && a.StatusName == "" {
+			return fmt.Errorf("status_name %q of action %q is also the name of another action", a.Name, other)
+		}
+	}
+	return nil
+}
+
 const kytheDownloadURL = "https://storage.googleapis.com/buildbuddy-tools/archives/kythe-v0.0.67h.tar.gz"
 
 func checkoutKythe(dirName, downloadURL string) string {
@@ -282,9 +810,40 @@ func MatchesAnyTrigger(action *Action, event, branch string) bool {
 	if prCfg := action.Triggers.PullRequest; prCfg != nil && event == webhook_data.EventName.PullRequest {
 		return matchesAnyBranch(prCfg.Branches, branch)
 	}
+
+	if mqCfg := action.Triggers.MergeQueue; mqCfg != nil && event == webhook_data.EventName.MergeQueue {
+		return matchesAnyBranch(mqCfg.Branches, branch)
+	}
+
+	if event == webhook_data.EventName.Schedule {
+		for _, schedule := range action.Triggers.Schedule {
+			if schedule.Branch == branch {
+				return true
+			}
+		}
+	}
 	return false
 }
 
+// GetPathFilter returns the path filter of the trigger that the event
+// matches, or nil if the trigger doesn't filter paths.
+func GetPathFilter(action *Action, event string) *PathFilter {
+	if action.Triggers == nil {
+		return nil
+	}
+	switch event {
+	case webhook_data.EventName.Push:
+		if t := action.Triggers.Push; t != nil && t.HasPathFilters() {
+			return &t.PathFilter
+		}
+	case webhook_data.EventName.PullRequest:
+		if t := action.Triggers.PullRequest; t != nil && t.HasPathFilters() {
+			return &t.PathFilter
+		}
+	}
+	return nil
+}
+
 // MatchesAnyActionName returns whether the given action matches any of the
 // given action names.
 func MatchesAnyActionName(action *Action, names []string) bool {
@@ -292,6 +851,10 @@ func MatchesAnyActionName(action *Action, names []string) bool {
 		if action.Name == name {
 			return true
 		}
+		// The name of a matrix action matches all of its combinations.
+		if p := action.MatrixParent(); p != nil && p.Name == name {
+			return true
+		}
 	}
 	return false
 }
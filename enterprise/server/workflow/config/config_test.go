@@ -2,11 +2,15 @@ package config_test
 
 import (
 	"bytes"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/workflow/config"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/workflow/config/test_data"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -119,3 +123,364 @@ func TestGetGitFetchFilters(t *testing.T) {
 		})
 	}
 }
+
+func TestScheduleTrigger(t *testing.T) {
+	s := `
+actions:
+  - name: Nightly
+    triggers:
+      schedule:
+        - cron: "0 3 * * *"
+          timezone: America/Los_Angeles
+          branch: main
+          jitter: 10m
+          catch_up: true
+`
+	cfg, err := config.NewConfig(strings.NewReader(s))
+	require.NoError(t, err)
+	action := cfg.Actions[0]
+	schedule := action.Triggers.Schedule[0]
+	assert.Equal(t, 10*time.Minute, schedule.GetJitter())
+	assert.True(t, schedule.CatchUp)
+	cronSchedule, loc, err := schedule.Parse()
+	require.NoError(t, err)
+	assert.Equal(t, "America/Los_Angeles", loc.String())
+	next := cronSchedule.Next(time.Date(2024, 3, 1, 12, 0, 0, 0, loc))
+	assert.Equal(t, time.Date(2024, 3, 2, 3, 0, 0, 0, loc), next)
+
+	assert.True(t, config.MatchesAnyTrigger(action, "schedule", "main"))
+	assert.False(t, config.MatchesAnyTrigger(action, "schedule", "other"))
+	assert.False(t, config.MatchesAnyTrigger(action, "push", "main"))
+
+	for _, invalid := range []*config.ScheduleTrigger{
+		{Cron: "0 3 * * *"},
+		{Cron: "0 3 * *", Branch: "main"},
+		{Cron: "0 3 * * *", Branch: "main", Timezone: "Mars/Olympus_Mons"},
+	} {
+		_, _, err := invalid.Parse()
+		assert.Error(t, err, "%+v", invalid)
+	}
+}
+
+func TestDispatchTrigger_ResolveInputs(t *testing.T) {
+	s := `
+actions:
+  - name: Deploy
+    triggers:
+      dispatch:
+        inputs:
+          - name: TARGET
+            required: true
+          - name: ENVIRONMENT
+            default: staging
+            options: [staging, production]
+          - name: DRY_RUN
+`
+	cfg, err := config.NewConfig(strings.NewReader(s))
+	require.NoError(t, err)
+	dispatch := cfg.Actions[0].Triggers.Dispatch
+	require.NotNil(t, dispatch)
+
+	env, err := dispatch.ResolveInputs(map[string]string{"TARGET": "//app"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"TARGET": "//app", "ENVIRONMENT": "staging", "DRY_RUN": ""}, env)
+
+	env, err = dispatch.ResolveInputs(map[string]string{"TARGET": "//app", "ENVIRONMENT": "production", "DRY_RUN": "1"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"TARGET": "//app", "ENVIRONMENT": "production", "DRY_RUN": "1"}, env)
+
+	for _, invalid := range []map[string]string{
+		{},
+		{"TARGET": "//app", "ENVIRONMENT": "dev"},
+		{"TARGET": "//app", "UNKNOWN": "1"},
+	} {
+		_, err := dispatch.ResolveInputs(invalid)
+		assert.Error(t, err, "%v", invalid)
+	}
+
+	_, err = (&config.DispatchTrigger{Inputs: []*config.DispatchInput{{Name: "1NVALID"}}}).ResolveInputs(nil)
+	assert.Error(t, err)
+}
+
+func TestConcurrency_GetGroup(t *testing.T) {
+	s := `
+actions:
+  - name: Test
+    concurrency:
+      cancel_in_progress: true
+  - name: Deploy
+    concurrency:
+      group: "deploy-{base_branch}-{pr_number}"
+`
+	cfg, err := config.NewConfig(strings.NewReader(s))
+	require.NoError(t, err)
+
+	c := cfg.Actions[0].Concurrency
+	require.NotNil(t, c)
+	assert.True(t, c.CancelInProgress)
+	assert.Equal(t, "Test:feature", c.GetGroup("Test", "feature", "main", 12))
+
+	c = cfg.Actions[1].Concurrency
+	require.NotNil(t, c)
+	assert.False(t, c.CancelInProgress)
+	assert.Equal(t, "deploy-main-12", c.GetGroup("Deploy", "feature", "main", 12))
+}
+
+func TestMergeQueue(t *testing.T) {
+	s := `
+merge_queue:
+  batch_size: 3
+  merge_method: squash
+actions:
+  - name: Test
+    triggers:
+      merge_queue:
+        branches: [main]
+`
+	cfg, err := config.NewConfig(strings.NewReader(s))
+	require.NoError(t, err)
+	require.NotNil(t, cfg.MergeQueue)
+	require.NoError(t, cfg.MergeQueue.Validate())
+	assert.Equal(t, "merge-queue", cfg.MergeQueue.GetLabel())
+	assert.Equal(t, 3, cfg.MergeQueue.GetBatchSize())
+	assert.Equal(t, "squash", cfg.MergeQueue.GetMergeMethod())
+
+	action := cfg.Actions[0]
+	assert.True(t, config.MatchesAnyTrigger(action, "merge_queue", "main"))
+	assert.False(t, config.MatchesAnyTrigger(action, "merge_queue", "release"))
+	assert.False(t, config.MatchesAnyTrigger(action, "pull_request", "main"))
+
+	q := &config.MergeQueue{}
+	assert.Equal(t, 1, q.GetBatchSize())
+	assert.Equal(t, "merge", q.GetMergeMethod())
+	assert.Error(t, (&config.MergeQueue{MergeMethod: "fast-forward"}).Validate())
+	assert.Error(t, (&config.MergeQueue{BatchSize: -1}).Validate())
+}
+
+func TestPathFilter(t *testing.T) {
+	s := `
+actions:
+  - name: Backend
+    triggers:
+      push:
+        branches: [main]
+        paths: ["backend/**", "/WORKSPACE"]
+        paths_ignore: ["**/*.md"]
+      pull_request:
+        branches: ["*"]
+  - name: Everything
+    triggers:
+      push:
+        branches: [main]
+`
+	cfg, err := config.NewConfig(strings.NewReader(s))
+	require.NoError(t, err)
+
+	f := config.GetPathFilter(cfg.Actions[0], "push")
+	require.NotNil(t, f)
+	assert.Nil(t, config.GetPathFilter(cfg.Actions[0], "pull_request"))
+	assert.Nil(t, config.GetPathFilter(cfg.Actions[1], "push"))
+
+	for _, test := range []struct {
+		files   []string
+		matches bool
+	}{
+		{[]string{"backend/server/main.go"}, true},
+		{[]string{"WORKSPACE"}, true},
+		{[]string{"frontend/app.ts", "backend/BUILD"}, true},
+		{[]string{"frontend/app.ts"}, false},
+		{[]string{"backend/README.md"}, false},
+		{[]string{}, false},
+	} {
+		matches, err := f.MatchesChangedFiles(test.files)
+		require.NoError(t, err)
+		assert.Equal(t, test.matches, matches, "%v", test.files)
+	}
+
+	ignoreOnly := &config.PathFilter{PathsIgnore: []string{"docs/**"}}
+	matches, err := ignoreOnly.MatchesChangedFiles([]string{"docs/index.md"})
+	require.NoError(t, err)
+	assert.False(t, matches)
+	matches, err = ignoreOnly.MatchesChangedFiles([]string{"docs/index.md", "main.go"})
+	require.NoError(t, err)
+	assert.True(t, matches)
+
+	_, err = (&config.PathFilter{Paths: []string{"[a-"}}).MatchesChangedFiles([]string{"a"})
+	assert.Error(t, err)
+}
+
+func TestStatusName(t *testing.T) {
+	s := `
+actions:
+  - name: Test all targets
+    status_name: ci/test
+  - name: Lint
+`
+	cfg, err := config.NewConfig(strings.NewReader(s))
+	require.NoError(t, err)
+	assert.Equal(t, "ci/test", cfg.Actions[0].GetStatusName())
+	assert.Equal(t, "Lint", cfg.Actions[1].GetStatusName())
+
+	for _, s := range []string{
+		`
+actions:
+  - name: Test
+    status_name: ci/test
+  - name: Test again
+    status_name: ci/test
+`,
+		`
+actions:
+  - name: Test
+    status_name: Lint
+  - name: Lint
+`,
+	} {
+		_, err := config.NewConfig(strings.NewReader(s))
+		assert.Error(t, err, s)
+	}
+}
+
+func TestMatrix(t *testing.T) {
+	s := `
+actions:
+  - name: Test
+    env:
+      CI: "1"
+    matrix:
+      USE_BAZEL_VERSION: ["7.4.0", "8.0.0"]
+      CONFIG: [asan, tsan]
+  - name: Lint
+`
+	cfg, err := config.NewConfig(strings.NewReader(s))
+	require.NoError(t, err)
+	var names []string
+	for _, a := range cfg.Actions {
+		names = append(names, a.Name)
+	}
+	assert.Equal(t, []string{
+		"Test (CONFIG=asan, USE_BAZEL_VERSION=7.4.0)",
+		"Test (CONFIG=asan, USE_BAZEL_VERSION=8.0.0)",
+		"Test (CONFIG=tsan, USE_BAZEL_VERSION=7.4.0)",
+		"Test (CONFIG=tsan, USE_BAZEL_VERSION=8.0.0)",
+		"Lint",
+	}, names)
+	assert.Equal(t, map[string]string{"CI": "1", "CONFIG": "tsan", "USE_BAZEL_VERSION": "7.4.0"}, cfg.Actions[2].Env)
+	assert.Nil(t, cfg.Actions[2].Matrix)
+	require.NotNil(t, cfg.Actions[2].MatrixParent())
+	assert.Equal(t, "Test", cfg.Actions[2].MatrixParent().Name)
+	assert.Nil(t, cfg.Actions[4].MatrixParent())
+	assert.True(t, config.MatchesAnyActionName(cfg.Actions[0], []string{"Test"}))
+	assert.True(t, config.MatchesAnyActionName(cfg.Actions[0], []string{"Test (CONFIG=asan, USE_BAZEL_VERSION=7.4.0)"}))
+	assert.False(t, config.MatchesAnyActionName(cfg.Actions[1], []string{"Test (CONFIG=asan, USE_BAZEL_VERSION=7.4.0)"}))
+
+	for _, s := range []string{
+		`
+actions:
+  - name: Test
+    matrix:
+      1CONFIG: [asan]
+`,
+		`
+actions:
+  - name: Test
+    matrix:
+      CONFIG: []
+`,
+		`
+actions:
+  - name: Test
+    matrix:
+      A: [1, 2, 3, 4, 5, 6, 7, 8, 9]
+      B: [1, 2, 3, 4, 5, 6, 7, 8, 9]
+`,
+		`
+actions:
+  - name: Test
+    matrix:
+      CONFIG: [asan]
+  - name: Test (CONFIG=asan)
+`,
+	} {
+		_, err := config.NewConfig(strings.NewReader(s))
+		assert.Error(t, err, s)
+	}
+}
+
+func TestArtifacts(t *testing.T) {
+	s := `
+actions:
+  - name: Build
+    artifacts:
+      - name: release
+        paths: ["bazel-bin/app/*.tar", "README.md"]
+      - name: test-logs
+        paths: ["bazel-testlogs/**/test.log"]
+`
+	cfg, err := config.NewConfig(strings.NewReader(s))
+	require.NoError(t, err)
+	require.Len(t, cfg.Actions[0].Artifacts, 2)
+
+	// bazel-bin and bazel-testlogs are symlinks to the output base, like in a
+	// real workspace.
+	root := testfs.MakeTempDir(t)
+	outputBase := testfs.MakeTempDir(t)
+	testfs.WriteAllFileContents(t, outputBase, map[string]string{
+		"bin/app/app.tar":           "tar",
+		"bin/app/app.zip":           "zip",
+		"bin/app/sub/other.tar":     "tar",
+		"testlogs/a/test.log":       "log",
+		"testlogs/a/b/test.log":     "log",
+		"testlogs/a/b/test.outputs": "outputs",
+	})
+	testfs.WriteAllFileContents(t, root, map[string]string{"README.md": "readme"})
+	require.NoError(t, os.Symlink(filepath.Join(outputBase, "bin"), filepath.Join(root, "bazel-bin")))
+	require.NoError(t, os.Symlink(filepath.Join(outputBase, "testlogs"), filepath.Join(root, "bazel-testlogs")))
+
+	files, err := cfg.Actions[0].Artifacts[0].MatchFiles(root)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"README.md", "bazel-bin/app/app.tar"}, files)
+	files, err = cfg.Actions[0].Artifacts[1].MatchFiles(root)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bazel-testlogs/a/b/test.log", "bazel-testlogs/a/test.log"}, files)
+
+	missing := &config.Artifact{Name: "missing", Paths: []string{"bazel-out/**"}}
+	files, err = missing.MatchFiles(root)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+
+	for _, s := range []string{
+		`
+actions:
+  - name: Build
+    artifacts:
+      - name: release
+`,
+		`
+actions:
+  - name: Build
+    artifacts:
+      - name: release/v1
+        paths: ["*.tar"]
+`,
+		`
+actions:
+  - name: Build
+    artifacts:
+      - name: release
+        paths: ["*.tar"]
+      - name: release
+        paths: ["*.zip"]
+`,
+		`
+actions:
+  - name: Build
+    artifacts:
+      - name: release
+        paths: ["../*.tar"]
+`,
+	} {
+		_, err := config.NewConfig(strings.NewReader(s))
+		assert.Error(t, err, s)
+	}
+}
@@ -0,0 +1,279 @@
+package service
+
+import (
+	"context"
+	"flag"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/redisutil"
+	"github.com/buildbuddy-io/buildbuddy/server/endpoint_urls/cache_api_url"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/urlutil"
+	"golang.org/x/sync/errgroup"
+
+	bespb "github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	wfpb "github.com/buildbuddy-io/buildbuddy/proto/workflow"
+	guuid "github.com/google/uuid"
+)
+
+var (
+	artifactTTL = flag.Duration("remote_execution.workflows_artifact_ttl", 30*24*time.Hour, "How long the artifacts declared in buildbuddy.yaml are kept after a workflow action publishes them, regardless of cache eviction. 0 disables persisting artifacts.")
+)
+
+const (
+	// How often to delete the expired artifacts.
+	artifactCleanupInterval = 10 * time.Minute
+
+	// The maximum number of expired artifact files deleted at a time.
+	artifactCleanupBatchSize = 500
+
+	// Max concurrency when copying artifact files from the cache to the
+	// blobstore.
+	artifactCopyConcurrency = 20
+
+	// Key used to make sure that only one app deletes the expired artifacts
+	// at a time.
+	artifactRedisLockKey = "lock.workflow_artifact_cleanup"
+
+	// How long deleting the expired artifacts may hold the lock for.
+	artifactRedisLockExpiry = 5 * time.Minute
+)
+
+// artifactBlobName returns the name of the blob that a file of an artifact
+// is stored in. It's named after the file's ID rather than its path, since
+// the path is chosen by the action.
+func artifactBlobName(invocationID, artifactFileID string) string {
+	return path.Join(invocationID, "artifacts", "workflow", artifactFileID)
+}
+
+func (ws *workflowService) PersistArtifacts(ctx context.Context, invocationID string, artifacts []*bespb.WorkflowArtifactPublished) error {
+	if *artifactTTL == 0 || ws.env.GetDBHandle() == nil || ws.env.GetBlobstore() == nil {
+		return nil
+	}
+	expiresAt := ws.env.GetClock().Now().Add(*artifactTTL)
+	var eg errgroup.Group
+	eg.SetLimit(artifactCopyConcurrency)
+	for _, artifact := range artifacts {
+		for _, f := range artifact.GetFiles() {
+			artifactName := artifact.GetName()
+			eg.Go(func() error {
+				uri, err := url.Parse(f.GetUri())
+				if err != nil {
+					return status.InvalidArgumentErrorf("invalid URI of file %q of artifact %q: %s", f.GetName(), artifactName, err)
+				}
+				// Only persist files from caches that are hosted on the
+				// BuildBuddy domain (but only if we know it).
+				if cache_api_url.String() != "" && urlutil.GetDomain(uri.Hostname()) != urlutil.GetDomain(cache_api_url.WithPath("").Hostname()) {
+					return status.InvalidArgumentErrorf("file %q of artifact %q is not stored in the BuildBuddy cache", f.GetName(), artifactName)
+				}
+				row := &tables.WorkflowArtifact{
+					ArtifactFileID: guuid.NewString(),
+					InvocationID:   invocationID,
+					Name:           artifactName,
+					FileName:       f.GetName(),
+					Digest:         f.GetDigest(),
+					SizeBytes:      f.GetLength(),
+					ExpiresAtUsec:  expiresAt.UnixMicro(),
+				}
+				row.BlobName = artifactBlobName(invocationID, row.ArtifactFileID)
+				if err := ws.copyArtifactFile(ctx, uri, row.BlobName); err != nil {
+					return status.WrapErrorf(err, "copy file %q of artifact %q", f.GetName(), artifactName)
+				}
+				return ws.env.GetDBHandle().NewQuery(ctx, "workflow_artifact_create_file").Create(row)
+			})
+		}
+	}
+	return eg.Wait()
+}
+
+// copyArtifactFile copies a file from the cache to the blob with the given
+// name.
+func (ws *workflowService) copyArtifactFile(ctx context.Context, uri *url.URL, blobName string) error {
+	w, err := ws.env.GetBlobstore().Writer(ctx, blobName)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if err := ws.env.GetPooledByteStreamClient().StreamBytestreamFile(ctx, uri, w); err != nil {
+		return err
+	}
+	return w.Commit()
+}
+
+// checkInvocationAccess returns an error if the authenticated user can't
+// access the given invocation.
+func (ws *workflowService) checkInvocationAccess(ctx context.Context, invocationID string) error {
+	if invocationID == "" {
+		return status.InvalidArgumentError("missing invocation_id")
+	}
+	_, err := ws.env.GetInvocationDB().LookupInvocation(ctx, invocationID)
+	return err
+}
+
+func (ws *workflowService) GetWorkflowArtifacts(ctx context.Context, req *wfpb.GetWorkflowArtifactsRequest) (*wfpb.GetWorkflowArtifactsResponse, error) {
+	if err := ws.checkInvocationAccess(ctx, req.GetInvocationId()); err != nil {
+		return nil, err
+	}
+	rq := ws.env.GetDBHandle().NewQuery(ctx, "workflow_artifact_get_files").Raw(`
+		SELECT * FROM "WorkflowArtifacts"
+		WHERE invocation_id = ? AND expires_at_usec > ?
+		ORDER BY name, file_name`,
+		req.GetInvocationId(), ws.env.GetClock().Now().UnixMicro(),
+	)
+	rsp := &wfpb.GetWorkflowArtifactsResponse{}
+	err := db.ScanEach(rq, func(ctx context.Context, a *tables.WorkflowArtifact) error {
+		if n := len(rsp.Artifact); n == 0 || rsp.Artifact[n-1].GetName() != a.Name {
+			rsp.Artifact = append(rsp.Artifact, &wfpb.WorkflowArtifact{
+				Name:          a.Name,
+				ExpiresAtUsec: a.ExpiresAtUsec,
+			})
+		}
+		artifact := rsp.Artifact[len(rsp.Artifact)-1]
+		artifact.File = append(artifact.File, &wfpb.WorkflowArtifact_File{
+			Name:      a.FileName,
+			Digest:    a.Digest,
+			SizeBytes: a.SizeBytes,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rsp, nil
+}
+
+func (ws *workflowService) ReadWorkflowArtifact(ctx context.Context, invocationID, artifactName, fileName string) ([]byte, error) {
+	if err := ws.checkInvocationAccess(ctx, invocationID); err != nil {
+		return nil, err
+	}
+	a := &tables.WorkflowArtifact{}
+	err := ws.env.GetDBHandle().NewQuery(ctx, "workflow_artifact_get_file").Raw(`
+		SELECT * FROM "WorkflowArtifacts"
+		WHERE invocation_id = ? AND name = ? AND file_name = ? AND expires_at_usec > ?`,
+		invocationID, artifactName, fileName, ws.env.GetClock().Now().UnixMicro(),
+	).Take(a)
+	if db.IsRecordNotFound(err) {
+		return nil, status.NotFoundErrorf("file %q of artifact %q not found", fileName, artifactName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ws.env.GetBlobstore().ReadBlob(ctx, a.BlobName)
+}
+
+// artifactJanitor deletes the artifacts that have expired.
+type artifactJanitor struct {
+	ws   *workflowService
+	lock interfaces.DistributedLock
+	quit chan struct{}
+	done chan struct{}
+}
+
+func newArtifactJanitor(ws *workflowService) *artifactJanitor {
+	var lock interfaces.DistributedLock
+	if rdb := ws.env.GetDefaultRedisClient(); rdb != nil {
+		l, err := redisutil.NewWeakLock(rdb, artifactRedisLockKey, artifactRedisLockExpiry)
+		if err != nil {
+			log.Warningf("Failed to create artifact cleanup lock, expired artifacts will be deleted by every app: %s", err)
+		} else {
+			lock = l
+		}
+	}
+	return &artifactJanitor{
+		ws:   ws,
+		lock: lock,
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// start deletes the expired artifacts until the server shuts down.
+func (j *artifactJanitor) start() {
+	env := j.ws.env
+	go func() {
+		defer close(j.done)
+		ticker := env.GetClock().NewTicker(artifactCleanupInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-j.quit:
+				return
+			case <-ticker.Chan():
+			}
+			if err := j.run(env.GetServerContext()); err != nil {
+				log.Warningf("Failed to delete expired workflow artifacts: %s", err)
+			}
+		}
+	}()
+	env.GetHealthChecker().RegisterShutdownFunction(func(ctx context.Context) error {
+		close(j.quit)
+		<-j.done
+		return nil
+	})
+}
+
+// DeleteExpiredArtifacts deletes the artifact files that have expired. It is
+// called periodically if remote_execution.workflows_artifact_ttl is set.
+func (ws *workflowService) DeleteExpiredArtifacts(ctx context.Context) error {
+	if ws.env.GetDBHandle() == nil {
+		return status.FailedPreconditionError("database not configured")
+	}
+	return ws.artifacts.run(ctx)
+}
+
+func (j *artifactJanitor) run(ctx context.Context) error {
+	if j.lock != nil {
+		err := j.lock.Lock(ctx)
+		if status.IsResourceExhaustedError(err) {
+			// Another app is already deleting the expired artifacts.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := j.lock.Unlock(ctx); err != nil {
+				log.Warningf("Failed to unlock distributed lock: %s", err)
+			}
+		}()
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, artifactRedisLockExpiry)
+		defer cancel()
+	}
+
+	dbh := j.ws.env.GetDBHandle()
+	rq := dbh.NewQuery(ctx, "workflow_artifact_get_expired_files").Raw(`
+		SELECT * FROM "WorkflowArtifacts"
+		WHERE expires_at_usec <= ?
+		ORDER BY expires_at_usec
+		LIMIT ?`,
+		j.ws.env.GetClock().Now().UnixMicro(), artifactCleanupBatchSize,
+	)
+	var expired []*tables.WorkflowArtifact
+	err := db.ScanEach(rq, func(ctx context.Context, a *tables.WorkflowArtifact) error {
+		expired = append(expired, a)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, a := range expired {
+		if err := j.ws.env.GetBlobstore().DeleteBlob(ctx, a.BlobName); err != nil && !status.IsNotFoundError(err) {
+			log.CtxWarningf(ctx, "Failed to delete blob of expired file %q of artifact %q of invocation %s: %s", a.FileName, a.Name, a.InvocationID, err)
+			continue
+		}
+		err := dbh.NewQuery(ctx, "workflow_artifact_delete_file").Raw(`
+			DELETE FROM "WorkflowArtifacts" WHERE artifact_file_id = ?`, a.ArtifactFileID,
+		).Exec().Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
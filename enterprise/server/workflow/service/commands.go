@@ -0,0 +1,168 @@
+package service
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/webhook_data"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/workflow/config"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+var (
+	enablePullRequestCommands = flag.Bool("remote_execution.workflows_enable_pull_request_commands", false, "Whether repo collaborators can run workflow actions by commenting commands like \"/buildbuddy retry\" on pull requests.")
+)
+
+const (
+	pullRequestCommandsDocsURL = "https://buildbuddy.io/docs/workflows-setup#pull-request-commands"
+
+	retryCommand = "retry"
+	runCommand   = "run"
+)
+
+// pullRequestCommand is a command that was commented on a pull request, such
+// as "/buildbuddy run Test".
+type pullRequestCommand struct {
+	// Name is retryCommand or runCommand.
+	Name string
+	// ActionName is the name of the action to run, for runCommand.
+	ActionName string
+}
+
+// parsePullRequestCommand parses the command on the first line of a pull
+// request comment.
+func parsePullRequestCommand(comment string) (*pullRequestCommand, error) {
+	line, _, _ := strings.Cut(strings.TrimSpace(comment), "\n")
+	args, ok := strings.CutPrefix(strings.TrimSpace(line), webhook_data.CommandPrefix)
+	if !ok {
+		return nil, status.InvalidArgumentErrorf("comment is not a %s command", webhook_data.CommandPrefix)
+	}
+	name, arg, _ := strings.Cut(strings.TrimSpace(args), " ")
+	arg = strings.TrimSpace(arg)
+	switch name {
+	case retryCommand:
+		if arg != "" {
+			return nil, status.InvalidArgumentErrorf("`%s %s` does not take any arguments", webhook_data.CommandPrefix, retryCommand)
+		}
+	case runCommand:
+		if arg == "" {
+			return nil, status.InvalidArgumentErrorf("`%s %s` requires the name of the action to run", webhook_data.CommandPrefix, runCommand)
+		}
+	case "":
+		return nil, status.InvalidArgumentError("missing command")
+	default:
+		return nil, status.InvalidArgumentErrorf("unknown command %q", name)
+	}
+	return &pullRequestCommand{Name: name, ActionName: arg}, nil
+}
+
+// pushedBefore returns whether the pushed repo of the pull request is known to
+// not have been pushed to since t, i.e. whether its head is the same as at t.
+func pushedBefore(prwd *interfaces.WebhookData, t time.Time) bool {
+	if prwd.PushedRepoPushedAt.IsZero() || t.IsZero() {
+		return false
+	}
+	return prwd.PushedRepoPushedAt.Before(t)
+}
+
+// handlePullRequestCommand runs the command that a repo collaborator
+// commented on a pull request, and replies with links to the started
+// invocations:
+//
+//   - "/buildbuddy retry" reruns the actions triggered by the pull request.
+//   - "/buildbuddy run <action>" runs the action with the given name on the
+//     pull request, regardless of its triggers, like a manual dispatch.
+//
+// The actions run as trusted, like they do once a collaborator approves the
+// pull request. Commands on pull requests from forks are rejected if the fork
+// was pushed to after the comment, since the collaborator didn't vouch for
+// the new head.
+func (ws *workflowService) handlePullRequestCommand(ctx context.Context, gitProvider interfaces.GitProvider, wd *interfaces.WebhookData, wf *tables.Workflow) error {
+	if !*enablePullRequestCommands {
+		return nil
+	}
+	reply := func(body string) error {
+		if err := gitProvider.CreatePullRequestComment(ctx, wf.AccessToken, wd.TargetRepoURL, wd.PullRequestNumber, body); err != nil {
+			return status.WrapError(err, "reply to pull request command")
+		}
+		return nil
+	}
+
+	isSenderTrusted, err := gitProvider.IsTrusted(ctx, wf.AccessToken, wd.TargetRepoURL, wd.Sender)
+	if err != nil {
+		return err
+	}
+	if !isSenderTrusted {
+		log.CtxInfof(ctx, "Ignoring command on pull request #%d of %s (sender %q is untrusted)", wd.PullRequestNumber, wf.RepoURL, wd.Sender)
+		return reply(fmt.Sprintf("@%s Only collaborators of this repository can run BuildBuddy commands.", wd.Sender))
+	}
+	cmd, err := parsePullRequestCommand(wd.PullRequestComment)
+	if err != nil {
+		return reply(fmt.Sprintf("@%s Invalid BuildBuddy command: %s. See %s for the supported commands.", wd.Sender, status.Message(err), pullRequestCommandsDocsURL))
+	}
+	prwd, err := gitProvider.GetPullRequest(ctx, wf.AccessToken, wd.TargetRepoURL, wd.PullRequestNumber)
+	if err != nil {
+		return err
+	}
+	// The collaborator vouches for the pull request as of their comment, but
+	// the head of a fork can be replaced by anyone with access to the fork
+	// afterwards. Only run the head if the fork hasn't been pushed to since.
+	if webhook_data.IsFork(prwd) && !pushedBefore(prwd, wd.PullRequestCommentCreatedAt) {
+		log.CtxInfof(ctx, "Ignoring command on pull request #%d of %s (fork %q was pushed to after the command)", wd.PullRequestNumber, wf.RepoURL, prwd.PushedRepoURL)
+		return reply(fmt.Sprintf("@%s The pull request may have been updated after your comment. Review the latest changes and comment again to run them.", wd.Sender))
+	}
+	apiKey, err := ws.apiKeyForWorkflow(ctx, wf)
+	if err != nil {
+		return err
+	}
+
+	var actions []*config.Action
+	var env map[string]string
+	switch cmd.Name {
+	case retryCommand:
+		actions, err = ws.getActions(ctx, wf, prwd, nil /*=actionFilter*/)
+	case runCommand:
+		// Run the action regardless of its triggers and path filters, like
+		// DispatchWorkflowAction does, using the default values of its
+		// dispatch inputs.
+		prwd.EventName = webhook_data.EventName.ManualDispatch
+		actions, err = ws.getActions(ctx, wf, prwd, []string{cmd.ActionName})
+		if err == nil {
+			if dispatch := actions[0].GetTriggers().Dispatch; dispatch != nil {
+				env, err = dispatch.ResolveInputs(nil)
+			}
+		}
+	}
+	if status.IsNotFoundError(err) {
+		return reply(fmt.Sprintf("@%s No workflow actions to run were found in %s at %s.", wd.Sender, config.FilePath, prwd.SHA))
+	}
+	if err != nil {
+		if replyErr := reply(fmt.Sprintf("@%s Failed to run BuildBuddy command: %s", wd.Sender, status.Message(err))); replyErr != nil {
+			log.CtxWarning(ctx, replyErr.Error())
+		}
+		return err
+	}
+	log.CtxInfof(ctx, "Running command %q on pull request #%d of %s for %q", cmd.Name, wd.PullRequestNumber, wf.RepoURL, wd.Sender)
+
+	isTrusted := true
+	invocationIDs := ws.startActions(ctx, apiKey, wf, prwd, isTrusted, actions, env)
+	var lines []string
+	for i, invocationID := range invocationIDs {
+		if invocationID == "" {
+			lines = append(lines, fmt.Sprintf("- %s: failed to start", actions[i].Name))
+			continue
+		}
+		invocationURL, err := ws.createBBURL(ctx, "/invocation/"+invocationID)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, fmt.Sprintf("- [%s](%s)", actions[i].Name, invocationURL))
+	}
+	return reply(fmt.Sprintf("@%s Started %d workflow actions at %s:\n\n%s", wd.Sender, len(actions), prwd.SHA, strings.Join(lines, "\n")))
+}
@@ -0,0 +1,299 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/workflow/config"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/background"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	// States of a WorkflowConcurrencyRun.
+	concurrencyRunQueued  int32 = 1
+	concurrencyRunStarted int32 = 2
+
+	// How often a queued run checks whether the in-progress runs of its
+	// concurrency group have finished.
+	concurrencyQueuePollInterval = 10 * time.Second
+
+	// How long a queued run waits for the in-progress runs of its concurrency
+	// group to finish before giving up.
+	maxConcurrencyQueueDuration = 6 * time.Hour
+
+	// Started runs that don't have an execution ID after this long failed to
+	// start, and no longer hold up their concurrency group.
+	maxConcurrencyRunStartDuration = 5 * time.Minute
+)
+
+// concurrencyRunStatus is a started run along with the stage of its
+// execution, or -1 if the execution is not found.
+type concurrencyRunStatus struct {
+	tables.WorkflowConcurrencyRun
+	Stage int64
+}
+
+func concurrencyGroupKey(group string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(group)))
+}
+
+// runWorkflowAction starts a run of a workflow action, using start to execute
+// it, and returns its execution ID. All runs go through here, so that the
+// action's concurrency group applies whatever triggered the run. If the run is
+// queued behind its concurrency group, the returned execution ID is empty and
+// start is called once the run is no longer waiting.
+func (ws *workflowService) runWorkflowAction(ctx context.Context, apiKey *tables.APIKey, wf *tables.Workflow, wd *interfaces.WebhookData, action *config.Action, invocationID string, start func(ctx context.Context) (string, error)) (string, error) {
+	if action.Concurrency == nil {
+		return start(ctx)
+	}
+	return ws.startConcurrentRun(ctx, apiKey, wf, wd, action, invocationID, start)
+}
+
+// startConcurrentRun starts a run of an action that has a concurrency config,
+// using start to execute it. It returns the execution ID if the run was
+// started right away.
+//
+// If the action cancels in-progress runs, the older runs in its concurrency
+// group are cancelled and the run is started right away. Otherwise, the run is
+// queued in the background until the in-progress runs in its group finish. A
+// newer run replaces the run that is queued, so that at most one run per group
+// is waiting.
+func (ws *workflowService) startConcurrentRun(ctx context.Context, apiKey *tables.APIKey, wf *tables.Workflow, wd *interfaces.WebhookData, action *config.Action, invocationID string, start func(ctx context.Context) (string, error)) (string, error) {
+	group := action.Concurrency.GetGroup(action.Name, wd.PushedBranch, wd.TargetBranch, wd.PullRequestNumber)
+	run := &tables.WorkflowConcurrencyRun{
+		InvocationID: invocationID,
+		WorkflowID:   wf.WorkflowID,
+		GroupKey:     concurrencyGroupKey(group),
+		State:        concurrencyRunQueued,
+	}
+	if err := ws.env.GetDBHandle().NewQuery(ctx, "workflow_service_create_concurrency_run").Create(run); err != nil {
+		return "", status.InternalErrorf("create concurrency run: %s", err)
+	}
+	if err := ws.supersedeConcurrencyRuns(ctx, apiKey, run, action.Concurrency.CancelInProgress); err != nil {
+		return "", err
+	}
+	if action.Concurrency.CancelInProgress {
+		return ws.runInConcurrencyGroup(ctx, apiKey, run, false /*=wait*/, start)
+	}
+
+	log.CtxInfof(ctx, "Queueing workflow action %q (%s) in concurrency group %q", action.Name, wf.RepoURL, group)
+	ws.queuedRuns.Add(1)
+	go func() {
+		defer ws.queuedRuns.Done()
+		ctx, cancel := context.WithTimeout(background.ToBackground(ctx), maxConcurrencyQueueDuration)
+		defer cancel()
+		if _, err := ws.runInConcurrencyGroup(ctx, apiKey, run, true /*=wait*/, start); err != nil {
+			log.CtxErrorf(ctx, "Failed to execute queued workflow %s (%s) action %q: %s", wf.WorkflowID, wf.RepoURL, action.Name, err)
+		}
+	}()
+	return "", nil
+}
+
+// supersedeConcurrencyRuns deletes the runs in the concurrency group that are
+// older than the given run, so that the queued ones don't start. If
+// cancelInProgress is set, the started ones are deleted and cancelled as well.
+//
+// Runs are created before the older runs are looked up, so if two runs are
+// created at the same time, the newer one always supersedes the older one.
+func (ws *workflowService) supersedeConcurrencyRuns(ctx context.Context, apiKey *tables.APIKey, run *tables.WorkflowConcurrencyRun, cancelInProgress bool) error {
+	dbh := ws.env.GetDBHandle()
+	rq := dbh.NewQuery(ctx, "workflow_service_get_older_concurrency_runs").Raw(`
+		SELECT * FROM "WorkflowConcurrencyRuns"
+		WHERE workflow_id = ? AND group_key = ?
+		AND (created_at_usec < ? OR (created_at_usec = ? AND invocation_id < ?))`,
+		run.WorkflowID, run.GroupKey, run.CreatedAtUsec, run.CreatedAtUsec, run.InvocationID,
+	)
+	var older []*tables.WorkflowConcurrencyRun
+	err := db.ScanEach(rq, func(ctx context.Context, r *tables.WorkflowConcurrencyRun) error {
+		older = append(older, r)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, r := range older {
+		if r.State == concurrencyRunStarted && !cancelInProgress {
+			continue
+		}
+		deleted, err := ws.deleteConcurrencyRun(ctx, r.InvocationID)
+		if err != nil {
+			return err
+		}
+		if !deleted {
+			// Already superseded by another run.
+			continue
+		}
+		log.CtxInfof(ctx, "Workflow invocation %s was superseded by %s", r.InvocationID, run.InvocationID)
+		if r.State == concurrencyRunStarted {
+			ws.cancelSupersededRun(ctx, apiKey, r.InvocationID)
+		}
+	}
+	return nil
+}
+
+// runInConcurrencyGroup claims the run, waiting for the in-progress runs of its
+// group to finish if wait is set, and starts it. It returns the execution ID,
+// or an empty string if the run didn't start.
+func (ws *workflowService) runInConcurrencyGroup(ctx context.Context, apiKey *tables.APIKey, run *tables.WorkflowConcurrencyRun, wait bool, start func(ctx context.Context) (string, error)) (string, error) {
+	var claimed bool
+	var err error
+	if wait {
+		claimed, err = ws.waitForConcurrencyGroup(ctx, run)
+	} else {
+		claimed, err = ws.claimConcurrencyRun(ctx, run)
+	}
+	if err != nil {
+		return "", err
+	}
+	if !claimed {
+		log.CtxInfof(ctx, "Not starting workflow invocation %s: superseded by a newer run", run.InvocationID)
+		return "", nil
+	}
+
+	executionID, err := start(ctx)
+	if err != nil || executionID == "" {
+		if _, err := ws.deleteConcurrencyRun(ctx, run.InvocationID); err != nil {
+			log.CtxWarningf(ctx, "Failed to delete concurrency run %s: %s", run.InvocationID, err)
+		}
+		return "", err
+	}
+	result := ws.env.GetDBHandle().NewQuery(ctx, "workflow_service_set_concurrency_run_execution").Raw(`
+		UPDATE "WorkflowConcurrencyRuns"
+		SET execution_id = ?, updated_at_usec = ?
+		WHERE invocation_id = ?`,
+		executionID, ws.env.GetDBHandle().NowFunc().UnixMicro(), run.InvocationID,
+	).Exec()
+	if result.Error != nil {
+		return "", result.Error
+	}
+	if result.RowsAffected == 0 {
+		// A newer run superseded this one while it was starting, but couldn't
+		// cancel its execution yet.
+		ws.cancelSupersededRun(ctx, apiKey, run.InvocationID)
+	}
+	return executionID, nil
+}
+
+// claimConcurrencyRun marks a queued run as started. It returns false if the
+// run was superseded.
+func (ws *workflowService) claimConcurrencyRun(ctx context.Context, run *tables.WorkflowConcurrencyRun) (bool, error) {
+	result := ws.env.GetDBHandle().NewQuery(ctx, "workflow_service_claim_concurrency_run").Raw(`
+		UPDATE "WorkflowConcurrencyRuns"
+		SET state = ?, updated_at_usec = ?
+		WHERE invocation_id = ? AND state = ?`,
+		concurrencyRunStarted, ws.env.GetDBHandle().NowFunc().UnixMicro(), run.InvocationID, concurrencyRunQueued,
+	).Exec()
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// waitForConcurrencyGroup waits until the concurrency group of a queued run has
+// no runs in progress, then claims the run. It returns false if the run was
+// superseded while waiting.
+func (ws *workflowService) waitForConcurrencyGroup(ctx context.Context, run *tables.WorkflowConcurrencyRun) (bool, error) {
+	dbh := ws.env.GetDBHandle()
+	for {
+		current := &tables.WorkflowConcurrencyRun{}
+		err := dbh.NewQuery(ctx, "workflow_service_get_concurrency_run").Raw(`
+			SELECT * FROM "WorkflowConcurrencyRuns" WHERE invocation_id = ?`,
+			run.InvocationID,
+		).Take(current)
+		if db.IsRecordNotFound(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		inProgress, err := ws.concurrencyGroupInProgress(ctx, run)
+		if err != nil {
+			return false, err
+		}
+		if !inProgress {
+			return ws.claimConcurrencyRun(ctx, run)
+		}
+		select {
+		case <-ctx.Done():
+			return false, status.DeadlineExceededErrorf("timed out waiting for in-progress runs of the concurrency group: %s", ctx.Err())
+		case <-ws.quit:
+			return false, status.UnavailableError("server is shutting down")
+		case <-ws.env.GetClock().After(concurrencyQueuePollInterval):
+		}
+	}
+}
+
+// concurrencyGroupInProgress returns whether the group of the given run has
+// another run in progress. Runs that have finished are deleted.
+func (ws *workflowService) concurrencyGroupInProgress(ctx context.Context, run *tables.WorkflowConcurrencyRun) (bool, error) {
+	dbh := ws.env.GetDBHandle()
+	rq := dbh.NewQuery(ctx, "workflow_service_get_started_concurrency_runs").Raw(`
+		SELECT r.*, COALESCE(e.stage, -1) AS stage
+		FROM "WorkflowConcurrencyRuns" r
+		LEFT JOIN "Executions" e ON e.execution_id = r.execution_id
+		WHERE r.workflow_id = ? AND r.group_key = ? AND r.state = ? AND r.invocation_id != ?`,
+		run.WorkflowID, run.GroupKey, concurrencyRunStarted, run.InvocationID,
+	)
+	var finished []string
+	inProgress := false
+	now := dbh.NowFunc()
+	err := db.ScanEach(rq, func(ctx context.Context, r *concurrencyRunStatus) error {
+		if r.ExecutionID == "" {
+			// The run is being started.
+			if now.Sub(time.UnixMicro(r.UpdatedAtUsec)) < maxConcurrencyRunStartDuration {
+				inProgress = true
+			} else {
+				finished = append(finished, r.InvocationID)
+			}
+		} else if r.Stage < 0 || r.Stage == int64(repb.ExecutionStage_COMPLETED) {
+			finished = append(finished, r.InvocationID)
+		} else {
+			inProgress = true
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, invocationID := range finished {
+		if _, err := ws.deleteConcurrencyRun(ctx, invocationID); err != nil {
+			log.CtxWarningf(ctx, "Failed to delete finished concurrency run %s: %s", invocationID, err)
+		}
+	}
+	return inProgress, nil
+}
+
+// deleteConcurrencyRun deletes a run, and returns whether it existed.
+func (ws *workflowService) deleteConcurrencyRun(ctx context.Context, invocationID string) (bool, error) {
+	result := ws.env.GetDBHandle().NewQuery(ctx, "workflow_service_delete_concurrency_run").Raw(`
+		DELETE FROM "WorkflowConcurrencyRuns" WHERE invocation_id = ?`,
+		invocationID,
+	).Exec()
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// cancelSupersededRun cancels the remote execution of a superseded run.
+func (ws *workflowService) cancelSupersededRun(ctx context.Context, apiKey *tables.APIKey, invocationID string) {
+	res := ws.env.GetRemoteExecutionService()
+	if res == nil {
+		log.CtxWarningf(ctx, "Cannot cancel superseded workflow invocation %s: remote execution is not enabled", invocationID)
+		return
+	}
+	log.CtxInfof(ctx, "Cancelling superseded workflow invocation %s", invocationID)
+	ctx = ws.env.GetAuthenticator().AuthContextFromAPIKey(ctx, apiKey.Value)
+	if err := res.Cancel(ctx, invocationID); err != nil {
+		log.CtxWarningf(ctx, "Failed to cancel superseded workflow invocation %s: %s", invocationID, err)
+	}
+}
@@ -0,0 +1,311 @@
+package service
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/redisutil"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/workflow/config"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/github"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	guuid "github.com/google/uuid"
+)
+
+var (
+	reportMatrixSummaries = flag.Bool("remote_execution.workflows_report_matrix_summaries", true, "Whether to report a combined status for the runs of each matrix workflow action, once they've all finished.")
+)
+
+const (
+	// How often to check whether the runs of matrix actions have finished.
+	matrixPollInterval = 30 * time.Second
+
+	// Runs that don't finish within this long are reported as timed out.
+	maxMatrixRunDuration = 6 * time.Hour
+
+	// Key used to make sure that only one app reports the matrix summaries
+	// at a time.
+	matrixRedisLockKey = "lock.workflow_matrix_summaries"
+
+	// How long reporting the matrix summaries may hold the lock for.
+	matrixRedisLockExpiry = 5 * time.Minute
+)
+
+// matrixRunStatus is a matrix run along with the result of one of its
+// executions. Stage is -1 if the run has no executions yet.
+type matrixRunStatus struct {
+	tables.WorkflowMatrixRun
+	Stage      int64
+	ExitCode   int32
+	StatusCode int32
+}
+
+// matrixRuns tracks the runs of the matrix actions started for an event, so
+// that a combined status can be reported for each matrix once its runs have
+// finished.
+type matrixRuns struct {
+	ws *workflowService
+	wf *tables.Workflow
+	wd *interfaces.WebhookData
+
+	mu sync.Mutex
+	// The ID and the number of started runs of each matrix.
+	ids    map[*config.Action]string
+	counts map[*config.Action]int
+}
+
+func (ws *workflowService) newMatrixRuns(wf *tables.Workflow, wd *interfaces.WebhookData) *matrixRuns {
+	return &matrixRuns{
+		ws:     ws,
+		wf:     wf,
+		wd:     wd,
+		ids:    map[*config.Action]string{},
+		counts: map[*config.Action]int{},
+	}
+}
+
+// add records the run of an action, if it's a combination of a matrix.
+func (m *matrixRuns) add(ctx context.Context, action *config.Action, invocationID string) error {
+	parent := action.MatrixParent()
+	if parent == nil || !*reportMatrixSummaries || m.ws.env.GetDBHandle() == nil {
+		return nil
+	}
+	m.mu.Lock()
+	id, ok := m.ids[parent]
+	if !ok {
+		id = guuid.NewString()
+		m.ids[parent] = id
+	}
+	m.counts[parent]++
+	m.mu.Unlock()
+	run := &tables.WorkflowMatrixRun{
+		InvocationID:  invocationID,
+		MatrixID:      id,
+		WorkflowID:    m.wf.WorkflowID,
+		ActionName:    action.Name,
+		StatusName:    parent.GetStatusName(),
+		StatusRepoURL: getStatusReportingURL(m.wd),
+		CommitSHA:     m.wd.SHA,
+	}
+	return m.ws.env.GetDBHandle().NewQuery(ctx, "workflow_matrix_create_run").Create(run)
+}
+
+// remove deletes the run of an action that failed to start.
+func (m *matrixRuns) remove(ctx context.Context, action *config.Action, invocationID string) {
+	parent := action.MatrixParent()
+	m.mu.Lock()
+	_, ok := m.ids[parent]
+	if ok {
+		m.counts[parent]--
+	}
+	m.mu.Unlock()
+	if !ok {
+		return
+	}
+	err := m.ws.env.GetDBHandle().NewQuery(ctx, "workflow_matrix_delete_run").Raw(`
+		DELETE FROM "WorkflowMatrixRuns" WHERE invocation_id = ?`, invocationID,
+	).Exec().Error
+	if err != nil {
+		log.CtxWarningf(ctx, "Failed to delete matrix run %s: %s", invocationID, err)
+	}
+}
+
+// reportPending reports the pending combined status of each matrix that has
+// started runs.
+func (m *matrixRuns) reportPending(ctx context.Context) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for parent, count := range m.counts {
+		if count == 0 {
+			continue
+		}
+		description := fmt.Sprintf("Running %d combinations...", count)
+		m.ws.createMatrixStatus(ctx, m.wf, getStatusReportingURL(m.wd), m.wd.SHA, parent.GetStatusName(), m.ws.bbUrl.String(), description, github.PendingState)
+	}
+}
+
+func (ws *workflowService) createMatrixStatus(ctx context.Context, wf *tables.Workflow, repoURL, sha, statusName, targetURL, description string, state github.State) {
+	provider, err := ws.providerForRepo(repoURL)
+	if err == nil {
+		payload := github.NewGithubStatusPayload(statusName, targetURL, description, state)
+		err = provider.CreateStatus(ctx, wf.AccessToken, repoURL, sha, payload)
+	}
+	if err != nil {
+		log.CtxWarningf(ctx, "Failed to create matrix status %q for %s at %s: %s", statusName, repoURL, sha, err)
+	}
+}
+
+// matrixProcessor reports the combined status of the runs of each matrix
+// action once they've all finished.
+type matrixProcessor struct {
+	ws   *workflowService
+	lock interfaces.DistributedLock
+	quit chan struct{}
+	done chan struct{}
+}
+
+func newMatrixProcessor(ws *workflowService) *matrixProcessor {
+	var lock interfaces.DistributedLock
+	if rdb := ws.env.GetDefaultRedisClient(); rdb != nil {
+		l, err := redisutil.NewWeakLock(rdb, matrixRedisLockKey, matrixRedisLockExpiry)
+		if err != nil {
+			log.Warningf("Failed to create matrix summary lock, matrix summaries will be reported by every app: %s", err)
+		} else {
+			lock = l
+		}
+	}
+	return &matrixProcessor{
+		ws:   ws,
+		lock: lock,
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// start reports the matrix summaries until the server shuts down.
+func (p *matrixProcessor) start() {
+	env := p.ws.env
+	go func() {
+		defer close(p.done)
+		ticker := env.GetClock().NewTicker(matrixPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.quit:
+				return
+			case <-ticker.Chan():
+			}
+			if err := p.run(env.GetServerContext()); err != nil {
+				log.Warningf("Failed to report matrix summaries: %s", err)
+			}
+		}
+	}()
+	env.GetHealthChecker().RegisterShutdownFunction(func(ctx context.Context) error {
+		close(p.quit)
+		<-p.done
+		return nil
+	})
+}
+
+// ProcessMatrixRuns reports the combined status of each matrix whose runs
+// have all finished. It is called periodically if
+// remote_execution.workflows_report_matrix_summaries is set.
+func (ws *workflowService) ProcessMatrixRuns(ctx context.Context) error {
+	if ws.env.GetDBHandle() == nil {
+		return status.FailedPreconditionError("database not configured")
+	}
+	return ws.matrix.run(ctx)
+}
+
+func (p *matrixProcessor) run(ctx context.Context) error {
+	if p.lock != nil {
+		err := p.lock.Lock(ctx)
+		if status.IsResourceExhaustedError(err) {
+			// Another app is already reporting the matrix summaries.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := p.lock.Unlock(ctx); err != nil {
+				log.Warningf("Failed to unlock distributed lock: %s", err)
+			}
+		}()
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, matrixRedisLockExpiry)
+		defer cancel()
+	}
+
+	dbh := p.ws.env.GetDBHandle()
+	rq := dbh.NewQuery(ctx, "workflow_matrix_get_runs").Raw(`
+		SELECT r.*, COALESCE(e.stage, -1) AS stage, COALESCE(e.exit_code, 0) AS exit_code, COALESCE(e.status_code, 0) AS status_code
+		FROM "WorkflowMatrixRuns" r
+		LEFT JOIN "Executions" e ON e.invocation_id = r.invocation_id
+		ORDER BY r.matrix_id, r.action_name`)
+	var matrixIDs []string
+	matrices := map[string][]*matrixRunStatus{}
+	err := db.ScanEach(rq, func(ctx context.Context, r *matrixRunStatus) error {
+		runs, ok := matrices[r.MatrixID]
+		if !ok {
+			matrixIDs = append(matrixIDs, r.MatrixID)
+		}
+		// A run may have several executions if it was retried. Only keep the
+		// completed one, if any.
+		if n := len(runs); n > 0 && runs[n-1].InvocationID == r.InvocationID {
+			if r.Stage == int64(repb.ExecutionStage_COMPLETED) {
+				runs[n-1] = r
+			}
+			return nil
+		}
+		matrices[r.MatrixID] = append(runs, r)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range matrixIDs {
+		if err := p.reportSummary(ctx, id, matrices[id]); err != nil {
+			log.CtxWarningf(ctx, "Failed to report summary of matrix %s: %s", id, err)
+		}
+	}
+	return nil
+}
+
+// reportSummary reports the combined status of a matrix if all of its runs
+// have finished, and deletes the runs.
+func (p *matrixProcessor) reportSummary(ctx context.Context, matrixID string, runs []*matrixRunStatus) error {
+	dbh := p.ws.env.GetDBHandle()
+	now := dbh.NowFunc()
+	passed := 0
+	var failedInvocationID string
+	for _, r := range runs {
+		switch {
+		case r.Stage == int64(repb.ExecutionStage_COMPLETED):
+			if r.ExitCode == 0 && r.StatusCode == 0 {
+				passed++
+			} else if failedInvocationID == "" {
+				failedInvocationID = r.InvocationID
+			}
+		case now.Sub(time.UnixMicro(r.CreatedAtUsec)) > maxMatrixRunDuration:
+			if failedInvocationID == "" {
+				failedInvocationID = r.InvocationID
+			}
+		default:
+			// Still running.
+			return nil
+		}
+	}
+
+	first := runs[0]
+	wf, err := p.ws.workflowWithAccessToken(ctx, first.WorkflowID)
+	if err != nil && !status.IsNotFoundError(err) {
+		return err
+	}
+	if wf != nil {
+		state := github.SuccessState
+		description := fmt.Sprintf("All %d combinations passed", len(runs))
+		invocationID := first.InvocationID
+		if failedInvocationID != "" {
+			state = github.FailureState
+			description = fmt.Sprintf("%d of %d combinations passed", passed, len(runs))
+			invocationID = failedInvocationID
+		}
+		targetURL, err := p.ws.createBBURL(ctx, "/invocation/"+invocationID)
+		if err != nil {
+			return err
+		}
+		p.ws.createMatrixStatus(ctx, wf, first.StatusRepoURL, first.CommitSHA, first.StatusName, targetURL, description, state)
+	}
+	return dbh.NewQuery(ctx, "workflow_matrix_delete_runs").Raw(`
+		DELETE FROM "WorkflowMatrixRuns" WHERE matrix_id = ?`, matrixID,
+	).Exec().Error
+}
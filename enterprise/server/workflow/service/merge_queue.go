@@ -0,0 +1,865 @@
+package service
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/redisutil"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/webhook_data"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/workflow/config"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/github"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	wfpb "github.com/buildbuddy-io/buildbuddy/proto/workflow"
+	gitutil "github.com/buildbuddy-io/buildbuddy/server/util/git"
+	guuid "github.com/google/uuid"
+)
+
+var (
+	enableMergeQueue = flag.Bool("remote_execution.workflows_enable_merge_queue", false, "Whether to test and merge the pull requests that are added to the merge queue of a repo.")
+)
+
+const (
+	// How often to check on the merge queues.
+	mergeQueuePollInterval = 30 * time.Second
+
+	// Runs that don't finish within this long fail their batch.
+	maxMergeQueueRunDuration = 6 * time.Hour
+
+	// Runs that don't have an execution ID after this long failed to start.
+	maxMergeQueueRunStartDuration = 5 * time.Minute
+
+	// Key used to make sure that only one app processes the merge queues at a
+	// time. Entries are claimed in the DB, so batches are only started once
+	// even without it.
+	mergeQueueRedisLockKey = "lock.workflow_merge_queue"
+
+	// How long processing the merge queues may hold the lock for.
+	mergeQueueRedisLockExpiry = 5 * time.Minute
+
+	// The context of the commit statuses that report the merge queue state of
+	// a pull request.
+	mergeQueueStatusContext = "BuildBuddy merge queue"
+
+	mergeQueueDocsURL = "https://buildbuddy.io/docs/workflows-setup#using-the-merge-queue"
+)
+
+// mergeQueueRunStatus is a merge queue run along with the result of its
+// execution. Stage is -1 if the execution is not found.
+type mergeQueueRunStatus struct {
+	tables.MergeQueueRun
+	Stage      int64
+	ExitCode   int32
+	StatusCode int32
+	// The state of the run in its concurrency group, or 0 if the action
+	// doesn't have a concurrency config, or the run was superseded or failed
+	// to start. Runs in a concurrency group may wait to start for longer than
+	// maxMergeQueueRunStartDuration.
+	ConcurrencyState int32
+}
+
+// mergeQueueProcessor tests the batches of pull requests in the merge queues,
+// and merges them when their workflow runs pass.
+type mergeQueueProcessor struct {
+	ws   *workflowService
+	lock interfaces.DistributedLock
+	quit chan struct{}
+	done chan struct{}
+}
+
+func newMergeQueueProcessor(ws *workflowService) *mergeQueueProcessor {
+	var lock interfaces.DistributedLock
+	if rdb := ws.env.GetDefaultRedisClient(); rdb != nil {
+		l, err := redisutil.NewWeakLock(rdb, mergeQueueRedisLockKey, mergeQueueRedisLockExpiry)
+		if err != nil {
+			log.Warningf("Failed to create merge queue lock, merge queues will be processed by every app: %s", err)
+		} else {
+			lock = l
+		}
+	}
+	return &mergeQueueProcessor{
+		ws:   ws,
+		lock: lock,
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// start processes the merge queues until the server shuts down.
+func (p *mergeQueueProcessor) start() {
+	env := p.ws.env
+	go func() {
+		defer close(p.done)
+		ticker := env.GetClock().NewTicker(mergeQueuePollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.quit:
+				return
+			case <-ticker.Chan():
+			}
+			if err := p.run(env.GetServerContext()); err != nil {
+				log.Warningf("Failed to process merge queues: %s", err)
+			}
+		}
+	}()
+	env.GetHealthChecker().RegisterShutdownFunction(func(ctx context.Context) error {
+		close(p.quit)
+		<-p.done
+		return nil
+	})
+}
+
+// ProcessMergeQueues merges the batches of pull requests whose workflow runs
+// passed, and starts testing the next batches. It is called periodically if
+// remote_execution.workflows_enable_merge_queue is set.
+func (ws *workflowService) ProcessMergeQueues(ctx context.Context) error {
+	if ws.env.GetDBHandle() == nil {
+		return status.FailedPreconditionError("database not configured")
+	}
+	return ws.mergeQueue.run(ctx)
+}
+
+func (p *mergeQueueProcessor) run(ctx context.Context) error {
+	if p.lock != nil {
+		err := p.lock.Lock(ctx)
+		if status.IsResourceExhaustedError(err) {
+			// Another app is already processing the merge queues.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := p.lock.Unlock(ctx); err != nil {
+				log.Warningf("Failed to unlock distributed lock: %s", err)
+			}
+		}()
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, mergeQueueRedisLockExpiry)
+		defer cancel()
+	}
+
+	type queueKey struct {
+		WorkflowID   string
+		TargetBranch string
+	}
+	var queues []*queueKey
+	rq := p.ws.env.GetDBHandle().NewQuery(ctx, "workflow_merge_queue_get_queues").Raw(`
+		SELECT DISTINCT workflow_id, target_branch FROM "MergeQueueEntries"`)
+	err := db.ScanEach(rq, func(ctx context.Context, q *queueKey) error {
+		queues = append(queues, q)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	workflows := map[string]*tables.Workflow{}
+	for _, q := range queues {
+		wf, ok := workflows[q.WorkflowID]
+		if !ok {
+			wf, err = p.workflow(ctx, q.WorkflowID)
+			if err != nil {
+				log.CtxWarningf(ctx, "Failed to look up workflow %s for its merge queue: %s", q.WorkflowID, err)
+				continue
+			}
+			workflows[q.WorkflowID] = wf
+		}
+		if err := p.processQueue(ctx, wf, q.TargetBranch); err != nil {
+			log.CtxWarningf(ctx, "Failed to process merge queue of workflow %s (%s) branch %q: %s", wf.WorkflowID, wf.RepoURL, q.TargetBranch, err)
+		}
+	}
+	return nil
+}
+
+// workflow looks up a workflow by ID, along with its access token. If the
+// workflow no longer exists, its merge queue entries are deleted.
+func (p *mergeQueueProcessor) workflow(ctx context.Context, workflowID string) (*tables.Workflow, error) {
+	wf, err := p.ws.workflowWithAccessToken(ctx, workflowID)
+	if status.IsNotFoundError(err) {
+		if err := p.ws.env.GetDBHandle().NewQuery(ctx, "workflow_merge_queue_delete_workflow_entries").Raw(`
+			DELETE FROM "MergeQueueEntries" WHERE workflow_id = ?`, workflowID,
+		).Exec().Error; err != nil {
+			return nil, err
+		}
+	}
+	return wf, err
+}
+
+// workflowWithAccessToken looks up a workflow by ID, or the GitRepository for
+// a synthetic workflow ID, along with its access token, without checking
+// that the authenticated user can access it. It returns a NotFound error if
+// the workflow no longer exists.
+func (ws *workflowService) workflowWithAccessToken(ctx context.Context, workflowID string) (*tables.Workflow, error) {
+	dbh := ws.env.GetDBHandle()
+	var wf *tables.Workflow
+	var err error
+	if !isRepositoryWorkflowID(workflowID) {
+		wf = &tables.Workflow{}
+		err = dbh.NewQuery(ctx, "workflow_service_get_workflow_with_token").Raw(`
+			SELECT * FROM "Workflows" WHERE workflow_id = ?`, workflowID,
+		).Take(wf)
+	} else {
+		groupID, repoURL, parseErr := parseRepositoryWorkflowID(workflowID)
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		repo := &tables.GitRepository{}
+		err = dbh.NewQuery(ctx, "workflow_service_get_repo_with_token").Raw(`
+			SELECT * FROM "GitRepositories" WHERE group_id = ? AND repo_url = ?`,
+			groupID, repoURL.String(),
+		).Take(repo)
+		if err == nil {
+			if ws.env.GetGitHubApp() == nil {
+				return nil, status.UnimplementedError("GitHub App is not configured")
+			}
+			wf = ws.gitRepositoryWorkflow(repo, "" /*=accessToken*/).Workflow
+			err = ws.scheduler.accessToken(ctx, wf)
+		}
+	}
+	if db.IsRecordNotFound(err) {
+		return nil, status.NotFoundErrorf("workflow %s not found", workflowID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return wf, nil
+}
+
+// queueEntries returns the entries in the merge queue of a workflow's target
+// branch, in the order they're merged in.
+func (ws *workflowService) queueEntries(ctx context.Context, workflowID, targetBranch string) ([]*tables.MergeQueueEntry, error) {
+	rq := ws.env.GetDBHandle().NewQuery(ctx, "workflow_merge_queue_get_entries").Raw(`
+		SELECT * FROM "MergeQueueEntries"
+		WHERE workflow_id = ? AND target_branch = ?
+		ORDER BY created_at_usec, pull_request_number`,
+		workflowID, targetBranch,
+	)
+	var entries []*tables.MergeQueueEntry
+	err := db.ScanEach(rq, func(ctx context.Context, e *tables.MergeQueueEntry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	return entries, err
+}
+
+func (p *mergeQueueProcessor) processQueue(ctx context.Context, wf *tables.Workflow, targetBranch string) error {
+	entries, err := p.ws.queueEntries(ctx, wf.WorkflowID, targetBranch)
+	if err != nil {
+		return err
+	}
+	var batch []*tables.MergeQueueEntry
+	for _, e := range entries {
+		if e.State == int32(wfpb.MergeQueueEntry_TESTING) {
+			batch = append(batch, e)
+		}
+	}
+	if len(batch) > 0 {
+		return p.checkBatch(ctx, wf, batch)
+	}
+	return p.startNextBatch(ctx, wf, entries)
+}
+
+// checkBatch merges the batch if all of its runs passed, or fails it if one
+// of them failed. A batch without any runs is requeued once it has waited
+// long enough for its runs to start, since it was never tested.
+func (p *mergeQueueProcessor) checkBatch(ctx context.Context, wf *tables.Workflow, batch []*tables.MergeQueueEntry) error {
+	dbh := p.ws.env.GetDBHandle()
+	rq := dbh.NewQuery(ctx, "workflow_merge_queue_get_runs").Raw(`
+		SELECT r.*, COALESCE(e.stage, -1) AS stage, COALESCE(e.exit_code, 0) AS exit_code, COALESCE(e.status_code, 0) AS status_code,
+			COALESCE(c.state, 0) AS concurrency_state
+		FROM "MergeQueueRuns" r
+		LEFT JOIN "Executions" e ON e.execution_id = r.execution_id
+		LEFT JOIN "WorkflowConcurrencyRuns" c ON c.invocation_id = r.invocation_id
+		WHERE r.batch_id = ?`,
+		batch[0].BatchID,
+	)
+	now := dbh.NowFunc()
+	done := true
+	numRuns := 0
+	var failure string
+	var failedInvocationID string
+	err := db.ScanEach(rq, func(ctx context.Context, r *mergeQueueRunStatus) error {
+		numRuns++
+		age := now.Sub(time.UnixMicro(r.CreatedAtUsec))
+		switch {
+		case r.ExecutionID == "" && r.ConcurrencyState == 0 && age > maxMergeQueueRunStartDuration:
+			failure = fmt.Sprintf("Workflow action %q failed to start", r.ActionName)
+		case r.Stage == int64(repb.ExecutionStage_COMPLETED):
+			if r.ExitCode != 0 || r.StatusCode != 0 {
+				failure = fmt.Sprintf("Workflow action %q failed", r.ActionName)
+				failedInvocationID = r.InvocationID
+			}
+		case age > maxMergeQueueRunDuration:
+			failure = fmt.Sprintf("Workflow action %q timed out", r.ActionName)
+			failedInvocationID = r.InvocationID
+		default:
+			done = false
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if numRuns == 0 {
+		if now.Sub(time.UnixMicro(batch[0].UpdatedAtUsec)) <= maxMergeQueueRunStartDuration {
+			return nil
+		}
+		log.CtxInfof(ctx, "Merge queue batch %s of %s has no runs, requeueing it", batch[0].BatchID, wf.RepoURL)
+		return p.ws.requeueBatch(ctx, wf.WorkflowID, batch[0].BatchID, false /*=testAlone*/)
+	}
+	if failure != "" {
+		return p.failBatch(ctx, wf, batch, failure, failedInvocationID)
+	}
+	if !done {
+		return nil
+	}
+	return p.mergeBatch(ctx, wf, batch)
+}
+
+// failBatch handles a failed run of a batch. If the batch has multiple pull
+// requests, they're requeued to be tested one at a time, since it's not known
+// which one caused the failure. Otherwise, the pull request fails.
+func (p *mergeQueueProcessor) failBatch(ctx context.Context, wf *tables.Workflow, batch []*tables.MergeQueueEntry, message, invocationID string) error {
+	if len(batch) > 1 {
+		log.CtxInfof(ctx, "Merge queue batch %s of %s failed, testing its %d pull requests one at a time", batch[0].BatchID, wf.RepoURL, len(batch))
+		return p.ws.requeueBatch(ctx, wf.WorkflowID, batch[0].BatchID, true /*=testAlone*/)
+	}
+	e := batch[0]
+	log.CtxInfof(ctx, "Merge queue entry for pull request #%d of %s failed: %s", e.PullRequestNumber, wf.RepoURL, message)
+	if err := p.ws.setMergeQueueEntryFailed(ctx, e, message); err != nil {
+		return err
+	}
+	targetURL := mergeQueueDocsURL
+	if invocationID != "" {
+		u, err := p.ws.createBBURL(ctx, "/invocation/"+invocationID)
+		if err != nil {
+			return err
+		}
+		targetURL = u
+	}
+	p.ws.createMergeQueueStatus(ctx, wf, e.CommitSHA, targetURL, message, github.FailureState)
+	return nil
+}
+
+// mergeBatch merges the pull requests of a batch whose runs passed, in order.
+// If a pull request fails to merge, it fails, and the pull requests after it
+// are requeued, since they were tested along with it.
+func (p *mergeQueueProcessor) mergeBatch(ctx context.Context, wf *tables.Workflow, batch []*tables.MergeQueueEntry) error {
+	cfg, err := p.ws.mergeQueueConfig(ctx, wf, batch[0].TargetBranch)
+	if err != nil {
+		return err
+	}
+	provider, err := p.ws.providerForRepo(wf.RepoURL)
+	if err != nil {
+		return err
+	}
+	for _, e := range batch {
+		err := provider.MergePullRequest(ctx, wf.AccessToken, wf.RepoURL, e.PullRequestNumber, e.CommitSHA, cfg.GetMergeMethod())
+		if err != nil {
+			log.CtxWarningf(ctx, "Failed to merge pull request #%d of %s: %s", e.PullRequestNumber, wf.RepoURL, err)
+			message := "Failed to merge the pull request"
+			if err := p.ws.setMergeQueueEntryFailed(ctx, e, fmt.Sprintf("%s: %s", message, status.Message(err))); err != nil {
+				return err
+			}
+			p.ws.createMergeQueueStatus(ctx, wf, e.CommitSHA, mergeQueueDocsURL, message, github.ErrorState)
+			return p.ws.requeueBatch(ctx, wf.WorkflowID, e.BatchID, false /*=testAlone*/)
+		}
+		log.CtxInfof(ctx, "Merge queue merged pull request #%d of %s", e.PullRequestNumber, wf.RepoURL)
+		if _, err := p.ws.deleteMergeQueueEntry(ctx, wf.WorkflowID, e.PullRequestNumber); err != nil {
+			return err
+		}
+		p.ws.createMergeQueueStatus(ctx, wf, e.CommitSHA, mergeQueueDocsURL, "Merged", github.SuccessState)
+	}
+	return p.ws.deleteMergeQueueRuns(ctx, batch[0].BatchID)
+}
+
+// startNextBatch starts testing the next batch of queued pull requests: the
+// first queued pull request, along with the queued pull requests after it, up
+// to the batch size. Pull requests that need to be tested alone are always
+// tested in a batch of their own.
+func (p *mergeQueueProcessor) startNextBatch(ctx context.Context, wf *tables.Workflow, entries []*tables.MergeQueueEntry) error {
+	var queued []*tables.MergeQueueEntry
+	for _, e := range entries {
+		if e.State == int32(wfpb.MergeQueueEntry_QUEUED) {
+			queued = append(queued, e)
+		}
+	}
+	if len(queued) == 0 {
+		return nil
+	}
+	cfg, err := p.ws.mergeQueueConfig(ctx, wf, queued[0].TargetBranch)
+	if err != nil {
+		return err
+	}
+	batch := queued[:1]
+	if !queued[0].TestAlone {
+		for _, e := range queued[1:] {
+			if len(batch) >= cfg.GetBatchSize() || e.TestAlone {
+				break
+			}
+			batch = append(batch, e)
+		}
+	}
+
+	batchID, err := guuid.NewRandom()
+	if err != nil {
+		return status.InternalErrorf("failed to generate batch ID: %s", err)
+	}
+	claimed, err := p.ws.claimMergeQueueBatch(ctx, wf.WorkflowID, batch, batchID.String())
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		// The queue changed since it was read; try again on the next poll.
+		return nil
+	}
+	for _, e := range batch {
+		e.BatchID = batchID.String()
+	}
+	return p.startBatch(ctx, wf, batch)
+}
+
+// startBatch starts the workflow actions with a merge_queue trigger for the
+// target branch, with the first pull request of the batch checked out and the
+// others merged into it.
+func (p *mergeQueueProcessor) startBatch(ctx context.Context, wf *tables.Workflow, batch []*tables.MergeQueueEntry) error {
+	first := batch[0]
+	wd := &interfaces.WebhookData{
+		EventName:         webhook_data.EventName.MergeQueue,
+		PushedRepoURL:     first.PushedRepoURL,
+		PushedBranch:      first.PushedBranch,
+		SHA:               first.CommitSHA,
+		TargetRepoURL:     wf.RepoURL,
+		TargetBranch:      first.TargetBranch,
+		PullRequestNumber: first.PullRequestNumber,
+		PullRequestAuthor: first.Author,
+	}
+	var extraArgs []string
+	for _, e := range batch[1:] {
+		extraArgs = append(extraArgs, "--merge_commit_sha="+e.CommitSHA)
+	}
+	fail := func(message string) error {
+		for _, e := range batch {
+			if err := p.ws.setMergeQueueEntryFailed(ctx, e, message); err != nil {
+				return err
+			}
+			p.ws.createMergeQueueStatus(ctx, wf, e.CommitSHA, mergeQueueDocsURL, message, github.ErrorState)
+		}
+		return p.ws.deleteMergeQueueRuns(ctx, first.BatchID)
+	}
+	// requeue puts the batch back in the queue if it couldn't be started, so
+	// that it's retried on the next poll instead of being left without runs.
+	requeue := func(err error) error {
+		if err := p.ws.requeueBatch(ctx, wf.WorkflowID, first.BatchID, false /*=testAlone*/); err != nil {
+			log.CtxWarningf(ctx, "Failed to requeue merge queue batch %s of %s: %s", first.BatchID, wf.RepoURL, err)
+		}
+		return err
+	}
+
+	actions, err := p.ws.getActions(ctx, wf, wd, nil /*=actionFilter*/)
+	if err != nil {
+		return requeue(err)
+	}
+	if len(actions) == 0 {
+		return fail(fmt.Sprintf("No workflow actions have a merge_queue trigger for branch %q", first.TargetBranch))
+	}
+	apiKey, err := p.ws.apiKeyForWorkflow(ctx, wf)
+	if err != nil {
+		return requeue(err)
+	}
+	log.CtxInfof(ctx, "Merge queue testing batch %s of %s (%d pull requests)", first.BatchID, wf.RepoURL, len(batch))
+	dbh := p.ws.env.GetDBHandle()
+	var invocationIDs []string
+	for i, action := range actions {
+		invocationUUID, err := guuid.NewRandom()
+		if err != nil {
+			err = status.InternalErrorf("failed to generate invocation ID: %s", err)
+			if i == 0 {
+				return requeue(err)
+			}
+			return err
+		}
+		invocationID := invocationUUID.String()
+		run := &tables.MergeQueueRun{
+			InvocationID: invocationID,
+			BatchID:      first.BatchID,
+			ActionName:   action.Name,
+		}
+		if err := dbh.NewQuery(ctx, "workflow_merge_queue_create_run").Create(run); err != nil {
+			err = status.InternalErrorf("create merge queue run: %s", err)
+			if i == 0 {
+				return requeue(err)
+			}
+			return err
+		}
+		// Queued pull requests are trusted, since a trusted user added them
+		// to the queue at the commit that is tested.
+		isTrusted := true
+		ctx := log.EnrichContext(ctx, log.InvocationIDKey, invocationID)
+		// If the run is queued behind its concurrency group, its execution
+		// is recorded once it starts.
+		start := func(ctx context.Context) (string, error) {
+			executionID, err := p.ws.executeWorkflowAction(ctx, apiKey, wf, wd, isTrusted, action, invocationID, extraArgs, nil /*=env*/)
+			if err != nil || executionID == "" {
+				return executionID, err
+			}
+			err = dbh.NewQuery(ctx, "workflow_merge_queue_set_run_execution").Raw(`
+				UPDATE "MergeQueueRuns" SET execution_id = ?, updated_at_usec = ?
+				WHERE invocation_id = ?`,
+				executionID, dbh.NowFunc().UnixMicro(), invocationID,
+			).Exec().Error
+			return executionID, err
+		}
+		if _, err := p.ws.runWorkflowAction(ctx, apiKey, wf, wd, action, invocationID, start); err != nil {
+			return fail(fmt.Sprintf("Failed to start workflow action %q", action.Name))
+		}
+		invocationIDs = append(invocationIDs, invocationID)
+	}
+	targetURL, err := p.ws.createBBURL(ctx, "/invocation/"+invocationIDs[0])
+	if err != nil {
+		return err
+	}
+	for _, e := range batch {
+		p.ws.createMergeQueueStatus(ctx, wf, e.CommitSHA, targetURL, "Testing...", github.PendingState)
+	}
+	return nil
+}
+
+// claimMergeQueueBatch marks the entries of a batch as being tested. It
+// returns false if any of them are no longer queued.
+func (ws *workflowService) claimMergeQueueBatch(ctx context.Context, workflowID string, batch []*tables.MergeQueueEntry, batchID string) (bool, error) {
+	numbers := make([]int64, 0, len(batch))
+	for _, e := range batch {
+		numbers = append(numbers, e.PullRequestNumber)
+	}
+	claimed := false
+	err := ws.env.GetDBHandle().Transaction(ctx, func(tx interfaces.DB) error {
+		result := tx.NewQuery(ctx, "workflow_merge_queue_claim_batch").Raw(`
+			UPDATE "MergeQueueEntries"
+			SET state = ?, batch_id = ?, updated_at_usec = ?
+			WHERE workflow_id = ? AND pull_request_number IN ? AND state = ?`,
+			int32(wfpb.MergeQueueEntry_TESTING), batchID, tx.NowFunc().UnixMicro(),
+			workflowID, numbers, int32(wfpb.MergeQueueEntry_QUEUED),
+		).Exec()
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != int64(len(batch)) {
+			// Roll back the entries that were claimed.
+			return status.AbortedError("merge queue changed")
+		}
+		claimed = true
+		return nil
+	})
+	if status.IsAbortedError(err) {
+		return false, nil
+	}
+	return claimed, err
+}
+
+// requeueBatch puts the entries of a batch that are still being tested back
+// in the queue, and deletes the batch's runs.
+func (ws *workflowService) requeueBatch(ctx context.Context, workflowID, batchID string, testAlone bool) error {
+	dbh := ws.env.GetDBHandle()
+	err := dbh.NewQuery(ctx, "workflow_merge_queue_requeue_batch").Raw(`
+		UPDATE "MergeQueueEntries"
+		SET state = ?, batch_id = '', test_alone = (test_alone OR ?), updated_at_usec = ?
+		WHERE workflow_id = ? AND batch_id = ? AND state = ?`,
+		int32(wfpb.MergeQueueEntry_QUEUED), testAlone, dbh.NowFunc().UnixMicro(),
+		workflowID, batchID, int32(wfpb.MergeQueueEntry_TESTING),
+	).Exec().Error
+	if err != nil {
+		return err
+	}
+	return ws.deleteMergeQueueRuns(ctx, batchID)
+}
+
+func (ws *workflowService) setMergeQueueEntryFailed(ctx context.Context, e *tables.MergeQueueEntry, message string) error {
+	dbh := ws.env.GetDBHandle()
+	return dbh.NewQuery(ctx, "workflow_merge_queue_set_entry_failed").Raw(`
+		UPDATE "MergeQueueEntries"
+		SET state = ?, batch_id = '', status_message = ?, updated_at_usec = ?
+		WHERE workflow_id = ? AND pull_request_number = ? AND commit_sha = ?`,
+		int32(wfpb.MergeQueueEntry_FAILED), message, dbh.NowFunc().UnixMicro(),
+		e.WorkflowID, e.PullRequestNumber, e.CommitSHA,
+	).Exec().Error
+}
+
+func (ws *workflowService) deleteMergeQueueRuns(ctx context.Context, batchID string) error {
+	return ws.env.GetDBHandle().NewQuery(ctx, "workflow_merge_queue_delete_runs").Raw(`
+		DELETE FROM "MergeQueueRuns" WHERE batch_id = ?`, batchID,
+	).Exec().Error
+}
+
+// deleteMergeQueueEntry removes a pull request from the merge queue, and
+// returns the deleted entry, or nil if the pull request wasn't queued. If the
+// pull request was being tested, the rest of its batch is requeued.
+func (ws *workflowService) deleteMergeQueueEntry(ctx context.Context, workflowID string, pullRequestNumber int64) (*tables.MergeQueueEntry, error) {
+	dbh := ws.env.GetDBHandle()
+	var deleted *tables.MergeQueueEntry
+	err := dbh.Transaction(ctx, func(tx interfaces.DB) error {
+		e := &tables.MergeQueueEntry{}
+		err := tx.NewQuery(ctx, "workflow_merge_queue_get_entry").Raw(`
+			SELECT * FROM "MergeQueueEntries"
+			WHERE workflow_id = ? AND pull_request_number = ?`+dbh.SelectForUpdateModifier(),
+			workflowID, pullRequestNumber,
+		).Take(e)
+		if db.IsRecordNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = tx.NewQuery(ctx, "workflow_merge_queue_delete_entry").Raw(`
+			DELETE FROM "MergeQueueEntries"
+			WHERE workflow_id = ? AND pull_request_number = ?`,
+			workflowID, pullRequestNumber,
+		).Exec().Error
+		if err != nil {
+			return err
+		}
+		deleted = e
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if deleted != nil && deleted.State == int32(wfpb.MergeQueueEntry_TESTING) {
+		if err := ws.requeueBatch(ctx, workflowID, deleted.BatchID, false /*=testAlone*/); err != nil {
+			return nil, err
+		}
+	}
+	return deleted, nil
+}
+
+// mergeQueueConfig returns the merge queue config on the target branch of a
+// workflow's repo.
+func (ws *workflowService) mergeQueueConfig(ctx context.Context, wf *tables.Workflow, targetBranch string) (*config.MergeQueue, error) {
+	provider, err := ws.providerForRepo(wf.RepoURL)
+	if err != nil {
+		return nil, err
+	}
+	wd := &interfaces.WebhookData{
+		EventName:     webhook_data.EventName.MergeQueue,
+		PushedRepoURL: wf.RepoURL,
+		PushedBranch:  targetBranch,
+		TargetRepoURL: wf.RepoURL,
+		TargetBranch:  targetBranch,
+	}
+	cfg, err := ws.fetchWorkflowConfig(ctx, provider, wf, wd)
+	if err != nil {
+		return nil, status.WrapError(err, "fetch workflow config")
+	}
+	if cfg.MergeQueue == nil {
+		return nil, status.FailedPreconditionErrorf("the merge queue is not configured in %s on branch %q", config.FilePath, targetBranch)
+	}
+	if err := cfg.MergeQueue.Validate(); err != nil {
+		return nil, status.InvalidArgumentError(err.Error())
+	}
+	return cfg.MergeQueue, nil
+}
+
+// handleMergeQueueEvent adds a pull request to the merge queue when it's
+// labeled with the merge queue label, and removes it when the label is
+// removed or the pull request is closed.
+func (ws *workflowService) handleMergeQueueEvent(ctx context.Context, gitProvider interfaces.GitProvider, wd *interfaces.WebhookData, wf *tables.Workflow) error {
+	if wd.EventName == webhook_data.EventName.PullRequestClosed {
+		_, err := ws.deleteMergeQueueEntry(ctx, wf.WorkflowID, wd.PullRequestNumber)
+		return err
+	}
+	cfg, err := ws.mergeQueueConfig(ctx, wf, wd.TargetBranch)
+	if status.IsFailedPreconditionError(err) {
+		// The repo doesn't use the merge queue.
+		if wd.EventName == webhook_data.EventName.PullRequestUnlabeled {
+			_, err := ws.deleteMergeQueueEntry(ctx, wf.WorkflowID, wd.PullRequestNumber)
+			return err
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if wd.PullRequestLabel != cfg.GetLabel() {
+		return nil
+	}
+	if wd.EventName == webhook_data.EventName.PullRequestUnlabeled {
+		e, err := ws.deleteMergeQueueEntry(ctx, wf.WorkflowID, wd.PullRequestNumber)
+		if err != nil {
+			return err
+		}
+		if e != nil {
+			log.CtxInfof(ctx, "Removed pull request #%d of %s from the merge queue", wd.PullRequestNumber, wf.RepoURL)
+			ws.createMergeQueueStatus(ctx, wf, e.CommitSHA, mergeQueueDocsURL, "Removed from the merge queue", github.ErrorState)
+		}
+		return nil
+	}
+
+	// Only trusted users may add pull requests to the queue, since queued pull
+	// requests are tested as trusted runs and merged automatically.
+	if wd.Sender == "" {
+		return status.FailedPreconditionErrorf("missing sender for %s event (workflow %s)", wd.EventName, wf.WorkflowID)
+	}
+	trusted, err := gitProvider.IsTrusted(ctx, wf.AccessToken, wd.TargetRepoURL, wd.Sender)
+	if err != nil {
+		return err
+	}
+	if !trusted {
+		log.CtxInfof(ctx, "Ignoring merge queue label added to pull request #%d of %s (user %q is untrusted)", wd.PullRequestNumber, wf.RepoURL, wd.Sender)
+		return nil
+	}
+	// The user vouches for the pull request as of the label, but the head of
+	// a fork can be replaced by anyone with access to the fork afterwards.
+	// Only queue the head if the fork hasn't been pushed to since.
+	if webhook_data.IsFork(wd) {
+		prwd, err := gitProvider.GetPullRequest(ctx, wf.AccessToken, wd.TargetRepoURL, wd.PullRequestNumber)
+		if err != nil {
+			return err
+		}
+		if prwd.SHA != wd.SHA || !pushedBefore(prwd, wd.PullRequestLabeledAt) {
+			log.CtxInfof(ctx, "Ignoring merge queue label added to pull request #%d of %s (fork %q was pushed to after the label)", wd.PullRequestNumber, wf.RepoURL, wd.PushedRepoURL)
+			ws.createMergeQueueStatus(ctx, wf, prwd.SHA, mergeQueueDocsURL, "Updated after the merge queue label was added, re-add the label to queue it", github.ErrorState)
+			return nil
+		}
+	}
+	if _, err := ws.deleteMergeQueueEntry(ctx, wf.WorkflowID, wd.PullRequestNumber); err != nil {
+		return err
+	}
+	e := &tables.MergeQueueEntry{
+		WorkflowID:        wf.WorkflowID,
+		PullRequestNumber: wd.PullRequestNumber,
+		GroupID:           wf.GroupID,
+		RepoURL:           wf.RepoURL,
+		TargetBranch:      wd.TargetBranch,
+		PushedRepoURL:     wd.PushedRepoURL,
+		PushedBranch:      wd.PushedBranch,
+		CommitSHA:         wd.SHA,
+		Author:            wd.PullRequestAuthor,
+		State:             int32(wfpb.MergeQueueEntry_QUEUED),
+	}
+	if err := ws.env.GetDBHandle().NewQuery(ctx, "workflow_merge_queue_create_entry").Create(e); err != nil {
+		return status.InternalErrorf("create merge queue entry: %s", err)
+	}
+	log.CtxInfof(ctx, "Added pull request #%d of %s to the merge queue of branch %q", wd.PullRequestNumber, wf.RepoURL, wd.TargetBranch)
+	ws.createMergeQueueStatus(ctx, wf, wd.SHA, mergeQueueDocsURL, "Queued...", github.PendingState)
+	return nil
+}
+
+// dequeueUpdatedPullRequest removes a pull request from the merge queue if
+// it was updated after it was queued, since the new commits haven't been
+// approved for merging.
+func (ws *workflowService) dequeueUpdatedPullRequest(ctx context.Context, wf *tables.Workflow, wd *interfaces.WebhookData) error {
+	e := &tables.MergeQueueEntry{}
+	err := ws.env.GetDBHandle().NewQuery(ctx, "workflow_merge_queue_get_pull_request_entry").Raw(`
+		SELECT * FROM "MergeQueueEntries"
+		WHERE workflow_id = ? AND pull_request_number = ?`,
+		wf.WorkflowID, wd.PullRequestNumber,
+	).Take(e)
+	if db.IsRecordNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if e.CommitSHA == wd.SHA {
+		return nil
+	}
+	if _, err := ws.deleteMergeQueueEntry(ctx, wf.WorkflowID, wd.PullRequestNumber); err != nil {
+		return err
+	}
+	log.CtxInfof(ctx, "Removed updated pull request #%d of %s from the merge queue", wd.PullRequestNumber, wf.RepoURL)
+	ws.createMergeQueueStatus(ctx, wf, wd.SHA, mergeQueueDocsURL, "Removed from the merge queue after an update, re-add the label to queue it again", github.ErrorState)
+	return nil
+}
+
+// createMergeQueueStatus reports the merge queue state of a pull request
+// commit.
+func (ws *workflowService) createMergeQueueStatus(ctx context.Context, wf *tables.Workflow, sha, targetURL, description string, state github.State) {
+	provider, err := ws.providerForRepo(wf.RepoURL)
+	if err == nil {
+		payload := github.NewGithubStatusPayload(mergeQueueStatusContext, targetURL, description, state)
+		err = provider.CreateStatus(ctx, wf.AccessToken, wf.RepoURL, sha, payload)
+	}
+	if err != nil {
+		log.CtxWarningf(ctx, "Failed to create merge queue status for %s at %s: %s", wf.RepoURL, sha, err)
+	}
+}
+
+// GetMergeQueue returns the pull requests in the merge queues of a repo.
+func (ws *workflowService) GetMergeQueue(ctx context.Context, req *wfpb.GetMergeQueueRequest) (*wfpb.GetMergeQueueResponse, error) {
+	u, err := ws.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	repoURL, err := gitutil.NormalizeRepoURL(req.GetRepoUrl())
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("invalid repo URL %q: %s", req.GetRepoUrl(), err)
+	}
+	dbh := ws.env.GetDBHandle()
+	rq := dbh.NewQuery(ctx, "workflow_merge_queue_get_repo_entries").Raw(`
+		SELECT * FROM "MergeQueueEntries"
+		WHERE group_id = ? AND repo_url = ?
+		ORDER BY target_branch, created_at_usec, pull_request_number`,
+		u.GetGroupID(), repoURL.String(),
+	)
+	rsp := &wfpb.GetMergeQueueResponse{}
+	entriesByBatch := map[string][]*wfpb.MergeQueueEntry{}
+	var batchIDs []string
+	err = db.ScanEach(rq, func(ctx context.Context, e *tables.MergeQueueEntry) error {
+		entry := &wfpb.MergeQueueEntry{
+			PullRequestNumber: e.PullRequestNumber,
+			TargetBranch:      e.TargetBranch,
+			Branch:            e.PushedBranch,
+			CommitSha:         e.CommitSHA,
+			Author:            e.Author,
+			State:             wfpb.MergeQueueEntry_State(e.State),
+			StatusMessage:     e.StatusMessage,
+			EnqueuedAtUsec:    e.CreatedAtUsec,
+		}
+		rsp.Entry = append(rsp.Entry, entry)
+		if e.BatchID != "" {
+			if _, ok := entriesByBatch[e.BatchID]; !ok {
+				batchIDs = append(batchIDs, e.BatchID)
+			}
+			entriesByBatch[e.BatchID] = append(entriesByBatch[e.BatchID], entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, status.InternalErrorf("get merge queue entries: %s", err)
+	}
+	if len(batchIDs) == 0 {
+		return rsp, nil
+	}
+	rq = dbh.NewQuery(ctx, "workflow_merge_queue_get_repo_runs").Raw(`
+		SELECT * FROM "MergeQueueRuns" WHERE batch_id IN ? ORDER BY action_name`,
+		batchIDs,
+	)
+	err = db.ScanEach(rq, func(ctx context.Context, r *tables.MergeQueueRun) error {
+		for _, entry := range entriesByBatch[r.BatchID] {
+			entry.InvocationId = append(entry.InvocationId, r.InvocationID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, status.InternalErrorf("get merge queue runs: %s", err)
+	}
+	return rsp, nil
+}
+
+// isMergeQueueEvent returns whether the event only affects the merge queue,
+// rather than triggering workflow actions.
+func isMergeQueueEvent(eventName string) bool {
+	switch eventName {
+	case webhook_data.EventName.PullRequestLabeled, webhook_data.EventName.PullRequestUnlabeled, webhook_data.EventName.PullRequestClosed:
+		return true
+	}
+	return false
+}
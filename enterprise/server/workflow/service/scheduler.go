@@ -0,0 +1,363 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/cron"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/redisutil"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/webhook_data"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/workflow/config"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"gorm.io/gorm/clause"
+
+	guuid "github.com/google/uuid"
+)
+
+var (
+	enableSchedules = flag.Bool("remote_execution.workflows_enable_schedules", false, "Whether to run workflow actions that have schedule triggers.")
+)
+
+const (
+	// How often to check for scheduled workflow actions that are due.
+	schedulePollInterval = time.Minute
+
+	// How long to use a repo's workflow config for scheduling before fetching
+	// it again, to avoid fetching every repo's config on every poll.
+	scheduleConfigTTL = 10 * time.Minute
+
+	// Scheduled runs that are due for longer than this are considered missed,
+	// and only run if the schedule has catch_up enabled.
+	maxScheduledRunDelay = 10 * time.Minute
+
+	// Upper bound on the number of missed activations to step through when
+	// looking for the most recent one. If there are more, the remaining ones
+	// are stepped through on the next poll.
+	maxMissedActivations = 100_000
+
+	// The ref that schedules are read from: the repo's default branch.
+	scheduleConfigRef = "HEAD"
+
+	// Key used to make sure that only one app polls the schedules at a time.
+	// The lock only reduces the load on Git providers; scheduled runs are
+	// claimed in the DB, so they are only started once even without it.
+	scheduleRedisLockKey = "lock.workflow_scheduler"
+
+	// How long a poll may hold the lock for.
+	scheduleRedisLockExpiry = 5 * time.Minute
+)
+
+type cachedScheduleConfig struct {
+	config    *config.BuildBuddyConfig
+	fetchedAt time.Time
+}
+
+// workflowScheduler starts the workflow actions that have schedule triggers
+// in the buildbuddy.yaml on the default branch of their repo.
+type workflowScheduler struct {
+	ws   *workflowService
+	lock interfaces.DistributedLock
+	quit chan struct{}
+	done chan struct{}
+
+	mu      sync.Mutex
+	configs map[string]*cachedScheduleConfig
+}
+
+func newWorkflowScheduler(ws *workflowService) *workflowScheduler {
+	var lock interfaces.DistributedLock
+	if rdb := ws.env.GetDefaultRedisClient(); rdb != nil {
+		l, err := redisutil.NewWeakLock(rdb, scheduleRedisLockKey, scheduleRedisLockExpiry)
+		if err != nil {
+			log.Warningf("Failed to create workflow scheduler lock, schedules will be polled by every app: %s", err)
+		} else {
+			lock = l
+		}
+	}
+	return &workflowScheduler{
+		ws:      ws,
+		lock:    lock,
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+		configs: map[string]*cachedScheduleConfig{},
+	}
+}
+
+// start polls the schedules until the server shuts down.
+func (s *workflowScheduler) start() {
+	env := s.ws.env
+	go func() {
+		defer close(s.done)
+		ticker := env.GetClock().NewTicker(schedulePollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.quit:
+				return
+			case <-ticker.Chan():
+			}
+			if err := s.run(env.GetServerContext()); err != nil {
+				log.Warningf("Failed to run scheduled workflows: %s", err)
+			}
+		}
+	}()
+	env.GetHealthChecker().RegisterShutdownFunction(func(ctx context.Context) error {
+		close(s.quit)
+		<-s.done
+		return nil
+	})
+}
+
+// RunSchedules starts the scheduled workflow actions that are due. It is
+// called periodically if remote_execution.workflows_enable_schedules is set.
+func (ws *workflowService) RunSchedules(ctx context.Context) error {
+	if ws.env.GetDBHandle() == nil {
+		return status.FailedPreconditionError("database not configured")
+	}
+	return ws.scheduler.run(ctx)
+}
+
+func (s *workflowScheduler) run(ctx context.Context) error {
+	if s.lock != nil {
+		err := s.lock.Lock(ctx)
+		if status.IsResourceExhaustedError(err) {
+			// Another app is already polling the schedules.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := s.lock.Unlock(ctx); err != nil {
+				log.Warningf("Failed to unlock distributed lock: %s", err)
+			}
+		}()
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, scheduleRedisLockExpiry)
+		defer cancel()
+	}
+
+	workflows, err := s.scheduledWorkflows(ctx)
+	if err != nil {
+		return err
+	}
+	for _, wf := range workflows {
+		if err := s.runWorkflowSchedules(ctx, wf); err != nil {
+			log.CtxWarningf(ctx, "Failed to run schedules for workflow %s (%s): %s", wf.WorkflowID, wf.RepoURL, err)
+		}
+	}
+	return nil
+}
+
+// scheduledWorkflows returns the legacy workflows and the workflows of the
+// GitRepositories that don't have their schedules disabled. Repository
+// workflows don't have an access token yet; it's fetched when needed.
+func (s *workflowScheduler) scheduledWorkflows(ctx context.Context) ([]*tables.Workflow, error) {
+	dbh := s.ws.env.GetDBHandle()
+	var workflows []*tables.Workflow
+	rq := dbh.NewQuery(ctx, "workflow_scheduler_get_workflows").Raw(`
+		SELECT * FROM "Workflows" WHERE schedules_disabled = ?`, false)
+	err := db.ScanEach(rq, func(ctx context.Context, wf *tables.Workflow) error {
+		workflows = append(workflows, wf)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if s.ws.env.GetGitHubApp() == nil {
+		return workflows, nil
+	}
+	rq = dbh.NewQuery(ctx, "workflow_scheduler_get_repos").Raw(`
+		SELECT * FROM "GitRepositories" WHERE schedules_disabled = ?`, false)
+	err = db.ScanEach(rq, func(ctx context.Context, repo *tables.GitRepository) error {
+		workflows = append(workflows, s.ws.gitRepositoryWorkflow(repo, "" /*=accessToken*/).Workflow)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return workflows, nil
+}
+
+func (s *workflowScheduler) accessToken(ctx context.Context, wf *tables.Workflow) error {
+	if wf.GitRepository == nil || wf.AccessToken != "" {
+		return nil
+	}
+	token, err := s.ws.env.GetGitHubApp().GetRepositoryInstallationToken(ctx, wf.GitRepository)
+	if err != nil {
+		return err
+	}
+	wf.AccessToken = token
+	return nil
+}
+
+// workflowConfig returns the workflow config on the default branch of the
+// workflow's repo, fetching it if the cached config is stale.
+func (s *workflowScheduler) workflowConfig(ctx context.Context, wf *tables.Workflow) (*config.BuildBuddyConfig, error) {
+	now := s.ws.env.GetClock().Now()
+	s.mu.Lock()
+	cached, ok := s.configs[wf.WorkflowID]
+	s.mu.Unlock()
+	if ok && now.Sub(cached.fetchedAt) < scheduleConfigTTL {
+		return cached.config, nil
+	}
+
+	if err := s.accessToken(ctx, wf); err != nil {
+		return nil, err
+	}
+	provider, err := s.ws.providerForRepo(wf.RepoURL)
+	if err != nil {
+		return nil, err
+	}
+	wd := &interfaces.WebhookData{
+		EventName:     webhook_data.EventName.Schedule,
+		PushedRepoURL: wf.RepoURL,
+		PushedBranch:  scheduleConfigRef,
+		TargetRepoURL: wf.RepoURL,
+	}
+	cfg, err := s.ws.fetchWorkflowConfig(ctx, provider, wf, wd)
+	if err != nil {
+		return nil, status.WrapError(err, "fetch workflow config")
+	}
+	s.mu.Lock()
+	s.configs[wf.WorkflowID] = &cachedScheduleConfig{config: cfg, fetchedAt: now}
+	s.mu.Unlock()
+	return cfg, nil
+}
+
+func (s *workflowScheduler) runWorkflowSchedules(ctx context.Context, wf *tables.Workflow) error {
+	cfg, err := s.workflowConfig(ctx, wf)
+	if err != nil {
+		return err
+	}
+	for _, action := range cfg.Actions {
+		for _, trigger := range action.GetTriggers().Schedule {
+			if err := s.runSchedule(ctx, wf, action, trigger); err != nil {
+				log.CtxWarningf(ctx, "Failed to run schedule %q of workflow action %q (%s): %s", trigger.Cron, action.Name, wf.RepoURL, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *workflowScheduler) runSchedule(ctx context.Context, wf *tables.Workflow, action *config.Action, trigger *config.ScheduleTrigger) error {
+	schedule, loc, err := trigger.Parse()
+	if err != nil {
+		return status.InvalidArgumentErrorf("invalid schedule: %s", err)
+	}
+	key := scheduleKey(action, trigger)
+	now := s.ws.env.GetClock().Now()
+
+	row := &tables.WorkflowSchedule{}
+	err = s.ws.env.GetDBHandle().NewQuery(ctx, "workflow_scheduler_get_schedule").Raw(`
+		SELECT * FROM "WorkflowSchedules" WHERE workflow_id = ? AND schedule_key = ?`,
+		wf.WorkflowID, key,
+	).Take(row)
+	if db.IsRecordNotFound(err) {
+		// New schedules start now, rather than running for past activations.
+		row = &tables.WorkflowSchedule{
+			WorkflowID:  wf.WorkflowID,
+			ScheduleKey: key,
+			LastRunUsec: now.UnixMicro(),
+		}
+		return s.ws.env.GetDBHandle().GORM(ctx, "workflow_scheduler_create_schedule").Clauses(clause.OnConflict{DoNothing: true}).Create(row).Error
+	}
+	if err != nil {
+		return err
+	}
+
+	// Delay each run by a consistent fraction of the jitter.
+	delay := jitterDelay(wf.WorkflowID+key, trigger.GetJitter())
+	last := time.UnixMicro(row.LastRunUsec).In(loc)
+	latest := latestActivation(schedule, last, now.Add(-delay))
+	if latest.IsZero() {
+		return nil
+	}
+	start := trigger.CatchUp || now.Sub(latest.Add(delay)) <= maxScheduledRunDelay
+
+	// Claim the run, so that it's only started once even if the schedules
+	// are polled by multiple apps at the same time.
+	result := s.ws.env.GetDBHandle().NewQuery(ctx, "workflow_scheduler_update_schedule").Raw(`
+		UPDATE "WorkflowSchedules"
+		SET last_run_usec = ?
+		WHERE workflow_id = ? AND schedule_key = ? AND last_run_usec = ?`,
+		latest.UnixMicro(), wf.WorkflowID, key, row.LastRunUsec,
+	).Exec()
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil
+	}
+	if !start {
+		log.CtxInfof(ctx, "Skipping missed scheduled run of workflow action %q (%s) at %s", action.Name, wf.RepoURL, latest)
+		return nil
+	}
+	return s.startScheduledRun(ctx, wf, action, trigger)
+}
+
+func (s *workflowScheduler) startScheduledRun(ctx context.Context, wf *tables.Workflow, action *config.Action, trigger *config.ScheduleTrigger) error {
+	if err := s.accessToken(ctx, wf); err != nil {
+		return err
+	}
+	apiKey, err := s.ws.apiKeyForWorkflow(ctx, wf)
+	if err != nil {
+		return err
+	}
+	wd := &interfaces.WebhookData{
+		EventName:     webhook_data.EventName.Schedule,
+		PushedRepoURL: wf.RepoURL,
+		PushedBranch:  trigger.Branch,
+		TargetRepoURL: wf.RepoURL,
+		TargetBranch:  trigger.Branch,
+	}
+	invocationUUID, err := guuid.NewRandom()
+	if err != nil {
+		return status.InternalErrorf("failed to generate invocation ID: %s", err)
+	}
+	invocationID := invocationUUID.String()
+	ctx = log.EnrichContext(ctx, log.InvocationIDKey, invocationID)
+	// Scheduled runs are trusted, since they run a branch of the repo itself.
+	isTrusted := true
+	start := func(ctx context.Context) (string, error) {
+		return s.ws.executeWorkflowAction(ctx, apiKey, wf, wd, isTrusted, action, invocationID, nil /*=extraCIRunnerArgs*/, nil /*=env*/)
+	}
+	_, err = s.ws.runWorkflowAction(ctx, apiKey, wf, wd, action, invocationID, start)
+	return err
+}
+
+// scheduleKey returns the key that identifies a schedule of an action.
+func scheduleKey(action *config.Action, trigger *config.ScheduleTrigger) string {
+	parts := []string{action.Name, trigger.Cron, trigger.Timezone, trigger.Branch}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Join(parts, "\x00"))))
+}
+
+// jitterDelay returns a delay in [0, jitter) that is consistent for the given
+// key.
+func jitterDelay(key string, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return 0
+	}
+	h := sha256.Sum256([]byte(key))
+	return time.Duration(binary.BigEndian.Uint64(h[:8]) % uint64(jitter))
+}
+
+// latestActivation returns the most recent activation of the schedule that is
+// after last and not after now, or the zero time if there is none.
+func latestActivation(schedule *cron.Schedule, last, now time.Time) time.Time {
+	var latest time.Time
+	for i, t := 0, schedule.Next(last); i < maxMissedActivations && !t.IsZero() && !t.After(now); i, t = i+1, schedule.Next(t) {
+		latest = t
+	}
+	return latest
+}
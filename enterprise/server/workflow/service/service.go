@@ -73,6 +73,7 @@ var (
 	workflowsLinuxComputeUnits    = flag.Int("remote_execution.workflows_linux_compute_units", 3, "Number of BuildBuddy compute units (BCU) to reserve for Linux workflow actions.")
 	workflowsMacComputeUnits      = flag.Int("remote_execution.workflows_mac_compute_units", 3, "Number of BuildBuddy compute units (BCU) to reserve for Mac workflow actions.")
 	enableKytheIndexing           = flag.Bool("remote_execution.enable_kythe_indexing", false, "If set, and codesearch is enabled, automatically run a kythe indexing action.")
+	untrustedNetworkPolicy        = flag.String("remote_execution.workflows_untrusted_network_policy", platform.InternalOnlyNetworkPolicy, "The network-policy property to use for workflow actions at untrusted commits, such as pull requests from forks. Restricted policies are only enforced with OCI isolation, so untrusted actions run with OCI isolation, and fail to start if they would run with Firecracker. Set to \"full\" to not restrict their network.")
 	workflowURLMatcher            = regexp.MustCompile(`^.*/webhooks/workflow/(?P<instance_name>.*)$`)
 
 	// ApprovalRequired is an error indicating that a workflow action could not be
@@ -155,9 +156,18 @@ type startWorkflowTask struct {
 type workflowService struct {
 	env environment.Env
 
-	wg    sync.WaitGroup
-	tasks chan *startWorkflowTask
-	bbUrl *url.URL
+	wg         sync.WaitGroup
+	tasks      chan *startWorkflowTask
+	bbUrl      *url.URL
+	scheduler  *workflowScheduler
+	mergeQueue *mergeQueueProcessor
+	matrix     *matrixProcessor
+	artifacts  *artifactJanitor
+
+	// Runs that are queued behind the in-progress runs of their concurrency
+	// group. They stop waiting when quit is closed.
+	queuedRuns sync.WaitGroup
+	quit       chan struct{}
 }
 
 func NewWorkflowService(env environment.Env) *workflowService {
@@ -165,8 +175,25 @@ func NewWorkflowService(env environment.Env) *workflowService {
 		env:   env,
 		tasks: make(chan *startWorkflowTask, webhookWorkerTaskQueueSize),
 		bbUrl: build_buddy_url.WithPath(""),
+		quit:  make(chan struct{}),
 	}
 	ws.startBackgroundWorkers()
+	ws.scheduler = newWorkflowScheduler(ws)
+	if *enableSchedules {
+		ws.scheduler.start()
+	}
+	ws.mergeQueue = newMergeQueueProcessor(ws)
+	if *enableMergeQueue {
+		ws.mergeQueue.start()
+	}
+	ws.matrix = newMatrixProcessor(ws)
+	if *reportMatrixSummaries {
+		ws.matrix.start()
+	}
+	ws.artifacts = newArtifactJanitor(ws)
+	if *artifactTTL > 0 {
+		ws.artifacts.start()
+	}
 	return ws
 }
 
@@ -193,6 +220,10 @@ func (ws *workflowService) startBackgroundWorkers() {
 		close(ws.tasks)
 		// Wait for all workers to exit.
 		ws.wg.Wait()
+		// No more runs can be queued now, so stop the queued runs from
+		// waiting. They're superseded by the next run in their group.
+		close(ws.quit)
+		ws.queuedRuns.Wait()
 		return nil
 	})
 }
@@ -316,18 +347,29 @@ func (ws *workflowService) CreateWorkflow(ctx context.Context, req *wfpb.CreateW
 		return nil, status.InternalError(err.Error())
 	}
 
+	workflowID, err := tables.PrimaryKeyForTable("Workflows")
+	if err != nil {
+		return nil, status.InternalError(err.Error())
+	}
 	rsp := &wfpb.CreateWorkflowResponse{}
 
-	providerWebhookID, err := provider.RegisterWebhook(ctx, accessToken, repoURL, webhookURL)
+	var webhookSecret, encryptedWebhookSecret string
+	if webhookSecretsEnabled() {
+		webhookSecret, encryptedWebhookSecret, err = newWebhookSecret(ws.env, workflowID)
+		if err != nil {
+			return nil, err
+		}
+		rsp.WebhookSecret = webhookSecret
+	} else if *requireWebhookSignatures {
+		return nil, status.FailedPreconditionError("Webhook signatures are required, but webhook secrets are not enabled.")
+	}
+
+	providerWebhookID, err := provider.RegisterWebhook(ctx, accessToken, repoURL, webhookURL, webhookSecret)
 	if err != nil {
 		log.CtxWarningf(ctx, "Failed to register webhook with git provider: %s", err)
 	}
 	rsp.WebhookRegistered = (providerWebhookID != "")
 
-	workflowID, err := tables.PrimaryKeyForTable("Workflows")
-	if err != nil {
-		return nil, status.InternalError(err.Error())
-	}
 	rsp.Id = workflowID
 	rsp.WebhookUrl = webhookURL
 	wf := &tables.Workflow{
@@ -340,6 +382,7 @@ func (ws *workflowService) CreateWorkflow(ctx context.Context, req *wfpb.CreateW
 		Username:             username,
 		AccessToken:          accessToken,
 		WebhookID:            webhookID,
+		WebhookSecret:        encryptedWebhookSecret,
 		GitProviderWebhookID: providerWebhookID,
 	}
 	err = ws.env.GetDBHandle().NewQuery(ctx, "workflow_service_insert_workflow").Create(wf)
@@ -402,6 +445,88 @@ func (ws *workflowService) DeleteWorkflow(ctx context.Context, req *wfpb.DeleteW
 	return &wfpb.DeleteWorkflowResponse{}, nil
 }
 
+// RotateWebhookSecret sets a new webhook secret for an existing workflow, such
+// as one that was created before webhook secrets were enabled, or one whose
+// secret was leaked. If the workflow's webhook was registered by the server,
+// it's re-registered with the new secret.
+func (ws *workflowService) RotateWebhookSecret(ctx context.Context, req *wfpb.RotateWorkflowWebhookSecretRequest) (*wfpb.RotateWorkflowWebhookSecretResponse, error) {
+	if err := ws.checkPreconditions(ctx); err != nil {
+		return nil, err
+	}
+	if req.GetId() == "" {
+		return nil, status.InvalidArgumentError("An ID is required to rotate a workflow's webhook secret.")
+	}
+	if !webhookSecretsEnabled() {
+		return nil, status.FailedPreconditionError("Webhook secrets are not enabled.")
+	}
+	authenticatedUser, err := ws.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	wf := &tables.Workflow{}
+	err = ws.env.GetDBHandle().NewQuery(ctx, "workflow_service_get_for_rotate_webhook_secret").Raw(
+		`SELECT * FROM "Workflows" WHERE workflow_id = ?`, req.GetId()).Take(wf)
+	if err != nil {
+		if db.IsRecordNotFound(err) {
+			return nil, status.NotFoundErrorf("Workflow %q not found", req.GetId())
+		}
+		return nil, err
+	}
+	acl := perms.ToACLProto(&uidpb.UserId{Id: wf.UserID}, wf.GroupID, wf.Perms)
+	if err := perms.AuthorizeWrite(&authenticatedUser, acl); err != nil {
+		return nil, err
+	}
+
+	webhookSecret, encryptedWebhookSecret, err := newWebhookSecret(ws.env, wf.WorkflowID)
+	if err != nil {
+		return nil, err
+	}
+	rsp := &wfpb.RotateWorkflowWebhookSecretResponse{WebhookSecret: webhookSecret}
+
+	// Providers don't let the secret of a registered webhook be changed, so
+	// replace the webhook. Git providers may reject a second webhook with the
+	// same URL, so the old one is removed first.
+	providerWebhookID := wf.GitProviderWebhookID
+	if providerWebhookID != "" {
+		providerWebhookID, err = ws.reregisterWebhook(ctx, wf, webhookSecret)
+		if err != nil {
+			log.CtxWarningf(ctx, "Failed to re-register webhook of workflow %q with its new secret: %s", wf.WorkflowID, err)
+		}
+		rsp.WebhookRegistered = err == nil
+	}
+
+	err = ws.env.GetDBHandle().NewQuery(ctx, "workflow_service_rotate_webhook_secret").Raw(
+		`UPDATE "Workflows" SET webhook_secret = ?, git_provider_webhook_id = ? WHERE workflow_id = ?`,
+		encryptedWebhookSecret, providerWebhookID, wf.WorkflowID).Exec().Error
+	if err != nil {
+		return nil, err
+	}
+	return rsp, nil
+}
+
+// reregisterWebhook replaces the webhook that the server registered for the
+// workflow with one that uses the given secret, and returns the provider's ID
+// for the new webhook. On error, it returns the ID of the webhook that is
+// still registered, if any.
+func (ws *workflowService) reregisterWebhook(ctx context.Context, wf *tables.Workflow, secret string) (string, error) {
+	provider, err := ws.providerForRepo(wf.RepoURL)
+	if err != nil {
+		return wf.GitProviderWebhookID, err
+	}
+	webhookURL, err := ws.getWebhookURL(wf.WebhookID)
+	if err != nil {
+		return wf.GitProviderWebhookID, err
+	}
+	if err := provider.UnregisterWebhook(ctx, wf.AccessToken, wf.RepoURL, wf.GitProviderWebhookID); err != nil {
+		return wf.GitProviderWebhookID, status.WrapError(err, "unregister webhook")
+	}
+	providerWebhookID, err := provider.RegisterWebhook(ctx, wf.AccessToken, wf.RepoURL, webhookURL, secret)
+	if err != nil {
+		return "", status.WrapError(err, "register webhook")
+	}
+	return providerWebhookID, nil
+}
+
 func (ws *workflowService) GetLinkedWorkflows(ctx context.Context, accessToken string) ([]string, error) {
 	q, args := query_builder.
 		NewQuery(`SELECT workflow_id FROM "Workflows"`).
@@ -568,16 +693,21 @@ func (ws *workflowService) ExecuteWorkflow(ctx context.Context, req *wfpb.Execut
 			// The workflow execution is trusted since we're authenticated as a member of
 			// the BuildBuddy org that owns the workflow.
 			isTrusted := true
-			executionID, err := ws.executeWorkflowAction(executionCtx, apiKey, wf, wd, isTrusted, action, invocationID, extraCIRunnerArgs, req.GetEnv())
+			start := func(ctx context.Context) (string, error) {
+				return ws.executeWorkflowAction(ctx, apiKey, wf, wd, isTrusted, action, invocationID, extraCIRunnerArgs, req.GetEnv())
+			}
+			executionID, err := ws.runWorkflowAction(executionCtx, apiKey, wf, wd, action, invocationID, start)
 			if err != nil {
 				statusErr = status.WrapErrorf(err, "failed to execute workflow action %q", action.Name)
 				log.CtxWarning(executionCtx, statusErr.Error())
 				return
 			}
-			executionCtx = log.EnrichContext(executionCtx, log.ExecutionIDKey, executionID)
-			if req.GetAsync() {
+			// Runs that are queued behind their concurrency group can't be
+			// waited for.
+			if req.GetAsync() || executionID == "" {
 				return
 			}
+			executionCtx = log.EnrichContext(executionCtx, log.ExecutionIDKey, executionID)
 			if err := ws.waitForWorkflowInvocationCreated(executionCtx, executionID, invocationID); err != nil {
 				statusErr = err
 				log.CtxWarning(executionCtx, statusErr.Error())
@@ -592,6 +722,81 @@ func (ws *workflowService) ExecuteWorkflow(ctx context.Context, req *wfpb.Execut
 	}, nil
 }
 
+// DispatchWorkflowAction runs an action that has a dispatch trigger, with the
+// inputs in the request passed to it as env vars.
+func (ws *workflowService) DispatchWorkflowAction(ctx context.Context, req *wfpb.DispatchWorkflowActionRequest) (*wfpb.DispatchWorkflowActionResponse, error) {
+	if req.GetWorkflowId() == "" {
+		return nil, status.InvalidArgumentError("Missing workflow_id")
+	}
+	if req.GetActionName() == "" {
+		return nil, status.InvalidArgumentError("Missing action_name")
+	}
+	if req.GetBranch() == "" {
+		return nil, status.InvalidArgumentError("Missing branch")
+	}
+
+	user, err := ws.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	wf, err := ws.getWorkflowByID(ctx, req.GetWorkflowId())
+	if err != nil {
+		return nil, err
+	}
+	wfACL := perms.ToACLProto(&uidpb.UserId{Id: wf.GroupID}, wf.GroupID, wf.Perms)
+	if err := perms.AuthorizeRead(user, wfACL); err != nil {
+		return nil, err
+	}
+
+	wd := &interfaces.WebhookData{
+		EventName:     webhook_data.EventName.ManualDispatch,
+		PushedRepoURL: wf.RepoURL,
+		PushedBranch:  req.GetBranch(),
+		TargetRepoURL: wf.RepoURL,
+		TargetBranch:  req.GetBranch(),
+		SHA:           req.GetCommitSha(),
+	}
+	actions, err := ws.getActions(ctx, wf, wd, []string{req.GetActionName()})
+	if err != nil {
+		return nil, err
+	}
+	action := actions[0]
+	if action.MatrixParent() != nil && action.Name != req.GetActionName() {
+		return nil, status.FailedPreconditionErrorf("workflow action %q is a matrix, dispatch one of its combinations instead, such as %q", req.GetActionName(), action.Name)
+	}
+	dispatch := action.GetTriggers().Dispatch
+	if dispatch == nil {
+		return nil, status.FailedPreconditionErrorf("workflow action %q does not have a dispatch trigger", action.Name)
+	}
+	env, err := dispatch.ResolveInputs(req.GetInputs())
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("invalid inputs for workflow action %q: %s", action.Name, err)
+	}
+	apiKey, err := ws.apiKeyForWorkflow(ctx, wf)
+	if err != nil {
+		return nil, err
+	}
+
+	invocationUUID, err := guuid.NewRandom()
+	if err != nil {
+		return nil, status.InternalErrorf("failed to generate invocation ID: %s", err)
+	}
+	invocationID := invocationUUID.String()
+	ctx = log.EnrichContext(ctx, log.InvocationIDKey, invocationID)
+	log.CtxInfof(ctx, "Workflow action %q (%s) dispatched on branch %q by user %q (API key %q)", action.Name, wf.RepoURL, req.GetBranch(), user.GetUserID(), user.GetAPIKeyID())
+
+	// The execution is trusted since we're authenticated as a member of the
+	// BuildBuddy org that owns the workflow.
+	isTrusted := true
+	start := func(ctx context.Context) (string, error) {
+		return ws.executeWorkflowAction(ctx, apiKey, wf, wd, isTrusted, action, invocationID, nil /*=extraCIRunnerArgs*/, env)
+	}
+	if _, err := ws.runWorkflowAction(ctx, apiKey, wf, wd, action, invocationID, start); err != nil {
+		return nil, status.WrapErrorf(err, "failed to execute workflow action %q", action.Name)
+	}
+	return &wfpb.DispatchWorkflowActionResponse{InvocationId: invocationID}, nil
+}
+
 // getActions fetches the workflow config (buildbuddy.yaml) and returns the list of
 // actions matching the webhook event
 func (ws *workflowService) getActions(ctx context.Context, wf *tables.Workflow, wd *interfaces.WebhookData, actionFilter []string) ([]*config.Action, error) {
@@ -609,9 +814,22 @@ func (ws *workflowService) getActions(ctx context.Context, wf *tables.Workflow,
 	for _, a := range cfg.Actions {
 		matchesActionName := len(actionFilter) == 0 || config.MatchesAnyActionName(a, actionFilter)
 		matchesTrigger := config.MatchesAnyTrigger(a, wd.EventName, wd.TargetBranch)
-		if matchesActionName && matchesTrigger {
-			actions = append(actions, a)
+		if !matchesActionName || !matchesTrigger {
+			continue
+		}
+		// If the webhook reported the changed files, skip actions whose path
+		// filters don't match any of them. Otherwise the CI runner computes
+		// the changed files itself.
+		if f := config.GetPathFilter(a, wd.EventName); f != nil && wd.ChangedFiles != nil {
+			matches, err := f.MatchesChangedFiles(wd.ChangedFiles)
+			if err != nil {
+				log.CtxWarningf(ctx, "Failed to evaluate path filters for action %q: %s", a.Name, err)
+			} else if !matches {
+				log.CtxInfof(ctx, "Skipping action %q: no changed files match its path filters", a.Name)
+				continue
+			}
 		}
+		actions = append(actions, a)
 	}
 	if len(actions) == 0 {
 		if len(actionFilter) == 0 {
@@ -687,6 +905,73 @@ func (ws *workflowService) InvalidateAllSnapshotsForRepo(ctx context.Context, re
 	return err
 }
 
+// SetSchedulesEnabled enables or disables the scheduled workflow actions of
+// the repo, for both the GitRepository and any legacy workflows of the repo.
+func (ws *workflowService) SetSchedulesEnabled(ctx context.Context, repoURL string, enabled bool) error {
+	u, err := ws.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return err
+	}
+	normalizedURL, err := gitutil.NormalizeRepoURL(repoURL)
+	if err != nil {
+		return status.InvalidArgumentErrorf("invalid repo URL %q: %s", repoURL, err)
+	}
+	repoURL = normalizedURL.String()
+
+	log.CtxInfof(ctx, "Workflow schedules enabled=%t for repo %q (group %s)", enabled, repoURL, u.GetGroupID())
+	return ws.env.GetDBHandle().Transaction(ctx, func(tx interfaces.DB) error {
+		err := tx.NewQuery(ctx, "workflow_service_set_repo_schedules_disabled").Raw(`
+			UPDATE "GitRepositories"
+			SET schedules_disabled = ?
+			WHERE group_id = ? AND repo_url = ?`,
+			!enabled, u.GetGroupID(), repoURL,
+		).Exec().Error
+		if err != nil {
+			return err
+		}
+		return tx.NewQuery(ctx, "workflow_service_set_workflow_schedules_disabled").Raw(`
+			UPDATE "Workflows"
+			SET schedules_disabled = ?
+			WHERE group_id = ? AND repo_url = ?`,
+			!enabled, u.GetGroupID(), repoURL,
+		).Exec().Error
+	})
+}
+
+// SetForkApprovalRequired sets whether pull requests from untrusted forks of
+// the repo must be approved before any workflow actions run, for both the
+// GitRepository and any legacy workflows of the repo.
+func (ws *workflowService) SetForkApprovalRequired(ctx context.Context, repoURL string, required bool) error {
+	u, err := ws.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return err
+	}
+	normalizedURL, err := gitutil.NormalizeRepoURL(repoURL)
+	if err != nil {
+		return status.InvalidArgumentErrorf("invalid repo URL %q: %s", repoURL, err)
+	}
+	repoURL = normalizedURL.String()
+
+	log.CtxInfof(ctx, "Workflow fork approval required=%t for repo %q (group %s)", required, repoURL, u.GetGroupID())
+	return ws.env.GetDBHandle().Transaction(ctx, func(tx interfaces.DB) error {
+		err := tx.NewQuery(ctx, "workflow_service_set_repo_fork_approval_required").Raw(`
+			UPDATE "GitRepositories"
+			SET fork_approval_required = ?
+			WHERE group_id = ? AND repo_url = ?`,
+			required, u.GetGroupID(), repoURL,
+		).Exec().Error
+		if err != nil {
+			return err
+		}
+		return tx.NewQuery(ctx, "workflow_service_set_workflow_fork_approval_required").Raw(`
+			UPDATE "Workflows"
+			SET fork_approval_required = ?
+			WHERE group_id = ? AND repo_url = ?`,
+			required, u.GetGroupID(), repoURL,
+		).Exec().Error
+	})
+}
+
 func (ws *workflowService) addKytheActionIfEnabled(ctx context.Context, c *config.BuildBuddyConfig, workflow *tables.Workflow, wd *interfaces.WebhookData) error {
 	enableKythe, err := ws.enableExtraKytheIndexingAction(ctx, workflow.GroupID)
 	if err != nil {
@@ -1114,9 +1399,23 @@ func (ws *workflowService) createActionForWorkflow(ctx context.Context, wf *tabl
 			envVars = append(envVars, &repb.Command_EnvironmentVariable{Name: "WORKDIR_OVERRIDE", Value: wd})
 		}
 	}
-	if os == platform.DarwinOperatingSystemName && !isTrusted {
+	// Untrusted commits can't run on Mac runners, which can't be isolated
+	// from each other, and never run if the repo requires approval for forks.
+	if !isTrusted && (os == platform.DarwinOperatingSystemName || forkApprovalRequired(wf)) {
 		return nil, ApprovalRequired
 	}
+	// Untrusted commits run with a restricted network, which is only enforced
+	// with OCI isolation.
+	networkPolicy := ""
+	if !isTrusted && *untrustedNetworkPolicy != "" && *untrustedNetworkPolicy != platform.FullNetworkPolicy {
+		networkPolicy = *untrustedNetworkPolicy
+		if isolationType == "" {
+			isolationType = string(platform.OCIContainerType)
+		}
+		if isolationType != string(platform.OCIContainerType) {
+			return nil, status.FailedPreconditionErrorf("workflow actions at untrusted commits must run with network policy %q, which %q isolation can't enforce", networkPolicy, isolationType)
+		}
+	}
 	// Make the "outer" workflow invocation public if the target repo is public,
 	// so that workflow commit status details can be seen by contributors.
 	visibility := ""
@@ -1194,6 +1493,9 @@ func (ws *workflowService) createActionForWorkflow(ctx context.Context, wf *tabl
 	for _, path := range workflowAction.GitCleanExclude {
 		args = append(args, "--git_clean_exclude="+path)
 	}
+	if config.GetPathFilter(workflowAction, wd.EventName) != nil && wd.ChangedFiles == nil {
+		args = append(args, "--filter_changed_paths", "--changed_files_base_sha="+wd.BaseSHA)
+	}
 	args = append(args, extraArgs...)
 
 	cmd := &repb.Command{
@@ -1232,6 +1534,13 @@ func (ws *workflowService) createActionForWorkflow(ctx context.Context, wf *tabl
 		}...)
 	}
 
+	if networkPolicy != "" {
+		cmd.Platform.Properties = append(cmd.Platform.Properties, &repb.Platform_Property{
+			Name:  platform.NetworkPolicyPropertyName,
+			Value: networkPolicy,
+		})
+	}
+
 	if isSharedFirecrackerWorkflow {
 		// For firecracker workflows, init dockerd in case local actions or
 		// setup scripts want to use it.
@@ -1372,7 +1681,7 @@ func (ws *workflowService) fetchWorkflowConfig(ctx context.Context, gitProvider
 func (ws *workflowService) isTrustedCommit(ctx context.Context, gitProvider interfaces.GitProvider, wf *tables.Workflow, wd *interfaces.WebhookData) (bool, error) {
 	// If the commit was pushed directly to the target repo then the commit must
 	// already be trusted.
-	if !isFork(wd) {
+	if !webhook_data.IsFork(wd) && !wd.IsUploadedForReview {
 		return true, nil
 	}
 	if wd.PullRequestAuthor == "" {
@@ -1400,6 +1709,13 @@ func (ws *workflowService) startLegacyWorkflow(ctx context.Context, webhookID st
 	if err != nil {
 		return err
 	}
+	wf, err := ws.readWorkflowForWebhook(ctx, webhookID)
+	if err != nil {
+		return status.WrapErrorf(err, "failed to lookup workflow for webhook ID %q", webhookID)
+	}
+	if err := ws.verifyWebhookSignature(gitProvider, wf, r); err != nil {
+		return err
+	}
 	wd, err := gitProvider.ParseWebhookData(r)
 	if err != nil {
 		return err
@@ -1408,14 +1724,49 @@ func (ws *workflowService) startLegacyWorkflow(ctx context.Context, webhookID st
 		return nil
 	}
 	log.CtxDebugf(ctx, "Parsed webhook data: %s", webhook_data.DebugString(wd))
-	wf, err := ws.readWorkflowForWebhook(ctx, webhookID)
+	return ws.enqueueStartWorkflowTask(ctx, gitProvider, wd, wf)
+}
+
+// verifyWebhookSignature checks that the webhook request was signed with the
+// workflow's webhook secret. Workflows created before webhook secrets were
+// enabled, as well as workflows for Git providers that don't sign webhook
+// deliveries, are let through unless signatures are required.
+func (ws *workflowService) verifyWebhookSignature(gitProvider interfaces.GitProvider, wf *tables.Workflow, r *http.Request) error {
+	if wf.WebhookSecret == "" {
+		if *requireWebhookSignatures {
+			return status.PermissionDeniedErrorf("workflow %s does not have a webhook secret", wf.WorkflowID)
+		}
+		return nil
+	}
+	secret, err := decryptWebhookSecret(ws.env, wf.WorkflowID, wf.WebhookSecret)
 	if err != nil {
-		return status.WrapErrorf(err, "failed to lookup workflow for webhook ID %q", webhookID)
+		return err
 	}
-	return ws.enqueueStartWorkflowTask(ctx, gitProvider, wd, wf)
+	err = gitProvider.VerifyWebhookSignature(r, secret)
+	if status.IsUnimplementedError(err) && !*requireWebhookSignatures {
+		return nil
+	}
+	if err != nil {
+		return status.WrapError(err, "verify webhook signature")
+	}
+	return nil
 }
 
 func (ws *workflowService) startWorkflow(ctx context.Context, gitProvider interfaces.GitProvider, wd *interfaces.WebhookData, wf *tables.Workflow, env map[string]string) error {
+	if wd.EventName == webhook_data.EventName.PullRequestComment {
+		return ws.handlePullRequestCommand(ctx, gitProvider, wd, wf)
+	}
+	if isMergeQueueEvent(wd.EventName) {
+		if !*enableMergeQueue {
+			return nil
+		}
+		return ws.handleMergeQueueEvent(ctx, gitProvider, wd, wf)
+	}
+	if *enableMergeQueue && wd.EventName == webhook_data.EventName.PullRequest {
+		if err := ws.dequeueUpdatedPullRequest(ctx, wf, wd); err != nil {
+			log.CtxWarningf(ctx, "Failed to check merge queue for pull request #%d of %s: %s", wd.PullRequestNumber, wf.RepoURL, err)
+		}
+	}
 	isTrusted, err := ws.isTrustedCommit(ctx, gitProvider, wf, wd)
 	if err != nil {
 		return err
@@ -1453,27 +1804,56 @@ func (ws *workflowService) startWorkflow(ctx context.Context, gitProvider interf
 		return err
 	}
 
+	ws.startActions(ctx, apiKey, wf, wd, isTrusted, actions, env)
+	return nil
+}
+
+// startActions starts the given workflow actions in parallel, and returns the
+// invocation ID of each action, or an empty string for the actions that
+// didn't start, such as ones that require approval. Actions in a concurrency
+// group count as started once they're queued.
+func (ws *workflowService) startActions(ctx context.Context, apiKey *tables.APIKey, wf *tables.Workflow, wd *interfaces.WebhookData, isTrusted bool, actions []*config.Action, env map[string]string) []string {
+	invocationIDs := make([]string, len(actions))
+	matrixRuns := ws.newMatrixRuns(wf, wd)
 	var wg sync.WaitGroup
-	for _, action := range actions {
+	for i, action := range actions {
 		action := action
 		invocationUUID, err := guuid.NewRandom()
 		if err != nil {
-			return err
+			log.CtxErrorf(ctx, "Failed to generate invocation ID for workflow %s (%s) action %q: %s", wf.WorkflowID, wf.RepoURL, action.Name, err)
+			continue
 		}
 		invocationID := invocationUUID.String()
+		if err := matrixRuns.add(ctx, action, invocationID); err != nil {
+			log.CtxWarningf(ctx, "Failed to record matrix run of workflow %s (%s) action %q: %s", wf.WorkflowID, wf.RepoURL, action.Name, err)
+		}
 
 		// Start executions in parallel to help reduce workflow start latency
 		// for repos with lots of workflow actions.
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			if _, err := ws.executeWorkflowAction(ctx, apiKey, wf, wd, isTrusted, action, invocationID, nil /*=extraCIRunnerArgs*/, env); err != nil {
+			start := func(ctx context.Context) (string, error) {
+				executionID, err := ws.executeWorkflowAction(ctx, apiKey, wf, wd, isTrusted, action, invocationID, nil /*=extraCIRunnerArgs*/, env)
+				if err != nil || executionID == "" {
+					// The action didn't run, so leave it out of its matrix
+					// summary.
+					matrixRuns.remove(ctx, action, invocationID)
+				}
+				return executionID, err
+			}
+			executionID, err := ws.runWorkflowAction(ctx, apiKey, wf, wd, action, invocationID, start)
+			started := executionID != "" || action.Concurrency != nil
+			if err != nil {
 				log.CtxErrorf(ctx, "Failed to execute workflow %s (%s) action %q: %s", wf.WorkflowID, wf.RepoURL, action.Name, err)
+			} else if started {
+				invocationIDs[i] = invocationID
 			}
 		}()
 	}
 	wg.Wait()
-	return nil
+	matrixRuns.reportPending(ctx)
+	return invocationIDs
 }
 
 // Starts a CI runner execution to execute a single workflow action, and returns the execution ID.
@@ -1483,10 +1863,10 @@ func (ws *workflowService) executeWorkflowAction(ctx context.Context, key *table
 	r := retry.New(ctx, opts)
 	var lastErr error
 	for r.Next() {
-		executionID, err := ws.attemptExecuteWorkflowAction(ctx, key, wf, wd, isTrusted, action, invocationID, nil /*=extraCIRunnerArgs*/, env)
+		executionID, err := ws.attemptExecuteWorkflowAction(ctx, key, wf, wd, isTrusted, action, invocationID, extraCIRunnerArgs, env)
 		if err == ApprovalRequired {
 			log.CtxInfof(ctx, "Skipping workflow action %s (%s) %q (requires approval)", wf.WorkflowID, wf.RepoURL, action.Name)
-			if err := ws.createApprovalRequiredStatus(ctx, wf, wd, action.Name); err != nil {
+			if err := ws.createApprovalRequiredStatus(ctx, wf, wd, action.GetStatusName()); err != nil {
 				log.CtxErrorf(ctx, "Failed to create 'approval required' status: %s", err)
 			}
 			return "", nil
@@ -1527,6 +1907,13 @@ func (ws *workflowService) attemptExecuteWorkflowAction(ctx context.Context, key
 			{Name: "REPO_TOKEN", Value: wf.AccessToken},
 		}
 		execCtx = withEnvOverrides(execCtx, headerEnv)
+		if secretService := ws.env.GetSecretService(); secretService != nil {
+			repoSecrets, err := secretService.GetRepoSecretEnvVars(ctx, wf.GroupID, wf.RepoURL)
+			if err != nil {
+				return "", err
+			}
+			execCtx = withBase64EnvOverrides(execCtx, repoSecrets)
+		}
 	}
 	execCtx, cancelRPC := context.WithCancel(execCtx)
 	// Note that we use this to cancel the operation update stream from the Execute RPC, not the execution itself.
@@ -1550,31 +1937,39 @@ func (ws *workflowService) attemptExecuteWorkflowAction(ctx context.Context, key
 		metrics.WebhookEventName: wd.EventName,
 	}).Inc()
 
-	if err := ws.createQueuedStatus(ctx, wf, wd, workflowAction.Name, invocationID); err != nil {
+	if err := ws.createQueuedStatus(ctx, wf, wd, workflowAction.GetStatusName(), invocationID); err != nil {
 		log.CtxWarningf(ctx, "Failed to publish workflow action queued status to GitHub: %s", err)
 	}
 
 	return op.GetName(), nil
 }
 
-func (ws *workflowService) createApprovalRequiredStatus(ctx context.Context, wf *tables.Workflow, wd *interfaces.WebhookData, actionName string) error {
-	// TODO: Create a help section in the docs that explains this error status, and link to it
-	status := github.NewGithubStatusPayload(actionName, ws.bbUrl.String(), "Check requires approving review", github.ErrorState)
-	ownerRepo, err := gitutil.OwnerRepoFromRepoURL(wd.TargetRepoURL)
+func (ws *workflowService) createApprovalRequiredStatus(ctx context.Context, wf *tables.Workflow, wd *interfaces.WebhookData, statusName string) error {
+	status := github.NewGithubStatusPayload(statusName, "https://buildbuddy.io/docs/workflows-setup#pull-requests-from-forks", "Check requires approving review", github.ErrorState)
+	statusReportingURL := getStatusReportingURL(wd)
+	provider, err := ws.providerForRepo(statusReportingURL)
 	if err != nil {
 		return err
 	}
-	ghc := github.NewGithubClient(ws.env, wf.AccessToken)
-	return ghc.CreateStatus(ctx, ownerRepo, wd.SHA, status)
+	return provider.CreateStatus(ctx, wf.AccessToken, statusReportingURL, wd.SHA, status)
 }
 
-func (ws *workflowService) createQueuedStatus(ctx context.Context, wf *tables.Workflow, wd *interfaces.WebhookData, actionName, invocationID string) error {
+// forkApprovalRequired returns whether pull requests from untrusted forks
+// must be approved before the workflow runs any actions for them.
+func forkApprovalRequired(wf *tables.Workflow) bool {
+	if wf.GitRepository != nil {
+		return wf.GitRepository.ForkApprovalRequired
+	}
+	return wf.ForkApprovalRequired
+}
+
+func (ws *workflowService) createQueuedStatus(ctx context.Context, wf *tables.Workflow, wd *interfaces.WebhookData, statusName, invocationID string) error {
 	invocationURL, err := ws.createBBURL(ctx, "/invocation/"+invocationID)
 	if err != nil {
 		return err
 	}
 	invocationURL += "?queued=true"
-	status := github.NewGithubStatusPayload(actionName, invocationURL, "Queued...", github.PendingState)
+	status := github.NewGithubStatusPayload(statusName, invocationURL, "Queued...", github.PendingState)
 	statusReportingURL := getStatusReportingURL(wd)
 	provider, err := ws.providerForRepo(statusReportingURL)
 	if err != nil {
@@ -1587,7 +1982,7 @@ func (ws *workflowService) createQueuedStatus(ctx context.Context, wf *tables.Wo
 func getStatusReportingURL(wd *interfaces.WebhookData) string {
 	// If the workflow was triggered by a pull request from a fork, statuses should
 	// be reported to the target repo (the repo the fork will be merged into)
-	if isFork(wd) {
+	if webhook_data.IsFork(wd) {
 		return wd.TargetRepoURL
 	}
 	// If there was not a fork, TargetRepoURL will not be set, or TargetRepoURL
@@ -1595,10 +1990,6 @@ func getStatusReportingURL(wd *interfaces.WebhookData) string {
 	return wd.PushedRepoURL
 }
 
-func isFork(wd *interfaces.WebhookData) bool {
-	return wd.TargetRepoURL != "" && wd.PushedRepoURL != wd.TargetRepoURL
-}
-
 func (ws *workflowService) createWorkflowConfigErrorStatus(ctx context.Context, wf *tables.Workflow, wd *interfaces.WebhookData) error {
 	// For now just point to docs. Eventually it'd be nice to link to BB code
 	// and highlight the YAML syntax error.
@@ -1641,7 +2032,11 @@ func (ws *workflowService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx = log.EnrichContext(ctx, "github_delivery", r.Header.Get("X-GitHub-Delivery"))
 	if err := ws.startLegacyWorkflow(ctx, webhookID, r); err != nil {
 		log.Errorf("Failed to start workflow (webhook ID: %q): %s", webhookID, err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		code := http.StatusBadRequest
+		if status.IsPermissionDeniedError(err) {
+			code = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), code)
 		return
 	}
 	w.Write([]byte("OK"))
@@ -1696,3 +2091,19 @@ func withEnvOverrides(ctx context.Context, env []*repb.Command_EnvironmentVariab
 	return platform.WithRemoteHeaderOverride(
 		ctx, platform.EnvOverridesPropertyName, strings.Join(assignments, ","))
 }
+
+// withBase64EnvOverrides is like withEnvOverrides, but encodes the
+// assignments so that values may contain commas. Base64 overrides take
+// precedence over both the command's env and plain env overrides, so repo
+// secrets shadow org secrets with the same name.
+func withBase64EnvOverrides(ctx context.Context, env []*repb.Command_EnvironmentVariable) context.Context {
+	if len(env) == 0 {
+		return ctx
+	}
+	assignments := make([]string, 0, len(env))
+	for _, e := range env {
+		assignments = append(assignments, base64.StdEncoding.EncodeToString([]byte(e.Name+"="+e.Value)))
+	}
+	return platform.WithRemoteHeaderOverride(
+		ctx, platform.EnvOverridesBase64PropertyName, strings.Join(assignments, ","))
+}
@@ -3,14 +3,25 @@ package service_test
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/kms"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testauth"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testenv"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/workflow/config"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/github"
 	"github.com/buildbuddy-io/buildbuddy/server/backends/repo_downloader"
 	"github.com/buildbuddy-io/buildbuddy/server/buildbuddy_server"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
@@ -21,11 +32,15 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testgit"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testhttp"
 	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 	"github.com/google/go-cmp/cmp"
+	"github.com/jonboulle/clockwork"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/genproto/googleapis/longrunning"
@@ -35,6 +50,7 @@ import (
 	"google.golang.org/protobuf/types/known/anypb"
 
 	workflow "github.com/buildbuddy-io/buildbuddy/enterprise/server/workflow/service"
+	bespb "github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
 	bbspb "github.com/buildbuddy-io/buildbuddy/proto/buildbuddy_service"
 	gitpb "github.com/buildbuddy-io/buildbuddy/proto/git"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
@@ -52,6 +68,22 @@ actions:
 `
 )
 
+// enableWebhookSecrets makes new workflows get a webhook secret, encrypted
+// with a local KMS master key.
+func enableWebhookSecrets(t *testing.T, te *testenv.TestEnv) {
+	kmsDir := testfs.MakeTempDir(t)
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(kmsDir, "master"), key, 0600))
+	flags.Set(t, "keystore.local_insecure_kms_directory", kmsDir)
+	flags.Set(t, "keystore.master_key_uri", "local-insecure-kms://master")
+	kmsClient, err := kms.New(context.Background())
+	require.NoError(t, err)
+	te.SetKMS(kmsClient)
+	flags.Set(t, "remote_execution.workflows_enable_webhook_secrets", true)
+}
+
 func newTestEnv(t *testing.T) *testenv.TestEnv {
 	te := enterprise_testenv.New(t)
 	enterprise_testauth.Configure(t, te)
@@ -140,6 +172,18 @@ func pingWebhook(t *testing.T, url string) {
 	require.Equal(t, 200, res.StatusCode)
 }
 
+// postWebhook makes an empty request to the given webhook URL with the given
+// headers, and returns the response status code.
+func postWebhook(t *testing.T, url string, header http.Header) int {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader([]byte{}))
+	require.NoError(t, err)
+	req.Header = header
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	return res.StatusCode
+}
+
 type execution struct {
 	Metadata metadata.MD
 	Action   *repb.Action
@@ -206,6 +250,16 @@ func (c *fakeExecutionClient) WaitExecution(ctx context.Context, req *repb.WaitE
 
 type fakeExecuteStream struct{ grpc.ClientStream }
 
+// fakeSecretService serves a fixed set of repo secrets.
+type fakeSecretService struct {
+	interfaces.SecretService
+	repoSecrets map[string][]*repb.Command_EnvironmentVariable
+}
+
+func (s *fakeSecretService) GetRepoSecretEnvVars(ctx context.Context, groupID, repoURL string) ([]*repb.Command_EnvironmentVariable, error) {
+	return s.repoSecrets[repoURL], nil
+}
+
 func (*fakeExecuteStream) Recv() (*longrunning.Operation, error) {
 	metadata, err := anypb.New(&repb.ExecuteOperationMetadata{
 		Stage: repb.ExecutionStage_COMPLETED,
@@ -269,6 +323,120 @@ func TestCreate_SuccessfullyRegisterWebhook(t *testing.T) {
 	assert.Equal(t, rsp.GetWebhookUrl(), provider.RegisteredWebhookURL, "returned webhook URL should be registered to the provider")
 }
 
+func TestCreate_WebhookSecret(t *testing.T) {
+	ctx := context.Background()
+	te := newTestEnv(t)
+	enableWebhookSecrets(t, te)
+	ctx, uid, gid := authenticate(t, ctx, te)
+	provider := setupFakeGitProvider(t, te)
+	repoURL := makeTempRepo(t)
+	clientConn := runBBServer(ctx, t, te)
+	bbClient := bbspb.NewBuildBuddyServiceClient(clientConn)
+
+	rsp, err := bbClient.CreateWorkflow(ctx, &wfpb.CreateWorkflowRequest{
+		RequestContext: testauth.RequestContext(uid, gid),
+		GitRepo:        &gitpb.GitRepo{RepoUrl: repoURL},
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, rsp.GetWebhookSecret())
+	assert.Equal(t, rsp.GetWebhookSecret(), provider.RegisteredWebhookSecret, "webhook secret should be registered to the provider")
+
+	var row tables.Workflow
+	err = te.GetDBHandle().NewQuery(ctx, "get_worflow").Raw(`SELECT * FROM "Workflows"`).Take(&row)
+	require.NoError(t, err)
+	assert.NotEmpty(t, row.WebhookSecret)
+	assert.NotContains(t, row.WebhookSecret, rsp.GetWebhookSecret(), "webhook secret should be stored encrypted")
+	// The secret is bound to the workflow.
+	masterKey, err := te.GetKMS().FetchMasterKey()
+	require.NoError(t, err)
+	ciphertext, err := base64.StdEncoding.DecodeString(row.WebhookSecret)
+	require.NoError(t, err)
+	secret, err := masterKey.Decrypt(ciphertext, []byte(row.WorkflowID))
+	require.NoError(t, err)
+	assert.Equal(t, rsp.GetWebhookSecret(), string(secret))
+	_, err = masterKey.Decrypt(ciphertext, []byte("WF-other"))
+	assert.Error(t, err, "webhook secret should only decrypt for its workflow")
+}
+
+func TestCreate_WebhookSignaturesRequiredWithoutWebhookSecrets(t *testing.T) {
+	flags.Set(t, "remote_execution.workflows_require_webhook_signatures", true)
+	ctx := context.Background()
+	te := newTestEnv(t)
+	ctx, uid, gid := authenticate(t, ctx, te)
+	setupFakeGitProvider(t, te)
+	repoURL := makeTempRepo(t)
+	clientConn := runBBServer(ctx, t, te)
+	bbClient := bbspb.NewBuildBuddyServiceClient(clientConn)
+
+	_, err := bbClient.CreateWorkflow(ctx, &wfpb.CreateWorkflowRequest{
+		RequestContext: testauth.RequestContext(uid, gid),
+		GitRepo:        &gitpb.GitRepo{RepoUrl: repoURL},
+	})
+	assert.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition error, got %v", err)
+}
+
+func TestRotateWebhookSecret(t *testing.T) {
+	ctx := context.Background()
+	te := newTestEnv(t)
+	ctx, uid, gid := authenticate(t, ctx, te)
+	provider := setupFakeGitProvider(t, te)
+	repoURL := makeTempRepo(t)
+	clientConn := runBBServer(ctx, t, te)
+	bbClient := bbspb.NewBuildBuddyServiceClient(clientConn)
+
+	// Create the workflow before webhook secrets are enabled.
+	wfRes, err := bbClient.CreateWorkflow(ctx, &wfpb.CreateWorkflowRequest{
+		RequestContext: testauth.RequestContext(uid, gid),
+		GitRepo:        &gitpb.GitRepo{RepoUrl: repoURL},
+	})
+	require.NoError(t, err)
+	require.Empty(t, wfRes.GetWebhookSecret())
+	rotate := func(id string) (*wfpb.RotateWorkflowWebhookSecretResponse, error) {
+		return bbClient.RotateWorkflowWebhookSecret(ctx, &wfpb.RotateWorkflowWebhookSecretRequest{
+			RequestContext: testauth.RequestContext(uid, gid),
+			Id:             id,
+		})
+	}
+	_, err = rotate(wfRes.GetId())
+	assert.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition error, got %v", err)
+
+	enableWebhookSecrets(t, te)
+	storedSecret := func() string {
+		var row tables.Workflow
+		err := te.GetDBHandle().NewQuery(ctx, "get_worflow").Raw(`SELECT * FROM "Workflows"`).Take(&row)
+		require.NoError(t, err)
+		masterKey, err := te.GetKMS().FetchMasterKey()
+		require.NoError(t, err)
+		ciphertext, err := base64.StdEncoding.DecodeString(row.WebhookSecret)
+		require.NoError(t, err)
+		secret, err := masterKey.Decrypt(ciphertext, []byte(row.WorkflowID))
+		require.NoError(t, err)
+		return string(secret)
+	}
+
+	// Setting a secret re-registers the webhook with it.
+	rsp, err := rotate(wfRes.GetId())
+	require.NoError(t, err)
+	require.NotEmpty(t, rsp.GetWebhookSecret())
+	assert.True(t, rsp.GetWebhookRegistered())
+	assert.Equal(t, testgit.FakeWebhookID, provider.UnregisteredWebhookID, "old webhook should be unregistered")
+	assert.Equal(t, rsp.GetWebhookSecret(), provider.RegisteredWebhookSecret, "new secret should be registered to the provider")
+	assert.Equal(t, wfRes.GetWebhookUrl(), provider.RegisteredWebhookURL)
+	assert.Equal(t, rsp.GetWebhookSecret(), storedSecret())
+
+	// Rotating replaces the secret. If the webhook can't be re-registered,
+	// the user is asked to update it manually.
+	provider.RegisterWebhookError = status.UnimplementedError("not implemented")
+	rotated, err := rotate(wfRes.GetId())
+	require.NoError(t, err)
+	assert.NotEqual(t, rsp.GetWebhookSecret(), rotated.GetWebhookSecret())
+	assert.False(t, rotated.GetWebhookRegistered())
+	assert.Equal(t, rotated.GetWebhookSecret(), storedSecret())
+
+	_, err = rotate("WF-unknown")
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound error, got %v", err)
+}
+
 func TestCreate_NoWebhookPermissions(t *testing.T) {
 	ctx := context.Background()
 	te := newTestEnv(t)
@@ -577,6 +745,130 @@ func TestWebhook_TrustedApprovalOnUntrustedPullRequest_StartsTrustedWorkflow(t *
 		"API key should be set via env-overrides")
 }
 
+func TestWebhook_RepoSecretsOnlyInjectedForTrustedRuns(t *testing.T) {
+	ctx := context.Background()
+	u, lis := testhttp.NewServer(t)
+	flags.Set(t, "app.build_buddy_url", *u)
+	flags.Set(t, "remote_execution.enable_remote_exec", true)
+	te := newTestEnv(t)
+	ctx, uid, gid := authenticate(t, ctx, te)
+	execClient := te.GetRemoteExecutionClient().(*fakeExecutionClient)
+	go http.Serve(lis, te.GetWorkflowService())
+	provider := setupFakeGitProvider(t, te)
+	repoURL := makeTempRepo(t)
+	te.SetSecretService(&fakeSecretService{
+		repoSecrets: map[string][]*repb.Command_EnvironmentVariable{
+			repoURL: {{Name: "DEPLOY_TOKEN", Value: "user:pass,with,commas"}},
+		},
+	})
+	clientConn := runBBServer(ctx, t, te)
+	bbClient := bbspb.NewBuildBuddyServiceClient(clientConn)
+	req := &wfpb.CreateWorkflowRequest{
+		RequestContext: testauth.RequestContext(uid, gid),
+		GitRepo:        &gitpb.GitRepo{RepoUrl: repoURL},
+	}
+	wfRes, err := bbClient.CreateWorkflow(ctx, req)
+	require.NoError(t, err)
+	webhookURL := wfRes.GetWebhookUrl()
+	provider.TrustedUsers = []string{"acme-inc-user-1"}
+	provider.WebhookData = &interfaces.WebhookData{
+		EventName:          "pull_request",
+		TargetRepoURL:      "https://github.com/acme-inc/acme",
+		TargetBranch:       "main",
+		PushedRepoURL:      "https://github.com/untrusteduser/acme",
+		PushedBranch:       "feature",
+		SHA:                "c04d68571cb519e095772c865847007ed3e7fea9",
+		IsTargetRepoPublic: true,
+		PullRequestAuthor:  "acme-inc-user-1",
+	}
+	provider.FileContents = map[string]string{"buildbuddy.yaml": configWithLinuxWorkflow}
+
+	pingWebhook(t, webhookURL)
+
+	execReq := execClient.NextExecuteRequest()
+	exec := getExecution(t, ctx, te, execReq.Payload)
+	assert.NotContains(t, envVars(exec.Command), "DEPLOY_TOKEN", "repo secrets should not be stored in the action")
+	overrides := execReq.Metadata["x-buildbuddy-platform.env-overrides-base64"]
+	require.Len(t, overrides, 1)
+	assignment, err := base64.StdEncoding.DecodeString(overrides[0])
+	require.NoError(t, err)
+	assert.Equal(t, "DEPLOY_TOKEN=user:pass,with,commas", string(assignment))
+
+	// Runs triggered by untrusted contributors don't get repo secrets.
+	provider.WebhookData.PullRequestAuthor = "external-user-1"
+
+	pingWebhook(t, webhookURL)
+
+	execReq = execClient.NextExecuteRequest()
+	assert.NotContains(t,
+		execReq.Metadata,
+		"x-buildbuddy-platform.env-overrides-base64",
+		"untrusted workflow should not have repo secrets")
+}
+
+func TestWebhook_UploadedForReview_OnlyTrustedUploadersGetSecrets(t *testing.T) {
+	ctx := context.Background()
+	u, lis := testhttp.NewServer(t)
+	flags.Set(t, "app.build_buddy_url", *u)
+	flags.Set(t, "remote_execution.enable_remote_exec", true)
+	te := newTestEnv(t)
+	ctx, uid, gid := authenticate(t, ctx, te)
+	execClient := te.GetRemoteExecutionClient().(*fakeExecutionClient)
+	go http.Serve(lis, te.GetWorkflowService())
+	provider := setupFakeGitProvider(t, te)
+	repoURL := makeTempRepo(t)
+	te.SetSecretService(&fakeSecretService{
+		repoSecrets: map[string][]*repb.Command_EnvironmentVariable{
+			repoURL: {{Name: "DEPLOY_TOKEN", Value: "secret"}},
+		},
+	})
+	clientConn := runBBServer(ctx, t, te)
+	bbClient := bbspb.NewBuildBuddyServiceClient(clientConn)
+	req := &wfpb.CreateWorkflowRequest{
+		RequestContext: testauth.RequestContext(uid, gid),
+		GitRepo:        &gitpb.GitRepo{RepoUrl: repoURL},
+	}
+	wfRes, err := bbClient.CreateWorkflow(ctx, req)
+	require.NoError(t, err)
+	webhookURL := wfRes.GetWebhookUrl()
+	provider.TrustedUsers = []string{"acme-inc-user-1"}
+	// A change uploaded for review to the target repo, such as a Gerrit patch
+	// set, isn't from a fork, but may be uploaded by anyone.
+	provider.WebhookData = &interfaces.WebhookData{
+		EventName:           "pull_request",
+		TargetRepoURL:       "https://review.acme.com/acme",
+		TargetBranch:        "main",
+		PushedRepoURL:       "https://review.acme.com/acme",
+		PushedBranch:        "refs/changes/23/123/2",
+		SHA:                 "c04d68571cb519e095772c865847007ed3e7fea9",
+		IsUploadedForReview: true,
+		PullRequestNumber:   123,
+		PullRequestAuthor:   "external-user-1",
+	}
+	provider.FileContents = map[string]string{"buildbuddy.yaml": configWithLinuxWorkflow}
+
+	pingWebhook(t, webhookURL)
+
+	execReq := execClient.NextExecuteRequest()
+	assert.NotContains(t,
+		execReq.Metadata,
+		"x-buildbuddy-platform.env-overrides",
+		"untrusted workflow should not have remote_header env vars")
+	assert.NotContains(t,
+		execReq.Metadata,
+		"x-buildbuddy-platform.env-overrides-base64",
+		"untrusted workflow should not have repo secrets")
+
+	// Changes uploaded by trusted users get secrets.
+	provider.WebhookData.PullRequestAuthor = "acme-inc-user-1"
+
+	pingWebhook(t, webhookURL)
+
+	execReq = execClient.NextExecuteRequest()
+	assert.Contains(t, execReq.Metadata, "x-buildbuddy-platform.env-overrides")
+	assert.Contains(t, execReq.Metadata, "x-buildbuddy-platform.env-overrides-base64")
+}
+
 func TestWebhook_TrustedApprovalOnAlreadyTrustedPullRequest_NOP(t *testing.T) {
 	ctx := context.Background()
 	u, lis := testhttp.NewServer(t)
@@ -653,7 +945,7 @@ func TestWebhook_UntrustedApprovalOnUntrustedPullRequest_NOP(t *testing.T) {
 	pingWebhook(t, webhookURL)
 }
 
-func TestWebhook_TrustedPush_StartsTrustedWorkflow(t *testing.T) {
+func TestWebhook_ForkApprovalRequired(t *testing.T) {
 	ctx := context.Background()
 	u, lis := testhttp.NewServer(t)
 	flags.Set(t, "app.build_buddy_url", *u)
@@ -661,78 +953,913 @@ func TestWebhook_TrustedPush_StartsTrustedWorkflow(t *testing.T) {
 	te := newTestEnv(t)
 	ctx, uid, gid := authenticate(t, ctx, te)
 	execClient := te.GetRemoteExecutionClient().(*fakeExecutionClient)
-	te.SetRemoteExecutionClient(execClient)
 	go http.Serve(lis, te.GetWorkflowService())
 	provider := setupFakeGitProvider(t, te)
 	repoURL := makeTempRepo(t)
 	clientConn := runBBServer(ctx, t, te)
 	bbClient := bbspb.NewBuildBuddyServiceClient(clientConn)
-	req := &wfpb.CreateWorkflowRequest{
+	wfRes, err := bbClient.CreateWorkflow(ctx, &wfpb.CreateWorkflowRequest{
 		RequestContext: testauth.RequestContext(uid, gid),
 		GitRepo:        &gitpb.GitRepo{RepoUrl: repoURL},
-	}
-	wfRes, err := bbClient.CreateWorkflow(ctx, req)
+	})
 	require.NoError(t, err)
 	webhookURL := wfRes.GetWebhookUrl()
 	provider.TrustedUsers = []string{"acme-inc-user-1"}
-	provider.WebhookData = &interfaces.WebhookData{
-		EventName:          "push",
+	provider.FileContents = map[string]string{"buildbuddy.yaml": configWithLinuxWorkflow}
+	wd := &interfaces.WebhookData{
+		EventName:          "pull_request",
 		TargetRepoURL:      "https://github.com/acme-inc/acme",
 		TargetBranch:       "main",
-		PushedRepoURL:      "https://github.com/acme-inc/acme",
-		PushedBranch:       "main",
+		PushedRepoURL:      "https://github.com/untrusteduser/acme",
+		PushedBranch:       "feature",
 		SHA:                "c04d68571cb519e095772c865847007ed3e7fea9",
 		IsTargetRepoPublic: true,
+		PullRequestAuthor:  "external-user-1",
 	}
-	provider.FileContents = map[string]string{"buildbuddy.yaml": configWithLinuxWorkflow}
 
+	// Without approval required, the untrusted run starts right away with a
+	// restricted network, which is enforced with OCI isolation.
+	provider.WebhookData = wd
 	pingWebhook(t, webhookURL)
+	exec := getExecution(t, ctx, te, execClient.NextExecuteRequest().Payload)
+	assert.Contains(t, exec.Command.GetPlatform().GetProperties(), &repb.Platform_Property{Name: "network-policy", Value: "internal-only"})
+	assert.Contains(t, exec.Command.GetPlatform().GetProperties(), &repb.Platform_Property{Name: "workload-isolation-type", Value: "oci"})
+
+	_, err = bbClient.SetWorkflowForkApprovalRequired(ctx, &wfpb.SetWorkflowForkApprovalRequiredRequest{
+		RequestContext: testauth.RequestContext(uid, gid),
+		RepoUrl:        repoURL,
+		Required:       true,
+	})
+	require.NoError(t, err)
+	// Drain the queued status of the first run.
+	<-provider.Statuses
 
+	pingWebhook(t, webhookURL)
+	s := <-provider.Statuses
+	assert.Equal(t, "https://github.com/acme-inc/acme", s.RepoURL)
+	assert.Equal(t, "c04d68571cb519e095772c865847007ed3e7fea9", s.CommitSHA)
+	payload := s.Payload.(*github.GithubStatusPayload)
+	assert.Equal(t, "Check requires approving review", *payload.Description)
+	assert.Empty(t, execClient.executeRequests, "untrusted run should wait for approval")
+
+	// An approving review from a trusted user starts a trusted run.
+	approved := *wd
+	approved.PullRequestApprover = "acme-inc-user-1"
+	provider.WebhookData = &approved
+	pingWebhook(t, webhookURL)
 	execReq := execClient.NextExecuteRequest()
-	exec := getExecution(t, ctx, te, execReq.Payload)
-	assert.Equal(t, "./buildbuddy_ci_runner", exec.Command.GetArguments()[0])
-	env := envVars(exec.Command)
-	assert.NotContains(t,
-		env, "BUILDBUDDY_API_KEY",
-		"action env should not contain BUILDBUDDY_API_KEY env var")
-	assert.Regexp(t,
-		`BUILDBUDDY_API_KEY=[\w]+,REPO_USER=,REPO_TOKEN=`,
-		execReq.Metadata["x-buildbuddy-platform.env-overrides"],
-		"API key should be set via env-overrides")
+	exec = getExecution(t, ctx, te, execReq.Payload)
+	assert.Regexp(t, `BUILDBUDDY_API_KEY=[\w]+`, execReq.Metadata["x-buildbuddy-platform.env-overrides"])
+	assert.NotContains(t, exec.Command.GetPlatform().GetProperties(), &repb.Platform_Property{Name: "network-policy", Value: "internal-only"})
 }
 
-func TestAPIDispatch_ActionFiltering(t *testing.T) {
-	ctx := context.Background()
+func TestWebhook_UntrustedFirecrackerRunIsRejected(t *testing.T) {
 	u, lis := testhttp.NewServer(t)
 	flags.Set(t, "app.build_buddy_url", *u)
 	flags.Set(t, "remote_execution.enable_remote_exec", true)
-	flags.Set(t, "remote_execution.enable_kythe_indexing", true)
-
+	flags.Set(t, "remote_execution.workflows_enable_firecracker", true)
 	te := newTestEnv(t)
-	ctx, uid, gid := authenticate(t, ctx, te)
+	ctx, uid, gid := authenticate(t, context.Background(), te)
 	execClient := te.GetRemoteExecutionClient().(*fakeExecutionClient)
-	te.SetRemoteExecutionClient(execClient)
 	go http.Serve(lis, te.GetWorkflowService())
-	_ = setupFakeGitProvider(t, te)
+	provider := setupFakeGitProvider(t, te)
 	repoURL := makeTempRepo(t)
 	clientConn := runBBServer(ctx, t, te)
 	bbClient := bbspb.NewBuildBuddyServiceClient(clientConn)
-	reqCtx := testauth.RequestContext(uid, gid)
-	req := &wfpb.CreateWorkflowRequest{
-		RequestContext: reqCtx,
+	wfRes, err := bbClient.CreateWorkflow(ctx, &wfpb.CreateWorkflowRequest{
+		RequestContext: testauth.RequestContext(uid, gid),
 		GitRepo:        &gitpb.GitRepo{RepoUrl: repoURL},
+	})
+	require.NoError(t, err)
+	provider.TrustedUsers = []string{"acme-inc-user-1"}
+	provider.FileContents = map[string]string{"buildbuddy.yaml": configWithLinuxWorkflow}
+	provider.WebhookData = &interfaces.WebhookData{
+		EventName:          "pull_request",
+		TargetRepoURL:      "https://github.com/acme-inc/acme",
+		TargetBranch:       "main",
+		PushedRepoURL:      "https://github.com/untrusteduser/acme",
+		PushedBranch:       "feature",
+		SHA:                "c04d68571cb519e095772c865847007ed3e7fea9",
+		IsTargetRepoPublic: true,
+		PullRequestAuthor:  "external-user-1",
 	}
-	wfRes, err := bbClient.CreateWorkflow(ctx, req)
+
+	// Firecracker VMs can't enforce the untrusted network policy, so the
+	// untrusted run doesn't start.
+	pingWebhook(t, wfRes.GetWebhookUrl())
+	assert.Empty(t, execClient.executeRequests)
+}
+
+func TestWebhook_StatusName(t *testing.T) {
+	ctx, te, provider, webhookURL := setupConcurrencyTest(t, false /*=cancelInProgress*/)
+	provider.FileContents = map[string]string{"buildbuddy.yaml": `
+actions:
+  - name: "Test all targets"
+    status_name: "ci/test"
+    triggers: { push: { branches: [ "*" ] } }
+    bazel_commands: [ "test //..." ]
+`}
+	execClient := te.GetRemoteExecutionClient().(*fakeExecutionClient)
+
+	provider.WebhookData = pushWebhookData("c04d68571cb519e095772c865847007ed3e7fea9")
+	pingWebhook(t, webhookURL)
+	exec := getExecution(t, ctx, te, execClient.NextExecuteRequest().Payload)
+	assert.Contains(t, exec.Command.GetArguments(), "--action_name=Test all targets")
+
+	s := <-provider.Statuses
+	payload := s.Payload.(*github.GithubStatusPayload)
+	assert.Equal(t, "ci/test", payload.GetContext())
+	assert.Equal(t, "Queued...", payload.GetDescription())
+}
+
+func TestWebhook_Matrix(t *testing.T) {
+	ctx, te, provider, webhookURL := setupConcurrencyTest(t, false /*=cancelInProgress*/)
+	provider.FileContents = map[string]string{"buildbuddy.yaml": `
+actions:
+  - name: "Test"
+    triggers: { push: { branches: [ "*" ] } }
+    matrix:
+      CONFIG: [ "asan", "tsan" ]
+    bazel_commands: [ "test //... --config=$CONFIG" ]
+`}
+	execClient := te.GetRemoteExecutionClient().(*fakeExecutionClient)
+
+	provider.WebhookData = pushWebhookData("c04d68571cb519e095772c865847007ed3e7fea9")
+	pingWebhook(t, webhookURL)
+	invocationIDs := map[string]string{}
+	for range 2 {
+		exec := getExecution(t, ctx, te, execClient.NextExecuteRequest().Payload)
+		invocationIDs[actionNameArg(t, exec.Command)] = invocationIDArg(t, exec.Command)
+		assert.Contains(t, envVars(exec.Command), "CONFIG")
+	}
+	require.Contains(t, invocationIDs, "Test (CONFIG=asan)")
+	require.Contains(t, invocationIDs, "Test (CONFIG=tsan)")
+
+	// Wait for the combined pending status, after the queued status of each
+	// combination.
+	nextMatrixStatus := func() *github.GithubStatusPayload {
+		for {
+			select {
+			case s := <-provider.Statuses:
+				payload := s.Payload.(*github.GithubStatusPayload)
+				if payload.GetContext() == "Test" {
+					return payload
+				}
+			case <-time.After(10 * time.Second):
+				require.FailNow(t, "timed out waiting for matrix status")
+			}
+		}
+	}
+	payload := nextMatrixStatus()
+	assert.Equal(t, "pending", payload.GetState())
+	assert.Equal(t, "Running 2 combinations...", payload.GetDescription())
+
+	ws := te.GetWorkflowService().(interface {
+		ProcessMatrixRuns(ctx context.Context) error
+	})
+	finish := func(actionName string, exitCode int32) {
+		execution := &tables.Execution{
+			ExecutionID:  "execution-" + actionName,
+			InvocationID: invocationIDs[actionName],
+			Stage:        int64(repb.ExecutionStage_COMPLETED),
+			ExitCode:     exitCode,
+		}
+		err := te.GetDBHandle().NewQuery(ctx, "create_execution").Create(execution)
+		require.NoError(t, err)
+	}
+
+	// The combined status isn't reported until all combinations finish.
+	finish("Test (CONFIG=asan)", 0)
+	err := ws.ProcessMatrixRuns(ctx)
 	require.NoError(t, err)
+	select {
+	case s := <-provider.Statuses:
+		require.FailNow(t, "unexpected status", "%+v", s.Payload)
+	default:
+	}
 
-	testCases := []struct {
-		name            string
-		actionFilter    []string
-		kytheEnabled    bool
-		expectedActions []string
-	}{
-		{
-			name:            "no action filter, kythe disabled",
+	finish("Test (CONFIG=tsan)", 1)
+	err = ws.ProcessMatrixRuns(ctx)
+	require.NoError(t, err)
+	payload = nextMatrixStatus()
+	assert.Equal(t, "failure", payload.GetState())
+	assert.Equal(t, "1 of 2 combinations passed", payload.GetDescription())
+	assert.Contains(t, payload.GetTargetURL(), invocationIDs["Test (CONFIG=tsan)"])
+
+	// The runs are deleted once the combined status is reported.
+	err = ws.ProcessMatrixRuns(ctx)
+	require.NoError(t, err)
+	select {
+	case s := <-provider.Statuses:
+		require.FailNow(t, "unexpected status", "%+v", s.Payload)
+	default:
+	}
+}
+
+func TestWebhook_PullRequestCommands(t *testing.T) {
+	flags.Set(t, "remote_execution.workflows_enable_pull_request_commands", true)
+	ctx, te, provider, webhookURL := setupConcurrencyTest(t, false /*=cancelInProgress*/)
+	provider.FileContents = map[string]string{"buildbuddy.yaml": `
+actions:
+  - name: "Test"
+    triggers: { pull_request: { branches: [ "*" ] } }
+    bazel_commands: [ "test //..." ]
+  - name: "Deploy"
+    triggers:
+      dispatch:
+        inputs:
+          - name: "ENVIRONMENT"
+            default: "staging"
+    bazel_commands: [ "run //:deploy" ]
+`}
+	// A pull request from a fork, by an untrusted author.
+	provider.PullRequests = map[int64]*interfaces.WebhookData{
+		7: {
+			EventName:          "pull_request",
+			TargetRepoURL:      "https://github.com/acme-inc/acme",
+			TargetBranch:       "main",
+			PushedRepoURL:      "https://github.com/some-user/acme-fork",
+			PushedBranch:       "feature",
+			SHA:                "c04d68571cb519e095772c865847007ed3e7fea9",
+			IsTargetRepoPublic: true,
+			PullRequestNumber:  7,
+			PullRequestAuthor:  "some-user",
+			PushedRepoPushedAt: time.Now().Add(-time.Hour),
+		},
+	}
+	execClient := te.GetRemoteExecutionClient().(*fakeExecutionClient)
+	comment := func(sender, body string) *testgit.PullRequestComment {
+		provider.WebhookData = &interfaces.WebhookData{
+			EventName:                   "pull_request_comment",
+			TargetRepoURL:               "https://github.com/acme-inc/acme",
+			IsTargetRepoPublic:          true,
+			PullRequestNumber:           7,
+			PullRequestAuthor:           "some-user",
+			Sender:                      sender,
+			PullRequestComment:          body,
+			PullRequestCommentCreatedAt: time.Now(),
+		}
+		pingWebhook(t, webhookURL)
+		select {
+		case c := <-provider.PullRequestComments:
+			assert.Equal(t, int64(7), c.Number)
+			return c
+		case <-time.After(10 * time.Second):
+			require.FailNow(t, "timed out waiting for reply")
+			return nil
+		}
+	}
+
+	// Commands from users who aren't collaborators are rejected.
+	reply := comment("some-user", "/buildbuddy retry")
+	assert.Contains(t, reply.Body, "Only collaborators")
+
+	reply = comment("acme-inc-user-1", "/buildbuddy deploy")
+	assert.Contains(t, reply.Body, `unknown command "deploy"`)
+
+	// The retried actions run as trusted, since a collaborator requested them.
+	reply = comment("acme-inc-user-1", "/buildbuddy retry")
+	execReq := execClient.NextExecuteRequest()
+	exec := getExecution(t, ctx, te, execReq.Payload)
+	assert.Equal(t, "Test", actionNameArg(t, exec.Command))
+	assert.Contains(t, exec.Command.GetArguments(), "--trigger_event=pull_request")
+	assert.Contains(t, exec.Command.GetArguments(), "--pushed_repo_url=https://github.com/some-user/acme-fork")
+	assert.Regexp(t, `BUILDBUDDY_API_KEY=[\w]+`, execReq.Metadata["x-buildbuddy-platform.env-overrides"])
+	assert.Contains(t, reply.Body, "[Test](")
+	assert.Contains(t, reply.Body, "/invocation/"+invocationIDArg(t, exec.Command)+")")
+
+	// Actions can be run by name regardless of their triggers, with the
+	// default values of their dispatch inputs.
+	reply = comment("acme-inc-user-1", "/buildbuddy run Deploy")
+	exec = getExecution(t, ctx, te, execClient.NextExecuteRequest().Payload)
+	assert.Equal(t, "Deploy", actionNameArg(t, exec.Command))
+	assert.Contains(t, exec.Command.GetArguments(), "--trigger_event=manual_dispatch")
+	assert.Equal(t, "staging", envVars(exec.Command)["ENVIRONMENT"])
+	assert.Contains(t, reply.Body, "[Deploy](")
+
+	reply = comment("acme-inc-user-1", "/buildbuddy run Lint")
+	assert.Contains(t, reply.Body, "No workflow actions")
+
+	// Commands are rejected if the fork was pushed to after the comment,
+	// since the head may not be the one the collaborator looked at.
+	provider.PullRequests[7].PushedRepoPushedAt = time.Now().Add(time.Hour)
+	reply = comment("acme-inc-user-1", "/buildbuddy retry")
+	assert.Contains(t, reply.Body, "updated after your comment")
+	assert.Empty(t, execClient.executeRequests)
+}
+
+func TestWebhook_TrustedPush_StartsTrustedWorkflow(t *testing.T) {
+	ctx := context.Background()
+	u, lis := testhttp.NewServer(t)
+	flags.Set(t, "app.build_buddy_url", *u)
+	flags.Set(t, "remote_execution.enable_remote_exec", true)
+	te := newTestEnv(t)
+	ctx, uid, gid := authenticate(t, ctx, te)
+	execClient := te.GetRemoteExecutionClient().(*fakeExecutionClient)
+	te.SetRemoteExecutionClient(execClient)
+	go http.Serve(lis, te.GetWorkflowService())
+	provider := setupFakeGitProvider(t, te)
+	repoURL := makeTempRepo(t)
+	clientConn := runBBServer(ctx, t, te)
+	bbClient := bbspb.NewBuildBuddyServiceClient(clientConn)
+	req := &wfpb.CreateWorkflowRequest{
+		RequestContext: testauth.RequestContext(uid, gid),
+		GitRepo:        &gitpb.GitRepo{RepoUrl: repoURL},
+	}
+	wfRes, err := bbClient.CreateWorkflow(ctx, req)
+	require.NoError(t, err)
+	webhookURL := wfRes.GetWebhookUrl()
+	provider.TrustedUsers = []string{"acme-inc-user-1"}
+	provider.WebhookData = &interfaces.WebhookData{
+		EventName:          "push",
+		TargetRepoURL:      "https://github.com/acme-inc/acme",
+		TargetBranch:       "main",
+		PushedRepoURL:      "https://github.com/acme-inc/acme",
+		PushedBranch:       "main",
+		SHA:                "c04d68571cb519e095772c865847007ed3e7fea9",
+		IsTargetRepoPublic: true,
+	}
+	provider.FileContents = map[string]string{"buildbuddy.yaml": configWithLinuxWorkflow}
+
+	pingWebhook(t, webhookURL)
+
+	execReq := execClient.NextExecuteRequest()
+	exec := getExecution(t, ctx, te, execReq.Payload)
+	assert.Equal(t, "./buildbuddy_ci_runner", exec.Command.GetArguments()[0])
+	env := envVars(exec.Command)
+	assert.NotContains(t,
+		env, "BUILDBUDDY_API_KEY",
+		"action env should not contain BUILDBUDDY_API_KEY env var")
+	assert.Regexp(t,
+		`BUILDBUDDY_API_KEY=[\w]+,REPO_USER=,REPO_TOKEN=`,
+		execReq.Metadata["x-buildbuddy-platform.env-overrides"],
+		"API key should be set via env-overrides")
+}
+
+func TestWebhook_SignedDelivery(t *testing.T) {
+	ctx := context.Background()
+	u, lis := testhttp.NewServer(t)
+	flags.Set(t, "app.build_buddy_url", *u)
+	flags.Set(t, "remote_execution.enable_remote_exec", true)
+	te := newTestEnv(t)
+	enableWebhookSecrets(t, te)
+	ctx, uid, gid := authenticate(t, ctx, te)
+	execClient := te.GetRemoteExecutionClient().(*fakeExecutionClient)
+	go http.Serve(lis, te.GetWorkflowService())
+	provider := setupFakeGitProvider(t, te)
+	repoURL := makeTempRepo(t)
+	clientConn := runBBServer(ctx, t, te)
+	bbClient := bbspb.NewBuildBuddyServiceClient(clientConn)
+	wfRes, err := bbClient.CreateWorkflow(ctx, &wfpb.CreateWorkflowRequest{
+		RequestContext: testauth.RequestContext(uid, gid),
+		GitRepo:        &gitpb.GitRepo{RepoUrl: repoURL},
+	})
+	require.NoError(t, err)
+	webhookURL := wfRes.GetWebhookUrl()
+	provider.WebhookData = &interfaces.WebhookData{
+		EventName:          "push",
+		TargetRepoURL:      "https://github.com/acme-inc/acme",
+		TargetBranch:       "main",
+		PushedRepoURL:      "https://github.com/acme-inc/acme",
+		PushedBranch:       "main",
+		SHA:                "c04d68571cb519e095772c865847007ed3e7fea9",
+		IsTargetRepoPublic: true,
+	}
+	provider.FileContents = map[string]string{"buildbuddy.yaml": configWithLinuxWorkflow}
+
+	// Deliveries without the secret are rejected.
+	code := postWebhook(t, webhookURL, http.Header{})
+	assert.Equal(t, http.StatusForbidden, code)
+	code = postWebhook(t, webhookURL, http.Header{testgit.FakeWebhookSecretHeader: {"wrong-secret"}})
+	assert.Equal(t, http.StatusForbidden, code)
+
+	code = postWebhook(t, webhookURL, http.Header{testgit.FakeWebhookSecretHeader: {wfRes.GetWebhookSecret()}})
+	require.Equal(t, http.StatusOK, code)
+
+	execReq := execClient.NextExecuteRequest()
+	exec := getExecution(t, ctx, te, execReq.Payload)
+	assert.Equal(t, "./buildbuddy_ci_runner", exec.Command.GetArguments()[0])
+}
+
+func TestWebhook_SignaturesRequired_RejectsWorkflowWithoutSecret(t *testing.T) {
+	ctx := context.Background()
+	u, lis := testhttp.NewServer(t)
+	flags.Set(t, "app.build_buddy_url", *u)
+	te := newTestEnv(t)
+	ctx, uid, gid := authenticate(t, ctx, te)
+	go http.Serve(lis, te.GetWorkflowService())
+	provider := setupFakeGitProvider(t, te)
+	repoURL := makeTempRepo(t)
+	clientConn := runBBServer(ctx, t, te)
+	bbClient := bbspb.NewBuildBuddyServiceClient(clientConn)
+	// Create the workflow before webhook secrets are enabled.
+	wfRes, err := bbClient.CreateWorkflow(ctx, &wfpb.CreateWorkflowRequest{
+		RequestContext: testauth.RequestContext(uid, gid),
+		GitRepo:        &gitpb.GitRepo{RepoUrl: repoURL},
+	})
+	require.NoError(t, err)
+	require.Empty(t, wfRes.GetWebhookSecret())
+	provider.WebhookData = &interfaces.WebhookData{EventName: "push"}
+
+	enableWebhookSecrets(t, te)
+	flags.Set(t, "remote_execution.workflows_require_webhook_signatures", true)
+
+	code := postWebhook(t, wfRes.GetWebhookUrl(), http.Header{})
+	assert.Equal(t, http.StatusForbidden, code)
+}
+
+func TestDispatchWorkflowAction(t *testing.T) {
+	ctx := context.Background()
+	u, _ := testhttp.NewServer(t)
+	flags.Set(t, "app.build_buddy_url", *u)
+	flags.Set(t, "remote_execution.enable_remote_exec", true)
+	te := newTestEnv(t)
+	ctx, uid, gid := authenticate(t, ctx, te)
+	execClient := te.GetRemoteExecutionClient().(*fakeExecutionClient)
+	provider := setupFakeGitProvider(t, te)
+	provider.FileContents = map[string]string{"buildbuddy.yaml": `
+actions:
+  - name: "Deploy"
+    triggers:
+      dispatch:
+        inputs:
+          - name: TARGET
+            required: true
+          - name: ENVIRONMENT
+            default: staging
+    bazel_commands: [ "run $TARGET" ]
+  - name: "Test"
+    triggers: { push: { branches: [ "main" ] } }
+    bazel_commands: [ "test //..." ]
+`}
+	repoURL := makeTempRepo(t)
+	clientConn := runBBServer(ctx, t, te)
+	bbClient := bbspb.NewBuildBuddyServiceClient(clientConn)
+	wfRes, err := bbClient.CreateWorkflow(ctx, &wfpb.CreateWorkflowRequest{
+		RequestContext: testauth.RequestContext(uid, gid),
+		GitRepo:        &gitpb.GitRepo{RepoUrl: repoURL},
+	})
+	require.NoError(t, err)
+	newRequest := func(actionName string, inputs map[string]string) *wfpb.DispatchWorkflowActionRequest {
+		return &wfpb.DispatchWorkflowActionRequest{
+			RequestContext: testauth.RequestContext(uid, gid),
+			WorkflowId:     wfRes.GetId(),
+			ActionName:     actionName,
+			Branch:         "main",
+			Inputs:         inputs,
+		}
+	}
+
+	rsp, err := bbClient.DispatchWorkflowAction(ctx, newRequest("Deploy", map[string]string{"TARGET": "//app:deploy"}))
+	require.NoError(t, err)
+	require.NotEmpty(t, rsp.GetInvocationId())
+
+	execReq := execClient.NextExecuteRequest()
+	exec := getExecution(t, ctx, te, execReq.Payload)
+	args := exec.Command.GetArguments()
+	assert.Contains(t, args, "--trigger_event=manual_dispatch")
+	assert.Contains(t, args, "--action_name=Deploy")
+	assert.Contains(t, args, "--invocation_id="+rsp.GetInvocationId())
+	env := envVars(exec.Command)
+	assert.Equal(t, "//app:deploy", env["TARGET"])
+	assert.Equal(t, "staging", env["ENVIRONMENT"])
+
+	_, err = bbClient.DispatchWorkflowAction(ctx, newRequest("Deploy", map[string]string{}))
+	assert.True(t, status.IsInvalidArgumentError(err), "missing required input: %s", err)
+	_, err = bbClient.DispatchWorkflowAction(ctx, newRequest("Deploy", map[string]string{"TARGET": "//app:deploy", "OTHER": "1"}))
+	assert.True(t, status.IsInvalidArgumentError(err), "unknown input: %s", err)
+	_, err = bbClient.DispatchWorkflowAction(ctx, newRequest("Test", nil))
+	assert.True(t, status.IsFailedPreconditionError(err), "action without dispatch trigger: %s", err)
+	_, err = bbClient.DispatchWorkflowAction(ctx, newRequest("Missing", nil))
+	assert.True(t, status.IsNotFoundError(err), "missing action: %s", err)
+
+	// Members of other orgs can't dispatch the workflow.
+	ctx2, uid2, gid2 := authenticateAsUser(t, context.Background(), te, "US2")
+	req := newRequest("Deploy", map[string]string{"TARGET": "//app:deploy"})
+	req.RequestContext = testauth.RequestContext(uid2, gid2)
+	_, err = bbClient.DispatchWorkflowAction(ctx2, req)
+	assert.Error(t, err)
+}
+
+type fakeRemoteExecutionService struct {
+	interfaces.RemoteExecutionService
+
+	mu        sync.Mutex
+	cancelled []string
+}
+
+func (s *fakeRemoteExecutionService) Cancel(ctx context.Context, invocationID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cancelled = append(s.cancelled, invocationID)
+	return nil
+}
+
+func (s *fakeRemoteExecutionService) Cancelled() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.cancelled)
+}
+
+func invocationIDArg(t *testing.T, cmd *repb.Command) string {
+	for _, arg := range cmd.GetArguments() {
+		if id, ok := strings.CutPrefix(arg, "--invocation_id="); ok {
+			return id
+		}
+	}
+	require.FailNow(t, "missing --invocation_id arg")
+	return ""
+}
+
+func pushWebhookData(sha string) *interfaces.WebhookData {
+	return &interfaces.WebhookData{
+		EventName:          "push",
+		TargetRepoURL:      "https://github.com/acme-inc/acme",
+		TargetBranch:       "main",
+		PushedRepoURL:      "https://github.com/acme-inc/acme",
+		PushedBranch:       "main",
+		SHA:                sha,
+		IsTargetRepoPublic: true,
+	}
+}
+
+func setupConcurrencyTest(t *testing.T, cancelInProgress bool) (ctx context.Context, te *testenv.TestEnv, provider *testgit.FakeProvider, webhookURL string) {
+	ctx = context.Background()
+	u, lis := testhttp.NewServer(t)
+	flags.Set(t, "app.build_buddy_url", *u)
+	flags.Set(t, "remote_execution.enable_remote_exec", true)
+	te = newTestEnv(t)
+	ctx, uid, gid := authenticate(t, ctx, te)
+	go http.Serve(lis, te.GetWorkflowService())
+	provider = setupFakeGitProvider(t, te)
+	provider.TrustedUsers = []string{"acme-inc-user-1"}
+	provider.FileContents = map[string]string{"buildbuddy.yaml": fmt.Sprintf(`
+actions:
+  - name: "Test"
+    triggers: { push: { branches: [ "*" ] } }
+    concurrency: { cancel_in_progress: %t }
+    bazel_commands: [ "test //..." ]
+`, cancelInProgress)}
+	repoURL := makeTempRepo(t)
+	clientConn := runBBServer(ctx, t, te)
+	bbClient := bbspb.NewBuildBuddyServiceClient(clientConn)
+	wfRes, err := bbClient.CreateWorkflow(ctx, &wfpb.CreateWorkflowRequest{
+		RequestContext: testauth.RequestContext(uid, gid),
+		GitRepo:        &gitpb.GitRepo{RepoUrl: repoURL},
+	})
+	require.NoError(t, err)
+	return ctx, te, provider, wfRes.GetWebhookUrl()
+}
+
+func TestConcurrency_CancelInProgress(t *testing.T) {
+	ctx, te, provider, webhookURL := setupConcurrencyTest(t, true /*=cancelInProgress*/)
+	res := &fakeRemoteExecutionService{}
+	te.SetRemoteExecutionService(res)
+	execClient := te.GetRemoteExecutionClient().(*fakeExecutionClient)
+
+	provider.WebhookData = pushWebhookData("c04d68571cb519e095772c865847007ed3e7fea9")
+	pingWebhook(t, webhookURL)
+	exec := getExecution(t, ctx, te, execClient.NextExecuteRequest().Payload)
+	firstInvocationID := invocationIDArg(t, exec.Command)
+
+	provider.WebhookData = pushWebhookData("e782592faf56da05cc0a243220689135e807958f")
+	pingWebhook(t, webhookURL)
+	exec = getExecution(t, ctx, te, execClient.NextExecuteRequest().Payload)
+	assert.Contains(t, exec.Command.GetArguments(), "--commit_sha=e782592faf56da05cc0a243220689135e807958f")
+	secondInvocationID := invocationIDArg(t, exec.Command)
+
+	require.Eventually(t, func() bool {
+		return slices.Contains(res.Cancelled(), firstInvocationID)
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.NotContains(t, res.Cancelled(), secondInvocationID)
+}
+
+func TestConcurrency_QueuesBehindInProgressRun(t *testing.T) {
+	ctx, te, provider, webhookURL := setupConcurrencyTest(t, false /*=cancelInProgress*/)
+	clock := clockwork.NewFakeClock()
+	te.SetClock(clock)
+	execClient := te.GetRemoteExecutionClient().(*fakeExecutionClient)
+
+	provider.WebhookData = pushWebhookData("c04d68571cb519e095772c865847007ed3e7fea9")
+	pingWebhook(t, webhookURL)
+	execReq := execClient.NextExecuteRequest()
+	getExecution(t, ctx, te, execReq.Payload)
+	// The fake execution client names every execution "fake-operation-name".
+	execution := &tables.Execution{ExecutionID: "fake-operation-name", Stage: int64(repb.ExecutionStage_EXECUTING)}
+	err := te.GetDBHandle().NewQuery(ctx, "create_execution").Create(execution)
+	require.NoError(t, err)
+
+	// The next runs wait for the first one. The third run replaces the second
+	// one in the queue.
+	provider.WebhookData = pushWebhookData("e782592faf56da05cc0a243220689135e807958f")
+	pingWebhook(t, webhookURL)
+	clock.BlockUntil(1)
+	provider.WebhookData = pushWebhookData("f9e7fea9c04d68571cb519e095772c865847007e")
+	pingWebhook(t, webhookURL)
+	clock.BlockUntil(2)
+
+	err = te.GetDBHandle().NewQuery(ctx, "update_execution").Raw(`
+		UPDATE "Executions" SET stage = ? WHERE execution_id = ?`,
+		int64(repb.ExecutionStage_COMPLETED), "fake-operation-name",
+	).Exec().Error
+	require.NoError(t, err)
+	clock.Advance(time.Minute)
+
+	exec := getExecution(t, ctx, te, execClient.NextExecuteRequest().Payload)
+	assert.Contains(t, exec.Command.GetArguments(), "--commit_sha=f9e7fea9c04d68571cb519e095772c865847007e")
+}
+
+func TestConcurrency_AppliesToDispatchedRuns(t *testing.T) {
+	ctx := context.Background()
+	u, lis := testhttp.NewServer(t)
+	flags.Set(t, "app.build_buddy_url", *u)
+	flags.Set(t, "remote_execution.enable_remote_exec", true)
+	te := newTestEnv(t)
+	ctx, uid, gid := authenticate(t, ctx, te)
+	go http.Serve(lis, te.GetWorkflowService())
+	res := &fakeRemoteExecutionService{}
+	te.SetRemoteExecutionService(res)
+	execClient := te.GetRemoteExecutionClient().(*fakeExecutionClient)
+	provider := setupFakeGitProvider(t, te)
+	provider.TrustedUsers = []string{"acme-inc-user-1"}
+	provider.FileContents = map[string]string{"buildbuddy.yaml": `
+actions:
+  - name: "Deploy"
+    triggers:
+      push: { branches: [ "main" ] }
+      dispatch: {}
+    concurrency: { cancel_in_progress: true }
+    bazel_commands: [ "run //app:deploy" ]
+`}
+	repoURL := makeTempRepo(t)
+	clientConn := runBBServer(ctx, t, te)
+	bbClient := bbspb.NewBuildBuddyServiceClient(clientConn)
+	wfRes, err := bbClient.CreateWorkflow(ctx, &wfpb.CreateWorkflowRequest{
+		RequestContext: testauth.RequestContext(uid, gid),
+		GitRepo:        &gitpb.GitRepo{RepoUrl: repoURL},
+	})
+	require.NoError(t, err)
+
+	provider.WebhookData = pushWebhookData("c04d68571cb519e095772c865847007ed3e7fea9")
+	pingWebhook(t, wfRes.GetWebhookUrl())
+	exec := getExecution(t, ctx, te, execClient.NextExecuteRequest().Payload)
+	pushInvocationID := invocationIDArg(t, exec.Command)
+
+	// A dispatched run of the action on the same branch is in the same
+	// concurrency group, so it cancels the push run.
+	rsp, err := bbClient.DispatchWorkflowAction(ctx, &wfpb.DispatchWorkflowActionRequest{
+		RequestContext: testauth.RequestContext(uid, gid),
+		WorkflowId:     wfRes.GetId(),
+		ActionName:     "Deploy",
+		Branch:         "main",
+	})
+	require.NoError(t, err)
+	exec = getExecution(t, ctx, te, execClient.NextExecuteRequest().Payload)
+	assert.Equal(t, rsp.GetInvocationId(), invocationIDArg(t, exec.Command))
+	require.Eventually(t, func() bool {
+		return slices.Contains(res.Cancelled(), pushInvocationID)
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.NotContains(t, res.Cancelled(), rsp.GetInvocationId())
+}
+
+func actionNameArg(t *testing.T, cmd *repb.Command) string {
+	for _, arg := range cmd.GetArguments() {
+		if name, ok := strings.CutPrefix(arg, "--action_name="); ok {
+			return name
+		}
+	}
+	require.FailNow(t, "missing --action_name arg")
+	return ""
+}
+
+func TestWebhook_PathFilters(t *testing.T) {
+	ctx, te, provider, webhookURL := setupConcurrencyTest(t, false /*=cancelInProgress*/)
+	provider.FileContents = map[string]string{"buildbuddy.yaml": `
+actions:
+  - name: "Backend"
+    triggers: { push: { branches: [ "*" ], paths: [ "backend/**" ] } }
+    bazel_commands: [ "test //backend/..." ]
+  - name: "Docs"
+    triggers: { push: { branches: [ "*" ], paths: [ "docs/**" ] } }
+    bazel_commands: [ "build //docs/..." ]
+`}
+	execClient := te.GetRemoteExecutionClient().(*fakeExecutionClient)
+
+	// Only the action matching the changed files runs.
+	wd := pushWebhookData("c04d68571cb519e095772c865847007ed3e7fea9")
+	wd.BaseSHA = "e782592faf56da05cc0a243220689135e807958f"
+	wd.ChangedFiles = []string{"backend/server/main.go", "README.md"}
+	provider.WebhookData = wd
+	pingWebhook(t, webhookURL)
+	exec := getExecution(t, ctx, te, execClient.NextExecuteRequest().Payload)
+	assert.Equal(t, "Backend", actionNameArg(t, exec.Command))
+	assert.NotContains(t, exec.Command.GetArguments(), "--filter_changed_paths")
+
+	// If the changed files are unknown, both actions run and the CI runner
+	// evaluates the path filters.
+	wd = pushWebhookData("f9e7fea9c04d68571cb519e095772c865847007e")
+	wd.BaseSHA = "c04d68571cb519e095772c865847007ed3e7fea9"
+	provider.WebhookData = wd
+	pingWebhook(t, webhookURL)
+	var actionNames []string
+	for i := 0; i < 2; i++ {
+		exec = getExecution(t, ctx, te, execClient.NextExecuteRequest().Payload)
+		assert.Contains(t, exec.Command.GetArguments(), "--commit_sha=f9e7fea9c04d68571cb519e095772c865847007e")
+		assert.Contains(t, exec.Command.GetArguments(), "--filter_changed_paths")
+		assert.Contains(t, exec.Command.GetArguments(), "--changed_files_base_sha=c04d68571cb519e095772c865847007ed3e7fea9")
+		actionNames = append(actionNames, actionNameArg(t, exec.Command))
+	}
+	assert.ElementsMatch(t, []string{"Backend", "Docs"}, actionNames)
+}
+
+type scheduleTest struct {
+	ctx        context.Context
+	te         *testenv.TestEnv
+	clock      clockwork.FakeClock
+	execClient *fakeExecutionClient
+	bbClient   bbspb.BuildBuddyServiceClient
+	uid, gid   string
+	repoURL    string
+}
+
+func setupScheduleTest(t *testing.T, buildBuddyYAML string) *scheduleTest {
+	ctx := context.Background()
+	u, _ := testhttp.NewServer(t)
+	flags.Set(t, "app.build_buddy_url", *u)
+	flags.Set(t, "remote_execution.enable_remote_exec", true)
+	te := newTestEnv(t)
+	clock := clockwork.NewFakeClockAt(time.Date(2024, 3, 1, 2, 0, 0, 0, time.UTC))
+	te.SetClock(clock)
+	ctx, uid, gid := authenticate(t, ctx, te)
+	provider := setupFakeGitProvider(t, te)
+	provider.FileContents = map[string]string{"buildbuddy.yaml": buildBuddyYAML}
+	repoURL := makeTempRepo(t)
+	clientConn := runBBServer(ctx, t, te)
+	bbClient := bbspb.NewBuildBuddyServiceClient(clientConn)
+	_, err := bbClient.CreateWorkflow(ctx, &wfpb.CreateWorkflowRequest{
+		RequestContext: testauth.RequestContext(uid, gid),
+		GitRepo:        &gitpb.GitRepo{RepoUrl: repoURL},
+	})
+	require.NoError(t, err)
+	return &scheduleTest{
+		ctx:        ctx,
+		te:         te,
+		clock:      clock,
+		execClient: te.GetRemoteExecutionClient().(*fakeExecutionClient),
+		bbClient:   bbClient,
+		uid:        uid,
+		gid:        gid,
+		repoURL:    repoURL,
+	}
+}
+
+func (st *scheduleTest) runSchedules(t *testing.T) {
+	ws := st.te.GetWorkflowService().(interface {
+		RunSchedules(ctx context.Context) error
+	})
+	err := ws.RunSchedules(st.ctx)
+	require.NoError(t, err)
+}
+
+func (st *scheduleTest) advanceTo(t *testing.T, ts time.Time) {
+	st.clock.Advance(ts.Sub(st.clock.Now()))
+}
+
+func TestSchedule_StartsScheduledRun(t *testing.T) {
+	st := setupScheduleTest(t, `
+actions:
+  - name: "Nightly"
+    triggers:
+      schedule:
+        - cron: "0 3 * * *"
+          branch: main
+    bazel_commands: [ "test //..." ]
+`)
+
+	// The first poll only records the schedule.
+	st.runSchedules(t)
+	st.advanceTo(t, time.Date(2024, 3, 1, 2, 59, 0, 0, time.UTC))
+	st.runSchedules(t)
+
+	st.advanceTo(t, time.Date(2024, 3, 1, 3, 1, 0, 0, time.UTC))
+	st.runSchedules(t)
+
+	execReq := st.execClient.NextExecuteRequest()
+	exec := getExecution(t, st.ctx, st.te, execReq.Payload)
+	args := exec.Command.GetArguments()
+	assert.Contains(t, args, "--trigger_event=schedule")
+	assert.Contains(t, args, "--pushed_branch=main")
+	assert.Contains(t, args, "--action_name=Nightly")
+
+	// The run is only started once.
+	st.advanceTo(t, time.Date(2024, 3, 1, 3, 2, 0, 0, time.UTC))
+	st.runSchedules(t)
+}
+
+func TestSchedule_MissedRun(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		catchUp bool
+	}{
+		{name: "Skipped", catchUp: false},
+		{name: "CaughtUp", catchUp: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			st := setupScheduleTest(t, fmt.Sprintf(`
+actions:
+  - name: "Nightly"
+    triggers:
+      schedule:
+        - cron: "0 3 * * *"
+          branch: main
+          catch_up: %t
+    bazel_commands: [ "test //..." ]
+`, test.catchUp))
+			st.runSchedules(t)
+
+			// The schedules aren't polled until hours after the run was due.
+			st.advanceTo(t, time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC))
+			st.runSchedules(t)
+			if test.catchUp {
+				execReq := st.execClient.NextExecuteRequest()
+				exec := getExecution(t, st.ctx, st.te, execReq.Payload)
+				assert.Contains(t, exec.Command.GetArguments(), "--trigger_event=schedule")
+			}
+
+			// The missed run is only considered once.
+			st.advanceTo(t, time.Date(2024, 3, 1, 9, 1, 0, 0, time.UTC))
+			st.runSchedules(t)
+		})
+	}
+}
+
+func TestSchedule_Disabled(t *testing.T) {
+	st := setupScheduleTest(t, `
+actions:
+  - name: "Hourly"
+    triggers:
+      schedule:
+        - cron: "@hourly"
+          branch: main
+    bazel_commands: [ "test //..." ]
+`)
+	st.runSchedules(t)
+
+	_, err := st.bbClient.SetWorkflowSchedulesEnabled(st.ctx, &wfpb.SetWorkflowSchedulesEnabledRequest{
+		RequestContext: testauth.RequestContext(st.uid, st.gid),
+		RepoUrl:        st.repoURL,
+		Enabled:        false,
+	})
+	require.NoError(t, err)
+	st.advanceTo(t, time.Date(2024, 3, 1, 3, 1, 0, 0, time.UTC))
+	st.runSchedules(t)
+
+	_, err = st.bbClient.SetWorkflowSchedulesEnabled(st.ctx, &wfpb.SetWorkflowSchedulesEnabledRequest{
+		RequestContext: testauth.RequestContext(st.uid, st.gid),
+		RepoUrl:        st.repoURL,
+		Enabled:        true,
+	})
+	require.NoError(t, err)
+	st.advanceTo(t, time.Date(2024, 3, 1, 4, 1, 0, 0, time.UTC))
+	st.runSchedules(t)
+
+	execReq := st.execClient.NextExecuteRequest()
+	exec := getExecution(t, st.ctx, st.te, execReq.Payload)
+	assert.Contains(t, exec.Command.GetArguments(), "--action_name=Hourly")
+}
+
+func TestAPIDispatch_ActionFiltering(t *testing.T) {
+	ctx := context.Background()
+	u, lis := testhttp.NewServer(t)
+	flags.Set(t, "app.build_buddy_url", *u)
+	flags.Set(t, "remote_execution.enable_remote_exec", true)
+	flags.Set(t, "remote_execution.enable_kythe_indexing", true)
+
+	te := newTestEnv(t)
+	ctx, uid, gid := authenticate(t, ctx, te)
+	execClient := te.GetRemoteExecutionClient().(*fakeExecutionClient)
+	te.SetRemoteExecutionClient(execClient)
+	go http.Serve(lis, te.GetWorkflowService())
+	_ = setupFakeGitProvider(t, te)
+	repoURL := makeTempRepo(t)
+	clientConn := runBBServer(ctx, t, te)
+	bbClient := bbspb.NewBuildBuddyServiceClient(clientConn)
+	reqCtx := testauth.RequestContext(uid, gid)
+	req := &wfpb.CreateWorkflowRequest{
+		RequestContext: reqCtx,
+		GitRepo:        &gitpb.GitRepo{RepoUrl: repoURL},
+	}
+	wfRes, err := bbClient.CreateWorkflow(ctx, req)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name            string
+		actionFilter    []string
+		kytheEnabled    bool
+		expectedActions []string
+	}{
+		{
+			name:            "no action filter, kythe disabled",
 			actionFilter:    nil,
 			kytheEnabled:    false,
 			expectedActions: []string{"Test all targets"},
@@ -791,3 +1918,389 @@ func TestAPIDispatch_ActionFiltering(t *testing.T) {
 		}
 	}
 }
+
+type mergeQueueTest struct {
+	ctx        context.Context
+	te         *testenv.TestEnv
+	provider   *testgit.FakeProvider
+	execClient *fakeExecutionClient
+	bbClient   bbspb.BuildBuddyServiceClient
+	uid, gid   string
+	repoURL    string
+	webhookURL string
+}
+
+func setupMergeQueueTest(t *testing.T) *mergeQueueTest {
+	ctx := context.Background()
+	u, lis := testhttp.NewServer(t)
+	flags.Set(t, "app.build_buddy_url", *u)
+	flags.Set(t, "remote_execution.enable_remote_exec", true)
+	te := newTestEnv(t)
+	// Enable the merge queue after creating the workflow service, so that the
+	// queues are only processed when the test says so.
+	flags.Set(t, "remote_execution.workflows_enable_merge_queue", true)
+	ctx, uid, gid := authenticate(t, ctx, te)
+	go http.Serve(lis, te.GetWorkflowService())
+	provider := setupFakeGitProvider(t, te)
+	provider.TrustedUsers = []string{"acme-inc-user-1"}
+	provider.FileContents = map[string]string{"buildbuddy.yaml": `
+merge_queue:
+  batch_size: 2
+actions:
+  - name: "Test"
+    triggers: { merge_queue: { branches: [ "main" ] } }
+    bazel_commands: [ "test //..." ]
+`}
+	repoURL := makeTempRepo(t)
+	clientConn := runBBServer(ctx, t, te)
+	bbClient := bbspb.NewBuildBuddyServiceClient(clientConn)
+	wfRes, err := bbClient.CreateWorkflow(ctx, &wfpb.CreateWorkflowRequest{
+		RequestContext: testauth.RequestContext(uid, gid),
+		GitRepo:        &gitpb.GitRepo{RepoUrl: repoURL},
+	})
+	require.NoError(t, err)
+	return &mergeQueueTest{
+		ctx:        ctx,
+		te:         te,
+		provider:   provider,
+		execClient: te.GetRemoteExecutionClient().(*fakeExecutionClient),
+		bbClient:   bbClient,
+		uid:        uid,
+		gid:        gid,
+		repoURL:    repoURL,
+		webhookURL: wfRes.GetWebhookUrl(),
+	}
+}
+
+func mergeQueueWebhookData(eventName string, number int64, sha string) *interfaces.WebhookData {
+	return &interfaces.WebhookData{
+		EventName:         eventName,
+		TargetRepoURL:     "https://github.com/acme-inc/acme",
+		TargetBranch:      "main",
+		PushedRepoURL:     "https://github.com/acme-inc/acme",
+		PushedBranch:      fmt.Sprintf("feature-%d", number),
+		SHA:               sha,
+		PullRequestNumber: number,
+		PullRequestAuthor: "acme-inc-user-2",
+		PullRequestLabel:  "merge-queue",
+		Sender:            "acme-inc-user-1",
+	}
+}
+
+func (mt *mergeQueueTest) getMergeQueue(t *testing.T) []*wfpb.MergeQueueEntry {
+	rsp, err := mt.bbClient.GetMergeQueue(mt.ctx, &wfpb.GetMergeQueueRequest{
+		RequestContext: testauth.RequestContext(mt.uid, mt.gid),
+		RepoUrl:        mt.repoURL,
+	})
+	require.NoError(t, err)
+	return rsp.GetEntry()
+}
+
+// sendEvent sends a webhook event, and waits until the merge queue has the
+// given number of entries.
+func (mt *mergeQueueTest) sendEvent(t *testing.T, wd *interfaces.WebhookData, wantEntries int) {
+	mt.provider.WebhookData = wd
+	pingWebhook(t, mt.webhookURL)
+	require.Eventually(t, func() bool {
+		return len(mt.getMergeQueue(t)) == wantEntries
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func (mt *mergeQueueTest) processMergeQueues(t *testing.T) {
+	ws := mt.te.GetWorkflowService().(interface {
+		ProcessMergeQueues(ctx context.Context) error
+	})
+	err := ws.ProcessMergeQueues(mt.ctx)
+	require.NoError(t, err)
+}
+
+// finishExecution marks the execution of the most recent run as completed
+// with the given exit code.
+func (mt *mergeQueueTest) finishExecution(t *testing.T, exitCode int32) {
+	dbh := mt.te.GetDBHandle()
+	// The fake execution client names every execution "fake-operation-name".
+	err := dbh.NewQuery(mt.ctx, "delete_execution").Raw(`
+		DELETE FROM "Executions" WHERE execution_id = ?`, "fake-operation-name",
+	).Exec().Error
+	require.NoError(t, err)
+	execution := &tables.Execution{
+		ExecutionID: "fake-operation-name",
+		Stage:       int64(repb.ExecutionStage_COMPLETED),
+		ExitCode:    exitCode,
+	}
+	err = dbh.NewQuery(mt.ctx, "create_execution").Create(execution)
+	require.NoError(t, err)
+}
+
+func TestMergeQueue_TestsAndMergesBatch(t *testing.T) {
+	mt := setupMergeQueueTest(t)
+	mt.sendEvent(t, mergeQueueWebhookData("pull_request_labeled", 1, "c04d68571cb519e095772c865847007ed3e7fea9"), 1)
+	mt.sendEvent(t, mergeQueueWebhookData("pull_request_labeled", 2, "e782592faf56da05cc0a243220689135e807958f"), 2)
+
+	mt.processMergeQueues(t)
+	exec := getExecution(t, mt.ctx, mt.te, mt.execClient.NextExecuteRequest().Payload)
+	args := exec.Command.GetArguments()
+	assert.Contains(t, args, "--trigger_event=merge_queue")
+	assert.Contains(t, args, "--action_name=Test")
+	assert.Contains(t, args, "--commit_sha=c04d68571cb519e095772c865847007ed3e7fea9")
+	assert.Contains(t, args, "--merge_commit_sha=e782592faf56da05cc0a243220689135e807958f")
+	entries := mt.getMergeQueue(t)
+	require.Len(t, entries, 2)
+	for _, e := range entries {
+		assert.Equal(t, wfpb.MergeQueueEntry_TESTING, e.GetState())
+		assert.Equal(t, []string{invocationIDArg(t, exec.Command)}, e.GetInvocationId())
+	}
+
+	// Nothing is merged while the run is in progress.
+	mt.processMergeQueues(t)
+	assert.Len(t, mt.getMergeQueue(t), 2)
+
+	mt.finishExecution(t, 0)
+	mt.processMergeQueues(t)
+	assert.Empty(t, mt.getMergeQueue(t))
+	merged := <-mt.provider.MergedPullRequests
+	assert.Equal(t, int64(1), merged.Number)
+	assert.Equal(t, "c04d68571cb519e095772c865847007ed3e7fea9", merged.CommitSHA)
+	assert.Equal(t, "merge", merged.MergeMethod)
+	merged = <-mt.provider.MergedPullRequests
+	assert.Equal(t, int64(2), merged.Number)
+}
+
+func TestMergeQueue_FailedBatchIsTestedOneAtATime(t *testing.T) {
+	mt := setupMergeQueueTest(t)
+	mt.sendEvent(t, mergeQueueWebhookData("pull_request_labeled", 1, "c04d68571cb519e095772c865847007ed3e7fea9"), 1)
+	mt.sendEvent(t, mergeQueueWebhookData("pull_request_labeled", 2, "e782592faf56da05cc0a243220689135e807958f"), 2)
+
+	mt.processMergeQueues(t)
+	mt.execClient.NextExecuteRequest()
+	mt.finishExecution(t, 1)
+	mt.processMergeQueues(t)
+	for _, e := range mt.getMergeQueue(t) {
+		assert.Equal(t, wfpb.MergeQueueEntry_QUEUED, e.GetState())
+	}
+
+	// The first pull request passes on its own.
+	mt.processMergeQueues(t)
+	exec := getExecution(t, mt.ctx, mt.te, mt.execClient.NextExecuteRequest().Payload)
+	assert.Contains(t, exec.Command.GetArguments(), "--commit_sha=c04d68571cb519e095772c865847007ed3e7fea9")
+	for _, arg := range exec.Command.GetArguments() {
+		assert.NotContains(t, arg, "--merge_commit_sha")
+	}
+	mt.finishExecution(t, 0)
+	mt.processMergeQueues(t)
+	merged := <-mt.provider.MergedPullRequests
+	assert.Equal(t, int64(1), merged.Number)
+
+	// The second one fails on its own, and stays in the queue as failed.
+	mt.processMergeQueues(t)
+	exec = getExecution(t, mt.ctx, mt.te, mt.execClient.NextExecuteRequest().Payload)
+	assert.Contains(t, exec.Command.GetArguments(), "--commit_sha=e782592faf56da05cc0a243220689135e807958f")
+	mt.finishExecution(t, 1)
+	mt.processMergeQueues(t)
+	entries := mt.getMergeQueue(t)
+	require.Len(t, entries, 1)
+	assert.Equal(t, int64(2), entries[0].GetPullRequestNumber())
+	assert.Equal(t, wfpb.MergeQueueEntry_FAILED, entries[0].GetState())
+	assert.Equal(t, `Workflow action "Test" failed`, entries[0].GetStatusMessage())
+	mt.processMergeQueues(t)
+	assert.Empty(t, mt.provider.MergedPullRequests)
+}
+
+func TestMergeQueue_BatchWithoutRunsIsRequeued(t *testing.T) {
+	mt := setupMergeQueueTest(t)
+	mt.sendEvent(t, mergeQueueWebhookData("pull_request_labeled", 1, "c04d68571cb519e095772c865847007ed3e7fea9"), 1)
+
+	// Simulate a batch that was claimed a while ago, but whose runs were
+	// never dispatched.
+	dbh := mt.te.GetDBHandle()
+	err := dbh.NewQuery(mt.ctx, "claim_batch").Raw(`
+		UPDATE "MergeQueueEntries" SET state = ?, batch_id = ?, updated_at_usec = ?`,
+		int32(wfpb.MergeQueueEntry_TESTING), "stale-batch", time.Now().Add(-time.Hour).UnixMicro(),
+	).Exec().Error
+	require.NoError(t, err)
+
+	mt.processMergeQueues(t)
+	entries := mt.getMergeQueue(t)
+	require.Len(t, entries, 1)
+	assert.Equal(t, wfpb.MergeQueueEntry_QUEUED, entries[0].GetState())
+	assert.Empty(t, mt.provider.MergedPullRequests)
+
+	// The requeued pull request is tested and merged as usual.
+	mt.processMergeQueues(t)
+	exec := getExecution(t, mt.ctx, mt.te, mt.execClient.NextExecuteRequest().Payload)
+	assert.Contains(t, exec.Command.GetArguments(), "--commit_sha=c04d68571cb519e095772c865847007ed3e7fea9")
+	mt.finishExecution(t, 0)
+	mt.processMergeQueues(t)
+	merged := <-mt.provider.MergedPullRequests
+	assert.Equal(t, int64(1), merged.Number)
+}
+
+func TestMergeQueue_RemovedWhenUnlabeledOrUpdated(t *testing.T) {
+	mt := setupMergeQueueTest(t)
+	mt.sendEvent(t, mergeQueueWebhookData("pull_request_labeled", 1, "c04d68571cb519e095772c865847007ed3e7fea9"), 1)
+	mt.sendEvent(t, mergeQueueWebhookData("pull_request_labeled", 2, "e782592faf56da05cc0a243220689135e807958f"), 2)
+
+	mt.sendEvent(t, mergeQueueWebhookData("pull_request_unlabeled", 1, "c04d68571cb519e095772c865847007ed3e7fea9"), 1)
+
+	// Pushing to a queued pull request removes it from the queue. The push
+	// doesn't start any actions, since none have a pull_request trigger.
+	mt.sendEvent(t, mergeQueueWebhookData("pull_request", 2, "f9e7fea9c04d68571cb519e095772c865847007e"), 0)
+}
+
+func TestMergeQueue_ForkPushedAfterLabelIsNotQueued(t *testing.T) {
+	mt := setupMergeQueueTest(t)
+	const forkURL = "https://github.com/some-user/acme-fork"
+	const sha = "c04d68571cb519e095772c865847007ed3e7fea9"
+	labeledAt := time.Now()
+	mt.provider.PullRequests = map[int64]*interfaces.WebhookData{
+		1: {
+			TargetRepoURL:      "https://github.com/acme-inc/acme",
+			TargetBranch:       "main",
+			PushedRepoURL:      forkURL,
+			PushedBranch:       "feature-1",
+			SHA:                sha,
+			PullRequestNumber:  1,
+			PushedRepoPushedAt: labeledAt.Add(time.Minute),
+		},
+	}
+	labelFork := func() *interfaces.WebhookData {
+		wd := mergeQueueWebhookData("pull_request_labeled", 1, sha)
+		wd.PushedRepoURL = forkURL
+		wd.PullRequestLabeledAt = labeledAt
+		return wd
+	}
+
+	// The fork was pushed to after the label was added, so the labeled head
+	// may not be the one the user looked at.
+	mt.provider.WebhookData = labelFork()
+	pingWebhook(t, mt.webhookURL)
+	select {
+	case s := <-mt.provider.Statuses:
+		payload := s.Payload.(*github.GithubStatusPayload)
+		assert.Equal(t, sha, s.CommitSHA)
+		assert.Equal(t, "error", payload.GetState())
+		assert.Contains(t, payload.GetDescription(), "re-add the label")
+	case <-time.After(10 * time.Second):
+		require.FailNow(t, "timed out waiting for merge queue status")
+	}
+	assert.Empty(t, mt.getMergeQueue(t))
+
+	// Forks that weren't pushed to since the label are queued.
+	mt.provider.PullRequests[1].PushedRepoPushedAt = labeledAt.Add(-time.Minute)
+	mt.sendEvent(t, labelFork(), 1)
+}
+
+// fakeByteStreamClient serves blobs keyed by their bytestream URI path.
+type fakeByteStreamClient struct {
+	interfaces.PooledByteStreamClient
+	blobs map[string][]byte
+}
+
+func (c *fakeByteStreamClient) StreamBytestreamFile(ctx context.Context, u *url.URL, w io.Writer) error {
+	b, ok := c.blobs[u.Path]
+	if !ok {
+		return status.NotFoundErrorf("%s not found", u)
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func TestArtifacts(t *testing.T) {
+	flags.Set(t, "remote_execution.workflows_artifact_ttl", 24*time.Hour)
+	te := newTestEnv(t)
+	clock := clockwork.NewFakeClock()
+	te.SetClock(clock)
+	ctx, uid, gid := authenticate(t, context.Background(), te)
+	otherCtx, _, _ := authenticateAsUser(t, context.Background(), te, "US2")
+	clientConn := runBBServer(ctx, t, te)
+	bbClient := bbspb.NewBuildBuddyServiceClient(clientConn)
+	bsClient := &fakeByteStreamClient{blobs: map[string][]byte{}}
+	te.SetPooledByteStreamClient(bsClient)
+
+	const invocationID = "4fd0e5a4-8b0c-4c0a-9f3c-6a4b3b1c2d5e"
+	_, err := te.GetInvocationDB().CreateInvocation(ctx, &tables.Invocation{
+		InvocationID: invocationID,
+		GroupID:      gid,
+		Perms:        perms.GROUP_READ | perms.GROUP_WRITE,
+	})
+	require.NoError(t, err)
+
+	file := func(name, contents string) *bespb.File {
+		d, err := digest.Compute(strings.NewReader(contents), repb.DigestFunction_SHA256)
+		require.NoError(t, err)
+		path := fmt.Sprintf("/blobs/%s/%d", d.GetHash(), d.GetSizeBytes())
+		bsClient.blobs[path] = []byte(contents)
+		return &bespb.File{
+			Name:   name,
+			File:   &bespb.File_Uri{Uri: "bytestream://localhost:1985" + path},
+			Digest: d.GetHash(),
+			Length: d.GetSizeBytes(),
+		}
+	}
+	artifacts := []*bespb.WorkflowArtifactPublished{
+		{Name: "release", Files: []*bespb.File{file("bazel-bin/app/app.tar", "tar")}},
+		{Name: "test-logs", Files: []*bespb.File{file("bazel-testlogs/a/test.log", "a"), file("bazel-testlogs/b/test.log", "b")}},
+	}
+	ws := te.GetWorkflowService()
+	err = ws.PersistArtifacts(ctx, invocationID, artifacts)
+	require.NoError(t, err)
+
+	// Once persisted, the files are served from the blobstore, even if
+	// they've been evicted from the cache.
+	clear(bsClient.blobs)
+	rsp, err := bbClient.GetWorkflowArtifacts(ctx, &wfpb.GetWorkflowArtifactsRequest{
+		RequestContext: testauth.RequestContext(uid, gid),
+		InvocationId:   invocationID,
+	})
+	require.NoError(t, err)
+	expiresAt := clock.Now().Add(24 * time.Hour).UnixMicro()
+	assert.Empty(t, cmp.Diff([]*wfpb.WorkflowArtifact{
+		{
+			Name:          "release",
+			File:          []*wfpb.WorkflowArtifact_File{{Name: "bazel-bin/app/app.tar", Digest: artifacts[0].Files[0].Digest, SizeBytes: 3}},
+			ExpiresAtUsec: expiresAt,
+		},
+		{
+			Name: "test-logs",
+			File: []*wfpb.WorkflowArtifact_File{
+				{Name: "bazel-testlogs/a/test.log", Digest: artifacts[1].Files[0].Digest, SizeBytes: 1},
+				{Name: "bazel-testlogs/b/test.log", Digest: artifacts[1].Files[1].Digest, SizeBytes: 1},
+			},
+			ExpiresAtUsec: expiresAt,
+		},
+	}, rsp.GetArtifact(), protocmp.Transform()))
+	b, err := ws.ReadWorkflowArtifact(ctx, invocationID, "test-logs", "bazel-testlogs/b/test.log")
+	require.NoError(t, err)
+	assert.Equal(t, "b", string(b))
+	_, err = ws.ReadWorkflowArtifact(ctx, invocationID, "release", "bazel-testlogs/b/test.log")
+	assert.True(t, status.IsNotFoundError(err), "%v", err)
+
+	// Other groups can't access the artifacts.
+	_, err = ws.ReadWorkflowArtifact(otherCtx, invocationID, "release", "bazel-bin/app/app.tar")
+	assert.True(t, status.IsPermissionDeniedError(err), "%v", err)
+
+	// Expired artifacts are no longer listed, and are deleted.
+	rq := te.GetDBHandle().NewQuery(ctx, "get_artifacts").Raw(`SELECT * FROM "WorkflowArtifacts"`)
+	rows, err := db.ScanAll(rq, &tables.WorkflowArtifact{})
+	require.NoError(t, err)
+	require.Len(t, rows, 3)
+	clock.Advance(24 * time.Hour)
+	rsp, err = bbClient.GetWorkflowArtifacts(ctx, &wfpb.GetWorkflowArtifactsRequest{
+		RequestContext: testauth.RequestContext(uid, gid),
+		InvocationId:   invocationID,
+	})
+	require.NoError(t, err)
+	assert.Empty(t, rsp.GetArtifact())
+	err = ws.(interface {
+		DeleteExpiredArtifacts(ctx context.Context) error
+	}).DeleteExpiredArtifacts(ctx)
+	require.NoError(t, err)
+	for _, row := range rows {
+		exists, err := te.GetBlobstore().BlobExists(ctx, row.BlobName)
+		require.NoError(t, err)
+		assert.False(t, exists, "blob %s should be deleted", row.BlobName)
+	}
+	rows, err = db.ScanAll(rq, &tables.WorkflowArtifact{})
+	require.NoError(t, err)
+	assert.Empty(t, rows)
+}
@@ -0,0 +1,70 @@
+package service
+
+import (
+	"encoding/base64"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/random"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+var (
+	enableWebhookSecrets     = flag.Bool("remote_execution.workflows_enable_webhook_secrets", false, "If true, new workflows are created with a webhook secret, and deliveries to their webhooks must be signed with it. The secrets are encrypted with the KMS master key, which must be configured.")
+	requireWebhookSignatures = flag.Bool("remote_execution.workflows_require_webhook_signatures", false, "If true, reject webhook deliveries for workflows that don't have a webhook secret, as well as deliveries from Git providers that don't support signatures.")
+)
+
+const webhookSecretLength = 32
+
+// webhookSecretsEnabled returns whether new workflows are created with a
+// webhook secret.
+func webhookSecretsEnabled() bool {
+	return *enableWebhookSecrets
+}
+
+func webhookSecretKey(env environment.Env) (interfaces.AEAD, error) {
+	kms := env.GetKMS()
+	if kms == nil {
+		return nil, status.FailedPreconditionError("No KMS was configured to encrypt webhook secrets")
+	}
+	return kms.FetchMasterKey()
+}
+
+// newWebhookSecret generates a webhook secret for the given workflow and
+// returns it along with its encrypted form, for storage in the Workflows
+// table. The encrypted secret is bound to the workflow ID, so that it can't
+// be used for another workflow.
+func newWebhookSecret(env environment.Env, workflowID string) (secret, encrypted string, err error) {
+	secret, err = random.RandomString(webhookSecretLength)
+	if err != nil {
+		return "", "", status.InternalErrorf("generate webhook secret: %s", err)
+	}
+	key, err := webhookSecretKey(env)
+	if err != nil {
+		return "", "", err
+	}
+	ciphertext, err := key.Encrypt([]byte(secret), []byte(workflowID))
+	if err != nil {
+		return "", "", status.InternalErrorf("encrypt webhook secret: %s", err)
+	}
+	return secret, base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// decryptWebhookSecret decrypts a webhook secret that was encrypted with
+// newWebhookSecret for the given workflow.
+func decryptWebhookSecret(env environment.Env, workflowID, encrypted string) (string, error) {
+	key, err := webhookSecretKey(env)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", status.InternalError("malformed webhook secret")
+	}
+	secret, err := key.Decrypt(ciphertext, []byte(workflowID))
+	if err != nil {
+		return "", status.InternalErrorf("decrypt webhook secret: %s", err)
+	}
+	return string(secret), nil
+}
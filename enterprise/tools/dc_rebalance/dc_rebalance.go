@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"io"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/grpc_client"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"golang.org/x/sync/errgroup"
+
+	dcpb "github.com/buildbuddy-io/buildbuddy/proto/distributed_cache"
+)
+
+var (
+	peers      = flag.Slice("peers", []string{}, "The distributed cache peers (host:port) to copy data from. Usually every node except the target.")
+	targetPeer = flag.String("target_peer", "", "The distributed cache peer (host:port) to copy data to, typically a node that just replaced another one.")
+)
+
+// This tool restores the replicas held by a replaced distributed cache node.
+// It asks each of the given peers to copy the entries that the target peer is
+// now responsible for to it, and logs their progress. Peers copy data at the
+// rate set by their cache.distributed_cache.rebalance_max_bytes_per_second
+// flag.
+//
+//	Ex. bazel run //enterprise/tools/dc_rebalance -- \
+//			--peers=cache-0:1991 --peers=cache-1:1991 \
+//			--target_peer=cache-2:1991
+func main() {
+	flag.Parse()
+	if err := log.Configure(); err != nil {
+		log.Fatalf("Could not configure logger: %s", err)
+	}
+	if *targetPeer == "" || len(*peers) == 0 {
+		log.Fatalf("--peers and --target_peer are required.")
+	}
+
+	eg, ctx := errgroup.WithContext(context.Background())
+	for _, peer := range *peers {
+		if peer == *targetPeer {
+			continue
+		}
+		eg.Go(func() error {
+			if err := rebalance(ctx, peer); err != nil {
+				return status.WrapErrorf(err, "rebalance from %q", peer)
+			}
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		log.Fatalf("Rebalance failed: %s", err)
+	}
+	log.Infof("Rebalance to %q finished.", *targetPeer)
+}
+
+func rebalance(ctx context.Context, peer string) error {
+	conn, err := grpc_client.DialSimple("grpc://" + peer)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stream, err := dcpb.NewDistributedCacheClient(conn).Rebalance(ctx, &dcpb.RebalanceRequest{TargetPeer: *targetPeer})
+	if err != nil {
+		return err
+	}
+	for {
+		rsp, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		log.Infof("%s: scanned %d entries, copied %d (%d bytes), %d failed", peer, rsp.GetEntriesScanned(), rsp.GetEntriesCopied(), rsp.GetBytesCopied(), rsp.GetEntriesFailed())
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/pebble_cache"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/healthcheck"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+)
+
+var (
+	configPath = flag.String("config_path", "config.yaml", "Path to the server config file. The cache.pebble settings in it determine which cache is collected.")
+	minAge     = flag.Duration("min_age", 24*time.Hour, "Unreachable CAS entries accessed more recently than this are kept.")
+	dryRun     = flag.Bool("dry_run", true, "If true, only report what would be deleted.")
+)
+
+// This tool deletes CAS entries from a pebble cache that are not referenced
+// by any ActionResult (directly, or through an output directory's Tree). It
+// is intended for deployments that disable LRU eviction and must be run
+// while no server is using the cache directory.
+//
+//	Ex. bazel run //enterprise/tools/pebble_gc -- \
+//			--config_path=/path/to/config.yaml \
+//			--min_age=72h \
+//			--dry_run=false
+func main() {
+	flag.Parse()
+	if err := config.LoadFromFile(*configPath); err != nil {
+		log.Fatalf("Could not read config from %s: %s", *configPath, err)
+	}
+	if err := log.Configure(); err != nil {
+		log.Fatalf("Could not configure logger: %s", err)
+	}
+
+	env := real_environment.NewRealEnv(healthcheck.NewHealthChecker("pebble_gc"))
+	if err := pebble_cache.Register(env); err != nil {
+		log.Fatalf("Error configuring pebble cache: %s", err)
+	}
+	pc, ok := env.GetCache().(*pebble_cache.PebbleCache)
+	if !ok {
+		log.Fatalf("No pebble cache configured; set cache.pebble.root_directory.")
+	}
+	defer pc.Stop()
+
+	res, err := pc.CollectGarbage(env.GetServerContext(), &pebble_cache.GCOptions{
+		MinAge: *minAge,
+		DryRun: *dryRun,
+	})
+	if err != nil {
+		log.Fatalf("Garbage collection failed: %s", err)
+	}
+	verb := "Deleted"
+	if *dryRun {
+		verb = "Would delete"
+	}
+	log.Infof("Scanned %d action results (%d reachable digests) and %d CAS entries.", res.ActionResultsScanned, res.ReachableDigests, res.CASEntriesScanned)
+	log.Infof("%s %d entries (%d bytes).", verb, res.DeletedEntries, res.DeletedBytes)
+	if len(res.SkippedPartitions) > 0 {
+		log.Warningf("Skipped partitions with unreadable action results or trees: %v", res.SkippedPartitions)
+	}
+}
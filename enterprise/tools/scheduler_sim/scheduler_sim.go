@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/simulator"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	tasksPath  = flag.String("tasks", "", "Path to the recorded tasks to replay, in JSON lines format. See the simulator package for how to export tasks from production.")
+	configPath = flag.String("config", "", "Path to the YAML scheduler configuration to simulate.")
+)
+
+// Replays recorded task submissions against a scheduler configuration, and
+// reports the simulated queue times of each pool.
+//
+// Example config:
+//
+//	pools:
+//	  - name: ""
+//	    executors: 20
+//	    milli_cpu: 8000
+//	    memory_bytes: 32000000000
+//	routing: random
+//	probes: 3
+//
+// Example usage:
+//
+//	$ bazel run //enterprise/tools/scheduler_sim -- \
+//	  --tasks=/tmp/tasks.jsonl --config=/tmp/config.yaml
+func main() {
+	flag.Parse()
+	if err := log.Configure(); err != nil {
+		log.Fatalf("Failed to configure logging: %s", err)
+	}
+	if *tasksPath == "" || *configPath == "" {
+		log.Fatalf("--tasks and --config are required")
+	}
+
+	b, err := os.ReadFile(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to read config: %s", err)
+	}
+	cfg := &simulator.Config{}
+	if err := yaml.Unmarshal(b, cfg); err != nil {
+		log.Fatalf("Failed to parse config: %s", err)
+	}
+
+	f, err := os.Open(*tasksPath)
+	if err != nil {
+		log.Fatalf("Failed to open tasks: %s", err)
+	}
+	defer f.Close()
+	tasks, err := simulator.ReadTasks(f)
+	if err != nil {
+		log.Fatalf("Failed to read tasks: %s", err)
+	}
+
+	log.Infof("Simulating %d tasks", len(tasks))
+	report, err := simulator.Run(cfg, tasks)
+	if err != nil {
+		log.Fatalf("Simulation failed: %s", err)
+	}
+	if err := report.Write(os.Stdout); err != nil {
+		log.Fatalf("Failed to write report: %s", err)
+	}
+}
@@ -0,0 +1,331 @@
+// vmdebug is a client for the VMDebug service, which executors serve when
+// --executor.firecracker_vm_debug_socket_path is set. It can run commands,
+// copy files, and forward ports in running firecracker VMs.
+//
+// To use it on a live executor pod:
+//
+// $ bazel build enterprise/tools/vmdebug
+// $ kubectl cp ./bazel-bin/enterprise/tools/vmdebug/vmdebug_/vmdebug executor-prod/executor-abc-123:/usr/local/bin/vmdebug
+// $ kubectl exec -n executor-prod executor-abc-123 -- bash
+// # vmdebug ls -socket_path=/tmp/vmdebug.sock
+// # vmdebug exec -socket_path=/tmp/vmdebug.sock -vm_id={vmid} sh -c 'ls /workspace'
+// # vmdebug cp -socket_path=/tmp/vmdebug.sock -vm_id={vmid} vm:/workspace/test.log ./test.log
+// # vmdebug cp -socket_path=/tmp/vmdebug.sock -vm_id={vmid} ./script.sh vm:/tmp/script.sh
+// # vmdebug forward -socket_path=/tmp/vmdebug.sock -vm_id={vmid} 8080:80
+//
+// The socket only accepts connections from the executor's user, so vmdebug
+// must run as that user.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/commandutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	vmdbpb "github.com/buildbuddy-io/buildbuddy/proto/vmdebug"
+	vmxpb "github.com/buildbuddy-io/buildbuddy/proto/vmexec"
+	gstatus "google.golang.org/grpc/status"
+)
+
+var (
+	socketPath       = flag.String("socket_path", "/tmp/vmdebug.sock", "Path of the executor's VM debug socket, as set by --executor.firecracker_vm_debug_socket_path.")
+	vmID             = flag.String("vm_id", "", "ID of the VM to debug, as shown by 'vmdebug ls'.")
+	workingDirectory = flag.String("working_directory", "/workspace", "Working directory to run commands from.")
+	path             = flag.String("path", "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin", "The PATH to use when executing commands.")
+	user             = flag.String("user", "", "User to run commands as. Defaults to root.")
+)
+
+const (
+	usage = `Usage: vmdebug <ls|exec|cp|forward> [flags] [args]
+
+  ls                               List the VMs running on the executor.
+  exec COMMAND [ARGS...]           Run a command in a VM.
+  cp vm:SRC DST | SRC vm:DST       Copy a file from or to a VM.
+  forward LOCAL_PORT:VM_PORT       Forward a local port to a port in a VM.
+`
+	vmPathPrefix = "vm:"
+	chunkSize    = 64 * 1024
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	subcommand := os.Args[1]
+	if err := flag.CommandLine.Parse(os.Args[2:]); err != nil {
+		log.Fatal(err.Error())
+	}
+	ctx := context.Background()
+	conn, err := grpc.NewClient("unix://"+*socketPath, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatalf("Failed to connect to %s: %s", *socketPath, err)
+	}
+	defer conn.Close()
+	client := vmdbpb.NewVMDebugClient(conn)
+
+	switch subcommand {
+	case "ls":
+		err = list(ctx, client)
+	case "exec":
+		var exitCode int
+		exitCode, err = execute(ctx, client, flag.Args())
+		if err == nil {
+			os.Exit(exitCode)
+		}
+	case "cp":
+		err = copyFile(ctx, client, flag.Args())
+	case "forward":
+		err = forward(ctx, client, flag.Args())
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("%s failed: %s", subcommand, err)
+	}
+}
+
+func list(ctx context.Context, client vmdbpb.VMDebugClient) error {
+	rsp, err := client.ListVMs(ctx, &vmdbpb.ListVMsRequest{})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-40s %-60s %-8s %s\n", "VM ID", "EXECUTION ID", "RECYCLED", "IMAGE")
+	for _, vm := range rsp.GetVms() {
+		fmt.Printf("%-40s %-60s %-8t %s\n", vm.GetVmId(), vm.GetExecutionId(), vm.GetRecycled(), vm.GetContainerImage())
+	}
+	return nil
+}
+
+func execute(ctx context.Context, client vmdbpb.VMDebugClient, args []string) (int, error) {
+	if len(args) == 0 {
+		return 0, status.InvalidArgumentError("missing command")
+	}
+	stream, err := client.Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+	err = stream.Send(&vmdbpb.ExecRequest{
+		VmId: *vmID,
+		Request: &vmxpb.ExecStreamedRequest{
+			Start: &vmxpb.ExecRequest{
+				Arguments:        args,
+				WorkingDirectory: *workingDirectory,
+				User:             *user,
+				OpenStdin:        true,
+				EnvironmentVariables: []*vmxpb.ExecRequest_EnvironmentVariable{
+					{Name: "PATH", Value: *path},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	go func() {
+		buf := make([]byte, chunkSize)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if n > 0 {
+				if err := stream.Send(&vmdbpb.ExecRequest{Request: &vmxpb.ExecStreamedRequest{Stdin: buf[:n]}}); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				stream.CloseSend()
+				return
+			}
+		}
+	}()
+	exitCode := commandutil.NoExitCode
+	for {
+		rsp, err := stream.Recv()
+		if err == io.EOF {
+			return exitCode, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		os.Stdout.Write(rsp.GetStdout())
+		os.Stderr.Write(rsp.GetStderr())
+		if res := rsp.GetResponse(); res != nil {
+			if err := gstatus.ErrorProto(res.GetStatus()); err != nil {
+				return 0, err
+			}
+			exitCode = int(res.GetExitCode())
+		}
+	}
+}
+
+func copyFile(ctx context.Context, client vmdbpb.VMDebugClient, args []string) error {
+	if len(args) != 2 {
+		return status.InvalidArgumentError("expected exactly 2 arguments: SRC DST")
+	}
+	src, dst := args[0], args[1]
+	if guestPath, ok := strings.CutPrefix(src, vmPathPrefix); ok {
+		return pull(ctx, client, guestPath, dst)
+	}
+	if guestPath, ok := strings.CutPrefix(dst, vmPathPrefix); ok {
+		return push(ctx, client, src, guestPath)
+	}
+	return status.InvalidArgumentErrorf("either SRC or DST must start with %q", vmPathPrefix)
+}
+
+func pull(ctx context.Context, client vmdbpb.VMDebugClient, guestPath, localPath string) error {
+	stream, err := client.ReadFile(ctx, &vmdbpb.ReadFileRequest{
+		VmId:    *vmID,
+		Request: &vmxpb.ReadFileRequest{Path: guestPath},
+	})
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for {
+		rsp, err := stream.Recv()
+		if err == io.EOF {
+			return f.Close()
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(rsp.GetData()); err != nil {
+			return err
+		}
+	}
+}
+
+func push(ctx context.Context, client vmdbpb.VMDebugClient, localPath, guestPath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	stream, err := client.WriteFile(ctx)
+	if err != nil {
+		return err
+	}
+	req := &vmdbpb.WriteFileRequest{
+		VmId:    *vmID,
+		Request: &vmxpb.WriteFileRequest{Path: guestPath, Mode: uint32(info.Mode().Perm())},
+	}
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			req.Request.Data = buf[:n]
+			if err := stream.Send(req); err != nil {
+				return err
+			}
+			req = &vmdbpb.WriteFileRequest{Request: &vmxpb.WriteFileRequest{}}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if req.GetVmId() != "" {
+		// The file is empty; send the initial request without data.
+		if err := stream.Send(req); err != nil {
+			return err
+		}
+	}
+	rsp, err := stream.CloseAndRecv()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %d bytes to %s\n", rsp.GetSizeBytes(), guestPath)
+	return nil
+}
+
+func forward(ctx context.Context, client vmdbpb.VMDebugClient, args []string) error {
+	if len(args) != 1 {
+		return status.InvalidArgumentError("expected exactly 1 argument: LOCAL_PORT:VM_PORT")
+	}
+	localPort, guestPortStr, ok := strings.Cut(args[0], ":")
+	if !ok {
+		return status.InvalidArgumentErrorf("invalid port mapping %q", args[0])
+	}
+	guestPort, err := strconv.Atoi(guestPortStr)
+	if err != nil {
+		return status.InvalidArgumentErrorf("invalid VM port %q", guestPortStr)
+	}
+	lis, err := net.Listen("tcp", "localhost:"+localPort)
+	if err != nil {
+		return err
+	}
+	defer lis.Close()
+	log.Infof("Forwarding %s to port %d in VM %s", lis.Addr(), guestPort, *vmID)
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := forwardConn(ctx, client, conn, int32(guestPort)); err != nil {
+				log.Warningf("Port forwarding connection failed: %s", err)
+			}
+		}()
+	}
+}
+
+func forwardConn(ctx context.Context, client vmdbpb.VMDebugClient, conn net.Conn, guestPort int32) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.ForwardPort(ctx)
+	if err != nil {
+		return err
+	}
+	if err := stream.Send(&vmdbpb.ForwardPortRequest{VmId: *vmID, Request: &vmxpb.ForwardPortRequest{Port: guestPort}}); err != nil {
+		return err
+	}
+	go func() {
+		buf := make([]byte, chunkSize)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				if err := stream.Send(&vmdbpb.ForwardPortRequest{Request: &vmxpb.ForwardPortRequest{Data: buf[:n]}}); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				stream.CloseSend()
+				return
+			}
+		}
+	}()
+	for {
+		rsp, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Write(rsp.GetData()); err != nil {
+			return err
+		}
+	}
+}
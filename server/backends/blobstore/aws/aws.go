@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
@@ -40,12 +41,21 @@ var (
 	awsS3StaticCredentialsToken   = flag.String("storage.aws_s3.static_credentials_token", "", "Static credentials token to use, useful for configuring the use of MinIO.")
 	awsS3DisableSSL               = flag.Bool("storage.aws_s3.disable_ssl", false, "Disables the use of SSL, useful for configuring the use of MinIO.", flag.Deprecated("Specify a non-HTTPS endpoint instead."))
 	awsS3ForcePathStyle           = flag.Bool("storage.aws_s3.s3_force_path_style", false, "Force path style urls for objects, useful for configuring the use of MinIO.")
+	awsS3Compatible               = flag.Bool("storage.aws_s3.s3_compatible", false, "If true, the bucket is served by an S3-compatible store (MinIO, Ceph, etc.) at storage.aws_s3.endpoint rather than by AWS. Implies path style urls.")
+	awsS3MultipartThresholdBytes  = flag.Int64("storage.aws_s3.multipart_threshold_bytes", s3manager.DefaultUploadPartSize, "Blobs larger than this are uploaded using multipart uploads, in parts of this size. Must be at least 5MiB.")
+	awsS3MultipartConcurrency     = flag.Int("storage.aws_s3.multipart_concurrency", s3manager.DefaultUploadConcurrency, "The number of parts of a single multipart upload that are uploaded in parallel.")
+	awsS3MaxRetryAttempts         = flag.Int("storage.aws_s3.max_retry_attempts", retry.DefaultMaxAttempts, "The maximum number of attempts for a request that fails with a retryable error, such as a 5xx response.")
+	awsS3MaxRetryBackoff          = flag.Duration("storage.aws_s3.max_retry_backoff", retry.DefaultMaxBackoff, "The maximum delay between attempts of a retried request.")
 )
 
 const (
 	// Prometheus BlobstoreTypeLabel values
 	awsS3Label        = "aws_s3"
 	bucketWaitTimeout = 10 * time.Second
+
+	// S3-compatible stores still require a region to sign requests, but
+	// most of them ignore its value.
+	defaultS3CompatibleRegion = "us-east-1"
 )
 
 // AWS stuff
@@ -61,8 +71,28 @@ func UseAwsS3BlobStore() bool {
 }
 
 func NewAwsS3BlobStore(ctx context.Context) (*AwsS3BlobStore, error) {
+	region := *awsS3Region
+	if *awsS3Compatible {
+		if *awsS3Endpoint == "" {
+			return nil, status.FailedPreconditionError("storage.aws_s3.endpoint must be set when storage.aws_s3.s3_compatible is enabled")
+		}
+		if region == "" {
+			region = defaultS3CompatibleRegion
+		}
+	}
+	if *awsS3MultipartThresholdBytes < s3manager.MinUploadPartSize {
+		return nil, status.InvalidArgumentErrorf("storage.aws_s3.multipart_threshold_bytes must be at least %d", s3manager.MinUploadPartSize)
+	}
 	configOptions := []func(*config.LoadOptions) error{
-		config.WithRegion(*awsS3Region),
+		config.WithRegion(region),
+		// The standard retryer retries throttling errors and 5xx responses
+		// with exponential backoff and jitter.
+		config.WithRetryer(func() aws.Retryer {
+			return retry.NewStandard(func(o *retry.StandardOptions) {
+				o.MaxAttempts = *awsS3MaxRetryAttempts
+				o.MaxBackoff = *awsS3MaxRetryBackoff
+			})
+		}),
 	}
 	// See https://docs.aws.amazon.com/sdk-for-go/v1/developer-guide/configuring-sdk.html#specifying-credentials
 	if *awsS3CredentialsProfile != "" {
@@ -82,7 +112,7 @@ func NewAwsS3BlobStore(ctx context.Context) (*AwsS3BlobStore, error) {
 				func(_, _ string, _ ...interface{}) (aws.Endpoint, error) {
 					return aws.Endpoint{
 						URL:               *awsS3Endpoint,
-						SigningRegion:     *awsS3Region,
+						SigningRegion:     region,
 						HostnameImmutable: true,
 					}, nil
 				},
@@ -111,8 +141,12 @@ func NewAwsS3BlobStore(ctx context.Context) (*AwsS3BlobStore, error) {
 	client := s3.NewFromConfig(
 		cfg,
 		func(o *s3.Options) {
-			log.Debug("AWS blobstore forcing path style")
-			o.UsePathStyle = *awsS3ForcePathStyle
+			// S3-compatible stores generally don't support virtual-hosted
+			// style urls, which require wildcard DNS for the endpoint.
+			if *awsS3ForcePathStyle || *awsS3Compatible {
+				log.Debug("AWS blobstore forcing path style")
+				o.UsePathStyle = true
+			}
 		},
 	)
 	log.Debug("AWS blobstore service client created")
@@ -121,13 +155,16 @@ func NewAwsS3BlobStore(ctx context.Context) (*AwsS3BlobStore, error) {
 		client:     client,
 		bucket:     awsS3Bucket,
 		downloader: s3manager.NewDownloader(client),
-		uploader:   s3manager.NewUploader(client),
+		uploader: s3manager.NewUploader(client, func(u *s3manager.Uploader) {
+			u.PartSize = *awsS3MultipartThresholdBytes
+			u.Concurrency = *awsS3MultipartConcurrency
+		}),
 	}
 
 	// S3 access points can't modify or delete buckets
 	// https://github.com/awsdocs/amazon-s3-developer-guide/blob/master/doc_source/access-points.md
 	const s3AccessPointPrefix = "arn:aws:s3"
-	if strings.HasPrefix(*awsS3Bucket, s3AccessPointPrefix) {
+	if !*awsS3Compatible && strings.HasPrefix(*awsS3Bucket, s3AccessPointPrefix) {
 		log.Infof("Encountered an S3 access point %s...not creating bucket", *awsS3Bucket)
 	} else {
 		if err := awsBlobStore.createBucketIfNotExists(ctx, *awsS3Bucket); err != nil {
@@ -197,6 +234,7 @@ func (a *AwsS3BlobStore) download(ctx context.Context, blobName string) ([]byte,
 		if errors.As(err, &nsk) {
 			return nil, status.NotFoundError(err.Error())
 		}
+		return nil, err
 	}
 
 	return buff.Bytes(), nil
@@ -0,0 +1,235 @@
+package aws_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/backends/blobstore/aws"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testBucket = "test-bucket"
+
+// fakeS3 is a minimal path style S3 server, supporting the requests made by
+// the blobstore.
+type fakeS3 struct {
+	t *testing.T
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	// Parts of in-progress multipart uploads, by upload ID and part number.
+	uploads map[string]map[int][]byte
+	// Number of parts of each completed multipart upload, by key.
+	multipartUploads map[string]int
+	// Number of object writes that fail with a 500 before succeeding.
+	failWrites int
+	paths      []string
+	authHeader string
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, string) {
+	f := &fakeS3{
+		t:                t,
+		objects:          make(map[string][]byte),
+		uploads:          make(map[string]map[int][]byte),
+		multipartUploads: make(map[string]int),
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, server.URL
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.paths = append(f.paths, r.URL.Path)
+	f.authHeader = r.Header.Get("Authorization")
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != testBucket {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	if key == "" {
+		// HeadBucket
+		return
+	}
+	q := r.URL.Query()
+	body, err := io.ReadAll(r.Body)
+	require.NoError(f.t, err)
+	switch {
+	case r.Method == http.MethodPut && f.failWrites > 0:
+		f.failWrites--
+		writeS3Error(w, http.StatusInternalServerError, "InternalError")
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		uploadID := strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[uploadID] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", bucket, key, uploadID)
+	case r.Method == http.MethodPut && q.Has("uploadId"):
+		partNumber, err := strconv.Atoi(q.Get("partNumber"))
+		require.NoError(f.t, err)
+		f.uploads[q.Get("uploadId")][partNumber] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, partNumber))
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		parts := f.uploads[q.Get("uploadId")]
+		var numbers []int
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		var object []byte
+		for _, n := range numbers {
+			object = append(object, parts[n]...)
+		}
+		f.objects[key] = object
+		f.multipartUploads[key] = len(parts)
+		delete(f.uploads, q.Get("uploadId"))
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key></CompleteMultipartUploadResult>", bucket, key)
+	case r.Method == http.MethodPut:
+		f.objects[key] = body
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		object, ok := f.objects[key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		start, end := 0, len(object)-1
+		if rng, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes="); ok {
+			s, e, _ := strings.Cut(rng, "-")
+			start, _ = strconv.Atoi(s)
+			end, _ = strconv.Atoi(e)
+			end = min(end, len(object)-1)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(object)))
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+		if r.Method == http.MethodGet {
+			w.Write(object[start : end+1])
+		}
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func writeS3Error(w http.ResponseWriter, statusCode int, code string) {
+	w.WriteHeader(statusCode)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func setS3CompatibleFlags(t *testing.T, endpoint string) {
+	flags.Set(t, "storage.aws_s3.bucket", testBucket)
+	flags.Set(t, "storage.aws_s3.endpoint", endpoint)
+	flags.Set(t, "storage.aws_s3.s3_compatible", true)
+	flags.Set(t, "storage.aws_s3.static_credentials_id", "test-id")
+	flags.Set(t, "storage.aws_s3.static_credentials_secret", "test-secret")
+	flags.Set(t, "storage.aws_s3.max_retry_backoff", time.Millisecond)
+}
+
+func TestS3Compatible(t *testing.T) {
+	ctx := context.Background()
+	fake, endpoint := newFakeS3(t)
+	setS3CompatibleFlags(t, endpoint)
+
+	bs, err := aws.NewAwsS3BlobStore(ctx)
+	require.NoError(t, err)
+	_, err = bs.WriteBlob(ctx, "foo/bar", []byte("hello"))
+	require.NoError(t, err)
+	b, err := bs.ReadBlob(ctx, "foo/bar")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), b)
+	exists, err := bs.BlobExists(ctx, "foo/bar")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	err = bs.DeleteBlob(ctx, "foo/bar")
+	require.NoError(t, err)
+	_, err = bs.ReadBlob(ctx, "foo/bar")
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound error, got %v", err)
+
+	// Requests use path style urls, and are signed for the default region.
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	for _, path := range fake.paths {
+		assert.True(t, strings.HasPrefix(path, "/"+testBucket), "path %q should start with the bucket name", path)
+	}
+	assert.Contains(t, fake.authHeader, "/us-east-1/s3/aws4_request")
+}
+
+func TestS3Compatible_RequiresEndpoint(t *testing.T) {
+	flags.Set(t, "storage.aws_s3.bucket", testBucket)
+	flags.Set(t, "storage.aws_s3.s3_compatible", true)
+
+	_, err := aws.NewAwsS3BlobStore(context.Background())
+	assert.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition error, got %v", err)
+}
+
+func TestMultipartUpload(t *testing.T) {
+	ctx := context.Background()
+	fake, endpoint := newFakeS3(t)
+	setS3CompatibleFlags(t, endpoint)
+
+	flags.Set(t, "storage.aws_s3.multipart_threshold_bytes", int64(1_000))
+	_, err := aws.NewAwsS3BlobStore(ctx)
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error, got %v", err)
+
+	partSize := int64(5 * 1024 * 1024)
+	flags.Set(t, "storage.aws_s3.multipart_threshold_bytes", partSize)
+	bs, err := aws.NewAwsS3BlobStore(ctx)
+	require.NoError(t, err)
+
+	// Random data doesn't compress, so the blob is uploaded in 3 parts.
+	data := make([]byte, 2*partSize+1)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+	_, err = bs.WriteBlob(ctx, "large", data)
+	require.NoError(t, err)
+	b, err := bs.ReadBlob(ctx, "large")
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, b), "read blob should match the written blob")
+	_, err = bs.WriteBlob(ctx, "small", []byte("hello"))
+	require.NoError(t, err)
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	assert.Equal(t, 3, fake.multipartUploads["large"])
+	assert.NotContains(t, fake.multipartUploads, "small")
+}
+
+func TestRetries(t *testing.T) {
+	ctx := context.Background()
+	fake, endpoint := newFakeS3(t)
+	setS3CompatibleFlags(t, endpoint)
+	flags.Set(t, "storage.aws_s3.max_retry_attempts", 3)
+	bs, err := aws.NewAwsS3BlobStore(ctx)
+	require.NoError(t, err)
+
+	fake.mu.Lock()
+	fake.failWrites = 2
+	fake.mu.Unlock()
+	_, err = bs.WriteBlob(ctx, "foo", []byte("hello"))
+	require.NoError(t, err)
+	b, err := bs.ReadBlob(ctx, "foo")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), b)
+
+	fake.mu.Lock()
+	fake.failWrites = 3
+	fake.mu.Unlock()
+	_, err = bs.WriteBlob(ctx, "bar", []byte("hello"))
+	require.Error(t, err)
+}
@@ -2,9 +2,13 @@ package azure
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/Azure/azure-storage-blob-go/azblob"
@@ -22,6 +26,10 @@ var (
 	azureAccountName   = flag.String("storage.azure.account_name", "", "The name of the Azure storage account")
 	azureAccountKey    = flag.String("storage.azure.account_key", "", "The key for the Azure storage account", flag.Secret)
 	azureContainerName = flag.String("storage.azure.container_name", "", "The name of the Azure storage container")
+	azureSASToken      = flag.String("storage.azure.sas_token", "", "A shared access signature (SAS) token to authenticate with instead of the account key.", flag.Secret)
+
+	azureUseManagedIdentity      = flag.Bool("storage.azure.use_managed_identity", false, "If true, authenticate using the managed identity of the VM or pod that BuildBuddy is running on instead of the account key.")
+	azureManagedIdentityClientID = flag.String("storage.azure.managed_identity_client_id", "", "The client ID of the user-assigned managed identity to authenticate as. If unset, the system-assigned identity is used.")
 )
 
 const (
@@ -31,9 +39,29 @@ const (
 
 const azureURLTemplate = "https://%s.blob.core.windows.net/%s"
 
-// GCSBlobStore implements the blobstore API on top of the google cloud storage API.
+const (
+	// The Azure Instance Metadata Service endpoint that issues access
+	// tokens for managed identities.
+	imdsTokenEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+	imdsAPIVersion    = "2018-02-01"
+	storageResource   = "https://storage.azure.com/"
+
+	// How long before expiry managed identity tokens are refreshed, and how
+	// long to wait before retrying a failed refresh.
+	tokenRefreshMargin     = 5 * time.Minute
+	tokenRefreshRetryDelay = 30 * time.Second
+)
+
+// How long to wait for IMDS to issue a token. IMDS is local to the VM, so a
+// slow response means it's unhealthy, and waiting longer would stall token
+// refreshes.
+const imdsRequestTimeout = 10 * time.Second
+
+var imdsClient = &http.Client{Timeout: imdsRequestTimeout}
+
+// AzureBlobStore implements the blobstore API on top of the Azure Blob
+// Storage API.
 type AzureBlobStore struct {
-	credential    *azblob.SharedKeyCredential
 	containerName string
 	containerURL  *azblob.ContainerURL
 }
@@ -43,7 +71,7 @@ func UseAzureBlobStore() bool {
 }
 
 func NewAzureBlobStore(ctx context.Context) (*AzureBlobStore, error) {
-	credential, err := azblob.NewSharedKeyCredential(*azureAccountName, *azureAccountKey)
+	credential, err := newCredential(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -52,9 +80,12 @@ func NewAzureBlobStore(ctx context.Context) (*AzureBlobStore, error) {
 	if err != nil {
 		return nil, err
 	}
+	if *azureAccountKey == "" && *azureSASToken != "" {
+		// SAS tokens are passed as query parameters on every request.
+		portalURL.RawQuery = strings.TrimPrefix(*azureSASToken, "?")
+	}
 	containerURL := azblob.NewContainerURL(*portalURL, pipeline)
 	z := &AzureBlobStore{
-		credential:    credential,
 		containerName: *azureContainerName,
 		containerURL:  &containerURL,
 	}
@@ -65,6 +96,100 @@ func NewAzureBlobStore(ctx context.Context) (*AzureBlobStore, error) {
 	return z, nil
 }
 
+// newCredential returns the credential to authenticate with, in order of
+// preference: the account key, a SAS token, or a managed identity.
+func newCredential(ctx context.Context) (azblob.Credential, error) {
+	switch {
+	case *azureAccountKey != "":
+		return azblob.NewSharedKeyCredential(*azureAccountName, *azureAccountKey)
+	case *azureSASToken != "":
+		return azblob.NewAnonymousCredential(), nil
+	case *azureUseManagedIdentity:
+		return newManagedIdentityCredential(ctx, imdsTokenEndpoint, *azureManagedIdentityClientID)
+	default:
+		return nil, status.FailedPreconditionError("One of storage.azure.account_key, storage.azure.sas_token or storage.azure.use_managed_identity must be set")
+	}
+}
+
+// newManagedIdentityCredential fetches an access token for the managed
+// identity and returns a credential that keeps it refreshed in the
+// background.
+func newManagedIdentityCredential(ctx context.Context, endpoint, clientID string) (azblob.TokenCredential, error) {
+	token, expiresIn, err := fetchManagedIdentityToken(ctx, endpoint, clientID)
+	if err != nil {
+		return nil, status.UnavailableErrorf("could not fetch managed identity token: %s", err)
+	}
+	first := true
+	return azblob.NewTokenCredential(token, func(tc azblob.TokenCredential) time.Duration {
+		if first {
+			// The refresher is invoked immediately when the credential is
+			// created; the initial token is still fresh at that point.
+			first = false
+			return refreshDelay(expiresIn)
+		}
+		// The refresher runs in the background, outside of any request.
+		ctx, cancel := context.WithTimeout(context.Background(), imdsRequestTimeout)
+		defer cancel()
+		token, expiresIn, err := fetchManagedIdentityToken(ctx, endpoint, clientID)
+		if err != nil {
+			log.Warningf("Could not refresh Azure managed identity token: %s", err)
+			return tokenRefreshRetryDelay
+		}
+		tc.SetToken(token)
+		return refreshDelay(expiresIn)
+	}), nil
+}
+
+func refreshDelay(expiresIn time.Duration) time.Duration {
+	return max(expiresIn-tokenRefreshMargin, tokenRefreshRetryDelay)
+}
+
+type imdsTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	// IMDS returns the number of seconds as a string.
+	ExpiresIn string `json:"expires_in"`
+}
+
+func fetchManagedIdentityToken(ctx context.Context, endpoint, clientID string) (string, time.Duration, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", 0, err
+	}
+	q := u.Query()
+	q.Set("api-version", imdsAPIVersion)
+	q.Set("resource", storageResource)
+	if clientID != "" {
+		q.Set("client_id", clientID)
+	}
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Metadata", "true")
+	rsp, err := imdsClient.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(rsp.Body, 1024))
+		return "", 0, fmt.Errorf("unexpected status %s: %s", rsp.Status, string(b))
+	}
+	tr := &imdsTokenResponse{}
+	if err := json.NewDecoder(rsp.Body).Decode(tr); err != nil {
+		return "", 0, err
+	}
+	if tr.AccessToken == "" {
+		return "", 0, fmt.Errorf("response did not contain an access token")
+	}
+	expiresInSeconds, err := strconv.Atoi(tr.ExpiresIn)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid expires_in %q: %s", tr.ExpiresIn, err)
+	}
+	return tr.AccessToken, time.Duration(expiresInSeconds) * time.Second, nil
+}
+
 func (z *AzureBlobStore) isAzureError(err error, code azblob.ServiceCodeType) bool {
 	if serr, ok := err.(azblob.StorageError); ok {
 		if serr.ServiceCode() == code {
@@ -0,0 +1,49 @@
+package azure
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchManagedIdentityToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "true", r.Header.Get("Metadata"))
+		assert.Equal(t, storageResource, r.URL.Query().Get("resource"))
+		if r.URL.Query().Get("client_id") != "my-client-id" {
+			http.Error(w, "identity not found", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"access_token": "my-token", "expires_in": "3599", "token_type": "Bearer"}`))
+	}))
+	defer server.Close()
+	ctx := context.Background()
+
+	token, expiresIn, err := fetchManagedIdentityToken(ctx, server.URL, "my-client-id")
+	require.NoError(t, err)
+	require.Equal(t, "my-token", token)
+	require.Equal(t, 3599*time.Second, expiresIn)
+
+	_, _, err = fetchManagedIdentityToken(ctx, server.URL, "other-client-id")
+	require.Error(t, err)
+}
+
+func TestFetchManagedIdentityToken_Timeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	client := imdsClient
+	imdsClient = &http.Client{Timeout: 10 * time.Millisecond}
+	t.Cleanup(func() { imdsClient = client })
+
+	// Token refreshes use a background context, so the client's timeout is
+	// what stops them from hanging.
+	_, _, err := fetchManagedIdentityToken(context.Background(), server.URL, "")
+	require.Error(t, err)
+}
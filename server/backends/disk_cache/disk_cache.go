@@ -21,6 +21,8 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/util/alert"
+	"github.com/buildbuddy-io/buildbuddy/server/util/bytebufferpool"
+	"github.com/buildbuddy-io/buildbuddy/server/util/compression"
 	"github.com/buildbuddy-io/buildbuddy/server/util/disk"
 	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
 	"github.com/buildbuddy-io/buildbuddy/server/util/ioutil"
@@ -64,6 +66,15 @@ const (
 	PartitionDirectoryPrefix = "PT"
 	HashPrefixDirPrefixLen   = 4
 	V2Dir                    = "v2"
+
+	// zstdFileSuffix is appended to the names of files that are stored zstd
+	// compressed on disk.
+	zstdFileSuffix = ".zstd"
+
+	// compressorBufSizeBytes is the buffer size we use for each chunk when
+	// compressing data. It should be relatively large to get a good
+	// compression ratio bc each chunk is compressed independently.
+	compressorBufSizeBytes = 4e6 // 4 MB
 )
 
 var (
@@ -72,6 +83,9 @@ var (
 	partitionMappingsFlag = flag.Slice("cache.disk.partition_mappings", []disk.PartitionMapping{}, "")
 	useV2LayoutFlag       = flag.Bool("cache.disk.use_v2_layout", false, "If enabled, files will be stored using the v2 layout. See disk_cache.MigrateToV2Layout for a description.")
 
+	enableZstdCompressionFlag       = flag.Bool("cache.disk.enable_zstd_compression", false, "If true, blobs are stored zstd compressed on disk and zstd compressed reads and writes are supported.")
+	minBytesAutoZstdCompressionFlag = flag.Int64("cache.disk.min_bytes_auto_zstd_compression", 100, "If zstd compression is enabled, uncompressed blobs larger than this will be zstd compressed before written to disk.")
+
 	migrateDiskCacheToV2AndExit = flag.Bool("migrate_disk_cache_to_v2_and_exit", false, "If true, attempt to migrate disk cache to v2 layout.")
 )
 
@@ -81,6 +95,9 @@ type Options struct {
 	PartitionMappings []disk.PartitionMapping
 	UseV2Layout       bool
 	ForceV1Layout     bool
+
+	EnableZstdCompression       bool
+	MinBytesAutoZstdCompression int64
 }
 
 // MigrateToV2Layout restructures the files under the root directory to conform to the "v2" layout.
@@ -163,11 +180,12 @@ func MigrateToV2Layout(rootDir string) error {
 // DiskCache stores data on disk as files.
 // It is broken up into partitions which are independent and maintain their own LRUs.
 type DiskCache struct {
-	env               environment.Env
-	useV2Layout       bool
-	partitions        map[string]*partition
-	partitionMappings []disk.PartitionMapping
-	defaultPartition  *partition
+	env                   environment.Env
+	useV2Layout           bool
+	enableZstdCompression bool
+	partitions            map[string]*partition
+	partitionMappings     []disk.PartitionMapping
+	defaultPartition      *partition
 }
 
 // Register registers the disk cache for use in a real environment.
@@ -184,6 +202,9 @@ func Register(env *real_environment.RealEnv) error {
 		Partitions:        *partitionsFlag,
 		PartitionMappings: *partitionMappingsFlag,
 		UseV2Layout:       *useV2LayoutFlag,
+
+		EnableZstdCompression:       *enableZstdCompressionFlag,
+		MinBytesAutoZstdCompression: *minBytesAutoZstdCompressionFlag,
 	}
 	c, err := NewDiskCache(env, dc, cache_config.MaxSizeBytes())
 	if err != nil {
@@ -238,9 +259,15 @@ func NewDiskCache(env environment.Env, opts *Options, defaultMaxSizeBytes int64)
 	}
 
 	c := &DiskCache{
-		env:               env,
-		partitionMappings: opts.PartitionMappings,
-		useV2Layout:       useV2Layout,
+		env:                   env,
+		partitionMappings:     opts.PartitionMappings,
+		useV2Layout:           useV2Layout,
+		enableZstdCompression: opts.EnableZstdCompression,
+	}
+	compressionOpts := &compressionOptions{
+		enableZstdCompression:       opts.EnableZstdCompression,
+		minBytesAutoZstdCompression: opts.MinBytesAutoZstdCompression,
+		bufferPool:                  bytebufferpool.VariableSize(compressorBufSizeBytes),
 	}
 
 	partitions := make(map[string]*partition)
@@ -258,7 +285,7 @@ func NewDiskCache(env environment.Env, opts *Options, defaultMaxSizeBytes int64)
 			rootDir = filepath.Join(rootDir, PartitionDirectoryPrefix+pc.ID)
 		}
 
-		p, err := newPartition(pc.ID, rootDir, pc.MaxSizeBytes, useV2Layout)
+		p, err := newPartition(pc.ID, rootDir, pc.MaxSizeBytes, useV2Layout, compressionOpts)
 		if err != nil {
 			return nil, err
 		}
@@ -272,7 +299,7 @@ func NewDiskCache(env environment.Env, opts *Options, defaultMaxSizeBytes int64)
 		if useV2Layout {
 			rootDir = filepath.Join(rootDir, V2Dir, PartitionDirectoryPrefix+DefaultPartitionID)
 		}
-		p, err := newPartition(DefaultPartitionID, rootDir, defaultMaxSizeBytes, useV2Layout)
+		p, err := newPartition(DefaultPartitionID, rootDir, defaultMaxSizeBytes, useV2Layout, compressionOpts)
 		if err != nil {
 			return nil, err
 		}
@@ -369,6 +396,9 @@ func (c *DiskCache) Metadata(ctx context.Context, r *rspb.ResourceName) (*interf
 	digestSizeBytes := int64(-1)
 	if r.GetCacheType() == rspb.CacheType_CAS {
 		digestSizeBytes = fileInfo.Size()
+		if lruRecord.key.compressor != repb.Compressor_IDENTITY {
+			digestSizeBytes = d.GetSizeBytes()
+		}
 	}
 
 	return &interfaces.CacheMetadata{
@@ -484,6 +514,7 @@ func (c *DiskCache) WithinTargetSize() bool {
 type partition struct {
 	id               string
 	useV2Layout      bool
+	compression      *compressionOptions
 	mu               sync.RWMutex
 	rootDir          string
 	maxSizeBytes     int64
@@ -497,11 +528,20 @@ type partition struct {
 	internedStrings  map[string]string
 }
 
-func newPartition(id string, rootDir string, maxSizeBytes int64, useV2Layout bool) (*partition, error) {
+// compressionOptions controls how blobs are compressed when stored on disk.
+// They are shared by all partitions of a DiskCache.
+type compressionOptions struct {
+	enableZstdCompression       bool
+	minBytesAutoZstdCompression int64
+	bufferPool                  *bytebufferpool.VariableSizePool
+}
+
+func newPartition(id string, rootDir string, maxSizeBytes int64, useV2Layout bool, compression *compressionOptions) (*partition, error) {
 	targetSizeBytes := int64(float64(maxSizeBytes) * janitorCutoffThreshold)
 	p := &partition{
 		id:               id,
 		useV2Layout:      useV2Layout,
+		compression:      compression,
 		maxSizeBytes:     maxSizeBytes,
 		targetSizeBytes:  targetSizeBytes,
 		rootDir:          filepath.Clean(rootDir),
@@ -800,9 +840,23 @@ func (p *partition) initializeCache() error {
 
 		p.mu.Lock()
 		// Populate our LRU with everything we scanned from disk, until the LRU reaches capacity.
+		scannedKeys := make(map[string]struct{}, len(timestampedRecords))
 		for _, timestampedRecord := range timestampedRecords {
 			record := timestampedRecord.fileRecord
-			if added := p.lru.PushBack(record.FullPath(), record); !added {
+			lruKey := record.key.lruKey()
+			if _, ok := scannedKeys[lruKey]; ok {
+				// The same blob may be stored both compressed and
+				// uncompressed if it was rewritten after compression
+				// was enabled or disabled. Records are sorted by
+				// descending ATime, so keep the copy that was already
+				// added and delete this one.
+				if err := disk.DeleteFile(context.TODO(), record.FullPath()); err != nil {
+					log.Warningf("Could not delete duplicate file %q: %s", record.FullPath(), err)
+				}
+				continue
+			}
+			scannedKeys[lruKey] = struct{}{}
+			if added := p.lru.PushBack(lruKey, record); !added {
 				break
 			}
 		}
@@ -840,7 +894,7 @@ func decodeDigest(d string) ([]byte, error) {
 	return dst, nil
 }
 
-func parseFilePath(rootDir, fullPath string, useV2Layout bool) (cacheType rspb.CacheType, userPrefix, remoteInstanceName string, digestBytes []byte, err error) {
+func parseFilePath(rootDir, fullPath string, useV2Layout bool) (cacheType rspb.CacheType, userPrefix, remoteInstanceName string, digestBytes []byte, compressor repb.Compressor_Value, err error) {
 	p := strings.TrimPrefix(fullPath, rootDir+"/")
 	parts := strings.Split(p, "/")
 
@@ -859,7 +913,12 @@ func parseFilePath(rootDir, fullPath string, useV2Layout bool) (cacheType rspb.C
 
 	// pull digest off the end
 	if len(parts) > 0 {
-		db, decodeErr := decodeDigest(parts[len(parts)-1])
+		digestPart := parts[len(parts)-1]
+		if strings.HasSuffix(digestPart, zstdFileSuffix) {
+			compressor = repb.Compressor_ZSTD
+			digestPart = strings.TrimSuffix(digestPart, zstdFileSuffix)
+		}
+		db, decodeErr := decodeDigest(digestPart)
 		if decodeErr != nil {
 			err = parseError()
 			return
@@ -907,12 +966,14 @@ type fileKey struct {
 	userPrefix         string
 	remoteInstanceName string
 	digestBytes        []byte
+	// compressor is the compressor used for the file contents on disk.
+	compressor repb.Compressor_Value
 }
 
 func (fk *fileKey) FromPartitionAndPath(part *partition, fullPath string) error {
 	fk.part = part
 
-	cacheType, userPrefix, remoteInstanceName, digestBytes, err := parseFilePath(fk.part.rootDir, fullPath, fk.part.useV2Layout)
+	cacheType, userPrefix, remoteInstanceName, digestBytes, compressor, err := parseFilePath(fk.part.rootDir, fullPath, fk.part.useV2Layout)
 	if err != nil {
 		return err
 	}
@@ -921,11 +982,31 @@ func (fk *fileKey) FromPartitionAndPath(part *partition, fullPath string) error
 	fk.digestBytes = digestBytes
 	fk.cacheType = cacheType
 	fk.remoteInstanceName = fk.part.internString(remoteInstanceName)
+	fk.compressor = compressor
 
 	return nil
 }
 
+// withCompressor returns a copy of the key for the file storing the contents
+// compressed with the given compressor.
+func (fk *fileKey) withCompressor(compressor repb.Compressor_Value) *fileKey {
+	k := *fk
+	k.compressor = compressor
+	return &k
+}
+
+// FullPath returns the path of the file on disk.
 func (fk *fileKey) FullPath() string {
+	if fk.compressor == repb.Compressor_ZSTD {
+		return fk.lruKey() + zstdFileSuffix
+	}
+	return fk.lruKey()
+}
+
+// lruKey returns the key that the file is tracked under in the LRU. Unlike
+// FullPath, it does not depend on how the file is compressed, so a blob can be
+// found in the LRU regardless of the compressor it was stored with.
+func (fk *fileKey) lruKey() string {
 	hashPrefixDir := ""
 	digestHash := hex.EncodeToString(fk.digestBytes)
 	if fk.part.useV2Layout {
@@ -964,8 +1045,18 @@ func (p *partition) key(ctx context.Context, pbRN *rspb.ResourceName) (*fileKey,
 	}, nil
 }
 
+// NB: Callers are responsible for locking the LRU before calling this function.
 func (p *partition) lruAdd(record *fileRecord) {
-	p.lru.Add(record.FullPath(), record)
+	lruKey := record.key.lruKey()
+	if existing, ok := p.lru.Get(lruKey); ok && existing.FullPath() != record.FullPath() {
+		// The blob was previously stored with a different compressor.
+		// The LRU entry is updated in place, so evictFn won't be called
+		// for the old file; delete it here instead.
+		if err := disk.DeleteFile(context.TODO(), existing.FullPath()); err != nil {
+			log.Warningf("Could not delete replaced file %q: %s", existing.FullPath(), err)
+		}
+	}
+	p.lru.Add(lruKey, record)
 }
 
 // Adds a single file, using the provided path, to the LRU.
@@ -974,13 +1065,17 @@ func (p *partition) addFileToLRUIfExists(key *fileKey) *fileRecord {
 	if p.diskIsMapped {
 		return nil
 	}
-	info, err := os.Stat(key.FullPath())
-	if err == nil {
+	for _, compressor := range []repb.Compressor_Value{repb.Compressor_IDENTITY, repb.Compressor_ZSTD} {
+		k := key.withCompressor(compressor)
+		info, err := os.Stat(k.FullPath())
+		if err != nil {
+			continue
+		}
 		if info.Size() == 0 {
-			log.Debugf("Skipping 0 length file: %q", key.FullPath())
+			log.Debugf("Skipping 0 length file: %q", k.FullPath())
 			return nil
 		}
-		record := makeRecordFromInfo(key, info)
+		record := makeRecordFromInfo(k, info)
 		p.fileChannel <- record
 		p.lruAdd(record)
 		return record
@@ -988,6 +1083,35 @@ func (p *partition) addFileToLRUIfExists(key *fileKey) *fileRecord {
 	return nil
 }
 
+// lookupStoredKey returns the key of the file that stores the contents of the
+// given key, and marks the file as used. The returned key may have a different
+// compressor than the one that was looked up, so callers must use it to access
+// the file on disk.
+func (p *partition) lookupStoredKey(k *fileKey) *fileKey {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if record, ok := p.lru.Get(k.lruKey()); ok {
+		return record.key
+	}
+	if !p.diskIsMapped {
+		if record := p.addFileToLRUIfExists(k); record != nil {
+			return record.key
+		}
+	}
+	return k
+}
+
+// storedCompressor returns the compressor that the contents of the given
+// resource should be stored with.
+func (p *partition) storedCompressor(r *rspb.ResourceName) repb.Compressor_Value {
+	if p.compression.enableZstdCompression &&
+		r.GetCompressor() == repb.Compressor_IDENTITY &&
+		r.GetDigest().GetSizeBytes() >= p.compression.minBytesAutoZstdCompression {
+		return repb.Compressor_ZSTD
+	}
+	return r.GetCompressor()
+}
+
 func (p *partition) lruGet(ctx context.Context, rn *rspb.ResourceName) (*fileRecord, error) {
 	k, err := p.key(ctx, rn)
 	if err != nil {
@@ -1008,7 +1132,7 @@ func (p *partition) lruGet(ctx context.Context, rn *rspb.ResourceName) (*fileRec
 	// if necessary and applicable.
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	v, ok := p.lru.Get(k.FullPath())
+	v, ok := p.lru.Get(k.lruKey())
 	if ok {
 		return v, nil
 	}
@@ -1059,20 +1183,30 @@ func (p *partition) get(ctx context.Context, r *rspb.ResourceName) ([]byte, erro
 	if err != nil {
 		return nil, err
 	}
-	buf, err := disk.ReadFile(ctx, k.FullPath())
-	p.mu.Lock()
-	defer p.mu.Unlock()
+	sk := p.lookupStoredKey(k)
+	buf, err := disk.ReadFile(ctx, sk.FullPath())
 	if err != nil {
-		p.lru.Remove(k.FullPath()) // remove it just in case
+		p.mu.Lock()
+		p.lru.Remove(k.lruKey()) // remove it just in case
+		p.mu.Unlock()
 		return nil, status.NotFoundErrorf("DiskCache missing file: %s", err)
 	}
+	return recompress(buf, sk.compressor, r.GetCompressor())
+}
 
-	if p.lru.Contains(k.FullPath()) {
-		p.lru.Get(k.FullPath()) // mark the file as used.
-	} else if !p.diskIsMapped {
-		p.addFileToLRUIfExists(k)
+// recompress converts a blob compressed with one compressor into a blob
+// compressed with another.
+func recompress(buf []byte, from, to repb.Compressor_Value) ([]byte, error) {
+	switch {
+	case from == to:
+		return buf, nil
+	case from == repb.Compressor_ZSTD && to == repb.Compressor_IDENTITY:
+		return compression.DecompressZstd(nil, buf)
+	case from == repb.Compressor_IDENTITY && to == repb.Compressor_ZSTD:
+		return compression.CompressZstd(nil, buf), nil
+	default:
+		return nil, status.UnimplementedErrorf("cannot convert %s data to %s", from, to)
 	}
-	return buf, nil
 }
 
 func (p *partition) getMulti(ctx context.Context, resources []*rspb.ResourceName) (map[*repb.Digest][]byte, error) {
@@ -1112,6 +1246,14 @@ func (p *partition) set(ctx context.Context, r *rspb.ResourceName, data []byte)
 	if err != nil {
 		return err
 	}
+	storedCompressor := p.storedCompressor(r)
+	if storedCompressor != r.GetCompressor() {
+		data, err = recompress(data, r.GetCompressor(), storedCompressor)
+		if err != nil {
+			return err
+		}
+	}
+	k = k.withCompressor(storedCompressor)
 	n, err := disk.WriteFile(ctx, k.FullPath(), data)
 	if err != nil {
 		// If we had an error writing the file, just return that.
@@ -1145,7 +1287,7 @@ func (p *partition) delete(ctx context.Context, r *rspb.ResourceName) error {
 	}
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	removed := p.lru.Remove(k.FullPath())
+	removed := p.lru.Remove(k.lruKey())
 	if !removed {
 		d := r.GetDigest()
 		return status.NotFoundErrorf("digest %s/%d not found in disk cache", d.GetHash(), d.GetSizeBytes())
@@ -1158,19 +1300,117 @@ func (p *partition) reader(ctx context.Context, rn *rspb.ResourceName, offset, l
 	if err != nil {
 		return nil, err
 	}
+	sk := p.lookupStoredKey(k)
+	requestedCompressor := rn.GetCompressor()
+	if sk.compressor == requestedCompressor &&
+		requestedCompressor != repb.Compressor_IDENTITY &&
+		(offset != 0 || limit != 0) {
+		return nil, status.FailedPreconditionError("passthrough compression does not support offset/limit")
+	}
+
+	// If the file is stored uncompressed, we can use the offset/limit
+	// directly, otherwise we need to decompress first.
+	rawOffset, rawLimit := offset, limit
+	if sk.compressor != repb.Compressor_IDENTITY {
+		rawOffset, rawLimit = 0, 0
+	}
 	// Can't specify length because this might be ActionCache
-	r, err := disk.FileReader(ctx, k.FullPath(), offset, limit)
-	p.mu.Lock()
-	defer p.mu.Unlock()
+	r, err := disk.FileReader(ctx, sk.FullPath(), rawOffset, rawLimit)
 	if err != nil {
-		p.lru.Remove(k.FullPath()) // remove it just in case
+		p.mu.Lock()
+		p.lru.Remove(k.lruKey()) // remove it just in case
+		p.mu.Unlock()
 		return nil, status.NotFoundErrorf("DiskCache missing file: %s", err)
-	} else {
-		p.lru.Get(k.FullPath()) // mark the file as used.
+	}
+
+	if sk.compressor == repb.Compressor_ZSTD && requestedCompressor == repb.Compressor_IDENTITY {
+		dr, err := compression.NewZstdDecompressingReader(r)
+		if err != nil {
+			_ = r.Close()
+			return nil, err
+		}
+		r = dr
+		if offset != 0 {
+			if _, err := io.CopyN(io.Discard, r, offset); err != nil {
+				_ = r.Close()
+				return nil, err
+			}
+		}
+		if limit != 0 {
+			r = &readCloser{io.LimitReader(r, limit), r}
+		}
+	}
+
+	if sk.compressor == repb.Compressor_IDENTITY && requestedCompressor == repb.Compressor_ZSTD {
+		bufSize := int64(compressorBufSizeBytes)
+		resourceSize := rn.GetDigest().GetSizeBytes()
+		if resourceSize > 0 && resourceSize < bufSize {
+			bufSize = resourceSize
+		}
+		bufferPool := p.compression.bufferPool
+		readBuf := bufferPool.Get(bufSize)
+		compressBuf := bufferPool.Get(bufSize)
+		cr, err := compression.NewZstdCompressingReader(r, readBuf, compressBuf)
+		if err != nil {
+			bufferPool.Put(readBuf)
+			bufferPool.Put(compressBuf)
+			_ = r.Close()
+			return nil, err
+		}
+		return &compressionReader{
+			ReadCloser:  cr,
+			readBuf:     readBuf,
+			compressBuf: compressBuf,
+			bufferPool:  bufferPool,
+		}, nil
 	}
 	return r, nil
 }
 
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// compressionReader helps manage resources associated with a
+// compression.NewZstdCompressingReader.
+type compressionReader struct {
+	io.ReadCloser
+	readBuf     []byte
+	compressBuf []byte
+	bufferPool  *bytebufferpool.VariableSizePool
+}
+
+func (r *compressionReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.bufferPool.Put(r.readBuf)
+	r.bufferPool.Put(r.compressBuf)
+	return err
+}
+
+// zstdCompressor compresses bytes before writing them to the nested writer.
+type zstdCompressor struct {
+	interfaces.CommittedWriteCloser
+	compressBuf []byte
+	bufferPool  *bytebufferpool.VariableSizePool
+}
+
+func (z *zstdCompressor) Write(decompressedBytes []byte) (int, error) {
+	z.compressBuf = compression.CompressZstd(z.compressBuf, decompressedBytes)
+	if _, err := z.CommittedWriteCloser.Write(z.compressBuf); err != nil {
+		return 0, err
+	}
+	// Return the size of the original buffer even though a different
+	// compressed buffer size may have been written, or clients will return
+	// a short write error.
+	return len(decompressedBytes), nil
+}
+
+func (z *zstdCompressor) Close() error {
+	z.bufferPool.Put(z.compressBuf)
+	return z.CommittedWriteCloser.Close()
+}
+
 type dbCloseFn func(totalBytesWritten int64) error
 type checkOversizeFn func(n int) error
 type dbWriteOnClose struct {
@@ -1199,7 +1439,7 @@ func (p *partition) writer(ctx context.Context, r *rspb.ResourceName) (interface
 	}
 
 	p.mu.Lock()
-	alreadyExists := p.diskIsMapped && p.lru.Contains(k.FullPath())
+	alreadyExists := p.diskIsMapped && p.lru.Contains(k.lruKey())
 	p.mu.Unlock()
 
 	if alreadyExists {
@@ -1207,6 +1447,8 @@ func (p *partition) writer(ctx context.Context, r *rspb.ResourceName) (interface
 		metrics.DiskCacheDuplicateWritesBytes.With(prometheus.Labels{metrics.CacheNameLabel: cacheName}).Add(float64(r.GetDigest().GetSizeBytes()))
 	}
 
+	storedCompressor := p.storedCompressor(r)
+	k = k.withCompressor(storedCompressor)
 	fw, err := disk.FileWriter(ctx, k.FullPath())
 	if err != nil {
 		return nil, err
@@ -1223,11 +1465,26 @@ func (p *partition) writer(ctx context.Context, r *rspb.ResourceName) (interface
 		metrics.DiskCacheAddedFileSizeBytes.With(prometheus.Labels{metrics.CacheNameLabel: cacheName}).Observe(float64(totalBytesWritten))
 		return nil
 	}
+	if storedCompressor != r.GetCompressor() {
+		// Data is written uncompressed, but should be stored compressed.
+		return &zstdCompressor{
+			CommittedWriteCloser: cwc,
+			compressBuf:          p.compression.bufferPool.Get(r.GetDigest().GetSizeBytes()),
+			bufferPool:           p.compression.bufferPool,
+		}, nil
+	}
 	return cwc, nil
 }
 
 func (c *DiskCache) SupportsCompressor(compressor repb.Compressor_Value) bool {
-	return compressor == repb.Compressor_IDENTITY
+	switch compressor {
+	case repb.Compressor_IDENTITY:
+		return true
+	case repb.Compressor_ZSTD:
+		return c.enableZstdCompression
+	default:
+		return false
+	}
 }
 
 func (c *DiskCache) SupportsEncryption(ctx context.Context) bool {
@@ -3,6 +3,7 @@ package disk_cache_test
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
@@ -18,11 +19,13 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
+	"github.com/buildbuddy-io/buildbuddy/server/util/compression"
 	"github.com/buildbuddy-io/buildbuddy/server/util/disk"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/sync/errgroup"
+	"google.golang.org/protobuf/proto"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
@@ -335,6 +338,162 @@ func TestReadOffsetLimit(t *testing.T) {
 	require.Equal(t, buf[offset:offset+limit], readBuf[:limit])
 }
 
+func writeResource(t *testing.T, ctx context.Context, dc *disk_cache.DiskCache, rn *rspb.ResourceName, data []byte) {
+	wc, err := dc.Writer(ctx, rn)
+	require.NoError(t, err)
+	_, err = wc.Write(data)
+	require.NoError(t, err)
+	err = wc.Commit()
+	require.NoError(t, err)
+	err = wc.Close()
+	require.NoError(t, err)
+}
+
+func readResource(t *testing.T, ctx context.Context, dc *disk_cache.DiskCache, rn *rspb.ResourceName, offset, limit int64) []byte {
+	rc, err := dc.Reader(ctx, rn, offset, limit)
+	require.NoError(t, err)
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	return data
+}
+
+func TestCompression(t *testing.T) {
+	maxSizeBytes := int64(1_000_000_000) // 1GB
+	te := getTestEnv(t, emptyUserMap)
+	ctx := getAnonContext(t, te)
+
+	for _, blobSize := range []int64{10, 1000, 5_000_000} {
+		decompressedRN, blob := testdigest.RandomCompressibleCASResourceBuf(t, blobSize, "" /*instanceName*/)
+		compressedBuf := compression.CompressZstd(nil, blob)
+		compressedRN := proto.Clone(decompressedRN).(*rspb.ResourceName)
+		compressedRN.Compressor = repb.Compressor_ZSTD
+
+		for _, tc := range []struct {
+			name              string
+			useSet            bool
+			isWriteCompressed bool
+			isReadCompressed  bool
+		}{
+			{name: "write_compressed_read_compressed", isWriteCompressed: true, isReadCompressed: true},
+			{name: "write_compressed_read_decompressed", isWriteCompressed: true, isReadCompressed: false},
+			{name: "write_uncompressed_read_compressed", isWriteCompressed: false, isReadCompressed: true},
+			{name: "write_uncompressed_read_decompressed", isWriteCompressed: false, isReadCompressed: false},
+			{name: "set_compressed_get_decompressed", useSet: true, isWriteCompressed: true, isReadCompressed: false},
+			{name: "set_uncompressed_get_compressed", useSet: true, isWriteCompressed: false, isReadCompressed: true},
+		} {
+			t.Run(fmt.Sprintf("%d_%s", blobSize, tc.name), func(t *testing.T) {
+				opts := &disk_cache.Options{
+					RootDirectory:               testfs.MakeTempDir(t),
+					EnableZstdCompression:       true,
+					MinBytesAutoZstdCompression: 100,
+				}
+				dc, err := disk_cache.NewDiskCache(te, opts, maxSizeBytes)
+				require.NoError(t, err)
+				require.True(t, dc.SupportsCompressor(repb.Compressor_ZSTD))
+
+				dataToWrite, rnToWrite := blob, decompressedRN
+				if tc.isWriteCompressed {
+					dataToWrite, rnToWrite = compressedBuf, compressedRN
+				}
+				rnToRead := decompressedRN
+				if tc.isReadCompressed {
+					rnToRead = compressedRN
+				}
+
+				var data []byte
+				if tc.useSet {
+					err = dc.Set(ctx, rnToWrite, dataToWrite)
+					require.NoError(t, err)
+					data, err = dc.Get(ctx, rnToRead)
+					require.NoError(t, err)
+				} else {
+					writeResource(t, ctx, dc, rnToWrite, dataToWrite)
+					data = readResource(t, ctx, dc, rnToRead, 0, 0)
+				}
+				if tc.isReadCompressed {
+					data, err = compression.DecompressZstd(nil, data)
+					require.NoError(t, err)
+				}
+				require.Equal(t, blob, data)
+
+				md, err := dc.Metadata(ctx, decompressedRN)
+				require.NoError(t, err)
+				require.Equal(t, blobSize, md.DigestSizeBytes)
+			})
+		}
+	}
+}
+
+func TestCompression_ReadOffsetLimit(t *testing.T) {
+	te := getTestEnv(t, emptyUserMap)
+	ctx := getAnonContext(t, te)
+	opts := &disk_cache.Options{
+		RootDirectory:               testfs.MakeTempDir(t),
+		EnableZstdCompression:       true,
+		MinBytesAutoZstdCompression: 100,
+	}
+	dc, err := disk_cache.NewDiskCache(te, opts, 1_000_000_000)
+	require.NoError(t, err)
+
+	rn, blob := testdigest.RandomCompressibleCASResourceBuf(t, 10_000, "" /*instanceName*/)
+	writeResource(t, ctx, dc, rn, blob)
+
+	data := readResource(t, ctx, dc, rn, 1000, 500)
+	require.Equal(t, blob[1000:1500], data)
+	data = readResource(t, ctx, dc, rn, 9000, 0)
+	require.Equal(t, blob[9000:], data)
+
+	// Offsets can't be applied to compressed reads of compressed data.
+	compressedRN := proto.Clone(rn).(*rspb.ResourceName)
+	compressedRN.Compressor = repb.Compressor_ZSTD
+	_, err = dc.Reader(ctx, compressedRN, 1000, 0)
+	require.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition, got %v", err)
+}
+
+func TestCompression_Reload(t *testing.T) {
+	maxSizeBytes := int64(1_000_000_000) // 1GB
+	rootDir := testfs.MakeTempDir(t)
+	te := getTestEnv(t, emptyUserMap)
+	ctx := getAnonContext(t, te)
+	opts := &disk_cache.Options{
+		RootDirectory:               rootDir,
+		EnableZstdCompression:       true,
+		MinBytesAutoZstdCompression: 100,
+	}
+	dc, err := disk_cache.NewDiskCache(te, opts, maxSizeBytes)
+	require.NoError(t, err)
+	dc.WaitUntilMapped()
+
+	compressedRN, compressedBlob := testdigest.RandomCompressibleCASResourceBuf(t, 10_000, "" /*instanceName*/)
+	smallRN, smallBlob := testdigest.RandomCompressibleCASResourceBuf(t, 10, "" /*instanceName*/)
+	writeResource(t, ctx, dc, compressedRN, compressedBlob)
+	writeResource(t, ctx, dc, smallRN, smallBlob)
+
+	// Reopen the cache with compression disabled; previously compressed
+	// blobs should still be readable.
+	dc, err = disk_cache.NewDiskCache(te, &disk_cache.Options{RootDirectory: rootDir}, maxSizeBytes)
+	require.NoError(t, err)
+	dc.WaitUntilMapped()
+	require.False(t, dc.SupportsCompressor(repb.Compressor_ZSTD))
+
+	missing, err := dc.FindMissing(ctx, []*rspb.ResourceName{compressedRN, smallRN})
+	require.NoError(t, err)
+	require.Empty(t, missing)
+	require.Equal(t, compressedBlob, readResource(t, ctx, dc, compressedRN, 0, 0))
+	require.Equal(t, smallBlob, readResource(t, ctx, dc, smallRN, 0, 0))
+
+	// Overwriting a compressed blob uncompressed should replace the
+	// compressed copy.
+	writeResource(t, ctx, dc, compressedRN, compressedBlob)
+	require.Equal(t, compressedBlob, readResource(t, ctx, dc, compressedRN, 0, 0))
+	err = dc.Delete(ctx, compressedRN)
+	require.NoError(t, err)
+	missing, err = dc.FindMissing(ctx, []*rspb.ResourceName{compressedRN})
+	require.NoError(t, err)
+	require.Len(t, missing, 1)
+}
+
 func TestSizeLimit(t *testing.T) {
 	// Enough space for 2 small digests.
 	maxSizeBytes := int64(defaultExt4BlockSize * 2)
@@ -6,10 +6,12 @@ import (
 	"strings"
 	"time"
 
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_metadata_schema"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/invocation_format"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/authutil"
 	"github.com/buildbuddy-io/buildbuddy/server/util/capabilities"
 	"github.com/buildbuddy-io/buildbuddy/server/util/db"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
@@ -128,6 +130,17 @@ func (d *InvocationDB) UpdateInvocation(ctx context.Context, ti *tables.Invocati
 	return updated, err
 }
 
+// authorizeACLUpdate checks whether the user can change the permissions of
+// the invocation. Org admins can change the permissions of any invocation in
+// their group, so that owner-only invocations can still be managed.
+func authorizeACLUpdate(authenticatedUser *interfaces.UserInfo, in *tables.Invocation) error {
+	err := perms.AuthorizeWrite(authenticatedUser, getACL(in))
+	if err != nil && authutil.AuthorizeOrgAdmin(*authenticatedUser, in.GroupID) == nil {
+		return nil
+	}
+	return err
+}
+
 func (d *InvocationDB) UpdateInvocationACL(ctx context.Context, authenticatedUser *interfaces.UserInfo, invocationID string, acl *aclpb.ACL) error {
 	p, err := perms.FromACL(acl)
 	if err != nil {
@@ -147,8 +160,16 @@ func (d *InvocationDB) UpdateInvocationACL(ctx context.Context, authenticatedUse
 		if !group.SharingEnabled {
 			return status.PermissionDeniedError("Your organization does not allow this action.")
 		}
+		if p&(perms.GROUP_READ|perms.OTHERS_READ) == 0 {
+			if in.UserID == "" {
+				return status.InvalidArgumentError("Invocations that were not created by a user cannot be made visible only to their owner.")
+			}
+			if p&perms.OWNER_READ == 0 {
+				return status.InvalidArgumentError("Invocations must be visible to at least their owner.")
+			}
+		}
 
-		if err := perms.AuthorizeWrite(authenticatedUser, getACL(&in)); err != nil {
+		if err := authorizeACLUpdate(authenticatedUser, &in); err != nil {
 			return err
 		}
 		if err := tx.NewQuery(ctx, "invocationdb_update_invocation_acl").Raw(
@@ -163,6 +184,70 @@ func (d *InvocationDB) UpdateInvocationACL(ctx context.Context, authenticatedUse
 	})
 }
 
+// downloadPermsFromProto returns the download permissions to store for the
+// given invocation permission.
+func downloadPermsFromProto(p inpb.InvocationPermission) (int32, error) {
+	switch p {
+	case inpb.InvocationPermission_PUBLIC:
+		return perms.NONE, nil
+	case inpb.InvocationPermission_GROUP:
+		return perms.OWNER_READ | perms.GROUP_READ, nil
+	case inpb.InvocationPermission_OWNER:
+		return perms.OWNER_READ, nil
+	default:
+		return 0, status.InvalidArgumentErrorf("invalid download permission %s", p)
+	}
+}
+
+func downloadPermsToProto(p int32) inpb.InvocationPermission {
+	if p == perms.NONE {
+		return inpb.InvocationPermission_PUBLIC
+	}
+	if p&perms.GROUP_READ != 0 {
+		return inpb.InvocationPermission_GROUP
+	}
+	return inpb.InvocationPermission_OWNER
+}
+
+// UpdateInvocationDownloadPermission restricts who can download the artifacts
+// and logs of an invocation, independently of who can view it. Only org
+// admins can change download permissions.
+func (d *InvocationDB) UpdateInvocationDownloadPermission(ctx context.Context, authenticatedUser *interfaces.UserInfo, invocationID string, permission inpb.InvocationPermission) error {
+	p, err := downloadPermsFromProto(permission)
+	if err != nil {
+		return err
+	}
+	return d.h.Transaction(ctx, func(tx interfaces.DB) error {
+		var in tables.Invocation
+		if err := tx.NewQuery(ctx, "invocationdb_get_invocation_for_update_download_perms").Raw(
+			`SELECT user_id, group_id, perms FROM "Invocations" WHERE invocation_id = ?`, invocationID).Take(&in); err != nil {
+			return err
+		}
+		if err := authutil.AuthorizeOrgAdmin(*authenticatedUser, in.GroupID); err != nil {
+			return err
+		}
+		if permission == inpb.InvocationPermission_OWNER && in.UserID == "" {
+			return status.InvalidArgumentError("Invocations that were not created by a user cannot be restricted to their owner.")
+		}
+		return tx.NewQuery(ctx, "invocationdb_update_invocation_download_perms").Raw(
+			`UPDATE "Invocations" SET download_perms = ? WHERE invocation_id = ?`, p, invocationID).Exec().Error
+	})
+}
+
+// GroupRestrictsDownloads returns whether the group restricts downloads from
+// any of its invocations.
+func (d *InvocationDB) GroupRestrictsDownloads(ctx context.Context, groupID string) (bool, error) {
+	err := d.h.NewQuery(ctx, "invocationdb_group_restricts_downloads").Raw(
+		`SELECT invocation_id FROM "Invocations" WHERE group_id = ? AND download_perms != 0 LIMIT 1`, groupID).Take(&tables.Invocation{})
+	if db.IsRecordNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 func (d *InvocationDB) LookupInvocation(ctx context.Context, invocationID string) (*tables.Invocation, error) {
 	ti := &tables.Invocation{}
 	if err := d.h.NewQuery(ctx, "invocationdb_get_invocation").Raw(
@@ -213,13 +298,146 @@ func (d *InvocationDB) LookupGroupIDFromInvocation(ctx context.Context, invocati
 	return in.GroupID, nil
 }
 
-func (d *InvocationDB) LookupExpiredInvocations(ctx context.Context, cutoffTime time.Time, limit int) ([]*tables.Invocation, error) {
-	cutoffUsec := cutoffTime.UnixMicro()
-	rq := d.h.NewQuery(ctx, "invocationdb_get_expired_invocations").Raw(
-		`SELECT * FROM "Invocations" as i
+// LookupExpiredInvocations returns up to limit invocations that are older
+// than cutoffTime, or than their group's retention period if groupRetention is
+// set and their group sets one. Anonymous invocations, which have no group,
+// are also returned if they're older than anonymousCutoffTime. A zero cutoff
+// time disables the corresponding expiry. Invocations under legal hold are
+// never returned.
+func (d *InvocationDB) LookupExpiredInvocations(ctx context.Context, cutoffTime, anonymousCutoffTime time.Time, groupRetention bool, limit int) ([]*tables.Invocation, error) {
+	// Each kind of expiry is looked up with its own query, rather than OR-ing
+	// the conditions together, so that each query can use the created_at_usec
+	// index.
+	var expired []*tables.Invocation
+	seen := make(map[string]struct{})
+	add := func(rq interfaces.DBRawQuery) error {
+		invocations, err := db.ScanAll(rq, &tables.Invocation{})
+		if err != nil {
+			return err
+		}
+		for _, in := range invocations {
+			if _, ok := seen[in.InvocationID]; ok || len(expired) >= limit {
+				continue
+			}
+			seen[in.InvocationID] = struct{}{}
+			expired = append(expired, in)
+		}
+		return nil
+	}
+	if groupRetention {
+		rq := d.h.NewQuery(ctx, "invocationdb_get_group_retention_expired_invocations").Raw(
+			`SELECT i.* FROM "Invocations" as i
+             JOIN "Groups" as g ON g.group_id = i.group_id
+             WHERE g.invocation_retention_days > 0
+             AND i.created_at_usec < ? - g.invocation_retention_days * ?
+             AND NOT EXISTS (
+               SELECT 1 FROM "InvocationLegalHolds" as h WHERE h.invocation_id = i.invocation_id
+             )
+             LIMIT ?`, d.h.NowFunc().UnixMicro(), (24 * time.Hour).Microseconds(), limit)
+		if err := add(rq); err != nil {
+			return nil, err
+		}
+	}
+	if !cutoffTime.IsZero() && len(expired) < limit {
+		var rq interfaces.DBRawQuery
+		if groupRetention {
+			// Skip invocations of groups that set their own retention
+			// period, since that period applies instead.
+			rq = d.h.NewQuery(ctx, "invocationdb_get_expired_invocations").Raw(
+				`SELECT i.* FROM "Invocations" as i
+             LEFT JOIN "Groups" as g ON g.group_id = i.group_id
              WHERE i.created_at_usec < ?
-             LIMIT ?`, cutoffUsec, limit)
-	return db.ScanAll(rq, &tables.Invocation{})
+             AND COALESCE(g.invocation_retention_days, 0) = 0
+             AND NOT EXISTS (
+               SELECT 1 FROM "InvocationLegalHolds" as h WHERE h.invocation_id = i.invocation_id
+             )
+             LIMIT ?`, cutoffTime.UnixMicro(), limit)
+		} else {
+			rq = d.h.NewQuery(ctx, "invocationdb_get_expired_invocations").Raw(
+				`SELECT i.* FROM "Invocations" as i
+             WHERE i.created_at_usec < ?
+             AND NOT EXISTS (
+               SELECT 1 FROM "InvocationLegalHolds" as h WHERE h.invocation_id = i.invocation_id
+             )
+             LIMIT ?`, cutoffTime.UnixMicro(), limit)
+		}
+		if err := add(rq); err != nil {
+			return nil, err
+		}
+	}
+	if !anonymousCutoffTime.IsZero() && len(expired) < limit {
+		rq := d.h.NewQuery(ctx, "invocationdb_get_expired_anonymous_invocations").Raw(
+			`SELECT i.* FROM "Invocations" as i
+             WHERE COALESCE(i.group_id, '') = ''
+             AND i.created_at_usec < ?
+             AND NOT EXISTS (
+               SELECT 1 FROM "InvocationLegalHolds" as h WHERE h.invocation_id = i.invocation_id
+             )
+             LIMIT ?`, anonymousCutoffTime.UnixMicro(), limit)
+		if err := add(rq); err != nil {
+			return nil, err
+		}
+	}
+	return expired, nil
+}
+
+func (d *InvocationDB) SetInvocationLegalHold(ctx context.Context, hold *tables.InvocationLegalHold) error {
+	return d.h.Transaction(ctx, func(tx interfaces.DB) error {
+		if err := tx.NewQuery(ctx, "invocationdb_replace_legal_hold").Raw(
+			`DELETE FROM "InvocationLegalHolds" WHERE invocation_id = ?`, hold.InvocationID).Exec().Error; err != nil {
+			return err
+		}
+		return tx.NewQuery(ctx, "invocationdb_create_legal_hold").Create(hold)
+	})
+}
+
+func (d *InvocationDB) RemoveInvocationLegalHold(ctx context.Context, invocationID string) error {
+	return d.h.NewQuery(ctx, "invocationdb_remove_legal_hold").Raw(
+		`DELETE FROM "InvocationLegalHolds" WHERE invocation_id = ?`, invocationID).Exec().Error
+}
+
+// HasInvocationLegalHold returns whether the invocation is under legal hold.
+func (d *InvocationDB) HasInvocationLegalHold(ctx context.Context, invocationID string) (bool, error) {
+	return hasLegalHold(ctx, d.h, invocationID)
+}
+
+func hasLegalHold(ctx context.Context, tx interfaces.DB, invocationID string) (bool, error) {
+	err := tx.NewQuery(ctx, "invocationdb_get_legal_hold").Raw(
+		`SELECT * FROM "InvocationLegalHolds" WHERE invocation_id = ?`, invocationID).Take(&tables.InvocationLegalHold{})
+	if db.IsRecordNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RefreshInvocations bumps the update time of the given invocations if they
+// are still in progress, so that they aren't considered abandoned.
+func (d *InvocationDB) RefreshInvocations(ctx context.Context, invocationIDs []string) error {
+	return d.h.NewQuery(ctx, "invocationdb_refresh_invocations").Raw(
+		`UPDATE "Invocations" SET updated_at_usec = ?
+             WHERE invocation_id IN ? AND invocation_status = ?`,
+		d.h.NowFunc().UnixMicro(),
+		invocationIDs,
+		int64(inspb.InvocationStatus_PARTIAL_INVOCATION_STATUS),
+	).Exec().Error
+}
+
+// DisconnectAbandonedInvocations marks in-progress invocations that haven't
+// been updated since cutoffTime as disconnected, and returns how many
+// invocations were marked.
+func (d *InvocationDB) DisconnectAbandonedInvocations(ctx context.Context, cutoffTime time.Time) (int64, error) {
+	result := d.h.NewQuery(ctx, "invocationdb_disconnect_abandoned_invocations").Raw(
+		`UPDATE "Invocations" SET invocation_status = ?, updated_at_usec = ?
+             WHERE invocation_status = ? AND updated_at_usec < ?`,
+		int64(inspb.InvocationStatus_DISCONNECTED_INVOCATION_STATUS),
+		d.h.NowFunc().UnixMicro(),
+		int64(inspb.InvocationStatus_PARTIAL_INVOCATION_STATUS),
+		cutoffTime.UnixMicro(),
+	).Exec()
+	return result.RowsAffected, result.Error
 }
 
 func (d *InvocationDB) FillCounts(ctx context.Context, stat *telpb.TelemetryStat) error {
@@ -241,8 +459,17 @@ func (d *InvocationDB) FillCounts(ctx context.Context, stat *telpb.TelemetryStat
 	return nil
 }
 
+// DeleteInvocation deletes the invocation's rows. It returns a
+// FailedPrecondition error if the invocation is under legal hold.
 func (d *InvocationDB) DeleteInvocation(ctx context.Context, invocationID string) error {
-	return d.deleteInvocation(ctx, d.h, invocationID)
+	return d.h.Transaction(ctx, func(tx interfaces.DB) error {
+		if held, err := hasLegalHold(ctx, tx, invocationID); err != nil {
+			return err
+		} else if held {
+			return status.FailedPreconditionErrorf("Invocation %s is under legal hold and cannot be deleted.", invocationID)
+		}
+		return d.deleteInvocation(ctx, tx, invocationID)
+	})
 }
 
 func (d *InvocationDB) DeleteInvocationWithPermsCheck(ctx context.Context, authenticatedUser *interfaces.UserInfo, invocationID string) error {
@@ -259,6 +486,11 @@ func (d *InvocationDB) DeleteInvocationWithPermsCheck(ctx context.Context, authe
 	q, args := qb.Build()
 
 	return d.h.Transaction(ctx, func(tx interfaces.DB) error {
+		if held, err := hasLegalHold(ctx, tx, invocationID); err != nil {
+			return err
+		} else if held {
+			return status.FailedPreconditionErrorf("Invocation %s is under legal hold and cannot be deleted.", invocationID)
+		}
 		result := tx.NewQuery(ctx, "invocationdb_delete_invocation_with_perms_check").Raw(q, args...).Exec()
 		if result.Error != nil {
 			return result.Error
@@ -274,6 +506,18 @@ func (d *InvocationDB) DeleteInvocationWithPermsCheck(ctx context.Context, authe
 			`DELETE FROM "InvocationExecutions" WHERE invocation_id = ?`, invocationID).Exec().Error; err != nil {
 			return err
 		}
+		if err := tx.NewQuery(ctx, "invocationdb_delete_attempts").Raw(
+			`DELETE FROM "InvocationAttempts" WHERE invocation_id = ?`, invocationID).Exec().Error; err != nil {
+			return err
+		}
+		if err := tx.NewQuery(ctx, "invocationdb_delete_timing_profile").Raw(
+			`DELETE FROM "InvocationTimingProfiles" WHERE invocation_id = ?`, invocationID).Exec().Error; err != nil {
+			return err
+		}
+		if err := tx.NewQuery(ctx, "invocationdb_delete_annotations").Raw(
+			`DELETE FROM "InvocationAnnotations" WHERE invocation_id = ?`, invocationID).Exec().Error; err != nil {
+			return err
+		}
 		return nil
 	})
 }
@@ -291,6 +535,18 @@ func (d *InvocationDB) deleteInvocation(ctx context.Context, tx interfaces.DB, i
 		`DELETE FROM "InvocationExecutions" WHERE invocation_id = ?`, invocationID).Exec().Error; err != nil {
 		return err
 	}
+	if err := tx.NewQuery(ctx, "invocationdb_delete_attempts").Raw(
+		`DELETE FROM "InvocationAttempts" WHERE invocation_id = ?`, invocationID).Exec().Error; err != nil {
+		return err
+	}
+	if err := tx.NewQuery(ctx, "invocationdb_delete_timing_profile").Raw(
+		`DELETE FROM "InvocationTimingProfiles" WHERE invocation_id = ?`, invocationID).Exec().Error; err != nil {
+		return err
+	}
+	if err := tx.NewQuery(ctx, "invocationdb_delete_annotations").Raw(
+		`DELETE FROM "InvocationAnnotations" WHERE invocation_id = ?`, invocationID).Exec().Error; err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -320,9 +576,12 @@ func TableInvocationToProto(i *tables.Invocation) *inpb.Invocation {
 	out.UpdatedAtUsec = i.Model.UpdatedAtUsec
 	if i.Perms&perms.OTHERS_READ > 0 {
 		out.ReadPermission = inpb.InvocationPermission_PUBLIC
-	} else {
+	} else if i.Perms&perms.GROUP_READ > 0 || i.UserID == "" {
 		out.ReadPermission = inpb.InvocationPermission_GROUP
+	} else {
+		out.ReadPermission = inpb.InvocationPermission_OWNER
 	}
+	out.DownloadPermission = downloadPermsToProto(i.DownloadPerms)
 	out.CreatedWithCapabilities = capabilities.FromInt(i.CreatedWithCapabilities)
 	out.Acl = perms.ToACLProto(&uidpb.UserId{Id: i.UserID}, i.GroupID, i.Perms)
 	out.CacheStats = &capb.CacheStats{
@@ -357,5 +616,7 @@ func TableInvocationToProto(i *tables.Invocation) *inpb.Invocation {
 	out.Tags, _ = invocation_format.SplitAndTrimAndDedupeTags(i.Tags, false)
 	out.ParentRunId = i.ParentRunID
 	out.RunId = i.RunID
+	out.BuildMetadataCompliance = inpb.BuildMetadataCompliance(i.BuildMetadataCompliance)
+	out.BuildMetadataViolations = build_metadata_schema.SplitViolations(i.BuildMetadataViolations)
 	return out
 }
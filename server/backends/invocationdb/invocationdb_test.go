@@ -6,13 +6,20 @@ import (
 	"testing"
 	"time"
 
+	aclpb "github.com/buildbuddy-io/buildbuddy/proto/acl"
+	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
 	inspb "github.com/buildbuddy-io/buildbuddy/proto/invocation_status"
+	uidpb "github.com/buildbuddy-io/buildbuddy/proto/user_id"
 	"github.com/buildbuddy-io/buildbuddy/server/backends/invocationdb"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
 	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/stretchr/testify/require"
 )
 
@@ -141,3 +148,246 @@ func TestAttemptLogic(t *testing.T) {
 	require.NoError(t, err)
 	require.False(t, created)
 }
+
+func TestLookupExpiredInvocations(t *testing.T) {
+	env, authenticator, ctx := getEnvAuthAndCtx(t)
+	ctx, err := authenticator.WithAuthenticatedUser(ctx, "user1")
+	require.NoError(t, err)
+	dbh := env.GetDBHandle()
+	idb := invocationdb.NewInvocationDB(env, dbh)
+
+	// group1 keeps invocations for 1 day; group2 uses the default TTL.
+	err = dbh.NewQuery(ctx, "create_group").Create(&tables.Group{GroupID: "group1", InvocationRetentionDays: 1})
+	require.NoError(t, err)
+
+	start := time.Unix(1_000_000, 0)
+	create := func(iid string, createdAt time.Time) {
+		dbh.SetNowFunc(func() time.Time { return createdAt })
+		created, err := idb.CreateInvocation(ctx, &tables.Invocation{InvocationID: iid})
+		require.NoError(t, err)
+		require.True(t, created)
+	}
+	create("old", start)
+	create("held", start)
+	create("new", start.Add(36*time.Hour))
+	create("other-group", start)
+	create("anonymous", start)
+	err = dbh.NewQuery(ctx, "update_group").Raw(
+		`UPDATE "Invocations" SET group_id = ? WHERE invocation_id = ?`, "group2", "other-group").Exec().Error
+	require.NoError(t, err)
+	err = dbh.NewQuery(ctx, "update_group").Raw(
+		`UPDATE "Invocations" SET group_id = '' WHERE invocation_id = ?`, "anonymous").Exec().Error
+	require.NoError(t, err)
+	err = idb.SetInvocationLegalHold(ctx, &tables.InvocationLegalHold{InvocationID: "held", GroupID: "group1", Reason: "case 123"})
+	require.NoError(t, err)
+
+	now := start.Add(48 * time.Hour)
+	dbh.SetNowFunc(func() time.Time { return now })
+	lookup := func(cutoff, anonymousCutoff time.Time, groupRetention bool, limit int) []string {
+		expired, err := idb.LookupExpiredInvocations(ctx, cutoff, anonymousCutoff, groupRetention, limit)
+		require.NoError(t, err)
+		var ids []string
+		for _, inv := range expired {
+			ids = append(ids, inv.InvocationID)
+		}
+		return ids
+	}
+	invocationIDsWithAnonymousCutoff := func(cutoff, anonymousCutoff time.Time) []string {
+		return lookup(cutoff, anonymousCutoff, true /*=groupRetention*/, 10)
+	}
+	invocationIDs := func(cutoff time.Time) []string {
+		return invocationIDsWithAnonymousCutoff(cutoff, time.Time{})
+	}
+
+	// Without a default TTL, only group1's retention applies.
+	require.ElementsMatch(t, []string{"old"}, invocationIDs(time.Time{}))
+	// A default TTL that is longer than the invocations' age doesn't expire
+	// invocations of group2.
+	require.ElementsMatch(t, []string{"old"}, invocationIDs(now.Add(-72*time.Hour)))
+	// The default TTL doesn't override group1's retention.
+	require.ElementsMatch(t, []string{"old", "other-group", "anonymous"}, invocationIDs(now.Add(-time.Hour)))
+	// Anonymous invocations may expire sooner than the default TTL.
+	require.ElementsMatch(t, []string{"old", "anonymous"}, invocationIDsWithAnonymousCutoff(time.Time{}, now.Add(-time.Hour)))
+	require.ElementsMatch(t, []string{"old"}, invocationIDsWithAnonymousCutoff(time.Time{}, now.Add(-72*time.Hour)))
+	// Invocations matching several kinds of expiry are only returned once.
+	require.ElementsMatch(t, []string{"old", "other-group", "anonymous"}, invocationIDsWithAnonymousCutoff(now.Add(-time.Hour), now.Add(-time.Hour)))
+	// The limit applies across all kinds of expiry.
+	require.Len(t, lookup(now.Add(-time.Hour), now.Add(-time.Hour), true /*=groupRetention*/, 2), 2)
+
+	// Without group retention, group1's retention period is ignored and the
+	// default TTL applies to all invocations.
+	require.Empty(t, lookup(time.Time{}, time.Time{}, false /*=groupRetention*/, 10))
+	require.Empty(t, lookup(now.Add(-72*time.Hour), time.Time{}, false /*=groupRetention*/, 10))
+	require.ElementsMatch(t, []string{"old", "new", "other-group", "anonymous"}, lookup(now.Add(-time.Hour), time.Time{}, false /*=groupRetention*/, 10))
+
+	// Held invocations can't be deleted by users either.
+	u, err := authenticator.AuthenticatedUser(ctx)
+	require.NoError(t, err)
+	err = idb.DeleteInvocationWithPermsCheck(ctx, &u, "held")
+	require.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition, got: %v", err)
+	// Nor by the janitor, if the hold is placed after the invocation was
+	// looked up.
+	held, err := idb.HasInvocationLegalHold(ctx, "held")
+	require.NoError(t, err)
+	require.True(t, held)
+	err = idb.DeleteInvocation(ctx, "held")
+	require.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition, got: %v", err)
+	_, err = idb.LookupInvocation(ctx, "held")
+	require.NoError(t, err)
+
+	// Once the hold is removed, the invocation expires.
+	err = idb.RemoveInvocationLegalHold(ctx, "held")
+	require.NoError(t, err)
+	held, err = idb.HasInvocationLegalHold(ctx, "held")
+	require.NoError(t, err)
+	require.False(t, held)
+	require.ElementsMatch(t, []string{"old", "held"}, invocationIDs(time.Time{}))
+}
+
+func TestDisconnectAbandonedInvocations(t *testing.T) {
+	env, authenticator, ctx := getEnvAuthAndCtx(t)
+	ctx, err := authenticator.WithAuthenticatedUser(ctx, "user1")
+	require.NoError(t, err)
+	dbh := env.GetDBHandle()
+	idb := invocationdb.NewInvocationDB(env, dbh)
+
+	start := time.Unix(1_000_000, 0)
+	dbh.SetNowFunc(func() time.Time { return start })
+	for iid, status := range map[string]inspb.InvocationStatus{
+		"abandoned": inspb.InvocationStatus_PARTIAL_INVOCATION_STATUS,
+		"refreshed": inspb.InvocationStatus_PARTIAL_INVOCATION_STATUS,
+		"complete":  inspb.InvocationStatus_COMPLETE_INVOCATION_STATUS,
+	} {
+		created, err := idb.CreateInvocation(ctx, &tables.Invocation{
+			InvocationID:     iid,
+			InvocationStatus: int64(status),
+		})
+		require.NoError(t, err)
+		require.True(t, created)
+	}
+
+	now := start.Add(2 * time.Hour)
+	dbh.SetNowFunc(func() time.Time { return now })
+	err = idb.RefreshInvocations(ctx, []string{"refreshed"})
+	require.NoError(t, err)
+
+	n, err := idb.DisconnectAbandonedInvocations(ctx, now.Add(-time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, int64(1), n)
+
+	for iid, want := range map[string]inspb.InvocationStatus{
+		"abandoned": inspb.InvocationStatus_DISCONNECTED_INVOCATION_STATUS,
+		"refreshed": inspb.InvocationStatus_PARTIAL_INVOCATION_STATUS,
+		"complete":  inspb.InvocationStatus_COMPLETE_INVOCATION_STATUS,
+	} {
+		inv, err := idb.LookupInvocation(ctx, iid)
+		require.NoError(t, err)
+		require.Equal(t, int64(want), inv.InvocationStatus, iid)
+	}
+}
+
+func invocationACL(userID, groupID string, ownerOnly, public bool) *aclpb.ACL {
+	return &aclpb.ACL{
+		UserId:            &uidpb.UserId{Id: userID},
+		GroupId:           groupID,
+		OwnerPermissions:  &aclpb.ACL_Permissions{Read: true, Write: true},
+		GroupPermissions:  &aclpb.ACL_Permissions{Read: !ownerOnly, Write: !ownerOnly},
+		OthersPermissions: &aclpb.ACL_Permissions{Read: public},
+	}
+}
+
+func TestInvocationPermissions(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	admin := testauth.User("US1", "GR1")
+	admin.GroupMemberships[0].Capabilities = append(admin.GroupMemberships[0].Capabilities, akpb.ApiKey_ORG_ADMIN_CAPABILITY)
+	developer := testauth.User("US2", "GR1")
+	ta := testauth.NewTestAuthenticator(map[string]interfaces.UserInfo{
+		"US1": admin,
+		"US2": developer,
+		"US3": testauth.User("US3", "GR1"),
+	})
+	te.SetAuthenticator(ta)
+	ctx := context.Background()
+	err := te.GetDBHandle().NewQuery(ctx, "create_group").Create(&tables.Group{GroupID: "GR1", SharingEnabled: true})
+	require.NoError(t, err)
+	idb := invocationdb.NewInvocationDB(te, te.GetDBHandle())
+
+	adminCtx, err := ta.WithAuthenticatedUser(ctx, "US1")
+	require.NoError(t, err)
+	ownerCtx, err := ta.WithAuthenticatedUser(ctx, "US2")
+	require.NoError(t, err)
+	otherCtx, err := ta.WithAuthenticatedUser(ctx, "US3")
+	require.NoError(t, err)
+	var adminUser, ownerUser, otherUser interfaces.UserInfo = admin, developer, testauth.User("US3", "GR1")
+
+	created, err := idb.CreateInvocation(ownerCtx, &tables.Invocation{InvocationID: "inv"})
+	require.NoError(t, err)
+	require.True(t, created)
+
+	// Make the invocation visible only to its owner.
+	err = idb.UpdateInvocationACL(ownerCtx, &ownerUser, "inv", invocationACL("US2", "GR1", true /*=ownerOnly*/, false /*=public*/))
+	require.NoError(t, err)
+	ti, err := idb.LookupInvocation(ownerCtx, "inv")
+	require.NoError(t, err)
+	require.Equal(t, inpb.InvocationPermission_OWNER, invocationdb.TableInvocationToProto(ti).GetReadPermission())
+	_, err = idb.LookupInvocation(otherCtx, "inv")
+	require.True(t, status.IsPermissionDeniedError(err), "unexpected error: %v", err)
+	_, err = idb.LookupInvocation(adminCtx, "inv")
+	require.True(t, status.IsPermissionDeniedError(err), "unexpected error: %v", err)
+
+	// Other group members can't change it back, but org admins can.
+	err = idb.UpdateInvocationACL(otherCtx, &otherUser, "inv", invocationACL("US2", "GR1", false /*=ownerOnly*/, false /*=public*/))
+	require.True(t, status.IsPermissionDeniedError(err), "unexpected error: %v", err)
+	err = idb.UpdateInvocationACL(adminCtx, &adminUser, "inv", invocationACL("US2", "GR1", false /*=ownerOnly*/, false /*=public*/))
+	require.NoError(t, err)
+	_, err = idb.LookupInvocation(otherCtx, "inv")
+	require.NoError(t, err)
+
+	// An invocation must remain visible to someone.
+	noOne := invocationACL("US2", "GR1", true /*=ownerOnly*/, false /*=public*/)
+	noOne.OwnerPermissions.Read = false
+	err = idb.UpdateInvocationACL(ownerCtx, &ownerUser, "inv", noOne)
+	require.True(t, status.IsInvalidArgumentError(err), "unexpected error: %v", err)
+
+	// Only org admins can restrict downloads.
+	restricted, err := idb.GroupRestrictsDownloads(ctx, "GR1")
+	require.NoError(t, err)
+	require.False(t, restricted)
+	err = idb.UpdateInvocationDownloadPermission(ownerCtx, &ownerUser, "inv", inpb.InvocationPermission_OWNER)
+	require.True(t, status.IsPermissionDeniedError(err), "unexpected error: %v", err)
+	err = idb.UpdateInvocationDownloadPermission(adminCtx, &adminUser, "inv", inpb.InvocationPermission_OWNER)
+	require.NoError(t, err)
+	restricted, err = idb.GroupRestrictsDownloads(ctx, "GR1")
+	require.NoError(t, err)
+	require.True(t, restricted)
+
+	// Other group members can still view the invocation, but not download
+	// from it.
+	ti, err = idb.LookupInvocation(otherCtx, "inv")
+	require.NoError(t, err)
+	require.Equal(t, inpb.InvocationPermission_OWNER, invocationdb.TableInvocationToProto(ti).GetDownloadPermission())
+	err = perms.AuthorizeInvocationDownload(otherCtx, te, ti.UserID, ti.GroupID, ti.DownloadPerms)
+	require.True(t, status.IsPermissionDeniedError(err), "unexpected error: %v", err)
+	err = perms.AuthorizeInvocationDownload(ownerCtx, te, ti.UserID, ti.GroupID, ti.DownloadPerms)
+	require.NoError(t, err)
+
+	// Downloads are restricted even if the invocation is public.
+	err = idb.UpdateInvocationACL(ownerCtx, &ownerUser, "inv", invocationACL("US2", "GR1", false /*=ownerOnly*/, true /*=public*/))
+	require.NoError(t, err)
+	ti, err = idb.LookupInvocation(ctx, "inv")
+	require.NoError(t, err)
+	err = perms.AuthorizeInvocationDownload(ctx, te, ti.UserID, ti.GroupID, ti.DownloadPerms)
+	require.True(t, status.IsPermissionDeniedError(err), "unexpected error: %v", err)
+
+	// Lift the restriction.
+	err = idb.UpdateInvocationDownloadPermission(adminCtx, &adminUser, "inv", inpb.InvocationPermission_PUBLIC)
+	require.NoError(t, err)
+	ti, err = idb.LookupInvocation(ctx, "inv")
+	require.NoError(t, err)
+	require.Equal(t, inpb.InvocationPermission_PUBLIC, invocationdb.TableInvocationToProto(ti).GetDownloadPermission())
+	err = perms.AuthorizeInvocationDownload(ctx, te, ti.UserID, ti.GroupID, ti.DownloadPerms)
+	require.NoError(t, err)
+	restricted, err = idb.GroupRestrictsDownloads(ctx, "GR1")
+	require.NoError(t, err)
+	require.False(t, restricted)
+}
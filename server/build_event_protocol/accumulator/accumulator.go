@@ -3,6 +3,7 @@ package accumulator
 import (
 	"context"
 	"net/url"
+	"path"
 	"regexp"
 	"time"
 
@@ -13,6 +14,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
 
+	clpb "github.com/buildbuddy-io/buildbuddy/proto/command_line"
 	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
 	inspb "github.com/buildbuddy-io/buildbuddy/proto/invocation_status"
 	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
@@ -21,6 +23,7 @@ import (
 const (
 	workflowIDFieldName                   = "workflowID"
 	actionNameFieldName                   = "actionName"
+	statusNameFieldName                   = "statusName"
 	disableCommitStatusReportingFieldName = "disableCommitStatusReporting"
 	disableTargetTrackingFieldName        = "disableTargetTracking"
 
@@ -32,6 +35,14 @@ const (
 	// If codesearch is enabled, and an invocation contains a single file with the
 	// following name, attempt to ingest this kythe sstable file in codesearch.
 	KytheOutputName = "kythe_serving.sst"
+
+	// The name of the test action output containing the test's log.
+	testLogName = "test.log"
+
+	// The name of the build tool log containing bazel's JSON trace profile,
+	// unless a different path is set with --profile.
+	defaultProfileName = "command.profile.gz"
+	profileOptionName  = "profile"
 )
 
 var (
@@ -61,11 +72,18 @@ type Accumulator interface {
 	DisableTargetTracking() bool
 	WorkflowID() string
 	ActionName() string
+	StatusName() string
 	Pattern() string
 
 	BuildFinished() bool
 }
 
+// TestLog is the test.log output of a test attempt.
+type TestLog struct {
+	TargetLabel string
+	URI         *url.URL
+}
+
 // BEValues is an in-memory data structure created for each new stream of build
 // events. Every event in the stream is passed through BEValues, which extracts
 // common values that many functions are interested in. By holding a reference
@@ -82,12 +100,16 @@ type BEValues struct {
 	sawFinishedEvent               bool
 	buildStartTime                 time.Time
 	buildToolLogURIs               []*url.URL
+	buildToolLogURIsByName         map[string]*url.URL
 	outputFilesMap                 map[string]*build_event_stream.File
 	kytheSSTableResourceName       *rspb.ResourceName
 	profileName                    string
 	hasBytestreamTestActionOutputs bool
 
-	testOutputURIs []*url.URL
+	testOutputURIs    []*url.URL
+	testLogs          []*TestLog
+	buildMetadata     map[string]string
+	workflowArtifacts []*build_event_stream.WorkflowArtifactPublished
 	// TODO(bduffany): Migrate all parser functionality directly into the
 	// accumulator. The parser is a separate entity only for historical reasons.
 	parser *event_parser.StreamingEventParser
@@ -98,6 +120,8 @@ func NewBEValues(invocation *inpb.Invocation) *BEValues {
 		valuesMap:                 make(map[string]string, 0),
 		unprocessedMetadataEvents: make(map[string]struct{}, 0),
 		outputFilesMap:            make(map[string]*build_event_stream.File),
+		buildToolLogURIsByName:    make(map[string]*url.URL),
+		buildMetadata:             make(map[string]string),
 		parser:                    event_parser.NewStreamingEventParser(invocation),
 	}
 }
@@ -148,6 +172,9 @@ func (v *BEValues) AddEvent(event *build_event_stream.BuildEvent) error {
 		v.maybeExtractOutputFile(p.TestSummary.GetFailed()...)
 	case *build_event_stream.BuildEvent_RunTargetAnalyzed:
 		v.maybeExtractOutputFile(p.RunTargetAnalyzed.GetRunfiles()...)
+	case *build_event_stream.BuildEvent_WorkflowArtifactPublished:
+		v.maybeExtractOutputFile(p.WorkflowArtifactPublished.GetFiles()...)
+		v.workflowArtifacts = append(v.workflowArtifacts, p.WorkflowArtifactPublished)
 	case *build_event_stream.BuildEvent_Action:
 		v.maybeExtractOutputFile(p.Action.GetStdout())
 		v.maybeExtractOutputFile(p.Action.GetStderr())
@@ -162,6 +189,8 @@ func (v *BEValues) AddEvent(event *build_event_stream.BuildEvent) error {
 		v.populateWorkspaceInfoFromBuildMetadata(p.BuildMetadata)
 	case *build_event_stream.BuildEvent_WorkflowConfigured:
 		v.handleWorkflowConfigured(p.WorkflowConfigured)
+	case *build_event_stream.BuildEvent_StructuredCommandLine:
+		v.handleStructuredCommandLine(p.StructuredCommandLine)
 	case *build_event_stream.BuildEvent_Finished:
 		v.sawFinishedEvent = true
 	case *build_event_stream.BuildEvent_BuildToolLogs:
@@ -172,6 +201,7 @@ func (v *BEValues) AddEvent(event *build_event_stream.BuildEvent) error {
 					log.Warningf("Error parsing uri from BuildToolLogs: %s", uri)
 				} else if url.Scheme == "bytestream" {
 					v.buildToolLogURIs = append(v.buildToolLogURIs, url)
+					v.buildToolLogURIsByName[toolLog.GetName()] = url
 				}
 			}
 		}
@@ -193,6 +223,12 @@ func (v *BEValues) AddEvent(event *build_event_stream.BuildEvent) error {
 					continue
 				}
 				v.testOutputURIs = append(v.testOutputURIs, u)
+				if f.GetName() == testLogName {
+					v.testLogs = append(v.testLogs, &TestLog{
+						TargetLabel: event.GetId().GetTestResult().GetLabel(),
+						URI:         u,
+					})
+				}
 			}
 		}
 	}
@@ -252,14 +288,46 @@ func (v *BEValues) ActionName() string {
 	return v.getStringValue(actionNameFieldName)
 }
 
+func (v *BEValues) StatusName() string {
+	return v.getStringValue(statusNameFieldName)
+}
+
 func (v *BEValues) BuildFinished() bool {
 	return v.sawFinishedEvent
 }
 
+// TestLogs returns the test logs of the test attempts in the stream that were
+// uploaded to a bytestream server.
+func (v *BEValues) TestLogs() []*TestLog {
+	return v.testLogs
+}
+
+// BuildMetadata returns the build metadata set on the invocation with
+// --build_metadata.
+func (v *BEValues) BuildMetadata() map[string]string {
+	return v.buildMetadata
+}
+
+// WorkflowArtifacts returns the artifacts published by the workflow action
+// that the invocation ran, if any.
+func (v *BEValues) WorkflowArtifacts() []*build_event_stream.WorkflowArtifactPublished {
+	return v.workflowArtifacts
+}
+
 func (v *BEValues) BuildToolLogURIs() []*url.URL {
 	return v.buildToolLogURIs
 }
 
+// TimingProfileURI returns the bytestream URI of the JSON trace profile
+// uploaded by bazel, or nil if there isn't one.
+func (v *BEValues) TimingProfileURI() *url.URL {
+	name := v.profileName
+	if name == "" {
+		name = defaultProfileName
+	}
+	return v.buildToolLogURIsByName[name]
+}
+
 func (v *BEValues) HasBytestreamTestActionOutputs() bool {
 	return v.hasBytestreamTestActionOutputs
 }
@@ -296,15 +364,31 @@ func (v *BEValues) handleStartedEvent(event *build_event_stream.BuildEvent) {
 
 func (v *BEValues) populateWorkspaceInfoFromBuildMetadata(metadata *build_event_stream.BuildMetadata) {
 	for mdKey, mdVal := range metadata.Metadata {
+		v.buildMetadata[mdKey] = mdVal
 		if fieldName := buildMetadataFieldMapping[mdKey]; fieldName != "" {
 			v.setStringValue(fieldName, mdVal)
 		}
 	}
 }
 
+func (v *BEValues) handleStructuredCommandLine(commandLine *clpb.CommandLine) {
+	if commandLine.GetCommandLineLabel() != event_parser.StructuredCommandLineLabelCanonical {
+		return
+	}
+	for _, section := range commandLine.GetSections() {
+		for _, option := range section.GetOptionList().GetOption() {
+			if option.GetOptionName() == profileOptionName && option.GetOptionValue() != "" {
+				// The profile is uploaded with the base name of its path.
+				v.profileName = path.Base(option.GetOptionValue())
+			}
+		}
+	}
+}
+
 func (v *BEValues) handleWorkflowConfigured(wfc *build_event_stream.WorkflowConfigured) {
 	v.setStringValue(workflowIDFieldName, wfc.GetWorkflowId())
 	v.setStringValue(actionNameFieldName, wfc.GetActionName())
+	v.setStringValue(statusNameFieldName, wfc.GetStatusName())
 }
 
 // IsMetadataEvent returns true for events containing invocation-level metadata,
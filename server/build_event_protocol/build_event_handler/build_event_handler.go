@@ -17,11 +17,15 @@ import (
 	"github.com/Masterminds/semver/v3"
 	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
 	"github.com/buildbuddy-io/buildbuddy/proto/command_line"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/chunkstore"
 	"github.com/buildbuddy-io/buildbuddy/server/backends/invocationdb"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/accumulator"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_metadata_schema"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_status_reporter"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/invocation_format"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/redaction_rules"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/target_tracker"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/timing_profile"
 	"github.com/buildbuddy-io/buildbuddy/server/endpoint_urls/build_buddy_url"
 	"github.com/buildbuddy-io/buildbuddy/server/endpoint_urls/cache_api_url"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
@@ -29,6 +33,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/metrics"
 	"github.com/buildbuddy-io/buildbuddy/server/olapdbconfig"
+	"github.com/buildbuddy-io/buildbuddy/server/public_instance"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/hit_tracker"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/scorecard"
@@ -36,6 +41,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/alert"
 	"github.com/buildbuddy-io/buildbuddy/server/util/authutil"
 	"github.com/buildbuddy-io/buildbuddy/server/util/background"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/paging"
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
@@ -52,6 +58,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"gorm.io/gorm/clause"
 
 	apipb "github.com/buildbuddy-io/buildbuddy/proto/api/v1"
 	bepb "github.com/buildbuddy-io/buildbuddy/proto/build_events"
@@ -94,6 +101,10 @@ const (
 	// event stream.
 	firstExpectedSequenceNumber = 1
 
+	// Values of app.invocation_attempt_retention.
+	retainAllAttempts = "all"
+	retainLastAttempt = "last"
+
 	// Skip unimportant events if more than this many are received in a
 	// single build event stream.
 	maxEventCount = 100_000
@@ -109,7 +120,12 @@ var (
 	disablePersistArtifacts = flag.Bool("storage.disable_persist_cache_artifacts", false, "If disabled, buildbuddy will not persist cache artifacts in the blobstore. This may make older invocations not display properly.")
 	writeToOLAPDBEnabled    = flag.Bool("app.enable_write_to_olap_db", true, "If enabled, complete invocations will be flushed to OLAP DB")
 
+	streamResumeTimeout        = flag.Duration("app.build_event_stream_resume_timeout", 0, "If set, events are acked as soon as they are handled, and invocations whose build event stream is interrupted are kept open for this long so that bazel can resume the stream from the last acked event. Streams are only resumed if bazel reconnects to the same app; streams that aren't resumed in time are finalized as disconnected.")
+	abandonedInvocationTimeout = flag.Duration("app.abandoned_invocation_timeout", 0, "If set, in-progress invocations whose build event stream hasn't been open on any app for this long are marked as disconnected. Every app runs the sweep, so the timeout must be set to the same value on all apps. If 0, abandoned invocations stay in progress forever.")
+
 	cacheStatsFinalizationDelay = flag.Duration("cache_stats_finalization_delay", 500*time.Millisecond, "The time allowed for all metrics collectors across all apps to flush their local cache stats to the backing storage, before finalizing stats in the DB.")
+
+	invocationAttemptRetention = flag.String("app.invocation_attempt_retention", retainAllAttempts, "Which attempts of an invocation to keep when bazel retries a command with the same invocation ID. If 'all', the build events, logs and cache stats of every attempt are kept. If 'last', those of earlier attempts are deleted once the latest attempt is finalized.")
 )
 
 var cacheArtifactsBlobstorePath = path.Join("artifacts", "cache")
@@ -124,6 +140,10 @@ type BuildEventHandler struct {
 	statsRecorder    *statsRecorder
 	openChannels     *sync.WaitGroup
 	cancelFnsByInvID sync.Map // map of string invocationID => context.CancelFunc
+	quit             chan struct{}
+
+	mu                sync.Mutex               // PROTECTS(suspendedChannels)
+	suspendedChannels map[string]*EventChannel // invocation ID => channel
 }
 
 func NewBuildEventHandler(env environment.Env) *BuildEventHandler {
@@ -136,10 +156,15 @@ func NewBuildEventHandler(env environment.Env) *BuildEventHandler {
 	webhookNotifier.Start()
 
 	h := &BuildEventHandler{
-		env:              env,
-		statsRecorder:    statsRecorder,
-		openChannels:     openChannels,
-		cancelFnsByInvID: sync.Map{},
+		env:               env,
+		statsRecorder:     statsRecorder,
+		openChannels:      openChannels,
+		cancelFnsByInvID:  sync.Map{},
+		quit:              make(chan struct{}),
+		suspendedChannels: make(map[string]*EventChannel),
+	}
+	if *abandonedInvocationTimeout > 0 {
+		go h.disconnectAbandonedInvocations()
 	}
 	env.GetHealthChecker().RegisterShutdownFunction(func(ctx context.Context) error {
 		h.Stop()
@@ -153,12 +178,21 @@ func NewBuildEventHandler(env environment.Env) *BuildEventHandler {
 func (b *BuildEventHandler) OpenChannel(ctx context.Context, iid string) interfaces.BuildEventChannel {
 	invocation := &inpb.Invocation{InvocationId: iid}
 	buildEventAccumulator := accumulator.NewBEValues(invocation)
+	if e := b.resumeChannel(iid); e != nil {
+		log.CtxInfof(ctx, "Resuming suspended channel for invocation %q", iid)
+		return e
+	}
 	val, ok := b.cancelFnsByInvID.Load(iid)
 	if ok {
 		cancelFn := val.(context.CancelFunc)
 		cancelFn()
 	}
 
+	if *streamResumeTimeout > 0 {
+		// The channel may outlive the stream that opened it, if the stream is
+		// interrupted and later resumed. It's still cancelled on shutdown.
+		ctx = context.WithoutCancel(ctx)
+	}
 	ctx, cancel := context.WithCancel(ctx)
 	b.cancelFnsByInvID.Store(iid, cancel)
 
@@ -168,7 +202,7 @@ func (b *BuildEventHandler) OpenChannel(ctx context.Context, iid string) interfa
 		b.cancelFnsByInvID.Delete(iid)
 	}
 
-	return &EventChannel{
+	e := &EventChannel{
 		env:            b.env,
 		statsRecorder:  b.statsRecorder,
 		ctx:            ctx,
@@ -187,9 +221,103 @@ func (b *BuildEventHandler) OpenChannel(ctx context.Context, iid string) interfa
 		onClose:                     onClose,
 		attempt:                     1,
 	}
+	e.onSuspend = func() { b.suspendChannel(iid, e) }
+	return e
+}
+
+// suspendChannel keeps the channel of an interrupted stream around until it is
+// resumed by OpenChannel, or until the resume timeout expires, in which case
+// the invocation is finalized.
+func (b *BuildEventHandler) suspendChannel(iid string, e *EventChannel) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if prev := b.suspendedChannels[iid]; prev != nil {
+		prev.suspendTimer.Stop()
+		go b.finalizeSuspendedChannel(iid, prev)
+	}
+	b.suspendedChannels[iid] = e
+	e.suspendTimer = time.AfterFunc(*streamResumeTimeout, func() {
+		b.mu.Lock()
+		if b.suspendedChannels[iid] != e {
+			// Resumed concurrently.
+			b.mu.Unlock()
+			return
+		}
+		delete(b.suspendedChannels, iid)
+		b.mu.Unlock()
+		b.finalizeSuspendedChannel(iid, e)
+	})
+}
+
+// resumeChannel returns the suspended channel for the given invocation, or nil
+// if there is none.
+func (b *BuildEventHandler) resumeChannel(iid string) *EventChannel {
+	b.mu.Lock()
+	e := b.suspendedChannels[iid]
+	delete(b.suspendedChannels, iid)
+	b.mu.Unlock()
+	if e == nil {
+		return nil
+	}
+	e.suspendTimer.Stop()
+	e.resume()
+	return e
+}
+
+func (b *BuildEventHandler) finalizeSuspendedChannel(iid string, e *EventChannel) {
+	defer e.Close()
+	log.CtxWarningf(e.ctx, "Build event stream for invocation %q was not resumed in time, finalizing it", iid)
+	if err := e.FinalizeInvocation(iid); err != nil {
+		log.CtxWarningf(e.ctx, "Error finalizing suspended invocation %q: %s", iid, err)
+	}
+}
+
+// disconnectAbandonedInvocations periodically refreshes the invocations that
+// have a channel open on this app, and marks in-progress invocations that no
+// app has refreshed within the abandoned invocation timeout as disconnected.
+// This catches invocations whose channel was never finalized, e.g. because the
+// app handling it crashed.
+func (b *BuildEventHandler) disconnectAbandonedInvocations() {
+	ticker := time.NewTicker(*abandonedInvocationTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.quit:
+			return
+		case <-ticker.C:
+		}
+		ctx := b.env.GetServerContext()
+		var iids []string
+		b.cancelFnsByInvID.Range(func(key, val interface{}) bool {
+			iids = append(iids, key.(string))
+			return true
+		})
+		if len(iids) > 0 {
+			if err := b.env.GetInvocationDB().RefreshInvocations(ctx, iids); err != nil {
+				log.Warningf("Failed to refresh open invocations: %s", err)
+			}
+		}
+		n, err := b.env.GetInvocationDB().DisconnectAbandonedInvocations(ctx, time.Now().Add(-*abandonedInvocationTimeout))
+		if err != nil {
+			log.Warningf("Failed to disconnect abandoned invocations: %s", err)
+			continue
+		}
+		if n > 0 {
+			log.Infof("Marked %d abandoned invocation(s) as disconnected", n)
+		}
+	}
 }
 
 func (b *BuildEventHandler) Stop() {
+	close(b.quit)
+	b.mu.Lock()
+	suspended := b.suspendedChannels
+	b.suspendedChannels = make(map[string]*EventChannel)
+	b.mu.Unlock()
+	for iid, e := range suspended {
+		e.suspendTimer.Stop()
+		b.finalizeSuspendedChannel(iid, e)
+	}
 	b.cancelFnsByInvID.Range(func(key, val interface{}) bool {
 		iid := key.(string)
 		cancelFn := val.(context.CancelFunc)
@@ -221,6 +349,9 @@ type recordStatsTask struct {
 	persist                  *PersistArtifacts
 	kytheSSTableResourceName *rspb.ResourceName
 	invocationStatus         inspb.InvocationStatus
+	testLogs                 []*accumulator.TestLog
+	timingProfileURI         *url.URL
+	workflowArtifacts        []*build_event_stream.WorkflowArtifactPublished
 }
 
 // statsRecorder listens for finalized invocations and copies cache stats from
@@ -252,7 +383,11 @@ func newStatsRecorder(env environment.Env, openChannels *sync.WaitGroup, onStats
 // once they are available.
 func (r *statsRecorder) Enqueue(ctx context.Context, beValues *accumulator.BEValues) {
 	persist := &PersistArtifacts{}
-	if !*disablePersistArtifacts {
+	// Anonymous invocations on a public instance leave their artifacts in the
+	// cache to expire, rather than keeping copies in the blobstore.
+	_, authErr := r.env.GetAuthenticator().AuthenticatedUser(ctx)
+	anonymous := public_instance.Enabled() && authErr != nil
+	if !*disablePersistArtifacts && !anonymous {
 		testOutputURIs := beValues.TestOutputURIs()
 		persist.URIs = make([]*url.URL, 0, len(testOutputURIs))
 		persist.URIs = append(persist.URIs, beValues.BuildToolLogURIs()...)
@@ -283,6 +418,9 @@ func (r *statsRecorder) Enqueue(ctx context.Context, beValues *accumulator.BEVal
 		invocationStatus:         invocation.GetInvocationStatus(),
 		persist:                  persist,
 		kytheSSTableResourceName: beValues.KytheSSTableResourceName(),
+		testLogs:                 beValues.TestLogs(),
+		timingProfileURI:         beValues.TimingProfileURI(),
+		workflowArtifacts:        beValues.WorkflowArtifacts(),
 	}
 	select {
 	case r.tasks <- req:
@@ -402,6 +540,111 @@ func (r *statsRecorder) maybeIngestKytheSST(ctx context.Context, ij *invocationI
 	return err
 }
 
+// maybeIndexLogs adds the console log and test logs of the invocation to the
+// log index, if one is configured.
+func (r *statsRecorder) maybeIndexLogs(ctx context.Context, ij *invocationInfo, testLogs []*accumulator.TestLog) error {
+	logIndex := r.env.GetLogIndex()
+	if logIndex == nil {
+		return nil
+	}
+	ti, err := r.lookupInvocation(ctx, ij)
+	if err != nil {
+		return err
+	}
+	// Searches are scoped by group, so logs of anonymous invocations would
+	// never be returned.
+	if ti.GroupID == "" {
+		return nil
+	}
+	ctx = r.env.GetAuthenticator().AuthContextFromTrustedJWT(ctx, ij.jwt)
+
+	if ti.LastChunkId != "" && ti.LastChunkId != eventlog.EmptyId {
+		consoleLog := &interfaces.IndexedLog{
+			GroupID:                 ti.GroupID,
+			InvocationID:            ti.InvocationID,
+			InvocationCreatedAtUsec: ti.CreatedAtUsec,
+		}
+		c := chunkstore.New(r.env.GetBlobstore(), &chunkstore.ChunkstoreOptions{})
+		reader := c.Reader(ctx, eventlog.GetEventLogPathFromInvocationIdAndAttempt(ti.InvocationID, ti.Attempt))
+		err := logIndex.IndexLog(ctx, consoleLog, reader)
+		reader.Close()
+		if err != nil {
+			return status.WrapError(err, "index console log")
+		}
+	}
+
+	for _, testLog := range testLogs {
+		indexedLog := &interfaces.IndexedLog{
+			GroupID:                 ti.GroupID,
+			InvocationID:            ti.InvocationID,
+			TargetLabel:             testLog.TargetLabel,
+			InvocationCreatedAtUsec: ti.CreatedAtUsec,
+		}
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(r.env.GetPooledByteStreamClient().StreamBytestreamFile(ctx, testLog.URI, pw))
+		}()
+		err := logIndex.IndexLog(ctx, indexedLog, pr)
+		// Unblock the writer if the index stopped reading early.
+		pr.Close()
+		if err != nil {
+			log.CtxWarningf(ctx, "Failed to index test log of %q: %s", testLog.TargetLabel, err)
+		}
+	}
+	return nil
+}
+
+// maybeIngestTimingProfile stores the phase and critical path durations from
+// the invocation's timing profile, if ingestion is enabled.
+func (r *statsRecorder) maybeIngestTimingProfile(ctx context.Context, ij *invocationInfo, uri *url.URL) error {
+	if !timing_profile.Enabled() || uri == nil {
+		return nil
+	}
+	ti, err := r.lookupInvocation(ctx, ij)
+	if err != nil {
+		return err
+	}
+	// Trends are scoped by group, so profiles of anonymous invocations would
+	// never be returned.
+	if ti.GroupID == "" {
+		return nil
+	}
+	ctx = r.env.GetAuthenticator().AuthContextFromTrustedJWT(ctx, ij.jwt)
+	return timing_profile.Ingest(ctx, r.env, ti, uri)
+}
+
+// maybeDeletePreviousAttempts deletes the data of the attempts that preceded
+// the given attempt, if only the last attempt of each invocation is retained.
+func (r *statsRecorder) maybeDeletePreviousAttempts(ctx context.Context, ij *invocationInfo) error {
+	if *invocationAttemptRetention != retainLastAttempt || ij.attempt <= 1 {
+		return nil
+	}
+	var lastErr error
+	for attempt := uint64(1); attempt < ij.attempt; attempt++ {
+		if err := DeleteAttemptBlobs(ctx, r.env, ij.id, attempt); err != nil {
+			lastErr = err
+		}
+	}
+	if r.env.GetDBHandle() != nil {
+		err := r.env.GetDBHandle().NewQuery(ctx, "build_event_handler_delete_previous_attempts").Raw(
+			`DELETE FROM "InvocationAttempts" WHERE invocation_id = ? AND attempt < ?`, ij.id, ij.attempt).Exec().Error
+		if err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (r *statsRecorder) maybePersistWorkflowArtifacts(ctx context.Context, ij *invocationInfo, artifacts []*build_event_stream.WorkflowArtifactPublished) error {
+	ws := r.env.GetWorkflowService()
+	if len(artifacts) == 0 || ws == nil {
+		return nil
+	}
+	// Like cache artifacts, associate the cache requests with the app.
+	ctx = usageutil.WithLocalServerLabels(ctx)
+	return ws.PersistArtifacts(ctx, ij.id, artifacts)
+}
+
 func (r *statsRecorder) handleTask(ctx context.Context, task *recordStatsTask) {
 	start := time.Now()
 	defer func() {
@@ -467,7 +710,23 @@ func (r *statsRecorder) handleTask(ctx context.Context, task *recordStatsTask) {
 		)
 	}
 
+	if err := r.maybeIndexLogs(ctx, task.invocationInfo, task.testLogs); err != nil {
+		log.CtxWarningf(ctx, "Failed to index invocation logs: %s", err)
+	}
+
+	if err := r.maybeIngestTimingProfile(ctx, task.invocationInfo, task.timingProfileURI); err != nil {
+		log.CtxWarningf(ctx, "Failed to ingest timing profile: %s", err)
+	}
+
+	if err := r.maybeDeletePreviousAttempts(ctx, task.invocationInfo); err != nil {
+		log.CtxWarningf(ctx, "Failed to delete previous invocation attempts: %s", err)
+	}
+
 	ctx = r.env.GetAuthenticator().AuthContextFromTrustedJWT(ctx, task.invocationInfo.jwt)
+	if err := r.maybePersistWorkflowArtifacts(ctx, task.invocationInfo, task.workflowArtifacts); err != nil {
+		log.CtxWarningf(ctx, "Failed to persist workflow artifacts: %s", err)
+	}
+
 	eg, ctx := errgroup.WithContext(ctx)
 	eg.SetLimit(50) // Max concurrency when copying files from cache->blobstore.
 	for _, uri := range task.persist.URIs {
@@ -653,12 +912,14 @@ func (w *webhookNotifier) lookupAndCreateTask(ctx context.Context, ij *invocatio
 		return err
 	}
 
-	// Don't call webhooks for disconnected invocations.
-	if invocation.GetInvocationStatus() == inspb.InvocationStatus_DISCONNECTED_INVOCATION_STATUS {
-		return nil
-	}
-
+	disconnected := invocation.GetInvocationStatus() == inspb.InvocationStatus_DISCONNECTED_INVOCATION_STATUS
 	for _, hook := range w.env.GetWebhooks() {
+		// Only call webhooks for disconnected invocations if they ask for it.
+		if disconnected {
+			if h, ok := hook.(interfaces.DisconnectedInvocationWebhook); !ok || !h.NotifiesDisconnected() {
+				continue
+			}
+		}
 		w.tasks <- &notifyWebhookTask{
 			hook:           hook,
 			invocationInfo: ij,
@@ -792,8 +1053,16 @@ type EventChannel struct {
 	hasReceivedStartedEvent          bool
 	logWriter                        *eventlog.EventLogWriter
 	onClose                          func()
+	onSuspend                        func()
 	attempt                          uint64
 
+	// lastSequenceNumber is the sequence number of the last event handled by
+	// this channel. resumed is set once the channel has been resumed by a new
+	// stream, which may resend events that were already handled.
+	lastSequenceNumber int64
+	resumed            bool
+	suspendTimer       *time.Timer
+
 	// isVoid determines whether all EventChannel operations are NOPs. This is set
 	// when we're retrying an invocation that is already complete, or is
 	// incomplete but was created too far in the past.
@@ -808,6 +1077,25 @@ func (e *EventChannel) Close() {
 	e.onClose()
 }
 
+func (e *EventChannel) Resumable() bool {
+	return *streamResumeTimeout > 0 && !e.isVoid && e.ctx.Err() == nil
+}
+
+func (e *EventChannel) Suspend() bool {
+	if !e.Resumable() {
+		return false
+	}
+	e.onSuspend()
+	return true
+}
+
+// resume prepares a suspended channel to handle events from a new stream.
+func (e *EventChannel) resume() {
+	e.resumed = true
+	// The new stream's acks start from the first event it sends.
+	e.initialSequenceNumber = 0
+}
+
 func (e *EventChannel) FinalizeInvocation(iid string) error {
 	if e.isVoid {
 		return nil
@@ -839,6 +1127,9 @@ func (e *EventChannel) FinalizeInvocation(iid string) error {
 	if err != nil {
 		return err
 	}
+	// Invocations that are rejected for missing build metadata are still
+	// saved, so that their violations can be inspected.
+	buildMetadataErr := e.checkBuildMetadata(ctx, ti)
 
 	e.recordInvocationMetrics(ti)
 	updated, err := e.env.GetInvocationDB().UpdateInvocation(ctx, ti)
@@ -849,8 +1140,12 @@ func (e *EventChannel) FinalizeInvocation(iid string) error {
 		e.isVoid = true
 		return status.CanceledErrorf("Attempt %d of invocation %s pre-empted by more recent attempt, invocation not finalized.", e.attempt, iid)
 	}
+	if err := recordAttemptFinalized(ctx, e.env, ti); err != nil {
+		log.CtxWarningf(ctx, "Failed to record finalized invocation attempt: %s", err)
+	}
 
 	e.flushAPIFacets(iid)
+	e.publishInvocationUpdate(ctx, iid)
 
 	// Report a disconnect only if we successfully updated the invocation.
 	// This reduces the likelihood that the disconnected invocation's status
@@ -862,6 +1157,52 @@ func (e *EventChannel) FinalizeInvocation(iid string) error {
 
 	e.statsRecorder.Enqueue(ctx, e.beValues)
 	log.CtxInfof(ctx, "Finalized invocation in primary DB and enqueued for stats recording (status: %s)", invocation.GetInvocationStatus())
+	if buildMetadataErr != nil && invocation.GetInvocationStatus() == inspb.InvocationStatus_COMPLETE_INVOCATION_STATUS {
+		log.CtxInfof(ctx, "Rejecting invocation: %s", buildMetadataErr)
+		return buildMetadataErr
+	}
+	return nil
+}
+
+// checkBuildMetadata records whether the invocation's build metadata satisfies
+// the requirements of the authenticated group, and returns an error if the
+// group rejects invocations that don't.
+func (e *EventChannel) checkBuildMetadata(ctx context.Context, ti *tables.Invocation) error {
+	if e.env.GetDBHandle() == nil {
+		return nil
+	}
+	u, err := e.env.GetAuthenticator().AuthenticatedUser(e.ctx)
+	if err != nil || u.GetGroupID() == "" {
+		return nil
+	}
+	schema, err := build_metadata_schema.Load(ctx, e.env, u.GetGroupID())
+	if err != nil {
+		log.CtxWarningf(ctx, "Failed to load build metadata requirements: %s", err)
+		return nil
+	}
+	if schema == nil {
+		return nil
+	}
+	return schema.Check(e.beValues.BuildMetadata(), ti)
+}
+
+// loadRedactionRules applies the redaction rules of the authenticated group
+// to the events of this invocation.
+func (e *EventChannel) loadRedactionRules() error {
+	if e.env.GetDBHandle() == nil {
+		return nil
+	}
+	u, err := e.env.GetAuthenticator().AuthenticatedUser(e.ctx)
+	if err != nil || u.GetGroupID() == "" {
+		return nil
+	}
+	rules, err := redaction_rules.Load(e.ctx, e.env, u.GetGroupID())
+	if err != nil {
+		// Don't risk storing the secrets that the rules are meant to
+		// redact.
+		return status.UnavailableErrorf("load redaction rules: %s", err)
+	}
+	e.redactor.SetCustomRules(rules)
 	return nil
 }
 
@@ -951,11 +1292,23 @@ func (e *EventChannel) handleEvent(event *pepb.PublishBuildToolEventStreamReques
 	if e.initialSequenceNumber == 0 {
 		e.initialSequenceNumber = seqNo
 	}
+	if e.resumed {
+		// Bazel resends all events that it didn't receive an ack for, some of
+		// which we may have already handled.
+		if seqNo <= e.lastSequenceNumber {
+			return nil
+		}
+		if seqNo != e.lastSequenceNumber+1 {
+			return status.FailedPreconditionErrorf("resumed build event stream skipped events: got sequence number %d, want %d", seqNo, e.lastSequenceNumber+1)
+		}
+	}
+	e.lastSequenceNumber = seqNo
 	// We only allow initial sequence numbers greater than one in the case where
 	// Bazel failed to receive all of our ACKs after we finalized an invocation
 	// (marking it complete). In that case we just void the channel and ACK all
-	// events without doing any work.
-	if e.initialSequenceNumber > firstExpectedSequenceNumber {
+	// events without doing any work. Resumed channels continue from wherever
+	// the previous stream left off.
+	if !e.resumed && e.initialSequenceNumber > firstExpectedSequenceNumber {
 		// TODO: once https://github.com/bazelbuild/bazel/pull/18437 lands in
 		// Bazel, log an error if the client attempt number is 1 in this case,
 		// since today we're relying on Bazel to always start sending events
@@ -1029,6 +1382,16 @@ func (e *EventChannel) handleEvent(event *pepb.PublishBuildToolEventStreamReques
 				return err
 			}
 			e.statusReporter.SetBaseBuildBuddyURL(baseBBURL)
+			// Events are buffered until now, so the group's rules apply to
+			// every event that is stored.
+			if err := e.loadRedactionRules(); err != nil {
+				return err
+			}
+		} else if public_instance.Enabled() {
+			if err := public_instance.AllowAnonymousInvocation(e.ctx); err != nil {
+				return err
+			}
+			e.redactor.SetCustomRules(public_instance.RedactionRules())
 		}
 
 		invocationUUID, err := uuid.StringToBytes(iid)
@@ -1059,6 +1422,9 @@ func (e *EventChannel) handleEvent(event *pepb.PublishBuildToolEventStreamReques
 		e.attempt = ti.Attempt
 		e.ctx = log.EnrichContext(e.ctx, "invocation_attempt", fmt.Sprintf("%d", e.attempt))
 		log.CtxInfof(e.ctx, "Created invocation %q, attempt %d", ti.InvocationID, ti.Attempt)
+		if err := recordAttemptStarted(e.ctx, e.env, ti); err != nil {
+			log.CtxWarningf(e.ctx, "Failed to record invocation attempt: %s", err)
+		}
 		chunkFileSizeBytes := *chunkFileSizeBytes
 		if chunkFileSizeBytes == 0 {
 			chunkFileSizeBytes = defaultChunkFileSizeBytes
@@ -1187,6 +1553,7 @@ func (e *EventChannel) processSingleEvent(event *inpb.InvocationEvent, iid strin
 			if err := e.pw.Flush(e.ctx); err != nil {
 				return err
 			}
+			e.publishInvocationUpdate(e.ctx, iid)
 		}
 	}
 
@@ -1295,9 +1662,22 @@ func (e *EventChannel) writeBuildMetadata(ctx context.Context, invocationID stri
 		e.isVoid = true
 		return status.CanceledErrorf("Attempt %d of invocation %s pre-empted by more recent attempt, no build metadata written.", e.attempt, invocationID)
 	}
+	e.publishInvocationUpdate(ctx, invocationID)
 	return nil
 }
 
+// publishInvocationUpdate notifies anyone following the invocation that new
+// events were flushed or that the invocation was updated in the DB.
+func (e *EventChannel) publishInvocationUpdate(ctx context.Context, iid string) {
+	ps := e.env.GetPubSub()
+	if ps == nil {
+		return
+	}
+	if err := ps.Publish(ctx, GetInvocationUpdatesPubSubChannel(iid), ""); err != nil {
+		log.CtxWarningf(ctx, "Failed to publish invocation update: %s", err)
+	}
+}
+
 func (e *EventChannel) GetNumDroppedEvents() uint64 {
 	return e.numDroppedEventsBeforeProcessing
 }
@@ -1387,6 +1767,27 @@ func streamRawInvocationEvents(env environment.Env, ctx context.Context, streamI
 // LookupInvocation looks up the invocation, including all events. Prefer to use
 // LookupInvocationWithCallback whenever possible, which avoids buffering events
 // in memory.
+// FlushInvocationPermsToOLAPDB flushes a finished invocation to the OLAP DB
+// again after its permissions were changed, so that stats queries see the
+// new permissions. Changing the permissions doesn't change the invocation's
+// sort key, so the new row replaces the one flushed when it finished. The
+// caller must have already authorized the change.
+func FlushInvocationPermsToOLAPDB(ctx context.Context, env environment.Env, iid string) error {
+	if env.GetOLAPDBHandle() == nil || !*writeToOLAPDBEnabled {
+		return nil
+	}
+	ti := &tables.Invocation{}
+	if err := env.GetDBHandle().NewQuery(ctx, "build_event_handler_get_invocation_for_perms_flush").Raw(
+		`SELECT * FROM "Invocations" WHERE invocation_id = ?`, iid).Take(ti); err != nil {
+		return err
+	}
+	if ti.InvocationStatus == int64(inspb.InvocationStatus_PARTIAL_INVOCATION_STATUS) {
+		// It will be flushed with its current permissions when it finishes.
+		return nil
+	}
+	return env.GetOLAPDBHandle().FlushInvocationStats(ctx, ti)
+}
+
 func LookupInvocation(env environment.Env, ctx context.Context, iid string) (*inpb.Invocation, error) {
 	var events []*inpb.InvocationEvent
 	inv, err := LookupInvocationWithCallback(ctx, env, iid, func(event *inpb.InvocationEvent) error {
@@ -1528,11 +1929,22 @@ func LookupInvocationWithCallback(ctx context.Context, env environment.Env, iid
 		return nil
 	})
 
+	var attempts []*inpb.InvocationAttempt
+	eg.Go(func() error {
+		a, err := lookupAttempts(ctx, env, iid)
+		if err != nil {
+			return err
+		}
+		attempts = a
+		return nil
+	})
+
 	if err := eg.Wait(); err != nil {
 		return nil, err
 	}
 
 	invocation.ScoreCard = scoreCard
+	invocation.Attempts = attempts
 	return invocation, nil
 }
 
@@ -1583,6 +1995,10 @@ func (e *EventChannel) tableInvocationFromProto(p *inpb.Invocation, blobID strin
 	}
 	if p.ReadPermission == inpb.InvocationPermission_PUBLIC {
 		i.Perms |= perms.OTHERS_READ
+	} else if p.ReadPermission == inpb.InvocationPermission_OWNER && userGroupPerms.UserID != "" {
+		// Only builds by signed-in users (or user-owned API keys) have an
+		// owner that can be the only one to see them.
+		i.Perms = perms.OWNER_READ | perms.OWNER_WRITE
 	}
 	i.DownloadOutputsOption = int64(p.DownloadOutputsOption)
 	i.RemoteExecutionEnabled = p.RemoteExecutionEnabled
@@ -1590,6 +2006,13 @@ func (e *EventChannel) tableInvocationFromProto(p *inpb.Invocation, blobID strin
 	return i, nil
 }
 
+// GetInvocationUpdatesPubSubChannel returns the PubSub channel on which a
+// message is published whenever new events of an in-progress invocation are
+// flushed, or the invocation is updated in the DB.
+func GetInvocationUpdatesPubSubChannel(iid string) string {
+	return fmt.Sprintf("invocation/%s/updates", iid)
+}
+
 func GetStreamIdFromInvocationIdAndAttempt(iid string, attempt uint64) string {
 	if attempt == 0 {
 		// This invocation predates the attempt-tracking functionality, so its
@@ -1599,6 +2022,79 @@ func GetStreamIdFromInvocationIdAndAttempt(iid string, attempt uint64) string {
 	return iid + "/" + strconv.FormatUint(attempt, 10)
 }
 
+// DeleteAttemptBlobs deletes the data that an attempt of an invocation stored
+// in the blobstore: its build events, event log, and cache scorecard.
+func DeleteAttemptBlobs(ctx context.Context, env environment.Env, iid string, attempt uint64) error {
+	bs := env.GetBlobstore()
+	var lastErr error
+	if err := protofile.DeleteExistingChunks(ctx, bs, GetStreamIdFromInvocationIdAndAttempt(iid, attempt)); err != nil {
+		lastErr = err
+	}
+	eventLogPath := eventlog.GetEventLogPathFromInvocationIdAndAttempt(iid, attempt)
+	if err := chunkstore.New(bs, &chunkstore.ChunkstoreOptions{}).DeleteBlob(ctx, eventLogPath); err != nil {
+		lastErr = err
+	}
+	if err := scorecard.Delete(ctx, env, iid, attempt); err != nil {
+		lastErr = err
+	}
+	return lastErr
+}
+
+// recordAttemptStarted records a new attempt of an invocation.
+func recordAttemptStarted(ctx context.Context, env environment.Env, ti *tables.Invocation) error {
+	if env.GetDBHandle() == nil {
+		return nil
+	}
+	row := &tables.InvocationAttempt{
+		InvocationID:     ti.InvocationID,
+		Attempt:          ti.Attempt,
+		InvocationStatus: ti.InvocationStatus,
+	}
+	return env.GetDBHandle().GORM(ctx, "build_event_handler_create_attempt").Clauses(clause.OnConflict{UpdateAll: true}).Create(row).Error
+}
+
+// recordAttemptFinalized records the outcome of a finalized attempt of an
+// invocation.
+func recordAttemptFinalized(ctx context.Context, env environment.Env, ti *tables.Invocation) error {
+	if env.GetDBHandle() == nil {
+		return nil
+	}
+	return env.GetDBHandle().NewQuery(ctx, "build_event_handler_finalize_attempt").Raw(`
+		UPDATE "InvocationAttempts"
+		SET invocation_status = ?, success = ?, bazel_exit_code = ?, duration_usec = ?, updated_at_usec = ?
+		WHERE invocation_id = ? AND attempt = ?`,
+		ti.InvocationStatus, ti.Success, ti.BazelExitCode, ti.DurationUsec, env.GetDBHandle().NowFunc().UnixMicro(),
+		ti.InvocationID, ti.Attempt,
+	).Exec().Error
+}
+
+// lookupAttempts returns the recorded attempts of an invocation, oldest
+// first. Callers must already be authorized to read the invocation.
+func lookupAttempts(ctx context.Context, env environment.Env, iid string) ([]*inpb.InvocationAttempt, error) {
+	if env.GetDBHandle() == nil {
+		return nil, nil
+	}
+	rq := env.GetDBHandle().NewQuery(ctx, "build_event_handler_lookup_attempts").Raw(
+		`SELECT * FROM "InvocationAttempts" WHERE invocation_id = ? ORDER BY attempt ASC`, iid)
+	var attempts []*inpb.InvocationAttempt
+	err := db.ScanEach(rq, func(ctx context.Context, a *tables.InvocationAttempt) error {
+		attempts = append(attempts, &inpb.InvocationAttempt{
+			Attempt:          a.Attempt,
+			InvocationStatus: inspb.InvocationStatus(a.InvocationStatus),
+			Success:          a.Success,
+			BazelExitCode:    a.BazelExitCode,
+			DurationUsec:     a.DurationUsec,
+			CreatedAtUsec:    a.CreatedAtUsec,
+			UpdatedAtUsec:    a.UpdatedAtUsec,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return attempts, nil
+}
+
 func toStoredInvocation(inv *tables.Invocation) *sipb.StoredInvocation {
 	return &sipb.StoredInvocation{
 		InvocationId:     inv.InvocationID,
@@ -15,7 +15,9 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/clientip"
 	"github.com/buildbuddy-io/buildbuddy/server/util/protofile"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
@@ -26,6 +28,7 @@ import (
 	bspb "github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
 	bepb "github.com/buildbuddy-io/buildbuddy/proto/build_events"
 	clpb "github.com/buildbuddy-io/buildbuddy/proto/command_line"
+	grpb "github.com/buildbuddy-io/buildbuddy/proto/group"
 	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
 	inspb "github.com/buildbuddy-io/buildbuddy/proto/invocation_status"
 	pepb "github.com/buildbuddy-io/buildbuddy/proto/publish_build_event"
@@ -650,6 +653,55 @@ func TestHandleEventWithEnvAndMetadataRedaction(t *testing.T) {
 	assert.Contains(t, string(txt), "--client_env=FOO_SECRET=<REDACTED>", "Values of non-allowed env vars should be redacted")
 }
 
+func TestHandleEventWithRedactionRules(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	auth := testauth.NewTestAuthenticator(testauth.TestUsers("USER1", "GROUP1"))
+	te.SetAuthenticator(auth)
+	ctx := context.Background()
+	for i, rule := range []*tables.RedactionRule{
+		{Target: int32(grpb.RedactionRuleTarget_ENV_VAR_NAME_REDACTION_RULE_TARGET), Pattern: "AWS_.*"},
+		{Target: int32(grpb.RedactionRuleTarget_URL_REDACTION_RULE_TARGET), Pattern: `https://artifacts\.internal\S*`},
+	} {
+		rule.GroupID = "GROUP1"
+		rule.Position = int32(i)
+		err := te.GetDBHandle().NewQuery(ctx, "create_rule").Create(rule)
+		require.NoError(t, err)
+	}
+	testUUID, err := uuid.NewRandom()
+	require.NoError(t, err)
+	testInvocationID := testUUID.String()
+	handler := build_event_handler.NewBuildEventHandler(te)
+	channel := handler.OpenChannel(ctx, testInvocationID)
+
+	// All env vars are allowed, but the group's rules still apply. The
+	// command line is sent before the event with the API key, and must be
+	// redacted too.
+	request := streamRequest(startedEvent(
+		"--remote_header='"+testauth.APIKeyHeader+"=USER1' --build_metadata='ALLOW_ENV=*'",
+		&bspb.BuildEventId_StructuredCommandLine{StructuredCommandLine: &bspb.BuildEventId_StructuredCommandLineId{CommandLineLabel: "original command line"}},
+		&bspb.BuildEventId_WorkspaceStatus{},
+	), testInvocationID, 1)
+	require.NoError(t, channel.HandleEvent(request))
+	request = streamRequest(structuredCommandLineEvent(map[string]string{
+		"AWS_SECRET_ACCESS_KEY": "secret_env_value",
+		"REGION":                "us-west1",
+	}), testInvocationID, 2)
+	require.NoError(t, channel.HandleEvent(request))
+	request = streamRequest(workspaceStatusEvent(
+		"DOWNLOAD_URL", "https://artifacts.internal/builds?token=secret_url_token",
+	), testInvocationID, 3)
+	require.NoError(t, channel.HandleEvent(request))
+
+	invocation, err := build_event_handler.LookupInvocation(te, auth.AuthContextFromAPIKey(ctx, "USER1"), testInvocationID)
+	require.NoError(t, err)
+	txt, err := prototext.Marshal(invocation)
+	require.NoError(t, err)
+	assert.NotContains(t, string(txt), "secret_env_value")
+	assert.NotContains(t, string(txt), "secret_url_token")
+	assert.Contains(t, string(txt), "--client_env=AWS_SECRET_ACCESS_KEY=<REDACTED>")
+	assert.Contains(t, string(txt), "--client_env=REGION=us-west1")
+}
+
 func TestHandleEventWithUsageTracking(t *testing.T) {
 	te := testenv.GetTestEnv(t)
 	ut := &FakeUsageTracker{}
@@ -774,6 +826,173 @@ func TestFinishedFinalize(t *testing.T) {
 	assert.Equal(t, inspb.InvocationStatus_COMPLETE_INVOCATION_STATUS, invocation.InvocationStatus)
 }
 
+func TestFinalizeWithRequiredBuildMetadata(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		enforcement grpb.BuildMetadataEnforcement
+		metadata    map[string]string
+		compliance  inpb.BuildMetadataCompliance
+		violations  []string
+		rejected    bool
+	}{
+		{
+			name:        "Compliant",
+			enforcement: grpb.BuildMetadataEnforcement_REJECT_BUILD_METADATA_VIOLATIONS,
+			metadata:    map[string]string{"TEAM": "infra"},
+			compliance:  inpb.BuildMetadataCompliance_COMPLIANT_BUILD_METADATA,
+		},
+		{
+			name:        "Flagged",
+			enforcement: grpb.BuildMetadataEnforcement_FLAG_BUILD_METADATA_VIOLATIONS,
+			metadata:    map[string]string{"TEAM": "Infra"},
+			compliance:  inpb.BuildMetadataCompliance_NONCOMPLIANT_BUILD_METADATA,
+			violations:  []string{"TEAM"},
+		},
+		{
+			name:        "Rejected",
+			enforcement: grpb.BuildMetadataEnforcement_REJECT_BUILD_METADATA_VIOLATIONS,
+			metadata:    map[string]string{},
+			compliance:  inpb.BuildMetadataCompliance_NONCOMPLIANT_BUILD_METADATA,
+			violations:  []string{"TEAM"},
+			rejected:    true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			te := testenv.GetTestEnv(t)
+			auth := testauth.NewTestAuthenticator(testauth.TestUsers("USER1", "GROUP1"))
+			te.SetAuthenticator(auth)
+			ctx := context.Background()
+			err := te.GetDBHandle().NewQuery(ctx, "create_group").Create(&tables.Group{
+				GroupID:                  "GROUP1",
+				BuildMetadataEnforcement: int32(test.enforcement),
+			})
+			require.NoError(t, err)
+			err = te.GetDBHandle().NewQuery(ctx, "create_requirement").Create(&tables.BuildMetadataRequirement{
+				GroupID:     "GROUP1",
+				MetadataKey: "TEAM",
+				Pattern:     "[a-z]+",
+			})
+			require.NoError(t, err)
+
+			testUUID, err := uuid.NewRandom()
+			require.NoError(t, err)
+			testInvocationID := testUUID.String()
+			handler := build_event_handler.NewBuildEventHandler(te)
+			channel := handler.OpenChannel(ctx, testInvocationID)
+			for i, event := range []*anypb.Any{
+				startedEvent("--remote_header='"+testauth.APIKeyHeader+"=USER1'", &bspb.BuildEventId_BuildMetadata{}),
+				buildMetadataEvent(test.metadata),
+				finishedEvent(),
+			} {
+				err := channel.HandleEvent(streamRequest(event, testInvocationID, int64(i+1)))
+				require.NoError(t, err)
+			}
+
+			err = channel.FinalizeInvocation(testInvocationID)
+			if test.rejected {
+				assert.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition error, got %v", err)
+			} else {
+				require.NoError(t, err)
+			}
+
+			// The invocation is saved either way.
+			invocation, err := build_event_handler.LookupInvocation(te, auth.AuthContextFromAPIKey(ctx, "USER1"), testInvocationID)
+			require.NoError(t, err)
+			assert.Equal(t, inspb.InvocationStatus_COMPLETE_INVOCATION_STATUS, invocation.GetInvocationStatus())
+			assert.Equal(t, test.compliance, invocation.GetBuildMetadataCompliance())
+			assert.Equal(t, test.violations, invocation.GetBuildMetadataViolations())
+		})
+	}
+}
+
+func TestOwnerVisibility(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	auth := testauth.NewTestAuthenticator(testauth.TestUsers("USER1", "GROUP1", "USER2", "GROUP1"))
+	te.SetAuthenticator(auth)
+	ctx := context.Background()
+	testUUID, err := uuid.NewRandom()
+	require.NoError(t, err)
+	testInvocationID := testUUID.String()
+
+	handler := build_event_handler.NewBuildEventHandler(te)
+	channel := handler.OpenChannel(ctx, testInvocationID)
+	for i, event := range []*anypb.Any{
+		startedEvent("--remote_header='"+testauth.APIKeyHeader+"=USER1'", &bspb.BuildEventId_BuildMetadata{}),
+		buildMetadataEvent(map[string]string{"VISIBILITY": "OWNER"}),
+		finishedEvent(),
+	} {
+		err := channel.HandleEvent(streamRequest(event, testInvocationID, int64(i+1)))
+		require.NoError(t, err)
+	}
+	err = channel.FinalizeInvocation(testInvocationID)
+	require.NoError(t, err)
+
+	invocation, err := build_event_handler.LookupInvocation(te, auth.AuthContextFromAPIKey(ctx, "USER1"), testInvocationID)
+	require.NoError(t, err)
+	assert.Equal(t, inpb.InvocationPermission_OWNER, invocation.ReadPermission)
+
+	// Other members of the group can't see it.
+	_, err = build_event_handler.LookupInvocation(te, auth.AuthContextFromAPIKey(ctx, "USER2"), testInvocationID)
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+}
+
+func TestPublicInstanceAnonymousInvocations(t *testing.T) {
+	flags.Set(t, "public_instance.enabled", true)
+	flags.Set(t, "public_instance.anonymous_invocations_per_hour", 1)
+	te := testenv.GetTestEnv(t)
+	auth := testauth.NewTestAuthenticator(testauth.TestUsers("USER1", "GROUP1"))
+	te.SetAuthenticator(auth)
+	handler := build_event_handler.NewBuildEventHandler(te)
+	// Use a fresh client IP so that uploads from other runs of this test
+	// don't count against the limit.
+	clientUUID, err := uuid.NewRandom()
+	require.NoError(t, err)
+	ctx := context.WithValue(context.Background(), clientip.ContextKey, clientUUID.String())
+
+	startInvocation := func(options string) (string, error) {
+		testUUID, err := uuid.NewRandom()
+		require.NoError(t, err)
+		testInvocationID := testUUID.String()
+		channel := handler.OpenChannel(ctx, testInvocationID)
+		request := streamRequest(startedEvent(
+			options,
+			&bspb.BuildEventId_StructuredCommandLine{StructuredCommandLine: &bspb.BuildEventId_StructuredCommandLineId{CommandLineLabel: "original command line"}},
+			&bspb.BuildEventId_WorkspaceStatus{},
+		), testInvocationID, 1)
+		if err := channel.HandleEvent(request); err != nil {
+			return "", err
+		}
+		request = streamRequest(structuredCommandLineEvent(map[string]string{"REGION": "us-west1"}), testInvocationID, 2)
+		require.NoError(t, channel.HandleEvent(request))
+		// The workspace status event flushes the command line.
+		request = streamRequest(workspaceStatusEvent("COMMIT_SHA", "abc123"), testInvocationID, 3)
+		return testInvocationID, channel.HandleEvent(request)
+	}
+
+	// Allowed env vars are still redacted from anonymous invocations.
+	iid, err := startInvocation("--build_metadata='ALLOW_ENV=*'")
+	require.NoError(t, err)
+	invocation, err := build_event_handler.LookupInvocation(te, ctx, iid)
+	require.NoError(t, err)
+	txt, err := prototext.Marshal(invocation)
+	require.NoError(t, err)
+	assert.NotContains(t, string(txt), "us-west1")
+	assert.Contains(t, string(txt), "--client_env=REGION=<REDACTED>")
+
+	// The client has used up its anonymous invocations.
+	_, err = startInvocation("--build_metadata='ALLOW_ENV=*'")
+	assert.True(t, status.IsResourceExhaustedError(err), "expected ResourceExhausted error, got %v", err)
+
+	// Authenticated invocations aren't limited.
+	iid, err = startInvocation("--remote_header='" + testauth.APIKeyHeader + "=USER1' --build_metadata='ALLOW_ENV=*'")
+	require.NoError(t, err)
+	invocation, err = build_event_handler.LookupInvocation(te, auth.AuthContextFromAPIKey(ctx, "USER1"), iid)
+	require.NoError(t, err)
+	txt, err = prototext.Marshal(invocation)
+	require.NoError(t, err)
+	assert.Contains(t, string(txt), "--client_env=REGION=us-west1")
+}
+
 func TestUnfinishedFinalizeWithCanceledContext(t *testing.T) {
 	te := testenv.GetTestEnv(t)
 	auth := testauth.NewTestAuthenticator(testauth.TestUsers("USER1", "GROUP1"))
@@ -1293,6 +1512,87 @@ func TestRetryOnOldDisconnect(t *testing.T) {
 	assert.True(t, exists)
 }
 
+func TestInvocationAttemptRetention(t *testing.T) {
+	for _, test := range []struct {
+		retention             string
+		firstAttemptsRetained bool
+		wantAttempts          []uint64
+	}{
+		{retention: "all", firstAttemptsRetained: true, wantAttempts: []uint64{1, 2}},
+		{retention: "last", firstAttemptsRetained: false, wantAttempts: []uint64{2}},
+	} {
+		t.Run(test.retention, func(t *testing.T) {
+			te := testenv.GetTestEnv(t)
+			auth := testauth.NewTestAuthenticator(testauth.TestUsers("USER1", "GROUP1"))
+			te.SetAuthenticator(auth)
+			ctx := context.Background()
+			testUUID, err := uuid.NewRandom()
+			require.NoError(t, err)
+			testInvocationID := testUUID.String()
+			chunkSize := 128
+			flags.Set(t, "storage.chunk_file_size_bytes", chunkSize)
+			flags.Set(t, "cache_stats_finalization_delay", time.Duration(0))
+			flags.Set(t, "app.invocation_attempt_retention", test.retention)
+
+			handler := build_event_handler.NewBuildEventHandler(te)
+
+			// The first attempt is disconnected.
+			channel := handler.OpenChannel(ctx, testInvocationID)
+			request := streamRequest(startedEvent("--remote_header='"+testauth.APIKeyHeader+"=USER1'", &bspb.BuildEventId_WorkspaceStatus{}), testInvocationID, 1)
+			require.NoError(t, channel.HandleEvent(request))
+			request = streamRequest(progressEventWithOutput(strings.Repeat("a", chunkSize/2+1), ""), testInvocationID, 2)
+			require.NoError(t, channel.HandleEvent(request))
+			request = streamRequest(workspaceStatusEvent("COMMIT_SHA", "abc123"), testInvocationID, 3)
+			require.NoError(t, channel.HandleEvent(request))
+			require.NoError(t, channel.FinalizeInvocation(testInvocationID))
+
+			// The retry completes.
+			channel = handler.OpenChannel(ctx, testInvocationID)
+			request = streamRequest(startedEvent("--remote_header='"+testauth.APIKeyHeader+"=USER1'", &bspb.BuildEventId_WorkspaceStatus{}), testInvocationID, 1)
+			require.NoError(t, channel.HandleEvent(request))
+			request = streamRequest(workspaceStatusEvent("COMMIT_SHA", "def456"), testInvocationID, 2)
+			require.NoError(t, channel.HandleEvent(request))
+			request = streamRequest(finishedEvent(), testInvocationID, 3)
+			require.NoError(t, channel.HandleEvent(request))
+			require.NoError(t, channel.FinalizeInvocation(testInvocationID))
+
+			firstAttemptExists := func() bool {
+				exists, err := te.GetBlobstore().BlobExists(ctx, protofile.ChunkName(build_event_handler.GetStreamIdFromInvocationIdAndAttempt(testInvocationID, 1), 0))
+				require.NoError(t, err)
+				logExists, err := chunkstore.New(te.GetBlobstore(), &chunkstore.ChunkstoreOptions{}).BlobExists(ctx, eventlog.GetEventLogPathFromInvocationIdAndAttempt(testInvocationID, 1))
+				require.NoError(t, err)
+				return exists || logExists
+			}
+			// Earlier attempts are deleted in the background, once the stats
+			// of the latest attempt are recorded.
+			require.Eventually(t, func() bool {
+				invocation, err := build_event_handler.LookupInvocation(te, auth.AuthContextFromAPIKey(ctx, "USER1"), testInvocationID)
+				require.NoError(t, err)
+				var attempts []uint64
+				for _, a := range invocation.GetAttempts() {
+					attempts = append(attempts, a.GetAttempt())
+				}
+				return assert.ObjectsAreEqual(test.wantAttempts, attempts) && firstAttemptExists() == test.firstAttemptsRetained
+			}, 5*time.Second, 10*time.Millisecond)
+
+			invocation, err := build_event_handler.LookupInvocation(te, auth.AuthContextFromAPIKey(ctx, "USER1"), testInvocationID)
+			require.NoError(t, err)
+			assert.Equal(t, "def456", invocation.GetCommitSha())
+			attempts := invocation.GetAttempts()
+			if test.firstAttemptsRetained {
+				assert.Equal(t, inspb.InvocationStatus_DISCONNECTED_INVOCATION_STATUS, attempts[0].GetInvocationStatus())
+			}
+			last := attempts[len(attempts)-1]
+			assert.Equal(t, inspb.InvocationStatus_COMPLETE_INVOCATION_STATUS, last.GetInvocationStatus())
+			assert.True(t, last.GetSuccess())
+
+			exists, err := te.GetBlobstore().BlobExists(ctx, protofile.ChunkName(build_event_handler.GetStreamIdFromInvocationIdAndAttempt(testInvocationID, 2), 0))
+			require.NoError(t, err)
+			assert.True(t, exists)
+		})
+	}
+}
+
 func TestBuildStatusReporting(t *testing.T) {
 	for _, test := range []struct {
 		name           string
@@ -1529,3 +1829,90 @@ func TestTruncateStringSlice(t *testing.T) {
 func pointer[T any](value T) *T {
 	return &value
 }
+
+func TestResumeSuspendedChannel(t *testing.T) {
+	flags.Set(t, "app.build_event_stream_resume_timeout", time.Hour)
+	te := testenv.GetTestEnv(t)
+	auth := testauth.NewTestAuthenticator(testauth.TestUsers("USER1", "GROUP1"))
+	te.SetAuthenticator(auth)
+	ctx := context.Background()
+	testUUID, err := uuid.NewRandom()
+	require.NoError(t, err)
+	testInvocationID := testUUID.String()
+
+	handler := build_event_handler.NewBuildEventHandler(te)
+	channel := handler.OpenChannel(ctx, testInvocationID)
+	require.True(t, channel.Resumable())
+
+	request := streamRequest(startedEvent("--remote_header='"+testauth.APIKeyHeader+"=USER1'", &bspb.BuildEventId_WorkspaceStatus{}), testInvocationID, 1)
+	err = channel.HandleEvent(request)
+	require.NoError(t, err)
+	request = streamRequest(workspaceStatusEvent("COMMIT_SHA", "abc123"), testInvocationID, 2)
+	err = channel.HandleEvent(request)
+	require.NoError(t, err)
+
+	// Interrupt the stream, then resume it from the last event, which bazel
+	// resends since it wasn't acked.
+	require.True(t, channel.Suspend())
+	resumed := handler.OpenChannel(ctx, testInvocationID)
+	require.Same(t, channel, resumed)
+	request = streamRequest(workspaceStatusEvent("COMMIT_SHA", "abc123"), testInvocationID, 2)
+	err = resumed.HandleEvent(request)
+	require.NoError(t, err)
+	request = streamRequest(finishedEvent(), testInvocationID, 3)
+	err = resumed.HandleEvent(request)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), resumed.GetInitialSequenceNumber())
+
+	// Skipping events is an error.
+	request = streamRequest(progressEvent(), testInvocationID, 5)
+	err = resumed.HandleEvent(request)
+	require.Error(t, err)
+
+	err = resumed.FinalizeInvocation(testInvocationID)
+	require.NoError(t, err)
+	resumed.Close()
+
+	invocation, err := build_event_handler.LookupInvocation(te, auth.AuthContextFromAPIKey(ctx, "USER1"), testInvocationID)
+	require.NoError(t, err)
+	require.Equal(t, "abc123", invocation.CommitSha)
+	require.Equal(t, inspb.InvocationStatus_COMPLETE_INVOCATION_STATUS, invocation.InvocationStatus)
+	require.Equal(t, uint64(1), invocation.Attempt)
+}
+
+func TestSuspendedChannelFinalizedAfterTimeout(t *testing.T) {
+	flags.Set(t, "app.build_event_stream_resume_timeout", 10*time.Millisecond)
+	te := testenv.GetTestEnv(t)
+	auth := testauth.NewTestAuthenticator(testauth.TestUsers("USER1", "GROUP1"))
+	te.SetAuthenticator(auth)
+	ctx := context.Background()
+	testUUID, err := uuid.NewRandom()
+	require.NoError(t, err)
+	testInvocationID := testUUID.String()
+
+	handler := build_event_handler.NewBuildEventHandler(te)
+	channel := handler.OpenChannel(ctx, testInvocationID)
+	request := streamRequest(startedEvent("--remote_header='"+testauth.APIKeyHeader+"=USER1'", &bspb.BuildEventId_WorkspaceStatus{}), testInvocationID, 1)
+	err = channel.HandleEvent(request)
+	require.NoError(t, err)
+	request = streamRequest(workspaceStatusEvent("COMMIT_SHA", "abc123"), testInvocationID, 2)
+	err = channel.HandleEvent(request)
+	require.NoError(t, err)
+
+	require.True(t, channel.Suspend())
+	require.Eventually(t, func() bool {
+		invocation, err := build_event_handler.LookupInvocation(te, auth.AuthContextFromAPIKey(ctx, "USER1"), testInvocationID)
+		require.NoError(t, err)
+		return invocation.InvocationStatus == inspb.InvocationStatus_DISCONNECTED_INVOCATION_STATUS
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// A new stream starts a new attempt rather than resuming the finalized
+	// channel.
+	channel = handler.OpenChannel(ctx, testInvocationID)
+	request = streamRequest(startedEvent("--remote_header='"+testauth.APIKeyHeader+"=USER1'", &bspb.BuildEventId_WorkspaceStatus{}), testInvocationID, 1)
+	err = channel.HandleEvent(request)
+	require.NoError(t, err)
+	invocation, err := build_event_handler.LookupInvocation(te, auth.AuthContextFromAPIKey(ctx, "USER1"), testInvocationID)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), invocation.Attempt)
+}
@@ -0,0 +1,171 @@
+package build_event_proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/retry"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	pepb "github.com/buildbuddy-io/buildbuddy/proto/publish_build_event"
+)
+
+const blobstoreSinkDir = "build_event_streams"
+
+// BlobstoreSink is a build event proxy client that writes each build event
+// stream to a file in the blobstore, in the format of bazel's
+// --build_event_binary_file: a sequence of varint length-delimited
+// build_event_stream.BuildEvent protos.
+//
+// Events are written to the blob as they arrive, and the blob is committed
+// once the stream is closed. If bazel retries the stream, the file is
+// overwritten by the retry.
+type BlobstoreSink struct {
+	env     environment.Env
+	rootCtx context.Context
+}
+
+func NewBlobstoreSink(env environment.Env) *BlobstoreSink {
+	return &BlobstoreSink{
+		env:     env,
+		rootCtx: env.GetServerContext(),
+	}
+}
+
+// BlobName returns the name of the blob that the build event stream of the
+// given invocation is written to.
+func BlobName(invocationID string) string {
+	return fmt.Sprintf("%s/%s.binpb", blobstoreSinkDir, invocationID)
+}
+
+func (s *BlobstoreSink) PublishLifecycleEvent(_ context.Context, req *pepb.PublishLifecycleEventRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	return &emptypb.Empty{}, nil
+}
+
+func (s *BlobstoreSink) PublishBuildToolEventStream(_ context.Context, opts ...grpc.CallOption) (pepb.PublishBuildEvent_PublishBuildToolEventStreamClient, error) {
+	return &blobstoreSinkStream{
+		sink: s,
+		done: make(chan struct{}),
+	}, nil
+}
+
+type blobstoreSinkStream struct {
+	// Only Send, Recv, CloseSend and Context are supported.
+	grpc.ClientStream
+
+	sink *BlobstoreSink
+
+	mu           sync.Mutex // PROTECTS(invocationID, writer, buf, writeErr, closed)
+	invocationID string
+	writer       interfaces.CommittedWriteCloser
+	buf          []byte
+	writeErr     error
+	closed       bool
+
+	done chan struct{}
+	err  error // set before done is closed
+}
+
+func (bss *blobstoreSinkStream) Context() context.Context {
+	return bss.sink.rootCtx
+}
+
+func (bss *blobstoreSinkStream) ctx() context.Context {
+	return log.EnrichContext(bss.sink.rootCtx, log.InvocationIDKey, bss.invocationID)
+}
+
+// openWriter opens the writer of the stream's blob, retrying if that fails.
+func (bss *blobstoreSinkStream) openWriter() (interfaces.CommittedWriteCloser, error) {
+	var w interfaces.CommittedWriteCloser
+	open := func(ctx context.Context) error {
+		var err error
+		w, err = bss.sink.env.GetBlobstore().Writer(ctx, BlobName(bss.invocationID))
+		return err
+	}
+	if *maxRetries == 0 {
+		return w, open(bss.ctx())
+	}
+	opts := retryOptions()
+	opts.Name = "open build event stream blob"
+	err := retry.DoVoid(bss.ctx(), opts, open)
+	return w, err
+}
+
+func (bss *blobstoreSinkStream) Send(req *pepb.PublishBuildToolEventStreamRequest) error {
+	bss.mu.Lock()
+	defer bss.mu.Unlock()
+	if bss.closed {
+		return status.FailedPreconditionError("stream is closed")
+	}
+	if bss.writeErr != nil {
+		return bss.writeErr
+	}
+	obe := req.GetOrderedBuildEvent()
+	if bss.invocationID == "" {
+		bss.invocationID = obe.GetStreamId().GetInvocationId()
+	}
+	e := obe.GetEvent().GetBazelEvent()
+	if e == nil || bss.invocationID == "" {
+		return nil
+	}
+	if bss.writer == nil {
+		w, err := bss.openWriter()
+		if err != nil {
+			bss.writeErr = status.WrapError(err, "open build event stream blob")
+			return bss.writeErr
+		}
+		bss.writer = w
+	}
+	// The Any's value is the serialized build_event_stream.BuildEvent, so it
+	// can be written out as-is.
+	bss.buf = protowire.AppendVarint(bss.buf[:0], uint64(len(e.GetValue())))
+	bss.buf = append(bss.buf, e.GetValue()...)
+	if _, err := bss.writer.Write(bss.buf); err != nil {
+		bss.writeErr = status.WrapError(err, "write build event stream blob")
+		bss.writer.Close()
+		bss.writer = nil
+		return bss.writeErr
+	}
+	return nil
+}
+
+// Recv waits until the stream's blob has been committed.
+func (bss *blobstoreSinkStream) Recv() (*pepb.PublishBuildToolEventStreamResponse, error) {
+	<-bss.done
+	if bss.err != nil {
+		return nil, bss.err
+	}
+	return nil, io.EOF
+}
+
+func (bss *blobstoreSinkStream) CloseSend() error {
+	bss.mu.Lock()
+	defer bss.mu.Unlock()
+	if bss.closed {
+		return nil
+	}
+	bss.closed = true
+	w, writeErr := bss.writer, bss.writeErr
+	bss.writer = nil
+	go func() {
+		defer close(bss.done)
+		if writeErr != nil {
+			bss.err = writeErr
+		} else if w != nil {
+			bss.err = w.Commit()
+			w.Close()
+		}
+		if bss.err != nil {
+			log.CtxWarningf(bss.ctx(), "Failed to write build event stream to blobstore: %s", bss.err)
+		}
+	}()
+	return nil
+}
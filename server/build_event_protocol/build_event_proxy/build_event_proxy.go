@@ -2,13 +2,17 @@ package build_event_proxy
 
 import (
 	"context"
+	"io"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
 	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
 	"github.com/buildbuddy-io/buildbuddy/server/util/grpc_client"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/retry"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
@@ -20,6 +24,16 @@ import (
 var (
 	hosts      = flag.Slice("build_event_proxy.hosts", []string{}, "The list of hosts to pass build events onto.")
 	bufferSize = flag.Int("build_event_proxy.buffer_size", 100, "The number of build events to buffer locally when proxying build events.")
+
+	maxRetries          = flag.Int("build_event_proxy.max_retries", 5, "The maximum number of times a build event stream is reopened and resent to a proxy host after it fails. Each host is retried independently.")
+	retryInitialBackoff = flag.Duration("build_event_proxy.retry_initial_backoff", 500*time.Millisecond, "How long to wait before first reopening a failed build event stream to a proxy host. The wait doubles on each subsequent retry, up to build_event_proxy.retry_max_backoff.")
+	retryMaxBackoff     = flag.Duration("build_event_proxy.retry_max_backoff", 30*time.Second, "The maximum time to wait before reopening a failed build event stream to a proxy host.")
+	retryBufferSize     = flag.Int("build_event_proxy.retry_buffer_size", 100_000, "The maximum number of build events per stream that are retained until acknowledged by a proxy host, so that they can be resent if the stream fails. Streams with more unacknowledged events are not retried.")
+
+	blobstoreSinkEnabled = flag.Bool("build_event_proxy.blobstore_sink.enabled", false, "If true, each build event stream is also written to the blobstore as build_event_streams/<invocation_id>.binpb, in the format of bazel's --build_event_binary_file. Events are written as they arrive, and files are committed once their stream is closed.")
+
+	kafkaSinkBrokers = flag.Slice("build_event_proxy.kafka_sink.brokers", []string{}, "The kafka brokers to produce build events to. If set, each bazel event is also produced to build_event_proxy.kafka_sink.topic, keyed by invocation ID.")
+	kafkaSinkTopic   = flag.String("build_event_proxy.kafka_sink.topic", "build_events", "The kafka topic that build events are produced to.")
 )
 
 type BuildEventProxyClient struct {
@@ -46,13 +60,25 @@ func (c *BuildEventProxyClient) reconnectIfNecessary() {
 }
 
 func Register(env *real_environment.RealEnv) error {
-	buildEventProxyClients := make([]pepb.PublishBuildEventClient, len(*hosts))
-	for i, target := range *hosts {
+	buildEventProxyClients := make([]pepb.PublishBuildEventClient, 0, len(*hosts)+2)
+	for _, target := range *hosts {
 		// NB: This can block for up to a second on connecting. This would be a
 		// great place to have our health checker and mark these as optional.
-		buildEventProxyClients[i] = NewBuildEventProxyClient(env, target, false)
+		buildEventProxyClients = append(buildEventProxyClients, NewBuildEventProxyClient(env, target, false))
 		log.Printf("Proxy: forwarding build events to: %s", target)
 	}
+	if *blobstoreSinkEnabled {
+		buildEventProxyClients = append(buildEventProxyClients, NewBlobstoreSink(env))
+		log.Printf("Proxy: writing build events to the blobstore")
+	}
+	if len(*kafkaSinkBrokers) > 0 {
+		w := NewKafkaWriter(*kafkaSinkBrokers, *kafkaSinkTopic)
+		env.GetHealthChecker().RegisterShutdownFunction(func(ctx context.Context) error {
+			return w.Close()
+		})
+		buildEventProxyClients = append(buildEventProxyClients, NewKafkaSink(env, w))
+		log.Printf("Proxy: producing build events to kafka topic %q", *kafkaSinkTopic)
+	}
 	env.SetBuildEventProxyClients(buildEventProxyClients)
 	return nil
 }
@@ -86,41 +112,191 @@ func (c *BuildEventProxyClient) PublishLifecycleEvent(_ context.Context, req *pe
 type asyncStreamProxy struct {
 	pepb.PublishBuildEvent_PublishBuildToolEventStreamClient
 	ctx    context.Context
+	client pepb.PublishBuildEventClient
+	opts   []grpc.CallOption
 	events chan *pepb.PublishBuildToolEventStreamRequest
+
+	// Events that were sent to the proxy host but not yet acknowledged by it.
+	// They are resent if the stream has to be reopened.
+	mu       sync.Mutex // PROTECTS(unacked, overflow)
+	unacked  []*pepb.PublishBuildToolEventStreamRequest
+	overflow bool
+
+	done chan struct{}
+	err  error // set before done is closed
+}
+
+func retryOptions() *retry.Options {
+	return &retry.Options{
+		InitialBackoff: *retryInitialBackoff,
+		MaxBackoff:     *retryMaxBackoff,
+		Multiplier:     2,
+		MaxRetries:     *maxRetries,
+	}
 }
 
 func (c *BuildEventProxyClient) newAsyncStreamProxy(ctx context.Context, opts ...grpc.CallOption) (*asyncStreamProxy, error) {
 	asp := &asyncStreamProxy{
 		ctx:    ctx,
+		client: c.client,
+		opts:   opts,
 		events: make(chan *pepb.PublishBuildToolEventStreamRequest, *bufferSize),
+		done:   make(chan struct{}),
 	}
-	stream, err := c.client.PublishBuildToolEventStream(ctx, opts...)
+	stream, cancel, err := asp.openStream()
 	if err != nil {
 		log.Warningf("Error opening BES stream to proxy: %s", err.Error())
 		return nil, status.UnavailableErrorf("Error opening BES stream to proxy: %s", err.Error())
 	}
 	asp.PublishBuildEvent_PublishBuildToolEventStreamClient = stream
-	// Start a goroutine that will open the stream and pass along events.
+	// Start a goroutine that will pass along events, reopening the stream
+	// with backoff if it fails. Each proxy host is retried independently, so
+	// a slow or failing host doesn't hold up the others.
 	go func() {
-		// `range` *copies* the values it returns into the loopvar, and
-		// copies of protos are not permitted, so rather than range over the
-		// channel we read from the channel inside of an outer loop.
+		defer close(asp.done)
+		r := retry.New(ctx, retryOptions())
+		r.Next() // The first attempt is made without delay.
 		for {
-			req, ok := <-asp.events
-			if !ok {
-				break
+			err := asp.forward(stream)
+			cancel()
+			if err == nil {
+				return
 			}
-			err := stream.Send(req)
-			if err != nil {
-				log.Warningf("Error sending req on stream: %s", err.Error())
-				break
+			if !asp.canRetry() || !r.Next() {
+				log.Warningf("Error proxying BES stream, giving up: %s", err)
+				asp.err = err
+				asp.drain()
+				return
+			}
+			log.Warningf("Error proxying BES stream, retrying (attempt %d): %s", r.AttemptNumber(), err)
+			stream, cancel, err = asp.openStream()
+			for err != nil {
+				if !r.Next() {
+					log.Warningf("Error reopening BES stream to proxy, giving up: %s", err)
+					asp.err = err
+					asp.drain()
+					return
+				}
+				stream, cancel, err = asp.openStream()
 			}
 		}
-		stream.CloseSend()
 	}()
 	return asp, nil
 }
 
+// openStream opens a stream to the proxy host. The returned cancel func must
+// be called once the stream is no longer used.
+func (asp *asyncStreamProxy) openStream() (pepb.PublishBuildEvent_PublishBuildToolEventStreamClient, context.CancelFunc, error) {
+	ctx, cancel := context.WithCancel(asp.ctx)
+	stream, err := asp.client.PublishBuildToolEventStream(ctx, asp.opts...)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return stream, cancel, nil
+}
+
+// forward resends any unacknowledged events on the stream, then sends events
+// as they arrive until the stream is closed. It returns nil once the proxy
+// host has closed its end of the stream after all events were sent.
+func (asp *asyncStreamProxy) forward(stream pepb.PublishBuildEvent_PublishBuildToolEventStreamClient) error {
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			rsp, err := stream.Recv()
+			if err == io.EOF {
+				recvErr <- nil
+				return
+			}
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			asp.ack(rsp.GetSequenceNumber())
+		}
+	}()
+
+	asp.mu.Lock()
+	resend := slices.Clone(asp.unacked)
+	asp.mu.Unlock()
+	for _, req := range resend {
+		if err := stream.Send(req); err != nil {
+			return err
+		}
+	}
+
+	// `range` *copies* the values it returns into the loopvar, and
+	// copies of protos are not permitted, so rather than range over the
+	// channel we read from the channel inside of an outer loop.
+	for {
+		select {
+		case req, ok := <-asp.events:
+			if !ok {
+				if err := stream.CloseSend(); err != nil {
+					return err
+				}
+				return <-recvErr
+			}
+			asp.retain(req)
+			if err := stream.Send(req); err != nil {
+				return err
+			}
+		case err := <-recvErr:
+			if err == nil {
+				return status.UnavailableError("proxy host closed the stream before all events were sent")
+			}
+			return err
+		}
+	}
+}
+
+// retain keeps a copy of an event until it is acknowledged, so that it can be
+// resent if the stream is reopened.
+func (asp *asyncStreamProxy) retain(req *pepb.PublishBuildToolEventStreamRequest) {
+	asp.mu.Lock()
+	defer asp.mu.Unlock()
+	if asp.overflow {
+		return
+	}
+	if len(asp.unacked) >= *retryBufferSize {
+		log.Warningf("BuildEventProxy retry buffer is full; the stream will not be retried if it fails.")
+		asp.overflow = true
+		asp.unacked = nil
+		return
+	}
+	asp.unacked = append(asp.unacked, req)
+}
+
+// ack drops all events up to and including the given sequence number, since
+// events are acknowledged in order.
+func (asp *asyncStreamProxy) ack(sequenceNumber int64) {
+	asp.mu.Lock()
+	defer asp.mu.Unlock()
+	i := 0
+	for i < len(asp.unacked) && asp.unacked[i].GetOrderedBuildEvent().GetSequenceNumber() <= sequenceNumber {
+		i++
+	}
+	asp.unacked = asp.unacked[i:]
+}
+
+func (asp *asyncStreamProxy) canRetry() bool {
+	asp.mu.Lock()
+	defer asp.mu.Unlock()
+	return *maxRetries > 0 && !asp.overflow
+}
+
+// drain discards events sent after the stream has failed, so that it's safe
+// to keep calling Send.
+func (asp *asyncStreamProxy) drain() {
+	go func() {
+		for {
+			if _, ok := <-asp.events; !ok {
+				return
+			}
+		}
+	}()
+}
+
 func (asp *asyncStreamProxy) Send(req *pepb.PublishBuildToolEventStreamRequest) error {
 	select {
 	case asp.events <- req:
@@ -131,8 +307,16 @@ func (asp *asyncStreamProxy) Send(req *pepb.PublishBuildToolEventStreamRequest)
 	return nil
 }
 
+// Recv waits until all events have been forwarded to the proxy host, or
+// forwarding has failed after exhausting retries. Acknowledgements from the
+// proxy host are consumed internally, since they are needed to decide which
+// events to resend.
 func (asp *asyncStreamProxy) Recv() (*pepb.PublishBuildToolEventStreamResponse, error) {
-	return asp.PublishBuildEvent_PublishBuildToolEventStreamClient.Recv()
+	<-asp.done
+	if asp.err != nil {
+		return nil, asp.err
+	}
+	return nil, io.EOF
 }
 
 func (asp *asyncStreamProxy) CloseSend() error {
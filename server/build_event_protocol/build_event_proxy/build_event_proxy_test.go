@@ -0,0 +1,363 @@
+package build_event_proxy_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_proxy"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/google/go-cmp/cmp"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	bspb "github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	bepb "github.com/buildbuddy-io/buildbuddy/proto/build_events"
+	pepb "github.com/buildbuddy-io/buildbuddy/proto/publish_build_event"
+)
+
+func progressEvent(stdout string) *bspb.BuildEvent {
+	return &bspb.BuildEvent{
+		Id: &bspb.BuildEventId{Id: &bspb.BuildEventId_Progress{}},
+		Payload: &bspb.BuildEvent_Progress{
+			Progress: &bspb.Progress{Stdout: stdout},
+		},
+	}
+}
+
+func streamRequest(t *testing.T, iid string, sequenceNumber int64, event *bspb.BuildEvent) *pepb.PublishBuildToolEventStreamRequest {
+	eventAny, err := anypb.New(event)
+	require.NoError(t, err)
+	return &pepb.PublishBuildToolEventStreamRequest{
+		OrderedBuildEvent: &pepb.OrderedBuildEvent{
+			SequenceNumber: sequenceNumber,
+			StreamId:       &bepb.StreamId{InvocationId: iid},
+			Event: &bepb.BuildEvent{
+				Event: &bepb.BuildEvent_BazelEvent{BazelEvent: eventAny},
+			},
+		},
+	}
+}
+
+// fakeBESServer acks all events once its client closes the stream, like the
+// BuildBuddy build event server. The first failStreams streams fail after
+// receiving their first event.
+type fakeBESServer struct {
+	failStreams int
+
+	mu       sync.Mutex
+	streams  int
+	received [][]int64
+}
+
+func (s *fakeBESServer) PublishLifecycleEvent(ctx context.Context, req *pepb.PublishLifecycleEventRequest) (*emptypb.Empty, error) {
+	return &emptypb.Empty{}, nil
+}
+
+func (s *fakeBESServer) PublishBuildToolEventStream(stream pepb.PublishBuildEvent_PublishBuildToolEventStreamServer) error {
+	s.mu.Lock()
+	s.streams++
+	fail := s.streams <= s.failStreams
+	s.mu.Unlock()
+
+	var seqs []int64
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if fail {
+			return status.UnavailableError("injected failure")
+		}
+		seqs = append(seqs, req.GetOrderedBuildEvent().GetSequenceNumber())
+	}
+	s.mu.Lock()
+	s.received = append(s.received, seqs)
+	s.mu.Unlock()
+	for _, seq := range seqs {
+		if err := stream.Send(&pepb.PublishBuildToolEventStreamResponse{SequenceNumber: seq}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func startFakeBESServer(t *testing.T, s *fakeBESServer) string {
+	lis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	pepb.RegisterPublishBuildEventServer(server, s)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return fmt.Sprintf("grpc://localhost:%d", lis.Addr().(*net.TCPAddr).Port)
+}
+
+func TestProxyClient_RetriesFailedStream(t *testing.T) {
+	flags.Set(t, "build_event_proxy.retry_initial_backoff", time.Millisecond)
+	env := testenv.GetTestEnv(t)
+	server := &fakeBESServer{failStreams: 2}
+	target := startFakeBESServer(t, server)
+	client := build_event_proxy.NewBuildEventProxyClient(env, target, false)
+
+	stream, err := client.PublishBuildToolEventStream(context.Background())
+	require.NoError(t, err)
+	for i := int64(1); i <= 3; i++ {
+		err := stream.Send(streamRequest(t, "test-invocation", i, progressEvent("")))
+		require.NoError(t, err)
+	}
+	err = stream.CloseSend()
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	require.Equal(t, 3, server.streams)
+	require.Equal(t, [][]int64{{1, 2, 3}}, server.received)
+}
+
+func TestProxyClient_GivesUpAfterMaxRetries(t *testing.T) {
+	flags.Set(t, "build_event_proxy.retry_initial_backoff", time.Millisecond)
+	flags.Set(t, "build_event_proxy.max_retries", 1)
+	env := testenv.GetTestEnv(t)
+	server := &fakeBESServer{failStreams: 2}
+	target := startFakeBESServer(t, server)
+	client := build_event_proxy.NewBuildEventProxyClient(env, target, false)
+
+	stream, err := client.PublishBuildToolEventStream(context.Background())
+	require.NoError(t, err)
+	err = stream.Send(streamRequest(t, "test-invocation", 1, progressEvent("")))
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.True(t, status.IsUnavailableError(err), "expected Unavailable error, got %v", err)
+	// Sending after the stream has failed should not block.
+	for i := int64(2); i <= 1000; i++ {
+		err := stream.Send(streamRequest(t, "test-invocation", i, progressEvent("")))
+		require.NoError(t, err)
+	}
+	err = stream.CloseSend()
+	require.NoError(t, err)
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	require.Equal(t, 2, server.streams)
+	require.Empty(t, server.received)
+}
+
+func TestBlobstoreSink(t *testing.T) {
+	env := testenv.GetTestEnv(t)
+	sink := build_event_proxy.NewBlobstoreSink(env)
+
+	stream, err := sink.PublishBuildToolEventStream(context.Background())
+	require.NoError(t, err)
+	events := []*bspb.BuildEvent{progressEvent("foo"), progressEvent("bar")}
+	for i, event := range events {
+		err := stream.Send(streamRequest(t, "test-invocation", int64(i+1), event))
+		require.NoError(t, err)
+	}
+	err = stream.CloseSend()
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+
+	data, err := env.GetBlobstore().ReadBlob(context.Background(), build_event_proxy.BlobName("test-invocation"))
+	require.NoError(t, err)
+
+	r := bufio.NewReader(bytes.NewReader(data))
+	var got []*bspb.BuildEvent
+	for {
+		event := &bspb.BuildEvent{}
+		err := protodelim.UnmarshalFrom(r, event)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		got = append(got, event)
+	}
+	require.Empty(t, cmp.Diff(events, got, protocmp.Transform()))
+}
+
+// recordingBlobstore records the bytes written to blob writers before they're
+// committed, and can be made to fail writes.
+type recordingBlobstore struct {
+	interfaces.Blobstore
+
+	mu       sync.Mutex
+	written  int
+	writeErr error
+}
+
+func (bs *recordingBlobstore) Writer(ctx context.Context, blobName string) (interfaces.CommittedWriteCloser, error) {
+	w, err := bs.Blobstore.Writer(ctx, blobName)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingWriter{CommittedWriteCloser: w, bs: bs}, nil
+}
+
+func (bs *recordingBlobstore) bytesWritten() int {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return bs.written
+}
+
+type recordingWriter struct {
+	interfaces.CommittedWriteCloser
+	bs *recordingBlobstore
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.bs.mu.Lock()
+	defer w.bs.mu.Unlock()
+	if w.bs.writeErr != nil {
+		return 0, w.bs.writeErr
+	}
+	w.bs.written += len(p)
+	return w.CommittedWriteCloser.Write(p)
+}
+
+func TestBlobstoreSink_StreamsEvents(t *testing.T) {
+	env := testenv.GetTestEnv(t)
+	bs := &recordingBlobstore{Blobstore: env.GetBlobstore()}
+	env.SetBlobstore(bs)
+	sink := build_event_proxy.NewBlobstoreSink(env)
+
+	stream, err := sink.PublishBuildToolEventStream(context.Background())
+	require.NoError(t, err)
+	err = stream.Send(streamRequest(t, "test-invocation", 1, progressEvent("foo")))
+	require.NoError(t, err)
+	// Events are written as they arrive, rather than buffered until the
+	// stream is closed.
+	written := bs.bytesWritten()
+	require.Greater(t, written, 0)
+	err = stream.Send(streamRequest(t, "test-invocation", 2, progressEvent("bar")))
+	require.NoError(t, err)
+	require.Greater(t, bs.bytesWritten(), written)
+
+	// The blob isn't visible until the stream is closed.
+	exists, err := env.GetBlobstore().BlobExists(context.Background(), build_event_proxy.BlobName("test-invocation"))
+	require.NoError(t, err)
+	require.False(t, exists)
+	err = stream.CloseSend()
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+	exists, err = env.GetBlobstore().BlobExists(context.Background(), build_event_proxy.BlobName("test-invocation"))
+	require.NoError(t, err)
+	require.True(t, exists)
+}
+
+func TestBlobstoreSink_WriteError(t *testing.T) {
+	env := testenv.GetTestEnv(t)
+	bs := &recordingBlobstore{Blobstore: env.GetBlobstore(), writeErr: status.UnavailableError("write failed")}
+	env.SetBlobstore(bs)
+	sink := build_event_proxy.NewBlobstoreSink(env)
+
+	stream, err := sink.PublishBuildToolEventStream(context.Background())
+	require.NoError(t, err)
+	err = stream.Send(streamRequest(t, "test-invocation", 1, progressEvent("foo")))
+	require.True(t, status.IsUnavailableError(err), "Send: %v", err)
+	err = stream.CloseSend()
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.True(t, status.IsUnavailableError(err), "Recv: %v", err)
+	exists, err := env.GetBlobstore().BlobExists(context.Background(), build_event_proxy.BlobName("test-invocation"))
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
+// fakeKafkaWriter records the messages written to it. The first failWrites
+// writes fail.
+type fakeKafkaWriter struct {
+	failWrites int
+
+	mu       sync.Mutex
+	writes   int
+	messages []kafka.Message
+}
+
+func (w *fakeKafkaWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes++
+	if w.writes <= w.failWrites {
+		return status.UnavailableError("write failed")
+	}
+	w.messages = append(w.messages, msgs...)
+	return nil
+}
+
+func TestKafkaSink(t *testing.T) {
+	flags.Set(t, "build_event_proxy.retry_initial_backoff", time.Millisecond)
+	env := testenv.GetTestEnv(t)
+	w := &fakeKafkaWriter{failWrites: 2}
+	sink := build_event_proxy.NewKafkaSink(env, w)
+
+	stream, err := sink.PublishBuildToolEventStream(context.Background())
+	require.NoError(t, err)
+	events := []*bspb.BuildEvent{progressEvent("foo"), progressEvent("bar"), progressEvent("baz")}
+	for i, event := range events {
+		err := stream.Send(streamRequest(t, "test-invocation", int64(i+1), event))
+		require.NoError(t, err)
+	}
+	err = stream.CloseSend()
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+
+	// Failed writes are retried, and each event is produced once, in order,
+	// keyed by invocation ID.
+	var got []*bspb.BuildEvent
+	for i, msg := range w.messages {
+		require.Equal(t, "test-invocation", string(msg.Key))
+		require.Equal(t, []kafka.Header{{Key: "sequence_number", Value: []byte(fmt.Sprint(i + 1))}}, msg.Headers)
+		event := &bspb.BuildEvent{}
+		err := proto.Unmarshal(msg.Value, event)
+		require.NoError(t, err)
+		got = append(got, event)
+	}
+	require.Empty(t, cmp.Diff(events, got, protocmp.Transform()))
+}
+
+func TestKafkaSink_GivesUpAfterMaxRetries(t *testing.T) {
+	flags.Set(t, "build_event_proxy.max_retries", 2)
+	flags.Set(t, "build_event_proxy.retry_initial_backoff", time.Millisecond)
+	env := testenv.GetTestEnv(t)
+	w := &fakeKafkaWriter{failWrites: 100}
+	sink := build_event_proxy.NewKafkaSink(env, w)
+
+	stream, err := sink.PublishBuildToolEventStream(context.Background())
+	require.NoError(t, err)
+	err = stream.Send(streamRequest(t, "test-invocation", 1, progressEvent("foo")))
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.True(t, status.IsUnavailableError(err), "Recv: %v", err)
+
+	// Sending after producing has failed doesn't block.
+	for i := range 1000 {
+		err = stream.Send(streamRequest(t, "test-invocation", int64(i+2), progressEvent("bar")))
+		require.NoError(t, err)
+	}
+	err = stream.CloseSend()
+	require.NoError(t, err)
+	require.Equal(t, 3, w.writes)
+	require.Empty(t, w.messages)
+}
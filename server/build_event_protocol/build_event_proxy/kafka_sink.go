@@ -0,0 +1,212 @@
+package build_event_proxy
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/retry"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/segmentio/kafka-go"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	pepb "github.com/buildbuddy-io/buildbuddy/proto/publish_build_event"
+)
+
+const (
+	// The header holding the event's sequence number within its stream.
+	kafkaSequenceNumberHeader = "sequence_number"
+
+	// How long the kafka writer waits for more messages before sending an
+	// incomplete batch.
+	kafkaBatchTimeout = 10 * time.Millisecond
+)
+
+// KafkaWriter writes messages to a kafka topic. It's implemented by
+// *kafka.Writer.
+type KafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// KafkaSink is a build event proxy client that produces each bazel event to a
+// kafka topic. Messages are keyed by invocation ID, so that the events of an
+// invocation land on the same partition in order, and their value is the
+// serialized build_event_stream.BuildEvent.
+//
+// Events are produced as they arrive. Failed writes are retried with backoff
+// independently of the other proxy clients; if bazel retries the stream, its
+// events are produced again.
+type KafkaSink struct {
+	writer  KafkaWriter
+	rootCtx context.Context
+}
+
+func NewKafkaSink(env environment.Env, writer KafkaWriter) *KafkaSink {
+	return &KafkaSink{
+		writer:  writer,
+		rootCtx: env.GetServerContext(),
+	}
+}
+
+// NewKafkaWriter returns a writer producing to the given topic on the given
+// brokers.
+func NewKafkaWriter(brokers []string, topic string) *kafka.Writer {
+	return &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		BatchTimeout: kafkaBatchTimeout,
+	}
+}
+
+func (s *KafkaSink) PublishLifecycleEvent(_ context.Context, req *pepb.PublishLifecycleEventRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	return &emptypb.Empty{}, nil
+}
+
+func (s *KafkaSink) PublishBuildToolEventStream(_ context.Context, opts ...grpc.CallOption) (pepb.PublishBuildEvent_PublishBuildToolEventStreamClient, error) {
+	kss := &kafkaSinkStream{
+		sink:   s,
+		events: make(chan *pepb.PublishBuildToolEventStreamRequest, *bufferSize),
+		done:   make(chan struct{}),
+	}
+	go kss.produce()
+	return kss, nil
+}
+
+type kafkaSinkStream struct {
+	// Only Send, Recv, CloseSend and Context are supported.
+	grpc.ClientStream
+
+	sink   *KafkaSink
+	events chan *pepb.PublishBuildToolEventStreamRequest
+
+	// Only accessed by the produce goroutine.
+	invocationID string
+
+	done chan struct{}
+	err  error // set before done is closed
+}
+
+func (kss *kafkaSinkStream) Context() context.Context {
+	return kss.sink.rootCtx
+}
+
+func (kss *kafkaSinkStream) ctx() context.Context {
+	return log.EnrichContext(kss.sink.rootCtx, log.InvocationIDKey, kss.invocationID)
+}
+
+// produce writes events to kafka as they arrive, batching the events that
+// queued up while the previous batch was being written.
+func (kss *kafkaSinkStream) produce() {
+	defer close(kss.done)
+	for {
+		req, ok := <-kss.events
+		if !ok {
+			return
+		}
+		var msgs []kafka.Message
+		msgs = kss.appendMessage(msgs, req)
+		closed := false
+	batch:
+		for len(msgs) < *bufferSize {
+			select {
+			case req, ok := <-kss.events:
+				if !ok {
+					closed = true
+					break batch
+				}
+				msgs = kss.appendMessage(msgs, req)
+			default:
+				break batch
+			}
+		}
+		if err := kss.write(msgs); err != nil {
+			kss.err = status.WrapError(err, "produce build events to kafka")
+			log.CtxWarningf(kss.ctx(), "Failed to produce build event stream to kafka, giving up: %s", err)
+			kss.drain()
+			return
+		}
+		if closed {
+			return
+		}
+	}
+}
+
+func (kss *kafkaSinkStream) appendMessage(msgs []kafka.Message, req *pepb.PublishBuildToolEventStreamRequest) []kafka.Message {
+	obe := req.GetOrderedBuildEvent()
+	if kss.invocationID == "" {
+		kss.invocationID = obe.GetStreamId().GetInvocationId()
+	}
+	e := obe.GetEvent().GetBazelEvent()
+	if e == nil || kss.invocationID == "" {
+		return msgs
+	}
+	return append(msgs, kafka.Message{
+		Key: []byte(kss.invocationID),
+		// The Any's value is the serialized build_event_stream.BuildEvent,
+		// so it can be produced as-is.
+		Value: e.GetValue(),
+		Headers: []kafka.Header{{
+			Key:   kafkaSequenceNumberHeader,
+			Value: []byte(strconv.FormatInt(obe.GetSequenceNumber(), 10)),
+		}},
+	})
+}
+
+// write writes the messages to kafka, retrying if that fails.
+func (kss *kafkaSinkStream) write(msgs []kafka.Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	write := func(ctx context.Context) error {
+		return kss.sink.writer.WriteMessages(ctx, msgs...)
+	}
+	if *maxRetries == 0 {
+		return write(kss.ctx())
+	}
+	opts := retryOptions()
+	opts.Name = "produce build events to kafka"
+	return retry.DoVoid(kss.ctx(), opts, write)
+}
+
+// drain discards events sent after producing has failed, so that it's safe
+// to keep calling Send.
+func (kss *kafkaSinkStream) drain() {
+	go func() {
+		for {
+			if _, ok := <-kss.events; !ok {
+				return
+			}
+		}
+	}()
+}
+
+func (kss *kafkaSinkStream) Send(req *pepb.PublishBuildToolEventStreamRequest) error {
+	select {
+	case kss.events <- req:
+		// does not fallthrough.
+	default:
+		log.Warningf("BuildEventProxy kafka sink dropped message.")
+	}
+	return nil
+}
+
+// Recv waits until all events have been produced to kafka, or producing has
+// failed after exhausting retries.
+func (kss *kafkaSinkStream) Recv() (*pepb.PublishBuildToolEventStreamResponse, error) {
+	<-kss.done
+	if kss.err != nil {
+		return nil, kss.err
+	}
+	return nil, io.EOF
+}
+
+func (kss *kafkaSinkStream) CloseSend() error {
+	close(kss.events)
+	return nil
+}
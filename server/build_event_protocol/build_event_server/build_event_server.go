@@ -82,8 +82,12 @@ func (s *BuildEventProtocolServer) PublishBuildToolEventStream(stream pepb.Publi
 	ctx := stream.Context()
 	// Semantically, the protocol requires we ack events in order.
 	acks := make([]int, 0)
+	// Events that have been handled but not yet acked. Unless the channel is
+	// resumable, events are only acked once the invocation is finalized.
+	unacked := make([]int, 0)
 	var streamID *bepb.StreamId
 	var channel interfaces.BuildEventChannel
+	suspended := false
 
 	eg, ctx := errgroup.WithContext(ctx)
 	forwardingStreams := make([]pepb.PublishBuildEvent_PublishBuildToolEventStreamClient, 0)
@@ -164,9 +168,14 @@ func (s *BuildEventProtocolServer) PublishBuildToolEventStream(stream pepb.Publi
 					log.CtxInfo(ctx, "Closing empty channel.")
 					return nil
 				}
-				return postProcessStream(ctx, channel, streamID, acks, stream)
+				return postProcessStream(ctx, channel, streamID, acks, unacked, stream)
 			}
 			log.CtxWarningf(ctx, "Error receiving build event stream %+v: %s", streamID, err)
+			if channel != nil && channel.Suspend() {
+				log.CtxInfof(ctx, "Suspended invocation channel until the stream is resumed")
+				suspended = true
+				return err
+			}
 			return disconnectWithErr(err)
 		case in := <-inCh:
 			if streamID == nil {
@@ -175,7 +184,11 @@ func (s *BuildEventProtocolServer) PublishBuildToolEventStream(stream pepb.Publi
 				channel = s.env.GetBuildEventHandler().OpenChannel(ctx, streamID.InvocationId)
 				log.CtxInfo(ctx, "Opened invocation channel")
 				channelDone = channel.Context().Done()
-				defer channel.Close()
+				defer func() {
+					if !suspended {
+						channel.Close()
+					}
+				}()
 			}
 
 			if err := channel.HandleEvent(in); err != nil {
@@ -190,6 +203,17 @@ func (s *BuildEventProtocolServer) PublishBuildToolEventStream(stream pepb.Publi
 				}
 			}
 			acks = append(acks, int(in.OrderedBuildEvent.SequenceNumber))
+			if channel.Resumable() {
+				// Ack everything but the latest event right away, so that
+				// bazel doesn't resend it if the stream is resumed. The
+				// latest event is acked on the next event, or after
+				// finalization, so that bazel retries if finalization fails.
+				if err := sendAcks(ctx, streamID, unacked, stream); err != nil {
+					return disconnectWithErr(err)
+				}
+				unacked = unacked[:0]
+			}
+			unacked = append(unacked, int(in.OrderedBuildEvent.SequenceNumber))
 		}
 	}
 }
@@ -200,8 +224,8 @@ func (s *BuildEventProtocolServer) PublishBuildToolEventStream(stream pepb.Publi
 // sequence number. If it is not, it returns an error to force the client to
 // open a new channel that resends everything; otherwise, it finalizes the
 // channel and then sends a stream of ACKs to the client which ACKs each build
-// event.
-func postProcessStream(ctx context.Context, channel interfaces.BuildEventChannel, streamID *bepb.StreamId, acks []int, stream pepb.PublishBuildEvent_PublishBuildToolEventStreamServer) error {
+// event in `unacked`.
+func postProcessStream(ctx context.Context, channel interfaces.BuildEventChannel, streamID *bepb.StreamId, acks, unacked []int, stream pepb.PublishBuildEvent_PublishBuildToolEventStreamServer) error {
 	if channel.GetNumDroppedEvents() > 0 {
 		log.CtxWarningf(ctx, "We got over 100 build events before an event with options for invocation %s. Dropped the %d earliest event(s).",
 			streamID.InvocationId, channel.GetNumDroppedEvents())
@@ -228,6 +252,11 @@ func postProcessStream(ctx context.Context, channel interfaces.BuildEventChannel
 	}
 
 	// Finally, ack everything.
+	sort.Ints(unacked)
+	return sendAcks(ctx, streamID, unacked, stream)
+}
+
+func sendAcks(ctx context.Context, streamID *bepb.StreamId, acks []int, stream pepb.PublishBuildEvent_PublishBuildToolEventStreamServer) error {
 	for _, ack := range acks {
 		rsp := &pepb.PublishBuildToolEventStreamResponse{
 			StreamId:       streamID,
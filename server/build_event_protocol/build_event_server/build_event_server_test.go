@@ -4,11 +4,17 @@ import (
 	"context"
 	"io"
 	"testing"
+	"time"
 
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_server"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/anypb"
 
+	bspb "github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	bepb "github.com/buildbuddy-io/buildbuddy/proto/build_events"
 	pepb "github.com/buildbuddy-io/buildbuddy/proto/publish_build_event"
 )
 
@@ -34,3 +40,44 @@ func TestPublishBuildToolEventStream_NoEvents(t *testing.T) {
 	_, err = stream.Recv()
 	require.Equal(t, io.EOF, err)
 }
+
+func TestPublishBuildToolEventStream_ResumableStreamAcksHandledEvents(t *testing.T) {
+	flags.Set(t, "app.build_event_stream_resume_timeout", time.Minute)
+	env := testenv.GetTestEnv(t)
+	env.SetBuildEventHandler(build_event_handler.NewBuildEventHandler(env))
+	server, err := build_event_server.NewBuildEventProtocolServer(env, false /*=synchronous*/)
+	require.NoError(t, err)
+	grpcServer, runServer, lis := testenv.RegisterLocalGRPCServer(t, env)
+	pepb.RegisterPublishBuildEventServer(grpcServer, server)
+	go runServer()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn, err := testenv.LocalGRPCConn(ctx, lis)
+	require.NoError(t, err)
+	client := pepb.NewPublishBuildEventClient(conn)
+	stream, err := client.PublishBuildToolEventStream(ctx)
+	require.NoError(t, err)
+
+	progress, err := anypb.New(&bspb.BuildEvent{
+		Id:      &bspb.BuildEventId{Id: &bspb.BuildEventId_Progress{}},
+		Payload: &bspb.BuildEvent_Progress{Progress: &bspb.Progress{}},
+	})
+	require.NoError(t, err)
+	for i := int64(1); i <= 2; i++ {
+		err := stream.Send(&pepb.PublishBuildToolEventStreamRequest{
+			OrderedBuildEvent: &pepb.OrderedBuildEvent{
+				SequenceNumber: i,
+				StreamId:       &bepb.StreamId{InvocationId: "test-invocation"},
+				Event:          &bepb.BuildEvent{Event: &bepb.BuildEvent_BazelEvent{BazelEvent: progress}},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	// The first event is acked before the stream is closed. The latest event
+	// isn't acked until the invocation is finalized.
+	rsp, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), rsp.GetSequenceNumber())
+}
@@ -0,0 +1,295 @@
+// Package build_metadata_schema checks invocations against the build_metadata
+// keys that their organization requires, and reports how many invocations
+// satisfied the requirements.
+package build_metadata_schema
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/authutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	grpb "github.com/buildbuddy-io/buildbuddy/proto/group"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+const (
+	maxRequirements  = 100
+	maxPatternLength = 1000
+
+	defaultComplianceWindow = 7 * 24 * time.Hour
+
+	// Separates the violated keys stored on an invocation. Keys can't contain
+	// it.
+	violationSeparator = ","
+)
+
+var keyRegexp = regexp.MustCompile(`^[A-Za-z0-9_.\-]+$`)
+
+type requirement struct {
+	key string
+	// nil if any non-empty value is accepted.
+	pattern *regexp.Regexp
+}
+
+// Schema is a group's build metadata requirements.
+type Schema struct {
+	Enforcement  grpb.BuildMetadataEnforcement
+	requirements []*requirement
+}
+
+func compileRequirement(key, pattern string) (*requirement, error) {
+	if !keyRegexp.MatchString(key) {
+		return nil, status.InvalidArgumentErrorf("invalid build metadata key %q: keys may only contain letters, digits, '_', '.' and '-'", key)
+	}
+	r := &requirement{key: key}
+	if pattern == "" {
+		return r, nil
+	}
+	if len(pattern) > maxPatternLength {
+		return nil, status.InvalidArgumentErrorf("pattern for build metadata key %q is longer than %d characters", key, maxPatternLength)
+	}
+	// Patterns must match the entire value.
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("invalid pattern for build metadata key %q: %s", key, err)
+	}
+	r.pattern = re
+	return r, nil
+}
+
+// Load returns the build metadata requirements of the given group, or nil if
+// the group doesn't have any.
+func Load(ctx context.Context, env environment.Env, groupID string) (*Schema, error) {
+	rows, err := lookupRequirements(ctx, env.GetDBHandle(), groupID)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	enforcement, err := lookupEnforcement(ctx, env.GetDBHandle(), groupID)
+	if err != nil {
+		return nil, err
+	}
+	s := &Schema{Enforcement: enforcement}
+	for _, row := range rows {
+		r, err := compileRequirement(row.MetadataKey, row.Pattern)
+		if err != nil {
+			return nil, status.InternalErrorf("group %s has an invalid build metadata requirement: %s", groupID, err)
+		}
+		s.requirements = append(s.requirements, r)
+	}
+	return s, nil
+}
+
+func lookupRequirements(ctx context.Context, dbh interfaces.DB, groupID string) ([]*tables.BuildMetadataRequirement, error) {
+	rq := dbh.NewQuery(ctx, "build_metadata_schema_get_requirements").Raw(
+		`SELECT * FROM "BuildMetadataRequirements" WHERE group_id = ? ORDER BY metadata_key`, groupID)
+	return db.ScanAll(rq, &tables.BuildMetadataRequirement{})
+}
+
+func lookupEnforcement(ctx context.Context, dbh interfaces.DB, groupID string) (grpb.BuildMetadataEnforcement, error) {
+	g := &tables.Group{}
+	err := dbh.NewQuery(ctx, "build_metadata_schema_get_enforcement").Raw(
+		`SELECT build_metadata_enforcement FROM "Groups" WHERE group_id = ?`, groupID).Take(g)
+	if err != nil {
+		return 0, err
+	}
+	return enforcementOrDefault(grpb.BuildMetadataEnforcement(g.BuildMetadataEnforcement)), nil
+}
+
+func enforcementOrDefault(e grpb.BuildMetadataEnforcement) grpb.BuildMetadataEnforcement {
+	if e == grpb.BuildMetadataEnforcement_UNKNOWN_BUILD_METADATA_ENFORCEMENT {
+		return grpb.BuildMetadataEnforcement_FLAG_BUILD_METADATA_VIOLATIONS
+	}
+	return e
+}
+
+// Violations returns the keys of the requirements that the given build
+// metadata doesn't satisfy, sorted by key.
+func (s *Schema) Violations(metadata map[string]string) []string {
+	var violations []string
+	for _, r := range s.requirements {
+		v := metadata[r.key]
+		if v == "" || (r.pattern != nil && !r.pattern.MatchString(v)) {
+			violations = append(violations, r.key)
+		}
+	}
+	return violations
+}
+
+// Check records the result of checking the given build metadata against the
+// schema on an invocation, and returns an error if the invocation should be
+// rejected.
+func (s *Schema) Check(metadata map[string]string, ti *tables.Invocation) error {
+	violations := s.Violations(metadata)
+	if len(violations) == 0 {
+		ti.BuildMetadataCompliance = int32(inpb.BuildMetadataCompliance_COMPLIANT_BUILD_METADATA)
+		return nil
+	}
+	ti.BuildMetadataCompliance = int32(inpb.BuildMetadataCompliance_NONCOMPLIANT_BUILD_METADATA)
+	ti.BuildMetadataViolations = strings.Join(violations, violationSeparator)
+	if s.Enforcement == grpb.BuildMetadataEnforcement_REJECT_BUILD_METADATA_VIOLATIONS {
+		return status.FailedPreconditionErrorf("Invocation %s is missing required build metadata, or has invalid values for it: %s. Set them with --build_metadata=KEY=VALUE.", ti.InvocationID, strings.Join(violations, ", "))
+	}
+	return nil
+}
+
+// SplitViolations returns the violated keys stored on an invocation.
+func SplitViolations(violations string) []string {
+	if violations == "" {
+		return nil
+	}
+	return strings.Split(violations, violationSeparator)
+}
+
+func GetSchema(ctx context.Context, env environment.Env, req *grpb.GetBuildMetadataSchemaRequest) (*grpb.GetBuildMetadataSchemaResponse, error) {
+	groupID := req.GetRequestContext().GetGroupId()
+	if err := authutil.AuthorizeGroupAccess(ctx, env, groupID); err != nil {
+		return nil, err
+	}
+	rows, err := lookupRequirements(ctx, env.GetDBHandle(), groupID)
+	if err != nil {
+		return nil, err
+	}
+	rsp := &grpb.GetBuildMetadataSchemaResponse{}
+	for _, row := range rows {
+		rsp.Requirement = append(rsp.Requirement, &grpb.BuildMetadataRequirement{
+			Key:     row.MetadataKey,
+			Pattern: row.Pattern,
+		})
+	}
+	if len(rows) > 0 {
+		rsp.Enforcement, err = lookupEnforcement(ctx, env.GetDBHandle(), groupID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rsp, nil
+}
+
+func SetSchema(ctx context.Context, env environment.Env, req *grpb.SetBuildMetadataSchemaRequest) (*grpb.SetBuildMetadataSchemaResponse, error) {
+	groupID := req.GetRequestContext().GetGroupId()
+	if groupID == "" {
+		return nil, status.InvalidArgumentError("Missing organization identifier.")
+	}
+	u, err := env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := authutil.AuthorizeOrgAdmin(u, groupID); err != nil {
+		return nil, err
+	}
+	if len(req.GetRequirement()) > maxRequirements {
+		return nil, status.InvalidArgumentErrorf("at most %d build metadata requirements may be set", maxRequirements)
+	}
+	if _, ok := grpb.BuildMetadataEnforcement_name[int32(req.GetEnforcement())]; !ok {
+		return nil, status.InvalidArgumentErrorf("unknown build metadata enforcement %d", req.GetEnforcement())
+	}
+	keys := make(map[string]bool, len(req.GetRequirement()))
+	rows := make([]*tables.BuildMetadataRequirement, 0, len(req.GetRequirement()))
+	for _, r := range req.GetRequirement() {
+		if _, err := compileRequirement(r.GetKey(), r.GetPattern()); err != nil {
+			return nil, err
+		}
+		if keys[r.GetKey()] {
+			return nil, status.InvalidArgumentErrorf("duplicate build metadata key %q", r.GetKey())
+		}
+		keys[r.GetKey()] = true
+		rows = append(rows, &tables.BuildMetadataRequirement{
+			GroupID:     groupID,
+			MetadataKey: r.GetKey(),
+			Pattern:     r.GetPattern(),
+		})
+	}
+
+	err = env.GetDBHandle().Transaction(ctx, func(tx interfaces.DB) error {
+		if err := tx.NewQuery(ctx, "build_metadata_schema_delete_requirements").Raw(
+			`DELETE FROM "BuildMetadataRequirements" WHERE group_id = ?`, groupID).Exec().Error; err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if err := tx.NewQuery(ctx, "build_metadata_schema_create_requirement").Create(row); err != nil {
+				return err
+			}
+		}
+		return tx.NewQuery(ctx, "build_metadata_schema_set_enforcement").Raw(
+			`UPDATE "Groups" SET build_metadata_enforcement = ? WHERE group_id = ?`,
+			int32(enforcementOrDefault(req.GetEnforcement())), groupID).Exec().Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &grpb.SetBuildMetadataSchemaResponse{}, nil
+}
+
+func GetCompliance(ctx context.Context, env environment.Env, req *grpb.GetBuildMetadataComplianceRequest) (*grpb.GetBuildMetadataComplianceResponse, error) {
+	groupID := req.GetRequestContext().GetGroupId()
+	if err := authutil.AuthorizeGroupAccessForStats(ctx, env, groupID); err != nil {
+		return nil, err
+	}
+	end := time.Now()
+	if req.GetEndTimeUsec() > 0 {
+		end = time.UnixMicro(req.GetEndTimeUsec())
+	}
+	start := end.Add(-defaultComplianceWindow)
+	if req.GetStartTimeUsec() > 0 {
+		start = time.UnixMicro(req.GetStartTimeUsec())
+	}
+	if end.Before(start) {
+		return nil, status.InvalidArgumentError("end time must not be before start time")
+	}
+
+	// Invocations with the same violations are counted together, so this
+	// returns at most one row per combination of violated keys.
+	rq := env.GetDBHandle().NewQuery(ctx, "build_metadata_schema_get_compliance").Raw(
+		`SELECT build_metadata_compliance, build_metadata_violations, COUNT(*) AS count
+		FROM "Invocations"
+		WHERE group_id = ? AND created_at_usec >= ? AND created_at_usec < ? AND build_metadata_compliance > 0
+		GROUP BY build_metadata_compliance, build_metadata_violations`,
+		groupID, start.UnixMicro(), end.UnixMicro())
+	type row struct {
+		BuildMetadataCompliance int32
+		BuildMetadataViolations string
+		Count                   int64
+	}
+	rsp := &grpb.GetBuildMetadataComplianceResponse{}
+	keyViolations := make(map[string]int64)
+	err := db.ScanEach(rq, func(ctx context.Context, r *row) error {
+		rsp.CheckedInvocationCount += r.Count
+		switch inpb.BuildMetadataCompliance(r.BuildMetadataCompliance) {
+		case inpb.BuildMetadataCompliance_COMPLIANT_BUILD_METADATA:
+			rsp.CompliantInvocationCount += r.Count
+		case inpb.BuildMetadataCompliance_NONCOMPLIANT_BUILD_METADATA:
+			rsp.NoncompliantInvocationCount += r.Count
+			for _, key := range SplitViolations(r.BuildMetadataViolations) {
+				keyViolations[key] += r.Count
+			}
+		default:
+			return status.InternalErrorf("unknown build metadata compliance %d", r.BuildMetadataCompliance)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for key, count := range keyViolations {
+		rsp.KeyViolations = append(rsp.KeyViolations, &grpb.GetBuildMetadataComplianceResponse_KeyViolations{
+			Key:             key,
+			InvocationCount: count,
+		})
+	}
+	sort.Slice(rsp.KeyViolations, func(i, j int) bool {
+		return rsp.KeyViolations[i].GetKey() < rsp.KeyViolations[j].GetKey()
+	})
+	return rsp, nil
+}
@@ -0,0 +1,182 @@
+package build_metadata_schema_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_metadata_schema"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
+	ctxpb "github.com/buildbuddy-io/buildbuddy/proto/context"
+	grpb "github.com/buildbuddy-io/buildbuddy/proto/group"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+func setup(t *testing.T) (*testenv.TestEnv, context.Context, context.Context) {
+	te := testenv.GetTestEnv(t)
+	admin := testauth.User("US1", "GR1")
+	admin.GroupMemberships[0].Capabilities = append(admin.GroupMemberships[0].Capabilities, akpb.ApiKey_ORG_ADMIN_CAPABILITY)
+	ta := testauth.NewTestAuthenticator(map[string]interfaces.UserInfo{
+		"US1": admin,
+		"US2": testauth.User("US2", "GR1"),
+	})
+	te.SetAuthenticator(ta)
+	ctx := context.Background()
+	err := te.GetDBHandle().NewQuery(ctx, "create_group").Create(&tables.Group{GroupID: "GR1"})
+	require.NoError(t, err)
+	adminCtx, err := ta.WithAuthenticatedUser(ctx, "US1")
+	require.NoError(t, err)
+	developerCtx, err := ta.WithAuthenticatedUser(ctx, "US2")
+	require.NoError(t, err)
+	return te, adminCtx, developerCtx
+}
+
+func requestContext() *ctxpb.RequestContext {
+	return &ctxpb.RequestContext{GroupId: "GR1"}
+}
+
+func TestSetSchema(t *testing.T) {
+	te, adminCtx, developerCtx := setup(t)
+
+	rsp, err := build_metadata_schema.GetSchema(developerCtx, te, &grpb.GetBuildMetadataSchemaRequest{RequestContext: requestContext()})
+	require.NoError(t, err)
+	assert.Empty(t, rsp.GetRequirement())
+
+	schema, err := build_metadata_schema.Load(adminCtx, te, "GR1")
+	require.NoError(t, err)
+	assert.Nil(t, schema)
+
+	req := &grpb.SetBuildMetadataSchemaRequest{
+		RequestContext: requestContext(),
+		Requirement: []*grpb.BuildMetadataRequirement{
+			{Key: "TEAM"},
+			{Key: "SERVICE", Pattern: "[a-z-]+"},
+		},
+		Enforcement: grpb.BuildMetadataEnforcement_REJECT_BUILD_METADATA_VIOLATIONS,
+	}
+	_, err = build_metadata_schema.SetSchema(developerCtx, te, req)
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+	_, err = build_metadata_schema.SetSchema(adminCtx, te, req)
+	require.NoError(t, err)
+
+	rsp, err = build_metadata_schema.GetSchema(developerCtx, te, &grpb.GetBuildMetadataSchemaRequest{RequestContext: requestContext()})
+	require.NoError(t, err)
+	assert.Equal(t, grpb.BuildMetadataEnforcement_REJECT_BUILD_METADATA_VIOLATIONS, rsp.GetEnforcement())
+	require.Len(t, rsp.GetRequirement(), 2)
+	assert.Equal(t, "SERVICE", rsp.GetRequirement()[0].GetKey())
+	assert.Equal(t, "[a-z-]+", rsp.GetRequirement()[0].GetPattern())
+	assert.Equal(t, "TEAM", rsp.GetRequirement()[1].GetKey())
+
+	// Setting the schema replaces the previous requirements.
+	_, err = build_metadata_schema.SetSchema(adminCtx, te, &grpb.SetBuildMetadataSchemaRequest{
+		RequestContext: requestContext(),
+		Requirement:    []*grpb.BuildMetadataRequirement{{Key: "TEAM"}},
+	})
+	require.NoError(t, err)
+	rsp, err = build_metadata_schema.GetSchema(developerCtx, te, &grpb.GetBuildMetadataSchemaRequest{RequestContext: requestContext()})
+	require.NoError(t, err)
+	assert.Equal(t, grpb.BuildMetadataEnforcement_FLAG_BUILD_METADATA_VIOLATIONS, rsp.GetEnforcement())
+	require.Len(t, rsp.GetRequirement(), 1)
+	assert.Equal(t, "TEAM", rsp.GetRequirement()[0].GetKey())
+}
+
+func TestSetSchema_InvalidRequirements(t *testing.T) {
+	te, adminCtx, _ := setup(t)
+	for _, requirements := range [][]*grpb.BuildMetadataRequirement{
+		{{Key: ""}},
+		{{Key: "TEAM,SERVICE"}},
+		{{Key: "TEAM", Pattern: "("}},
+		{{Key: "TEAM"}, {Key: "TEAM"}},
+	} {
+		_, err := build_metadata_schema.SetSchema(adminCtx, te, &grpb.SetBuildMetadataSchemaRequest{
+			RequestContext: requestContext(),
+			Requirement:    requirements,
+		})
+		assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error for %v, got %v", requirements, err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	te, adminCtx, _ := setup(t)
+	_, err := build_metadata_schema.SetSchema(adminCtx, te, &grpb.SetBuildMetadataSchemaRequest{
+		RequestContext: requestContext(),
+		Requirement: []*grpb.BuildMetadataRequirement{
+			{Key: "TEAM"},
+			{Key: "SERVICE", Pattern: "[a-z-]+"},
+		},
+	})
+	require.NoError(t, err)
+	schema, err := build_metadata_schema.Load(adminCtx, te, "GR1")
+	require.NoError(t, err)
+	require.NotNil(t, schema)
+
+	for _, test := range []struct {
+		name       string
+		metadata   map[string]string
+		violations []string
+	}{
+		{name: "Compliant", metadata: map[string]string{"TEAM": "Infra", "SERVICE": "build-cache"}},
+		{name: "Missing", metadata: map[string]string{"SERVICE": "build-cache"}, violations: []string{"TEAM"}},
+		{name: "Empty", metadata: map[string]string{"TEAM": "", "SERVICE": "build-cache"}, violations: []string{"TEAM"}},
+		// Patterns must match the whole value.
+		{name: "PartialMatch", metadata: map[string]string{"TEAM": "Infra", "SERVICE": "Build cache"}, violations: []string{"SERVICE"}},
+		{name: "AllMissing", metadata: map[string]string{}, violations: []string{"SERVICE", "TEAM"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ti := &tables.Invocation{InvocationID: "inv1"}
+			err := schema.Check(test.metadata, ti)
+			// Violations are only flagged by default.
+			require.NoError(t, err)
+			assert.Equal(t, test.violations, schema.Violations(test.metadata))
+			assert.Equal(t, test.violations, build_metadata_schema.SplitViolations(ti.BuildMetadataViolations))
+			if len(test.violations) == 0 {
+				assert.Equal(t, int32(inpb.BuildMetadataCompliance_COMPLIANT_BUILD_METADATA), ti.BuildMetadataCompliance)
+			} else {
+				assert.Equal(t, int32(inpb.BuildMetadataCompliance_NONCOMPLIANT_BUILD_METADATA), ti.BuildMetadataCompliance)
+			}
+		})
+	}
+
+	schema.Enforcement = grpb.BuildMetadataEnforcement_REJECT_BUILD_METADATA_VIOLATIONS
+	err = schema.Check(map[string]string{"TEAM": "Infra", "SERVICE": "build-cache"}, &tables.Invocation{InvocationID: "inv1"})
+	require.NoError(t, err)
+	err = schema.Check(map[string]string{"TEAM": "Infra"}, &tables.Invocation{InvocationID: "inv1"})
+	assert.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition error, got %v", err)
+}
+
+func TestGetCompliance(t *testing.T) {
+	te, _, developerCtx := setup(t)
+	ctx := context.Background()
+	for _, ti := range []*tables.Invocation{
+		{InvocationID: "inv1", GroupID: "GR1", BuildMetadataCompliance: int32(inpb.BuildMetadataCompliance_COMPLIANT_BUILD_METADATA)},
+		{InvocationID: "inv2", GroupID: "GR1", BuildMetadataCompliance: int32(inpb.BuildMetadataCompliance_NONCOMPLIANT_BUILD_METADATA), BuildMetadataViolations: "SERVICE,TEAM"},
+		{InvocationID: "inv3", GroupID: "GR1", BuildMetadataCompliance: int32(inpb.BuildMetadataCompliance_NONCOMPLIANT_BUILD_METADATA), BuildMetadataViolations: "TEAM"},
+		// Unchecked invocations and other groups' invocations aren't counted.
+		{InvocationID: "inv4", GroupID: "GR1"},
+		{InvocationID: "inv5", GroupID: "GR2", BuildMetadataCompliance: int32(inpb.BuildMetadataCompliance_NONCOMPLIANT_BUILD_METADATA), BuildMetadataViolations: "TEAM"},
+	} {
+		err := te.GetDBHandle().NewQuery(ctx, "create_invocation").Create(ti)
+		require.NoError(t, err)
+	}
+
+	rsp, err := build_metadata_schema.GetCompliance(developerCtx, te, &grpb.GetBuildMetadataComplianceRequest{RequestContext: requestContext()})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), rsp.GetCheckedInvocationCount())
+	assert.Equal(t, int64(1), rsp.GetCompliantInvocationCount())
+	assert.Equal(t, int64(2), rsp.GetNoncompliantInvocationCount())
+	require.Len(t, rsp.GetKeyViolations(), 2)
+	assert.Equal(t, "SERVICE", rsp.GetKeyViolations()[0].GetKey())
+	assert.Equal(t, int64(1), rsp.GetKeyViolations()[0].GetInvocationCount())
+	assert.Equal(t, "TEAM", rsp.GetKeyViolations()[1].GetKey())
+	assert.Equal(t, int64(2), rsp.GetKeyViolations()[1].GetInvocationCount())
+
+	_, err = build_metadata_schema.GetCompliance(developerCtx, te, &grpb.GetBuildMetadataComplianceRequest{RequestContext: &ctxpb.RequestContext{GroupId: "GR2"}})
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net/url"
 	"strings"
 
 	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
@@ -27,6 +28,8 @@ type BuildStatusReporter struct {
 	baseBBURL                 string
 	env                       environment.Env
 	githubClient              interfaces.GitHubStatusClient
+	workflow                  *tables.Workflow
+	workflowLoaded            bool
 	buildEventAccumulator     accumulator.Accumulator
 	groups                    map[string]*GroupStatus
 	inFlight                  map[string]bool
@@ -57,18 +60,70 @@ func (r *BuildStatusReporter) SetBaseBuildBuddyURL(url string) {
 	r.baseBBURL = url
 }
 
+// loadWorkflow returns the workflow that started the invocation, if any.
+// The workflow ID is reported by the build itself, so the workflow is only
+// returned if it belongs to the invocation's group.
+func (r *BuildStatusReporter) loadWorkflow(ctx context.Context) *tables.Workflow {
+	if r.workflowLoaded {
+		return r.workflow
+	}
+	r.workflowLoaded = true
+	workflowID := r.buildEventAccumulator.WorkflowID()
+	dbh := r.env.GetDBHandle()
+	if workflowID == "" || dbh == nil || r.env.GetAuthenticator() == nil {
+		return nil
+	}
+	u, err := r.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil || u.GetGroupID() == "" {
+		return nil
+	}
+	workflow := &tables.Workflow{}
+	err = dbh.NewQuery(ctx, "build_status_reporter_get_workflow").Raw(
+		`SELECT * from "Workflows" WHERE workflow_id = ? AND group_id = ?`,
+		workflowID, u.GetGroupID()).Take(workflow)
+	if err != nil {
+		return nil
+	}
+	r.workflow = workflow
+	return workflow
+}
+
+// workflowAccessToken returns the access token of the workflow that started
+// the invocation, if the workflow's repo matches matchRepoURL. This ensures
+// that the token is only sent to the git provider that it was issued by.
+func (r *BuildStatusReporter) workflowAccessToken(ctx context.Context, matchRepoURL func(u *url.URL) bool) string {
+	workflow := r.loadWorkflow(ctx)
+	if workflow == nil {
+		return ""
+	}
+	u, err := gitutil.NormalizeRepoURL(workflow.RepoURL)
+	if err != nil || !matchRepoURL(u) {
+		return ""
+	}
+	return workflow.AccessToken
+}
+
 func (r *BuildStatusReporter) initGHClient(ctx context.Context) interfaces.GitHubStatusClient {
-	accessToken := ""
-	if workflowID := r.buildEventAccumulator.WorkflowID(); workflowID != "" {
-		if dbh := r.env.GetDBHandle(); dbh != nil {
-			workflow := &tables.Workflow{}
-			if err := dbh.NewQuery(ctx, "build_status_reporter_get_workflow").Raw(
-				`SELECT * from "Workflows" WHERE workflow_id = ?`, workflowID).Take(workflow); err == nil {
-				accessToken = workflow.AccessToken
-			}
+	isGitHubRepo := func(u *url.URL) bool { return u.Host == "github.com" }
+	return r.env.GetGitHubStatusService().GetStatusClient(r.workflowAccessToken(ctx, isGitHubRepo))
+}
+
+// gitProviderForRepo returns the git provider that statuses are reported to
+// for repos that aren't hosted on GitHub, or nil if there is none.
+func (r *BuildStatusReporter) gitProviderForRepo(repoURL string) interfaces.GitProvider {
+	if repoURL == "" {
+		return nil
+	}
+	u, err := gitutil.NormalizeRepoURL(repoURL)
+	if err != nil || u.Host == "github.com" {
+		return nil
+	}
+	for _, provider := range r.env.GetGitProviders() {
+		if provider.MatchRepoURL(u) {
+			return provider
 		}
 	}
-	return r.env.GetGitHubStatusService().GetStatusClient(accessToken)
+	return nil
 }
 
 // ReportStatusForEvent reports a status to GitHub for the event if applicable.
@@ -129,28 +184,29 @@ func (r *BuildStatusReporter) ReportDisconnect(ctx context.Context) {
 }
 
 func (r *BuildStatusReporter) flushPayloadsIfMetadataLoaded(ctx context.Context) {
-	// TODO: support other providers than just GitHub
-	if r.env.GetGitHubStatusService() == nil {
-		return
-	}
 	// Don't flush payloads if explicitly disabled in build metadata, or if we
 	// don't yet have the metadata.
 	if !r.buildEventAccumulator.MetadataIsLoaded() || r.buildEventAccumulator.DisableCommitStatusReporting() {
 		return
 	}
+	// Statuses of repos on other hosts than GitHub are reported by their git
+	// provider.
+	repoURL := r.buildEventAccumulator.Invocation().GetRepoUrl()
+	if provider := r.gitProviderForRepo(repoURL); provider != nil {
+		r.flushPayloadsToGitProvider(ctx, provider, repoURL)
+		return
+	}
+	if r.env.GetGitHubStatusService() == nil {
+		return
+	}
 	if r.githubClient == nil {
 		r.githubClient = r.initGHClient(ctx)
 	}
 
 	for _, payload := range r.payloads {
-		if github.State(payload.GetState()) == github.PendingState {
-			r.inFlight[payload.GetContext()] = true
-		} else {
-			delete(r.inFlight, payload.GetContext())
-		}
+		r.trackInFlight(payload)
 
 		// TODO(siggisim): Kick these into a queue or something (but maintain order).
-		repoURL := r.buildEventAccumulator.Invocation().GetRepoUrl()
 		ownerRepo, err := gitutil.OwnerRepoFromRepoURL(repoURL)
 		if err != nil {
 			log.CtxWarningf(ctx, "Failed to report GitHub status: %s", err)
@@ -174,6 +230,29 @@ func (r *BuildStatusReporter) flushPayloadsIfMetadataLoaded(ctx context.Context)
 	r.payloads = make([]*github.GithubStatusPayload, 0)
 }
 
+func (r *BuildStatusReporter) flushPayloadsToGitProvider(ctx context.Context, provider interfaces.GitProvider, repoURL string) {
+	commitSHA := r.buildEventAccumulator.Invocation().GetCommitSha()
+	for _, payload := range r.payloads {
+		r.trackInFlight(payload)
+		if commitSHA == "" {
+			log.CtxDebugf(ctx, "Not reporting commit status (missing COMMIT_SHA metadata)")
+			continue
+		}
+		if err := provider.CreateStatus(ctx, r.workflowAccessToken(ctx, provider.MatchRepoURL), repoURL, commitSHA, payload); err != nil {
+			log.CtxInfof(ctx, "Failed to report commit status for %q @ %q: %s", repoURL, commitSHA, err)
+		}
+	}
+	r.payloads = make([]*github.GithubStatusPayload, 0)
+}
+
+func (r *BuildStatusReporter) trackInFlight(payload *github.GithubStatusPayload) {
+	if github.State(payload.GetState()) == github.PendingState {
+		r.inFlight[payload.GetContext()] = true
+	} else {
+		delete(r.inFlight, payload.GetContext())
+	}
+}
+
 func (r *BuildStatusReporter) githubPayloadForBuildMetadata() *github.GithubStatusPayload {
 	return github.NewGithubStatusPayload(r.invocationLabel(), r.invocationURL(), "Running...", github.PendingState)
 }
@@ -260,7 +339,10 @@ func (r *BuildStatusReporter) githubPayloadFromAbortedEvent(event *build_event_s
 
 func (r *BuildStatusReporter) invocationLabel() string {
 	// If this is a synthetic action invocation as part of a workflow, return the
-	// action name configured in /buildbuddy.yaml
+	// status name or action name configured in /buildbuddy.yaml
+	if r.buildEventAccumulator.StatusName() != "" {
+		return r.buildEventAccumulator.StatusName()
+	}
 	if r.buildEventAccumulator.ActionName() != "" {
 		return r.buildEventAccumulator.ActionName()
 	}
@@ -0,0 +1,359 @@
+// Package completion_webhooks notifies the endpoints that organizations
+// configure when their invocations are finalized.
+package completion_webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/event_index"
+	"github.com/buildbuddy-io/buildbuddy/server/endpoint_urls/build_buddy_url"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/authutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/random"
+	"github.com/buildbuddy-io/buildbuddy/server/util/retry"
+	"github.com/buildbuddy-io/buildbuddy/server/util/ssrf"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	grpb "github.com/buildbuddy-io/buildbuddy/proto/group"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	inspb "github.com/buildbuddy-io/buildbuddy/proto/invocation_status"
+)
+
+var (
+	enabled = flag.Bool("integrations.completion_webhooks.enabled", false, "Whether organizations may configure webhooks that are notified when their invocations are finalized.")
+)
+
+const (
+	maxWebhooks     = 10
+	maxURLLength    = 2048
+	secretLength    = 32
+	signatureHeader = "X-BuildBuddy-Signature-256"
+	eventHeader     = "X-BuildBuddy-Event"
+	eventName       = "invocation.finalized"
+
+	// How long a single delivery attempt may take.
+	deliveryTimeout = 10 * time.Second
+
+	successStatus      = "success"
+	failureStatus      = "failure"
+	disconnectedStatus = "disconnected"
+)
+
+// retryOptions controls how failed deliveries are retried. The webhook
+// notifier gives up on the whole notification after a minute.
+var retryOptions = &retry.Options{
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     10 * time.Second,
+	Multiplier:     2,
+	MaxRetries:     4,
+	Name:           "completion webhook delivery",
+}
+
+// TargetSummary counts the targets of an invocation.
+type TargetSummary struct {
+	Configured int64 `json:"configured"`
+	// Target counts keyed by lowercase status, e.g. "passed" or
+	// "failed_to_build".
+	ByStatus map[string]int64 `json:"by_status"`
+}
+
+type Links struct {
+	Invocation string `json:"invocation"`
+}
+
+// Payload is the JSON body POSTed to completion webhooks.
+type Payload struct {
+	Event         string        `json:"event"`
+	InvocationID  string        `json:"invocation_id"`
+	Attempt       uint64        `json:"attempt"`
+	Status        string        `json:"status"`
+	BazelExitCode string        `json:"bazel_exit_code,omitempty"`
+	Command       string        `json:"command,omitempty"`
+	Pattern       []string      `json:"pattern,omitempty"`
+	User          string        `json:"user,omitempty"`
+	Host          string        `json:"host,omitempty"`
+	Role          string        `json:"role,omitempty"`
+	RepoURL       string        `json:"repo_url,omitempty"`
+	BranchName    string        `json:"branch_name,omitempty"`
+	CommitSHA     string        `json:"commit_sha,omitempty"`
+	CreatedAtUsec int64         `json:"created_at_usec"`
+	DurationUsec  int64         `json:"duration_usec"`
+	Targets       TargetSummary `json:"targets"`
+	Links         Links         `json:"links"`
+}
+
+type completionHook struct {
+	env    environment.Env
+	client *http.Client
+}
+
+func Register(env *real_environment.RealEnv) error {
+	if *enabled {
+		env.SetWebhooks(
+			append(env.GetWebhooks(), NewCompletionHook(env)),
+		)
+	}
+	return nil
+}
+
+// NewCompletionHook returns a webhook that POSTs a signed summary of each
+// finalized invocation to the webhooks configured by its group.
+func NewCompletionHook(env environment.Env) interfaces.DisconnectedInvocationWebhook {
+	return NewCompletionHookWithClient(env, ssrf.NewClient(deliveryTimeout))
+}
+
+// NewCompletionHookWithClient is like NewCompletionHook, but delivers
+// notifications with the given client. The client should not be able to
+// connect to internal addresses, like the clients returned by ssrf.NewClient.
+func NewCompletionHookWithClient(env environment.Env, client *http.Client) interfaces.DisconnectedInvocationWebhook {
+	return &completionHook{env: env, client: client}
+}
+
+func (h *completionHook) NotifiesDisconnected() bool {
+	return true
+}
+
+func (h *completionHook) NotifyComplete(ctx context.Context, in *inpb.Invocation) error {
+	groupID := in.GetAcl().GetGroupId()
+	if groupID == "" {
+		return nil
+	}
+	rq := h.env.GetDBHandle().NewQueryWithOpts(ctx, "completion_webhooks_get_for_notify", db.Opts().WithStaleReads()).Raw(
+		`SELECT * FROM "CompletionWebhooks" WHERE group_id = ? ORDER BY position`, groupID)
+	hooks, err := db.ScanAll(rq, &tables.CompletionWebhook{})
+	if err != nil {
+		return err
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(NewPayload(in))
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, hook := range hooks {
+		err := retry.DoVoid(ctx, retryOptions, func(ctx context.Context) error {
+			return h.post(ctx, hook, body)
+		})
+		if err != nil {
+			log.CtxWarningf(ctx, "Failed to deliver completion webhook for group %s: %s", groupID, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (h *completionHook) post(ctx context.Context, hook *tables.CompletionWebhook, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return retry.NonRetryableError(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(eventHeader, eventName)
+	req.Header.Set(signatureHeader, Sign(hook.SigningSecret, body))
+	res, err := h.client.Do(req)
+	if err != nil {
+		// Connecting to an address that isn't allowed won't succeed later.
+		if status.IsPermissionDeniedError(err) {
+			return retry.NonRetryableError(err)
+		}
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 1024))
+	if res.StatusCode >= 300 {
+		err := status.UnavailableErrorf("HTTP %d while calling completion webhook", res.StatusCode)
+		// Only retry errors that might be transient.
+		if res.StatusCode < 500 && res.StatusCode != http.StatusTooManyRequests {
+			return retry.NonRetryableError(err)
+		}
+		return err
+	}
+	return nil
+}
+
+// Sign returns the value of the signature header for a request body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewPayload returns the notification for a finalized invocation.
+func NewPayload(in *inpb.Invocation) *Payload {
+	s := failureStatus
+	if in.GetInvocationStatus() == inspb.InvocationStatus_DISCONNECTED_INVOCATION_STATUS {
+		s = disconnectedStatus
+	} else if in.GetSuccess() {
+		s = successStatus
+	}
+	idx := event_index.New()
+	for _, e := range in.GetEvent() {
+		idx.Add(e)
+	}
+	idx.Finalize()
+	targets := TargetSummary{
+		Configured: idx.ConfiguredCount,
+		ByStatus:   make(map[string]int64, len(idx.TargetsByStatus)),
+	}
+	for st, t := range idx.TargetsByStatus {
+		targets.ByStatus[strings.ToLower(st.String())] = int64(len(t))
+	}
+	return &Payload{
+		Event:         eventName,
+		InvocationID:  in.GetInvocationId(),
+		Attempt:       in.GetAttempt(),
+		Status:        s,
+		BazelExitCode: in.GetBazelExitCode(),
+		Command:       in.GetCommand(),
+		Pattern:       in.GetPattern(),
+		User:          in.GetUser(),
+		Host:          in.GetHost(),
+		Role:          in.GetRole(),
+		RepoURL:       in.GetRepoUrl(),
+		BranchName:    in.GetBranchName(),
+		CommitSHA:     in.GetCommitSha(),
+		CreatedAtUsec: in.GetCreatedAtUsec(),
+		DurationUsec:  in.GetDurationUsec(),
+		Targets:       targets,
+		Links: Links{
+			Invocation: build_buddy_url.WithPath("/invocation/" + in.GetInvocationId()).String(),
+		},
+	}
+}
+
+func validateURL(rawURL string) error {
+	if len(rawURL) > maxURLLength {
+		return status.InvalidArgumentErrorf("webhook URLs may be at most %d characters", maxURLLength)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return status.InvalidArgumentErrorf("invalid webhook URL %q: %s", rawURL, err)
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return status.InvalidArgumentErrorf("invalid webhook URL %q: expected an https URL", rawURL)
+	}
+	return nil
+}
+
+func authorize(ctx context.Context, env environment.Env, groupID string) error {
+	if groupID == "" {
+		return status.InvalidArgumentError("Missing organization identifier.")
+	}
+	u, err := env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return err
+	}
+	return authutil.AuthorizeOrgAdmin(u, groupID)
+}
+
+func lookupWebhooks(ctx context.Context, dbh interfaces.DB, groupID string) ([]*tables.CompletionWebhook, error) {
+	rq := dbh.NewQuery(ctx, "completion_webhooks_get_webhooks").Raw(
+		`SELECT * FROM "CompletionWebhooks" WHERE group_id = ? ORDER BY position`, groupID)
+	return db.ScanAll(rq, &tables.CompletionWebhook{})
+}
+
+func toProto(rows []*tables.CompletionWebhook) []*grpb.CompletionWebhook {
+	webhooks := make([]*grpb.CompletionWebhook, 0, len(rows))
+	for _, row := range rows {
+		webhooks = append(webhooks, &grpb.CompletionWebhook{
+			Url:           row.URL,
+			SigningSecret: row.SigningSecret,
+		})
+	}
+	return webhooks
+}
+
+func GetWebhooks(ctx context.Context, env environment.Env, req *grpb.GetCompletionWebhooksRequest) (*grpb.GetCompletionWebhooksResponse, error) {
+	groupID := req.GetRequestContext().GetGroupId()
+	if err := authorize(ctx, env, groupID); err != nil {
+		return nil, err
+	}
+	rows, err := lookupWebhooks(ctx, env.GetDBHandle(), groupID)
+	if err != nil {
+		return nil, err
+	}
+	return &grpb.GetCompletionWebhooksResponse{Webhook: toProto(rows)}, nil
+}
+
+func SetWebhooks(ctx context.Context, env environment.Env, req *grpb.SetCompletionWebhooksRequest) (*grpb.SetCompletionWebhooksResponse, error) {
+	if !*enabled {
+		return nil, status.FailedPreconditionError("Completion webhooks are not enabled on this server.")
+	}
+	groupID := req.GetRequestContext().GetGroupId()
+	if err := authorize(ctx, env, groupID); err != nil {
+		return nil, err
+	}
+	if len(req.GetWebhook()) > maxWebhooks {
+		return nil, status.InvalidArgumentErrorf("at most %d completion webhooks may be set", maxWebhooks)
+	}
+	seen := make(map[string]bool, len(req.GetWebhook()))
+	for _, w := range req.GetWebhook() {
+		if err := validateURL(w.GetUrl()); err != nil {
+			return nil, err
+		}
+		if seen[w.GetUrl()] {
+			return nil, status.InvalidArgumentErrorf("webhook URL %q is listed more than once", w.GetUrl())
+		}
+		seen[w.GetUrl()] = true
+	}
+
+	var rows []*tables.CompletionWebhook
+	err := env.GetDBHandle().Transaction(ctx, func(tx interfaces.DB) error {
+		existing, err := lookupWebhooks(ctx, tx, groupID)
+		if err != nil {
+			return err
+		}
+		secrets := make(map[string]string, len(existing))
+		for _, row := range existing {
+			secrets[row.URL] = row.SigningSecret
+		}
+		rows = make([]*tables.CompletionWebhook, 0, len(req.GetWebhook()))
+		for i, w := range req.GetWebhook() {
+			secret, ok := secrets[w.GetUrl()]
+			if !ok {
+				secret, err = random.RandomString(secretLength)
+				if err != nil {
+					return err
+				}
+			}
+			rows = append(rows, &tables.CompletionWebhook{
+				GroupID:       groupID,
+				Position:      int32(i),
+				URL:           w.GetUrl(),
+				SigningSecret: secret,
+			})
+		}
+		if err := tx.NewQuery(ctx, "completion_webhooks_delete_webhooks").Raw(
+			`DELETE FROM "CompletionWebhooks" WHERE group_id = ?`, groupID).Exec().Error; err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if err := tx.NewQuery(ctx, "completion_webhooks_create_webhook").Create(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &grpb.SetCompletionWebhooksResponse{Webhook: toProto(rows)}, nil
+}
@@ -0,0 +1,253 @@
+package completion_webhooks_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/completion_webhooks"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/ssrf"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	aclpb "github.com/buildbuddy-io/buildbuddy/proto/acl"
+	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
+	ctxpb "github.com/buildbuddy-io/buildbuddy/proto/context"
+	grpb "github.com/buildbuddy-io/buildbuddy/proto/group"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	inspb "github.com/buildbuddy-io/buildbuddy/proto/invocation_status"
+)
+
+func setup(t *testing.T) (*testenv.TestEnv, context.Context, context.Context) {
+	te := testenv.GetTestEnv(t)
+	flags.Set(t, "integrations.completion_webhooks.enabled", true)
+	admin := testauth.User("US1", "GR1")
+	admin.GroupMemberships[0].Capabilities = append(admin.GroupMemberships[0].Capabilities, akpb.ApiKey_ORG_ADMIN_CAPABILITY)
+	ta := testauth.NewTestAuthenticator(map[string]interfaces.UserInfo{
+		"US1": admin,
+		"US2": testauth.User("US2", "GR1"),
+	})
+	te.SetAuthenticator(ta)
+	ctx := context.Background()
+	adminCtx, err := ta.WithAuthenticatedUser(ctx, "US1")
+	require.NoError(t, err)
+	developerCtx, err := ta.WithAuthenticatedUser(ctx, "US2")
+	require.NoError(t, err)
+	return te, adminCtx, developerCtx
+}
+
+func requestContext() *ctxpb.RequestContext {
+	return &ctxpb.RequestContext{GroupId: "GR1"}
+}
+
+func TestSetWebhooks(t *testing.T) {
+	te, adminCtx, developerCtx := setup(t)
+
+	req := &grpb.SetCompletionWebhooksRequest{
+		RequestContext: requestContext(),
+		Webhook: []*grpb.CompletionWebhook{
+			{Url: "https://ci.example.com/hooks/buildbuddy"},
+			{Url: "https://chat.example.com/hooks/builds"},
+		},
+	}
+	_, err := completion_webhooks.SetWebhooks(developerCtx, te, req)
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+	setRsp, err := completion_webhooks.SetWebhooks(adminCtx, te, req)
+	require.NoError(t, err)
+	require.Len(t, setRsp.GetWebhook(), 2)
+	secret := setRsp.GetWebhook()[0].GetSigningSecret()
+	assert.NotEmpty(t, secret)
+	assert.NotEqual(t, secret, setRsp.GetWebhook()[1].GetSigningSecret())
+
+	_, err = completion_webhooks.GetWebhooks(developerCtx, te, &grpb.GetCompletionWebhooksRequest{RequestContext: requestContext()})
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+	getRsp, err := completion_webhooks.GetWebhooks(adminCtx, te, &grpb.GetCompletionWebhooksRequest{RequestContext: requestContext()})
+	require.NoError(t, err)
+	require.Len(t, getRsp.GetWebhook(), 2)
+	assert.Equal(t, "https://ci.example.com/hooks/buildbuddy", getRsp.GetWebhook()[0].GetUrl())
+	assert.Equal(t, secret, getRsp.GetWebhook()[0].GetSigningSecret())
+
+	// Webhooks that are kept keep their signing secret.
+	setRsp, err = completion_webhooks.SetWebhooks(adminCtx, te, &grpb.SetCompletionWebhooksRequest{
+		RequestContext: requestContext(),
+		Webhook:        []*grpb.CompletionWebhook{{Url: "https://ci.example.com/hooks/buildbuddy", SigningSecret: "ignored"}},
+	})
+	require.NoError(t, err)
+	require.Len(t, setRsp.GetWebhook(), 1)
+	assert.Equal(t, secret, setRsp.GetWebhook()[0].GetSigningSecret())
+}
+
+func TestSetWebhooks_Invalid(t *testing.T) {
+	te, adminCtx, _ := setup(t)
+	for _, webhooks := range [][]*grpb.CompletionWebhook{
+		{{Url: ""}},
+		{{Url: "ftp://example.com/hook"}},
+		{{Url: "http://example.com/hook"}},
+		{{Url: "https:///hook"}},
+		{{Url: "https://example.com/hook"}, {Url: "https://example.com/hook"}},
+	} {
+		_, err := completion_webhooks.SetWebhooks(adminCtx, te, &grpb.SetCompletionWebhooksRequest{
+			RequestContext: requestContext(),
+			Webhook:        webhooks,
+		})
+		assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error for %v, got %v", webhooks, err)
+	}
+}
+
+func TestSetWebhooks_Disabled(t *testing.T) {
+	te, adminCtx, _ := setup(t)
+	flags.Set(t, "integrations.completion_webhooks.enabled", false)
+	_, err := completion_webhooks.SetWebhooks(adminCtx, te, &grpb.SetCompletionWebhooksRequest{
+		RequestContext: requestContext(),
+		Webhook:        []*grpb.CompletionWebhook{{Url: "https://example.com/hook"}},
+	})
+	assert.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition error, got %v", err)
+}
+
+// startServer starts an HTTPS server on a loopback address that webhooks may
+// be delivered to, returning its URL and a completion hook that trusts its
+// certificate.
+func startServer(t *testing.T, te *testenv.TestEnv, handler http.Handler) (string, interfaces.DisconnectedInvocationWebhook) {
+	flags.Set(t, "app.allowed_private_destination_cidrs", []string{"127.0.0.0/8", "::1/128"})
+	server := httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+	client := ssrf.NewClient(10 * time.Second)
+	client.Transport.(*http.Transport).TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig
+	return server.URL, completion_webhooks.NewCompletionHookWithClient(te, client)
+}
+
+type delivery struct {
+	header http.Header
+	body   []byte
+}
+
+func TestNotifyComplete(t *testing.T) {
+	te, adminCtx, _ := setup(t)
+
+	var mu sync.Mutex
+	var deliveries []*delivery
+	failures := 1
+	u, hook := startServer(t, te, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		mu.Lock()
+		defer mu.Unlock()
+		deliveries = append(deliveries, &delivery{header: r.Header, body: body})
+		// Fail the first delivery to check that it is retried.
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	setRsp, err := completion_webhooks.SetWebhooks(adminCtx, te, &grpb.SetCompletionWebhooksRequest{
+		RequestContext: requestContext(),
+		Webhook:        []*grpb.CompletionWebhook{{Url: u + "/hook"}},
+	})
+	require.NoError(t, err)
+	secret := setRsp.GetWebhook()[0].GetSigningSecret()
+
+	assert.True(t, completion_webhooks.NewCompletionHook(te).NotifiesDisconnected())
+	err = hook.NotifyComplete(context.Background(), &inpb.Invocation{
+		InvocationId:     "inv1",
+		Acl:              &aclpb.ACL{GroupId: "GR1"},
+		InvocationStatus: inspb.InvocationStatus_DISCONNECTED_INVOCATION_STATUS,
+		Command:          "test",
+		DurationUsec:     1500,
+	})
+	require.NoError(t, err)
+
+	require.Len(t, deliveries, 2)
+	d := deliveries[1]
+	assert.Equal(t, deliveries[0].body, d.body)
+	assert.Equal(t, "invocation.finalized", d.header.Get("X-BuildBuddy-Event"))
+	assert.Equal(t, completion_webhooks.Sign(secret, d.body), d.header.Get("X-BuildBuddy-Signature-256"))
+	payload := &completion_webhooks.Payload{}
+	require.NoError(t, json.Unmarshal(d.body, payload))
+	assert.Equal(t, "inv1", payload.InvocationID)
+	assert.Equal(t, "disconnected", payload.Status)
+	assert.Equal(t, "test", payload.Command)
+	assert.Equal(t, int64(1500), payload.DurationUsec)
+	assert.Contains(t, payload.Links.Invocation, "/invocation/inv1")
+
+	// Invocations of groups without webhooks aren't delivered anywhere.
+	err = hook.NotifyComplete(context.Background(), &inpb.Invocation{
+		InvocationId: "inv2",
+		Acl:          &aclpb.ACL{GroupId: "GR2"},
+	})
+	require.NoError(t, err)
+	assert.Len(t, deliveries, 2)
+}
+
+func TestNotifyComplete_ClientError(t *testing.T) {
+	te, adminCtx, _ := setup(t)
+
+	requests := 0
+	u, hook := startServer(t, te, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	_, err := completion_webhooks.SetWebhooks(adminCtx, te, &grpb.SetCompletionWebhooksRequest{
+		RequestContext: requestContext(),
+		Webhook:        []*grpb.CompletionWebhook{{Url: u}},
+	})
+	require.NoError(t, err)
+
+	err = hook.NotifyComplete(context.Background(), &inpb.Invocation{
+		InvocationId: "inv1",
+		Acl:          &aclpb.ACL{GroupId: "GR1"},
+		Success:      true,
+	})
+	require.Error(t, err)
+	// Client errors aren't retried.
+	assert.Equal(t, 1, requests)
+}
+
+func TestNewPayload(t *testing.T) {
+	p := completion_webhooks.NewPayload(&inpb.Invocation{
+		InvocationId:     "inv1",
+		InvocationStatus: inspb.InvocationStatus_COMPLETE_INVOCATION_STATUS,
+		Success:          true,
+		BazelExitCode:    "SUCCESS",
+	})
+	assert.Equal(t, "success", p.Status)
+	assert.Equal(t, "SUCCESS", p.BazelExitCode)
+
+	p = completion_webhooks.NewPayload(&inpb.Invocation{
+		InvocationStatus: inspb.InvocationStatus_COMPLETE_INVOCATION_STATUS,
+		BazelExitCode:    "BUILD_FAILURE",
+	})
+	assert.Equal(t, "failure", p.Status)
+}
+
+func TestNotifyComplete_InternalAddress(t *testing.T) {
+	te, adminCtx, _ := setup(t)
+
+	requests := 0
+	u, hook := startServer(t, te, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	_, err := completion_webhooks.SetWebhooks(adminCtx, te, &grpb.SetCompletionWebhooksRequest{
+		RequestContext: requestContext(),
+		Webhook:        []*grpb.CompletionWebhook{{Url: u}},
+	})
+	require.NoError(t, err)
+
+	// Loopback addresses can't be reached unless they're allowed.
+	flags.Set(t, "app.allowed_private_destination_cidrs", []string{})
+	err = hook.NotifyComplete(context.Background(), &inpb.Invocation{
+		InvocationId: "inv1",
+		Acl:          &aclpb.ACL{GroupId: "GR1"},
+	})
+	require.Error(t, err)
+	assert.Equal(t, 0, requests)
+}
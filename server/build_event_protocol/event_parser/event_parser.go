@@ -427,6 +427,8 @@ func (sep *StreamingEventParser) fillInvocationFromBuildMetadata(metadata map[st
 	}
 	if visibility, ok := metadata["VISIBILITY"]; ok && visibility == "PUBLIC" {
 		sep.setReadPermission(inpb.InvocationPermission_PUBLIC, priority)
+	} else if ok && visibility == "OWNER" {
+		sep.setReadPermission(inpb.InvocationPermission_OWNER, priority)
 	}
 	if tags, ok := metadata["TAGS"]; ok && tags != "" {
 		if err := sep.setTags(tags, priority); err != nil {
@@ -0,0 +1,156 @@
+// Package redaction_rules stores the redactions that organizations configure
+// for their build events, in addition to the standard redactions.
+package redaction_rules
+
+import (
+	"context"
+	"regexp"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/authutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/redact"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	grpb "github.com/buildbuddy-io/buildbuddy/proto/group"
+)
+
+const (
+	maxRules         = 100
+	maxPatternLength = 1000
+)
+
+func compileRule(target grpb.RedactionRuleTarget, pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, status.InvalidArgumentError("redaction rule patterns must not be empty")
+	}
+	if len(pattern) > maxPatternLength {
+		return nil, status.InvalidArgumentErrorf("redaction rule pattern is longer than %d characters", maxPatternLength)
+	}
+	expr := pattern
+	switch target {
+	case grpb.RedactionRuleTarget_ENV_VAR_NAME_REDACTION_RULE_TARGET, grpb.RedactionRuleTarget_FLAG_NAME_REDACTION_RULE_TARGET:
+		// Name patterns must match the entire name.
+		expr = "^(?:" + pattern + ")$"
+	case grpb.RedactionRuleTarget_URL_REDACTION_RULE_TARGET:
+	default:
+		return nil, status.InvalidArgumentErrorf("unknown redaction rule target %d", target)
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("invalid redaction rule pattern %q: %s", pattern, err)
+	}
+	if target == grpb.RedactionRuleTarget_URL_REDACTION_RULE_TARGET && re.MatchString("") {
+		return nil, status.InvalidArgumentErrorf("redaction rule pattern %q must not match empty text", pattern)
+	}
+	return re, nil
+}
+
+func lookupRules(ctx context.Context, dbh interfaces.DB, groupID string) ([]*tables.RedactionRule, error) {
+	rq := dbh.NewQuery(ctx, "redaction_rules_get_rules").Raw(
+		`SELECT * FROM "RedactionRules" WHERE group_id = ? ORDER BY position`, groupID)
+	return db.ScanAll(rq, &tables.RedactionRule{})
+}
+
+// Load returns the redaction rules of the given group, or nil if the group
+// doesn't have any.
+func Load(ctx context.Context, env environment.Env, groupID string) (*redact.CustomRules, error) {
+	rows, err := lookupRules(ctx, env.GetDBHandle(), groupID)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	rules := &redact.CustomRules{}
+	for _, row := range rows {
+		target := grpb.RedactionRuleTarget(row.Target)
+		re, err := compileRule(target, row.Pattern)
+		if err != nil {
+			return nil, status.InternalErrorf("group %s has an invalid redaction rule: %s", groupID, err)
+		}
+		switch target {
+		case grpb.RedactionRuleTarget_ENV_VAR_NAME_REDACTION_RULE_TARGET:
+			rules.EnvVarNames = append(rules.EnvVarNames, re)
+		case grpb.RedactionRuleTarget_FLAG_NAME_REDACTION_RULE_TARGET:
+			rules.FlagNames = append(rules.FlagNames, re)
+		case grpb.RedactionRuleTarget_URL_REDACTION_RULE_TARGET:
+			rules.URLs = append(rules.URLs, re)
+		}
+	}
+	return rules, nil
+}
+
+func GetRules(ctx context.Context, env environment.Env, req *grpb.GetRedactionRulesRequest) (*grpb.GetRedactionRulesResponse, error) {
+	groupID := req.GetRequestContext().GetGroupId()
+	if groupID == "" {
+		return nil, status.InvalidArgumentError("Missing organization identifier.")
+	}
+	u, err := env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := authutil.AuthorizeOrgAdmin(u, groupID); err != nil {
+		return nil, err
+	}
+	rows, err := lookupRules(ctx, env.GetDBHandle(), groupID)
+	if err != nil {
+		return nil, err
+	}
+	rsp := &grpb.GetRedactionRulesResponse{}
+	for _, row := range rows {
+		rsp.Rule = append(rsp.Rule, &grpb.RedactionRule{
+			Target:  grpb.RedactionRuleTarget(row.Target),
+			Pattern: row.Pattern,
+		})
+	}
+	return rsp, nil
+}
+
+func SetRules(ctx context.Context, env environment.Env, req *grpb.SetRedactionRulesRequest) (*grpb.SetRedactionRulesResponse, error) {
+	groupID := req.GetRequestContext().GetGroupId()
+	if groupID == "" {
+		return nil, status.InvalidArgumentError("Missing organization identifier.")
+	}
+	u, err := env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := authutil.AuthorizeOrgAdmin(u, groupID); err != nil {
+		return nil, err
+	}
+	if len(req.GetRule()) > maxRules {
+		return nil, status.InvalidArgumentErrorf("at most %d redaction rules may be set", maxRules)
+	}
+	rows := make([]*tables.RedactionRule, 0, len(req.GetRule()))
+	for i, r := range req.GetRule() {
+		if _, err := compileRule(r.GetTarget(), r.GetPattern()); err != nil {
+			return nil, err
+		}
+		rows = append(rows, &tables.RedactionRule{
+			GroupID:  groupID,
+			Position: int32(i),
+			Target:   int32(r.GetTarget()),
+			Pattern:  r.GetPattern(),
+		})
+	}
+
+	err = env.GetDBHandle().Transaction(ctx, func(tx interfaces.DB) error {
+		if err := tx.NewQuery(ctx, "redaction_rules_delete_rules").Raw(
+			`DELETE FROM "RedactionRules" WHERE group_id = ?`, groupID).Exec().Error; err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if err := tx.NewQuery(ctx, "redaction_rules_create_rule").Create(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &grpb.SetRedactionRulesResponse{}, nil
+}
@@ -0,0 +1,104 @@
+package redaction_rules_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/redaction_rules"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
+	ctxpb "github.com/buildbuddy-io/buildbuddy/proto/context"
+	grpb "github.com/buildbuddy-io/buildbuddy/proto/group"
+)
+
+func setup(t *testing.T) (*testenv.TestEnv, context.Context, context.Context) {
+	te := testenv.GetTestEnv(t)
+	admin := testauth.User("US1", "GR1")
+	admin.GroupMemberships[0].Capabilities = append(admin.GroupMemberships[0].Capabilities, akpb.ApiKey_ORG_ADMIN_CAPABILITY)
+	ta := testauth.NewTestAuthenticator(map[string]interfaces.UserInfo{
+		"US1": admin,
+		"US2": testauth.User("US2", "GR1"),
+	})
+	te.SetAuthenticator(ta)
+	ctx := context.Background()
+	adminCtx, err := ta.WithAuthenticatedUser(ctx, "US1")
+	require.NoError(t, err)
+	developerCtx, err := ta.WithAuthenticatedUser(ctx, "US2")
+	require.NoError(t, err)
+	return te, adminCtx, developerCtx
+}
+
+func requestContext() *ctxpb.RequestContext {
+	return &ctxpb.RequestContext{GroupId: "GR1"}
+}
+
+func TestSetRules(t *testing.T) {
+	te, adminCtx, developerCtx := setup(t)
+
+	rules, err := redaction_rules.Load(adminCtx, te, "GR1")
+	require.NoError(t, err)
+	assert.Nil(t, rules)
+
+	req := &grpb.SetRedactionRulesRequest{
+		RequestContext: requestContext(),
+		Rule: []*grpb.RedactionRule{
+			{Target: grpb.RedactionRuleTarget_ENV_VAR_NAME_REDACTION_RULE_TARGET, Pattern: "AWS_.*"},
+			{Target: grpb.RedactionRuleTarget_FLAG_NAME_REDACTION_RULE_TARGET, Pattern: "deploy_token"},
+			{Target: grpb.RedactionRuleTarget_URL_REDACTION_RULE_TARGET, Pattern: `https://internal\.example\.com\S*`},
+		},
+	}
+	_, err = redaction_rules.SetRules(developerCtx, te, req)
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+	_, err = redaction_rules.SetRules(adminCtx, te, req)
+	require.NoError(t, err)
+
+	_, err = redaction_rules.GetRules(developerCtx, te, &grpb.GetRedactionRulesRequest{RequestContext: requestContext()})
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+	rsp, err := redaction_rules.GetRules(adminCtx, te, &grpb.GetRedactionRulesRequest{RequestContext: requestContext()})
+	require.NoError(t, err)
+	require.Len(t, rsp.GetRule(), 3)
+	assert.Equal(t, "AWS_.*", rsp.GetRule()[0].GetPattern())
+	assert.Equal(t, grpb.RedactionRuleTarget_URL_REDACTION_RULE_TARGET, rsp.GetRule()[2].GetTarget())
+
+	rules, err = redaction_rules.Load(adminCtx, te, "GR1")
+	require.NoError(t, err)
+	require.Len(t, rules.EnvVarNames, 1)
+	// Name patterns must match the entire name.
+	assert.True(t, rules.EnvVarNames[0].MatchString("AWS_SECRET_ACCESS_KEY"))
+	assert.False(t, rules.EnvVarNames[0].MatchString("MY_AWS_REGION"))
+	require.Len(t, rules.FlagNames, 1)
+	assert.False(t, rules.FlagNames[0].MatchString("deploy_token_file"))
+	require.Len(t, rules.URLs, 1)
+	assert.True(t, rules.URLs[0].MatchString("fetch https://internal.example.com/x?key=1"))
+
+	// Setting the rules replaces the previous rules.
+	_, err = redaction_rules.SetRules(adminCtx, te, &grpb.SetRedactionRulesRequest{RequestContext: requestContext()})
+	require.NoError(t, err)
+	rules, err = redaction_rules.Load(adminCtx, te, "GR1")
+	require.NoError(t, err)
+	assert.Nil(t, rules)
+}
+
+func TestSetRules_Invalid(t *testing.T) {
+	te, adminCtx, _ := setup(t)
+	for _, rule := range []*grpb.RedactionRule{
+		{Target: grpb.RedactionRuleTarget_FLAG_NAME_REDACTION_RULE_TARGET, Pattern: ""},
+		{Target: grpb.RedactionRuleTarget_FLAG_NAME_REDACTION_RULE_TARGET, Pattern: "("},
+		{Target: grpb.RedactionRuleTarget_UNKNOWN_REDACTION_RULE_TARGET, Pattern: "token"},
+		// URL rules that match empty text would redact between every
+		// character.
+		{Target: grpb.RedactionRuleTarget_URL_REDACTION_RULE_TARGET, Pattern: "x*"},
+	} {
+		_, err := redaction_rules.SetRules(adminCtx, te, &grpb.SetRedactionRulesRequest{
+			RequestContext: requestContext(),
+			Rule:           []*grpb.RedactionRule{rule},
+		})
+		assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error for %v, got %v", rule, err)
+	}
+}
@@ -61,6 +61,18 @@ type target struct {
 	targetType     cmpb.TargetType
 	testSize       build_event_stream.TestSize
 	buildSuccess   bool
+	attempts       []*testAttempt
+}
+
+// testAttempt is the result of a single attempt of a test run and shard.
+type testAttempt struct {
+	run       int32
+	shard     int32
+	attempt   int32
+	status    build_event_stream.TestStatus
+	cached    bool
+	startTime time.Time
+	duration  time.Duration
 }
 
 func md5Int64(text string) int64 {
@@ -99,7 +111,18 @@ func (t *target) updateFromEvent(event *build_event_stream.BuildEvent) {
 		}
 		t.state = targetStateCompleted
 	case *build_event_stream.BuildEvent_TestResult:
-		t.cached = p.TestResult.GetCachedLocally() || p.TestResult.GetExecutionInfo().GetCachedRemotely()
+		tr := p.TestResult
+		t.cached = tr.GetCachedLocally() || tr.GetExecutionInfo().GetCachedRemotely()
+		id := event.GetId().GetTestResult()
+		t.attempts = append(t.attempts, &testAttempt{
+			run:       id.GetRun(),
+			shard:     id.GetShard(),
+			attempt:   id.GetAttempt(),
+			status:    tr.GetStatus(),
+			cached:    t.cached,
+			startTime: timeutil.GetTimeWithFallback(tr.GetTestAttemptStart(), tr.GetTestAttemptStartMillisEpoch()),
+			duration:  timeutil.GetDurationWithFallback(tr.GetTestAttemptDuration(), tr.GetTestAttemptDurationMillis()),
+		})
 		t.state = targetStateResult
 	case *build_event_stream.BuildEvent_TestSummary:
 		ts := p.TestSummary
@@ -288,12 +311,31 @@ func (t *TargetTracker) writeTestTargetStatuses(ctx context.Context, permissions
 		return err
 	}
 	newTargetStatuses := make([]*tables.TargetStatus, 0)
+	newTestAttempts := make([]*tables.TargetTestAttempt, 0)
 	for _, target := range t.targets {
 		if !isTest(target) {
 			continue
 		}
+		targetID := md5Int64(repoURL + target.label)
+		for _, a := range target.attempts {
+			startTimeUsec := int64(0)
+			if !a.startTime.IsZero() {
+				startTimeUsec = a.startTime.UnixMicro()
+			}
+			newTestAttempts = append(newTestAttempts, &tables.TargetTestAttempt{
+				TargetID:       targetID,
+				InvocationUUID: invocationUUID,
+				Run:            a.run,
+				Shard:          a.shard,
+				Attempt:        a.attempt,
+				Status:         int32(a.status),
+				Cached:         a.cached,
+				StartTimeUsec:  startTimeUsec,
+				DurationUsec:   a.duration.Microseconds(),
+			})
+		}
 		newTargetStatuses = append(newTargetStatuses, &tables.TargetStatus{
-			TargetID:       md5Int64(repoURL + target.label),
+			TargetID:       targetID,
 			InvocationUUID: invocationUUID,
 			TargetType:     int32(target.targetType),
 			TestSize:       int32(target.testSize),
@@ -307,6 +349,10 @@ func (t *TargetTracker) writeTestTargetStatuses(ctx context.Context, permissions
 		log.Warningf("Error inserting %q target statuses: %s", t.invocationID(), err.Error())
 		return err
 	}
+	if err := insertTestAttempts(ctx, t.env, newTestAttempts); err != nil {
+		log.Warningf("Error inserting %q test attempts: %s", t.invocationID(), err.Error())
+		return err
+	}
 	return nil
 }
 
@@ -615,6 +661,48 @@ func insertOrUpdateTargetStatuses(ctx context.Context, env environment.Env, stat
 	return nil
 }
 
+func chunkTestAttemptsBy(items []*tables.TargetTestAttempt, chunkSize int) (chunks [][]*tables.TargetTestAttempt) {
+	if len(items) == 0 {
+		return nil
+	}
+	for chunkSize < len(items) {
+		items, chunks = items[chunkSize:], append(chunks, items[0:chunkSize:chunkSize])
+	}
+	return append(chunks, items)
+}
+
+func insertTestAttempts(ctx context.Context, env environment.Env, attempts []*tables.TargetTestAttempt) error {
+	if env.GetDBHandle() == nil {
+		return status.FailedPreconditionError("database not configured")
+	}
+	chunkList := chunkTestAttemptsBy(attempts, 100)
+	for _, chunk := range chunkList {
+		valueStrings := []string{}
+		valueArgs := []interface{}{}
+		for _, a := range chunk {
+			nowUsec := time.Now().UnixMicro()
+			valueStrings = append(valueStrings, "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+			valueArgs = append(valueArgs, a.TargetID)
+			valueArgs = append(valueArgs, a.InvocationUUID)
+			valueArgs = append(valueArgs, a.Run)
+			valueArgs = append(valueArgs, a.Shard)
+			valueArgs = append(valueArgs, a.Attempt)
+			valueArgs = append(valueArgs, a.Status)
+			valueArgs = append(valueArgs, a.Cached)
+			valueArgs = append(valueArgs, a.StartTimeUsec)
+			valueArgs = append(valueArgs, a.DurationUsec)
+			valueArgs = append(valueArgs, nowUsec)
+			valueArgs = append(valueArgs, nowUsec)
+		}
+		stmt := fmt.Sprintf(`INSERT INTO "TargetTestAttempts" (target_id, invocation_uuid, run, shard, attempt, status, cached, start_time_usec, duration_usec, created_at_usec, updated_at_usec) VALUES %s`, strings.Join(valueStrings, ","))
+		err := env.GetDBHandle().NewQuery(ctx, "target_tracker_insert_test_attempts").Raw(stmt, valueArgs...).Exec().Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (t *TargetTracker) WriteToOLAPDBEnabled() bool {
 	return *writeTestTargetStatusesToOLAPDBEnabled && t.env.GetOLAPDBHandle() != nil
 }
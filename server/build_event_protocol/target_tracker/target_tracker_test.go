@@ -126,6 +126,10 @@ func (a *fakeAccumulator) ActionName() string {
 	return ""
 }
 
+func (a *fakeAccumulator) StatusName() string {
+	return ""
+}
+
 func (a *fakeAccumulator) MetadataIsLoaded() bool {
 	return true
 }
@@ -473,6 +477,21 @@ func runTrackTargetsForEventsTest(t *testing.T) {
 		assertTestTargetStatusesMatchOLAPDB(t, te, expected)
 	} else {
 		assertTestTargetStatusesMatchPrimaryDB(t, ctx, te, testUUID, expected)
+
+		// Each TestResult event is stored as a test attempt.
+		var attempts []*tables.TargetTestAttempt
+		err := te.GetDBHandle().NewQuery(ctx, "get_test_attempts").Raw(`SELECT * FROM "TargetTestAttempts"`).Take(&attempts)
+		require.NoError(t, err)
+		var statuses []int32
+		for _, a := range attempts {
+			statuses = append(statuses, a.Status)
+		}
+		assert.ElementsMatch(t, []int32{
+			int32(build_event_stream.TestStatus_PASSED),
+			int32(build_event_stream.TestStatus_PASSED),
+			int32(build_event_stream.TestStatus_PASSED),
+			int32(build_event_stream.TestStatus_FAILED),
+		}, statuses)
 	}
 }
 
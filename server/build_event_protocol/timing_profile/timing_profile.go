@@ -0,0 +1,248 @@
+// Package timing_profile parses the JSON trace profiles that Bazel uploads
+// with its build tool logs, and stores the phase and critical path durations
+// of each invocation so that they can be compared across invocations.
+package timing_profile
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	enableIngestion = flag.Bool("app.enable_timing_profile_ingestion", false, "If enabled, the JSON trace profiles uploaded by bazel are parsed after invocations complete, and their phase and critical path durations are stored so that timing trends can be queried.")
+)
+
+const (
+	phaseMarkerCategory   = "build phase marker"
+	criticalPathCategory  = "critical path component"
+	metadataEventPhase    = "M"
+	gzipMagic             = "\x1f\x8b"
+	traceEventsObjectName = "traceEvents"
+)
+
+var (
+	// Phases are named after the description of the phase marker events that
+	// start them.
+	phaseNames = map[string]Phase{
+		"Launch Blaze":                  LaunchPhase,
+		"Initialize command":            InitPhase,
+		"Evaluate target patterns":      TargetPatternEvaluationPhase,
+		"Load and analyze dependencies": AnalysisPhase,
+		// Older bazel versions checked licenses after analysis.
+		"Analyze licenses":  AnalysisPhase,
+		"Prepare for build": PreparationPhase,
+		"Build artifacts":   ExecutionPhase,
+		"Complete build":    FinishPhase,
+	}
+)
+
+type Phase int
+
+const (
+	LaunchPhase Phase = iota
+	InitPhase
+	TargetPatternEvaluationPhase
+	AnalysisPhase
+	PreparationPhase
+	ExecutionPhase
+	FinishPhase
+	numPhases
+)
+
+func Enabled() bool {
+	return *enableIngestion
+}
+
+// Summary contains the durations extracted from a profile.
+type Summary struct {
+	// The duration of each phase of the build, indexed by Phase. Phases that
+	// didn't run have a zero duration.
+	Phases [numPhases]time.Duration
+
+	// The summed duration of the actions on the critical path.
+	CriticalPath time.Duration
+
+	// The time from the first to the last event in the profile.
+	Total time.Duration
+}
+
+type traceEvent struct {
+	Category string  `json:"cat"`
+	Name     string  `json:"name"`
+	Phase    string  `json:"ph"`
+	Ts       float64 `json:"ts"`
+	Dur      float64 `json:"dur"`
+}
+
+type phaseMarker struct {
+	phase Phase
+	ts    float64
+}
+
+// Parse reads a JSON trace profile, which may be gzipped. Trace events are
+// decoded one at a time, so that large profiles don't need to be held in
+// memory.
+func Parse(r io.Reader) (*Summary, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(len(gzipMagic)); err == nil && bytes.Equal(magic, []byte(gzipMagic)) {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("read gzipped profile: %s", err)
+		}
+		defer gr.Close()
+		r = gr
+	} else {
+		r = br
+	}
+
+	p := &parser{start: -1}
+	dec := json.NewDecoder(r)
+	t, err := dec.Token()
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("parse profile: %s", err)
+	}
+	// Profiles are usually an object with a "traceEvents" list, but may
+	// also be just the list.
+	switch t {
+	case json.Delim('['):
+		if err := p.parseEvents(dec); err != nil {
+			return nil, err
+		}
+	case json.Delim('{'):
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, status.InvalidArgumentErrorf("parse profile: %s", err)
+			}
+			if key != traceEventsObjectName {
+				var skipped json.RawMessage
+				if err := dec.Decode(&skipped); err != nil {
+					return nil, status.InvalidArgumentErrorf("parse profile: %s", err)
+				}
+				continue
+			}
+			if t, err := dec.Token(); err != nil || t != json.Delim('[') {
+				return nil, status.InvalidArgumentError("parse profile: traceEvents is not a list")
+			}
+			if err := p.parseEvents(dec); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, status.InvalidArgumentError("parse profile: profile is not a JSON object or list")
+	}
+	return p.summary(), nil
+}
+
+type parser struct {
+	markers      []phaseMarker
+	criticalPath float64
+	start, end   float64
+}
+
+// parseEvents parses the events in a list whose opening bracket has already
+// been read, including the closing bracket.
+func (p *parser) parseEvents(dec *json.Decoder) error {
+	for dec.More() {
+		e := &traceEvent{}
+		if err := dec.Decode(e); err != nil {
+			return status.InvalidArgumentErrorf("parse profile event: %s", err)
+		}
+		p.add(e)
+	}
+	if _, err := dec.Token(); err != nil {
+		return status.InvalidArgumentErrorf("parse profile: %s", err)
+	}
+	return nil
+}
+
+func (p *parser) add(e *traceEvent) {
+	if e.Phase == metadataEventPhase {
+		return
+	}
+	if p.start < 0 || e.Ts < p.start {
+		p.start = e.Ts
+	}
+	if end := e.Ts + e.Dur; end > p.end {
+		p.end = end
+	}
+	switch e.Category {
+	case phaseMarkerCategory:
+		if phase, ok := phaseNames[e.Name]; ok {
+			p.markers = append(p.markers, phaseMarker{phase: phase, ts: e.Ts})
+		}
+	case criticalPathCategory:
+		p.criticalPath += e.Dur
+	}
+}
+
+func (p *parser) summary() *Summary {
+	s := &Summary{CriticalPath: usec(p.criticalPath)}
+	if p.start >= 0 {
+		s.Total = usec(p.end - p.start)
+	}
+	// Each phase lasts until the next one starts, and the last one lasts
+	// until the end of the profile.
+	sort.SliceStable(p.markers, func(i, j int) bool {
+		return p.markers[i].ts < p.markers[j].ts
+	})
+	for i, m := range p.markers {
+		end := p.end
+		if i+1 < len(p.markers) {
+			end = p.markers[i+1].ts
+		}
+		s.Phases[m.phase] += usec(end - m.ts)
+	}
+	return s
+}
+
+// Trace event timestamps and durations are in microseconds.
+func usec(v float64) time.Duration {
+	return time.Duration(v * float64(time.Microsecond))
+}
+
+// Ingest fetches the profile with the given bytestream URI, and stores its
+// summary for the given invocation, replacing the summary of any previous
+// attempt.
+func Ingest(ctx context.Context, env environment.Env, ti *tables.Invocation, uri *url.URL) error {
+	if env.GetDBHandle() == nil || env.GetPooledByteStreamClient() == nil {
+		return nil
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(env.GetPooledByteStreamClient().StreamBytestreamFile(ctx, uri, pw))
+	}()
+	s, err := Parse(pr)
+	// Unblock the writer if parsing stopped early.
+	pr.Close()
+	if err != nil {
+		return err
+	}
+	row := &tables.InvocationTimingProfile{
+		InvocationID:                     ti.InvocationID,
+		Attempt:                          ti.Attempt,
+		LaunchPhaseUsec:                  s.Phases[LaunchPhase].Microseconds(),
+		InitPhaseUsec:                    s.Phases[InitPhase].Microseconds(),
+		TargetPatternEvaluationPhaseUsec: s.Phases[TargetPatternEvaluationPhase].Microseconds(),
+		AnalysisPhaseUsec:                s.Phases[AnalysisPhase].Microseconds(),
+		PreparationPhaseUsec:             s.Phases[PreparationPhase].Microseconds(),
+		ExecutionPhaseUsec:               s.Phases[ExecutionPhase].Microseconds(),
+		FinishPhaseUsec:                  s.Phases[FinishPhase].Microseconds(),
+		CriticalPathUsec:                 s.CriticalPath.Microseconds(),
+		TotalUsec:                        s.Total.Microseconds(),
+	}
+	return env.GetDBHandle().GORM(ctx, "timing_profile_upsert").Clauses(clause.OnConflict{UpdateAll: true}).Create(row).Error
+}
@@ -0,0 +1,89 @@
+package timing_profile_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/timing_profile"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testProfile = `{
+  "otherData": {"build_id": "1234", "output_base": "/tmp/output_base"},
+  "traceEvents": [
+    {"name": "thread_name", "ph": "M", "pid": 1, "tid": 0, "args": {"name": "Critical Path"}},
+    {"cat": "build phase marker", "name": "Launch Blaze", "ph": "i", "ts": 0, "pid": 1, "tid": 1},
+    {"cat": "build phase marker", "name": "Initialize command", "ph": "i", "ts": 100, "pid": 1, "tid": 1},
+    {"cat": "build phase marker", "name": "Evaluate target patterns", "ph": "i", "ts": 300, "pid": 1, "tid": 1},
+    {"cat": "build phase marker", "name": "Load and analyze dependencies", "ph": "i", "ts": 600, "pid": 1, "tid": 1},
+    {"cat": "build phase marker", "name": "Analyze licenses", "ph": "i", "ts": 1000, "pid": 1, "tid": 1},
+    {"cat": "build phase marker", "name": "Prepare for build", "ph": "i", "ts": 1500, "pid": 1, "tid": 1},
+    {"cat": "build phase marker", "name": "Build artifacts", "ph": "i", "ts": 2100, "pid": 1, "tid": 1},
+    {"cat": "action processing", "name": "GoCompilePkg", "ph": "X", "ts": 2200, "dur": 5000.5, "pid": 1, "tid": 2},
+    {"cat": "critical path component", "name": "action 'GoCompilePkg'", "ph": "X", "ts": 2200, "dur": 4000, "pid": 1, "tid": 0},
+    {"cat": "critical path component", "name": "action 'GoLink'", "ph": "X", "ts": 6200, "dur": 1000, "pid": 1, "tid": 0},
+    {"cat": "build phase marker", "name": "Complete build", "ph": "i", "ts": 7300, "pid": 1, "tid": 1},
+    {"cat": "general information", "name": "Finish", "ph": "X", "ts": 7300, "dur": 700, "pid": 1, "tid": 1}
+  ]
+}`
+
+func TestParse(t *testing.T) {
+	s, err := timing_profile.Parse(strings.NewReader(testProfile))
+	require.NoError(t, err)
+	assert.Equal(t, 100*time.Microsecond, s.Phases[timing_profile.LaunchPhase])
+	assert.Equal(t, 200*time.Microsecond, s.Phases[timing_profile.InitPhase])
+	assert.Equal(t, 300*time.Microsecond, s.Phases[timing_profile.TargetPatternEvaluationPhase])
+	// License checking is counted as part of analysis.
+	assert.Equal(t, 900*time.Microsecond, s.Phases[timing_profile.AnalysisPhase])
+	assert.Equal(t, 600*time.Microsecond, s.Phases[timing_profile.PreparationPhase])
+	assert.Equal(t, 5200*time.Microsecond, s.Phases[timing_profile.ExecutionPhase])
+	assert.Equal(t, 700*time.Microsecond, s.Phases[timing_profile.FinishPhase])
+	assert.Equal(t, 5000*time.Microsecond, s.CriticalPath)
+	assert.Equal(t, 8000*time.Microsecond, s.Total)
+}
+
+func TestParse_Gzipped(t *testing.T) {
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	_, err := gw.Write([]byte(testProfile))
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	s, err := timing_profile.Parse(buf)
+	require.NoError(t, err)
+	assert.Equal(t, 5000*time.Microsecond, s.CriticalPath)
+	assert.Equal(t, 8000*time.Microsecond, s.Total)
+}
+
+func TestParse_EventList(t *testing.T) {
+	s, err := timing_profile.Parse(strings.NewReader(`[
+		{"cat": "build phase marker", "name": "Launch Blaze", "ph": "i", "ts": 1000},
+		{"cat": "build phase marker", "name": "Build artifacts", "ph": "i", "ts": 3000},
+		{"cat": "action processing", "name": "GoCompilePkg", "ph": "X", "ts": 3000, "dur": 2000}
+	]`))
+	require.NoError(t, err)
+	assert.Equal(t, 2000*time.Microsecond, s.Phases[timing_profile.LaunchPhase])
+	assert.Equal(t, 2000*time.Microsecond, s.Phases[timing_profile.ExecutionPhase])
+	assert.Equal(t, time.Duration(0), s.Phases[timing_profile.AnalysisPhase])
+	assert.Equal(t, time.Duration(0), s.CriticalPath)
+	assert.Equal(t, 4000*time.Microsecond, s.Total)
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for _, profile := range []string{
+		``,
+		`"profile"`,
+		`{"traceEvents": {}}`,
+		// Truncated profiles are rejected, since their durations would be
+		// misleading.
+		`{"traceEvents": [{"cat": "build phase marker", "name": "Launch Blaze", "ph": "i", "ts": 0},`,
+	} {
+		_, err := timing_profile.Parse(strings.NewReader(profile))
+		assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error for %q, got %v", profile, err)
+	}
+}
@@ -16,7 +16,10 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/backends/chunkstore"
 	"github.com/buildbuddy-io/buildbuddy/server/backends/invocationdb"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_metadata_schema"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/completion_webhooks"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/event_index"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/redaction_rules"
 	"github.com/buildbuddy-io/buildbuddy/server/capabilities_filter"
 	"github.com/buildbuddy-io/buildbuddy/server/endpoint_urls/build_buddy_url"
 	"github.com/buildbuddy-io/buildbuddy/server/endpoint_urls/cache_api_url"
@@ -25,7 +28,11 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/eventlog"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/invocation_annotations"
+	"github.com/buildbuddy-io/buildbuddy/server/janitor"
+	"github.com/buildbuddy-io/buildbuddy/server/public_instance"
 	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/action_cache_invalidation"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/directory_size"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/scorecard"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
@@ -38,6 +45,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
 	"github.com/buildbuddy-io/buildbuddy/server/util/role"
+	"github.com/buildbuddy-io/buildbuddy/server/util/scopes"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/subdomain"
 	"golang.org/x/time/rate"
@@ -57,6 +65,8 @@ import (
 	grpb "github.com/buildbuddy-io/buildbuddy/proto/group"
 	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
 	irpb "github.com/buildbuddy-io/buildbuddy/proto/iprules"
+	ofpb "github.com/buildbuddy-io/buildbuddy/proto/oidc_federation"
+	oppb "github.com/buildbuddy-io/buildbuddy/proto/oidc_provider"
 	qpb "github.com/buildbuddy-io/buildbuddy/proto/quota"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/repo"
 	rnpb "github.com/buildbuddy-io/buildbuddy/proto/runner"
@@ -151,6 +161,11 @@ func (s *BuildBuddyServer) GetInvocation(ctx context.Context, req *inpb.GetInvoc
 		}
 	}
 
+	inv.Annotation, err = invocation_annotations.ForInvocation(ctx, s.env, inv.GetAcl().GetGroupId(), inv.GetInvocationId())
+	if err != nil {
+		return nil, err
+	}
+
 	return &inpb.GetInvocationResponse{Invocation: []*inpb.Invocation{inv}}, nil
 }
 
@@ -192,9 +207,22 @@ func (s *BuildBuddyServer) UpdateInvocation(ctx context.Context, req *inpb.Updat
 		return nil, err
 	}
 
+	if req.GetAcl() == nil && req.GetDownloadPermission() == inpb.InvocationPermission_UNKNOWN_PERMISSION {
+		return nil, status.InvalidArgumentError("An ACL or download permission is required.")
+	}
 	db := s.env.GetInvocationDB()
-	if err := db.UpdateInvocationACL(ctx, &authenticatedUser, req.GetInvocationId(), req.GetAcl()); err != nil {
-		return nil, err
+	if req.GetAcl() != nil {
+		if err := db.UpdateInvocationACL(ctx, &authenticatedUser, req.GetInvocationId(), req.GetAcl()); err != nil {
+			return nil, err
+		}
+		if err := build_event_handler.FlushInvocationPermsToOLAPDB(ctx, s.env, req.GetInvocationId()); err != nil {
+			log.CtxWarningf(ctx, "Failed to flush permissions of invocation %q to OLAP DB: %s", req.GetInvocationId(), err)
+		}
+	}
+	if req.GetDownloadPermission() != inpb.InvocationPermission_UNKNOWN_PERMISSION {
+		if err := db.UpdateInvocationDownloadPermission(ctx, &authenticatedUser, req.GetInvocationId(), req.GetDownloadPermission()); err != nil {
+			return nil, err
+		}
 	}
 	if al := s.env.GetAuditLogger(); al != nil {
 		al.LogForInvocation(ctx, req.GetInvocationId(), alpb.Action_UPDATE, req)
@@ -209,14 +237,83 @@ func (s *BuildBuddyServer) DeleteInvocation(ctx context.Context, req *inpb.Delet
 	}
 
 	db := s.env.GetInvocationDB()
+	// Look up the group before the invocation is deleted, so that its
+	// indexed logs can be deleted too.
+	groupID := ""
+	if s.env.GetLogIndex() != nil {
+		groupID, err = db.LookupGroupIDFromInvocation(ctx, req.GetInvocationId())
+		if err != nil {
+			return nil, err
+		}
+	}
 	if err := db.DeleteInvocationWithPermsCheck(ctx, &authenticatedUser, req.GetInvocationId()); err != nil {
 		return nil, err
 	}
+	if al := s.env.GetAuditLogger(); al != nil {
+		al.LogForInvocation(ctx, req.GetInvocationId(), alpb.Action_DELETE, req)
+	}
+	if groupID != "" {
+		if err := s.env.GetLogIndex().DeleteInvocationLogs(ctx, groupID, req.GetInvocationId()); err != nil {
+			log.CtxWarningf(ctx, "Error deleting indexed logs of invocation %q: %s", req.GetInvocationId(), err)
+		}
+	}
 
 	return &inpb.DeleteInvocationResponse{}, nil
 }
 
+func (s *BuildBuddyServer) SetInvocationLegalHold(ctx context.Context, req *inpb.SetInvocationLegalHoldRequest) (*inpb.SetInvocationLegalHoldResponse, error) {
+	u, err := s.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	db := s.env.GetInvocationDB()
+	groupID, err := db.LookupGroupIDFromInvocation(ctx, req.GetInvocationId())
+	if err != nil {
+		return nil, err
+	}
+	if err := authutil.AuthorizeOrgAdmin(u, groupID); err != nil {
+		return nil, err
+	}
+	if req.GetLegalHold() {
+		err = db.SetInvocationLegalHold(ctx, &tables.InvocationLegalHold{
+			InvocationID: req.GetInvocationId(),
+			GroupID:      groupID,
+			UserID:       u.GetUserID(),
+			Reason:       req.GetReason(),
+		})
+	} else {
+		err = db.RemoveInvocationLegalHold(ctx, req.GetInvocationId())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if al := s.env.GetAuditLogger(); al != nil {
+		al.LogForInvocation(ctx, req.GetInvocationId(), alpb.Action_UPDATE, req)
+	}
+	return &inpb.SetInvocationLegalHoldResponse{}, nil
+}
+
+func (s *BuildBuddyServer) CreateInvocationAnnotation(ctx context.Context, req *inpb.CreateInvocationAnnotationRequest) (*inpb.CreateInvocationAnnotationResponse, error) {
+	return invocation_annotations.Create(ctx, s.env, req)
+}
+
+func (s *BuildBuddyServer) GetInvocationAnnotations(ctx context.Context, req *inpb.GetInvocationAnnotationsRequest) (*inpb.GetInvocationAnnotationsResponse, error) {
+	return invocation_annotations.Get(ctx, s.env, req)
+}
+
+func (s *BuildBuddyServer) UpdateInvocationAnnotation(ctx context.Context, req *inpb.UpdateInvocationAnnotationRequest) (*inpb.UpdateInvocationAnnotationResponse, error) {
+	return invocation_annotations.Update(ctx, s.env, req)
+}
+
+func (s *BuildBuddyServer) DeleteInvocationAnnotation(ctx context.Context, req *inpb.DeleteInvocationAnnotationRequest) (*inpb.DeleteInvocationAnnotationResponse, error) {
+	return invocation_annotations.Delete(ctx, s.env, req)
+}
+
 func (s *BuildBuddyServer) GetZipManifest(ctx context.Context, req *zipb.GetZipManifestRequest) (*zipb.GetZipManifestResponse, error) {
+	// Zip manifests are read from the cache over ByteStream, like downloads.
+	if err := public_instance.CheckCaptcha(ctx, s.env); err != nil {
+		return nil, err
+	}
 	u, err := url.Parse(req.GetUri())
 	if err != nil {
 		return nil, err
@@ -242,6 +339,9 @@ func (s *BuildBuddyServer) CancelExecutions(ctx context.Context, req *inpb.Cance
 	if err = res.Cancel(ctx, req.GetInvocationId()); err != nil {
 		return nil, err
 	}
+	if al := s.env.GetAuditLogger(); al != nil {
+		al.LogForInvocation(ctx, req.GetInvocationId(), alpb.Action_CANCEL_EXECUTIONS, req)
+	}
 
 	return &inpb.CancelExecutionsResponse{}, nil
 }
@@ -290,6 +390,7 @@ func makeGroups(groupRoles []*tables.GroupRole) ([]*grpb.Group, error) {
 			Url:                               getGroupUrl(&gr.Group),
 			ExternalUserManagement:            g.ExternalUserManagement,
 			AllowedUserApiKeyCapabilities:     allowedUserAPIKeyCapabilities,
+			InvocationRetentionDays:           g.InvocationRetentionDays,
 		})
 	}
 	return groups, nil
@@ -538,6 +639,9 @@ func (s *BuildBuddyServer) CreateGroup(ctx context.Context, req *grpb.CreateGrou
 	if err != nil {
 		return nil, err
 	}
+	if al := s.env.GetAuditLogger(); al != nil {
+		al.LogForGroup(ctx, groupID, alpb.Action_CREATE, req)
+	}
 	return &grpb.CreateGroupResponse{
 		Id:  groupID,
 		Url: getGroupUrl(group),
@@ -581,6 +685,15 @@ func (s *BuildBuddyServer) UpdateGroup(ctx context.Context, req *grpb.UpdateGrou
 	if group.SuggestionPreference == grpb.SuggestionPreference_UNKNOWN_SUGGESTION_PREFERENCE {
 		group.SuggestionPreference = grpb.SuggestionPreference_ENABLED
 	}
+	if req.InvocationRetentionDays != nil && req.GetInvocationRetentionDays() != group.InvocationRetentionDays {
+		if !janitor.GroupRetentionEnabled() {
+			return nil, status.FailedPreconditionError("Per-organization invocation retention is not enabled on this server.")
+		}
+		if req.GetInvocationRetentionDays() < 0 {
+			return nil, status.InvalidArgumentError("Invocation retention must not be negative.")
+		}
+		group.InvocationRetentionDays = req.GetInvocationRetentionDays()
+	}
 	if _, err := userDB.UpdateGroup(ctx, group); err != nil {
 		return nil, err
 	}
@@ -590,6 +703,76 @@ func (s *BuildBuddyServer) UpdateGroup(ctx context.Context, req *grpb.UpdateGrou
 	return &grpb.UpdateGroupResponse{}, nil
 }
 
+func (s *BuildBuddyServer) GetBuildMetadataSchema(ctx context.Context, req *grpb.GetBuildMetadataSchemaRequest) (*grpb.GetBuildMetadataSchemaResponse, error) {
+	if s.env.GetDBHandle() == nil {
+		return nil, status.UnimplementedError("Not Implemented")
+	}
+	return build_metadata_schema.GetSchema(ctx, s.env, req)
+}
+
+func (s *BuildBuddyServer) SetBuildMetadataSchema(ctx context.Context, req *grpb.SetBuildMetadataSchemaRequest) (*grpb.SetBuildMetadataSchemaResponse, error) {
+	if s.env.GetDBHandle() == nil {
+		return nil, status.UnimplementedError("Not Implemented")
+	}
+	rsp, err := build_metadata_schema.SetSchema(ctx, s.env, req)
+	if err != nil {
+		return nil, err
+	}
+	if al := s.env.GetAuditLogger(); al != nil {
+		al.LogForGroup(ctx, req.GetRequestContext().GetGroupId(), alpb.Action_UPDATE, req)
+	}
+	return rsp, nil
+}
+
+func (s *BuildBuddyServer) GetBuildMetadataCompliance(ctx context.Context, req *grpb.GetBuildMetadataComplianceRequest) (*grpb.GetBuildMetadataComplianceResponse, error) {
+	if s.env.GetDBHandle() == nil {
+		return nil, status.UnimplementedError("Not Implemented")
+	}
+	return build_metadata_schema.GetCompliance(ctx, s.env, req)
+}
+
+func (s *BuildBuddyServer) GetRedactionRules(ctx context.Context, req *grpb.GetRedactionRulesRequest) (*grpb.GetRedactionRulesResponse, error) {
+	if s.env.GetDBHandle() == nil {
+		return nil, status.UnimplementedError("Not Implemented")
+	}
+	return redaction_rules.GetRules(ctx, s.env, req)
+}
+
+func (s *BuildBuddyServer) SetRedactionRules(ctx context.Context, req *grpb.SetRedactionRulesRequest) (*grpb.SetRedactionRulesResponse, error) {
+	if s.env.GetDBHandle() == nil {
+		return nil, status.UnimplementedError("Not Implemented")
+	}
+	rsp, err := redaction_rules.SetRules(ctx, s.env, req)
+	if err != nil {
+		return nil, err
+	}
+	if al := s.env.GetAuditLogger(); al != nil {
+		al.LogForGroup(ctx, req.GetRequestContext().GetGroupId(), alpb.Action_UPDATE, req)
+	}
+	return rsp, nil
+}
+
+func (s *BuildBuddyServer) GetCompletionWebhooks(ctx context.Context, req *grpb.GetCompletionWebhooksRequest) (*grpb.GetCompletionWebhooksResponse, error) {
+	if s.env.GetDBHandle() == nil {
+		return nil, status.UnimplementedError("Not Implemented")
+	}
+	return completion_webhooks.GetWebhooks(ctx, s.env, req)
+}
+
+func (s *BuildBuddyServer) SetCompletionWebhooks(ctx context.Context, req *grpb.SetCompletionWebhooksRequest) (*grpb.SetCompletionWebhooksResponse, error) {
+	if s.env.GetDBHandle() == nil {
+		return nil, status.UnimplementedError("Not Implemented")
+	}
+	rsp, err := completion_webhooks.SetWebhooks(ctx, s.env, req)
+	if err != nil {
+		return nil, err
+	}
+	if al := s.env.GetAuditLogger(); al != nil {
+		al.LogForGroup(ctx, req.GetRequestContext().GetGroupId(), alpb.Action_UPDATE, req)
+	}
+	return rsp, nil
+}
+
 func (s *BuildBuddyServer) JoinGroup(ctx context.Context, req *grpb.JoinGroupRequest) (*grpb.JoinGroupResponse, error) {
 	userDB := s.env.GetUserDB()
 	if userDB == nil {
@@ -598,6 +781,9 @@ func (s *BuildBuddyServer) JoinGroup(ctx context.Context, req *grpb.JoinGroupReq
 	if _, err := userDB.RequestToJoinGroup(ctx, req.GetId()); err != nil {
 		return nil, err
 	}
+	if al := s.env.GetAuditLogger(); al != nil {
+		al.LogForGroup(ctx, req.GetId(), alpb.Action_UPDATE_MEMBERSHIP, req)
+	}
 	return &grpb.JoinGroupResponse{}, nil
 }
 
@@ -619,6 +805,7 @@ func (s *BuildBuddyServer) GetApiKeys(ctx context.Context, req *akpb.GetApiKeysR
 			Id:                  k.APIKeyID,
 			Label:               k.Label,
 			Capability:          capabilities.FromInt(k.Capabilities),
+			Scope:               scopes.FromInt(k.Scopes),
 			VisibleToDevelopers: k.VisibleToDevelopers,
 		})
 	}
@@ -648,6 +835,7 @@ func (s *BuildBuddyServer) GetApiKey(ctx context.Context, req *akpb.GetApiKeyReq
 			Value:               key.Value,
 			Label:               key.Label,
 			Capability:          capabilities.FromInt(key.Capabilities),
+			Scope:               scopes.FromInt(key.Scopes),
 			VisibleToDevelopers: key.VisibleToDevelopers,
 		},
 	}
@@ -675,7 +863,7 @@ func (s *BuildBuddyServer) CreateApiKey(ctx context.Context, req *akpb.CreateApi
 	}
 	k, err := authDB.CreateAPIKey(
 		ctx, req.GetRequestContext().GetGroupId(), req.GetLabel(), req.GetCapability(),
-		req.GetVisibleToDevelopers())
+		req.GetScope(), req.GetVisibleToDevelopers())
 	if err != nil {
 		return nil, err
 	}
@@ -693,6 +881,7 @@ func (s *BuildBuddyServer) CreateApiKey(ctx context.Context, req *akpb.CreateApi
 			Value:               k.Value,
 			Label:               k.Label,
 			Capability:          capabilities.FromInt(k.Capabilities),
+			Scope:               scopes.FromInt(k.Scopes),
 			VisibleToDevelopers: k.VisibleToDevelopers,
 		},
 	}, nil
@@ -726,6 +915,7 @@ func (s *BuildBuddyServer) UpdateApiKey(ctx context.Context, req *akpb.UpdateApi
 		APIKeyID:            req.GetId(),
 		Label:               req.GetLabel(),
 		Capabilities:        capabilities.ToInt(req.GetCapability()),
+		Scopes:              updatedScopes(existingKey, req),
 		VisibleToDevelopers: req.GetVisibleToDevelopers(),
 	}
 	if err := authDB.UpdateAPIKey(ctx, tk); err != nil {
@@ -742,6 +932,16 @@ func (s *BuildBuddyServer) UpdateApiKey(ctx context.Context, req *akpb.UpdateApi
 	return &akpb.UpdateApiKeyResponse{}, nil
 }
 
+// updatedScopes returns the scopes that an API key has after the given
+// update. Scopes are only changed if the update sets them, so that e.g.
+// changing the label of a key doesn't lift its restrictions.
+func updatedScopes(existingKey *tables.APIKey, req *akpb.UpdateApiKeyRequest) int32 {
+	if req.Scopes == nil {
+		return existingKey.Scopes
+	}
+	return scopes.ToInt(req.GetScopes().GetScope())
+}
+
 func (s *BuildBuddyServer) DeleteApiKey(ctx context.Context, req *akpb.DeleteApiKeyRequest) (*akpb.DeleteApiKeyResponse, error) {
 	authDB := s.env.GetAuthDB()
 	if authDB == nil {
@@ -783,6 +983,7 @@ func (s *BuildBuddyServer) CreateImpersonationApiKey(ctx context.Context, req *a
 			Value:               k.Value,
 			Label:               k.Label,
 			Capability:          capabilities.FromInt(k.Capabilities),
+			Scope:               scopes.FromInt(k.Scopes),
 			VisibleToDevelopers: k.VisibleToDevelopers,
 			ExpiryUsec:          k.ExpiryUsec,
 		},
@@ -819,6 +1020,7 @@ func (s *BuildBuddyServer) GetUserApiKeys(ctx context.Context, req *akpb.GetApiK
 			Id:                  k.APIKeyID,
 			Label:               k.Label,
 			Capability:          capabilities.FromInt(k.Capabilities),
+			Scope:               scopes.FromInt(k.Scopes),
 			VisibleToDevelopers: k.VisibleToDevelopers,
 		})
 	}
@@ -848,6 +1050,7 @@ func (s *BuildBuddyServer) GetUserApiKey(ctx context.Context, req *akpb.GetApiKe
 			Value:               key.Value,
 			Label:               key.Label,
 			Capability:          capabilities.FromInt(key.Capabilities),
+			Scope:               scopes.FromInt(key.Scopes),
 			VisibleToDevelopers: key.VisibleToDevelopers,
 		},
 	}
@@ -884,7 +1087,7 @@ func (s *BuildBuddyServer) CreateUserApiKey(ctx context.Context, req *akpb.Creat
 	if userID == "" {
 		userID = u.GetUserID()
 	}
-	k, err := authDB.CreateUserAPIKey(ctx, req.GetRequestContext().GetGroupId(), userID, req.GetLabel(), req.GetCapability())
+	k, err := authDB.CreateUserAPIKey(ctx, req.GetRequestContext().GetGroupId(), userID, req.GetLabel(), req.GetCapability(), req.GetScope())
 	if err != nil {
 		return nil, err
 	}
@@ -902,6 +1105,7 @@ func (s *BuildBuddyServer) CreateUserApiKey(ctx context.Context, req *akpb.Creat
 			Value:               k.Value,
 			Label:               k.Label,
 			Capability:          capabilities.FromInt(k.Capabilities),
+			Scope:               scopes.FromInt(k.Scopes),
 			VisibleToDevelopers: k.VisibleToDevelopers,
 		},
 	}, nil
@@ -921,6 +1125,7 @@ func (s *BuildBuddyServer) UpdateUserApiKey(ctx context.Context, req *akpb.Updat
 		APIKeyID:            req.GetId(),
 		Label:               req.GetLabel(),
 		Capabilities:        capabilities.ToInt(req.GetCapability()),
+		Scopes:              updatedScopes(existingKey, req),
 		VisibleToDevelopers: req.GetVisibleToDevelopers(),
 	}
 	if err := authDB.UpdateAPIKey(ctx, updates); err != nil {
@@ -1233,6 +1438,13 @@ func (s *BuildBuddyServer) GetExecutionNodes(ctx context.Context, req *scpb.GetE
 	return nil, status.UnimplementedError("Not implemented")
 }
 
+func (s *BuildBuddyServer) GetPoolDemand(ctx context.Context, req *scpb.GetPoolDemandRequest) (*scpb.GetPoolDemandResponse, error) {
+	if ss := s.env.GetSchedulerService(); ss != nil {
+		return ss.GetPoolDemand(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
 func (s *BuildBuddyServer) SearchExecution(ctx context.Context, req *espb.SearchExecutionRequest) (*espb.SearchExecutionResponse, error) {
 	if req == nil {
 		return nil, status.InvalidArgumentErrorf("SearchExecutionRequest cannot be empty")
@@ -1261,6 +1473,9 @@ func (s *BuildBuddyServer) GetTargetFlakeSamples(ctx context.Context, req *trpb.
 }
 
 func (s *BuildBuddyServer) GetEventLogChunk(ctx context.Context, req *elpb.GetEventLogChunkRequest) (*elpb.GetEventLogChunkResponse, error) {
+	if err := public_instance.CheckCaptcha(ctx, s.env); err != nil {
+		return nil, err
+	}
 	resp, err := eventlog.GetEventLogChunk(ctx, s.env, req)
 	if err != nil {
 		log.Errorf("Encountered error getting event log chunk: %s\nRequest: %s", err, req)
@@ -1270,6 +1485,9 @@ func (s *BuildBuddyServer) GetEventLogChunk(ctx context.Context, req *elpb.GetEv
 
 func (s *BuildBuddyServer) GetEventLog(req *elpb.GetEventLogChunkRequest, stream bbspb.BuildBuddyService_GetEventLogServer) error {
 	ctx := stream.Context()
+	if err := public_instance.CheckCaptcha(ctx, s.env); err != nil {
+		return err
+	}
 	// Fetch the event log once as soon as we get the request, once whenever
 	// we see an update from Redis, and once every 3s (as a fallback).
 	initialFetch := make(chan struct{}, 1)
@@ -1328,13 +1546,43 @@ func (s *BuildBuddyServer) GetEventLog(req *elpb.GetEventLogChunkRequest, stream
 
 func (s *BuildBuddyServer) CreateWorkflow(ctx context.Context, req *wfpb.CreateWorkflowRequest) (*wfpb.CreateWorkflowResponse, error) {
 	if wfs := s.env.GetWorkflowService(); wfs != nil {
-		return wfs.CreateWorkflow(ctx, req)
+		rsp, err := wfs.CreateWorkflow(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		if al := s.env.GetAuditLogger(); al != nil {
+			r := &alpb.ResourceID{Type: alpb.ResourceType_WORKFLOW, Id: rsp.GetId(), Name: req.GetGitRepo().GetRepoUrl()}
+			al.Log(ctx, r, alpb.Action_CREATE, req)
+		}
+		return rsp, nil
 	}
 	return nil, status.UnimplementedError("Not implemented")
 }
 func (s *BuildBuddyServer) DeleteWorkflow(ctx context.Context, req *wfpb.DeleteWorkflowRequest) (*wfpb.DeleteWorkflowResponse, error) {
 	if wfs := s.env.GetWorkflowService(); wfs != nil {
-		return wfs.DeleteWorkflow(ctx, req)
+		rsp, err := wfs.DeleteWorkflow(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		if al := s.env.GetAuditLogger(); al != nil {
+			r := &alpb.ResourceID{Type: alpb.ResourceType_WORKFLOW, Id: req.GetId(), Name: req.GetRepoUrl()}
+			al.Log(ctx, r, alpb.Action_DELETE, req)
+		}
+		return rsp, nil
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+func (s *BuildBuddyServer) RotateWorkflowWebhookSecret(ctx context.Context, req *wfpb.RotateWorkflowWebhookSecretRequest) (*wfpb.RotateWorkflowWebhookSecretResponse, error) {
+	if wfs := s.env.GetWorkflowService(); wfs != nil {
+		rsp, err := wfs.RotateWebhookSecret(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		if al := s.env.GetAuditLogger(); al != nil {
+			r := &alpb.ResourceID{Type: alpb.ResourceType_WORKFLOW, Id: req.GetId()}
+			al.Log(ctx, r, alpb.Action_UPDATE, req)
+		}
+		return rsp, nil
 	}
 	return nil, status.UnimplementedError("Not implemented")
 }
@@ -1365,10 +1613,33 @@ func (s *BuildBuddyServer) ExecuteWorkflow(ctx context.Context, req *wfpb.Execut
 
 			req.WorkflowId = wfs.GetLegacyWorkflowIDForGitRepository(authenticatedUser.GetGroupID(), req.GetTargetRepoUrl())
 		}
-		return wfs.ExecuteWorkflow(ctx, req)
+		rsp, err := wfs.ExecuteWorkflow(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		if al := s.env.GetAuditLogger(); al != nil {
+			r := &alpb.ResourceID{Type: alpb.ResourceType_WORKFLOW, Id: req.GetWorkflowId(), Name: req.GetTargetRepoUrl()}
+			al.Log(ctx, r, alpb.Action_EXECUTE_WORKFLOW, req)
+		}
+		return rsp, nil
 	}
 	return nil, status.UnimplementedError("Not implemented")
 }
+func (s *BuildBuddyServer) DispatchWorkflowAction(ctx context.Context, req *wfpb.DispatchWorkflowActionRequest) (*wfpb.DispatchWorkflowActionResponse, error) {
+	wfs := s.env.GetWorkflowService()
+	if wfs == nil {
+		return nil, status.UnimplementedError("Not implemented")
+	}
+	rsp, err := wfs.DispatchWorkflowAction(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if al := s.env.GetAuditLogger(); al != nil {
+		r := &alpb.ResourceID{Type: alpb.ResourceType_WORKFLOW, Id: req.GetWorkflowId(), Name: req.GetActionName()}
+		al.Log(ctx, r, alpb.Action_DISPATCH_WORKFLOW_ACTION, req)
+	}
+	return rsp, nil
+}
 func (s *BuildBuddyServer) GetRepos(ctx context.Context, req *wfpb.GetReposRequest) (*wfpb.GetReposResponse, error) {
 	if wfs := s.env.GetWorkflowService(); wfs != nil {
 		return wfs.GetRepos(ctx, req)
@@ -1460,7 +1731,14 @@ func (s *BuildBuddyServer) LinkGitHubAppInstallation(ctx context.Context, req *g
 	if a == nil {
 		return nil, status.UnimplementedError("Not implemented")
 	}
-	return a.LinkGitHubAppInstallation(ctx, req)
+	rsp, err := a.LinkGitHubAppInstallation(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if al := s.env.GetAuditLogger(); al != nil {
+		al.LogForGroup(ctx, req.GetRequestContext().GetGroupId(), alpb.Action_LINK_GITHUB_APP_INSTALLATION, req)
+	}
+	return rsp, nil
 }
 func (s *BuildBuddyServer) GetGitHubAppInstallations(ctx context.Context, req *ghpb.GetAppInstallationsRequest) (*ghpb.GetAppInstallationsResponse, error) {
 	a := s.env.GetGitHubApp()
@@ -1474,7 +1752,14 @@ func (s *BuildBuddyServer) UnlinkGitHubAppInstallation(ctx context.Context, req
 	if a == nil {
 		return nil, status.UnimplementedError("Not implemented")
 	}
-	return a.UnlinkGitHubAppInstallation(ctx, req)
+	rsp, err := a.UnlinkGitHubAppInstallation(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if al := s.env.GetAuditLogger(); al != nil {
+		al.LogForGroup(ctx, req.GetRequestContext().GetGroupId(), alpb.Action_UNLINK_GITHUB_APP_INSTALLATION, req)
+	}
+	return rsp, nil
 }
 func (s *BuildBuddyServer) GetAccessibleGitHubRepos(ctx context.Context, req *ghpb.GetAccessibleReposRequest) (*ghpb.GetAccessibleReposResponse, error) {
 	a := s.env.GetGitHubApp()
@@ -1579,6 +1864,48 @@ func (s *BuildBuddyServer) InvalidateAllSnapshotsForRepo(ctx context.Context, re
 	return nil, status.UnimplementedError("Not implemented")
 }
 
+func (s *BuildBuddyServer) SetWorkflowSchedulesEnabled(ctx context.Context, req *wfpb.SetWorkflowSchedulesEnabledRequest) (*wfpb.SetWorkflowSchedulesEnabledResponse, error) {
+	if wfs := s.env.GetWorkflowService(); wfs != nil {
+		if err := wfs.SetSchedulesEnabled(ctx, req.GetRepoUrl(), req.GetEnabled()); err != nil {
+			return nil, err
+		}
+		if al := s.env.GetAuditLogger(); al != nil {
+			r := &alpb.ResourceID{Type: alpb.ResourceType_WORKFLOW, Name: req.GetRepoUrl()}
+			al.Log(ctx, r, alpb.Action_UPDATE, req)
+		}
+		return &wfpb.SetWorkflowSchedulesEnabledResponse{}, nil
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (s *BuildBuddyServer) SetWorkflowForkApprovalRequired(ctx context.Context, req *wfpb.SetWorkflowForkApprovalRequiredRequest) (*wfpb.SetWorkflowForkApprovalRequiredResponse, error) {
+	if wfs := s.env.GetWorkflowService(); wfs != nil {
+		if err := wfs.SetForkApprovalRequired(ctx, req.GetRepoUrl(), req.GetRequired()); err != nil {
+			return nil, err
+		}
+		if al := s.env.GetAuditLogger(); al != nil {
+			r := &alpb.ResourceID{Type: alpb.ResourceType_WORKFLOW, Name: req.GetRepoUrl()}
+			al.Log(ctx, r, alpb.Action_UPDATE, req)
+		}
+		return &wfpb.SetWorkflowForkApprovalRequiredResponse{}, nil
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (s *BuildBuddyServer) GetMergeQueue(ctx context.Context, req *wfpb.GetMergeQueueRequest) (*wfpb.GetMergeQueueResponse, error) {
+	if wfs := s.env.GetWorkflowService(); wfs != nil {
+		return wfs.GetMergeQueue(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (s *BuildBuddyServer) GetWorkflowArtifacts(ctx context.Context, req *wfpb.GetWorkflowArtifactsRequest) (*wfpb.GetWorkflowArtifactsResponse, error) {
+	if wfs := s.env.GetWorkflowService(); wfs != nil {
+		return wfs.GetWorkflowArtifacts(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
 func (s *BuildBuddyServer) Run(ctx context.Context, req *rnpb.RunRequest) (*rnpb.RunResponse, error) {
 	if rs := s.env.GetRunnerService(); rs != nil {
 		return rs.Run(ctx, req)
@@ -1634,10 +1961,64 @@ func (s *BuildBuddyServer) GetCacheMetadata(ctx context.Context, req *capb.GetCa
 	}, nil
 }
 
+func (s *BuildBuddyServer) GetCacheEntryProvenance(ctx context.Context, req *capb.GetCacheEntryProvenanceRequest) (*capb.GetCacheEntryProvenanceResponse, error) {
+	c, ok := s.env.GetCache().(interfaces.ProvenanceTrackingCache)
+	if !ok {
+		return nil, status.UnimplementedError("Cache entry provenance is not supported by the configured cache")
+	}
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, s.env)
+	if err != nil {
+		return nil, err
+	}
+	prov, err := c.Provenance(ctx, req.GetResourceName())
+	if err != nil {
+		return nil, err
+	}
+	return &capb.GetCacheEntryProvenanceResponse{Provenance: prov}, nil
+}
+
+// logForAuthenticatedGroup records an audit log entry for the group that the
+// request was authenticated as, which is the group that it applied to
+// regardless of the group in its request context.
+func (s *BuildBuddyServer) logForAuthenticatedGroup(ctx context.Context, al interfaces.AuditLogger, action alpb.Action, req proto.Message) {
+	u, err := s.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		log.CtxWarningf(ctx, "Could not record %s in the audit log: %s", action, err)
+		return
+	}
+	al.LogForGroup(ctx, u.GetGroupID(), action, req)
+}
+
+func (s *BuildBuddyServer) InvalidateActionCache(ctx context.Context, req *capb.InvalidateActionCacheRequest) (*capb.InvalidateActionCacheResponse, error) {
+	rsp, err := action_cache_invalidation.Invalidate(ctx, s.env, req)
+	if err != nil {
+		return nil, err
+	}
+	if al := s.env.GetAuditLogger(); al != nil {
+		s.logForAuthenticatedGroup(ctx, al, alpb.Action_INVALIDATE_ACTION_CACHE, req)
+	}
+	return rsp, nil
+}
+
+func (s *BuildBuddyServer) DeleteActionCacheInvalidation(ctx context.Context, req *capb.DeleteActionCacheInvalidationRequest) (*capb.DeleteActionCacheInvalidationResponse, error) {
+	rsp, err := action_cache_invalidation.Delete(ctx, s.env, req)
+	if err != nil {
+		return nil, err
+	}
+	if al := s.env.GetAuditLogger(); al != nil {
+		s.logForAuthenticatedGroup(ctx, al, alpb.Action_DELETE_ACTION_CACHE_INVALIDATION, req)
+	}
+	return rsp, nil
+}
+
 func (s *BuildBuddyServer) GetCacheScoreCard(ctx context.Context, req *capb.GetCacheScoreCardRequest) (*capb.GetCacheScoreCardResponse, error) {
 	return scorecard.GetCacheScoreCard(ctx, s.env, req)
 }
 
+func (s *BuildBuddyServer) GetCacheHitRates(ctx context.Context, req *capb.GetCacheHitRatesRequest) (*capb.GetCacheHitRatesResponse, error) {
+	return scorecard.GetCacheHitRates(ctx, s.env, req)
+}
+
 func (s *BuildBuddyServer) GetNamespace(ctx context.Context, req *qpb.GetNamespaceRequest) (*qpb.GetNamespaceResponse, error) {
 	if qm := s.env.GetQuotaManager(); qm != nil {
 		return qm.GetNamespace(ctx, req)
@@ -1698,7 +2079,14 @@ func (s *BuildBuddyServer) UpdateSecret(ctx context.Context, req *skpb.UpdateSec
 }
 func (s *BuildBuddyServer) DeleteSecret(ctx context.Context, req *skpb.DeleteSecretRequest) (*skpb.DeleteSecretResponse, error) {
 	if secretService := s.env.GetSecretService(); secretService != nil {
-		return secretService.DeleteSecret(ctx, req)
+		rsp, err := secretService.DeleteSecret(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		if al := s.env.GetAuditLogger(); al != nil {
+			al.LogForSecret(ctx, req.GetSecret().GetName(), alpb.Action_DELETE, req)
+		}
+		return rsp, nil
 	}
 	return nil, status.UnimplementedError("Not implemented")
 }
@@ -1738,17 +2126,15 @@ func parseByteStreamURL(bsURL, filename string) (*bsLookup, error) {
 	return nil, fmt.Errorf("unparsable bytestream URL: '%s'", bsURL)
 }
 
-func (s *BuildBuddyServer) getAnyAPIKeyForInvocation(ctx context.Context, invocationID string) (*tables.APIKey, error) {
-	// LookupInvocation implicitly checks the logged-in user's access to invocationID.
-	in, err := s.env.GetInvocationDB().LookupInvocation(ctx, invocationID)
-	if err != nil {
-		return nil, err
-	}
+// getAnyAPIKeyForInvocation returns an API key for the group that owns the
+// invocation. The caller must have already checked the logged-in user's
+// access to the invocation.
+func (s *BuildBuddyServer) getAnyAPIKeyForInvocation(ctx context.Context, in *tables.Invocation) (*tables.APIKey, error) {
 	authDB := s.env.GetAuthDB()
 	if authDB == nil {
 		return nil, status.UnimplementedError("Not Implemented")
 	}
-	// We can use any API key because LookupInvocation above already confirmed authorization.
+	// We can use any API key because the caller already confirmed authorization.
 	groupKey, err := authDB.GetAPIKeyForInternalUseOnly(ctx, in.GroupID)
 	if err != nil && !status.IsNotFoundError(err) {
 		return nil, err
@@ -1780,11 +2166,19 @@ func (s *BuildBuddyServer) getAnyAPIKeyForInvocation(ctx context.Context, invoca
 // them up from our cache servers using the bytestream API or pulling them
 // from blobstore.
 func (s *BuildBuddyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if public_instance.CaptchaEnabled() && !public_instance.PassedCaptcha(r) {
+		if _, err := s.env.GetAuthenticator().AuthenticatedUser(r.Context()); err != nil {
+			public_instance.ServeCaptcha(w, r)
+			return
+		}
+	}
 	params := r.URL.Query()
 	var code int
 	var err error
 	if params.Get("artifact") != "" {
 		code, err = s.serveArtifact(r.Context(), w, params)
+	} else if params.Get("audit_log_export") != "" {
+		code, err = s.serveAuditLogExport(r.Context(), w, params.Get("audit_log_export"))
 	} else if params.Get("bytestream_url") != "" {
 		// bytestream request
 		code, err = s.serveBytestream(r.Context(), w, params)
@@ -1795,20 +2189,45 @@ func (s *BuildBuddyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	} else {
 		code = http.StatusBadRequest
-		err = status.FailedPreconditionError(`One of "artifact" or "bytestream_url" query param is required`)
+		err = status.FailedPreconditionError(`One of "artifact", "audit_log_export" or "bytestream_url" query param is required`)
 	}
 	if err != nil {
 		http.Error(w, err.Error(), code)
 	}
 }
 
+// serveAuditLogExport serves a blob written by ExportAuditLogs.
+func (s *BuildBuddyServer) serveAuditLogExport(ctx context.Context, w http.ResponseWriter, blobName string) (int, error) {
+	al := s.env.GetAuditLogger()
+	if al == nil {
+		return http.StatusNotFound, status.NotFoundError("File not found.")
+	}
+	b, err := al.ReadExport(ctx, blobName)
+	if err != nil {
+		if status.IsPermissionDeniedError(err) || status.IsUnauthenticatedError(err) {
+			return http.StatusForbidden, err
+		} else if status.IsNotFoundError(err) {
+			return http.StatusNotFound, status.NotFoundError("File not found.")
+		}
+		log.CtxWarningf(ctx, "Error reading audit log export %q: %s", blobName, err)
+		return http.StatusInternalServerError, status.InternalError("Internal server error")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", path.Base(blobName)))
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if _, err := w.Write(b); err != nil {
+		log.CtxWarningf(ctx, "Error serving audit log export %q: %s", blobName, err)
+	}
+	return http.StatusOK, nil
+}
+
 // serveArtifact handles requests that specify particular build artifacts
 func (s *BuildBuddyServer) serveArtifact(ctx context.Context, w http.ResponseWriter, params url.Values) (int, error) {
 	iid := params.Get("invocation_id")
 	if iid == "" {
 		return http.StatusBadRequest, status.FailedPreconditionError("Missing invocation_id param")
 	}
-	if _, err := s.env.GetInvocationDB().LookupInvocation(ctx, iid); err != nil {
+	inv, err := s.env.GetInvocationDB().LookupInvocation(ctx, iid)
+	if err != nil {
 		if status.IsPermissionDeniedError(err) {
 			return http.StatusForbidden, status.PermissionDeniedErrorf("User does not have permissions to access invocation %s", iid)
 		} else if status.IsNotFoundError(err) {
@@ -1818,6 +2237,9 @@ func (s *BuildBuddyServer) serveArtifact(ctx context.Context, w http.ResponseWri
 			return http.StatusInternalServerError, status.InternalErrorf("Internal server error")
 		}
 	}
+	if err := perms.AuthorizeInvocationDownload(ctx, s.env, inv.UserID, inv.GroupID, inv.DownloadPerms); err != nil {
+		return http.StatusForbidden, err
+	}
 	switch artifact := params.Get("artifact"); artifact {
 	case "raw_json":
 		if err := s.serveRawEventJSON(ctx, w, iid); err != nil {
@@ -1845,6 +2267,23 @@ func (s *BuildBuddyServer) serveArtifact(ctx context.Context, w http.ResponseWri
 			log.Warningf("Error serving invocation-%s.log: %s", iid, err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 		}
+	case "workflow_artifact":
+		wfs := s.env.GetWorkflowService()
+		if wfs == nil {
+			return http.StatusNotFound, status.NotFoundError("File not found.")
+		}
+		fileName := params.Get("filename")
+		b, err := wfs.ReadWorkflowArtifact(ctx, iid, params.Get("artifact_name"), fileName)
+		if err != nil {
+			if status.IsNotFoundError(err) {
+				return http.StatusNotFound, status.NotFoundError("File not found.")
+			}
+			log.Infof("Failed to serve workflow artifact file %q for invocation %s: %s", fileName, iid, err)
+			return http.StatusInternalServerError, status.InternalErrorf("Internal server error")
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", path.Base(fileName)))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(b)
 	case "": // fallback for cache artifact
 		lookup, err := parseByteStreamURL(params.Get("bytestream_url"), params.Get("filename"))
 		if err != nil {
@@ -1909,6 +2348,26 @@ func (s *BuildBuddyServer) serveRawEventJSON(ctx context.Context, w http.Respons
 	return err
 }
 
+// authorizeDownloadWithoutInvocation checks whether the user can download files
+// without saying which invocation they belong to, which is only allowed if the
+// user's group doesn't restrict downloads from any of its invocations.
+func (s *BuildBuddyServer) authorizeDownloadWithoutInvocation(ctx context.Context) error {
+	u, err := s.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil || u.GetGroupID() == "" {
+		// Anonymous users can only read from the anonymous cache.
+		return nil
+	}
+	restricted, err := s.env.GetInvocationDB().GroupRestrictsDownloads(ctx, u.GetGroupID())
+	if err != nil {
+		log.CtxWarningf(ctx, "Failed to check download restrictions of group %q: %s", u.GetGroupID(), err)
+		return status.PermissionDeniedError("Could not check the download permissions of this file.")
+	}
+	if restricted {
+		return status.PermissionDeniedError("Downloads are restricted by your organization; download the file from an invocation that you have access to.")
+	}
+	return nil
+}
+
 // serveBytestream handles requests that specify bytestream URLs.
 func (s *BuildBuddyServer) serveBytestream(ctx context.Context, w http.ResponseWriter, params url.Values) (int, error) {
 	lookup, err := parseByteStreamURL(params.Get("bytestream_url"), params.Get("filename"))
@@ -1917,10 +2376,27 @@ func (s *BuildBuddyServer) serveBytestream(ctx context.Context, w http.ResponseW
 	}
 
 	if lookup.URL.User == nil {
-		// Note that this implicitly authorizes the logged-in user's access to the invocation.
-		apiKey, _ := s.getAnyAPIKeyForInvocation(ctx, params.Get("invocation_id"))
-		if apiKey != nil {
-			ctx = metadata.AppendToOutgoingContext(ctx, authutil.APIKeyHeader, apiKey.Value)
+		iid := params.Get("invocation_id")
+		var in *tables.Invocation
+		if iid != "" {
+			// LookupInvocation implicitly checks the logged-in user's access to invocationID.
+			in, err = s.env.GetInvocationDB().LookupInvocation(ctx, iid)
+		}
+		if iid == "" || err != nil {
+			// The file is read with the user's own credentials, so it may
+			// belong to one of their group's invocations whose downloads are
+			// restricted.
+			if err := s.authorizeDownloadWithoutInvocation(ctx); err != nil {
+				return http.StatusForbidden, err
+			}
+		} else {
+			if err := perms.AuthorizeInvocationDownload(ctx, s.env, in.UserID, in.GroupID, in.DownloadPerms); err != nil {
+				return http.StatusForbidden, err
+			}
+			apiKey, _ := s.getAnyAPIKeyForInvocation(ctx, in)
+			if apiKey != nil {
+				ctx = metadata.AppendToOutgoingContext(ctx, authutil.APIKeyHeader, apiKey.Value)
+			}
 		}
 	}
 
@@ -1999,6 +2475,14 @@ func (s *BuildBuddyServer) GetAuditLogs(ctx context.Context, request *alpb.GetAu
 	return al.GetLogs(ctx, request)
 }
 
+func (s *BuildBuddyServer) ExportAuditLogs(ctx context.Context, request *alpb.ExportAuditLogsRequest) (*alpb.ExportAuditLogsResponse, error) {
+	al := s.env.GetAuditLogger()
+	if al == nil {
+		return nil, status.UnimplementedError("Audit logger not configured")
+	}
+	return al.ExportLogs(ctx, request)
+}
+
 func (s *BuildBuddyServer) CreateRepo(ctx context.Context, request *repb.CreateRepoRequest) (*repb.CreateRepoResponse, error) {
 	gh := s.env.GetGitHubApp()
 	if gh == nil {
@@ -2206,6 +2690,44 @@ func (s *BuildBuddyServer) SetIPRulesConfig(ctx context.Context, request *irpb.S
 	return rsp, err
 }
 
+func (s *BuildBuddyServer) CreateIPRulesOverride(ctx context.Context, request *irpb.CreateOverrideRequest) (*irpb.CreateOverrideResponse, error) {
+	irs := s.env.GetIPRulesService()
+	if irs == nil {
+		return nil, status.UnimplementedError("IP rules not enabled")
+	}
+	rsp, err := irs.CreateOverride(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	if al := s.env.GetAuditLogger(); al != nil {
+		al.LogForGroup(ctx, request.GetRequestContext().GetGroupId(), alpb.Action_CREATE_IP_RULES_OVERRIDE, request)
+	}
+	return rsp, nil
+}
+
+func (s *BuildBuddyServer) GetIPRulesOverrides(ctx context.Context, request *irpb.GetOverridesRequest) (*irpb.GetOverridesResponse, error) {
+	irs := s.env.GetIPRulesService()
+	if irs == nil {
+		return nil, status.UnimplementedError("IP rules not enabled")
+	}
+	return irs.GetOverrides(ctx, request)
+}
+
+func (s *BuildBuddyServer) DeleteIPRulesOverride(ctx context.Context, request *irpb.DeleteOverrideRequest) (*irpb.DeleteOverrideResponse, error) {
+	irs := s.env.GetIPRulesService()
+	if irs == nil {
+		return nil, status.UnimplementedError("IP rules not enabled")
+	}
+	rsp, err := irs.DeleteOverride(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	if al := s.env.GetAuditLogger(); al != nil {
+		al.LogForGroup(ctx, request.GetRequestContext().GetGroupId(), alpb.Action_DELETE_IP_RULES_OVERRIDE, request)
+	}
+	return rsp, nil
+}
+
 func (s *BuildBuddyServer) GetIPRulesConfig(ctx context.Context, request *irpb.GetRulesConfigRequest) (*irpb.GetRulesConfigResponse, error) {
 	irs := s.env.GetIPRulesService()
 	if irs == nil {
@@ -2294,6 +2816,113 @@ func (s *BuildBuddyServer) DeleteIPRule(ctx context.Context, request *irpb.Delet
 	return rsp, nil
 }
 
+func (s *BuildBuddyServer) GetOIDCTrustPolicies(ctx context.Context, request *ofpb.GetTrustPoliciesRequest) (*ofpb.GetTrustPoliciesResponse, error) {
+	ofs := s.env.GetOIDCFederationService()
+	if ofs == nil {
+		return nil, status.UnimplementedError("OIDC federation not enabled")
+	}
+	return ofs.GetTrustPolicies(ctx, request)
+}
+
+func (s *BuildBuddyServer) CreateOIDCTrustPolicy(ctx context.Context, request *ofpb.CreateTrustPolicyRequest) (*ofpb.CreateTrustPolicyResponse, error) {
+	ofs := s.env.GetOIDCFederationService()
+	if ofs == nil {
+		return nil, status.UnimplementedError("OIDC federation not enabled")
+	}
+	rsp, err := ofs.CreateTrustPolicy(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	if al := s.env.GetAuditLogger(); al != nil {
+		rid := &alpb.ResourceID{
+			Type: alpb.ResourceType_OIDC_TRUST_POLICY,
+			Id:   rsp.GetTrustPolicy().GetTrustPolicyId(),
+			Name: rsp.GetTrustPolicy().GetLabel(),
+		}
+		al.Log(ctx, rid, alpb.Action_CREATE, request)
+	}
+	return rsp, nil
+}
+
+func (s *BuildBuddyServer) DeleteOIDCTrustPolicy(ctx context.Context, request *ofpb.DeleteTrustPolicyRequest) (*ofpb.DeleteTrustPolicyResponse, error) {
+	ofs := s.env.GetOIDCFederationService()
+	if ofs == nil {
+		return nil, status.UnimplementedError("OIDC federation not enabled")
+	}
+	p, err := ofs.GetTrustPolicy(ctx, request.GetRequestContext().GetGroupId(), request.GetTrustPolicyId())
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := ofs.DeleteTrustPolicy(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	if al := s.env.GetAuditLogger(); al != nil {
+		rid := &alpb.ResourceID{
+			Type: alpb.ResourceType_OIDC_TRUST_POLICY,
+			Id:   request.GetTrustPolicyId(),
+			Name: p.Label,
+		}
+		al.Log(ctx, rid, alpb.Action_DELETE, request)
+	}
+	return rsp, nil
+}
+
+func (s *BuildBuddyServer) ExchangeOIDCToken(ctx context.Context, request *ofpb.ExchangeTokenRequest) (*ofpb.ExchangeTokenResponse, error) {
+	ofs := s.env.GetOIDCFederationService()
+	if ofs == nil {
+		return nil, status.UnimplementedError("OIDC federation not enabled")
+	}
+	return ofs.ExchangeToken(ctx, request)
+}
+
+func (s *BuildBuddyServer) GetGroupOIDCProvider(ctx context.Context, request *oppb.GetOIDCProviderRequest) (*oppb.GetOIDCProviderResponse, error) {
+	ops := s.env.GetOIDCProviderService()
+	if ops == nil {
+		return nil, status.UnimplementedError("Group OIDC providers not enabled")
+	}
+	return ops.GetOIDCProvider(ctx, request)
+}
+
+func (s *BuildBuddyServer) SetGroupOIDCProvider(ctx context.Context, request *oppb.SetOIDCProviderRequest) (*oppb.SetOIDCProviderResponse, error) {
+	ops := s.env.GetOIDCProviderService()
+	if ops == nil {
+		return nil, status.UnimplementedError("Group OIDC providers not enabled")
+	}
+	rsp, err := ops.SetOIDCProvider(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	if al := s.env.GetAuditLogger(); al != nil {
+		rid := &alpb.ResourceID{
+			Type: alpb.ResourceType_OIDC_PROVIDER,
+			Id:   request.GetRequestContext().GetGroupId(),
+			Name: request.GetProvider().GetIssuerUrl(),
+		}
+		al.Log(ctx, rid, alpb.Action_UPDATE, request)
+	}
+	return rsp, nil
+}
+
+func (s *BuildBuddyServer) DeleteGroupOIDCProvider(ctx context.Context, request *oppb.DeleteOIDCProviderRequest) (*oppb.DeleteOIDCProviderResponse, error) {
+	ops := s.env.GetOIDCProviderService()
+	if ops == nil {
+		return nil, status.UnimplementedError("Group OIDC providers not enabled")
+	}
+	rsp, err := ops.DeleteOIDCProvider(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	if al := s.env.GetAuditLogger(); al != nil {
+		rid := &alpb.ResourceID{
+			Type: alpb.ResourceType_OIDC_PROVIDER,
+			Id:   request.GetRequestContext().GetGroupId(),
+		}
+		al.Log(ctx, rid, alpb.Action_DELETE, request)
+	}
+	return rsp, nil
+}
+
 func (s *BuildBuddyServer) GetGCPProject(ctx context.Context, request *gcpb.GetGCPProjectRequest) (*gcpb.GetGCPProjectResponse, error) {
 	gcpService := s.env.GetGCPService()
 	if gcpService == nil {
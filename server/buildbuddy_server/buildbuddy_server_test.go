@@ -16,9 +16,11 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/buildbuddy_server"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/http/interceptors"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauditlog"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testcache"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
@@ -27,12 +29,16 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testport"
 	"github.com/buildbuddy-io/buildbuddy/server/util/grpc_client"
 	"github.com/buildbuddy-io/buildbuddy/server/util/grpc_server"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/protobuf/types/known/anypb"
 
+	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
+	alpb "github.com/buildbuddy-io/buildbuddy/proto/auditlog"
 	bepb "github.com/buildbuddy-io/buildbuddy/proto/build_events"
+	capb "github.com/buildbuddy-io/buildbuddy/proto/cache"
 	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
 	pepb "github.com/buildbuddy-io/buildbuddy/proto/publish_build_event"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
@@ -191,6 +197,8 @@ func TestDeleteInvocation(t *testing.T) {
 	te := testenv.GetTestEnv(t)
 	auth := testauth.NewTestAuthenticator(testauth.TestUsers(user1, group1))
 	te.SetAuthenticator(auth)
+	al := testauditlog.New(t)
+	te.SetAuditLogger(al)
 
 	iid, err := createInvocationForTesting(te, user1)
 	require.NoError(t, err)
@@ -216,6 +224,12 @@ func TestDeleteInvocation(t *testing.T) {
 	)
 	require.NoError(t, err)
 
+	entries := al.GetAllEntries()
+	require.Len(t, entries, 1)
+	require.Equal(t, alpb.ResourceType_INVOCATION, entries[0].Resource.GetType())
+	require.Equal(t, iid, entries[0].Resource.GetId())
+	require.Equal(t, alpb.Action_DELETE, entries[0].Action)
+
 	_, err = server.GetInvocation(
 		te.GetAuthenticator().AuthContextFromAPIKey(context.Background(), user1),
 		&inpb.GetInvocationRequest{
@@ -225,11 +239,9 @@ func TestDeleteInvocation(t *testing.T) {
 	require.Error(t, err)
 }
 
-func TestFileDownloadEndpoint(t *testing.T) {
-	ctx := context.Background()
-	te := testenv.GetTestEnv(t)
-	auth := testauth.NewTestAuthenticator(testauth.TestUsers(user1, group1))
-	te.SetAuthenticator(auth)
+// startFileDownloadServer starts the cache API and the /file/download
+// endpoint, and returns the endpoint's base URL and the port of the cache API.
+func startFileDownloadServer(t *testing.T, te *testenv.TestEnv) (*url.URL, int) {
 	err := buildbuddy_server.Register(te)
 	require.NoError(t, err)
 	// Start gRPC server (for cache API)
@@ -248,7 +260,15 @@ func TestFileDownloadEndpoint(t *testing.T) {
 	// Start HTTP server (for /file/download endpoint)
 	mux := http.NewServeMux()
 	mux.Handle("/file/download", interceptors.WrapAuthenticatedExternalHandler(te, te.GetBuildBuddyServer()))
-	baseURL := testhttp.StartServer(t, mux)
+	return testhttp.StartServer(t, mux), grpcPort
+}
+
+func TestFileDownloadEndpoint(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	auth := testauth.NewTestAuthenticator(testauth.TestUsers(user1, group1))
+	te.SetAuthenticator(auth)
+	baseURL, grpcPort := startFileDownloadServer(t, te)
 
 	iid, err := createInvocationForTesting(te, "" /*=user*/)
 	require.NoError(t, err)
@@ -303,3 +323,79 @@ func TestFileDownloadEndpoint(t *testing.T) {
 		require.Equal(t, arb, body)
 	}
 }
+
+func TestFileDownloadEndpoint_RestrictedDownloads(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	auth := testauth.NewTestAuthenticator(testauth.TestUsers(user1, group1))
+	te.SetAuthenticator(auth)
+	baseURL, grpcPort := startFileDownloadServer(t, te)
+
+	iid, err := createInvocationForTesting(te, user1)
+	require.NoError(t, err)
+	rn, b := testdigest.NewRandomResourceAndBuf(t, 100, rspb.CacheType_CAS, "")
+	_, _, err = cachetools.UploadFromReader(ctx, te.GetByteStreamClient(), digest.ResourceNameFromProto(rn), bytes.NewReader(b))
+	require.NoError(t, err)
+	bsURL := fmt.Sprintf("bytestream://localhost:%d/blobs/%s", grpcPort, digest.String(rn.GetDigest()))
+
+	download := func(invocationID string) int {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf(
+			"%s/file/download?invocation_id=%s&bytestream_url=%s",
+			baseURL, invocationID, url.QueryEscape(bsURL)), nil)
+		require.NoError(t, err)
+		req.Header.Set(testauth.APIKeyHeader, user1)
+		rsp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer rsp.Body.Close()
+		return rsp.StatusCode
+	}
+
+	// Files can be downloaded without an invocation if the group doesn't
+	// restrict downloads.
+	require.Equal(t, http.StatusOK, download(""))
+	require.Equal(t, http.StatusOK, download("unknown-invocation"))
+
+	// Once the group restricts downloads from one of its invocations, files
+	// can only be downloaded from invocations that allow it.
+	err = te.GetDBHandle().NewQuery(ctx, "restrict_downloads").Raw(
+		`UPDATE "Invocations" SET download_perms = ? WHERE invocation_id = ?`, perms.OWNER_READ, iid).Exec().Error
+	require.NoError(t, err)
+	require.Equal(t, http.StatusForbidden, download(""))
+	require.Equal(t, http.StatusForbidden, download("unknown-invocation"))
+	require.Equal(t, http.StatusOK, download(iid))
+}
+
+func TestInvalidateActionCacheAuditLog(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	admin := testauth.User(user1, group1)
+	admin.GroupMemberships[0].Capabilities = append(admin.GroupMemberships[0].Capabilities, akpb.ApiKey_ORG_ADMIN_CAPABILITY)
+	auth := testauth.NewTestAuthenticator(map[string]interfaces.UserInfo{user1: admin})
+	te.SetAuthenticator(auth)
+	al := testauditlog.New(t)
+	te.SetAuditLogger(al)
+	server, err := buildbuddy_server.NewBuildBuddyServer(te, nil)
+	require.NoError(t, err)
+	ctx := auth.AuthContextFromAPIKey(context.Background(), user1)
+
+	// The entries are recorded for the group that the invalidation applies
+	// to, even if the request context names another group.
+	rsp, err := server.InvalidateActionCache(ctx, &capb.InvalidateActionCacheRequest{
+		RequestContext:     testauth.RequestContext(user1, group2),
+		InstanceNamePrefix: "ci/",
+	})
+	require.NoError(t, err)
+	_, err = server.DeleteActionCacheInvalidation(ctx, &capb.DeleteActionCacheInvalidationRequest{
+		RequestContext: testauth.RequestContext(user1, group2),
+		InvalidationId: rsp.GetInvalidationId(),
+	})
+	require.NoError(t, err)
+
+	entries := al.GetAllEntries()
+	require.Len(t, entries, 2)
+	require.Equal(t, alpb.Action_INVALIDATE_ACTION_CACHE, entries[0].Action)
+	require.Equal(t, alpb.Action_DELETE_ACTION_CACHE_INVALIDATION, entries[1].Action)
+	for _, e := range entries {
+		require.Equal(t, alpb.ResourceType_GROUP, e.Resource.GetType())
+		require.Equal(t, group1, e.Resource.GetId())
+	}
+}
@@ -173,6 +173,10 @@ func (p *CacheProxy) GetTree(req *repb.GetTreeRequest, stream repb.ContentAddres
 	return nil
 }
 
+func (p *CacheProxy) SpliceBlob(ctx context.Context, req *repb.SpliceBlobRequest) (*repb.SpliceBlobResponse, error) {
+	return p.casClient.SpliceBlob(ctx, req)
+}
+
 func (p *CacheProxy) FindMissingBlobs(ctx context.Context, req *repb.FindMissingBlobsRequest) (*repb.FindMissingBlobsResponse, error) {
 	localMissing, err := p.localCAS.FindMissingBlobs(ctx, req)
 	if err == nil && len(localMissing.GetMissingBlobDigests()) == 0 {
@@ -24,6 +24,9 @@ var (
 		"GetUser",
 		"CreateUser",
 		"GetGroup",
+		// CI jobs exchange their OIDC token to get credentials in the first
+		// place; the token is verified against the trust policies.
+		"ExchangeOIDCToken",
 
 		// Invocations can be shared publicly, so authorization for these RPCs is
 		// done purely using perms bits attached to each row.
@@ -31,6 +34,7 @@ var (
 		"GetEventLogChunk",
 		"GetEventLog",
 		"GetCacheScoreCard",
+		"GetCacheHitRates",
 		"GetCacheMetadata",
 		"GetTreeDirectorySizes",
 		"GetTarget",
@@ -38,6 +42,7 @@ var (
 		"GetExecution",
 		"WaitExecution",
 		"GetZipManifest",
+		"GetWorkflowArtifacts",
 		// Users do not need any particular role within their current group to be
 		// able to create another group or request to join an existing group.
 		"JoinGroup",
@@ -48,11 +53,16 @@ var (
 		// TODO(bduffany): prefix all of these with the service name,
 		// since API methods and BuildBuddyService methods may be the same.
 		"GetInvocation",
+		"CompareInvocations",
+		"GetTimingTrend",
 		"GetLog",
+		"SearchLogs",
 		"DeleteFile",
 		"GetTarget",
+		"GetTargetFlakeStats",
 		"GetAction",
 		"GetFile",
+		"GetArtifactManifest",
 		"DeleteFile",
 		// GitHub passthrough endpoints use User's linked GitHub account
 		"GetGithubUserInstallations",
@@ -94,17 +104,26 @@ var (
 		"GetTargetStats",
 		"GetDailyTargetStats",
 		"GetTargetFlakeSamples",
+		// Build metadata requirements and compliance.
+		"GetBuildMetadataSchema",
+		"GetBuildMetadataCompliance",
 		// Workflow configuration and history (read-only).
 		"GetWorkflows",
 		"GetRepos",
 		"GetWorkflowHistory",
+		"GetMergeQueue",
 		// Github configuration (read-only).
 		"GetLinkedGitHubRepos",
 		// Per-invocation actions
 		"UpdateInvocation",
 		"DeleteInvocation",
 		"CancelExecutions",
+		"CreateInvocationAnnotation",
+		"GetInvocationAnnotations",
+		"UpdateInvocationAnnotation",
+		"DeleteInvocationAnnotation",
 		"ExecuteWorkflow",
+		"DispatchWorkflowAction",
 		"InvalidateSnapshot",
 		// Org API keys (implementation only returns developer-visible keys
 		// for developers; admins can see all keys).
@@ -132,6 +151,13 @@ var (
 	groupAdminOnlyRPCs = []string{
 		// Org details management
 		"UpdateGroup",
+		"SetBuildMetadataSchema",
+		"GetRedactionRules",
+		"SetRedactionRules",
+		"GetCompletionWebhooks",
+		"SetCompletionWebhooks",
+		// Invocation legal holds
+		"SetInvocationLegalHold",
 		// Org members management
 		"GetGroupUsers",
 		"UpdateGroupUsers",
@@ -157,9 +183,13 @@ var (
 		// Workflow management
 		"CreateWorkflow",
 		"DeleteWorkflow",
+		"RotateWorkflowWebhookSecret",
 		"InvalidateAllSnapshotsForRepo",
+		"SetWorkflowSchedulesEnabled",
+		"SetWorkflowForkApprovalRequired",
 		// RBE deployment view
 		"GetExecutionNodes",
+		"GetPoolDemand",
 		// BuildBuddy usage data
 		"GetUsage",
 		// Encryption.
@@ -167,6 +197,7 @@ var (
 		"SetEncryptionConfig",
 		// Audit logs.
 		"GetAuditLogs",
+		"ExportAuditLogs",
 		// Repo management
 		"CreateRepo",
 		// IP Rules.
@@ -176,8 +207,23 @@ var (
 		"DeleteIPRule",
 		"GetIPRulesConfig",
 		"SetIPRulesConfig",
+		"CreateIPRulesOverride",
+		"GetIPRulesOverrides",
+		"DeleteIPRulesOverride",
+		// OIDC federation.
+		"GetOIDCTrustPolicies",
+		"CreateOIDCTrustPolicy",
+		"DeleteOIDCTrustPolicy",
+		// Group OIDC providers.
+		"GetGroupOIDCProvider",
+		"SetGroupOIDCProvider",
+		"DeleteGroupOIDCProvider",
 		// GCP
 		"GetGCPProject",
+		// Cache entry provenance and invalidation
+		"GetCacheEntryProvenance",
+		"InvalidateActionCache",
+		"DeleteActionCacheInvalidation",
 	}
 
 	// ServerAdminOnlyRPCs can only be called by server admins. It is different
@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
@@ -32,6 +33,9 @@ var (
 
 	// This may be optionally set by a configured provider.
 	SecretProvider interfaces.ConfigSecretProvider
+
+	reloadMu    sync.Mutex // PROTECTS(reloadFuncs)
+	reloadFuncs []func() error
 )
 
 func Path() string {
@@ -109,10 +113,39 @@ func Load() error {
 }
 
 // Reload resets the flags to their default values, re-parses the flags and
-// loads the config file specified by config.Path().
+// loads the config file specified by config.Path(). Functions registered with
+// RegisterReloadFunc are called once the new config is loaded.
 func Reload() error {
-	flagutil.ResetFlags()
-	return Load()
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	if err := flagutil.ResetFlags(); err != nil {
+		log.Warningf("Failed to reset flags: %s", err)
+	}
+	// Flags set on the command line take precedence over the config file, so
+	// they must be re-applied before loading it.
+	if err := common.DefaultFlagSet.Parse(os.Args[1:]); err != nil {
+		return err
+	}
+	if err := Load(); err != nil {
+		return err
+	}
+	var lastErr error
+	for _, f := range reloadFuncs {
+		if err := f(); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// RegisterReloadFunc registers a function to be called after the config has
+// been reloaded, which applies the new flag values to state that is only
+// initialized from them at startup. If any of these functions return an
+// error, Reload returns the last one, after calling all of them.
+func RegisterReloadFunc(f func() error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	reloadFuncs = append(reloadFuncs, f)
 }
 
 // ReloadOnSIGHUP registers a signal handler (as a goroutine) for syscall.SIGHUP
@@ -3,6 +3,7 @@ package config_test
 import (
 	"context"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -263,3 +264,45 @@ must_be_a_number: "not a string, like this"
 		require.Contains(t, err.Error(), "into int")
 	}
 }
+
+func TestReload(t *testing.T) {
+	flags := replaceFlagsForTesting(t)
+	fromFile := flags.String("from_file", "", "")
+	fromCommandLine := flags.String("from_command_line", "", "")
+	defaulted := flags.String("defaulted", "default", "")
+
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	oldConfigFile := config.Path()
+	err := flag.CommandLine.Set("config_file", configFile)
+	require.NoError(t, err)
+	oldArgs := os.Args
+	os.Args = []string{"test", "--from_command_line=cli"}
+	t.Cleanup(func() {
+		os.Args = oldArgs
+		flag.CommandLine.Set("config_file", oldConfigFile)
+	})
+	err = flags.Parse(os.Args[1:])
+	require.NoError(t, err)
+	err = os.WriteFile(configFile, []byte("from_file: v1\nfrom_command_line: file\ndefaulted: v1\n"), 0644)
+	require.NoError(t, err)
+	err = config.LoadFromFile(configFile)
+	require.NoError(t, err)
+	require.Equal(t, "v1", *fromFile)
+	require.Equal(t, "cli", *fromCommandLine)
+	require.Equal(t, "v1", *defaulted)
+
+	var reloadedValues []string
+	config.RegisterReloadFunc(func() error {
+		reloadedValues = append(reloadedValues, *fromFile)
+		return nil
+	})
+	err = os.WriteFile(configFile, []byte("from_file: v2\nfrom_command_line: file\n"), 0644)
+	require.NoError(t, err)
+	err = config.Reload()
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"v2"}, reloadedValues)
+	require.Equal(t, "v2", *fromFile)
+	require.Equal(t, "cli", *fromCommandLine)
+	require.Equal(t, "default", *defaulted)
+}
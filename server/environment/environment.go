@@ -119,6 +119,8 @@ type Env interface {
 	GetPromQuerier() interfaces.PromQuerier
 	GetAuditLogger() interfaces.AuditLogger
 	GetIPRulesService() interfaces.IPRulesService
+	GetOIDCFederationService() interfaces.OIDCFederationService
+	GetOIDCProviderService() interfaces.OIDCProviderService
 	GetClientIdentityService() interfaces.ClientIdentityService
 	GetImageCacheAuthenticator() interfaces.ImageCacheAuthenticator
 	GetServerNotificationService() interfaces.ServerNotificationService
@@ -133,4 +135,5 @@ type Env interface {
 	GetPubSub() interfaces.PubSub
 	GetClock() clockwork.Clock
 	GetAtimeUpdater() interfaces.AtimeUpdater
+	GetLogIndex() interfaces.LogIndex
 }
@@ -14,6 +14,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/util/keyval"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/terminal"
@@ -58,6 +59,9 @@ func GetEventLogChunk(ctx context.Context, env environment.Env, req *elpb.GetEve
 	if err != nil {
 		return nil, err
 	}
+	if err := perms.AuthorizeInvocationDownload(ctx, env, inv.UserID, inv.GroupID, inv.DownloadPerms); err != nil {
+		return nil, err
+	}
 
 	if inv.LastChunkId == "" {
 		return &elpb.GetEventLogChunkResponse{}, nil
@@ -29,6 +29,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
 	"github.com/buildbuddy-io/buildbuddy/server/util/region"
+	"github.com/buildbuddy-io/buildbuddy/server/util/scopes"
 	"github.com/buildbuddy-io/buildbuddy/server/util/subdomain"
 	"github.com/buildbuddy-io/buildbuddy/server/util/uuid"
 	"github.com/prometheus/client_golang/prometheus"
@@ -221,6 +222,18 @@ func AuthorizeSelectedGroupRole(env environment.Env, next http.Handler) http.Han
 	})
 }
 
+// AuthorizeScopes rejects requests made with scoped API keys to endpoints
+// outside of the key's scopes.
+func AuthorizeScopes(env environment.Env, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := scopes.AuthorizeHTTPRequest(r.Context(), env, r.URL.Path); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func AuthorizeIP(env environment.Env, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if irs := env.GetIPRulesService(); irs != nil {
@@ -423,6 +436,7 @@ func WrapAuthenticatedExternalProtoletHandler(env environment.Env, httpPrefix st
 	return wrapHandler(env, handlers.RequestHandler, &[]wrapFn{
 		Gzip,
 		func(h http.Handler) http.Handler { return AuthorizeSelectedGroupRole(env, h) },
+		func(h http.Handler) http.Handler { return AuthorizeScopes(env, h) },
 		func(h http.Handler) http.Handler { return AuthorizeIP(env, h) },
 		func(h http.Handler) http.Handler { return Authenticate(env, h) },
 		// The request message is parsed before authentication since the request_context
@@ -459,6 +473,7 @@ func WrapAuthenticatedExternalHandler(env environment.Env, next http.Handler) ht
 	return wrapHandler(env, next, &[]wrapFn{
 		Zstd,
 		Gzip,
+		func(h http.Handler) http.Handler { return AuthorizeScopes(env, h) },
 		func(h http.Handler) http.Handler { return AuthorizeIP(env, h) },
 		func(h http.Handler) http.Handler { return Authenticate(env, h) },
 		RequestContextFromURL,
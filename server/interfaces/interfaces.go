@@ -3,6 +3,7 @@ package interfaces
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
 	"io"
 	"net/http"
@@ -24,7 +25,9 @@ import (
 	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
 	alpb "github.com/buildbuddy-io/buildbuddy/proto/auditlog"
 	authpb "github.com/buildbuddy-io/buildbuddy/proto/auth"
+	bespb "github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
 	bbspb "github.com/buildbuddy-io/buildbuddy/proto/buildbuddy_service"
+	capb "github.com/buildbuddy-io/buildbuddy/proto/cache"
 	enpb "github.com/buildbuddy-io/buildbuddy/proto/encryption"
 	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
 	fcpb "github.com/buildbuddy-io/buildbuddy/proto/firecracker"
@@ -34,6 +37,8 @@ import (
 	csinpb "github.com/buildbuddy-io/buildbuddy/proto/index"
 	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
 	irpb "github.com/buildbuddy-io/buildbuddy/proto/iprules"
+	ofpb "github.com/buildbuddy-io/buildbuddy/proto/oidc_federation"
+	oppb "github.com/buildbuddy-io/buildbuddy/proto/oidc_provider"
 	pepb "github.com/buildbuddy-io/buildbuddy/proto/publish_build_event"
 	qpb "github.com/buildbuddy-io/buildbuddy/proto/quota"
 	rfpb "github.com/buildbuddy-io/buildbuddy/proto/raft"
@@ -53,6 +58,7 @@ import (
 	wspb "github.com/buildbuddy-io/buildbuddy/proto/workspace"
 	zipb "github.com/buildbuddy-io/buildbuddy/proto/zip"
 	dto "github.com/prometheus/client_model/go"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
 	hlpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
@@ -111,6 +117,9 @@ type UserInfo interface {
 	// GetCapabilities returns the user's capabilities.
 	GetCapabilities() []akpb.ApiKey_Capability
 	HasCapability(akpb.ApiKey_Capability) bool
+	// GetScopes returns the scopes of the API key used to authenticate the
+	// request. Empty if the request isn't restricted to any scopes.
+	GetScopes() []akpb.ApiKey_Scope
 	GetUseGroupOwnedExecutors() bool
 	GetCacheEncryptionEnabled() bool
 	GetEnforceIPRules() bool
@@ -217,6 +226,19 @@ type SSLService interface {
 	GetGRPCSTLSCreds() (credentials.TransportCredentials, error)
 	GenerateCerts(apiKeyID string) (string, string, error)
 	ValidateCert(certString string) (string, string, error)
+	// IsIssuedByAuthority returns whether one of the verified chains of a
+	// client certificate is rooted at the built-in CA.
+	IsIssuedByAuthority(verifiedChains [][]*x509.Certificate) bool
+
+	// IsSVIDIssuanceEnabled returns whether SignSVID can be used.
+	IsSVIDIssuanceEnabled() bool
+	// SPIFFETrustDomain returns the trust domain of the SVIDs signed by
+	// SignSVID.
+	SPIFFETrustDomain() string
+	// SignSVID signs an X.509 SVID for the given SPIFFE ID, using the public
+	// key in the PEM encoded certificate signing request, and returns the
+	// PEM encoded certificate.
+	SignSVID(csrPEM, spiffeID string) (string, error)
 }
 
 type BuildEventChannel interface {
@@ -226,6 +248,15 @@ type BuildEventChannel interface {
 	GetNumDroppedEvents() uint64
 	GetInitialSequenceNumber() int64
 	Close()
+
+	// Resumable returns whether the channel can be suspended if its stream
+	// is interrupted. Events on resumable channels may be acked as soon as
+	// they are handled.
+	Resumable() bool
+	// Suspend keeps the channel open after its stream is interrupted, so that
+	// a reconnecting stream can resume it. If it returns true, the caller
+	// must not use or close the channel afterwards.
+	Suspend() bool
 }
 
 type BuildEventHandler interface {
@@ -292,6 +323,48 @@ type StoppableCache interface {
 	Stop() error
 }
 
+// A ScannableCache is a Cache that can enumerate the resources it stores.
+type ScannableCache interface {
+	Cache
+
+	// ScanResources calls fn once for each resource stored in the cache. The
+	// context passed to fn is authenticated as the group that owns the
+	// resource, so it can be used to read the resource back. Scanning stops
+	// at the first error returned by fn.
+	ScanResources(ctx context.Context, fn func(ctx context.Context, r *rspb.ResourceName) error) error
+}
+
+// CacheWriteLoad describes how far behind a cache's storage is on absorbing
+// writes.
+type CacheWriteLoad struct {
+	// CompactionDebtBytes is an estimate of the number of bytes that need to
+	// be compacted before the storage stops falling behind.
+	CompactionDebtBytes uint64
+
+	// DiskWriteBytesPerSecond is the recent rate at which the cache has been
+	// writing to disk, including writes caused by compactions.
+	DiskWriteBytesPerSecond float64
+}
+
+// A WriteLoadReportingCache is a Cache that can report the load on its
+// storage, so that servers can hold off on writes before the cache falls far
+// enough behind to slow down every request.
+type WriteLoadReportingCache interface {
+	Cache
+
+	WriteLoad() CacheWriteLoad
+}
+
+// A ProvenanceTrackingCache is a Cache that records who first wrote each AC
+// entry.
+type ProvenanceTrackingCache interface {
+	Cache
+
+	// Provenance returns the provenance recorded for the given AC entry, or
+	// a NotFound error if none was recorded.
+	Provenance(ctx context.Context, r *rspb.ResourceName) (*capb.CacheEntryProvenance, error)
+}
+
 type PooledByteStreamClient interface {
 	StreamBytestreamFile(ctx context.Context, url *url.URL, writer io.Writer) error
 	FetchBytestreamZipManifest(ctx context.Context, url *url.URL) (*zipb.Manifest, error)
@@ -410,10 +483,17 @@ type InvocationDB interface {
 	CreateInvocation(ctx context.Context, in *tables.Invocation) (bool, error)
 	UpdateInvocation(ctx context.Context, in *tables.Invocation) (bool, error)
 	UpdateInvocationACL(ctx context.Context, authenticatedUser *UserInfo, invocationID string, acl *aclpb.ACL) error
+	UpdateInvocationDownloadPermission(ctx context.Context, authenticatedUser *UserInfo, invocationID string, permission inpb.InvocationPermission) error
+	GroupRestrictsDownloads(ctx context.Context, groupID string) (bool, error)
 	LookupInvocation(ctx context.Context, invocationID string) (*tables.Invocation, error)
 	LookupGroupFromInvocation(ctx context.Context, invocationID string) (*tables.Group, error)
 	LookupGroupIDFromInvocation(ctx context.Context, invocationID string) (string, error)
-	LookupExpiredInvocations(ctx context.Context, cutoffTime time.Time, limit int) ([]*tables.Invocation, error)
+	LookupExpiredInvocations(ctx context.Context, cutoffTime, anonymousCutoffTime time.Time, groupRetention bool, limit int) ([]*tables.Invocation, error)
+	SetInvocationLegalHold(ctx context.Context, hold *tables.InvocationLegalHold) error
+	RemoveInvocationLegalHold(ctx context.Context, invocationID string) error
+	HasInvocationLegalHold(ctx context.Context, invocationID string) (bool, error)
+	RefreshInvocations(ctx context.Context, invocationIDs []string) error
+	DisconnectAbandonedInvocations(ctx context.Context, cutoffTime time.Time) (int64, error)
 	LookupChildInvocations(ctx context.Context, parentRunID string) ([]*tables.Invocation, error)
 	DeleteInvocation(ctx context.Context, invocationID string) error
 	DeleteInvocationWithPermsCheck(ctx context.Context, authenticatedUser *UserInfo, invocationID string) error
@@ -423,6 +503,7 @@ type InvocationDB interface {
 
 type APIKeyGroup interface {
 	GetCapabilities() int32
+	GetScopes() int32
 	GetAPIKeyID() string
 	GetUserID() string
 	GetGroupID() string
@@ -461,7 +542,7 @@ type AuthDB interface {
 	GetAPIKeys(ctx context.Context, groupID string) ([]*tables.APIKey, error)
 
 	// CreateAPIKey creates a group-level API key.
-	CreateAPIKey(ctx context.Context, groupID string, label string, capabilities []akpb.ApiKey_Capability, visibleToDevelopers bool) (*tables.APIKey, error)
+	CreateAPIKey(ctx context.Context, groupID string, label string, capabilities []akpb.ApiKey_Capability, scopes []akpb.ApiKey_Scope, visibleToDevelopers bool) (*tables.APIKey, error)
 
 	// CreateAPIKeyWithoutAuthCheck creates a group-level API key without
 	// checking that the user has admin rights on the group. This should only
@@ -472,6 +553,16 @@ type AuthDB interface {
 	// group ID.
 	CreateImpersonationAPIKey(ctx context.Context, groupID string) (*tables.APIKey, error)
 
+	// CreateShortLivedAPIKeyWithoutAuthCheck creates a group-level API key
+	// that expires after the given duration, without checking that the user
+	// has admin rights on the group. This should only be used when the caller
+	// has been authorized by other means, e.g. by a trusted OIDC token.
+	CreateShortLivedAPIKeyWithoutAuthCheck(ctx context.Context, groupID string, label string, capabilities []akpb.ApiKey_Capability, scopes []akpb.ApiKey_Scope, ttl time.Duration) (*tables.APIKey, error)
+
+	// DeleteExpiredAPIKeys deletes the short-lived API keys that have
+	// expired.
+	DeleteExpiredAPIKeys(ctx context.Context) error
+
 	// GetUserOwnedKeysEnabled returns whether user-owned keys are enabled.
 	GetUserOwnedKeysEnabled() bool
 
@@ -482,7 +573,7 @@ type AuthDB interface {
 	// user must be a member of the group. If the request is not authenticated
 	// as the given user, then the authenticated user or API key must have
 	// ORG_ADMIN capability.
-	CreateUserAPIKey(ctx context.Context, groupID, userID, label string, capabilities []akpb.ApiKey_Capability) (*tables.APIKey, error)
+	CreateUserAPIKey(ctx context.Context, groupID, userID, label string, capabilities []akpb.ApiKey_Capability, scopes []akpb.ApiKey_Scope) (*tables.APIKey, error)
 
 	// GetAPIKey returns an API key by ID. The key may be user-owned or
 	// group-owned.
@@ -561,6 +652,14 @@ type Webhook interface {
 	NotifyComplete(ctx context.Context, invocation *inpb.Invocation) error
 }
 
+// A webhook that is also called when an invocation is finalized after its
+// build event stream disconnected. Other webhooks are only called for
+// invocations that completed.
+type DisconnectedInvocationWebhook interface {
+	Webhook
+	NotifiesDisconnected() bool
+}
+
 // Allows aggregating invocation statistics.
 type InvocationStatService interface {
 	GetInvocationStat(ctx context.Context, req *inpb.GetInvocationStatRequest) (*inpb.GetInvocationStatResponse, error)
@@ -590,6 +689,8 @@ type UsageTracker interface {
 type ApiService interface {
 	apipb.ApiServiceServer
 	GetFileHandler() http.Handler
+	DownloadArtifactsHandler() http.Handler
+	StreamInvocationHandler() http.Handler
 	GetMetricsHandler() http.Handler
 	CacheEnabled() bool
 }
@@ -597,9 +698,12 @@ type ApiService interface {
 type WorkflowService interface {
 	CreateWorkflow(ctx context.Context, req *wfpb.CreateWorkflowRequest) (*wfpb.CreateWorkflowResponse, error)
 	DeleteWorkflow(ctx context.Context, req *wfpb.DeleteWorkflowRequest) (*wfpb.DeleteWorkflowResponse, error)
+	// RotateWebhookSecret sets a new webhook secret for an existing workflow.
+	RotateWebhookSecret(ctx context.Context, req *wfpb.RotateWorkflowWebhookSecretRequest) (*wfpb.RotateWorkflowWebhookSecretResponse, error)
 	GetWorkflows(ctx context.Context) (*wfpb.GetWorkflowsResponse, error)
 	GetWorkflowHistory(ctx context.Context) (*wfpb.GetWorkflowHistoryResponse, error)
 	ExecuteWorkflow(ctx context.Context, req *wfpb.ExecuteWorkflowRequest) (*wfpb.ExecuteWorkflowResponse, error)
+	DispatchWorkflowAction(ctx context.Context, req *wfpb.DispatchWorkflowActionRequest) (*wfpb.DispatchWorkflowActionResponse, error)
 	GetRepos(ctx context.Context, req *wfpb.GetReposRequest) (*wfpb.GetReposResponse, error)
 	ServeHTTP(w http.ResponseWriter, r *http.Request)
 
@@ -622,6 +726,29 @@ type WorkflowService interface {
 	// InvalidateAllSnapshotsForRepo invalidates all snapshots for a repo. Any future workflow
 	// runs will be executed on a clean runner.
 	InvalidateAllSnapshotsForRepo(ctx context.Context, repoURL string) error
+
+	// SetSchedulesEnabled enables or disables the scheduled workflow actions
+	// of a repo.
+	SetSchedulesEnabled(ctx context.Context, repoURL string, enabled bool) error
+
+	// SetForkApprovalRequired sets whether pull requests from untrusted forks
+	// of a repo require approval before any workflow actions run.
+	SetForkApprovalRequired(ctx context.Context, repoURL string, required bool) error
+
+	// GetMergeQueue returns the pull requests in the merge queue of a repo.
+	GetMergeQueue(ctx context.Context, req *wfpb.GetMergeQueueRequest) (*wfpb.GetMergeQueueResponse, error)
+
+	// PersistArtifacts copies the files of the artifacts published by the
+	// workflow action of the given invocation from the cache to the
+	// blobstore, where they're kept until they expire.
+	PersistArtifacts(ctx context.Context, invocationID string, artifacts []*bespb.WorkflowArtifactPublished) error
+
+	// GetWorkflowArtifacts returns the persisted artifacts of an invocation.
+	GetWorkflowArtifacts(ctx context.Context, req *wfpb.GetWorkflowArtifactsRequest) (*wfpb.GetWorkflowArtifactsResponse, error)
+
+	// ReadWorkflowArtifact returns the contents of a file of a persisted
+	// artifact of an invocation.
+	ReadWorkflowArtifact(ctx context.Context, invocationID, artifactName, fileName string) ([]byte, error)
 }
 
 type WorkspaceService interface {
@@ -719,9 +846,15 @@ type GitProvider interface {
 	// true.
 	ParseWebhookData(req *http.Request) (*WebhookData, error)
 
+	// VerifyWebhookSignature verifies that the given webhook request was sent
+	// with the secret that was configured when registering the webhook. The
+	// request body can still be parsed afterwards.
+	VerifyWebhookSignature(req *http.Request, secret string) error
+
 	// RegisterWebhook registers the given webhook URL to listen for push and
-	// pull request (also called "merge request") events.
-	RegisterWebhook(ctx context.Context, accessToken, repoURL, webhookURL string) (string, error)
+	// pull request (also called "merge request") events. If secret is set, the
+	// provider is configured to authenticate deliveries with it.
+	RegisterWebhook(ctx context.Context, accessToken, repoURL, webhookURL, secret string) (string, error)
 
 	// UnregisterWebhook unregisters the webhook with the given ID from the repo.
 	UnregisterWebhook(ctx context.Context, accessToken, repoURL, webhookID string) error
@@ -740,6 +873,19 @@ type GitProvider interface {
 	// commit SHA.
 	CreateStatus(ctx context.Context, accessToken, repoURL, commitSHA string, payload any) error
 
+	// MergePullRequest merges the pull request with the given number using the
+	// given merge method ("merge", "squash" or "rebase"). It should fail if
+	// the head of the pull request is no longer at the given commit SHA.
+	MergePullRequest(ctx context.Context, accessToken, repoURL string, number int64, commitSHA, mergeMethod string) error
+
+	// GetPullRequest returns the webhook data of a pull_request event for the
+	// current head of the pull request with the given number.
+	GetPullRequest(ctx context.Context, accessToken, repoURL string, number int64) (*WebhookData, error)
+
+	// CreatePullRequestComment adds a comment with the given markdown body to
+	// the pull request with the given number.
+	CreatePullRequestComment(ctx context.Context, accessToken, repoURL string, number int64, body string) error
+
 	// TODO(bduffany): ListRepos
 }
 
@@ -762,6 +908,18 @@ type WebhookData struct {
 	// SHA is the commit SHA of the branch that was pushed.
 	SHA string
 
+	// BaseSHA is the commit that the pushed commits are compared against to
+	// find the files they change: the previous commit of the pushed branch for
+	// push events, or the commit of the target branch for pull request
+	// events. Empty if unknown, such as when a branch is created.
+	BaseSHA string
+
+	// ChangedFiles are the paths of the files changed since BaseSHA, relative
+	// to the repo root, if reported by the git provider. Nil if unknown, in
+	// which case the CI runner computes them from the git history.
+	// Ex: ["server/main.go", "docs/README.md"]
+	ChangedFiles []string
+
 	// TargetRepoURL is the canonical URL of the repo containing the TargetBranch.
 	// For non-pull request events, this can be empty, or can equal `PushedRepoURL`.
 	// Ex: "https://github.com/acme-inc/acme"
@@ -781,6 +939,12 @@ type WebhookData struct {
 	// the git provider.
 	IsTargetRepoPublic bool
 
+	// IsUploadedForReview is true if the commit was uploaded for review to
+	// the target repo rather than pushed to one of its branches, such as a
+	// Gerrit patch set. Like pull requests from forks, such commits are only
+	// trusted if the PullRequestAuthor is.
+	IsUploadedForReview bool
+
 	// PullRequestNumber is the PR number if applicable.
 	// Ex: 123
 	PullRequestNumber int64
@@ -794,6 +958,33 @@ type WebhookData struct {
 	// request, if applicable.
 	// Ex: "acmedev123"
 	PullRequestApprover string
+
+	// PullRequestLabel is the label that was added to or removed from the
+	// pull request, for pull_request_labeled and pull_request_unlabeled events.
+	// Ex: "merge-queue"
+	PullRequestLabel string
+
+	// Sender is the user name of the user who triggered the event, such as the
+	// user who labeled the pull request or commented on it.
+	// Ex: "acmedev123"
+	Sender string
+
+	// PullRequestComment is the body of the comment that was added to the
+	// pull request, for pull_request_comment events.
+	// Ex: "/buildbuddy retry"
+	PullRequestComment string
+
+	// PullRequestCommentCreatedAt is when the pull request comment was
+	// added, for pull_request_comment events.
+	PullRequestCommentCreatedAt time.Time
+
+	// PullRequestLabeledAt is when the label was added to the pull request,
+	// for pull_request_labeled events.
+	PullRequestLabeledAt time.Time
+
+	// PushedRepoPushedAt is when any branch of the pushed repo was last
+	// pushed to, if known. It's only set by GitProvider.GetPullRequest.
+	PushedRepoPushedAt time.Time
 }
 
 type SplashPrinter interface {
@@ -804,7 +995,13 @@ type RemoteExecutionService interface {
 	Dispatch(ctx context.Context, req *repb.ExecuteRequest) (string, error)
 	Execute(req *repb.ExecuteRequest, stream repb.Execution_ExecuteServer) error
 	WaitExecution(req *repb.WaitExecutionRequest, stream repb.Execution_WaitExecutionServer) error
+	BatchExecute(req *repb.BatchExecuteRequest, stream repb.Execution_BatchExecuteServer) error
 	PublishOperation(stream repb.Execution_PublishOperationServer) error
+	PublishExecutionOutput(stream repb.Execution_PublishExecutionOutputServer) error
+	// ReadExecutionOutput streams the stdout or stderr of an execution, as
+	// named by one of the stream names in its ExecuteOperationMetadata,
+	// until the execution finishes.
+	ReadExecutionOutput(req *bspb.ReadRequest, stream bspb.ByteStream_ReadServer) error
 	MarkExecutionFailed(ctx context.Context, taskID string, reason error) error
 	Cancel(ctx context.Context, invocationID string) error
 	RedisAvailabilityMonitoringEnabled() bool
@@ -824,6 +1021,10 @@ type FileCache interface {
 	// as the filecache. The directory is not unique per call. Callers should
 	// generate globally unique file names under this directory.
 	TempDir() string
+
+	// FlushStats logs a summary of the cache's contents and publishes its
+	// size metrics. It's called before the executor goes away.
+	FlushStats()
 }
 
 // PoolType represents the user's requested executor pool type for an executed
@@ -845,7 +1046,9 @@ type SchedulerService interface {
 	EnqueueTaskReservation(ctx context.Context, req *scpb.EnqueueTaskReservationRequest) (*scpb.EnqueueTaskReservationResponse, error)
 	ReEnqueueTask(ctx context.Context, req *scpb.ReEnqueueTaskRequest) (*scpb.ReEnqueueTaskResponse, error)
 	GetExecutionNodes(ctx context.Context, req *scpb.GetExecutionNodesRequest) (*scpb.GetExecutionNodesResponse, error)
+	GetPoolDemand(ctx context.Context, req *scpb.GetPoolDemandRequest) (*scpb.GetPoolDemandResponse, error)
 	GetPoolInfo(ctx context.Context, os, requestedPool, workflowID string, poolType PoolType) (*PoolInfo, error)
+	IssueExecutorCertificate(ctx context.Context, req *scpb.IssueExecutorCertificateRequest) (*scpb.IssueExecutorCertificateResponse, error)
 }
 
 // PoolInfo holds high level metadata for an executor pool.
@@ -953,7 +1156,11 @@ type Runner interface {
 	DownloadInputs(ctx context.Context, ioStats *repb.IOStats) error
 
 	// Run runs the task that is currently assigned to the runner.
-	Run(ctx context.Context) *CommandResult
+	//
+	// If liveOutput is non-nil, the command's stdout and stderr are also
+	// written to its Stdout and Stderr as the command runs, in addition to
+	// being returned in the result.
+	Run(ctx context.Context, liveOutput *Stdio) *CommandResult
 
 	// GracefulTerminate sends a graceful termination signal to the runner.
 	GracefulTerminate(ctx context.Context) error
@@ -1079,6 +1286,14 @@ type CommandResult struct {
 
 	// VMMetadata associated with the VM that ran the task, if applicable.
 	VMMetadata *fcpb.VMMetadata
+
+	// NetworkPolicyMetadata describes the network policy that was enforced
+	// for the command, if one was requested.
+	NetworkPolicyMetadata *espb.NetworkPolicyMetadata
+
+	// AccessedInputs holds the input files that the command read, in the
+	// order that they were first read, if the runner tracked them.
+	AccessedInputs []*repb.FileNode
 }
 
 type Subscriber interface {
@@ -1310,6 +1525,7 @@ const (
 	KMSTypeLocalInsecure KMSType = iota
 	KMSTypeGCP
 	KMSTypeAWS
+	KMSTypeLocalKeyFile
 )
 
 // A KMS is a Key Managment Service (typically a cloud provider or external
@@ -1331,6 +1547,11 @@ type SecretService interface {
 
 	// Internal use only -- fetches decoded secrets for use in running a command.
 	GetSecretEnvVars(ctx context.Context, groupID string) ([]*repb.Command_EnvironmentVariable, error)
+	// Internal use only -- fetches decoded secrets scoped to the given repo,
+	// for use in running a workflow for that repo.
+	GetRepoSecretEnvVars(ctx context.Context, groupID, repoURL string) ([]*repb.Command_EnvironmentVariable, error)
+	// Internal use only -- fetches the decoded value of a single secret.
+	GetSecret(ctx context.Context, groupID, name string) (string, error)
 }
 
 // ExecutionCollector keeps track of a list of Executions for each invocation ID.
@@ -1395,6 +1616,12 @@ type AuditLogger interface {
 	LogForInvocation(ctx context.Context, invocationID string, action alpb.Action, request proto.Message)
 	LogForSecret(ctx context.Context, secretName string, action alpb.Action, request proto.Message)
 	GetLogs(ctx context.Context, req *alpb.GetAuditLogsRequest) (*alpb.GetAuditLogsResponse, error)
+	// ExportLogs writes the entries of the authenticated group in the
+	// requested time range to the blobstore.
+	ExportLogs(ctx context.Context, req *alpb.ExportAuditLogsRequest) (*alpb.ExportAuditLogsResponse, error)
+	// ReadExport returns the contents of a blob written by ExportLogs, if it
+	// belongs to the authenticated group.
+	ReadExport(ctx context.Context, blobName string) ([]byte, error)
 }
 
 type IPRulesService interface {
@@ -1416,12 +1643,43 @@ type IPRulesService interface {
 
 	GetIPRuleConfig(ctx context.Context, request *irpb.GetRulesConfigRequest) (*irpb.GetRulesConfigResponse, error)
 	SetIPRuleConfig(ctx context.Context, request *irpb.SetRulesConfigRequest) (*irpb.SetRulesConfigResponse, error)
+	// CreateOverride lets the authenticated org admin bypass the group's IP
+	// rules for a limited time.
+	CreateOverride(ctx context.Context, req *irpb.CreateOverrideRequest) (*irpb.CreateOverrideResponse, error)
+	// GetOverrides returns the group's overrides that haven't expired.
+	GetOverrides(ctx context.Context, req *irpb.GetOverridesRequest) (*irpb.GetOverridesResponse, error)
+	// DeleteOverride revokes an override of the group's IP rules.
+	DeleteOverride(ctx context.Context, req *irpb.DeleteOverrideRequest) (*irpb.DeleteOverrideResponse, error)
 	GetRules(ctx context.Context, req *irpb.GetRulesRequest) (*irpb.GetRulesResponse, error)
 	AddRule(ctx context.Context, req *irpb.AddRuleRequest) (*irpb.AddRuleResponse, error)
 	UpdateRule(ctx context.Context, req *irpb.UpdateRuleRequest) (*irpb.UpdateRuleResponse, error)
 	DeleteRule(ctx context.Context, req *irpb.DeleteRuleRequest) (*irpb.DeleteRuleResponse, error)
 }
 
+// OIDCFederationService exchanges OIDC tokens issued to CI jobs for
+// short-lived API keys, according to the trust policies configured by each
+// group.
+type OIDCFederationService interface {
+	GetTrustPolicy(ctx context.Context, groupID, trustPolicyID string) (*tables.OIDCTrustPolicy, error)
+
+	GetTrustPolicies(ctx context.Context, req *ofpb.GetTrustPoliciesRequest) (*ofpb.GetTrustPoliciesResponse, error)
+	CreateTrustPolicy(ctx context.Context, req *ofpb.CreateTrustPolicyRequest) (*ofpb.CreateTrustPolicyResponse, error)
+	DeleteTrustPolicy(ctx context.Context, req *ofpb.DeleteTrustPolicyRequest) (*ofpb.DeleteTrustPolicyResponse, error)
+
+	// ExchangeToken verifies the OIDC token in the request and returns a
+	// short-lived API key of the group whose trust policy matches it. The
+	// request doesn't need to be authenticated.
+	ExchangeToken(ctx context.Context, req *ofpb.ExchangeTokenRequest) (*ofpb.ExchangeTokenResponse, error)
+}
+
+// OIDCProviderService manages the OIDC identity providers that groups
+// register for their members to log in with.
+type OIDCProviderService interface {
+	GetOIDCProvider(ctx context.Context, req *oppb.GetOIDCProviderRequest) (*oppb.GetOIDCProviderResponse, error)
+	SetOIDCProvider(ctx context.Context, req *oppb.SetOIDCProviderRequest) (*oppb.SetOIDCProviderResponse, error)
+	DeleteOIDCProvider(ctx context.Context, req *oppb.DeleteOIDCProviderRequest) (*oppb.DeleteOIDCProviderResponse, error)
+}
+
 type ClientIdentity struct {
 	Origin string
 	Client string
@@ -1543,6 +1801,51 @@ type CodesearchService interface {
 	KytheProxy(ctx context.Context, req *cssrpb.KytheRequest) (*cssrpb.KytheResponse, error)
 }
 
+// IndexedLog identifies a log that is indexed by a LogIndex.
+type IndexedLog struct {
+	GroupID      string
+	InvocationID string
+	// The label of the test target that produced the log, or empty for the
+	// invocation's console log.
+	TargetLabel string
+	// When the invocation was created. Searches are scoped by this time.
+	InvocationCreatedAtUsec int64
+}
+
+type LogSearchQuery struct {
+	GroupID string
+	// A regular expression matched against each log line.
+	Query         string
+	StartTimeUsec int64
+	EndTimeUsec   int64
+	MaxResults    int
+}
+
+// LogMatch is a log line that matched a LogSearchQuery.
+type LogMatch struct {
+	Log *IndexedLog
+	// The byte offset of the start of the line in the log.
+	Offset int64
+	// The 1-based line number of the line in the log.
+	LineNumber int64
+	Line       string
+}
+
+// LogIndex indexes invocation console logs and test logs so that they can be
+// searched.
+type LogIndex interface {
+	// IndexLog reads the contents of the log from r and indexes them,
+	// replacing any previously indexed contents of the same log.
+	IndexLog(ctx context.Context, log *IndexedLog, r io.Reader) error
+
+	// SearchLogs returns the lines of the group's logs that match the query.
+	SearchLogs(ctx context.Context, q *LogSearchQuery) ([]*LogMatch, error)
+
+	// DeleteInvocationLogs removes all of the invocation's logs from the
+	// index.
+	DeleteInvocationLogs(ctx context.Context, groupID, invocationID string) error
+}
+
 type AuthService interface {
 	Authenticate(ctx context.Context, req *authpb.AuthenticateRequest) (*authpb.AuthenticateResponse, error)
 }
@@ -0,0 +1,264 @@
+// Package invocation_annotations stores notes that members of an organization
+// leave on its invocations, or on targets within them.
+package invocation_annotations
+
+import (
+	"context"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/authutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	uspb "github.com/buildbuddy-io/buildbuddy/proto/user_id"
+)
+
+const (
+	maxBodyLength               = 64 * 1024
+	maxAnnotationsPerInvocation = 1000
+)
+
+func validateBody(body string) error {
+	if body == "" {
+		return status.InvalidArgumentError("Annotation body is required")
+	}
+	if len(body) > maxBodyLength {
+		return status.InvalidArgumentErrorf("Annotation body may be at most %d bytes", maxBodyLength)
+	}
+	return nil
+}
+
+// authorizeInvocation returns the authenticated user and the group that owns
+// the given invocation, if the user is a member of that group.
+func authorizeInvocation(ctx context.Context, env environment.Env, invocationID string) (interfaces.UserInfo, string, error) {
+	if invocationID == "" {
+		return nil, "", status.InvalidArgumentError("An invocation ID is required")
+	}
+	u, err := env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	groupID, err := env.GetInvocationDB().LookupGroupIDFromInvocation(ctx, invocationID)
+	if err != nil {
+		if db.IsRecordNotFound(err) {
+			return nil, "", status.NotFoundErrorf("Invocation %q not found", invocationID)
+		}
+		return nil, "", err
+	}
+	if err := authutil.AuthorizeGroupAccess(ctx, env, groupID); err != nil {
+		return nil, "", err
+	}
+	return u, groupID, nil
+}
+
+// lookupAnnotation returns the annotation with the given ID, if the
+// authenticated user is a member of the group that owns it.
+func lookupAnnotation(ctx context.Context, env environment.Env, annotationID string) (interfaces.UserInfo, *tables.InvocationAnnotation, error) {
+	if annotationID == "" {
+		return nil, nil, status.InvalidArgumentError("An annotation ID is required")
+	}
+	u, err := env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	a := &tables.InvocationAnnotation{}
+	err = env.GetDBHandle().NewQuery(ctx, "invocation_annotations_lookup").Raw(
+		`SELECT * FROM "InvocationAnnotations" WHERE annotation_id = ?`, annotationID).Take(a)
+	if err != nil {
+		if db.IsRecordNotFound(err) {
+			return nil, nil, status.NotFoundErrorf("Annotation %q not found", annotationID)
+		}
+		return nil, nil, err
+	}
+	if err := authutil.AuthorizeGroupAccess(ctx, env, a.GroupID); err != nil {
+		// Don't reveal that the annotation exists.
+		return nil, nil, status.NotFoundErrorf("Annotation %q not found", annotationID)
+	}
+	return u, a, nil
+}
+
+// lookupAnnotations returns the annotations of an invocation, oldest first,
+// with their authors.
+func lookupAnnotations(ctx context.Context, env environment.Env, invocationID, targetLabel string) ([]*inpb.InvocationAnnotation, error) {
+	q := `SELECT * FROM "InvocationAnnotations" WHERE invocation_id = ?`
+	args := []any{invocationID}
+	if targetLabel != "" {
+		q += ` AND target_label = ?`
+		args = append(args, targetLabel)
+	}
+	q += ` ORDER BY created_at_usec ASC, annotation_id ASC`
+	rq := env.GetDBHandle().NewQuery(ctx, "invocation_annotations_lookup_for_invocation").Raw(q, args...)
+	rows, err := db.ScanAll(rq, &tables.InvocationAnnotation{})
+	if err != nil {
+		return nil, err
+	}
+	authors, err := lookupAuthors(ctx, env, rows)
+	if err != nil {
+		return nil, err
+	}
+	annotations := make([]*inpb.InvocationAnnotation, 0, len(rows))
+	for _, row := range rows {
+		annotations = append(annotations, toProto(row, authors[row.UserID]))
+	}
+	return annotations, nil
+}
+
+func lookupAuthors(ctx context.Context, env environment.Env, rows []*tables.InvocationAnnotation) (map[string]*tables.User, error) {
+	authors := make(map[string]*tables.User)
+	var userIDs []string
+	for _, row := range rows {
+		if _, ok := authors[row.UserID]; !ok {
+			authors[row.UserID] = nil
+			userIDs = append(userIDs, row.UserID)
+		}
+	}
+	if len(userIDs) == 0 {
+		return authors, nil
+	}
+	rq := env.GetDBHandle().NewQuery(ctx, "invocation_annotations_lookup_authors").Raw(
+		`SELECT * FROM "Users" WHERE user_id IN ?`, userIDs)
+	err := db.ScanEach(rq, func(ctx context.Context, u *tables.User) error {
+		authors[u.UserID] = u
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return authors, nil
+}
+
+func toProto(a *tables.InvocationAnnotation, author *tables.User) *inpb.InvocationAnnotation {
+	// Authors that have since been deleted are still identified by ID.
+	displayAuthor := &uspb.DisplayUser{UserId: &uspb.UserId{Id: a.UserID}}
+	if author != nil {
+		displayAuthor = author.ToProto()
+	}
+	return &inpb.InvocationAnnotation{
+		AnnotationId:  a.AnnotationID,
+		TargetLabel:   a.TargetLabel,
+		Body:          a.Body,
+		Author:        displayAuthor,
+		CreatedAtUsec: a.CreatedAtUsec,
+		UpdatedAtUsec: a.UpdatedAtUsec,
+	}
+}
+
+func annotationProto(ctx context.Context, env environment.Env, a *tables.InvocationAnnotation) (*inpb.InvocationAnnotation, error) {
+	authors, err := lookupAuthors(ctx, env, []*tables.InvocationAnnotation{a})
+	if err != nil {
+		return nil, err
+	}
+	return toProto(a, authors[a.UserID]), nil
+}
+
+// ForInvocation returns the annotations of an invocation owned by the given
+// group, or nil if the authenticated user isn't a member of the group.
+func ForInvocation(ctx context.Context, env environment.Env, groupID, invocationID string) ([]*inpb.InvocationAnnotation, error) {
+	if env.GetDBHandle() == nil || groupID == "" {
+		return nil, nil
+	}
+	if err := authutil.AuthorizeGroupAccess(ctx, env, groupID); err != nil {
+		return nil, nil
+	}
+	return lookupAnnotations(ctx, env, invocationID, "")
+}
+
+func Create(ctx context.Context, env environment.Env, req *inpb.CreateInvocationAnnotationRequest) (*inpb.CreateInvocationAnnotationResponse, error) {
+	if err := validateBody(req.GetBody()); err != nil {
+		return nil, err
+	}
+	u, groupID, err := authorizeInvocation(ctx, env, req.GetInvocationId())
+	if err != nil {
+		return nil, err
+	}
+	annotationID, err := tables.PrimaryKeyForTable("InvocationAnnotations")
+	if err != nil {
+		return nil, err
+	}
+	a := &tables.InvocationAnnotation{
+		AnnotationID: annotationID,
+		InvocationID: req.GetInvocationId(),
+		GroupID:      groupID,
+		UserID:       u.GetUserID(),
+		TargetLabel:  req.GetTargetLabel(),
+		Body:         req.GetBody(),
+	}
+	err = env.GetDBHandle().Transaction(ctx, func(tx interfaces.DB) error {
+		count := &struct{ Count int64 }{}
+		err := tx.NewQuery(ctx, "invocation_annotations_count").Raw(
+			`SELECT COUNT(*) AS count FROM "InvocationAnnotations" WHERE invocation_id = ?`, req.GetInvocationId()).Take(count)
+		if err != nil {
+			return err
+		}
+		if count.Count >= maxAnnotationsPerInvocation {
+			return status.ResourceExhaustedErrorf("Invocations may have at most %d annotations", maxAnnotationsPerInvocation)
+		}
+		return tx.NewQuery(ctx, "invocation_annotations_create").Create(a)
+	})
+	if err != nil {
+		return nil, err
+	}
+	annotation, err := annotationProto(ctx, env, a)
+	if err != nil {
+		return nil, err
+	}
+	return &inpb.CreateInvocationAnnotationResponse{Annotation: annotation}, nil
+}
+
+func Get(ctx context.Context, env environment.Env, req *inpb.GetInvocationAnnotationsRequest) (*inpb.GetInvocationAnnotationsResponse, error) {
+	if _, _, err := authorizeInvocation(ctx, env, req.GetInvocationId()); err != nil {
+		return nil, err
+	}
+	annotations, err := lookupAnnotations(ctx, env, req.GetInvocationId(), req.GetTargetLabel())
+	if err != nil {
+		return nil, err
+	}
+	return &inpb.GetInvocationAnnotationsResponse{Annotation: annotations}, nil
+}
+
+func Update(ctx context.Context, env environment.Env, req *inpb.UpdateInvocationAnnotationRequest) (*inpb.UpdateInvocationAnnotationResponse, error) {
+	if err := validateBody(req.GetBody()); err != nil {
+		return nil, err
+	}
+	u, a, err := lookupAnnotation(ctx, env, req.GetAnnotationId())
+	if err != nil {
+		return nil, err
+	}
+	if a.UserID != u.GetUserID() {
+		return nil, status.PermissionDeniedError("Only the author of an annotation may update it")
+	}
+	a.Body = req.GetBody()
+	a.UpdatedAtUsec = env.GetDBHandle().NowFunc().UnixMicro()
+	err = env.GetDBHandle().NewQuery(ctx, "invocation_annotations_update").Raw(
+		`UPDATE "InvocationAnnotations" SET body = ?, updated_at_usec = ? WHERE annotation_id = ?`,
+		a.Body, a.UpdatedAtUsec, a.AnnotationID).Exec().Error
+	if err != nil {
+		return nil, err
+	}
+	annotation, err := annotationProto(ctx, env, a)
+	if err != nil {
+		return nil, err
+	}
+	return &inpb.UpdateInvocationAnnotationResponse{Annotation: annotation}, nil
+}
+
+func Delete(ctx context.Context, env environment.Env, req *inpb.DeleteInvocationAnnotationRequest) (*inpb.DeleteInvocationAnnotationResponse, error) {
+	u, a, err := lookupAnnotation(ctx, env, req.GetAnnotationId())
+	if err != nil {
+		return nil, err
+	}
+	if a.UserID != u.GetUserID() {
+		if err := authutil.AuthorizeOrgAdmin(u, a.GroupID); err != nil {
+			return nil, status.PermissionDeniedError("Only the author of an annotation or an organization admin may delete it")
+		}
+	}
+	err = env.GetDBHandle().NewQuery(ctx, "invocation_annotations_delete").Raw(
+		`DELETE FROM "InvocationAnnotations" WHERE annotation_id = ?`, a.AnnotationID).Exec().Error
+	if err != nil {
+		return nil, err
+	}
+	return &inpb.DeleteInvocationAnnotationResponse{}, nil
+}
@@ -0,0 +1,181 @@
+package invocation_annotations_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/invocation_annotations"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+type testContexts struct {
+	admin, developer, otherDeveloper, outsider context.Context
+}
+
+func setup(t *testing.T) (*testenv.TestEnv, *testContexts) {
+	te := testenv.GetTestEnv(t)
+	admin := testauth.User("US1", "GR1")
+	admin.GroupMemberships[0].Capabilities = append(admin.GroupMemberships[0].Capabilities, akpb.ApiKey_ORG_ADMIN_CAPABILITY)
+	ta := testauth.NewTestAuthenticator(map[string]interfaces.UserInfo{
+		"US1": admin,
+		"US2": testauth.User("US2", "GR1"),
+		"US3": testauth.User("US3", "GR1"),
+		"US4": testauth.User("US4", "GR2"),
+	})
+	te.SetAuthenticator(ta)
+	ctx := context.Background()
+	for _, u := range []*tables.User{
+		{UserID: "US1", FirstName: "Ada", LastName: "Admin"},
+		{UserID: "US2", FirstName: "Dev", LastName: "One"},
+	} {
+		err := te.GetDBHandle().NewQuery(ctx, "create_user").Create(u)
+		require.NoError(t, err)
+	}
+	err := te.GetDBHandle().NewQuery(ctx, "create_invocation").Create(&tables.Invocation{InvocationID: "inv1", GroupID: "GR1"})
+	require.NoError(t, err)
+
+	c := &testContexts{}
+	for _, uc := range []struct {
+		userID string
+		ctx    *context.Context
+	}{
+		{"US1", &c.admin},
+		{"US2", &c.developer},
+		{"US3", &c.otherDeveloper},
+		{"US4", &c.outsider},
+	} {
+		*uc.ctx, err = ta.WithAuthenticatedUser(ctx, uc.userID)
+		require.NoError(t, err)
+	}
+	return te, c
+}
+
+func TestCreateAndGet(t *testing.T) {
+	te, c := setup(t)
+
+	rsp, err := invocation_annotations.Create(c.developer, te, &inpb.CreateInvocationAnnotationRequest{
+		InvocationId: "inv1",
+		Body:         "Broken by the **cache outage**.",
+	})
+	require.NoError(t, err)
+	assert.NotEmpty(t, rsp.GetAnnotation().GetAnnotationId())
+	assert.Equal(t, "Dev One", rsp.GetAnnotation().GetAuthor().GetName().GetFull())
+	assert.NotZero(t, rsp.GetAnnotation().GetCreatedAtUsec())
+
+	_, err = invocation_annotations.Create(c.otherDeveloper, te, &inpb.CreateInvocationAnnotationRequest{
+		InvocationId: "inv1",
+		TargetLabel:  "//server:server_test",
+		Body:         "Flaky since yesterday.",
+	})
+	require.NoError(t, err)
+
+	getRsp, err := invocation_annotations.Get(c.admin, te, &inpb.GetInvocationAnnotationsRequest{InvocationId: "inv1"})
+	require.NoError(t, err)
+	require.Len(t, getRsp.GetAnnotation(), 2)
+	assert.Equal(t, "Broken by the **cache outage**.", getRsp.GetAnnotation()[0].GetBody())
+	assert.Equal(t, "//server:server_test", getRsp.GetAnnotation()[1].GetTargetLabel())
+	// Authors without a user record are identified by ID.
+	assert.Equal(t, "US3", getRsp.GetAnnotation()[1].GetAuthor().GetUserId().GetId())
+
+	getRsp, err = invocation_annotations.Get(c.admin, te, &inpb.GetInvocationAnnotationsRequest{InvocationId: "inv1", TargetLabel: "//server:server_test"})
+	require.NoError(t, err)
+	require.Len(t, getRsp.GetAnnotation(), 1)
+	assert.Equal(t, "Flaky since yesterday.", getRsp.GetAnnotation()[0].GetBody())
+
+	annotations, err := invocation_annotations.ForInvocation(c.developer, te, "GR1", "inv1")
+	require.NoError(t, err)
+	assert.Len(t, annotations, 2)
+}
+
+func TestCreate_Invalid(t *testing.T) {
+	te, c := setup(t)
+
+	_, err := invocation_annotations.Create(c.developer, te, &inpb.CreateInvocationAnnotationRequest{InvocationId: "inv1"})
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error, got %v", err)
+
+	_, err = invocation_annotations.Create(c.developer, te, &inpb.CreateInvocationAnnotationRequest{
+		InvocationId: "inv1",
+		Body:         strings.Repeat("a", 64*1024+1),
+	})
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error, got %v", err)
+
+	_, err = invocation_annotations.Create(c.developer, te, &inpb.CreateInvocationAnnotationRequest{
+		InvocationId: "nonexistent",
+		Body:         "Note",
+	})
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound error, got %v", err)
+}
+
+func TestOutsider(t *testing.T) {
+	te, c := setup(t)
+	rsp, err := invocation_annotations.Create(c.developer, te, &inpb.CreateInvocationAnnotationRequest{
+		InvocationId: "inv1",
+		Body:         "Internal note",
+	})
+	require.NoError(t, err)
+	id := rsp.GetAnnotation().GetAnnotationId()
+
+	_, err = invocation_annotations.Create(c.outsider, te, &inpb.CreateInvocationAnnotationRequest{
+		InvocationId: "inv1",
+		Body:         "Note",
+	})
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+
+	_, err = invocation_annotations.Get(c.outsider, te, &inpb.GetInvocationAnnotationsRequest{InvocationId: "inv1"})
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+
+	// Annotations aren't returned to users outside the group, e.g. when the
+	// invocation is public.
+	annotations, err := invocation_annotations.ForInvocation(c.outsider, te, "GR1", "inv1")
+	require.NoError(t, err)
+	assert.Empty(t, annotations)
+
+	_, err = invocation_annotations.Delete(c.outsider, te, &inpb.DeleteInvocationAnnotationRequest{AnnotationId: id})
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound error, got %v", err)
+}
+
+func TestUpdateAndDelete(t *testing.T) {
+	te, c := setup(t)
+	var ids []string
+	for range 2 {
+		rsp, err := invocation_annotations.Create(c.developer, te, &inpb.CreateInvocationAnnotationRequest{
+			InvocationId: "inv1",
+			Body:         "Note",
+		})
+		require.NoError(t, err)
+		ids = append(ids, rsp.GetAnnotation().GetAnnotationId())
+	}
+
+	// Only the author can update an annotation.
+	_, err := invocation_annotations.Update(c.admin, te, &inpb.UpdateInvocationAnnotationRequest{AnnotationId: ids[0], Body: "Edited"})
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+	updateRsp, err := invocation_annotations.Update(c.developer, te, &inpb.UpdateInvocationAnnotationRequest{AnnotationId: ids[0], Body: "Edited"})
+	require.NoError(t, err)
+	assert.Equal(t, "Edited", updateRsp.GetAnnotation().GetBody())
+	assert.GreaterOrEqual(t, updateRsp.GetAnnotation().GetUpdatedAtUsec(), updateRsp.GetAnnotation().GetCreatedAtUsec())
+
+	// Annotations can be deleted by their author or an admin.
+	_, err = invocation_annotations.Delete(c.otherDeveloper, te, &inpb.DeleteInvocationAnnotationRequest{AnnotationId: ids[0]})
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+	_, err = invocation_annotations.Delete(c.developer, te, &inpb.DeleteInvocationAnnotationRequest{AnnotationId: ids[0]})
+	require.NoError(t, err)
+	_, err = invocation_annotations.Delete(c.admin, te, &inpb.DeleteInvocationAnnotationRequest{AnnotationId: ids[1]})
+	require.NoError(t, err)
+
+	getRsp, err := invocation_annotations.Get(c.developer, te, &inpb.GetInvocationAnnotationsRequest{InvocationId: "inv1"})
+	require.NoError(t, err)
+	assert.Empty(t, getRsp.GetAnnotation())
+
+	_, err = invocation_annotations.Update(c.developer, te, &inpb.UpdateInvocationAnnotationRequest{AnnotationId: ids[0], Body: "Edited"})
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound error, got %v", err)
+}
@@ -7,10 +7,17 @@ import (
 	"strings"
 	"time"
 
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_proxy"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/public_instance"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/claims"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 var (
@@ -24,6 +31,8 @@ var (
 	invocationCleanupInterval  = flag.Duration("cleanup_interval", 10*60*time.Second, "How often the janitor cleanup tasks will run")
 	invocationCleanupWorkers   = flag.Int("cleanup_workers", 1, "How many cleanup tasks to run")
 
+	groupRetentionEnabled = flag.Bool("storage.enable_group_retention", false, "If true, organization admins can set how many days their organization's invocations are kept, overriding storage.ttl_seconds for those invocations. Invocations under legal hold are kept regardless.")
+
 	// Flags for Execution Janitor.
 	executionTTL = flag.Duration("storage.execution.ttl", 0, "The time, in seconds, to keep invocations before deletion. 0 disables invocation deletion.")
 
@@ -44,6 +53,7 @@ type Janitor struct {
 	quit   chan struct{}
 
 	name       string
+	enabled    bool
 	interval   time.Duration
 	numWorkers int
 
@@ -52,26 +62,115 @@ type Janitor struct {
 	deleteFn func(c *JanitorConfig)
 }
 
+// GroupRetentionEnabled returns whether groups may set their own invocation
+// retention period.
+func GroupRetentionEnabled() bool {
+	return *groupRetentionEnabled
+}
+
+// deleteInvocationBlobs deletes the data that an invocation stored in the
+// blobstore: its build events, event log, and cache scorecard for each attempt,
+// as well as any copy of its build event stream written by the build event
+// proxy. Cache artifacts in the CAS are content-addressed and may be shared with
+// other invocations, so they are left to expire from the cache.
+func deleteInvocationBlobs(ctx context.Context, c *JanitorConfig, invocation *tables.Invocation) error {
+	bs := c.env.GetBlobstore()
+	var lastErr error
+	if err := bs.DeleteBlob(ctx, invocation.BlobID); err != nil {
+		lastErr = err
+	}
+	attempts := []uint64{0}
+	if invocation.Attempt > 0 {
+		attempts = attempts[:0]
+		for a := uint64(1); a <= invocation.Attempt; a++ {
+			attempts = append(attempts, a)
+		}
+	}
+	for _, attempt := range attempts {
+		if err := build_event_handler.DeleteAttemptBlobs(ctx, c.env, invocation.InvocationID, attempt); err != nil {
+			lastErr = err
+		}
+	}
+	proxyBlobName := build_event_proxy.BlobName(invocation.InvocationID)
+	if exists, err := bs.BlobExists(ctx, proxyBlobName); err != nil {
+		lastErr = err
+	} else if exists {
+		if err := bs.DeleteBlob(ctx, proxyBlobName); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// deleteInvocationLogs removes the invocation's logs from the log index, if
+// any were indexed.
+func deleteInvocationLogs(ctx context.Context, c *JanitorConfig, invocation *tables.Invocation) error {
+	li := c.env.GetLogIndex()
+	if li == nil || invocation.GroupID == "" {
+		return nil
+	}
+	// The log index may be served remotely, so authenticate as a member of
+	// the invocation's group.
+	ctx = claims.AuthContextFromClaims(ctx, &claims.Claims{
+		GroupID:          invocation.GroupID,
+		AllowedGroups:    []string{invocation.GroupID},
+		GroupMemberships: []*interfaces.GroupMembership{{GroupID: invocation.GroupID}},
+	}, nil)
+	return li.DeleteInvocationLogs(ctx, invocation.GroupID, invocation.InvocationID)
+}
+
 func deleteInvocation(c *JanitorConfig, invocation *tables.Invocation) {
 	ctx := c.env.GetServerContext()
-	if err := c.env.GetBlobstore().DeleteBlob(ctx, invocation.BlobID); err != nil && c.errorLoggingEnabled {
-		log.Warningf("Error deleting blob (%s): %s", invocation.BlobID, err)
+	err := deleteInvocationData(ctx, c, invocation)
+	metrics.InvocationJanitorDeletions.With(prometheus.Labels{
+		metrics.StatusHumanReadableLabel: status.MetricsLabel(err),
+	}).Inc()
+	if err != nil && c.errorLoggingEnabled {
+		log.Warningf("Error deleting invocation (%s): %s", invocation.InvocationID, err)
 	}
+}
 
-	// Try to delete the row too, even if blob deletion failed.
-	if err := c.env.GetInvocationDB().DeleteInvocation(ctx, invocation.InvocationID); err != nil && c.errorLoggingEnabled {
-		log.Warningf("Error deleting invocation (%s): %s", invocation.InvocationID, err)
+// deleteInvocationData deletes the invocation's blobs and logs, and then its
+// row. If the blobs or logs can't be deleted, the row is kept so that the
+// invocation is found again, and its deletion retried, on a later run.
+func deleteInvocationData(ctx context.Context, c *JanitorConfig, invocation *tables.Invocation) error {
+	// A legal hold may have been placed on the invocation since it was
+	// looked up. Deleting the row also fails if the invocation is held, but
+	// by then its blobs would be gone.
+	held, err := c.env.GetInvocationDB().HasInvocationLegalHold(ctx, invocation.InvocationID)
+	if err != nil {
+		return err
 	}
+	if held {
+		return status.FailedPreconditionErrorf("Invocation %s is under legal hold and cannot be deleted.", invocation.InvocationID)
+	}
+	if err := deleteInvocationBlobs(ctx, c, invocation); err != nil {
+		return status.WrapError(err, "delete blobs")
+	}
+	if err := deleteInvocationLogs(ctx, c, invocation); err != nil {
+		return status.WrapError(err, "delete indexed logs")
+	}
+	return c.env.GetInvocationDB().DeleteInvocation(ctx, invocation.InvocationID)
 }
 
 func deleteExpiredInvocations(c *JanitorConfig) {
 	ctx := c.env.GetServerContext()
-	cutoff := time.Now().Add(-1 * c.ttl)
-	expired, err := c.env.GetInvocationDB().LookupExpiredInvocations(ctx, cutoff, c.batchSize)
+	// Without a TTL, only invocations of groups with their own retention
+	// period expire.
+	cutoff := time.Time{}
+	if c.ttl > 0 {
+		cutoff = time.Now().Add(-1 * c.ttl)
+	}
+	anonymousCutoff := time.Time{}
+	if ttl := public_instance.AnonymousInvocationTTL(); ttl > 0 {
+		anonymousCutoff = time.Now().Add(-1 * ttl)
+	}
+	expired, err := c.env.GetInvocationDB().LookupExpiredInvocations(ctx, cutoff, anonymousCutoff, *groupRetentionEnabled, c.batchSize)
 	if err != nil && c.errorLoggingEnabled {
 		log.Warningf("Error finding expired deletions: %s", err)
 		return
 	}
+	metrics.InvocationJanitorExpiredBacklog.Set(float64(len(expired)))
 
 	for _, exp := range expired {
 		deleteInvocation(c, exp)
@@ -87,6 +186,7 @@ func NewInvocationJanitor(env environment.Env) *Janitor {
 	}
 	return &Janitor{
 		name:       "invocation janitor",
+		enabled:    c.ttl > 0 || *groupRetentionEnabled || public_instance.AnonymousInvocationTTL() > 0,
 		config:     c,
 		interval:   *invocationCleanupInterval,
 		numWorkers: *invocationCleanupWorkers,
@@ -149,6 +249,7 @@ func NewExecutionJanitor(env environment.Env) *Janitor {
 	}
 	return &Janitor{
 		name:       "execution janitor",
+		enabled:    c.ttl > 0,
 		config:     c,
 		interval:   *executionCleanupInterval,
 		numWorkers: *executionCleanupWorkers,
@@ -160,7 +261,7 @@ func (j *Janitor) Start() {
 	j.ticker = time.NewTicker(j.interval)
 	j.quit = make(chan struct{})
 
-	if j.config.ttl == 0 {
+	if !j.enabled {
 		log.Infof("Configured TTL was 0; disabling %s", j.name)
 		return
 	}
@@ -22,6 +22,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_proxy"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_server"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/completion_webhooks"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/webhooks"
 	"github.com/buildbuddy-io/buildbuddy/server/buildbuddy_server"
 	"github.com/buildbuddy-io/buildbuddy/server/gossip"
@@ -30,6 +31,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/http/protolet"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/nullauth"
+	"github.com/buildbuddy-io/buildbuddy/server/public_instance"
 	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_asset/fetch_server"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_asset/push_server"
@@ -182,6 +184,9 @@ func GetConfiguredEnvironmentOrDie(healthChecker *healthcheck.HealthChecker, app
 	if err := webhooks.Register(realEnv); err != nil {
 		log.Fatalf("%v", err)
 	}
+	if err := completion_webhooks.Register(realEnv); err != nil {
+		log.Fatalf("%v", err)
+	}
 
 	if err := build_event_proxy.Register(realEnv); err != nil {
 		log.Fatalf("%v", err)
@@ -423,7 +428,7 @@ func StartAndRunServices(env *real_environment.RealEnv) {
 		mux.Handle(appRoute, interceptors.WrapExternalHandler(env, staticFileServer))
 	}
 	mux.Handle("/app/", interceptors.WrapExternalHandler(env, http.StripPrefix("/app", afs)))
-	mux.Handle("/rpc/BuildBuddyService/", interceptors.WrapAuthenticatedExternalProtoletHandler(env, "/rpc/BuildBuddyService/", protoletHandler))
+	mux.Handle("/rpc/BuildBuddyService/", public_instance.WithCaptchaCookie(interceptors.WrapAuthenticatedExternalProtoletHandler(env, "/rpc/BuildBuddyService/", protoletHandler)))
 	mux.Handle("/file/download", interceptors.WrapAuthenticatedExternalHandler(env, env.GetBuildBuddyServer()))
 	mux.Handle("/healthz", env.GetHealthChecker().LivenessHandler())
 	mux.Handle("/readyz", env.GetHealthChecker().ReadinessHandler())
@@ -436,6 +441,9 @@ func StartAndRunServices(env *real_environment.RealEnv) {
 	if err := github.Register(env); err != nil {
 		log.Fatalf("%v", err)
 	}
+	if err := public_instance.Register(env); err != nil {
+		log.Fatalf("%v", err)
+	}
 
 	// Register API as an HTTP service.
 	if api := env.GetAPIService(); api != nil {
@@ -446,6 +454,8 @@ func StartAndRunServices(env *real_environment.RealEnv) {
 		mux.Handle("/api/v1/", interceptors.WrapAuthenticatedExternalProtoletHandler(env, "/api/v1/", apiProtoHandlers))
 		// Protolet doesn't currently support streaming RPCs, so we'll register a regular old http handler.
 		mux.Handle("/api/v1/GetFile", interceptors.WrapAuthenticatedExternalHandler(env, api.GetFileHandler()))
+		mux.Handle("/api/v1/DownloadArtifacts", interceptors.WrapAuthenticatedExternalHandler(env, api.DownloadArtifactsHandler()))
+		mux.Handle("/api/v1/StreamInvocation", interceptors.WrapAuthenticatedExternalHandler(env, api.StreamInvocationHandler()))
 		mux.Handle("/api/v1/metrics", interceptors.WrapAuthenticatedExternalHandler(env, api.GetMetricsHandler()))
 	}
 
@@ -121,6 +121,10 @@ const (
 	// Reason for a runner not being added to the runner pool.
 	RunnerPoolFailedRecycleReason = "reason"
 
+	// Recycling policy that caused a runner to be removed rather than reused:
+	// `max_task_count`, `max_age`, or `task_failed`.
+	RunnerPoolRetireReason = "reason"
+
 	// Effective workload isolation type used for an executed task, such as
 	// "docker", "podman", "firecracker", or "none".
 	IsolationTypeLabel = "isolation"
@@ -134,6 +138,9 @@ const (
 	// CPU architecture associated with the request.
 	Arch = "arch"
 
+	// Executor pool name associated with the request.
+	Pool = "pool"
+
 	// The name used to identify the type of an unexpected event.
 	EventName = "name"
 
@@ -143,6 +150,33 @@ const (
 	// Status of the file cache request: `hit` if found in cache, `miss` otherwise.
 	FileCacheRequestStatusLabel = "status"
 
+	// Name of a custom executor resource, such as `nvidia.com/gpu`.
+	CustomResourceNameLabel = "resource_name"
+
+	// Status of input tree routing for a task: `preferred` if an executor that
+	// recently ran a task with an overlapping input tree was preferred, or
+	// `no_match` otherwise.
+	InputTreeRoutingStatusLabel = "status"
+
+	// A queue-time SLO decision made when scheduling a task: `borrowed` if the
+	// task was scheduled on one of its group's borrow pools, `over_budget` if
+	// the group was over its queue-time budget but no borrow pool had
+	// capacity, or `shed` if the task was rejected because every pool it
+	// could run on was saturated.
+	QueueTimeSLODecisionLabel = "decision"
+
+	// Whether a task was claimed by an executor in the same region as the
+	// app: `same_region`, `cross_region`, or `unknown` if the executor's
+	// region isn't known.
+	RegionLocalityLabel = "region_locality"
+
+	// The outcome of speculatively executing a slow action: `hedge_won` if
+	// the speculative copy finished first, `original_won` if the original
+	// execution finished first, `hedge_failed` if the speculative copy failed,
+	// or `capped` if no copy was started because the group already had the
+	// maximum number of speculative executions running.
+	SpeculativeExecutionOutcomeLabel = "outcome"
+
 	// Status of the task size read request: `hit`, `miss`, or `error`.
 	TaskSizeReadStatusLabel = "status"
 
@@ -238,6 +272,23 @@ const (
 	// One of: "expired" or "size"
 	LookasideCacheEvictionReason = "eviction_reason"
 
+	// The reason an item was removed from the pebble cache hot tier.
+	// One of: "size", "manual" or "conflict".
+	PebbleCacheHotTierEvictionReason = "eviction_reason"
+
+	// The result of a FindMissing bloom filter lookup in the pebble cache:
+	// "definitely_missing", "maybe_present", or "not_ready" (the filter
+	// hasn't been built yet).
+	PebbleCacheFindMissingFilterResult = "filter_result"
+
+	// How a cache write was handled by admission control: "admitted" (without
+	// waiting), "queued" (admitted after waiting for load to drop), or "shed".
+	CacheWriteAdmissionDecision = "decision"
+
+	// Why admission control considered the cache overloaded:
+	// "compaction_debt" or "disk_write_throughput".
+	CacheWriteAdmissionOverloadReason = "overload_reason"
+
 	// Distributed cache operation name, such as "FindMissing" or "Get".
 	DistributedCacheOperation = "op"
 
@@ -401,6 +452,22 @@ var (
 		Help:      "How long it took to finalize an invocation's stats, in **microseconds**. This includes the time required to wait for all BuildBuddy apps to flush their local metrics to Redis (if applicable) and then record the metrics to the DB.",
 	})
 
+	InvocationJanitorDeletions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "invocation",
+		Name:      "janitor_deletion_count",
+		Help:      "Number of expired invocations deleted by the invocation janitor, by status of the deletion.",
+	}, []string{
+		StatusHumanReadableLabel,
+	})
+
+	InvocationJanitorExpiredBacklog = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "invocation",
+		Name:      "janitor_expired_backlog",
+		Help:      "Number of expired invocations found by the invocation janitor's most recent cleanup task, up to the cleanup batch size. Stays at the batch size while the janitor is behind, and drops once it has caught up.",
+	})
+
 	WebhookInvocationLookupWorkers = promauto.NewGauge(prometheus.GaugeOpts{
 		Namespace: bbNamespace,
 		Subsystem: "invocation",
@@ -500,6 +567,20 @@ var (
 		Help:      "Size in bytes of the first file requested to be inlined (if any).",
 	}, []string{})
 
+	ActionCacheMissingOutputsCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_cache",
+		Name:      "action_cache_missing_outputs_count",
+		Help:      "Number of ActionResults read from the action cache that referenced outputs missing from the CAS.",
+	})
+
+	ActionCacheInvalidatedCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_cache",
+		Name:      "action_cache_invalidated_count",
+		Help:      "Number of ActionResults read from the action cache that were reported as misses because they were invalidated.",
+	})
+
 	// #### Examples
 	//
 	// ```promql
@@ -1004,6 +1085,16 @@ var (
 		GroupID,
 	})
 
+	RemoteExecutionSpeculativeExecutions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "speculative_executions",
+		Help:      "Number of slow executions for which a speculative copy was considered, by outcome.",
+	}, []string{
+		GroupID,
+		SpeculativeExecutionOutcomeLabel,
+	})
+
 	RemoteExecutionMergedActionsPerExecution = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: bbNamespace,
 		Subsystem: "remote_execution",
@@ -1031,6 +1122,54 @@ var (
 	// sum(rate(buildbuddy_remote_execution_merged_actions[1m])) by (group_id)
 	// ```
 
+	RemoteExecutionPoolQueuedTaskCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "pool_queued_task_count",
+		Help:      "Number of tasks queued for an executor pool that haven't been claimed by an executor yet. Intended for autoscaling executor pools.",
+	}, []string{
+		GroupID,
+		OS,
+		Arch,
+		Pool,
+	})
+
+	RemoteExecutionPoolQueuedTaskMaxAgeSeconds = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "pool_queued_task_max_age_seconds",
+		Help:      "How long the oldest unclaimed task queued for an executor pool has been waiting, in **seconds**. Intended for autoscaling executor pools.",
+	}, []string{
+		GroupID,
+		OS,
+		Arch,
+		Pool,
+	})
+
+	RemoteExecutionPoolQueuedMilliCPU = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "pool_queued_milli_cpu",
+		Help:      "Total estimated milli-CPU of the unclaimed tasks queued for an executor pool. Intended for autoscaling executor pools.",
+	}, []string{
+		GroupID,
+		OS,
+		Arch,
+		Pool,
+	})
+
+	RemoteExecutionPoolQueuedMemoryBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "pool_queued_memory_bytes",
+		Help:      "Total estimated memory, in **bytes**, of the unclaimed tasks queued for an executor pool. Intended for autoscaling executor pools.",
+	}, []string{
+		GroupID,
+		OS,
+		Arch,
+		Pool,
+	})
+
 	// Note: RemoteExecutionQueueLength is exported to customers.
 	RemoteExecutionQueueLength = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: bbNamespace,
@@ -1094,6 +1233,15 @@ var (
 		Help:      "Estimated CPU time on the executor that is currently allocated for task execution, in **milliCPU** (CPU-milliseconds per second).",
 	})
 
+	RemoteExecutionAssignedCustomResources = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "assigned_custom_resources",
+		Help:      "Amount of each custom resource on the executor (configured with `executor.custom_resources`) that is currently allocated for task execution.",
+	}, []string{
+		CustomResourceNameLabel,
+	})
+
 	RemoteExecutionAssignedOrQueuedEstimatedMilliCPU = promauto.NewGauge(prometheus.GaugeOpts{
 		Namespace: bbNamespace,
 		Subsystem: "remote_execution",
@@ -1171,6 +1319,44 @@ var (
 		Help:      "Per-file download duration during remote execution, in **microseconds**.",
 	})
 
+	FileLocalCacheHitSizeBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "file_local_cache_hit_size_bytes",
+		Buckets:   prometheus.ExponentialBuckets(1, 10, 9),
+		Help:      "Total number of input bytes linked from the executor's local file cache during remote execution, rather than downloaded.",
+	})
+
+	RemoteExecutionInputTreeRoutedTaskCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "input_tree_routed_task_count",
+		Help:      "Number of tasks ranked by input tree routing, which prefers executors that recently ran tasks with overlapping input trees.",
+	}, []string{
+		InputTreeRoutingStatusLabel,
+	})
+
+	RemoteExecutionQueueTimeSLODecisionCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "queue_time_slo_decision_count",
+		Help:      "Number of tasks that were scheduled on a borrow pool, scheduled despite their group being over its queue-time budget, or shed, by the group and the pool that the task requested.",
+	}, []string{
+		GroupID,
+		Pool,
+		QueueTimeSLODecisionLabel,
+	})
+
+	RemoteExecutionRegionLocalityCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "region_locality_count",
+		Help:      "Number of tasks claimed by executors, by whether the executor is in the same region as the app. Only recorded if the app's region is configured.",
+	}, []string{
+		Pool,
+		RegionLocalityLabel,
+	})
+
 	FileUploadCount = promauto.NewHistogram(prometheus.HistogramOpts{
 		Namespace: bbNamespace,
 		Subsystem: "remote_execution",
@@ -1265,6 +1451,14 @@ var (
 		Help:      "Time taken to dial the VM guest execution server after it has been started or resumed, in **microseconds**.",
 	})
 
+	FirecrackerGuestClockDriftUsec = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: bbNamespace,
+		Subsystem: "firecracker",
+		Name:      "guest_clock_drift_usec",
+		Buckets:   durationUsecBuckets(1*time.Millisecond, 30*24*time.Hour, 2),
+		Help:      "How far the VM guest clock had drifted from the host clock when it was resynchronized after resuming the VM, in **microseconds**. Drift in either direction is counted.",
+	})
+
 	SnapshotRemoteCacheUploadSizeBytes = promauto.NewCounter(prometheus.CounterOpts{
 		Namespace: bbNamespace,
 		Subsystem: "firecracker",
@@ -1272,6 +1466,22 @@ var (
 		Help:      "After a copy-on-write snapshot has been used, the total count of bytes dirtied.",
 	})
 
+	SnapshotArtifactVerificationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "firecracker",
+		Name:      "snapshot_artifact_verification_failures",
+		Help:      "Number of snapshot artifacts (including copy-on-write chunks) whose contents did not match their digest when fetched.",
+	}, []string{
+		ChunkSource,
+	})
+
+	SnapshotCorruptionFallbacks = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "firecracker",
+		Name:      "snapshot_corruption_fallbacks",
+		Help:      "Number of times a VM was booted from scratch because its snapshot failed verification while being resumed.",
+	})
+
 	COWSnapshotDirtyChunkRatio = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: bbNamespace,
 		Subsystem: "firecracker",
@@ -1386,6 +1596,16 @@ var (
 		RunnerPoolFailedRecycleReason,
 	})
 
+	RunnerPoolRetirements = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "runner_pool_retirements",
+		Help:      "Number of recycled runners that were removed instead of being reused because of a recycling policy, such as a max task count or max age.",
+	}, []string{
+		RunnerPoolRetireReason,
+		IsolationTypeLabel,
+	})
+
 	RunnerPoolMemoryUsageBytes = promauto.NewGauge(prometheus.GaugeOpts{
 		Namespace: bbNamespace,
 		Subsystem: "remote_execution",
@@ -1409,6 +1629,30 @@ var (
 		FileCacheRequestStatusLabel,
 	})
 
+	WorkspaceInputLayerRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "workspace_input_layer_requests",
+		Help:      "Number of requests for a shared overlayfs input layer by an action workspace. Misses require materializing the input tree.",
+	}, []string{
+		CacheHitMissStatus,
+	})
+
+	WorkspaceInputLayerCount = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "workspace_input_layer_count",
+		Help:      "Number of materialized input trees cached as shared overlayfs input layers.",
+	})
+
+	WorkspaceCopyUpSizeBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "workspace_copy_up_size_bytes",
+		Buckets:   exponentialBucketRange(1, 1024*1024*1024*1024 /*1 TB*/, 4),
+		Help:      "Total size of the files written to the overlayfs upper dir of an action workspace, including inputs copied up due to writes.",
+	})
+
 	FileCacheLastEvictionAgeUsec = promauto.NewGauge(prometheus.GaugeOpts{
 		Namespace: bbNamespace,
 		Subsystem: "remote_execution",
@@ -1416,6 +1660,13 @@ var (
 		Help:      "Age of the last entry evicted from the executor's local file cache (relative to when it was added to the cache), in **microseconds**.",
 	})
 
+	FileCacheTrackedBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "file_cache_tracked_bytes",
+		Help:      "Total size of the files tracked by the executor's local file cache, in **bytes**.",
+	})
+
 	FileCacheAddedFileSizeBytes = promauto.NewHistogram(prometheus.HistogramOpts{
 		Namespace: bbNamespace,
 		Subsystem: "remote_execution",
@@ -2750,6 +3001,74 @@ var (
 		CacheNameLabel,
 	})
 
+	PebbleCacheDedupedChunkSizeBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_cache",
+		Name:      "pebble_cache_deduped_chunk_size_bytes",
+		Help:      "Number of bytes of chunks that were not written to pebble cache because an identical chunk was already stored.",
+	}, []string{
+		CacheNameLabel,
+	})
+
+	PebbleCacheHotTierRequestCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_cache",
+		Name:      "pebble_cache_hot_tier_request_count",
+		Help:      "Number of reads of hot tier eligible entries, by whether they were served from the in-memory hot tier (hit) or from disk (miss).",
+	}, []string{
+		CacheNameLabel,
+		CacheTypeLabel,
+		CacheHitMissStatus,
+	})
+
+	PebbleCacheHotTierSizeBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_cache",
+		Name:      "pebble_cache_hot_tier_size_bytes",
+		Help:      "Number of bytes currently held in the in-memory hot tier.",
+	}, []string{
+		CacheNameLabel,
+	})
+
+	PebbleCacheHotTierEvictionCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_cache",
+		Name:      "pebble_cache_hot_tier_eviction_count",
+		Help:      "Number of entries removed from the in-memory hot tier, by reason.",
+	}, []string{
+		CacheNameLabel,
+		PebbleCacheHotTierEvictionReason,
+	})
+
+	PebbleCacheFindMissingFilterLookupCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_cache",
+		Name:      "pebble_cache_find_missing_filter_lookup_count",
+		Help:      "Number of FindMissing lookups checked against a partition's bloom filter, by result. Only maybe_present and not_ready lookups are read from pebble.",
+	}, []string{
+		CacheNameLabel,
+		PartitionID,
+		PebbleCacheFindMissingFilterResult,
+	})
+
+	CacheWriteAdmissionCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_cache",
+		Name:      "write_admission_count",
+		Help:      "Number of cache write RPCs checked by admission control, by decision and, for writes that were queued or shed, the reason the cache was overloaded.",
+	}, []string{
+		CacheWriteAdmissionDecision,
+		CacheWriteAdmissionOverloadReason,
+	})
+
+	CacheWriteAdmissionQueueDurationUsec = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_cache",
+		Name:      "write_admission_queue_duration_usec",
+		Buckets:   durationUsecBuckets(1*time.Millisecond, 1*time.Minute, 2),
+		Help:      "Time that cache writes spent queued by admission control before being admitted or shed, in **microseconds**.",
+	})
+
 	// ## Podman metrics
 
 	PodmanSociStoreCrashes = promauto.NewCounter(prometheus.CounterOpts{
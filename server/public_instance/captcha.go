@@ -0,0 +1,292 @@
+package public_instance
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/http/csp"
+	"github.com/buildbuddy-io/buildbuddy/server/http/interceptors"
+	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/clientip"
+	"github.com/buildbuddy-io/buildbuddy/server/util/cookie"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+var (
+	captchaProviderName = flag.String("public_instance.captcha.provider", "", "The CAPTCHA service that anonymous visitors of a public instance must pass before downloading artifacts and logs: 'turnstile', 'hcaptcha' or 'recaptcha'. If empty, no CAPTCHA is required.")
+	captchaSiteKey      = flag.String("public_instance.captcha.site_key", "", "The site key of the CAPTCHA service.")
+	captchaSecretKey    = flag.String("public_instance.captcha.secret_key", "", "The secret key of the CAPTCHA service. Also used to sign the cookie that remembers a passed CAPTCHA, which is only valid for the client IP that passed it.", flag.Secret)
+)
+
+const (
+	// CaptchaVerifyPath is where the CAPTCHA page posts its response.
+	CaptchaVerifyPath = "/captcha/verify"
+
+	captchaCookie = "Captcha-Verified"
+	// How long a passed CAPTCHA lets a visitor download without solving
+	// another one.
+	captchaCookieDuration = time.Hour
+
+	redirectURLField = "redirect_url"
+)
+
+type captchaCookieKey struct{}
+
+type captchaProvider struct {
+	// The script that renders the widget.
+	scriptURL string
+	// The class of the element that the script renders the widget into.
+	widgetClass string
+	// The form field that the widget fills with its response token.
+	responseField string
+	// The endpoint that checks a response token.
+	verifyURL string
+}
+
+var captchaProviders = map[string]*captchaProvider{
+	"turnstile": {
+		scriptURL:     "https://challenges.cloudflare.com/turnstile/v0/api.js",
+		widgetClass:   "cf-turnstile",
+		responseField: "cf-turnstile-response",
+		verifyURL:     "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+	},
+	"hcaptcha": {
+		scriptURL:     "https://js.hcaptcha.com/1/api.js",
+		widgetClass:   "h-captcha",
+		responseField: "h-captcha-response",
+		verifyURL:     "https://api.hcaptcha.com/siteverify",
+	},
+	"recaptcha": {
+		scriptURL:     "https://www.google.com/recaptcha/api.js",
+		widgetClass:   "g-recaptcha",
+		responseField: "g-recaptcha-response",
+		verifyURL:     "https://www.google.com/recaptcha/api/siteverify",
+	},
+}
+
+var captchaPage = template.Must(template.New("captcha").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Verify download | BuildBuddy</title>
+<script src="{{.ScriptURL}}" nonce="{{.Nonce}}" async defer></script>
+<style nonce="{{.Nonce}}">
+body { font-family: sans-serif; display: flex; justify-content: center; margin-top: 96px; color: #212121; }
+form { display: flex; flex-direction: column; align-items: center; gap: 16px; }
+button { font-size: 16px; padding: 8px 16px; cursor: pointer; }
+</style>
+</head>
+<body>
+<form method="POST" action="{{.VerifyPath}}">
+<div>Please confirm that you're human to view this page.</div>
+<input type="hidden" name="{{.RedirectURLField}}" value="{{.RedirectURL}}">
+<div class="{{.WidgetClass}}" data-sitekey="{{.SiteKey}}"></div>
+<button type="submit">Download</button>
+</form>
+</body>
+</html>
+`))
+
+// CaptchaEnabled returns whether anonymous visitors must pass a CAPTCHA
+// before downloading artifacts.
+func CaptchaEnabled() bool {
+	return *enabled && *captchaProviderName != ""
+}
+
+// Register registers the handler that verifies CAPTCHA responses.
+func Register(env *real_environment.RealEnv) error {
+	if !CaptchaEnabled() {
+		return nil
+	}
+	if _, ok := captchaProviders[*captchaProviderName]; !ok {
+		return status.InvalidArgumentErrorf("unknown public_instance.captcha.provider %q", *captchaProviderName)
+	}
+	if *captchaSiteKey == "" || *captchaSecretKey == "" {
+		return status.FailedPreconditionError("public_instance.captcha.site_key and public_instance.captcha.secret_key are required when public_instance.captcha.provider is set")
+	}
+	env.GetMux().Handle(CaptchaVerifyPath, interceptors.WrapExternalHandler(env, &captchaHandler{client: &http.Client{Timeout: 10 * time.Second}}))
+	return nil
+}
+
+// PassedCaptcha returns whether the request carries proof of a CAPTCHA that
+// was recently passed from the same client IP.
+func PassedCaptcha(r *http.Request) bool {
+	return passedCaptcha(r.Context(), cookie.GetCookie(r, captchaCookie))
+}
+
+func passedCaptcha(ctx context.Context, cookieValue string) bool {
+	expiryStr, mac, ok := strings.Cut(cookieValue, ".")
+	if !ok {
+		return false
+	}
+	expiry, err := strconv.ParseInt(expiryStr, 10, 64)
+	if err != nil || time.Now().Unix() > expiry {
+		return false
+	}
+	return hmac.Equal([]byte(mac), []byte(signCaptchaCookie(clientip.Get(ctx), expiryStr)))
+}
+
+// WithCaptchaCookie passes the CAPTCHA cookie of HTTP requests on to their
+// contexts, so that RPC handlers can call CheckCaptcha.
+func WithCaptchaCookie(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if CaptchaEnabled() {
+			ctx := context.WithValue(r.Context(), captchaCookieKey{}, cookie.GetCookie(r, captchaCookie))
+			r = r.WithContext(ctx)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CheckCaptcha returns a PermissionDenied error if anonymous visitors must
+// pass a CAPTCHA, the caller isn't authenticated, and the request that ctx
+// belongs to doesn't carry proof of a recently passed CAPTCHA.
+func CheckCaptcha(ctx context.Context, env environment.Env) error {
+	if !CaptchaEnabled() {
+		return nil
+	}
+	if _, err := env.GetAuthenticator().AuthenticatedUser(ctx); err == nil {
+		return nil
+	}
+	cookieValue, _ := ctx.Value(captchaCookieKey{}).(string)
+	if passedCaptcha(ctx, cookieValue) {
+		return nil
+	}
+	return status.PermissionDeniedErrorf("Anonymous visitors must pass a CAPTCHA first. Visit %s?%s=/ to continue.", CaptchaVerifyPath, redirectURLField)
+}
+
+// ServeCaptcha responds with a page that asks the visitor to pass a CAPTCHA and
+// then retries the request.
+func ServeCaptcha(w http.ResponseWriter, r *http.Request) {
+	p := captchaProviders[*captchaProviderName]
+	if p == nil {
+		http.Error(w, "CAPTCHA is misconfigured", http.StatusInternalServerError)
+		return
+	}
+	nonce, _ := r.Context().Value(csp.Nonce{}).(string)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	err := captchaPage.Execute(w, map[string]string{
+		"ScriptURL":        p.scriptURL,
+		"Nonce":            nonce,
+		"VerifyPath":       CaptchaVerifyPath,
+		"RedirectURLField": redirectURLField,
+		"RedirectURL":      r.URL.RequestURI(),
+		"WidgetClass":      p.widgetClass,
+		"SiteKey":          *captchaSiteKey,
+	})
+	if err != nil {
+		log.Warningf("Failed to render CAPTCHA page: %s", err)
+	}
+}
+
+// signCaptchaCookie signs the expiry of a passed CAPTCHA along with the IP of
+// the client that passed it, so that the cookie can't be shared with other
+// clients.
+func signCaptchaCookie(ip, expiry string) string {
+	mac := hmac.New(sha256.New, []byte(*captchaSecretKey))
+	mac.Write([]byte(captchaCookie + ":" + ip + ":" + expiry))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func setCaptchaCookie(w http.ResponseWriter, r *http.Request) {
+	expiry := time.Now().Add(captchaCookieDuration)
+	expiryStr := strconv.FormatInt(expiry.Unix(), 10)
+	mac := signCaptchaCookie(clientip.Get(r.Context()), expiryStr)
+	cookie.SetCookie(w, captchaCookie, expiryStr+"."+mac, expiry, true /*=httpOnly*/)
+}
+
+// isLocalPath returns whether the URL stays on this site, so that the verify
+// handler can't be used as an open redirect.
+func isLocalPath(u string) bool {
+	return strings.HasPrefix(u, "/") && !strings.HasPrefix(u, "//") && !strings.HasPrefix(u, "/\\")
+}
+
+type captchaHandler struct {
+	client *http.Client
+}
+
+func (h *captchaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Pages that can't serve the CAPTCHA page themselves, such as the
+	// invocation page when its logs are requested over RPC, link here.
+	if r.Method == http.MethodGet {
+		redirectURL := r.URL.Query().Get(redirectURLField)
+		u, err := url.Parse(redirectURL)
+		if err != nil || !isLocalPath(redirectURL) {
+			http.Error(w, "Invalid redirect URL", http.StatusBadRequest)
+			return
+		}
+		r = r.Clone(r.Context())
+		r.URL = u
+		ServeCaptcha(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p := captchaProviders[*captchaProviderName]
+	redirectURL := r.PostFormValue(redirectURLField)
+	if !isLocalPath(redirectURL) {
+		http.Error(w, "Invalid redirect URL", http.StatusBadRequest)
+		return
+	}
+	if err := h.verify(r, p, r.PostFormValue(p.responseField)); err != nil {
+		log.CtxInfof(r.Context(), "CAPTCHA verification failed: %s", err)
+		http.Error(w, "CAPTCHA verification failed. Go back and try again.", http.StatusForbidden)
+		return
+	}
+	setCaptchaCookie(w, r)
+	http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+}
+
+func (h *captchaHandler) verify(r *http.Request, p *captchaProvider, token string) error {
+	if token == "" {
+		return status.InvalidArgumentError("missing CAPTCHA response")
+	}
+	form := url.Values{
+		"secret":   {*captchaSecretKey},
+		"response": {token},
+	}
+	if ip := clientip.Get(r.Context()); ip != "" {
+		form.Set("remoteip", ip)
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, p.verifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rsp, err := h.client.Do(req)
+	if err != nil {
+		return status.UnavailableErrorf("verify CAPTCHA response: %s", err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return status.UnavailableErrorf("verify CAPTCHA response: HTTP %d", rsp.StatusCode)
+	}
+	result := struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}{}
+	if err := json.NewDecoder(rsp.Body).Decode(&result); err != nil {
+		return status.UnavailableErrorf("decode CAPTCHA verification response: %s", err)
+	}
+	if !result.Success {
+		return status.PermissionDeniedErrorf("CAPTCHA response rejected: %v", result.ErrorCodes)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// Package public_instance hardens an app that accepts build events from
+// anyone, such as a public community instance: anonymous invocations are rate
+// limited, redacted more aggressively and expire, and anonymous visitors have
+// to solve a CAPTCHA before downloading artifacts.
+package public_instance
+
+import (
+	"context"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/clientip"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/lru"
+	"github.com/buildbuddy-io/buildbuddy/server/util/redact"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"golang.org/x/time/rate"
+)
+
+var (
+	enabled                     = flag.Bool("public_instance.enabled", false, "If true, the app is hardened for accepting build events without an API key, such as on a public community instance. Anonymous invocations are rate limited per client IP, have all environment variable values and credential-like options redacted, expire after public_instance.anonymous_invocation_ttl, and their cache artifacts aren't copied to the blobstore. Anonymous visitors must solve a CAPTCHA to download artifacts if public_instance.captcha.provider is set.")
+	anonymousInvocationsPerHour = flag.Int("public_instance.anonymous_invocations_per_hour", 60, "How many anonymous invocations a single client IP may upload per hour. 0 means no limit.")
+	anonymousInvocationTTL      = flag.Duration("public_instance.anonymous_invocation_ttl", 7*24*time.Hour, "How long anonymous invocations are kept before the janitor deletes them. 0 means they're kept as long as other invocations.")
+)
+
+const (
+	// The most client IPs whose recent uploads are tracked at once.
+	maxTrackedClientIPs = 100_000
+)
+
+var (
+	// anonymousRedactionRules are applied to anonymous invocations on top of
+	// the standard redactions, since there's no organization to configure
+	// rules of its own.
+	anonymousRedactionRules = &redact.CustomRules{
+		EnvVarNames: []*regexp.Regexp{regexp.MustCompile(`.*`)},
+		FlagNames:   []*regexp.Regexp{regexp.MustCompile(`(?i).*(token|secret|password|passwd|credential|api_?key|auth).*`)},
+		URLs:        []*regexp.Regexp{regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)},
+	}
+
+	mu       sync.Mutex // protects(limiters)
+	limiters *lru.LRU[*rate.Limiter]
+)
+
+// Enabled returns whether the app runs as a public instance.
+func Enabled() bool {
+	return *enabled
+}
+
+// AnonymousInvocationTTL returns how long anonymous invocations are kept, or 0
+// if they aren't deleted sooner than other invocations.
+func AnonymousInvocationTTL() time.Duration {
+	if !*enabled {
+		return 0
+	}
+	return *anonymousInvocationTTL
+}
+
+// RedactionRules returns the rules applied to anonymous invocations.
+func RedactionRules() *redact.CustomRules {
+	return anonymousRedactionRules
+}
+
+// AllowAnonymousInvocation returns a ResourceExhausted error if the client
+// that sent the request has uploaded too many anonymous invocations recently.
+func AllowAnonymousInvocation(ctx context.Context) error {
+	if !*enabled || *anonymousInvocationsPerHour <= 0 {
+		return nil
+	}
+	ip := clientip.Get(ctx)
+	l, err := limiterFor(ip)
+	if err != nil {
+		return err
+	}
+	if !l.Allow() {
+		return status.ResourceExhaustedErrorf("Too many anonymous invocations from %q; use an API key or try again later.", ip)
+	}
+	return nil
+}
+
+func limiterFor(ip string) (*rate.Limiter, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if limiters == nil {
+		l, err := lru.NewLRU[*rate.Limiter](&lru.Config[*rate.Limiter]{
+			// Evicting a limiter only forgets a client's recent uploads, so
+			// it's fine to bound memory by the number of clients.
+			SizeFn:  func(*rate.Limiter) int64 { return 1 },
+			MaxSize: maxTrackedClientIPs,
+		})
+		if err != nil {
+			return nil, err
+		}
+		limiters = l
+	}
+	if l, ok := limiters.Get(ip); ok {
+		return l, nil
+	}
+	perHour := *anonymousInvocationsPerHour
+	l := rate.NewLimiter(rate.Every(time.Hour/time.Duration(perHour)), perHour)
+	limiters.Add(ip, l)
+	return l, nil
+}
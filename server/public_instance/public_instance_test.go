@@ -0,0 +1,185 @@
+package public_instance
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/util/clientip"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowAnonymousInvocation(t *testing.T) {
+	flags.Set(t, "public_instance.enabled", true)
+	flags.Set(t, "public_instance.anonymous_invocations_per_hour", 2)
+	ctx1 := context.WithValue(context.Background(), clientip.ContextKey, t.Name()+"-1")
+	ctx2 := context.WithValue(context.Background(), clientip.ContextKey, t.Name()+"-2")
+
+	require.NoError(t, AllowAnonymousInvocation(ctx1))
+	require.NoError(t, AllowAnonymousInvocation(ctx1))
+	err := AllowAnonymousInvocation(ctx1)
+	assert.True(t, status.IsResourceExhaustedError(err), "expected ResourceExhausted error, got %v", err)
+
+	// Each client has its own limit.
+	require.NoError(t, AllowAnonymousInvocation(ctx2))
+
+	// There's no limit outside of public instances.
+	flags.Set(t, "public_instance.enabled", false)
+	require.NoError(t, AllowAnonymousInvocation(ctx1))
+}
+
+func setUpCaptcha(t *testing.T, verify http.HandlerFunc) *captchaHandler {
+	verifyServer := httptest.NewServer(verify)
+	t.Cleanup(verifyServer.Close)
+	captchaProviders["test"] = &captchaProvider{
+		scriptURL:     "https://captcha.example.com/api.js",
+		widgetClass:   "test-captcha",
+		responseField: "test-captcha-response",
+		verifyURL:     verifyServer.URL,
+	}
+	t.Cleanup(func() { delete(captchaProviders, "test") })
+	flags.Set(t, "public_instance.enabled", true)
+	flags.Set(t, "public_instance.captcha.provider", "test")
+	flags.Set(t, "public_instance.captcha.site_key", "site-key")
+	flags.Set(t, "public_instance.captcha.secret_key", "secret-key")
+	return &captchaHandler{client: verifyServer.Client()}
+}
+
+// newRequest returns a request from the given client IP.
+func newRequest(method, target, ip string, body io.Reader) *http.Request {
+	r := httptest.NewRequest(method, target, body)
+	return r.WithContext(context.WithValue(r.Context(), clientip.ContextKey, ip))
+}
+
+func postCaptchaResponse(h http.Handler, form url.Values) *httptest.ResponseRecorder {
+	r := newRequest(http.MethodPost, CaptchaVerifyPath, "1.2.3.4", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestCaptcha(t *testing.T) {
+	h := setUpCaptcha(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("secret") == "secret-key" && r.PostFormValue("response") == "good-token" {
+			w.Write([]byte(`{"success": true}`))
+			return
+		}
+		w.Write([]byte(`{"success": false, "error-codes": ["invalid-input-response"]}`))
+	})
+	download := "/file/download?invocation_id=abc&artifact=buildlog&attempt=1"
+
+	// Anonymous visitors get the CAPTCHA page, which retries the download
+	// once it's solved.
+	r := httptest.NewRequest(http.MethodGet, download, nil)
+	require.False(t, PassedCaptcha(r))
+	w := httptest.NewRecorder()
+	ServeCaptcha(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), `data-sitekey="site-key"`)
+	assert.Contains(t, w.Body.String(), `value="/file/download?invocation_id=abc&amp;artifact=buildlog&amp;attempt=1"`)
+
+	// A rejected response doesn't set the cookie.
+	w = postCaptchaResponse(h, url.Values{"test-captcha-response": {"bad-token"}, "redirect_url": {download}})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, w.Result().Cookies())
+
+	// The verify handler only redirects within the site.
+	w = postCaptchaResponse(h, url.Values{"test-captcha-response": {"good-token"}, "redirect_url": {"//evil.example.com/"}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = postCaptchaResponse(h, url.Values{"test-captcha-response": {"good-token"}, "redirect_url": {download}})
+	require.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, download, w.Header().Get("Location"))
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+
+	r = newRequest(http.MethodGet, download, "1.2.3.4", nil)
+	r.AddCookie(cookies[0])
+	assert.True(t, PassedCaptcha(r))
+
+	// The cookie is only valid for the client that passed the CAPTCHA.
+	r = newRequest(http.MethodGet, download, "5.6.7.8", nil)
+	r.AddCookie(cookies[0])
+	assert.False(t, PassedCaptcha(r))
+
+	// The cookie can't be forged without the secret key.
+	expiry, _, _ := strings.Cut(cookies[0].Value, ".")
+	r = newRequest(http.MethodGet, download, "1.2.3.4", nil)
+	r.AddCookie(&http.Cookie{Name: captchaCookie, Value: expiry + ".forged"})
+	assert.False(t, PassedCaptcha(r))
+
+	flags.Set(t, "public_instance.captcha.secret_key", "rotated-secret-key")
+	r = newRequest(http.MethodGet, download, "1.2.3.4", nil)
+	r.AddCookie(cookies[0])
+	assert.False(t, PassedCaptcha(r))
+}
+
+func TestCaptchaPageForRPCs(t *testing.T) {
+	h := setUpCaptcha(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest(http.MethodGet, CaptchaVerifyPath+"?redirect_url=%2Finvocation%2Fabc", "1.2.3.4", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), `data-sitekey="site-key"`)
+	assert.Contains(t, w.Body.String(), `value="/invocation/abc"`)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest(http.MethodGet, CaptchaVerifyPath+"?redirect_url=https://evil.example.com/", "1.2.3.4", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestCheckCaptcha(t *testing.T) {
+	setUpCaptcha(t, func(w http.ResponseWriter, r *http.Request) {})
+	env := real_environment.NewBatchEnv()
+	ta := testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1"))
+	env.SetAuthenticator(ta)
+
+	// checkRPC calls CheckCaptcha from an RPC handler that's served over HTTP,
+	// as RPCs from the app are.
+	checkRPC := func(ctx context.Context, cookies ...*http.Cookie) error {
+		var err error
+		h := WithCaptchaCookie(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			err = CheckCaptcha(r.Context(), env)
+		}))
+		r := httptest.NewRequest(http.MethodPost, "/rpc/BuildBuddyService/GetEventLogChunk", nil).WithContext(ctx)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		return err
+	}
+	ctx := context.WithValue(context.Background(), clientip.ContextKey, "1.2.3.4")
+
+	err := checkRPC(ctx)
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+
+	// Logged-in users don't need to pass a CAPTCHA.
+	authCtx, err := ta.WithAuthenticatedUser(ctx, "US1")
+	require.NoError(t, err)
+	require.NoError(t, checkRPC(authCtx))
+
+	w := httptest.NewRecorder()
+	setCaptchaCookie(w, httptest.NewRequest(http.MethodPost, CaptchaVerifyPath, nil).WithContext(ctx))
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+	require.NoError(t, checkRPC(ctx, cookies[0]))
+
+	// The cookie is only valid for the client that passed the CAPTCHA.
+	otherCtx := context.WithValue(context.Background(), clientip.ContextKey, "5.6.7.8")
+	err = checkRPC(otherCtx, cookies[0])
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+
+	// Nothing is gated without a CAPTCHA provider.
+	flags.Set(t, "public_instance.captcha.provider", "")
+	require.NoError(t, checkRPC(ctx))
+}
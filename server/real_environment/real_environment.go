@@ -117,6 +117,8 @@ type RealEnv struct {
 	promQuerier                      interfaces.PromQuerier
 	auditLog                         interfaces.AuditLogger
 	ipRulesService                   interfaces.IPRulesService
+	oidcFederationService            interfaces.OIDCFederationService
+	oidcProviderService              interfaces.OIDCProviderService
 	serverIdentityService            interfaces.ClientIdentityService
 	imageCacheAuthenticator          interfaces.ImageCacheAuthenticator
 	serverNotificationService        interfaces.ServerNotificationService
@@ -131,6 +133,7 @@ type RealEnv struct {
 	pubsub                           interfaces.PubSub
 	clock                            clockwork.Clock
 	atimeUpdater                     interfaces.AtimeUpdater
+	logIndex                         interfaces.LogIndex
 }
 
 // NewRealEnv returns an environment for use in servers.
@@ -700,6 +703,22 @@ func (r *RealEnv) SetIPRulesService(e interfaces.IPRulesService) {
 	r.ipRulesService = e
 }
 
+func (r *RealEnv) GetOIDCFederationService() interfaces.OIDCFederationService {
+	return r.oidcFederationService
+}
+
+func (r *RealEnv) SetOIDCFederationService(s interfaces.OIDCFederationService) {
+	r.oidcFederationService = s
+}
+
+func (r *RealEnv) GetOIDCProviderService() interfaces.OIDCProviderService {
+	return r.oidcProviderService
+}
+
+func (r *RealEnv) SetOIDCProviderService(s interfaces.OIDCProviderService) {
+	r.oidcProviderService = s
+}
+
 func (r *RealEnv) GetClientIdentityService() interfaces.ClientIdentityService {
 	return r.serverIdentityService
 }
@@ -797,3 +816,10 @@ func (r *RealEnv) GetAtimeUpdater() interfaces.AtimeUpdater {
 func (r *RealEnv) SetAtimeUpdater(updater interfaces.AtimeUpdater) {
 	r.atimeUpdater = updater
 }
+
+func (r *RealEnv) GetLogIndex() interfaces.LogIndex {
+	return r.logIndex
+}
+func (r *RealEnv) SetLogIndex(logIndex interfaces.LogIndex) {
+	r.logIndex = logIndex
+}
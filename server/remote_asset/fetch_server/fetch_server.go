@@ -36,6 +36,10 @@ const (
 	BazelCanonicalIDQualifier         = "bazel.canonical_id"
 	BazelHttpHeaderPrefixQualifier    = "http_header:"
 	BazelHttpHeaderUrlPrefixQualifier = "http_header_url:"
+	ResourceTypeQualifier             = "resource_type"
+	VCSBranchQualifier                = "vcs.branch"
+	VCSCommitQualifier                = "vcs.commit"
+	GitResourceType                   = "application/x-git"
 	maxHTTPTimeout                    = 60 * time.Minute
 )
 
@@ -78,7 +82,10 @@ func timeoutFromContext(ctx context.Context) (time.Duration, bool) {
 	return time.Until(deadline), true
 }
 
-func timeoutHTTPClient(ctx context.Context, protoTimeout *durationpb.Duration) *http.Client {
+// fetchTimeout returns how long fetching a resource may take, which is the
+// timeout of the request if set, or else the time left until the deadline of
+// the context, capped at maxHTTPTimeout.
+func fetchTimeout(ctx context.Context, protoTimeout *durationpb.Duration) time.Duration {
 	timeout := time.Duration(0)
 	if ctxDuration, ok := timeoutFromContext(ctx); ok {
 		timeout = ctxDuration
@@ -89,6 +96,11 @@ func timeoutHTTPClient(ctx context.Context, protoTimeout *durationpb.Duration) *
 	if timeout == 0 || timeout > maxHTTPTimeout {
 		timeout = maxHTTPTimeout
 	}
+	return timeout
+}
+
+func timeoutHTTPClient(ctx context.Context, protoTimeout *durationpb.Duration) *http.Client {
+	timeout := fetchTimeout(ctx, protoTimeout)
 
 	tp := &http.Transport{
 		Dial: (&net.Dialer{
@@ -104,6 +116,18 @@ func timeoutHTTPClient(ctx context.Context, protoTimeout *durationpb.Duration) *
 	}
 }
 
+// credentialsFromHeader returns the credentials in the Authorization header
+// supplied using the http_header qualifiers, which are also used to
+// authenticate to git servers and container registries. Either a username and
+// password (for basic auth) or a bearer token is returned.
+func credentialsFromHeader(header http.Header) (username, password, token string) {
+	if token, ok := strings.CutPrefix(header.Get("Authorization"), "Bearer "); ok {
+		return "", "", token
+	}
+	username, password, _ = (&http.Request{Header: header}).BasicAuth()
+	return username, password, ""
+}
+
 // parseChecksumQualifier returns a digest function and digest hash
 // given a "checksum.sri" qualifier.
 func parseChecksumQualifier(qualifier *rapb.Qualifier) (repb.DigestFunction_Value, string, error) {
@@ -136,6 +160,8 @@ func (p *FetchServer) FetchBlob(ctx context.Context, req *rapb.FetchBlobRequest)
 	uriHeaders := make(map[int]http.Header)
 	var checksumFunc repb.DigestFunction_Value
 	var expectedChecksum string
+	var resourceType string
+	var gitSrc *gitSource
 	for _, qualifier := range req.GetQualifiers() {
 		if qualifier.GetName() == ChecksumQualifier {
 			checksumFunc, expectedChecksum, err = parseChecksumQualifier(qualifier)
@@ -179,6 +205,35 @@ func (p *FetchServer) FetchBlob(ctx context.Context, req *rapb.FetchBlobRequest)
 			// TODO: Implement canonical ID handling.
 			continue
 		}
+		if qualifier.GetName() == ResourceTypeQualifier {
+			resourceType = qualifier.GetValue()
+			continue
+		}
+		if qualifier.GetName() == VCSBranchQualifier || qualifier.GetName() == VCSCommitQualifier {
+			if gitSrc == nil {
+				gitSrc = &gitSource{}
+			}
+			if qualifier.GetName() == VCSBranchQualifier {
+				gitSrc.branch = qualifier.GetValue()
+			} else {
+				gitSrc.commit = qualifier.GetValue()
+			}
+			continue
+		}
+	}
+	if gitSrc == nil && resourceType == GitResourceType {
+		// Fetch the tip of the default branch.
+		gitSrc = &gitSource{}
+	}
+	if gitSrc != nil {
+		if err := gitSrc.validate(); err != nil {
+			return nil, err
+		}
+		for _, uri := range req.GetUris() {
+			if err := validateGitURI(uri); err != nil {
+				return nil, err
+			}
+		}
 	}
 	if len(expectedChecksum) != 0 {
 		blobDigest := p.findBlobInCache(ctx, req.GetInstanceName(), checksumFunc, expectedChecksum)
@@ -216,17 +271,46 @@ func (p *FetchServer) FetchBlob(ctx context.Context, req *rapb.FetchBlobRequest)
 				}
 			}
 		}
-		blobDigest, err := mirrorToCache(
-			ctx,
-			p.env.GetByteStreamClient(),
-			req.GetInstanceName(),
-			httpClient,
-			uri,
-			header,
-			storageFunc,
-			checksumFunc,
-			expectedChecksum,
-		)
+		var blobDigest *repb.Digest
+		switch {
+		case gitSrc != nil:
+			blobDigest, err = mirrorGitToCache(
+				ctx,
+				p.env.GetByteStreamClient(),
+				req.GetInstanceName(),
+				uri,
+				header,
+				gitSrc,
+				fetchTimeout(ctx, req.GetTimeout()),
+				storageFunc,
+				checksumFunc,
+				expectedChecksum,
+			)
+		case isContainerResourceType(resourceType):
+			blobDigest, err = p.mirrorImageToCache(
+				ctx,
+				req.GetInstanceName(),
+				httpClient,
+				uri,
+				header,
+				resourceType,
+				storageFunc,
+				checksumFunc,
+				expectedChecksum,
+			)
+		default:
+			blobDigest, err = mirrorToCache(
+				ctx,
+				p.env.GetByteStreamClient(),
+				req.GetInstanceName(),
+				httpClient,
+				uri,
+				header,
+				storageFunc,
+				checksumFunc,
+				expectedChecksum,
+			)
+		}
 		if err != nil {
 			lastFetchErr = err
 			log.CtxWarningf(ctx, "Failed to mirror %q to cache: %s", uri, err)
@@ -1,13 +1,19 @@
 package fetch_server_test
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"net/http"
+	"net/http/cgi"
 	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -16,15 +22,23 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/byte_stream_server"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testgit"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testregistry"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/scratchspace"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
 
 	rapb "github.com/buildbuddy-io/buildbuddy/proto/remote_asset"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	bspb "google.golang.org/genproto/googleapis/bytestream"
+	gcodes "google.golang.org/grpc/codes"
 )
 
 func runFetchServer(ctx context.Context, t *testing.T, env *testenv.TestEnv) *grpc.ClientConn {
@@ -552,6 +566,327 @@ func TestFetchBlobWithUnknownQualifiers(t *testing.T) {
 	assert.NotNil(t, resp)
 }
 
+func readTar(t *testing.T, b []byte) map[string]string {
+	contents := map[string]string{}
+	tr := tar.NewReader(bytes.NewReader(b))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		b, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		contents[hdr.Name] = string(b)
+	}
+	return contents
+}
+
+// serveGitRepo serves the git repository at the given path over HTTP using
+// git's smart HTTP protocol, returning its URL.
+func serveGitRepo(t *testing.T, repoPath string) string {
+	server := httptest.NewServer(gitHTTPBackend(t, repoPath))
+	t.Cleanup(server.Close)
+	return server.URL + "/" + filepath.Base(repoPath)
+}
+
+// serveGitRepoWithBasicAuth is like serveGitRepo, but only serves requests
+// with the given basic auth credentials.
+func serveGitRepoWithBasicAuth(t *testing.T, repoPath, username, password string) string {
+	backend := gitHTTPBackend(t, repoPath)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != username || p != password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		backend.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/" + filepath.Base(repoPath)
+}
+
+func gitHTTPBackend(t *testing.T, repoPath string) http.Handler {
+	gitPath, err := exec.LookPath("git")
+	require.NoError(t, err)
+	return &cgi.Handler{
+		Path: gitPath,
+		Args: []string{"http-backend"},
+		Env: []string{
+			"GIT_PROJECT_ROOT=" + filepath.Dir(repoPath),
+			"GIT_HTTP_EXPORT_ALL=1",
+		},
+	}
+}
+
+func TestFetchBlobWithGitQualifiers(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	require.NoError(t, scratchspace.Init())
+	clientConn := runFetchServer(ctx, t, te)
+	fetchClient := rapb.NewFetchClient(clientConn)
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, te)
+	require.NoError(t, err)
+
+	repoPath, firstCommit := testgit.MakeTempRepo(t, map[string]string{
+		"README":    "v1",
+		"src/lib.c": "int main() {}",
+	})
+	secondCommit := testgit.CommitFiles(t, repoPath, map[string]string{"README": "v2"})
+	repoURL := serveGitRepo(t, repoPath)
+
+	fetchArchive := func(qualifiers ...*rapb.Qualifier) (*repb.Digest, map[string]string) {
+		resp, err := fetchClient.FetchBlob(ctx, &rapb.FetchBlobRequest{
+			Uris:       []string{repoURL},
+			Qualifiers: qualifiers,
+		})
+		require.NoError(t, err)
+		require.Equal(t, int32(0), resp.GetStatus().GetCode(), resp.GetStatus().GetMessage())
+		require.Equal(t, repoURL, resp.GetUri())
+		b, err := te.GetCache().Get(ctx, digest.NewResourceName(resp.GetBlobDigest(), "", resource.CacheType_CAS, repb.DigestFunction_SHA256).ToProto())
+		require.NoError(t, err)
+		return resp.GetBlobDigest(), readTar(t, b)
+	}
+
+	firstDigest, contents := fetchArchive(&rapb.Qualifier{Name: fetch_server.VCSCommitQualifier, Value: firstCommit})
+	assert.Equal(t, map[string]string{"README": "v1", "src/lib.c": "int main() {}"}, contents)
+
+	_, contents = fetchArchive(&rapb.Qualifier{Name: fetch_server.VCSBranchQualifier, Value: "master"})
+	assert.Equal(t, "v2", contents["README"])
+
+	_, contents = fetchArchive(&rapb.Qualifier{Name: fetch_server.ResourceTypeQualifier, Value: fetch_server.GitResourceType})
+	assert.Equal(t, "v2", contents["README"])
+
+	_, contents = fetchArchive(
+		&rapb.Qualifier{Name: fetch_server.VCSBranchQualifier, Value: "master"},
+		&rapb.Qualifier{Name: fetch_server.VCSCommitQualifier, Value: secondCommit},
+	)
+	assert.Equal(t, "v2", contents["README"])
+
+	// Archiving the same commit again should produce an identical blob.
+	againDigest, _ := fetchArchive(&rapb.Qualifier{Name: fetch_server.VCSCommitQualifier, Value: firstCommit})
+	assert.Equal(t, firstDigest.GetHash(), againDigest.GetHash())
+
+	_, err = fetchClient.FetchBlob(ctx, &rapb.FetchBlobRequest{
+		Uris:       []string{repoURL},
+		Qualifiers: []*rapb.Qualifier{{Name: fetch_server.VCSCommitQualifier, Value: "abc123"}},
+	})
+	require.Error(t, err)
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+
+	resp, err := fetchClient.FetchBlob(ctx, &rapb.FetchBlobRequest{
+		Uris:       []string{repoURL},
+		Qualifiers: []*rapb.Qualifier{{Name: fetch_server.VCSBranchQualifier, Value: "does-not-exist"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(gcodes.NotFound), resp.GetStatus().GetCode())
+}
+
+func TestFetchBlobWithGitQualifiersRejectsNonHTTPURIs(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	require.NoError(t, scratchspace.Init())
+	clientConn := runFetchServer(ctx, t, te)
+	fetchClient := rapb.NewFetchClient(clientConn)
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, te)
+	require.NoError(t, err)
+
+	repoPath, _ := testgit.MakeTempRepo(t, map[string]string{"README": "secret"})
+	for _, uri := range []string{
+		"file://" + repoPath,
+		repoPath,
+		"ssh://git@github.com/buildbuddy-io/buildbuddy",
+		"git@github.com:buildbuddy-io/buildbuddy.git",
+		"git://github.com/buildbuddy-io/buildbuddy",
+	} {
+		_, err := fetchClient.FetchBlob(ctx, &rapb.FetchBlobRequest{
+			Uris:       []string{uri},
+			Qualifiers: []*rapb.Qualifier{{Name: fetch_server.ResourceTypeQualifier, Value: fetch_server.GitResourceType}},
+		})
+		assert.True(t, status.IsInvalidArgumentError(err), "%s: expected InvalidArgument, got %v", uri, err)
+	}
+}
+
+func TestFetchBlobWithGitQualifiersLimitsCheckoutSize(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	require.NoError(t, scratchspace.Init())
+	clientConn := runFetchServer(ctx, t, te)
+	fetchClient := rapb.NewFetchClient(clientConn)
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, te)
+	require.NoError(t, err)
+	flags.Set(t, "remote_asset.max_git_checkout_size_bytes", int64(500_000))
+
+	// The first commit adds a large file that doesn't compress, and the
+	// second commit removes it.
+	large := make([]byte, 1_000_000)
+	_, err = rand.Read(large)
+	require.NoError(t, err)
+	repoPath, firstCommit := testgit.MakeTempRepo(t, map[string]string{
+		"README": "v1",
+		"large":  string(large),
+	})
+	err = exec.Command("git", "-C", repoPath, "rm", "large").Run()
+	require.NoError(t, err)
+	secondCommit := testgit.CommitFiles(t, repoPath, map[string]string{"README": "v2"})
+	repoURL := serveGitRepo(t, repoPath)
+
+	fetchCommit := func(commit string) *rapb.FetchBlobResponse {
+		resp, err := fetchClient.FetchBlob(ctx, &rapb.FetchBlobRequest{
+			Uris:       []string{repoURL},
+			Qualifiers: []*rapb.Qualifier{{Name: fetch_server.VCSCommitQualifier, Value: commit}},
+		})
+		require.NoError(t, err)
+		return resp
+	}
+
+	// The server doesn't allow fetching commits by SHA, so the whole history
+	// is fetched, which is too large.
+	resp := fetchCommit(secondCommit)
+	assert.Equal(t, int32(gcodes.NotFound), resp.GetStatus().GetCode())
+	assert.Contains(t, resp.GetStatus().GetMessage(), "maximum checkout size")
+
+	// Once it does, only the tree of the requested commit is fetched.
+	err = exec.Command("git", "-C", repoPath, "config", "uploadpack.allowReachableSHA1InWant", "true").Run()
+	require.NoError(t, err)
+	resp = fetchCommit(secondCommit)
+	require.Equal(t, int32(0), resp.GetStatus().GetCode(), resp.GetStatus().GetMessage())
+	b, err := te.GetCache().Get(ctx, digest.NewResourceName(resp.GetBlobDigest(), "", resource.CacheType_CAS, repb.DigestFunction_SHA256).ToProto())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"README": "v2"}, readTar(t, b))
+
+	resp = fetchCommit(firstCommit)
+	assert.Equal(t, int32(gcodes.NotFound), resp.GetStatus().GetCode())
+	assert.Contains(t, resp.GetStatus().GetMessage(), "maximum checkout size")
+}
+
+func TestFetchBlobWithGitQualifiersAndCredentials(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	require.NoError(t, scratchspace.Init())
+	clientConn := runFetchServer(ctx, t, te)
+	fetchClient := rapb.NewFetchClient(clientConn)
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, te)
+	require.NoError(t, err)
+
+	repoPath, commit := testgit.MakeTempRepo(t, map[string]string{"README": "private"})
+	repoURL := serveGitRepoWithBasicAuth(t, repoPath, "user", "pass")
+
+	resp, err := fetchClient.FetchBlob(ctx, &rapb.FetchBlobRequest{
+		Uris:       []string{repoURL},
+		Qualifiers: []*rapb.Qualifier{{Name: fetch_server.VCSCommitQualifier, Value: commit}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(gcodes.NotFound), resp.GetStatus().GetCode())
+
+	resp, err = fetchClient.FetchBlob(ctx, &rapb.FetchBlobRequest{
+		Uris: []string{repoURL},
+		Qualifiers: []*rapb.Qualifier{
+			{Name: fetch_server.VCSCommitQualifier, Value: commit},
+			{Name: fetch_server.BazelHttpHeaderPrefixQualifier + "Authorization", Value: "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass"))},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, int32(0), resp.GetStatus().GetCode(), resp.GetStatus().GetMessage())
+	b, err := te.GetCache().Get(ctx, digest.NewResourceName(resp.GetBlobDigest(), "", resource.CacheType_CAS, repb.DigestFunction_SHA256).ToProto())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"README": "private"}, readTar(t, b))
+}
+
+func TestFetchBlobWithContainerImage(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	require.NoError(t, scratchspace.Init())
+	clientConn := runFetchServer(ctx, t, te)
+	fetchClient := rapb.NewFetchClient(clientConn)
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, te)
+	require.NoError(t, err)
+
+	reg := testregistry.Run(t, testregistry.Opts{})
+	img, err := random.Image(1024, 2)
+	require.NoError(t, err)
+	imageName := reg.Push(t, img, "test-image:latest")
+	manifest, err := img.RawManifest()
+	require.NoError(t, err)
+	manifestDigest, err := img.Digest()
+	require.NoError(t, err)
+
+	resp, err := fetchClient.FetchBlob(ctx, &rapb.FetchBlobRequest{
+		Uris: []string{"docker://" + imageName},
+		Qualifiers: []*rapb.Qualifier{{
+			Name:  fetch_server.ResourceTypeQualifier,
+			Value: string(types.OCIManifestSchema1),
+		}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, int32(0), resp.GetStatus().GetCode(), resp.GetStatus().GetMessage())
+	assert.Equal(t, manifestDigest.Hex, resp.GetBlobDigest().GetHash())
+	b, err := te.GetCache().Get(ctx, digest.NewResourceName(resp.GetBlobDigest(), "", resource.CacheType_CAS, repb.DigestFunction_SHA256).ToProto())
+	require.NoError(t, err)
+	assert.Equal(t, manifest, b)
+
+	// The config and layers should be fetchable from the CAS as well.
+	m, err := img.Manifest()
+	require.NoError(t, err)
+	for _, desc := range append([]v1.Descriptor{m.Config}, m.Layers...) {
+		d := &repb.Digest{Hash: desc.Digest.Hex, SizeBytes: desc.Size}
+		exists, err := te.GetCache().Contains(ctx, digest.NewResourceName(d, "", resource.CacheType_CAS, repb.DigestFunction_SHA256).ToProto())
+		require.NoError(t, err)
+		assert.True(t, exists, "blob %s should be in the cache", desc.Digest)
+	}
+}
+
+func TestFetchBlobWithContainerImageAndCredentials(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	require.NoError(t, scratchspace.Init())
+	clientConn := runFetchServer(ctx, t, te)
+	fetchClient := rapb.NewFetchClient(clientConn)
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, te)
+	require.NoError(t, err)
+
+	authorization := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	requireAuth := false
+	reg := testregistry.Run(t, testregistry.Opts{
+		HttpInterceptor: func(w http.ResponseWriter, r *http.Request) bool {
+			if requireAuth && r.Header.Get("Authorization") != authorization {
+				w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return false
+			}
+			return true
+		},
+	})
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	imageName := reg.Push(t, img, "test-image:latest")
+	manifestDigest, err := img.Digest()
+	require.NoError(t, err)
+	requireAuth = true
+
+	resourceType := &rapb.Qualifier{Name: fetch_server.ResourceTypeQualifier, Value: string(types.OCIManifestSchema1)}
+	resp, err := fetchClient.FetchBlob(ctx, &rapb.FetchBlobRequest{
+		Uris:       []string{"docker://" + imageName},
+		Qualifiers: []*rapb.Qualifier{resourceType},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(gcodes.NotFound), resp.GetStatus().GetCode())
+
+	resp, err = fetchClient.FetchBlob(ctx, &rapb.FetchBlobRequest{
+		Uris: []string{"docker://" + imageName},
+		Qualifiers: []*rapb.Qualifier{
+			resourceType,
+			{Name: fetch_server.BazelHttpHeaderPrefixQualifier + "Authorization", Value: authorization},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, int32(0), resp.GetStatus().GetCode(), resp.GetStatus().GetMessage())
+	assert.Equal(t, manifestDigest.Hex, resp.GetBlobDigest().GetHash())
+}
+
 func TestFetchDirectory(t *testing.T) {
 	ctx := context.Background()
 	te := testenv.GetTestEnv(t)
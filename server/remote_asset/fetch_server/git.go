@@ -0,0 +1,388 @@
+package fetch_server
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/scratchspace"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	gitutil "github.com/buildbuddy-io/buildbuddy/server/util/git"
+	git "github.com/go-git/go-git/v5"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+)
+
+var (
+	maxGitCheckoutSizeBytes = flag.Int64("remote_asset.max_git_checkout_size_bytes", 2e9, "The maximum number of bytes that fetching and checking out a git repository for the Remote Asset API may write to disk.")
+)
+
+// errGitCheckoutTooLarge is returned by writes to a git checkout once it
+// exceeds the configured size limit.
+var errGitCheckoutTooLarge = errors.New("git checkout exceeds size limit")
+
+// gitSource identifies a revision of a git repository, as requested using the
+// vcs.branch and vcs.commit qualifiers.
+type gitSource struct {
+	branch string
+	commit string
+}
+
+func (s *gitSource) validate() error {
+	if s.commit != "" && !plumbing.IsHash(s.commit) {
+		return status.InvalidArgumentErrorf("invalid %s qualifier %q: must be a full commit SHA", VCSCommitQualifier, s.commit)
+	}
+	return nil
+}
+
+// validateGitURI returns an error unless the URI refers to a repository that
+// is served over HTTP(S). Other transports would let clients read
+// repositories from the server's filesystem (file:// URLs and local paths), or
+// connect to hosts with the server's SSH credentials.
+func validateGitURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return status.InvalidArgumentErrorf("unsupported git repository URI %q: must be an http or https URL", gitutil.StripRepoURLCredentials(uri))
+	}
+	return nil
+}
+
+// mirrorGitToCache checks out the requested revision of the git repository at
+// the given URI and uploads a tar archive of the checked out tree to the
+// cache, returning the archive digest.
+//
+// The archive contains only the working tree (no .git directory), and
+// entries are written in a fixed order with normalized metadata, so that
+// archiving the same commit always produces the same digest.
+func mirrorGitToCache(
+	ctx context.Context,
+	bsClient bspb.ByteStreamClient,
+	remoteInstanceName string,
+	uri string,
+	header http.Header,
+	src *gitSource,
+	timeout time.Duration,
+	storageFunc repb.DigestFunction_Value,
+	checksumFunc repb.DigestFunction_Value,
+	expectedChecksum string,
+) (*repb.Digest, error) {
+	repoDir, err := scratchspace.MkdirTemp("remote-asset-git-*")
+	if err != nil {
+		return nil, status.UnavailableErrorf("failed to create temp dir for git checkout: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(repoDir); err != nil {
+			log.Errorf("Failed to remove temp dir: %s", err)
+		}
+	}()
+	cloneCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := checkoutGitSource(cloneCtx, uri, gitAuth(header), src, repoDir); err != nil {
+		return nil, err
+	}
+
+	archivePath, err := archiveGitCheckout(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := os.Remove(archivePath); err != nil {
+			log.Errorf("Failed to remove temp file: %s", err)
+		}
+	}()
+
+	if expectedChecksum != "" {
+		rn, err := cachetools.ComputeFileDigest(archivePath, remoteInstanceName, checksumFunc)
+		if err != nil {
+			return nil, status.UnavailableErrorf("failed to compute checksum digest: %s", err)
+		}
+		if rn.GetDigest().GetHash() != expectedChecksum {
+			return nil, status.InvalidArgumentErrorf("archive checksum for %q was %q but wanted %q", gitutil.StripRepoURLCredentials(uri), rn.GetDigest().GetHash(), expectedChecksum)
+		}
+	}
+	blobDigest, err := cachetools.UploadFile(ctx, bsClient, remoteInstanceName, storageFunc, archivePath)
+	if err != nil {
+		return nil, status.UnavailableErrorf("failed to add archive to cache: %s", err)
+	}
+	log.CtxDebugf(ctx, "Mirrored git repo %s to cache (digest: %s)", gitutil.StripRepoURLCredentials(uri), digest.String(blobDigest))
+	return blobDigest, nil
+}
+
+// gitAuth returns the credentials in the Authorization header supplied with
+// the request, if any, for authenticating to the git server.
+func gitAuth(header http.Header) transport.AuthMethod {
+	username, password, token := credentialsFromHeader(header)
+	if token != "" {
+		return &githttp.TokenAuth{Token: token}
+	}
+	if username != "" || password != "" {
+		return &githttp.BasicAuth{Username: username, Password: password}
+	}
+	return nil
+}
+
+// checkoutGitSource checks out the requested revision of the repository at
+// uri into dir. Only the history needed to check out the revision is fetched,
+// if the server allows it, and the checkout fails once it would take up more
+// than --remote_asset.max_git_checkout_size_bytes on disk.
+func checkoutGitSource(ctx context.Context, uri string, auth transport.AuthMethod, src *gitSource, dir string) error {
+	wt := &sizeLimitedFS{Filesystem: osfs.New(dir), limit: &sizeLimit{max: *maxGitCheckoutSizeBytes}}
+	dot, err := wt.Chroot(git.GitDirName)
+	if err != nil {
+		return status.InternalErrorf("failed to create git dir: %s", err)
+	}
+	storer := filesystem.NewStorage(dot, cache.NewObjectLRUDefault())
+	if src.commit == "" {
+		err = cloneGitBranch(ctx, storer, wt, uri, auth, src.branch)
+	} else {
+		err = fetchGitCommit(ctx, storer, wt, uri, auth, src)
+	}
+	if wt.limit.exceeded() {
+		return status.ResourceExhaustedErrorf("git repository %q exceeds the maximum checkout size of %d bytes", gitutil.StripRepoURLCredentials(uri), wt.limit.max)
+	}
+	return err
+}
+
+// cloneGitBranch checks out the tip of the given branch, or of the default
+// branch if none is given.
+func cloneGitBranch(ctx context.Context, storer *filesystem.Storage, wt billy.Filesystem, uri string, auth transport.AuthMethod, branch string) error {
+	opts := &git.CloneOptions{
+		URL:   uri,
+		Auth:  auth,
+		Tags:  git.NoTags,
+		Depth: 1,
+	}
+	if branch != "" {
+		opts.ReferenceName = plumbing.NewBranchReferenceName(branch)
+		opts.SingleBranch = true
+	}
+	if _, err := git.CloneContext(ctx, storer, wt, opts); err != nil {
+		return status.UnavailableErrorf("failed to clone %q: %s", gitutil.StripRepoURLCredentials(uri), err)
+	}
+	return nil
+}
+
+// fetchGitCommit checks out the given commit. Servers that allow fetching
+// commits by SHA only send the commit's tree; for others, the requested
+// branch (or all branches) are fetched with their full history.
+func fetchGitCommit(ctx context.Context, storer *filesystem.Storage, wt billy.Filesystem, uri string, auth transport.AuthMethod, src *gitSource) error {
+	repo, err := git.Init(storer, wt)
+	if err != nil {
+		return status.InternalErrorf("failed to init git repo: %s", err)
+	}
+	remote, err := repo.CreateRemote(&config.RemoteConfig{Name: git.DefaultRemoteName, URLs: []string{uri}})
+	if err != nil {
+		return status.InternalErrorf("failed to create git remote: %s", err)
+	}
+	err = remote.FetchContext(ctx, &git.FetchOptions{
+		RefSpecs: []config.RefSpec{config.RefSpec(src.commit + ":refs/heads/requested")},
+		Depth:    1,
+		Auth:     auth,
+		Tags:     git.NoTags,
+	})
+	if errors.Is(err, git.ErrExactSHA1NotSupported) {
+		refSpec := config.RefSpec("+refs/heads/*:refs/remotes/origin/*")
+		if src.branch != "" {
+			refSpec = config.RefSpec("+refs/heads/" + src.branch + ":refs/remotes/origin/" + src.branch)
+		}
+		err = remote.FetchContext(ctx, &git.FetchOptions{
+			RefSpecs: []config.RefSpec{refSpec},
+			Auth:     auth,
+			Tags:     git.NoTags,
+		})
+	}
+	if err != nil {
+		return status.UnavailableErrorf("failed to fetch %q: %s", gitutil.StripRepoURLCredentials(uri), err)
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return status.InternalErrorf("failed to open worktree: %s", err)
+	}
+	if err := worktree.Checkout(&git.CheckoutOptions{Hash: plumbing.NewHash(src.commit), Force: true}); err != nil {
+		return status.NotFoundErrorf("failed to check out commit %q from %q: %s", src.commit, gitutil.StripRepoURLCredentials(uri), err)
+	}
+	return nil
+}
+
+// sizeLimit tracks the number of bytes written to a git checkout.
+type sizeLimit struct {
+	max     int64
+	written atomic.Int64
+}
+
+func (l *sizeLimit) add(n int) error {
+	if l.written.Add(int64(n)) > l.max {
+		return errGitCheckoutTooLarge
+	}
+	return nil
+}
+
+func (l *sizeLimit) exceeded() bool {
+	return l.written.Load() > l.max
+}
+
+// sizeLimitedFS is a billy.Filesystem whose file writes fail once the total
+// number of bytes written exceeds the limit. Bytes are counted on every
+// write, so files that are rewritten are counted more than once.
+type sizeLimitedFS struct {
+	billy.Filesystem
+	limit *sizeLimit
+}
+
+func (fs *sizeLimitedFS) Create(filename string) (billy.File, error) {
+	return fs.wrap(fs.Filesystem.Create(filename))
+}
+
+func (fs *sizeLimitedFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	return fs.wrap(fs.Filesystem.OpenFile(filename, flag, perm))
+}
+
+func (fs *sizeLimitedFS) TempFile(dir, prefix string) (billy.File, error) {
+	return fs.wrap(fs.Filesystem.TempFile(dir, prefix))
+}
+
+func (fs *sizeLimitedFS) Chroot(path string) (billy.Filesystem, error) {
+	chroot, err := fs.Filesystem.Chroot(path)
+	if err != nil {
+		return nil, err
+	}
+	return &sizeLimitedFS{Filesystem: chroot, limit: fs.limit}, nil
+}
+
+func (fs *sizeLimitedFS) wrap(f billy.File, err error) (billy.File, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &sizeLimitedFile{File: f, limit: fs.limit}, nil
+}
+
+type sizeLimitedFile struct {
+	billy.File
+	limit *sizeLimit
+}
+
+func (f *sizeLimitedFile) Write(p []byte) (int, error) {
+	if err := f.limit.add(len(p)); err != nil {
+		return 0, err
+	}
+	return f.File.Write(p)
+}
+
+// archiveGitCheckout writes a reproducible tar archive of the working tree at
+// dir to a temp file, returning its path.
+func archiveGitCheckout(dir string) (path string, err error) {
+	var paths []string
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		return "", status.InternalErrorf("failed to walk git checkout: %s", err)
+	}
+	sort.Strings(paths)
+
+	f, err := scratchspace.CreateTemp("remote-asset-git-*.tar")
+	if err != nil {
+		return "", status.UnavailableErrorf("failed to create temp file for archive: %s", err)
+	}
+	defer func() {
+		f.Close()
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	tw := tar.NewWriter(f)
+	for _, path := range paths {
+		if err := writeTarEntry(tw, dir, path); err != nil {
+			return "", status.InternalErrorf("failed to archive %q: %s", path, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return "", status.InternalErrorf("failed to finish archive: %s", err)
+	}
+	return f.Name(), nil
+}
+
+func writeTarEntry(tw *tar.Writer, root, path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Name:    filepath.ToSlash(rel),
+		ModTime: time.Unix(0, 0),
+		Format:  tar.FormatPAX,
+	}
+	switch {
+	case info.IsDir():
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+		hdr.Mode = 0755
+	case info.Mode()&fs.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = target
+		hdr.Mode = 0777
+	case info.Mode().IsRegular():
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = info.Size()
+		// Git only tracks whether files are executable.
+		hdr.Mode = 0644
+		if info.Mode()&0100 != 0 {
+			hdr.Mode = 0755
+		}
+	default:
+		return nil
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
@@ -0,0 +1,169 @@
+package fetch_server
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// containerURIPrefixes are the URI schemes accepted for container image
+// references. The remainder of the URI is parsed as an image reference, e.g.
+// "docker://gcr.io/distroless/static:nonroot".
+var containerURIPrefixes = []string{"docker://", "oci://"}
+
+// isContainerResourceType returns whether the given resource_type qualifier
+// value requests a container image manifest or index.
+func isContainerResourceType(resourceType string) bool {
+	mt := types.MediaType(resourceType)
+	return mt.IsImage() || mt.IsIndex()
+}
+
+func parseImageReference(uri string) (name.Reference, error) {
+	refStr := uri
+	for _, p := range containerURIPrefixes {
+		if strings.HasPrefix(uri, p) {
+			refStr = strings.TrimPrefix(uri, p)
+			break
+		}
+	}
+	ref, err := name.ParseReference(refStr)
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("invalid image reference %q: %s", uri, err)
+	}
+	return ref, nil
+}
+
+// mirrorImageToCache resolves the image reference in the given URI and stores
+// its manifest (or index, depending on the requested resource type) in the
+// cache, returning the manifest digest.
+//
+// For single-platform image manifests stored with SHA256, the config and layer
+// blobs are mirrored as well. Since OCI content digests are SHA256 digests of
+// the raw blobs, clients can then fetch them from the CAS using the digests
+// listed in the manifest.
+func (p *FetchServer) mirrorImageToCache(
+	ctx context.Context,
+	remoteInstanceName string,
+	httpClient *http.Client,
+	uri string,
+	header http.Header,
+	resourceType string,
+	storageFunc repb.DigestFunction_Value,
+	checksumFunc repb.DigestFunction_Value,
+	expectedChecksum string,
+) (*repb.Digest, error) {
+	ref, err := parseImageReference(uri)
+	if err != nil {
+		return nil, err
+	}
+	opts := []remote.Option{
+		remote.WithContext(ctx),
+		remote.WithTransport(httpClient.Transport),
+		remote.WithAuth(registryAuth(header)),
+	}
+	desc, err := remote.Get(ref, opts...)
+	if err != nil {
+		return nil, status.UnavailableErrorf("failed to resolve image %q: %s", ref, err)
+	}
+	manifest := desc.Manifest
+	mediaType := desc.MediaType
+	if types.MediaType(resourceType).IsImage() && desc.MediaType.IsIndex() {
+		// The client asked for a single image manifest, so resolve the index
+		// to the image for the default platform.
+		img, err := desc.Image()
+		if err != nil {
+			return nil, status.UnavailableErrorf("failed to resolve image %q from index: %s", ref, err)
+		}
+		if manifest, err = img.RawManifest(); err != nil {
+			return nil, status.UnavailableErrorf("failed to fetch manifest for %q: %s", ref, err)
+		}
+		if mediaType, err = img.MediaType(); err != nil {
+			return nil, status.UnavailableErrorf("failed to fetch manifest for %q: %s", ref, err)
+		}
+	}
+
+	if expectedChecksum != "" {
+		d, err := digest.Compute(bytes.NewReader(manifest), checksumFunc)
+		if err != nil {
+			return nil, err
+		}
+		if d.GetHash() != expectedChecksum {
+			return nil, status.InvalidArgumentErrorf("manifest checksum for %q was %q but wanted %q", uri, d.GetHash(), expectedChecksum)
+		}
+	}
+
+	bsClient := p.env.GetByteStreamClient()
+	if mediaType.IsImage() && storageFunc == repb.DigestFunction_SHA256 {
+		m, err := v1.ParseManifest(bytes.NewReader(manifest))
+		if err != nil {
+			return nil, status.UnavailableErrorf("failed to parse manifest for %q: %s", ref, err)
+		}
+		blobs := append([]v1.Descriptor{m.Config}, m.Layers...)
+		for _, blob := range blobs {
+			if err := p.mirrorImageBlob(ctx, remoteInstanceName, ref, blob, opts); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	manifestDigest, err := cachetools.UploadBlob(ctx, bsClient, remoteInstanceName, storageFunc, bytes.NewReader(manifest))
+	if err != nil {
+		return nil, status.UnavailableErrorf("failed to add manifest to cache: %s", err)
+	}
+	log.CtxDebugf(ctx, "Mirrored image %s to cache (digest: %s)", ref, digest.String(manifestDigest))
+	return manifestDigest, nil
+}
+
+// registryAuth returns an authenticator for the credentials in the
+// Authorization header supplied with the request, or anonymous access if
+// there are none.
+func registryAuth(header http.Header) authn.Authenticator {
+	username, password, token := credentialsFromHeader(header)
+	if token != "" {
+		return &authn.Bearer{Token: token}
+	}
+	if username != "" || password != "" {
+		return &authn.Basic{Username: username, Password: password}
+	}
+	return authn.Anonymous
+}
+
+func (p *FetchServer) mirrorImageBlob(ctx context.Context, remoteInstanceName string, ref name.Reference, blob v1.Descriptor, opts []remote.Option) error {
+	// Non-distributable layers must be fetched from their own URLs by
+	// whoever pulls the image; don't try to mirror them.
+	if len(blob.URLs) > 0 {
+		return nil
+	}
+	d := &repb.Digest{Hash: blob.Digest.Hex, SizeBytes: blob.Size}
+	rn := digest.NewResourceName(d, remoteInstanceName, rspb.CacheType_CAS, repb.DigestFunction_SHA256)
+	if exists, err := p.env.GetCache().Contains(ctx, rn.ToProto()); err == nil && exists {
+		return nil
+	}
+	layer, err := remote.Layer(ref.Context().Digest(blob.Digest.String()), opts...)
+	if err != nil {
+		return status.UnavailableErrorf("failed to fetch blob %s of %q: %s", blob.Digest, ref, err)
+	}
+	rc, err := layer.Compressed()
+	if err != nil {
+		return status.UnavailableErrorf("failed to fetch blob %s of %q: %s", blob.Digest, ref, err)
+	}
+	defer rc.Close()
+	if _, _, err := cachetools.UploadFromReader(ctx, p.env.GetByteStreamClient(), rn, rc); err != nil {
+		return status.UnavailableErrorf("failed to upload blob %s to cache: %s", blob.Digest, err)
+	}
+	return nil
+}
@@ -0,0 +1,349 @@
+// Package action_cache_invalidation lets org admins invalidate all AC entries
+// under an instance name prefix or platform property, without flushing the
+// CAS.
+//
+// Invalidations are recorded in the DB rather than applied to the cache
+// directly: AC entries written before a matching invalidation are reported as
+// cache misses by the ActionCacheServer, and are overwritten once their
+// actions are re-run. Invalidations expire after
+// cache.action_cache_invalidation.ttl, and are deleted from the DB then.
+package action_cache_invalidation
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/authutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/lru"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/jonboulle/clockwork"
+
+	capb "github.com/buildbuddy-io/buildbuddy/proto/cache"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
+)
+
+var (
+	invalidationCacheTTL = flag.Duration("cache.action_cache_invalidation.cache_ttl", 1*time.Minute, "How long each app caches a group's action cache invalidations in memory. New invalidations may take this long to take effect. If 0, invalidations are read from the DB on every action cache read.")
+	invalidationTTL      = flag.Duration("cache.action_cache_invalidation.ttl", 30*24*time.Hour, "How long action cache invalidations stay in effect before they're deleted. Invalidated entries that are still in the cache when their invalidation expires are served again, so this should be longer than action cache entries are kept. If 0, invalidations never expire.")
+)
+
+const (
+	// The number of groups whose invalidations are cached in memory.
+	invalidationCacheSize = 10_000
+
+	// The number of actions whose platforms are cached in memory.
+	platformCacheSize = 100_000
+
+	// How often expired invalidations are deleted.
+	cleanupInterval = 1 * time.Hour
+)
+
+// Invalidate records an invalidation of the authenticated group's AC entries
+// matching req. The caller must be an admin of the group.
+func Invalidate(ctx context.Context, env environment.Env, req *capb.InvalidateActionCacheRequest) (*capb.InvalidateActionCacheResponse, error) {
+	if env.GetDBHandle() == nil {
+		return nil, status.UnimplementedError("Action cache invalidation requires a database")
+	}
+	u, err := env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := authutil.AuthorizeOrgAdmin(u, u.GetGroupID()); err != nil {
+		return nil, err
+	}
+	prop := req.GetPlatformProperty()
+	if req.GetInstanceNamePrefix() == "" && prop.GetName() == "" {
+		return nil, status.InvalidArgumentError("An instance name prefix or platform property is required")
+	}
+	if prop.GetName() == "" && prop.GetValue() != "" {
+		return nil, status.InvalidArgumentError("Platform property name is required")
+	}
+
+	id, err := tables.PrimaryKeyForTable("ActionCacheInvalidations")
+	if err != nil {
+		return nil, err
+	}
+	inv := &tables.ActionCacheInvalidation{
+		InvalidationID:        id,
+		GroupID:               u.GetGroupID(),
+		UserID:                u.GetUserID(),
+		InstanceNamePrefix:    req.GetInstanceNamePrefix(),
+		PlatformPropertyName:  prop.GetName(),
+		PlatformPropertyValue: prop.GetValue(),
+	}
+	if err := env.GetDBHandle().NewQuery(ctx, "action_cache_invalidation_create").Create(inv); err != nil {
+		return nil, err
+	}
+	log.CtxInfof(ctx, "Invalidated action cache entries for group %s (instance name prefix: %q, platform property: %q=%q)", u.GetGroupID(), inv.InstanceNamePrefix, inv.PlatformPropertyName, inv.PlatformPropertyValue)
+	return &capb.InvalidateActionCacheResponse{InvalidationId: id}, nil
+}
+
+// Delete deletes an invalidation of the authenticated group, so that the
+// entries it invalidated are served again. The caller must be an admin of the
+// group.
+func Delete(ctx context.Context, env environment.Env, req *capb.DeleteActionCacheInvalidationRequest) (*capb.DeleteActionCacheInvalidationResponse, error) {
+	if env.GetDBHandle() == nil {
+		return nil, status.UnimplementedError("Action cache invalidation requires a database")
+	}
+	u, err := env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := authutil.AuthorizeOrgAdmin(u, u.GetGroupID()); err != nil {
+		return nil, err
+	}
+	if req.GetInvalidationId() == "" {
+		return nil, status.InvalidArgumentError("An invalidation ID is required")
+	}
+	res := env.GetDBHandle().NewQuery(ctx, "action_cache_invalidation_delete").Raw(
+		`DELETE FROM "ActionCacheInvalidations" WHERE invalidation_id = ? AND group_id = ?`,
+		req.GetInvalidationId(), u.GetGroupID()).Exec()
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, status.NotFoundErrorf("Invalidation %q not found", req.GetInvalidationId())
+	}
+	log.CtxInfof(ctx, "Deleted action cache invalidation %s of group %s", req.GetInvalidationId(), u.GetGroupID())
+	return &capb.DeleteActionCacheInvalidationResponse{}, nil
+}
+
+// expiryCutoffUsec returns the creation time before which invalidations have
+// expired, or 0 if they never expire.
+func expiryCutoffUsec(env environment.Env) int64 {
+	if *invalidationTTL <= 0 {
+		return 0
+	}
+	return env.GetClock().Now().Add(-*invalidationTTL).UnixMicro()
+}
+
+// DeleteExpired deletes the invalidations that have expired.
+func DeleteExpired(ctx context.Context, env environment.Env) error {
+	if *invalidationTTL <= 0 {
+		return nil
+	}
+	return env.GetDBHandle().NewQuery(ctx, "action_cache_invalidation_delete_expired").Raw(
+		`DELETE FROM "ActionCacheInvalidations" WHERE created_at_usec <= ?`, expiryCutoffUsec(env)).Exec().Error
+}
+
+// StartCleanup periodically deletes the expired invalidations until the
+// server shuts down.
+func StartCleanup(env environment.Env) {
+	if env.GetDBHandle() == nil {
+		return
+	}
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := env.GetClock().NewTicker(cleanupInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.Chan():
+			}
+			if err := DeleteExpired(env.GetServerContext(), env); err != nil {
+				log.Warningf("Failed to delete expired action cache invalidations: %s", err)
+			}
+		}
+	}()
+	env.GetHealthChecker().RegisterShutdownFunction(func(ctx context.Context) error {
+		close(quit)
+		<-done
+		return nil
+	})
+}
+
+type cacheEntry struct {
+	invalidations []*tables.ActionCacheInvalidation
+	expiresAfter  time.Time
+}
+
+// Checker checks AC entries against their group's invalidations.
+type Checker struct {
+	env   environment.Env
+	clock clockwork.Clock
+
+	mu  sync.Mutex // PROTECTS(lru, platforms)
+	lru interfaces.LRU[*cacheEntry]
+	// The platforms of actions that were checked against invalidations,
+	// keyed by action digest. An action's platform is part of its digest, so
+	// they never go stale.
+	platforms interfaces.LRU[*repb.Platform]
+}
+
+// NewChecker returns a Checker, or nil if invalidations can't be recorded
+// because there's no database. All Checker methods are safe to call on a nil
+// Checker.
+func NewChecker(env environment.Env) (*Checker, error) {
+	if env.GetDBHandle() == nil {
+		return nil, nil
+	}
+	l, err := lru.NewLRU[*cacheEntry](&lru.Config[*cacheEntry]{
+		MaxSize: invalidationCacheSize,
+		SizeFn:  func(*cacheEntry) int64 { return 1 },
+	})
+	if err != nil {
+		return nil, err
+	}
+	platforms, err := lru.NewLRU[*repb.Platform](&lru.Config[*repb.Platform]{
+		MaxSize: platformCacheSize,
+		SizeFn:  func(*repb.Platform) int64 { return 1 },
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Checker{
+		env:       env,
+		clock:     env.GetClock(),
+		lru:       l,
+		platforms: platforms,
+	}, nil
+}
+
+func (c *Checker) invalidations(ctx context.Context, groupID string) ([]*tables.ActionCacheInvalidation, error) {
+	c.mu.Lock()
+	e, ok := c.lru.Get(groupID)
+	c.mu.Unlock()
+	if ok && c.clock.Now().Before(e.expiresAfter) {
+		return e.invalidations, nil
+	}
+
+	// Expired invalidations are ignored even before they're deleted.
+	rq := c.env.GetDBHandle().NewQuery(ctx, "action_cache_invalidation_load").Raw(
+		`SELECT * FROM "ActionCacheInvalidations" WHERE group_id = ? AND created_at_usec > ? ORDER BY created_at_usec`,
+		groupID, expiryCutoffUsec(c.env))
+	invs, err := db.ScanAll(rq, &tables.ActionCacheInvalidation{})
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.lru.Add(groupID, &cacheEntry{invalidations: invs, expiresAfter: c.clock.Now().Add(*invalidationCacheTTL)})
+	c.mu.Unlock()
+	return invs, nil
+}
+
+// IsInvalidated returns whether the AC entry rn, holding ar, was invalidated.
+// The context must be authenticated as the group that owns the entry.
+//
+// Entries whose action can no longer be read from the CAS when an invalidation
+// depends on its platform are considered invalidated, since we can't rule out
+// that they were written by the invalidated actions. Entries that can't be
+// dated are not: they would stay invalidated even after their action is re-run.
+func (c *Checker) IsInvalidated(ctx context.Context, cache interfaces.Cache, rn *digest.ResourceName, ar *repb.ActionResult) (bool, error) {
+	if c == nil {
+		return false, nil
+	}
+	u, err := c.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		// Anonymous users can't record invalidations.
+		return false, nil
+	}
+	invs, err := c.invalidations(ctx, u.GetGroupID())
+	if err != nil {
+		return false, err
+	}
+
+	writeUsec := int64(-1)
+	var platform *repb.Platform
+	platformFetched := false
+	for _, inv := range invs {
+		if !strings.HasPrefix(rn.GetInstanceName(), inv.InstanceNamePrefix) {
+			continue
+		}
+		if writeUsec < 0 {
+			writeUsec = entryWriteUsec(ctx, cache, rn, ar)
+		}
+		if writeUsec == 0 {
+			return false, nil
+		}
+		if writeUsec > inv.CreatedAtUsec {
+			continue
+		}
+		if inv.PlatformPropertyName == "" {
+			return true, nil
+		}
+		if !platformFetched {
+			platform, err = c.actionPlatform(ctx, cache, rn)
+			if err != nil {
+				log.CtxInfof(ctx, "Could not read platform of action %s to check invalidation %s: %s", digest.String(rn.GetDigest()), inv.InvalidationID, err)
+				return true, nil
+			}
+			platformFetched = true
+		}
+		for _, p := range platform.GetProperties() {
+			if p.GetName() == inv.PlatformPropertyName && p.GetValue() == inv.PlatformPropertyValue {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// entryWriteUsec returns when the action whose result is stored in the AC
+// entry was run, or 0 if unknown.
+func entryWriteUsec(ctx context.Context, cache interfaces.Cache, rn *digest.ResourceName, ar *repb.ActionResult) int64 {
+	// The entry records when its action finished executing, which saves a
+	// cache read on every hit.
+	if ts := ar.GetExecutionMetadata().GetWorkerCompletedTimestamp(); ts != nil {
+		return ts.AsTime().UnixMicro()
+	}
+	// Otherwise fall back to when the entry was last written, if the cache
+	// tracks it.
+	if md, err := cache.Metadata(ctx, rn.ToProto()); err == nil && md.LastModifyTimeUsec > 0 {
+		return md.LastModifyTimeUsec
+	}
+	return 0
+}
+
+// actionPlatform returns the platform of the action whose result is stored
+// in the AC entry rn.
+func (c *Checker) actionPlatform(ctx context.Context, cache interfaces.Cache, rn *digest.ResourceName) (*repb.Platform, error) {
+	key := digest.String(rn.GetDigest())
+	c.mu.Lock()
+	platform, ok := c.platforms.Get(key)
+	c.mu.Unlock()
+	if ok {
+		return platform, nil
+	}
+
+	action := &repb.Action{}
+	if err := getProto(ctx, cache, rn.GetDigest(), rn, action); err != nil {
+		return nil, err
+	}
+	platform = action.GetPlatform()
+	if platform == nil {
+		// Older clients only set the platform on the Command.
+		cmd := &repb.Command{}
+		if err := getProto(ctx, cache, action.GetCommandDigest(), rn, cmd); err != nil {
+			return nil, err
+		}
+		platform = cmd.GetPlatform()
+	}
+	c.mu.Lock()
+	c.platforms.Add(key, platform)
+	c.mu.Unlock()
+	return platform, nil
+}
+
+func getProto(ctx context.Context, cache interfaces.Cache, d *repb.Digest, rn *digest.ResourceName, msg proto.Message) error {
+	casRN := digest.NewResourceName(d, rn.GetInstanceName(), rspb.CacheType_CAS, rn.GetDigestFunction())
+	buf, err := cache.Get(ctx, casRN.ToProto())
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(buf, msg)
+}
@@ -3,6 +3,7 @@ package action_cache_server
 import (
 	"context"
 	"encoding/binary"
+	"flag"
 	"fmt"
 	"strings"
 	"sync"
@@ -12,6 +13,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/metrics"
 	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/action_cache_invalidation"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/hit_tracker"
 	"github.com/buildbuddy-io/buildbuddy/server/util/capabilities"
@@ -27,9 +29,20 @@ import (
 	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
 )
 
+var (
+	checkActionResultOutputs      = flag.Bool("cache.check_action_result_outputs", true, "If true, GetActionResult checks that every output referenced by an ActionResult still exists in the CAS before returning it.")
+	missOnMissingOutputs          = flag.Bool("cache.miss_on_missing_outputs", true, "If true, an ActionResult with outputs missing from the CAS is reported as a cache miss, so that the client re-runs the action instead of failing when it fetches the outputs. If false, such results are logged and returned as-is.")
+	actionResultValidationWorkers = flag.Int("cache.action_result_validation_concurrency", 8, "The maximum number of concurrent CAS lookups made while checking the outputs of a single ActionResult.")
+)
+
+// The maximum number of digests passed to a single FindMissing call while
+// validating an ActionResult.
+const validationBatchSize = 1000
+
 type ActionCacheServer struct {
-	env   environment.Env
-	cache interfaces.Cache
+	env          environment.Env
+	cache        interfaces.Cache
+	invalidation *action_cache_invalidation.Checker
 }
 
 func Register(env *real_environment.RealEnv) error {
@@ -42,6 +55,7 @@ func Register(env *real_environment.RealEnv) error {
 		return status.InternalErrorf("Error initializing ActionCacheServer: %s", err)
 	}
 	env.SetActionCacheServer(actionCacheServer)
+	action_cache_invalidation.StartCleanup(env)
 	return nil
 }
 
@@ -50,21 +64,34 @@ func NewActionCacheServer(env environment.Env) (*ActionCacheServer, error) {
 	if cache == nil {
 		return nil, fmt.Errorf("A cache is required to enable the ActionCacheServer")
 	}
+	invalidation, err := action_cache_invalidation.NewChecker(env)
+	if err != nil {
+		return nil, err
+	}
 	return &ActionCacheServer{
-		env:   env,
-		cache: cache,
+		env:          env,
+		cache:        cache,
+		invalidation: invalidation,
 	}, nil
 }
 
 func checkFilesExist(ctx context.Context, cache interfaces.Cache, digests []*rspb.ResourceName) error {
-	missing, err := cache.FindMissing(ctx, digests)
-	if err != nil {
-		return err
-	}
-	if len(missing) > 0 {
-		return status.NotFoundErrorf("ActionResult output file: '%s' not found in cache", missing[0])
+	g, gCtx := errgroup.WithContext(ctx)
+	g.SetLimit(max(*actionResultValidationWorkers, 1))
+	for start := 0; start < len(digests); start += validationBatchSize {
+		batch := digests[start:min(start+validationBatchSize, len(digests))]
+		g.Go(func() error {
+			missing, err := cache.FindMissing(gCtx, batch)
+			if err != nil {
+				return err
+			}
+			if len(missing) > 0 {
+				return status.NotFoundErrorf("ActionResult output file: '%s' not found in cache", missing[0])
+			}
+			return nil
+		})
 	}
-	return nil
+	return g.Wait()
 }
 
 func ValidateActionResult(ctx context.Context, cache interfaces.Cache, remoteInstanceName string, digestFunction repb.DigestFunction_Value, r *repb.ActionResult) error {
@@ -81,8 +108,11 @@ func ValidateActionResult(ctx context.Context, cache interfaces.Cache, remoteIns
 	for _, f := range r.OutputFiles {
 		appendDigest(f.GetDigest())
 	}
+	appendDigest(r.GetStdoutDigest())
+	appendDigest(r.GetStderrDigest())
 
 	g, gCtx := errgroup.WithContext(ctx)
+	g.SetLimit(max(*actionResultValidationWorkers, 1))
 	for _, d := range r.OutputDirectories {
 		dc := d
 		g.Go(func() error {
@@ -153,6 +183,7 @@ func (s *ActionCacheServer) GetActionResult(ctx context.Context, req *repb.GetAc
 	}
 
 	ht := hit_tracker.NewHitTracker(ctx, s.env, true)
+	ht.SetInstanceName(req.GetInstanceName())
 	// Fetch the "ActionResult" object which enumerates all the files in the action.
 	d := req.GetActionDigest()
 	downloadTracker := ht.TrackDownload(d)
@@ -163,7 +194,13 @@ func (s *ActionCacheServer) GetActionResult(ctx context.Context, req *repb.GetAc
 		}
 		return nil, status.NotFoundErrorf("ActionResult (%s) not found: %s", d, err)
 	}
+	// Set if the ActionResult is found but not returned, so that the lookup
+	// is only counted as a miss.
+	missed := false
 	defer func() {
+		if missed {
+			return
+		}
 		if err := downloadTracker.CloseWithBytesTransferred(int64(len(blob)), int64(len(blob)), repb.Compressor_IDENTITY, "ac_server"); err != nil {
 			log.Debugf("GetActionResult: download tracker error: %s", err)
 		}
@@ -173,9 +210,29 @@ func (s *ActionCacheServer) GetActionResult(ctx context.Context, req *repb.GetAc
 	if err := proto.Unmarshal(blob, rsp); err != nil {
 		return nil, err
 	}
+	if invalidated, err := s.invalidation.IsInvalidated(ctx, s.cache, rn, rsp); err != nil {
+		return nil, err
+	} else if invalidated {
+		metrics.ActionCacheInvalidatedCount.Inc()
+		missed = true
+		if err := ht.TrackMiss(d); err != nil {
+			log.Debugf("GetActionResult: hit tracker error: %s", err)
+		}
+		return nil, status.NotFoundErrorf("ActionResult (%s) not found: invalidated", d)
+	}
 	ht.SetExecutedActionMetadata(rsp.GetExecutionMetadata())
-	if err := ValidateActionResult(ctx, s.cache, req.GetInstanceName(), req.GetDigestFunction(), rsp); err != nil {
-		return nil, status.NotFoundErrorf("ActionResult (%s) not found: %s", d, err)
+	if *checkActionResultOutputs {
+		if err := ValidateActionResult(ctx, s.cache, req.GetInstanceName(), req.GetDigestFunction(), rsp); err != nil {
+			metrics.ActionCacheMissingOutputsCount.Inc()
+			if *missOnMissingOutputs {
+				missed = true
+				if err := ht.TrackMissingOutputs(d); err != nil {
+					log.Debugf("GetActionResult: hit tracker error: %s", err)
+				}
+				return nil, status.NotFoundErrorf("ActionResult (%s) not found: %s", d, err)
+			}
+			log.CtxInfof(ctx, "Returning ActionResult (%s) that failed validation: %s", d, err)
+		}
 	}
 	// The default limit on incoming gRPC messages is 4MB and Bazel doesn't
 	// change it.
@@ -227,6 +284,7 @@ func (s *ActionCacheServer) UpdateActionResult(ctx context.Context, req *repb.Up
 	}
 
 	ht := hit_tracker.NewHitTracker(ctx, s.env, true)
+	ht.SetInstanceName(req.GetInstanceName())
 	ht.SetExecutedActionMetadata(req.GetActionResult().GetExecutionMetadata())
 	d := req.GetActionDigest()
 	acResource := digest.NewResourceName(d, req.GetInstanceName(), rspb.CacheType_AC, req.GetDigestFunction())
@@ -4,20 +4,29 @@ import (
 	"context"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/action_cache_invalidation"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/action_cache_server"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/byte_stream_server"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/content_addressable_storage_server"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testmetrics"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
+	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
+	capb "github.com/buildbuddy-io/buildbuddy/proto/cache"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	bspb "google.golang.org/genproto/googleapis/bytestream"
 )
@@ -166,6 +175,253 @@ func TestInlineMultipleFiles(t *testing.T) {
 	)))
 }
 
+func TestMissingOutputs(t *testing.T) {
+	ctx := context.Background()
+	missingDigest := &repb.Digest{
+		Hash:      strings.Repeat("b", 64),
+		SizeBytes: 10,
+	}
+
+	for _, tc := range []struct {
+		name                 string
+		checkOutputs         bool
+		missOnMissingOutputs bool
+		wantMiss             bool
+	}{
+		{name: "miss", checkOutputs: true, missOnMissingOutputs: true, wantMiss: true},
+		{name: "log only", checkOutputs: true, missOnMissingOutputs: false, wantMiss: false},
+		{name: "unchecked", checkOutputs: false, missOnMissingOutputs: true, wantMiss: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			flags.Set(t, "cache.check_action_result_outputs", tc.checkOutputs)
+			flags.Set(t, "cache.miss_on_missing_outputs", tc.missOnMissingOutputs)
+			te := testenv.GetTestEnv(t)
+			clientConn := runACServer(ctx, t, te)
+			acClient := repb.NewActionCacheClient(clientConn)
+			bsClient := bspb.NewByteStreamClient(clientConn)
+
+			digestA, err := cachetools.UploadBlobToCAS(ctx, bsClient, "", repb.DigestFunction_SHA256, []byte("hello world"))
+			require.NoError(t, err)
+			update(t, ctx, acClient, []*repb.OutputFile{
+				{Path: "my/pkg/file", Digest: digestA},
+				{Path: "my/pkg/missing", Digest: missingDigest},
+			})
+
+			before := testutil.ToFloat64(metrics.ActionCacheMissingOutputsCount)
+			_, err = acClient.GetActionResult(ctx, &repb.GetActionResultRequest{
+				ActionDigest: &repb.Digest{
+					Hash:      strings.Repeat("a", 64),
+					SizeBytes: 1024,
+				},
+				DigestFunction: repb.DigestFunction_SHA256,
+			})
+			if tc.wantMiss {
+				require.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+			} else {
+				require.NoError(t, err)
+			}
+			wantCount := float64(0)
+			if tc.checkOutputs {
+				wantCount = 1
+			}
+			assert.Equal(t, wantCount, testutil.ToFloat64(metrics.ActionCacheMissingOutputsCount)-before)
+		})
+	}
+}
+
+func TestInvalidation(t *testing.T) {
+	flags.Set(t, "cache.action_cache_invalidation.cache_ttl", time.Duration(0))
+	te := testenv.GetTestEnv(t)
+	admin := testauth.User("US1", "GR1")
+	admin.GroupMemberships[0].Capabilities = append(admin.GroupMemberships[0].Capabilities, akpb.ApiKey_ORG_ADMIN_CAPABILITY)
+	ta := testauth.NewTestAuthenticator(map[string]interfaces.UserInfo{"US1": admin})
+	te.SetAuthenticator(ta)
+	ctx, err := ta.WithAuthenticatedUser(context.Background(), "US1")
+	require.NoError(t, err)
+
+	clientConn := runACServer(ctx, t, te)
+	acClient := repb.NewActionCacheClient(clientConn)
+	bsClient := bspb.NewByteStreamClient(clientConn)
+
+	// Writes an AC entry for an action with the given platform, and returns
+	// the action's digest.
+	write := func(instanceName, osFamily string, completed time.Time) *repb.Digest {
+		action := &repb.Action{
+			Platform: &repb.Platform{Properties: []*repb.Platform_Property{
+				{Name: "OSFamily", Value: osFamily},
+			}},
+		}
+		ad, err := cachetools.UploadProto(ctx, bsClient, instanceName, repb.DigestFunction_SHA256, action)
+		require.NoError(t, err)
+		_, err = acClient.UpdateActionResult(ctx, &repb.UpdateActionResultRequest{
+			InstanceName:   instanceName,
+			ActionDigest:   ad,
+			DigestFunction: repb.DigestFunction_SHA256,
+			ActionResult: &repb.ActionResult{
+				ExitCode: 1,
+				ExecutionMetadata: &repb.ExecutedActionMetadata{
+					WorkerCompletedTimestamp: timestamppb.New(completed),
+				},
+			},
+		})
+		require.NoError(t, err)
+		return ad
+	}
+	get := func(instanceName string, ad *repb.Digest) error {
+		_, err := acClient.GetActionResult(ctx, &repb.GetActionResultRequest{
+			InstanceName:   instanceName,
+			ActionDigest:   ad,
+			DigestFunction: repb.DigestFunction_SHA256,
+		})
+		return err
+	}
+
+	past := time.Now().Add(-time.Hour)
+	linuxA := write("ci/a", "linux", past)
+	windowsA := write("ci/a", "windows", past)
+	linuxB := write("dev", "linux", past)
+
+	// Invalidations require a prefix or platform property.
+	_, err = action_cache_invalidation.Invalidate(ctx, te, &capb.InvalidateActionCacheRequest{})
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+
+	before := testutil.ToFloat64(metrics.ActionCacheInvalidatedCount)
+	_, err = action_cache_invalidation.Invalidate(ctx, te, &capb.InvalidateActionCacheRequest{
+		InstanceNamePrefix: "ci/",
+		PlatformProperty:   &repb.Platform_Property{Name: "OSFamily", Value: "linux"},
+	})
+	require.NoError(t, err)
+
+	err = get("ci/a", linuxA)
+	require.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+	require.NoError(t, get("ci/a", windowsA), "platform doesn't match")
+	require.NoError(t, get("dev", linuxB), "instance name doesn't match")
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.ActionCacheInvalidatedCount)-before)
+
+	// Entries written after the invalidation are served again.
+	write("ci/a", "linux", time.Now().Add(time.Hour))
+	require.NoError(t, get("ci/a", linuxA))
+
+	// Invalidating by prefix alone invalidates every matching entry.
+	_, err = action_cache_invalidation.Invalidate(ctx, te, &capb.InvalidateActionCacheRequest{
+		InstanceNamePrefix: "dev",
+	})
+	require.NoError(t, err)
+	err = get("dev", linuxB)
+	require.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+	require.NoError(t, get("ci/a", windowsA))
+}
+
+func TestInvalidationDeleteAndExpiry(t *testing.T) {
+	flags.Set(t, "cache.action_cache_invalidation.cache_ttl", time.Duration(0))
+	te := testenv.GetTestEnv(t)
+	admin := testauth.User("US1", "GR1")
+	admin.GroupMemberships[0].Capabilities = append(admin.GroupMemberships[0].Capabilities, akpb.ApiKey_ORG_ADMIN_CAPABILITY)
+	ta := testauth.NewTestAuthenticator(map[string]interfaces.UserInfo{
+		"US1": admin,
+		"US2": testauth.User("US2", "GR2"),
+	})
+	te.SetAuthenticator(ta)
+	ctx, err := ta.WithAuthenticatedUser(context.Background(), "US1")
+	require.NoError(t, err)
+
+	clientConn := runACServer(ctx, t, te)
+	acClient := repb.NewActionCacheClient(clientConn)
+	ad := &repb.Digest{Hash: strings.Repeat("b", 64), SizeBytes: 1024}
+	_, err = acClient.UpdateActionResult(ctx, &repb.UpdateActionResultRequest{
+		InstanceName:   "ci",
+		ActionDigest:   ad,
+		DigestFunction: repb.DigestFunction_SHA256,
+		ActionResult: &repb.ActionResult{
+			ExitCode: 1,
+			ExecutionMetadata: &repb.ExecutedActionMetadata{
+				WorkerCompletedTimestamp: timestamppb.New(time.Now().Add(-time.Hour)),
+			},
+		},
+	})
+	require.NoError(t, err)
+	get := func() error {
+		_, err := acClient.GetActionResult(ctx, &repb.GetActionResultRequest{
+			InstanceName:   "ci",
+			ActionDigest:   ad,
+			DigestFunction: repb.DigestFunction_SHA256,
+		})
+		return err
+	}
+	invalidate := func() string {
+		rsp, err := action_cache_invalidation.Invalidate(ctx, te, &capb.InvalidateActionCacheRequest{InstanceNamePrefix: "ci"})
+		require.NoError(t, err)
+		err = get()
+		require.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+		return rsp.GetInvalidationId()
+	}
+	count := func() int64 {
+		var n int64
+		err := te.GetDBHandle().NewQuery(ctx, "count_invalidations").Raw(`SELECT COUNT(*) FROM "ActionCacheInvalidations"`).Take(&n)
+		require.NoError(t, err)
+		return n
+	}
+
+	// Deleting an invalidation serves the entries it invalidated again.
+	id := invalidate()
+	otherCtx, err := ta.WithAuthenticatedUser(context.Background(), "US2")
+	require.NoError(t, err)
+	_, err = action_cache_invalidation.Delete(otherCtx, te, &capb.DeleteActionCacheInvalidationRequest{InvalidationId: id})
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+	_, err = action_cache_invalidation.Delete(ctx, te, &capb.DeleteActionCacheInvalidationRequest{InvalidationId: id})
+	require.NoError(t, err)
+	require.NoError(t, get())
+	_, err = action_cache_invalidation.Delete(ctx, te, &capb.DeleteActionCacheInvalidationRequest{InvalidationId: id})
+	require.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+
+	// Expired invalidations are ignored, and deleted by the cleanup.
+	invalidate()
+	require.NoError(t, action_cache_invalidation.DeleteExpired(ctx, te))
+	require.Equal(t, int64(1), count(), "unexpired invalidations should be kept")
+	flags.Set(t, "cache.action_cache_invalidation.ttl", time.Duration(0))
+	require.NoError(t, action_cache_invalidation.DeleteExpired(ctx, te))
+	require.Equal(t, int64(1), count(), "invalidations should be kept without a TTL")
+	flags.Set(t, "cache.action_cache_invalidation.ttl", time.Nanosecond)
+	require.NoError(t, get())
+	require.NoError(t, action_cache_invalidation.DeleteExpired(ctx, te))
+	require.Equal(t, int64(0), count())
+}
+
+func TestInvalidationOfUndatedEntries(t *testing.T) {
+	flags.Set(t, "cache.action_cache_invalidation.cache_ttl", time.Duration(0))
+	te := testenv.GetTestEnv(t)
+	admin := testauth.User("US1", "GR1")
+	admin.GroupMemberships[0].Capabilities = append(admin.GroupMemberships[0].Capabilities, akpb.ApiKey_ORG_ADMIN_CAPABILITY)
+	ta := testauth.NewTestAuthenticator(map[string]interfaces.UserInfo{"US1": admin})
+	te.SetAuthenticator(ta)
+	ctx, err := ta.WithAuthenticatedUser(context.Background(), "US1")
+	require.NoError(t, err)
+
+	clientConn := runACServer(ctx, t, te)
+	acClient := repb.NewActionCacheClient(clientConn)
+	// The entry doesn't record when its action ran, and the memory cache
+	// doesn't track when entries are written.
+	ad := &repb.Digest{Hash: strings.Repeat("c", 64), SizeBytes: 1024}
+	_, err = acClient.UpdateActionResult(ctx, &repb.UpdateActionResultRequest{
+		InstanceName:   "ci",
+		ActionDigest:   ad,
+		DigestFunction: repb.DigestFunction_SHA256,
+		ActionResult:   &repb.ActionResult{ExitCode: 1},
+	})
+	require.NoError(t, err)
+	_, err = action_cache_invalidation.Invalidate(ctx, te, &capb.InvalidateActionCacheRequest{InstanceNamePrefix: "ci"})
+	require.NoError(t, err)
+
+	// Entries that can't be dated are served, since they couldn't be told
+	// apart from the results of re-running their actions either.
+	_, err = acClient.GetActionResult(ctx, &repb.GetActionResultRequest{
+		InstanceName:   "ci",
+		ActionDigest:   ad,
+		DigestFunction: repb.DigestFunction_SHA256,
+	})
+	require.NoError(t, err)
+}
+
 func update(t *testing.T, ctx context.Context, client repb.ActionCacheClient, outputFiles []*repb.OutputFile) {
 	req := repb.UpdateActionResultRequest{
 		ActionDigest: &repb.Digest{
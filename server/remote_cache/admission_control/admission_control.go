@@ -0,0 +1,144 @@
+// Package admission_control holds off cache writes while the cache's storage
+// is falling behind, so that bursts of uploads don't degrade latency for
+// every client of the cache.
+package admission_control
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/jonboulle/clockwork"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	gstatus "google.golang.org/grpc/status"
+)
+
+var (
+	maxCompactionDebtBytes     = flag.UInt64("cache.admission_control.max_compaction_debt_bytes", 0, "If set, cache writes are queued, and eventually shed, while the cache's estimated compaction backlog exceeds this many bytes.")
+	maxDiskWriteBytesPerSecond = flag.Float64("cache.admission_control.max_disk_write_bytes_per_second", 0, "If set, cache writes are queued, and eventually shed, while the cache is writing to disk faster than this rate.")
+	maxQueueDuration           = flag.Duration("cache.admission_control.max_queue_duration", 500*time.Millisecond, "How long a cache write may wait for load to drop below the admission control thresholds before it is rejected.")
+	maxQueuedWrites            = flag.Int64("cache.admission_control.max_queued_writes", 100, "The maximum number of cache writes that may wait for load to drop at once. Writes beyond this are rejected immediately.")
+	retryDelay                 = flag.Duration("cache.admission_control.retry_delay", 1*time.Second, "The minimum delay suggested to clients whose writes were rejected by admission control. A random jitter of up to half this value is added so that rejected clients don't retry in lockstep.")
+)
+
+const (
+	// How often queued writes re-check the load on the cache.
+	pollInterval = 25 * time.Millisecond
+
+	admittedDecision = "admitted"
+	queuedDecision   = "queued"
+	shedDecision     = "shed"
+
+	compactionDebtReason      = "compaction_debt"
+	diskWriteThroughputReason = "disk_write_throughput"
+)
+
+// Controller decides whether cache writes may proceed. A nil *Controller
+// admits every write.
+type Controller struct {
+	cache  interfaces.WriteLoadReportingCache
+	clock  clockwork.Clock
+	queued atomic.Int64
+}
+
+// New returns a Controller that checks writes against the load reported by
+// cache. It returns nil if no thresholds are configured or if the cache
+// doesn't report its load.
+func New(cache interfaces.Cache, clock clockwork.Clock) *Controller {
+	if *maxCompactionDebtBytes == 0 && *maxDiskWriteBytesPerSecond == 0 {
+		return nil
+	}
+	r, ok := cache.(interfaces.WriteLoadReportingCache)
+	if !ok {
+		return nil
+	}
+	return &Controller{cache: r, clock: clock}
+}
+
+// overloadReason returns why the cache is currently too busy to accept
+// writes, or "" if it isn't.
+func (c *Controller) overloadReason() string {
+	load := c.cache.WriteLoad()
+	if *maxCompactionDebtBytes > 0 && load.CompactionDebtBytes > *maxCompactionDebtBytes {
+		return compactionDebtReason
+	}
+	if *maxDiskWriteBytesPerSecond > 0 && load.DiskWriteBytesPerSecond > *maxDiskWriteBytesPerSecond {
+		return diskWriteThroughputReason
+	}
+	return ""
+}
+
+// Admit returns nil once a write may proceed. If the cache is overloaded, the
+// write is queued until the load drops, up to the configured queue duration.
+// Writes that can't be admitted in time, or that arrive while the queue is
+// full, fail with a retryable UNAVAILABLE error that tells the client how long
+// to back off for.
+func (c *Controller) Admit(ctx context.Context) error {
+	if c == nil {
+		return nil
+	}
+	reason := c.overloadReason()
+	if reason == "" {
+		recordDecision(admittedDecision, "")
+		return nil
+	}
+	if c.queued.Add(1) > *maxQueuedWrites {
+		c.queued.Add(-1)
+		recordDecision(shedDecision, reason)
+		return overloadedError(reason)
+	}
+	defer c.queued.Add(-1)
+
+	start := c.clock.Now()
+	defer func() {
+		metrics.CacheWriteAdmissionQueueDurationUsec.Observe(float64(c.clock.Since(start).Microseconds()))
+	}()
+	ticker := c.clock.NewTicker(pollInterval)
+	defer ticker.Stop()
+	deadline := c.clock.After(*maxQueueDuration)
+	for {
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx)
+		case <-deadline:
+			recordDecision(shedDecision, reason)
+			return overloadedError(reason)
+		case <-ticker.Chan():
+			if r := c.overloadReason(); r != "" {
+				reason = r
+				continue
+			}
+			recordDecision(queuedDecision, reason)
+			return nil
+		}
+	}
+}
+
+func recordDecision(decision, reason string) {
+	metrics.CacheWriteAdmissionCount.With(prometheus.Labels{
+		metrics.CacheWriteAdmissionDecision:       decision,
+		metrics.CacheWriteAdmissionOverloadReason: reason,
+	}).Inc()
+}
+
+func overloadedError(reason string) error {
+	delay := *retryDelay + time.Duration(rand.Int63n(int64(*retryDelay/2)+1))
+	msg := fmt.Sprintf("The cache is temporarily overloaded (%s). Retry after %s.", reason, delay)
+	st, err := gstatus.New(codes.Unavailable, msg).WithDetails(&errdetails.RetryInfo{
+		RetryDelay: durationpb.New(delay),
+	})
+	if err != nil {
+		return status.UnavailableError(msg)
+	}
+	return st.Err()
+}
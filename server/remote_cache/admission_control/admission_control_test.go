@@ -0,0 +1,140 @@
+package admission_control_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/backends/memory_cache"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/admission_control"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+
+	gstatus "google.golang.org/grpc/status"
+)
+
+type fakeCache struct {
+	interfaces.Cache
+
+	mu   sync.Mutex
+	load interfaces.CacheWriteLoad
+}
+
+func newFakeCache(t *testing.T) *fakeCache {
+	mc, err := memory_cache.NewMemoryCache(1_000_000)
+	require.NoError(t, err)
+	return &fakeCache{Cache: mc}
+}
+
+func (c *fakeCache) WriteLoad() interfaces.CacheWriteLoad {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.load
+}
+
+func (c *fakeCache) setLoad(load interfaces.CacheWriteLoad) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load = load
+}
+
+func admitAsync(ctx context.Context, c *admission_control.Controller) chan error {
+	ch := make(chan error, 1)
+	go func() { ch <- c.Admit(ctx) }()
+	return ch
+}
+
+func requireRetryInfo(t *testing.T, err error) {
+	require.True(t, status.IsUnavailableError(err), "expected Unavailable, got %v", err)
+	for _, d := range gstatus.Convert(err).Details() {
+		if ri, ok := d.(*errdetails.RetryInfo); ok {
+			require.GreaterOrEqual(t, ri.GetRetryDelay().AsDuration(), 1*time.Second)
+			return
+		}
+	}
+	require.FailNow(t, "error is missing RetryInfo", "%v", err)
+}
+
+func TestNew_Disabled(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+
+	// No thresholds configured.
+	c := admission_control.New(newFakeCache(t), clock)
+	require.Nil(t, c)
+	require.NoError(t, c.Admit(context.Background()))
+
+	// Cache doesn't report its load.
+	flags.Set(t, "cache.admission_control.max_compaction_debt_bytes", uint64(100))
+	mc, err := memory_cache.NewMemoryCache(1_000_000)
+	require.NoError(t, err)
+	require.Nil(t, admission_control.New(mc, clock))
+}
+
+func TestAdmit(t *testing.T) {
+	flags.Set(t, "cache.admission_control.max_compaction_debt_bytes", uint64(100))
+	flags.Set(t, "cache.admission_control.max_disk_write_bytes_per_second", 1000.0)
+	flags.Set(t, "cache.admission_control.max_queue_duration", 1*time.Second)
+	ctx := context.Background()
+	clock := clockwork.NewFakeClock()
+	cache := newFakeCache(t)
+	c := admission_control.New(cache, clock)
+	require.NotNil(t, c)
+
+	// Writes are admitted immediately while the cache keeps up.
+	cache.setLoad(interfaces.CacheWriteLoad{CompactionDebtBytes: 100, DiskWriteBytesPerSecond: 1000})
+	require.NoError(t, c.Admit(ctx))
+
+	// Writes are queued while the cache is behind, and admitted once it
+	// catches up.
+	cache.setLoad(interfaces.CacheWriteLoad{CompactionDebtBytes: 101})
+	ch := admitAsync(ctx, c)
+	clock.BlockUntil(2)
+	clock.Advance(500 * time.Millisecond)
+	select {
+	case err := <-ch:
+		require.FailNow(t, "write should still be queued", "got %v", err)
+	default:
+	}
+	cache.setLoad(interfaces.CacheWriteLoad{})
+	clock.Advance(100 * time.Millisecond)
+	require.NoError(t, <-ch)
+
+	// Writes are shed if the cache doesn't catch up in time.
+	cache.setLoad(interfaces.CacheWriteLoad{DiskWriteBytesPerSecond: 1001})
+	ch = admitAsync(ctx, c)
+	clock.BlockUntil(2)
+	clock.Advance(1 * time.Second)
+	requireRetryInfo(t, <-ch)
+
+	// Queued writes are canceled along with their request.
+	cctx, cancel := context.WithCancel(ctx)
+	ch = admitAsync(cctx, c)
+	clock.BlockUntil(2)
+	cancel()
+	require.True(t, status.IsCanceledError(<-ch))
+}
+
+func TestAdmit_QueueFull(t *testing.T) {
+	flags.Set(t, "cache.admission_control.max_compaction_debt_bytes", uint64(100))
+	flags.Set(t, "cache.admission_control.max_queued_writes", int64(1))
+	ctx := context.Background()
+	clock := clockwork.NewFakeClock()
+	cache := newFakeCache(t)
+	c := admission_control.New(cache, clock)
+	cache.setLoad(interfaces.CacheWriteLoad{CompactionDebtBytes: 101})
+
+	queued := admitAsync(ctx, c)
+	clock.BlockUntil(2)
+
+	// The queue is full, so this write is shed without waiting.
+	requireRetryInfo(t, c.Admit(ctx))
+
+	cache.setLoad(interfaces.CacheWriteLoad{})
+	clock.Advance(100 * time.Millisecond)
+	require.NoError(t, <-queued)
+}
@@ -9,8 +9,10 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/admission_control"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/hit_tracker"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_execution/execution_output"
 	"github.com/buildbuddy-io/buildbuddy/server/util/bazel_deprecation"
 	"github.com/buildbuddy-io/buildbuddy/server/util/bazel_request"
 	"github.com/buildbuddy-io/buildbuddy/server/util/bytebufferpool"
@@ -44,6 +46,7 @@ type ByteStreamServer struct {
 	cache      interfaces.Cache
 	bufferPool *bytebufferpool.VariableSizePool
 	warner     *bazel_deprecation.Warner
+	admission  *admission_control.Controller
 }
 
 func Register(env *real_environment.RealEnv) error {
@@ -69,6 +72,7 @@ func NewByteStreamServer(env environment.Env) (*ByteStreamServer, error) {
 		cache:      cache,
 		bufferPool: bytebufferpool.VariableSize(readBufSizeBytes),
 		warner:     bazel_deprecation.NewWarner(env),
+		admission:  admission_control.New(cache, env.GetClock()),
 	}, nil
 }
 
@@ -92,6 +96,15 @@ func (s *ByteStreamServer) Read(req *bspb.ReadRequest, stream bspb.ByteStream_Re
 	if err := checkReadPreconditions(req); err != nil {
 		return err
 	}
+	// The output of in-progress executions is streamed by the execution
+	// server rather than read from the cache.
+	if _, _, ok := execution_output.ParseStreamName(req.GetResourceName()); ok {
+		rexec := s.env.GetRemoteExecutionService()
+		if rexec == nil {
+			return status.UnimplementedError("Remote execution is not enabled")
+		}
+		return rexec.ReadExecutionOutput(req, stream)
+	}
 	r, err := digest.ParseDownloadResourceName(req.GetResourceName())
 	if err != nil {
 		return err
@@ -114,6 +127,10 @@ func (s *ByteStreamServer) Read(req *bspb.ReadRequest, stream bspb.ByteStream_Re
 	downloadTracker := ht.TrackDownload(r.GetDigest())
 
 	cacheRN := digest.NewResourceName(r.GetDigest(), r.GetInstanceName(), rspb.CacheType_CAS, r.GetDigestFunction())
+	// For compressed blobs, ReadOffset and ReadLimit refer to the
+	// uncompressed contents, so the cache only passes compressed bytes
+	// through when the whole blob is read. Otherwise, the requested range of
+	// uncompressed bytes is compressed below.
 	passthroughCompressionEnabled := s.cache.SupportsCompressor(r.GetCompressor()) && req.ReadOffset == 0 && req.ReadLimit == 0
 	if passthroughCompressionEnabled {
 		cacheRN.SetCompressor(r.GetCompressor())
@@ -394,6 +411,10 @@ func (s *ByteStreamServer) Write(stream bspb.ByteStream_WriteServer) error {
 				return s.handleAlreadyExists(ctx, ht, stream, req)
 			}
 
+			if err := s.admission.Admit(ctx); err != nil {
+				return err
+			}
+
 			streamState, err = s.initStreamState(ctx, req)
 			if status.IsAlreadyExistsError(err) {
 				return s.handleAlreadyExists(ctx, ht, stream, req)
@@ -247,6 +247,41 @@ func TestRPCReadWriteLargeBlob(t *testing.T) {
 	require.Equal(t, blob, buf.String())
 }
 
+func TestRPCWriteAndReadBlake3(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	clientConn := runByteStreamServer(ctx, t, te)
+	bsClient := bspb.NewByteStreamClient(clientConn)
+
+	blob, err := random.RandomString(1000)
+	require.NoError(t, err)
+	d, err := digest.Compute(strings.NewReader(blob), repb.DigestFunction_BLAKE3)
+	require.NoError(t, err)
+	rn := digest.NewResourceName(d, "", rspb.CacheType_CAS, repb.DigestFunction_BLAKE3)
+
+	uploadString, err := rn.UploadString()
+	require.NoError(t, err)
+	require.Contains(t, uploadString, "/blobs/blake3/")
+
+	// Write
+	_, _, err = cachetools.UploadFromReader(ctx, bsClient, rn, strings.NewReader(blob))
+	require.NoError(t, err)
+
+	// Read
+	var buf bytes.Buffer
+	err = byte_stream.ReadBlob(ctx, bsClient, rn, &buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, blob, buf.String())
+
+	// The upload must be verified using the BLAKE3 hash: the SHA256 digest of
+	// the same bytes should be rejected.
+	sha256Digest, err := digest.Compute(strings.NewReader(blob), repb.DigestFunction_SHA256)
+	require.NoError(t, err)
+	badRN := digest.NewResourceName(sha256Digest, "", rspb.CacheType_CAS, repb.DigestFunction_BLAKE3)
+	_, _, err = cachetools.UploadFromReader(ctx, bsClient, badRN, strings.NewReader(blob))
+	require.True(t, status.IsDataLossError(err), "expected DataLoss error, got %v", err)
+}
+
 func TestRPCWriteAndReadCompressed(t *testing.T) {
 	ctx := context.Background()
 	te := testenv.GetTestEnv(t)
@@ -561,6 +596,78 @@ func Test_CacheHandlesCompression(t *testing.T) {
 	}
 }
 
+func TestRPCReadWithOffsetAndLimit(t *testing.T) {
+	rn, blob := testdigest.RandomCompressibleCASResourceBuf(t, 1e6, "" /*instanceName*/)
+	d := rn.GetDigest()
+	size := d.GetSizeBytes()
+
+	read := func(t *testing.T, bsClient bspb.ByteStreamClient, ctx context.Context, req *bspb.ReadRequest) ([]byte, error) {
+		stream, err := bsClient.Read(ctx, req)
+		require.NoError(t, err)
+		var buf []byte
+		for {
+			res, err := stream.Recv()
+			if err == io.EOF {
+				return buf, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			buf = append(buf, res.Data...)
+		}
+	}
+
+	for _, cacheSupportsCompression := range []bool{false, true} {
+		t.Run(fmt.Sprintf("cache_supports_compression=%t", cacheSupportsCompression), func(t *testing.T) {
+			te := testenv.GetTestEnv(t)
+			flags.Set(t, "cache.zstd_transcoding_enabled", true)
+			if cacheSupportsCompression {
+				te.SetCache(&testcompression.CompressionCache{Cache: te.GetCache()})
+			}
+			ctx, err := prefix.AttachUserPrefixToContext(context.Background(), te)
+			require.NoError(t, err)
+			clientConn := runByteStreamServer(ctx, t, te)
+			bsClient := bspb.NewByteStreamClient(clientConn)
+
+			uploadResourceName := fmt.Sprintf("uploads/%s/compressed-blobs/zstd/%s/%d", newUUID(t), d.Hash, d.SizeBytes)
+			byte_stream.MustUploadChunked(t, ctx, bsClient, defaultBazelVersion, uploadResourceName, compression.CompressZstd(nil, blob), true)
+
+			for _, tc := range []struct {
+				offset, limit int64
+			}{
+				{offset: 0, limit: 100},
+				{offset: size - 100, limit: 0},
+				{offset: size - 100, limit: 10},
+				{offset: size / 2, limit: size},
+				{offset: size, limit: 0},
+			} {
+				// Reading uncompressed blobs supports both offset and limit.
+				got, err := read(t, bsClient, ctx, &bspb.ReadRequest{
+					ResourceName: fmt.Sprintf("blobs/%s/%d", d.Hash, d.SizeBytes),
+					ReadOffset:   tc.offset,
+					ReadLimit:    tc.limit,
+				})
+				require.NoError(t, err)
+				end := size
+				if tc.limit != 0 && tc.offset+tc.limit < size {
+					end = tc.offset + tc.limit
+				}
+				require.Equal(t, string(blob[tc.offset:end]), string(got), "offset=%d, limit=%d", tc.offset, tc.limit)
+
+				// Reading compressed blobs applies the offset and limit to
+				// the uncompressed contents.
+				got, err = read(t, bsClient, ctx, &bspb.ReadRequest{
+					ResourceName: fmt.Sprintf("compressed-blobs/zstd/%s/%d", d.Hash, d.SizeBytes),
+					ReadOffset:   tc.offset,
+					ReadLimit:    tc.limit,
+				})
+				require.NoError(t, err)
+				require.Equal(t, string(blob[tc.offset:end]), string(zstdDecompress(t, got)), "offset=%d, limit=%d", tc.offset, tc.limit)
+			}
+		})
+	}
+}
+
 func zstdDecompress(t *testing.T, b []byte) []byte {
 	out, err := compression.DecompressZstd(nil, b)
 	require.NoError(t, err, "failed to decompress blob")
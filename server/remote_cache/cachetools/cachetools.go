@@ -551,6 +551,16 @@ func SupportsCompression(ctx context.Context, capabilitiesClient repb.Capabiliti
 	return supportsBytestreamCompression && supportsBatchUpdateCompression, nil
 }
 
+// SupportsSpliceBlob returns whether the cache server supports splicing blobs
+// from chunks with the SpliceBlob API.
+func SupportsSpliceBlob(ctx context.Context, capabilitiesClient repb.CapabilitiesClient) (bool, error) {
+	rsp, err := capabilitiesClient.GetCapabilities(ctx, &repb.GetCapabilitiesRequest{})
+	if err != nil {
+		return false, err
+	}
+	return rsp.GetCacheCapabilities().GetSpliceBlobSupport(), nil
+}
+
 // BatchCASUploader uploads many files to CAS concurrently, batching small
 // uploads together and falling back to bytestream uploads for large files.
 type BatchCASUploader struct {
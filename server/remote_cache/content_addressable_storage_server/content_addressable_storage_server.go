@@ -5,6 +5,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"slices"
@@ -16,6 +17,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/metrics"
 	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/admission_control"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/directory_size"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/hit_tracker"
@@ -57,8 +59,9 @@ var (
 )
 
 type ContentAddressableStorageServer struct {
-	env   environment.Env
-	cache interfaces.Cache
+	env       environment.Env
+	cache     interfaces.Cache
+	admission *admission_control.Controller
 }
 
 func Register(env *real_environment.RealEnv) error {
@@ -88,8 +91,9 @@ func NewContentAddressableStorageServer(env environment.Env) (*ContentAddressabl
 		return nil, fmt.Errorf("A cache is required to enable the ContentAddressableStorageServer")
 	}
 	return &ContentAddressableStorageServer{
-		env:   env,
-		cache: cache,
+		env:       env,
+		cache:     cache,
+		admission: admission_control.New(cache, env.GetClock()),
 	}, nil
 }
 
@@ -167,6 +171,10 @@ func (s *ContentAddressableStorageServer) BatchUpdateBlobs(ctx context.Context,
 		return rsp, nil
 	}
 
+	if err := s.admission.Admit(ctx); err != nil {
+		return nil, err
+	}
+
 	rsp.Responses = make([]*repb.BatchUpdateBlobsResponse_Response, 0, len(req.Requests))
 
 	ht := hit_tracker.NewHitTracker(ctx, s.env, false)
@@ -261,6 +269,100 @@ func (s *ContentAddressableStorageServer) BatchUpdateBlobs(ctx context.Context,
 	return rsp, nil
 }
 
+// Splice a blob from chunks that are already in the CAS.
+//
+// Errors:
+//
+//   - `INVALID_ARGUMENT`: The sizes of the chunks don't add up to the size of
+//     the blob.
+//   - `NOT_FOUND`: At least one of the chunks is not present in the CAS.
+//   - `DATA_LOSS`: The spliced chunks don't match the blob digest.
+func (s *ContentAddressableStorageServer) SpliceBlob(ctx context.Context, req *repb.SpliceBlobRequest) (*repb.SpliceBlobResponse, error) {
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, s.env)
+	if err != nil {
+		return nil, err
+	}
+	rsp := &repb.SpliceBlobResponse{BlobDigest: req.GetBlobDigest()}
+
+	canWrite, err := capabilities.IsGranted(ctx, s.env, akpb.ApiKey_CACHE_WRITE_CAPABILITY|akpb.ApiKey_CAS_WRITE_CAPABILITY)
+	if err != nil {
+		return nil, err
+	}
+	if !canWrite {
+		// For read-only API keys, pretend the write succeeded, like
+		// BatchUpdateBlobs.
+		return rsp, nil
+	}
+
+	blobRN := digest.NewResourceName(req.GetBlobDigest(), req.GetInstanceName(), rspb.CacheType_CAS, req.GetDigestFunction())
+	if err := blobRN.Validate(); err != nil {
+		return nil, err
+	}
+	if blobRN.IsEmpty() {
+		return rsp, nil
+	}
+	chunkRNs := make([]*rspb.ResourceName, 0, len(req.GetChunkDigests()))
+	chunksSize := int64(0)
+	for _, d := range req.GetChunkDigests() {
+		rn := digest.NewResourceName(d, req.GetInstanceName(), rspb.CacheType_CAS, req.GetDigestFunction())
+		if err := rn.Validate(); err != nil {
+			return nil, err
+		}
+		if rn.IsEmpty() {
+			continue
+		}
+		chunkRNs = append(chunkRNs, rn.ToProto())
+		chunksSize += d.GetSizeBytes()
+	}
+	if chunksSize != blobRN.GetDigest().GetSizeBytes() {
+		return nil, status.InvalidArgumentErrorf("chunks add up to %d bytes, but the blob is %d bytes", chunksSize, blobRN.GetDigest().GetSizeBytes())
+	}
+
+	if err := s.admission.Admit(ctx); err != nil {
+		return nil, err
+	}
+
+	if exists, err := s.cache.Contains(ctx, blobRN.ToProto()); err == nil && exists {
+		return rsp, nil
+	}
+	missing, err := s.cache.FindMissing(ctx, chunkRNs)
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) > 0 {
+		return nil, status.NotFoundErrorf("%d of the %d chunks of %s are missing, including %s", len(missing), len(chunkRNs), blobRN.GetDigest().GetHash(), missing[0].GetHash())
+	}
+
+	checksum, err := digest.HashForDigestType(blobRN.GetDigestFunction())
+	if err != nil {
+		return nil, err
+	}
+	wc, err := s.cache.Writer(ctx, blobRN.ToProto())
+	if err != nil {
+		return nil, err
+	}
+	defer wc.Close()
+	w := io.MultiWriter(checksum, wc)
+	for _, rn := range chunkRNs {
+		r, err := s.cache.Reader(ctx, rn, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(w, r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if computedDigest := fmt.Sprintf("%x", checksum.Sum(nil)); computedDigest != blobRN.GetDigest().GetHash() {
+		return nil, status.DataLossErrorf("Spliced chunks checksum (%q) did not match digest (%q).", computedDigest, blobRN.GetDigest().GetHash())
+	}
+	if err := wc.Commit(); err != nil {
+		return nil, err
+	}
+	return rsp, nil
+}
+
 type downloadTrackerData struct {
 	bytesReadFromCache      int
 	bytesDownloadedToClient int
@@ -422,6 +422,69 @@ func TestMalevolentCache(t *testing.T) {
 	assert.Equal(t, int32(gcodes.OK), set.GetResponses()[0].GetStatus().GetCode())
 }
 
+func TestSpliceBlob(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, te)
+	require.NoError(t, err)
+
+	clientConn := runCASServer(ctx, t, te)
+	casClient := repb.NewContentAddressableStorageClient(clientConn)
+	bsClient := bspb.NewByteStreamClient(clientConn)
+
+	var blob []byte
+	var chunkDigests []*repb.Digest
+	req := &repb.BatchUpdateBlobsRequest{}
+	for i := 0; i < 3; i++ {
+		rn, buf := testdigest.RandomCASResourceBuf(t, 1000)
+		req.Requests = append(req.Requests, &repb.BatchUpdateBlobsRequest_Request{
+			Digest: rn.GetDigest(),
+			Data:   buf,
+		})
+		chunkDigests = append(chunkDigests, rn.GetDigest())
+		blob = append(blob, buf...)
+	}
+	_, err = casClient.BatchUpdateBlobs(ctx, req)
+	require.NoError(t, err)
+	blobDigest, err := digest.Compute(bytes.NewReader(blob), repb.DigestFunction_SHA256)
+	require.NoError(t, err)
+
+	// The chunks must add up to the blob.
+	_, err = casClient.SpliceBlob(ctx, &repb.SpliceBlobRequest{
+		BlobDigest:   blobDigest,
+		ChunkDigests: chunkDigests[:2],
+	})
+	require.Equal(t, gcodes.InvalidArgument, gstatus.Code(err), "%s", err)
+
+	// The chunks must all be in the CAS.
+	missingRN, _ := testdigest.RandomCASResourceBuf(t, 1000)
+	_, err = casClient.SpliceBlob(ctx, &repb.SpliceBlobRequest{
+		BlobDigest:   blobDigest,
+		ChunkDigests: []*repb.Digest{chunkDigests[0], missingRN.GetDigest(), chunkDigests[2]},
+	})
+	require.Equal(t, gcodes.NotFound, gstatus.Code(err), "%s", err)
+
+	// The spliced chunks must match the blob digest.
+	_, err = casClient.SpliceBlob(ctx, &repb.SpliceBlobRequest{
+		BlobDigest:   blobDigest,
+		ChunkDigests: []*repb.Digest{chunkDigests[1], chunkDigests[0], chunkDigests[2]},
+	})
+	require.Equal(t, gcodes.DataLoss, gstatus.Code(err), "%s", err)
+
+	rsp, err := casClient.SpliceBlob(ctx, &repb.SpliceBlobRequest{
+		BlobDigest:   blobDigest,
+		ChunkDigests: chunkDigests,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, blobDigest.GetHash(), rsp.GetBlobDigest().GetHash())
+
+	out := &bytes.Buffer{}
+	blobRN := digest.NewResourceName(blobDigest, "", rspb.CacheType_CAS, repb.DigestFunction_SHA256)
+	err = cachetools.GetBlob(ctx, bsClient, blobRN, out)
+	require.NoError(t, err)
+	assert.Equal(t, blob, out.Bytes())
+}
+
 func digestStrings(digests ...*repb.Digest) []string {
 	out := make([]string, len(digests))
 	for i, d := range digests {
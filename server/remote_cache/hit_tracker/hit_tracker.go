@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"regexp"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
@@ -30,8 +31,11 @@ import (
 )
 
 var (
-	detailedStatsEnabled = flag.Bool("cache.detailed_stats_enabled", false, "Whether to enable detailed stats recording for all cache requests.")
-	scorecardResultsTTL  = flag.Duration("cache.detailed_stats_ttl", 3*time.Hour, "How long to go without receiving any cache requests for an invocation before deleting the invocation's detailed results from the metrics collector. Has no effect if cache.detailed_stats_enabled is not set.")
+	detailedStatsEnabled      = flag.Bool("cache.detailed_stats_enabled", false, "Whether to enable detailed stats recording for all cache requests.")
+	scorecardResultsTTL       = flag.Duration("cache.detailed_stats_ttl", 3*time.Hour, "How long to go without receiving any cache requests for an invocation before deleting the invocation's detailed results from the metrics collector. Has no effect if cache.detailed_stats_enabled is not set.")
+	hitRateTrackingEnabled    = flag.Bool("cache.target_hit_rate_tracking_enabled", false, "If true, action cache hits and misses are also counted per target label and per action mnemonic, and saved with the invocation's cache scorecard.")
+	missClassificationEnabled = flag.Bool("cache.miss_classification_enabled", false, "If true, action cache writes are recorded per group, and action cache misses in the detailed cache scorecard are classified by comparing them with the recorded writes. Has no effect if cache.detailed_stats_enabled is not set.")
+	acWriteHistoryTTL         = flag.Duration("cache.miss_classification_history_ttl", 7*24*time.Hour, "How long action cache writes are remembered for classifying action cache misses.")
 
 	// Example: "GoLink(//merger:merger_test)/16f1152b7b260f690ea06f8b938a1b60712b5ee41a1c125ecad8ed9416481fbb"
 	actionRegexp = regexp.MustCompile(`^(?P<action_mnemonic>[[:alnum:]]*)\((?P<target_id>.+)\)/(?P<action_id>[[:alnum:]]+)$`)
@@ -106,6 +110,57 @@ func resultsKey(iid string) string {
 	return "hit_tracker/" + iid + "/results"
 }
 
+// targetHitRatesKey returns a string key under which action cache hits and
+// misses are accounted per target label.
+func targetHitRatesKey(iid string) string {
+	return "hit_tracker/" + iid + "/target_hit_rates"
+}
+
+// mnemonicHitRatesKey returns a string key under which action cache hits and
+// misses are accounted per action mnemonic.
+func mnemonicHitRatesKey(iid string) string {
+	return "hit_tracker/" + iid + "/mnemonic_hit_rates"
+}
+
+// acWritesKey returns a string key under which the action cache writes of an
+// action digest are counted per instance name, across all of a group's
+// invocations.
+func acWritesKey(groupID, actionHash string) string {
+	return "hit_tracker/ac_writes/" + groupID + "/" + actionHash
+}
+
+// acWritesField returns the field under which action cache writes for the
+// given instance name are counted. Instance names are often empty, so they
+// are prefixed.
+func acWritesField(instanceName string) string {
+	return "instance/" + instanceName
+}
+
+// hitRateField returns the field under which hits or misses for the given
+// target label or mnemonic are accounted. Labels may contain slashes, so the
+// counter name comes first.
+func hitRateField(ct counterType, label string) string {
+	if ct == Hit {
+		return "hits/" + label
+	}
+	return "misses/" + label
+}
+
+func parseHitRateField(f string) (counterType, string, bool) {
+	name, label, ok := strings.Cut(f, "/")
+	if !ok || label == "" {
+		return 0, "", false
+	}
+	switch name {
+	case "hits":
+		return Hit, label, true
+	case "misses":
+		return Miss, label, true
+	default:
+		return 0, "", false
+	}
+}
+
 func counterField(actionCache bool, ct counterType) string {
 	switch ct {
 	case Hit:
@@ -143,6 +198,9 @@ type HitTracker struct {
 	iid         string
 	actionCache bool
 
+	// The remote instance name of the request, if known.
+	instanceName string
+
 	// The request metadata, may be nil or incomplete.
 	requestMetadata *repb.RequestMetadata
 
@@ -197,6 +255,65 @@ func (h *HitTracker) SetExecutedActionMetadata(md *repb.ExecutedActionMetadata)
 	h.executedActionMetadata = md
 }
 
+func (h *HitTracker) SetInstanceName(instanceName string) {
+	h.instanceName = instanceName
+}
+
+func (h *HitTracker) groupID() string {
+	if a := h.env.GetAuthenticator(); a != nil {
+		if u, err := a.AuthenticatedUser(h.ctx); err == nil {
+			return u.GetGroupID()
+		}
+	}
+	return interfaces.AuthAnonymousUser
+}
+
+func (h *HitTracker) classifyMisses() bool {
+	return *missClassificationEnabled && *detailedStatsEnabled && h.actionCache
+}
+
+// classifyMiss explains an action cache miss using the action cache writes
+// recorded for the group.
+func (h *HitTracker) classifyMiss(d *repb.Digest) capb.MissReason {
+	writes, err := h.c.ReadCounts(h.ctx, acWritesKey(h.groupID(), d.GetHash()))
+	if err != nil {
+		log.CtxDebugf(h.ctx, "Failed to read action cache writes: %s", err)
+		return capb.MissReason_UNKNOWN_MISS_REASON
+	}
+	if len(writes) == 0 {
+		return capb.MissReason_NEW_ACTION_DIGEST
+	}
+	if writes[acWritesField(h.instanceName)] > 0 {
+		return capb.MissReason_EVICTED
+	}
+	return capb.MissReason_DIFFERENT_INSTANCE_NAME
+}
+
+// recordACWrite remembers that an action result was written for the given
+// action digest, so that later misses can be classified.
+func (h *HitTracker) recordACWrite(d *repb.Digest) error {
+	return h.c.IncrementCountWithExpiry(h.ctx, acWritesKey(h.groupID(), d.GetHash()), acWritesField(h.instanceName), 1, *acWriteHistoryTTL)
+}
+
+// trackHitRate accounts an action cache hit or miss against the target label
+// and action mnemonic from the request metadata.
+func (h *HitTracker) trackHitRate(ct counterType) error {
+	if !*hitRateTrackingEnabled || !h.actionCache {
+		return nil
+	}
+	if targetID := h.requestMetadata.GetTargetId(); targetID != "" {
+		if err := h.c.IncrementCount(h.ctx, targetHitRatesKey(h.iid), hitRateField(ct, targetID), 1); err != nil {
+			return err
+		}
+	}
+	if mnemonic := h.requestMetadata.GetActionMnemonic(); mnemonic != "" {
+		if err := h.c.IncrementCount(h.ctx, mnemonicHitRatesKey(h.iid), hitRateField(ct, mnemonic), 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Example Usage:
 //
 // ht := NewHitTracker(env, invocationID, false /*=actionCache*/)
@@ -205,6 +322,16 @@ func (h *HitTracker) SetExecutedActionMetadata(md *repb.ExecutedActionMetadata)
 //	  log.Printf("Error counting cache miss.")
 //	}
 func (h *HitTracker) TrackMiss(d *repb.Digest) error {
+	return h.trackMiss(d, capb.MissReason_UNKNOWN_MISS_REASON)
+}
+
+// TrackMissingOutputs tracks an action cache lookup that found an action
+// result, but not all of its outputs, as a miss.
+func (h *HitTracker) TrackMissingOutputs(d *repb.Digest) error {
+	return h.trackMiss(d, capb.MissReason_OUTPUT_NOT_FOUND)
+}
+
+func (h *HitTracker) trackMiss(d *repb.Digest, reason capb.MissReason) error {
 	start := time.Now()
 	metrics.CacheEvents.With(prometheus.Labels{
 		metrics.CacheTypeLabel:      h.cacheTypeLabel(),
@@ -216,12 +343,21 @@ func (h *HitTracker) TrackMiss(d *repb.Digest) error {
 	if err := h.c.IncrementCount(h.ctx, h.counterKey(), h.counterField(Miss), 1); err != nil {
 		return err
 	}
+	if err := h.trackHitRate(Miss); err != nil {
+		return err
+	}
 	if *detailedStatsEnabled {
 		stats := &detailedStats{
 			Status:    Miss,
 			StartTime: start,
 			Duration:  time.Since(start),
 		}
+		if h.classifyMisses() {
+			stats.MissReason = reason
+			if reason == capb.MissReason_UNKNOWN_MISS_REASON {
+				stats.MissReason = h.classifyMiss(d)
+			}
+		}
 		if err := h.recordDetailedStats(d, stats); err != nil {
 			return err
 		}
@@ -314,6 +450,7 @@ func (h *HitTracker) recordDetailedStats(d *repb.Digest, stats *detailedStats) e
 		result.ExecutionStartTimestamp = md.GetExecutionStartTimestamp()
 		result.ExecutionCompletedTimestamp = md.GetExecutionCompletedTimestamp()
 	}
+	result.MissReason = stats.MissReason
 	// ScoreCard_Result.MarshalVT is slower, so we use MarshalOld for now.
 	// https://github.com/buildbuddy-io/buildbuddy-internal/issues/3018
 	b, err := proto.MarshalOld(result)
@@ -337,6 +474,7 @@ type detailedStats struct {
 	Duration             time.Duration
 	Compressor           repb.Compressor_Value
 	TransferredSizeBytes int64
+	MissReason           capb.MissReason
 }
 
 func cacheEventTypeLabel(c counterType) string {
@@ -350,12 +488,7 @@ func cacheEventTypeLabel(c counterType) string {
 }
 
 func (t *TransferTimer) emitSizeMetrics(compressor repb.Compressor_Value, ct counterType, cacheTypeLabel, serverLabel string, digestSizeBytes, bytesTransferredCache, bytesTransferredClient float64) {
-	groupID := interfaces.AuthAnonymousUser
-	if a := t.h.env.GetAuthenticator(); a != nil {
-		if u, err := a.AuthenticatedUser(t.h.ctx); err == nil {
-			groupID = u.GetGroupID()
-		}
-	}
+	groupID := t.h.groupID()
 
 	if ct == UploadSizeBytes {
 		metrics.CacheUploadSizeBytes.With(prometheus.Labels{
@@ -445,6 +578,14 @@ func (t *TransferTimer) CloseWithBytesTransferred(bytesTransferredCache, bytesTr
 		return err
 	}
 
+	// Action cache writes are recorded even without an invocation ID, since
+	// executors may not send one.
+	if h.c != nil && t.actionCounter == Upload && h.classifyMisses() {
+		if err := h.recordACWrite(t.d); err != nil {
+			return err
+		}
+	}
+
 	if h.c == nil || h.iid == "" {
 		return nil
 	}
@@ -452,6 +593,11 @@ func (t *TransferTimer) CloseWithBytesTransferred(bytesTransferredCache, bytesTr
 	if err := h.c.IncrementCount(h.ctx, h.counterKey(), h.counterField(t.actionCounter), 1); err != nil {
 		return err
 	}
+	if t.actionCounter == Hit {
+		if err := h.trackHitRate(Hit); err != nil {
+			return err
+		}
+	}
 	if err := h.c.IncrementCount(h.ctx, h.counterKey(), h.counterField(t.sizeCounter), t.d.GetSizeBytes()); err != nil {
 		return err
 	}
@@ -582,6 +728,54 @@ func parseTargetField(f string) (string, string, string) {
 }
 
 func ScoreCard(ctx context.Context, env environment.Env, iid string) *capb.ScoreCard {
+	sc := scoreCard(ctx, env, iid)
+	if sc != nil && *hitRateTrackingEnabled {
+		c := env.GetMetricsCollector()
+		sc.TargetHitRates = readHitRates(ctx, c, targetHitRatesKey(iid), func(hr *capb.HitRate, label string) { hr.TargetId = label })
+		sc.MnemonicHitRates = readHitRates(ctx, c, mnemonicHitRatesKey(iid), func(hr *capb.HitRate, label string) { hr.ActionMnemonic = label })
+	}
+	return sc
+}
+
+// readHitRates reads the hit and miss counts stored under the given key,
+// using setLabel to record the target label or mnemonic on each HitRate.
+func readHitRates(ctx context.Context, c interfaces.MetricsCollector, key string, setLabel func(hr *capb.HitRate, label string)) []*capb.HitRate {
+	counts, err := c.ReadCounts(ctx, key)
+	if err != nil {
+		log.CtxWarningf(ctx, "Failed to read cache hit rates: %s", err)
+		return nil
+	}
+	byLabel := make(map[string]*capb.HitRate, len(counts))
+	for field, n := range counts {
+		ct, label, ok := parseHitRateField(field)
+		if !ok {
+			continue
+		}
+		hr, ok := byLabel[label]
+		if !ok {
+			hr = &capb.HitRate{}
+			setLabel(hr, label)
+			byLabel[label] = hr
+		}
+		if ct == Hit {
+			hr.ActionCacheHits += n
+		} else {
+			hr.ActionCacheMisses += n
+		}
+	}
+	labels := make([]string, 0, len(byLabel))
+	for label := range byLabel {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	hitRates := make([]*capb.HitRate, 0, len(labels))
+	for _, label := range labels {
+		hitRates = append(hitRates, byLabel[label])
+	}
+	return hitRates
+}
+
+func scoreCard(ctx context.Context, env environment.Env, iid string) *capb.ScoreCard {
 	if *detailedStatsEnabled {
 		return readResults(ctx, env, iid)
 	}
@@ -715,4 +909,12 @@ func CleanupCacheStats(ctx context.Context, env environment.Env, iid string) {
 	if err := c.Delete(ctx, targetMissesKey(iid)); err != nil {
 		log.Warningf("Failed to clean up cache stats for invocation %s: %s", iid, err)
 	}
+
+	if *hitRateTrackingEnabled {
+		for _, key := range []string{targetHitRatesKey(iid), mnemonicHitRatesKey(iid)} {
+			if err := c.Delete(ctx, key); err != nil {
+				log.Warningf("Failed to clean up cache hit rates for invocation %s: %s", iid, err)
+			}
+		}
+	}
 }
@@ -166,6 +166,103 @@ func TestHitTracker_RecordsUsage(t *testing.T) {
 	}
 }
 
+func TestHitTracker_RecordsHitRates(t *testing.T) {
+	env := testenv.GetTestEnv(t)
+	flags.Set(t, "cache.target_hit_rate_tracking_enabled", true)
+	mc, err := memory_metrics_collector.NewMemoryMetricsCollector()
+	require.NoError(t, err)
+	env.SetMetricsCollector(mc)
+	iid := "d42f4cd1-6963-4a5a-9680-cb77cfaad9bd"
+	d := &repb.Digest{
+		Hash:      "7d865e959b2466918c9863afca942d0fb89d7c9ac0c99bafc3749504ded97730",
+		SizeBytes: 111,
+	}
+
+	for _, tc := range []struct {
+		mnemonic, targetID string
+		actionCache, hit   bool
+	}{
+		{"GoCompile", "//foo:bar", true, true},
+		{"GoCompile", "//foo:bar", true, false},
+		{"GoLink", "//foo:bar", true, false},
+		{"GoCompile", "//foo:baz", true, true},
+		// CAS requests don't count towards hit rates.
+		{"GoCompile", "//foo:baz", false, false},
+	} {
+		ctx := withRequestMetadata(t, context.Background(), &repb.RequestMetadata{
+			ToolInvocationId: iid,
+			ActionId:         "f498500e6d2825ef3bd5564bb56c439da36efe38ab4936ae0ff93794e704ccb4",
+			ActionMnemonic:   tc.mnemonic,
+			TargetId:         tc.targetID,
+		})
+		ht := hit_tracker.NewHitTracker(ctx, env, tc.actionCache)
+		if tc.hit {
+			dl := ht.TrackDownload(d)
+			err := dl.CloseWithBytesTransferred(d.SizeBytes, d.SizeBytes, repb.Compressor_IDENTITY, "test")
+			require.NoError(t, err)
+		} else {
+			err := ht.TrackMiss(d)
+			require.NoError(t, err)
+		}
+	}
+
+	sc := hit_tracker.ScoreCard(context.Background(), env, iid)
+	assert.Equal(t, []*capb.HitRate{
+		{TargetId: "//foo:bar", ActionCacheHits: 1, ActionCacheMisses: 2},
+		{TargetId: "//foo:baz", ActionCacheHits: 1},
+	}, sc.GetTargetHitRates())
+	assert.Equal(t, []*capb.HitRate{
+		{ActionMnemonic: "GoCompile", ActionCacheHits: 2, ActionCacheMisses: 1},
+		{ActionMnemonic: "GoLink", ActionCacheMisses: 1},
+	}, sc.GetMnemonicHitRates())
+}
+
+func TestHitTracker_ClassifiesMisses(t *testing.T) {
+	env := testenv.GetTestEnv(t)
+	flags.Set(t, "cache.detailed_stats_enabled", true)
+	flags.Set(t, "cache.miss_classification_enabled", true)
+	mc, err := memory_metrics_collector.NewMemoryMetricsCollector()
+	require.NoError(t, err)
+	env.SetMetricsCollector(mc)
+	writerIID := "ec1d3ac4-7b7d-4c27-8e4e-3e0b2c0f7b9a"
+	iid := "d42f4cd1-6963-4a5a-9680-cb77cfaad9bd"
+	written := &repb.Digest{Hash: "7d865e959b2466918c9863afca942d0fb89d7c9ac0c99bafc3749504ded97730", SizeBytes: 111}
+	unwritten := &repb.Digest{Hash: "c9c111006b30ffe6ce309fd64c44da651bffa068d530c7b1898698186b4afe2b", SizeBytes: 111}
+
+	newTracker := func(iid, instanceName string) *hit_tracker.HitTracker {
+		ctx := withRequestMetadata(t, context.Background(), &repb.RequestMetadata{
+			ToolInvocationId: iid,
+			ActionId:         "f498500e6d2825ef3bd5564bb56c439da36efe38ab4936ae0ff93794e704ccb4",
+			ActionMnemonic:   "GoCompile",
+			TargetId:         "//foo:bar",
+		})
+		ht := hit_tracker.NewHitTracker(ctx, env, true)
+		ht.SetInstanceName(instanceName)
+		return ht
+	}
+
+	// An earlier invocation writes an action result under instance name "a".
+	ul := newTracker(writerIID, "a").TrackUpload(written)
+	require.NoError(t, ul.CloseWithBytesTransferred(written.SizeBytes, written.SizeBytes, repb.Compressor_IDENTITY, "test"))
+
+	require.NoError(t, newTracker(iid, "a").TrackMiss(written))
+	require.NoError(t, newTracker(iid, "b").TrackMiss(written))
+	require.NoError(t, newTracker(iid, "a").TrackMiss(unwritten))
+	require.NoError(t, newTracker(iid, "a").TrackMissingOutputs(written))
+
+	sc := hit_tracker.ScoreCard(context.Background(), env, iid)
+	var reasons []capb.MissReason
+	for _, r := range sc.GetResults() {
+		reasons = append(reasons, r.GetMissReason())
+	}
+	assert.Equal(t, []capb.MissReason{
+		capb.MissReason_EVICTED,
+		capb.MissReason_DIFFERENT_INSTANCE_NAME,
+		capb.MissReason_NEW_ACTION_DIGEST,
+		capb.MissReason_OUTPUT_NOT_FOUND,
+	}, reasons)
+}
+
 type fakeUsageTracker struct {
 	interfaces.UsageTracker
 	Increments []*tables.UsageCounts
@@ -45,24 +45,13 @@ func GetCacheScoreCard(ctx context.Context, env environment.Env, req *capb.GetCa
 	}
 
 	scorecard := &capb.ScoreCard{}
-	for attempt := uint64(0); attempt < invocation.Attempt; attempt++ {
-		sc, err := Read(ctx, env, req.InvocationId, attempt)
-		if err != nil {
-			if status.IsNotFoundError(err) {
-				// it's okay for scorecards to be missing for prior attempts
-				continue
-			}
-			return nil, err
-		}
+	err = readAllAttempts(ctx, env, req.InvocationId, invocation.Attempt, func(sc *capb.ScoreCard) {
 		scorecard.Misses = append(scorecard.Misses, sc.Misses...)
 		scorecard.Results = append(scorecard.Results, sc.Results...)
-	}
-	sc, err := Read(ctx, env, req.InvocationId, invocation.Attempt)
+	})
 	if err != nil {
 		return nil, err
 	}
-	scorecard.Misses = append(scorecard.Misses, sc.Misses...)
-	scorecard.Results = append(scorecard.Results, sc.Results...)
 
 	results, err := filterResults(scorecard.Results, req)
 	if err != nil {
@@ -96,11 +85,145 @@ func GetCacheScoreCard(ctx context.Context, env environment.Env, req *capb.GetCa
 		Descending: req.Descending,
 	})
 	return &capb.GetCacheScoreCardResponse{
-		Results:       results[start:end],
+		Results:          results[start:end],
+		NextPageToken:    nextPageToken,
+		MissReasonCounts: countMissReasons(scorecard.Results),
+	}, nil
+}
+
+// countMissReasons counts the classified action cache misses among the given
+// results, ordered by miss reason.
+func countMissReasons(results []*capb.ScoreCard_Result) []*capb.GetCacheScoreCardResponse_MissReasonCount {
+	counts := make(map[capb.MissReason]int64)
+	for _, r := range results {
+		if r.GetMissReason() != capb.MissReason_UNKNOWN_MISS_REASON {
+			counts[r.GetMissReason()]++
+		}
+	}
+	out := make([]*capb.GetCacheScoreCardResponse_MissReasonCount, 0, len(counts))
+	for reason, count := range counts {
+		out = append(out, &capb.GetCacheScoreCardResponse_MissReasonCount{MissReason: reason, Count: count})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].GetMissReason() < out[j].GetMissReason()
+	})
+	return out
+}
+
+// readAllAttempts calls fn with the scorecard of each attempt of an invocation,
+// up to and including the given latest attempt.
+func readAllAttempts(ctx context.Context, env environment.Env, invocationID string, latestAttempt uint64, fn func(sc *capb.ScoreCard)) error {
+	for attempt := uint64(0); attempt < latestAttempt; attempt++ {
+		sc, err := Read(ctx, env, invocationID, attempt)
+		if err != nil {
+			if status.IsNotFoundError(err) {
+				// it's okay for scorecards to be missing for prior attempts
+				continue
+			}
+			return err
+		}
+		fn(sc)
+	}
+	sc, err := Read(ctx, env, invocationID, latestAttempt)
+	if err != nil {
+		return err
+	}
+	fn(sc)
+	return nil
+}
+
+// GetCacheHitRates returns the action cache hit rates of an invocation's
+// targets or action mnemonics, lowest hit rate first.
+func GetCacheHitRates(ctx context.Context, env environment.Env, req *capb.GetCacheHitRatesRequest) (*capb.GetCacheHitRatesResponse, error) {
+	// Authorize access to the requested invocation
+	invocation, err := env.GetInvocationDB().LookupInvocation(ctx, req.GetInvocationId())
+	if err != nil {
+		return nil, err
+	}
+	page := &pgpb.OffsetLimit{Offset: 0, Limit: defaultScoreCardPageSize}
+	if req.PageToken != "" {
+		reqPage, err := paging.DecodeOffsetLimit(req.PageToken)
+		if err != nil {
+			return nil, err
+		}
+		page = reqPage
+	}
+	if page.Offset < 0 || page.Limit < 0 {
+		return nil, status.InvalidArgumentError("invalid page token")
+	}
+
+	byTarget := req.GetGroupBy() != capb.GetCacheHitRatesRequest_GROUP_BY_MNEMONIC
+	merged := make(map[string]*capb.HitRate)
+	err = readAllAttempts(ctx, env, req.GetInvocationId(), invocation.Attempt, func(sc *capb.ScoreCard) {
+		hitRates := sc.GetTargetHitRates()
+		if !byTarget {
+			hitRates = sc.GetMnemonicHitRates()
+		}
+		for _, hr := range hitRates {
+			key := hr.GetTargetId()
+			if !byTarget {
+				key = hr.GetActionMnemonic()
+			}
+			m, ok := merged[key]
+			if !ok {
+				m = &capb.HitRate{TargetId: hr.GetTargetId(), ActionMnemonic: hr.GetActionMnemonic()}
+				merged[key] = m
+			}
+			m.ActionCacheHits += hr.GetActionCacheHits()
+			m.ActionCacheMisses += hr.GetActionCacheMisses()
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	hitRates := make([]*capb.HitRate, 0, len(merged))
+	for _, hr := range merged {
+		hitRates = append(hitRates, hr)
+	}
+	sortHitRates(hitRates)
+
+	start := min(page.Offset, int64(len(hitRates)))
+	end := min(start+page.Limit, int64(len(hitRates)))
+	nextPageToken := ""
+	if end < int64(len(hitRates)) {
+		next, err := paging.EncodeOffsetLimit(&pgpb.OffsetLimit{
+			Offset: end,
+			Limit:  defaultScoreCardPageSize,
+		})
+		if err != nil {
+			return nil, err
+		}
+		nextPageToken = next
+	}
+	return &capb.GetCacheHitRatesResponse{
+		HitRates:      hitRates[start:end],
 		NextPageToken: nextPageToken,
 	}, nil
 }
 
+// sortHitRates orders hit rates from the lowest hit rate to the highest. Ties
+// are broken by putting the entries with more misses first, then by label.
+func sortHitRates(hitRates []*capb.HitRate) {
+	rate := func(hr *capb.HitRate) float64 {
+		total := hr.GetActionCacheHits() + hr.GetActionCacheMisses()
+		if total == 0 {
+			return 0
+		}
+		return float64(hr.GetActionCacheHits()) / float64(total)
+	}
+	sort.Slice(hitRates, func(i, j int) bool {
+		ri, rj := rate(hitRates[i]), rate(hitRates[j])
+		if ri != rj {
+			return ri < rj
+		}
+		mi, mj := hitRates[i].GetActionCacheMisses(), hitRates[j].GetActionCacheMisses()
+		if mi != mj {
+			return mi > mj
+		}
+		return hitRates[i].GetTargetId()+hitRates[i].GetActionMnemonic() < hitRates[j].GetTargetId()+hitRates[j].GetActionMnemonic()
+	})
+}
+
 func filterResults(results []*capb.ScoreCard_Result, req *capb.GetCacheScoreCardRequest) ([]*capb.ScoreCard_Result, error) {
 	mask := req.GetFilter().GetMask()
 	if len(mask.GetPaths()) == 0 {
@@ -140,6 +263,10 @@ func filterResults(results []*capb.ScoreCard_Result, req *capb.GetCacheScoreCard
 			default:
 				return nil, status.InvalidArgumentErrorf("invalid response type %d", req.GetFilter().GetResponseType())
 			}
+		case "miss_reason":
+			predicates = append(predicates, func(result *capb.ScoreCard_Result) bool {
+				return result.GetMissReason() == req.GetFilter().GetMissReason()
+			})
 		case "search":
 			s := strings.ToLower(req.GetFilter().GetSearch())
 			predicates = append(predicates, func(result *capb.ScoreCard_Result) bool {
@@ -329,6 +456,25 @@ func Read(ctx context.Context, env environment.Env, invocationID string, invocat
 	return sc, nil
 }
 
+// Delete deletes the invocation cache scorecard from the configured
+// blobstore, if it exists.
+func Delete(ctx context.Context, env environment.Env, invocationID string, invocationAttempt uint64) error {
+	blobStore := env.GetBlobstore()
+	for _, name := range []string{blobName(invocationID, invocationAttempt), blobNameDeprecated(invocationID)} {
+		exists, err := blobStore.BlobExists(ctx, name)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		if err := blobStore.DeleteBlob(ctx, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Write writes the invocation cache scorecard to the configured blobstore.
 func Write(ctx context.Context, env environment.Env, invocationID string, invocationAttempt uint64, scoreCard *capb.ScoreCard) error {
 	// Use MarshalOld b/c ScoreCard.MarshalVT is 50% slower than standard Marshal()
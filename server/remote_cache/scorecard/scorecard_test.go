@@ -157,6 +157,41 @@ func TestGetCacheScoreCard_Filter_ResponseType(t *testing.T) {
 	assertResults(t, res, acMiss)
 }
 
+func TestGetCacheScoreCard_Filter_MissReason(t *testing.T) {
+	ctx := context.Background()
+	evictedMiss := acMiss.CloneVT()
+	evictedMiss.ActionId = "evicted"
+	evictedMiss.MissReason = capb.MissReason_EVICTED
+	newMiss := acMiss.CloneVT()
+	newMiss.ActionId = "new"
+	newMiss.MissReason = capb.MissReason_NEW_ACTION_DIGEST
+	env := setupEnv(t, &capb.ScoreCard{
+		Results: []*capb.ScoreCard_Result{besUpload, evictedMiss, newMiss, newMiss, casDownload},
+	})
+	req := &capb.GetCacheScoreCardRequest{
+		InvocationId: invocationID,
+		Filter: &capb.GetCacheScoreCardRequest_Filter{
+			Mask:       &fieldmaskpb.FieldMask{Paths: []string{"miss_reason"}},
+			MissReason: capb.MissReason_EVICTED,
+		},
+	}
+
+	res, err := scorecard.GetCacheScoreCard(ctx, env, req)
+	require.NoError(t, err)
+
+	require.Len(t, res.GetResults(), 1)
+	assert.Equal(t, "evicted", res.GetResults()[0].GetActionId())
+	// Miss reasons are counted regardless of the filter.
+	expected := []*capb.GetCacheScoreCardResponse_MissReasonCount{
+		{MissReason: capb.MissReason_NEW_ACTION_DIGEST, Count: 2},
+		{MissReason: capb.MissReason_EVICTED, Count: 1},
+	}
+	require.Len(t, res.GetMissReasonCounts(), len(expected))
+	for i := range expected {
+		assert.True(t, proto.Equal(expected[i], res.GetMissReasonCounts()[i]), "unexpected miss reason count: %s", prototext.Format(res.GetMissReasonCounts()[i]))
+	}
+}
+
 func TestGetCacheScoreCard_Sort_StartTime(t *testing.T) {
 	ctx := context.Background()
 	env := setupEnv(t, testScorecard)
@@ -254,6 +289,44 @@ func TestGetCacheScoreCard_GroupByTargetOrderByDuration(t *testing.T) {
 	assertResults(t, res, expectedResults...)
 }
 
+func TestGetCacheHitRates(t *testing.T) {
+	ctx := context.Background()
+	env := setupEnv(t, &capb.ScoreCard{
+		TargetHitRates: []*capb.HitRate{
+			{TargetId: "//foo", ActionCacheHits: 3, ActionCacheMisses: 1},
+			{TargetId: "//bar", ActionCacheHits: 0, ActionCacheMisses: 2},
+			{TargetId: "//baz", ActionCacheHits: 0, ActionCacheMisses: 5},
+		},
+		MnemonicHitRates: []*capb.HitRate{
+			{ActionMnemonic: "GoCompile", ActionCacheHits: 1, ActionCacheMisses: 1},
+			{ActionMnemonic: "GoLink", ActionCacheHits: 2, ActionCacheMisses: 0},
+		},
+	})
+
+	res, err := scorecard.GetCacheHitRates(ctx, env, &capb.GetCacheHitRatesRequest{
+		InvocationId: invocationID,
+		GroupBy:      capb.GetCacheHitRatesRequest_GROUP_BY_TARGET,
+	})
+	require.NoError(t, err)
+	expected := &capb.GetCacheHitRatesResponse{HitRates: []*capb.HitRate{
+		{TargetId: "//baz", ActionCacheHits: 0, ActionCacheMisses: 5},
+		{TargetId: "//bar", ActionCacheHits: 0, ActionCacheMisses: 2},
+		{TargetId: "//foo", ActionCacheHits: 3, ActionCacheMisses: 1},
+	}}
+	assert.True(t, proto.Equal(expected, res), "unexpected response: %s", prototext.Format(res))
+
+	res, err = scorecard.GetCacheHitRates(ctx, env, &capb.GetCacheHitRatesRequest{
+		InvocationId: invocationID,
+		GroupBy:      capb.GetCacheHitRatesRequest_GROUP_BY_MNEMONIC,
+	})
+	require.NoError(t, err)
+	expected = &capb.GetCacheHitRatesResponse{HitRates: []*capb.HitRate{
+		{ActionMnemonic: "GoCompile", ActionCacheHits: 1, ActionCacheMisses: 1},
+		{ActionMnemonic: "GoLink", ActionCacheHits: 2, ActionCacheMisses: 0},
+	}}
+	assert.True(t, proto.Equal(expected, res), "unexpected response: %s", prototext.Format(res))
+}
+
 func assertResults(t *testing.T, res *capb.GetCacheScoreCardResponse, msg ...*capb.ScoreCard_Result) {
 	// Note: not asserting directly on the protos because the diff is too hard to read.
 	t.Log("EXPECTED:")
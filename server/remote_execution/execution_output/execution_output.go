@@ -0,0 +1,34 @@
+// Package execution_output names the streams that the stdout and stderr of
+// in-progress executions can be read from with ByteStream.Read.
+package execution_output
+
+import (
+	"regexp"
+)
+
+const (
+	Stdout = "stdout"
+	Stderr = "stderr"
+)
+
+// Execution IDs are upload resource names, which always include an upload
+// UUID. Requiring it keeps stream names from being confused with download
+// resource names, which may end with an arbitrary file name.
+var streamNameRegex = regexp.MustCompile(`^(?P<execution_id>(?:.*/)?uploads/[a-f0-9-]{36}/.+)/(?P<stream>stdout|stderr)$`)
+
+// StreamName returns the resource name that the given output stream of an
+// execution can be read from.
+func StreamName(executionID, stream string) string {
+	return executionID + "/" + stream
+}
+
+// ParseStreamName returns the execution ID and output stream (Stdout or
+// Stderr) named by the given resource name, or false if it doesn't name an
+// output stream.
+func ParseStreamName(resourceName string) (executionID, stream string, ok bool) {
+	m := streamNameRegex.FindStringSubmatch(resourceName)
+	if m == nil {
+		return "", "", false
+	}
+	return m[streamNameRegex.SubexpIndex("execution_id")], m[streamNameRegex.SubexpIndex("stream")], true
+}
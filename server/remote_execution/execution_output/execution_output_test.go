@@ -0,0 +1,53 @@
+package execution_output_test
+
+import (
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/remote_execution/execution_output"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseStreamName(t *testing.T) {
+	executionID := "instance/uploads/6f4d1b8e-2c2a-4a8e-9d0c-5d0f6b1f2e3a/blobs/e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855/0"
+	for _, test := range []struct {
+		name          string
+		resourceName  string
+		wantOK        bool
+		wantExecution string
+		wantStream    string
+	}{
+		{
+			name:          "stdout",
+			resourceName:  execution_output.StreamName(executionID, execution_output.Stdout),
+			wantOK:        true,
+			wantExecution: executionID,
+			wantStream:    execution_output.Stdout,
+		},
+		{
+			name:          "stderr without instance name",
+			resourceName:  "uploads/6f4d1b8e-2c2a-4a8e-9d0c-5d0f6b1f2e3a/blobs/e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855/0/stderr",
+			wantOK:        true,
+			wantExecution: "uploads/6f4d1b8e-2c2a-4a8e-9d0c-5d0f6b1f2e3a/blobs/e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855/0",
+			wantStream:    execution_output.Stderr,
+		},
+		{
+			name:         "download with file name",
+			resourceName: "instance/blobs/e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855/0/stdout",
+		},
+		{
+			name:         "execution ID",
+			resourceName: executionID,
+		},
+		{
+			name:         "unknown stream",
+			resourceName: executionID + "/stdin",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			executionID, stream, ok := execution_output.ParseStreamName(test.resourceName)
+			assert.Equal(t, test.wantOK, ok)
+			assert.Equal(t, test.wantExecution, executionID)
+			assert.Equal(t, test.wantStream, stream)
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package resources
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+var (
+	gpus = flag.String("executor.gpus", "", "GPUs that may be assigned to tasks requesting them with the 'gpus' platform property. Set to 'all' to use all NVIDIA GPUs on the host, or to a comma-separated list of PCI addresses such as '0000:3b:00.0'. GPUs are scheduled as the '"+GPUResourceName+"' custom resource, which must not also be configured in executor.custom_resources.")
+)
+
+const (
+	// GPUResourceName is the name of the custom resource used to schedule
+	// GPUs requested with the "gpus" platform property.
+	GPUResourceName = "gpu"
+
+	allGPUs           = "all"
+	nvidiaPCIVendorID = "0x10de"
+	// PCI class code prefix of display controllers. This excludes other
+	// functions of the same card, such as its audio controller.
+	pciDisplayControllerClassPrefix = "0x03"
+)
+
+var (
+	// Overridden in tests.
+	pciDevicesPath = "/sys/bus/pci/devices"
+	nvidiaGPUsPath = "/proc/driver/nvidia/gpus"
+	devPath        = "/dev"
+
+	allocatedGPUs []GPU
+)
+
+// GPU is a GPU on the executor's host that may be assigned to tasks.
+type GPU struct {
+	// PCI address of the GPU, such as "0000:3b:00.0".
+	PCIAddress string
+
+	// UUID assigned by the NVIDIA driver, or empty if the GPU isn't bound to
+	// the NVIDIA driver.
+	UUID string
+
+	// Minor number of the GPU's /dev/nvidia<N> device node, or -1 if the GPU
+	// isn't bound to the NVIDIA driver.
+	Minor int
+}
+
+// DevicePath returns the path of the GPU's device node, or "" if the GPU
+// isn't bound to the NVIDIA driver.
+func (g GPU) DevicePath() string {
+	if g.Minor < 0 {
+		return ""
+	}
+	return "/dev/nvidia" + strconv.Itoa(g.Minor)
+}
+
+func configureGPUs() error {
+	allocatedGPUs = nil
+	if *gpus == "" {
+		return nil
+	}
+	if err := checkGPUResourceNotReserved(); err != nil {
+		return err
+	}
+	detected, err := detectGPUs()
+	if err != nil {
+		return status.UnavailableErrorf("detect GPUs: %s", err)
+	}
+	var configured []GPU
+	if *gpus == allGPUs {
+		configured = detected
+	} else {
+		for _, addr := range strings.Split(*gpus, ",") {
+			addr = strings.ToLower(strings.TrimSpace(addr))
+			i := slices.IndexFunc(detected, func(g GPU) bool { return g.PCIAddress == addr })
+			if i < 0 {
+				return status.InvalidArgumentErrorf("invalid executor.gpus: no NVIDIA GPU found at PCI address %q", addr)
+			}
+			configured = append(configured, detected[i])
+		}
+	}
+	for _, gpu := range configured {
+		if err := checkGPUUsable(gpu); err != nil {
+			log.Warningf("Not allocating GPU %s to tasks: %s", gpu.PCIAddress, err)
+			continue
+		}
+		allocatedGPUs = append(allocatedGPUs, gpu)
+	}
+	return nil
+}
+
+// checkGPUUsable returns an error if the GPU can't be assigned to tasks,
+// because it isn't bound to the NVIDIA driver or has no device node.
+func checkGPUUsable(gpu GPU) error {
+	if gpu.Minor < 0 {
+		return status.FailedPreconditionError("GPU is not bound to the NVIDIA driver")
+	}
+	path := filepath.Join(devPath, "nvidia"+strconv.Itoa(gpu.Minor))
+	if _, err := os.Stat(path); err != nil {
+		return status.FailedPreconditionErrorf("GPU device node %s is unavailable: %s", path, err)
+	}
+	return nil
+}
+
+// checkGPUResourceNotReserved returns an error if GPUs are configured with
+// executor.gpus and also listed in executor.custom_resources.
+func checkGPUResourceNotReserved() error {
+	if *gpus == "" {
+		return nil
+	}
+	for _, r := range *customResources {
+		if NormalizeCustomResourceName(r.Name) == GPUResourceName {
+			return status.InvalidArgumentErrorf("invalid executor.custom_resources: resource %q is reserved for GPUs configured with executor.gpus", GPUResourceName)
+		}
+	}
+	return nil
+}
+
+// detectGPUs returns the NVIDIA GPUs on the host, ordered by PCI address.
+func detectGPUs() ([]GPU, error) {
+	entries, err := os.ReadDir(pciDevicesPath)
+	if err != nil {
+		return nil, err
+	}
+	var out []GPU
+	for _, e := range entries {
+		dir := filepath.Join(pciDevicesPath, e.Name())
+		vendor, err := os.ReadFile(filepath.Join(dir, "vendor"))
+		if err != nil {
+			return nil, err
+		}
+		class, err := os.ReadFile(filepath.Join(dir, "class"))
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(string(vendor)) != nvidiaPCIVendorID || !strings.HasPrefix(strings.TrimSpace(string(class)), pciDisplayControllerClassPrefix) {
+			continue
+		}
+		gpu := GPU{PCIAddress: e.Name(), Minor: -1}
+		info, err := os.ReadFile(filepath.Join(nvidiaGPUsPath, e.Name(), "information"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		// The information file has lines like "Device Minor: 	 0".
+		for _, line := range strings.Split(string(info), "\n") {
+			key, val, ok := strings.Cut(line, ":")
+			if !ok {
+				continue
+			}
+			val = strings.TrimSpace(val)
+			switch strings.TrimSpace(key) {
+			case "GPU UUID":
+				gpu.UUID = val
+			case "Device Minor":
+				minor, err := strconv.Atoi(val)
+				if err != nil {
+					return nil, status.InternalErrorf("parse device minor of GPU %s: %s", e.Name(), err)
+				}
+				gpu.Minor = minor
+			}
+		}
+		out = append(out, gpu)
+	}
+	return out, nil
+}
+
+// GetAllocatedGPUs returns the GPUs that may be assigned to tasks. All of
+// them are bound to the NVIDIA driver.
+func GetAllocatedGPUs() []GPU {
+	return allocatedGPUs
+}
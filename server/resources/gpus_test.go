@@ -0,0 +1,114 @@
+package resources
+
+import (
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/require"
+
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+)
+
+func setupFakeGPUs(t *testing.T) {
+	root := testfs.MakeTempDir(t)
+	testfs.WriteAllFileContents(t, root, map[string]string{
+		// Bound to the NVIDIA driver.
+		"pci/0000:3b:00.0/vendor": "0x10de\n",
+		"pci/0000:3b:00.0/class":  "0x030200\n",
+		"nvidia/0000:3b:00.0/information": "Model: \t\t NVIDIA L4\n" +
+			"GPU UUID: \t GPU-5b7e3c0e-98d1-4f2c-8f5e-2b3c7c0b1a11\n" +
+			"Device Minor: \t 1\n",
+		"dev/nvidia1": "",
+		// Bound to the NVIDIA driver, but missing its device node.
+		"pci/0000:d8:00.0/vendor": "0x10de\n",
+		"pci/0000:d8:00.0/class":  "0x030200\n",
+		"nvidia/0000:d8:00.0/information": "GPU UUID: \t GPU-0c2d4f1a-6a37-4b8e-9d8b-7f0e6c1d2e33\n" +
+			"Device Minor: \t 2\n",
+		// The audio controller of the same card.
+		"pci/0000:3b:00.1/vendor": "0x10de\n",
+		"pci/0000:3b:00.1/class":  "0x040300\n",
+		// Not bound to the NVIDIA driver (e.g. bound to vfio-pci).
+		"pci/0000:af:00.0/vendor": "0x10de\n",
+		"pci/0000:af:00.0/class":  "0x030000\n",
+		// Not an NVIDIA device.
+		"pci/0000:00:02.0/vendor": "0x8086\n",
+		"pci/0000:00:02.0/class":  "0x030000\n",
+	})
+	oldPCIDevicesPath, oldNvidiaGPUsPath, oldDevPath := pciDevicesPath, nvidiaGPUsPath, devPath
+	pciDevicesPath = root + "/pci"
+	nvidiaGPUsPath = root + "/nvidia"
+	devPath = root + "/dev"
+	t.Cleanup(func() {
+		pciDevicesPath, nvidiaGPUsPath, devPath = oldPCIDevicesPath, oldNvidiaGPUsPath, oldDevPath
+		allocatedGPUs = nil
+	})
+}
+
+func TestConfigureGPUs_All(t *testing.T) {
+	setupFakeGPUs(t)
+	flags.Set(t, "executor.gpus", "all")
+
+	// Unusable GPUs are skipped.
+	err := configureGPUs()
+	require.NoError(t, err)
+	require.Equal(t, []GPU{
+		{PCIAddress: "0000:3b:00.0", UUID: "GPU-5b7e3c0e-98d1-4f2c-8f5e-2b3c7c0b1a11", Minor: 1},
+	}, GetAllocatedGPUs())
+	require.Equal(t, "/dev/nvidia1", GetAllocatedGPUs()[0].DevicePath())
+	require.Equal(t, []*scpb.CustomResource{{Name: GPUResourceName, Value: 1}}, GetAllocatedCustomResources())
+}
+
+func TestConfigureGPUs_PCIAddresses(t *testing.T) {
+	setupFakeGPUs(t)
+	flags.Set(t, "executor.gpus", "0000:3B:00.0")
+
+	err := configureGPUs()
+	require.NoError(t, err)
+	require.Equal(t, []GPU{
+		{PCIAddress: "0000:3b:00.0", UUID: "GPU-5b7e3c0e-98d1-4f2c-8f5e-2b3c7c0b1a11", Minor: 1},
+	}, GetAllocatedGPUs())
+
+	flags.Set(t, "executor.gpus", "0000:00:02.0")
+	err = configureGPUs()
+	require.Error(t, err)
+}
+
+func TestConfigureGPUs_SkipsUnusableGPUs(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		gpus string
+	}{
+		{name: "NotBoundToNvidiaDriver", gpus: "0000:af:00.0"},
+		{name: "MissingDeviceNode", gpus: "0000:d8:00.0"},
+		{name: "Both", gpus: "0000:af:00.0,0000:d8:00.0"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			setupFakeGPUs(t)
+			flags.Set(t, "executor.gpus", test.gpus)
+
+			err := configureGPUs()
+			require.NoError(t, err)
+			require.Empty(t, GetAllocatedGPUs())
+			require.Empty(t, GetAllocatedCustomResources())
+		})
+	}
+}
+
+func TestConfigureGPUs_ConflictsWithCustomResource(t *testing.T) {
+	setupFakeGPUs(t)
+	flags.Set(t, "executor.gpus", "all")
+	flags.Set(t, "executor.custom_resources", []CustomResource{{Name: "GPU", Value: 1}})
+
+	err := configureGPUs()
+	require.Error(t, err)
+}
+
+func TestConfigureGPUs_Disabled(t *testing.T) {
+	setupFakeGPUs(t)
+
+	err := configureGPUs()
+	require.NoError(t, err)
+	require.Empty(t, GetAllocatedGPUs())
+	require.Empty(t, GetAllocatedCustomResources())
+}
@@ -1,11 +1,14 @@
 package resources
 
 import (
+	"math"
 	"os"
 	"regexp"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"cloud.google.com/go/compute/metadata"
 	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
@@ -18,7 +21,7 @@ import (
 )
 
 var (
-	customResources = flag.Slice("executor.custom_resources", []CustomResource{}, "Optional allocatable custom resources. This works similarly to bazel's local_extra_resources flag. Request these resources in exec_properties using the 'resources:<name>': '<value>' syntax.")
+	customResources = flag.Slice("executor.custom_resources", []CustomResource{}, "Optional allocatable custom resources. This works similarly to bazel's local_extra_resources flag. Request these resources in exec_properties using the 'resources:<name>': '<value>' syntax. Resource names are case-insensitive, and may be arbitrary strings such as 'nvidia.com/gpu'.")
 	memoryBytes     = flag.Int64("executor.memory_bytes", 0, "Optional maximum memory to allocate to execution tasks (approximate). Cannot set both this option and the SYS_MEMORY_BYTES env var.")
 	mmapMemoryBytes = flag.Int64("executor.mmap_memory_bytes", 10e9, "Maximum memory to be allocated towards mmapped files for Firecracker copy-on-write functionality. This is subtraced from the configured memory_bytes. Has no effect if firecracker is disabled or snapshot sharing is disabled.")
 	milliCPU        = flag.Int64("executor.millicpu", 0, "Optional maximum CPU milliseconds to allocate to execution tasks (approximate). Cannot set both this option and the SYS_MILLICPU env var.")
@@ -40,9 +43,10 @@ const (
 )
 
 var (
-	allocatedRAMBytes     int64
-	allocatedMmapRAMBytes int64
-	allocatedCPUMillis    int64
+	// These may be changed by Reconfigure while tasks are running.
+	allocatedRAMBytes     atomic.Int64
+	allocatedMmapRAMBytes atomic.Int64
+	allocatedCPUMillis    atomic.Int64
 	once                  sync.Once
 )
 
@@ -52,71 +56,106 @@ var (
 
 func init() {
 	once.Do(func() {
-		setSysRAMBytes()
-		setSysMilliCPUCapacity()
+		allocatedRAMBytes.Store(sysRAMBytes())
+		allocatedCPUMillis.Store(sysMilliCPUCapacity())
 	})
 }
 
-func setSysRAMBytes() {
+func sysRAMBytes() int64 {
 	if v := os.Getenv(memoryEnvVarName); v != "" {
 		i, err := strconv.ParseInt(v, 10, 64)
 		if err == nil {
-			allocatedRAMBytes = i
-			return
+			return i
 		}
 	}
 	mem := gosigar.Mem{}
 	mem.Get()
-	allocatedRAMBytes = int64(mem.Total)
+	return int64(mem.Total)
 }
 
-func setSysMilliCPUCapacity() {
+func sysMilliCPUCapacity() int64 {
 	if v := os.Getenv(cpuEnvVarName); v != "" {
 		f, err := strconv.ParseFloat(v, 64)
 		if err == nil {
-			allocatedCPUMillis = int64(f * 1000)
-			return
+			return int64(f * 1000)
 		}
 	}
 
 	cpuList := gosigar.CpuList{}
 	cpuList.Get()
 	numCores := len(cpuList.List)
-	allocatedCPUMillis = int64(numCores * 1000)
+	return int64(numCores * 1000)
 }
 
 func Configure(mmapLRUEnabled bool) error {
+	if err := configureCPUAndMemory(mmapLRUEnabled, *mmapMemoryBytes); err != nil {
+		return err
+	}
+	if err := configureGPUs(); err != nil {
+		return err
+	}
+	if len(allocatedGPUs) > 0 {
+		log.Infof("Allocating %d GPUs to tasks", len(allocatedGPUs))
+	}
+	return nil
+}
+
+// Reconfigure re-applies the memory, CPU, and custom resource flags after the
+// config has been reloaded. GPUs are not re-detected, since they may be in use
+// by running tasks, and the memory allocated to mmapped files is not changed,
+// since the mmap LRU is sized at startup. If the new config is invalid, the
+// previous allocation is kept.
+func Reconfigure() error {
+	if err := checkGPUResourceNotReserved(); err != nil {
+		return err
+	}
+	mmapRAMBytes := allocatedMmapRAMBytes.Load()
+	return configureCPUAndMemory(mmapRAMBytes > 0, mmapRAMBytes)
+}
+
+// configureCPUAndMemory sets the allocated CPU and memory from the flags. If
+// mmapLRUEnabled is set, mmapRAMBytes of the memory is reserved for mmapped
+// files.
+func configureCPUAndMemory(mmapLRUEnabled bool, mmapRAMBytes int64) error {
+	var ramBytes, cpuMillis int64
 	if *memoryBytes > 0 {
 		if os.Getenv(memoryEnvVarName) != "" {
 			return status.InvalidArgumentErrorf("Only one of the 'executor.memory_bytes' config option and 'SYS_MEMORY_BYTES' environment variable may be set")
 		}
-		allocatedRAMBytes = *memoryBytes
+		ramBytes = *memoryBytes
 	} else {
 		// If flag is not set, fall back to env var, or total memory.
-		setSysRAMBytes()
+		ramBytes = sysRAMBytes()
 	}
 	if *milliCPU > 0 {
 		if os.Getenv(cpuEnvVarName) != "" {
 			return status.InvalidArgumentErrorf("Only one of the 'executor.millicpu' config option and 'SYS_MILLICPU' environment variable may be set")
 		}
-		allocatedCPUMillis = *milliCPU
+		cpuMillis = *milliCPU
 	} else {
 		// If flag is not set, fall back to env var, or available cores.
-		setSysMilliCPUCapacity()
+		cpuMillis = sysMilliCPUCapacity()
 	}
 
 	if mmapLRUEnabled {
 		// Check for too little or too much mmap memory.
-		if *mmapMemoryBytes < 64*1024*1024 || *mmapMemoryBytes > allocatedRAMBytes {
-			return status.InvalidArgumentErrorf("invalid mmap_memory_bytes %d (must be >= 64MB and <= allocated memory bytes %d)", *mmapMemoryBytes, allocatedRAMBytes)
+		if mmapRAMBytes < 64*1024*1024 || mmapRAMBytes > ramBytes {
+			return status.InvalidArgumentErrorf("invalid mmap_memory_bytes %d (must be >= 64MB and <= allocated memory bytes %d)", mmapRAMBytes, ramBytes)
 		}
-		allocatedMmapRAMBytes = *mmapMemoryBytes
-		allocatedRAMBytes -= allocatedMmapRAMBytes
+		ramBytes -= mmapRAMBytes
+	} else {
+		mmapRAMBytes = 0
 	}
 
-	log.Debugf("Set allocatedRAMBytes to %d", allocatedRAMBytes)
-	log.Debugf("Set allocatedCPUMillis to %d", allocatedCPUMillis)
+	if err := validateCustomResources(*customResources); err != nil {
+		return err
+	}
 
+	allocatedRAMBytes.Store(ramBytes)
+	allocatedMmapRAMBytes.Store(mmapRAMBytes)
+	allocatedCPUMillis.Store(cpuMillis)
+	log.Debugf("Set allocatedRAMBytes to %d", ramBytes)
+	log.Debugf("Set allocatedCPUMillis to %d", cpuMillis)
 	return nil
 }
 
@@ -127,15 +166,15 @@ func GetSysFreeRAMBytes() int64 {
 }
 
 func GetAllocatedRAMBytes() int64 {
-	return allocatedRAMBytes
+	return allocatedRAMBytes.Load()
 }
 
 func GetAllocatedMmapRAMBytes() int64 {
-	return allocatedMmapRAMBytes
+	return allocatedMmapRAMBytes.Load()
 }
 
 func GetAllocatedCPUMillis() int64 {
-	return allocatedCPUMillis
+	return allocatedCPUMillis.Load()
 }
 
 // Struct version of scpb.CustomResource (for YAML configuration).
@@ -144,14 +183,45 @@ type CustomResource struct {
 	Value float64 `yaml:"value" json:"value"`
 }
 
+func validateCustomResources(customResources []CustomResource) error {
+	names := make(map[string]struct{}, len(customResources))
+	for _, r := range customResources {
+		name := NormalizeCustomResourceName(r.Name)
+		if name == "" {
+			return status.InvalidArgumentError("invalid executor.custom_resources: resource name is required")
+		}
+		if _, ok := names[name]; ok {
+			return status.InvalidArgumentErrorf("invalid executor.custom_resources: resource %q is configured more than once", name)
+		}
+		names[name] = struct{}{}
+		if r.Value < 0 || math.IsNaN(r.Value) || math.IsInf(r.Value, 0) {
+			return status.InvalidArgumentErrorf("invalid executor.custom_resources: resource %q has invalid value %v", name, r.Value)
+		}
+	}
+	return nil
+}
+
+// NormalizeCustomResourceName returns the canonical form of a custom resource
+// name. Platform property names are case-insensitive, so custom resources are
+// matched case-insensitively as well.
+func NormalizeCustomResourceName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
 func GetAllocatedCustomResources() []*scpb.CustomResource {
 	out := make([]*scpb.CustomResource, 0, len(*customResources))
 	for _, r := range *customResources {
 		out = append(out, &scpb.CustomResource{
-			Name:  r.Name,
+			Name:  NormalizeCustomResourceName(r.Name),
 			Value: float32(r.Value),
 		})
 	}
+	if len(allocatedGPUs) > 0 {
+		out = append(out, &scpb.CustomResource{
+			Name:  GPUResourceName,
+			Value: float32(len(allocatedGPUs)),
+		})
+	}
 	return out
 }
 
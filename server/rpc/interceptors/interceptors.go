@@ -21,6 +21,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
 	"github.com/buildbuddy-io/buildbuddy/server/util/quota"
+	"github.com/buildbuddy-io/buildbuddy/server/util/scopes"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/subdomain"
 	"github.com/buildbuddy-io/buildbuddy/server/util/uuid"
@@ -223,6 +224,28 @@ func ipAuthStreamServerInterceptor(env environment.Env) grpc.StreamServerInterce
 	}
 }
 
+// scopeAuthUnaryServerInterceptor rejects requests made with scoped API keys
+// to RPCs outside of the key's scopes.
+func scopeAuthUnaryServerInterceptor(env environment.Env) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := scopes.AuthorizeRPC(ctx, env, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// scopeAuthStreamServerInterceptor rejects requests made with scoped API keys
+// to RPCs outside of the key's scopes.
+func scopeAuthStreamServerInterceptor(env environment.Env) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := scopes.AuthorizeRPC(stream.Context(), env, info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, stream)
+	}
+}
+
 func identityUnaryServerInterceptor(env environment.Env) grpc.UnaryServerInterceptor {
 	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 		if cis := env.GetClientIdentityService(); cis != nil {
@@ -497,6 +520,7 @@ func GetUnaryInterceptor(env environment.Env, extraInterceptors ...grpc.UnarySer
 		quotaUnaryServerInterceptor(env),
 		identityUnaryServerInterceptor(env),
 		ipAuthUnaryServerInterceptor(env),
+		scopeAuthUnaryServerInterceptor(env),
 		roleAuthUnaryServerInterceptor(env))
 	return grpc.ChainUnaryInterceptor(interceptors...)
 }
@@ -521,6 +545,7 @@ func GetStreamInterceptor(env environment.Env, extraInterceptors ...grpc.StreamS
 		quotaStreamServerInterceptor(env),
 		identityStreamServerInterceptor(env),
 		ipAuthStreamServerInterceptor(env),
+		scopeAuthStreamServerInterceptor(env),
 		roleAuthStreamServerInterceptor(env))
 	return grpc.ChainStreamInterceptor(interceptors...)
 }
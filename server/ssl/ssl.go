@@ -13,6 +13,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"slices"
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/endpoint_urls/build_buddy_url"
@@ -21,7 +22,9 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/certreloader"
 	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/spiffe"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
@@ -41,6 +44,11 @@ var (
 	enableSSL        = flag.Bool("ssl.enable_ssl", false, "Whether or not to enable SSL/TLS on gRPC connections (gRPCS).")
 	useACME          = flag.Bool("ssl.use_acme", false, "Whether or not to automatically configure SSL certs using ACME. If ACME is enabled, cert_file and key_file should not be set.")
 	defaultHost      = flag.String("ssl.default_host", "", "Host name to use for ACME generated cert if TLS request does not contain SNI.")
+
+	clientCertRequired = flag.Bool("ssl.client_cert_required", false, "If true, gRPC clients must present a client certificate issued by the client CA or by a CA in ssl.trust_bundle_file. Executors can't fetch certificates from the built-in CA when this is set, since they need to connect without one first.")
+	trustBundleFile    = flag.String("ssl.trust_bundle_file", "", "Path to a PEM encoded bundle of additional CA certificates that client certificates may be issued by, such as the SPIRE trust bundle. The file is reloaded when it changes.")
+	spiffeTrustDomain  = flag.String("ssl.spiffe_trust_domain", "", "SPIFFE trust domain of the SVIDs that the client CA issues, e.g. 'buildbuddy.example.com'. If not set, the client CA does not issue SVIDs.")
+	svidLifespan       = flag.Duration("ssl.svid_lifespan", 24*time.Hour, "How long SVIDs issued by the client CA are valid for. Executors renew their SVID when 2/3 of its lifespan has passed.")
 )
 
 type CertCache struct {
@@ -77,6 +85,9 @@ type SSLService struct {
 	autocertManager *autocert.Manager
 	AuthorityCert   *x509.Certificate
 	AuthorityKey    *rsa.PrivateKey
+
+	// Trusted client CAs, if they are reloaded from ssl.trust_bundle_file.
+	trustBundle *certreloader.CertPool
 }
 
 func Register(env *real_environment.RealEnv) error {
@@ -125,6 +136,18 @@ func (s *SSLService) populateTLSConfig() error {
 		clientCACertPool.AddCert(s.AuthorityCert)
 	}
 
+	if *trustBundleFile != "" {
+		var extra []*x509.Certificate
+		if s.AuthorityCert != nil {
+			extra = append(extra, s.AuthorityCert)
+		}
+		trustBundle, err := certreloader.NewCertPool(*trustBundleFile, extra...)
+		if err != nil {
+			return err
+		}
+		s.trustBundle = trustBundle
+	}
+
 	// List based on Mozilla recommended ciphers:
 	// https://wiki.mozilla.org/Security/Server_Side_TLS
 	//
@@ -167,14 +190,32 @@ func (s *SSLService) populateTLSConfig() error {
 		ClientCAs:                clientCACertPool,
 		CipherSuites:             cipherSuites,
 	}
+	if *clientCertRequired {
+		grpcTLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if s.trustBundle != nil {
+		// The bundle may change at any time, so use its current contents for
+		// each handshake.
+		grpcTLSConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c := grpcTLSConfig.Clone()
+			c.ClientCAs = s.trustBundle.Pool()
+			// gRPC adds h2 to a copy of this config, which the returned
+			// config replaces.
+			if !slices.Contains(c.NextProtos, "h2") {
+				c.NextProtos = append(c.NextProtos, "h2")
+			}
+			return c, nil
+		}
+	}
 
 	if *keyFile != "" && *certFile != "" {
-		certPair, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		// Reload the certificate when it's rotated on disk.
+		keyPair, err := certreloader.NewKeyPair(*certFile, *keyFile)
 		if err != nil {
 			return err
 		}
-		httpTLSConfig.Certificates = []tls.Certificate{certPair}
-		grpcTLSConfig.Certificates = []tls.Certificate{certPair}
+		httpTLSConfig.GetCertificate = keyPair.GetCertificate
+		grpcTLSConfig.GetCertificate = keyPair.GetCertificate
 		s.httpTLSConfig = httpTLSConfig
 		s.grpcTLSConfig = grpcTLSConfig
 	} else if *selfSigned {
@@ -271,8 +312,7 @@ func GenerateCert(subject pkix.Name, caCert *CACert, validity time.Duration) (st
 	notBefore := time.Now()
 	notAfter := notBefore.Add(validity)
 
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	serialNumber, err := newSerialNumber()
 	if err != nil {
 		return "", "", err
 	}
@@ -344,8 +384,12 @@ func (s *SSLService) ValidateCert(certString string) (string, string, error) {
 		return "", "", status.FailedPreconditionErrorf("Failed to parse client certificate: %s", err)
 	}
 
+	// Certificates identify API keys by their subject, so only the built-in
+	// CA may issue them, not the CAs of ssl.trust_bundle_file.
+	roots := x509.NewCertPool()
+	roots.AddCert(s.AuthorityCert)
 	opts := x509.VerifyOptions{
-		Roots: s.grpcTLSConfig.ClientCAs,
+		Roots: roots,
 	}
 
 	if _, err := cert.Verify(opts); err != nil {
@@ -355,6 +399,86 @@ func (s *SSLService) ValidateCert(certString string) (string, string, error) {
 	return cert.Subject.CommonName, cert.Subject.SerialNumber, nil
 }
 
+// IsIssuedByAuthority returns whether one of the verified chains of a client
+// certificate is rooted at the built-in CA, rather than at a CA of
+// ssl.trust_bundle_file.
+func (s *SSLService) IsIssuedByAuthority(verifiedChains [][]*x509.Certificate) bool {
+	if s.AuthorityCert == nil {
+		return false
+	}
+	for _, chain := range verifiedChains {
+		if len(chain) > 0 && chain[len(chain)-1].Equal(s.AuthorityCert) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *SSLService) IsSVIDIssuanceEnabled() bool {
+	return s.IsCertGenerationEnabled() && *spiffeTrustDomain != ""
+}
+
+func (s *SSLService) SPIFFETrustDomain() string {
+	return *spiffeTrustDomain
+}
+
+// SignSVID signs an X.509 SVID for the given SPIFFE ID using the public key of
+// the PEM encoded certificate signing request. The certificate can be used
+// both as a client and as a server certificate. Other fields of the request,
+// such as the subject and SANs, are ignored.
+func (s *SSLService) SignSVID(csrPEM, spiffeID string) (string, error) {
+	if !s.IsSVIDIssuanceEnabled() {
+		return "", status.FailedPreconditionError("Cert authority and SPIFFE trust domain must be set up in order to issue SVIDs")
+	}
+	id, err := spiffe.ParseID(spiffeID)
+	if err != nil {
+		return "", err
+	}
+	if id.Host != *spiffeTrustDomain {
+		return "", status.InvalidArgumentErrorf("SPIFFE ID %q is not in trust domain %q", spiffeID, *spiffeTrustDomain)
+	}
+	block, _ := pem.Decode([]byte(csrPEM))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return "", status.InvalidArgumentError("certificate signing request did not contain valid PEM data")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return "", status.InvalidArgumentErrorf("could not parse certificate signing request: %s", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return "", status.InvalidArgumentErrorf("invalid certificate signing request signature: %s", err)
+	}
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return "", err
+	}
+	// Allow for some clock skew between the server and the client.
+	notBefore := time.Now().Add(-1 * time.Minute)
+	notAfter := time.Now().Add(*svidLifespan)
+	if notAfter.After(s.AuthorityCert.NotAfter) {
+		notAfter = s.AuthorityCert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		URIs:                  []*url.URL{id},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, s.AuthorityCert, csr.PublicKey, s.AuthorityKey)
+	if err != nil {
+		return "", status.InternalErrorf("could not sign SVID: %s", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})), nil
+}
+
+func newSerialNumber() (*big.Int, error) {
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	return rand.Int(rand.Reader, serialNumberLimit)
+}
+
 // LoadCertificate loads a certificate and its key either from files or from
 // raw bytes.
 func LoadCertificate(certFile, cert string) (*x509.Certificate, error) {
@@ -0,0 +1,137 @@
+package ssl_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/ssl"
+	"github.com/buildbuddy-io/buildbuddy/server/util/spiffe"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/require"
+)
+
+func newCA(t *testing.T) *ssl.SSLService {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(48 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &ssl.SSLService{AuthorityCert: cert, AuthorityKey: key}
+}
+
+func newCSR(t *testing.T) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	require.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr}))
+}
+
+func TestSignSVID(t *testing.T) {
+	flags.Set(t, "ssl.enable_ssl", true)
+	flags.Set(t, "ssl.spiffe_trust_domain", "bb.example.com")
+	flags.Set(t, "ssl.svid_lifespan", 24*time.Hour)
+	s := newCA(t)
+	require.True(t, s.IsSVIDIssuanceEnabled())
+
+	certPEM, err := s.SignSVID(newCSR(t), "spiffe://bb.example.com/executor/e1")
+	require.NoError(t, err)
+	block, _ := pem.Decode([]byte(certPEM))
+	require.NotNil(t, block)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+
+	id, err := spiffe.IDFromCertificate(cert)
+	require.NoError(t, err)
+	require.Equal(t, "spiffe://bb.example.com/executor/e1", id)
+	require.WithinDuration(t, time.Now().Add(24*time.Hour), cert.NotAfter, time.Minute)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(s.AuthorityCert)
+	_, err = cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	require.NoError(t, err)
+
+	// SVIDs don't outlive the CA.
+	flags.Set(t, "ssl.svid_lifespan", 100*24*time.Hour)
+	certPEM, err = s.SignSVID(newCSR(t), "spiffe://bb.example.com/executor/e1")
+	require.NoError(t, err)
+	block, _ = pem.Decode([]byte(certPEM))
+	cert, err = x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	require.Equal(t, s.AuthorityCert.NotAfter, cert.NotAfter)
+}
+
+func TestSignSVIDInvalidRequests(t *testing.T) {
+	flags.Set(t, "ssl.enable_ssl", true)
+	flags.Set(t, "ssl.spiffe_trust_domain", "bb.example.com")
+	s := newCA(t)
+
+	_, err := s.SignSVID(newCSR(t), "spiffe://other.example.com/executor/e1")
+	require.True(t, status.IsInvalidArgumentError(err), "unexpected error: %v", err)
+
+	_, err = s.SignSVID(newCSR(t), "https://bb.example.com/executor/e1")
+	require.True(t, status.IsInvalidArgumentError(err), "unexpected error: %v", err)
+
+	_, err = s.SignSVID("not a CSR", "spiffe://bb.example.com/executor/e1")
+	require.True(t, status.IsInvalidArgumentError(err), "unexpected error: %v", err)
+
+	flags.Set(t, "ssl.spiffe_trust_domain", "")
+	_, err = s.SignSVID(newCSR(t), "spiffe://bb.example.com/executor/e1")
+	require.True(t, status.IsFailedPreconditionError(err), "unexpected error: %v", err)
+}
+
+func TestCertificatesOfOtherCAs(t *testing.T) {
+	flags.Set(t, "ssl.enable_ssl", true)
+	s := newCA(t)
+	other := newCA(t)
+	subject := pkix.Name{CommonName: "BuildBuddy ID", SerialNumber: "AK123"}
+
+	certPEM, _, err := s.GenerateCerts("AK123")
+	require.NoError(t, err)
+	commonName, serialNumber, err := s.ValidateCert(certPEM)
+	require.NoError(t, err)
+	require.Equal(t, "BuildBuddy ID", commonName)
+	require.Equal(t, "AK123", serialNumber)
+
+	// Other CAs, such as the ones of ssl.trust_bundle_file, can't issue
+	// certificates that identify API keys.
+	otherPEM, _, err := ssl.GenerateCert(subject, &ssl.CACert{Cert: other.AuthorityCert, Key: other.AuthorityKey}, time.Hour)
+	require.NoError(t, err)
+	_, _, err = s.ValidateCert(otherPEM)
+	require.True(t, status.IsFailedPreconditionError(err), "unexpected error: %v", err)
+
+	parse := func(certPEM string) *x509.Certificate {
+		block, _ := pem.Decode([]byte(certPEM))
+		require.NotNil(t, block)
+		cert, err := x509.ParseCertificate(block.Bytes)
+		require.NoError(t, err)
+		return cert
+	}
+	require.True(t, s.IsIssuedByAuthority([][]*x509.Certificate{{parse(certPEM), s.AuthorityCert}}))
+	require.False(t, s.IsIssuedByAuthority([][]*x509.Certificate{{parse(otherPEM), other.AuthorityCert}}))
+	require.True(t, s.IsIssuedByAuthority([][]*x509.Certificate{
+		{parse(otherPEM), other.AuthorityCert},
+		{parse(certPEM), s.AuthorityCert},
+	}))
+	require.False(t, s.IsIssuedByAuthority(nil))
+	require.False(t, (&ssl.SSLService{}).IsIssuedByAuthority([][]*x509.Certificate{{parse(certPEM), s.AuthorityCert}}))
+}
@@ -174,6 +174,19 @@ type Invocation struct {
 	Tags string
 
 	ParentRunID string `gorm:"index:parent_run_id_index"`
+
+	// Whether the invocation satisfied its group's build metadata
+	// requirements. The value maps to invocation.BuildMetadataCompliance.
+	BuildMetadataCompliance int32 `gorm:"not null;default:0"`
+
+	// A comma-separated list of the required build metadata keys that were
+	// missing or invalid.
+	BuildMetadataViolations string `gorm:"type:text;"`
+
+	// Permissions, in addition to Perms, that are required to download the
+	// invocation's artifacts and logs. Zero if downloads are not restricted
+	// beyond Perms.
+	DownloadPerms int32 `gorm:"not null;default:0"`
 }
 
 func (i *Invocation) TableName() string {
@@ -252,6 +265,15 @@ type Group struct {
 	// When a Group is designated as a "parent" then any Admin keys from that
 	// org also work for managing groups with the same SAML IDP Metadata URL.
 	IsParent bool `gorm:"not null;default:0"`
+
+	// How many days the group's invocations are kept before the invocation
+	// janitor deletes them. 0 means the server's default TTL applies.
+	InvocationRetentionDays int32 `gorm:"not null;default:0"`
+
+	// What happens to invocations that don't satisfy the group's
+	// BuildMetadataRequirements. The value maps to
+	// grp.BuildMetadataEnforcement.
+	BuildMetadataEnforcement int32 `gorm:"not null;default:0"`
 }
 
 func (g *Group) TableName() string {
@@ -297,6 +319,12 @@ type User struct {
 	// User-specific Github token (if linked).
 	GithubToken string
 
+	// The ID of the group whose own OIDC provider the user signed up with,
+	// if any. The emails of these users come from an IdP and a claim that
+	// the group's admins chose, so they can't join other organizations by
+	// their email domain.
+	ProviderGroupID string
+
 	// Group roles are used to determine read/write permissions
 	// for everything.
 	Groups []*GroupRole `gorm:"-"`
@@ -383,7 +411,10 @@ type APIKey struct {
 	//
 	// NOTE: If the default is changed, a DB migration may be required to
 	// migrate old DB rows to reflect the new default.
-	Capabilities        int32 `gorm:"default:1"`
+	Capabilities int32 `gorm:"default:1"`
+	// Scopes that restrict the RPCs this key can be used for. 0 means the
+	// key is not restricted.
+	Scopes              int32 `gorm:"not null;default:0"`
 	VisibleToDevelopers bool  `gorm:"not null;default:0"`
 	// Indicates whether this key is used for impersonation.
 	Impersonation bool `gorm:"not null;default:0"`
@@ -407,6 +438,22 @@ func (s *Secret) TableName() string {
 	return "Secrets"
 }
 
+// RepoSecret is a secret that is only exposed to workflows for a single repo.
+// Like Secret, its value is sealed with the group's public key.
+type RepoSecret struct {
+	GroupID string `gorm:"primaryKey"`
+	// RepoURL is the normalized URL of the repo.
+	RepoURL string `gorm:"primaryKey"`
+	Name    string `gorm:"primaryKey"`
+	UserID  string
+	Value   string `gorm:"type:text"`
+	Perms   int32  `gorm:"default:NULL"`
+}
+
+func (s *RepoSecret) TableName() string {
+	return "RepoSecrets"
+}
+
 type Execution struct {
 	// The subscriber ID, a concatenated string of the
 	// auth Issuer ID and the subcriber ID string.
@@ -476,6 +523,145 @@ func (t *InvocationExecution) TableName() string {
 	return "InvocationExecutions"
 }
 
+// InvocationLegalHold exempts an invocation from deletion, both by the
+// invocation janitor and by users, until the hold is removed.
+type InvocationLegalHold struct {
+	Model
+
+	InvocationID string `gorm:"primaryKey"`
+	GroupID      string `gorm:"index:invocation_legal_hold_group_id_index"`
+
+	// The user who placed the hold.
+	UserID string
+
+	// Why the invocation is held, e.g. a case or ticket reference.
+	Reason string `gorm:"type:text;"`
+}
+
+func (t *InvocationLegalHold) TableName() string {
+	return "InvocationLegalHolds"
+}
+
+// InvocationAttempt is one attempt of an invocation. Retries of a bazel command
+// with the same invocation ID are recorded as new attempts of the same
+// invocation, and the Invocations row always describes the latest attempt.
+type InvocationAttempt struct {
+	Model
+
+	InvocationID string `gorm:"primaryKey"`
+	Attempt      uint64 `gorm:"primaryKey;autoIncrement:false"`
+
+	InvocationStatus int64
+	Success          bool
+	BazelExitCode    string
+	DurationUsec     int64
+}
+
+func (t *InvocationAttempt) TableName() string {
+	return "InvocationAttempts"
+}
+
+// InvocationAnnotation is a note left on an invocation by a member of its
+// group.
+type InvocationAnnotation struct {
+	Model
+
+	AnnotationID string `gorm:"primaryKey"`
+	InvocationID string `gorm:"index:invocation_annotation_invocation_id_index"`
+	GroupID      string
+
+	// The user who created the annotation.
+	UserID string
+
+	// If set, the label of the target that the annotation is about.
+	TargetLabel string
+
+	// The contents of the annotation, in markdown.
+	Body string `gorm:"type:text;"`
+}
+
+func (t *InvocationAnnotation) TableName() string {
+	return "InvocationAnnotations"
+}
+
+// InvocationTimingProfile contains the durations parsed from the JSON trace
+// profile of an invocation. Durations are in microseconds.
+type InvocationTimingProfile struct {
+	Model
+
+	InvocationID string `gorm:"primaryKey"`
+	// The attempt of the invocation that uploaded the profile.
+	Attempt uint64 `gorm:"not null;default:0"`
+
+	LaunchPhaseUsec                  int64
+	InitPhaseUsec                    int64
+	TargetPatternEvaluationPhaseUsec int64
+	AnalysisPhaseUsec                int64
+	PreparationPhaseUsec             int64
+	ExecutionPhaseUsec               int64
+	FinishPhaseUsec                  int64
+
+	// The summed duration of the actions on the critical path.
+	CriticalPathUsec int64
+	// The time from the first to the last event in the profile.
+	TotalUsec int64
+}
+
+func (t *InvocationTimingProfile) TableName() string {
+	return "InvocationTimingProfiles"
+}
+
+// BuildMetadataRequirement is a build_metadata key that a group's invocations
+// must set.
+type BuildMetadataRequirement struct {
+	Model
+
+	GroupID     string `gorm:"primaryKey"`
+	MetadataKey string `gorm:"primaryKey"`
+
+	// If set, a regular expression that the entire value must match.
+	Pattern string `gorm:"type:text;"`
+}
+
+func (t *BuildMetadataRequirement) TableName() string {
+	return "BuildMetadataRequirements"
+}
+
+// RedactionRule is a redaction that is applied to a group's build events
+// before they are stored.
+type RedactionRule struct {
+	Model
+
+	GroupID string `gorm:"primaryKey"`
+	// The position of the rule in the group's list of rules.
+	Position int32 `gorm:"primaryKey;autoIncrement:false"`
+
+	// What the rule matches. The value maps to grp.RedactionRuleTarget.
+	Target  int32
+	Pattern string `gorm:"type:text;"`
+}
+
+func (t *RedactionRule) TableName() string {
+	return "RedactionRules"
+}
+
+// CompletionWebhook is an endpoint that is notified when a group's
+// invocations are finalized.
+type CompletionWebhook struct {
+	Model
+
+	GroupID string `gorm:"primaryKey"`
+	// The position of the webhook in the group's list of webhooks.
+	Position int32 `gorm:"primaryKey;autoIncrement:false"`
+
+	URL           string `gorm:"type:text;"`
+	SigningSecret string
+}
+
+func (t *CompletionWebhook) TableName() string {
+	return "CompletionWebhooks"
+}
+
 type TelemetryLog struct {
 	Hostname         string
 	InstallationUUID string `gorm:"primaryKey"`
@@ -547,6 +733,55 @@ func (ts *TargetStatus) TableName() string {
 	return "TargetStatuses"
 }
 
+// TargetTestAttempt is the status of a single attempt of a test target's run
+// and shard, as reported by the test's TestResult event.
+type TargetTestAttempt struct {
+	Model
+	TargetID       int64  `gorm:"primaryKey;autoIncrement:false"`
+	InvocationUUID []byte `gorm:"primaryKey;autoIncrement:false;size:16;index:target_test_attempt_invocation_uuid_idx"`
+	Run            int32  `gorm:"primaryKey;autoIncrement:false"`
+	Shard          int32  `gorm:"primaryKey;autoIncrement:false"`
+	Attempt        int32  `gorm:"primaryKey;autoIncrement:false"`
+	Status         int32
+	Cached         bool `gorm:"not null;default:0"`
+	StartTimeUsec  int64
+	DurationUsec   int64
+}
+
+func (ta *TargetTestAttempt) TableName() string {
+	return "TargetTestAttempts"
+}
+
+// TargetFlakeStats summarizes how flaky a test target was over a rolling
+// window of CI invocations. The stats are periodically recomputed by the flake
+// detector.
+type TargetFlakeStats struct {
+	Model
+	TargetID int64  `gorm:"primaryKey;autoIncrement:false"`
+	GroupID  string `gorm:"primaryKey;index:target_flake_stats_group_id"`
+	RepoURL  string
+	Label    string
+
+	WindowStartUsec int64
+	WindowEndUsec   int64
+
+	// TotalRuns is the number of invocations in the window that ran the
+	// target. FlakyRuns and FailedRuns are the number of those in which the
+	// target passed after failed attempts, or didn't pass at all.
+	TotalRuns  int64
+	FlakyRuns  int64
+	FailedRuns int64
+
+	// TotalAttempts and FailedAttempts count individual test attempts across
+	// all runs and shards.
+	TotalAttempts  int64
+	FailedAttempts int64
+}
+
+func (tf *TargetFlakeStats) TableName() string {
+	return "TargetFlakeStats"
+}
+
 // GitHubAppInstallation represents a BuildBuddy GitHub App installation linked
 // to an organization.
 //
@@ -599,6 +834,13 @@ type GitRepository struct {
 	// within this repository should run as a non-root user by default.
 	// TODO(http://go/b/3286): Remove this field after completing migration.
 	DefaultNonRootRunner bool `gorm:"not null;default:0"`
+
+	// SchedulesDisabled disables the scheduled workflow actions of this repo.
+	SchedulesDisabled bool `gorm:"not null;default:0"`
+
+	// ForkApprovalRequired requires a trusted user to approve pull requests
+	// from untrusted forks of this repo before any workflow actions run.
+	ForkApprovalRequired bool `gorm:"not null;default:0"`
 }
 
 func (g *GitRepository) TableName() string {
@@ -630,6 +872,16 @@ type Workflow struct {
 	// registering the webhook. This will only be set for the case where we
 	// successfully auto-registered the webhook.
 	GitProviderWebhookID string
+	// WebhookSecret is the encrypted secret that webhook deliveries must be
+	// signed with. Workflows created before webhook secrets were enabled
+	// don't have one.
+	WebhookSecret string `gorm:"size:512"`
+	// SchedulesDisabled disables the scheduled workflow actions of this
+	// workflow.
+	SchedulesDisabled bool `gorm:"not null;default:0"`
+	// ForkApprovalRequired requires a trusted user to approve pull requests
+	// from untrusted forks before any workflow actions run.
+	ForkApprovalRequired bool `gorm:"not null;default:0"`
 
 	// Set if this workflow was adapted from a GitRepository.
 	GitRepository *GitRepository `gorm:"-"`
@@ -639,6 +891,198 @@ func (wf *Workflow) TableName() string {
 	return "Workflows"
 }
 
+// WorkflowSchedule records the most recent run of a scheduled workflow
+// action, so that each scheduled run is started exactly once.
+type WorkflowSchedule struct {
+	Model
+
+	// WorkflowID is the ID of the workflow, or the synthetic workflow ID of
+	// the GitRepository that the action belongs to.
+	WorkflowID string `gorm:"primaryKey"`
+	// ScheduleKey identifies the schedule within the workflow. It is a hash of
+	// the action name and the schedule's cron expression, time zone and
+	// branch, so that changing the schedule resets it.
+	ScheduleKey string `gorm:"primaryKey"`
+
+	// LastRunUsec is the scheduled time of the most recent run, whether it
+	// was started or skipped.
+	LastRunUsec int64 `gorm:"not null"`
+}
+
+func (ws *WorkflowSchedule) TableName() string {
+	return "WorkflowSchedules"
+}
+
+// WorkflowConcurrencyRun is a run of a workflow action that belongs to a
+// concurrency group. Runs are deleted when they're superseded by a newer run in
+// their group.
+type WorkflowConcurrencyRun struct {
+	Model
+
+	// InvocationID is the invocation ID of the run.
+	InvocationID string `gorm:"primaryKey"`
+
+	// WorkflowID is the ID of the workflow, or the synthetic workflow ID of
+	// the GitRepository that the action belongs to.
+	WorkflowID string `gorm:"index:workflow_concurrency_group_index"`
+	// GroupKey is a hash of the name of the concurrency group.
+	GroupKey string `gorm:"index:workflow_concurrency_group_index"`
+
+	// State is whether the run is waiting for the in-progress runs in its
+	// group, or has been started.
+	State int32 `gorm:"not null;default:0"`
+	// ExecutionID is the ID of the run's execution, once it has started.
+	ExecutionID string
+}
+
+func (wr *WorkflowConcurrencyRun) TableName() string {
+	return "WorkflowConcurrencyRuns"
+}
+
+// MergeQueueEntry is a pull request in the merge queue of a workflow. Entries
+// are deleted when the pull request is merged or leaves the queue.
+type MergeQueueEntry struct {
+	Model
+
+	// WorkflowID is the ID of the workflow, or the synthetic workflow ID of
+	// the GitRepository that the pull request belongs to.
+	WorkflowID        string `gorm:"primaryKey"`
+	PullRequestNumber int64  `gorm:"primaryKey;autoIncrement:false"`
+
+	// GroupID and RepoURL are the group and repo of the workflow.
+	GroupID string `gorm:"not null;index:merge_queue_repo_index"`
+	RepoURL string `gorm:"not null;index:merge_queue_repo_index"`
+	// TargetBranch is the branch that the pull request is merged into.
+	TargetBranch string `gorm:"not null"`
+	// PushedRepoURL and PushedBranch are the repo and branch of the pull
+	// request's head, which may be a fork.
+	PushedRepoURL string `gorm:"not null"`
+	PushedBranch  string `gorm:"not null"`
+	// CommitSHA is the head commit of the pull request when it was queued.
+	CommitSHA string `gorm:"not null"`
+	// Author is the login of the pull request's author.
+	Author string
+
+	// State is a wfpb.MergeQueueEntry_State value.
+	State int32 `gorm:"not null;default:0"`
+	// BatchID identifies the batch of entries that is being tested together,
+	// while the entry is being tested.
+	BatchID string `gorm:"index:merge_queue_batch_index"`
+	// TestAlone is set if the entry was part of a batch that failed, so that
+	// it's tested on its own to find out whether it caused the failure.
+	TestAlone bool `gorm:"not null;default:0"`
+	// StatusMessage describes why the entry failed.
+	StatusMessage string
+}
+
+func (e *MergeQueueEntry) TableName() string {
+	return "MergeQueueEntries"
+}
+
+// MergeQueueRun is a workflow run that tests a batch of merge queue entries.
+type MergeQueueRun struct {
+	Model
+
+	// InvocationID is the invocation ID of the run.
+	InvocationID string `gorm:"primaryKey"`
+	// BatchID is the ID of the batch that the run tests.
+	BatchID string `gorm:"index:merge_queue_run_batch_index"`
+	// ActionName is the name of the workflow action.
+	ActionName string
+	// ExecutionID is the ID of the run's execution, once it has started.
+	ExecutionID string
+}
+
+func (r *MergeQueueRun) TableName() string {
+	return "MergeQueueRuns"
+}
+
+// WorkflowMatrixRun is a run of one combination of a matrix workflow action.
+// The runs of a matrix are deleted once they've all finished and their
+// combined status has been reported.
+type WorkflowMatrixRun struct {
+	Model
+
+	// InvocationID is the invocation ID of the run.
+	InvocationID string `gorm:"primaryKey"`
+	// MatrixID identifies the runs of all combinations of the matrix that
+	// were started for the same event.
+	MatrixID string `gorm:"index:workflow_matrix_run_matrix_index"`
+	// WorkflowID is the ID of the workflow, or the synthetic workflow ID of
+	// the GitRepository that the action belongs to.
+	WorkflowID string
+	// ActionName is the name of the combination's workflow action.
+	ActionName string
+	// StatusName is the name of the combined status of the matrix.
+	StatusName string
+	// StatusRepoURL is the repo that the combined status is reported to.
+	StatusRepoURL string
+	// CommitSHA is the commit that the combined status is reported for.
+	CommitSHA string
+}
+
+func (r *WorkflowMatrixRun) TableName() string {
+	return "WorkflowMatrixRuns"
+}
+
+// WorkflowArtifact is a file of an artifact published by a workflow action,
+// which is copied from the cache to the blobstore so that it's kept until it
+// expires, regardless of cache eviction.
+type WorkflowArtifact struct {
+	Model
+
+	// ArtifactFileID uniquely identifies the file.
+	ArtifactFileID string `gorm:"primaryKey"`
+	// InvocationID is the invocation of the workflow action that published
+	// the artifact.
+	InvocationID string `gorm:"index:workflow_artifact_invocation_index"`
+	// Name is the name of the artifact, as declared in buildbuddy.yaml.
+	Name string
+	// FileName is the path of the file relative to the repo root.
+	FileName string
+	// Digest is the SHA256 digest of the file's contents.
+	Digest    string
+	SizeBytes int64
+	// BlobName is the name of the blob that the file is stored in.
+	BlobName string
+	// ExpiresAtUsec is when the file is deleted.
+	ExpiresAtUsec int64 `gorm:"index:workflow_artifact_expires_at_index"`
+}
+
+func (a *WorkflowArtifact) TableName() string {
+	return "WorkflowArtifacts"
+}
+
+// SCIMGroup is a group of users that an identity provider pushed to an org
+// via the SCIM API. Its members may be given roles in the org by the
+// auth.saml.group_mappings of the org.
+type SCIMGroup struct {
+	Model
+
+	SCIMGroupID string `gorm:"primaryKey;column:scim_group_id"`
+	// GroupID is the org that the group was pushed to.
+	GroupID string `gorm:"index:scim_group_group_id_index"`
+	// DisplayName is the name of the group in the identity provider.
+	DisplayName string
+	// ExternalID is the ID of the group in the identity provider, if it sent
+	// one.
+	ExternalID string
+}
+
+func (*SCIMGroup) TableName() string {
+	return "SCIMGroups"
+}
+
+// SCIMGroupMember is a member of a SCIMGroup.
+type SCIMGroupMember struct {
+	SCIMGroupID string `gorm:"primaryKey;column:scim_group_id"`
+	UserID      string `gorm:"primaryKey"`
+}
+
+func (*SCIMGroupMember) TableName() string {
+	return "SCIMGroupMembers"
+}
+
 type UsageCounts struct {
 	Invocations            int64
 	CASCacheHits           int64
@@ -656,6 +1100,7 @@ type UsageCounts struct {
 	TotalCachedActionExecUsec            int64 `gorm:"not null;default:0"`
 	CPUNanos                             int64 `gorm:"not null;default:0"`
 	MemoryGBUsec                         int64 `gorm:"not null;default:0"`
+	CacheStorageGBUsec                   int64 `gorm:"not null;default:0"`
 }
 
 type UsageLabels struct {
@@ -802,6 +1247,101 @@ func (*IPRule) TableName() string {
 	return "IPRules"
 }
 
+// IPRuleOverride lets an org admin bypass the group's IP rules until it
+// expires.
+type IPRuleOverride struct {
+	Model
+	IPRuleOverrideID string `gorm:"primaryKey"`
+	GroupID          string `gorm:"not null;index:ip_rule_override_group_user_idx,priority:1"`
+	UserID           string `gorm:"not null;index:ip_rule_override_group_user_idx,priority:2"`
+	Reason           string `gorm:"not null;default:''"`
+	ExpiryUsec       int64  `gorm:"not null"`
+}
+
+func (*IPRuleOverride) TableName() string {
+	return "IPRuleOverrides"
+}
+
+// OIDCTrustPolicy allows CI jobs to exchange the OIDC tokens issued by their
+// CI provider for short-lived API keys of the group, if the token was issued
+// for the repository and a branch matching the policy.
+type OIDCTrustPolicy struct {
+	Model
+	TrustPolicyID string `gorm:"primaryKey"`
+	GroupID       string `gorm:"index:oidc_trust_policy_group_id_idx"`
+	Label         string
+	Issuer        string `gorm:"not null;index:oidc_trust_policy_repository_idx,priority:1"`
+	Repository    string `gorm:"not null;index:oidc_trust_policy_repository_idx,priority:2"`
+	// Glob pattern that the branch must match. Empty matches any ref.
+	Branch       string `gorm:"not null;default:''"`
+	Capabilities int32  `gorm:"not null;default:0"`
+	Scopes       int32  `gorm:"not null;default:0"`
+	// IDs of the repository and its owner that tokens must be issued for.
+	// Empty if the policy isn't bound to them.
+	RepositoryID      string `gorm:"not null;default:''"`
+	RepositoryOwnerID string `gorm:"not null;default:''"`
+}
+
+func (*OIDCTrustPolicy) TableName() string {
+	return "OIDCTrustPolicies"
+}
+
+// GroupOIDCProvider is the OIDC identity provider that members of a group log
+// in with, instead of one of the providers configured for the whole server.
+type GroupOIDCProvider struct {
+	Model
+	GroupID   string `gorm:"primaryKey"`
+	IssuerURL string `gorm:"not null"`
+	ClientID  string `gorm:"not null"`
+	// The client secret, encrypted with the KMS master key.
+	EncryptedClientSecret string `gorm:"not null;default:''"`
+
+	// The claims of the ID token holding the user's details. Empty means the
+	// standard claim.
+	EmailClaim     string `gorm:"not null;default:''"`
+	FirstNameClaim string `gorm:"not null;default:''"`
+	LastNameClaim  string `gorm:"not null;default:''"`
+	GroupsClaim    string `gorm:"not null;default:''"`
+}
+
+func (*GroupOIDCProvider) TableName() string {
+	return "GroupOIDCProviders"
+}
+
+// GroupOIDCRoleMapping assigns a role to the users whose ID token, issued by
+// the group's OIDC provider, lists the given IdP group.
+type GroupOIDCRoleMapping struct {
+	Model
+
+	GroupID string `gorm:"primaryKey"`
+	// The position of the mapping in the group's list of mappings.
+	Position int32 `gorm:"primaryKey;autoIncrement:false"`
+
+	IDPGroup string `gorm:"not null"`
+	Role     uint32 `gorm:"not null"`
+}
+
+func (*GroupOIDCRoleMapping) TableName() string {
+	return "GroupOIDCRoleMappings"
+}
+
+// ActionCacheInvalidation causes AC entries written before it was created to
+// be treated as missing, if they belong to the group and match the instance
+// name prefix and (if set) platform property.
+type ActionCacheInvalidation struct {
+	Model
+	InvalidationID        string `gorm:"primaryKey"`
+	GroupID               string `gorm:"index:action_cache_invalidation_group_id_idx"`
+	UserID                string
+	InstanceNamePrefix    string
+	PlatformPropertyName  string
+	PlatformPropertyValue string
+}
+
+func (*ActionCacheInvalidation) TableName() string {
+	return "ActionCacheInvalidations"
+}
+
 type PostAutoMigrateLogic func() error
 
 // Manual migration called before auto-migration.
@@ -1286,28 +1826,51 @@ func RegisterTables() {
 	allTables = nil
 	// Keep these sorted by two-letter prefix (and when adding new tables,
 	// use a unique prefix if possible):
+	registerTable("AI", &ActionCacheInvalidation{})
 	registerTable("AK", &APIKey{})
+	registerTable("BM", &BuildMetadataRequirement{})
 	registerTable("CA", &CacheEntry{})
 	registerTable("CL", &CacheLog{})
+	registerTable("CW", &CompletionWebhook{})
 	registerTable("EK", &EncryptionKey{})
 	registerTable("EV", &EncryptionKeyVersion{})
 	registerTable("EX", &Execution{})
 	registerTable("GH", &GitHubAppInstallation{})
 	registerTable("GR", &Group{})
+	registerTable("IA", &InvocationAnnotation{})
 	registerTable("IE", &InvocationExecution{})
+	registerTable("IH", &InvocationLegalHold{})
 	registerTable("IN", &Invocation{})
+	registerTable("IO", &IPRuleOverride{})
+	registerTable("IP", &InvocationAttempt{})
 	registerTable("IR", &IPRule{})
+	registerTable("IT", &InvocationTimingProfile{})
+	registerTable("MQ", &MergeQueueEntry{})
+	registerTable("MR", &MergeQueueRun{})
+	registerTable("OM", &GroupOIDCRoleMapping{})
+	registerTable("OP", &GroupOIDCProvider{})
+	registerTable("OT", &OIDCTrustPolicy{})
 	registerTable("QB", &QuotaBucket{})
 	registerTable("QG", &QuotaGroup{})
 	registerTable("RE", &GitRepository{})
+	registerTable("RR", &RedactionRule{})
+	registerTable("RS", &RepoSecret{})
+	registerTable("SC", &SCIMGroup{})
 	registerTable("SE", &Session{})
 	registerTable("SK", &Secret{})
+	registerTable("SM", &SCIMGroupMember{})
 	registerTable("TA", &Target{})
+	registerTable("TF", &TargetFlakeStats{})
 	registerTable("TL", &TelemetryLog{})
 	registerTable("TO", &Token{})
 	registerTable("TS", &TargetStatus{})
+	registerTable("TT", &TargetTestAttempt{})
 	registerTable("UA", &Usage{})
 	registerTable("UG", &UserGroup{})
 	registerTable("US", &User{})
+	registerTable("WA", &WorkflowArtifact{})
+	registerTable("WC", &WorkflowConcurrencyRun{})
 	registerTable("WF", &Workflow{})
+	registerTable("WM", &WorkflowMatrixRun{})
+	registerTable("WS", &WorkflowSchedule{})
 }
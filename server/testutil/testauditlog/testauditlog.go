@@ -76,6 +76,14 @@ func (f *FakeAuditLog) GetLogs(ctx context.Context, req *alpb.GetAuditLogsReques
 	return nil, status.UnimplementedError("not implemented")
 }
 
+func (f *FakeAuditLog) ExportLogs(ctx context.Context, req *alpb.ExportAuditLogsRequest) (*alpb.ExportAuditLogsResponse, error) {
+	return nil, status.UnimplementedError("not implemented")
+}
+
+func (f *FakeAuditLog) ReadExport(ctx context.Context, blobName string) ([]byte, error) {
+	return nil, status.UnimplementedError("not implemented")
+}
+
 func (f *FakeAuditLog) GetAllEntries() []*FakeEntry {
 	return f.entries
 }
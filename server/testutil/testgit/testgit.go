@@ -21,6 +21,10 @@ const (
 	// FakeWebhookID is the fake webhook ID returned by the provider when
 	// creating a webhook.
 	FakeWebhookID = "fake-webhook-id"
+
+	// FakeWebhookSecretHeader is the header that the provider expects the
+	// webhook secret to be sent in.
+	FakeWebhookSecretHeader = "X-Fake-Webhook-Secret"
 )
 
 type Status struct {
@@ -30,25 +34,47 @@ type Status struct {
 	Payload     any
 }
 
+type MergedPullRequest struct {
+	RepoURL     string
+	Number      int64
+	CommitSHA   string
+	MergeMethod string
+}
+
+type PullRequestComment struct {
+	RepoURL string
+	Number  int64
+	Body    string
+}
+
 // FakeProvider implements the git provider interface for tests.
 type FakeProvider struct {
 	// Captured values
 
-	RegisteredWebhookURL  string
-	UnregisteredWebhookID string
-	Statuses              chan *Status
+	RegisteredWebhookURL    string
+	RegisteredWebhookSecret string
+	UnregisteredWebhookID   string
+	Statuses                chan *Status
+	MergedPullRequests      chan *MergedPullRequest
+	PullRequestComments     chan *PullRequestComment
 
 	// Faked values
 
-	RegisterWebhookError error
-	WebhookData          *interfaces.WebhookData
-	FileContents         map[string]string
-	TrustedUsers         []string
+	RegisterWebhookError  error
+	MergePullRequestError error
+	WebhookData           *interfaces.WebhookData
+	FileContents          map[string]string
+	TrustedUsers          []string
+	// PullRequests are the webhook data returned by GetPullRequest, by pull
+	// request number.
+	PullRequests map[int64]*interfaces.WebhookData
 }
 
 func NewFakeProvider() *FakeProvider {
 	return &FakeProvider{
-		Statuses: make(chan *Status, 1024),
+		Statuses:            make(chan *Status, 1024),
+		MergedPullRequests:  make(chan *MergedPullRequest, 1024),
+		PullRequestComments: make(chan *PullRequestComment, 1024),
 	}
 }
 
@@ -64,11 +90,18 @@ func (p *FakeProvider) ParseWebhookData(req *http.Request) (*interfaces.WebhookD
 	}
 	return p.WebhookData, nil
 }
-func (p *FakeProvider) RegisterWebhook(ctx context.Context, accessToken, repoURL, webhookURL string) (string, error) {
+func (p *FakeProvider) VerifyWebhookSignature(req *http.Request, secret string) error {
+	if req.Header.Get(FakeWebhookSecretHeader) != secret {
+		return status.PermissionDeniedError("webhook secret mismatch")
+	}
+	return nil
+}
+func (p *FakeProvider) RegisterWebhook(ctx context.Context, accessToken, repoURL, webhookURL, secret string) (string, error) {
 	if p.RegisterWebhookError != nil {
 		return "", p.RegisterWebhookError
 	}
 	p.RegisteredWebhookURL = webhookURL
+	p.RegisteredWebhookSecret = secret
 	return FakeWebhookID, nil
 }
 func (p *FakeProvider) UnregisterWebhook(ctx context.Context, accessToken, repoURL, webhookID string) error {
@@ -94,6 +127,24 @@ func (p *FakeProvider) CreateStatus(ctx context.Context, accessToken, repoURL, c
 	p.Statuses <- &Status{accessToken, repoURL, commitSHA, payload}
 	return nil
 }
+func (p *FakeProvider) MergePullRequest(ctx context.Context, accessToken, repoURL string, number int64, commitSHA, mergeMethod string) error {
+	if p.MergePullRequestError != nil {
+		return p.MergePullRequestError
+	}
+	p.MergedPullRequests <- &MergedPullRequest{repoURL, number, commitSHA, mergeMethod}
+	return nil
+}
+func (p *FakeProvider) GetPullRequest(ctx context.Context, accessToken, repoURL string, number int64) (*interfaces.WebhookData, error) {
+	wd, ok := p.PullRequests[number]
+	if !ok {
+		return nil, status.NotFoundError("Not found")
+	}
+	return wd, nil
+}
+func (p *FakeProvider) CreatePullRequestComment(ctx context.Context, accessToken, repoURL string, number int64, body string) error {
+	p.PullRequestComments <- &PullRequestComment{repoURL, number, body}
+	return nil
+}
 
 // MakeTempRepo initializes a Git repository with the given file contents, and
 // creates an initial commit of those files. Contents are specified as a map of
@@ -34,3 +34,44 @@ func Setup(t *testing.T) {
 		require.NoError(t, err, "enable IPv4 forwarding")
 	}
 }
+
+// SetupIPv6 is like Setup, but also sets up the test to be able to use
+// dual-stack networks. It skips the test if ip6tables isn't available.
+func SetupIPv6(t *testing.T) {
+	Setup(t)
+
+	cmd := []string{"ip6tables", "--wait", "--list", "FORWARD"}
+	if os.Getuid() != 0 {
+		cmd = append([]string{"sudo", "--non-interactive"}, cmd...)
+	}
+	if b, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput(); err != nil {
+		t.Logf("%s failed: %s: %s", cmd, err, strings.TrimSpace(string(b)))
+		t.Skipf("test requires ip6tables")
+	}
+
+	// Ensure IPv6 forwarding is enabled
+	b, err := os.ReadFile("/proc/sys/net/ipv6/conf/all/forwarding")
+	if os.IsNotExist(err) {
+		t.Skipf("test requires IPv6 support in the kernel")
+	}
+	require.NoError(t, err)
+	if strings.TrimSpace(string(b)) != "1" {
+		err := os.WriteFile("/proc/sys/net/ipv6/conf/all/forwarding", []byte("1"), 0)
+		require.NoError(t, err, "enable IPv6 forwarding")
+	}
+}
+
+// SetupNftables is like Setup, but also sets up the test to be able to use the
+// nftables firewall backend. It skips the test if nft isn't available.
+func SetupNftables(t *testing.T) {
+	Setup(t)
+
+	cmd := []string{"nft", "list", "tables"}
+	if os.Getuid() != 0 {
+		cmd = append([]string{"sudo", "--non-interactive"}, cmd...)
+	}
+	if b, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput(); err != nil {
+		t.Logf("%s failed: %s: %s", cmd, err, strings.TrimSpace(string(b)))
+		t.Skipf("test requires nft")
+	}
+}
@@ -0,0 +1,159 @@
+// Package certreloader serves TLS certificates and CA bundles from files that
+// are rotated in place, e.g. by cert-manager or the SPIRE spiffe-helper, so
+// that short-lived certificates can be used without restarting.
+package certreloader
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+// How often the files are checked for changes. Checks happen lazily, when the
+// certificate is requested for a handshake.
+const checkInterval = 10 * time.Second
+
+// files tracks the modification times of a set of files.
+type files struct {
+	paths     []string
+	modTimes  []time.Time
+	lastCheck time.Time
+}
+
+// changed reports whether any of the files was modified since the last call
+// that returned true. It stats the files at most once per checkInterval.
+func (f *files) changed(now time.Time) bool {
+	if now.Sub(f.lastCheck) < checkInterval {
+		return false
+	}
+	f.lastCheck = now
+	changed := false
+	for i, p := range f.paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			// The file may be in the middle of being replaced; keep the
+			// current contents and check again later.
+			continue
+		}
+		if !info.ModTime().Equal(f.modTimes[i]) {
+			f.modTimes[i] = info.ModTime()
+			changed = true
+		}
+	}
+	return changed
+}
+
+func newFiles(paths ...string) *files {
+	return &files{paths: paths, modTimes: make([]time.Time, len(paths))}
+}
+
+// KeyPair is a certificate and private key that are reloaded from their
+// files when the files change.
+type KeyPair struct {
+	mu    sync.Mutex
+	files *files
+	cert  *tls.Certificate
+}
+
+// NewKeyPair loads a PEM encoded certificate chain and private key from the
+// given files.
+func NewKeyPair(certFile, keyFile string) (*KeyPair, error) {
+	k := &KeyPair{files: newFiles(certFile, keyFile)}
+	k.files.changed(time.Now())
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, status.FailedPreconditionErrorf("could not load key pair from %q and %q: %s", certFile, keyFile, err)
+	}
+	k.cert = &cert
+	return k, nil
+}
+
+// Certificate returns the current certificate.
+func (k *KeyPair) Certificate() *tls.Certificate {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.files.changed(time.Now()) {
+		cert, err := tls.LoadX509KeyPair(k.files.paths[0], k.files.paths[1])
+		if err != nil {
+			// Key pairs are usually rotated by writing the two files one
+			// after the other, so the pair can be briefly mismatched.
+			log.Warningf("Could not reload key pair from %q and %q, keeping the current certificate: %s", k.files.paths[0], k.files.paths[1], err)
+			k.files.modTimes[0] = time.Time{}
+		} else {
+			log.Infof("Reloaded key pair from %q and %q", k.files.paths[0], k.files.paths[1])
+			k.cert = &cert
+		}
+	}
+	return k.cert
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate.
+func (k *KeyPair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return k.Certificate(), nil
+}
+
+// GetClientCertificate can be used as tls.Config.GetClientCertificate.
+func (k *KeyPair) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return k.Certificate(), nil
+}
+
+// CertPool is a pool of CA certificates that is reloaded from its file when
+// the file changes.
+type CertPool struct {
+	mu    sync.Mutex
+	files *files
+	pool  *x509.CertPool
+	// Certificates that are always part of the pool, in addition to the
+	// certificates in the file.
+	extra []*x509.Certificate
+}
+
+// NewCertPool loads a PEM encoded CA bundle from the given file. The extra
+// certificates are added to the pool in addition to those in the file.
+func NewCertPool(file string, extra ...*x509.Certificate) (*CertPool, error) {
+	p := &CertPool{files: newFiles(file), extra: extra}
+	p.files.changed(time.Now())
+	pool, err := p.load()
+	if err != nil {
+		return nil, err
+	}
+	p.pool = pool
+	return p, nil
+}
+
+func (p *CertPool) load() (*x509.CertPool, error) {
+	data, err := os.ReadFile(p.files.paths[0])
+	if err != nil {
+		return nil, status.FailedPreconditionErrorf("could not read CA bundle from %q: %s", p.files.paths[0], err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, status.FailedPreconditionErrorf("CA bundle %q did not contain any PEM encoded certificates", p.files.paths[0])
+	}
+	for _, c := range p.extra {
+		pool.AddCert(c)
+	}
+	return pool, nil
+}
+
+// Pool returns the current pool.
+func (p *CertPool) Pool() *x509.CertPool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.files.changed(time.Now()) {
+		pool, err := p.load()
+		if err != nil {
+			log.Warningf("Could not reload CA bundle, keeping the current one: %s", err)
+			p.files.modTimes[0] = time.Time{}
+		} else {
+			log.Infof("Reloaded CA bundle from %q", p.files.paths[0])
+			p.pool = pool
+		}
+	}
+	return p.pool
+}
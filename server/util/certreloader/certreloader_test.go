@@ -0,0 +1,119 @@
+package certreloader
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCert writes a new self-signed certificate and its key to the given
+// files, and returns the certificate.
+func writeCert(t *testing.T, certFile, keyFile, name string, modTime time.Time) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	require.NoError(t, err)
+	err = os.Chtimes(certFile, modTime, modTime)
+	require.NoError(t, err)
+	if keyFile != "" {
+		err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+		require.NoError(t, err)
+		err = os.Chtimes(keyFile, modTime, modTime)
+		require.NoError(t, err)
+	}
+	return cert
+}
+
+func TestKeyPairReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Hour)
+	writeCert(t, certFile, keyFile, "first", start)
+
+	kp, err := NewKeyPair(certFile, keyFile)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(kp.Certificate().Certificate[0])
+	require.NoError(t, err)
+	assert.Equal(t, "first", leaf.Subject.CommonName)
+
+	writeCert(t, certFile, keyFile, "second", start.Add(time.Minute))
+
+	// Files are not re-checked until the check interval has passed.
+	leaf, err = x509.ParseCertificate(kp.Certificate().Certificate[0])
+	require.NoError(t, err)
+	assert.Equal(t, "first", leaf.Subject.CommonName)
+
+	kp.files.lastCheck = time.Time{}
+	cert, err := kp.GetCertificate(nil)
+	require.NoError(t, err)
+	leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	assert.Equal(t, "second", leaf.Subject.CommonName)
+
+	// A broken key pair keeps the previous certificate.
+	err = os.WriteFile(keyFile, []byte("garbage"), 0600)
+	require.NoError(t, err)
+	kp.files.lastCheck = time.Time{}
+	cert, err = kp.GetClientCertificate(nil)
+	require.NoError(t, err)
+	leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	assert.Equal(t, "second", leaf.Subject.CommonName)
+}
+
+func TestNewKeyPairMissingFiles(t *testing.T) {
+	dir := t.TempDir()
+	_, err := NewKeyPair(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	require.Error(t, err)
+}
+
+func TestCertPoolReload(t *testing.T) {
+	dir := t.TempDir()
+	bundleFile := filepath.Join(dir, "bundle.pem")
+	start := time.Now().Add(-time.Hour)
+	first := writeCert(t, bundleFile, "", "first", start)
+	extra := writeCert(t, filepath.Join(dir, "extra.pem"), "", "extra", start)
+
+	p, err := NewCertPool(bundleFile, extra)
+	require.NoError(t, err)
+	assert.True(t, hasCert(p.Pool(), first))
+	assert.True(t, hasCert(p.Pool(), extra))
+
+	second := writeCert(t, bundleFile, "", "second", start.Add(time.Minute))
+	p.files.lastCheck = time.Time{}
+	assert.False(t, hasCert(p.Pool(), first))
+	assert.True(t, hasCert(p.Pool(), second))
+	assert.True(t, hasCert(p.Pool(), extra))
+}
+
+func hasCert(pool *x509.CertPool, cert *x509.Certificate) bool {
+	_, err := cert.Verify(x509.VerifyOptions{Roots: pool})
+	return err == nil
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
 	"github.com/buildbuddy-io/buildbuddy/server/util/lru"
 	"github.com/buildbuddy-io/buildbuddy/server/util/role"
+	"github.com/buildbuddy-io/buildbuddy/server/util/scopes"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/subdomain"
 	"github.com/golang-jwt/jwt"
@@ -49,6 +50,7 @@ type Claims struct {
 	AllowedGroups          []string                      `json:"allowed_groups"`
 	GroupMemberships       []*interfaces.GroupMembership `json:"group_memberships"`
 	Capabilities           []akpb.ApiKey_Capability      `json:"capabilities"`
+	Scopes                 []akpb.ApiKey_Scope           `json:"scopes,omitempty"`
 	UseGroupOwnedExecutors bool                          `json:"use_group_owned_executors,omitempty"`
 	CacheEncryptionEnabled bool                          `json:"cache_encryption_enabled,omitempty"`
 	EnforceIPRules         bool                          `json:"enforce_ip_rules,omitempty"`
@@ -92,6 +94,10 @@ func (c *Claims) HasCapability(cap akpb.ApiKey_Capability) bool {
 	return false
 }
 
+func (c *Claims) GetScopes() []akpb.ApiKey_Scope {
+	return c.Scopes
+}
+
 func (c *Claims) GetUseGroupOwnedExecutors() bool {
 	return c.UseGroupOwnedExecutors
 }
@@ -162,6 +168,7 @@ func APIKeyGroupClaims(akg interfaces.APIKeyGroup) *Claims {
 		AllowedGroups:          allowedGroups,
 		GroupMemberships:       groupMemberships,
 		Capabilities:           capabilities.FromInt(akg.GetCapabilities()),
+		Scopes:                 scopes.FromInt(akg.GetScopes()),
 		UseGroupOwnedExecutors: akg.GetUseGroupOwnedExecutors(),
 		CacheEncryptionEnabled: akg.GetCacheEncryptionEnabled(),
 		EnforceIPRules:         akg.GetEnforceIPRules(),
@@ -117,6 +117,11 @@ type Invocation struct {
 	Tags                              []string `gorm:"type:Array(String);"`
 	RunID                             string
 	ParentRunID                       string
+
+	// Perms is used to exclude the invocations that are only visible to
+	// their owner from the stats of other users. Zero for invocations that
+	// were flushed before it was stored.
+	Perms int32
 }
 
 func (i *Invocation) ExcludedFields() []string {
@@ -126,7 +131,9 @@ func (i *Invocation) ExcludedFields() []string {
 		"LastChunkId",
 		"RedactionFlags",
 		"CreatedWithCapabilities",
-		"Perms",
+		"BuildMetadataCompliance",
+		"BuildMetadataViolations",
+		"DownloadPerms",
 	}
 }
 
@@ -471,5 +478,6 @@ func ToInvocationFromPrimaryDB(ti *tables.Invocation) *Invocation {
 		Tags:                              invocation_format.ConvertDBTagsToOLAP(ti.Tags),
 		RunID:                             ti.RunID,
 		ParentRunID:                       ti.ParentRunID,
+		Perms:                             ti.Perms,
 	}
 }
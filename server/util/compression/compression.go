@@ -1,12 +1,14 @@
 package compression
 
 import (
+	"bufio"
 	"io"
 	"runtime"
 	"sync"
 
 	"github.com/buildbuddy-io/buildbuddy/server/metrics"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/klauspost/compress/zstd"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -199,6 +201,95 @@ func NewZstdDecompressingReader(reader io.ReadCloser) (io.ReadCloser, error) {
 	}, nil
 }
 
+// SkipZstdFrames advances past the leading frames of the zstd-compressed
+// stream in reader that decompress to bytes before uncompressedOffset, without
+// decompressing them. It returns a reader for the remainder of the compressed
+// stream, along with the number of decompressed bytes that were skipped. The
+// number of skipped bytes may be less than uncompressedOffset, in which case
+// the caller must decompress the returned reader and discard the difference.
+//
+// A frame can only be skipped if its header records its decompressed size.
+// This is true of all frames written by CompressZstd and
+// NewZstdCompressingReader, so blobs compressed with those functions can be
+// read from an offset while only decompressing a single chunk.
+func SkipZstdFrames(reader io.Reader, uncompressedOffset int64) (io.Reader, int64, error) {
+	if uncompressedOffset <= 0 {
+		return reader, 0, nil
+	}
+	br := bufio.NewReader(reader)
+	skipped := int64(0)
+	for skipped < uncompressedOffset {
+		buf, err := br.Peek(zstd.HeaderMaxSize)
+		if err != nil && err != io.EOF {
+			return nil, 0, err
+		}
+		h := zstd.Header{}
+		if err := h.Decode(buf); err != nil {
+			// Leave anything that isn't a valid frame for the decoder to
+			// report.
+			break
+		}
+		if h.Skippable {
+			if err := discard(br, int(h.HeaderSize)+int(h.SkippableSize)); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		if !h.HasFCS || skipped+int64(h.FrameContentSize) > uncompressedOffset {
+			break
+		}
+		if err := skipZstdFrame(br, &h); err != nil {
+			return nil, 0, err
+		}
+		skipped += int64(h.FrameContentSize)
+	}
+	return br, skipped, nil
+}
+
+// skipZstdFrame discards the frame described by h from br by walking its block
+// headers.
+func skipZstdFrame(br *bufio.Reader, h *zstd.Header) error {
+	if err := discard(br, h.HeaderSize); err != nil {
+		return err
+	}
+	for {
+		bh, err := br.Peek(3)
+		if err != nil {
+			return status.DataLossErrorf("truncated zstd block header: %s", err)
+		}
+		header := uint32(bh[0]) | uint32(bh[1])<<8 | uint32(bh[2])<<16
+		last := header&1 != 0
+		size := int(header >> 3)
+		switch blockType := (header >> 1) & 3; blockType {
+		case 0, 2: // Raw and compressed blocks.
+		case 1: // RLE blocks store a single byte.
+			size = 1
+		default:
+			return status.DataLossError("reserved zstd block type")
+		}
+		if err := discard(br, 3+size); err != nil {
+			return err
+		}
+		if last {
+			break
+		}
+	}
+	if h.HasCheckSum {
+		return discard(br, 4)
+	}
+	return nil
+}
+
+func discard(br *bufio.Reader, n int) error {
+	if _, err := br.Discard(n); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return status.DataLossErrorf("truncated zstd frame: %s", err)
+	}
+	return nil
+}
+
 // DecoderRef wraps a *zstd.Decoder. Since it does not directly start any
 // goroutines, it can be garbage collected before the wrapped decoder can.
 // When garbage collected, a finalizer automatically closes the wrapped decoder,
@@ -1,10 +1,13 @@
 package compression
 
 import (
+	"bytes"
 	"io"
+	"math/rand"
 	"strings"
 	"testing"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/require"
 )
 
@@ -19,3 +22,55 @@ func Test_NewZstdDecompressingReader(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, blob, string(b))
 }
+
+func TestSkipZstdFrames(t *testing.T) {
+	const chunkSize = 1000
+	// Mix incompressible, compressible and repetitive data so that the stream
+	// contains raw, compressed and RLE blocks.
+	blob := make([]byte, 0, 10*chunkSize+123)
+	random := make([]byte, 3*chunkSize)
+	_, err := rand.New(rand.NewSource(0)).Read(random)
+	require.NoError(t, err)
+	blob = append(blob, random...)
+	blob = append(blob, strings.Repeat("hello world ", 300)...)
+	blob = append(blob, bytes.Repeat([]byte{'A'}, 10*chunkSize+123-len(blob))...)
+
+	rc, err := NewZstdCompressingReader(io.NopCloser(bytes.NewReader(blob)), make([]byte, chunkSize), nil)
+	require.NoError(t, err)
+	compressed, err := io.ReadAll(rc)
+	require.NoError(t, err)
+
+	for _, offset := range []int64{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 5*chunkSize + 17, 10 * chunkSize, int64(len(blob)) - 1, int64(len(blob))} {
+		r, skipped, err := SkipZstdFrames(bytes.NewReader(compressed), offset)
+		require.NoError(t, err)
+		require.Equal(t, offset/chunkSize*chunkSize, skipped, "offset %d", offset)
+
+		dr, err := NewZstdDecompressingReader(io.NopCloser(r))
+		require.NoError(t, err)
+		_, err = io.CopyN(io.Discard, dr, offset-skipped)
+		require.NoError(t, err)
+		rest, err := io.ReadAll(dr)
+		require.NoError(t, err)
+		require.Equal(t, blob[offset:], rest, "offset %d", offset)
+	}
+}
+
+func TestSkipZstdFrames_UnknownContentSize(t *testing.T) {
+	blob := strings.Repeat("hello world ", 1000)
+	var buf bytes.Buffer
+	enc, err := zstd.NewWriter(&buf)
+	require.NoError(t, err)
+	_, err = enc.Write([]byte(blob))
+	require.NoError(t, err)
+	require.NoError(t, enc.Close())
+
+	// Streamed frames don't record their size, so nothing can be skipped.
+	r, skipped, err := SkipZstdFrames(bytes.NewReader(buf.Bytes()), 100)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), skipped)
+	dr, err := NewZstdDecompressingReader(io.NopCloser(r))
+	require.NoError(t, err)
+	b, err := io.ReadAll(dr)
+	require.NoError(t, err)
+	require.Equal(t, blob, string(b))
+}
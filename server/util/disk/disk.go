@@ -33,6 +33,7 @@ type Partition struct {
 	ID                  string `yaml:"id" json:"id" usage:"The ID of the partition."`
 	MaxSizeBytes        int64  `yaml:"max_size_bytes" json:"max_size_bytes" usage:"Maximum size of the partition."`
 	EncryptionSupported bool   `yaml:"encryption_supported" json:"encryption_supported" usage:"Whether encrypted data can be stored on this partition."`
+	HardQuota           bool   `yaml:"hard_quota" json:"hard_quota" usage:"If true, writes to this partition are rejected once it reaches its maximum size."`
 }
 
 type PartitionMapping struct {
@@ -2,6 +2,8 @@ package grpc_client
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"math"
 	"net/url"
 	"strings"
@@ -12,12 +14,14 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/rpc/interceptors"
 	"github.com/buildbuddy-io/buildbuddy/server/util/canary"
+	"github.com/buildbuddy-io/buildbuddy/server/util/certreloader"
 	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/google"
 	"google.golang.org/grpc/experimental"
 	"google.golang.org/grpc/keepalive"
@@ -35,8 +39,26 @@ const (
 
 var (
 	poolSize = flag.Int("grpc_client.pool_size", 10, "Number of connections to create to each target.")
+
+	tlsCertFile = flag.String("grpc_client.tls.cert_file", "", "Path to a PEM encoded client certificate to present to grpcs:// targets for mTLS, e.g. an X.509 SVID written by the SPIRE spiffe-helper. The certificate is reloaded when the file changes.")
+	tlsKeyFile  = flag.String("grpc_client.tls.key_file", "", "Path to the PEM encoded private key of grpc_client.tls.cert_file.")
+	tlsCAFile   = flag.String("grpc_client.tls.ca_file", "", "Path to a PEM encoded CA bundle used to verify grpcs:// targets instead of the system roots. The bundle is reloaded when the file changes.")
+
+	clientCertificateSource atomic.Pointer[ClientCertificateSource]
 )
 
+// ClientCertificateSource returns the client certificate presented to
+// grpcs:// targets.
+type ClientCertificateSource func() (*tls.Certificate, error)
+
+// SetClientCertificateSource sets the source of the client certificate that
+// is presented to grpcs:// targets, in place of grpc_client.tls.cert_file. It
+// must be called before dialing; the source is consulted on every handshake,
+// so the certificate can be rotated.
+func SetClientCertificateSource(source ClientCertificateSource) {
+	clientCertificateSource.Store(&source)
+}
+
 type clientConn struct {
 	*grpc.ClientConn
 	wasEverReady atomic.Bool
@@ -179,7 +201,11 @@ func DialSimpleWithoutPooling(target string, extraOptions ...grpc.DialOption) (*
 			dialOptions = append(dialOptions, grpc.WithPerRPCCredentials(newRPCCredentials(u.User.String())))
 		}
 		if u.Scheme == "grpcs" {
-			dialOptions = append(dialOptions, grpc.WithTransportCredentials(google.NewDefaultCredentials().TransportCredentials()))
+			creds, err := transportCredentials()
+			if err != nil {
+				return nil, err
+			}
+			dialOptions = append(dialOptions, grpc.WithTransportCredentials(creds))
 		} else {
 			dialOptions = append(dialOptions, grpc.WithInsecure())
 		}
@@ -219,6 +245,76 @@ func DialInternalWithoutPooling(env environment.Env, target string, extraOptions
 	return DialSimpleWithoutPooling(target, opts...)
 }
 
+// tlsFiles are the files configured with the grpc_client.tls flags.
+type tlsFiles struct {
+	keyPair *certreloader.KeyPair
+	caPool  *certreloader.CertPool
+}
+
+var loadTLSFiles = sync.OnceValues(func() (*tlsFiles, error) {
+	f := &tlsFiles{}
+	var err error
+	if *tlsCertFile != "" || *tlsKeyFile != "" {
+		f.keyPair, err = certreloader.NewKeyPair(*tlsCertFile, *tlsKeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if *tlsCAFile != "" {
+		f.caPool, err = certreloader.NewCertPool(*tlsCAFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+})
+
+// transportCredentials returns the credentials for grpcs:// targets.
+func transportCredentials() (credentials.TransportCredentials, error) {
+	files, err := loadTLSFiles()
+	if err != nil {
+		return nil, err
+	}
+	keyPair, caPool := files.keyPair, files.caPool
+	if keyPair == nil && caPool == nil && clientCertificateSource.Load() == nil {
+		return google.NewDefaultCredentials().TransportCredentials(), nil
+	}
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(req *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if source := clientCertificateSource.Load(); source != nil {
+				return (*source)()
+			}
+			if keyPair != nil {
+				return keyPair.Certificate(), nil
+			}
+			// Don't present a certificate.
+			return &tls.Certificate{}, nil
+		},
+	}
+	if caPool != nil {
+		// RootCAs can't change after the config is created, so verify the
+		// server against the current bundle ourselves.
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return status.UnauthenticatedError("server did not present a certificate")
+			}
+			intermediates := x509.NewCertPool()
+			for _, c := range cs.PeerCertificates[1:] {
+				intermediates.AddCert(c)
+			}
+			_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+				Roots:         caPool.Pool(),
+				Intermediates: intermediates,
+				DNSName:       cs.ServerName,
+			})
+			return err
+		}
+	}
+	return credentials.NewTLS(config), nil
+}
+
 func normalizeTarget(target string) string {
 	if strings.Contains(target, "://") {
 		return target
@@ -2,6 +2,7 @@ package monitoring
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/pprof"
 
@@ -21,13 +22,46 @@ import (
 var (
 	basicAuthUser = flag.String("monitoring.basic_auth.username", "", "Optional username for basic auth on the monitoring port.")
 	basicAuthPass = flag.String("monitoring.basic_auth.password", "", "Optional password for basic auth on the monitoring port.", flag.Secret)
+
+	// Handlers that change the state of the server, registered with
+	// HandleAdmin.
+	adminHandlers = map[string]http.Handler{}
 )
 
+// HandleAdmin registers a handler that changes the state of the server (e.g.
+// draining it) on the monitoring port. It must be called before the
+// monitoring handlers are started.
+//
+// Admin handlers require the monitoring basic auth credentials. If none are
+// configured, they only accept requests from loopback addresses.
+func HandleAdmin(pattern string, handler http.Handler) {
+	adminHandlers[pattern] = handler
+}
+
+func basicAuthEnabled() bool {
+	return *basicAuthUser != "" || *basicAuthPass != ""
+}
+
+// loopbackOnly rejects requests that don't come from a loopback address.
+func loopbackOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			http.Error(w, "Forbidden: configure monitoring.basic_auth to allow remote requests", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // Registers monitoring handlers on the provided mux. Note that using
 // StartMonitoringHandler on a monitoring-only port is preferred.
 func RegisterMonitoringHandlers(env environment.Env, mux *http.ServeMux) {
 	handle := mux.Handle
-	if *basicAuthUser != "" || *basicAuthPass != "" {
+	if basicAuthEnabled() {
 		auth := basicauth.Middleware(basicauth.DefaultRealm, map[string]string{*basicAuthUser: *basicAuthPass})
 		handle = func(pattern string, handler http.Handler) {
 			mux.Handle(pattern, auth(handler))
@@ -55,6 +89,13 @@ func RegisterMonitoringHandlers(env environment.Env, mux *http.ServeMux) {
 	// Redirect "/channelz" to "/channelz/" (so the trailing slash is
 	// optional)
 	handle("/channelz", http.RedirectHandler("/channelz/", http.StatusFound))
+
+	for pattern, handler := range adminHandlers {
+		if !basicAuthEnabled() {
+			handler = loopbackOnly(handler)
+		}
+		handle(pattern, handler)
+	}
 }
 
 // StartMonitoringHandler enables the prometheus and pprof monitoring handlers
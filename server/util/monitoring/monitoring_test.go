@@ -0,0 +1,60 @@
+package monitoring_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/monitoring"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminHandlers(t *testing.T) {
+	var calls int
+	monitoring.HandleAdmin("/test-admin", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+
+	for _, tc := range []struct {
+		name           string
+		basicAuth      bool
+		remoteAddr     string
+		user, pass     string
+		expectedStatus int
+	}{
+		{name: "NoAuthConfigured_Loopback", remoteAddr: "127.0.0.1:1234", expectedStatus: http.StatusOK},
+		{name: "NoAuthConfigured_LoopbackIPv6", remoteAddr: "[::1]:1234", expectedStatus: http.StatusOK},
+		{name: "NoAuthConfigured_Remote", remoteAddr: "10.0.0.1:1234", expectedStatus: http.StatusForbidden},
+		{name: "Unauthenticated", basicAuth: true, remoteAddr: "10.0.0.1:1234", expectedStatus: http.StatusUnauthorized},
+		{name: "Unauthenticated_Loopback", basicAuth: true, remoteAddr: "127.0.0.1:1234", expectedStatus: http.StatusUnauthorized},
+		{name: "WrongPassword", basicAuth: true, remoteAddr: "10.0.0.1:1234", user: "admin", pass: "wrong", expectedStatus: http.StatusUnauthorized},
+		{name: "Authenticated", basicAuth: true, remoteAddr: "10.0.0.1:1234", user: "admin", pass: "secret", expectedStatus: http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.basicAuth {
+				flags.Set(t, "monitoring.basic_auth.username", "admin")
+				flags.Set(t, "monitoring.basic_auth.password", "secret")
+			}
+			mux := http.NewServeMux()
+			monitoring.RegisterMonitoringHandlers(real_environment.NewBatchEnv(), mux)
+			calls = 0
+
+			req := httptest.NewRequest(http.MethodPost, "/test-admin", nil)
+			req.RemoteAddr = tc.remoteAddr
+			if tc.user != "" {
+				req.SetBasicAuth(tc.user, tc.pass)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			require.Equal(t, tc.expectedStatus, rec.Code)
+			if tc.expectedStatus == http.StatusOK {
+				require.Equal(t, 1, calls)
+			} else {
+				require.Equal(t, 0, calls)
+			}
+		})
+	}
+}
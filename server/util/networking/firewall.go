@@ -0,0 +1,402 @@
+package networking
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+var firewallBackend = flag.String("executor.firewall_backend", iptablesBackend, "How firewall and NAT rules are managed: 'iptables', or 'nftables' to manage rules natively using nft, which doesn't require the iptables-legacy shim on distros that use nftables by default. Note that with nftables, rules that accept traffic can't override rules that drop traffic in other tables, such as a host's default-deny policy.")
+
+const (
+	iptablesBackend = "iptables"
+	nftablesBackend = "nftables"
+
+	// Name of the nftables table that holds the rules managed by the
+	// executor. It has the inet family so that it applies to both IPv4 and
+	// IPv6 traffic.
+	nftTable = "bb_executor"
+)
+
+// Rule verdicts.
+const (
+	acceptVerdict = "accept"
+	dropVerdict   = "drop"
+	rejectVerdict = "reject"
+)
+
+// filterRule is a rule in the forward chain, which matches packets routed
+// through the host. Empty fields match any packet.
+type filterRule struct {
+	// Whether the rule matches IPv6 packets rather than IPv4 packets.
+	ipv6 bool
+
+	inDevice  string
+	outDevice string
+	src       string
+	dst       string
+
+	// Comment identifying the rule, so that its packet counter can be looked
+	// up. Optional.
+	comment string
+
+	verdict string
+}
+
+// masqueradeRule is a rule in the postrouting NAT chain that rewrites the
+// source address of packets leaving through a device to the address of the
+// device.
+type masqueradeRule struct {
+	ipv6      bool
+	outDevice string
+	// Protocol to match, "tcp" or "udp". If empty, all protocols match.
+	protocol string
+	// Source port range to use for translated packets, e.g. "1024-65535".
+	// Only applicable if protocol is set.
+	portRange string
+}
+
+// vmNATRules are the rules in a VM's network namespace that translate the VM's
+// address to the address of the namespaced end of the veth pair.
+type vmNATRules struct {
+	vethDevice   string
+	vmIP         string
+	namespacedIP string
+}
+
+// firewall manages packet filtering and NAT rules.
+type firewall interface {
+	// AppendFilterRule appends a rule to the end of the host's forward chain.
+	// It returns a function which deletes the rule.
+	AppendFilterRule(ctx context.Context, r *filterRule) (remove func(ctx context.Context) error, err error)
+
+	// InsertFilterRule inserts a rule at the start of the host's forward
+	// chain.
+	InsertFilterRule(ctx context.Context, r *filterRule) error
+
+	// FilterRulePackets returns the number of packets matched by the rules in
+	// the host's forward chain with the given comment. If ipv6 is true, both
+	// IPv4 and IPv6 rules are counted, otherwise only IPv4 rules are counted.
+	FilterRulePackets(ctx context.Context, comment string, ipv6 bool) (int64, error)
+
+	// EnsureMasqueradeRule adds a masquerade rule to the host, if it was not
+	// already added.
+	EnsureMasqueradeRule(ctx context.Context, r *masqueradeRule) error
+
+	// AddVMNATRules adds NAT rules to the given network namespace. The rules
+	// are deleted along with the namespace.
+	AddVMNATRules(ctx context.Context, netns *Namespace, r *vmNATRules) error
+}
+
+// getFirewall returns the firewall for the configured backend.
+func getFirewall() firewall {
+	if *firewallBackend == nftablesBackend {
+		return defaultNftables
+	}
+	return iptables{}
+}
+
+// iptables manages rules using iptables and ip6tables.
+type iptables struct{}
+
+func (iptables) tool(ipv6 bool) string {
+	if ipv6 {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+func (iptables) filterRuleArgs(r *filterRule) []string {
+	args := []string{"FORWARD"}
+	if r.inDevice != "" {
+		args = append(args, "-i", r.inDevice)
+	}
+	if r.outDevice != "" {
+		args = append(args, "-o", r.outDevice)
+	}
+	if r.src != "" {
+		args = append(args, "-s", r.src)
+	}
+	if r.dst != "" {
+		args = append(args, "-d", r.dst)
+	}
+	if r.comment != "" {
+		args = append(args, "-m", "comment", "--comment", r.comment)
+	}
+	return append(args, "-j", strings.ToUpper(r.verdict))
+}
+
+func (t iptables) AppendFilterRule(ctx context.Context, r *filterRule) (func(ctx context.Context) error, error) {
+	args := t.filterRuleArgs(r)
+	if err := runCommand(ctx, slices.Concat([]string{t.tool(r.ipv6), "--wait", "-A"}, args)...); err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context) error {
+		return runCommand(ctx, slices.Concat([]string{t.tool(r.ipv6), "--wait", "--delete"}, args)...)
+	}, nil
+}
+
+func (t iptables) InsertFilterRule(ctx context.Context, r *filterRule) error {
+	return runCommand(ctx, slices.Concat([]string{t.tool(r.ipv6), "--wait", "-I"}, t.filterRuleArgs(r))...)
+}
+
+func (t iptables) FilterRulePackets(ctx context.Context, comment string, ipv6 bool) (int64, error) {
+	tools := []string{t.tool(false)}
+	if ipv6 {
+		tools = append(tools, t.tool(true))
+	}
+	var total int64
+	for _, tool := range tools {
+		out, err := sudoCommand(ctx, tool, "--wait", "--list", "FORWARD", "--numeric", "--verbose", "--exact")
+		if err != nil {
+			return 0, err
+		}
+		n, err := parseRulePacketCount(string(out), comment)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+func (t iptables) EnsureMasqueradeRule(ctx context.Context, r *masqueradeRule) error {
+	args := []string{"POSTROUTING", "-o", r.outDevice, "-j", "MASQUERADE"}
+	if r.protocol != "" {
+		args = append(args, "-p", r.protocol)
+		if r.portRange != "" {
+			args = append(args, "--to-ports", r.portRange)
+		}
+	}
+	// Skip appending the rule if it's already in the table.
+	if err := runCommand(ctx, slices.Concat([]string{t.tool(r.ipv6), "--wait", "-t", "nat", "--check"}, args)...); err == nil {
+		return nil
+	}
+	return runCommand(ctx, slices.Concat([]string{t.tool(r.ipv6), "--wait", "-t", "nat", "-A"}, args)...)
+}
+
+func (iptables) AddVMNATRules(ctx context.Context, netns *Namespace, r *vmNATRules) error {
+	for _, command := range [][]string{
+		{"iptables", "--wait", "-t", "nat", "-A", "POSTROUTING", "-o", r.vethDevice, "-s", r.vmIP, "-j", "SNAT", "--to", r.namespacedIP},
+		{"iptables", "--wait", "-t", "nat", "-A", "PREROUTING", "-i", r.vethDevice, "-d", r.namespacedIP, "-j", "DNAT", "--to", r.vmIP},
+	} {
+		if err := runCommand(ctx, namespace(netns, command...)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseRulePacketCount returns the packet counter of the rule with the given
+// comment, from the output of `iptables --list --verbose --exact`.
+func parseRulePacketCount(iptablesOutput, comment string) (int64, error) {
+	for _, line := range strings.Split(iptablesOutput, "\n") {
+		if !strings.Contains(line, "/* "+comment+" */") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		n, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return 0, status.InternalErrorf("parse packet count of iptables rule %q: %s", comment, err)
+		}
+		return n, nil
+	}
+	return 0, status.NotFoundErrorf("iptables rule %q not found", comment)
+}
+
+var defaultNftables = &nftables{}
+
+// nftables manages rules using nft, in a table that is owned by the executor.
+type nftables struct {
+	mu sync.Mutex // PROTECTS(initialized)
+	// Whether the host table and chains have been created.
+	initialized bool
+}
+
+// chainArgs returns the nft arguments that create the table and base chains
+// used by the executor. Creating a table or chain that already exists has no
+// effect.
+func (*nftables) chainArgs() [][]string {
+	return [][]string{
+		{"add", "table", "inet", nftTable},
+		{"add", "chain", "inet", nftTable, "forward", "{", "type", "filter", "hook", "forward", "priority", "filter", ";", "policy", "accept", ";", "}"},
+		{"add", "chain", "inet", nftTable, "prerouting", "{", "type", "nat", "hook", "prerouting", "priority", "dstnat", ";", "}"},
+		{"add", "chain", "inet", nftTable, "postrouting", "{", "type", "nat", "hook", "postrouting", "priority", "srcnat", ";", "}"},
+	}
+}
+
+// init creates the host table and chains, if they haven't been created yet.
+func (f *nftables) init(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.initialized {
+		return nil
+	}
+	for _, args := range f.chainArgs() {
+		if err := runCommand(ctx, append([]string{"nft"}, args...)...); err != nil {
+			return status.WrapError(err, "create nftables chain")
+		}
+	}
+	f.initialized = true
+	return nil
+}
+
+// nftFamily returns the nft address family and the corresponding protocol
+// family, which is matched in the inet table to restrict a rule to IPv4 or
+// IPv6 packets.
+func nftFamily(ipv6 bool) (addrFamily, nfproto string) {
+	if ipv6 {
+		return "ip6", "ipv6"
+	}
+	return "ip", "ipv4"
+}
+
+func (*nftables) filterRuleExpr(r *filterRule) []string {
+	family, nfproto := nftFamily(r.ipv6)
+	expr := []string{"meta", "nfproto", nfproto}
+	if r.inDevice != "" {
+		expr = append(expr, "iifname", strconv.Quote(r.inDevice))
+	}
+	if r.outDevice != "" {
+		expr = append(expr, "oifname", strconv.Quote(r.outDevice))
+	}
+	if r.src != "" {
+		expr = append(expr, family, "saddr", r.src)
+	}
+	if r.dst != "" {
+		expr = append(expr, family, "daddr", r.dst)
+	}
+	// Count packets matched by the rule, so that FilterRulePackets works.
+	expr = append(expr, "counter", r.verdict)
+	if r.comment != "" {
+		expr = append(expr, "comment", strconv.Quote(r.comment))
+	}
+	return expr
+}
+
+func (f *nftables) AppendFilterRule(ctx context.Context, r *filterRule) (func(ctx context.Context) error, error) {
+	if err := f.init(ctx); err != nil {
+		return nil, err
+	}
+	out, err := sudoCommand(ctx, slices.Concat([]string{"nft", "--echo", "--handle", "add", "rule", "inet", nftTable, "forward"}, f.filterRuleExpr(r))...)
+	if err != nil {
+		return nil, err
+	}
+	handle, err := parseNftRuleHandle(string(out))
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context) error {
+		return runCommand(ctx, "nft", "delete", "rule", "inet", nftTable, "forward", "handle", handle)
+	}, nil
+}
+
+func (f *nftables) InsertFilterRule(ctx context.Context, r *filterRule) error {
+	if err := f.init(ctx); err != nil {
+		return err
+	}
+	return runCommand(ctx, slices.Concat([]string{"nft", "insert", "rule", "inet", nftTable, "forward"}, f.filterRuleExpr(r))...)
+}
+
+func (f *nftables) FilterRulePackets(ctx context.Context, comment string, ipv6 bool) (int64, error) {
+	if err := f.init(ctx); err != nil {
+		return 0, err
+	}
+	out, err := sudoCommand(ctx, "nft", "list", "chain", "inet", nftTable, "forward")
+	if err != nil {
+		return 0, err
+	}
+	// IPv4 and IPv6 rules are in the same chain, and IPv6 rules are only
+	// added when IPv6 is enabled.
+	return parseNftRulePacketCount(string(out), comment)
+}
+
+func (f *nftables) EnsureMasqueradeRule(ctx context.Context, r *masqueradeRule) error {
+	if err := f.init(ctx); err != nil {
+		return err
+	}
+	// Rules can't be looked up by their contents, so identify the rule by a
+	// comment derived from its fields.
+	_, nfproto := nftFamily(r.ipv6)
+	comment := fmt.Sprintf("bb-executor-masquerade-%s-%s-%s-%s", nfproto, r.outDevice, r.protocol, r.portRange)
+	out, err := sudoCommand(ctx, "nft", "list", "chain", "inet", nftTable, "postrouting")
+	if err != nil {
+		return err
+	}
+	if strings.Contains(string(out), strconv.Quote(comment)) {
+		return nil
+	}
+	expr := []string{"meta", "nfproto", nfproto, "oifname", strconv.Quote(r.outDevice)}
+	if r.protocol != "" {
+		expr = append(expr, "meta", "l4proto", r.protocol)
+	}
+	expr = append(expr, "masquerade")
+	if r.protocol != "" && r.portRange != "" {
+		expr = append(expr, "to", ":"+r.portRange)
+	}
+	expr = append(expr, "comment", strconv.Quote(comment))
+	return runCommand(ctx, slices.Concat([]string{"nft", "add", "rule", "inet", nftTable, "postrouting"}, expr)...)
+}
+
+func (f *nftables) AddVMNATRules(ctx context.Context, netns *Namespace, r *vmNATRules) error {
+	commands := f.chainArgs()
+	commands = append(commands,
+		[]string{"add", "rule", "inet", nftTable, "postrouting", "oifname", strconv.Quote(r.vethDevice), "ip", "saddr", r.vmIP, "snat", "ip", "to", r.namespacedIP},
+		[]string{"add", "rule", "inet", nftTable, "prerouting", "iifname", strconv.Quote(r.vethDevice), "ip", "daddr", r.namespacedIP, "dnat", "ip", "to", r.vmIP},
+	)
+	for _, args := range commands {
+		if err := runCommand(ctx, namespace(netns, append([]string{"nft"}, args...)...)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseNftRuleHandle returns the handle of the rule echoed by
+// `nft --echo --handle add rule`, which ends with a "# handle N" comment.
+func parseNftRuleHandle(nftOutput string) (string, error) {
+	_, handle, ok := strings.Cut(nftOutput, "# handle ")
+	if ok {
+		handle = strings.TrimSpace(handle)
+		if _, err := strconv.ParseUint(handle, 10, 64); err == nil {
+			return handle, nil
+		}
+	}
+	return "", status.InternalErrorf("could not find handle of added nftables rule in output %q", nftOutput)
+}
+
+// parseNftRulePacketCount returns the sum of the packet counters of the rules
+// with the given comment, from the output of `nft list chain`.
+func parseNftRulePacketCount(nftOutput, comment string) (int64, error) {
+	found := false
+	var total int64
+	for _, line := range strings.Split(nftOutput, "\n") {
+		if !strings.Contains(line, "comment "+strconv.Quote(comment)) {
+			continue
+		}
+		fields := strings.Fields(line)
+		i := slices.Index(fields, "packets")
+		if i < 0 || i+1 >= len(fields) {
+			continue
+		}
+		n, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil {
+			return 0, status.InternalErrorf("parse packet count of nftables rule %q: %s", comment, err)
+		}
+		found = true
+		total += n
+	}
+	if !found {
+		return 0, status.NotFoundErrorf("nftables rule %q not found", comment)
+	}
+	return total, nil
+}
@@ -3,7 +3,6 @@ package networking
 import (
 	"bufio"
 	"context"
-	"flag"
 	"fmt"
 	"net"
 	"os"
@@ -18,6 +17,7 @@ import (
 
 	"github.com/buildbuddy-io/buildbuddy/server/util/alert"
 	"github.com/buildbuddy-io/buildbuddy/server/util/background"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/random"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
@@ -33,9 +33,20 @@ var (
 	preserveExistingNetNamespaces = flag.Bool("executor.preserve_existing_netns", false, "Preserve existing bb-executor net namespaces. By default all \"bb-executor\" net namespaces are removed on executor startup, but if multiple executors are running on the same machine this behavior should be disabled to prevent them interfering with each other.")
 	natSourcePortRange            = flag.String("executor.nat_source_port_range", "", "If set, restrict the source ports for NATed traffic to this range. ")
 	networkLockDir                = flag.String("executor.network_lock_directory", "", "If set, use this directory to store lockfiles for allocated IP ranges. This is required if running multiple executors within the same networking environment.")
+	enableIPv6                    = flag.Bool("executor.enable_ipv6", false, "If true, container networks are dual-stack: each network is also assigned a unique local IPv6 range, and IPv6 traffic is NATed using ip6tables. Requires IPv6 forwarding to be enabled on the host. With executor.blackhole_private_ranges, private IPv6 ranges are blackholed as well. Not supported with executor.route_prefix.")
+	internalNetworkExtraRanges    = flag.Slice("executor.internal_network_extra_ranges", []string{}, "Additional IP ranges (in CIDR notation) that actions using the internal-only network policy can reach. Link-local ranges, which may expose cloud metadata servers, are only reachable if listed here.")
 
 	// Private IP ranges, as defined in RFC1918.
 	PrivateIPRanges = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16"}
+
+	// Private IPv6 ranges: unique local addresses, as defined in RFC4193, and
+	// link-local addresses.
+	PrivateIPv6Ranges = []string{"fc00::/7", "fe80::/10"}
+
+	// Link-local ranges. These are included in the private ranges above, but
+	// aren't reachable from internal-only networks by default, since they
+	// usually expose cloud metadata servers.
+	linkLocalRanges = []string{"169.254.0.0/16", "fe80::/10"}
 )
 
 const (
@@ -60,6 +71,34 @@ const (
 
 	// CIDR matching all container networks on the host.
 	containerNetworkingCIDR = "192.168.0.0/16"
+
+	// Unique local IPv6 prefix (see RFC4193) from which IPv6 container networks
+	// are assigned. Each network gets a /64 subnet, with the subnet ID set to
+	// the network index.
+	containerNetworkingIPv6Prefix = "fd8b:5ba1:7a36"
+	ipv6CIDRSuffix                = "/64"
+
+	// CIDR matching all IPv6 container networks on the host.
+	containerNetworkingIPv6CIDR = containerNetworkingIPv6Prefix + "::/48"
+
+	// Prefix of the iptables comment on the rule that rejects traffic from
+	// an internal-only network to public addresses. The host veth device name
+	// is appended, so that the rule's packet counter can be looked up.
+	rejectRuleCommentPrefix = "bb-executor-reject-"
+)
+
+// NetworkPolicy controls which addresses a container network can reach.
+type NetworkPolicy int
+
+const (
+	// FullNetwork allows traffic to any address.
+	FullNetwork NetworkPolicy = iota
+	// InternalNetwork only allows traffic to private IP ranges, such as
+	// services on the executor's internal network. Traffic to other addresses
+	// is rejected, and counted.
+	InternalNetwork
+	// NoNetwork only provides a loopback interface.
+	NoNetwork
 )
 
 var (
@@ -219,6 +258,17 @@ func attachAddressToVeth(ctx context.Context, netns *Namespace, ipAddr, vethName
 	}
 }
 
+// attachIPv6AddressToVeth attaches an IPv6 address to the given veth device.
+// Duplicate address detection is disabled, since the address is unique to the
+// veth pair and would otherwise not be usable until detection completes.
+func attachIPv6AddressToVeth(ctx context.Context, netns *Namespace, ipAddr, vethName string) error {
+	args := []string{"ip", "-6", "addr", "add", ipAddr, "dev", vethName, "nodad"}
+	if netns != nil {
+		args = namespace(netns, args...)
+	}
+	return runCommand(ctx, args...)
+}
+
 // ContainerNetworkPool holds a pool of container networks that can be reused
 // across container instances. This pooling helps to reduce the performance
 // overhead associated with rapidly creating and destroying networks along with
@@ -287,6 +337,12 @@ func (p *ContainerNetworkPool) Get(ctx context.Context) (n *ContainerNetwork) {
 		log.CtxErrorf(ctx, "Failed to set up default route in namespace: %s", err)
 		return nil
 	}
+	if n.vethPair.ipv6 {
+		if err := n.vethPair.attachIPv6Addrs(ctx); err != nil {
+			log.CtxErrorf(ctx, "Failed to set up IPv6 addresses for pooled network: %s", err)
+			return nil
+		}
+	}
 
 	return n
 }
@@ -393,6 +449,22 @@ func (n *HostNet) NamespacedIPWithCIDR() string {
 	return n.NamespacedIP() + cidrSuffix
 }
 
+func (n *HostNet) HostIPv6() string {
+	return fmt.Sprintf("%s:%x::1", containerNetworkingIPv6Prefix, n.netIdx)
+}
+
+func (n *HostNet) HostIPv6WithCIDR() string {
+	return n.HostIPv6() + ipv6CIDRSuffix
+}
+
+func (n *HostNet) NamespacedIPv6() string {
+	return fmt.Sprintf("%s:%x::2", containerNetworkingIPv6Prefix, n.netIdx)
+}
+
+func (n *HostNet) NamespacedIPv6WithCIDR() string {
+	return n.NamespacedIPv6() + ipv6CIDRSuffix
+}
+
 func (n *HostNet) Unlock() {
 	if n.unlock == nil {
 		alert.UnexpectedEvent("ip_range_double_unlock", "Attempted to unlock an assigned IP range more than once.")
@@ -496,17 +568,27 @@ type vethPair struct {
 	// Network information for the veth pair.
 	network *HostNet
 
+	// Whether the veth pair is also assigned IPv6 addresses.
+	ipv6 bool
+
+	// Comment on the iptables rule that rejects traffic to public addresses,
+	// if the namespace may only reach private IP ranges.
+	rejectRuleComment string
+
 	// Cleanup deletes the veth pair and associated host IP configuration
 	// changes.
 	Cleanup func(ctx context.Context) error
 }
 
 // setupVethPair creates a new veth pair with one end in the given network
-// namespace and the other end in the root namespace.
+// namespace and the other end in the root namespace. If internalOnly is true,
+// traffic from the namespace is only forwarded to private IP ranges. If ipv6
+// is true, the veth pair is also assigned IPv6 addresses, and IPv6 traffic is
+// forwarded with the same restrictions.
 //
 // The Cleanup method must be called on the returned struct to clean up all
 // resources associated with it.
-func setupVethPair(ctx context.Context, netns *Namespace) (_ *vethPair, err error) {
+func setupVethPair(ctx context.Context, netns *Namespace, internalOnly, ipv6 bool) (_ *vethPair, err error) {
 	// Keep a list of cleanup work to be done.
 	var cleanupStack cleanupStack
 	// If we return an error from this func then we need to clean up any
@@ -523,7 +605,7 @@ func setupVethPair(ctx context.Context, netns *Namespace) (_ *vethPair, err erro
 	}
 	device := r.device
 
-	vp := &vethPair{netns: netns}
+	vp := &vethPair{netns: netns, ipv6: ipv6}
 
 	// Reserve an IP range for the veth pair.
 	vp.network, err = hostNetAllocator.Get()
@@ -577,6 +659,11 @@ func setupVethPair(ctx context.Context, netns *Namespace) (_ *vethPair, err erro
 	if err != nil {
 		return nil, status.WrapError(err, "add default route in namespace")
 	}
+	if ipv6 {
+		if err := vp.attachIPv6Addrs(ctx); err != nil {
+			return nil, status.WrapError(err, "set up IPv6 addresses")
+		}
+	}
 
 	if IsSecondaryNetworkEnabled() {
 		err = runCommand(ctx, "ip", "rule", "add", "from", vp.network.NamespacedIP(), "lookup", routingTableName)
@@ -588,32 +675,108 @@ func setupVethPair(ctx context.Context, netns *Namespace) (_ *vethPair, err erro
 		})
 	}
 
-	iptablesRules := [][]string{
-		// Allow forwarding traffic between the host side of the veth pair and
-		// the device associated with the configured route prefix (usually the
-		// default route). This is necessary on hosts with default-deny policies
-		// in place.
-		{"FORWARD", "-i", vp.hostDevice, "-o", device, "-j", "ACCEPT"},
-		{"FORWARD", "-i", device, "-o", vp.hostDevice, "-j", "ACCEPT"},
-
-		// Drop any traffic from the namespace that is targeting another
-		// namespace.
-		{"FORWARD", "-i", vp.hostDevice, "-d", containerNetworkingCIDR, "-j", "DROP"},
+	// Allow forwarding traffic between the host side of the veth pair and
+	// the device associated with the configured route prefix (usually the
+	// default route). This is necessary on hosts with default-deny policies
+	// in place.
+	if internalOnly {
+		vp.rejectRuleComment = rejectRuleCommentPrefix + vp.hostDevice
 	}
-
-	for _, rule := range iptablesRules {
-		if err := runCommand(ctx, append([]string{"iptables", "--wait", "-A"}, rule...)...); err != nil {
+	rules := vp.forwardingRules(device, false /*=ipv6*/, internalOnly)
+	if ipv6 {
+		rules = append(rules, vp.forwardingRules(device, true /*=ipv6*/, internalOnly)...)
+	}
+	fw := getFirewall()
+	for _, rule := range rules {
+		remove, err := fw.AppendFilterRule(ctx, rule)
+		if err != nil {
 			return nil, err
 		}
-		cleanupStack = append(cleanupStack, func(ctx context.Context) error {
-			return runCommand(ctx, append([]string{"iptables", "--wait", "--delete"}, rule...)...)
-		})
+		cleanupStack = append(cleanupStack, remove)
 	}
 
 	vp.Cleanup = cleanupStack.Cleanup
 	return vp, nil
 }
 
+// forwardingRules returns the IPv4 (or IPv6, if ipv6 is true) forwarding
+// rules for the veth pair, given the device associated with the configured
+// route prefix.
+func (v *vethPair) forwardingRules(device string, ipv6, internalOnly bool) []*filterRule {
+	containerCIDR := containerNetworkingCIDR
+	if ipv6 {
+		containerCIDR = containerNetworkingIPv6CIDR
+	}
+	rules := []*filterRule{
+		{ipv6: ipv6, inDevice: v.hostDevice, outDevice: device, verdict: acceptVerdict},
+	}
+	if internalOnly {
+		rules = nil
+		for _, r := range internalNetworkRanges(ipv6) {
+			rules = append(rules, &filterRule{ipv6: ipv6, inDevice: v.hostDevice, outDevice: device, dst: r, verdict: acceptVerdict})
+		}
+	}
+	rules = append(rules,
+		&filterRule{ipv6: ipv6, inDevice: device, outDevice: v.hostDevice, verdict: acceptVerdict},
+
+		// Drop any traffic from the namespace that is targeting another
+		// namespace.
+		&filterRule{ipv6: ipv6, inDevice: v.hostDevice, dst: containerCIDR, verdict: dropVerdict},
+	)
+	if internalOnly {
+		// Reject everything else, so that the action fails fast instead of
+		// timing out.
+		rules = append(rules, &filterRule{ipv6: ipv6, inDevice: v.hostDevice, comment: v.rejectRuleComment, verdict: rejectVerdict})
+	}
+	return rules
+}
+
+// internalNetworkRanges returns the IPv4 (or IPv6, if ipv6 is true) ranges
+// that internal-only networks can reach: the private ranges, except for the
+// container network and link-local ranges, plus any extra ranges configured
+// by flag.
+func internalNetworkRanges(ipv6 bool) []string {
+	privateRanges, containerCIDR := PrivateIPRanges, containerNetworkingCIDR
+	if ipv6 {
+		privateRanges, containerCIDR = PrivateIPv6Ranges, containerNetworkingIPv6CIDR
+	}
+	var ranges []string
+	for _, r := range privateRanges {
+		if r == containerCIDR || slices.Contains(linkLocalRanges, r) {
+			continue
+		}
+		ranges = append(ranges, r)
+	}
+	for _, r := range *internalNetworkExtraRanges {
+		ip, _, err := net.ParseCIDR(r)
+		if err != nil {
+			log.Warningf("Ignoring invalid internal network range %q: %s", r, err)
+			continue
+		}
+		if (ip.To4() == nil) == ipv6 && !slices.Contains(ranges, r) {
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges
+}
+
+// attachIPv6Addrs assigns IPv6 addresses to the host and namespaced ends of
+// the veth pair, and routes IPv6 traffic via the host end by default.
+func (v *vethPair) attachIPv6Addrs(ctx context.Context) error {
+	if err := attachIPv6AddressToVeth(ctx, v.netns, v.network.NamespacedIPv6WithCIDR(), v.namespacedDevice); err != nil {
+		return status.WrapError(err, "attach IPv6 address to veth device in namespace")
+	}
+	if err := attachIPv6AddressToVeth(ctx, nil /*=namespace*/, v.network.HostIPv6WithCIDR(), v.hostDevice); err != nil {
+		return status.WrapError(err, "attach IPv6 address to host veth device")
+	}
+	// Use "replace" since a pooled network may still have the default route
+	// from when it was last taken from the pool.
+	if err := runCommand(ctx, namespace(v.netns, "ip", "-6", "route", "replace", "default", "via", v.network.HostIPv6())...); err != nil {
+		return status.WrapError(err, "add default IPv6 route in namespace")
+	}
+	return nil
+}
+
 // RemoveAddrs unassigns the IP addresses from the host and veth side of the
 // VethPair, and unlocks the associated host IP range.
 func (v *vethPair) RemoveAddrs(ctx context.Context) error {
@@ -626,6 +789,16 @@ func (v *vethPair) RemoveAddrs(ctx context.Context) error {
 		log.CtxErrorf(ctx, "Failed to delete IP address %s from %s: %s", v.network.NamespacedIPWithCIDR(), v.namespacedDevice, err)
 		lastErr = err
 	}
+	if v.ipv6 {
+		if err := runCommand(ctx, "ip", "-6", "addr", "del", v.network.HostIPv6WithCIDR(), "dev", v.hostDevice); err != nil {
+			log.CtxErrorf(ctx, "Failed to delete IP address %s from %s: %s", v.network.HostIPv6WithCIDR(), v.hostDevice, err)
+			lastErr = err
+		}
+		if err := runCommand(ctx, namespace(v.netns, "ip", "-6", "addr", "del", v.network.NamespacedIPv6WithCIDR(), "dev", v.namespacedDevice)...); err != nil {
+			log.CtxErrorf(ctx, "Failed to delete IP address %s from %s: %s", v.network.NamespacedIPv6WithCIDR(), v.namespacedDevice, err)
+			lastErr = err
+		}
+	}
 	if lastErr == nil {
 		v.network.Unlock()
 		v.network = nil
@@ -686,7 +859,7 @@ func CreateVMNetwork(ctx context.Context, tapDeviceName, tapAddr, vmIP string) (
 	})
 
 	// Create a veth pair with one end in the namespace.
-	vethPair, err := setupVethPair(ctx, netns)
+	vethPair, err := setupVethPair(ctx, netns, false /*=internalOnly*/, false /*=ipv6*/)
 	if err != nil {
 		return nil, status.WrapError(err, "setup veth pair")
 	}
@@ -707,13 +880,19 @@ func CreateVMNetwork(ctx context.Context, tapDeviceName, tapAddr, vmIP string) (
 		{"ip", "tuntap", "add", "name", tapDeviceName, "mode", "tap"},
 		{"ip", "addr", "add", tapAddr, "dev", tapDeviceName},
 		{"ip", "link", "set", tapDeviceName, "up"},
-		{"iptables", "--wait", "-t", "nat", "-A", "POSTROUTING", "-o", vethPair.namespacedDevice, "-s", vmIP, "-j", "SNAT", "--to", vethPair.network.NamespacedIP()},
-		{"iptables", "--wait", "-t", "nat", "-A", "PREROUTING", "-i", vethPair.namespacedDevice, "-d", vethPair.network.NamespacedIP(), "-j", "DNAT", "--to", vmIP},
 	} {
 		if err := runCommand(ctx, namespace(netns, command...)...); err != nil {
 			return nil, status.WrapError(err, "set up tap device")
 		}
 	}
+	err = getFirewall().AddVMNATRules(ctx, netns, &vmNATRules{
+		vethDevice:   vethPair.namespacedDevice,
+		vmIP:         vmIP,
+		namespacedIP: vethPair.network.NamespacedIP(),
+	})
+	if err != nil {
+		return nil, status.WrapError(err, "set up tap device")
+	}
 
 	return &VMNetwork{
 		netns:    netns,
@@ -745,9 +924,9 @@ type ContainerNetwork struct {
 // CreateContainerNetwork initializes a network namespace, networking
 // interfaces, and host configuration required for container networking.
 //
-// If loopbackOnly is true, only a loopback interface will be created in the
+// If the policy is NoNetwork, only a loopback interface will be created in the
 // namespace, and the container will not be able to reach external addresses.
-func CreateContainerNetwork(ctx context.Context, loopbackOnly bool) (_ *ContainerNetwork, err error) {
+func CreateContainerNetwork(ctx context.Context, policy NetworkPolicy) (_ *ContainerNetwork, err error) {
 	var cleanupStack cleanupStack
 	defer func() {
 		// If we failed to fully set up the network, make sure to clean up any
@@ -772,9 +951,9 @@ func CreateContainerNetwork(ctx context.Context, loopbackOnly bool) (_ *Containe
 	}
 
 	var vethPair *vethPair
-	if !loopbackOnly {
+	if policy != NoNetwork {
 		// Create a veth pair with one end in the namespace.
-		vp, err := setupVethPair(ctx, netns)
+		vp, err := setupVethPair(ctx, netns, policy == InternalNetwork, *enableIPv6)
 		if err != nil {
 			return nil, status.WrapError(err, "setup veth pair")
 		}
@@ -802,6 +981,16 @@ func (c *ContainerNetwork) HostNetwork() *HostNet {
 	return c.vethPair.network
 }
 
+// BlockedPackets returns the number of packets that the network has sent to
+// addresses that its network policy doesn't allow. It's always 0 unless the
+// policy is InternalNetwork.
+func (c *ContainerNetwork) BlockedPackets(ctx context.Context) (int64, error) {
+	if c.vethPair == nil || c.vethPair.rejectRuleComment == "" {
+		return 0, nil
+	}
+	return getFirewall().FilterRulePackets(ctx, c.vethPair.rejectRuleComment, c.vethPair.ipv6)
+}
+
 func (c *ContainerNetwork) Cleanup(ctx context.Context) error {
 	return c.cleanup(ctx)
 }
@@ -899,20 +1088,20 @@ func EnableMasquerading(ctx context.Context) error {
 	}
 	device := route.device
 
-	for _, protocol := range []string{"tcp", "udp", ""} {
-		args := []string{"POSTROUTING", "-o", device, "-j", "MASQUERADE"}
-		if protocol != "" {
-			args = append(args, "-p", protocol)
-			if *natSourcePortRange != "" {
-				args = append(args, "--to-ports", *natSourcePortRange)
+	families := []bool{false /*=ipv6*/}
+	if *enableIPv6 {
+		families = append(families, true /*=ipv6*/)
+	}
+	fw := getFirewall()
+	for _, ipv6 := range families {
+		for _, protocol := range []string{"tcp", "udp", ""} {
+			r := &masqueradeRule{ipv6: ipv6, outDevice: device, protocol: protocol}
+			if protocol != "" {
+				r.portRange = *natSourcePortRange
+			}
+			if err := fw.EnsureMasqueradeRule(ctx, r); err != nil {
+				return err
 			}
-		}
-		// Skip appending the rule if it's already in the table.
-		if err = runCommand(ctx, slices.Concat([]string{"iptables", "--wait", "-t", "nat", "--check"}, args)...); err == nil {
-			continue
-		}
-		if err := runCommand(ctx, slices.Concat([]string{"iptables", "--wait", "-t", "nat", "-A"}, args)...); err != nil {
-			return err
 		}
 	}
 	return nil
@@ -960,9 +1149,21 @@ func routingTableContainsTable(tableEntry string) (bool, error) {
 	return false, nil
 }
 
+// ConfigurePrivateRangeBlackholing rejects traffic from the given source range
+// to private IP ranges. If the source range is an IPv6 range, traffic to
+// private IPv6 ranges is rejected instead.
 func ConfigurePrivateRangeBlackholing(ctx context.Context, sourceRange string) error {
-	for _, r := range PrivateIPRanges {
-		if err := runCommand(ctx, "iptables", "--wait", "-I", "FORWARD", "-s", sourceRange, "-d", r, "-j", "REJECT"); err != nil {
+	ip, _, err := net.ParseCIDR(sourceRange)
+	if err != nil {
+		return status.InvalidArgumentErrorf("invalid source range %q: %s", sourceRange, err)
+	}
+	ipv6 := ip.To4() == nil
+	privateRanges := PrivateIPRanges
+	if ipv6 {
+		privateRanges = PrivateIPv6Ranges
+	}
+	for _, r := range privateRanges {
+		if err := getFirewall().InsertFilterRule(ctx, &filterRule{ipv6: ipv6, src: sourceRange, dst: r, verdict: rejectVerdict}); err != nil {
 			return err
 		}
 	}
@@ -978,6 +1179,11 @@ func ConfigureRoutingForIsolation(ctx context.Context) error {
 	}
 
 	if IsSecondaryNetworkEnabled() {
+		// Policy routing only applies to IPv4 traffic, so IPv6 traffic would
+		// bypass the secondary network.
+		if IPv6Enabled() {
+			return status.FailedPreconditionError("executor.enable_ipv6 is not supported with executor.route_prefix")
+		}
 		// Adds a new routing table
 		if err := addRoutingTableEntryIfNotPresent(ctx); err != nil {
 			return err
@@ -987,6 +1193,11 @@ func ConfigureRoutingForIsolation(ctx context.Context) error {
 		if err := ConfigurePrivateRangeBlackholing(ctx, containerNetworkingCIDR); err != nil {
 			return err
 		}
+		if IPv6Enabled() {
+			if err := ConfigurePrivateRangeBlackholing(ctx, containerNetworkingIPv6CIDR); err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
@@ -1105,6 +1316,10 @@ func IsSecondaryNetworkEnabled() bool {
 	return *routePrefix != "default"
 }
 
+func IPv6Enabled() bool {
+	return *enableIPv6
+}
+
 func IsPrivateRangeBlackholingEnabled() bool {
 	return *blackholePrivateRanges
 }
@@ -14,6 +14,8 @@ import (
 
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testnetworking"
 	"github.com/buildbuddy-io/buildbuddy/server/util/networking"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/sync/errgroup"
@@ -55,6 +57,12 @@ func TestHostNetAllocator(t *testing.T) {
 	assert.Equal(t, "192.168.0.13", nets[1].HostIP())
 	assert.Equal(t, "192.168.0.14", nets[1].NamespacedIP())
 
+	assert.Equal(t, "fd8b:5ba1:7a36:0::1", nets[0].HostIPv6())
+	assert.Equal(t, "fd8b:5ba1:7a36:0::1/64", nets[0].HostIPv6WithCIDR())
+	assert.Equal(t, "fd8b:5ba1:7a36:0::2", nets[0].NamespacedIPv6())
+	assert.Equal(t, "fd8b:5ba1:7a36:0::2/64", nets[0].NamespacedIPv6WithCIDR())
+	assert.Equal(t, "fd8b:5ba1:7a36:3e7::2", nets[n-1].NamespacedIPv6())
+
 	assert.Equal(t, "192.168.33.69", nets[n-2].HostIP())
 	assert.Equal(t, "192.168.33.70", nets[n-2].NamespacedIP())
 
@@ -185,6 +193,76 @@ func TestContainerNetworking(t *testing.T) {
 	}
 }
 
+func TestContainerNetworking_IPv6(t *testing.T) {
+	testnetworking.SetupIPv6(t)
+	flags.Set(t, "executor.enable_ipv6", true)
+
+	ctx := context.Background()
+	err := networking.EnableMasquerading(ctx)
+	require.NoError(t, err)
+	pool := networking.NewContainerNetworkPool(-1 /*=default size limit*/)
+
+	c1 := createContainerNetwork(ctx, t)
+	c2 := createContainerNetwork(ctx, t)
+
+	// Containers should be able to reach the host end of their veth pair.
+	netnsExec(t, c1.NamespacePath(), `ping -6 -c 1 -W 1 `+c1.HostNetwork().HostIPv6())
+	netnsExec(t, c2.NamespacePath(), `ping -6 -c 1 -W 1 `+c2.HostNetwork().HostIPv6())
+
+	// Containers should not be able to reach each other.
+	netnsExec(t, c1.NamespacePath(), `if ping -6 -c 1 -W 1 `+c2.HostNetwork().NamespacedIPv6()+` ; then exit 1; fi`)
+	netnsExec(t, c2.NamespacePath(), `if ping -6 -c 1 -W 1 `+c1.HostNetwork().NamespacedIPv6()+` ; then exit 1; fi`)
+
+	// IPv6 addresses should be reassigned when a network is taken from the
+	// pool.
+	c3, err := networking.CreateContainerNetwork(ctx, networking.FullNetwork)
+	require.NoError(t, err)
+	ok := pool.Add(ctx, c3)
+	require.True(t, ok, "add to pool")
+	c3 = pool.Get(ctx)
+	require.NotNil(t, c3, "take from pool")
+	t.Cleanup(func() {
+		err := c3.Cleanup(context.Background())
+		require.NoError(t, err)
+	})
+	netnsExec(t, c3.NamespacePath(), `ping -6 -c 1 -W 1 `+c3.HostNetwork().HostIPv6())
+}
+
+func TestConfigureRoutingForIsolation_IPv6(t *testing.T) {
+	testnetworking.SetupIPv6(t)
+	flags.Set(t, "executor.enable_ipv6", true)
+	flags.Set(t, "executor.blackhole_private_ranges", true)
+
+	ctx := context.Background()
+	err := networking.ConfigureRoutingForIsolation(ctx)
+	require.NoError(t, err)
+
+	// Traffic from IPv6 container networks to private IPv6 ranges should be
+	// rejected, just like IPv4 traffic to private IPv4 ranges.
+	containerRange := "fd8b:5ba1:7a36::/48"
+	for _, r := range networking.PrivateIPv6Ranges {
+		rule := []string{"FORWARD", "-s", containerRange, "-d", r, "-j", "REJECT"}
+		b, err := exec.Command("ip6tables", append([]string{"--wait", "--check"}, rule...)...).CombinedOutput()
+		require.NoError(t, err, "ip6tables rule %s should exist: %s", rule, string(b))
+		t.Cleanup(func() {
+			b, err := exec.Command("ip6tables", append([]string{"--wait", "--delete"}, rule...)...).CombinedOutput()
+			require.NoError(t, err, "delete ip6tables rule: %s", string(b))
+		})
+	}
+	for _, r := range networking.PrivateIPRanges {
+		rule := []string{"FORWARD", "-s", "192.168.0.0/16", "-d", r, "-j", "REJECT"}
+		t.Cleanup(func() {
+			b, err := exec.Command("iptables", append([]string{"--wait", "--delete"}, rule...)...).CombinedOutput()
+			require.NoError(t, err, "delete iptables rule: %s", string(b))
+		})
+	}
+
+	// Secondary networks only route IPv4 traffic.
+	flags.Set(t, "executor.route_prefix", "172.24.0.0/18")
+	err = networking.ConfigureRoutingForIsolation(ctx)
+	require.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition error, got %v", err)
+}
+
 func TestContainerNetworkPool(t *testing.T) {
 	testnetworking.Setup(t)
 
@@ -215,7 +293,7 @@ func BenchmarkCreateContainerNetwork_Unpooled(b *testing.B) {
 
 	for i := 0; i < b.N; i++ {
 		eg.Go(func() error {
-			n, err := networking.CreateContainerNetwork(ctx, false /*=loopbackOnly*/)
+			n, err := networking.CreateContainerNetwork(ctx, networking.FullNetwork)
 			require.NoError(b, err)
 			err = n.Cleanup(ctx)
 			require.NoError(b, err)
@@ -239,7 +317,7 @@ func BenchmarkCreateContainerNetwork_Pooled(b *testing.B) {
 			n := pool.Get(ctx)
 			if n == nil {
 				var err error
-				n, err = networking.CreateContainerNetwork(ctx, false /*=loopbackOnly*/)
+				n, err = networking.CreateContainerNetwork(ctx, networking.FullNetwork)
 				require.NoError(b, err)
 			}
 			if !pool.Add(ctx, n) {
@@ -256,8 +334,91 @@ func BenchmarkCreateContainerNetwork_Pooled(b *testing.B) {
 	require.NoError(b, err)
 }
 
+func TestContainerNetworkPolicy(t *testing.T) {
+	testnetworking.Setup(t)
+
+	ctx := context.Background()
+	err := os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1\n"), 0)
+	require.NoError(t, err)
+	err = networking.EnableMasquerading(ctx)
+	require.NoError(t, err)
+
+	internal := createContainerNetworkWithPolicy(ctx, t, networking.InternalNetwork)
+	blocked, err := internal.BlockedPackets(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), blocked)
+
+	// Public addresses should be rejected, and counted.
+	netnsExec(t, internal.NamespacePath(), `if ping -c 1 -W 3 8.8.8.8 ; then exit 1; fi`)
+	blocked, err = internal.BlockedPackets(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), blocked)
+
+	// Link-local addresses, such as cloud metadata servers, are rejected
+	// unless they're allowed by flag.
+	netnsExec(t, internal.NamespacePath(), `if ping -c 1 -W 3 169.254.169.254 ; then exit 1; fi`)
+	blocked, err = internal.BlockedPackets(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), blocked)
+
+	flags.Set(t, "executor.internal_network_extra_ranges", []string{"169.254.0.0/16"})
+	linkLocal := createContainerNetworkWithPolicy(ctx, t, networking.InternalNetwork)
+	netnsExec(t, linkLocal.NamespacePath(), `ping -c 1 -W 1 169.254.169.254 || true`)
+	blocked, err = linkLocal.BlockedPackets(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), blocked)
+
+	// Networks without a policy never block packets.
+	full := createContainerNetworkWithPolicy(ctx, t, networking.FullNetwork)
+	netnsExec(t, full.NamespacePath(), `ping -c 1 -W 3 8.8.8.8`)
+	blocked, err = full.BlockedPackets(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), blocked)
+
+	// Networks with no network only have a loopback interface.
+	none := createContainerNetworkWithPolicy(ctx, t, networking.NoNetwork)
+	require.Nil(t, none.HostNetwork())
+	netnsExec(t, none.NamespacePath(), `ping -c 1 -W 1 127.0.0.1`)
+	netnsExec(t, none.NamespacePath(), `if ping -c 1 -W 1 8.8.8.8 ; then exit 1; fi`)
+}
+
+func TestContainerNetworking_Nftables(t *testing.T) {
+	testnetworking.SetupNftables(t)
+	flags.Set(t, "executor.firewall_backend", "nftables")
+
+	ctx := context.Background()
+	err := os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1\n"), 0)
+	require.NoError(t, err)
+	err = networking.EnableMasquerading(ctx)
+	require.NoError(t, err)
+	// Enabling masquerading again should not add duplicate rules.
+	err = networking.EnableMasquerading(ctx)
+	require.NoError(t, err)
+
+	c1 := createContainerNetwork(ctx, t)
+	c2 := createContainerNetwork(ctx, t)
+	netnsExec(t, c1.NamespacePath(), `ping -c 1 -W 3 8.8.8.8`)
+	netnsExec(t, c1.NamespacePath(), `if ping -c 1 -W 1 `+c2.HostNetwork().NamespacedIP()+` ; then exit 1; fi`)
+
+	internal := createContainerNetworkWithPolicy(ctx, t, networking.InternalNetwork)
+	netnsExec(t, internal.NamespacePath(), `if ping -c 1 -W 3 8.8.8.8 ; then exit 1; fi`)
+	blocked, err := internal.BlockedPackets(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), blocked)
+
+	// VM networks should also work with nftables.
+	vmNetwork, err := networking.CreateVMNetwork(ctx, tapDeviceName, tapAddr, vmIP)
+	require.NoError(t, err)
+	err = vmNetwork.Cleanup(ctx)
+	require.NoError(t, err)
+}
+
 func createContainerNetwork(ctx context.Context, t *testing.T) *networking.ContainerNetwork {
-	c, err := networking.CreateContainerNetwork(ctx, false /*=loopbackOnly*/)
+	return createContainerNetworkWithPolicy(ctx, t, networking.FullNetwork)
+}
+
+func createContainerNetworkWithPolicy(ctx context.Context, t *testing.T, policy networking.NetworkPolicy) *networking.ContainerNetwork {
+	c, err := networking.CreateContainerNetwork(ctx, policy)
 	require.NoError(t, err)
 	t.Cleanup(func() {
 		err := c.Cleanup(context.Background())
@@ -232,3 +232,22 @@ func ForAuthenticatedGroup(ctx context.Context, env environment.Env) (*UserGroup
 
 	return DefaultPermissions(u), nil
 }
+
+// AuthorizeInvocationDownload checks whether the authenticated user can
+// download the artifacts and logs of an invocation that they are allowed to
+// read. downloadPerms are the invocation's download permissions, which are
+// zero if downloads are not restricted.
+func AuthorizeInvocationDownload(ctx context.Context, env environment.Env, userID, groupID string, downloadPerms int32) error {
+	if downloadPerms == NONE {
+		return nil
+	}
+	u, err := env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return status.PermissionDeniedError("Downloads from this invocation are restricted by its organization.")
+	}
+	acl := ToACLProto(&uidpb.UserId{Id: userID}, groupID, downloadPerms)
+	if err := AuthorizeRead(u, acl); err != nil {
+		return status.PermissionDeniedError("Downloads from this invocation are restricted by its organization.")
+	}
+	return nil
+}
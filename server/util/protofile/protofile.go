@@ -94,6 +94,18 @@ func DeleteExistingChunks(ctx context.Context, bs interfaces.Blobstore, streamID
 	return nil
 }
 
+// ReadChunk reads the messages in a single chunk of a stream written by a
+// BufferedProtoWriter. Chunks are never modified once written, so this can be
+// used to follow a stream that is still being written: a NotFound error is
+// returned if the chunk hasn't been written yet.
+func ReadChunk(ctx context.Context, bs interfaces.Blobstore, streamID string, sequenceNumber int, allocator MessageAllocator) ([]proto.Message, error) {
+	data, err := bs.ReadBlob(ctx, ChunkName(streamID, sequenceNumber))
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalChunk(data, allocator)
+}
+
 func (w *BufferedProtoWriter) internalFlush(ctx context.Context) error {
 	if w.writeBuf.Len() == 0 {
 		return nil
@@ -205,7 +217,7 @@ func (f *fetcher) start(ctx context.Context) {
 					req.ResponseChan <- &fetchResponse{Error: err}
 					return
 				}
-				messages, err := f.unmarshalBlob(data)
+				messages, err := unmarshalChunk(data, f.allocator)
 				req.ResponseChan <- &fetchResponse{
 					Messages: messages,
 					Error:    err,
@@ -215,7 +227,7 @@ func (f *fetcher) start(ctx context.Context) {
 	}()
 }
 
-func (f *fetcher) unmarshalBlob(b []byte) ([]proto.Message, error) {
+func unmarshalChunk(b []byte, allocator MessageAllocator) ([]proto.Message, error) {
 	buf := bytes.NewBuffer(b)
 	var messages []proto.Message
 	for buf.Len() > 0 {
@@ -224,7 +236,7 @@ func (f *fetcher) unmarshalBlob(b []byte) ([]proto.Message, error) {
 			return nil, err
 		}
 		recordContent := buf.Next(int(recordLength))
-		msg := f.allocator()
+		msg := allocator()
 		if err := proto.Unmarshal(recordContent, msg); err != nil {
 			return nil, err
 		}
@@ -88,6 +88,16 @@ var (
 	// alphanum chars long), followed by an @ symbol.
 	apiKeyAtPattern = regexp.MustCompile("(^|[^[:alnum:]])[[:alnum:]]{20}@")
 
+	// Option names whose values are environment variable assignments like
+	// NAME=VALUE.
+	envOptionNames = []string{
+		envVarOptionName,
+		"action_env",
+		"host_action_env",
+		"test_env",
+		"repo_env",
+	}
+
 	// Option names which may contain gRPC headers that should be redacted.
 	headerOptionNames = []string{
 		"remote_header",
@@ -338,7 +348,7 @@ func splitCombinedForm(cf string) (string, string) {
 	return cf[:i], cf[i+1:]
 }
 
-func redactStructuredCommandLine(commandLine *clpb.CommandLine, allowedEnvVars []string) error {
+func redactStructuredCommandLine(commandLine *clpb.CommandLine, allowedEnvVars []string, rules *CustomRules) error {
 	command := ""
 	residualChunks := []*clpb.ChunkList{}
 
@@ -370,11 +380,10 @@ func redactStructuredCommandLine(commandLine *clpb.CommandLine, allowedEnvVars [
 				// Redact non-allowed env vars
 				if option.OptionName == envVarOptionName {
 					parts := strings.Split(option.OptionValue, envVarSeparator)
-					if len(parts) == 0 || isAllowedEnvVar(parts[0], allowedEnvVars) {
-						continue
+					if len(parts) > 0 && !isAllowedEnvVar(parts[0], allowedEnvVars) {
+						option.OptionValue = parts[0] + envVarSeparator + redactedPlaceholder
+						option.CombinedForm = envVarPrefix + envVarOptionName + envVarSeparator + parts[0] + envVarSeparator + redactedPlaceholder
 					}
-					option.OptionValue = parts[0] + envVarSeparator + redactedPlaceholder
-					option.CombinedForm = envVarPrefix + envVarOptionName + envVarSeparator + parts[0] + envVarSeparator + redactedPlaceholder
 				}
 
 				// Redact sensitive platform props
@@ -389,12 +398,14 @@ func redactStructuredCommandLine(commandLine *clpb.CommandLine, allowedEnvVars [
 
 				// Redact bazel sub command (for remote runners)
 				if option.OptionName == "bazel_sub_command" {
-					redactedCmd, err := RedactCommand(option.OptionValue)
+					redactedCmd, err := redactCommand(option.OptionValue, rules)
 					if err != nil {
 						return status.WrapError(err, "redact command")
 					}
 					option.OptionValue = redactedCmd
 				}
+
+				rules.redactOption(option)
 			}
 			continue
 		}
@@ -406,6 +417,9 @@ func redactStructuredCommandLine(commandLine *clpb.CommandLine, allowedEnvVars [
 
 			if section.SectionLabel == "residual" {
 				residualChunks = append(residualChunks, p.ChunkList)
+				for i, c := range p.ChunkList.Chunk {
+					p.ChunkList.Chunk[i] = rules.redactURLs(c)
+				}
 			}
 		}
 	}
@@ -488,11 +502,125 @@ func parseAllowedEnv(optionsDescription string) []string {
 	return []string{}
 }
 
+// CustomRules are redactions configured by an organization, which are applied
+// in addition to the standard redactions. A nil *CustomRules redacts nothing.
+type CustomRules struct {
+	// Environment variables whose names entirely match any of these patterns
+	// have their values redacted from options like --client_env and
+	// --action_env, even if they are allowed with ALLOW_ENV.
+	EnvVarNames []*regexp.Regexp
+
+	// Options whose names, without leading dashes, entirely match any of
+	// these patterns have their values redacted.
+	FlagNames []*regexp.Regexp
+
+	// Text matching any of these patterns is redacted wherever it appears in
+	// the command line, build metadata and workspace status.
+	URLs []*regexp.Regexp
+}
+
+func matchesAny(patterns []*regexp.Regexp, s string) bool {
+	for _, p := range patterns {
+		if p.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CustomRules) redactURLs(s string) string {
+	if c == nil {
+		return s
+	}
+	for _, p := range c.URLs {
+		s = p.ReplaceAllLiteralString(s, redactedPlaceholder)
+	}
+	return s
+}
+
+// redactFlag redacts a flag with the given name (without leading dashes) and
+// value, returning the redacted value.
+func (c *CustomRules) redactFlag(name, value string) string {
+	if c == nil {
+		return value
+	}
+	if matchesAny(c.FlagNames, name) {
+		return redactedPlaceholder
+	}
+	for _, envOptionName := range envOptionNames {
+		if name != envOptionName {
+			continue
+		}
+		envVarName, _, hasValue := strings.Cut(value, envVarSeparator)
+		if hasValue && matchesAny(c.EnvVarNames, envVarName) {
+			return envVarName + envVarSeparator + redactedPlaceholder
+		}
+	}
+	return c.redactURLs(value)
+}
+
+func (c *CustomRules) redactOption(option *clpb.Option) {
+	if c == nil {
+		return
+	}
+	redacted := c.redactFlag(option.OptionName, option.OptionValue)
+	if redacted != option.OptionValue {
+		option.OptionValue = redacted
+		option.CombinedForm = envVarPrefix + option.OptionName + envVarSeparator + redacted
+		return
+	}
+	option.CombinedForm = c.redactURLs(option.CombinedForm)
+}
+
+func (c *CustomRules) redactCmdLine(tokens []string) {
+	if c == nil {
+		return
+	}
+	for i, token := range tokens {
+		if !strings.HasPrefix(token, "--") {
+			tokens[i] = c.redactURLs(token)
+			continue
+		}
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(token, "--"), "=")
+		if !hasValue {
+			continue
+		}
+		tokens[i] = "--" + name + "=" + c.redactFlag(name, value)
+	}
+}
+
+func (c *CustomRules) redactBuildMetadata(metadata *bespb.BuildMetadata) {
+	if c == nil {
+		return
+	}
+	for k, v := range metadata.Metadata {
+		if k == explicitCommandLineName {
+			var commandLine []string
+			_ = json.Unmarshal([]byte(v), &commandLine)
+			c.redactCmdLine(commandLine)
+			commandLineJSON, _ := json.Marshal(commandLine)
+			metadata.Metadata[k] = string(commandLineJSON)
+			continue
+		}
+		metadata.Metadata[k] = c.redactURLs(v)
+	}
+}
+
+func (c *CustomRules) redactWorkspaceStatus(status *bespb.WorkspaceStatus) {
+	if c == nil {
+		return
+	}
+	for _, item := range status.Item {
+		item.Value = c.redactURLs(item.Value)
+	}
+}
+
 // StreamingRedactor processes a stream of build events and redacts them as they are
 // received by the event handler.
 type StreamingRedactor struct {
 	env            environment.Env
 	allowedEnvVars []string
+	rules          *CustomRules
 }
 
 func NewStreamingRedactor(env environment.Env) *StreamingRedactor {
@@ -502,6 +630,12 @@ func NewStreamingRedactor(env environment.Env) *StreamingRedactor {
 	}
 }
 
+// SetCustomRules sets the organization-defined redactions that are applied
+// to subsequent events.
+func (r *StreamingRedactor) SetCustomRules(rules *CustomRules) {
+	r.rules = rules
+}
+
 func (r *StreamingRedactor) RedactMetadata(event *bespb.BuildEvent) error {
 	switch p := event.Payload.(type) {
 	case *bespb.BuildEvent_Progress:
@@ -525,7 +659,7 @@ func (r *StreamingRedactor) RedactMetadata(event *bespb.BuildEvent) error {
 		}
 	case *bespb.BuildEvent_StructuredCommandLine:
 		{
-			if err := redactStructuredCommandLine(p.StructuredCommandLine, r.allowedEnvVars); err != nil {
+			if err := redactStructuredCommandLine(p.StructuredCommandLine, r.allowedEnvVars, r.rules); err != nil {
 				return err
 			}
 		}
@@ -533,10 +667,13 @@ func (r *StreamingRedactor) RedactMetadata(event *bespb.BuildEvent) error {
 		{
 			redactCmdLine(p.OptionsParsed.CmdLine)
 			redactCmdLine(p.OptionsParsed.ExplicitCmdLine)
+			r.rules.redactCmdLine(p.OptionsParsed.CmdLine)
+			r.rules.redactCmdLine(p.OptionsParsed.ExplicitCmdLine)
 		}
 	case *bespb.BuildEvent_WorkspaceStatus:
 		{
 			stripRepoURLCredentialsFromWorkspaceStatus(p.WorkspaceStatus)
+			r.rules.redactWorkspaceStatus(p.WorkspaceStatus)
 		}
 	case *bespb.BuildEvent_Fetch:
 		{
@@ -590,6 +727,7 @@ func (r *StreamingRedactor) RedactMetadata(event *bespb.BuildEvent) error {
 	case *bespb.BuildEvent_BuildMetadata:
 		{
 			stripRepoURLCredentialsFromBuildMetadata(p.BuildMetadata)
+			r.rules.redactBuildMetadata(p.BuildMetadata)
 		}
 	case *bespb.BuildEvent_ConvenienceSymlinksIdentified:
 		{
@@ -597,7 +735,7 @@ func (r *StreamingRedactor) RedactMetadata(event *bespb.BuildEvent) error {
 	case *bespb.BuildEvent_WorkflowConfigured:
 		{
 			for _, m := range p.WorkflowConfigured.Invocation {
-				redactedCmd, err := RedactCommand(m.BazelCommand)
+				redactedCmd, err := redactCommand(m.BazelCommand, r.rules)
 				if err != nil {
 					return status.WrapError(err, "redact command")
 				}
@@ -607,7 +745,7 @@ func (r *StreamingRedactor) RedactMetadata(event *bespb.BuildEvent) error {
 	case *bespb.BuildEvent_ChildInvocationsConfigured:
 		{
 			for _, m := range p.ChildInvocationsConfigured.Invocation {
-				redactedCmd, err := RedactCommand(m.BazelCommand)
+				redactedCmd, err := redactCommand(m.BazelCommand, r.rules)
 				if err != nil {
 					return status.WrapError(err, "redact command")
 				}
@@ -622,11 +760,16 @@ func (r *StreamingRedactor) RedactMetadata(event *bespb.BuildEvent) error {
 // unterminated quote, it will return an error). Use `RedactText` to redact
 // more arbitary strings.
 func RedactCommand(cmd string) (string, error) {
+	return redactCommand(cmd, nil)
+}
+
+func redactCommand(cmd string, rules *CustomRules) (string, error) {
 	cmdTokens, err := shlex.Split(cmd)
 	if err != nil {
 		return "", status.WrapError(err, "split command")
 	}
 	redactCmdLine(cmdTokens)
+	rules.redactCmdLine(cmdTokens)
 	return strings.Join(cmdTokens, " "), nil
 }
 
@@ -3,6 +3,7 @@ package redact_test
 import (
 	"context"
 	"fmt"
+	"regexp"
 	"testing"
 
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
@@ -221,6 +222,88 @@ func TestRedactMetadata_OptionsParsed_StripsURLSecretsAndRemoteHeaders(t *testin
 		optionsParsed.ExplicitCmdLine)
 }
 
+func TestRedactMetadata_CustomRules(t *testing.T) {
+	redactor := redact.NewStreamingRedactor(testenv.GetTestEnv(t))
+	redactor.SetCustomRules(&redact.CustomRules{
+		EnvVarNames: []*regexp.Regexp{regexp.MustCompile(`^(?:AWS_.*)$`)},
+		FlagNames:   []*regexp.Regexp{regexp.MustCompile(`^(?:deploy_token)$`)},
+		URLs:        []*regexp.Regexp{regexp.MustCompile(`https://artifacts\.internal\S*`)},
+	})
+	err := redactor.RedactMetadata(&bespb.BuildEvent{
+		Payload: &bespb.BuildEvent_Started{Started: &bespb.BuildStarted{
+			OptionsDescription: "--build_metadata='ALLOW_ENV=*'",
+		}},
+	})
+	require.NoError(t, err)
+
+	for _, testCase := range []struct {
+		optionName    string
+		inputValue    string
+		expectedValue string
+	}{
+		// Custom rules apply even to allowed env vars.
+		{"client_env", "AWS_SECRET_ACCESS_KEY=secret", "AWS_SECRET_ACCESS_KEY=<REDACTED>"},
+		{"action_env", "AWS_SESSION_TOKEN=secret", "AWS_SESSION_TOKEN=<REDACTED>"},
+		{"action_env", "AWS_PROFILE", "AWS_PROFILE"},
+		{"client_env", "MY_AWS_REGION=us-west1", "MY_AWS_REGION=us-west1"},
+		{"deploy_token", "secret", "<REDACTED>"},
+		{"deploy_token_file", "/tmp/token", "/tmp/token"},
+		{"remote_instance_name", "https://artifacts.internal/x?key=secret", "<REDACTED>"},
+	} {
+		option := &clpb.Option{
+			OptionName:   testCase.optionName,
+			OptionValue:  testCase.inputValue,
+			CombinedForm: fmt.Sprintf("--%s=%s", testCase.optionName, testCase.inputValue),
+		}
+
+		err := redactor.RedactMetadata(structuredCommandLineEvent(option))
+		require.NoError(t, err)
+
+		expectedCombinedForm := fmt.Sprintf("--%s=%s", testCase.optionName, testCase.expectedValue)
+		assert.Equal(t, expectedCombinedForm, option.CombinedForm)
+		assert.Equal(t, testCase.expectedValue, option.OptionValue)
+	}
+
+	optionsParsed := &bespb.OptionsParsed{
+		CmdLine: []string{
+			"--deploy_token=secret",
+			"--test_env=AWS_SECRET_ACCESS_KEY=secret",
+			"--test_env=HOME=/home/user",
+			"--flag",
+			"//pkg:https://artifacts.internal/x",
+		},
+	}
+	err = redactor.RedactMetadata(&bespb.BuildEvent{
+		Payload: &bespb.BuildEvent_OptionsParsed{OptionsParsed: optionsParsed},
+	})
+	require.NoError(t, err)
+	assert.Equal(
+		t,
+		[]string{
+			"--deploy_token=<REDACTED>",
+			"--test_env=AWS_SECRET_ACCESS_KEY=<REDACTED>",
+			"--test_env=HOME=/home/user",
+			"--flag",
+			"//pkg:<REDACTED>",
+		},
+		optionsParsed.CmdLine)
+
+	buildMetadata := &bespb.BuildMetadata{
+		Metadata: map[string]string{
+			"DOWNLOAD_URL":          "https://artifacts.internal/x?key=secret",
+			"EXPLICIT_COMMAND_LINE": `["--deploy_token=secret"]`,
+		},
+	}
+	err = redactor.RedactMetadata(&bespb.BuildEvent{
+		Payload: &bespb.BuildEvent_BuildMetadata{BuildMetadata: buildMetadata},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"DOWNLOAD_URL":          "<REDACTED>",
+		"EXPLICIT_COMMAND_LINE": `["--deploy_token=\u003cREDACTED\u003e"]`,
+	}, buildMetadata.Metadata)
+}
+
 func TestRedactMetadata_ActionExecuted_StripsURLSecrets(t *testing.T) {
 	redactor := redact.NewStreamingRedactor(testenv.GetTestEnv(t))
 	actionExecuted := &bespb.ActionExecuted{
@@ -0,0 +1,168 @@
+// Package scopes restricts the RPCs that can be called with an API key.
+//
+// Scopes are independent of capabilities: capabilities control what a key is
+// allowed to do with the resources it accesses (e.g. whether it can write to
+// the action cache) while scopes control which services it can talk to in
+// the first place. A key with no scopes is unrestricted.
+package scopes
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
+)
+
+const (
+	casPrefix         = "/build.bazel.remote.execution.v2.ContentAddressableStorage/"
+	acPrefix          = "/build.bazel.remote.execution.v2.ActionCache/"
+	byteStreamPrefix  = "/google.bytestream.ByteStream/"
+	fetchPrefix       = "/build.bazel.remote.asset.v1.Fetch/"
+	pushPrefix        = "/build.bazel.remote.asset.v1.Push/"
+	executionPrefix   = "/build.bazel.remote.execution.v2.Execution/"
+	besPrefix         = "/google.devtools.build.v1.PublishBuildEvent/"
+	apiServicePrefix  = "/api.v1.ApiService/"
+	capabilitiesRPC   = "/build.bazel.remote.execution.v2.Capabilities/GetCapabilities"
+	apiHTTPPathPrefix = "/api/v1/"
+)
+
+var (
+	// unscopedRPCs can be called with any scoped key, since clients call them
+	// before doing anything else.
+	unscopedRPCs = []string{
+		capabilitiesRPC,
+	}
+
+	cacheReadRPCs = []string{
+		casPrefix + "FindMissingBlobs",
+		casPrefix + "BatchReadBlobs",
+		casPrefix + "GetTree",
+		acPrefix + "GetActionResult",
+		byteStreamPrefix + "Read",
+	}
+
+	cacheWriteRPCs = []string{
+		// Uploads are preceded by a FindMissingBlobs call, so it doesn't
+		// make sense to allow writes without it.
+		casPrefix + "FindMissingBlobs",
+		casPrefix + "BatchUpdateBlobs",
+		casPrefix + "SpliceBlob",
+		acPrefix + "UpdateActionResult",
+		byteStreamPrefix + "Write",
+		byteStreamPrefix + "QueryWriteStatus",
+		pushPrefix + "PushBlob",
+		pushPrefix + "PushDirectory",
+		// Fetches write the fetched contents into the CAS.
+		fetchPrefix + "FetchBlob",
+		fetchPrefix + "FetchDirectory",
+	}
+
+	// apiReadRPCs are the read-only methods of the BuildBuddy API. The
+	// HTTP-only endpoints are listed by their path relative to /api/v1/.
+	apiReadRPCs = []string{
+		apiServicePrefix + "GetInvocation",
+		apiServicePrefix + "CompareInvocations",
+		apiServicePrefix + "GetTimingTrend",
+		apiServicePrefix + "GetLog",
+		apiServicePrefix + "SearchLogs",
+		apiServicePrefix + "GetTarget",
+		apiServicePrefix + "GetTargetFlakeStats",
+		apiServicePrefix + "GetAction",
+		apiServicePrefix + "GetFile",
+		apiServicePrefix + "GetArtifactManifest",
+		apiServicePrefix + "DownloadArtifacts",
+		apiServicePrefix + "StreamInvocation",
+		apiServicePrefix + "metrics",
+	}
+)
+
+func FromInt(m int32) []akpb.ApiKey_Scope {
+	scopes := []akpb.ApiKey_Scope{}
+	for _, s := range akpb.ApiKey_Scope_value {
+		if m&s > 0 {
+			scopes = append(scopes, akpb.ApiKey_Scope(s))
+		}
+	}
+	slices.Sort(scopes)
+	return scopes
+}
+
+func ToInt(scopes []akpb.ApiKey_Scope) int32 {
+	m := int32(0)
+	for _, s := range scopes {
+		m |= int32(s)
+	}
+	return m
+}
+
+// Allows returns whether a key with the given scopes may call the RPC with
+// the given full method name (e.g. "/google.bytestream.ByteStream/Read").
+func Allows(scopes []akpb.ApiKey_Scope, fullMethod string) bool {
+	if len(scopes) == 0 {
+		return true
+	}
+	if slices.Contains(unscopedRPCs, fullMethod) {
+		return true
+	}
+	for _, s := range scopes {
+		if scopeAllows(s, fullMethod) {
+			return true
+		}
+	}
+	return false
+}
+
+func scopeAllows(scope akpb.ApiKey_Scope, fullMethod string) bool {
+	switch scope {
+	case akpb.ApiKey_CACHE_READ_SCOPE:
+		return slices.Contains(cacheReadRPCs, fullMethod)
+	case akpb.ApiKey_CACHE_WRITE_SCOPE:
+		return slices.Contains(cacheWriteRPCs, fullMethod)
+	case akpb.ApiKey_BES_WRITE_SCOPE:
+		return strings.HasPrefix(fullMethod, besPrefix)
+	case akpb.ApiKey_EXECUTION_SCOPE:
+		// Executing an action involves uploading its inputs and reading its
+		// outputs, and executors access the cache with the credentials of
+		// the action, so the cache RPCs are part of this scope too.
+		return strings.HasPrefix(fullMethod, executionPrefix) ||
+			slices.Contains(cacheReadRPCs, fullMethod) ||
+			slices.Contains(cacheWriteRPCs, fullMethod)
+	case akpb.ApiKey_API_READ_SCOPE:
+		return slices.Contains(apiReadRPCs, fullMethod)
+	default:
+		return false
+	}
+}
+
+// AuthorizeRPC returns a PermissionDenied error if the request is
+// authenticated with a scoped key that doesn't allow calling the RPC with the
+// given full method name. Unauthenticated requests are left to the other auth
+// checks.
+func AuthorizeRPC(ctx context.Context, env environment.Env, fullMethod string) error {
+	a := env.GetAuthenticator()
+	if a == nil {
+		return nil
+	}
+	u, err := a.AuthenticatedUser(ctx)
+	if err != nil {
+		return nil
+	}
+	if !Allows(u.GetScopes(), fullMethod) {
+		return status.PermissionDeniedErrorf("the API key used for this request is not allowed to call %s", fullMethod)
+	}
+	return nil
+}
+
+// AuthorizeHTTPRequest is like AuthorizeRPC, for requests to HTTP endpoints.
+// Only the BuildBuddy API can be accessed with scoped keys over HTTP.
+func AuthorizeHTTPRequest(ctx context.Context, env environment.Env, path string) error {
+	method := path
+	if strings.HasPrefix(path, apiHTTPPathPrefix) {
+		method = apiServicePrefix + strings.TrimPrefix(path, apiHTTPPathPrefix)
+	}
+	return AuthorizeRPC(ctx, env, method)
+}
@@ -0,0 +1,174 @@
+package scopes_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/scopes"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
+)
+
+func TestToIntFromInt(t *testing.T) {
+	assert.Equal(t, int32(0), scopes.ToInt(nil))
+	assert.Equal(t, []akpb.ApiKey_Scope{}, scopes.FromInt(0))
+
+	s := []akpb.ApiKey_Scope{akpb.ApiKey_CACHE_READ_SCOPE, akpb.ApiKey_BES_WRITE_SCOPE}
+	assert.Equal(t, int32(5), scopes.ToInt(s))
+	assert.Equal(t, s, scopes.FromInt(scopes.ToInt(s)))
+}
+
+func TestAllows(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		scopes     []akpb.ApiKey_Scope
+		fullMethod string
+		want       bool
+	}{
+		{
+			name:       "unscoped key can call anything",
+			fullMethod: "/buildbuddy.service.BuildBuddyService/GetApiKeys",
+			want:       true,
+		},
+		{
+			name:       "capabilities are always allowed",
+			scopes:     []akpb.ApiKey_Scope{akpb.ApiKey_BES_WRITE_SCOPE},
+			fullMethod: "/build.bazel.remote.execution.v2.Capabilities/GetCapabilities",
+			want:       true,
+		},
+		{
+			name:       "cache read allows reads",
+			scopes:     []akpb.ApiKey_Scope{akpb.ApiKey_CACHE_READ_SCOPE},
+			fullMethod: "/build.bazel.remote.execution.v2.ActionCache/GetActionResult",
+			want:       true,
+		},
+		{
+			name:       "cache read doesn't allow writes",
+			scopes:     []akpb.ApiKey_Scope{akpb.ApiKey_CACHE_READ_SCOPE},
+			fullMethod: "/google.bytestream.ByteStream/Write",
+			want:       false,
+		},
+		{
+			name:       "cache read doesn't allow fetching into the CAS",
+			scopes:     []akpb.ApiKey_Scope{akpb.ApiKey_CACHE_READ_SCOPE},
+			fullMethod: "/build.bazel.remote.asset.v1.Fetch/FetchBlob",
+			want:       false,
+		},
+		{
+			name:       "cache write allows fetching into the CAS",
+			scopes:     []akpb.ApiKey_Scope{akpb.ApiKey_CACHE_WRITE_SCOPE},
+			fullMethod: "/build.bazel.remote.asset.v1.Fetch/FetchDirectory",
+			want:       true,
+		},
+		{
+			name:       "cache write allows writes",
+			scopes:     []akpb.ApiKey_Scope{akpb.ApiKey_CACHE_WRITE_SCOPE},
+			fullMethod: "/google.bytestream.ByteStream/Write",
+			want:       true,
+		},
+		{
+			name:       "cache write allows splicing blobs",
+			scopes:     []akpb.ApiKey_Scope{akpb.ApiKey_CACHE_WRITE_SCOPE},
+			fullMethod: "/build.bazel.remote.execution.v2.ContentAddressableStorage/SpliceBlob",
+			want:       true,
+		},
+		{
+			name:       "cache read doesn't allow splicing blobs",
+			scopes:     []akpb.ApiKey_Scope{akpb.ApiKey_CACHE_READ_SCOPE},
+			fullMethod: "/build.bazel.remote.execution.v2.ContentAddressableStorage/SpliceBlob",
+			want:       false,
+		},
+		{
+			name:       "cache write doesn't allow reads",
+			scopes:     []akpb.ApiKey_Scope{akpb.ApiKey_CACHE_WRITE_SCOPE},
+			fullMethod: "/google.bytestream.ByteStream/Read",
+			want:       false,
+		},
+		{
+			name:       "BES write allows publishing build events",
+			scopes:     []akpb.ApiKey_Scope{akpb.ApiKey_BES_WRITE_SCOPE},
+			fullMethod: "/google.devtools.build.v1.PublishBuildEvent/PublishBuildToolEventStream",
+			want:       true,
+		},
+		{
+			name:       "BES write doesn't allow cache access",
+			scopes:     []akpb.ApiKey_Scope{akpb.ApiKey_BES_WRITE_SCOPE},
+			fullMethod: "/build.bazel.remote.execution.v2.ContentAddressableStorage/FindMissingBlobs",
+			want:       false,
+		},
+		{
+			name:       "execution allows executing and cache access",
+			scopes:     []akpb.ApiKey_Scope{akpb.ApiKey_EXECUTION_SCOPE},
+			fullMethod: "/build.bazel.remote.execution.v2.ContentAddressableStorage/BatchUpdateBlobs",
+			want:       true,
+		},
+		{
+			name:       "cache write doesn't allow executing",
+			scopes:     []akpb.ApiKey_Scope{akpb.ApiKey_CACHE_READ_SCOPE, akpb.ApiKey_CACHE_WRITE_SCOPE},
+			fullMethod: "/build.bazel.remote.execution.v2.Execution/Execute",
+			want:       false,
+		},
+		{
+			name:       "API read allows reading invocations",
+			scopes:     []akpb.ApiKey_Scope{akpb.ApiKey_API_READ_SCOPE},
+			fullMethod: "/api.v1.ApiService/GetInvocation",
+			want:       true,
+		},
+		{
+			name:       "API read doesn't allow deleting files",
+			scopes:     []akpb.ApiKey_Scope{akpb.ApiKey_API_READ_SCOPE},
+			fullMethod: "/api.v1.ApiService/DeleteFile",
+			want:       false,
+		},
+		{
+			name:       "scoped keys can't call the BuildBuddy service",
+			scopes:     []akpb.ApiKey_Scope{akpb.ApiKey_CACHE_READ_SCOPE, akpb.ApiKey_CACHE_WRITE_SCOPE, akpb.ApiKey_BES_WRITE_SCOPE, akpb.ApiKey_EXECUTION_SCOPE, akpb.ApiKey_API_READ_SCOPE},
+			fullMethod: "/buildbuddy.service.BuildBuddyService/CreateApiKey",
+			want:       false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, scopes.Allows(tc.scopes, tc.fullMethod))
+		})
+	}
+}
+
+func TestAuthorizeRPC(t *testing.T) {
+	users := testauth.TestUsers("US1", "GR1")
+	scoped := testauth.User("US2", "GR1")
+	scoped.Scopes = []akpb.ApiKey_Scope{akpb.ApiKey_CACHE_READ_SCOPE}
+	users["US2"] = scoped
+	te := testenv.GetTestEnv(t)
+	ta := testauth.NewTestAuthenticator(users)
+	te.SetAuthenticator(ta)
+
+	ctx := context.Background()
+	unscopedCtx, err := ta.WithAuthenticatedUser(ctx, "US1")
+	require.NoError(t, err)
+	scopedCtx, err := ta.WithAuthenticatedUser(ctx, "US2")
+	require.NoError(t, err)
+
+	// Unauthenticated requests are left to the other auth checks.
+	err = scopes.AuthorizeRPC(ctx, te, "/google.bytestream.ByteStream/Write")
+	require.NoError(t, err)
+
+	err = scopes.AuthorizeRPC(unscopedCtx, te, "/google.bytestream.ByteStream/Write")
+	require.NoError(t, err)
+
+	err = scopes.AuthorizeRPC(scopedCtx, te, "/google.bytestream.ByteStream/Read")
+	require.NoError(t, err)
+
+	err = scopes.AuthorizeRPC(scopedCtx, te, "/google.bytestream.ByteStream/Write")
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+
+	err = scopes.AuthorizeRPC(scopedCtx, te, "/build.bazel.remote.asset.v1.Fetch/FetchBlob")
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+
+	err = scopes.AuthorizeHTTPRequest(scopedCtx, te, "/api/v1/GetInvocation")
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+}
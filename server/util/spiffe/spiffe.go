@@ -0,0 +1,91 @@
+// Package spiffe contains helpers for working with SPIFFE IDs, which are
+// URIs of the form spiffe://<trust domain>/<path> that identify workloads in
+// X.509 SVIDs (certificates with the ID as their only URI SAN).
+//
+// See https://github.com/spiffe/spiffe/blob/main/standards/SPIFFE-ID.md
+package spiffe
+
+import (
+	"context"
+	"crypto/x509"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+const scheme = "spiffe"
+
+// ParseID parses and validates a SPIFFE ID.
+func ParseID(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("invalid SPIFFE ID %q: %s", s, err)
+	}
+	if u.Scheme != scheme {
+		return nil, status.InvalidArgumentErrorf("invalid SPIFFE ID %q: scheme must be %q", s, scheme)
+	}
+	if u.Host == "" {
+		return nil, status.InvalidArgumentErrorf("invalid SPIFFE ID %q: missing trust domain", s)
+	}
+	if u.User != nil || u.Port() != "" || u.RawQuery != "" || u.Fragment != "" || u.Opaque != "" {
+		return nil, status.InvalidArgumentErrorf("invalid SPIFFE ID %q: must not contain a user, port, query or fragment", s)
+	}
+	if strings.HasSuffix(u.Path, "/") {
+		return nil, status.InvalidArgumentErrorf("invalid SPIFFE ID %q: path must not have a trailing slash", s)
+	}
+	return u, nil
+}
+
+// NewID returns the SPIFFE ID with the given trust domain and path segments.
+func NewID(trustDomain string, segments ...string) (string, error) {
+	u := &url.URL{Scheme: scheme, Host: trustDomain, Path: "/" + path.Join(segments...)}
+	if len(segments) == 0 {
+		u.Path = ""
+	}
+	if _, err := ParseID(u.String()); err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// IDFromCertificate returns the SPIFFE ID of an X.509 SVID.
+func IDFromCertificate(cert *x509.Certificate) (string, error) {
+	if len(cert.URIs) != 1 {
+		return "", status.InvalidArgumentErrorf("certificate must contain exactly one URI SAN, found %d", len(cert.URIs))
+	}
+	id := cert.URIs[0].String()
+	if _, err := ParseID(id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// PeerID returns the SPIFFE ID of the client certificate that the gRPC peer
+// in the context presented and that was verified in the TLS handshake.
+func PeerID(ctx context.Context) (string, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	id, err := IDFromCertificate(tlsInfo.State.VerifiedChains[0][0])
+	if err != nil {
+		return "", false
+	}
+	return id, true
+}
+
+// MatchID reports whether the SPIFFE ID matches the pattern. Patterns use the
+// syntax of path.Match, so "spiffe://example.com/executor/*" matches the IDs
+// of all executors in the example.com trust domain.
+func MatchID(pattern, id string) bool {
+	ok, err := path.Match(pattern, id)
+	return err == nil && ok
+}
@@ -0,0 +1,64 @@
+package spiffe_test
+
+import (
+	"crypto/x509"
+	"net/url"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/spiffe"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseID(t *testing.T) {
+	for _, tc := range []struct {
+		id    string
+		valid bool
+	}{
+		{"spiffe://example.com", true},
+		{"spiffe://example.com/executor/abc", true},
+		{"https://example.com/executor/abc", false},
+		{"spiffe:///executor/abc", false},
+		{"spiffe://example.com:443/executor", false},
+		{"spiffe://user@example.com/executor", false},
+		{"spiffe://example.com/executor?a=b", false},
+		{"spiffe://example.com/executor#a", false},
+		{"spiffe://example.com/executor/", false},
+	} {
+		t.Run(tc.id, func(t *testing.T) {
+			_, err := spiffe.ParseID(tc.id)
+			assert.Equal(t, tc.valid, err == nil, "error: %v", err)
+		})
+	}
+}
+
+func TestNewID(t *testing.T) {
+	id, err := spiffe.NewID("example.com", "group", "GR1", "executor", "e1")
+	require.NoError(t, err)
+	assert.Equal(t, "spiffe://example.com/group/GR1/executor/e1", id)
+
+	_, err = spiffe.NewID("")
+	require.Error(t, err)
+}
+
+func TestIDFromCertificate(t *testing.T) {
+	u, err := url.Parse("spiffe://example.com/executor/e1")
+	require.NoError(t, err)
+
+	id, err := spiffe.IDFromCertificate(&x509.Certificate{URIs: []*url.URL{u}})
+	require.NoError(t, err)
+	assert.Equal(t, "spiffe://example.com/executor/e1", id)
+
+	_, err = spiffe.IDFromCertificate(&x509.Certificate{})
+	require.Error(t, err)
+	_, err = spiffe.IDFromCertificate(&x509.Certificate{URIs: []*url.URL{u, u}})
+	require.Error(t, err)
+}
+
+func TestMatchID(t *testing.T) {
+	assert.True(t, spiffe.MatchID("spiffe://example.com/executor/*", "spiffe://example.com/executor/e1"))
+	assert.True(t, spiffe.MatchID("spiffe://example.com/executor/e1", "spiffe://example.com/executor/e1"))
+	assert.False(t, spiffe.MatchID("spiffe://example.com/executor/*", "spiffe://example.com/executor/e1/x"))
+	assert.False(t, spiffe.MatchID("spiffe://example.com/executor/*", "spiffe://other.com/executor/e1"))
+	assert.False(t, spiffe.MatchID("spiffe://example.com/[", "spiffe://example.com/["))
+}
@@ -0,0 +1,92 @@
+// Package ssrf protects requests to URLs that users configure, such as
+// webhooks, from reaching services on the internal network of the server
+// (server-side request forgery).
+package ssrf
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+var (
+	allowedCIDRs = flag.Slice("app.allowed_private_destination_cidrs", []string{}, "Private, loopback and link-local address ranges that the app may connect to when making requests to URLs configured by users, such as completion webhooks and the OIDC providers of organizations. Connections to other such addresses are refused.")
+
+	// Shared address space for carrier-grade NAT, which some clouds use for
+	// internal services.
+	sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+	// Addresses in "this network", which connect to the local host on Linux.
+	thisNetwork = netip.MustParsePrefix("0.0.0.0/8")
+)
+
+func isInternal(ip netip.Addr) bool {
+	return ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() ||
+		ip.IsUnspecified() ||
+		sharedAddressSpace.Contains(ip) ||
+		thisNetwork.Contains(ip)
+}
+
+// CheckIP returns an error if connecting to the given IP in order to request
+// a user-supplied URL is not allowed.
+func CheckIP(ip netip.Addr) error {
+	ip = ip.Unmap()
+	if !isInternal(ip) {
+		return nil
+	}
+	for _, c := range *allowedCIDRs {
+		prefix, err := netip.ParsePrefix(c)
+		if err != nil {
+			return status.InvalidArgumentErrorf("invalid app.allowed_private_destination_cidrs entry %q: %s", c, err)
+		}
+		if prefix.Contains(ip) {
+			return nil
+		}
+	}
+	return status.PermissionDeniedErrorf("connecting to internal address %s is not allowed", ip)
+}
+
+// Control can be used as the Control function of a net.Dialer to refuse
+// connecting to internal addresses. Since it checks the address that is
+// connected to after resolving the host name, it also protects against DNS
+// rebinding.
+func Control(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return status.InternalErrorf("could not parse dialed address %q: %s", address, err)
+	}
+	return CheckIP(addrPort.Addr())
+}
+
+// NewClient returns an HTTP client that refuses to connect to internal
+// addresses, for requesting user-supplied URLs.
+//
+// The client doesn't use the proxy configured by the environment, since the
+// proxy would connect to the internal addresses on behalf of the client.
+func NewClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   Control,
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+	}
+}
@@ -0,0 +1,70 @@
+package ssrf_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/ssrf"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckIP(t *testing.T) {
+	for _, ip := range []string{
+		"8.8.8.8",
+		"2001:4860:4860::8888",
+		"100.128.0.1",
+	} {
+		require.NoError(t, ssrf.CheckIP(netip.MustParseAddr(ip)), ip)
+	}
+	for _, ip := range []string{
+		"127.0.0.1",
+		"::1",
+		"10.1.2.3",
+		"172.16.0.1",
+		"192.168.1.1",
+		"169.254.169.254",
+		"fe80::1",
+		"fc00::1",
+		"100.64.0.1",
+		"0.0.0.0",
+		"0.1.2.3",
+		"::",
+		"::ffff:127.0.0.1",
+		"::ffff:169.254.169.254",
+		"224.0.0.1",
+	} {
+		err := ssrf.CheckIP(netip.MustParseAddr(ip))
+		require.True(t, status.IsPermissionDeniedError(err), "%s: expected PermissionDenied, got %v", ip, err)
+	}
+}
+
+func TestCheckIP_AllowedCIDRs(t *testing.T) {
+	flags.Set(t, "app.allowed_private_destination_cidrs", []string{"10.0.0.0/8"})
+	require.NoError(t, ssrf.CheckIP(netip.MustParseAddr("10.1.2.3")))
+	err := ssrf.CheckIP(netip.MustParseAddr("192.168.1.1"))
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+
+	flags.Set(t, "app.allowed_private_destination_cidrs", []string{"not-a-cidr"})
+	err = ssrf.CheckIP(netip.MustParseAddr("10.1.2.3"))
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+}
+
+func TestNewClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(server.Close)
+	client := ssrf.NewClient(5 * time.Second)
+
+	_, err := client.Get(server.URL)
+	require.Error(t, err)
+
+	flags.Set(t, "app.allowed_private_destination_cidrs", []string{"127.0.0.0/8"})
+	res, err := client.Get(server.URL)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+}